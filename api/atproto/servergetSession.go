@@ -12,9 +12,10 @@ import (
 
 // ServerGetSession_Output is the output of a com.atproto.server.getSession call.
 type ServerGetSession_Output struct {
-	Did    string  `json:"did" cborgen:"did"`
-	Email  *string `json:"email,omitempty" cborgen:"email,omitempty"`
-	Handle string  `json:"handle" cborgen:"handle"`
+	Did             string  `json:"did" cborgen:"did"`
+	Email           *string `json:"email,omitempty" cborgen:"email,omitempty"`
+	EmailAuthFactor *bool   `json:"emailAuthFactor,omitempty" cborgen:"emailAuthFactor,omitempty"`
+	Handle          string  `json:"handle" cborgen:"handle"`
 }
 
 // ServerGetSession calls the XRPC method "com.atproto.server.getSession".
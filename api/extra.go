@@ -9,7 +9,6 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/bluesky-social/indigo/did"
@@ -75,10 +74,32 @@ type HandleResolver interface {
 	ResolveHandleToDid(ctx context.Context, handle string) (string, error)
 }
 
+// ErrHandleNotFound is wrapped by the errors of handle resolvers when a handle
+// definitely does not resolve to a DID, rather than it not being possible to
+// tell, as when its DNS servers or web host can't be reached
+var ErrHandleNotFound = errors.New("handle not found")
+
+// ProdHandleResolver resolves handles with a DNS TXT record on
+// _atproto.<handle>, falling back to https://<handle>/.well-known/atproto-did.
+// Both are tried at once, but DNS takes precedence: the well-known result is
+// only used when DNS has no valid record, even if it answers first.
 type ProdHandleResolver struct {
 	ReqMod func(*http.Request, string) error
+
+	// DNS does the TXT lookups, defaulting to the system resolver
+	DNS TXTResolver
+
+	// DNSTimeout and WellKnownTimeout bound each method, and default to
+	// DefaultDNSTimeout and DefaultWellKnownTimeout
+	DNSTimeout       time.Duration
+	WellKnownTimeout time.Duration
 }
 
+const (
+	DefaultDNSTimeout       = 5 * time.Second
+	DefaultWellKnownTimeout = 10 * time.Second
+)
+
 func (dr *ProdHandleResolver) ResolveHandleToDid(ctx context.Context, handle string) (string, error) {
 	ctx, cancel := context.WithTimeout(ctx, time.Second*20)
 	defer cancel()
@@ -86,41 +107,42 @@ func (dr *ProdHandleResolver) ResolveHandleToDid(ctx context.Context, handle str
 	ctx, span := otel.Tracer("resolver").Start(ctx, "ResolveHandleToDid")
 	defer span.End()
 
-	var wkres, dnsres string
-	var wkerr, dnserr error
-
-	var wg sync.WaitGroup
-	wg.Add(2)
+	var wkres string
+	var wkerr error
 
+	wkdone := make(chan struct{})
 	go func() {
-		defer wg.Done()
+		defer close(wkdone)
 		wkres, wkerr = dr.resolveWellKnown(ctx, handle)
-		if wkerr == nil {
-			cancel()
-		}
-	}()
-	go func() {
-		defer wg.Done()
-		dnsres, dnserr = dr.resolveDNS(ctx, handle)
-		if dnserr == nil {
-			cancel()
-		}
 	}()
 
-	wg.Wait()
-
+	dnsres, dnserr := dr.resolveDNS(ctx, handle)
 	if dnserr == nil {
+		cancel()
+		<-wkdone
 		return dnsres, nil
 	}
 
+	<-wkdone
 	if wkerr == nil {
 		return wkres, nil
 	}
 
-	return "", errors.Join(fmt.Errorf("no did record found for handle %q", handle), dnserr, wkerr)
+	// a handle is only missing if neither method could have found it
+	if errors.Is(dnserr, ErrHandleNotFound) && errors.Is(wkerr, ErrHandleNotFound) {
+		return "", fmt.Errorf("%w: no did record found for handle %q (%s; %s)", ErrHandleNotFound, handle, dnserr, wkerr)
+	}
+	return "", fmt.Errorf("no did record found for handle %q (%s; %s)", handle, dnserr, wkerr)
 }
 
 func (dr *ProdHandleResolver) resolveWellKnown(ctx context.Context, handle string) (string, error) {
+	timeout := dr.WellKnownTimeout
+	if timeout == 0 {
+		timeout = DefaultWellKnownTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
 	c := http.Client{
 		Transport: otelhttp.NewTransport(http.DefaultTransport),
 	}
@@ -140,9 +162,19 @@ func (dr *ProdHandleResolver) resolveWellKnown(ctx context.Context, handle strin
 
 	resp, err := c.Do(req)
 	if err != nil {
+		var dnserr *net.DNSError
+		if errors.As(err, &dnserr) && dnserr.IsNotFound {
+			return "", fmt.Errorf("%w: handle (%s) has no HTTP well-known route: %s", ErrHandleNotFound, handle, err)
+		}
 		return "", fmt.Errorf("failed to resolve handle (%s) through HTTP well-known route: %s", handle, err)
 	}
-	if resp.StatusCode != 200 {
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200:
+	case http.StatusNotFound, http.StatusGone:
+		return "", fmt.Errorf("%w: handle (%s) has no HTTP well-known route: status=%d", ErrHandleNotFound, handle, resp.StatusCode)
+	default:
 		return "", fmt.Errorf("failed to resolve handle (%s) through HTTP well-known route: status=%d", handle, resp.StatusCode)
 	}
 
@@ -157,32 +189,46 @@ func (dr *ProdHandleResolver) resolveWellKnown(ctx context.Context, handle strin
 
 	parsed, err := did.ParseDID(string(b))
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("%w: invalid did from HTTP well-known route: %s", ErrHandleNotFound, err)
 	}
 
 	return parsed.String(), nil
 }
 
 func (dr *ProdHandleResolver) resolveDNS(ctx context.Context, handle string) (string, error) {
+	timeout := dr.DNSTimeout
+	if timeout == 0 {
+		timeout = DefaultDNSTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var res TXTResolver = net.DefaultResolver
+	if dr.DNS != nil {
+		res = dr.DNS
+	}
 
-	res, err := net.LookupTXT("_atproto." + handle)
+	records, err := res.LookupTXT(ctx, "_atproto."+handle)
 	if err != nil {
+		var dnserr *net.DNSError
+		if errors.As(err, &dnserr) && dnserr.IsNotFound {
+			return "", fmt.Errorf("%w: handle lookup failed: %s", ErrHandleNotFound, err)
+		}
 		return "", fmt.Errorf("handle lookup failed: %w", err)
 	}
 
-	for _, s := range res {
-		if strings.HasPrefix(s, "did=") {
-			parts := strings.Split(s, "=")
-			pdid, err := did.ParseDID(parts[1])
+	for _, s := range records {
+		if val, ok := strings.CutPrefix(s, "did="); ok {
+			pdid, err := did.ParseDID(val)
 			if err != nil {
-				return "", fmt.Errorf("invalid did in record: %w", err)
+				return "", fmt.Errorf("%w: invalid did in record: %s", ErrHandleNotFound, err)
 			}
 
 			return pdid.String(), nil
 		}
 	}
 
-	return "", fmt.Errorf("no did record found")
+	return "", fmt.Errorf("%w: no did record found", ErrHandleNotFound)
 }
 
 type TestHandleResolver struct {
@@ -192,6 +238,7 @@ type TestHandleResolver struct {
 func (tr *TestHandleResolver) ResolveHandleToDid(ctx context.Context, handle string) (string, error) {
 	c := http.DefaultClient
 
+	unreachable := false
 	for _, h := range tr.TrialHosts {
 		req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/.well-known/atproto-did", h), nil)
 		if err != nil {
@@ -203,6 +250,7 @@ func (tr *TestHandleResolver) ResolveHandleToDid(ctx context.Context, handle str
 		resp, err := c.Do(req)
 		if err != nil {
 			log.Warnf("failed to get did: %s", err)
+			unreachable = true
 			continue
 		}
 
@@ -224,5 +272,8 @@ func (tr *TestHandleResolver) ResolveHandleToDid(ctx context.Context, handle str
 		return parsed.String(), nil
 	}
 
-	return "", fmt.Errorf("no did record found for handle %q", handle)
+	if unreachable {
+		return "", fmt.Errorf("no did record found for handle %q", handle)
+	}
+	return "", fmt.Errorf("%w: no did record found for handle %q", ErrHandleNotFound, handle)
 }
@@ -0,0 +1,169 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// TXTResolver looks up DNS TXT records. *net.Resolver implements it.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// NewDNSServerResolver returns a resolver that sends every query to the DNS
+// server at addr (host:port) rather than the system resolver
+func NewDNSServerResolver(addr string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// DoHResolver looks up TXT records with DNS over HTTPS (RFC 8484), such as
+// https://cloudflare-dns.com/dns-query
+type DoHResolver struct {
+	URL    string
+	Client *http.Client
+}
+
+func (r *DoHResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dns name %q: %w", name, err)
+	}
+
+	q := dnsmessage.Message{
+		Header: dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  qname,
+			Type:  dnsmessage.TypeTXT,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	body, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", r.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	c := r.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("dns over https request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("dns over https request failed: status=%d", resp.StatusCode)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(b); err != nil {
+		return nil, fmt.Errorf("invalid dns over https response: %w", err)
+	}
+
+	switch msg.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	default:
+		return nil, &net.DNSError{Err: msg.RCode.String(), Name: name}
+	}
+
+	var out []string
+	for _, a := range msg.Answers {
+		if txt, ok := a.Body.(*dnsmessage.TXTResource); ok {
+			// like net.LookupTXT, the strings of one record are joined
+			out = append(out, strings.Join(txt.TXT, ""))
+		}
+	}
+
+	if len(out) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	return out, nil
+}
+
+type txtCacheEntry struct {
+	records []string
+	err     error
+	expires time.Time
+}
+
+// CachingTXTResolver keeps the results of TXT lookups for a fixed time,
+// including failures where the name was not found
+type CachingTXTResolver struct {
+	Inner TXTResolver
+	TTL   time.Duration
+
+	cache *lru.ARCCache
+}
+
+func NewCachingTXTResolver(inner TXTResolver, size int, ttl time.Duration) (*CachingTXTResolver, error) {
+	c, err := lru.NewARC(size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CachingTXTResolver{
+		Inner: inner,
+		TTL:   ttl,
+		cache: c,
+	}, nil
+}
+
+func (r *CachingTXTResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if v, ok := r.cache.Get(name); ok {
+		e := v.(*txtCacheEntry)
+		if time.Now().Before(e.expires) {
+			return e.records, e.err
+		}
+	}
+
+	records, err := r.Inner.LookupTXT(ctx, name)
+
+	// timeouts and server failures are not cached, only definite answers
+	var dnserr *net.DNSError
+	if err == nil || (errors.As(err, &dnserr) && dnserr.IsNotFound) {
+		r.cache.Add(name, &txtCacheEntry{
+			records: records,
+			err:     err,
+			expires: time.Now().Add(r.TTL),
+		})
+	}
+
+	return records, err
+}
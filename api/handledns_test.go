@@ -0,0 +1,182 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type fakeTXT struct {
+	records map[string][]string
+	calls   int
+}
+
+func (f *fakeTXT) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	f.calls++
+	r, ok := f.records[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return r, nil
+}
+
+func TestHandleResolutionPrecedence(t *testing.T) {
+	wk := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("did:plc:fromwellknown"))
+	}))
+	defer wk.Close()
+
+	dns := &fakeTXT{records: map[string][]string{
+		"_atproto.dns.test": {"v=spf1 -all", "did=did:plc:fromdns"},
+	}}
+
+	hr := &ProdHandleResolver{
+		DNS: dns,
+		ReqMod: func(req *http.Request, handle string) error {
+			req.URL.Scheme = "http"
+			req.URL.Host = wk.Listener.Addr().String()
+			return nil
+		},
+	}
+
+	ctx := context.Background()
+
+	// dns wins even though both methods have an answer
+	d, err := hr.ResolveHandleToDid(ctx, "dns.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d != "did:plc:fromdns" {
+		t.Fatalf("expected dns to take precedence, got %s", d)
+	}
+
+	d, err = hr.ResolveHandleToDid(ctx, "other.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d != "did:plc:fromwellknown" {
+		t.Fatalf("expected well-known fallback, got %s", d)
+	}
+}
+
+func TestHandleNotFound(t *testing.T) {
+	status := http.StatusNotFound
+	wk := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer wk.Close()
+
+	hr := &ProdHandleResolver{
+		DNS: &fakeTXT{records: map[string][]string{
+			"_atproto.nodid.test": {"v=spf1 -all"},
+		}},
+		ReqMod: func(req *http.Request, handle string) error {
+			req.URL.Scheme = "http"
+			req.URL.Host = wk.Listener.Addr().String()
+			return nil
+		},
+	}
+
+	ctx := context.Background()
+	for _, h := range []string{"missing.test", "nodid.test"} {
+		if _, err := hr.ResolveHandleToDid(ctx, h); !errors.Is(err, ErrHandleNotFound) {
+			t.Fatalf("%s: expected handle not found, got %v", h, err)
+		}
+	}
+
+	// the web host failing says nothing about the handle
+	status = http.StatusBadGateway
+	if _, err := hr.ResolveHandleToDid(ctx, "missing.test"); err == nil || errors.Is(err, ErrHandleNotFound) {
+		t.Fatalf("expected an indefinite failure, got %v", err)
+	}
+}
+
+func TestDoHResolver(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad content type", 415)
+			return
+		}
+
+		b, _ := io.ReadAll(r.Body)
+		var q dnsmessage.Message
+		if err := q.Unpack(b); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		resp := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: q.ID, Response: true},
+			Questions: q.Questions,
+		}
+		if q.Questions[0].Name.String() == "_atproto.alice.test." {
+			resp.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Questions[0].Name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET, TTL: 300},
+				Body:   &dnsmessage.TXTResource{TXT: []string{"did=did:plc:", "alice"}},
+			}}
+		} else {
+			resp.RCode = dnsmessage.RCodeNameError
+		}
+
+		out, err := resp.Pack()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(out)
+	}))
+	defer srv.Close()
+
+	hr := &ProdHandleResolver{
+		DNS: &DoHResolver{URL: srv.URL},
+		ReqMod: func(req *http.Request, handle string) error {
+			// keep the well-known fallback from reaching the network
+			req.URL.Scheme = "http"
+			req.URL.Host = "127.0.0.1:1"
+			return nil
+		},
+	}
+
+	ctx := context.Background()
+	d, err := hr.ResolveHandleToDid(ctx, "alice.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d != "did:plc:alice" {
+		t.Fatalf("unexpected did %s", d)
+	}
+
+	if _, err := hr.ResolveHandleToDid(ctx, "bob.test"); err == nil {
+		t.Fatal("expected missing handle to fail")
+	}
+}
+
+func TestCachingTXTResolver(t *testing.T) {
+	inner := &fakeTXT{records: map[string][]string{"a.test": {"x"}}}
+	c, err := NewCachingTXTResolver(inner, 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if _, err := c.LookupTXT(ctx, "a.test"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.LookupTXT(ctx, "missing.test"); err == nil {
+			t.Fatal("expected missing name to fail")
+		}
+	}
+
+	if inner.calls != 2 {
+		t.Fatalf("expected answers and not found to be cached, got %d lookups", inner.calls)
+	}
+}
@@ -25,12 +25,16 @@ func (t *Label) MarshalCBOR(w io.Writer) error {
 	}
 
 	cw := cbg.NewCborWriter(w)
-	fieldCount := 7
+	fieldCount := 8
 
 	if t.Cid == nil {
 		fieldCount--
 	}
 
+	if t.Sig == nil {
+		fieldCount--
+	}
+
 	if _, err := cw.Write(cbg.CborEncodeMajorType(cbg.MajMap, uint64(fieldCount))); err != nil {
 		return err
 	}
@@ -106,6 +110,33 @@ func (t *Label) MarshalCBOR(w io.Writer) error {
 		return err
 	}
 
+	// t.Sig ([]uint8) (slice)
+	if t.Sig != nil {
+
+		if len("sig") > cbg.MaxLength {
+			return xerrors.Errorf("Value in field \"sig\" was too long")
+		}
+
+		if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("sig"))); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, string("sig")); err != nil {
+			return err
+		}
+
+		if len(t.Sig) > cbg.ByteArrayMaxLen {
+			return xerrors.Errorf("Byte array in field t.Sig was too long")
+		}
+
+		if err := cw.WriteMajorTypeHeader(cbg.MajByteString, uint64(len(t.Sig))); err != nil {
+			return err
+		}
+
+		if _, err := cw.Write(t.Sig[:]); err != nil {
+			return err
+		}
+	}
+
 	// t.Src (string) (string)
 	if len("src") > cbg.MaxLength {
 		return xerrors.Errorf("Value in field \"src\" was too long")
@@ -284,6 +315,28 @@ func (t *Label) UnmarshalCBOR(r io.Reader) (err error) {
 			default:
 				return fmt.Errorf("booleans are either major type 7, value 20 or 21 (got %d)", extra)
 			}
+			// t.Sig ([]uint8) (slice)
+		case "sig":
+
+			maj, extra, err = cr.ReadHeader()
+			if err != nil {
+				return err
+			}
+
+			if extra > cbg.ByteArrayMaxLen {
+				return fmt.Errorf("t.Sig: byte array too large (%d)", extra)
+			}
+			if maj != cbg.MajByteString {
+				return fmt.Errorf("expected byte array")
+			}
+
+			if extra > 0 {
+				t.Sig = make([]uint8, extra)
+			}
+
+			if _, err := io.ReadFull(cr, t.Sig[:]); err != nil {
+				return err
+			}
 			// t.Src (string) (string)
 		case "src":
 
@@ -16,7 +16,9 @@ type Label struct {
 	Cid           *string `json:"cid,omitempty" cborgen:"cid,omitempty"`
 	Cts           string  `json:"cts" cborgen:"cts"`
 	// manually setting this to 'bool' not '*bool'
-	Neg bool   `json:"neg" cborgen:"neg"`
+	Neg bool `json:"neg" cborgen:"neg"`
+	// sig: signature of the label's DAG-CBOR encoding, without sig, by the src's key
+	Sig []byte `json:"sig,omitempty" cborgen:"sig,omitempty"`
 	Src string `json:"src" cborgen:"src"`
 	Uri string `json:"uri" cborgen:"uri"`
 	Val string `json:"val" cborgen:"val"`
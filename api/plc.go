@@ -13,6 +13,8 @@ import (
 	"net/url"
 	"strings"
 
+	"github.com/bluesky-social/indigo/util/signer"
+
 	did "github.com/whyrusleeping/go-did"
 	otel "go.opentelemetry.io/otel"
 )
@@ -20,6 +22,9 @@ import (
 type PLCServer struct {
 	Host string
 	C    *http.Client
+
+	// RotationKey signs the operations for UpdateUserHandle
+	RotationKey *did.PrivKey
 }
 
 func (s *PLCServer) GetDocument(ctx context.Context, didstr string) (*did.Document, error) {
@@ -64,14 +69,19 @@ type CreateOp struct {
 	Sig         string  `json:"sig" cborgen:"sig,omitempty"`
 }
 
-func (s *PLCServer) CreateDID(ctx context.Context, sigkey *did.PrivKey, recovery string, handle string, service string) (string, error) {
+func (s *PLCServer) CreateDID(ctx context.Context, sigkey signer.Signer, recovery string, handle string, service string) (string, error) {
 	if s.C == nil {
 		s.C = http.DefaultClient
 	}
 
+	pub, err := sigkey.Public(ctx)
+	if err != nil {
+		return "", err
+	}
+
 	op := CreateOp{
 		Type:        "create",
-		SigningKey:  sigkey.Public().DID(),
+		SigningKey:  pub.DID(),
 		RecoveryKey: recovery,
 		Handle:      handle,
 		Service:     service,
@@ -82,7 +92,7 @@ func (s *PLCServer) CreateDID(ctx context.Context, sigkey *did.PrivKey, recovery
 		return "", err
 	}
 
-	sig, err := sigkey.Sign(buf.Bytes())
+	sig, err := sigkey.Sign(ctx, buf.Bytes())
 	if err != nil {
 		return "", err
 	}
@@ -123,8 +133,16 @@ func (s *PLCServer) CreateDID(ctx context.Context, sigkey *did.PrivKey, recovery
 	return opdid, nil
 }
 
-func (s *PLCServer) UpdateUserHandle(ctx context.Context, did string, handle string) error {
-	return fmt.Errorf("handle updates not yet implemented")
+func (s *PLCServer) UpdateUserHandle(ctx context.Context, didstr string, handle string) error {
+	if s.RotationKey == nil {
+		return fmt.Errorf("no rotation key configured for handle updates")
+	}
+
+	_, err := s.UpdateOp(ctx, didstr, s.RotationKey, func(op *PLCOp) error {
+		op.SetHandle(handle)
+		return nil
+	})
+	return err
 }
 
 func didForCreateOp(op *CreateOp) (string, error) {
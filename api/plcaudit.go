@@ -0,0 +1,351 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/util/keyutil"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	mh "github.com/multiformats/go-multihash"
+	did "github.com/whyrusleeping/go-did"
+	otel "go.opentelemetry.io/otel"
+)
+
+// PLCNullifyWindow is how long after an operation a higher priority rotation
+// key may fork the log around it, nullifying it
+const PLCNullifyWindow = 72 * time.Hour
+
+// PLCLowSRequiredSince is when the PLC directory started requiring low-S
+// signatures. Operations it accepted before then may be signed with either
+// form of s.
+var PLCLowSRequiredSince = time.Date(2023, 11, 1, 0, 0, 0, 0, time.UTC)
+
+type PLCService struct {
+	Type     string `json:"type"`
+	Endpoint string `json:"endpoint"`
+}
+
+// PLCOp is a single operation in a DID's PLC log. This covers the current
+// "plc_operation" and "plc_tombstone" types, as well as the legacy "create"
+// type. The original JSON is kept, as signatures and CIDs are computed over
+// exactly what the PLC server was sent.
+type PLCOp struct {
+	Type string `json:"type"`
+
+	// plc_operation
+	RotationKeys        []string              `json:"rotationKeys,omitempty"`
+	VerificationMethods map[string]string     `json:"verificationMethods,omitempty"`
+	AlsoKnownAs         []string              `json:"alsoKnownAs,omitempty"`
+	Services            map[string]PLCService `json:"services,omitempty"`
+
+	// legacy create
+	SigningKey  string `json:"signingKey,omitempty"`
+	RecoveryKey string `json:"recoveryKey,omitempty"`
+	Handle      string `json:"handle,omitempty"`
+	Service     string `json:"service,omitempty"`
+
+	Prev *string `json:"prev"`
+	Sig  string  `json:"sig"`
+
+	raw json.RawMessage
+}
+
+func (op *PLCOp) UnmarshalJSON(b []byte) error {
+	type plain PLCOp
+	var p plain
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+
+	*op = PLCOp(p)
+	op.raw = append(json.RawMessage(nil), b...)
+	return nil
+}
+
+func (op *PLCOp) MarshalJSON() ([]byte, error) {
+	if op.raw != nil {
+		return op.raw, nil
+	}
+
+	type plain PLCOp
+	return json.Marshal((*plain)(op))
+}
+
+// Keys returns the rotation keys allowed to sign the operation after this
+// one, in priority order
+func (op *PLCOp) Keys() []string {
+	switch op.Type {
+	case "create":
+		return []string{op.RecoveryKey, op.SigningKey}
+	case "plc_tombstone":
+		return nil
+	default:
+		return op.RotationKeys
+	}
+}
+
+// encode returns the DAG-CBOR encoding of the operation, optionally without
+// its signature
+func (op *PLCOp) encode(withSig bool) ([]byte, error) {
+	b, err := op.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	var m map[string]any
+	if err := dec.Decode(&m); err != nil {
+		return nil, err
+	}
+
+	if !withSig {
+		delete(m, "sig")
+	}
+
+	return cbor.DumpObject(m)
+}
+
+// Cid returns the CID of the signed operation, which is what the next
+// operation references as prev
+func (op *PLCOp) Cid() (cid.Cid, error) {
+	b, err := op.encode(true)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	return cid.NewPrefixV1(cid.DagCBOR, mh.SHA2_256).Sum(b)
+}
+
+// DID returns the DID that the operation creates, when it is the first one in
+// a log
+func (op *PLCOp) DID() (string, error) {
+	b, err := op.encode(true)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.Sum256(b)
+	enchash := strings.ToLower(base32.StdEncoding.EncodeToString(h[:]))
+	return "did:plc:" + enchash[:24], nil
+}
+
+// verifySig checks the operation, accepted by the PLC directory at
+// createdAt, was signed by one of keys, and returns the index of the key that
+// signed it
+func (op *PLCOp) verifySig(keys []string, createdAt time.Time) (int, error) {
+	sig, err := base64.RawURLEncoding.DecodeString(op.Sig)
+	if err != nil {
+		return -1, fmt.Errorf("invalid signature encoding: %w", err)
+	}
+
+	unsigned, err := op.encode(false)
+	if err != nil {
+		return -1, err
+	}
+
+	// legacy create operations, and any others from before the low-S
+	// requirement, may have been signed with either form of s
+	verify := keyutil.Verify
+	if op.Type == "create" || createdAt.Before(PLCLowSRequiredSince) {
+		verify = func(pk *did.PubKey, msg, sig []byte) error { return pk.Verify(msg, sig) }
+	}
+
+	for i, k := range keys {
+		pk, err := keyutil.ParsePublicKey(k)
+		if err != nil {
+			continue
+		}
+
+		if verify(pk, unsigned, sig) == nil {
+			return i, nil
+		}
+	}
+
+	return -1, fmt.Errorf("not signed by any of the %d rotation keys", len(keys))
+}
+
+type PLCAuditEntry struct {
+	Did       string `json:"did"`
+	Operation *PLCOp `json:"operation"`
+	Cid       string `json:"cid"`
+	Nullified bool   `json:"nullified"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// GetAuditLog fetches every operation ever submitted for a DID, including
+// nullified ones, in the order the PLC server received them
+func (s *PLCServer) GetAuditLog(ctx context.Context, didstr string) ([]*PLCAuditEntry, error) {
+	ctx, span := otel.Tracer("gosky").Start(ctx, "plcGetAuditLog")
+	defer span.End()
+
+	if s.C == nil {
+		s.C = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", s.Host+"/"+didstr+"/log/audit", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.C.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("get audit log request failed (code %d): %s", resp.StatusCode, resp.Status)
+	}
+
+	var entries []*PLCAuditEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// VerifyAuditLog checks an audit log for didstr without trusting the PLC
+// server that served it. Every operation must have the CID claimed for it
+// and be signed by a rotation key of the operation it follows, the first
+// operation must hash to the DID, and operations marked nullified must be
+// exactly those forked around by a higher priority key within
+// PLCNullifyWindow. It returns the current operation.
+func VerifyAuditLog(didstr string, entries []*PLCAuditEntry) (*PLCOp, error) {
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("audit log is empty")
+	}
+
+	type link struct {
+		entry *PLCAuditEntry
+		cid   string
+		// index of the key in the previous operation that signed this one
+		signer    int
+		createdAt time.Time
+	}
+
+	// chain holds the operations that are valid so far, genesis first
+	var chain []*link
+	for i, e := range entries {
+		if e.Operation == nil {
+			return nil, fmt.Errorf("entry %d has no operation", i)
+		}
+		if e.Did != "" && e.Did != didstr {
+			return nil, fmt.Errorf("entry %d is for %s, not %s", i, e.Did, didstr)
+		}
+
+		op := e.Operation
+		c, err := op.Cid()
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: computing cid: %w", i, err)
+		}
+		if c.String() != e.Cid {
+			return nil, fmt.Errorf("entry %d: cid mismatch, log has %s but operation hashes to %s", i, e.Cid, c)
+		}
+
+		createdAt, err := time.Parse(time.RFC3339Nano, e.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: invalid createdAt: %w", i, err)
+		}
+
+		l := &link{entry: e, cid: e.Cid, createdAt: createdAt}
+
+		if i == 0 {
+			if op.Prev != nil {
+				return nil, fmt.Errorf("first operation has a prev")
+			}
+			if op.Type == "plc_tombstone" {
+				return nil, fmt.Errorf("first operation is a tombstone")
+			}
+
+			gdid, err := op.DID()
+			if err != nil {
+				return nil, err
+			}
+			if gdid != didstr {
+				return nil, fmt.Errorf("first operation creates %s, not %s", gdid, didstr)
+			}
+
+			l.signer, err = op.verifySig(op.Keys(), createdAt)
+			if err != nil {
+				return nil, fmt.Errorf("genesis operation: %w", err)
+			}
+
+			chain = append(chain, l)
+			continue
+		}
+
+		if op.Prev == nil {
+			return nil, fmt.Errorf("entry %d: only the first operation may omit prev", i)
+		}
+		if op.Type == "create" {
+			return nil, fmt.Errorf("entry %d: create operations may only be first", i)
+		}
+
+		pos := -1
+		for j, pl := range chain {
+			if pl.cid == *op.Prev {
+				pos = j
+				break
+			}
+		}
+		if pos < 0 {
+			return nil, fmt.Errorf("entry %d: prev %s is not a valid earlier operation", i, *op.Prev)
+		}
+
+		prev := chain[pos].entry.Operation
+		if prev.Type == "plc_tombstone" {
+			return nil, fmt.Errorf("entry %d: follows a tombstone", i)
+		}
+
+		l.signer, err = op.verifySig(prev.Keys(), createdAt)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %w", i, err)
+		}
+
+		if pos < len(chain)-1 {
+			// a fork, which nullifies everything after prev
+			disputed := chain[pos+1]
+			if l.signer >= disputed.signer {
+				return nil, fmt.Errorf("entry %d: forks around %s without a higher priority rotation key", i, disputed.cid)
+			}
+			if createdAt.Sub(disputed.createdAt) > PLCNullifyWindow {
+				return nil, fmt.Errorf("entry %d: forks around %s after the nullification window", i, disputed.cid)
+			}
+
+			for _, n := range chain[pos+1:] {
+				if !n.entry.Nullified {
+					return nil, fmt.Errorf("operation %s was forked around but is not marked nullified", n.cid)
+				}
+			}
+			chain = chain[:pos+1]
+		}
+
+		chain = append(chain, l)
+	}
+
+	valid := make(map[*PLCAuditEntry]bool, len(chain))
+	for _, l := range chain {
+		valid[l.entry] = true
+	}
+	for i, e := range entries {
+		if e.Nullified == valid[e] {
+			return nil, fmt.Errorf("entry %d: nullified is %t, but verification says %t", i, e.Nullified, !valid[e])
+		}
+	}
+
+	return chain[len(chain)-1].entry.Operation, nil
+}
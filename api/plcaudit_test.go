@@ -0,0 +1,329 @@
+package api
+
+import (
+	"context"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/util/keyutil"
+
+	did "github.com/whyrusleeping/go-did"
+)
+
+func TestPLCOpLegacyVector(t *testing.T) {
+	var op PLCOp
+	if err := json.Unmarshal([]byte(`{
+    "type": "create",
+    "signingKey": "did:key:zDnaeRSYs7c2NpcNA5NRAUqS8DCkLWDyNLnATi28D6w7no7hX",
+    "recoveryKey": "did:key:zDnaeRSYs7c2NpcNA5NRAUqS8DCkLWDyNLnATi28D6w7no7hX",
+    "handle": "why.bsky.social",
+    "service": "bsky.social",
+    "prev": null,
+    "sig": "e8h6dCx405Z_95cZWWkZtfLgDPvfdXDG9pCZQi1NhduooZgb4d1w-CzahA3J-iNGCCgP3D0O5l997G3vQfxKOA"
+  }`), &op); err != nil {
+		t.Fatal(err)
+	}
+
+	unsigned, err := op.encode(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base64.RawURLEncoding.EncodeToString(unsigned) != "pmRwcmV29mR0eXBlZmNyZWF0ZWZoYW5kbGVvd2h5LmJza3kuc29jaWFsZ3NlcnZpY2VrYnNreS5zb2NpYWxqc2lnbmluZ0tleXg5ZGlkOmtleTp6RG5hZVJTWXM3YzJOcGNOQTVOUkFVcVM4RENrTFdEeU5MbkFUaTI4RDZ3N25vN2hYa3JlY292ZXJ5S2V5eDlkaWQ6a2V5OnpEbmFlUlNZczdjMk5wY05BNU5SQVVxUzhEQ2tMV0R5TkxuQVRpMjhENnc3bm83aFg" {
+		t.Fatal("encoding mismatched")
+	}
+
+	if _, err := op.verifySig(op.Keys(), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type testLog struct {
+	t       *testing.T
+	did     string
+	entries []*PLCAuditEntry
+	start   time.Time
+
+	// highS has operations signed with the high-S form of their P-256
+	// signatures
+	highS bool
+}
+
+func (tl *testLog) add(prev *PLCAuditEntry, k *did.PrivKey, rotation []*did.PrivKey, handle string, after time.Duration) *PLCAuditEntry {
+	tl.t.Helper()
+
+	var keys []string
+	for _, rk := range rotation {
+		keys = append(keys, rk.Public().DID())
+	}
+
+	op := &PLCOp{
+		Type:                "plc_operation",
+		RotationKeys:        keys,
+		VerificationMethods: map[string]string{"atproto": k.Public().DID()},
+		AlsoKnownAs:         []string{"at://" + handle},
+		Services:            map[string]PLCService{"atproto_pds": {Type: "AtprotoPersonalDataServer", Endpoint: "https://pds.example.com"}},
+	}
+	if prev != nil {
+		op.Prev = &prev.Cid
+	}
+
+	unsigned, err := op.encode(false)
+	if err != nil {
+		tl.t.Fatal(err)
+	}
+	sig, err := keyutil.Sign(k, unsigned)
+	if err != nil {
+		tl.t.Fatal(err)
+	}
+	if tl.highS {
+		n := elliptic.P256().Params().N
+		hs := new(big.Int).Sub(n, new(big.Int).SetBytes(sig[32:]))
+		hs.FillBytes(sig[32:])
+	}
+	op.Sig = base64.RawURLEncoding.EncodeToString(sig)
+
+	// round trip so the op carries its original JSON, as it would from a server
+	b, err := json.Marshal(op)
+	if err != nil {
+		tl.t.Fatal(err)
+	}
+	var sop PLCOp
+	if err := json.Unmarshal(b, &sop); err != nil {
+		tl.t.Fatal(err)
+	}
+
+	c, err := sop.Cid()
+	if err != nil {
+		tl.t.Fatal(err)
+	}
+
+	if prev == nil {
+		tl.did, err = sop.DID()
+		if err != nil {
+			tl.t.Fatal(err)
+		}
+	}
+
+	e := &PLCAuditEntry{
+		Did:       tl.did,
+		Operation: &sop,
+		Cid:       c.String(),
+		CreatedAt: tl.start.Add(after).Format(time.RFC3339Nano),
+	}
+	tl.entries = append(tl.entries, e)
+	return e
+}
+
+func TestVerifyAuditLog(t *testing.T) {
+	var keys []*did.PrivKey
+	for i := 0; i < 2; i++ {
+		k, err := did.GeneratePrivKey(rand.Reader, did.KeyTypeSecp256k1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, k)
+	}
+	recovery, signing := keys[0], keys[1]
+
+	tl := &testLog{t: t, start: time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)}
+	genesis := tl.add(nil, signing, keys, "alice.test", 0)
+	hijack := tl.add(genesis, signing, keys, "mallory.test", time.Hour)
+
+	if _, err := VerifyAuditLog(tl.did, tl.entries); err != nil {
+		t.Fatal(err)
+	}
+
+	// the recovery key outranks the key that signed the hijack, so can undo it
+	recover := tl.add(genesis, recovery, keys, "alice.test", 2*time.Hour)
+	if _, err := VerifyAuditLog(tl.did, tl.entries); err == nil {
+		t.Fatal("expected the hijack to need marking as nullified")
+	}
+
+	hijack.Nullified = true
+	cur, err := VerifyAuditLog(tl.did, tl.entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur != recover.Operation {
+		t.Fatal("expected the recovery to be the current operation")
+	}
+
+	if _, err := VerifyAuditLog("did:plc:aaaaaaaaaaaaaaaaaaaaaaaa", tl.entries); err == nil {
+		t.Fatal("expected a log for another did to fail")
+	}
+
+	// a fork signed by the same key is not allowed
+	tl.add(recover, signing, keys, "bob.test", 3*time.Hour)
+	tl.add(recover, signing, keys, "carol.test", 4*time.Hour)
+	tl.entries[3].Nullified = true
+	if _, err := VerifyAuditLog(tl.did, tl.entries); err == nil {
+		t.Fatal("expected fork without a higher priority key to fail")
+	}
+
+	// nor is one after the window has passed
+	tl.entries = tl.entries[:4]
+	tl.add(recover, recovery, keys, "carol.test", 100*time.Hour)
+	if _, err := VerifyAuditLog(tl.did, tl.entries); err == nil {
+		t.Fatal("expected fork after the nullification window to fail")
+	}
+
+	// and tampering with an operation breaks its cid
+	tl.entries = tl.entries[:3]
+	tl.entries[2].Operation.Sig = hijack.Operation.Sig
+	tl.entries[2].Operation.raw = nil
+	if _, err := VerifyAuditLog(tl.did, tl.entries); err == nil {
+		t.Fatal("expected tampered operation to fail")
+	}
+}
+
+func TestVerifyAuditLogHighS(t *testing.T) {
+	k, err := did.GeneratePrivKey(rand.Reader, did.KeyTypeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []*did.PrivKey{k}
+
+	// operations from before the low-S requirement are accepted either way
+	tl := &testLog{t: t, start: PLCLowSRequiredSince.Add(-48 * time.Hour), highS: true}
+	genesis := tl.add(nil, k, keys, "alice.test", 0)
+	tl.add(genesis, k, keys, "alice2.test", time.Hour)
+	if _, err := VerifyAuditLog(tl.did, tl.entries); err != nil {
+		t.Fatal(err)
+	}
+
+	tl.add(tl.entries[1], k, keys, "alice3.test", 72*time.Hour)
+	if _, err := VerifyAuditLog(tl.did, tl.entries); err == nil {
+		t.Fatal("expected a high-S operation after the low-S requirement to fail")
+	}
+}
+
+// fakePLC serves a single DID's log, accepting any operation that keeps it
+// verifiable
+type fakePLC struct {
+	tl *testLog
+}
+
+func (f *fakePLC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" && r.URL.Path == "/"+f.tl.did+"/log/audit" {
+		json.NewEncoder(w).Encode(f.tl.entries)
+		return
+	}
+
+	if r.Method != "POST" || r.URL.Path != "/"+f.tl.did {
+		http.NotFound(w, r)
+		return
+	}
+
+	var op PLCOp
+	if err := json.NewDecoder(r.Body).Decode(&op); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	c, err := op.Cid()
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	e := &PLCAuditEntry{
+		Did:       f.tl.did,
+		Operation: &op,
+		Cid:       c.String(),
+		CreatedAt: f.tl.start.Add(time.Duration(len(f.tl.entries)) * time.Hour).Format(time.RFC3339Nano),
+	}
+	entries := append(f.tl.entries, e)
+
+	// mark whatever a fork nullifies
+	for _, prev := range entries {
+		if op.Prev != nil && prev.Cid == *op.Prev {
+			nullify := false
+			for _, o := range entries[:len(entries)-1] {
+				if nullify && !o.Nullified {
+					o.Nullified = true
+				}
+				if o == prev {
+					nullify = true
+				}
+			}
+		}
+	}
+
+	if _, err := VerifyAuditLog(f.tl.did, entries); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	f.tl.entries = entries
+}
+
+func TestUpdateAndRecoverOp(t *testing.T) {
+	var keys []*did.PrivKey
+	for i := 0; i < 3; i++ {
+		k, err := did.GeneratePrivKey(rand.Reader, did.KeyTypeP256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, k)
+	}
+	recovery, rotation, signing := keys[0], keys[1], keys[2]
+
+	tl := &testLog{t: t, start: time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)}
+	genesis := tl.add(nil, recovery, []*did.PrivKey{recovery, rotation}, "alice.test", 0)
+
+	srv := httptest.NewServer(&fakePLC{tl: tl})
+	defer srv.Close()
+
+	ctx := context.Background()
+	s := &PLCServer{Host: srv.URL, RotationKey: rotation}
+
+	if err := s.UpdateUserHandle(ctx, tl.did, "alice2.test"); err != nil {
+		t.Fatal(err)
+	}
+
+	cur, err := s.UpdateOp(ctx, tl.did, rotation, func(op *PLCOp) error {
+		op.SetPDS("https://new-pds.example.com")
+		op.SetSigningKey(signing.Public().DID())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur.AlsoKnownAs[0] != "at://alice2.test" || cur.Services["atproto_pds"].Endpoint != "https://new-pds.example.com" {
+		t.Fatalf("update lost state: %+v", cur)
+	}
+
+	// a key that is not a rotation key is refused
+	if _, err := s.UpdateOp(ctx, tl.did, signing, nil); err == nil {
+		t.Fatal("expected operation signed by a non rotation key to be refused")
+	}
+
+	// the recovery key can undo both updates
+	if _, err := s.RecoverOp(ctx, tl.did, genesis.Cid, recovery, func(op *PLCOp) error {
+		op.RotationKeys = []string{recovery.Public().DID()}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	cur, err = s.CurrentOp(ctx, tl.did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur.AlsoKnownAs[0] != "at://alice.test" || len(cur.RotationKeys) != 1 {
+		t.Fatalf("unexpected state after recovery: %+v", cur)
+	}
+	if n := len(tl.entries); n != 4 || !tl.entries[1].Nullified || !tl.entries[2].Nullified {
+		t.Fatal("expected the recovery to nullify both updates")
+	}
+
+	// and the old rotation key no longer works
+	if err := s.UpdateUserHandle(ctx, tl.did, "mallory.test"); err == nil {
+		t.Fatal("expected the removed rotation key to be refused")
+	}
+}
@@ -0,0 +1,215 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/bluesky-social/indigo/util/keyutil"
+
+	did "github.com/whyrusleeping/go-did"
+)
+
+// Sign signs the operation with k, which must be one of the rotation keys of
+// the operation it follows for the PLC server to accept it
+func (op *PLCOp) Sign(k *did.PrivKey) error {
+	op.raw = nil
+	op.Sig = ""
+
+	unsigned, err := op.encode(false)
+	if err != nil {
+		return err
+	}
+
+	sig, err := keyutil.Sign(k, unsigned)
+	if err != nil {
+		return err
+	}
+
+	op.Sig = base64.RawURLEncoding.EncodeToString(sig)
+	return nil
+}
+
+// NextOp returns an unsigned plc_operation that follows prev and keeps its
+// state, for the caller to modify. Legacy create operations are converted to
+// the current format.
+func NextOp(prev *PLCOp) (*PLCOp, error) {
+	if prev.Type == "plc_tombstone" {
+		return nil, fmt.Errorf("cannot follow a tombstone")
+	}
+
+	c, err := prev.Cid()
+	if err != nil {
+		return nil, err
+	}
+	pcid := c.String()
+
+	op := &PLCOp{
+		Type:                "plc_operation",
+		VerificationMethods: map[string]string{},
+		Services:            map[string]PLCService{},
+		Prev:                &pcid,
+	}
+
+	if prev.Type == "create" {
+		op.RotationKeys = prev.Keys()
+		op.VerificationMethods["atproto"] = prev.SigningKey
+		op.AlsoKnownAs = []string{"at://" + prev.Handle}
+
+		endpoint := prev.Service
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "https://" + endpoint
+		}
+		op.Services["atproto_pds"] = PLCService{Type: "AtprotoPersonalDataServer", Endpoint: endpoint}
+		return op, nil
+	}
+
+	op.RotationKeys = append(op.RotationKeys, prev.RotationKeys...)
+	op.AlsoKnownAs = append(op.AlsoKnownAs, prev.AlsoKnownAs...)
+	for k, v := range prev.VerificationMethods {
+		op.VerificationMethods[k] = v
+	}
+	for k, v := range prev.Services {
+		op.Services[k] = v
+	}
+
+	return op, nil
+}
+
+// SetHandle replaces the handle in the operation's alsoKnownAs, keeping any
+// other entries
+func (op *PLCOp) SetHandle(handle string) {
+	aka := []string{"at://" + handle}
+	for _, a := range op.AlsoKnownAs {
+		if !strings.HasPrefix(a, "at://") {
+			aka = append(aka, a)
+		}
+	}
+	op.AlsoKnownAs = aka
+}
+
+// SetPDS sets the operation's atproto_pds service endpoint
+func (op *PLCOp) SetPDS(endpoint string) {
+	if op.Services == nil {
+		op.Services = make(map[string]PLCService)
+	}
+	op.Services["atproto_pds"] = PLCService{Type: "AtprotoPersonalDataServer", Endpoint: endpoint}
+}
+
+// SetSigningKey sets the did:key repos are signed with
+func (op *PLCOp) SetSigningKey(key string) {
+	if op.VerificationMethods == nil {
+		op.VerificationMethods = make(map[string]string)
+	}
+	op.VerificationMethods["atproto"] = key
+}
+
+// SubmitOp sends a signed operation for didstr to the PLC server
+func (s *PLCServer) SubmitOp(ctx context.Context, didstr string, op *PLCOp) error {
+	if s.C == nil {
+		s.C = http.DefaultClient
+	}
+
+	body, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.Host+"/"+url.QueryEscape(didstr), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.C.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("bad response from plc operation (code %d): %s", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+
+	return nil
+}
+
+// CurrentOp fetches and verifies the audit log for didstr, returning its
+// current operation
+func (s *PLCServer) CurrentOp(ctx context.Context, didstr string) (*PLCOp, error) {
+	entries, err := s.GetAuditLog(ctx, didstr)
+	if err != nil {
+		return nil, err
+	}
+
+	return VerifyAuditLog(didstr, entries)
+}
+
+// UpdateOp applies update to the current state of didstr, then signs the
+// resulting operation with the rotation key k and submits it
+func (s *PLCServer) UpdateOp(ctx context.Context, didstr string, k *did.PrivKey, update func(op *PLCOp) error) (*PLCOp, error) {
+	cur, err := s.CurrentOp(ctx, didstr)
+	if err != nil {
+		return nil, fmt.Errorf("getting current operation: %w", err)
+	}
+
+	return s.submitNext(ctx, didstr, cur, k, update)
+}
+
+// RecoverOp forks the log of didstr at the operation with cid from,
+// nullifying every operation after it. k must be a higher priority rotation
+// key than the one that signed the operation after from, and the fork must
+// happen within PLCNullifyWindow of it.
+func (s *PLCServer) RecoverOp(ctx context.Context, didstr string, from string, k *did.PrivKey, update func(op *PLCOp) error) (*PLCOp, error) {
+	entries, err := s.GetAuditLog(ctx, didstr)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := VerifyAuditLog(didstr, entries); err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		if e.Cid == from {
+			if e.Nullified {
+				return nil, fmt.Errorf("operation %s is already nullified", from)
+			}
+			return s.submitNext(ctx, didstr, e.Operation, k, update)
+		}
+	}
+
+	return nil, fmt.Errorf("operation %s is not in the log for %s", from, didstr)
+}
+
+func (s *PLCServer) submitNext(ctx context.Context, didstr string, prev *PLCOp, k *did.PrivKey, update func(op *PLCOp) error) (*PLCOp, error) {
+	op, err := NextOp(prev)
+	if err != nil {
+		return nil, err
+	}
+
+	if update != nil {
+		if err := update(op); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := op.Sign(k); err != nil {
+		return nil, err
+	}
+
+	if err := s.SubmitOp(ctx, didstr, op); err != nil {
+		return nil, err
+	}
+
+	return op, nil
+}
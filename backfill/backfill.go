@@ -0,0 +1,478 @@
+// Package backfill fetches whole repos from their PDS and passes every
+// record in them to a handler, for services like palomar or an appview that
+// need the existing content of accounts and not just what comes in over the
+// firehose.
+//
+// Each repo is a Job, kept in a Store so that backfills survive restarts.
+// Jobs are run by a pool of workers, with limits on how many run at once and
+// how quickly repos are fetched from each PDS. Progress through a repo is
+// checkpointed, so an interrupted job resumes close to where it stopped;
+// handlers have to cope with seeing some records twice. Failed jobs are
+// retried with backoff, unless the error is one retrying can not fix.
+//
+// Repos that have been backfilled can be resynced, which fetches only the
+// commits written since the last backfill where the PDS can serve them,
+// and handles the records they create or change.
+package backfill
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/bluesky-social/indigo/xrpc"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	logging "github.com/ipfs/go-log"
+	"golang.org/x/time/rate"
+)
+
+var log = logging.Logger("backfill")
+
+// HandleRecordFunc is called with each record of a repo being backfilled.
+// Returning an error fails the job, which is retried later unless the error
+// is wrapped with Permanent.
+type HandleRecordFunc func(ctx context.Context, did string, path string, rcid cid.Cid, rec *lexutil.RawRecord) error
+
+// HandleDeleteFunc is called with each record deleted from a repo since it
+// was last backfilled. Errors are treated as those of a HandleRecordFunc.
+type HandleDeleteFunc func(ctx context.Context, did string, path string) error
+
+// Options control how a Backfiller runs its jobs
+type Options struct {
+	// Concurrency is the most jobs run at once
+	Concurrency int
+
+	// HostConcurrency is the most jobs run at once for repos on the same PDS
+	HostConcurrency int
+
+	// HostRate and HostBurst limit how many repos are fetched from each PDS
+	// per second
+	HostRate  float64
+	HostBurst int
+
+	// CheckpointInterval is how many records are handled between saves of a
+	// job's progress
+	CheckpointInterval int
+
+	// MaxAttempts is how many times a job is run before it is given up on
+	MaxAttempts int
+
+	// MinBackoff and MaxBackoff bound the wait before a failed job is run
+	// again, which doubles after every attempt
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// PollInterval is how often the store is checked for jobs that are due
+	PollInterval time.Duration
+
+	// HTTPClient, if set, is used to fetch repos
+	HTTPClient *http.Client
+}
+
+// DefaultOptions returns options that are gentle enough on PDSs to backfill
+// the whole network with
+func DefaultOptions() *Options {
+	return &Options{
+		Concurrency:        20,
+		HostConcurrency:    4,
+		HostRate:           2,
+		HostBurst:          4,
+		CheckpointInterval: 500,
+		MaxAttempts:        6,
+		MinBackoff:         time.Minute,
+		MaxBackoff:         6 * time.Hour,
+		PollInterval:       5 * time.Second,
+	}
+}
+
+// Backfiller runs the jobs in a Store. Several backfillers, with their own
+// handlers, can share a database as long as each has its own name.
+type Backfiller struct {
+	name   string
+	store  Store
+	handle HandleRecordFunc
+	opts   *Options
+
+	handleDelete HandleDeleteFunc
+
+	wake chan struct{}
+	wg   sync.WaitGroup
+
+	lk       sync.Mutex
+	running  map[string]bool
+	hostJobs map[string]int
+	limiters map[string]*rate.Limiter
+	clients  map[string]*xrpc.Client
+}
+
+func NewBackfiller(name string, store Store, handle HandleRecordFunc, opts *Options) *Backfiller {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+
+	return &Backfiller{
+		name:     name,
+		store:    store,
+		handle:   handle,
+		opts:     opts,
+		wake:     make(chan struct{}, 1),
+		running:  make(map[string]bool),
+		hostJobs: make(map[string]int),
+		limiters: make(map[string]*rate.Limiter),
+		clients:  make(map[string]*xrpc.Client),
+	}
+}
+
+// SetDeleteHandler has h called with the records deleted from repos since
+// they were last backfilled. Without one, deletions are skipped. Must be
+// called before Run.
+func (b *Backfiller) SetDeleteHandler(h HandleDeleteFunc) {
+	b.handleDelete = h
+}
+
+// Enqueue adds a job for the repo of did, hosted on the PDS at pds (eg
+// https://pds.example.com). Repos that already have a job are left alone.
+func (b *Backfiller) Enqueue(ctx context.Context, did, pds string) error {
+	created, err := b.store.EnqueueJob(ctx, did, pds)
+	if err != nil {
+		return err
+	}
+	if created {
+		jobsEnqueued.WithLabelValues(b.name).Inc()
+		b.poke()
+	}
+	return nil
+}
+
+// Resync enqueues the repo of did again, to catch up with what was written
+// to it since it was backfilled, for instance after the consumer missed part
+// of the firehose. Only the commits since then are fetched where the PDS can
+// serve them. Repos without a job get one, as with Enqueue.
+func (b *Backfiller) Resync(ctx context.Context, did, pds string) error {
+	if err := b.store.RequeueJob(ctx, did, pds); err != nil {
+		return err
+	}
+	b.poke()
+	return nil
+}
+
+func (b *Backfiller) poke() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run runs jobs until ctx is cancelled, then waits for running jobs to stop.
+// Jobs left running by a previous process are resumed from their
+// checkpoints.
+func (b *Backfiller) Run(ctx context.Context) error {
+	if err := b.store.ResetRunning(ctx); err != nil {
+		return fmt.Errorf("resetting interrupted jobs: %w", err)
+	}
+
+	t := time.NewTicker(b.opts.PollInterval)
+	defer t.Stop()
+
+	for {
+		if err := b.schedule(ctx); err != nil && ctx.Err() == nil {
+			log.Errorw("failed to schedule backfill jobs", "backfiller", b.name, "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			b.wg.Wait()
+			return nil
+		case <-t.C:
+		case <-b.wake:
+		}
+	}
+}
+
+// schedule starts as many due jobs as the concurrency limits allow
+func (b *Backfiller) schedule(ctx context.Context) error {
+	free := b.opts.Concurrency - b.numRunning()
+	if free <= 0 {
+		return nil
+	}
+
+	// jobs on busy hosts are passed over, so look further ahead than the
+	// free slots
+	jobs, err := b.store.GetDueJobs(ctx, time.Now(), free*4)
+	if err != nil {
+		return err
+	}
+
+	for _, j := range jobs {
+		if free <= 0 {
+			break
+		}
+		if !b.claim(j.Repo, j.PDS) {
+			continue
+		}
+
+		j.State = StateRunning
+		if err := b.store.UpdateJob(ctx, j); err != nil {
+			b.release(j.Repo, j.PDS)
+			return err
+		}
+
+		free--
+		b.wg.Add(1)
+		go b.runJob(ctx, j)
+	}
+
+	return nil
+}
+
+func (b *Backfiller) numRunning() int {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	return len(b.running)
+}
+
+// claim marks the repo of a job as running, unless it already is. Jobs
+// fetching from a PDS count against its concurrency limit, which can also
+// keep them from running; host is empty for those that do not.
+func (b *Backfiller) claim(did, host string) bool {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	if b.running[did] || (host != "" && b.hostJobs[host] >= b.opts.HostConcurrency) {
+		return false
+	}
+	b.running[did] = true
+	if host != "" {
+		b.hostJobs[host]++
+	}
+	jobsRunning.WithLabelValues(b.name).Inc()
+	return true
+}
+
+func (b *Backfiller) release(did, host string) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	delete(b.running, did)
+	if host != "" {
+		b.hostJobs[host]--
+		if b.hostJobs[host] <= 0 {
+			delete(b.hostJobs, host)
+		}
+	}
+	jobsRunning.WithLabelValues(b.name).Dec()
+}
+
+// host returns the client and rate limiter shared by jobs on pds
+func (b *Backfiller) host(pds string) (*xrpc.Client, *rate.Limiter) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	c, ok := b.clients[pds]
+	if !ok {
+		// the PDS's own rate limits are waited out rather than failing the
+		// job, and retries are left to the job
+		c = &xrpc.Client{
+			Host:             pds,
+			Client:           b.opts.HTTPClient,
+			WaitForRateLimit: true,
+		}
+		b.clients[pds] = c
+		b.limiters[pds] = rate.NewLimiter(rate.Limit(b.opts.HostRate), b.opts.HostBurst)
+	}
+	return c, b.limiters[pds]
+}
+
+func (b *Backfiller) runJob(ctx context.Context, j *Job) {
+	defer b.wg.Done()
+	defer b.poke()
+	defer b.release(j.Repo, j.PDS)
+
+	start := time.Now()
+	b.finishJob(ctx, j, b.backfillRepo(ctx, j), start)
+}
+
+// finishJob records the outcome of a run of j, which failed if err is set
+func (b *Backfiller) finishJob(ctx context.Context, j *Job, err error, start time.Time) {
+	result := "complete"
+	switch {
+	case err == nil:
+		j.State = StateComplete
+		j.LastError = ""
+		j.RetryAfter = nil
+	case ctx.Err() != nil:
+		// shutting down; the job resumes from its checkpoint next time, and
+		// does not count as an attempt
+		j.State = StateEnqueued
+		result = "interrupted"
+	default:
+		j.Attempts++
+		j.LastError = err.Error()
+		if IsPermanent(err) || j.Attempts >= b.opts.MaxAttempts {
+			j.State = StateFailed
+			result = "failed"
+		} else {
+			retry := time.Now().Add(b.backoff(j.Attempts))
+			j.State = StateEnqueued
+			j.RetryAfter = &retry
+			result = "retry"
+		}
+		log.Warnw("backfill job failed", "backfiller", b.name, "did", j.Repo, "pds", j.PDS, "attempts", j.Attempts, "state", j.State, "err", err)
+	}
+	jobsFinished.WithLabelValues(b.name, result).Inc()
+	jobDuration.WithLabelValues(b.name, result).Observe(time.Since(start).Seconds())
+
+	// the job's context may be gone, but its state still has to be saved
+	uctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := b.store.UpdateJob(uctx, j); err != nil {
+		log.Errorw("failed to save backfill job", "backfiller", b.name, "did", j.Repo, "err", err)
+	}
+}
+
+func (b *Backfiller) backoff(attempt int) time.Duration {
+	d := b.opts.MinBackoff
+	for i := 1; i < attempt && d < b.opts.MaxBackoff; i++ {
+		d *= 2
+	}
+	if b.opts.MaxBackoff > 0 && d > b.opts.MaxBackoff {
+		d = b.opts.MaxBackoff
+	}
+	return d
+}
+
+// backfillRepo fetches the repo of j, or only what was written since its
+// head if it has been backfilled before, and handles the records in key
+// order from the checkpoint on
+func (b *Backfiller) backfillRepo(ctx context.Context, j *Job) error {
+	c, lim := b.host(j.PDS)
+
+	wstart := time.Now()
+	if err := lim.Wait(ctx); err != nil {
+		return err
+	}
+	rateLimitWait.WithLabelValues(b.name).Observe(time.Since(wstart).Seconds())
+
+	var src *recordSource
+	if j.Head != "" {
+		var err error
+		src, err = b.fetchSince(ctx, c, j)
+		if err != nil {
+			return err
+		}
+		if src == nil {
+			incrementalFallbacks.WithLabelValues(b.name).Inc()
+		}
+	}
+	if src == nil {
+		var err error
+		src, err = b.fetchFull(ctx, c, j)
+		if err != nil {
+			return err
+		}
+	}
+
+	return b.handleRecords(ctx, j, src)
+}
+
+// handleRecords passes the records of src to the handler, from the
+// checkpoint of j on, and moves the head of j up to that of src once done
+func (b *Backfiller) handleRecords(ctx context.Context, j *Job, src *recordSource) error {
+	var sinceCheckpoint int
+	err := src.forEach(ctx, j.Checkpoint, func(k string, v cid.Cid) error {
+		if k == j.Checkpoint {
+			// handled before the job was interrupted
+			return nil
+		}
+
+		if !v.Defined() {
+			if b.handleDelete != nil {
+				if err := b.handleDelete(ctx, j.Repo, k); err != nil {
+					return fmt.Errorf("handling deletion of %s: %w", k, err)
+				}
+				recordsHandled.WithLabelValues(b.name).Inc()
+			}
+		} else {
+			blk, err := src.bs.Get(ctx, v)
+			if err != nil {
+				return Permanent(fmt.Errorf("reading record %s: %w", k, err))
+			}
+			rec, err := lexutil.NewRawRecord(blk.RawData())
+			if err != nil {
+				return Permanent(fmt.Errorf("decoding record %s: %w", k, err))
+			}
+
+			if err := b.handle(ctx, j.Repo, k, v, rec); err != nil {
+				return fmt.Errorf("handling record %s: %w", k, err)
+			}
+			recordsHandled.WithLabelValues(b.name).Inc()
+		}
+
+		j.Checkpoint = k
+		sinceCheckpoint++
+		if sinceCheckpoint >= b.opts.CheckpointInterval {
+			sinceCheckpoint = 0
+			if err := b.store.UpdateJob(ctx, j); err != nil {
+				return fmt.Errorf("saving checkpoint: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, context.Canceled) && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+
+	j.Head = src.head.String()
+	j.Checkpoint = ""
+	return nil
+}
+
+// recordSource is a fetched repo, or the part of one written since an
+// earlier commit
+type recordSource struct {
+	// head is the commit the records are as of
+	head cid.Cid
+	bs   blockstore.Blockstore
+
+	// forEach calls cb with each record, in key order, starting with from.
+	// Records deleted since an earlier commit are passed with cid.Undef.
+	forEach func(ctx context.Context, from string, cb func(k string, v cid.Cid) error) error
+}
+
+func (b *Backfiller) fetchFull(ctx context.Context, c *xrpc.Client, j *Job) (*recordSource, error) {
+	start := time.Now()
+	carb, err := comatproto.SyncGetRepo(ctx, c, j.Repo, "", "")
+	if err != nil {
+		return nil, classifyFetchError(fmt.Errorf("fetching repo: %w", err))
+	}
+	repoFetchDuration.WithLabelValues(b.name, "full").Observe(time.Since(start).Seconds())
+
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	root, err := repo.IngestRepo(ctx, bs, bytes.NewReader(carb))
+	if err != nil {
+		return nil, Permanent(fmt.Errorf("reading repo: %w", err))
+	}
+	r, err := repo.OpenRepo(ctx, bs, root, false)
+	if err != nil {
+		return nil, Permanent(fmt.Errorf("reading repo: %w", err))
+	}
+
+	return &recordSource{
+		head:    root,
+		bs:      bs,
+		forEach: r.ForEach,
+	}, nil
+}
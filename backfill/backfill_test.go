@@ -0,0 +1,458 @@
+package backfill
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	bsky "github.com/bluesky-social/indigo/api/bsky"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/bluesky-social/indigo/xrpc"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	car "github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// testPDS serves a single repo, the blocks written to it since any of its
+// commits, and any of its blocks by cid
+type testPDS struct {
+	t   *testing.T
+	did string
+
+	lk      sync.Mutex
+	bs      blockstore.Blockstore
+	r       *repo.Repo
+	head    cid.Cid
+	written map[cid.Cid]int
+	commits map[cid.Cid]int
+
+	// noIncremental makes fetches since a commit fail
+	noIncremental bool
+	// noBlocks makes fetches of blocks by cid fail
+	noBlocks bool
+}
+
+func newTestPDS(t *testing.T, did string) *testPDS {
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	return &testPDS{
+		t:       t,
+		did:     did,
+		bs:      bs,
+		r:       repo.NewRepo(context.Background(), did, bs),
+		written: make(map[cid.Cid]int),
+		commits: make(map[cid.Cid]int),
+	}
+}
+
+func (p *testPDS) put(rpath, text string) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	if _, err := p.r.PutRecord(context.Background(), rpath, &bsky.FeedPost{Text: text}); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+func (p *testPDS) delete(rpath string) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	if err := p.r.DeleteRecord(context.Background(), rpath); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+func (p *testPDS) edit(rpath, text string) {
+	p.lk.Lock()
+	err := p.r.DeleteRecord(context.Background(), rpath)
+	p.lk.Unlock()
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	p.put(rpath, text)
+}
+
+func (p *testPDS) commit() cid.Cid {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	ctx := context.Background()
+
+	root, err := p.r.Commit(ctx, func(context.Context, string, []byte) ([]byte, error) {
+		return []byte("sig"), nil
+	})
+	if err != nil {
+		p.t.Fatal(err)
+	}
+
+	n := len(p.commits)
+	p.commits[root] = n
+	keys, err := p.bs.AllKeysChan(ctx)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	for k := range keys {
+		if _, ok := p.written[k]; !ok {
+			p.written[k] = n
+		}
+	}
+	p.head = root
+
+	// the next commit only points back to this one once reopened at it
+	if p.r, err = repo.OpenRepo(ctx, p.bs, root, true); err != nil {
+		p.t.Fatal(err)
+	}
+	return root
+}
+
+func (p *testPDS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	ctx := context.Background()
+
+	if r.URL.Query().Get("did") != p.did {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(400)
+		w.Write([]byte(`{"error":"RepoTakendown","message":"repo has been taken down"}`))
+		return
+	}
+
+	if xrpc.RequestMethod(r) == "com.atproto.sync.getHead" {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"root":%q}`, p.head.String())
+		return
+	}
+
+	if xrpc.RequestMethod(r) == "com.atproto.sync.getBlocks" {
+		p.serveBlocks(w, r)
+		return
+	}
+
+	since := -1
+	if earliest := r.URL.Query().Get("earliest"); earliest != "" {
+		n, ok := p.commits[cid.MustParse(earliest)]
+		if !ok || p.noIncremental {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(500)
+			w.Write([]byte(`{"message":"finding early shard: record not found"}`))
+			return
+		}
+		since = n
+	}
+
+	buf := new(bytes.Buffer)
+	if err := car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{p.head}, Version: 1}, buf); err != nil {
+		p.t.Fatal(err)
+	}
+	for k, n := range p.written {
+		if n <= since {
+			continue
+		}
+		blk, err := p.bs.Get(ctx, k)
+		if err != nil {
+			p.t.Fatal(err)
+		}
+		if err := carutil.LdWrite(buf, k.Bytes(), blk.RawData()); err != nil {
+			p.t.Fatal(err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/vnd.ipld.car")
+	w.Write(buf.Bytes())
+}
+
+func (p *testPDS) serveBlocks(w http.ResponseWriter, r *http.Request) {
+	if p.noBlocks {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(501)
+		w.Write([]byte(`{"error":"MethodNotImplemented","message":"method not implemented"}`))
+		return
+	}
+
+	// like the reference PDS, with no roots
+	buf := new(bytes.Buffer)
+	if err := car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{}, Version: 1}, buf); err != nil {
+		p.t.Fatal(err)
+	}
+	for _, s := range strings.Split(r.URL.Query().Get("cids"), ",") {
+		c := cid.MustParse(s)
+		blk, err := p.bs.Get(context.Background(), c)
+		if err != nil {
+			continue
+		}
+		if err := carutil.LdWrite(buf, c.Bytes(), blk.RawData()); err != nil {
+			p.t.Fatal(err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/vnd.ipld.car")
+	w.Write(buf.Bytes())
+}
+
+type testBackfill struct {
+	t     *testing.T
+	store *GormStore
+	b     *Backfiller
+
+	lk sync.Mutex
+	// calls are the paths handled, with those of deletions prefixed
+	// with "-"
+	calls []string
+	// failAt makes the handler fail once for this path
+	failAt string
+}
+
+func newTestBackfill(t *testing.T) *testBackfill {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "backfill.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	tb := &testBackfill{t: t, store: NewGormStore(db, "test")}
+
+	opts := DefaultOptions()
+	opts.CheckpointInterval = 1
+	opts.MinBackoff = 0
+	opts.PollInterval = 10 * time.Millisecond
+	opts.HTTPClient = http.DefaultClient
+	tb.b = NewBackfiller("test", tb.store, tb.handle, opts)
+	tb.b.SetDeleteHandler(tb.handleDelete)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- tb.b.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+
+	return tb
+}
+
+func (tb *testBackfill) handle(ctx context.Context, did, path string, rcid cid.Cid, rec *lexutil.RawRecord) error {
+	tb.lk.Lock()
+	defer tb.lk.Unlock()
+
+	if _, ok := rec.Val.(*bsky.FeedPost); !ok {
+		return fmt.Errorf("unexpected record type %s", rec.Type)
+	}
+	tb.calls = append(tb.calls, path)
+	if path == tb.failAt {
+		tb.failAt = ""
+		return errors.New("temporarily broken")
+	}
+	return nil
+}
+
+func (tb *testBackfill) handleDelete(ctx context.Context, did, path string) error {
+	tb.lk.Lock()
+	defer tb.lk.Unlock()
+
+	tb.calls = append(tb.calls, "-"+path)
+	return nil
+}
+
+// handled returns the paths of the records handled since the last call
+func (tb *testBackfill) handled() []string {
+	tb.lk.Lock()
+	defer tb.lk.Unlock()
+
+	out := tb.calls
+	tb.calls = nil
+	return out
+}
+
+// wait waits for the job of did to complete or fail, and returns it
+func (tb *testBackfill) wait(did string) *Job {
+	tb.t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		j, err := tb.store.GetJob(context.Background(), did)
+		if err != nil {
+			tb.t.Fatal(err)
+		}
+		if j.State == StateComplete || j.State == StateFailed {
+			return j
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tb.t.Fatalf("timed out waiting for job of %s", did)
+	return nil
+}
+
+func postPaths(ns ...int) []string {
+	var out []string
+	for _, n := range ns {
+		out = append(out, fmt.Sprintf("app.bsky.feed.post/%04d", n))
+	}
+	return out
+}
+
+func TestBackfiller(t *testing.T) {
+	ctx := context.Background()
+
+	pds := newTestPDS(t, "did:plc:alice")
+	for i := 0; i < 5; i++ {
+		pds.put(postPaths(i)[0], fmt.Sprint(i))
+	}
+	pds.commit()
+	srv := httptest.NewServer(pds)
+	defer srv.Close()
+
+	tb := newTestBackfill(t)
+	tb.failAt = "app.bsky.feed.post/0002"
+	for _, did := range []string{"did:plc:alice", "did:plc:gone"} {
+		if err := tb.b.Enqueue(ctx, did, srv.URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	alice := tb.wait("did:plc:alice")
+	if alice.State != StateComplete || alice.Attempts != 1 {
+		t.Errorf("expected alice to complete on the second attempt, got %s after %d", alice.State, alice.Attempts)
+	}
+	if alice.Head != pds.head.String() || alice.Checkpoint != "" {
+		t.Errorf("expected head to be recorded and checkpoint cleared, got %q, %q", alice.Head, alice.Checkpoint)
+	}
+
+	// the retry resumes from the checkpoint after the last handled record
+	if got, want := tb.handled(), postPaths(0, 1, 2, 2, 3, 4); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected records handled: %v", got)
+	}
+
+	gone := tb.wait("did:plc:gone")
+	if gone.State != StateFailed || gone.Attempts != 1 || !strings.Contains(gone.LastError, "RepoTakendown") {
+		t.Errorf("expected taken down repo to fail without retries, got %s after %d: %s", gone.State, gone.Attempts, gone.LastError)
+	}
+}
+
+func TestResync(t *testing.T) {
+	ctx := context.Background()
+
+	pds := newTestPDS(t, "did:plc:alice")
+	for i := 0; i < 20; i++ {
+		pds.put(postPaths(i)[0], fmt.Sprint(i))
+	}
+	pds.commit()
+	srv := httptest.NewServer(pds)
+	defer srv.Close()
+
+	tb := newTestBackfill(t)
+	resync := func() *Job {
+		t.Helper()
+		if err := tb.b.Resync(ctx, "did:plc:alice", srv.URL); err != nil {
+			t.Fatal(err)
+		}
+		j := tb.wait("did:plc:alice")
+		if j.State != StateComplete || j.Head != pds.head.String() {
+			t.Fatalf("expected resync to complete at %s, got %s at %s: %s", pds.head, j.State, j.Head, j.LastError)
+		}
+		return j
+	}
+
+	// no job yet, so everything is fetched
+	resync()
+	if got := tb.handled(); len(got) != 20 {
+		t.Fatalf("expected whole repo to be handled, got %v", got)
+	}
+
+	// only what changed in the two commits since
+	pds.edit(postPaths(3)[0], "edited")
+	pds.commit()
+	pds.put(postPaths(25)[0], "new")
+	pds.commit()
+	resync()
+	if got, want := tb.handled(), postPaths(3, 25); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected only changed records to be handled, got %v", got)
+	}
+
+	// deletions are found by diffing against the tree at the old head
+	pds.delete(postPaths(4)[0])
+	pds.delete(postPaths(10)[0])
+	pds.commit()
+	pds.put(postPaths(27)[0], "newest")
+	pds.commit()
+	resync()
+	if got, want := tb.handled(), []string{"-" + postPaths(4)[0], "-" + postPaths(10)[0], postPaths(27)[0]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected deletions to be handled, got %v", got)
+	}
+
+	// nothing new
+	resync()
+	if got := tb.handled(); len(got) != 0 {
+		t.Errorf("expected no records to be handled, got %v", got)
+	}
+
+	// the PDS can no longer serve the commits since the head
+	pds.put(postPaths(26)[0], "newer")
+	pds.commit()
+	pds.noIncremental = true
+	resync()
+	if got := tb.handled(); len(got) != 21 {
+		t.Errorf("expected fallback to a whole repo fetch, got %v", got)
+	}
+
+	// or the nodes of the old tree
+	pds.noIncremental = false
+	pds.noBlocks = true
+	pds.delete(postPaths(26)[0])
+	pds.commit()
+	resync()
+	if got := tb.handled(); len(got) != 20 {
+		t.Errorf("expected fallback to a whole repo fetch, got %v", got)
+	}
+}
+
+func TestEnqueueExisting(t *testing.T) {
+	ctx := context.Background()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "backfill.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewGormStore(db, "test")
+	if created, err := store.EnqueueJob(ctx, "did:plc:alice", "https://pds.test"); err != nil || !created {
+		t.Fatalf("expected job to be created, got %v, %v", created, err)
+	}
+	if created, err := store.EnqueueJob(ctx, "did:plc:alice", "https://pds.test"); err != nil || created {
+		t.Fatalf("expected existing job to be left alone, got %v, %v", created, err)
+	}
+
+	// jobs of other backfillers are separate
+	if created, err := NewGormStore(db, "other").EnqueueJob(ctx, "did:plc:alice", "https://pds.test"); err != nil || !created {
+		t.Fatalf("expected job for another backfiller to be created, got %v, %v", created, err)
+	}
+}
+
+func TestPermanent(t *testing.T) {
+	err := fmt.Errorf("handling record: %w", Permanent(errors.New("bad record")))
+	if !IsPermanent(err) {
+		t.Error("expected wrapped permanent error to be permanent")
+	}
+	if IsPermanent(errors.New("timeout")) {
+		t.Error("expected plain errors to be retried")
+	}
+}
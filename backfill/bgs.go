@@ -0,0 +1,259 @@
+package backfill
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/bluesky-social/indigo/repo"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipld/go-car/v2"
+)
+
+// SnapshotSize is how many repos a bootstrap asks the BGS for at once, which
+// is also the most a BGS serves in one snapshot
+var SnapshotSize = 100
+
+// BGSClient uses the backfill API of a BGS, to list the repos it has and
+// fetch them in bulk instead of from each PDS
+type BGSClient struct {
+	// Host is the URL of the BGS, eg https://bgs.example.com
+	Host   string
+	Client *http.Client
+}
+
+// ListedRepo is a repo listed by a BGS
+type ListedRepo struct {
+	Did  string `json:"did"`
+	Head string `json:"head,omitempty"`
+	// Pds is the URL of the PDS hosting the repo, if the BGS knows it
+	Pds    string `json:"pds,omitempty"`
+	Active bool   `json:"active"`
+}
+
+// ListReposOutput is a page of repos listed by a BGS
+type ListReposOutput struct {
+	Cursor *string       `json:"cursor,omitempty"`
+	Repos  []*ListedRepo `json:"repos"`
+}
+
+func (c *BGSClient) client() *http.Client {
+	if c.Client == nil {
+		return http.DefaultClient
+	}
+	return c.Client
+}
+
+func (c *BGSClient) do(req *http.Request) (*http.Response, error) {
+	resp, err := c.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		defer resp.Body.Close()
+		var e struct {
+			Message string `json:"message"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&e)
+		return nil, fmt.Errorf("%s %s: status %d: %s", req.Method, req.URL.Path, resp.StatusCode, e.Message)
+	}
+	return resp, nil
+}
+
+// ListRepos lists a page of the repos on the BGS, after cursor. If host is
+// set, only repos on the PDS with that hostname are listed, and if
+// activeOnly is, only those that have not been taken down.
+func (c *BGSClient) ListRepos(ctx context.Context, cursor string, limit int, host string, activeOnly bool) (*ListReposOutput, error) {
+	q := url.Values{}
+	if cursor != "" {
+		q.Set("cursor", cursor)
+	}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	if host != "" {
+		q.Set("host", host)
+	}
+	if activeOnly {
+		q.Set("active", "true")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.Host+"/backfill/listRepos?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var out ListReposOutput
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("decoding repo list: %w", err)
+	}
+	return &out, nil
+}
+
+// GetSnapshot fetches the repos of dids in a single request, and returns
+// them by DID. Repos the BGS does not have, or will not serve, are missing
+// from the result.
+func (c *BGSClient) GetSnapshot(ctx context.Context, dids []string) (map[string]*repo.Repo, map[string]cid.Cid, error) {
+	body, err := json.Marshal(map[string][]string{"dids": dids})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.Host+"/backfill/getSnapshot", bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	carb, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading snapshot: %w", err)
+	}
+
+	// a snapshot is a CAR file with the head commit of each repo as a root
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	br, err := car.NewBlockReader(bytes.NewReader(carb))
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading snapshot: %w", err)
+	}
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading snapshot: %w", err)
+		}
+		if err := bs.Put(ctx, blk); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	repos := make(map[string]*repo.Repo)
+	heads := make(map[string]cid.Cid)
+	for _, root := range br.Roots {
+		r, err := repo.OpenRepo(ctx, bs, root, false)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading snapshot repo %s: %w", root, err)
+		}
+		repos[r.RepoDid()] = r
+		heads[r.RepoDid()] = root
+	}
+	return repos, heads, nil
+}
+
+// Bootstrap backfills the repos the BGS has, on the PDS with hostname host
+// or on all of them if it is empty. Repos are fetched from the BGS in
+// snapshots, and those left out of a snapshot are enqueued to be fetched
+// from their PDS by Run. Repos whose job has already run are skipped, so an
+// interrupted bootstrap can just be run again.
+func (b *Backfiller) Bootstrap(ctx context.Context, bgs *BGSClient, host string) error {
+	var cursor string
+	for {
+		page, err := bgs.ListRepos(ctx, cursor, SnapshotSize, host, true)
+		if err != nil {
+			return fmt.Errorf("listing repos: %w", err)
+		}
+
+		if err := b.bootstrapRepos(ctx, bgs, page.Repos); err != nil {
+			return err
+		}
+
+		if page.Cursor == nil {
+			return nil
+		}
+		cursor = *page.Cursor
+	}
+}
+
+func (b *Backfiller) bootstrapRepos(ctx context.Context, bgs *BGSClient, listed []*ListedRepo) error {
+	var jobs []*Job
+	var dids []string
+	for _, lr := range listed {
+		pds := lr.Pds
+		if pds == "" {
+			// the BGS serves the repo itself, if nothing else does
+			pds = bgs.Host
+		}
+
+		created, err := b.store.EnqueueJob(ctx, lr.Did, pds)
+		if err != nil {
+			return err
+		}
+		if created {
+			jobsEnqueued.WithLabelValues(b.name).Inc()
+		}
+
+		// jobs left enqueued by an earlier bootstrap are taken up again
+		j, err := b.store.GetJob(ctx, lr.Did)
+		if err != nil {
+			return err
+		}
+		if j.State != StateEnqueued || !b.claim(j.Repo, "") {
+			continue
+		}
+		jobs = append(jobs, j)
+		dids = append(dids, j.Repo)
+	}
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	// jobs that are not handled here are left enqueued for Run
+	defer b.poke()
+	defer func() {
+		for _, j := range jobs {
+			b.release(j.Repo, "")
+		}
+	}()
+
+	start := time.Now()
+	repos, heads, err := bgs.GetSnapshot(ctx, dids)
+	if err != nil {
+		return fmt.Errorf("fetching snapshot: %w", err)
+	}
+	repoFetchDuration.WithLabelValues(b.name, "snapshot").Observe(time.Since(start).Seconds())
+
+	for _, j := range jobs {
+		r, ok := repos[j.Repo]
+		if !ok {
+			continue
+		}
+
+		j.State = StateRunning
+		if err := b.store.UpdateJob(ctx, j); err != nil {
+			return err
+		}
+
+		jstart := time.Now()
+		err := b.handleRecords(ctx, j, &recordSource{
+			head:    heads[j.Repo],
+			bs:      r.Blockstore(),
+			forEach: r.ForEach,
+		})
+		b.finishJob(ctx, j, err, jstart)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package backfill
+
+import (
+	"errors"
+
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+// permanentError marks a failure that retrying the job will not fix
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent wraps err so that the job it fails is not retried. Handlers use
+// it for records they will never be able to handle.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent reports whether err, or an error it wraps, was marked with
+// Permanent
+func IsPermanent(err error) bool {
+	var pe *permanentError
+	return errors.As(err, &pe)
+}
+
+// permanentFetchErrors are the errors a PDS answers getRepo with that will
+// not go away by asking again. Anything else, like timeouts or 5xx
+// responses, is retried.
+var permanentFetchErrors = map[string]bool{
+	"InvalidRequest":  true,
+	"RepoNotFound":    true,
+	"RepoDeactivated": true,
+	"RepoSuspended":   true,
+	"RepoTakendown":   true,
+	"RepoDeleted":     true,
+}
+
+func classifyFetchError(err error) error {
+	var xe *xrpc.XRPCError
+	if errors.As(err, &xe) && permanentFetchErrors[xe.ErrStr] {
+		return Permanent(err)
+	}
+	return err
+}
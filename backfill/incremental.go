@@ -0,0 +1,216 @@
+package backfill
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/mst"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/xrpc"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipld/go-car/v2"
+)
+
+// fetchSince fetches the commits written to the repo of j since its head,
+// and returns the records created, changed or deleted by them, found by
+// diffing the tree at the head against the new one. It returns nil if the
+// PDS can not serve those commits, or the nodes of the old tree the diff
+// needs, in which case the whole repo has to be fetched.
+func (b *Backfiller) fetchSince(ctx context.Context, c *xrpc.Client, j *Job) (*recordSource, error) {
+	since, err := cid.Decode(j.Head)
+	if err != nil {
+		log.Warnw("invalid head for backfill job, fetching whole repo", "backfiller", b.name, "did", j.Repo, "head", j.Head, "err", err)
+		return nil, nil
+	}
+
+	// asking for the commits since the current head is an error, so check
+	// for that first
+	head, err := comatproto.SyncGetHead(ctx, c, j.Repo)
+	if err != nil {
+		return nil, classifyFetchError(fmt.Errorf("fetching repo head: %w", err))
+	}
+	if head.Root == j.Head {
+		return &recordSource{head: since, forEach: noRecords}, nil
+	}
+
+	start := time.Now()
+	carb, err := comatproto.SyncGetRepo(ctx, c, j.Repo, j.Head, "")
+	if err != nil {
+		var xe *xrpc.XRPCError
+		if errors.As(err, &xe) && !permanentFetchErrors[xe.ErrStr] {
+			// the PDS is there, but does not have the commits since the head
+			// any more, or can not serve them separately
+			log.Infow("incremental fetch failed, fetching whole repo", "backfiller", b.name, "did", j.Repo, "head", j.Head, "err", err)
+			return nil, nil
+		}
+		return nil, classifyFetchError(fmt.Errorf("fetching repo since %s: %w", j.Head, err))
+	}
+	repoFetchDuration.WithLabelValues(b.name, "incremental").Observe(time.Since(start).Seconds())
+
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	root, err := repo.IngestRepo(ctx, bs, bytes.NewReader(carb))
+	if err != nil {
+		return nil, Permanent(fmt.Errorf("reading repo since %s: %w", j.Head, err))
+	}
+
+	data, ok, err := dataSince(ctx, bs, root, since)
+	if err != nil {
+		return nil, Permanent(err)
+	}
+	if !ok {
+		log.Infow("incremental fetch does not reach back to head, fetching whole repo", "backfiller", b.name, "did", j.Repo, "head", j.Head)
+		return nil, nil
+	}
+
+	// the fetch only has the nodes written since the head, so those of the
+	// old tree are fetched as the diff comes to them
+	fbs := &fetchingBlockstore{Blockstore: bs, c: c, did: j.Repo}
+
+	var sc repo.SignedCommit
+	if err := util.CborStore(fbs).Get(ctx, since, &sc); err != nil {
+		return b.oldTreeUnavailable(j, err)
+	}
+	ops, err := mst.DiffTrees(ctx, fbs, sc.Data, data)
+	if err != nil {
+		return b.oldTreeUnavailable(j, err)
+	}
+
+	return &recordSource{
+		head: root,
+		bs:   fbs,
+		forEach: func(ctx context.Context, from string, cb func(k string, v cid.Cid) error) error {
+			i := sort.Search(len(ops), func(i int) bool { return ops[i].Rpath >= from })
+			for _, op := range ops[i:] {
+				// deletions are passed with no cid
+				if err := cb(op.Rpath, op.NewCid); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}, nil
+}
+
+// oldTreeUnavailable handles err from diffing against the tree at the head
+// of j, falling back to fetching the whole repo if the PDS could not serve
+// the nodes needed
+func (b *Backfiller) oldTreeUnavailable(j *Job, err error) (*recordSource, error) {
+	var fe *blockFetchError
+	if !errors.As(err, &fe) {
+		return nil, Permanent(fmt.Errorf("diffing against tree at %s: %w", j.Head, err))
+	}
+
+	var xe *xrpc.XRPCError
+	if errors.As(err, &xe) && permanentFetchErrors[xe.ErrStr] {
+		return nil, classifyFetchError(err)
+	}
+	log.Infow("could not fetch tree at head, fetching whole repo", "backfiller", b.name, "did", j.Repo, "head", j.Head, "err", err)
+	return nil, nil
+}
+
+// blockFetchError is a failure to fetch a block from the PDS
+type blockFetchError struct {
+	c   cid.Cid
+	err error
+}
+
+func (e *blockFetchError) Error() string {
+	return fmt.Sprintf("fetching block %s: %s", e.c, e.err)
+}
+
+func (e *blockFetchError) Unwrap() error {
+	return e.err
+}
+
+// fetchingBlockstore fetches the blocks of a repo it does not have from the
+// PDS, and keeps them
+type fetchingBlockstore struct {
+	blockstore.Blockstore
+
+	c   *xrpc.Client
+	did string
+}
+
+func (fbs *fetchingBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	has, err := fbs.Blockstore.Has(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if has {
+		return fbs.Blockstore.Get(ctx, c)
+	}
+
+	carb, err := comatproto.SyncGetBlocks(ctx, fbs.c, []string{c.String()}, fbs.did)
+	if err != nil {
+		return nil, &blockFetchError{c: c, err: err}
+	}
+	// getBlocks CARs may have no roots, which IngestRepo does not allow
+	br, err := car.NewBlockReader(bytes.NewReader(carb))
+	if err != nil {
+		return nil, &blockFetchError{c: c, err: err}
+	}
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, &blockFetchError{c: c, err: err}
+		}
+		if err := fbs.Blockstore.Put(ctx, blk); err != nil {
+			return nil, err
+		}
+	}
+
+	blk, err := fbs.Blockstore.Get(ctx, c)
+	if err != nil {
+		return nil, &blockFetchError{c: c, err: err}
+	}
+	return blk, nil
+}
+
+func noRecords(ctx context.Context, from string, cb func(k string, v cid.Cid) error) error {
+	return nil
+}
+
+// dataSince follows the commits in bs back from root, and returns the tree
+// of root if they lead back to since. ok is false if some commit in between
+// is missing.
+func dataSince(ctx context.Context, bs blockstore.Blockstore, root, since cid.Cid) (data cid.Cid, ok bool, err error) {
+	cst := util.CborStore(bs)
+
+	for c := root; c != since; {
+		has, err := bs.Has(ctx, c)
+		if err != nil {
+			return cid.Undef, false, err
+		}
+		if !has {
+			return cid.Undef, false, nil
+		}
+
+		var sc repo.SignedCommit
+		if err := cst.Get(ctx, c, &sc); err != nil {
+			return cid.Undef, false, fmt.Errorf("reading commit %s: %w", c, err)
+		}
+		if c == root {
+			data = sc.Data
+		}
+		if sc.Prev == nil {
+			return cid.Undef, false, nil
+		}
+		c = *sc.Prev
+	}
+
+	return data, true, nil
+}
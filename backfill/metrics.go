@@ -0,0 +1,49 @@
+package backfill
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var jobsEnqueued = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "backfill_jobs_enqueued_total",
+	Help: "Total number of backfill jobs created, by backfiller",
+}, []string{"backfiller"})
+
+var jobsRunning = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "backfill_jobs_running",
+	Help: "Number of backfill jobs running, by backfiller",
+}, []string{"backfiller"})
+
+var jobsFinished = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "backfill_job_runs_total",
+	Help: "Total number of backfill job runs, by backfiller and result (complete, retry, failed or interrupted)",
+}, []string{"backfiller", "result"})
+
+var jobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "backfill_job_duration_seconds",
+	Help:    "Duration of backfill job runs, by backfiller and result",
+	Buckets: prometheus.ExponentialBuckets(0.1, 2, 14),
+}, []string{"backfiller", "result"})
+
+var repoFetchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "backfill_repo_fetch_duration_seconds",
+	Help:    "Duration of successful repo fetches, by backfiller and mode (full or incremental)",
+	Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+}, []string{"backfiller", "mode"})
+
+var incrementalFallbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "backfill_incremental_fallbacks_total",
+	Help: "Total number of resyncs that had to fetch the whole repo, by backfiller",
+}, []string{"backfiller"})
+
+var rateLimitWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "backfill_rate_limit_wait_seconds",
+	Help:    "Time jobs waited on the per-PDS rate limit before fetching a repo, by backfiller",
+	Buckets: prometheus.ExponentialBuckets(0.01, 2, 14),
+}, []string{"backfiller"})
+
+var recordsHandled = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "backfill_records_handled_total",
+	Help: "Total number of records passed to the handler, by backfiller",
+}, []string{"backfiller"})
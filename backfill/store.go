@@ -0,0 +1,141 @@
+package backfill
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// job states. Jobs waiting on a retry are enqueued, with RetryAfter set.
+const (
+	StateEnqueued = "enqueued"
+	StateRunning  = "running"
+	StateComplete = "complete"
+	StateFailed   = "failed"
+)
+
+// Job is the backfill of a single repo
+type Job struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	// Backfiller is the name of the backfiller the job belongs to
+	Backfiller string `gorm:"uniqueIndex:idx_backfill_job_repo;index:idx_backfill_job_due"`
+	Repo       string `gorm:"uniqueIndex:idx_backfill_job_repo"`
+	PDS        string
+
+	State      string     `gorm:"index:idx_backfill_job_due"`
+	RetryAfter *time.Time `gorm:"index:idx_backfill_job_due"`
+
+	// Head is the commit the repo was last backfilled up to, which resyncs
+	// fetch the commits since
+	Head string
+
+	// Checkpoint is the path of the last record handled and saved by a run
+	// that has not finished. Records are handled in path order, so the job
+	// resumes after it.
+	Checkpoint string
+	Attempts   int
+	LastError  string
+}
+
+func (Job) TableName() string {
+	return "backfill_jobs"
+}
+
+// Store persists jobs
+type Store interface {
+	// EnqueueJob creates an enqueued job for did, and reports whether it did
+	// so; a repo with a job in any state already is left alone
+	EnqueueJob(ctx context.Context, did, pds string) (bool, error)
+	GetJob(ctx context.Context, did string) (*Job, error)
+	// GetDueJobs returns up to limit enqueued jobs that are not waiting on
+	// a retry at now, oldest first
+	GetDueJobs(ctx context.Context, now time.Time, limit int) ([]*Job, error)
+	// RequeueJob enqueues the job for did again if it is complete or has
+	// failed, creating it if there is none
+	RequeueJob(ctx context.Context, did, pds string) error
+	UpdateJob(ctx context.Context, j *Job) error
+	// ResetRunning enqueues jobs that were running, to resume them after a
+	// restart
+	ResetRunning(ctx context.Context) error
+}
+
+// GormStore keeps the jobs of a backfiller in a database table shared with
+// other backfillers
+type GormStore struct {
+	db   *gorm.DB
+	name string
+}
+
+// NewGormStore returns a store for the jobs of the backfiller called name.
+// The Job table has to be migrated first, see Migrate.
+func NewGormStore(db *gorm.DB, name string) *GormStore {
+	return &GormStore{db: db, name: name}
+}
+
+// Migrate creates or updates the jobs table
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(&Job{})
+}
+
+func (s *GormStore) EnqueueJob(ctx context.Context, did, pds string) (bool, error) {
+	res := s.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&Job{
+		Backfiller: s.name,
+		Repo:       did,
+		PDS:        pds,
+		State:      StateEnqueued,
+	})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected > 0, nil
+}
+
+func (s *GormStore) GetJob(ctx context.Context, did string) (*Job, error) {
+	var j Job
+	if err := s.db.WithContext(ctx).Where("backfiller = ? AND repo = ?", s.name, did).First(&j).Error; err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+func (s *GormStore) GetDueJobs(ctx context.Context, now time.Time, limit int) ([]*Job, error) {
+	var jobs []*Job
+	if err := s.db.WithContext(ctx).
+		Where("backfiller = ? AND state = ? AND (retry_after IS NULL OR retry_after <= ?)", s.name, StateEnqueued, now).
+		Order("id").Limit(limit).Find(&jobs).Error; err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func (s *GormStore) RequeueJob(ctx context.Context, did, pds string) error {
+	created, err := s.EnqueueJob(ctx, did, pds)
+	if err != nil || created {
+		return err
+	}
+
+	return s.db.WithContext(ctx).Model(&Job{}).
+		Where("backfiller = ? AND repo = ? AND state IN ?", s.name, did, []string{StateComplete, StateFailed}).
+		Updates(map[string]any{
+			"pds":         pds,
+			"state":       StateEnqueued,
+			"retry_after": nil,
+			"attempts":    0,
+			"last_error":  "",
+		}).Error
+}
+
+func (s *GormStore) UpdateJob(ctx context.Context, j *Job) error {
+	return s.db.WithContext(ctx).Select("*").Omit("created_at").Save(j).Error
+}
+
+func (s *GormStore) ResetRunning(ctx context.Context) error {
+	return s.db.WithContext(ctx).Model(&Job{}).
+		Where("backfiller = ? AND state = ?", s.name, StateRunning).
+		Update("state", StateEnqueued).Error
+}
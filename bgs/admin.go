@@ -2,12 +2,15 @@ package bgs
 
 import (
 	"errors"
-	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/identity"
 	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/util/invalidation"
+	"github.com/bluesky-social/indigo/util/xrpcerr"
 	"github.com/labstack/echo/v4"
 	dto "github.com/prometheus/client_model/go"
 	"gorm.io/gorm"
@@ -20,10 +23,7 @@ func (bgs *BGS) handleAdminBlockRepoStream(e echo.Context) error {
 func (bgs *BGS) handleAdminSetSubsEnabled(e echo.Context) error {
 	enabled, err := strconv.ParseBool(e.QueryParam("enabled"))
 	if err != nil {
-		return &echo.HTTPError{
-			Code:    400,
-			Message: err.Error(),
-		}
+		return xrpcerr.InvalidRequest("%s", err)
 	}
 
 	return bgs.slurper.SetNewSubsDisabled(!enabled)
@@ -44,24 +44,15 @@ func (bgs *BGS) handleAdminTakeDownRepo(e echo.Context) error {
 	}
 	did, ok := body["did"]
 	if !ok {
-		return &echo.HTTPError{
-			Code:    400,
-			Message: "must specify did parameter in body",
-		}
+		return xrpcerr.InvalidRequest("must specify did parameter in body")
 	}
 
 	err := bgs.TakeDownRepo(ctx, did)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return &echo.HTTPError{
-				Code:    http.StatusNotFound,
-				Message: "repo not found",
-			}
-		}
-		return &echo.HTTPError{
-			Code:    http.StatusInternalServerError,
-			Message: err.Error(),
+			return xrpcerr.NotFound("repo not found")
 		}
+		return xrpcerr.Internal(err)
 	}
 	return nil
 }
@@ -73,15 +64,9 @@ func (bgs *BGS) handleAdminReverseTakedown(e echo.Context) error {
 
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return &echo.HTTPError{
-				Code:    http.StatusNotFound,
-				Message: "repo not found",
-			}
-		}
-		return &echo.HTTPError{
-			Code:    http.StatusInternalServerError,
-			Message: err.Error(),
+			return xrpcerr.NotFound("repo not found")
 		}
+		return xrpcerr.Internal(err)
 	}
 
 	return nil
@@ -131,6 +116,7 @@ type consumer struct {
 	ID             uint64    `json:"id"`
 	RemoteAddr     string    `json:"remote_addr"`
 	UserAgent      string    `json:"user_agent"`
+	Subscriber     string    `json:"subscriber"`
 	EventsConsumed uint64    `json:"events_consumed"`
 	ConnectedAt    time.Time `json:"connected_at"`
 }
@@ -149,6 +135,7 @@ func (bgs *BGS) handleAdminListConsumers(e echo.Context) error {
 			ID:             id,
 			RemoteAddr:     c.RemoteAddr,
 			UserAgent:      c.UserAgent,
+			Subscriber:     c.Subscriber,
 			EventsConsumed: uint64(m.Counter.GetValue()),
 			ConnectedAt:    c.ConnectedAt,
 		})
@@ -157,23 +144,102 @@ func (bgs *BGS) handleAdminListConsumers(e echo.Context) error {
 	return e.JSON(200, consumers)
 }
 
+// handleAdminGetConsumerUsage returns the events and bytes sent to each
+// subscriber, across their connections, since they were last idle for
+// events.SubscriberIdleTimeout
+func (bgs *BGS) handleAdminGetConsumerUsage(e echo.Context) error {
+	return e.JSON(200, bgs.bandwidth.Usage())
+}
+
+// handleAdminSetConsumerCap sets the bandwidth cap of a subscriber, on this
+// instance only. Replicas each have their own caps.
+func (bgs *BGS) handleAdminSetConsumerCap(e echo.Context) error {
+	var body struct {
+		Subscriber string `json:"subscriber"`
+		Cap        *int64 `json:"cap"`
+	}
+	if err := e.Bind(&body); err != nil {
+		return err
+	}
+	if body.Subscriber == "" {
+		return xrpcerr.InvalidRequest("must specify subscriber parameter in body")
+	}
+	if body.Cap != nil && *body.Cap < 0 {
+		return xrpcerr.InvalidRequest("cap must not be negative")
+	}
+
+	bgs.bandwidth.SetCap(body.Subscriber, body.Cap)
+	return nil
+}
+
+func (bgs *BGS) handleAdminCreateConsumerToken(e echo.Context) error {
+	var body map[string]string
+	if err := e.Bind(&body); err != nil {
+		return err
+	}
+	name, ok := body["name"]
+	if !ok || name == "" {
+		return xrpcerr.InvalidRequest("must specify name parameter in body")
+	}
+
+	tok, err := bgs.CreateSubscriberToken(name)
+	if err != nil {
+		return err
+	}
+
+	return e.JSON(200, map[string]string{
+		"subscriber": "token:" + name,
+		"token":      tok,
+	})
+}
+
+func (bgs *BGS) handleAdminListConsumerPolicies(e echo.Context) error {
+	policies, err := bgs.subscribers.Policies(e.Request().Context())
+	if err != nil {
+		return err
+	}
+
+	return e.JSON(200, policies)
+}
+
+// handleAdminSetConsumerPolicy sets the policy of an authenticated
+// subscriber, or removes it if the policy is null. Policies apply from the
+// subscriber's next connection.
+func (bgs *BGS) handleAdminSetConsumerPolicy(e echo.Context) error {
+	var body struct {
+		Subscriber string                     `json:"subscriber"`
+		Policy     *events.SubscriptionPolicy `json:"policy"`
+	}
+	if err := e.Bind(&body); err != nil {
+		return err
+	}
+	if body.Subscriber == "" {
+		return xrpcerr.InvalidRequest("must specify subscriber parameter in body")
+	}
+
+	if err := bgs.subscribers.SetPolicy(e.Request().Context(), body.Subscriber, body.Policy); err != nil {
+		if errors.Is(err, events.ErrInvalidPolicy) {
+			return xrpcerr.InvalidRequest("%s", err)
+		}
+		return err
+	}
+
+	return e.JSON(200, map[string]any{
+		"success": "true",
+	})
+}
+
 func (bgs *BGS) handleAdminKillUpstreamConn(e echo.Context) error {
 	host := strings.TrimSpace(e.QueryParam("host"))
 	if host == "" {
-		return &echo.HTTPError{
-			Code:    400,
-			Message: "must pass a valid host",
-		}
+		return xrpcerr.InvalidRequest("must pass a valid host")
 	}
 
 	block := strings.ToLower(e.QueryParam("block")) == "true"
 
 	if err := bgs.slurper.KillUpstreamConnection(host, block); err != nil {
 		if errors.Is(err, ErrNoActiveConnection) {
-			return &echo.HTTPError{
-				Code:    400,
-				Message: "no active connection to given host",
-			}
+			return xrpcerr.InvalidRequest("no active connection to given host")
 		}
 		return err
 	}
@@ -186,10 +252,7 @@ func (bgs *BGS) handleAdminKillUpstreamConn(e echo.Context) error {
 func (bgs *BGS) handleBlockPDS(e echo.Context) error {
 	host := strings.TrimSpace(e.QueryParam("host"))
 	if host == "" {
-		return &echo.HTTPError{
-			Code:    400,
-			Message: "must pass a valid host",
-		}
+		return xrpcerr.InvalidRequest("must pass a valid host")
 	}
 
 	// Set the block flag to true in the DB
@@ -205,10 +268,7 @@ func (bgs *BGS) handleBlockPDS(e echo.Context) error {
 func (bgs *BGS) handleUnblockPDS(e echo.Context) error {
 	host := strings.TrimSpace(e.QueryParam("host"))
 	if host == "" {
-		return &echo.HTTPError{
-			Code:    400,
-			Message: "must pass a valid host",
-		}
+		return xrpcerr.InvalidRequest("must pass a valid host")
 	}
 
 	// Set the block flag to false in the DB
@@ -254,10 +314,7 @@ func (bgs *BGS) handleAdminBanDomain(c echo.Context) error {
 	// Check if the domain is already banned
 	var existing models.DomainBan
 	if err := bgs.db.Where("domain = ?", body.Domain).First(&existing).Error; err == nil {
-		return &echo.HTTPError{
-			Code:    400,
-			Message: "domain is already banned",
-		}
+		return xrpcerr.InvalidRequest("domain is already banned")
 	}
 
 	if err := bgs.db.Create(&models.DomainBan{
@@ -285,3 +342,93 @@ func (bgs *BGS) handleAdminUnbanDomain(c echo.Context) error {
 		"success": "true",
 	})
 }
+
+// cachingResolver returns the BGS's identity resolver, if it caches
+func (bgs *BGS) cachingResolver() (*identity.Resolver, error) {
+	r, ok := bgs.didr.(*identity.Resolver)
+	if !ok {
+		return nil, xrpcerr.MethodNotImplemented("identities are not cached by this BGS")
+	}
+	return r, nil
+}
+
+// claimedHandles returns the handles claimed by a cached DID document
+func claimedHandles(e *identity.Entry) []string {
+	handles := []string{}
+	if e == nil || e.Doc == nil {
+		return handles
+	}
+	for _, aka := range e.Doc.AlsoKnownAs {
+		if h, ok := strings.CutPrefix(aka, "at://"); ok {
+			handles = append(handles, strings.ToLower(h))
+		}
+	}
+	return handles
+}
+
+type cachedIdentity struct {
+	Did     string                     `json:"did"`
+	Doc     *identity.Entry            `json:"doc"`
+	Handles map[string]*identity.Entry `json:"handles"`
+}
+
+func (bgs *BGS) handleAdminGetIdentity(e echo.Context) error {
+	ctx := e.Request().Context()
+	did := e.QueryParam("did")
+	if did == "" {
+		return xrpcerr.InvalidRequest("must specify did parameter")
+	}
+
+	r, err := bgs.cachingResolver()
+	if err != nil {
+		return err
+	}
+
+	doc, err := r.CachedDid(ctx, did)
+	if err != nil {
+		return err
+	}
+	out := cachedIdentity{
+		Did:     did,
+		Doc:     doc,
+		Handles: make(map[string]*identity.Entry),
+	}
+	for _, h := range claimedHandles(doc) {
+		he, err := r.CachedHandle(ctx, h)
+		if err != nil {
+			return err
+		}
+		out.Handles[h] = he
+	}
+
+	return e.JSON(200, out)
+}
+
+func (bgs *BGS) handleAdminFlushIdentity(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	var body map[string]string
+	if err := e.Bind(&body); err != nil {
+		return err
+	}
+	did, ok := body["did"]
+	if !ok {
+		return xrpcerr.InvalidRequest("must specify did parameter in body")
+	}
+
+	if _, err := bgs.cachingResolver(); err != nil {
+		return err
+	}
+
+	handles, err := bgs.purgeIdentity(ctx, did)
+	if err != nil {
+		return err
+	}
+	// other services may have cached the same stale identity
+	bgs.publishInvalidation(ctx, invalidation.IdentityChanged(invalidationSource, did, ""))
+
+	return e.JSON(200, map[string]any{
+		"success": "true",
+		"handles": handles,
+	})
+}
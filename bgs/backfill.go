@@ -0,0 +1,268 @@
+package bgs
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+
+	comatprototypes "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/util/xrpcerr"
+
+	"github.com/ipfs/go-cid"
+	car "github.com/ipld/go-car"
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	"gorm.io/gorm"
+)
+
+// The backfill API lets new consumers bootstrap from the BGS instead of
+// fetching every repo from its PDS: /backfill/listRepos lists the repos the
+// BGS has, with their head and the PDS they are on, and
+// /backfill/getSnapshot returns many of them in a single CAR file.
+
+// MaxSnapshotRepos is the most repos that can be asked for in one snapshot
+var MaxSnapshotRepos = 100
+
+// ListedRepo is a repo as listed by the backfill API
+type ListedRepo struct {
+	Did  string `json:"did"`
+	Head string `json:"head,omitempty"`
+	// Pds is the URL of the PDS hosting the repo, if known
+	Pds string `json:"pds,omitempty"`
+	// Active is false for repos that have been taken down, which have no
+	// head listed
+	Active bool `json:"active"`
+}
+
+type listReposOutput struct {
+	Cursor *string       `json:"cursor,omitempty"`
+	Repos  []*ListedRepo `json:"repos"`
+}
+
+// listRepos lists repos in the order they were first seen, starting after
+// cursor. If host is set, only repos on the PDS with that hostname are
+// listed, and if activeOnly is, only repos that have not been taken down.
+func (bgs *BGS) listRepos(ctx context.Context, cursor string, limit int, host string, activeOnly bool) (*listReposOutput, error) {
+	ctx, span := otel.Tracer("bgs").Start(ctx, "listRepos")
+	defer span.End()
+
+	if limit < 1 || limit > 1000 {
+		return nil, xrpcerr.InvalidRequest("limit must be between 1 and 1000")
+	}
+
+	var after uint64
+	if cursor != "" {
+		c, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return nil, xrpcerr.InvalidRequest("invalid cursor")
+		}
+		after = c
+	}
+
+	q := bgs.db.WithContext(ctx).Model(&User{}).Where("id > ?", after)
+	if host != "" {
+		var pds models.PDS
+		if err := bgs.db.WithContext(ctx).Find(&pds, "host = ?", host).Error; err != nil {
+			return nil, err
+		}
+		if pds.ID == 0 {
+			return &listReposOutput{Repos: []*ListedRepo{}}, nil
+		}
+		q = q.Where("pds = ?", pds.ID)
+	}
+	if activeOnly {
+		q = q.Where("taken_down = ?", false)
+	}
+
+	var users []User
+	if err := q.Order("id").Limit(limit).Find(&users).Error; err != nil {
+		return nil, err
+	}
+
+	pdsURLs, err := bgs.pdsURLs(ctx, users)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &listReposOutput{Repos: []*ListedRepo{}}
+	for _, u := range users {
+		lr := &ListedRepo{
+			Did:    u.Did,
+			Pds:    pdsURLs[u.PDS],
+			Active: !u.TakenDown,
+		}
+
+		if lr.Active {
+			head, err := bgs.repoman.GetRepoRoot(ctx, u.ID)
+			if err != nil {
+				return nil, fmt.Errorf("getting head of %s: %w", u.Did, err)
+			}
+			if !head.Defined() {
+				// nothing stored for the repo yet
+				continue
+			}
+			lr.Head = head.String()
+		}
+
+		out.Repos = append(out.Repos, lr)
+	}
+
+	if len(users) == limit {
+		next := strconv.FormatUint(uint64(users[len(users)-1].ID), 10)
+		out.Cursor = &next
+	}
+
+	return out, nil
+}
+
+// pdsURLs returns the URLs of the PDSs users are on, by PDS id
+func (bgs *BGS) pdsURLs(ctx context.Context, users []User) (map[uint]string, error) {
+	var ids []uint
+	for _, u := range users {
+		if u.PDS != 0 {
+			ids = append(ids, u.PDS)
+		}
+	}
+
+	out := make(map[uint]string)
+	if len(ids) == 0 {
+		return out, nil
+	}
+
+	var hosts []models.PDS
+	if err := bgs.db.WithContext(ctx).Find(&hosts, "id IN ?", ids).Error; err != nil {
+		return nil, err
+	}
+	for _, h := range hosts {
+		out[h.ID] = models.ClientForPds(&h).Host
+	}
+	return out, nil
+}
+
+func (bgs *BGS) handleBackfillListRepos(e echo.Context) error {
+	limit := 500
+	if p := e.QueryParam("limit"); p != "" {
+		l, err := strconv.Atoi(p)
+		if err != nil {
+			return xrpcerr.InvalidRequest("invalid limit")
+		}
+		limit = l
+	}
+
+	var activeOnly bool
+	if p := e.QueryParam("active"); p != "" {
+		a, err := strconv.ParseBool(p)
+		if err != nil {
+			return xrpcerr.InvalidRequest("invalid active filter")
+		}
+		activeOnly = a
+	}
+
+	out, err := bgs.listRepos(e.Request().Context(), e.QueryParam("cursor"), limit, e.QueryParam("host"), activeOnly)
+	if err != nil {
+		return err
+	}
+	return e.JSON(200, out)
+}
+
+type getSnapshotBody struct {
+	Dids []string `json:"dids"`
+}
+
+// handleBackfillGetSnapshot writes the repos asked for as a single CAR file,
+// with the head commit of each as a root. Repos that are unknown or taken
+// down are left out, so clients have to check which roots they got.
+func (bgs *BGS) handleBackfillGetSnapshot(e echo.Context) error {
+	ctx, span := otel.Tracer("bgs").Start(e.Request().Context(), "handleBackfillGetSnapshot")
+	defer span.End()
+
+	var body getSnapshotBody
+	if err := e.Bind(&body); err != nil {
+		return err
+	}
+	if len(body.Dids) == 0 || len(body.Dids) > MaxSnapshotRepos {
+		return xrpcerr.InvalidRequest("must ask for between 1 and %d repos", MaxSnapshotRepos)
+	}
+
+	var users []*User
+	var roots []cid.Cid
+	for _, did := range body.Dids {
+		u, err := bgs.lookupUserByDid(ctx, did)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				continue
+			}
+			return err
+		}
+		if u.TakenDown {
+			continue
+		}
+
+		head, err := bgs.repoman.GetRepoRoot(ctx, u.ID)
+		if err != nil {
+			return fmt.Errorf("getting head of %s: %w", did, err)
+		}
+		if !head.Defined() {
+			continue
+		}
+
+		users = append(users, u)
+		roots = append(roots, head)
+	}
+
+	if len(roots) == 0 {
+		return xrpcerr.NotFound("none of the repos asked for are available")
+	}
+
+	e.Response().Header().Set(echo.HeaderContentType, "application/vnd.ipld.car")
+	e.Response().WriteHeader(200)
+	if err := car.WriteHeader(&car.CarHeader{Roots: roots, Version: 1}, e.Response()); err != nil {
+		return err
+	}
+
+	// the repos are read one at a time, and their blocks copied without the
+	// header of their own CAR. Failures past this point can only cut the
+	// response short, which clients see as a truncated CAR.
+	for i, u := range users {
+		buf := new(bytes.Buffer)
+		if err := bgs.repoman.ReadRepo(ctx, u.ID, cid.Undef, roots[i], buf); err != nil {
+			log.Errorw("failed to read repo for snapshot", "did", u.Did, "err", err)
+			return nil
+		}
+
+		hlen, n := binary.Uvarint(buf.Bytes())
+		if n <= 0 || uint64(buf.Len()-n) < hlen {
+			log.Errorw("invalid CAR header reading repo for snapshot", "did", u.Did)
+			return nil
+		}
+		if _, err := e.Response().Write(buf.Bytes()[n+int(hlen):]); err != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+// handleComAtprotoSyncListRepos is listRepos as specified in the lexicon,
+// which only lists active repos
+func (s *BGS) handleComAtprotoSyncListRepos(ctx context.Context, cursor string, limit int) (*comatprototypes.SyncListRepos_Output, error) {
+	lo, err := s.listRepos(ctx, cursor, limit, "", true)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &comatprototypes.SyncListRepos_Output{
+		Cursor: lo.Cursor,
+		Repos:  []*comatprototypes.SyncListRepos_Repo{},
+	}
+	for _, r := range lo.Repos {
+		out.Repos = append(out.Repos, &comatprototypes.SyncListRepos_Repo{
+			Did:  r.Did,
+			Head: r.Head,
+		})
+	}
+	return out, nil
+}
@@ -12,6 +12,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"contrib.go.opencensus.io/exporter/prometheus"
@@ -24,12 +25,19 @@ import (
 	"github.com/bluesky-social/indigo/events"
 	"github.com/bluesky-social/indigo/indexer"
 	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/lex/validate"
 	"github.com/bluesky-social/indigo/models"
 	"github.com/bluesky-social/indigo/repomgr"
-	"github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/rules"
+	"github.com/bluesky-social/indigo/util/invalidation"
+	"github.com/bluesky-social/indigo/util/logutil"
+	"github.com/bluesky-social/indigo/util/serviceauth"
+	"github.com/bluesky-social/indigo/util/syntax"
+	"github.com/bluesky-social/indigo/util/xrpcerr"
 	"github.com/bluesky-social/indigo/xrpc"
 
 	"github.com/gorilla/websocket"
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log"
 	"github.com/labstack/echo/v4"
@@ -43,6 +51,9 @@ import (
 
 var log = logging.Logger("bgs")
 
+// logger is for structured logs carrying the fields of the event being handled
+var logger = logutil.Logger("bgs")
+
 // serverListenerBootTimeout is how long to wait for the requested server socket
 // to become available for use. This is an arbitrary timeout that should be safe
 // on any platform, but there's no great way to weave this timeout without
@@ -66,31 +77,140 @@ type BGS struct {
 
 	crawlOnly bool
 
+	// replica is set for BGSs which serve another's data read-only, see
+	// NewReplicaBGS
+	replica bool
+
 	// TODO: at some point we will want to lock specific DIDs, this lock as is
 	// is overly broad, but i dont expect it to be a bottleneck for now
 	extUserLk sync.Mutex
 
 	repoman *repomgr.RepoManager
 
+	echo *echo.Echo
+
 	// Management of Socket Consumers
 	consumersLk    sync.RWMutex
 	nextConsumerID uint64
 	consumers      map[uint64]*SocketConsumer
+
+	// bandwidth accounts for what is sent to each firehose subscriber
+	bandwidth *events.BandwidthTracker
+
+	// subscribers are the tokens and policies of firehose subscribers, who
+	// are authenticated with subscriberAuth
+	subscribers    *events.SubscriberDB
+	subscriberAuth events.SubscriptionAuth
+
+	// rules checked against the records of incoming commits, if set
+	rules atomic.Pointer[rules.Engine]
+
+	// verifier checks incoming commits before they are stored, if set
+	verifier atomic.Pointer[commitVerifier]
+
+	// seenCommits are the commits handled recently, by repo and commit CID,
+	// so that commits arriving from more than one upstream relay are only
+	// handled once
+	seenCommits *lru.Cache
+
+	// requestValidator checks XRPC calls against their lexicons, if set
+	requestValidator *validate.Validator
+
+	// invalidations tells other services of handle changes and takedowns,
+	// if set
+	invalidations invalidation.Bus
 }
 
+// SeenCommitsCacheSize is how many recent commits are remembered, to drop
+// those arriving again from another upstream
+const SeenCommitsCacheSize = 200_000
+
 type SocketConsumer struct {
 	UserAgent   string
 	RemoteAddr  string
 	ConnectedAt time.Time
 	EventsSent  promclient.Counter
+
+	// Subscriber is who the consumer's usage is accounted to
+	Subscriber string
+}
+
+// SetSubscriberBandwidthCap caps the rate events are sent to each firehose
+// subscriber at, in bytes per second, unless capped otherwise through the
+// admin API. Zero means no cap.
+func (bgs *BGS) SetSubscriberBandwidthCap(bytesPerSec int64) {
+	bgs.bandwidth.SetDefaultCap(bytesPerSec)
+}
+
+// SetSubscriptionAuth has firehose subscribers authenticating with service
+// auth tokens (see com.atproto.server.getServiceAuth) checked with v, or
+// refused if v is nil, and refuses subscribers which don't authenticate if
+// require is set. Service auth subscribers without a policy are treated as
+// anonymous, as any account can get a token. Subscribers may always
+// authenticate with tokens created with CreateSubscriberToken. Must be called
+// before StartWithListener.
+func (bgs *BGS) SetSubscriptionAuth(v *serviceauth.Validator, require bool) {
+	bgs.subscriberAuth.ServiceAuth = v
+	bgs.subscriberAuth.RequireAuth = require
+}
+
+// SetAnonymousSubscriptionPolicy applies p to firehose subscribers which
+// don't authenticate. Without one they are refused once any subscriber has a
+// policy. Must be called before StartWithListener.
+func (bgs *BGS) SetAnonymousSubscriptionPolicy(p *events.SubscriptionPolicy) {
+	bgs.subscriberAuth.Anonymous = p
+}
+
+// SetRequestValidator has the parameters and JSON inputs of XRPC calls
+// checked against their lexicons before they are handled. Must be called
+// before StartWithListener.
+func (bgs *BGS) SetRequestValidator(v *validate.Validator) {
+	bgs.requestValidator = v
+}
+
+// Migrate creates or updates the tables the BGS keeps in its database, which
+// NewBGS does itself. It's there to migrate without starting a BGS.
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(User{}, AuthToken{}, models.SubscriberToken{}, models.SubscriberPolicy{}, models.PDS{}, models.DomainBan{}, &SlurpConfig{})
 }
 
 func NewBGS(db *gorm.DB, ix *indexer.Indexer, repoman *repomgr.RepoManager, evtman *events.EventManager, didr did.Resolver, blobs blobs.BlobStore, hr api.HandleResolver, ssl bool) (*BGS, error) {
-	db.AutoMigrate(User{})
-	db.AutoMigrate(AuthToken{})
-	db.AutoMigrate(models.PDS{})
-	db.AutoMigrate(models.DomainBan{})
+	if err := Migrate(db); err != nil {
+		return nil, err
+	}
 
+	bgs := newBGS(db, ix, repoman, evtman, didr, blobs, hr, ssl)
+
+	ix.CreateExternalUser = bgs.createExternalUser
+	s, err := NewSlurper(db, bgs.handleFedEvent, ssl)
+	if err != nil {
+		return nil, err
+	}
+
+	bgs.slurper = s
+
+	if err := bgs.slurper.RestartAll(); err != nil {
+		return nil, err
+	}
+
+	return bgs, nil
+}
+
+// NewReplicaBGS returns a BGS which serves the sync endpoints and the firehose
+// of an ingesting BGS, from a read replica of its database and its carstore,
+// so that read traffic can be scaled separately from ingestion. It never
+// subscribes to PDSs or writes to the database: requestCrawl and the admin
+// endpoints which change anything are refused, and have to be sent to the
+// ingesting BGS. evtman should be backed by an events.ReplicaPersistence,
+// repoman by a carstore.NewReadOnlyCarStore, and ix should not crawl.
+func NewReplicaBGS(db *gorm.DB, ix *indexer.Indexer, repoman *repomgr.RepoManager, evtman *events.EventManager, didr did.Resolver, blobs blobs.BlobStore, hr api.HandleResolver, ssl bool) (*BGS, error) {
+	bgs := newBGS(db, ix, repoman, evtman, didr, blobs, hr, ssl)
+	bgs.replica = true
+	return bgs, nil
+}
+
+func newBGS(db *gorm.DB, ix *indexer.Indexer, repoman *repomgr.RepoManager, evtman *events.EventManager, didr did.Resolver, blobs blobs.BlobStore, hr api.HandleResolver, ssl bool) *BGS {
+	seen, _ := lru.New(SeenCommitsCacheSize)
 	bgs := &BGS{
 		Index: ix,
 		db:    db,
@@ -105,25 +225,46 @@ func NewBGS(db *gorm.DB, ix *indexer.Indexer, repoman *repomgr.RepoManager, evtm
 
 		consumersLk: sync.RWMutex{},
 		consumers:   make(map[uint64]*SocketConsumer),
-	}
+		bandwidth:   events.NewBandwidthTracker(0),
+		subscribers: events.NewSubscriberDB(db),
 
-	ix.CreateExternalUser = bgs.createExternalUser
-	s, err := NewSlurper(db, bgs.handleFedEvent, ssl)
-	if err != nil {
-		return nil, err
+		seenCommits: seen,
 	}
+	bgs.subscriberAuth.Subscribers = bgs.subscribers
+	return bgs
+}
 
-	bgs.slurper = s
+// AddUpstreamRelay subscribes to the firehose of another relay, instead of (or
+// as well as) to PDSs directly. With more than one upstream relay, each commit
+// is handled once, from whichever relay it arrives from first, so that events
+// keep arriving while any of them is up.
+func (bgs *BGS) AddUpstreamRelay(ctx context.Context, host string) error {
+	log.Infow("subscribing to upstream relay", "host", host)
+	return bgs.slurper.SubscribeToRelay(ctx, host)
+}
 
-	if err := bgs.slurper.RestartAll(); err != nil {
-		return nil, err
-	}
+// errorMappings are the errors handlers may return which aren't XRPC errors
+// already. Lookups of repos and hosts which aren't known end in
+// ErrRecordNotFound.
+var errorMappings = []xrpcerr.Mapping{
+	xrpcerr.Map(gorm.ErrRecordNotFound, http.StatusNotFound, xrpcerr.NameNotFound),
+}
 
-	return bgs, nil
+// ingestOnly refuses requests to endpoints which only the ingesting BGS can
+// serve, on replicas
+func (bgs *BGS) ingestOnly(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(e echo.Context) error {
+		if bgs.replica {
+			return xrpcerr.MethodNotImplemented("this BGS is a read-only replica, send the request to the ingesting BGS")
+		}
+		return next(e)
+	}
 }
 
-func (bgs *BGS) StartDebug(listen string) error {
-	http.HandleFunc("/repodbg/user", func(w http.ResponseWriter, r *http.Request) {
+// RegisterDebugHandlers adds the /repodbg endpoints, for inspecting and
+// crawling repos, to the debug listener's mux
+func (bgs *BGS) RegisterDebugHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/repodbg/user", func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 		did := r.FormValue("did")
 
@@ -155,7 +296,12 @@ func (bgs *BGS) StartDebug(listen string) error {
 
 		json.NewEncoder(w).Encode(out)
 	})
-	http.HandleFunc("/repodbg/crawl", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/repodbg/crawl", func(w http.ResponseWriter, r *http.Request) {
+		if bgs.replica {
+			http.Error(w, "replicas don't crawl", http.StatusNotImplemented)
+			return
+		}
+
 		ctx := r.Context()
 		did := r.FormValue("did")
 
@@ -172,7 +318,7 @@ func (bgs *BGS) StartDebug(listen string) error {
 			return
 		}
 	})
-	http.HandleFunc("/repodbg/blocks", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/repodbg/blocks", func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 		did := r.FormValue("did")
 		c := r.FormValue("cid")
@@ -206,8 +352,6 @@ func (bgs *BGS) StartDebug(listen string) error {
 		w.WriteHeader(200)
 		w.Write(blk.RawData())
 	})
-
-	return http.ListenAndServe(listen, nil)
 }
 
 func (bgs *BGS) Start(addr string) error {
@@ -225,6 +369,7 @@ func (bgs *BGS) Start(addr string) error {
 func (bgs *BGS) StartWithListener(listen net.Listener) error {
 	e := echo.New()
 	e.HideBanner = true
+	bgs.echo = e
 
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
 		AllowOrigins: []string{"http://localhost:*", "https://bgs.bsky-sandbox.dev"},
@@ -240,6 +385,10 @@ func (bgs *BGS) StartWithListener(listen net.Listener) error {
 	}
 
 	e.Use(MetricsMiddleware)
+	e.Use(echo.WrapMiddleware(logutil.Middleware))
+	if bgs.requestValidator != nil {
+		e.Use(validate.RequestMiddleware(bgs.requestValidator))
+	}
 
 	// React uses a virtual router, so we need to serve the index.html for all
 	// routes that aren't otherwise handled or in the /assets directory.
@@ -247,27 +396,7 @@ func (bgs *BGS) StartWithListener(listen net.Listener) error {
 	e.File("/dash/*", "/public/index.html")
 	e.Static("/assets", "/public/assets")
 
-	e.HTTPErrorHandler = func(err error, ctx echo.Context) {
-		switch err := err.(type) {
-		case *echo.HTTPError:
-			if err2 := ctx.JSON(err.Code, map[string]any{
-				"error": err.Message,
-			}); err2 != nil {
-				log.Errorf("Failed to write http error: %s", err2)
-			}
-		default:
-			sendHeader := true
-			if ctx.Path() == "/xrpc/com.atproto.sync.subscribeRepos" {
-				sendHeader = false
-			}
-
-			log.Warnf("HANDLER ERROR: (%s) %s", ctx.Path(), err)
-
-			if sendHeader {
-				ctx.Response().WriteHeader(500)
-			}
-		}
-	}
+	e.HTTPErrorHandler = xrpcerr.ErrorHandler(logger, errorMappings...)
 
 	// TODO: this API is temporary until we formalize what we want here
 
@@ -278,11 +407,16 @@ func (bgs *BGS) StartWithListener(listen net.Listener) error {
 	e.GET("/xrpc/com.atproto.sync.getRecord", bgs.HandleComAtprotoSyncGetRecord)
 	e.GET("/xrpc/com.atproto.sync.getRepo", bgs.HandleComAtprotoSyncGetRepo)
 	e.GET("/xrpc/com.atproto.sync.getBlocks", bgs.HandleComAtprotoSyncGetBlocks)
-	e.GET("/xrpc/com.atproto.sync.requestCrawl", bgs.HandleComAtprotoSyncRequestCrawl)
-	e.POST("/xrpc/com.atproto.sync.requestCrawl", bgs.HandleComAtprotoSyncRequestCrawl)
-	e.GET("/xrpc/com.atproto.sync.notifyOfUpdate", bgs.HandleComAtprotoSyncNotifyOfUpdate)
+	e.GET("/xrpc/com.atproto.sync.listRepos", bgs.HandleComAtprotoSyncListRepos)
+	e.GET("/xrpc/com.atproto.sync.requestCrawl", bgs.HandleComAtprotoSyncRequestCrawl, bgs.ingestOnly)
+	e.POST("/xrpc/com.atproto.sync.requestCrawl", bgs.HandleComAtprotoSyncRequestCrawl, bgs.ingestOnly)
+	e.GET("/xrpc/com.atproto.sync.notifyOfUpdate", bgs.HandleComAtprotoSyncNotifyOfUpdate, bgs.ingestOnly)
 	e.GET("/xrpc/_health", bgs.HandleHealthCheck)
 
+	// Backfill API, for consumers bootstrapping from the BGS
+	e.GET("/backfill/listRepos", bgs.handleBackfillListRepos)
+	e.POST("/backfill/getSnapshot", bgs.handleBackfillGetSnapshot)
+
 	promh := prometheusHandler()
 	e.GET("/metrics", func(e echo.Context) error {
 		promh.ServeHTTP(e.Response().Writer, e.Request())
@@ -291,41 +425,73 @@ func (bgs *BGS) StartWithListener(listen net.Listener) error {
 
 	admin := e.Group("/admin", bgs.checkAdminAuth)
 
+	admin.GET("/log/getLevels", echo.WrapHandler(logutil.LevelsHandler()))
+	admin.POST("/log/setLevels", echo.WrapHandler(logutil.LevelsHandler()))
+
 	// Slurper-related Admin API
-	admin.GET("/subs/getUpstreamConns", bgs.handleAdminGetUpstreamConns)
-	admin.GET("/subs/getEnabled", bgs.handleAdminGetSubsEnabled)
-	admin.POST("/subs/setEnabled", bgs.handleAdminSetSubsEnabled)
-	admin.POST("/subs/killUpstream", bgs.handleAdminKillUpstreamConn)
+	admin.GET("/subs/getUpstreamConns", bgs.handleAdminGetUpstreamConns, bgs.ingestOnly)
+	admin.GET("/subs/getEnabled", bgs.handleAdminGetSubsEnabled, bgs.ingestOnly)
+	admin.POST("/subs/setEnabled", bgs.handleAdminSetSubsEnabled, bgs.ingestOnly)
+	admin.POST("/subs/killUpstream", bgs.handleAdminKillUpstreamConn, bgs.ingestOnly)
 
 	// Domain-related Admin API
 	admin.GET("/subs/listDomainBans", bgs.handleAdminListDomainBans)
-	admin.POST("/subs/banDomain", bgs.handleAdminBanDomain)
-	admin.POST("/subs/unbanDomain", bgs.handleAdminUnbanDomain)
+	admin.POST("/subs/banDomain", bgs.handleAdminBanDomain, bgs.ingestOnly)
+	admin.POST("/subs/unbanDomain", bgs.handleAdminUnbanDomain, bgs.ingestOnly)
 
 	// Repo-related Admin API
-	admin.POST("/repo/takeDown", bgs.handleAdminTakeDownRepo)
-	admin.POST("/repo/reverseTakedown", bgs.handleAdminReverseTakedown)
+	admin.POST("/repo/takeDown", bgs.handleAdminTakeDownRepo, bgs.ingestOnly)
+	admin.POST("/repo/reverseTakedown", bgs.handleAdminReverseTakedown, bgs.ingestOnly)
 
 	// PDS-related Admin API
-	admin.GET("/pds/list", bgs.handleListPDSs)
-	admin.POST("/pds/block", bgs.handleBlockPDS)
-	admin.POST("/pds/unblock", bgs.handleUnblockPDS)
+	admin.GET("/pds/list", bgs.handleListPDSs, bgs.ingestOnly)
+	admin.POST("/pds/block", bgs.handleBlockPDS, bgs.ingestOnly)
+	admin.POST("/pds/unblock", bgs.handleUnblockPDS, bgs.ingestOnly)
 
 	// Consumer-related Admin API
 	admin.GET("/consumers/list", bgs.handleAdminListConsumers)
+	admin.GET("/consumers/usage", bgs.handleAdminGetConsumerUsage)
+	admin.POST("/consumers/setCap", bgs.handleAdminSetConsumerCap)
+	admin.POST("/consumers/createToken", bgs.handleAdminCreateConsumerToken, bgs.ingestOnly)
+	admin.GET("/consumers/policies", bgs.handleAdminListConsumerPolicies)
+	admin.POST("/consumers/setPolicy", bgs.handleAdminSetConsumerPolicy, bgs.ingestOnly)
+
+	// Identity-related Admin API
+	admin.GET("/identity/get", bgs.handleAdminGetIdentity)
+	admin.POST("/identity/flush", bgs.handleAdminFlushIdentity)
 
 	// In order to support booting on random ports in tests, we need to tell the
 	// Echo instance it's already got a port, and then use its StartServer
 	// method to re-use that listener.
 	e.Listener = listen
-	srv := &http.Server{}
-	return e.StartServer(srv)
+	return e.StartServer(e.Server)
 }
 
-func (bgs *BGS) Shutdown() []error {
-	errs := bgs.slurper.Shutdown()
+// Shutdown stops accepting requests, drains the upstream subscriptions and
+// saves their cursors, flushes the event persister, and then closes the
+// connections of downstream consumers.
+func (bgs *BGS) Shutdown(ctx context.Context) []error {
+	var errs []error
+	if bgs.echo != nil {
+		// websocket connections are hijacked, so this doesn't wait for them
+		if err := bgs.echo.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("stopping http server: %w", err))
+		}
+	}
+
+	if bgs.slurper != nil {
+		errs = append(errs, bgs.slurper.Shutdown()...)
+	}
 
-	if err := bgs.events.Shutdown(context.TODO()); err != nil {
+	if cv := bgs.verifier.Load(); cv != nil {
+		cv.shutdown()
+	}
+
+	if err := bgs.events.Shutdown(ctx); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := bgs.events.CloseSubscribers(ctx); err != nil {
 		errs = append(errs, err)
 	}
 
@@ -364,6 +530,12 @@ func (bgs *BGS) lookupAdminToken(tok string) (bool, error) {
 	return true, nil
 }
 
+// CreateSubscriberToken creates a token for a firehose subscriber to
+// authenticate with, replacing any it had before
+func (bgs *BGS) CreateSubscriberToken(name string) (string, error) {
+	return bgs.subscribers.CreateToken(context.TODO(), name)
+}
+
 func (bgs *BGS) CreateAdminToken(tok string) error {
 	exists, err := bgs.lookupAdminToken(tok)
 	if err != nil {
@@ -462,11 +634,25 @@ func (bgs *BGS) EventsHandler(c echo.Context) error {
 		}
 		since = &sval
 	}
+	sample, err := events.ParseSample(c.QueryParam(events.SampleParam))
+	if err != nil {
+		return xrpcerr.InvalidRequest("%s", err)
+	}
+
+	// subscribers which don't authenticate are accounted for by address
+	subscriber, policy, err := bgs.subscriberAuth.Authenticate(c.Request().Context(), c.Request().Header.Get("Authorization"), "com.atproto.sync.subscribeRepos")
+	if err != nil {
+		return err
+	}
+	if subscriber == "" {
+		subscriber = c.RealIP() + "-" + c.Request().UserAgent()
+	}
+
+	since, outdated := policy.Cursor(since, bgs.events.LastSeq())
 
 	ctx, cancel := context.WithCancel(c.Request().Context())
 	defer cancel()
 
-	// TODO: authhhh
 	conn, err := websocket.Upgrade(c.Response(), c.Request(), c.Response().Header(), 10<<10, 10<<10)
 	if err != nil {
 		return fmt.Errorf("upgrading websocket: %w", err)
@@ -527,6 +713,13 @@ func (bgs *BGS) EventsHandler(c echo.Context) error {
 	}()
 
 	ident := c.RealIP() + "-" + c.Request().UserAgent()
+	var policyCap *int64
+	if policy != nil {
+		policyCap = policy.BandwidthCap
+	}
+	bgs.bandwidth.SetPolicyCap(subscriber, policyCap)
+	usage, disconnect := bgs.bandwidth.Connect(subscriber)
+	defer disconnect()
 
 	evts, cleanup, err := bgs.events.Subscribe(ctx, ident, func(evt *events.XRPCStreamEvent) bool { return true }, since)
 	if err != nil {
@@ -539,6 +732,7 @@ func (bgs *BGS) EventsHandler(c echo.Context) error {
 		RemoteAddr:  c.RealIP(),
 		UserAgent:   c.Request().UserAgent(),
 		ConnectedAt: time.Now(),
+		Subscriber:  subscriber,
 	}
 	sentCounter := eventsSentCounter.WithLabelValues(consumer.RemoteAddr, consumer.UserAgent)
 	consumer.EventsSent = sentCounter
@@ -550,60 +744,95 @@ func (bgs *BGS) EventsHandler(c echo.Context) error {
 		"remote_addr", consumer.RemoteAddr,
 		"user_agent", consumer.UserAgent,
 		"cursor", since,
+		"sample", sample.Rate(),
 		"consumer_id", consumerID,
+		"subscriber", subscriber,
 	)
 
+	// subscribers whose cursor was moved forward are told so first
+	var next *events.XRPCStreamEvent
+	if outdated {
+		msg := fmt.Sprintf("cursor is further back than this subscriber may replay, sending from %d", *since)
+		next = &events.XRPCStreamEvent{RepoInfo: &comatproto.SyncSubscribeRepos_Info{
+			Name:    "OutdatedCursor",
+			Message: &msg,
+		}}
+	}
+
 	header := events.EventHeader{Op: events.EvtKindMessage}
 	for {
-		select {
-		case evt := <-evts:
-			wc, err := conn.NextWriter(websocket.BinaryMessage)
-			if err != nil {
-				log.Errorf("failed to get next writer: %s", err)
-				return err
+		evt := next
+		next = nil
+		if evt == nil {
+			select {
+			case evt = <-evts:
+			case <-bgs.events.Closing():
+				if err := events.CloseWebsocket(conn, websocket.CloseGoingAway, "server shutting down"); err != nil {
+					log.Warnw("failed to close consumer connection", "consumer_id", consumerID, "err", err)
+				}
+				return nil
+			case <-ctx.Done():
+				return nil
 			}
+		}
 
-			var obj lexutil.CBOR
-
-			switch {
-			case evt.Error != nil:
-				header.Op = events.EvtKindErrorFrame
-				obj = evt.Error
-			case evt.RepoCommit != nil:
-				header.MsgType = "#commit"
-				obj = evt.RepoCommit
-			case evt.RepoHandle != nil:
-				header.MsgType = "#handle"
-				obj = evt.RepoHandle
-			case evt.RepoInfo != nil:
-				header.MsgType = "#info"
-				obj = evt.RepoInfo
-			case evt.RepoMigrate != nil:
-				header.MsgType = "#migrate"
-				obj = evt.RepoMigrate
-			case evt.RepoTombstone != nil:
-				header.MsgType = "#tombstone"
-				obj = evt.RepoTombstone
-			default:
-				return fmt.Errorf("unrecognized event kind")
-			}
+		if evt = sample.Filter(policy.Filter(evt)); evt == nil {
+			continue
+		}
 
-			if err := header.MarshalCBOR(wc); err != nil {
-				return fmt.Errorf("failed to write header: %w", err)
-			}
+		wc, err := conn.NextWriter(websocket.BinaryMessage)
+		if err != nil {
+			log.Errorf("failed to get next writer: %s", err)
+			return err
+		}
 
-			if err := obj.MarshalCBOR(wc); err != nil {
-				return fmt.Errorf("failed to write event: %w", err)
-			}
+		var obj lexutil.CBOR
+
+		switch {
+		case evt.Error != nil:
+			header.Op = events.EvtKindErrorFrame
+			obj = evt.Error
+		case evt.RepoCommit != nil:
+			header.MsgType = "#commit"
+			obj = evt.RepoCommit
+		case evt.RepoHandle != nil:
+			header.MsgType = "#handle"
+			obj = evt.RepoHandle
+		case evt.RepoInfo != nil:
+			header.MsgType = "#info"
+			obj = evt.RepoInfo
+		case evt.RepoMigrate != nil:
+			header.MsgType = "#migrate"
+			obj = evt.RepoMigrate
+		case evt.RepoTombstone != nil:
+			header.MsgType = "#tombstone"
+			obj = evt.RepoTombstone
+		case evt.RepoAccount != nil:
+			header.MsgType = "#account"
+			obj = evt.RepoAccount
+		default:
+			return fmt.Errorf("unrecognized event kind")
+		}
 
-			if err := wc.Close(); err != nil {
-				return fmt.Errorf("failed to flush-close our event write: %w", err)
-			}
-			lastWriteLk.Lock()
-			lastWrite = time.Now()
-			lastWriteLk.Unlock()
-			sentCounter.Inc()
-		case <-ctx.Done():
+		cw := &events.CountingWriter{W: wc}
+		if err := header.MarshalCBOR(cw); err != nil {
+			return fmt.Errorf("failed to write header: %w", err)
+		}
+
+		if err := obj.MarshalCBOR(cw); err != nil {
+			return fmt.Errorf("failed to write event: %w", err)
+		}
+
+		if err := wc.Close(); err != nil {
+			return fmt.Errorf("failed to flush-close our event write: %w", err)
+		}
+		lastWriteLk.Lock()
+		lastWrite = time.Now()
+		lastWriteLk.Unlock()
+		sentCounter.Inc()
+
+		// holds subscribers over their cap back from the next event
+		if err := usage.Sent(ctx, cw.N); err != nil {
 			return nil
 		}
 	}
@@ -700,7 +929,7 @@ func stringLink(lnk *lexutil.LexLink) string {
 	return lnk.String()
 }
 
-func (bgs *BGS) handleFedEvent(ctx context.Context, host *models.PDS, env *events.XRPCStreamEvent) error {
+func (bgs *BGS) handleFedEvent(ctx context.Context, host *models.PDS, env *events.XRPCStreamEvent) (rerr error) {
 	ctx, span := otel.Tracer("bgs").Start(ctx, "handleFedEvent")
 	defer span.End()
 
@@ -710,7 +939,24 @@ func (bgs *BGS) handleFedEvent(ctx context.Context, host *models.PDS, env *event
 	case env.RepoCommit != nil:
 		repoCommitsReceivedCounter.WithLabelValues(host.Host).Add(1)
 		evt := env.RepoCommit
-		log.Infow("bgs got repo append event", "seq", evt.Seq, "host", host.Host, "repo", evt.Repo)
+		ctx = logutil.WithFields(ctx, "did", evt.Repo, "seq", evt.Seq, "host", host.Host)
+		logger.InfoCtx(ctx, "bgs got repo append event")
+
+		// this version of the firehose has no revs, so commits are told
+		// apart by their CID
+		seenKey := evt.Repo + " " + evt.Commit.String()
+		if seen, _ := bgs.seenCommits.ContainsOrAdd(seenKey, true); seen {
+			duplicateCommitsCounter.WithLabelValues(host.Host).Add(1)
+			logger.DebugCtx(ctx, "dropping commit already received from another upstream")
+			return nil
+		}
+		// a commit we failed to handle may yet be handled from another
+		// upstream
+		defer func() {
+			if rerr != nil {
+				bgs.seenCommits.Remove(seenKey)
+			}
+		}()
 		u, err := bgs.lookupUserByDid(ctx, evt.Repo)
 		if err != nil {
 			if !errors.Is(err, gorm.ErrRecordNotFound) {
@@ -725,10 +971,12 @@ func (bgs *BGS) handleFedEvent(ctx context.Context, host *models.PDS, env *event
 			u = new(User)
 			u.ID = subj.Uid
 			u.Did = evt.Repo
+			u.PDS = subj.PDS
+			u.CreatedAt = time.Now()
 		}
 
 		if u.TakenDown {
-			log.Infow("dropping event from taken down user", "did", evt.Repo, "seq", evt.Seq, "host", host.Host)
+			logger.InfoCtx(ctx, "dropping event from taken down user")
 			return nil
 		}
 
@@ -751,8 +999,14 @@ func (bgs *BGS) handleFedEvent(ctx context.Context, host *models.PDS, env *event
 			return bgs.Index.Crawler.AddToCatchupQueue(ctx, host, ai, evt)
 		}
 
-		if err := bgs.repoman.HandleExternalUserEvent(ctx, host.ID, u.ID, u.Did, (*cid.Cid)(evt.Prev), evt.Blocks, evt.Ops); err != nil {
-			log.Warnw("failed handling event", "err", err, "host", host.Host, "seq", evt.Seq, "repo", u.Did, "prev", stringLink(evt.Prev), "commit", evt.Commit.String())
+		verified, err := bgs.verifyCommit(ctx, u, evt)
+		if err != nil {
+			logger.WarnCtx(ctx, "commit failed verification", "err", err, "prev", stringLink(evt.Prev), "commit", evt.Commit.String())
+			return fmt.Errorf("verifying commit: %w", err)
+		}
+
+		if err := bgs.handleCommit(ctx, host, u, evt, verified); err != nil {
+			logger.WarnCtx(ctx, "failed handling event", "err", err, "prev", stringLink(evt.Prev), "commit", evt.Commit.String())
 
 			if errors.Is(err, carstore.ErrRepoBaseMismatch) {
 				ai, err := bgs.Index.LookupUser(ctx, u.ID)
@@ -766,7 +1020,7 @@ func (bgs *BGS) handleFedEvent(ctx context.Context, host *models.PDS, env *event
 			}
 
 			if errors.Is(err, carstore.ErrRepoFork) {
-				log.Errorw("detected repo fork", "from", stringLink(evt.Prev), "host", host.Host, "repo", u.Did)
+				logger.ErrorCtx(ctx, "detected repo fork", "from", stringLink(evt.Prev))
 
 				span.SetAttributes(attribute.Bool("catchup_queue", true))
 				span.SetAttributes(attribute.Bool("fork", true))
@@ -777,13 +1031,22 @@ func (bgs *BGS) handleFedEvent(ctx context.Context, host *models.PDS, env *event
 			return fmt.Errorf("handle user event failed: %w", err)
 		}
 
+		bgs.applyRules(ctx, u, evt)
+
 		// sync blobs
 		if len(evt.Blobs) > 0 {
 			var blobStrs []string
 			for _, b := range evt.Blobs {
 				blobStrs = append(blobStrs, b.String())
 			}
-			if err := bgs.syncUserBlobs(ctx, host, u.ID, blobStrs); err != nil {
+			blobHost := host
+			if host.Relay {
+				// relays don't serve blobs, the repo's PDS does
+				if blobHost, err = bgs.userPDS(ctx, u); err != nil {
+					return err
+				}
+			}
+			if err := bgs.syncUserBlobs(ctx, blobHost, u.ID, blobStrs); err != nil {
 				return err
 			}
 		}
@@ -792,6 +1055,11 @@ func (bgs *BGS) handleFedEvent(ctx context.Context, host *models.PDS, env *event
 	case env.RepoHandle != nil:
 
 		// TODO: ignoring the data in the message and just going out to the DID doc
+		// the cached document names the old handle, so it has to be resolved again
+		if _, err := bgs.purgeIdentity(ctx, env.RepoHandle.Did); err != nil {
+			log.Warnw("failed to purge cached identity", "did", env.RepoHandle.Did, "err", err)
+		}
+
 		act, err := bgs.createExternalUser(ctx, env.RepoHandle.Did)
 		if err != nil {
 			return err
@@ -813,6 +1081,15 @@ func (bgs *BGS) handleFedEvent(ctx context.Context, host *models.PDS, env *event
 	}
 }
 
+// userPDS loads the PDS the user is on
+func (bgs *BGS) userPDS(ctx context.Context, u *User) (*models.PDS, error) {
+	var pds models.PDS
+	if err := bgs.db.WithContext(ctx).First(&pds, u.PDS).Error; err != nil {
+		return nil, fmt.Errorf("loading pds of user: %w", err)
+	}
+	return &pds, nil
+}
+
 func (s *BGS) syncUserBlobs(ctx context.Context, pds *models.PDS, user models.Uid, blobs []string) error {
 	if s.blobs == nil {
 		log.Debugf("blob syncing disabled")
@@ -916,25 +1193,9 @@ func (s *BGS) createExternalUser(ctx context.Context, did string) (*models.Actor
 		panic("somehow failed to create a pds entry?")
 	}
 
-	if len(doc.AlsoKnownAs) == 0 {
-		return nil, fmt.Errorf("user has no 'known as' field in their DID document")
-	}
-
-	hurl, err := url.Parse(doc.AlsoKnownAs[0])
-	if err != nil {
-		return nil, err
-	}
-
-	handle := hurl.Host
-
-	resdid, err := s.hr.ResolveHandleToDid(ctx, handle)
-	if err != nil {
-		return nil, fmt.Errorf("failed to resolve users claimed handle (%q) on pds: %w", handle, err)
-	}
-
-	if resdid != did {
-		return nil, fmt.Errorf("claimed handle did not match servers response (%s != %s)", resdid, did)
-	}
+	// an existing user whose handle no longer verifies keeps their account,
+	// but loses the handle
+	handle, herr := s.verifyHandle(ctx, did, doc)
 
 	s.extUserLk.Lock()
 	defer s.extUserLk.Unlock()
@@ -950,21 +1211,29 @@ func (s *BGS) createExternalUser(ctx context.Context, did string) (*models.Actor
 
 		}
 
-		if exu.Handle != handle {
-			// Users handle has changed, update
-			if err := s.db.Model(User{}).Where("id = ?", exu.ID).Update("handle", handle).Error; err != nil {
-				return nil, fmt.Errorf("failed to update users handle: %w", err)
+		if herr != nil {
+			if definitelyInvalid(herr) {
+				log.Infow("users handle no longer verifies", "did", did, "err", herr)
+				handle = syntax.HandleInvalid
+			} else {
+				// the handle couldn't be checked, which says nothing
+				// about whether it has changed
+				log.Warnw("could not verify users handle, keeping the old one", "did", did, "handle", exu.Handle, "err", herr)
+				handle = exu.Handle
 			}
+		}
 
-			if err := s.events.AddEvent(ctx, &events.XRPCStreamEvent{
-				RepoHandle: &comatproto.SyncSubscribeRepos_Handle{
-					Did:    exu.Did,
-					Handle: handle,
-					Time:   time.Now().Format(util.ISO8601),
-				},
-			}); err != nil {
+		if exu.Handle != handle && !(handle == syntax.HandleInvalid && exu.Handle == "") {
+			// Users handle has changed, update
+			if err := s.updateHandle(ctx, exu.Uid, exu.Did, handle); err != nil {
 				// TODO: should we really error here? I'm leaning towards no
-				return nil, fmt.Errorf("failed to push handle update event: %s", err)
+				return nil, err
+			}
+
+			if handle == syntax.HandleInvalid {
+				exu.Handle = ""
+			} else {
+				exu.Handle = handle
 			}
 		}
 		return exu, nil
@@ -974,6 +1243,10 @@ func (s *BGS) createExternalUser(ctx context.Context, did string) (*models.Actor
 		return nil, err
 	}
 
+	if herr != nil {
+		return nil, herr
+	}
+
 	// TODO: request this users info from their server to fill out our data...
 	u := User{
 		Handle: handle,
@@ -981,22 +1254,35 @@ func (s *BGS) createExternalUser(ctx context.Context, did string) (*models.Actor
 		PDS:    peering.ID,
 	}
 
-	if err := s.db.Create(&u).Error; err != nil {
-		// some debugging...
-		return nil, fmt.Errorf("failed to create other pds user: %w", err)
-	}
-
 	// okay cool, its a user on a server we are peered with
 	// lets make a local record of that user for the future
 	subj := &models.ActorInfo{
-		Uid:         u.ID,
 		Handle:      handle,
 		DisplayName: "", //*profile.DisplayName,
 		Did:         did,
 		Type:        "",
 		PDS:         peering.ID,
 	}
-	if err := s.db.Create(subj).Error; err != nil {
+
+	var stale []string
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if stale, err = releaseHandle(tx, handle, 0); err != nil {
+			return err
+		}
+
+		if err := tx.Create(&u).Error; err != nil {
+			// some debugging...
+			return fmt.Errorf("failed to create other pds user: %w", err)
+		}
+
+		subj.Uid = u.ID
+		return tx.Create(subj).Error
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := s.tombstoneStale(ctx, stale, handle); err != nil {
 		return nil, err
 	}
 
@@ -1021,6 +1307,7 @@ func (bgs *BGS) TakeDownRepo(ctx context.Context, did string) error {
 		return err
 	}
 
+	bgs.publishInvalidation(ctx, invalidation.RepoTakenDown(invalidationSource, did, false))
 	return nil
 }
 
@@ -1034,5 +1321,6 @@ func (bgs *BGS) ReverseTakedown(ctx context.Context, did string) error {
 		return err
 	}
 
+	bgs.publishInvalidation(ctx, invalidation.RepoTakenDown(invalidationSource, did, true))
 	return nil
 }
@@ -31,8 +31,9 @@ type Slurper struct {
 
 	newSubsDisabled bool
 
-	shutdownChan   chan bool
-	shutdownResult chan []error
+	shutdownChan chan bool
+	shutdown     bool
+	wg           sync.WaitGroup
 
 	ssl bool
 }
@@ -47,12 +48,11 @@ type activeSub struct {
 func NewSlurper(db *gorm.DB, cb IndexCallback, ssl bool) (*Slurper, error) {
 	db.AutoMigrate(&SlurpConfig{})
 	s := &Slurper{
-		cb:             cb,
-		db:             db,
-		active:         make(map[string]*activeSub),
-		ssl:            ssl,
-		shutdownChan:   make(chan bool),
-		shutdownResult: make(chan []error),
+		cb:           cb,
+		db:           db,
+		active:       make(map[string]*activeSub),
+		ssl:          ssl,
+		shutdownChan: make(chan bool),
 	}
 	if err := s.loadConfig(); err != nil {
 		return nil, err
@@ -63,18 +63,7 @@ func NewSlurper(db *gorm.DB, cb IndexCallback, ssl bool) (*Slurper, error) {
 		for {
 			select {
 			case <-s.shutdownChan:
-				log.Info("flushing PDS cursors on shutdown")
-				ctx := context.Background()
-				ctx, span := otel.Tracer("feedmgr").Start(ctx, "CursorFlusherShutdown")
-				defer span.End()
-				var errs []error
-				if errs = s.flushCursors(ctx); len(errs) > 0 {
-					for _, err := range errs {
-						log.Errorf("failed to flush cursors on shutdown: %s", err)
-					}
-				}
-				log.Info("done flushing PDS cursors on shutdown")
-				s.shutdownResult <- errs
+				// Shutdown flushes the cursors itself once the subscriptions have stopped
 				return
 			case <-time.After(time.Second * 10):
 				log.Debug("flushing PDS cursors")
@@ -94,15 +83,37 @@ func NewSlurper(db *gorm.DB, cb IndexCallback, ssl bool) (*Slurper, error) {
 	return s, nil
 }
 
-// Shutdown shuts down the slurper
+// Shutdown shuts down the slurper. Every upstream subscription is stopped,
+// events already received are handled, and then the cursors are saved so
+// subscriptions resume where they left off.
 func (s *Slurper) Shutdown() []error {
+	s.lk.Lock()
+	if s.shutdown {
+		s.lk.Unlock()
+		return nil
+	}
+	s.shutdown = true
+
+	subs := make([]*activeSub, 0, len(s.active))
+	for _, sub := range s.active {
+		subs = append(subs, sub)
+		sub.cancel()
+	}
+	s.lk.Unlock()
+
+	// stop the periodic flushes, outside the lock which they take
 	s.shutdownChan <- true
-	log.Info("waiting for slurper shutdown")
-	errs := <-s.shutdownResult
-	if len(errs) > 0 {
-		for _, err := range errs {
-			log.Errorf("shutdown error: %s", err)
-		}
+
+	log.Infow("waiting for slurper subscriptions to drain", "subscriptions", len(subs))
+	s.wg.Wait()
+
+	log.Info("flushing PDS cursors on shutdown")
+	ctx, span := otel.Tracer("feedmgr").Start(context.Background(), "CursorFlusherShutdown")
+	defer span.End()
+
+	errs := s.writeCursors(ctx, subs)
+	for _, err := range errs {
+		log.Errorf("failed to flush cursors on shutdown: %s", err)
 	}
 	log.Info("slurper shutdown complete")
 	return errs
@@ -150,11 +161,27 @@ func (s *Slurper) GetNewSubsDisabledState() bool {
 }
 
 var ErrNewSubsDisabled = fmt.Errorf("new subscriptions temporarily disabled")
+var ErrSlurperShutdown = fmt.Errorf("slurper is shutting down")
 
 func (s *Slurper) SubscribeToPds(ctx context.Context, host string, reg bool) error {
+	return s.subscribe(ctx, host, reg, false)
+}
+
+// SubscribeToRelay subscribes to the firehose of another relay, which carries
+// the repos of all of the PDSs it is subscribed to. Unlike PDSs, relays are
+// never unsubscribed from for being down; they are redialed until they are
+// back.
+func (s *Slurper) SubscribeToRelay(ctx context.Context, host string) error {
+	return s.subscribe(ctx, host, true, true)
+}
+
+func (s *Slurper) subscribe(ctx context.Context, host string, reg, relay bool) error {
 	// TODO: for performance, lock on the hostname instead of global
 	s.lk.Lock()
 	defer s.lk.Unlock()
+	if s.shutdown {
+		return ErrSlurperShutdown
+	}
 	if s.newSubsDisabled {
 		return ErrNewSubsDisabled
 	}
@@ -179,6 +206,7 @@ func (s *Slurper) SubscribeToPds(ctx context.Context, host string, reg bool) err
 			Host:       host,
 			SSL:        s.ssl,
 			Registered: reg,
+			Relay:      relay,
 		}
 		if err := s.db.Create(&npds).Error; err != nil {
 			return err
@@ -194,6 +222,13 @@ func (s *Slurper) SubscribeToPds(ctx context.Context, host string, reg bool) err
 		}
 	}
 
+	if !peering.Relay && relay {
+		peering.Relay = true
+		if err := s.db.Model(models.PDS{}).Where("id = ?", peering.ID).Update("relay", true).Error; err != nil {
+			return err
+		}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	sub := activeSub{
 		pds:    &peering,
@@ -202,6 +237,7 @@ func (s *Slurper) SubscribeToPds(ctx context.Context, host string, reg bool) err
 	}
 	s.active[host] = &sub
 
+	s.wg.Add(1)
 	go s.subscribeWithRedialer(ctx, &peering, &sub)
 
 	return nil
@@ -210,6 +246,9 @@ func (s *Slurper) SubscribeToPds(ctx context.Context, host string, reg bool) err
 func (s *Slurper) RestartAll() error {
 	s.lk.Lock()
 	defer s.lk.Unlock()
+	if s.shutdown {
+		return ErrSlurperShutdown
+	}
 
 	var all []models.PDS
 	if err := s.db.Find(&all, "registered = true AND blocked = false").Error; err != nil {
@@ -226,6 +265,7 @@ func (s *Slurper) RestartAll() error {
 			cancel: cancel,
 		}
 		s.active[pds.Host] = &sub
+		s.wg.Add(1)
 		go s.subscribeWithRedialer(ctx, &pds, &sub)
 	}
 
@@ -233,6 +273,7 @@ func (s *Slurper) RestartAll() error {
 }
 
 func (s *Slurper) subscribeWithRedialer(ctx context.Context, host *models.PDS, sub *activeSub) {
+	defer s.wg.Done()
 	defer func() {
 		s.lk.Lock()
 		defer s.lk.Unlock()
@@ -261,10 +302,14 @@ func (s *Slurper) subscribeWithRedialer(ctx context.Context, host *models.PDS, s
 		con, res, err := d.DialContext(ctx, url, nil)
 		if err != nil {
 			log.Warnw("dialing failed", "host", host.Host, "err", err, "backoff", backoff)
-			time.Sleep(sleepForBackoff(backoff))
+			select {
+			case <-time.After(sleepForBackoff(backoff)):
+			case <-ctx.Done():
+				return
+			}
 			backoff++
 
-			if backoff > 15 {
+			if backoff > 15 && !host.Relay {
 				log.Warnw("pds does not appear to be online, disabling for now", "host", host.Host)
 				if err := s.db.Model(&models.PDS{}).Where("id = ?", host.ID).Update("registered", false).Error; err != nil {
 					log.Errorf("failed to unregister failing pds: %w", err)
@@ -415,14 +460,25 @@ type cursorSnapshot struct {
 
 // flushCursors updates the PDS cursors in the DB for all active subscriptions
 func (s *Slurper) flushCursors(ctx context.Context) []error {
+	s.lk.Lock()
+	subs := make([]*activeSub, 0, len(s.active))
+	for _, sub := range s.active {
+		subs = append(subs, sub)
+	}
+	s.lk.Unlock()
+
+	return s.writeCursors(ctx, subs)
+}
+
+// writeCursors updates the PDS cursors in the DB for the given subscriptions
+func (s *Slurper) writeCursors(ctx context.Context, subs []*activeSub) []error {
 	ctx, span := otel.Tracer("feedmgr").Start(ctx, "flushCursors")
 	defer span.End()
 
 	var cursors []cursorSnapshot
 
-	s.lk.Lock()
-	// Iterate over active subs and copy the current cursor
-	for _, sub := range s.active {
+	// copy the current cursor of each sub
+	for _, sub := range subs {
 		sub.lk.RLock()
 		cursors = append(cursors, cursorSnapshot{
 			id:     sub.pds.ID,
@@ -430,7 +486,6 @@ func (s *Slurper) flushCursors(ctx context.Context) []error {
 		})
 		sub.lk.RUnlock()
 	}
-	s.lk.Unlock()
 
 	errs := []error{}
 
@@ -11,9 +11,9 @@ import (
 	atproto "github.com/bluesky-social/indigo/api/atproto"
 	comatprototypes "github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/util/xrpcerr"
 	"github.com/bluesky-social/indigo/xrpc"
 	"github.com/ipfs/go-cid"
-	"github.com/labstack/echo/v4"
 )
 
 func (s *BGS) handleComAtprotoSyncGetCheckout(ctx context.Context, commit string, did string) (io.Reader, error) {
@@ -60,7 +60,27 @@ func (s *BGS) handleComAtprotoSyncGetHead(ctx context.Context, did string) (*com
 }
 
 func (s *BGS) handleComAtprotoSyncGetRecord(ctx context.Context, collection string, commit string, did string, rkey string) (io.Reader, error) {
-	return nil, fmt.Errorf("nyi")
+	u, err := s.Index.LookupUserByDid(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+
+	var commitCid cid.Cid
+	if commit != "" {
+		c, err := cid.Decode(commit)
+		if err != nil {
+			return nil, err
+		}
+
+		commitCid = c
+	}
+
+	buf := new(bytes.Buffer)
+	if err := s.repoman.ReadRecordProof(ctx, u.Uid, commitCid, collection, rkey, buf); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
 }
 
 func (s *BGS) handleComAtprotoSyncGetRepo(ctx context.Context, did string, earliest string, latest string) (io.Reader, error) {
@@ -103,27 +123,21 @@ func (s *BGS) handleComAtprotoSyncGetBlocks(ctx context.Context, cids []string,
 
 func (s *BGS) handleComAtprotoSyncRequestCrawl(ctx context.Context, host string) error {
 	if host == "" {
-		return fmt.Errorf("must pass valid hostname")
+		return xrpcerr.InvalidRequest("must pass valid hostname")
 	}
 
 	if strings.HasPrefix(host, "https://") || strings.HasPrefix(host, "http://") {
-		return &echo.HTTPError{
-			Code:    400,
-			Message: "must pass domain without protocol scheme",
-		}
+		return xrpcerr.InvalidRequest("must pass domain without protocol scheme")
 	}
 
 	norm, err := util.NormalizeHostname(host)
 	if err != nil {
-		return err
+		return xrpcerr.InvalidRequest("%s", err)
 	}
 
 	banned, err := s.domainIsBanned(ctx, host)
 	if banned {
-		return &echo.HTTPError{
-			Code:    401,
-			Message: "domain is banned",
-		}
+		return xrpcerr.AuthRequired("domain is banned")
 	}
 
 	log.Warnf("TODO: better host validation for crawl requests")
@@ -139,10 +153,7 @@ func (s *BGS) handleComAtprotoSyncRequestCrawl(ctx context.Context, host string)
 
 	desc, err := atproto.ServerDescribeServer(ctx, c)
 	if err != nil {
-		return &echo.HTTPError{
-			Code:    401,
-			Message: fmt.Sprintf("given host failed to respond to ping: %s", err),
-		}
+		return xrpcerr.AuthRequired("given host failed to respond to ping: %s", err)
 	}
 
 	// Maybe we could do something with this response later
@@ -172,7 +183,3 @@ func (s *BGS) handleComAtprotoSyncGetBlob(ctx context.Context, cid string, did s
 func (s *BGS) handleComAtprotoSyncListBlobs(ctx context.Context, did string, earliest string, latest string) (*comatprototypes.SyncListBlobs_Output, error) {
 	return nil, fmt.Errorf("NYI")
 }
-
-func (s *BGS) handleComAtprotoSyncListRepos(ctx context.Context, cursor string, limit int) (*comatprototypes.SyncListRepos_Output, error) {
-	return nil, fmt.Errorf("NYI")
-}
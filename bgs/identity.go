@@ -0,0 +1,246 @@
+package bgs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/bluesky-social/indigo/api"
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/identity"
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/util/invalidation"
+	"github.com/bluesky-social/indigo/util/syntax"
+
+	"github.com/whyrusleeping/go-did"
+	"gorm.io/gorm"
+)
+
+// handleReconcileBatchSize is how many accounts the handle reconciler
+// re-verifies at a time
+const handleReconcileBatchSize = 100
+
+// verifyHandle returns the handle claimed in a DID document, once checked to
+// resolve back to the DID
+// errHandleInvalid is wrapped by the errors of verifyHandle when the handle
+// definitely doesn't verify
+var errHandleInvalid = errors.New("handle does not verify")
+
+// definitelyInvalid reports whether an error from verifyHandle means that the
+// handle doesn't verify, rather than that it couldn't be checked
+func definitelyInvalid(err error) bool {
+	return errors.Is(err, errHandleInvalid) || errors.Is(err, api.ErrHandleNotFound)
+}
+
+func (s *BGS) verifyHandle(ctx context.Context, udid string, doc *did.Document) (string, error) {
+	if len(doc.AlsoKnownAs) == 0 {
+		return "", fmt.Errorf("%w: user has no 'known as' field in their DID document", errHandleInvalid)
+	}
+
+	hurl, err := url.Parse(doc.AlsoKnownAs[0])
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", errHandleInvalid, err)
+	}
+
+	handle := hurl.Host
+
+	resdid, err := s.hr.ResolveHandleToDid(ctx, handle)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve users claimed handle (%q) on pds: %w", handle, err)
+	}
+
+	if resdid != udid {
+		return "", fmt.Errorf("%w: claimed handle did not match servers response (%s != %s)", errHandleInvalid, resdid, udid)
+	}
+
+	return handle, nil
+}
+
+// purgeIdentity drops the cached DID document of an account, and the handles
+// it claims, so that they are resolved again on next use. It does nothing if
+// the BGS's identity resolver doesn't cache.
+func (s *BGS) purgeIdentity(ctx context.Context, udid string) ([]string, error) {
+	r, ok := s.didr.(*identity.Resolver)
+	if !ok {
+		return nil, nil
+	}
+
+	// the handles have to be found before the document is dropped
+	doc, err := r.CachedDid(ctx, udid)
+	if err != nil {
+		return nil, err
+	}
+	handles := claimedHandles(doc)
+	for _, h := range handles {
+		if err := r.PurgeHandle(ctx, h); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.PurgeDid(ctx, udid); err != nil {
+		return nil, err
+	}
+	return handles, nil
+}
+
+// updateHandle sets the handle of an account, or tombstones it if handle is
+// syntax.HandleInvalid, and emits #handle events for the change. Any other account
+// still holding the handle has lost it, so is tombstoned too.
+func (s *BGS) updateHandle(ctx context.Context, uid models.Uid, udid string, handle string) error {
+	var stale []string
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		stale, err = releaseHandle(tx, handle, uid)
+		if err != nil {
+			return err
+		}
+
+		var val any = handle
+		if handle == syntax.HandleInvalid {
+			val = gorm.Expr("NULL")
+		}
+		if err := tx.Model(User{}).Where("id = ?", uid).Update("handle", val).Error; err != nil {
+			return err
+		}
+		return tx.Model(models.ActorInfo{}).Where("uid = ?", uid).Update("handle", val).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update users handle: %w", err)
+	}
+
+	if err := s.tombstoneStale(ctx, stale, handle); err != nil {
+		return err
+	}
+	return s.emitHandle(ctx, udid, handle)
+}
+
+// releaseHandle takes a handle away from any account other than uid still
+// holding it, returning their DIDs
+func releaseHandle(tx *gorm.DB, handle string, uid models.Uid) ([]string, error) {
+	if handle == syntax.HandleInvalid {
+		return nil, nil
+	}
+
+	var stale []string
+	if err := tx.Model(User{}).Where("handle = ? AND id != ?", handle, uid).Pluck("did", &stale).Error; err != nil {
+		return nil, err
+	}
+	if len(stale) == 0 {
+		return nil, nil
+	}
+
+	if err := tx.Model(User{}).Where("did IN ?", stale).Update("handle", gorm.Expr("NULL")).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Model(models.ActorInfo{}).Where("did IN ?", stale).Update("handle", gorm.Expr("NULL")).Error; err != nil {
+		return nil, err
+	}
+	return stale, nil
+}
+
+// tombstoneStale emits #handle events for accounts which lost handle to
+// another account
+func (s *BGS) tombstoneStale(ctx context.Context, stale []string, handle string) error {
+	for _, sd := range stale {
+		log.Infow("tombstoning stale handle", "did", sd, "handle", handle)
+		if err := s.emitHandle(ctx, sd, syntax.HandleInvalid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BGS) emitHandle(ctx context.Context, udid string, handle string) error {
+	result := "updated"
+	if handle == syntax.HandleInvalid {
+		result = "tombstoned"
+	}
+	handleChangesCounter.WithLabelValues(result).Inc()
+
+	if err := s.events.AddEvent(ctx, &events.XRPCStreamEvent{
+		RepoHandle: &comatproto.SyncSubscribeRepos_Handle{
+			Did:    udid,
+			Handle: handle,
+			Time:   time.Now().Format(util.ISO8601),
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to push handle update event: %w", err)
+	}
+
+	s.publishInvalidation(ctx, invalidation.IdentityChanged(invalidationSource, udid, handle))
+	return nil
+}
+
+// RunHandleReconciler re-verifies the handle of every account every interval,
+// to catch changes which were missed or never announced, until ctx is done
+func (s *BGS) RunHandleReconciler(ctx context.Context, interval time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+
+		if err := s.reconcileHandles(ctx); err != nil && ctx.Err() == nil {
+			log.Errorw("failed to reconcile handles", "err", err)
+		}
+	}
+}
+
+// reconcileHandles re-verifies the handles of all accounts which aren't
+// taken down, updating any which have changed
+func (s *BGS) reconcileHandles(ctx context.Context) error {
+	var last models.Uid
+	for {
+		var users []User
+		if err := s.db.Where("id > ? AND NOT taken_down", last).Order("id").Limit(handleReconcileBatchSize).Find(&users).Error; err != nil {
+			return err
+		}
+		if len(users) == 0 {
+			return nil
+		}
+
+		for _, u := range users {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err := s.reconcileHandle(ctx, &u); err != nil {
+				log.Warnw("failed to reconcile handle", "did", u.Did, "err", err)
+			}
+		}
+		last = users[len(users)-1].ID
+	}
+}
+
+func (s *BGS) reconcileHandle(ctx context.Context, u *User) error {
+	doc, err := s.didr.GetDocument(ctx, u.Did)
+	if err != nil {
+		// the PLC directory or DID's host being unreachable says nothing
+		// about the handle, so leave it be
+		return fmt.Errorf("could not locate DID document: %w", err)
+	}
+
+	handle, err := s.verifyHandle(ctx, u.Did, doc)
+	if err != nil {
+		if !definitelyInvalid(err) {
+			// nor does the handle's DNS or host being unreachable
+			return fmt.Errorf("could not verify handle: %w", err)
+		}
+		log.Infow("handle no longer verifies", "did", u.Did, "handle", u.Handle, "err", err)
+		handle = syntax.HandleInvalid
+	}
+
+	if handle == u.Handle || (handle == syntax.HandleInvalid && u.Handle == "") {
+		return nil
+	}
+
+	s.extUserLk.Lock()
+	defer s.extUserLk.Unlock()
+
+	return s.updateHandle(ctx, u.ID, u.Did, handle)
+}
@@ -0,0 +1,41 @@
+package bgs
+
+import (
+	"context"
+
+	"github.com/bluesky-social/indigo/util/invalidation"
+)
+
+// invalidationSource is the Source of the invalidation messages the BGS
+// publishes
+const invalidationSource = "bgs"
+
+// SetInvalidationBus has the BGS publish handle changes and takedowns to b,
+// and drop the cached identities of accounts other services say have
+// changed. Must be called before StartWithListener.
+func (bgs *BGS) SetInvalidationBus(b invalidation.Bus) {
+	bgs.invalidations = b
+	b.Subscribe(bgs.handleInvalidation)
+}
+
+func (bgs *BGS) handleInvalidation(ctx context.Context, m invalidation.Message) {
+	// the BGS's own changes are purged as they are made
+	if m.Kind != invalidation.KindIdentity || m.Source == invalidationSource {
+		return
+	}
+
+	if _, err := bgs.purgeIdentity(ctx, m.Did); err != nil {
+		log.Warnw("failed to purge cached identity", "did", m.Did, "source", m.Source, "err", err)
+	}
+}
+
+// publishInvalidation tells other services of a change, if there is a bus to
+// tell them on. Failing to isn't fatal, as their caches expire anyway.
+func (bgs *BGS) publishInvalidation(ctx context.Context, m invalidation.Message) {
+	if bgs.invalidations == nil {
+		return
+	}
+	if err := bgs.invalidations.Publish(ctx, m); err != nil {
+		log.Warnw("failed to publish invalidation", "kind", m.Kind, "did", m.Did, "err", err)
+	}
+}
@@ -1,11 +1,12 @@
 package bgs
 
 import (
-	"errors"
 	"net/http"
 	"strconv"
 	"time"
 
+	"github.com/bluesky-social/indigo/util/xrpcerr"
+
 	"github.com/labstack/echo/v4"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -21,11 +22,37 @@ var repoCommitsReceivedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 	Help: "The total number of events received",
 }, []string{"pds"})
 
+var duplicateCommitsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "duplicate_commits_received_total",
+	Help: "The total number of commits dropped for having been received from another upstream already",
+}, []string{"pds"})
+
+var commitsVerifiedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "commits_verified_total",
+	Help: "The total number of incoming commits verified before being stored, by level and result",
+}, []string{"level", "result"})
+
+var commitVerifyDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "commit_verify_duration_seconds",
+	Help:    "How long verifying incoming commits takes, by level",
+	Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16),
+}, []string{"level"})
+
 var rebasesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "event_rebases",
 	Help: "The total number of rebase events received",
 }, []string{"pds"})
 
+var ruleActionsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "rule_actions_total",
+	Help: "The total number of actions called for by ingest rules, by rule and kind of action",
+}, []string{"rule", "kind"})
+
+var handleChangesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "handle_changes_total",
+	Help: "The total number of account handles changed, by whether they were updated or tombstoned",
+}, []string{"result"})
+
 var eventsSentCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "events_sent_counter",
 	Help: "The total number of events sent to consumers",
@@ -68,14 +95,9 @@ func MetricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 		err := next(c)
 
 		status := c.Response().Status
-		if err != nil {
-			var httpError *echo.HTTPError
-			if errors.As(err, &httpError) {
-				status = httpError.Code
-			}
-			if status == 0 || status == http.StatusOK {
-				status = http.StatusInternalServerError
-			}
+		// handlers which sent a response before failing keep its status
+		if err != nil && !c.Response().Committed {
+			status = xrpcerr.Status(err, errorMappings...)
 		}
 
 		elapsed := float64(time.Since(start)) / float64(time.Second)
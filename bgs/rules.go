@@ -0,0 +1,63 @@
+package bgs
+
+import (
+	"context"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/rules"
+	"github.com/bluesky-social/indigo/util/logutil"
+)
+
+// SetRules has the records in the commits the BGS takes in checked against a
+// rule engine, or stops checking them if e is nil. Accounts are as old as
+// the BGS has known them. The BGS does not label or take reports, so label,
+// flag and report actions are only logged and counted, while escalating an
+// account for takedown takes it down here.
+func (bgs *BGS) SetRules(e *rules.Engine) {
+	bgs.rules.Store(e)
+}
+
+// applyRules checks the records of a commit that has been stored against the
+// rules, if there are any. Failures are logged rather than returned, as the
+// commit has been handled by then.
+func (bgs *BGS) applyRules(ctx context.Context, u *User, evt *comatproto.SyncSubscribeRepos_Commit) {
+	e := bgs.rules.Load()
+	if e == nil {
+		return
+	}
+
+	evts, err := e.CommitEvents(ctx, evt, u.CreatedAt)
+	if err != nil {
+		logger.WarnCtx(ctx, "failed to read commit for rules", "err", err)
+		return
+	}
+
+	takedown := false
+	for _, ev := range evts {
+		res, err := e.Evaluate(ctx, ev)
+		if err != nil {
+			logger.WarnCtx(ctx, "failed to evaluate rules", "err", err, "path", ev.Collection+"/"+ev.Rkey)
+			continue
+		}
+		for _, a := range res.Actions {
+			ruleActionsCounter.WithLabelValues(a.Rule, a.Kind()).Inc()
+
+			actx := logutil.WithFields(ctx, "rule", a.Rule, "path", ev.Collection+"/"+ev.Rkey)
+			switch {
+			case a.Escalate == rules.EscalateTakedown:
+				logger.WarnCtx(actx, "rule escalated account for takedown")
+				takedown = true
+			case a.Report != nil:
+				logger.InfoCtx(actx, "rule reported record", "reasonType", a.Report.ReasonType, "reason", a.Report.Reason)
+			default:
+				logger.InfoCtx(actx, "rule matched record", "label", a.Label, "flag", a.Flag)
+			}
+		}
+	}
+
+	if takedown {
+		if err := bgs.TakeDownRepo(ctx, u.Did); err != nil {
+			logger.ErrorCtx(ctx, "failed to take down repo escalated by rules", "err", err)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package bgs
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/repomgr"
+
+	"github.com/ipfs/go-cid"
+)
+
+// commitVerifier checks the commits of incoming events before they are
+// stored, in a pool of workers so that verification keeps up with bursts of
+// events. Repos are sharded across the workers, so each repo's commits are
+// verified in the order they are handed over.
+type commitVerifier struct {
+	repoman *repomgr.RepoManager
+	level   repomgr.VerifyLevel
+	shards  []chan *verifyTask
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+type verifyTask struct {
+	ctx  context.Context
+	uid  models.Uid
+	did  string
+	evt  *comatproto.SyncSubscribeRepos_Commit
+	done chan error
+}
+
+// errVerifierStopped is returned for commits handed to a verifier which has
+// been replaced, which should be handed to the new one
+var errVerifierStopped = errors.New("commit verifier stopped")
+
+func newCommitVerifier(repoman *repomgr.RepoManager, level repomgr.VerifyLevel, workers int) *commitVerifier {
+	cv := &commitVerifier{
+		repoman: repoman,
+		level:   level,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if level == repomgr.VerifyNone {
+		close(cv.stopped)
+		return cv
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+	cv.shards = make([]chan *verifyTask, workers)
+	done := make(chan struct{}, workers)
+	for i := range cv.shards {
+		// unbuffered, so that a backed up shard holds up the events of
+		// its repos rather than queueing them
+		cv.shards[i] = make(chan *verifyTask)
+		go func(tasks chan *verifyTask) {
+			defer func() { done <- struct{}{} }()
+			for {
+				select {
+				case t := <-tasks:
+					t.done <- cv.run(t)
+				case <-cv.stop:
+					return
+				}
+			}
+		}(cv.shards[i])
+	}
+	go func() {
+		for range cv.shards {
+			<-done
+		}
+		close(cv.stopped)
+	}()
+
+	return cv
+}
+
+func (cv *commitVerifier) run(t *verifyTask) error {
+	start := time.Now()
+	err := cv.repoman.VerifyExternalCommit(t.ctx, t.uid, t.did, (*cid.Cid)(t.evt.Prev), t.evt.Blocks, t.evt.Ops, cv.level)
+	commitVerifyDuration.WithLabelValues(cv.level.String()).Observe(time.Since(start).Seconds())
+	switch {
+	case err == nil:
+		commitsVerifiedCounter.WithLabelValues(cv.level.String(), "ok").Inc()
+	case errors.Is(err, repomgr.ErrInvalidCommit):
+		commitsVerifiedCounter.WithLabelValues(cv.level.String(), "invalid").Inc()
+	default:
+		commitsVerifiedCounter.WithLabelValues(cv.level.String(), "error").Inc()
+	}
+	return err
+}
+
+// verify checks a commit at the verifier's level, waiting for a worker if
+// they are all busy
+func (cv *commitVerifier) verify(ctx context.Context, uid models.Uid, did string, evt *comatproto.SyncSubscribeRepos_Commit) error {
+	if cv.level == repomgr.VerifyNone {
+		return nil
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(did))
+	shard := cv.shards[h.Sum32()%uint32(len(cv.shards))]
+
+	t := &verifyTask{
+		ctx:  ctx,
+		uid:  uid,
+		did:  did,
+		evt:  evt,
+		done: make(chan error, 1),
+	}
+	select {
+	case shard <- t:
+	case <-cv.stop:
+		return errVerifierStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// a task once taken is always finished, even by a stopping worker
+	return <-t.done
+}
+
+// shutdown stops the workers once they have finished the commits they have
+func (cv *commitVerifier) shutdown() {
+	select {
+	case <-cv.stop:
+	default:
+		close(cv.stop)
+	}
+	<-cv.stopped
+}
+
+// SetCommitVerification sets how thoroughly the commits of incoming events
+// are checked before they are stored, and the number of workers checking
+// them. At repomgr.VerifyNone, only the signature check made as commits are
+// stored is done, as it is for commits handled before this is first called.
+func (bgs *BGS) SetCommitVerification(level repomgr.VerifyLevel, workers int) {
+	old := bgs.verifier.Swap(newCommitVerifier(bgs.repoman, level, workers))
+	if old != nil {
+		old.shutdown()
+	}
+}
+
+// verifyCommit checks a commit with the current verifier, returning whether
+// the commit was verified (at repomgr.VerifyLight or above)
+func (bgs *BGS) verifyCommit(ctx context.Context, u *User, evt *comatproto.SyncSubscribeRepos_Commit) (bool, error) {
+	for {
+		cv := bgs.verifier.Load()
+		if cv == nil || cv.level == repomgr.VerifyNone {
+			return false, nil
+		}
+
+		// a verifier stopped by SetCommitVerification has been replaced,
+		// one stopped by Shutdown hasn't
+		err := cv.verify(ctx, u.ID, u.Did, evt)
+		if !errors.Is(err, errVerifierStopped) || bgs.verifier.Load() == cv {
+			return err == nil, err
+		}
+	}
+}
+
+// handleCommit stores a commit, skipping the signature check if verification
+// has made it
+func (bgs *BGS) handleCommit(ctx context.Context, host *models.PDS, u *User, evt *comatproto.SyncSubscribeRepos_Commit, verified bool) error {
+	if verified {
+		return bgs.repoman.HandleVerifiedExternalUserEvent(ctx, host.ID, u.ID, u.Did, (*cid.Cid)(evt.Prev), evt.Blocks, evt.Ops)
+	}
+	return bgs.repoman.HandleExternalUserEvent(ctx, host.ID, u.ID, u.Did, (*cid.Cid)(evt.Prev), evt.Blocks, evt.Ops)
+}
@@ -2,6 +2,7 @@ package blobs
 
 import (
 	"context"
+	"io"
 	"os"
 	"path/filepath"
 )
@@ -9,6 +10,32 @@ import (
 type BlobStore interface {
 	PutBlob(ctx context.Context, cid string, did string, blob []byte) error
 	GetBlob(ctx context.Context, cid string, did string) ([]byte, error)
+	DeleteBlob(ctx context.Context, cid string, did string) error
+}
+
+// StreamingBlobStore is a BlobStore which can write and read blobs without
+// holding them in memory, for blobs such as videos
+type StreamingBlobStore interface {
+	BlobStore
+
+	// CreateBlob starts writing a blob, whose cid is only known once all of
+	// it has been written
+	CreateBlob(ctx context.Context, did string) (PendingBlob, error)
+
+	// OpenBlob opens a blob for reading, with seeking to serve ranges of it
+	OpenBlob(ctx context.Context, cid string, did string) (io.ReadSeekCloser, error)
+}
+
+// PendingBlob is a blob being written, which is only stored once committed
+type PendingBlob interface {
+	io.Writer
+
+	// Commit stores the blob under its cid
+	Commit(cid string) error
+
+	// Abort throws away what has been written. It does nothing once the blob
+	// has been committed, so may be deferred.
+	Abort() error
 }
 
 type DiskBlobStore struct {
@@ -24,6 +51,68 @@ func (dbs *DiskBlobStore) PutBlob(ctx context.Context, cid string, did string, b
 	return os.WriteFile(filepath.Join(udir, cid), blob, 0664)
 }
 
+func (dbs *DiskBlobStore) CreateBlob(ctx context.Context, did string) (PendingBlob, error) {
+	udir := filepath.Join(dbs.Dir, did)
+	if err := os.MkdirAll(udir, 0775); err != nil {
+		return nil, err
+	}
+
+	// the dot keeps partial uploads apart from the cids of stored blobs
+	f, err := os.CreateTemp(udir, ".upload-*")
+	if err != nil {
+		return nil, err
+	}
+
+	return &pendingFile{f: f, dir: udir}, nil
+}
+
+type pendingFile struct {
+	f    *os.File
+	dir  string
+	done bool
+}
+
+func (pf *pendingFile) Write(b []byte) (int, error) {
+	return pf.f.Write(b)
+}
+
+func (pf *pendingFile) Commit(cid string) error {
+	if err := pf.f.Chmod(0664); err != nil {
+		return err
+	}
+	if err := pf.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(pf.f.Name(), filepath.Join(pf.dir, cid)); err != nil {
+		return err
+	}
+
+	pf.done = true
+	return nil
+}
+
+func (pf *pendingFile) Abort() error {
+	if pf.done {
+		return nil
+	}
+	pf.done = true
+
+	pf.f.Close()
+	return os.Remove(pf.f.Name())
+}
+
+func (dbs *DiskBlobStore) OpenBlob(ctx context.Context, cid string, did string) (io.ReadSeekCloser, error) {
+	return os.Open(filepath.Join(dbs.Dir, did, cid))
+}
+
 func (dbs *DiskBlobStore) GetBlob(ctx context.Context, cid string, did string) ([]byte, error) {
 	return os.ReadFile(filepath.Join(dbs.Dir, did, cid))
 }
+
+func (dbs *DiskBlobStore) DeleteBlob(ctx context.Context, cid string, did string) error {
+	if err := os.Remove(filepath.Join(dbs.Dir, did, cid)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
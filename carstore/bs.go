@@ -25,6 +25,7 @@ import (
 	car "github.com/ipld/go-car"
 	carutil "github.com/ipld/go-car/util"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"gorm.io/gorm"
 )
 
@@ -36,6 +37,37 @@ type CarStore struct {
 
 	lscLk          sync.Mutex
 	lastShardCache map[models.Uid]*CarShard
+
+	// held for reading by every shard write, so Close can wait for them
+	writeLk sync.RWMutex
+	closed  bool
+
+	// readonly is set for carstores whose shards are written by another
+	// process, see NewReadOnlyCarStore
+	readonly bool
+}
+
+var ErrCarStoreClosed = fmt.Errorf("carstore is closed")
+
+var ErrCarStoreReadOnly = fmt.Errorf("carstore is read-only")
+
+// Close waits for shard writes in progress to finish, and makes any later
+// writes fail with ErrCarStoreClosed
+func (cs *CarStore) Close(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		cs.writeLk.Lock()
+		cs.closed = true
+		cs.writeLk.Unlock()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for carstore writes: %w", ctx.Err())
+	}
 }
 
 func NewCarStore(meta *gorm.DB, root string) (*CarStore, error) {
@@ -58,6 +90,22 @@ func NewCarStore(meta *gorm.DB, root string) (*CarStore, error) {
 	}, nil
 }
 
+// NewReadOnlyCarStore opens a carstore which another process writes to, such
+// as one shared with the ingesting BGS by a read replica. Its metadata database
+// is never migrated or written to, and the last shard of each user isn't
+// cached, as new shards are written without this process seeing them.
+func NewReadOnlyCarStore(meta *gorm.DB, root string) (*CarStore, error) {
+	if _, err := os.Stat(root); err != nil {
+		return nil, err
+	}
+	return &CarStore{
+		meta:           meta,
+		rootDir:        root,
+		lastShardCache: make(map[models.Uid]*CarShard),
+		readonly:       true,
+	}, nil
+}
+
 type UserInfo struct {
 	gorm.Model
 	Head string
@@ -148,13 +196,32 @@ func (uv *userView) Get(ctx context.Context, k cid.Cid) (blockformat.Block, erro
 	}
 }
 
+// maxPrefetchShardSize is the largest shard that will be read into the cache
+// in full. Larger shards (such as those written by a ShardWriter for a full
+// repo import) are read a block at a time.
+const maxPrefetchShardSize = 16 << 20
+
 func (uv *userView) prefetchRead(ctx context.Context, k cid.Cid, path string, offset int64) (blockformat.Block, error) {
+	ctx, span := otel.Tracer("carstore").Start(ctx, "prefetchRead")
+	defer span.End()
+	span.SetAttributes(attribute.String("path", path))
+
+	start := time.Now()
 	fi, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	defer fi.Close()
 
+	st, err := fi.Stat()
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int64("size", st.Size()))
+	if st.Size() > maxPrefetchShardSize {
+		return uv.singleRead(ctx, k, path, offset)
+	}
+
 	cr, err := car.NewCarReader(fi)
 	if err != nil {
 		return nil, err
@@ -171,6 +238,7 @@ func (uv *userView) prefetchRead(ctx context.Context, k cid.Cid, path string, of
 
 		uv.cache[blk.Cid()] = blk
 	}
+	readDuration.WithLabelValues("prefetch").Observe(time.Since(start).Seconds())
 
 	outblk, ok := uv.cache[k]
 	if !ok {
@@ -181,6 +249,11 @@ func (uv *userView) prefetchRead(ctx context.Context, k cid.Cid, path string, of
 }
 
 func (uv *userView) singleRead(ctx context.Context, k cid.Cid, path string, offset int64) (blockformat.Block, error) {
+	_, span := otel.Tracer("carstore").Start(ctx, "singleRead")
+	defer span.End()
+	span.SetAttributes(attribute.String("path", path), attribute.Int64("offset", offset))
+
+	start := time.Now()
 	fi, err := os.Open(path)
 	if err != nil {
 		return nil, err
@@ -205,6 +278,7 @@ func (uv *userView) singleRead(ctx context.Context, k cid.Cid, path string, offs
 	if rcid != k {
 		return nil, fmt.Errorf("mismatch in cid on disk: %s != %s", rcid, k)
 	}
+	readDuration.WithLabelValues("block").Observe(time.Since(start).Seconds())
 
 	return blocks.NewBlockWithCid(data, rcid)
 }
@@ -268,9 +342,11 @@ func (cs *CarStore) getLastShard(ctx context.Context, user models.Uid) (*CarShar
 	ctx, span := otel.Tracer("carstore").Start(ctx, "getLastShard")
 	defer span.End()
 
-	maybeLs := cs.checkLastShardCache(user)
-	if maybeLs != nil {
-		return maybeLs, nil
+	if !cs.readonly {
+		maybeLs := cs.checkLastShardCache(user)
+		if maybeLs != nil {
+			return maybeLs, nil
+		}
 	}
 
 	var lastShard CarShard
@@ -283,7 +359,9 @@ func (cs *CarStore) getLastShard(ctx context.Context, user models.Uid) (*CarShar
 		//}
 	}
 
-	cs.putLastShardCache(user, &lastShard)
+	if !cs.readonly {
+		cs.putLastShardCache(user, &lastShard)
+	}
 	return &lastShard, nil
 }
 
@@ -291,10 +369,9 @@ var ErrRepoBaseMismatch = fmt.Errorf("attempted a delta session on top of the wr
 
 var ErrRepoFork = fmt.Errorf("repo fork detected")
 
-func (cs *CarStore) NewDeltaSession(ctx context.Context, user models.Uid, prev *cid.Cid) (*DeltaSession, error) {
-	ctx, span := otel.Tracer("carstore").Start(ctx, "NewSession")
-	defer span.End()
-
+// checkBase returns the last shard for the user, after checking that it is
+// for the expected previous head (if prev is set)
+func (cs *CarStore) checkBase(ctx context.Context, user models.Uid, prev *cid.Cid) (*CarShard, error) {
 	// TODO: ensure that we don't write updates on top of the wrong head
 	// this needs to be a compare and swap type operation
 	lastShard, err := cs.getLastShard(ctx, user)
@@ -317,6 +394,22 @@ func (cs *CarStore) NewDeltaSession(ctx context.Context, user models.Uid, prev *
 		}
 	}
 
+	return lastShard, nil
+}
+
+func (cs *CarStore) NewDeltaSession(ctx context.Context, user models.Uid, prev *cid.Cid) (*DeltaSession, error) {
+	ctx, span := otel.Tracer("carstore").Start(ctx, "NewSession")
+	defer span.End()
+
+	if cs.readonly {
+		return nil, ErrCarStoreReadOnly
+	}
+
+	lastShard, err := cs.checkBase(ctx, user, prev)
+	if err != nil {
+		return nil, err
+	}
+
 	return &DeltaSession{
 		fresh: blockstore.NewBlockstore(datastore.NewMapDatastore()),
 		blks:  make(map[cid.Cid]blockformat.Block),
@@ -349,6 +442,9 @@ func (cs *CarStore) ReadOnlySession(user models.Uid) (*DeltaSession, error) {
 func (cs *CarStore) ReadUserCar(ctx context.Context, user models.Uid, earlyCid, lateCid cid.Cid, incremental bool, w io.Writer) error {
 	ctx, span := otel.Tracer("carstore").Start(ctx, "ReadUserCar")
 	defer span.End()
+	span.SetAttributes(attribute.Int64("user", int64(user)), attribute.Bool("incremental", incremental))
+
+	start := time.Now()
 
 	var lateSeq, earlySeq int
 
@@ -385,6 +481,10 @@ func (cs *CarStore) ReadUserCar(ctx context.Context, user models.Uid, earlyCid,
 	if len(shards) == 0 {
 		return fmt.Errorf("no data found for user %d", user)
 	}
+	span.SetAttributes(attribute.Int("shards", len(shards)))
+	if !earlyCid.Defined() && !lateCid.Defined() {
+		userShards.Observe(float64(len(shards)))
+	}
 
 	// fast path!
 	if err := car.WriteHeader(&car.CarHeader{
@@ -406,6 +506,7 @@ func (cs *CarStore) ReadUserCar(ctx context.Context, user models.Uid, earlyCid,
 			}
 		}
 	}
+	readDuration.WithLabelValues("car").Observe(time.Since(start).Seconds())
 
 	return nil
 }
@@ -413,6 +514,7 @@ func (cs *CarStore) ReadUserCar(ctx context.Context, user models.Uid, earlyCid,
 func (cs *CarStore) writeShardBlocks(ctx context.Context, sh *CarShard, w io.Writer) error {
 	ctx, span := otel.Tracer("carstore").Start(ctx, "writeShardBlocks")
 	defer span.End()
+	span.SetAttributes(attribute.String("path", sh.Path))
 
 	fi, err := os.Open(sh.Path)
 	if err != nil {
@@ -434,6 +536,10 @@ func (cs *CarStore) writeShardBlocks(ctx context.Context, sh *CarShard, w io.Wri
 }
 
 func (cs *CarStore) writeBlockFromShard(ctx context.Context, sh *CarShard, w io.Writer, c cid.Cid) error {
+	_, span := otel.Tracer("carstore").Start(ctx, "writeBlockFromShard")
+	defer span.End()
+	span.SetAttributes(attribute.String("path", sh.Path))
+
 	fi, err := os.Open(sh.Path)
 	if err != nil {
 		return err
@@ -544,6 +650,7 @@ func (cs *CarStore) openNewShardFile(ctx context.Context, user models.Uid, seq i
 func (cs *CarStore) writeNewShardFile(ctx context.Context, user models.Uid, seq int, data []byte) (string, error) {
 	_, span := otel.Tracer("carstore").Start(ctx, "writeNewShardFile")
 	defer span.End()
+	span.SetAttributes(attribute.Int("bytes", len(data)))
 
 	// TODO: some overwrite protections
 	fname := filepath.Join(cs.rootDir, fnameForShard(user, seq))
@@ -585,11 +692,19 @@ func WriteCarHeader(w io.Writer, root cid.Cid) (int64, error) {
 func (ds *DeltaSession) closeWithRoot(ctx context.Context, root cid.Cid, rebase bool) ([]byte, error) {
 	ctx, span := otel.Tracer("carstore").Start(ctx, "CloseWithRoot")
 	defer span.End()
+	span.SetAttributes(attribute.Int64("user", int64(ds.user)), attribute.Int("seq", ds.seq), attribute.Int("blocks", len(ds.blks)))
 
 	if ds.readonly {
 		return nil, fmt.Errorf("cannot write to readonly deltaSession")
 	}
 
+	ds.cs.writeLk.RLock()
+	defer ds.cs.writeLk.RUnlock()
+	if ds.cs.closed {
+		return nil, ErrCarStoreClosed
+	}
+
+	start := time.Now()
 	buf := new(bytes.Buffer)
 	hnw, err := WriteCarHeader(buf, root)
 	if err != nil {
@@ -640,25 +755,28 @@ func (ds *DeltaSession) closeWithRoot(ctx context.Context, root cid.Cid, rebase
 		Usr:       ds.user,
 	}
 
-	if err := ds.putShard(ctx, &shard, brefs); err != nil {
+	if err := ds.cs.putShard(ctx, &shard, brefs); err != nil {
 		return nil, err
 	}
+	writeDuration.WithLabelValues("delta").Observe(time.Since(start).Seconds())
+	bytesWritten.WithLabelValues("delta").Add(float64(buf.Len()))
+	blocksWritten.WithLabelValues("delta").Add(float64(len(ds.blks)))
 
 	return buf.Bytes(), nil
 }
 
-func (ds *DeltaSession) putShard(ctx context.Context, shard *CarShard, brefs []map[string]any) error {
+func (cs *CarStore) putShard(ctx context.Context, shard *CarShard, brefs []map[string]any) error {
 	ctx, span := otel.Tracer("carstore").Start(ctx, "putShard")
 	defer span.End()
 
 	// TODO: there should be a way to create the shard and block_refs that
 	// reference it in the same query, would save a lot of time
-	tx := ds.cs.meta.WithContext(ctx).Begin()
+	tx := cs.meta.WithContext(ctx).Begin()
 
 	if err := tx.WithContext(ctx).Create(shard).Error; err != nil {
 		return fmt.Errorf("failed to create shard in DB tx: %w", err)
 	}
-	ds.cs.putLastShardCache(ds.user, shard)
+	cs.putLastShardCache(shard.Usr, shard)
 
 	for _, ref := range brefs {
 		ref["shard"] = shard.ID
@@ -687,11 +805,14 @@ func createBlockRefs(ctx context.Context, tx *gorm.DB, brefs []map[string]any) e
 	return nil
 }
 
-func generateInsertQuery(data []map[string]any) (string, []any) {
+// generateInsertQuery builds a multi-row insert for block refs, quoting the
+// column names (offset is a keyword) in the style of the database tx is for
+func generateInsertQuery(tx *gorm.DB, data []map[string]any) (string, []any) {
 	placeholders := strings.Repeat("(?, ?, ?),", len(data))
 	placeholders = placeholders[:len(placeholders)-1] // trim trailing comma
 
-	query := "INSERT INTO block_refs (\"cid\", \"offset\", \"shard\") VALUES " + placeholders
+	q := tx.Statement.Quote
+	query := "INSERT INTO " + q("block_refs") + " (" + q("cid") + ", " + q("offset") + ", " + q("shard") + ") VALUES " + placeholders
 
 	values := make([]any, 0, 3*len(data))
 	for _, entry := range data {
@@ -710,7 +831,7 @@ func createInBatches(ctx context.Context, tx *gorm.DB, data []map[string]any, ba
 		}
 
 		batch := data[i:end]
-		query, values := generateInsertQuery(batch)
+		query, values := generateInsertQuery(tx, batch)
 
 		if err := tx.WithContext(ctx).Exec(query, values...).Error; err != nil {
 			return err
@@ -725,31 +846,54 @@ func (ds *DeltaSession) CloseAsRebase(ctx context.Context, root cid.Cid) error {
 		return err
 	}
 
-	// TODO: this *could* get large, might be worth doing it incrementally
-	var oldslices []CarShard
-	if err := ds.cs.meta.Find(&oldslices, "usr = ? AND seq < ?", ds.user, ds.seq).Error; err != nil {
-		return err
-	}
+	return ds.cs.deleteShardsBefore(ctx, ds.user, ds.seq)
+}
+
+// deleteShardsBefore removes every shard of the user older than seq, along
+// with its blocks, a batch at a time so that users with very long histories
+// don't have to fit in memory.
+func (cs *CarStore) deleteShardsBefore(ctx context.Context, user models.Uid, seq int) error {
+	ctx, span := otel.Tracer("carstore").Start(ctx, "deleteShardsBefore")
+	defer span.End()
+	span.SetAttributes(attribute.Int64("user", int64(user)), attribute.Int("seq", seq))
+
+	start := time.Now()
+	deleted := 0
 
 	// If anything here fails, cleanup is straightforward. Simply look for any
 	// shard in the database with a higher seq shard marked as 'rebase'
-	for _, sl := range oldslices {
-		if err := os.Remove(sl.Path); err != nil {
-			if !os.IsNotExist(err) {
-				return err
+	for {
+		var oldslices []CarShard
+		if err := cs.meta.WithContext(ctx).Limit(100).Find(&oldslices, "usr = ? AND seq < ?", user, seq).Error; err != nil {
+			return err
+		}
+
+		if len(oldslices) == 0 {
+			span.SetAttributes(attribute.Int("deleted", deleted))
+			compactionDuration.Observe(time.Since(start).Seconds())
+			return nil
+		}
+
+		ids := make([]uint, 0, len(oldslices))
+		for _, sl := range oldslices {
+			if err := os.Remove(sl.Path); err != nil {
+				if !os.IsNotExist(err) {
+					return err
+				}
 			}
+			ids = append(ids, sl.ID)
 		}
 
-		if err := ds.cs.meta.Delete(&sl).Error; err != nil {
+		if err := cs.meta.WithContext(ctx).Where("shard IN ?", ids).Delete(&blockRef{}).Error; err != nil {
 			return err
 		}
 
-		if err := ds.cs.meta.Where("shard = ?", sl.ID).Delete(&blockRef{}).Error; err != nil {
+		if err := cs.meta.WithContext(ctx).Delete(&CarShard{}, ids).Error; err != nil {
 			return err
 		}
+		deleted += len(ids)
+		shardsCompacted.Add(float64(len(ids)))
 	}
-
-	return nil
 }
 
 func LdWrite(w io.Writer, d ...[]byte) (int64, error) {
@@ -874,6 +1018,10 @@ func (cs *CarStore) checkFork(ctx context.Context, user models.Uid, prev cid.Cid
 }
 
 func (cs *CarStore) TakeDownRepo(ctx context.Context, user models.Uid) error {
+	if cs.readonly {
+		return ErrCarStoreReadOnly
+	}
+
 	var shards []CarShard
 	if err := cs.meta.Find(&shards, "usr = ?", user).Error; err != nil {
 		return err
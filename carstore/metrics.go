@@ -0,0 +1,45 @@
+package carstore
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var readDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "carstore_read_duration_seconds",
+	Help:    "Duration of carstore reads, by kind (block, prefetch or car)",
+	Buckets: prometheus.ExponentialBuckets(0.0001, 2, 18),
+}, []string{"kind"})
+
+var writeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "carstore_write_duration_seconds",
+	Help:    "Duration of shard writes, including their block refs, by kind (delta or shard_writer)",
+	Buckets: prometheus.ExponentialBuckets(0.0001, 2, 18),
+}, []string{"kind"})
+
+var bytesWritten = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "carstore_bytes_written_total",
+	Help: "Total bytes written to shard files, by kind (delta or shard_writer)",
+}, []string{"kind"})
+
+var blocksWritten = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "carstore_blocks_written_total",
+	Help: "Total number of blocks written to shard files, by kind (delta or shard_writer)",
+}, []string{"kind"})
+
+var userShards = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "carstore_user_shards",
+	Help:    "Number of shards making up users' repos, observed when a whole repo is read",
+	Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+})
+
+var compactionDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "carstore_compaction_duration_seconds",
+	Help:    "Duration of deleting the shards older than a rebase",
+	Buckets: prometheus.ExponentialBuckets(0.001, 2, 16),
+})
+
+var shardsCompacted = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "carstore_shards_compacted_total",
+	Help: "Total number of shards deleted because a rebase replaced them",
+})
@@ -132,6 +132,47 @@ func TestBasicOperation(t *testing.T) {
 
 }
 
+func TestShardWriterAfterClose(t *testing.T) {
+	ctx := context.TODO()
+
+	cs, cleanup, err := testCarStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	ds, err := cs.NewDeltaSession(ctx, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := setupRepo(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sw, err := cs.NewShardWriter(ctx, 1, nil, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk, err := ds.Get(ctx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.Put(ctx, blk); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cs.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.Close(ctx); err != ErrCarStoreClosed {
+		t.Fatalf("expected shard writer to fail once the carstore is closed, got %v", err)
+	}
+	if _, err := os.Stat(sw.path); !os.IsNotExist(err) {
+		t.Fatalf("expected abandoned shard file to be removed, got %v", err)
+	}
+}
+
 func setupRepo(ctx context.Context, bs blockstore.Blockstore) (cid.Cid, error) {
 	nr := repo.NewRepo(ctx, "did:foo", bs)
 
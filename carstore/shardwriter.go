@@ -0,0 +1,203 @@
+package carstore
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/bluesky-social/indigo/models"
+
+	blockformat "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-libipfs/blocks"
+	carutil "github.com/ipld/go-car/util"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ShardWriter streams blocks straight into a new shard file, for imports that
+// are too large to buffer in a DeltaSession. Only the offsets of written
+// blocks are kept in memory. Blocks can be read back through the writer as
+// soon as they are written, but are not visible to the rest of the carstore
+// until Close is called.
+type ShardWriter struct {
+	cs   *CarStore
+	user models.Uid
+	seq  int
+	root cid.Cid
+
+	fi        *os.File
+	w         *bufio.Writer
+	path      string
+	dataStart int64
+	offset    int64
+	offsets   map[cid.Cid]int64
+	start     time.Time
+}
+
+// NewShardWriter starts a new shard for the user, with the given root. As with
+// NewDeltaSession, prev must match the users current head if it is set.
+func (cs *CarStore) NewShardWriter(ctx context.Context, user models.Uid, prev *cid.Cid, root cid.Cid) (*ShardWriter, error) {
+	ctx, span := otel.Tracer("carstore").Start(ctx, "NewShardWriter")
+	defer span.End()
+
+	if cs.readonly {
+		return nil, ErrCarStoreReadOnly
+	}
+
+	lastShard, err := cs.checkBase(ctx, user, prev)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, path, err := cs.openNewShardFile(ctx, user, lastShard.Seq+1)
+	if err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(fi)
+	hnw, err := WriteCarHeader(w, root)
+	if err != nil {
+		fi.Close()
+		os.Remove(path)
+		return nil, fmt.Errorf("failed to write car header: %w", err)
+	}
+
+	return &ShardWriter{
+		cs:        cs,
+		user:      user,
+		seq:       lastShard.Seq + 1,
+		root:      root,
+		fi:        fi,
+		w:         w,
+		path:      path,
+		dataStart: hnw,
+		offset:    hnw,
+		offsets:   make(map[cid.Cid]int64),
+		start:     time.Now(),
+	}, nil
+}
+
+// Put appends a block to the shard. Blocks that have already been written are
+// skipped.
+func (sw *ShardWriter) Put(ctx context.Context, blk blockformat.Block) error {
+	if _, ok := sw.offsets[blk.Cid()]; ok {
+		return nil
+	}
+
+	nw, err := LdWrite(sw.w, blk.Cid().Bytes(), blk.RawData())
+	if err != nil {
+		return fmt.Errorf("failed to write block: %w", err)
+	}
+
+	sw.offsets[blk.Cid()] = sw.offset
+	sw.offset += nw
+	return nil
+}
+
+// Get reads back a block written to the shard
+func (sw *ShardWriter) Get(ctx context.Context, k cid.Cid) (blockformat.Block, error) {
+	off, ok := sw.offsets[k]
+	if !ok {
+		return nil, ipld.ErrNotFound{Cid: k}
+	}
+
+	if err := sw.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	rcid, data, err := carutil.ReadNode(bufio.NewReader(io.NewSectionReader(sw.fi, off, sw.offset-off)))
+	if err != nil {
+		return nil, err
+	}
+
+	if rcid != k {
+		return nil, fmt.Errorf("mismatch in cid on disk: %s != %s", rcid, k)
+	}
+
+	return blocks.NewBlockWithCid(data, rcid)
+}
+
+// Has reports whether the block has been written to the shard
+func (sw *ShardWriter) Has(ctx context.Context, k cid.Cid) (bool, error) {
+	_, ok := sw.offsets[k]
+	return ok, nil
+}
+
+// Close finishes the shard, making its blocks part of the users repo and its
+// root the users head
+func (sw *ShardWriter) Close(ctx context.Context) error {
+	ctx, span := otel.Tracer("carstore").Start(ctx, "ShardWriterClose")
+	defer span.End()
+	span.SetAttributes(attribute.Int64("user", int64(sw.user)), attribute.Int("seq", sw.seq), attribute.Int("blocks", len(sw.offsets)), attribute.Int64("bytes", sw.offset))
+
+	sw.cs.writeLk.RLock()
+	defer sw.cs.writeLk.RUnlock()
+	if sw.cs.closed {
+		sw.Abort()
+		return ErrCarStoreClosed
+	}
+
+	if err := sw.w.Flush(); err != nil {
+		sw.Abort()
+		return err
+	}
+
+	if err := sw.fi.Sync(); err != nil {
+		sw.Abort()
+		return err
+	}
+
+	if err := sw.fi.Close(); err != nil {
+		os.Remove(sw.path)
+		return err
+	}
+
+	brefs := make([]map[string]any, 0, len(sw.offsets))
+	for k, off := range sw.offsets {
+		brefs = append(brefs, map[string]any{
+			"cid":    models.DbCID{CID: k},
+			"offset": off,
+		})
+	}
+
+	shard := CarShard{
+		Root:      models.DbCID{CID: sw.root},
+		DataStart: sw.dataStart,
+		Seq:       sw.seq,
+		Path:      sw.path,
+		Usr:       sw.user,
+	}
+
+	if err := sw.cs.putShard(ctx, &shard, brefs); err != nil {
+		os.Remove(sw.path)
+		return err
+	}
+	// the whole time the shard was open, as its blocks are written as they
+	// are fetched
+	writeDuration.WithLabelValues("shard_writer").Observe(time.Since(sw.start).Seconds())
+	bytesWritten.WithLabelValues("shard_writer").Add(float64(sw.offset))
+	blocksWritten.WithLabelValues("shard_writer").Add(float64(len(sw.offsets)))
+
+	return nil
+}
+
+// CloseAsRebase finishes the shard like Close, then deletes all of the users
+// older shards. The shard must hold a complete copy of the repo.
+func (sw *ShardWriter) CloseAsRebase(ctx context.Context) error {
+	if err := sw.Close(ctx); err != nil {
+		return err
+	}
+
+	return sw.cs.deleteShardsBefore(ctx, sw.user, sw.seq)
+}
+
+// Abort discards the shard
+func (sw *ShardWriter) Abort() error {
+	sw.fi.Close()
+	return os.Remove(sw.path)
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	label "github.com/bluesky-social/indigo/api/label"
+	"github.com/bluesky-social/indigo/util/counters"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultThrottle is how long alerts with the same rule and key are not sent
+// again for, if the rule doesn't say
+const DefaultThrottle = 10 * time.Minute
+
+// AlertsConfig is the alerts file: the notification channels, and the rules
+// of which events to notify them about. For example:
+//
+//	channels:
+//	  mods:
+//	    type: slack
+//	    url: $SLACK_WEBHOOK_URL
+//	  oncall:
+//	    type: pagerduty
+//	    routing_key: $PAGERDUTY_ROUTING_KEY
+//	alerts:
+//	  - name: new-report
+//	    when:
+//	      new_report: {}
+//	    channels: [mods]
+//	  - name: firehose-stall
+//	    when:
+//	      firehose_stall:
+//	        after: 5m
+//	    channels: [mods, oncall]
+type AlertsConfig struct {
+	Channels map[string]*ChannelConfig `yaml:"channels"`
+	Alerts   []*AlertRule              `yaml:"alerts"`
+}
+
+// AlertRule sends alerts to channels when its condition is met
+type AlertRule struct {
+	Name     string         `yaml:"name"`
+	When     AlertCondition `yaml:"when"`
+	Channels []string       `yaml:"channels"`
+	Severity string         `yaml:"severity,omitempty"`
+	// Throttle is how long alerts with the same key are not sent again for
+	// (eg the same label spiking), DefaultThrottle if unset
+	Throttle time.Duration `yaml:"throttle,omitempty"`
+}
+
+// AlertCondition is what alert rules fire on. Exactly one field is set.
+type AlertCondition struct {
+	// NewReport fires on each new moderation report
+	NewReport *ReportFilter `yaml:"new_report,omitempty"`
+	// ReportRate fires when there are more than MoreThan new reports in the
+	// window
+	ReportRate *RateCondition `yaml:"report_rate,omitempty"`
+	// LabelRate fires when a label is applied more than MoreThan times in the
+	// window
+	LabelRate *RateCondition `yaml:"label_rate,omitempty"`
+	// FirehoseStall fires when the firehose had no events for a while, and
+	// is resolved when they start again
+	FirehoseStall *StallCondition `yaml:"firehose_stall,omitempty"`
+}
+
+type ReportFilter struct {
+	// ReasonTypes limits the reports counted to these reason types, if set.
+	// The short form (eg reasonSpam) can be used.
+	ReasonTypes []string `yaml:"reason_types,omitempty"`
+}
+
+func (rf *ReportFilter) matches(reasonType string) bool {
+	if len(rf.ReasonTypes) == 0 {
+		return true
+	}
+	for _, rt := range rf.ReasonTypes {
+		if rt == reasonType || rt == shortReasonType(reasonType) {
+			return true
+		}
+	}
+	return false
+}
+
+type RateCondition struct {
+	ReportFilter `yaml:",inline"`
+
+	Window   time.Duration `yaml:"window"`
+	MoreThan int           `yaml:"more_than"`
+	// Labels limits the labels counted to these values, if set
+	Labels []string `yaml:"labels,omitempty"`
+}
+
+func (rc *RateCondition) matchesLabel(val string) bool {
+	if len(rc.Labels) == 0 {
+		return true
+	}
+	for _, l := range rc.Labels {
+		if l == val {
+			return true
+		}
+	}
+	return false
+}
+
+type StallCondition struct {
+	After time.Duration `yaml:"after"`
+}
+
+// LoadAlertsFile reads an alerts file, and checks its rules
+func LoadAlertsFile(path string) (*AlertsConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg AlertsConfig
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing alerts file: %w", err)
+	}
+	if err := cfg.check(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func (cfg *AlertsConfig) check() error {
+	if len(cfg.Alerts) == 0 {
+		return fmt.Errorf("alerts file has no alerts")
+	}
+
+	for i, r := range cfg.Alerts {
+		if r.Name == "" {
+			return fmt.Errorf("alert %d: name is required", i)
+		}
+
+		var n int
+		for _, set := range []bool{r.When.NewReport != nil, r.When.ReportRate != nil, r.When.LabelRate != nil, r.When.FirehoseStall != nil} {
+			if set {
+				n++
+			}
+		}
+		if n != 1 {
+			return fmt.Errorf("alert %s: expected exactly one condition, got %d", r.Name, n)
+		}
+		for _, rc := range []*RateCondition{r.When.ReportRate, r.When.LabelRate} {
+			if rc != nil && (rc.Window <= 0 || rc.MoreThan < 0) {
+				return fmt.Errorf("alert %s: rates need a window and more_than", r.Name)
+			}
+		}
+		if r.When.FirehoseStall != nil && r.When.FirehoseStall.After <= 0 {
+			return fmt.Errorf("alert %s: firehose stalls need a duration (after)", r.Name)
+		}
+
+		if len(r.Channels) == 0 {
+			return fmt.Errorf("alert %s: no channels", r.Name)
+		}
+		for _, ch := range r.Channels {
+			if _, ok := cfg.Channels[ch]; !ok {
+				return fmt.Errorf("alert %s: unknown channel %q", r.Name, ch)
+			}
+		}
+	}
+	return nil
+}
+
+// needs returns which event sources the rules need
+func (cfg *AlertsConfig) needs() (reports, labels, firehose bool) {
+	for _, r := range cfg.Alerts {
+		reports = reports || r.When.NewReport != nil || r.When.ReportRate != nil
+		labels = labels || r.When.LabelRate != nil
+		firehose = firehose || r.When.FirehoseStall != nil
+	}
+	return
+}
+
+// alerter checks events against alert rules, and sends the alerts to their
+// channels
+type alerter struct {
+	rules    []*AlertRule
+	channels map[string]Notifier
+	counts   counters.Store
+
+	lk        sync.Mutex
+	lastFired map[string]time.Time
+	// the rules currently alerting for a stall
+	stalled       map[string]bool
+	lastFirehose  time.Time
+	firehoseStart time.Time
+}
+
+func newAlerter(cfg *AlertsConfig) (*alerter, error) {
+	channels := make(map[string]Notifier)
+	for name, cc := range cfg.Channels {
+		n, err := newNotifier(name, cc)
+		if err != nil {
+			return nil, err
+		}
+		channels[name] = n
+	}
+
+	counts, err := counters.NewMemoryStore(10_000)
+	if err != nil {
+		return nil, err
+	}
+
+	return &alerter{
+		rules:     cfg.Alerts,
+		channels:  channels,
+		counts:    counts,
+		lastFired: make(map[string]time.Time),
+		stalled:   make(map[string]bool),
+	}, nil
+}
+
+// fire sends an alert to the channels of its rule, unless one with the same
+// key was sent within the throttle period. Resolutions are always sent.
+func (al *alerter) fire(ctx context.Context, r *AlertRule, a *Alert) {
+	a.Rule = r.Name
+	if a.Severity == "" {
+		a.Severity = r.Severity
+	}
+	if a.Severity == "" {
+		a.Severity = SeverityInfo
+	}
+
+	throttle := r.Throttle
+	if throttle == 0 {
+		throttle = DefaultThrottle
+	}
+	key := r.Name + ":" + a.Key
+	now := time.Now()
+
+	al.lk.Lock()
+	last, ok := al.lastFired[key]
+	if ok && !a.Resolved && now.Sub(last) < throttle {
+		al.lk.Unlock()
+		log.Debugf("throttled alert rule=%s key=%s", r.Name, a.Key)
+		return
+	}
+	if a.Resolved {
+		delete(al.lastFired, key)
+	} else {
+		al.lastFired[key] = now
+	}
+	al.lk.Unlock()
+
+	log.Infof("sending alert rule=%s key=%s resolved=%v", r.Name, a.Key, a.Resolved)
+	for _, ch := range r.Channels {
+		if err := al.channels[ch].Notify(ctx, a); err != nil {
+			// one failing channel shouldn't keep the alert from the others
+			log.Errorf("failed to send alert rule=%s channel=%s: %v", r.Name, ch, err)
+		}
+	}
+}
+
+// countRate counts an event for a rate condition, and returns how many there
+// were in its window
+func (al *alerter) countRate(ctx context.Context, key string, rc *RateCondition) (int, error) {
+	w := counters.NewWindow(rc.Window)
+	now := time.Now()
+	if err := al.counts.Incr(ctx, key, w, now); err != nil {
+		return 0, err
+	}
+	return al.counts.Count(ctx, key, w, now)
+}
+
+func shortReasonType(reasonType string) string {
+	if _, short, ok := strings.Cut(reasonType, "#"); ok {
+		return short
+	}
+	return reasonType
+}
+
+// HandleReport checks a new report against the rules. text describes the
+// report, for new report alerts.
+func (al *alerter) HandleReport(ctx context.Context, report *comatproto.AdminDefs_ReportView, text string) {
+	reasonType := ""
+	if report.ReasonType != nil {
+		reasonType = *report.ReasonType
+	}
+
+	for _, r := range al.rules {
+		switch {
+		case r.When.NewReport != nil && r.When.NewReport.matches(reasonType):
+			al.fire(ctx, r, &Alert{
+				Key:  fmt.Sprintf("report:%d", report.Id),
+				Text: text,
+			})
+		case r.When.ReportRate != nil && r.When.ReportRate.matches(reasonType):
+			n, err := al.countRate(ctx, "reports:"+r.Name, r.When.ReportRate)
+			if err != nil {
+				log.Errorf("failed to count reports rule=%s: %v", r.Name, err)
+				continue
+			}
+			if n > r.When.ReportRate.MoreThan {
+				al.fire(ctx, r, &Alert{
+					Key:  "reports",
+					Text: fmt.Sprintf("Report spike: `%d` new reports in the last %s", n, r.When.ReportRate.Window),
+				})
+			}
+		}
+	}
+}
+
+// HandleLabel checks a newly applied label against the rules
+func (al *alerter) HandleLabel(ctx context.Context, l *label.Label) {
+	if l.Neg {
+		return
+	}
+
+	for _, r := range al.rules {
+		rc := r.When.LabelRate
+		if rc == nil || !rc.matchesLabel(l.Val) {
+			continue
+		}
+		n, err := al.countRate(ctx, "labels:"+r.Name+":"+l.Val, rc)
+		if err != nil {
+			log.Errorf("failed to count labels rule=%s: %v", r.Name, err)
+			continue
+		}
+		if n > rc.MoreThan {
+			al.fire(ctx, r, &Alert{
+				Key:  "label:" + l.Val,
+				Text: fmt.Sprintf("Label spike: `%s` applied `%d` times in the last %s, by `%s`", l.Val, n, rc.Window, l.Src),
+			})
+		}
+	}
+}
+
+// HandleFirehoseEvent records that the firehose is flowing, and resolves any
+// stall alerts
+func (al *alerter) HandleFirehoseEvent(ctx context.Context) {
+	now := time.Now()
+
+	al.lk.Lock()
+	al.lastFirehose = now
+	var resolved []*AlertRule
+	for _, r := range al.rules {
+		if al.stalled[r.Name] {
+			delete(al.stalled, r.Name)
+			resolved = append(resolved, r)
+		}
+	}
+	al.lk.Unlock()
+
+	for _, r := range resolved {
+		al.fire(ctx, r, &Alert{
+			Key:      "firehose",
+			Text:     "Firehose is flowing again",
+			Resolved: true,
+		})
+	}
+}
+
+// CheckStalls fires the stall alerts of rules whose firehose stall duration
+// passed since the last firehose event (or since watching the firehose
+// started, if there were none yet)
+func (al *alerter) CheckStalls(ctx context.Context, now time.Time) {
+	al.lk.Lock()
+	last := al.lastFirehose
+	if last.IsZero() {
+		last = al.firehoseStart
+	}
+	var stalled []*AlertRule
+	for _, r := range al.rules {
+		sc := r.When.FirehoseStall
+		if sc == nil || last.IsZero() || al.stalled[r.Name] || now.Sub(last) < sc.After {
+			continue
+		}
+		al.stalled[r.Name] = true
+		stalled = append(stalled, r)
+	}
+	al.lk.Unlock()
+
+	for _, r := range stalled {
+		al.fire(ctx, r, &Alert{
+			Key:  "firehose",
+			Text: fmt.Sprintf("Firehose stalled: no events since `%s`", last.Format(time.RFC3339)),
+		})
+	}
+}
+
+// startFirehose marks when watching the firehose started, from which stalls
+// are counted until the first event
+func (al *alerter) startFirehose() {
+	al.lk.Lock()
+	defer al.lk.Unlock()
+	al.firehoseStart = time.Now()
+}
@@ -1,20 +1,20 @@
-// Bluesky MOderation bot (BMO), a chatops helper for slack
-// For now, polls a PDS for new moderation reports and publishes notifications to slack
+// Bluesky MOderation bot (BMO), a chatops helper for slack and other channels
+// Polls a PDS for new moderation reports, and watches labelers and the firehose,
+// and publishes notifications to slack, discord, pagerduty or webhooks
 
 package main
 
 import (
-	"bytes"
-	"context"
-	"encoding/json"
 	"fmt"
-	"net/http"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
 	"time"
 
 	comatproto "github.com/bluesky-social/indigo/api/atproto"
-	"github.com/bluesky-social/indigo/util"
+	label "github.com/bluesky-social/indigo/api/label"
+	"github.com/bluesky-social/indigo/util/cliutil"
+	"github.com/bluesky-social/indigo/util/cursorstore"
 	"github.com/bluesky-social/indigo/util/version"
 	"github.com/bluesky-social/indigo/xrpc"
 
@@ -23,6 +23,7 @@ import (
 
 	logging "github.com/ipfs/go-log"
 	"github.com/urfave/cli/v2"
+	"golang.org/x/sync/errgroup"
 )
 
 var log = logging.Logger("beemo")
@@ -55,30 +56,42 @@ func run(args []string) error {
 			EnvVars: []string{"ATP_REDSKY_HOST"},
 		},
 		&cli.StringFlag{
-			Name:     "handle",
-			Usage:    "for PDS login",
-			Required: true,
-			EnvVars:  []string{"ATP_AUTH_HANDLE"},
+			Name:    "handle",
+			Usage:   "for PDS login (required to watch for reports)",
+			EnvVars: []string{"ATP_AUTH_HANDLE"},
 		},
 		&cli.StringFlag{
-			Name:     "password",
-			Usage:    "for PDS login",
-			Required: true,
-			EnvVars:  []string{"ATP_AUTH_PASSWORD"},
+			Name:    "password",
+			Usage:   "for PDS login (required to watch for reports)",
+			EnvVars: []string{"ATP_AUTH_PASSWORD"},
 		},
 		&cli.StringFlag{
-			Name:     "admin-password",
-			Usage:    "admin authentication password for PDS",
-			Required: true,
-			EnvVars:  []string{"ATP_AUTH_ADMIN_PASSWORD"},
+			Name:    "admin-password",
+			Usage:   "admin authentication password for PDS (required to watch for reports)",
+			EnvVars: []string{"ATP_AUTH_ADMIN_PASSWORD"},
 		},
 		&cli.StringFlag{
 			Name: "slack-webhook-url",
 			// eg: https://hooks.slack.com/services/X1234
-			Usage:    "full URL of slack webhook",
-			Required: true,
-			EnvVars:  []string{"SLACK_WEBHOOK_URL"},
+			Usage:   "full URL of slack webhook, for notify-reports",
+			EnvVars: []string{"SLACK_WEBHOOK_URL"},
 		},
+		&cli.StringFlag{
+			Name:    "alerts-file",
+			Usage:   "notification channels and alert rules, as YAML file, for watch",
+			EnvVars: []string{"BEEMO_ALERTS_FILE"},
+		},
+		&cli.StringFlag{
+			Name:    "labeler-host",
+			Usage:   "method, hostname, and port of labeler, for label alerts",
+			EnvVars: []string{"ATP_LABELER_HOST"},
+		},
+		&cli.StringFlag{
+			Name:    "bgs-host",
+			Usage:   "method, hostname, and port of BGS, for firehose alerts",
+			EnvVars: []string{"ATP_BGS_HOST"},
+		},
+		cliutil.CursorStoreFlag,
 		&cli.IntFlag{
 			Name:    "poll-period",
 			Usage:   "API poll period in seconds",
@@ -92,132 +105,139 @@ func run(args []string) error {
 			Usage:  "watch for new moderation reports, notify in slack",
 			Action: pollNewReports,
 		},
+		&cli.Command{
+			Name:   "watch",
+			Usage:  "watch for reports, label spikes and firehose stalls, notify channels of an alerts file",
+			Action: watch,
+		},
 	}
 	return app.Run(args)
 }
 
 func pollNewReports(cctx *cli.Context) error {
+	ctx := cctx.Context
+	if cctx.String("slack-webhook-url") == "" {
+		return fmt.Errorf("--slack-webhook-url is required")
+	}
+
 	// record last-seen report timestamp
 	since := time.Now()
 	// NOTE: uncomment this for testing
 	//since = time.Now().Add(time.Duration(-12) * time.Hour)
-	period := time.Duration(cctx.Int("poll-period")) * time.Second
 
-	// create a new session
-	xrpcc := &xrpc.Client{
-		Client: util.RobustHTTPClient(),
-		Host:   cctx.String("pds-host"),
-		Auth:   &xrpc.AuthInfo{Handle: cctx.String("handle")},
+	xrpcc, err := pdsLogin(ctx, cctx)
+	if err != nil {
+		return err
 	}
 
-	auth, err := comatproto.ServerCreateSession(context.TODO(), xrpcc, &comatproto.ServerCreateSession_Input{
-		Identifier: xrpcc.Auth.Handle,
-		Password:   cctx.String("password"),
+	al, err := newAlerter(&AlertsConfig{
+		Channels: map[string]*ChannelConfig{
+			"slack": {Type: "slack", URL: cctx.String("slack-webhook-url")},
+		},
+		Alerts: []*AlertRule{{
+			Name:     "new-report",
+			When:     AlertCondition{NewReport: &ReportFilter{}},
+			Channels: []string{"slack"},
+			Severity: SeverityWarning,
+		}},
 	})
 	if err != nil {
 		return err
 	}
-	xrpcc.Auth.AccessJwt = auth.AccessJwt
-	xrpcc.Auth.RefreshJwt = auth.RefreshJwt
-	xrpcc.Auth.Did = auth.Did
-	xrpcc.Auth.Handle = auth.Handle
 
-	adminToken := cctx.String("admin-password")
-	if len(adminToken) > 0 {
-		xrpcc.AdminToken = &adminToken
-	}
 	log.Infof("report polling bot starting up...")
 	// can flip this bool to false to prevent spamming slack channel on startup
 	if true {
-		err := sendSlackMsg(cctx, fmt.Sprintf("restarted bot, monitoring for reports since `%s`...", since.Format(time.RFC3339)))
+		slack := al.channels["slack"]
+		err := slack.Notify(ctx, &Alert{Text: fmt.Sprintf("restarted bot, monitoring for reports since `%s`...", since.Format(time.RFC3339))})
 		if err != nil {
 			return err
 		}
 	}
-	for {
-		// refresh session
-		xrpcc.Auth.AccessJwt = xrpcc.Auth.RefreshJwt
-		refresh, err := comatproto.ServerRefreshSession(context.TODO(), xrpcc)
+
+	return pollReports(ctx, cctx, xrpcc, since, func(report *comatproto.AdminDefs_ReportView, text string) {
+		al.HandleReport(ctx, report, text)
+	})
+}
+
+// watch sends alerts to the channels of an alerts file, watching the event
+// sources its rules need
+func watch(cctx *cli.Context) error {
+	ctx, stop := signal.NotifyContext(cctx.Context, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	path := cctx.String("alerts-file")
+	if path == "" {
+		return fmt.Errorf("--alerts-file is required")
+	}
+	cfg, err := LoadAlertsFile(path)
+	if err != nil {
+		return err
+	}
+	al, err := newAlerter(cfg)
+	if err != nil {
+		return err
+	}
+
+	needReports, needLabels, needFirehose := cfg.needs()
+	labelerHost, bgsHost := cctx.String("labeler-host"), cctx.String("bgs-host")
+	if needLabels && labelerHost == "" {
+		return fmt.Errorf("--labeler-host is required for label alerts")
+	}
+	if needFirehose && bgsHost == "" {
+		return fmt.Errorf("--bgs-host is required for firehose alerts")
+	}
+
+	var xrpcc *xrpc.Client
+	if needReports {
+		xrpcc, err = pdsLogin(ctx, cctx)
 		if err != nil {
 			return err
 		}
-		xrpcc.Auth.AccessJwt = refresh.AccessJwt
-		xrpcc.Auth.RefreshJwt = refresh.RefreshJwt
+	}
 
-		// AdminGetModerationReports(ctx context.Context, c *xrpc.Client, actionType string, actionedBy string, cursor string, ignoreSubjects []string, limit int64, reporters []string, resolved bool, reverse bool, subject string) (*AdminGetModerationReports_Output, error)
-		resolved := false
-		var limit int64 = 50
-		mrr, err := comatproto.AdminGetModerationReports(context.TODO(), xrpcc, "", "", "", nil, limit, nil, resolved, false, "")
+	var labelCursors *cursorstore.Tracker
+	if needLabels {
+		cs, err := cliutil.OpenCursorStore(cctx, nil)
 		if err != nil {
 			return err
 		}
-		// this works out to iterate from newest to oldest, which is the behavior we want (report only newest, then break)
-		for _, report := range mrr.Reports {
-			if len(report.ResolvedByActionIds) > 0 {
-				continue
-			}
-			createdAt, err := time.Parse(time.RFC3339, report.CreatedAt)
-			if err != nil {
-				return fmt.Errorf("invalid time format for 'createdAt': %w", err)
-			}
-			if createdAt.After(since) {
-				shortType := ""
-				if report.ReasonType != nil && strings.Contains(*report.ReasonType, "#") {
-					shortType = strings.SplitN(*report.ReasonType, "#", 2)[1]
-				}
-				// ok, we found a "new" report, need to notify
-				msg := fmt.Sprintf("⚠️ New report at `%s` ⚠️\n", report.CreatedAt)
-				msg += fmt.Sprintf("report id: `%d`\t", report.Id)
-				msg += fmt.Sprintf("recent unresolved: `%d`\t", len(mrr.Reports))
-				msg += fmt.Sprintf("instance: `%s`\n", cctx.String("pds-host"))
-				msg += fmt.Sprintf("reasonType: `%s`\t", shortType)
-				msg += fmt.Sprintf("Redsky: %s/reports/%d\n", cctx.String("redsky-host"), report.Id)
-				//msg += fmt.Sprintf("reportedByDid: `%s`\n", report.ReportedByDid)
-				log.Infof("found new report, notifying slack: %s", report)
-				err := sendSlackMsg(cctx, msg)
-				if err != nil {
-					return fmt.Errorf("failed to send slack message: %w", err)
-				}
-				since = createdAt
-				break
-			} else {
-				log.Debugf("skipping report: %s", report)
+		if cs != nil {
+			defer cs.Close()
+			labelCursors = cursorstore.NewTracker(cs, "beemo/"+labelerHost)
+			if _, err := labelCursors.Load(ctx); err != nil {
+				return fmt.Errorf("loading label cursor: %w", err)
 			}
 		}
-		log.Infof("... sleeping for %s", period)
-		time.Sleep(period)
 	}
-}
 
-type SlackWebhookBody struct {
-	Text string `json:"text"`
-}
-
-// sends a simple slack message to a channel via "incoming webhook"
-// The slack incoming webhook must be already configured in the slack workplace.
-func sendSlackMsg(cctx *cli.Context, msg string) error {
-	// loosely based on: https://golangcode.com/send-slack-messages-without-a-library/
-
-	webhookUrl := cctx.String("slack-webhook-url")
-	body, _ := json.Marshal(SlackWebhookBody{Text: msg})
-	req, err := http.NewRequest(http.MethodPost, webhookUrl, bytes.NewBuffer(body))
-	if err != nil {
-		return err
+	eg, ctx := errgroup.WithContext(ctx)
+	if needReports {
+		eg.Go(func() error {
+			return pollReports(ctx, cctx, xrpcc, time.Now(), func(report *comatproto.AdminDefs_ReportView, text string) {
+				al.HandleReport(ctx, report, text)
+			})
+		})
 	}
-	req.Header.Add("Content-Type", "application/json")
-	client := util.RobustHTTPClient()
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
+	if labelCursors != nil {
+		eg.Go(func() error {
+			labelCursors.Run(ctx, 5*time.Second)
+			return nil
+		})
 	}
-
-	defer resp.Body.Close()
-
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(resp.Body)
-	if resp.StatusCode != 200 || buf.String() != "ok" {
-		// TODO: in some cases print body? eg, if short and text
-		return fmt.Errorf("failed slack webhook POST request. status=%d", resp.StatusCode)
+	if needLabels {
+		eg.Go(func() error {
+			return watchLabels(ctx, labelerHost, labelCursors, func(l *label.Label) {
+				al.HandleLabel(ctx, l)
+			})
+		})
 	}
-	return nil
+	if needFirehose {
+		eg.Go(func() error {
+			return watchFirehose(ctx, bgsHost, al)
+		})
+	}
+
+	log.Infof("watching for alerts rules=%d", len(cfg.Alerts))
+	return eg.Wait()
 }
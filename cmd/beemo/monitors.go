@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	label "github.com/bluesky-social/indigo/api/label"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/events/schedulers/sequential"
+	"github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/util/cursorstore"
+	"github.com/bluesky-social/indigo/xrpc"
+
+	"github.com/gorilla/websocket"
+	"github.com/urfave/cli/v2"
+)
+
+// reconnectDelay is how long streams wait before reconnecting after failing
+const reconnectDelay = 5 * time.Second
+
+// stallCheckPeriod is how often firehose stalls are checked for
+const stallCheckPeriod = 10 * time.Second
+
+// pdsLogin creates a session on the PDS, with admin auth for moderation
+// endpoints
+func pdsLogin(ctx context.Context, cctx *cli.Context) (*xrpc.Client, error) {
+	for _, f := range []string{"handle", "password", "admin-password"} {
+		if cctx.String(f) == "" {
+			return nil, fmt.Errorf("--%s is required to watch for reports", f)
+		}
+	}
+
+	xrpcc := &xrpc.Client{
+		Client: util.RobustHTTPClient(),
+		Host:   cctx.String("pds-host"),
+		Auth:   &xrpc.AuthInfo{Handle: cctx.String("handle")},
+	}
+
+	auth, err := comatproto.ServerCreateSession(ctx, xrpcc, &comatproto.ServerCreateSession_Input{
+		Identifier: xrpcc.Auth.Handle,
+		Password:   cctx.String("password"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	xrpcc.Auth.AccessJwt = auth.AccessJwt
+	xrpcc.Auth.RefreshJwt = auth.RefreshJwt
+	xrpcc.Auth.Did = auth.Did
+	xrpcc.Auth.Handle = auth.Handle
+
+	adminToken := cctx.String("admin-password")
+	xrpcc.AdminToken = &adminToken
+	return xrpcc, nil
+}
+
+// pollReports polls the PDS for new moderation reports, and passes them to
+// handle, oldest first, with a description for notifications
+func pollReports(ctx context.Context, cctx *cli.Context, xrpcc *xrpc.Client, since time.Time, handle func(report *comatproto.AdminDefs_ReportView, text string)) error {
+	period := time.Duration(cctx.Int("poll-period")) * time.Second
+
+	for {
+		// refresh session
+		xrpcc.Auth.AccessJwt = xrpcc.Auth.RefreshJwt
+		refresh, err := comatproto.ServerRefreshSession(ctx, xrpcc)
+		if err != nil {
+			return err
+		}
+		xrpcc.Auth.AccessJwt = refresh.AccessJwt
+		xrpcc.Auth.RefreshJwt = refresh.RefreshJwt
+
+		resolved := false
+		var limit int64 = 50
+		mrr, err := comatproto.AdminGetModerationReports(ctx, xrpcc, "", "", "", nil, limit, nil, resolved, false, "")
+		if err != nil {
+			return err
+		}
+
+		// reports come newest first
+		var fresh []*comatproto.AdminDefs_ReportView
+		for _, report := range mrr.Reports {
+			if len(report.ResolvedByActionIds) > 0 {
+				continue
+			}
+			createdAt, err := time.Parse(time.RFC3339, report.CreatedAt)
+			if err != nil {
+				return fmt.Errorf("invalid time format for 'createdAt': %w", err)
+			}
+			if !createdAt.After(since) {
+				log.Debugf("skipping report: %v", report)
+				break
+			}
+			fresh = append(fresh, report)
+		}
+
+		for i := len(fresh) - 1; i >= 0; i-- {
+			report := fresh[i]
+			log.Infof("found new report: %v", report)
+			handle(report, reportText(cctx, report, len(mrr.Reports)))
+		}
+		if len(fresh) > 0 {
+			since, _ = time.Parse(time.RFC3339, fresh[0].CreatedAt)
+		}
+
+		log.Infof("... sleeping for %s", period)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(period):
+		}
+	}
+}
+
+// reportText is the notification text of a new report
+func reportText(cctx *cli.Context, report *comatproto.AdminDefs_ReportView, unresolved int) string {
+	shortType := ""
+	if report.ReasonType != nil && strings.Contains(*report.ReasonType, "#") {
+		shortType = strings.SplitN(*report.ReasonType, "#", 2)[1]
+	}
+	msg := fmt.Sprintf("New report at `%s`\n", report.CreatedAt)
+	msg += fmt.Sprintf("report id: `%d`\t", report.Id)
+	msg += fmt.Sprintf("recent unresolved: `%d`\t", unresolved)
+	msg += fmt.Sprintf("instance: `%s`\n", cctx.String("pds-host"))
+	msg += fmt.Sprintf("reasonType: `%s`\t", shortType)
+	msg += fmt.Sprintf("Redsky: %s/reports/%d\n", cctx.String("redsky-host"), report.Id)
+	//msg += fmt.Sprintf("reportedByDid: `%s`\n", report.ReportedByDid)
+	return msg
+}
+
+// streamURL returns the websocket URL of a subscription endpoint on host
+func streamURL(host, nsid string) (string, error) {
+	if !strings.Contains(host, "://") {
+		host = "wss://" + host
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	case "http":
+		u.Scheme = "ws"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/xrpc/" + nsid
+	return u.String(), nil
+}
+
+// consumeStream subscribes to a stream until ctx is done, reconnecting when
+// it fails. With cursors, it resumes from the last event handled, and
+// otherwise from the live end of the stream.
+func consumeStream(ctx context.Context, host, nsid string, cursors *cursorstore.Tracker, do func(context.Context, *events.XRPCStreamEvent) error) error {
+	base, err := streamURL(host, nsid)
+	if err != nil {
+		return err
+	}
+	if cursors != nil {
+		next := do
+		do = func(ctx context.Context, xev *events.XRPCStreamEvent) error {
+			if err := next(ctx, xev); err != nil {
+				return err
+			}
+			cursors.Advance(xev.Sequence(), xev.Time())
+			return nil
+		}
+	}
+
+	for {
+		u := base
+		if cursors != nil {
+			if seq := cursors.Cursor().Seq; seq > 0 {
+				u = fmt.Sprintf("%s?cursor=%d", base, seq)
+			}
+		}
+		log.Infof("subscribing to %s", u)
+		con, _, err := websocket.DefaultDialer.DialContext(ctx, u, http.Header{})
+		if err != nil {
+			log.Errorf("failed to connect to %s: %v", u, err)
+		} else {
+			sched := sequential.NewScheduler(nsid, do)
+			if err := events.HandleRepoStream(ctx, con, sched); err != nil && ctx.Err() == nil {
+				log.Errorf("stream %s failed: %v", u, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+// watchLabels passes the labels a labeler applies to handle, keeping its
+// place in the stream with cursors if not nil
+func watchLabels(ctx context.Context, host string, cursors *cursorstore.Tracker, handle func(l *label.Label)) error {
+	return consumeStream(ctx, host, "com.atproto.label.subscribeLabels", cursors, func(ctx context.Context, xev *events.XRPCStreamEvent) error {
+		if xev.Error != nil {
+			return fmt.Errorf("error frame: %s: %s", xev.Error.Error, xev.Error.Message)
+		}
+		if xev.LabelLabels != nil {
+			for _, l := range xev.LabelLabels.Labels {
+				handle(l)
+			}
+		}
+		return nil
+	})
+}
+
+// watchFirehose follows the firehose of a BGS, for stall alerts. Failing to
+// connect to it counts as a stall too.
+func watchFirehose(ctx context.Context, host string, al *alerter) error {
+	al.startFirehose()
+	go func() {
+		t := time.NewTicker(stallCheckPeriod)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-t.C:
+				al.CheckStalls(ctx, now)
+			}
+		}
+	}()
+
+	return consumeStream(ctx, host, "com.atproto.sync.subscribeRepos", nil, func(ctx context.Context, xev *events.XRPCStreamEvent) error {
+		if xev.Error != nil {
+			return fmt.Errorf("error frame: %s: %s", xev.Error.Error, xev.Error.Message)
+		}
+		al.HandleFirehoseEvent(ctx)
+		return nil
+	})
+}
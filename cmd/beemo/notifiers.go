@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/util/version"
+)
+
+// Alert is a notification sent to channels
+type Alert struct {
+	// Rule is the name of the alert rule which fired
+	Rule string `json:"rule"`
+	// Key identifies what the alert is about (eg a report, or a label value),
+	// for deduplication. Alerts with the same rule and key are throttled.
+	Key      string `json:"key"`
+	Severity string `json:"severity"`
+	Text     string `json:"text"`
+	// Resolved is set on alerts saying the condition of an earlier alert
+	// with the same key is over, eg that the firehose is flowing again
+	Resolved bool `json:"resolved,omitempty"`
+}
+
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// Notifier sends alerts to a notification channel
+type Notifier interface {
+	Notify(ctx context.Context, a *Alert) error
+}
+
+// ChannelConfig is a notification channel, as configured in the alerts file
+type ChannelConfig struct {
+	// Type is one of slack, discord, pagerduty or webhook
+	Type string `yaml:"type"`
+	// URL is the webhook URL, for all types except pagerduty. Values
+	// starting with $ are read from the environment.
+	URL string `yaml:"url,omitempty"`
+	// RoutingKey is the integration key of PagerDuty services. Values
+	// starting with $ are read from the environment.
+	RoutingKey string `yaml:"routing_key,omitempty"`
+	// Headers are set on generic webhook requests, eg for auth. Values
+	// starting with $ are read from the environment.
+	Headers map[string]string `yaml:"headers,omitempty"`
+}
+
+// expandSecret reads values like "$SLACK_WEBHOOK_URL" from the environment, so
+// that secrets don't have to be in the alerts file
+func expandSecret(v string) string {
+	if len(v) > 1 && v[0] == '$' {
+		return os.Getenv(v[1:])
+	}
+	return v
+}
+
+func newNotifier(name string, cfg *ChannelConfig) (Notifier, error) {
+	url := expandSecret(cfg.URL)
+	if cfg.Type != "pagerduty" && url == "" {
+		return nil, fmt.Errorf("channel %s: url is required", name)
+	}
+
+	switch cfg.Type {
+	case "slack":
+		return &SlackNotifier{WebhookURL: url}, nil
+	case "discord":
+		return &DiscordNotifier{WebhookURL: url}, nil
+	case "pagerduty":
+		key := expandSecret(cfg.RoutingKey)
+		if key == "" {
+			return nil, fmt.Errorf("channel %s: routing_key is required", name)
+		}
+		return &PagerDutyNotifier{RoutingKey: key}, nil
+	case "webhook":
+		headers := make(map[string]string, len(cfg.Headers))
+		for k, v := range cfg.Headers {
+			headers[k] = expandSecret(v)
+		}
+		return &WebhookNotifier{URL: url, Headers: headers}, nil
+	default:
+		return nil, fmt.Errorf("channel %s: unknown type %q", name, cfg.Type)
+	}
+}
+
+// alertText is the text of an alert, for chat channels
+func alertText(a *Alert) string {
+	switch {
+	case a.Resolved:
+		return "✅ " + a.Text
+	case a.Severity == SeverityCritical:
+		return "🚨 " + a.Text
+	case a.Severity == SeverityWarning:
+		return "⚠️ " + a.Text
+	default:
+		return a.Text
+	}
+}
+
+// postJSON posts body to url, and returns the response body if the request
+// succeeded
+func postJSON(ctx context.Context, url string, headers map[string]string, body any) ([]byte, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "beemo/"+version.Version)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := util.RobustHTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return respBody, fmt.Errorf("request failed. status=%d", resp.StatusCode)
+	}
+	return respBody, nil
+}
+
+type SlackWebhookBody struct {
+	Text string `json:"text"`
+}
+
+// SlackNotifier sends alerts to a slack channel via "incoming webhook". The
+// slack incoming webhook must be already configured in the slack workplace.
+type SlackNotifier struct {
+	WebhookURL string
+}
+
+func (sn *SlackNotifier) Notify(ctx context.Context, a *Alert) error {
+	// loosely based on: https://golangcode.com/send-slack-messages-without-a-library/
+	body, err := postJSON(ctx, sn.WebhookURL, nil, SlackWebhookBody{Text: alertText(a)})
+	if err != nil {
+		// TODO: in some cases print body? eg, if short and text
+		return fmt.Errorf("failed slack webhook POST request: %w", err)
+	}
+	if string(body) != "ok" {
+		return fmt.Errorf("failed slack webhook POST request: unexpected response")
+	}
+	return nil
+}
+
+type DiscordWebhookBody struct {
+	Content string `json:"content"`
+}
+
+// DiscordNotifier sends alerts to a discord channel via a webhook
+type DiscordNotifier struct {
+	WebhookURL string
+}
+
+func (dn *DiscordNotifier) Notify(ctx context.Context, a *Alert) error {
+	// discord messages are limited to 2000 characters
+	text := alertText(a)
+	if len(text) > 2000 {
+		text = text[:1997] + "..."
+	}
+	if _, err := postJSON(ctx, dn.WebhookURL, nil, DiscordWebhookBody{Content: text}); err != nil {
+		return fmt.Errorf("failed discord webhook POST request: %w", err)
+	}
+	return nil
+}
+
+// schema: https://developer.pagerduty.com/docs/events-api-v2/trigger-events/
+type PagerDutyEvent struct {
+	RoutingKey  string                  `json:"routing_key"`
+	EventAction string                  `json:"event_action"`
+	DedupKey    string                  `json:"dedup_key"`
+	Payload     *PagerDutyEvent_Payload `json:"payload,omitempty"`
+}
+
+type PagerDutyEvent_Payload struct {
+	Summary  string `json:"summary"`
+	Source   string `json:"source"`
+	Severity string `json:"severity"`
+}
+
+// PagerDutyEventsURL is the endpoint of the PagerDuty events API
+var PagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// PagerDutyNotifier triggers PagerDuty incidents, and resolves them when the
+// alert is resolved. Incidents are deduplicated by the rule and key of
+// alerts.
+type PagerDutyNotifier struct {
+	RoutingKey string
+}
+
+func (pn *PagerDutyNotifier) Notify(ctx context.Context, a *Alert) error {
+	evt := PagerDutyEvent{
+		RoutingKey:  pn.RoutingKey,
+		EventAction: "trigger",
+		DedupKey:    a.Rule + ":" + a.Key,
+	}
+	if a.Resolved {
+		evt.EventAction = "resolve"
+	} else {
+		sev := a.Severity
+		if sev == "" {
+			sev = SeverityInfo
+		}
+		summary := a.Text
+		if len(summary) > 1024 {
+			summary = summary[:1021] + "..."
+		}
+		evt.Payload = &PagerDutyEvent_Payload{
+			Summary:  summary,
+			Source:   "beemo",
+			Severity: sev,
+		}
+	}
+
+	if _, err := postJSON(ctx, PagerDutyEventsURL, nil, evt); err != nil {
+		return fmt.Errorf("failed pagerduty event request: %w", err)
+	}
+	return nil
+}
+
+// WebhookNotifier posts alerts as JSON to a URL
+type WebhookNotifier struct {
+	URL     string
+	Headers map[string]string
+}
+
+func (wn *WebhookNotifier) Notify(ctx context.Context, a *Alert) error {
+	if _, err := postJSON(ctx, wn.URL, wn.Headers, a); err != nil {
+		return fmt.Errorf("failed webhook POST request: %w", err)
+	}
+	return nil
+}
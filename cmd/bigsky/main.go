@@ -2,11 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"os"
-	"os/signal"
 	"path/filepath"
-	"syscall"
+	"runtime"
 	"time"
 
 	"github.com/bluesky-social/indigo/api"
@@ -15,17 +16,19 @@ import (
 	"github.com/bluesky-social/indigo/carstore"
 	"github.com/bluesky-social/indigo/did"
 	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/identity"
 	"github.com/bluesky-social/indigo/indexer"
+	"github.com/bluesky-social/indigo/lex/validate"
 	"github.com/bluesky-social/indigo/notifs"
-	"github.com/bluesky-social/indigo/plc"
 	"github.com/bluesky-social/indigo/repomgr"
+	"github.com/bluesky-social/indigo/rules"
 	"github.com/bluesky-social/indigo/util/cliutil"
+	"github.com/bluesky-social/indigo/util/counters"
+	"github.com/bluesky-social/indigo/util/serviceauth"
 	"github.com/bluesky-social/indigo/util/version"
 	"github.com/bluesky-social/indigo/xrpc"
 	_ "go.uber.org/automaxprocs"
 
-	_ "net/http/pprof"
-
 	_ "github.com/joho/godotenv/autoload"
 
 	logging "github.com/ipfs/go-log"
@@ -101,10 +104,6 @@ func run(args []string) {
 			Name:  "api-listen",
 			Value: ":2470",
 		},
-		&cli.StringFlag{
-			Name:  "debug-listen",
-			Value: "localhost:2471",
-		},
 		&cli.StringFlag{
 			Name: "disk-blob-store",
 		},
@@ -112,6 +111,11 @@ func run(args []string) {
 			Name:  "disk-persister-dir",
 			Usage: "set directory for disk persister (implicitly enables disk persister)",
 		},
+		&cli.StringFlag{
+			Name:    "postgres-events-channel",
+			Usage:   "persist events in full to the (postgres) database, announcing them with NOTIFY on this channel, for consumers which read them from there",
+			EnvVars: []string{"BGS_POSTGRES_EVENTS_CHANNEL"},
+		},
 		&cli.StringFlag{
 			Name:    "admin-key",
 			EnvVars: []string{"BGS_ADMIN_KEY"},
@@ -120,6 +124,46 @@ func run(args []string) {
 			Name:    "handle-resolver-hosts",
 			EnvVars: []string{"HANDLE_RESOLVER_HOSTS"},
 		},
+		&cli.StringFlag{
+			Name:    "handle-resolver-dns",
+			Usage:   "dns server (host:port) for handle TXT lookups, instead of the system resolver",
+			EnvVars: []string{"HANDLE_RESOLVER_DNS"},
+		},
+		&cli.StringFlag{
+			Name:    "handle-resolver-doh",
+			Usage:   "dns over https endpoint for handle TXT lookups, such as https://cloudflare-dns.com/dns-query",
+			EnvVars: []string{"HANDLE_RESOLVER_DOH"},
+		},
+		&cli.DurationFlag{
+			Name:    "handle-resolver-dns-cache",
+			Usage:   "how long to cache handle TXT lookups, 0 to disable",
+			Value:   5 * time.Minute,
+			EnvVars: []string{"HANDLE_RESOLVER_DNS_CACHE"},
+		},
+		&cli.BoolFlag{
+			Name:    "identity-db-cache",
+			Usage:   "keep resolved identities in the database too, so they are still cached after a restart",
+			Value:   true,
+			EnvVars: []string{"BGS_IDENTITY_DB_CACHE"},
+		},
+		&cli.DurationFlag{
+			Name:    "identity-warm-interval",
+			Usage:   "how often identities in the database cache that are about to expire are resolved again",
+			Value:   time.Minute,
+			EnvVars: []string{"BGS_IDENTITY_WARM_INTERVAL"},
+		},
+		&cli.IntFlag{
+			Name:    "identity-warm-batch",
+			Usage:   "how many identities are resolved again at most every identity-warm-interval",
+			Value:   500,
+			EnvVars: []string{"BGS_IDENTITY_WARM_BATCH"},
+		},
+		&cli.DurationFlag{
+			Name:    "handle-reconcile-interval",
+			Usage:   "how often the handles of all accounts are verified again, to tombstone or update those which changed without an event (never if zero)",
+			Value:   24 * time.Hour,
+			EnvVars: []string{"BGS_HANDLE_RECONCILE_INTERVAL"},
+		},
 		&cli.IntFlag{
 			Name:    "max-carstore-connections",
 			EnvVars: []string{"MAX_CARSTORE_CONNECTIONS"},
@@ -130,7 +174,106 @@ func run(args []string) {
 			EnvVars: []string{"MAX_METADB_CONNECTIONS"},
 			Value:   40,
 		},
+		&cli.StringFlag{
+			Name:    "lexicon-dir",
+			Usage:   "directory of lexicon JSON files to validate records and XRPC requests against (validation is disabled if unset)",
+			EnvVars: []string{"LEXICON_DIR"},
+		},
+		&cli.BoolFlag{
+			Name:    "strict-validation",
+			Usage:   "reject records that can not be fully validated against a known lexicon",
+			EnvVars: []string{"STRICT_VALIDATION"},
+		},
+		&cli.StringFlag{
+			Name:    "rules-file",
+			Usage:   "moderation rules to check incoming records against, as YAML file",
+			EnvVars: []string{"BGS_RULES_FILE"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "upstream-relay",
+			Usage:   "hostname of another relay to consume the firehose of, as well as that of PDSs, can be repeated",
+			EnvVars: []string{"BGS_UPSTREAM_RELAYS"},
+		},
+		&cli.StringFlag{
+			Name:    "commit-verification",
+			Usage:   "how thoroughly commits from PDSs and relays are checked before they are stored: none (signature only), light (signature, prev and record blocks) or full (light, and ops match the repo tree)",
+			Value:   "light",
+			EnvVars: []string{"BGS_COMMIT_VERIFICATION"},
+		},
+		&cli.IntFlag{
+			Name:    "commit-verify-workers",
+			Usage:   "number of workers verifying commits (defaults to GOMAXPROCS)",
+			EnvVars: []string{"BGS_COMMIT_VERIFY_WORKERS"},
+		},
+		&cli.BoolFlag{
+			Name:    "replica",
+			Usage:   "serve the sync endpoints and firehose of another BGS, from a read replica of its database and its carstore (shared with it), without ingesting",
+			EnvVars: []string{"BGS_REPLICA"},
+		},
+		&cli.DurationFlag{
+			Name:    "replica-poll-interval",
+			Usage:   "how often a replica checks the database for new events",
+			Value:   events.DefaultReplicaOptions().PollInterval,
+			EnvVars: []string{"BGS_REPLICA_POLL_INTERVAL"},
+		},
+		&cli.DurationFlag{
+			Name:    "event-batch-target-latency",
+			Usage:   "how long each batch of events written to the database should take, with batches sized to fit (0 for fixed size batches)",
+			Value:   50 * time.Millisecond,
+			EnvVars: []string{"BGS_EVENT_BATCH_TARGET_LATENCY"},
+		},
+		&cli.IntFlag{
+			Name:    "event-batch-max-size",
+			Usage:   "most events written to the database in one batch",
+			Value:   events.DefaultOptions().MaxBatchSize,
+			EnvVars: []string{"BGS_EVENT_BATCH_MAX_SIZE"},
+		},
+		&cli.Int64Flag{
+			Name:    "subscriber-bandwidth-cap",
+			Usage:   "most bytes per second sent to each firehose subscriber, unless set for them through the admin API (0 for no cap)",
+			EnvVars: []string{"BGS_SUBSCRIBER_BANDWIDTH_CAP"},
+		},
+		&cli.StringFlag{
+			Name:    "service-did",
+			Usage:   "DID of this BGS, which firehose subscribers authenticating with service auth tokens address them to (service auth is refused if unset)",
+			EnvVars: []string{"BGS_SERVICE_DID"},
+		},
+		&cli.BoolFlag{
+			Name:    "require-subscriber-auth",
+			Usage:   "refuse firehose subscribers which don't authenticate with a subscriber token or service auth token",
+			EnvVars: []string{"BGS_REQUIRE_SUBSCRIBER_AUTH"},
+		},
+		&cli.StringFlag{
+			Name:    "anonymous-subscriber-policy",
+			Usage:   "policy for firehose subscribers which don't authenticate, as JSON like the admin API's (eg '{}' for none), needed to allow them once any subscriber has a policy",
+			EnvVars: []string{"BGS_ANONYMOUS_SUBSCRIBER_POLICY"},
+		},
+		&cli.StringFlag{
+			Name:    "counters-redis-url",
+			Usage:   "redis server used to share the velocities rules count between instances (in-memory if unset)",
+			EnvVars: []string{"COUNTERS_REDIS_URL"},
+		},
+	}
+
+	app.Flags = append(app.Flags, cliutil.IdentityCacheFlags...)
+	app.Flags = append(app.Flags, cliutil.InvalidationBusFlag)
+	app.Flags = append(app.Flags, cliutil.DatabaseFlags("metadb")...)
+	app.Flags = append(app.Flags, cliutil.DatabaseFlags("carstore")...)
+	app.Flags = append(app.Flags, cliutil.AutoMigrateFlag)
+	app.Flags = append(app.Flags, cliutil.ShutdownFlags...)
+	app.Flags = append(app.Flags, cliutil.DebugFlags("localhost:2471")...)
+	app.Flags = append(app.Flags, cliutil.LogFlags...)
+	app.Flags = append(app.Flags, cliutil.ConfigFlag)
+	app.Before = func(cctx *cli.Context) error {
+		if err := cliutil.LoadConfig(cctx); err != nil {
+			return err
+		}
+		if err := cliutil.ResolveSecretFlags(cctx, "admin-key"); err != nil {
+			return err
+		}
+		return cliutil.SetupLogging(cctx)
 	}
+	app.Commands = []*cli.Command{cliutil.ConfigCommand, cliutil.MigrateCommand(nil, Bigsky)}
 
 	app.Action = Bigsky
 	err := app.Run(os.Args)
@@ -140,9 +283,8 @@ func run(args []string) {
 }
 
 func Bigsky(cctx *cli.Context) error {
-	// Trap SIGINT to trigger a shutdown.
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	// stops everything cleanly on SIGINT or SIGTERM
+	sm := cliutil.NewShutdownManagerFromFlags(cctx)
 
 	if cctx.Bool("jaeger") {
 		url := "http://localhost:14268/api/traces"
@@ -206,14 +348,40 @@ func Bigsky(cctx *cli.Context) error {
 		return err
 	}
 
+	verifyLevel, err := repomgr.ParseVerifyLevel(cctx.String("commit-verification"))
+	if err != nil {
+		return err
+	}
+
+	// replicas never write to the databases, the ingesting BGS migrates them
+	replica := cctx.Bool("replica")
+	if replica {
+		if cliutil.MigrateOnly(cctx) {
+			return fmt.Errorf("replicas don't migrate the database, migrate the ingesting BGS instead")
+		}
+		if cctx.String("disk-persister-dir") != "" {
+			return fmt.Errorf("replicas read events from the database, and can't be used with the disk persister")
+		}
+		if cctx.String("postgres-events-channel") != "" {
+			return fmt.Errorf("replicas don't persist events, set the postgres events channel on the ingesting BGS instead")
+		}
+		if len(cctx.StringSlice("upstream-relay")) > 0 {
+			return fmt.Errorf("replicas don't ingest, set upstream relays on the ingesting BGS instead")
+		}
+	}
+
+	dbopts := cliutil.DatabaseOptions(cctx, "metadb")
+	dbopts.DisableAutoMigrate = dbopts.DisableAutoMigrate || replica
 	dburl := cctx.String("db-url")
-	db, err := cliutil.SetupDatabase(dburl, cctx.Int("max-metadb-connections"))
+	db, err := cliutil.SetupDatabaseWithOptions(dburl, dbopts)
 	if err != nil {
 		return err
 	}
 
+	csdbopts := cliutil.DatabaseOptions(cctx, "carstore")
+	csdbopts.DisableAutoMigrate = csdbopts.DisableAutoMigrate || replica
 	csdburl := cctx.String("carstore-db-url")
-	csdb, err := cliutil.SetupDatabase(csdburl, cctx.Int("max-carstore-connections"))
+	csdb, err := cliutil.SetupDatabaseWithOptions(csdburl, csdbopts)
 	if err != nil {
 		return err
 	}
@@ -227,8 +395,13 @@ func Bigsky(cctx *cli.Context) error {
 		}
 	}
 
-	os.MkdirAll(filepath.Dir(csdir), os.ModePerm)
-	cstore, err := carstore.NewCarStore(csdb, csdir)
+	var cstore *carstore.CarStore
+	if replica {
+		cstore, err = carstore.NewReadOnlyCarStore(csdb, csdir)
+	} else {
+		os.MkdirAll(filepath.Dir(csdir), os.ModePerm)
+		cstore, err = carstore.NewCarStore(csdb, csdir)
+	}
 	if err != nil {
 		return err
 	}
@@ -244,7 +417,46 @@ func Bigsky(cctx *cli.Context) error {
 	}
 	mr.AddHandler("web", &webr)
 
-	cachedidr := plc.NewCachingDidResolver(mr, time.Minute*5, 1000)
+	phr := &api.ProdHandleResolver{}
+	switch {
+	case cctx.String("handle-resolver-doh") != "":
+		phr.DNS = &api.DoHResolver{URL: cctx.String("handle-resolver-doh")}
+	case cctx.String("handle-resolver-dns") != "":
+		phr.DNS = api.NewDNSServerResolver(cctx.String("handle-resolver-dns"))
+	}
+	if ttl := cctx.Duration("handle-resolver-dns-cache"); ttl > 0 {
+		var inner api.TXTResolver = net.DefaultResolver
+		if phr.DNS != nil {
+			inner = phr.DNS
+		}
+		phr.DNS, err = api.NewCachingTXTResolver(inner, 100000, ttl)
+		if err != nil {
+			return err
+		}
+	}
+
+	var hr api.HandleResolver = phr
+	if cctx.StringSlice("handle-resolver-hosts") != nil {
+		hr = &api.TestHandleResolver{
+			TrialHosts: cctx.StringSlice("handle-resolver-hosts"),
+		}
+	}
+
+	cachedidr, err := cliutil.NewIdentityResolver(cctx, mr, hr, "bigsky:identity:", 1000)
+	if err != nil {
+		return err
+	}
+
+	// replicas can't write to the database, so keep their identities in the
+	// plain cache
+	var identityDb *identity.DbCache
+	if cctx.Bool("identity-db-cache") && !replica {
+		identityDb, err = identity.NewDbCache(db, cachedidr.Cache)
+		if err != nil {
+			return fmt.Errorf("setting up identity database cache: %w", err)
+		}
+		cachedidr.Cache = identityDb
+	}
 
 	kmgr := indexer.NewKeyManager(cachedidr, nil)
 
@@ -252,14 +464,31 @@ func Bigsky(cctx *cli.Context) error {
 
 	var persister events.EventPersistence
 
-	if dpd := cctx.String("disk-persister-dir"); dpd != "" {
+	if replica {
+		opts := events.DefaultReplicaOptions()
+		opts.PollInterval = cctx.Duration("replica-poll-interval")
+		rp, err := events.NewReplicaPersistence(cctx.Context, db, cstore, opts)
+		if err != nil {
+			return fmt.Errorf("setting up replica event persistence: %w", err)
+		}
+		persister = rp
+	} else if dpd := cctx.String("disk-persister-dir"); dpd != "" {
 		dp, err := events.NewDiskPersistence(dpd, "", db, events.DefaultDiskPersistOptions())
 		if err != nil {
 			return fmt.Errorf("setting up disk persister: %w", err)
 		}
 		persister = dp
+	} else if channel := cctx.String("postgres-events-channel"); channel != "" {
+		pp, err := events.NewPostgresPersistence(cctx.Context, db, channel)
+		if err != nil {
+			return fmt.Errorf("setting up postgres event persistence: %w", err)
+		}
+		persister = pp
 	} else {
-		dbp, err := events.NewDbPersistence(db, cstore, nil)
+		opts := events.DefaultOptions()
+		opts.TargetFlushLatency = cctx.Duration("event-batch-target-latency")
+		opts.MaxBatchSize = cctx.Int("event-batch-max-size")
+		dbp, err := events.NewDbPersistence(db, cstore, opts)
 		if err != nil {
 			return fmt.Errorf("setting up db event persistence: %w", err)
 		}
@@ -270,11 +499,25 @@ func Bigsky(cctx *cli.Context) error {
 
 	notifman := &notifs.NullNotifs{}
 
-	ix, err := indexer.NewIndexer(db, notifman, evtman, cachedidr, repoman, true, cctx.Bool("aggregation"))
+	ix, err := indexer.NewIndexer(db, notifman, evtman, cachedidr, repoman, !replica, cctx.Bool("aggregation"))
 	if err != nil {
 		return err
 	}
 
+	var validator *validate.Validator
+	if dir := cctx.String("lexicon-dir"); dir != "" {
+		cat := validate.NewCatalog()
+		if err := cat.LoadDirectory(dir); err != nil {
+			return fmt.Errorf("loading lexicons: %w", err)
+		}
+		mode := validate.Lenient
+		if cctx.Bool("strict-validation") {
+			mode = validate.Strict
+		}
+		validator = validate.NewValidator(cat, mode)
+		ix.RecordValidator = validator
+	}
+
 	rlskip := os.Getenv("BSKY_SOCIAL_RATE_LIMIT_SKIP")
 	ix.ApplyPDSClientSettings = func(c *xrpc.Client) {
 		if c.Host == "https://bsky.social" && rlskip != "" {
@@ -295,57 +538,114 @@ func Bigsky(cctx *cli.Context) error {
 		blobstore = &blobs.DiskBlobStore{bsdir}
 	}
 
-	var hr api.HandleResolver = &api.ProdHandleResolver{}
-	if cctx.StringSlice("handle-resolver-hosts") != nil {
-		hr = &api.TestHandleResolver{
-			TrialHosts: cctx.StringSlice("handle-resolver-hosts"),
-		}
+	// everything before here has migrated its tables, and the BGS would
+	// start connecting to PDSs
+	if cliutil.MigrateOnly(cctx) {
+		return bgs.Migrate(db)
 	}
 
-	bgs, err := bgs.NewBGS(db, ix, repoman, evtman, cachedidr, blobstore, hr, !cctx.Bool("crawl-insecure-ws"))
+	newBGS := bgs.NewBGS
+	if replica {
+		log.Info("starting as a read-only replica")
+		newBGS = bgs.NewReplicaBGS
+	}
+	bgs, err := newBGS(db, ix, repoman, evtman, cachedidr, blobstore, cachedidr, !cctx.Bool("crawl-insecure-ws"))
 	if err != nil {
 		return err
 	}
-
-	if tok := cctx.String("admin-key"); tok != "" {
-		if err := bgs.CreateAdminToken(tok); err != nil {
-			return fmt.Errorf("failed to set up admin token: %w", err)
+	if validator != nil {
+		bgs.SetRequestValidator(validator)
+	}
+	invalidations, err := cliutil.OpenInvalidationBus(cctx)
+	if err != nil {
+		return err
+	}
+	bgs.SetInvalidationBus(invalidations)
+	bgs.SetSubscriberBandwidthCap(cctx.Int64("subscriber-bandwidth-cap"))
+	var subscriberServiceAuth *serviceauth.Validator
+	if sd := cctx.String("service-did"); sd != "" {
+		subscriberServiceAuth = &serviceauth.Validator{
+			Dir:        cachedidr,
+			ServiceDID: sd,
+			RequireLxm: true,
 		}
 	}
-
-	// set up pprof endpoint
-	go func() {
-		if err := bgs.StartDebug(cctx.String("debug-listen")); err != nil {
-			panic(err)
+	bgs.SetSubscriptionAuth(subscriberServiceAuth, cctx.Bool("require-subscriber-auth"))
+	if cctx.IsSet("anonymous-subscriber-policy") {
+		p, err := events.ParseSubscriptionPolicy(cctx.String("anonymous-subscriber-policy"))
+		if err != nil {
+			return err
 		}
-	}()
-
-	bgsErr := make(chan error, 1)
+		bgs.SetAnonymousSubscriptionPolicy(p)
+	}
+	if !replica {
+		workers := cctx.Int("commit-verify-workers")
+		if workers <= 0 {
+			workers = runtime.GOMAXPROCS(0)
+		}
+		bgs.SetCommitVerification(verifyLevel, workers)
+	}
 
-	go func() {
-		err := bgs.Start(cctx.String("api-listen"))
-		bgsErr <- err
-	}()
+	for _, host := range cctx.StringSlice("upstream-relay") {
+		if err := bgs.AddUpstreamRelay(cctx.Context, host); err != nil {
+			return fmt.Errorf("subscribing to upstream relay %s: %w", host, err)
+		}
+	}
 
-	select {
-	case <-signals:
-		log.Info("received shutdown signal")
-		errs := bgs.Shutdown()
-		for err := range errs {
-			log.Errorw("error during BGS shutdown", "err", err)
+	if rulesFile := cctx.String("rules-file"); rulesFile != "" && !replica {
+		engine, err := rules.LoadFile(rulesFile)
+		if err != nil {
+			return fmt.Errorf("loading rules: %w", err)
 		}
-	case err := <-bgsErr:
+		velocities, err := counters.NewStore(cctx.String("counters-redis-url"), "bgs:counters:")
 		if err != nil {
-			log.Errorw("error during BGS startup", "err", err)
+			return err
 		}
-		log.Info("shutting down")
-		errs := bgs.Shutdown()
-		for err := range errs {
-			log.Errorw("error during BGS shutdown", "err", err)
+		engine.SetCounters(velocities)
+		bgs.SetRules(engine)
+	}
+
+	// the ingesting BGS creates the admin token in the shared database
+	if tok := cctx.String("admin-key"); tok != "" && !replica {
+		if err := bgs.CreateAdminToken(tok); err != nil {
+			return fmt.Errorf("failed to set up admin token: %w", err)
 		}
 	}
 
+	dbg, err := cliutil.StartDebugServer(cctx, bgs.RegisterDebugHandlers)
+	if err != nil {
+		return err
+	}
+
+	// upstream subscriptions are drained, and their events flushed, before
+	// the carstore stops taking writes
+	sm.Add("bgs", func(ctx context.Context) error {
+		return errors.Join(bgs.Shutdown(ctx)...)
+	})
+	sm.Go("api", func(ctx context.Context) error {
+		return bgs.Start(cctx.String("api-listen"))
+	})
+	if identityDb != nil {
+		sm.Go("identity-warmer", func(ctx context.Context) error {
+			cachedidr.KeepWarm(ctx, identityDb, cctx.Duration("identity-warm-interval"), cctx.Int("identity-warm-batch"))
+			return nil
+		})
+	}
+	if interval := cctx.Duration("handle-reconcile-interval"); interval > 0 && !replica {
+		sm.Go("handle-reconciler", func(ctx context.Context) error {
+			return bgs.RunHandleReconciler(ctx, interval)
+		})
+	}
+	sm.Add("carstore", cstore.Close)
+	sm.Add("invalidation-bus", func(ctx context.Context) error {
+		return invalidations.Close()
+	})
+	if dbg != nil {
+		sm.Add("debug", dbg.Shutdown)
+	}
+
+	err = sm.Wait()
 	log.Info("shutdown complete")
 
-	return nil
+	return err
 }
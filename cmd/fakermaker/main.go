@@ -5,11 +5,13 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"runtime"
+	"time"
 
 	comatproto "github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/fakedata"
@@ -182,6 +184,114 @@ func run(args []string) {
 				},
 			},
 		},
+		&cli.Command{
+			Name:   "gen-dataset",
+			Usage:  "generate a deterministic dataset (follow graph and activity schedule), as JSON lines",
+			Action: genDataset,
+			Flags: []cli.Flag{
+				&cli.Int64Flag{
+					Name:  "seed",
+					Usage: "random seed; the same seed and flags always generate the same dataset",
+					Value: 1,
+				},
+				&cli.IntFlag{
+					Name:    "count",
+					Aliases: []string{"n"},
+					Usage:   "total number of accounts; should match the account catalog",
+					Value:   100,
+				},
+				&cli.IntFlag{
+					Name:  "count-celebrities",
+					Usage: "number of accounts as 'celebrities' (many followers)",
+					Value: 10,
+				},
+				&cli.TimestampFlag{
+					Name:   "start",
+					Usage:  "start time of the dataset activity",
+					Layout: time.RFC3339,
+					Value:  cli.NewTimestamp(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)),
+				},
+				&cli.DurationFlag{
+					Name:  "duration",
+					Usage: "span of time of the dataset activity",
+					Value: 24 * time.Hour,
+				},
+				&cli.Float64Flag{
+					Name:  "posts-per-day",
+					Usage: "mean number of posts (including replies) per account per day",
+					Value: 5,
+				},
+				&cli.Float64Flag{
+					Name:  "follows-per-account",
+					Usage: "mean number of accounts followed by each account",
+					Value: 30,
+				},
+				&cli.Float64Flag{
+					Name:  "frac-reply",
+					Usage: "portion of posts which are replies",
+					Value: 0.30,
+				},
+				&cli.Float64Flag{
+					Name:  "frac-image",
+					Usage: "portion of posts to include images",
+					Value: 0.15,
+				},
+				&cli.Float64Flag{
+					Name:  "frac-mention",
+					Usage: "portion of posts to include mentions",
+					Value: 0.10,
+				},
+				&cli.Float64Flag{
+					Name:  "frac-like",
+					Usage: "portion of an author's followers who like each of their posts",
+					Value: 0.05,
+				},
+				&cli.Float64Flag{
+					Name:  "frac-repost",
+					Usage: "portion of an author's followers who repost each of their posts",
+					Value: 0.01,
+				},
+			},
+		},
+		&cli.Command{
+			Name:   "load-dataset",
+			Usage:  "create all the records of a dataset, as fast as possible (back-dated to the dataset schedule)",
+			Action: loadDataset,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "catalog",
+					Usage: "file path of account catalog JSON file",
+					Value: "data/fakermaker/accounts.json",
+				},
+				&cli.StringFlag{
+					Name:  "dataset",
+					Usage: "file path of dataset JSON file",
+					Value: "data/fakermaker/dataset.json",
+				},
+			},
+		},
+		&cli.Command{
+			Name:   "run-load",
+			Usage:  "stream the activity of a dataset against the PDS, following its schedule",
+			Action: runLoad,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "catalog",
+					Usage: "file path of account catalog JSON file",
+					Value: "data/fakermaker/accounts.json",
+				},
+				&cli.StringFlag{
+					Name:  "dataset",
+					Usage: "file path of dataset JSON file",
+					Value: "data/fakermaker/dataset.json",
+				},
+				&cli.Float64Flag{
+					Name:  "speedup",
+					Usage: "play the schedule this many times faster than real time (eg 60 for an hour of activity per minute)",
+					Value: 1,
+				},
+			},
+		},
 		&cli.Command{
 			Name:   "run-browsing",
 			Usage:  "creates read-only load on service (notifications, timeline, etc)",
@@ -412,6 +522,68 @@ func genInteractions(cctx *cli.Context) error {
 	return eg.Wait()
 }
 
+func genDataset(cctx *cli.Context) error {
+	cfg := fakedata.DatasetConfig{
+		Seed:              cctx.Int64("seed"),
+		Accounts:          cctx.Int("count"),
+		Celebrities:       cctx.Int("count-celebrities"),
+		Start:             cctx.Timestamp("start").UTC(),
+		Duration:          cctx.Duration("duration"),
+		PostsPerDay:       cctx.Float64("posts-per-day"),
+		FollowsPerAccount: cctx.Float64("follows-per-account"),
+		FracReply:         cctx.Float64("frac-reply"),
+		FracImage:         cctx.Float64("frac-image"),
+		FracMention:       cctx.Float64("frac-mention"),
+		FracLike:          cctx.Float64("frac-like"),
+		FracRepost:        cctx.Float64("frac-repost"),
+	}
+
+	t1 := fakedata.MeasureIterations("generate dataset")
+	ds, err := fakedata.GenDataset(cfg)
+	if err != nil {
+		return err
+	}
+	t1(1)
+
+	out := bufio.NewWriter(os.Stdout)
+	if err := ds.Write(out); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+func loadDataset(cctx *cli.Context) error {
+	return runDataset(cctx, 0)
+}
+
+func runLoad(cctx *cli.Context) error {
+	speedup := cctx.Float64("speedup")
+	if speedup <= 0 {
+		return fmt.Errorf("speedup must be positive")
+	}
+	return runDataset(cctx, speedup)
+}
+
+func runDataset(cctx *cli.Context, speedup float64) error {
+	catalog, err := fakedata.ReadAccountCatalog(cctx.String("catalog"))
+	if err != nil {
+		return err
+	}
+	ds, err := fakedata.ReadDataset(cctx.String("dataset"))
+	if err != nil {
+		return err
+	}
+
+	dl := fakedata.DatasetLoader{
+		PdsHost: cctx.String("pds-host"),
+		Catalog: catalog,
+		Dataset: ds,
+		Jobs:    cctx.Int("jobs"),
+		Speedup: speedup,
+	}
+	return dl.Run(cctx.Context)
+}
+
 func runBrowsing(cctx *cli.Context) error {
 	catalog, err := fakedata.ReadAccountCatalog(cctx.String("catalog"))
 	if err != nil {
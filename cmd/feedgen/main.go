@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/feedgen"
+	"github.com/bluesky-social/indigo/util/cliutil"
+	"github.com/bluesky-social/indigo/util/version"
+	"github.com/urfave/cli/v2"
+
+	_ "github.com/joho/godotenv/autoload"
+	_ "go.uber.org/automaxprocs"
+
+	logging "github.com/ipfs/go-log"
+)
+
+var log = logging.Logger("feedgen")
+
+func main() {
+	if err := run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(args []string) error {
+
+	app := cli.App{
+		Name:    "feedgen",
+		Usage:   "atproto feed generator, serving custom feeds of posts indexed from the firehose",
+		Version: version.Version,
+	}
+
+	app.Flags = []cli.Flag{
+		&cli.StringFlag{
+			Name:    "db-url",
+			Usage:   "database connection string for feedgen database",
+			Value:   "sqlite://./data/feedgen/feedgen.sqlite",
+			EnvVars: []string{"DATABASE_URL"},
+		},
+		&cli.StringFlag{
+			Name:    "firehose-host",
+			Usage:   "hostname of the relay to index posts from (ws:// or wss:// URLs are used as given)",
+			Value:   "bsky.network",
+			EnvVars: []string{"FEEDGEN_FIREHOSE_HOST"},
+		},
+		&cli.StringFlag{
+			Name:    "bind",
+			Usage:   "IP or address, and port, to listen on for HTTP APIs",
+			Value:   ":2260",
+			EnvVars: []string{"FEEDGEN_BIND"},
+		},
+		&cli.StringFlag{
+			Name:    "service-did",
+			Usage:   "DID of the feed generator service, eg did:web:feeds.example.com",
+			EnvVars: []string{"FEEDGEN_SERVICE_DID"},
+		},
+		&cli.StringFlag{
+			Name:    "publisher-did",
+			Usage:   "DID of the account whose repo has the feeds' generator records",
+			EnvVars: []string{"FEEDGEN_PUBLISHER_DID"},
+		},
+		&cli.StringFlag{
+			Name:    "endpoint",
+			Usage:   "URL the service is hosted at, for its did:web document (https:// and the did:web domain by default)",
+			EnvVars: []string{"FEEDGEN_ENDPOINT"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "tag-feed",
+			Usage:   "feed of posts with any of a set of hashtags, as NAME=TAG,TAG (can be repeated)",
+			EnvVars: []string{"FEEDGEN_TAG_FEEDS"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "author-feed",
+			Usage:   "feed of the posts, not replies, of a set of accounts, as NAME=DID,DID (can be repeated)",
+			EnvVars: []string{"FEEDGEN_AUTHOR_FEEDS"},
+		},
+		&cli.BoolFlag{
+			Name:    "require-auth",
+			Usage:   "refuse feed requests without a service auth token",
+			EnvVars: []string{"FEEDGEN_REQUIRE_AUTH"},
+		},
+		&cli.DurationFlag{
+			Name:    "retention",
+			Usage:   "how long indexed posts are kept in the feeds (forever if zero)",
+			Value:   7 * 24 * time.Hour,
+			EnvVars: []string{"FEEDGEN_RETENTION"},
+		},
+		&cli.StringFlag{
+			Name:    "plc",
+			Usage:   "method, hostname, and port of PLC registry, to check service auth tokens",
+			Value:   "https://plc.directory",
+			EnvVars: []string{"ATP_PLC_HOST"},
+		},
+	}
+
+	app.Flags = append(app.Flags, cliutil.DatabaseFlags("metadb")...)
+	app.Flags = append(app.Flags, cliutil.AutoMigrateFlag)
+	app.Flags = append(app.Flags, cliutil.ShutdownFlags...)
+	app.Flags = append(app.Flags, cliutil.DebugFlags("")...)
+	app.Flags = append(app.Flags, cliutil.LogFlags...)
+	app.Flags = append(app.Flags, cliutil.ConfigFlag)
+	app.Before = func(cctx *cli.Context) error {
+		if err := cliutil.LoadConfig(cctx); err != nil {
+			return err
+		}
+		return cliutil.SetupLogging(cctx)
+	}
+	app.Commands = []*cli.Command{cliutil.ConfigCommand, publishCmd}
+
+	app.Action = func(cctx *cli.Context) error {
+
+		os.MkdirAll("data/feedgen", os.ModePerm)
+
+		dburl := cctx.String("db-url")
+		db, err := cliutil.SetupDatabaseWithOptions(dburl, cliutil.DatabaseOptions(cctx, "metadb"))
+		if err != nil {
+			return err
+		}
+
+		algos, err := feedsFromFlags(cctx)
+		if err != nil {
+			return err
+		}
+
+		serviceDID := cctx.String("service-did")
+		endpoint := cctx.String("endpoint")
+		if endpoint == "" && strings.HasPrefix(serviceDID, "did:web:") {
+			endpoint = "https://" + strings.TrimPrefix(serviceDID, "did:web:")
+		}
+
+		srv, err := feedgen.NewServer(db, feedgen.Config{
+			ServiceDID:   serviceDID,
+			PublisherDID: cctx.String("publisher-did"),
+			Endpoint:     endpoint,
+			Algorithms:   algos,
+			Resolver:     cliutil.GetDidResolver(cctx),
+			RequireAuth:  cctx.Bool("require-auth"),
+		})
+		if err != nil {
+			return err
+		}
+
+		if cliutil.MigrateOnly(cctx) {
+			return nil
+		}
+
+		firehose := cctx.String("firehose-host")
+		if !strings.Contains(firehose, "://") {
+			firehose = "wss://" + firehose
+		}
+		firehose += "/xrpc/com.atproto.sync.subscribeRepos"
+
+		dbg, err := cliutil.StartDebugServer(cctx)
+		if err != nil {
+			return err
+		}
+
+		sm := cliutil.NewShutdownManagerFromFlags(cctx)
+		sm.Add("feedgen", srv.Shutdown)
+		sm.Go("api", func(ctx context.Context) error {
+			return srv.RunAPI(cctx.String("bind"))
+		})
+		sm.Go("firehose", func(ctx context.Context) error {
+			return srv.Subscribe(ctx, firehose)
+		})
+		if retention := cctx.Duration("retention"); retention > 0 {
+			sm.Go("pruner", func(ctx context.Context) error {
+				return srv.RunPruner(ctx, retention)
+			})
+		}
+		if dbg != nil {
+			sm.Add("debug", dbg.Shutdown)
+		}
+
+		return sm.Wait()
+	}
+	app.Commands = append(app.Commands, cliutil.MigrateCommand(nil, app.Action))
+
+	return app.Run(args)
+}
+
+// feedsFromFlags returns the algorithms of the feeds given with --tag-feed
+// and --author-feed
+func feedsFromFlags(cctx *cli.Context) ([]feedgen.Algorithm, error) {
+	var algos []feedgen.Algorithm
+	for _, f := range cctx.StringSlice("tag-feed") {
+		name, tags, ok := strings.Cut(f, "=")
+		if !ok || name == "" || tags == "" {
+			return nil, fmt.Errorf("tag feed %q is not NAME=TAG,TAG", f)
+		}
+		algos = append(algos, feedgen.NewTagFeed(name, strings.Split(tags, ",")))
+	}
+	for _, f := range cctx.StringSlice("author-feed") {
+		name, dids, ok := strings.Cut(f, "=")
+		if !ok || name == "" || dids == "" {
+			return nil, fmt.Errorf("author feed %q is not NAME=DID,DID", f)
+		}
+		algos = append(algos, &feedgen.AuthorFeed{FeedName: name, DIDs: strings.Split(dids, ",")})
+	}
+	if len(algos) == 0 {
+		return nil, fmt.Errorf("no feeds given, with --tag-feed or --author-feed")
+	}
+	return algos, nil
+}
+
+var publishCmd = &cli.Command{
+	Name:  "publish",
+	Usage: "write a feed's generator record to the publisher's repo, so that it can be found and subscribed to",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "pds-host",
+			Usage:   "method, hostname, and port of the publisher's PDS",
+			Value:   "https://bsky.social",
+			EnvVars: []string{"ATP_PDS_HOST"},
+		},
+		&cli.StringFlag{
+			Name:    "auth",
+			Usage:   "path to JSON file with ATP auth info of the publisher",
+			Value:   "bsky.auth",
+			EnvVars: []string{"ATP_AUTH_FILE"},
+		},
+		&cli.StringFlag{
+			Name:     "name",
+			Usage:    "name of the feed, as given to --tag-feed or --author-feed",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "display-name",
+			Usage:    "name of the feed shown to users",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "description",
+			Usage: "description of the feed shown to users",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		xrpcc, err := cliutil.GetXrpcClient(cctx, true)
+		if err != nil {
+			return err
+		}
+
+		uri, err := feedgen.Publish(cctx.Context, xrpcc, cctx.String("service-did"), feedgen.FeedInfo{
+			Name:        cctx.String("name"),
+			DisplayName: cctx.String("display-name"),
+			Description: cctx.String("description"),
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Println(uri)
+		return nil
+	},
+}
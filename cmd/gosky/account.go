@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/util/cliutil"
+	"github.com/bluesky-social/indigo/xrpc"
+
+	cli "github.com/urfave/cli/v2"
+)
+
+var accountCmd = &cli.Command{
+	Name:  "account",
+	Usage: "manage the logged in account",
+	Subcommands: []*cli.Command{
+		accountExportCmd,
+	},
+}
+
+var accountExportCmd = &cli.Command{
+	Name:  "export",
+	Usage: "save everything needed to migrate the logged in account to another PDS",
+	Description: `Writes the account's signed repo to repo.car, each of its blobs to
+blobs/<cid>, and its preferences to preferences.json, in the given directory.
+These are what a new PDS takes with importRepo, uploadBlob and putPreferences.`,
+	ArgsUsage: `<dir>`,
+	Action: func(cctx *cli.Context) error {
+		args, err := needArgs(cctx, "dir")
+		if err != nil {
+			return err
+		}
+		dir := args[0]
+
+		xrpcc, err := cliutil.GetXrpcClient(cctx, true)
+		if err != nil {
+			return err
+		}
+
+		return exportAccount(cctx, xrpcc, dir)
+	},
+}
+
+func exportAccount(cctx *cli.Context, xrpcc *xrpc.Client, dir string) error {
+	ctx := cctx.Context
+	did := xrpcc.Auth.Did
+
+	if err := os.MkdirAll(filepath.Join(dir, "blobs"), 0755); err != nil {
+		return err
+	}
+
+	car, err := comatproto.SyncGetRepo(ctx, xrpcc, did, "", "")
+	if err != nil {
+		return fmt.Errorf("fetching repo: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "repo.car"), car, 0644); err != nil {
+		return err
+	}
+
+	blobs, err := comatproto.SyncListBlobs(ctx, xrpcc, did, "", "")
+	if err != nil {
+		return fmt.Errorf("listing blobs: %w", err)
+	}
+	for _, c := range blobs.Cids {
+		b, err := comatproto.SyncGetBlob(ctx, xrpcc, c, did)
+		if err != nil {
+			return fmt.Errorf("fetching blob %s: %w", c, err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "blobs", c), b, 0644); err != nil {
+			return err
+		}
+	}
+
+	// preferences are passed through as they are, as they may be of types
+	// we don't know
+	var prefs json.RawMessage
+	if err := xrpcc.Do(ctx, xrpc.Query, "", "app.bsky.actor.getPreferences", nil, nil, &prefs); err != nil {
+		return fmt.Errorf("fetching preferences: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "preferences.json"), prefs, 0644); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "exported %s to %s (%d bytes of repo, %d blobs)\n", did, dir, len(car), len(blobs.Cids))
+	return nil
+}
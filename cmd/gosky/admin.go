@@ -12,7 +12,9 @@ import (
 
 	"github.com/bluesky-social/indigo/api"
 	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/util"
 	"github.com/bluesky-social/indigo/util/cliutil"
+	"github.com/bluesky-social/indigo/xrpc"
 	cli "github.com/urfave/cli/v2"
 )
 
@@ -25,6 +27,11 @@ var adminCmd = &cli.Command{
 		disableInvitesCmd,
 		enableInvitesCmd,
 		listInviteTreeCmd,
+		listAccountsCmd,
+		takedownCmd,
+		reinstateCmd,
+		adminUpdateHandleCmd,
+		adminCreateInvitesCmd,
 	},
 }
 
@@ -600,3 +607,344 @@ var listInviteTreeCmd = &cli.Command{
 		return nil
 	},
 }
+
+// adminPasswordFlag is shared by the admin subcommands below, which each
+// authenticate with the server's admin password rather than a session
+var adminPasswordFlag = &cli.StringFlag{
+	Name:     "admin-password",
+	EnvVars:  []string{"ATP_AUTH_ADMIN_PASSWORD"},
+	Required: true,
+}
+
+const adminTakedownAction = "com.atproto.admin.defs#takedown"
+
+// adminClient returns an xrpc client authed with --admin-password
+func adminClient(cctx *cli.Context) (*xrpc.Client, error) {
+	xrpcc, err := cliutil.GetXrpcClient(cctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	adminKey := cctx.String("admin-password")
+	xrpcc.AdminToken = &adminKey
+	return xrpcc, nil
+}
+
+// resolveAccountDid returns the DID of the given DID or handle
+func resolveAccountDid(ctx context.Context, ident string) (string, error) {
+	if strings.HasPrefix(ident, "did:") {
+		return ident, nil
+	}
+
+	phr := &api.ProdHandleResolver{}
+	did, err := phr.ResolveHandleToDid(ctx, ident)
+	if err != nil {
+		return "", fmt.Errorf("resolve handle %q: %w", ident, err)
+	}
+	return did, nil
+}
+
+// moderationCreatedBy returns the DID moderation actions are recorded as
+// taken by: --created-by, or else the authed account
+func moderationCreatedBy(cctx *cli.Context, xrpcc *xrpc.Client) (string, error) {
+	if by := cctx.String("created-by"); by != "" {
+		return by, nil
+	}
+	if xrpcc.Auth != nil && xrpcc.Auth.Did != "" {
+		return xrpcc.Auth.Did, nil
+	}
+	return "", fmt.Errorf("no moderator DID, pass --created-by or auth")
+}
+
+var listAccountsCmd = &cli.Command{
+	Name:  "listAccounts",
+	Usage: "list accounts with com.atproto.admin.searchRepos, as JSON lines",
+	Flags: []cli.Flag{
+		adminPasswordFlag,
+		&cli.StringFlag{
+			Name:  "term",
+			Usage: "only list accounts whose handle or email matches",
+		},
+		&cli.StringFlag{
+			Name:  "invited-by",
+			Usage: "only list accounts invited by this DID",
+		},
+		&cli.IntFlag{
+			Name:  "limit",
+			Usage: "number of accounts to get per request",
+			Value: 100,
+		},
+		&cli.IntFlag{
+			Name:  "max",
+			Usage: "stop after listing this many accounts (0 for all)",
+		},
+		&cli.StringFlag{
+			Name: "cursor",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		xrpcc, err := adminClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		ctx := cctx.Context
+		enc := json.NewEncoder(os.Stdout)
+		maxListed := cctx.Int("max")
+
+		var listed int
+		cursor := cctx.String("cursor")
+		for {
+			out, err := atproto.AdminSearchRepos(ctx, xrpcc, cursor, cctx.String("invited-by"), int64(cctx.Int("limit")), cctx.String("term"))
+			if err != nil {
+				return fmt.Errorf("searchRepos: %w", err)
+			}
+
+			for _, r := range out.Repos {
+				if err := enc.Encode(r); err != nil {
+					return err
+				}
+				listed++
+				if maxListed > 0 && listed >= maxListed {
+					if out.Cursor != nil {
+						fmt.Fprintf(os.Stderr, "cursor: %s\n", *out.Cursor)
+					}
+					return nil
+				}
+			}
+
+			if out.Cursor == nil || *out.Cursor == "" || len(out.Repos) == 0 {
+				return nil
+			}
+			cursor = *out.Cursor
+		}
+	},
+}
+
+var takedownCmd = &cli.Command{
+	Name:      "takedown",
+	Usage:     "take down an account or a record",
+	ArgsUsage: `<did|handle|at-uri>`,
+	Flags: []cli.Flag{
+		adminPasswordFlag,
+		&cli.StringFlag{
+			Name:     "reason",
+			Usage:    "reason recorded with the takedown",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "created-by",
+			Usage: "DID of the moderator taking the action (defaults to the authed account)",
+		},
+		&cli.StringFlag{
+			Name:  "cid",
+			Usage: "CID of the record version to take down (defaults to the current version)",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		args, err := needArgs(cctx, "subject")
+		if err != nil {
+			return err
+		}
+
+		xrpcc, err := adminClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		createdBy, err := moderationCreatedBy(cctx, xrpcc)
+		if err != nil {
+			return err
+		}
+
+		ctx := cctx.Context
+		subj := &atproto.AdminTakeModerationAction_Input_Subject{}
+		if strings.HasPrefix(args[0], "at://") {
+			puri, err := util.ParseAtUri(args[0])
+			if err != nil {
+				return err
+			}
+			did, err := resolveAccountDid(ctx, puri.Did)
+			if err != nil {
+				return err
+			}
+			uri := "at://" + did + "/" + puri.Collection + "/" + puri.Rkey
+
+			rcid := cctx.String("cid")
+			if rcid == "" {
+				rec, err := atproto.AdminGetRecord(ctx, xrpcc, "", uri)
+				if err != nil {
+					return fmt.Errorf("getRecord %s: %w", uri, err)
+				}
+				rcid = rec.Cid
+			}
+
+			subj.RepoStrongRef = &atproto.RepoStrongRef{Uri: uri, Cid: rcid}
+		} else {
+			did, err := resolveAccountDid(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			subj.AdminDefs_RepoRef = &atproto.AdminDefs_RepoRef{Did: did}
+		}
+
+		out, err := atproto.AdminTakeModerationAction(ctx, xrpcc, &atproto.AdminTakeModerationAction_Input{
+			Action:    adminTakedownAction,
+			CreatedBy: createdBy,
+			Reason:    cctx.String("reason"),
+			Subject:   subj,
+		})
+		if err != nil {
+			return fmt.Errorf("takeModerationAction: %w", err)
+		}
+
+		fmt.Printf("took down %s (action %d)\n", args[0], out.Id)
+		return nil
+	},
+}
+
+var reinstateCmd = &cli.Command{
+	Name:      "reinstate",
+	Usage:     "reverse the takedown of an account or a record",
+	ArgsUsage: `<did|handle|at-uri>`,
+	Flags: []cli.Flag{
+		adminPasswordFlag,
+		&cli.StringFlag{
+			Name:     "reason",
+			Usage:    "reason recorded with the reversal",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "created-by",
+			Usage: "DID of the moderator reversing the action (defaults to the authed account)",
+		},
+		&cli.Int64Flag{
+			Name:  "id",
+			Usage: "ID of the action to reverse (defaults to the subject's latest takedown)",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		args, err := needArgs(cctx, "subject")
+		if err != nil {
+			return err
+		}
+
+		xrpcc, err := adminClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		createdBy, err := moderationCreatedBy(cctx, xrpcc)
+		if err != nil {
+			return err
+		}
+
+		ctx := cctx.Context
+		subject := args[0]
+		if strings.HasPrefix(subject, "at://") {
+			puri, err := util.ParseAtUri(subject)
+			if err != nil {
+				return err
+			}
+			did, err := resolveAccountDid(ctx, puri.Did)
+			if err != nil {
+				return err
+			}
+			subject = "at://" + did + "/" + puri.Collection + "/" + puri.Rkey
+		} else {
+			subject, err = resolveAccountDid(ctx, subject)
+			if err != nil {
+				return err
+			}
+		}
+
+		id := cctx.Int64("id")
+		if id == 0 {
+			id, err = findTakedownAction(ctx, xrpcc, subject)
+			if err != nil {
+				return err
+			}
+		}
+
+		if _, err := atproto.AdminReverseModerationAction(ctx, xrpcc, &atproto.AdminReverseModerationAction_Input{
+			Id:        id,
+			CreatedBy: createdBy,
+			Reason:    cctx.String("reason"),
+		}); err != nil {
+			return fmt.Errorf("reverseModerationAction %d: %w", id, err)
+		}
+
+		fmt.Printf("reinstated %s (reversed action %d)\n", args[0], id)
+		return nil
+	},
+}
+
+// findTakedownAction returns the ID of the latest takedown of subject that
+// has not been reversed
+func findTakedownAction(ctx context.Context, xrpcc *xrpc.Client, subject string) (int64, error) {
+	var cursor string
+	for {
+		out, err := atproto.AdminGetModerationActions(ctx, xrpcc, cursor, 100, subject)
+		if err != nil {
+			return 0, fmt.Errorf("getModerationActions %s: %w", subject, err)
+		}
+
+		// actions are listed newest first
+		for _, a := range out.Actions {
+			if a.Action != nil && *a.Action == adminTakedownAction && a.Reversal == nil {
+				return a.Id, nil
+			}
+		}
+
+		if out.Cursor == nil || *out.Cursor == "" || len(out.Actions) == 0 {
+			return 0, fmt.Errorf("no active takedown of %s", subject)
+		}
+		cursor = *out.Cursor
+	}
+}
+
+var adminUpdateHandleCmd = &cli.Command{
+	Name:      "updateHandle",
+	Usage:     "change the handle of an account",
+	ArgsUsage: `<did|handle> <new-handle>`,
+	Flags: []cli.Flag{
+		adminPasswordFlag,
+	},
+	Action: func(cctx *cli.Context) error {
+		args, err := needArgs(cctx, "account", "new-handle")
+		if err != nil {
+			return err
+		}
+
+		xrpcc, err := adminClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		ctx := cctx.Context
+		did, err := resolveAccountDid(ctx, args[0])
+		if err != nil {
+			return err
+		}
+
+		if err := atproto.AdminUpdateAccountHandle(ctx, xrpcc, &atproto.AdminUpdateAccountHandle_Input{
+			Did:    did,
+			Handle: args[1],
+		}); err != nil {
+			return fmt.Errorf("updateAccountHandle %s: %w", did, err)
+		}
+
+		fmt.Printf("%s is now %s\n", did, args[1])
+		return nil
+	},
+}
+
+// adminCreateInvitesCmd is createInvites, grouped with the other commands
+// needing the admin password
+var adminCreateInvitesCmd = &cli.Command{
+	Name:      "createInvites",
+	Usage:     "create invite codes, for an account or a list of them with --bulk",
+	Flags:     createInviteCmd.Flags,
+	ArgsUsage: createInviteCmd.ArgsUsage,
+	Action:    createInviteCmd.Action,
+}
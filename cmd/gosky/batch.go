@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/util/cliutil"
+	cli "github.com/urfave/cli/v2"
+)
+
+var batchCmd = &cli.Command{
+	Name:  "batch",
+	Usage: "apply record creates, updates and deletes from a JSONL file with com.atproto.repo.applyWrites",
+	Description: `Reads one operation per line, from the given file or stdin, such as
+
+  {"action":"create","collection":"app.bsky.feed.post","value":{"$type":"app.bsky.feed.post","text":"hi","createdAt":"2023-08-01T00:00:00Z"}}
+  {"action":"update","collection":"app.bsky.actor.profile","rkey":"self","value":{...}}
+  {"action":"delete","uri":"at://did:plc:abc/app.bsky.feed.post/3k2a4b"}
+
+Records can be given by collection and rkey, or by at:// URI. Operations are
+sent in chunks, each applied atomically by the PDS, waiting out the server's
+rate limit as needed.
+
+With --resume-file, the number of operations applied is saved after every
+chunk, and a later run with the same file skips them.`,
+	ArgsUsage: `[<file>]`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "repo",
+			Usage: "DID of the repo to write to (defaults to the authed account)",
+		},
+		&cli.IntFlag{
+			Name:  "batch-size",
+			Usage: "number of operations per applyWrites call",
+			Value: 50,
+		},
+		&cli.DurationFlag{
+			Name:  "delay",
+			Usage: "time to wait between chunks, on top of any rate limit",
+		},
+		&cli.StringFlag{
+			Name:  "resume-file",
+			Usage: "file to record progress in, and resume from",
+		},
+		&cli.BoolFlag{
+			Name:  "validate",
+			Usage: "ask the PDS to validate records against their lexicons",
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "parse and check the operations without sending them",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		ctx := cctx.Context
+
+		xrpcc, err := cliutil.GetXrpcClient(cctx, !cctx.Bool("dry-run"))
+		if err != nil {
+			return err
+		}
+
+		repoDid := cctx.String("repo")
+		if repoDid == "" && xrpcc.Auth != nil {
+			repoDid = xrpcc.Auth.Did
+		}
+		if repoDid == "" {
+			return fmt.Errorf("no repo to write to, pass --repo or auth")
+		}
+
+		bsize := cctx.Int("batch-size")
+		if bsize < 1 {
+			return fmt.Errorf("--batch-size must be at least 1")
+		}
+
+		var r io.Reader = os.Stdin
+		if fname := cctx.Args().First(); fname != "" && fname != "-" {
+			fi, err := os.Open(fname)
+			if err != nil {
+				return err
+			}
+			defer fi.Close()
+			r = fi
+		}
+
+		var done int
+		rfile := cctx.String("resume-file")
+		if rfile != "" {
+			d, err := loadBatchProgress(rfile)
+			if err != nil {
+				return err
+			}
+			done = d
+			if done > 0 {
+				fmt.Fprintf(os.Stderr, "resuming after %d operations\n", done)
+			}
+		}
+		start := done
+
+		var validate *bool
+		if cctx.IsSet("validate") {
+			v := cctx.Bool("validate")
+			validate = &v
+		}
+
+		flush := func(writes []*comatproto.RepoApplyWrites_Input_Writes_Elem) error {
+			if cctx.Bool("dry-run") {
+				done += len(writes)
+				return nil
+			}
+
+			if err := comatproto.RepoApplyWrites(ctx, xrpcc, &comatproto.RepoApplyWrites_Input{
+				Repo:     repoDid,
+				Validate: validate,
+				Writes:   writes,
+			}); err != nil {
+				return fmt.Errorf("applying operations %d to %d: %w", done+1, done+len(writes), err)
+			}
+			done += len(writes)
+
+			if rfile != "" {
+				if err := saveBatchProgress(rfile, done); err != nil {
+					return fmt.Errorf("saving progress: %w", err)
+				}
+			}
+
+			status := fmt.Sprintf("applied %d operations", done)
+			if rl := xrpcc.RateLimit(); rl != nil {
+				status += fmt.Sprintf(" (rate limit: %d/%d remaining)", rl.Remaining, rl.Limit)
+			}
+			fmt.Fprintln(os.Stderr, status)
+
+			if d := cctx.Duration("delay"); d > 0 {
+				select {
+				case <-time.After(d):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			return nil
+		}
+
+		scan := bufio.NewScanner(r)
+		// records can be much longer than a default scanner line
+		scan.Buffer(nil, 4<<20)
+
+		var line int
+		var writes []*comatproto.RepoApplyWrites_Input_Writes_Elem
+		for scan.Scan() {
+			b := scan.Bytes()
+			if len(b) == 0 {
+				continue
+			}
+			line++
+			if line <= start {
+				continue
+			}
+
+			w, err := parseBatchOp(b, repoDid)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+
+			writes = append(writes, w)
+			if len(writes) == bsize {
+				if err := flush(writes); err != nil {
+					return err
+				}
+				writes = nil
+			}
+		}
+		if err := scan.Err(); err != nil {
+			return fmt.Errorf("reading operations: %w", err)
+		}
+
+		if len(writes) > 0 {
+			if err := flush(writes); err != nil {
+				return err
+			}
+		}
+
+		if line < start {
+			fmt.Fprintf(os.Stderr, "input has only %d operations, but %d were already applied\n", line, start)
+		}
+		if cctx.Bool("dry-run") {
+			fmt.Fprintf(os.Stderr, "%d operations ok\n", done-start)
+		}
+
+		return nil
+	},
+}
+
+// batchOp is a line of batch command input
+type batchOp struct {
+	Action     string                      `json:"action"`
+	Uri        string                      `json:"uri"`
+	Collection string                      `json:"collection"`
+	Rkey       string                      `json:"rkey"`
+	Value      *lexutil.LexiconTypeDecoder `json:"value"`
+}
+
+func parseBatchOp(b []byte, repoDid string) (*comatproto.RepoApplyWrites_Input_Writes_Elem, error) {
+	var op batchOp
+	if err := json.Unmarshal(b, &op); err != nil {
+		return nil, err
+	}
+
+	if op.Uri != "" {
+		puri, err := util.ParseAtUri(op.Uri)
+		if err != nil {
+			return nil, err
+		}
+		if puri.Did != repoDid {
+			return nil, fmt.Errorf("%s is not in repo %s", op.Uri, repoDid)
+		}
+		op.Collection, op.Rkey = puri.Collection, puri.Rkey
+	}
+
+	if op.Collection == "" {
+		return nil, fmt.Errorf("no collection or uri given")
+	}
+
+	switch op.Action {
+	case "create":
+		if op.Value == nil {
+			return nil, fmt.Errorf("create needs a value")
+		}
+		var rkey *string
+		if op.Rkey != "" {
+			rkey = &op.Rkey
+		}
+		return &comatproto.RepoApplyWrites_Input_Writes_Elem{
+			RepoApplyWrites_Create: &comatproto.RepoApplyWrites_Create{
+				Collection: op.Collection,
+				Rkey:       rkey,
+				Value:      op.Value,
+			},
+		}, nil
+	case "update":
+		if op.Value == nil || op.Rkey == "" {
+			return nil, fmt.Errorf("update needs an rkey and value")
+		}
+		return &comatproto.RepoApplyWrites_Input_Writes_Elem{
+			RepoApplyWrites_Update: &comatproto.RepoApplyWrites_Update{
+				Collection: op.Collection,
+				Rkey:       op.Rkey,
+				Value:      op.Value,
+			},
+		}, nil
+	case "delete":
+		if op.Rkey == "" {
+			return nil, fmt.Errorf("delete needs an rkey")
+		}
+		return &comatproto.RepoApplyWrites_Input_Writes_Elem{
+			RepoApplyWrites_Delete: &comatproto.RepoApplyWrites_Delete{
+				Collection: op.Collection,
+				Rkey:       op.Rkey,
+			},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown action %q", op.Action)
+	}
+}
+
+type batchProgress struct {
+	Done int `json:"done"`
+}
+
+func loadBatchProgress(path string) (int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	var p batchProgress
+	if err := json.Unmarshal(b, &p); err != nil {
+		return 0, fmt.Errorf("invalid resume file %s: %w", path, err)
+	}
+	return p.Done, nil
+}
+
+func saveBatchProgress(path string, done int) error {
+	b, err := json.Marshal(batchProgress{Done: done})
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
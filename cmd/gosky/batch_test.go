@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+)
+
+func TestParseBatchOp(t *testing.T) {
+	const repoDid = "did:plc:alice"
+	const post = `{"$type":"app.bsky.feed.post","text":"hi","createdAt":"2023-08-01T00:00:00Z"}`
+
+	w, err := parseBatchOp([]byte(`{"action":"create","collection":"app.bsky.feed.post","value":`+post+`}`), repoDid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := w.RepoApplyWrites_Create; c == nil || c.Collection != "app.bsky.feed.post" || c.Rkey != nil {
+		t.Fatalf("expected a create without an rkey, got %+v", w)
+	}
+	if p, ok := w.RepoApplyWrites_Create.Value.Val.(*appbsky.FeedPost); !ok || p.Text != "hi" {
+		t.Errorf("expected the post to be decoded, got %#v", w.RepoApplyWrites_Create.Value.Val)
+	}
+
+	w, err = parseBatchOp([]byte(`{"action":"update","uri":"at://did:plc:alice/app.bsky.feed.post/3k2a","value":`+post+`}`), repoDid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := w.RepoApplyWrites_Update; u == nil || u.Collection != "app.bsky.feed.post" || u.Rkey != "3k2a" {
+		t.Errorf("expected an update of the record of the uri, got %+v", w)
+	}
+
+	w, err = parseBatchOp([]byte(`{"action":"delete","collection":"app.bsky.feed.like","rkey":"3k2b"}`), repoDid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := w.RepoApplyWrites_Delete; d == nil || d.Collection != "app.bsky.feed.like" || d.Rkey != "3k2b" {
+		t.Errorf("expected a delete, got %+v", w)
+	}
+
+	for _, bad := range []string{
+		`not json`,
+		`{"action":"create","value":` + post + `}`,
+		`{"action":"create","collection":"app.bsky.feed.post"}`,
+		`{"action":"update","collection":"app.bsky.feed.post","value":` + post + `}`,
+		`{"action":"delete","collection":"app.bsky.feed.post"}`,
+		`{"action":"delete","uri":"at://did:plc:bob/app.bsky.feed.post/3k2a"}`,
+		`{"action":"upsert","collection":"app.bsky.feed.post","rkey":"3k2a"}`,
+	} {
+		if _, err := parseBatchOp([]byte(bad), repoDid); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
+
+func TestBatchProgress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "progress.json")
+
+	done, err := loadBatchProgress(path)
+	if err != nil || done != 0 {
+		t.Fatalf("expected a missing file to be no progress, got %d, %v", done, err)
+	}
+	if err := saveBatchProgress(path, 150); err != nil {
+		t.Fatal(err)
+	}
+	if done, err := loadBatchProgress(path); err != nil || done != 150 {
+		t.Errorf("expected 150 done, got %d, %v", done, err)
+	}
+
+	if err := os.WriteFile(path, []byte("150"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadBatchProgress(path); err == nil {
+		t.Error("expected an invalid resume file to be an error")
+	}
+}
+
+// testBatchInput writes n post deletes to a file
+func testBatchInput(t *testing.T, n int, extra ...string) string {
+	var lines []string
+	for i := 0; i < n; i++ {
+		lines = append(lines, `{"action":"delete","collection":"app.bsky.feed.post","rkey":"3k2a`+string(rune('a'+i))+`"}`)
+	}
+	lines = append(lines, extra...)
+
+	path := filepath.Join(t.TempDir(), "ops.jsonl")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBatch(t *testing.T) {
+	var lk sync.Mutex
+	var calls []int
+	pds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/xrpc/com.atproto.repo.applyWrites" || r.Header.Get("Authorization") != "Bearer tok" {
+			w.WriteHeader(400)
+			return
+		}
+		var in comatproto.RepoApplyWrites_Input
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil || in.Repo != "did:plc:alice" {
+			w.WriteHeader(400)
+			return
+		}
+		lk.Lock()
+		calls = append(calls, len(in.Writes))
+		lk.Unlock()
+	}))
+	defer pds.Close()
+
+	dir := t.TempDir()
+	auth := filepath.Join(dir, "auth.json")
+	if err := os.WriteFile(auth, []byte(`{"accessJwt":"tok","did":"did:plc:alice"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	resume := filepath.Join(dir, "resume.json")
+
+	app := testApp(batchCmd)
+	input := testBatchInput(t, 5)
+	args := []string{"gosky", "--pds-host", pds.URL, "--auth", auth, "batch", "--batch-size", "2", "--resume-file", resume, input}
+	if err := app.Run(args); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 3 || calls[0] != 2 || calls[1] != 2 || calls[2] != 1 {
+		t.Errorf("expected chunks of 2, 2 and 1 operations, got %v", calls)
+	}
+	if done, _ := loadBatchProgress(resume); done != 5 {
+		t.Errorf("expected 5 operations to be saved as done, got %d", done)
+	}
+
+	// a rerun with the same resume file only applies what is new
+	calls = nil
+	args[len(args)-1] = testBatchInput(t, 6)
+	if err := app.Run(args); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 1 || calls[0] != 1 {
+		t.Errorf("expected only the new operation to be applied, got %v", calls)
+	}
+}
+
+func TestBatchDryRun(t *testing.T) {
+	t.Setenv("ATP_AUTH_FILE", "")
+	app := testApp(batchCmd)
+
+	// dry runs need no auth or PDS, but do need a repo
+	input := testBatchInput(t, 3)
+	if err := app.Run([]string{"gosky", "--pds-host", "http://pds.invalid", "batch", "--dry-run", input}); err == nil || !strings.Contains(err.Error(), "--repo") {
+		t.Errorf("expected a missing repo error, got %v", err)
+	}
+	if err := app.Run([]string{"gosky", "--pds-host", "http://pds.invalid", "batch", "--dry-run", "--repo", "did:plc:alice", input}); err != nil {
+		t.Error(err)
+	}
+
+	input = testBatchInput(t, 3, `{"action":"delete","collection":"app.bsky.feed.post"}`)
+	err := app.Run([]string{"gosky", "--pds-host", "http://pds.invalid", "batch", "--dry-run", "--repo", "did:plc:alice", input})
+	if err == nil || !strings.Contains(err.Error(), "line 4:") {
+		t.Errorf("expected an error on line 4, got %v", err)
+	}
+
+	err = app.Run([]string{"gosky", "batch", "--dry-run", "--repo", "did:plc:alice", "--batch-size", "0", input})
+	if err == nil || !strings.Contains(err.Error(), "--batch-size") {
+		t.Errorf("expected a batch size error, got %v", err)
+	}
+}
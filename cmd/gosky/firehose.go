@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/events/schedulers/sequential"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+
+	"github.com/gorilla/websocket"
+	"github.com/ipld/go-car"
+	"github.com/mattn/go-isatty"
+	cli "github.com/urfave/cli/v2"
+)
+
+var firehoseCmd = &cli.Command{
+	Name:  "firehose",
+	Usage: "stream repo events from a PDS or BGS, decoded and filtered",
+	Description: `Prints one line per record operation, with the record decoded to JSON,
+and one line per handle, account, migrate and tombstone event.
+
+Filters are applied client side: --did and --collection can be repeated, and a
+collection ending in ".*" matches every collection with that prefix. --match
+keeps only operations whose path or record contains the (case insensitive)
+text.
+
+--sample asks the host to only send the events of a fraction of repos, chosen
+by a hash of their DIDs, so the same repos are sampled every time.
+
+With --state-file, the last sequence number seen is saved to the file, and the
+stream resumes from it when run again.`,
+	ArgsUsage: `[<host>]`,
+	Flags: []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "did",
+			Usage: "only show events for this account",
+		},
+		&cli.StringSliceFlag{
+			Name:  "collection",
+			Usage: "only show record operations in this collection, eg app.bsky.feed.post or app.bsky.feed.*",
+		},
+		&cli.StringFlag{
+			Name:  "match",
+			Usage: "only show record operations whose path or record contain this text",
+		},
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "print events as JSON objects, one per line, rather than for reading",
+		},
+		&cli.StringFlag{
+			Name:  "color",
+			Usage: "colorize output: auto, always or never",
+			Value: "auto",
+		},
+		&cli.Int64Flag{
+			Name:  "cursor",
+			Usage: "sequence number to start streaming from, overriding the state file",
+		},
+		&cli.Float64Flag{
+			Name:  "sample",
+			Usage: "fraction of repos to be sent the events of, eg 0.01",
+		},
+		&cli.StringFlag{
+			Name:  "state-file",
+			Usage: "file to save the stream cursor to, and resume from",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+
+		host := cctx.Args().First()
+		if host == "" {
+			host = "wss://bsky.network"
+		}
+
+		var color bool
+		switch c := cctx.String("color"); c {
+		case "auto":
+			color = isatty.IsTerminal(os.Stdout.Fd())
+		case "always":
+			color = true
+		case "never":
+		default:
+			return fmt.Errorf("unknown --color value %q", c)
+		}
+
+		fp := &firehosePrinter{
+			out:   os.Stdout,
+			filt:  newFirehoseFilter(cctx.StringSlice("did"), cctx.StringSlice("collection"), cctx.String("match")),
+			json:  cctx.Bool("json"),
+			color: color,
+		}
+
+		var state *firehoseState
+		if sfi := cctx.String("state-file"); sfi != "" {
+			st, err := loadFirehoseState(sfi)
+			if err != nil {
+				return err
+			}
+			state = st
+		}
+
+		var cursor int64
+		switch {
+		case cctx.IsSet("cursor"):
+			cursor = cctx.Int64("cursor")
+		case state != nil && state.Host == host:
+			cursor = state.Cursor
+		}
+
+		sample, err := sampleFlag(cctx)
+		if err != nil {
+			return err
+		}
+
+		u, err := streamURL(host, "com.atproto.sync.subscribeRepos", cursor, sample)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintln(os.Stderr, "dialing: ", u)
+		con, _, err := websocket.DefaultDialer.DialContext(ctx, u, http.Header{})
+		if err != nil {
+			return fmt.Errorf("dial failure: %w", err)
+		}
+
+		if state != nil {
+			state.Host = host
+
+			// the cursor is saved every few seconds rather than every event,
+			// and once more on the way out
+			go func() {
+				t := time.NewTicker(time.Second * 5)
+				defer t.Stop()
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-t.C:
+						if err := state.Save(fp.seq.Load()); err != nil {
+							fmt.Fprintln(os.Stderr, "failed to save cursor: ", err)
+						}
+					}
+				}
+			}()
+			defer func() {
+				if err := state.Save(fp.seq.Load()); err != nil {
+					fmt.Fprintln(os.Stderr, "failed to save cursor: ", err)
+				}
+			}()
+		}
+
+		rsc := &events.RepoStreamCallbacks{
+			RepoCommit:    fp.commit,
+			RepoHandle:    fp.handle,
+			RepoAccount:   fp.account,
+			RepoMigrate:   fp.migrate,
+			RepoTombstone: fp.tombstone,
+			RepoInfo: func(info *comatproto.SyncSubscribeRepos_Info) error {
+				msg := ""
+				if info.Message != nil {
+					msg = *info.Message
+				}
+				fmt.Fprintf(os.Stderr, "INFO: %s: %s\n", info.Name, msg)
+				return nil
+			},
+			Error: func(errf *events.ErrorFrame) error {
+				return fmt.Errorf("error frame: %s: %s", errf.Error, errf.Message)
+			},
+		}
+
+		seqScheduler := sequential.NewScheduler("firehose", rsc.EventHandler)
+		err = events.HandleRepoStream(ctx, con, seqScheduler)
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	},
+}
+
+// sampleFlag returns the sample asked for with --sample, or nil for every repo
+func sampleFlag(cctx *cli.Context) (*events.Sample, error) {
+	if !cctx.IsSet("sample") {
+		return nil, nil
+	}
+	return events.NewSample(cctx.Float64("sample"))
+}
+
+// streamURL makes the websocket URL of the subscription method nsid on host,
+// which can be given with or without a scheme, optionally asking for only a
+// sample of the stream's repos
+func streamURL(host, nsid string, cursor int64, sample *events.Sample) (string, error) {
+	if !strings.Contains(host, "://") {
+		host = "wss://" + host
+	}
+
+	u, err := url.Parse(host)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	case "http":
+		u.Scheme = "ws"
+	}
+	if !strings.Contains(u.Path, nsid) {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/xrpc/" + nsid
+	}
+	q := u.Query()
+	if cursor != 0 {
+		q.Set("cursor", strconv.FormatInt(cursor, 10))
+	}
+	if sample != nil {
+		q.Set(events.SampleParam, sample.String())
+	}
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// firehoseState is what --state-file holds, so that a stream can be resumed
+type firehoseState struct {
+	Host   string `json:"host"`
+	Cursor int64  `json:"cursor"`
+
+	path string
+	lk   sync.Mutex
+}
+
+func loadFirehoseState(path string) (*firehoseState, error) {
+	st := &firehoseState{path: path}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return st, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, st); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %w", path, err)
+	}
+	return st, nil
+}
+
+func (st *firehoseState) Save(seq int64) error {
+	st.lk.Lock()
+	defer st.lk.Unlock()
+
+	if seq == 0 || seq == st.Cursor {
+		return nil
+	}
+	st.Cursor = seq
+
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+
+	// written to the side and renamed, so a crash never leaves a torn file
+	tmp := st.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, st.path)
+}
+
+type firehoseFilter struct {
+	dids        map[string]bool
+	collections map[string]bool
+	prefixes    []string
+	match       string
+}
+
+func newFirehoseFilter(dids, collections []string, match string) *firehoseFilter {
+	f := &firehoseFilter{
+		match: strings.ToLower(match),
+	}
+	if len(dids) > 0 {
+		f.dids = make(map[string]bool)
+		for _, d := range dids {
+			f.dids[d] = true
+		}
+	}
+	if len(collections) > 0 {
+		f.collections = make(map[string]bool)
+		for _, c := range collections {
+			if p, ok := strings.CutSuffix(c, "*"); ok {
+				f.prefixes = append(f.prefixes, p)
+			} else {
+				f.collections[c] = true
+			}
+		}
+	}
+	return f
+}
+
+func (f *firehoseFilter) Did(did string) bool {
+	return f.dids == nil || f.dids[did]
+}
+
+// RecordsOnly is true when the filter only lets through record operations
+func (f *firehoseFilter) RecordsOnly() bool {
+	return f.collections != nil || f.match != ""
+}
+
+func (f *firehoseFilter) Collection(col string) bool {
+	if f.collections == nil || f.collections[col] {
+		return true
+	}
+	for _, p := range f.prefixes {
+		if strings.HasPrefix(col, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *firehoseFilter) Match(path string, rec []byte) bool {
+	if f.match == "" {
+		return true
+	}
+	return strings.Contains(strings.ToLower(path), f.match) || strings.Contains(strings.ToLower(string(rec)), f.match)
+}
+
+// firehoseOp is a single record operation from a commit, as printed with --json
+type firehoseOp struct {
+	Seq        int64           `json:"seq"`
+	Time       string          `json:"time"`
+	Repo       string          `json:"repo"`
+	Commit     string          `json:"commit"`
+	Action     string          `json:"action"`
+	Collection string          `json:"collection"`
+	Rkey       string          `json:"rkey"`
+	Cid        string          `json:"cid,omitempty"`
+	Record     json.RawMessage `json:"record,omitempty"`
+}
+
+const (
+	ansiReset  = "\x1b[0m"
+	ansiDim    = "\x1b[2m"
+	ansiRed    = "\x1b[31m"
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+	ansiBlue   = "\x1b[34m"
+	ansiCyan   = "\x1b[36m"
+)
+
+type firehosePrinter struct {
+	out   io.Writer
+	filt  *firehoseFilter
+	json  bool
+	color bool
+
+	// the last sequence number handled, read by the state file saver
+	seq atomic.Int64
+}
+
+func (fp *firehosePrinter) paint(color, s string) string {
+	if !fp.color {
+		return s
+	}
+	return color + s + ansiReset
+}
+
+func (fp *firehosePrinter) commit(evt *comatproto.SyncSubscribeRepos_Commit) error {
+	defer fp.seq.Store(evt.Seq)
+
+	if !fp.filt.Did(evt.Repo) {
+		return nil
+	}
+
+	blocks, err := carBlocks(evt.Blocks)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "(%d) failed to read commit blocks: %s\n", evt.Seq, err)
+	}
+
+	for _, op := range evt.Ops {
+		col, rkey, _ := strings.Cut(op.Path, "/")
+		if !fp.filt.Collection(col) {
+			continue
+		}
+
+		fop := firehoseOp{
+			Seq:        evt.Seq,
+			Time:       evt.Time,
+			Repo:       evt.Repo,
+			Commit:     evt.Commit.String(),
+			Action:     op.Action,
+			Collection: col,
+			Rkey:       rkey,
+		}
+		if op.Cid != nil {
+			fop.Cid = op.Cid.String()
+			if raw, ok := blocks[fop.Cid]; ok {
+				rec, err := decodeFirehoseRecord(raw)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "(%d) failed to decode %s: %s\n", evt.Seq, op.Path, err)
+				}
+				fop.Record = rec
+			}
+		}
+
+		if !fp.filt.Match(op.Path, fop.Record) {
+			continue
+		}
+
+		if err := fp.printOp(&fop, evt.TooBig); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (fp *firehosePrinter) printOp(fop *firehoseOp, tooBig bool) error {
+	if fp.json {
+		return json.NewEncoder(fp.out).Encode(fop)
+	}
+
+	var action string
+	switch fop.Action {
+	case "create":
+		action = fp.paint(ansiGreen, "create")
+	case "update":
+		action = fp.paint(ansiYellow, "update")
+	case "delete":
+		action = fp.paint(ansiRed, "delete")
+	default:
+		action = fop.Action
+	}
+
+	line := fmt.Sprintf("%s %s %s %s/%s",
+		fp.paint(ansiDim, fmt.Sprintf("(%d) %s", fop.Seq, fop.Time)),
+		action,
+		fp.paint(ansiCyan, fop.Repo),
+		fp.paint(ansiBlue, fop.Collection),
+		fop.Rkey,
+	)
+	switch {
+	case fop.Record != nil:
+		line += " " + string(fop.Record)
+	case tooBig && fop.Action != "delete":
+		line += " " + fp.paint(ansiDim, "[commit too big for blocks]")
+	}
+
+	_, err := fmt.Fprintln(fp.out, line)
+	return err
+}
+
+// printEvent prints a non-commit event, which has no records to filter on
+func (fp *firehosePrinter) printEvent(kind string, seq int64, did string, evt any, detail string) error {
+	defer fp.seq.Store(seq)
+
+	if !fp.filt.Did(did) || fp.filt.RecordsOnly() {
+		return nil
+	}
+
+	if fp.json {
+		b, err := json.Marshal(evt)
+		if err != nil {
+			return err
+		}
+		var out map[string]any
+		if err := json.Unmarshal(b, &out); err != nil {
+			return err
+		}
+		out["$type"] = kind
+		return json.NewEncoder(fp.out).Encode(out)
+	}
+
+	_, err := fmt.Fprintf(fp.out, "%s %s %s %s\n",
+		fp.paint(ansiDim, fmt.Sprintf("(%d)", seq)),
+		fp.paint(ansiYellow, kind),
+		fp.paint(ansiCyan, did),
+		detail,
+	)
+	return err
+}
+
+func (fp *firehosePrinter) handle(evt *comatproto.SyncSubscribeRepos_Handle) error {
+	return fp.printEvent("handle", evt.Seq, evt.Did, evt, evt.Handle)
+}
+
+func (fp *firehosePrinter) account(evt *comatproto.SyncSubscribeRepos_Account) error {
+	detail := "active"
+	if !evt.Active {
+		detail = "inactive"
+		if evt.Status != nil {
+			detail += " (" + *evt.Status + ")"
+		}
+	}
+	return fp.printEvent("account", evt.Seq, evt.Did, evt, detail)
+}
+
+func (fp *firehosePrinter) migrate(evt *comatproto.SyncSubscribeRepos_Migrate) error {
+	detail := ""
+	if evt.MigrateTo != nil {
+		detail = *evt.MigrateTo
+	}
+	return fp.printEvent("migrate", evt.Seq, evt.Did, evt, detail)
+}
+
+func (fp *firehosePrinter) tombstone(evt *comatproto.SyncSubscribeRepos_Tombstone) error {
+	return fp.printEvent("tombstone", evt.Seq, evt.Did, evt, "")
+}
+
+// carBlocks reads the blocks of a commit's CAR slice, keyed by CID
+func carBlocks(b []byte) (map[string][]byte, error) {
+	out := make(map[string][]byte)
+	if len(b) == 0 {
+		return out, nil
+	}
+
+	carr, err := car.NewCarReader(bytes.NewReader(b))
+	if err != nil {
+		return out, err
+	}
+
+	for {
+		blk, err := carr.Next()
+		if err != nil {
+			if err == io.EOF {
+				return out, nil
+			}
+			return out, err
+		}
+		out[blk.Cid().String()] = blk.RawData()
+	}
+}
+
+// decodeFirehoseRecord converts a DAG-CBOR record, of any type, to JSON
+func decodeFirehoseRecord(raw []byte) (json.RawMessage, error) {
+	rr, err := lexutil.NewRawRecord(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return rr.MarshalJSON()
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	"github.com/multiformats/go-multihash"
+	cli "github.com/urfave/cli/v2"
+)
+
+func TestStreamURL(t *testing.T) {
+	const nsid = "com.atproto.sync.subscribeRepos"
+	sample, err := events.NewSample(0.25)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		host   string
+		cursor int64
+		sample *events.Sample
+		want   string
+	}{
+		{"bsky.network", 0, nil, "wss://bsky.network/xrpc/" + nsid},
+		{"https://pds.example/", 0, nil, "wss://pds.example/xrpc/" + nsid},
+		{"http://localhost:2583", 42, nil, "ws://localhost:2583/xrpc/" + nsid + "?cursor=42"},
+		{"wss://bgs.example/xrpc/" + nsid, 0, sample, "wss://bgs.example/xrpc/" + nsid + "?sample=0.25"},
+	}
+	for _, c := range cases {
+		got, err := streamURL(c.host, nsid, c.cursor, c.sample)
+		if err != nil {
+			t.Fatalf("%s: %s", c.host, err)
+		}
+		if got != c.want {
+			t.Errorf("%s: expected %s, got %s", c.host, c.want, got)
+		}
+	}
+}
+
+func TestFirehoseFlags(t *testing.T) {
+	app := &cli.App{
+		Commands: []*cli.Command{firehoseCmd},
+	}
+
+	// bad flags are rejected before anything is dialed
+	err := app.Run([]string{"gosky", "firehose", "--color", "rainbow", "pds.invalid"})
+	if err == nil || !strings.Contains(err.Error(), "--color") {
+		t.Errorf("expected an unknown --color error, got %v", err)
+	}
+
+	err = app.Run([]string{"gosky", "firehose", "--sample", "2", "pds.invalid"})
+	if !errors.Is(err, events.ErrInvalidSample) {
+		t.Errorf("expected an invalid sample error, got %v", err)
+	}
+}
+
+func TestFirehoseFilter(t *testing.T) {
+	all := newFirehoseFilter(nil, nil, "")
+	if !all.Did("did:plc:anyone") || !all.Collection("app.bsky.feed.like") || !all.Match("x/y", nil) || all.RecordsOnly() {
+		t.Error("expected an empty filter to let everything through")
+	}
+
+	f := newFirehoseFilter([]string{"did:plc:alice"}, []string{"app.bsky.graph.follow", "app.bsky.feed.*"}, "Hello")
+	if !f.Did("did:plc:alice") || f.Did("did:plc:bob") {
+		t.Error("expected only alice's events")
+	}
+	for col, want := range map[string]bool{
+		"app.bsky.graph.follow": true,
+		"app.bsky.graph.block":  false,
+		"app.bsky.feed.post":    true,
+		"app.bsky.feed.like":    true,
+		"com.example.feed.post": false,
+	} {
+		if got := f.Collection(col); got != want {
+			t.Errorf("%s: expected %v, got %v", col, want, got)
+		}
+	}
+	if !f.Match("app.bsky.feed.post/1", []byte(`{"text":"oh hello there"}`)) {
+		t.Error("expected the record text to match case insensitively")
+	}
+	if !f.Match("app.bsky.feed.post/hello", nil) {
+		t.Error("expected the path to match")
+	}
+	if f.Match("app.bsky.feed.post/1", []byte(`{"text":"goodbye"}`)) {
+		t.Error("expected a record without the text not to match")
+	}
+	if !f.RecordsOnly() {
+		t.Error("expected a filter on collections and text to only pass records")
+	}
+}
+
+func TestFirehoseState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	st, err := loadFirehoseState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Cursor != 0 {
+		t.Fatalf("expected a missing state file to start from the beginning, got %d", st.Cursor)
+	}
+
+	if err := st.Save(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing to be saved before any events, got %v", err)
+	}
+
+	st.Host = "wss://bsky.network"
+	if err := st.Save(1234); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err = loadFirehoseState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Host != "wss://bsky.network" || st.Cursor != 1234 {
+		t.Errorf("expected the saved host and cursor, got %q at %d", st.Host, st.Cursor)
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadFirehoseState(path); err == nil {
+		t.Error("expected an invalid state file to be an error")
+	}
+}
+
+// testCommit makes a commit event creating a post and deleting a like
+func testCommit(t *testing.T) *comatproto.SyncSubscribeRepos_Commit {
+	var rr lexutil.RawRecord
+	if err := json.Unmarshal([]byte(`{"$type": "app.bsky.feed.post", "text": "hello firehose", "createdAt": "2023-09-01T00:00:00Z"}`), &rr); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := cid.NewPrefixV1(cid.DagCBOR, multihash.SHA2_256).Sum(rr.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{rc}, Version: 1}, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := carutil.LdWrite(buf, rc.Bytes(), rr.Raw); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := lexutil.LexLink(rc)
+	return &comatproto.SyncSubscribeRepos_Commit{
+		Seq:    7,
+		Time:   "2023-09-01T00:00:01Z",
+		Repo:   "did:plc:alice",
+		Commit: lexutil.LexLink(rc),
+		Blocks: buf.Bytes(),
+		Ops: []*comatproto.SyncSubscribeRepos_RepoOp{
+			{Action: "create", Path: "app.bsky.feed.post/3k2a", Cid: &rec},
+			{Action: "delete", Path: "app.bsky.feed.like/3k2b"},
+		},
+	}
+}
+
+func TestFirehosePrinter(t *testing.T) {
+	out := new(bytes.Buffer)
+	fp := &firehosePrinter{out: out, filt: newFirehoseFilter(nil, nil, "")}
+
+	if err := fp.commit(testCommit(t)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fp.handle(&comatproto.SyncSubscribeRepos_Handle{Seq: 8, Did: "did:plc:alice", Handle: "alice.test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines, got %q", out.String())
+	}
+	if want := "(7) 2023-09-01T00:00:01Z create did:plc:alice app.bsky.feed.post/3k2a {"; !strings.HasPrefix(lines[0], want) || !strings.Contains(lines[0], `"text":"hello firehose"`) {
+		t.Errorf("expected the post to be printed with its record, got %q", lines[0])
+	}
+	if want := "(7) 2023-09-01T00:00:01Z delete did:plc:alice app.bsky.feed.like/3k2b"; lines[1] != want {
+		t.Errorf("expected %q, got %q", want, lines[1])
+	}
+	if want := "(8) handle did:plc:alice alice.test"; lines[2] != want {
+		t.Errorf("expected %q, got %q", want, lines[2])
+	}
+	if fp.seq.Load() != 8 {
+		t.Errorf("expected the last sequence number to be 8, got %d", fp.seq.Load())
+	}
+}
+
+func TestFirehosePrinterJSON(t *testing.T) {
+	out := new(bytes.Buffer)
+	fp := &firehosePrinter{
+		out:  out,
+		filt: newFirehoseFilter(nil, []string{"app.bsky.feed.post"}, ""),
+		json: true,
+	}
+
+	if err := fp.commit(testCommit(t)); err != nil {
+		t.Fatal(err)
+	}
+	// filtering on collections leaves out events other than commits
+	if err := fp.handle(&comatproto.SyncSubscribeRepos_Handle{Seq: 8, Did: "did:plc:alice", Handle: "alice.test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	dec := json.NewDecoder(out)
+	var fop firehoseOp
+	if err := dec.Decode(&fop); err != nil {
+		t.Fatal(err)
+	}
+	if fop.Seq != 7 || fop.Action != "create" || fop.Collection != "app.bsky.feed.post" || fop.Rkey != "3k2a" {
+		t.Errorf("unexpected op: %+v", fop)
+	}
+	var post struct {
+		Type string `json:"$type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(fop.Record, &post); err != nil {
+		t.Fatal(err)
+	}
+	if post.Type != "app.bsky.feed.post" || post.Text != "hello firehose" {
+		t.Errorf("expected the decoded post, got %s", fop.Record)
+	}
+	if dec.More() {
+		t.Errorf("expected only the post to be printed")
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/bluesky-social/indigo/util/keyutil"
+
+	cli "github.com/urfave/cli/v2"
+	"github.com/whyrusleeping/go-did"
+)
+
+var keyCmd = &cli.Command{
+	Name:  "key",
+	Usage: "generate P-256 and secp256k1 signing keys, and convert them between JWK, PEM, and multibase",
+	Subcommands: []*cli.Command{
+		keyGenCmd,
+		keyConvertCmd,
+		keyPublicCmd,
+	},
+}
+
+var keyFormatFlag = &cli.StringFlag{
+	Name:  "format",
+	Usage: "output format: jwk, pem or multibase",
+	Value: "jwk",
+}
+
+var keyGenCmd = &cli.Command{
+	Name:  "gen",
+	Usage: "generate a private key, printing it or writing it to a file",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "type",
+			Usage: "key type: p256 or k256",
+			Value: "p256",
+		},
+		keyFormatFlag,
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Usage:   "file to write the key to, instead of stdout",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		kt, err := keyutil.ParseKeyType(cctx.String("type"))
+		if err != nil {
+			return err
+		}
+
+		key, err := did.GeneratePrivKey(rand.Reader, kt)
+		if err != nil {
+			return err
+		}
+
+		out, err := encodePrivateKey(key, cctx.String("format"))
+		if err != nil {
+			return err
+		}
+
+		if fname := cctx.String("output"); fname != "" {
+			if err := os.WriteFile(fname, out, 0600); err != nil {
+				return err
+			}
+			fmt.Fprintln(os.Stderr, key.Public().DID())
+			return nil
+		}
+		_, err = os.Stdout.Write(out)
+		return err
+	},
+}
+
+var keyConvertCmd = &cli.Command{
+	Name:      "convert",
+	Usage:     "re-encode a private key (as JWK, PEM, or multibase) in another format",
+	ArgsUsage: `<file, or - for stdin>`,
+	Flags: []cli.Flag{
+		keyFormatFlag,
+	},
+	Action: func(cctx *cli.Context) error {
+		key, err := readPrivateKeyArg(cctx)
+		if err != nil {
+			return err
+		}
+
+		out, err := encodePrivateKey(key, cctx.String("format"))
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(out)
+		return err
+	},
+}
+
+var keyPublicCmd = &cli.Command{
+	Name:      "public",
+	Usage:     "print the public key of a private key (as JWK, PEM, or multibase)",
+	ArgsUsage: `<file, or - for stdin>`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "output format: did, multibase, pem or jwk",
+			Value: "did",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		key, err := readPrivateKeyArg(cctx)
+		if err != nil {
+			return err
+		}
+		pub := key.Public()
+
+		switch cctx.String("format") {
+		case "did":
+			fmt.Println(pub.DID())
+		case "multibase":
+			fmt.Println(pub.MultibaseString())
+		case "pem":
+			out, err := keyutil.MarshalPublicKeyPEM(pub)
+			if err != nil {
+				return err
+			}
+			os.Stdout.Write(out)
+		case "jwk":
+			out, err := keyutil.MarshalPublicJWK(pub, "")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(out))
+		default:
+			return fmt.Errorf("unknown format %q", cctx.String("format"))
+		}
+		return nil
+	},
+}
+
+func readPrivateKeyArg(cctx *cli.Context) (*did.PrivKey, error) {
+	if cctx.Args().Len() != 1 {
+		return nil, fmt.Errorf("must pass a key file, or - for stdin")
+	}
+
+	var b []byte
+	var err error
+	if fname := cctx.Args().First(); fname == "-" {
+		b, err = io.ReadAll(os.Stdin)
+	} else {
+		b, err = os.ReadFile(fname)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return keyutil.ParsePrivateKey(b)
+}
+
+func encodePrivateKey(key *did.PrivKey, format string) ([]byte, error) {
+	switch format {
+	case "jwk":
+		out, err := keyutil.MarshalJWK(key, "")
+		if err != nil {
+			return nil, err
+		}
+		return append(out, '\n'), nil
+	case "pem":
+		return keyutil.MarshalPrivateKeyPEM(key)
+	case "multibase":
+		out, err := keyutil.PrivateKeyMultibase(key)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(out + "\n"), nil
+	default:
+		return nil, fmt.Errorf("unknown format %q (expected jwk, pem or multibase)", format)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	label "github.com/bluesky-social/indigo/api/label"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/events/schedulers/sequential"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/bluesky-social/indigo/util/cliutil"
+	"github.com/bluesky-social/indigo/util/labelsig"
+	"github.com/bluesky-social/indigo/xrpc"
+
+	"github.com/gorilla/websocket"
+	"github.com/ipfs/go-cid"
+	cli "github.com/urfave/cli/v2"
+)
+
+var labelsCmd = &cli.Command{
+	Name:  "labels",
+	Usage: "query and subscribe to the labels published by a labeler",
+	Description: `Labels are printed as JSON, one per line. Unless --no-verify is given, every
+label is verified: signed labels by their signature, against the key in their
+source's DID document, and unsigned labels against the label records in their
+source's repo, whose commit signature is checked against the same key.`,
+	Subcommands: []*cli.Command{
+		labelsQueryCmd,
+		labelsSubscribeCmd,
+	},
+}
+
+var labelVerifyFlags = []cli.Flag{
+	&cli.BoolFlag{
+		Name:  "no-verify",
+		Usage: "skip checking labels against their source's repo",
+	},
+	&cli.BoolFlag{
+		Name:  "require-sig",
+		Usage: "fail unsigned labels, rather than checking them against their source's repo",
+	},
+	&cli.DurationFlag{
+		Name:  "verify-refresh",
+		Usage: "how often a source's repo can be refetched to find labels newer than the last fetch",
+		Value: 10 * time.Second,
+	},
+}
+
+var labelsQueryCmd = &cli.Command{
+	Name:      "query",
+	Usage:     "list labels with com.atproto.label.queryLabels",
+	ArgsUsage: `<labeler-host>`,
+	Flags: append([]cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "uri",
+			Usage: "subject URI to get labels for, ending in * to match a prefix (defaults to every subject)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "source",
+			Usage: "only list labels from this source DID",
+		},
+		&cli.IntFlag{
+			Name:  "limit",
+			Usage: "number of labels to get per request",
+			Value: 50,
+		},
+		&cli.StringFlag{
+			Name: "cursor",
+		},
+		&cli.BoolFlag{
+			Name:  "all",
+			Usage: "page through every matching label, rather than just the first page",
+		},
+	}, labelVerifyFlags...),
+	Action: func(cctx *cli.Context) error {
+		args, err := needArgs(cctx, "labeler-host")
+		if err != nil {
+			return err
+		}
+
+		ctx := cctx.Context
+		xrpcc := &xrpc.Client{
+			Client:           cliutil.NewHttpClient(),
+			Host:             args[0],
+			WaitForRateLimit: true,
+		}
+
+		uris := cctx.StringSlice("uri")
+		if len(uris) == 0 {
+			uris = []string{"*"}
+		}
+
+		lv, err := newLabelVerifier(cctx)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(os.Stdout)
+
+		cursor := cctx.String("cursor")
+		for {
+			out, err := label.QueryLabels(ctx, xrpcc, cursor, int64(cctx.Int("limit")), cctx.StringSlice("source"), uris)
+			if err != nil {
+				return err
+			}
+
+			for _, l := range out.Labels {
+				if err := enc.Encode(lv.Check(ctx, l, 0)); err != nil {
+					return err
+				}
+			}
+
+			if !cctx.Bool("all") || out.Cursor == nil || *out.Cursor == "" {
+				if out.Cursor != nil {
+					fmt.Fprintf(os.Stderr, "cursor: %s\n", *out.Cursor)
+				}
+				break
+			}
+			cursor = *out.Cursor
+		}
+
+		lv.Report()
+		return nil
+	},
+}
+
+var labelsSubscribeCmd = &cli.Command{
+	Name:      "subscribe",
+	Usage:     "stream labels with com.atproto.label.subscribeLabels",
+	ArgsUsage: `<labeler-host>`,
+	Flags: append([]cli.Flag{
+		&cli.Int64Flag{
+			Name:  "cursor",
+			Usage: "sequence number to start streaming from",
+		},
+		&cli.Float64Flag{
+			Name:  "sample",
+			Usage: "fraction of accounts to be sent the labels on, and on their records, eg 0.01",
+		},
+	}, labelVerifyFlags...),
+	Action: func(cctx *cli.Context) error {
+		args, err := needArgs(cctx, "labeler-host")
+		if err != nil {
+			return err
+		}
+
+		ctx, stop := signal.NotifyContext(cctx.Context, syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+
+		sample, err := sampleFlag(cctx)
+		if err != nil {
+			return err
+		}
+
+		u, err := streamURL(args[0], "com.atproto.label.subscribeLabels", cctx.Int64("cursor"), sample)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintln(os.Stderr, "dialing: ", u)
+		con, _, err := websocket.DefaultDialer.DialContext(ctx, u, http.Header{})
+		if err != nil {
+			return fmt.Errorf("dial failure: %w", err)
+		}
+
+		lv, err := newLabelVerifier(cctx)
+		if err != nil {
+			return err
+		}
+		defer lv.Report()
+		enc := json.NewEncoder(os.Stdout)
+
+		rsc := &events.RepoStreamCallbacks{
+			LabelLabels: func(evt *label.SubscribeLabels_Labels) error {
+				for _, l := range evt.Labels {
+					if err := enc.Encode(lv.Check(ctx, l, evt.Seq)); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			// labelers send info frames with the same schema as repo streams
+			RepoInfo: func(info *comatproto.SyncSubscribeRepos_Info) error {
+				msg := ""
+				if info.Message != nil {
+					msg = *info.Message
+				}
+				fmt.Fprintf(os.Stderr, "INFO: %s: %s\n", info.Name, msg)
+				return nil
+			},
+			Error: func(errf *events.ErrorFrame) error {
+				return fmt.Errorf("error frame: %s: %s", errf.Error, errf.Message)
+			},
+		}
+
+		seqScheduler := sequential.NewScheduler("labels", rsc.EventHandler)
+		err = events.HandleRepoStream(ctx, con, seqScheduler)
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	},
+}
+
+// labelLine is a label as printed by the labels commands
+type labelLine struct {
+	*label.Label
+
+	Seq         int64  `json:"seq,omitempty"`
+	Verified    *bool  `json:"verified,omitempty"`
+	VerifyError string `json:"verifyError,omitempty"`
+}
+
+// labelVerifier checks the signatures of signed labels, and unsigned labels
+// against the label records in their source's repo, refetching a repo when
+// it is missing a label and was last fetched long enough ago
+type labelVerifier struct {
+	cctx       *cli.Context
+	skip       bool
+	requireSig bool
+	refresh    time.Duration
+
+	sigs *labelsig.Verifier
+
+	sources map[string]*labelSource
+
+	verified int
+	failed   int
+}
+
+type labelSource struct {
+	fetched time.Time
+	labels  map[string]bool
+	err     error
+}
+
+func newLabelVerifier(cctx *cli.Context) (*labelVerifier, error) {
+	sigs, err := labelsig.NewVerifier(cliutil.GetDidResolver(cctx), 1000)
+	if err != nil {
+		return nil, err
+	}
+	sigs.RefetchInterval = cctx.Duration("verify-refresh")
+
+	return &labelVerifier{
+		cctx:       cctx,
+		skip:       cctx.Bool("no-verify"),
+		requireSig: cctx.Bool("require-sig"),
+		refresh:    cctx.Duration("verify-refresh"),
+		sigs:       sigs,
+		sources:    make(map[string]*labelSource),
+	}, nil
+}
+
+// labelKey identifies what a label says. The creation time is left out, as
+// a labeler's database and repo can disagree on its precision.
+func labelKey(l *label.Label) string {
+	var c string
+	if l.Cid != nil {
+		c = *l.Cid
+	}
+	return fmt.Sprintf("%s %s %s %s %t", l.Src, l.Uri, c, l.Val, l.Neg)
+}
+
+func (lv *labelVerifier) Check(ctx context.Context, l *label.Label, seq int64) *labelLine {
+	out := &labelLine{Label: l, Seq: seq}
+	if lv.skip {
+		return out
+	}
+
+	ok, err := lv.verify(ctx, l)
+	out.Verified = &ok
+	if err != nil {
+		out.VerifyError = err.Error()
+	}
+	if ok {
+		lv.verified++
+	} else {
+		lv.failed++
+	}
+	return out
+}
+
+func (lv *labelVerifier) verify(ctx context.Context, l *label.Label) (bool, error) {
+	if len(l.Sig) != 0 || lv.requireSig {
+		if err := lv.sigs.Verify(ctx, l); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	key := labelKey(l)
+
+	src := lv.sources[l.Src]
+	if src != nil && src.err == nil && src.labels[key] {
+		return true, nil
+	}
+
+	if src == nil || time.Since(src.fetched) > lv.refresh {
+		src = lv.fetch(ctx, l.Src)
+		lv.sources[l.Src] = src
+	}
+	if src.err != nil {
+		return false, src.err
+	}
+	if !src.labels[key] {
+		return false, fmt.Errorf("no matching label record in the repo of %s", l.Src)
+	}
+	return true, nil
+}
+
+func (lv *labelVerifier) fetch(ctx context.Context, did string) *labelSource {
+	src := &labelSource{
+		fetched: time.Now(),
+		labels:  make(map[string]bool),
+	}
+
+	lr, err := loadRepo(lv.cctx, did)
+	if err != nil {
+		src.err = fmt.Errorf("loading repo of %s: %w", did, err)
+		return src
+	}
+
+	prefix := "com.atproto.label.label/"
+	if err := lr.Repo.ForEach(ctx, prefix, func(k string, v cid.Cid) error {
+		if !strings.HasPrefix(k, prefix) {
+			return repo.ErrDoneIterating
+		}
+
+		_, rec, err := lr.Repo.GetRecord(ctx, k)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", k, err)
+		}
+		if l, ok := rec.(*label.Label); ok {
+			src.labels[labelKey(l)] = true
+		}
+		return nil
+	}); err != nil {
+		src.err = fmt.Errorf("reading labels of %s: %w", did, err)
+	}
+
+	return src
+}
+
+func (lv *labelVerifier) Report() {
+	if lv.skip {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%d labels verified, %d failed\n", lv.verified, lv.failed)
+}
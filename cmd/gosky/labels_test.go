@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	label "github.com/bluesky-social/indigo/api/label"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/bluesky-social/indigo/util/keyutil"
+	"github.com/bluesky-social/indigo/util/labelsig"
+
+	cli "github.com/urfave/cli/v2"
+	"github.com/whyrusleeping/go-did"
+)
+
+// testLabeler is a labeler which is its own PLC directory and PDS, serving
+// one label per page of queryLabels
+type testLabeler struct {
+	*httptest.Server
+
+	repoFetches atomic.Int64
+}
+
+func newTestLabeler(t *testing.T, k *did.PrivKey, car []byte, labels []*label.Label) *testLabeler {
+	tl := &testLabeler{}
+	tl.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/" + testRepoDid:
+			fmt.Fprintf(w, `{
+				"id": %q,
+				"verificationMethod": [{"id": "#atproto", "type": "Multikey", "controller": %q, "publicKeyMultibase": %q}],
+				"service": [{"id": "#atproto_pds", "type": "AtprotoPersonalDataServer", "serviceEndpoint": %q}]
+			}`, testRepoDid, testRepoDid, k.Public().MultibaseString(), tl.URL)
+		case "/xrpc/com.atproto.sync.getRepo":
+			tl.repoFetches.Add(1)
+			w.Write(car)
+		case "/xrpc/com.atproto.label.queryLabels":
+			i, _ := strconv.Atoi(r.URL.Query().Get("cursor"))
+			out := &label.QueryLabels_Output{Labels: []*label.Label{}}
+			if i < len(labels) {
+				out.Labels = append(out.Labels, labels[i])
+				next := strconv.Itoa(i + 1)
+				out.Cursor = &next
+			}
+			json.NewEncoder(w).Encode(out)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	t.Cleanup(tl.Close)
+	return tl
+}
+
+func testLabel(t *testing.T, val string, k *did.PrivKey) *label.Label {
+	l := &label.Label{
+		LexiconTypeID: "com.atproto.label.label",
+		Src:           testRepoDid,
+		Uri:           "at://did:plc:bob/app.bsky.feed.post/3k2aaaaaaaaa1",
+		Val:           val,
+		Cts:           "2023-09-01T00:00:00Z",
+	}
+	if k != nil {
+		b, err := labelsig.SigningBytes(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := keyutil.Sign(k, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Sig = sig
+	}
+	return l
+}
+
+// runLabels runs a labels command, returning the labels printed
+func runLabels(t *testing.T, args ...string) ([]labelLine, error) {
+	var err error
+	out := captureStdout(t, func() {
+		err = testApp(labelsCmd).Run(append([]string{"gosky"}, args...))
+	})
+
+	var lines []labelLine
+	dec := json.NewDecoder(strings.NewReader(out))
+	for dec.More() {
+		var l labelLine
+		if err := dec.Decode(&l); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, l)
+	}
+	return lines, err
+}
+
+func TestLabelsArgs(t *testing.T) {
+	app := testApp(labelsCmd)
+
+	for _, args := range [][]string{
+		{"gosky", "labels", "query"},
+		{"gosky", "labels", "subscribe"},
+	} {
+		err := app.Run(args)
+		var ec cli.ExitCoder
+		if !errors.As(err, &ec) || ec.ExitCode() != 127 {
+			t.Errorf("%v: expected a missing argument error, got %v", args, err)
+		}
+	}
+
+	err := app.Run([]string{"gosky", "labels", "subscribe", "--sample", "0", "labeler.invalid"})
+	if !errors.Is(err, events.ErrInvalidSample) {
+		t.Errorf("expected an invalid sample error, got %v", err)
+	}
+}
+
+func TestLabelsQuery(t *testing.T) {
+	k := testRepoKey(t)
+
+	// the repo holds the label records of the unsigned labels it backs
+	inRepo := testLabel(t, "spam", nil)
+	car := testRepo(t, k, map[string]repo.CborMarshaler{
+		"com.atproto.label.label/3k2aaaaaaaaa1": inRepo,
+	})
+	labels := []*label.Label{
+		testLabel(t, "porn", k),
+		inRepo,
+		testLabel(t, "gore", nil),
+		testLabel(t, "nudity", testRepoKey(t)),
+	}
+	tl := newTestLabeler(t, k, car, labels)
+
+	lines, err := runLabels(t, "--plc", tl.URL, "labels", "query", "--all", tl.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != len(labels) {
+		t.Fatalf("expected %d labels, got %d", len(labels), len(lines))
+	}
+	for i, want := range []bool{true, true, false, false} {
+		l := lines[i]
+		if l.Label == nil || l.Val != labels[i].Val {
+			t.Errorf("%d: expected label %s, got %+v", i, labels[i].Val, l)
+			continue
+		}
+		if l.Verified == nil || *l.Verified != want {
+			t.Errorf("%s: expected verified to be %v, got %v (%s)", l.Val, want, l.Verified, l.VerifyError)
+		}
+		if !want && l.VerifyError == "" {
+			t.Errorf("%s: expected a verification error", l.Val)
+		}
+	}
+	// the repo is only refetched once it is stale
+	if n := tl.repoFetches.Load(); n != 1 {
+		t.Errorf("expected the repo to be fetched once, got %d", n)
+	}
+
+	// without --all only the first page is printed
+	lines, err = runLabels(t, "--plc", tl.URL, "labels", "query", "--no-verify", tl.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 1 || lines[0].Val != "porn" || lines[0].Verified != nil {
+		t.Errorf("expected only the first label, unverified, got %+v", lines)
+	}
+
+	// unsigned labels fail outright with --require-sig
+	lines, err = runLabels(t, "--plc", tl.URL, "labels", "query", "--all", "--require-sig", tl.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != len(labels) || lines[1].Verified == nil || *lines[1].Verified || !strings.Contains(lines[1].VerifyError, labelsig.ErrUnsigned.Error()) {
+		t.Errorf("expected the unsigned label to fail, got %+v", lines)
+	}
+}
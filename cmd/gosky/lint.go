@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/lex/validate"
+	"github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/util/cliutil"
+	"github.com/bluesky-social/indigo/xrpc"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	cli "github.com/urfave/cli/v2"
+)
+
+var lintRecordCmd = &cli.Command{
+	Name:  "lint-record",
+	Usage: "pretty-print a record, with problems found checking it against its lexicon",
+	Description: `The record is read from an at:// URI, fetched from the PDS of its repo, or
+from a file, or stdin if given -, holding either JSON or DAG-CBOR.
+
+Errors are anything the lexicon does not allow, and warnings are fields the
+lexicon does not define, data that could not be checked, and blob refs a PDS
+would not have made. With --check-blobs, every blob the record refers to is
+also fetched from the PDS and checked against its ref.`,
+	ArgsUsage: `<at-uri|file|->`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "lexicon-dir",
+			Usage:   "directory of lexicon JSON files to check the record against",
+			EnvVars: []string{"LEXICON_DIR"},
+		},
+		&cli.StringFlag{
+			Name:  "collection",
+			Usage: "lexicon to check the record against (defaults to the record's $type)",
+		},
+		&cli.BoolFlag{
+			Name:  "strict",
+			Usage: "treat anything that can not be checked against a known lexicon as an error",
+		},
+		&cli.BoolFlag{
+			Name:  "check-blobs",
+			Usage: "fetch the record's blobs and check them against their refs",
+		},
+		&cli.StringFlag{
+			Name:  "did",
+			Usage: "repo to fetch blobs from, for records read from a file",
+		},
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the record and lint results as a single JSON object",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		args, err := needArgs(cctx, "record")
+		if err != nil {
+			return err
+		}
+
+		cat := validate.NewCatalog()
+		if dir := cctx.String("lexicon-dir"); dir != "" {
+			if err := cat.LoadDirectory(dir); err != nil {
+				return fmt.Errorf("loading lexicons: %w", err)
+			}
+		}
+		mode := validate.Lenient
+		if cctx.Bool("strict") {
+			mode = validate.Strict
+		}
+		v := validate.NewValidator(cat, mode)
+
+		lr, err := readLintRecord(cctx, args[0])
+		if err != nil {
+			return err
+		}
+
+		collection := cctx.String("collection")
+		if collection == "" {
+			collection = lr.Type
+		}
+		if collection == "" {
+			return fmt.Errorf("record has no $type, pass --collection")
+		}
+
+		res, err := v.LintRecord(collection, lr.Value)
+		if err != nil {
+			return err
+		}
+		if cctx.String("lexicon-dir") == "" {
+			res.Diagnostics = append(res.Diagnostics, validate.Diagnostic{
+				Path:     "$",
+				Severity: validate.SeverityWarning,
+				Msg:      "no --lexicon-dir given",
+			})
+		}
+
+		if did := cctx.String("did"); did != "" {
+			lr.Did = did
+		}
+		if cctx.Bool("check-blobs") {
+			diags, err := checkRecordBlobs(cctx, lr.Did, res.Blobs)
+			if err != nil {
+				return err
+			}
+			res.Diagnostics = append(res.Diagnostics, diags...)
+		}
+
+		if cctx.Bool("json") {
+			b, err := json.MarshalIndent(map[string]any{
+				"uri":         lr.Uri,
+				"cid":         lr.Cid,
+				"record":      lr.Raw,
+				"diagnostics": res.Diagnostics,
+				"blobs":       res.Blobs,
+			}, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(b))
+		} else {
+			var buf bytes.Buffer
+			if err := json.Indent(&buf, lr.Raw, "", "  "); err != nil {
+				return err
+			}
+			if lr.Uri != "" {
+				fmt.Printf("# %s\n", lr.Uri)
+			}
+			if lr.Cid != "" {
+				fmt.Printf("# cid: %s\n", lr.Cid)
+			}
+			fmt.Println(buf.String())
+
+			for _, b := range res.Blobs {
+				fmt.Printf("blob: %s: %s (%s, %d bytes)\n", b.Path, b.Cid, b.MimeType, b.Size)
+			}
+			for _, d := range res.Diagnostics {
+				fmt.Println(d)
+			}
+		}
+
+		if n := res.Errors(); n > 0 {
+			return fmt.Errorf("record has %d errors", n)
+		}
+		return nil
+	},
+}
+
+// lintedRecord is a record read by lint-record
+type lintedRecord struct {
+	Uri string
+	Cid string
+	Did string
+
+	Type string
+	// Raw is the record as JSON, and Value the same decoded into maps, with
+	// numbers left as json.Number
+	Raw   json.RawMessage
+	Value map[string]any
+}
+
+func readLintRecord(cctx *cli.Context, arg string) (*lintedRecord, error) {
+	lr := &lintedRecord{}
+
+	if strings.HasPrefix(arg, "at://") {
+		puri, err := util.ParseAtUri(arg)
+		if err != nil {
+			return nil, err
+		}
+		id, pds, err := resolvePds(cctx, puri.Did)
+		if err != nil {
+			return nil, err
+		}
+		lr.Did = id.Did
+		lr.Uri = "at://" + id.Did + "/" + puri.Collection + "/" + puri.Rkey
+
+		// fetched raw, as decoding into the generated types would drop any
+		// fields they do not know about
+		var out struct {
+			Cid   *string         `json:"cid"`
+			Value json.RawMessage `json:"value"`
+		}
+		xrpcc := &xrpc.Client{
+			Client: cliutil.NewHttpClient(),
+			Host:   pds,
+		}
+		params := map[string]interface{}{
+			"repo":       id.Did,
+			"collection": puri.Collection,
+			"rkey":       puri.Rkey,
+		}
+		if err := xrpcc.Do(cctx.Context, xrpc.Query, "", "com.atproto.repo.getRecord", params, nil, &out); err != nil {
+			return nil, fmt.Errorf("fetching %s: %w", lr.Uri, err)
+		}
+		if out.Cid != nil {
+			lr.Cid = *out.Cid
+		}
+		lr.Raw = out.Value
+	} else {
+		var b []byte
+		var err error
+		if arg == "-" {
+			b, err = io.ReadAll(os.Stdin)
+		} else {
+			b, err = os.ReadFile(arg)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if t := bytes.TrimSpace(b); len(t) > 0 && t[0] == '{' {
+			lr.Raw = t
+		} else {
+			rr, err := lexutil.NewRawRecord(b)
+			if err != nil {
+				return nil, fmt.Errorf("record is neither JSON nor DAG-CBOR: %w", err)
+			}
+			j, err := rr.MarshalJSON()
+			if err != nil {
+				return nil, err
+			}
+			lr.Raw = j
+
+			c, err := cid.Prefix{
+				Version:  1,
+				Codec:    cid.DagCBOR,
+				MhType:   multihash.SHA2_256,
+				MhLength: -1,
+			}.Sum(b)
+			if err != nil {
+				return nil, err
+			}
+			lr.Cid = c.String()
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(lr.Raw))
+	dec.UseNumber()
+	if err := dec.Decode(&lr.Value); err != nil {
+		return nil, fmt.Errorf("decoding record: %w", err)
+	}
+	if lr.Value == nil {
+		return nil, fmt.Errorf("record must be an object")
+	}
+	lr.Type, _ = lr.Value["$type"].(string)
+
+	return lr, nil
+}
+
+// checkRecordBlobs fetches each blob from the PDS of did, and checks it
+// against its ref
+func checkRecordBlobs(cctx *cli.Context, did string, blobs []validate.BlobRef) ([]validate.Diagnostic, error) {
+	if len(blobs) == 0 {
+		return nil, nil
+	}
+	if did == "" {
+		return nil, fmt.Errorf("no repo to fetch blobs from, pass --did")
+	}
+
+	id, pds, err := resolvePds(cctx, did)
+	if err != nil {
+		return nil, err
+	}
+	xrpcc := &xrpc.Client{
+		Client: cliutil.NewHttpClient(),
+		Host:   pds,
+	}
+
+	var diags []validate.Diagnostic
+	fail := func(b validate.BlobRef, format string, args ...any) {
+		diags = append(diags, validate.Diagnostic{
+			Path:     b.Path,
+			Severity: validate.SeverityError,
+			Msg:      fmt.Sprintf(format, args...),
+		})
+	}
+
+	for _, b := range blobs {
+		c, err := cid.Decode(b.Cid)
+		if err != nil {
+			fail(b, "invalid blob ref: %s", err)
+			continue
+		}
+
+		data, err := comatproto.SyncGetBlob(cctx.Context, xrpcc, b.Cid, id.Did)
+		if err != nil {
+			fail(b, "fetching blob %s: %s", b.Cid, err)
+			continue
+		}
+
+		chk, err := c.Prefix().Sum(data)
+		if err != nil {
+			return nil, err
+		}
+		if !chk.Equals(c) {
+			fail(b, "blob %s does not match its ref", b.Cid)
+		}
+		if b.Size >= 0 && int64(len(data)) != b.Size {
+			fail(b, "blob is %d bytes, but its ref says %d", len(data), b.Size)
+		}
+	}
+
+	return diags, nil
+}
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -25,6 +26,7 @@ import (
 	"github.com/bluesky-social/indigo/repo"
 	"github.com/bluesky-social/indigo/util"
 	"github.com/bluesky-social/indigo/util/cliutil"
+	"github.com/bluesky-social/indigo/util/signer"
 	"github.com/bluesky-social/indigo/util/version"
 	"github.com/bluesky-social/indigo/xrpc"
 	lru "github.com/hashicorp/golang-lru"
@@ -79,7 +81,9 @@ func run(args []string) {
 		},
 	}
 	app.Commands = []*cli.Command{
+		accountCmd,
 		actorGetSuggestionsCmd,
+		batchCmd,
 		bgsAdminCmd,
 		createSessionCmd,
 		debugCmd,
@@ -97,12 +101,18 @@ func run(args []string) {
 		followsCmd,
 		resetPasswordCmd,
 		readRepoStreamCmd,
+		firehoseCmd,
 		handleCmd,
+		keyCmd,
+		labelsCmd,
 		getRecordCmd,
 		createInviteCmd,
 		adminCmd,
 		createFeedGeneratorCmd,
 		rebaseRepoCmd,
+		repoCmd,
+		lintRecordCmd,
+		resolveCmd,
 	}
 
 	app.RunAndExitOnError()
@@ -218,6 +228,9 @@ var didCmd = &cli.Command{
 		didGetCmd,
 		didCreateCmd,
 		didKeyCmd,
+		didAuditCmd,
+		didUpdateCmd,
+		didRecoverCmd,
 	},
 }
 
@@ -274,7 +287,8 @@ var didCreateCmd = &cli.Command{
 			Name: "recoverydid",
 		},
 		&cli.StringFlag{
-			Name: "signingkey",
+			Name:  "signingkey",
+			Usage: "path of a key file, or an awskms:// or pkcs11: signing key identifier",
 		},
 	},
 	Action: func(cctx *cli.Context) error {
@@ -288,14 +302,28 @@ var didCreateCmd = &cli.Command{
 
 		recoverydid := cctx.String("recoverydid")
 
-		sigkey, err := cliutil.LoadKeyFromFile(cctx.String("signingkey"))
+		var sig signer.Signer
+		keyID := cctx.String("signingkey")
+		if strings.HasPrefix(keyID, "awskms://") || strings.HasPrefix(keyID, "pkcs11:") {
+			sig, err = signer.Open(cctx.Context, keyID)
+			if err != nil {
+				return err
+			}
+		} else {
+			sigkey, err := cliutil.LoadKeyFromFile(keyID)
+			if err != nil {
+				return err
+			}
+			sig = signer.NewKeySigner(sigkey)
+		}
+
+		pub, err := sig.Public(cctx.Context)
 		if err != nil {
 			return err
 		}
+		fmt.Println("KEYDID: ", pub.DID())
 
-		fmt.Println("KEYDID: ", sigkey.Public().DID())
-
-		ndid, err := s.CreateDID(context.TODO(), sigkey, recoverydid, handle, service)
+		ndid, err := s.CreateDID(context.TODO(), sig, recoverydid, handle, service)
 		if err != nil {
 			return err
 		}
@@ -322,6 +350,183 @@ var didKeyCmd = &cli.Command{
 	},
 }
 
+var didAuditCmd = &cli.Command{
+	Name:      "audit",
+	Usage:     "fetch the full PLC operation log for a did and verify it locally",
+	ArgsUsage: `<did>`,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the raw audit log",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		args, err := needArgs(cctx, "did")
+		if err != nil {
+			return err
+		}
+		did := args[0]
+
+		s := cliutil.GetPLCClient(cctx)
+		entries, err := s.GetAuditLog(cctx.Context, did)
+		if err != nil {
+			return err
+		}
+
+		if cctx.Bool("json") {
+			b, err := json.MarshalIndent(entries, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(b))
+		} else {
+			for _, e := range entries {
+				var note string
+				if e.Nullified {
+					note = " (nullified)"
+				}
+				fmt.Printf("%s\t%s\t%s%s\n", e.CreatedAt, e.Cid, e.Operation.Type, note)
+			}
+		}
+
+		cur, err := api.VerifyAuditLog(did, entries)
+		if err != nil {
+			return fmt.Errorf("audit log failed verification: %w", err)
+		}
+
+		fmt.Fprintf(os.Stderr, "verified %d operations, current is %s\n", len(entries), cur.Type)
+		return nil
+	},
+}
+
+var didOpFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:     "key",
+		Usage:    "path to the rotation key to sign the operation with",
+		Required: true,
+	},
+	&cli.StringFlag{
+		Name:  "handle",
+		Usage: "set the handle",
+	},
+	&cli.StringFlag{
+		Name:  "pds",
+		Usage: "set the pds endpoint",
+	},
+	&cli.StringFlag{
+		Name:  "signing-key",
+		Usage: "set the did:key repos are signed with",
+	},
+	&cli.StringSliceFlag{
+		Name:  "rotation-key",
+		Usage: "replace the rotation keys, highest priority first",
+	},
+	&cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "print the operation instead of submitting it",
+	},
+}
+
+// errDryRun stops an operation from being submitted once didOpUpdate has
+// printed it
+var errDryRun = errors.New("dry run, not submitting")
+
+// didOpUpdate applies the changes requested by didOpFlags to an operation
+func didOpUpdate(cctx *cli.Context) func(op *api.PLCOp) error {
+	return func(op *api.PLCOp) error {
+		if h := cctx.String("handle"); h != "" {
+			op.SetHandle(h)
+		}
+		if pds := cctx.String("pds"); pds != "" {
+			op.SetPDS(pds)
+		}
+		if k := cctx.String("signing-key"); k != "" {
+			op.SetSigningKey(k)
+		}
+		if keys := cctx.StringSlice("rotation-key"); len(keys) > 0 {
+			op.RotationKeys = keys
+		}
+
+		if cctx.Bool("dry-run") {
+			b, err := json.MarshalIndent(op, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(b))
+			return errDryRun
+		}
+		return nil
+	}
+}
+
+var didUpdateCmd = &cli.Command{
+	Name:      "update",
+	Usage:     "sign and submit a plc operation changing a did",
+	ArgsUsage: `<did>`,
+	Flags:     didOpFlags,
+	Action: func(cctx *cli.Context) error {
+		args, err := needArgs(cctx, "did")
+		if err != nil {
+			return err
+		}
+
+		key, err := cliutil.LoadKeyFromFile(cctx.String("key"))
+		if err != nil {
+			return err
+		}
+
+		s := cliutil.GetPLCClient(cctx)
+		op, err := s.UpdateOp(cctx.Context, args[0], key, didOpUpdate(cctx))
+		if errors.Is(err, errDryRun) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		b, err := json.MarshalIndent(op, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	},
+}
+
+var didRecoverCmd = &cli.Command{
+	Name:      "recover",
+	Usage:     "fork the log of a did at an earlier operation, nullifying everything after it",
+	ArgsUsage: `<did> <cid>`,
+	Flags:     didOpFlags,
+	Action: func(cctx *cli.Context) error {
+		args, err := needArgs(cctx, "did", "cid")
+		if err != nil {
+			return err
+		}
+
+		key, err := cliutil.LoadKeyFromFile(cctx.String("key"))
+		if err != nil {
+			return err
+		}
+
+		s := cliutil.GetPLCClient(cctx)
+		op, err := s.RecoverOp(cctx.Context, args[0], args[1], key, didOpUpdate(cctx))
+		if errors.Is(err, errDryRun) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		b, err := json.MarshalIndent(op, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	},
+}
+
 var syncCmd = &cli.Command{
 	Name: "sync",
 	Subcommands: []*cli.Command{
@@ -522,17 +727,14 @@ var feedSetVoteCmd = &cli.Command{
 
 		arg := cctx.Args().First()
 
-		parts := strings.Split(arg, "/")
-		if len(parts) < 3 {
-			return fmt.Errorf("invalid post uri: %q", arg)
+		puri, err := util.ParseAtUri(arg)
+		if err != nil {
+			return fmt.Errorf("invalid post uri: %w", err)
 		}
-		rkey := parts[len(parts)-1]
-		collection := parts[len(parts)-2]
-		did := parts[2]
 
-		fmt.Println(did, collection, rkey)
+		fmt.Println(puri.Did, puri.Collection, puri.Rkey)
 		ctx := context.TODO()
-		resp, err := comatproto.RepoGetRecord(ctx, xrpcc, "", collection, did, rkey)
+		resp, err := comatproto.RepoGetRecord(ctx, xrpcc, "", puri.Collection, puri.Did, puri.Rkey)
 		if err != nil {
 			return fmt.Errorf("getting record: %w", err)
 		}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/bluesky-social/indigo/api"
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/did"
+	"github.com/bluesky-social/indigo/identity"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/bluesky-social/indigo/util/cliutil"
+	"github.com/bluesky-social/indigo/util/keyutil"
+	"github.com/bluesky-social/indigo/xrpc"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipld/go-car"
+	cli "github.com/urfave/cli/v2"
+)
+
+var repoCmd = &cli.Command{
+	Name:  "repo",
+	Usage: "fetch, verify and inspect whole repos",
+	Description: `Repos are given as a DID or handle, and fetched from the PDS in the DID
+document, or as the path of a CAR file saved by "repo export". Either way, the
+commit signature is checked against the key in the DID document, unless
+--no-verify is given.`,
+	Subcommands: []*cli.Command{
+		repoGetCmd,
+		repoExportCmd,
+		repoLsCmd,
+		repoCatCmd,
+	},
+}
+
+var repoVerifyFlags = []cli.Flag{
+	&cli.BoolFlag{
+		Name:  "no-verify",
+		Usage: "skip checking the commit signature",
+	},
+}
+
+var repoGetCmd = &cli.Command{
+	Name:      "get",
+	Usage:     "print a summary of a repo's commit and records",
+	ArgsUsage: `<did|handle|car-file>`,
+	Flags:     repoVerifyFlags,
+	Action: func(cctx *cli.Context) error {
+		args, err := needArgs(cctx, "repo")
+		if err != nil {
+			return err
+		}
+
+		lr, err := loadRepo(cctx, args[0])
+		if err != nil {
+			return err
+		}
+
+		ctx := cctx.Context
+		collections := make(map[string]int)
+		var total int
+		if err := lr.Repo.ForEach(ctx, "", func(k string, v cid.Cid) error {
+			col, _, _ := strings.Cut(k, "/")
+			collections[col]++
+			total++
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		sc := lr.Repo.SignedCommit()
+		out := map[string]any{
+			"did":         lr.Did,
+			"commit":      lr.Commit.String(),
+			"data":        sc.Data.String(),
+			"version":     sc.Version,
+			"verified":    lr.Verified,
+			"records":     total,
+			"collections": collections,
+			"size":        len(lr.Car),
+		}
+		if sc.Prev != nil {
+			out["prev"] = sc.Prev.String()
+		}
+		if lr.Handle != "" {
+			out["handle"] = lr.Handle
+		}
+		if lr.Pds != "" {
+			out["pds"] = lr.Pds
+		}
+
+		jsonPrint(out)
+		return nil
+	},
+}
+
+var repoExportCmd = &cli.Command{
+	Name:      "export",
+	Usage:     "save a verified repo as a CAR file",
+	ArgsUsage: `<did|handle>`,
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:     "car",
+			Usage:    "file to write the repo CAR to, or - for stdout",
+			Required: true,
+		},
+	}, repoVerifyFlags...),
+	Action: func(cctx *cli.Context) error {
+		args, err := needArgs(cctx, "repo")
+		if err != nil {
+			return err
+		}
+
+		lr, err := loadRepo(cctx, args[0])
+		if err != nil {
+			return err
+		}
+
+		fname := cctx.String("car")
+		if fname == "-" {
+			_, err := os.Stdout.Write(lr.Car)
+			return err
+		}
+
+		if err := os.WriteFile(fname, lr.Car, 0644); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "wrote %s (%d bytes, commit %s)\n", fname, len(lr.Car), lr.Commit)
+		return nil
+	},
+}
+
+var repoLsCmd = &cli.Command{
+	Name:      "ls",
+	Usage:     "list the records in a repo, optionally only those in one collection",
+	ArgsUsage: `<did|handle|car-file> [collection]`,
+	Flags: append([]cli.Flag{
+		&cli.BoolFlag{
+			Name:  "collections",
+			Usage: "list collections, with record counts, rather than records",
+		},
+	}, repoVerifyFlags...),
+	Action: func(cctx *cli.Context) error {
+		args, err := needArgs(cctx, "repo")
+		if err != nil {
+			return err
+		}
+
+		lr, err := loadRepo(cctx, args[0])
+		if err != nil {
+			return err
+		}
+
+		prefix := ""
+		if col := cctx.Args().Get(1); col != "" {
+			prefix = strings.TrimSuffix(col, "/") + "/"
+		}
+
+		counts := make(map[string]int)
+		if err := lr.Repo.ForEach(cctx.Context, prefix, func(k string, v cid.Cid) error {
+			if !strings.HasPrefix(k, prefix) {
+				// keys are sorted, so we are past the collection
+				return repo.ErrDoneIterating
+			}
+			if cctx.Bool("collections") {
+				col, _, _ := strings.Cut(k, "/")
+				counts[col]++
+				return nil
+			}
+			fmt.Printf("%s\t%s\n", k, v)
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		if cctx.Bool("collections") {
+			var cols []string
+			for c := range counts {
+				cols = append(cols, c)
+			}
+			sort.Strings(cols)
+			for _, c := range cols {
+				fmt.Printf("%s\t%d\n", c, counts[c])
+			}
+		}
+
+		return nil
+	},
+}
+
+var repoCatCmd = &cli.Command{
+	Name:      "cat",
+	Usage:     "print a record from a repo as JSON",
+	ArgsUsage: `<did|handle|car-file> <collection>/<rkey>`,
+	Flags: append([]cli.Flag{
+		&cli.BoolFlag{
+			Name:  "raw",
+			Usage: "print the record's DAG-CBOR bytes, hex encoded",
+		},
+	}, repoVerifyFlags...),
+	Action: func(cctx *cli.Context) error {
+		args, err := needArgs(cctx, "repo", "path")
+		if err != nil {
+			return err
+		}
+
+		lr, err := loadRepo(cctx, args[0])
+		if err != nil {
+			return err
+		}
+
+		ctx := cctx.Context
+		rc, rec, err := lr.Repo.GetRawRecord(ctx, args[1])
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", args[1], err)
+		}
+
+		if cctx.Bool("raw") {
+			fmt.Printf("%x\n", rec.Raw)
+			return nil
+		}
+
+		b, err := rec.MarshalJSON()
+		if err != nil {
+			return err
+		}
+
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, b, "", "  "); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "cid: %s\n", rc)
+		fmt.Println(buf.String())
+		return nil
+	},
+}
+
+// loadedRepo is a repo fetched from its PDS or read from a file
+type loadedRepo struct {
+	Did    string
+	Handle string
+	Pds    string
+
+	Commit cid.Cid
+	Car    []byte
+	Repo   *repo.Repo
+
+	// Verified is true if the commit signature was checked
+	Verified bool
+}
+
+func loadRepo(cctx *cli.Context, ident string) (*loadedRepo, error) {
+	ctx := cctx.Context
+	didr := cliutil.GetDidResolver(cctx)
+	lr := &loadedRepo{}
+
+	var doc *did.Document
+	if fi, err := os.Stat(ident); err == nil && !fi.IsDir() {
+		b, err := os.ReadFile(ident)
+		if err != nil {
+			return nil, err
+		}
+		lr.Car = b
+	} else {
+		id, pds, err := resolvePds(cctx, ident)
+		if err != nil {
+			return nil, err
+		}
+		lr.Did, lr.Handle, lr.Pds, doc = id.Did, id.Handle, pds, id.Doc
+
+		xrpcc := &xrpc.Client{
+			Client: cliutil.NewHttpClient(),
+			Host:   lr.Pds,
+		}
+		b, err := comatproto.SyncGetRepo(ctx, xrpcc, lr.Did, "", "")
+		if err != nil {
+			return nil, fmt.Errorf("fetching repo from %s: %w", lr.Pds, err)
+		}
+		lr.Car = b
+	}
+
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	root, err := ingestVerifiedCar(ctx, bs, bytes.NewReader(lr.Car))
+	if err != nil {
+		return nil, err
+	}
+	lr.Commit = root
+
+	r, err := repo.OpenRepo(ctx, bs, root, false)
+	if err != nil {
+		return nil, err
+	}
+	lr.Repo = r
+
+	sc := r.SignedCommit()
+	if lr.Did == "" {
+		lr.Did = sc.Did
+	} else if sc.Did != lr.Did {
+		return nil, fmt.Errorf("repo commit is for %s, not %s", sc.Did, lr.Did)
+	}
+
+	if cctx.Bool("no-verify") {
+		return lr, nil
+	}
+
+	if doc == nil {
+		d, err := didr.GetDocument(ctx, sc.Did)
+		if err != nil {
+			return nil, fmt.Errorf("resolving %s to verify commit: %w", sc.Did, err)
+		}
+		doc = d
+	}
+
+	key, err := keyutil.DocumentKey(doc, sc.Did, "#atproto")
+	if err != nil {
+		return nil, fmt.Errorf("getting signing key of %s: %w", sc.Did, err)
+	}
+
+	sb, err := sc.Unsigned().BytesForSigning()
+	if err != nil {
+		return nil, err
+	}
+	if err := keyutil.Verify(key, sb, sc.Sig); err != nil {
+		return nil, fmt.Errorf("invalid commit signature for %s: %w", sc.Did, err)
+	}
+	lr.Verified = true
+
+	return lr, nil
+}
+
+// resolvePds resolves a DID or handle, and finds the PDS in its DID document
+func resolvePds(cctx *cli.Context, ident string) (*identity.Identity, string, error) {
+	res := identity.NewResolver(cliutil.GetDidResolver(cctx), &api.ProdHandleResolver{}, identity.NewMemCache(10))
+	id := res.Resolve(cctx.Context, ident)
+	if id.Err != nil {
+		return nil, "", fmt.Errorf("resolving %s: %w", ident, id.Err)
+	}
+
+	for _, s := range id.Doc.Service {
+		if strings.HasSuffix(s.ID.String(), "#atproto_pds") {
+			return id, s.ServiceEndpoint, nil
+		}
+	}
+	return nil, "", fmt.Errorf("did document for %s has no PDS", id.Did)
+}
+
+// ingestVerifiedCar reads a repo CAR into bs, checking every block against
+// its CID, which the CAR reader does not do, and returns the root
+func ingestVerifiedCar(ctx context.Context, bs blockstore.Blockstore, r io.Reader) (cid.Cid, error) {
+	cr, err := car.NewCarReader(r)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("reading repo car: %w", err)
+	}
+	if len(cr.Header.Roots) != 1 {
+		return cid.Undef, fmt.Errorf("repo car must have exactly one root")
+	}
+
+	for {
+		blk, err := cr.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return cid.Undef, fmt.Errorf("reading repo car: %w", err)
+		}
+
+		chk, err := blk.Cid().Prefix().Sum(blk.RawData())
+		if err != nil {
+			return cid.Undef, err
+		}
+		if !chk.Equals(blk.Cid()) {
+			return cid.Undef, fmt.Errorf("block %s does not match its CID", blk.Cid())
+		}
+
+		if err := bs.Put(ctx, blk); err != nil {
+			return cid.Undef, err
+		}
+	}
+
+	return cr.Header.Roots[0], nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/bluesky-social/indigo/util/keyutil"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	cli "github.com/urfave/cli/v2"
+	"github.com/whyrusleeping/go-did"
+)
+
+const testRepoDid = "did:plc:alice"
+
+// captureStdout returns what fn prints to stdout
+func captureStdout(t *testing.T, fn func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	out := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- string(b)
+	}()
+
+	fn()
+	w.Close()
+	return <-out
+}
+
+// testApp runs gosky commands without exiting on errors
+func testApp(cmds ...*cli.Command) *cli.App {
+	return &cli.App{
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "plc"},
+			&cli.StringFlag{Name: "pds-host"},
+			&cli.StringFlag{Name: "auth"},
+		},
+		Commands:       cmds,
+		ExitErrHandler: func(*cli.Context, error) {},
+	}
+}
+
+// testRepoCar writes a repo with two posts and a follow, signed by k, to a
+// CAR file
+func testRepoCar(t *testing.T, k *did.PrivKey) string {
+	b := testRepo(t, k, map[string]repo.CborMarshaler{
+		"app.bsky.feed.post/3k2aaaaaaaaa1":    &appbsky.FeedPost{Text: "first post", CreatedAt: "2023-09-01T00:00:00Z"},
+		"app.bsky.feed.post/3k2aaaaaaaaa2":    &appbsky.FeedPost{Text: "second post", CreatedAt: "2023-09-02T00:00:00Z"},
+		"app.bsky.graph.follow/3k2aaaaaaaaa1": &appbsky.GraphFollow{Subject: "did:plc:bob", CreatedAt: "2023-09-03T00:00:00Z"},
+	})
+
+	path := filepath.Join(t.TempDir(), "repo.car")
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testRepo makes the CAR of a repo of testRepoDid with recs, signed by k
+func testRepo(t *testing.T, k *did.PrivKey, recs map[string]repo.CborMarshaler) []byte {
+	ctx := context.Background()
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	r := repo.NewRepo(ctx, testRepoDid, bs)
+
+	for path, rec := range recs {
+		if _, err := r.PutRecord(ctx, path, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, err := r.Commit(ctx, func(_ context.Context, _ string, b []byte) ([]byte, error) {
+		return keyutil.Sign(k, b)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{root}, Version: 1}, buf); err != nil {
+		t.Fatal(err)
+	}
+	for c := range keys {
+		blk, err := bs.Get(ctx, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := carutil.LdWrite(buf, c.Bytes(), blk.RawData()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// testPLC serves a DID document for testRepoDid with k as its signing key
+func testPLC(t *testing.T, k *did.PrivKey) *httptest.Server {
+	doc := fmt.Sprintf(`{
+		"id": %q,
+		"verificationMethod": [{"id": "#atproto", "type": "Multikey", "controller": %q, "publicKeyMultibase": %q}]
+	}`, testRepoDid, testRepoDid, k.Public().MultibaseString())
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+testRepoDid {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write([]byte(doc))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func testRepoKey(t *testing.T) *did.PrivKey {
+	k, err := did.GeneratePrivKey(rand.Reader, did.KeyTypeSecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestRepoArgs(t *testing.T) {
+	app := testApp(repoCmd)
+
+	for _, args := range [][]string{
+		{"gosky", "repo", "get"},
+		{"gosky", "repo", "ls"},
+		{"gosky", "repo", "cat", "repo.car"},
+	} {
+		err := app.Run(args)
+		var ec cli.ExitCoder
+		if !errors.As(err, &ec) || ec.ExitCode() != 127 {
+			t.Errorf("%v: expected a missing argument error, got %v", args, err)
+		}
+	}
+
+	if err := app.Run([]string{"gosky", "repo", "export", "did:plc:alice"}); err == nil || !strings.Contains(err.Error(), "car") {
+		t.Errorf("expected export to require --car, got %v", err)
+	}
+}
+
+func TestRepoLsCat(t *testing.T) {
+	app := testApp(repoCmd)
+	path := testRepoCar(t, testRepoKey(t))
+
+	var err error
+	out := captureStdout(t, func() {
+		err = app.Run([]string{"gosky", "repo", "ls", "--no-verify", path})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, l := range strings.Split(strings.TrimSpace(out), "\n") {
+		p, _, _ := strings.Cut(l, "\t")
+		paths = append(paths, p)
+	}
+	if want := "app.bsky.feed.post/3k2aaaaaaaaa1 app.bsky.feed.post/3k2aaaaaaaaa2 app.bsky.graph.follow/3k2aaaaaaaaa1"; strings.Join(paths, " ") != want {
+		t.Errorf("expected records %s, got %q", want, out)
+	}
+
+	out = captureStdout(t, func() {
+		err = app.Run([]string{"gosky", "repo", "ls", "--no-verify", path, "app.bsky.graph.follow"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out, "app.bsky.graph.follow/3k2aaaaaaaaa1\t") || strings.Count(out, "\n") != 1 {
+		t.Errorf("expected only the follow, got %q", out)
+	}
+
+	out = captureStdout(t, func() {
+		err = app.Run([]string{"gosky", "repo", "ls", "--no-verify", "--collections", path})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "app.bsky.feed.post\t2\napp.bsky.graph.follow\t1\n"; out != want {
+		t.Errorf("expected %q, got %q", want, out)
+	}
+
+	out = captureStdout(t, func() {
+		err = app.Run([]string{"gosky", "repo", "cat", "--no-verify", path, "app.bsky.feed.post/3k2aaaaaaaaa2"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var post appbsky.FeedPost
+	if err := json.Unmarshal([]byte(out), &post); err != nil {
+		t.Fatal(err)
+	}
+	if post.Text != "second post" {
+		t.Errorf("expected the second post, got %q", out)
+	}
+
+	err = app.Run([]string{"gosky", "repo", "cat", "--no-verify", path, "app.bsky.feed.post/3k2aaaaaaaaa3"})
+	if err == nil {
+		t.Error("expected reading a missing record to fail")
+	}
+}
+
+func TestRepoVerify(t *testing.T) {
+	k := testRepoKey(t)
+	path := testRepoCar(t, k)
+
+	app := testApp(repoCmd)
+	plc := testPLC(t, k)
+
+	var err error
+	out := captureStdout(t, func() {
+		err = app.Run([]string{"gosky", "--plc", plc.URL, "repo", "get", path})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary struct {
+		Did         string         `json:"did"`
+		Verified    bool           `json:"verified"`
+		Records     int            `json:"records"`
+		Collections map[string]int `json:"collections"`
+	}
+	if err := json.Unmarshal([]byte(out), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Did != testRepoDid || !summary.Verified || summary.Records != 3 || summary.Collections["app.bsky.feed.post"] != 2 {
+		t.Errorf("unexpected summary: %s", out)
+	}
+
+	// a repo signed by another key is rejected
+	other := testPLC(t, testRepoKey(t))
+	err = app.Run([]string{"gosky", "--plc", other.URL, "repo", "get", path})
+	if err == nil || !strings.Contains(err.Error(), "invalid commit signature") {
+		t.Errorf("expected an invalid signature error, got %v", err)
+	}
+
+	// exports are byte for byte what was fetched
+	exported := filepath.Join(t.TempDir(), "export.car")
+	if err := app.Run([]string{"gosky", "--plc", plc.URL, "repo", "export", "--car", exported, path}); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := os.ReadFile(path)
+	got, err := os.ReadFile(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("expected the exported CAR to be the same as the original")
+	}
+}
+
+func TestIngestVerifiedCar(t *testing.T) {
+	ctx := context.Background()
+
+	good := blocks.NewBlock([]byte("good block"))
+	bad, err := blocks.NewBlockWithCid([]byte("tampered block"), blocks.NewBlock([]byte("original block")).Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, blks := range [][]blocks.Block{{good}, {good, bad}} {
+		buf := new(bytes.Buffer)
+		if err := car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{good.Cid()}, Version: 1}, buf); err != nil {
+			t.Fatal(err)
+		}
+		for _, blk := range blks {
+			if err := carutil.LdWrite(buf, blk.Cid().Bytes(), blk.RawData()); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+		root, err := ingestVerifiedCar(ctx, bs, buf)
+		if len(blks) == 1 {
+			if err != nil || !root.Equals(good.Cid()) {
+				t.Errorf("expected the root to be read, got %s, %v", root, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("expected a tampered block to be rejected, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/bluesky-social/indigo/api"
+	"github.com/bluesky-social/indigo/identity"
+	"github.com/bluesky-social/indigo/util/cliutil"
+	cli "github.com/urfave/cli/v2"
+)
+
+var resolveCmd = &cli.Command{
+	Name:      "resolve",
+	Usage:     "resolve DIDs and handles in bulk, printing one JSON result per line",
+	ArgsUsage: `[did or handle...]`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "file",
+			Usage: "file with one DID or handle per line, or - for stdin",
+		},
+		&cli.IntFlag{
+			Name:  "parallel",
+			Usage: "number of resolutions to run at once",
+			Value: 20,
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		ctx := context.TODO()
+
+		res := identity.NewResolver(cliutil.GetDidResolver(cctx), &api.ProdHandleResolver{}, identity.NewMemCache(100000))
+
+		in := make(chan string)
+		out := make(chan *identity.Identity)
+		go res.ResolveStream(ctx, in, cctx.Int("parallel"), out)
+
+		readErr := make(chan error, 1)
+		go func() {
+			defer close(in)
+			for _, a := range cctx.Args().Slice() {
+				in <- a
+			}
+
+			fname := cctx.String("file")
+			if fname == "" {
+				readErr <- nil
+				return
+			}
+
+			var r io.Reader = os.Stdin
+			if fname != "-" {
+				fi, err := os.Open(fname)
+				if err != nil {
+					readErr <- err
+					return
+				}
+				defer fi.Close()
+				r = fi
+			}
+
+			scan := bufio.NewScanner(r)
+			for scan.Scan() {
+				if line := strings.TrimSpace(scan.Text()); line != "" {
+					in <- line
+				}
+			}
+			readErr <- scan.Err()
+		}()
+
+		type result struct {
+			Input  string `json:"input"`
+			Did    string `json:"did,omitempty"`
+			Handle string `json:"handle,omitempty"`
+			Pds    string `json:"pds,omitempty"`
+			Error  string `json:"error,omitempty"`
+		}
+
+		w := bufio.NewWriter(os.Stdout)
+		defer w.Flush()
+		enc := json.NewEncoder(w)
+
+		var failed int
+		for id := range out {
+			r := result{
+				Input:  id.Input,
+				Did:    id.Did,
+				Handle: id.Handle,
+			}
+			if id.Doc != nil {
+				for _, s := range id.Doc.Service {
+					if strings.HasSuffix(s.ID.String(), "#atproto_pds") {
+						r.Pds = s.ServiceEndpoint
+					}
+				}
+			}
+			if id.Err != nil {
+				r.Error = id.Err.Error()
+				failed++
+			}
+
+			if err := enc.Encode(&r); err != nil {
+				return err
+			}
+		}
+
+		if err := <-readErr; err != nil {
+			return fmt.Errorf("reading input: %w", err)
+		}
+
+		if failed > 0 {
+			fmt.Fprintf(os.Stderr, "%d identities failed to resolve\n", failed)
+		}
+
+		return nil
+	},
+}
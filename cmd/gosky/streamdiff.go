@@ -134,6 +134,8 @@ func evtOp(evt *events.XRPCStreamEvent) string {
 		return "#migrate"
 	case evt.RepoTombstone != nil:
 		return "#tombstone"
+	case evt.RepoAccount != nil:
+		return "#account"
 	default:
 		return "unknown"
 	}
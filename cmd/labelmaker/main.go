@@ -2,12 +2,24 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
+	"github.com/bluesky-social/indigo/api"
 	"github.com/bluesky-social/indigo/carstore"
+	didres "github.com/bluesky-social/indigo/did"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/identity"
 	"github.com/bluesky-social/indigo/labeler"
+	"github.com/bluesky-social/indigo/lex/validate"
 	"github.com/bluesky-social/indigo/util/cliutil"
+	"github.com/bluesky-social/indigo/util/counters"
+	"github.com/bluesky-social/indigo/util/phash"
+	"github.com/bluesky-social/indigo/util/ratelimit"
+	"github.com/bluesky-social/indigo/util/serviceauth"
+	"github.com/bluesky-social/indigo/util/signer"
 	"github.com/bluesky-social/indigo/util/version"
 	"github.com/urfave/cli/v2"
 
@@ -100,9 +112,14 @@ func run(args []string) error {
 		},
 		&cli.StringFlag{
 			Name:    "signing-secret-key-jwk",
-			Usage:   "signing key for labelmaker repo, in JWK serialization",
+			Usage:   "signing key (P-256 or secp256k1) for labelmaker repo, as a JWK, PEM or multibase string, or a file://, awssm:// or vault:// reference to one",
 			EnvVars: []string{"LABELMAKER_SIGNING_SECRET_KEY_JWK"},
 		},
+		&cli.StringFlag{
+			Name:    "signing-key",
+			Usage:   "signing key for labelmaker repo held in AWS KMS (awskms://<key id or ARN>) or on a PKCS#11 token (pkcs11:token=..;object=..?module-path=..), used instead of signing-secret-key-jwk",
+			EnvVars: []string{"LABELMAKER_SIGNING_KEY"},
+		},
 		&cli.StringFlag{
 			Name:    "bind",
 			Usage:   "IP or address, and port, to listen on for HTTP and WebSocket APIs",
@@ -126,6 +143,43 @@ func run(args []string) error {
 			Usage:   "keyword filter config, as JSON file",
 			EnvVars: []string{"LABELMAKER_KEYWORD_FILE"},
 		},
+		&cli.StringFlag{
+			Name:    "rules-file",
+			Usage:   "moderation rules to check records against, as YAML file",
+			EnvVars: []string{"LABELMAKER_RULES_FILE"},
+		},
+		&cli.StringFlag{
+			Name:    "label-vocabulary-file",
+			Usage:   "label values the labelmaker emits, with definitions of custom ones, as the JSON policies of an app.bsky.labeler.service record (any values may be emitted if unset)",
+			EnvVars: []string{"LABELMAKER_LABEL_VOCABULARY_FILE"},
+		},
+		&cli.StringFlag{
+			Name:    "counters-redis-url",
+			Usage:   "redis server used to share the velocities rules count between instances (in-memory if unset)",
+			EnvVars: []string{"COUNTERS_REDIS_URL"},
+		},
+		&cli.StringFlag{
+			Name:    "thread-appview-url",
+			Usage:   "appview to fetch the posts replies are to from, for the parent and root conditions of rules (full URL)",
+			EnvVars: []string{"LABELMAKER_THREAD_APPVIEW_URL"},
+		},
+		&cli.IntFlag{
+			Name:    "thread-cache-size",
+			Usage:   "how many recent posts to keep for the parent and root conditions of rules",
+			EnvVars: []string{"LABELMAKER_THREAD_CACHE_SIZE"},
+			Value:   100_000,
+		},
+		&cli.StringFlag{
+			Name:    "thread-fetch-budget",
+			Usage:   "how many posts can be fetched from the appview for rules, as count/period",
+			EnvVars: []string{"LABELMAKER_THREAD_FETCH_BUDGET"},
+			Value:   labeler.DefaultThreadFetchBudget.String(),
+		},
+		&cli.StringSliceFlag{
+			Name:    "list-label",
+			Usage:   "label the accounts on a moderation list, as listUri=label (can be repeated)",
+			EnvVars: []string{"LABELMAKER_LIST_LABELS"},
+		},
 		&cli.StringFlag{
 			Name:    "micro-nsfw-img-url",
 			Usage:   "'micro-nsfw-img' classifier endpoint (full URL)",
@@ -136,6 +190,27 @@ func run(args []string) error {
 			Usage:   "thehive.ai API token",
 			EnvVars: []string{"LABELMAKER_HIVEAI_API_TOKEN"},
 		},
+		&cli.StringSliceFlag{
+			Name:    "image-hash-list",
+			Usage:   "file of perceptual hashes of known images to label, and their labels (see 'hash-image')",
+			EnvVars: []string{"LABELMAKER_IMAGE_HASH_LISTS"},
+		},
+		&cli.StringFlag{
+			Name:    "image-hash-api-url",
+			Usage:   "hash matching service endpoint to check image hashes against (full URL)",
+			EnvVars: []string{"LABELMAKER_IMAGE_HASH_API_URL"},
+		},
+		&cli.StringFlag{
+			Name:    "image-hash-api-token",
+			Usage:   "bearer token for the hash matching service",
+			EnvVars: []string{"LABELMAKER_IMAGE_HASH_API_TOKEN"},
+		},
+		&cli.IntFlag{
+			Name:    "image-hash-max-distance",
+			Usage:   "how many bits image hashes can differ by and still match (of 256)",
+			EnvVars: []string{"LABELMAKER_IMAGE_HASH_MAX_DISTANCE"},
+			Value:   labeler.DefaultHashMaxDistance,
+		},
 		&cli.StringFlag{
 			Name:    "sqrl-url",
 			Usage:   "SQRL API endpoint (full URL)",
@@ -151,7 +226,102 @@ func run(args []string) error {
 			EnvVars: []string{"MAX_METADB_CONNECTIONS"},
 			Value:   40,
 		},
+		&cli.StringFlag{
+			Name:    "ratelimit-redis-url",
+			Usage:   "redis server used to share rate limit state between instances (in-memory if unset)",
+			EnvVars: []string{"RATELIMIT_REDIS_URL"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "ratelimit",
+			Usage:   "override the rate limit for an endpoint, as nsid=count/period (or nsid=off)",
+			EnvVars: []string{"RATELIMIT_OVERRIDES"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "trusted-proxy",
+			Usage:   "CIDR range of reverse proxies whose X-Forwarded-For headers give client IPs (by default they are ignored)",
+			EnvVars: []string{"TRUSTED_PROXIES"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "report-threshold",
+			Usage:   "label subjects reported by enough accounts, as reasonType=count:label",
+			EnvVars: []string{"LABELMAKER_REPORT_THRESHOLDS"},
+		},
+		&cli.StringFlag{
+			Name:    "report-forward-url",
+			Usage:   "moderation service to forward reports to (full URL)",
+			EnvVars: []string{"LABELMAKER_REPORT_FORWARD_URL"},
+		},
+		&cli.StringFlag{
+			Name:    "report-forward-token",
+			Usage:   "bearer token for the moderation service reports are forwarded to",
+			EnvVars: []string{"LABELMAKER_REPORT_FORWARD_TOKEN"},
+		},
+		&cli.BoolFlag{
+			Name:    "accept-service-auth",
+			Usage:   "accept reports authenticated with service auth tokens addressed to the repo DID",
+			EnvVars: []string{"LABELMAKER_ACCEPT_SERVICE_AUTH"},
+		},
+		&cli.BoolFlag{
+			Name:    "accept-subscriber-service-auth",
+			Usage:   "accept label subscribers authenticated with service auth tokens addressed to the repo DID, as anonymous unless they have a policy",
+			EnvVars: []string{"LABELMAKER_ACCEPT_SUBSCRIBER_SERVICE_AUTH"},
+		},
+		&cli.BoolFlag{
+			Name:    "require-subscriber-auth",
+			Usage:   "refuse label subscribers which don't authenticate with a subscriber token or (with --accept-subscriber-service-auth) a service auth token with a policy",
+			EnvVars: []string{"LABELMAKER_REQUIRE_SUBSCRIBER_AUTH"},
+		},
+		&cli.StringFlag{
+			Name:    "anonymous-subscriber-policy",
+			Usage:   "policy for label subscribers which don't authenticate, as JSON like the admin API's (eg '{}' for none), needed to allow them once any subscriber has a policy",
+			EnvVars: []string{"LABELMAKER_ANONYMOUS_SUBSCRIBER_POLICY"},
+		},
+		&cli.StringFlag{
+			Name:    "lexicon-dir",
+			Usage:   "directory of lexicon JSON files to validate XRPC requests against (validation is disabled if unset)",
+			EnvVars: []string{"LEXICON_DIR"},
+		},
+		&cli.BoolFlag{
+			Name:    "verify-signatures",
+			Usage:   "check the signatures of commits from the BGS against their repos' keys, dropping those which fail",
+			EnvVars: []string{"LABELMAKER_VERIFY_SIGNATURES"},
+		},
+		&cli.BoolFlag{
+			Name:    "allow-list",
+			Usage:   "only process records from accounts on the allow-list (--allow-did, --allow-pds-host, and entries added with the admin endpoints), instead of the whole firehose",
+			EnvVars: []string{"LABELMAKER_ALLOW_LIST"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "allow-did",
+			Usage:   "DID to process records from, in allow-list mode (implies --allow-list; can be repeated)",
+			EnvVars: []string{"LABELMAKER_ALLOW_DIDS"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "allow-pds-host",
+			Usage:   "PDS host whose accounts to process records from, in allow-list mode (implies --allow-list; can be repeated)",
+			EnvVars: []string{"LABELMAKER_ALLOW_PDS_HOSTS"},
+		},
+	}
+
+	app.Flags = append(app.Flags, cliutil.DatabaseFlags("metadb")...)
+	app.Flags = append(app.Flags, cliutil.DatabaseFlags("carstore")...)
+	app.Flags = append(app.Flags, cliutil.AutoMigrateFlag)
+	app.Flags = append(app.Flags, cliutil.CursorStoreFlag)
+	app.Flags = append(app.Flags, cliutil.InvalidationBusFlag)
+	app.Flags = append(app.Flags, cliutil.ShutdownFlags...)
+	app.Flags = append(app.Flags, cliutil.DebugFlags("")...)
+	app.Flags = append(app.Flags, cliutil.LogFlags...)
+	app.Flags = append(app.Flags, cliutil.ConfigFlag)
+	app.Before = func(cctx *cli.Context) error {
+		if err := cliutil.LoadConfig(cctx); err != nil {
+			return err
+		}
+		if err := cliutil.ResolveSecretFlags(cctx, "repo-password", "signing-secret-key-jwk", "signing-key", "xrpc-proxy-admin-password", "hiveai-api-token", "image-hash-api-token", "report-forward-token"); err != nil {
+			return err
+		}
+		return cliutil.SetupLogging(cctx)
 	}
+	app.Commands = []*cli.Command{cliutil.ConfigCommand, hashImageCmd}
 
 	app.Action = func(cctx *cli.Context) error {
 
@@ -162,13 +332,13 @@ func run(args []string) error {
 		repoKeyPath := filepath.Join(datadir, "labelmaker.key")
 
 		dburl := cctx.String("db-url")
-		db, err := cliutil.SetupDatabase(dburl, cctx.Int("max-metadb-connections"))
+		db, err := cliutil.SetupDatabaseWithOptions(dburl, cliutil.DatabaseOptions(cctx, "metadb"))
 		if err != nil {
 			return err
 		}
 
 		csdburl := cctx.String("carstore-db-url")
-		csdb, err := cliutil.SetupDatabase(csdburl, cctx.Int("max-carstore-connections"))
+		csdb, err := cliutil.SetupDatabaseWithOptions(csdburl, cliutil.DatabaseOptions(cctx, "carstore"))
 		if err != nil {
 			return err
 		}
@@ -222,7 +392,18 @@ func run(args []string) error {
 		}
 
 		var serkey *did.PrivKey
-		if signingSecretKeyJwk != "" {
+		var sig signer.Signer
+		if signingKey := cctx.String("signing-key"); signingKey != "" {
+			sig, err = signer.Open(cctx.Context, signingKey)
+			if err != nil {
+				return fmt.Errorf("opening signing key: %w", err)
+			}
+			pub, err := sig.Public(cctx.Context)
+			if err != nil {
+				return err
+			}
+			log.Infow("signing repo with external key", "did", pub.DID())
+		} else if signingSecretKeyJwk != "" {
 			serkey, err = labeler.ParseSecretKey(signingSecretKeyJwk)
 			if err != nil {
 				return err
@@ -239,16 +420,147 @@ func run(args []string) error {
 			Did:        repoDid,
 			Password:   repoPassword,
 			SigningKey: serkey,
+			Signer:     sig,
 			UserId:     1,
 		}
 
-		srv, err := labeler.NewServer(db, cstore, repoUser, plcURL, blobPdsURL, xrpcProxyURL, xrpcProxyAdminPassword, useWss)
+		srv, err := labeler.NewServer(db, cstore, repoUser, plcURL, blobPdsURL, xrpcProxyURL, xrpcProxyAdminPassword)
+		if err != nil {
+			return err
+		}
+
+		if cliutil.MigrateOnly(cctx) {
+			return nil
+		}
+
+		srv.SetKeywordLabelers(kwl)
+
+		if url := cctx.String("thread-appview-url"); url != "" {
+			budget, err := ratelimit.ParseLimit(cctx.String("thread-fetch-budget"))
+			if err != nil {
+				return fmt.Errorf("thread-fetch-budget: %w", err)
+			}
+			tc, err := labeler.NewThreadContext(url, cctx.Int("thread-cache-size"), budget)
+			if err != nil {
+				return err
+			}
+			srv.AddThreadContext(tc)
+		}
+
+		if rulesFile := cctx.String("rules-file"); rulesFile != "" {
+			velocities, err := counters.NewStore(cctx.String("counters-redis-url"), "labelmaker:counters:")
+			if err != nil {
+				return err
+			}
+			if err := srv.LoadRulesFile(rulesFile, velocities); err != nil {
+				return fmt.Errorf("loading rules: %w", err)
+			}
+		}
+
+		rlstore, err := ratelimit.NewStore(cctx.String("ratelimit-redis-url"), "labelmaker:")
+		if err != nil {
+			return err
+		}
+		rlimits, err := ratelimit.ApplyOverrides(labeler.DefaultRateLimits, cctx.StringSlice("ratelimit"))
+		if err != nil {
+			return err
+		}
+		srv.SetRateLimits(rlstore, rlimits)
+
+		ipx, err := ratelimit.IPExtractor(cctx.StringSlice("trusted-proxy"))
+		if err != nil {
+			return err
+		}
+		srv.SetIPExtractor(ipx)
+
+		var thresholds []labeler.ReportThreshold
+		for _, t := range cctx.StringSlice("report-threshold") {
+			rt, err := labeler.ParseReportThreshold(t)
+			if err != nil {
+				return err
+			}
+			thresholds = append(thresholds, rt)
+		}
+		srv.SetReportThresholds(thresholds)
+
+		if url := cctx.String("report-forward-url"); url != "" {
+			srv.SetReportForwarding(url, cctx.String("report-forward-token"))
+		}
+
+		if lexDir := cctx.String("lexicon-dir"); lexDir != "" {
+			cat := validate.NewCatalog()
+			if err := cat.LoadDirectory(lexDir); err != nil {
+				return fmt.Errorf("loading lexicons: %w", err)
+			}
+			srv.SetRequestValidator(validate.NewValidator(cat, validate.Lenient))
+		}
+
+		mr := didres.NewMultiResolver()
+		mr.AddHandler("plc", &api.PLCServer{Host: plcURL})
+		mr.AddHandler("web", &didres.WebResolver{})
+		dir := identity.NewResolver(mr, nil, identity.NewMemCache(100_000))
+
+		sav := &serviceauth.Validator{
+			Dir:         dir,
+			ServiceDID:  repoDid,
+			RequireLxm:  true,
+			MaxLifetime: 5 * time.Minute,
+		}
+		if cctx.Bool("accept-service-auth") {
+			srv.SetServiceAuth(sav)
+		}
+		if cctx.Bool("accept-subscriber-service-auth") {
+			srv.SetSubscriberServiceAuth(sav)
+		}
+		srv.SetRequireSubscriberAuth(cctx.Bool("require-subscriber-auth"))
+		if cctx.IsSet("anonymous-subscriber-policy") {
+			p, err := events.ParseSubscriptionPolicy(cctx.String("anonymous-subscriber-policy"))
+			if err != nil {
+				return err
+			}
+			srv.SetAnonymousSubscriptionPolicy(p)
+		}
+
+		if cctx.Bool("verify-signatures") {
+			sv, err := events.NewSignatureVerifier(dir, 100_000)
+			if err != nil {
+				return err
+			}
+			srv.SetSignatureVerifier(sv)
+		}
+
+		if cctx.IsSet("cursor-store") {
+			cs, err := cliutil.OpenCursorStore(cctx, nil)
+			if err != nil {
+				return err
+			}
+			srv.SetCursorStore(cs)
+		}
+
+		invalidations, err := cliutil.OpenInvalidationBus(cctx)
 		if err != nil {
 			return err
 		}
+		srv.SetInvalidationBus(invalidations)
+
+		allowDids := cctx.StringSlice("allow-did")
+		allowHosts := cctx.StringSlice("allow-pds-host")
+		if cctx.Bool("allow-list") || len(allowDids) > 0 || len(allowHosts) > 0 {
+			if err := srv.EnableAllowList(dir, allowDids, allowHosts); err != nil {
+				return err
+			}
+		}
 
-		for _, l := range kwl {
-			srv.AddKeywordLabeler(l)
+		var listLabels []labeler.ListLabel
+		for _, l := range cctx.StringSlice("list-label") {
+			ll, err := labeler.ParseListLabel(l)
+			if err != nil {
+				return err
+			}
+			listLabels = append(listLabels, ll)
+		}
+		if err := srv.AddListLabels(cctx.Context, dir, listLabels); err != nil {
+			return err
 		}
 
 		if microNSFWImgURL != "" {
@@ -263,9 +575,86 @@ func run(args []string) error {
 			srv.AddSQRLLabeler(sqrlURL)
 		}
 
-		srv.SubscribeBGS(context.TODO(), bgsURL, useWss)
-		return srv.RunAPI(bind)
+		var hashLists []labeler.HashList
+		maxDistance := cctx.Int("image-hash-max-distance")
+		for _, path := range cctx.StringSlice("image-hash-list") {
+			hl, err := labeler.LoadHashListFile(path, maxDistance)
+			if err != nil {
+				return fmt.Errorf("loading image hash list: %w", err)
+			}
+			hashLists = append(hashLists, hl)
+		}
+		if url := cctx.String("image-hash-api-url"); url != "" {
+			hashLists = append(hashLists, labeler.NewRemoteHashList(url, cctx.String("image-hash-api-token"), maxDistance))
+		}
+		if len(hashLists) > 0 {
+			ihl, err := labeler.NewImageHashLabeler(hashLists, 100_000)
+			if err != nil {
+				return err
+			}
+			srv.AddImageHashLabeler(ihl)
+		}
+
+		if vocabFile := cctx.String("label-vocabulary-file"); vocabFile != "" {
+			vocab, err := labeler.LoadLabelVocabularyFile(vocabFile)
+			if err != nil {
+				return err
+			}
+			if err := srv.SetLabelVocabulary(vocab); err != nil {
+				return err
+			}
+		}
+
+		dbg, err := cliutil.StartDebugServer(cctx)
+		if err != nil {
+			return err
+		}
+
+		// the BGS subscription is drained and its cursor saved before the
+		// carstore stops taking writes
+		sm := cliutil.NewShutdownManagerFromFlags(cctx)
+		if err := srv.SubscribeBGS(sm.Context(), bgsURL, useWss); err != nil {
+			return err
+		}
+		sm.Add("labelmaker", srv.Shutdown)
+		sm.Go("api", func(ctx context.Context) error {
+			return srv.RunAPI(bind)
+		})
+		sm.Add("carstore", cstore.Close)
+		sm.Add("invalidation-bus", func(ctx context.Context) error {
+			return invalidations.Close()
+		})
+		if dbg != nil {
+			sm.Add("debug", dbg.Shutdown)
+		}
+
+		return sm.Wait()
 	}
+	app.Commands = append(app.Commands, cliutil.MigrateCommand(nil, app.Action))
 
 	return app.Run(args)
 }
+
+var hashImageCmd = &cli.Command{
+	Name:      "hash-image",
+	Usage:     "print the perceptual hashes of image files, for image hash lists",
+	ArgsUsage: "<file>...",
+	Action: func(cctx *cli.Context) error {
+		if !cctx.Args().Present() {
+			return fmt.Errorf("need at least one image file")
+		}
+		for _, path := range cctx.Args().Slice() {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			h, err := phash.Decode(f)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			fmt.Printf("%s\t%s\n", h, path)
+		}
+		return nil
+	},
+}
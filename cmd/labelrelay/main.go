@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bluesky-social/indigo/labelrelay"
+	"github.com/bluesky-social/indigo/util/cliutil"
+	"github.com/bluesky-social/indigo/util/labelsig"
+	"github.com/bluesky-social/indigo/util/version"
+	"github.com/urfave/cli/v2"
+
+	_ "github.com/joho/godotenv/autoload"
+	_ "go.uber.org/automaxprocs"
+
+	logging "github.com/ipfs/go-log"
+)
+
+var log = logging.Logger("labelrelay")
+
+func main() {
+	if err := run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(args []string) error {
+
+	app := cli.App{
+		Name:    "labelrelay",
+		Usage:   "atproto label stream aggregator, relaying many labelers' labels as one stream",
+		Version: version.Version,
+	}
+
+	app.Flags = []cli.Flag{
+		&cli.StringFlag{
+			Name:    "db-url",
+			Usage:   "database connection string for labelrelay database",
+			Value:   "sqlite://./data/labelrelay/labelrelay.sqlite",
+			EnvVars: []string{"DATABASE_URL"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "source",
+			Usage:   "labeler host to relay the labels of, as hostname[:port] or a ws:// or wss:// URL (can be repeated; sources stay added across restarts)",
+			EnvVars: []string{"LABELRELAY_SOURCES"},
+		},
+		&cli.BoolFlag{
+			Name:  "subscribe-insecure-ws",
+			Usage: "when connecting to sources given as bare hostnames, use ws:// instead of wss://",
+		},
+		&cli.StringFlag{
+			Name:    "bind",
+			Usage:   "IP or address, and port, to listen on for HTTP and WebSocket APIs",
+			Value:   ":2215",
+			EnvVars: []string{"LABELRELAY_BIND"},
+		},
+		&cli.StringFlag{
+			Name:    "admin-password",
+			Usage:   "password for the admin endpoints adding and removing sources (disabled if unset)",
+			EnvVars: []string{"LABELRELAY_ADMIN_PASSWORD"},
+		},
+		&cli.BoolFlag{
+			Name:    "verify-labels",
+			Usage:   "check the signatures of relayed labels against their labelers' keys, dropping those which fail",
+			EnvVars: []string{"LABELRELAY_VERIFY_LABELS"},
+		},
+		&cli.BoolFlag{
+			Name:    "allow-unsigned",
+			Usage:   "with --verify-labels, relay labels which have no signature rather than dropping them",
+			EnvVars: []string{"LABELRELAY_ALLOW_UNSIGNED"},
+		},
+		&cli.StringFlag{
+			Name:    "plc",
+			Usage:   "method, hostname, and port of PLC registry, to resolve labelers' keys",
+			Value:   "https://plc.directory",
+			EnvVars: []string{"ATP_PLC_HOST"},
+		},
+		&cli.DurationFlag{
+			Name:    "retention",
+			Usage:   "how long relayed labels are kept for replay (forever if zero)",
+			EnvVars: []string{"LABELRELAY_RETENTION"},
+		},
+	}
+
+	app.Flags = append(app.Flags, cliutil.DatabaseFlags("metadb")...)
+	app.Flags = append(app.Flags, cliutil.AutoMigrateFlag)
+	app.Flags = append(app.Flags, cliutil.ShutdownFlags...)
+	app.Flags = append(app.Flags, cliutil.DebugFlags("")...)
+	app.Flags = append(app.Flags, cliutil.LogFlags...)
+	app.Flags = append(app.Flags, cliutil.ConfigFlag)
+	app.Before = func(cctx *cli.Context) error {
+		if err := cliutil.LoadConfig(cctx); err != nil {
+			return err
+		}
+		if err := cliutil.ResolveSecretFlags(cctx, "admin-password"); err != nil {
+			return err
+		}
+		return cliutil.SetupLogging(cctx)
+	}
+	app.Commands = []*cli.Command{cliutil.ConfigCommand}
+
+	app.Action = func(cctx *cli.Context) error {
+
+		os.MkdirAll("data/labelrelay", os.ModePerm)
+
+		dburl := cctx.String("db-url")
+		db, err := cliutil.SetupDatabaseWithOptions(dburl, cliutil.DatabaseOptions(cctx, "metadb"))
+		if err != nil {
+			return err
+		}
+
+		relay, err := labelrelay.NewRelay(db)
+		if err != nil {
+			return err
+		}
+
+		if cliutil.MigrateOnly(cctx) {
+			return nil
+		}
+
+		for _, host := range cctx.StringSlice("source") {
+			if cctx.Bool("subscribe-insecure-ws") && !strings.Contains(host, "://") {
+				host = "ws://" + host
+			}
+			if err := relay.AddSource(cctx.Context, host); err != nil {
+				return fmt.Errorf("adding source: %w", err)
+			}
+		}
+
+		if cctx.Bool("verify-labels") {
+			v, err := labelsig.NewVerifier(cliutil.GetDidResolver(cctx), 1000)
+			if err != nil {
+				return err
+			}
+			v.AllowUnsigned = cctx.Bool("allow-unsigned")
+			relay.SetVerifier(v)
+		}
+		relay.SetRetention(cctx.Duration("retention"))
+
+		dbg, err := cliutil.StartDebugServer(cctx)
+		if err != nil {
+			return err
+		}
+
+		sm := cliutil.NewShutdownManagerFromFlags(cctx)
+		if err := relay.Start(sm.Context()); err != nil {
+			return err
+		}
+		sm.Add("labelrelay", relay.Shutdown)
+		sm.Go("api", func(ctx context.Context) error {
+			return relay.RunAPI(cctx.String("bind"), cctx.String("admin-password"))
+		})
+		if dbg != nil {
+			sm.Add("debug", dbg.Shutdown)
+		}
+
+		return sm.Wait()
+	}
+	app.Commands = append(app.Commands, cliutil.MigrateCommand(nil, app.Action))
+
+	return app.Run(args)
+}
@@ -1,14 +1,22 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 
 	"github.com/bluesky-social/indigo/api"
+	"github.com/bluesky-social/indigo/blobs"
 	"github.com/bluesky-social/indigo/carstore"
+	"github.com/bluesky-social/indigo/lex/validate"
 	"github.com/bluesky-social/indigo/pds"
 	"github.com/bluesky-social/indigo/plc"
+	"github.com/bluesky-social/indigo/rules"
 	"github.com/bluesky-social/indigo/util/cliutil"
+	"github.com/bluesky-social/indigo/util/counters"
+	"github.com/bluesky-social/indigo/util/keyutil"
+	"github.com/bluesky-social/indigo/util/ratelimit"
+	"github.com/bluesky-social/indigo/util/signer"
 	"github.com/bluesky-social/indigo/util/version"
 
 	_ "github.com/joho/godotenv/autoload"
@@ -95,6 +103,104 @@ func run(args []string) {
 			EnvVars: []string{"MAX_METADB_CONNECTIONS"},
 			Value:   40,
 		},
+		&cli.StringFlag{
+			Name:    "ratelimit-redis-url",
+			Usage:   "redis server used to share rate limit state between instances (in-memory if unset)",
+			EnvVars: []string{"RATELIMIT_REDIS_URL"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "ratelimit",
+			Usage:   "override the rate limit for an endpoint, as nsid=count/period (or nsid=off)",
+			EnvVars: []string{"RATELIMIT_OVERRIDES"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "trusted-proxy",
+			Usage:   "CIDR range of reverse proxies whose X-Forwarded-For headers give client IPs (by default they are ignored)",
+			EnvVars: []string{"TRUSTED_PROXIES"},
+		},
+		&cli.StringFlag{
+			Name:    "admin-key",
+			Usage:   "bearer token for the /admin API (disabled if unset)",
+			EnvVars: []string{"PDS_ADMIN_KEY"},
+		},
+		&cli.StringFlag{
+			Name:    "signing-key",
+			Usage:   "repo signing key held in AWS KMS (awskms://<key id or ARN>) or on a PKCS#11 token (pkcs11:token=..;object=..?module-path=..), instead of the server key",
+			EnvVars: []string{"PDS_SIGNING_KEY"},
+		},
+		&cli.StringFlag{
+			Name:    "lexicon-dir",
+			Usage:   "directory of lexicon JSON files to validate records and XRPC requests against (validation is disabled if unset)",
+			EnvVars: []string{"LEXICON_DIR"},
+		},
+		&cli.BoolFlag{
+			Name:    "strict-validation",
+			Usage:   "reject records that can not be fully validated against a known lexicon",
+			EnvVars: []string{"STRICT_VALIDATION"},
+		},
+		&cli.DurationFlag{
+			Name:    "orphan-blob-grace-period",
+			Usage:   "how long uploaded blobs can go unreferenced by any record before they are deleted",
+			EnvVars: []string{"PDS_ORPHAN_BLOB_GRACE_PERIOD"},
+			Value:   pds.OrphanBlobGracePeriod,
+		},
+		&cli.DurationFlag{
+			Name:    "notification-retention",
+			Usage:   "how long notifications are kept before they are pruned (forever if zero)",
+			EnvVars: []string{"PDS_NOTIFICATION_RETENTION"},
+			Value:   pds.NotificationRetention,
+		},
+		&cli.Int64Flag{
+			Name:    "image-max-size",
+			Usage:   "largest image accepted by uploadBlob, in bytes (0 for no limit beyond that of all blobs)",
+			EnvVars: []string{"PDS_IMAGE_MAX_SIZE"},
+			Value:   pds.DefaultImageConfig.MaxSize,
+		},
+		&cli.IntFlag{
+			Name:    "image-max-dimension",
+			Usage:   "largest width or height of images accepted by uploadBlob, in pixels (0 for no limit)",
+			EnvVars: []string{"PDS_IMAGE_MAX_DIMENSION"},
+			Value:   pds.DefaultImageConfig.MaxDimension,
+		},
+		&cli.BoolFlag{
+			Name:    "strip-image-metadata",
+			Usage:   "remove EXIF and other metadata from uploaded JPEG and PNG images",
+			EnvVars: []string{"PDS_STRIP_IMAGE_METADATA"},
+			Value:   pds.DefaultImageConfig.StripMetadata,
+		},
+		&cli.Int64Flag{
+			Name:    "max-video-size",
+			Usage:   "largest video accepted by uploadBlob, in bytes",
+			EnvVars: []string{"PDS_MAX_VIDEO_SIZE"},
+			Value:   pds.DefaultMaxVideoSize,
+		},
+		&cli.Int64Flag{
+			Name:    "blob-quota",
+			Usage:   "total size of blobs each account may store, in bytes, unless set for the account through the admin API (0 for no quota)",
+			EnvVars: []string{"PDS_BLOB_QUOTA"},
+		},
+		&cli.IntSliceFlag{
+			Name:    "image-variants",
+			Usage:   "sizes, in pixels across, of resized copies to store of uploaded images, served from /img/<did>/<cid>/<size>",
+			EnvVars: []string{"PDS_IMAGE_VARIANTS"},
+		},
+		&cli.StringFlag{
+			Name:    "rules-file",
+			Usage:   "moderation rules to check written records against, with the IP addresses they were written from, as YAML file",
+			EnvVars: []string{"PDS_RULES_FILE"},
+		},
+		&cli.StringFlag{
+			Name:    "counters-redis-url",
+			Usage:   "redis server used to share the velocities rules count between instances (in-memory if unset)",
+			EnvVars: []string{"COUNTERS_REDIS_URL"},
+		},
+	}
+
+	app.Flags = append(app.Flags, cliutil.DebugFlags("")...)
+	app.Flags = append(app.Flags, cliutil.InvalidationBusFlag)
+
+	app.Before = func(cctx *cli.Context) error {
+		return cliutil.ResolveSecretFlags(cctx, "jwt-secret", "admin-key", "signing-key")
 	}
 
 	app.Commands = []*cli.Command{
@@ -163,24 +269,109 @@ func run(args []string) {
 			return err
 		}
 
+		key, err := cliutil.LoadKeyFromFile(keypath)
+		if err != nil {
+			return err
+		}
+
+		// accounts are created with the pds key as a rotation key, which
+		// lets it update their handles
 		var didr plc.PLCClient
 		if plchost := cctx.String("plc-host"); plchost != "" {
-			didr = &api.PLCServer{Host: plchost}
+			didr = &api.PLCServer{Host: plchost, RotationKey: key}
 		} else {
 			didr = plc.NewFakeDid(db)
 		}
 
 		pdshost := cctx.String("name")
 
-		key, err := cliutil.LoadKeyFromFile(keypath)
+		srv, err := pds.NewServer(db, cstore, key, pdsdomain, pdshost, didr, jwtsecret)
 		if err != nil {
 			return err
 		}
 
-		srv, err := pds.NewServer(db, cstore, key, pdsdomain, pdshost, didr, jwtsecret)
+		if signingKey := cctx.String("signing-key"); signingKey != "" {
+			sig, err := signer.Open(cctx.Context, signingKey)
+			if err != nil {
+				return fmt.Errorf("opening signing key: %w", err)
+			}
+			pub, err := sig.Public(cctx.Context)
+			if err != nil {
+				return err
+			}
+			log.Infow("signing repos with external key", "did", pub.DID())
+			srv.SetSigner(sig)
+		}
+
+		srv.SetBlobStore(&blobs.DiskBlobStore{Dir: filepath.Join(datadir, "blobs")})
+		pds.OrphanBlobGracePeriod = cctx.Duration("orphan-blob-grace-period")
+		pds.NotificationRetention = cctx.Duration("notification-retention")
+		srv.SetMaxVideoSize(cctx.Int64("max-video-size"))
+		srv.SetDefaultBlobQuota(cctx.Int64("blob-quota"))
+		srv.SetImageConfig(&pds.ImageConfig{
+			MaxSize:       cctx.Int64("image-max-size"),
+			MaxDimension:  cctx.Int("image-max-dimension"),
+			StripMetadata: cctx.Bool("strip-image-metadata"),
+			Variants:      cctx.IntSlice("image-variants"),
+		})
+
+		rlstore, err := ratelimit.NewStore(cctx.String("ratelimit-redis-url"), "laputa:")
+		if err != nil {
+			return err
+		}
+		rlimits, err := ratelimit.ApplyOverrides(pds.DefaultRateLimits, cctx.StringSlice("ratelimit"))
+		if err != nil {
+			return err
+		}
+		srv.SetRateLimits(rlstore, rlimits)
+
+		ipx, err := ratelimit.IPExtractor(cctx.StringSlice("trusted-proxy"))
+		if err != nil {
+			return err
+		}
+		srv.SetIPExtractor(ipx)
+
+		if tok := cctx.String("admin-key"); tok != "" {
+			srv.SetAdminToken(tok)
+		}
+
+		invalidations, err := cliutil.OpenInvalidationBus(cctx)
 		if err != nil {
 			return err
 		}
+		defer invalidations.Close()
+		srv.SetInvalidationBus(invalidations)
+
+		if dir := cctx.String("lexicon-dir"); dir != "" {
+			cat := validate.NewCatalog()
+			if err := cat.LoadDirectory(dir); err != nil {
+				return fmt.Errorf("loading lexicons: %w", err)
+			}
+			mode := validate.Lenient
+			if cctx.Bool("strict-validation") {
+				mode = validate.Strict
+			}
+			v := validate.NewValidator(cat, mode)
+			srv.SetRecordValidator(v)
+			srv.SetRequestValidator(v)
+		}
+
+		if rulesFile := cctx.String("rules-file"); rulesFile != "" {
+			engine, err := rules.LoadFile(rulesFile)
+			if err != nil {
+				return fmt.Errorf("loading rules: %w", err)
+			}
+			velocities, err := counters.NewStore(cctx.String("counters-redis-url"), "laputa:counters:")
+			if err != nil {
+				return err
+			}
+			engine.SetCounters(velocities)
+			srv.SetRules(engine)
+		}
+
+		if _, err := cliutil.StartDebugServer(cctx); err != nil {
+			return err
+		}
 
 		return srv.RunAPI(":4989")
 	}
@@ -196,9 +387,18 @@ var generateKeyCmd = &cli.Command{
 			Aliases: []string{"o"},
 			Value:   "data/laputa/server.key",
 		},
+		&cli.StringFlag{
+			Name:  "type",
+			Usage: "key type: p256 or k256",
+			Value: "p256",
+		},
 	},
 	Action: func(cctx *cli.Context) error {
 		fname := cctx.String("output")
-		return cliutil.GenerateKeyToFile(fname)
+		kt, err := keyutil.ParseKeyType(cctx.String("type"))
+		if err != nil {
+			return err
+		}
+		return cliutil.GenerateKeyToFileWithType(fname, kt)
 	},
 }
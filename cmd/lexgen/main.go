@@ -5,6 +5,7 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	lex "github.com/bluesky-social/indigo/lex"
@@ -80,6 +81,14 @@ func main() {
 			Name:  "package",
 			Value: "schemagen",
 		},
+		&cli.StringSliceFlag{
+			Name:  "import",
+			Usage: "Go package for the types of an NSID prefix, as prefix=path (eg com.example=example.com/myapp/api/example). Needed for the prefix being generated, and any others its lexicons refer to",
+		},
+		&cli.BoolFlag{
+			Name:  "gen-cbor",
+			Usage: "also generate CBOR encoders for record types, by building and running a cbor-gen program in the output directory",
+		},
 	}
 	app.Action = func(cctx *cli.Context) error {
 		outdir := cctx.String("outdir")
@@ -110,9 +119,28 @@ func main() {
 			"app.bsky":    "github.com/bluesky-social/indigo/api/bsky",
 			"com.atproto": "github.com/bluesky-social/indigo/api/atproto",
 		}
+		for _, imp := range cctx.StringSlice("import") {
+			nsid, path, ok := strings.Cut(imp, "=")
+			if !ok {
+				return fmt.Errorf("invalid import %q, expected prefix=path", imp)
+			}
+			imports[nsid] = path
+		}
+
+		// longest first, so that the most specific prefix of a lexicon wins
+		var prefixes []string
+		for k := range imports {
+			prefixes = append(prefixes, k)
+		}
+		sort.Slice(prefixes, func(i, j int) bool {
+			if len(prefixes[i]) != len(prefixes[j]) {
+				return len(prefixes[i]) > len(prefixes[j])
+			}
+			return prefixes[i] < prefixes[j]
+		})
 
 		if cctx.Bool("gen-server") {
-			defmap := lex.BuildExtDefMap(schemas, []string{"com.atproto", "app.bsky"})
+			defmap := lex.BuildExtDefMap(schemas, prefixes)
 			_ = defmap
 
 			paths := cctx.StringSlice("types-import")
@@ -129,7 +157,7 @@ func main() {
 			}
 
 		} else {
-			defmap := lex.BuildExtDefMap(schemas, []string{"com.atproto", "app.bsky"})
+			defmap := lex.BuildExtDefMap(schemas, prefixes)
 
 			// Run this twice as a hack to deal with indirect references referencing indirect references.
 			// This part of the codegen needs to be redone
@@ -146,6 +174,18 @@ func main() {
 					return fmt.Errorf("failed to process schema %q: %w", paths[i], err)
 				}
 			}
+
+			if cctx.Bool("gen-cbor") {
+				importPath, ok := imports[prefix]
+				if !ok {
+					return fmt.Errorf("generating cbor encoders needs the import path for %q (--import)", prefix)
+				}
+
+				types := lex.CborTypes(schemas, prefix, defmap)
+				if err := lex.GenCborEncoders(outdir, pkgname, importPath, types); err != nil {
+					return err
+				}
+			}
 		}
 
 		return nil
@@ -7,9 +7,13 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	_ "github.com/joho/godotenv/autoload"
 
+	"github.com/bluesky-social/indigo/api"
+	"github.com/bluesky-social/indigo/did"
+	"github.com/bluesky-social/indigo/events"
 	"github.com/bluesky-social/indigo/search"
 	"github.com/bluesky-social/indigo/util/cliutil"
 
@@ -97,18 +101,40 @@ func run(args []string) error {
 		},
 	}
 
+	app.Flags = append(app.Flags, cliutil.IdentityCacheFlags...)
+	app.Flags = append(app.Flags, cliutil.DatabaseFlags("metadb")...)
+	app.Flags = append(app.Flags, cliutil.AutoMigrateFlag)
+	app.Flags = append(app.Flags, cliutil.CursorStoreFlag)
+	app.Flags = append(app.Flags, cliutil.InvalidationBusFlag)
+	app.Flags = append(app.Flags, cliutil.ShutdownFlags...)
+	app.Flags = append(app.Flags, cliutil.DebugFlags("")...)
+	app.Flags = append(app.Flags, cliutil.LogFlags...)
+	app.Flags = append(app.Flags, cliutil.ConfigFlag)
+	app.Before = func(cctx *cli.Context) error {
+		if err := cliutil.LoadConfig(cctx); err != nil {
+			return err
+		}
+		if err := cliutil.ResolveSecretFlags(cctx, "elastic-password"); err != nil {
+			return err
+		}
+		return cliutil.SetupLogging(cctx)
+	}
+
 	app.Commands = []*cli.Command{
 		elasticCheckCmd,
 		searchCmd,
 		runCmd,
+		cliutil.MigrateCommand(runCmd.Flags, runCmd.Action),
+		cliutil.ConfigCommand,
 	}
 
 	return app.Run(args)
 }
 
 var runCmd = &cli.Command{
-	Name:  "run",
-	Usage: "combined indexing+query server",
+	Name:   "run",
+	Usage:  "combined indexing+query server",
+	Before: cliutil.LoadConfig,
 	Flags: []cli.Flag{
 		&cli.StringFlag{
 			Name: "database-url",
@@ -126,22 +152,63 @@ var runCmd = &cli.Command{
 			Value:   ":3999",
 			EnvVars: []string{"PALOMAR_BIND"},
 		},
+		&cli.StringFlag{
+			Name:    "admin-token",
+			Usage:   "bearer token for the /admin endpoints, which are disabled if unset",
+			EnvVars: []string{"PALOMAR_ADMIN_TOKEN"},
+		},
+		&cli.StringFlag{
+			Name:    "search-backend",
+			Usage:   "where documents are indexed and searched: opensearch, or sqlite for small deployments",
+			Value:   "opensearch",
+			EnvVars: []string{"PALOMAR_SEARCH_BACKEND"},
+		},
+		&cli.StringFlag{
+			Name:    "sqlite-search-path",
+			Usage:   "database file of the sqlite search backend",
+			Value:   "data/palomar/search.sqlite",
+			EnvVars: []string{"PALOMAR_SQLITE_SEARCH_PATH"},
+		},
+		&cli.DurationFlag{
+			Name:    "reconcile-interval",
+			Usage:   "how often to check the status and handle of every indexed account, removing content of inactive ones (0 to disable)",
+			Value:   24 * time.Hour,
+			EnvVars: []string{"PALOMAR_RECONCILE_INTERVAL"},
+		},
+		&cli.BoolFlag{
+			Name:    "verify-signatures",
+			Usage:   "check the signatures of commits from the BGS against their repos' keys, dropping those which fail",
+			EnvVars: []string{"PALOMAR_VERIFY_SIGNATURES"},
+		},
 	},
 	Action: func(cctx *cli.Context) error {
-		db, err := cliutil.SetupDatabase(cctx.String("database-url"), cctx.Int("max-metadb-connections"))
+		db, err := cliutil.SetupDatabaseWithOptions(cctx.String("database-url"), cliutil.DatabaseOptions(cctx, "metadb"))
 		if err != nil {
 			return err
 		}
 
-		escli, err := createEsClient(cctx)
+		if cliutil.MigrateOnly(cctx) {
+			return search.Migrate(db)
+		}
+
+		backend, err := createSearchBackend(cctx)
 		if err != nil {
-			return fmt.Errorf("failed to get elasticsearch: %w", err)
+			return err
+		}
+
+		mr := did.NewMultiResolver()
+		mr.AddHandler("plc", &api.PLCServer{Host: cctx.String("atp-plc-host")})
+		mr.AddHandler("web", &did.WebResolver{})
+
+		dir, err := cliutil.NewIdentityResolver(cctx, mr, &api.ProdHandleResolver{}, "palomar:identity:", 100000)
+		if err != nil {
+			return err
 		}
 
 		srv, err := search.NewServer(
 			db,
-			escli,
-			cctx.String("atp-plc-host"),
+			backend,
+			dir,
 			cctx.String("atp-pds-host"),
 			cctx.String("atp-bgs-host"),
 		)
@@ -149,20 +216,68 @@ var runCmd = &cli.Command{
 			return err
 		}
 
-		go func() {
-			srv.RunAPI(cctx.String("bind"))
-		}()
+		srv.SetAdminToken(cctx.String("admin-token"))
 
-		if cctx.Bool("readonly") {
-			select {}
-		} else {
-			ctx := context.TODO()
-			if err := srv.RunIndexer(ctx); err != nil {
-				return fmt.Errorf("failed to run indexer: %w", err)
+		if cctx.Bool("verify-signatures") {
+			sv, err := events.NewSignatureVerifier(dir, 100000)
+			if err != nil {
+				return err
 			}
+			srv.SetSignatureVerifier(sv)
 		}
 
-		return nil
+		if cctx.IsSet("cursor-store") {
+			cs, err := cliutil.OpenCursorStore(cctx, nil)
+			if err != nil {
+				return err
+			}
+			srv.SetCursorStore(cs)
+		}
+
+		dbg, err := cliutil.StartDebugServer(cctx)
+		if err != nil {
+			return err
+		}
+
+		// the indexer is drained and its cursor saved before the API stops
+		sm := cliutil.NewShutdownManagerFromFlags(cctx)
+		if !cctx.Bool("readonly") {
+			if err := srv.EnsureIndices(cctx.Context); err != nil {
+				return err
+			}
+			sm.Go("indexer", func(ctx context.Context) error {
+				if err := srv.RunIndexer(ctx); err != nil {
+					return fmt.Errorf("failed to run indexer: %w", err)
+				}
+				return nil
+			})
+			if _, ok := backend.(*search.OpenSearchBackend); ok {
+				sm.Go("reindexer", srv.RunReindexer)
+			}
+			if interval := cctx.Duration("reconcile-interval"); interval > 0 {
+				sm.Go("reconciler", func(ctx context.Context) error {
+					return srv.RunReconciler(ctx, interval)
+				})
+			}
+
+			invalidations, err := cliutil.OpenInvalidationBus(cctx)
+			if err != nil {
+				return err
+			}
+			srv.SetInvalidationBus(invalidations)
+			sm.Add("invalidation-bus", func(ctx context.Context) error {
+				return invalidations.Close()
+			})
+		}
+		sm.Add("http", srv.Shutdown)
+		sm.Go("api", func(ctx context.Context) error {
+			return srv.RunAPI(cctx.String("bind"))
+		})
+		if dbg != nil {
+			sm.Add("debug", dbg.Shutdown)
+		}
+
+		return sm.Wait()
 	},
 }
 
@@ -230,6 +345,27 @@ var searchCmd = &cli.Command{
 	},
 }
 
+func createSearchBackend(cctx *cli.Context) (search.Backend, error) {
+	switch b := cctx.String("search-backend"); b {
+	case "opensearch":
+		escli, err := createEsClient(cctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get elasticsearch: %w", err)
+		}
+		return search.NewOpenSearchBackend(escli), nil
+	case "sqlite":
+		// a single connection, as the indexer writes concurrently and
+		// sqlite only takes one writer at a time
+		db, err := cliutil.SetupDatabase("sqlite://"+cctx.String("sqlite-search-path"), 1)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open sqlite search database: %w", err)
+		}
+		return search.NewSQLiteBackend(db), nil
+	default:
+		return nil, fmt.Errorf("unknown search backend %q, expected opensearch or sqlite", b)
+	}
+}
+
 func createEsClient(cctx *cli.Context) (*es.Client, error) {
 
 	addrs := []string{}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/bluesky-social/indigo/socialgraph"
+	"github.com/bluesky-social/indigo/util/cliutil"
+	"github.com/bluesky-social/indigo/util/version"
+	"github.com/urfave/cli/v2"
+
+	_ "github.com/joho/godotenv/autoload"
+	_ "go.uber.org/automaxprocs"
+
+	logging "github.com/ipfs/go-log"
+)
+
+var log = logging.Logger("socialgraph")
+
+func main() {
+	if err := run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(args []string) error {
+
+	app := cli.App{
+		Name:    "socialgraph",
+		Usage:   "atproto social graph service, answering follow and block queries from the firehose",
+		Version: version.Version,
+	}
+
+	app.Flags = []cli.Flag{
+		&cli.StringFlag{
+			Name:    "db-url",
+			Usage:   "database connection string for social graph database",
+			Value:   "sqlite://./data/socialgraph/socialgraph.sqlite",
+			EnvVars: []string{"DATABASE_URL"},
+		},
+		&cli.StringFlag{
+			Name:    "firehose-host",
+			Usage:   "hostname of the relay to index the graph from (ws:// or wss:// URLs are used as given)",
+			Value:   "bsky.network",
+			EnvVars: []string{"SOCIALGRAPH_FIREHOSE_HOST"},
+		},
+		&cli.StringFlag{
+			Name:    "bind",
+			Usage:   "IP or address, and port, to listen on for HTTP APIs",
+			Value:   ":2270",
+			EnvVars: []string{"SOCIALGRAPH_BIND"},
+		},
+	}
+
+	app.Flags = append(app.Flags, cliutil.DatabaseFlags("metadb")...)
+	app.Flags = append(app.Flags, cliutil.AutoMigrateFlag)
+	app.Flags = append(app.Flags, cliutil.ShutdownFlags...)
+	app.Flags = append(app.Flags, cliutil.DebugFlags("")...)
+	app.Flags = append(app.Flags, cliutil.LogFlags...)
+	app.Flags = append(app.Flags, cliutil.ConfigFlag)
+	app.Before = func(cctx *cli.Context) error {
+		if err := cliutil.LoadConfig(cctx); err != nil {
+			return err
+		}
+		return cliutil.SetupLogging(cctx)
+	}
+	app.Commands = []*cli.Command{cliutil.ConfigCommand}
+
+	app.Action = func(cctx *cli.Context) error {
+
+		os.MkdirAll("data/socialgraph", os.ModePerm)
+
+		dburl := cctx.String("db-url")
+		db, err := cliutil.SetupDatabaseWithOptions(dburl, cliutil.DatabaseOptions(cctx, "metadb"))
+		if err != nil {
+			return err
+		}
+
+		g, err := socialgraph.NewGraph(db)
+		if err != nil {
+			return err
+		}
+
+		if cliutil.MigrateOnly(cctx) {
+			return nil
+		}
+
+		firehose := cctx.String("firehose-host")
+		if !strings.Contains(firehose, "://") {
+			firehose = "wss://" + firehose
+		}
+		firehose += "/xrpc/com.atproto.sync.subscribeRepos"
+
+		dbg, err := cliutil.StartDebugServer(cctx)
+		if err != nil {
+			return err
+		}
+
+		srv := socialgraph.NewServer(g)
+
+		sm := cliutil.NewShutdownManagerFromFlags(cctx)
+		sm.Add("socialgraph", srv.Shutdown)
+		sm.Go("api", func(ctx context.Context) error {
+			return srv.RunAPI(cctx.String("bind"))
+		})
+		sm.Go("firehose", func(ctx context.Context) error {
+			return g.Subscribe(ctx, firehose)
+		})
+		if dbg != nil {
+			sm.Add("debug", dbg.Shutdown)
+		}
+
+		return sm.Wait()
+	}
+	app.Commands = append(app.Commands, cliutil.MigrateCommand(nil, app.Action))
+
+	return app.Run(args)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
@@ -12,11 +13,16 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/bluesky-social/indigo/api"
 	"github.com/bluesky-social/indigo/events"
 	"github.com/bluesky-social/indigo/events/schedulers/autoscaling"
+	"github.com/bluesky-social/indigo/identity"
 	"github.com/bluesky-social/indigo/sonar"
+	"github.com/bluesky-social/indigo/util/cliutil"
+	"github.com/bluesky-social/indigo/util/cursorstore"
 	"github.com/bluesky-social/indigo/util/version"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	_ "go.uber.org/automaxprocs"
 	"go.uber.org/zap"
@@ -57,11 +63,54 @@ func main() {
 			Usage: "max number of events to queue",
 			Value: 10,
 		},
+		&cli.StringFlag{
+			Name:    "cursor-store",
+			Usage:   cliutil.CursorStoreFlag.Usage,
+			Value:   "file://sonar_cursors.json",
+			EnvVars: []string{"CURSOR_STORE"},
+		},
 		&cli.StringFlag{
 			Name:  "cursor-file",
-			Usage: "path to cursor file",
+			Usage: "path to the cursor file of older versions of sonar, resumed from if the cursor store has no cursor",
 			Value: "sonar_cursor.json",
 		},
+		&cli.BoolFlag{
+			Name:    "resolve-pds",
+			Usage:   "resolve the PDS host of each repo, for per-PDS event rates",
+			EnvVars: []string{"SONAR_RESOLVE_PDS"},
+		},
+		&cli.StringFlag{
+			Name:    "plc",
+			Usage:   "method, hostname, and port of PLC registry, for resolving PDS hosts",
+			Value:   "https://plc.directory",
+			EnvVars: []string{"ATP_PLC_HOST"},
+		},
+		&cli.IntFlag{
+			Name:  "identity-cache-size",
+			Usage: "number of DID documents to cache, for resolving PDS hosts",
+			Value: 1_000_000,
+		},
+		&cli.IntFlag{
+			Name:  "max-metric-values",
+			Usage: "max number of collections or PDS hosts with event rate metrics",
+			Value: 100,
+		},
+		&cli.StringFlag{
+			Name:    "sample-dir",
+			Usage:   "directory to write parquet files of sampled events to (disabled if empty)",
+			EnvVars: []string{"SONAR_SAMPLE_DIR"},
+		},
+		&cli.Float64Flag{
+			Name:    "sample-rate",
+			Usage:   "fraction of events to sample, from 0 to 1",
+			Value:   0.01,
+			EnvVars: []string{"SONAR_SAMPLE_RATE"},
+		},
+		&cli.IntFlag{
+			Name:  "sample-rows-per-file",
+			Usage: "number of sampled ops to write to each parquet file",
+			Value: 100_000,
+		},
 	}
 
 	app.Action = Sonar
@@ -102,11 +151,46 @@ func Sonar(cctx *cli.Context) error {
 		log.Fatalf("failed to parse ws-url: %+v", err)
 	}
 
-	s, err := sonar.NewSonar(log, cctx.String("cursor-file"), u.String())
+	cursorStore, err := cliutil.OpenCursorStore(cctx, nil)
+	if err != nil {
+		log.Fatalf("failed to open cursor store: %+v", err)
+	}
+	defer cursorStore.Close()
+	cursors := cursorstore.NewTracker(cursorStore, "sonar/"+u.Host)
+
+	s, err := sonar.NewSonar(ctx, log, cursors, u.String())
 	if err != nil {
 		log.Fatalf("failed to create sonar: %+v", err)
 	}
 
+	if s.Progress.LastSeq < 0 {
+		if p, err := sonar.ReadCursorFile(cctx.String("cursor-file")); err == nil && p.LastSeq >= 0 {
+			log.Infof("resuming from cursor file %s", cctx.String("cursor-file"))
+			s.Progress.LastSeq = p.LastSeq
+		}
+	}
+
+	s.Stats.MaxMetricValues = cctx.Int("max-metric-values")
+	prometheus.MustRegister(s.Stats)
+
+	if cctx.Bool("resolve-pds") {
+		s.Resolver = identity.NewResolver(cliutil.GetDidResolver(cctx), &api.ProdHandleResolver{}, identity.NewMemCache(cctx.Int("identity-cache-size")))
+	}
+
+	if dir := cctx.String("sample-dir"); dir != "" {
+		sampler, err := sonar.NewSampler(dir, cctx.Float64("sample-rate"), cctx.Int("sample-rows-per-file"))
+		if err != nil {
+			log.Fatalf("failed to create sampler: %+v", err)
+		}
+		s.Sampler = sampler
+		defer func() {
+			if err := sampler.Close(); err != nil {
+				log.Errorf("failed to close sampler: %+v", err)
+			}
+		}()
+		log.Infof("writing %.2f%% of events to %s", sampler.Rate*100, dir)
+	}
+
 	wg := sync.WaitGroup{}
 
 	scalingSettings := autoscaling.DefaultAutoscaleSettings()
@@ -115,34 +199,11 @@ func Sonar(cctx *cli.Context) error {
 
 	pool := autoscaling.NewScheduler(scalingSettings, u.Host, s.HandleStreamEvent)
 
-	// Start a goroutine to manage the cursor file, saving the current cursor every 5 seconds.
+	// Start a goroutine to save the current cursor every 5 seconds, and on shutdown.
+	wg.Add(1)
 	go func() {
-		wg.Add(1)
 		defer wg.Done()
-		ticker := time.NewTicker(5 * time.Second)
-		rawlog, err := zap.NewProduction()
-		if err != nil {
-			log.Fatalf("failed to create logger: %+v", err)
-		}
-		log := rawlog.Sugar().With("source", "cursor_file_manager")
-
-		for {
-			select {
-			case <-ctx.Done():
-				log.Info("shutting down cursor file manager")
-				err := s.WriteCursorFile()
-				if err != nil {
-					log.Errorf("failed to write cursor file: %+v", err)
-				}
-				log.Info("cursor file manager shut down successfully")
-				return
-			case <-ticker.C:
-				err := s.WriteCursorFile()
-				if err != nil {
-					log.Errorf("failed to write cursor file: %+v", err)
-				}
-			}
-		}
+		cursors.Run(ctx, 5*time.Second)
 	}()
 
 	// Start a goroutine to manage the liveness checker, shutting down if no events are received for 15 seconds
@@ -180,6 +241,12 @@ func Sonar(cctx *cli.Context) error {
 
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(s.Stats.Snapshot(time.Now())); err != nil {
+			log.Errorf("failed to write stats: %+v", err)
+		}
+	})
 
 	metricServer := &http.Server{
 		Addr:    fmt.Sprintf(":%d", cctx.Int("port")),
@@ -355,6 +355,9 @@ func Reload(cctx *cli.Context) error {
 				case evt.RepoTombstone != nil:
 					header.MsgType = "#tombstone"
 					obj = evt.RepoTombstone
+				case evt.RepoAccount != nil:
+					header.MsgType = "#account"
+					obj = evt.RepoAccount
 				default:
 					log.Errorf("unrecognized event kind")
 					continue
@@ -4,17 +4,38 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 	"unicode"
 
 	"github.com/whyrusleeping/go-did"
 	"go.opentelemetry.io/otel"
 )
 
+// maxWebDocumentSize bounds how much of a did:web document is read
+const maxWebDocumentSize = 64 << 10
+
 type WebResolver struct {
+	// Insecure fetches documents over plain http, and allows ports and bare
+	// hostnames like localhost, for testing
 	Insecure bool
-	// TODO: cache? maybe at a different layer
+
+	// AllowPaths allows DIDs with path segments (did:web:example.com:user:alice),
+	// which the W3C spec permits but atproto does not
+	AllowPaths bool
+
+	// Client is used to fetch documents, defaulting to a client with a short
+	// timeout. Cache documents by wrapping the resolver in an
+	// identity.Resolver.
+	Client *http.Client
+}
+
+var defaultWebClient = &http.Client{
+	Timeout: 10 * time.Second,
 }
 
 func (wr *WebResolver) GetDocument(ctx context.Context, didstr string) (*Document, error) {
@@ -26,17 +47,27 @@ func (wr *WebResolver) GetDocument(ctx context.Context, didstr string) (*Documen
 		return nil, err
 	}
 
-	val := pdid.Value()
-	if err := checkValidDidWeb(val); err != nil {
+	if pdid.Protocol() != "web" {
+		return nil, fmt.Errorf("not a did:web: %q", didstr)
+	}
+
+	u, err := wr.documentURL(pdid.Value())
+	if err != nil {
 		return nil, err
 	}
 
-	proto := "https"
-	if wr.Insecure {
-		proto = "http"
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
 	}
+	req.Header.Set("Accept", "application/did+json, application/json")
 
-	resp, err := http.Get(proto + "://" + val + "/.well-known/did.json")
+	c := wr.Client
+	if c == nil {
+		c = defaultWebClient
+	}
+
+	resp, err := c.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -47,13 +78,69 @@ func (wr *WebResolver) GetDocument(ctx context.Context, didstr string) (*Documen
 	}
 
 	var out did.Document
-	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
-		return nil, err
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxWebDocumentSize)).Decode(&out); err != nil {
+		return nil, fmt.Errorf("decoding did document from %s: %w", u, err)
+	}
+
+	// a document served for some other DID must not be used for this one
+	if out.ID.String() != didstr {
+		return nil, fmt.Errorf("did document from %s is for %q, not %q", u, out.ID.String(), didstr)
 	}
 
 	return &out, nil
 }
 
+// documentURL finds where the document for a did:web lives. The first
+// segment of the DID is the host, with any port percent-encoded
+// (did:web:localhost%3A8080), and any further segments are a path which
+// replaces /.well-known.
+func (wr *WebResolver) documentURL(val string) (string, error) {
+	segments := strings.Split(val, ":")
+
+	host, err := url.PathUnescape(segments[0])
+	if err != nil {
+		return "", fmt.Errorf("invalid did:web host: %w", err)
+	}
+
+	hostname, port, hasPort := strings.Cut(host, ":")
+	if hasPort {
+		if !wr.Insecure {
+			return "", fmt.Errorf("did:web resolver does not handle ports")
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return "", fmt.Errorf("invalid did:web port %q", port)
+		}
+	}
+
+	if !(wr.Insecure && hostname == "localhost") {
+		if err := checkValidDidWeb(hostname); err != nil {
+			return "", err
+		}
+	}
+
+	path := "/.well-known"
+	if len(segments) > 1 {
+		if !wr.AllowPaths {
+			return "", fmt.Errorf("did:web resolver does not handle documents at sub-paths")
+		}
+
+		for _, seg := range segments[1:] {
+			p, err := url.PathUnescape(seg)
+			if err != nil || p == "" || p == "." || p == ".." || strings.Contains(p, "/") {
+				return "", fmt.Errorf("invalid did:web path segment %q", seg)
+			}
+		}
+		path = "/" + strings.Join(segments[1:], "/")
+	}
+
+	proto := "https"
+	if wr.Insecure {
+		proto = "http"
+	}
+
+	return proto + "://" + host + path + "/did.json", nil
+}
+
 var disallowedTlds = map[string]bool{
 	"example":  true,
 	"invalid":  true,
@@ -65,8 +152,8 @@ var disallowedTlds = map[string]bool{
 
 func checkValidDidWeb(val string) error {
 	// no ports or ipv6
-	if strings.Contains(val, ":") {
-		return fmt.Errorf("did:web resolver does not handle ports or documents at sub-paths")
+	if strings.Contains(val, ":") || val == "" {
+		return fmt.Errorf("invalid did:web hostname %q", val)
 	}
 	// no trailing '.'
 	if strings.HasSuffix(val, ".") {
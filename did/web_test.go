@@ -0,0 +1,76 @@
+package did
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebDocumentURL(t *testing.T) {
+	secure := &WebResolver{}
+	insecure := &WebResolver{Insecure: true, AllowPaths: true}
+
+	for _, tc := range []struct {
+		res *WebResolver
+		val string
+		url string
+	}{
+		{secure, "example.com", "https://example.com/.well-known/did.json"},
+		{secure, "sub.example.co.uk", "https://sub.example.co.uk/.well-known/did.json"},
+		{insecure, "localhost%3A8080", "http://localhost:8080/.well-known/did.json"},
+		{insecure, "example.com:user:alice", "http://example.com/user/alice/did.json"},
+		{secure, "localhost%3A8080", ""},
+		{secure, "localhost", ""},
+		{secure, "example.com:user:alice", ""},
+		{secure, "example.local", ""},
+		{secure, "192.168.0.1", ""},
+		{insecure, "localhost%3Aabc", ""},
+		{insecure, "example.com:..", ""},
+	} {
+		u, err := tc.res.documentURL(tc.val)
+		if tc.url == "" {
+			if err == nil {
+				t.Errorf("expected %q to be rejected, got %s", tc.val, u)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tc.val, err)
+		} else if u != tc.url {
+			t.Errorf("%s: expected %s, got %s", tc.val, tc.url, u)
+		}
+	}
+}
+
+func TestWebGetDocument(t *testing.T) {
+	var served string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/did.json" {
+			w.WriteHeader(404)
+			return
+		}
+		fmt.Fprintf(w, `{"id": %q, "alsoKnownAs": ["at://alice.test"]}`, served)
+	}))
+	defer srv.Close()
+
+	didstr := "did:web:" + strings.Replace(strings.TrimPrefix(srv.URL, "http://127.0.0.1"), ":", "localhost%3A", 1)
+	wr := &WebResolver{Insecure: true}
+	ctx := context.Background()
+
+	served = didstr
+	doc, err := wr.GetDocument(ctx, didstr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.AlsoKnownAs) != 1 || doc.AlsoKnownAs[0] != "at://alice.test" {
+		t.Fatalf("unexpected document: %+v", doc)
+	}
+
+	served = "did:web:someone.else"
+	if _, err := wr.GetDocument(ctx, didstr); err == nil {
+		t.Fatal("expected document for another DID to be rejected")
+	}
+}
@@ -0,0 +1,407 @@
+package events
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	label "github.com/bluesky-social/indigo/api/label"
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/util/aturi"
+	"github.com/bluesky-social/indigo/util/serviceauth"
+	"github.com/bluesky-social/indigo/util/xrpcerr"
+
+	"gorm.io/gorm"
+)
+
+// ErrInvalidPolicy is returned, wrapped, by SetPolicy for policies which
+// can't be applied
+var ErrInvalidPolicy = errors.New("invalid subscription policy")
+
+// SubscriptionPolicy limits what a stream subscriber is sent
+type SubscriptionPolicy struct {
+	// Collections, if set, limits commits to those with an op in one of these
+	// collections, and labels to those on records in them. Entries ending in
+	// ".*" match every collection under them.
+	Collections []string `json:"collections,omitempty"`
+
+	// Repos, if set, limits events to those of these repos, and labels to
+	// those on these accounts and their records
+	Repos []string `json:"repos,omitempty"`
+
+	// BandwidthCap, if set, is the most bytes per second the subscriber is
+	// sent, in place of the server's default
+	BandwidthCap *int64 `json:"bandwidthCap,omitempty"`
+
+	// ReplayDepth, if set, is how many events behind the latest a cursor may
+	// be. Subscribers asking for older events are sent from there instead.
+	ReplayDepth *int64 `json:"replayDepth,omitempty"`
+}
+
+// ParseSubscriptionPolicy parses a policy from its JSON form, as configured
+// on the command line
+func ParseSubscriptionPolicy(s string) (*SubscriptionPolicy, error) {
+	var p SubscriptionPolicy
+	if err := json.Unmarshal([]byte(s), &p); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidPolicy, err)
+	}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (p *SubscriptionPolicy) validate() error {
+	for _, c := range p.Collections {
+		if c == "" || strings.Contains(c, ",") {
+			return fmt.Errorf("%w: invalid collection %q", ErrInvalidPolicy, c)
+		}
+	}
+	for _, r := range p.Repos {
+		if !strings.HasPrefix(r, "did:") || strings.Contains(r, ",") {
+			return fmt.Errorf("%w: invalid repo %q", ErrInvalidPolicy, r)
+		}
+	}
+	if p.BandwidthCap != nil && *p.BandwidthCap < 0 {
+		return fmt.Errorf("%w: bandwidth cap must not be negative", ErrInvalidPolicy)
+	}
+	if p.ReplayDepth != nil && *p.ReplayDepth < 0 {
+		return fmt.Errorf("%w: replay depth must not be negative", ErrInvalidPolicy)
+	}
+	return nil
+}
+
+func policyFromModel(m *models.SubscriberPolicy) *SubscriptionPolicy {
+	return &SubscriptionPolicy{
+		Collections:  splitList(m.Collections),
+		Repos:        splitList(m.Repos),
+		BandwidthCap: m.BandwidthCap,
+		ReplayDepth:  m.ReplayDepth,
+	}
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func collectionMatches(patterns []string, nsid string) bool {
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(nsid, prefix) {
+				return true
+			}
+		} else if p == nsid {
+			return true
+		}
+	}
+	return false
+}
+
+func repoMatches(repos []string, did string) bool {
+	for _, r := range repos {
+		if r == did {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter returns the event as the subscriber should be sent it, or nil if
+// it shouldn't be sent at all. Label events are sent with only the labels
+// the policy allows.
+func (p *SubscriptionPolicy) Filter(evt *XRPCStreamEvent) *XRPCStreamEvent {
+	if p == nil || (len(p.Collections) == 0 && len(p.Repos) == 0) {
+		return evt
+	}
+
+	switch {
+	case evt.RepoCommit != nil:
+		if len(p.Collections) > 0 && !p.commitMatches(evt.RepoCommit) {
+			return nil
+		}
+	case evt.LabelLabels != nil:
+		return filterLabels(evt, p.labelMatches)
+	}
+
+	did := evt.Repo()
+	if did == "" {
+		// info and error frames are for every subscriber
+		return evt
+	}
+	if len(p.Repos) > 0 && !repoMatches(p.Repos, did) {
+		return nil
+	}
+	return evt
+}
+
+func (p *SubscriptionPolicy) commitMatches(evt *comatproto.SyncSubscribeRepos_Commit) bool {
+	for _, op := range evt.Ops {
+		coll, _, _ := strings.Cut(op.Path, "/")
+		if collectionMatches(p.Collections, coll) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *SubscriptionPolicy) labelMatches(did, coll string) bool {
+	if len(p.Repos) > 0 && !repoMatches(p.Repos, did) {
+		return false
+	}
+	if len(p.Collections) > 0 {
+		if coll == "" || !collectionMatches(p.Collections, coll) {
+			return false
+		}
+	}
+	return true
+}
+
+// filterLabels returns a label event with only the labels whose subjects
+// match, which are given the subject's DID and, for records, collection, or
+// nil if none do
+func filterLabels(evt *XRPCStreamEvent, match func(did, coll string) bool) *XRPCStreamEvent {
+	var keep []*label.Label
+	for _, l := range evt.LabelLabels.Labels {
+		// subjects are either an account's DID or a record's at:// uri
+		did, coll := l.Uri, ""
+		if u, err := aturi.Parse(l.Uri); err == nil {
+			did, coll = u.Authority, u.Collection
+		}
+		if match(did, coll) {
+			keep = append(keep, l)
+		}
+	}
+
+	if len(keep) == 0 {
+		return nil
+	}
+	if len(keep) == len(evt.LabelLabels.Labels) {
+		return evt
+	}
+
+	out := *evt.LabelLabels
+	out.Labels = keep
+	return &XRPCStreamEvent{LabelLabels: &out}
+}
+
+// Cursor returns the cursor a subscriber asking for since should be sent
+// events from, given the latest event's sequence number, and whether it was
+// moved forward to the policy's replay depth
+func (p *SubscriptionPolicy) Cursor(since *int64, last int64) (*int64, bool) {
+	if p == nil || p.ReplayDepth == nil || since == nil || last-*since <= *p.ReplayDepth {
+		return since, false
+	}
+
+	c := last - *p.ReplayDepth
+	if c < 0 {
+		c = 0
+	}
+	return &c, true
+}
+
+// SubscriberDB keeps the tokens and policies of stream subscribers
+type SubscriberDB struct {
+	db *gorm.DB
+}
+
+// NewSubscriberDB returns a SubscriberDB on db, which must have been
+// migrated with the models.SubscriberToken and models.SubscriberPolicy tables
+func NewSubscriberDB(db *gorm.DB) *SubscriberDB {
+	return &SubscriberDB{db: db}
+}
+
+// LookupToken returns the name of the subscriber with a token, or "" if
+// there is none
+func (sd *SubscriberDB) LookupToken(ctx context.Context, tok string) (string, error) {
+	var st models.SubscriberToken
+	if err := sd.db.WithContext(ctx).Find(&st, "token = ?", tok).Error; err != nil {
+		return "", err
+	}
+
+	return st.Name, nil
+}
+
+// CreateToken creates a token for a subscriber to authenticate with,
+// replacing any it had before
+func (sd *SubscriberDB) CreateToken(ctx context.Context, name string) (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	tok := base64.RawURLEncoding.EncodeToString(buf)
+
+	st := models.SubscriberToken{Name: name}
+	if err := sd.db.WithContext(ctx).Unscoped().Where(models.SubscriberToken{Name: name}).Assign(models.SubscriberToken{Token: tok}).FirstOrCreate(&st).Error; err != nil {
+		return "", err
+	}
+
+	return tok, nil
+}
+
+// Policy returns the policy of a subscriber, or nil if it has none
+func (sd *SubscriberDB) Policy(ctx context.Context, subscriber string) (*SubscriptionPolicy, error) {
+	var sp models.SubscriberPolicy
+	if err := sd.db.WithContext(ctx).Find(&sp, "subscriber = ?", subscriber).Error; err != nil {
+		return nil, err
+	}
+	if sp.ID == 0 {
+		return nil, nil
+	}
+
+	return policyFromModel(&sp), nil
+}
+
+// Policies returns the policy of every subscriber which has one
+func (sd *SubscriberDB) Policies(ctx context.Context) (map[string]*SubscriptionPolicy, error) {
+	var sps []models.SubscriberPolicy
+	if err := sd.db.WithContext(ctx).Find(&sps).Error; err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]*SubscriptionPolicy, len(sps))
+	for i := range sps {
+		out[sps[i].Subscriber] = policyFromModel(&sps[i])
+	}
+	return out, nil
+}
+
+// HasPolicies reports whether any subscriber has a policy
+func (sd *SubscriberDB) HasPolicies(ctx context.Context) (bool, error) {
+	var n int64
+	if err := sd.db.WithContext(ctx).Model(&models.SubscriberPolicy{}).Limit(1).Count(&n).Error; err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// SetPolicy sets the policy of a subscriber, or removes it if p is nil. It
+// applies to the subscriber's next connections.
+func (sd *SubscriberDB) SetPolicy(ctx context.Context, subscriber string, p *SubscriptionPolicy) error {
+	if p == nil {
+		return sd.db.WithContext(ctx).Where("subscriber = ?", subscriber).Delete(&models.SubscriberPolicy{}).Error
+	}
+
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	sp := models.SubscriberPolicy{Subscriber: subscriber}
+	return sd.db.WithContext(ctx).Where(models.SubscriberPolicy{Subscriber: subscriber}).Assign(map[string]any{
+		"collections":   strings.Join(p.Collections, ","),
+		"repos":         strings.Join(p.Repos, ","),
+		"bandwidth_cap": p.BandwidthCap,
+		"replay_depth":  p.ReplayDepth,
+	}).FirstOrCreate(&sp).Error
+}
+
+// SubscriptionAuth authenticates the subscribers of a stream, who may send a
+// token from Subscribers or a service auth token (see
+// com.atproto.server.getServiceAuth) as a bearer token
+type SubscriptionAuth struct {
+	Subscribers *SubscriberDB
+
+	// ServiceAuth, if set, accepts service auth tokens, with subscribers
+	// known by the DID they are issued by. As any account can get one,
+	// those without a policy of their own are treated as anonymous.
+	ServiceAuth *serviceauth.Validator
+
+	// RequireAuth refuses subscribers which don't authenticate, or only
+	// authenticate with service auth and have no policy
+	RequireAuth bool
+
+	// Anonymous is the policy of subscribers which don't authenticate. If
+	// it is nil they are refused once any subscriber has a policy, as not
+	// authenticating would otherwise be a way around it.
+	Anonymous *SubscriptionPolicy
+}
+
+// Authenticate checks the Authorization header of a subscription to lxm,
+// returning who the subscriber is and its policy, or "" for subscribers which
+// don't authenticate. Errors are xrpcerr errors to send to the subscriber.
+func (sa *SubscriptionAuth) Authenticate(ctx context.Context, authz, lxm string) (string, *SubscriptionPolicy, error) {
+	if authz == "" {
+		p, err := sa.anonymousPolicy(ctx)
+		return "", p, err
+	}
+
+	tok, ok := strings.CutPrefix(authz, "Bearer ")
+	if !ok {
+		return "", nil, xrpcerr.AuthRequired("subscriber token must be a bearer token")
+	}
+
+	var subscriber string
+	var viaServiceAuth bool
+	if strings.Count(tok, ".") == 2 {
+		// tokens from Subscribers never have dots, JWTs always do
+		if sa.ServiceAuth == nil {
+			return "", nil, xrpcerr.AuthRequired("service auth is not accepted")
+		}
+		claims, err := sa.ServiceAuth.Validate(ctx, tok, lxm)
+		if err != nil {
+			log.Warnw("rejected subscriber service auth token", "lxm", lxm, "err", err)
+			return "", nil, xrpcerr.AuthRequired("invalid service auth token")
+		}
+		subscriber, _, _ = strings.Cut(claims.Iss, "#")
+		viaServiceAuth = true
+	} else {
+		if sa.Subscribers == nil {
+			return "", nil, xrpcerr.AuthRequired("subscriber tokens are not accepted")
+		}
+		name, err := sa.Subscribers.LookupToken(ctx, tok)
+		if err != nil {
+			return "", nil, err
+		}
+		if name == "" {
+			return "", nil, xrpcerr.AuthRequired("invalid subscriber token")
+		}
+		subscriber = "token:" + name
+	}
+
+	var p *SubscriptionPolicy
+	if sa.Subscribers != nil {
+		sp, err := sa.Subscribers.Policy(ctx, subscriber)
+		if err != nil {
+			return "", nil, err
+		}
+		p = sp
+	}
+	if p == nil && viaServiceAuth {
+		// anyone can get a service auth token, so it alone is no better
+		// than not authenticating
+		ap, err := sa.anonymousPolicy(ctx)
+		if err != nil {
+			return "", nil, err
+		}
+		return subscriber, ap, nil
+	}
+	return subscriber, p, nil
+}
+
+// anonymousPolicy is the policy of subscribers which don't authenticate, or
+// which can't be told apart from them, refusing them if they aren't allowed
+func (sa *SubscriptionAuth) anonymousPolicy(ctx context.Context) (*SubscriptionPolicy, error) {
+	if sa.RequireAuth {
+		return nil, xrpcerr.AuthRequired("this stream requires authentication")
+	}
+	if sa.Anonymous != nil {
+		return sa.Anonymous, nil
+	}
+	if sa.Subscribers != nil {
+		restricted, err := sa.Subscribers.HasPolicies(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if restricted {
+			return nil, xrpcerr.AuthRequired("this stream requires authentication")
+		}
+	}
+	return nil, nil
+}
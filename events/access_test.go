@@ -0,0 +1,209 @@
+package events_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	atproto "github.com/bluesky-social/indigo/api/atproto"
+	label "github.com/bluesky-social/indigo/api/label"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/util/serviceauth"
+	"github.com/bluesky-social/indigo/util/xrpcerr"
+
+	"github.com/stretchr/testify/assert"
+	godid "github.com/whyrusleeping/go-did"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func commitEvent(repo string, paths ...string) *events.XRPCStreamEvent {
+	evt := &atproto.SyncSubscribeRepos_Commit{Repo: repo}
+	for _, p := range paths {
+		evt.Ops = append(evt.Ops, &atproto.SyncSubscribeRepos_RepoOp{Action: "create", Path: p})
+	}
+	return &events.XRPCStreamEvent{RepoCommit: evt}
+}
+
+func TestSubscriptionPolicyFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	var none *events.SubscriptionPolicy
+	evt := commitEvent("did:plc:alice", "app.bsky.feed.post/1")
+	assert.Equal(evt, none.Filter(evt))
+
+	p := &events.SubscriptionPolicy{Collections: []string{"app.bsky.feed.*", "app.bsky.graph.follow"}}
+	assert.NotNil(p.Filter(commitEvent("did:plc:alice", "app.bsky.actor.profile/self", "app.bsky.feed.like/1")))
+	assert.NotNil(p.Filter(commitEvent("did:plc:alice", "app.bsky.graph.follow/1")))
+	assert.Nil(p.Filter(commitEvent("did:plc:alice", "app.bsky.graph.block/1")))
+	assert.NotNil(p.Filter(&events.XRPCStreamEvent{RepoHandle: &atproto.SyncSubscribeRepos_Handle{Did: "did:plc:alice"}}))
+
+	p = &events.SubscriptionPolicy{Repos: []string{"did:plc:alice"}}
+	assert.NotNil(p.Filter(commitEvent("did:plc:alice", "app.bsky.graph.block/1")))
+	assert.Nil(p.Filter(commitEvent("did:plc:bob", "app.bsky.graph.block/1")))
+	assert.Nil(p.Filter(&events.XRPCStreamEvent{RepoTombstone: &atproto.SyncSubscribeRepos_Tombstone{Did: "did:plc:bob"}}))
+	assert.NotNil(p.Filter(&events.XRPCStreamEvent{RepoInfo: &atproto.SyncSubscribeRepos_Info{Name: "OutdatedCursor"}}))
+
+	// label events are trimmed to the labels the policy allows
+	p = &events.SubscriptionPolicy{Repos: []string{"did:plc:alice"}, Collections: []string{"app.bsky.feed.post"}}
+	labels := &events.XRPCStreamEvent{LabelLabels: &label.SubscribeLabels_Labels{Seq: 3, Labels: []*label.Label{
+		{Uri: "at://did:plc:alice/app.bsky.feed.post/1", Val: "spam"},
+		{Uri: "at://did:plc:bob/app.bsky.feed.post/1", Val: "spam"},
+		{Uri: "did:plc:alice", Val: "spam"},
+	}}}
+	out := p.Filter(labels)
+	if assert.NotNil(out) && assert.Len(out.LabelLabels.Labels, 1) {
+		assert.Equal("at://did:plc:alice/app.bsky.feed.post/1", out.LabelLabels.Labels[0].Uri)
+		assert.Equal(int64(3), out.LabelLabels.Seq)
+	}
+	assert.Len(labels.LabelLabels.Labels, 3, "the event itself shouldn't be changed")
+}
+
+func TestSubscriptionPolicyCursor(t *testing.T) {
+	assert := assert.New(t)
+
+	depth := int64(100)
+	p := &events.SubscriptionPolicy{ReplayDepth: &depth}
+
+	since := int64(950)
+	c, moved := p.Cursor(&since, 1000)
+	assert.Equal(since, *c)
+	assert.False(moved)
+
+	since = 10
+	c, moved = p.Cursor(&since, 1000)
+	assert.Equal(int64(900), *c)
+	assert.True(moved)
+
+	c, moved = p.Cursor(nil, 1000)
+	assert.Nil(c)
+	assert.False(moved)
+
+	var none *events.SubscriptionPolicy
+	c, moved = none.Cursor(&since, 1000)
+	assert.Equal(since, *c)
+	assert.False(moved)
+}
+
+func testSubscriberDB(t *testing.T) *events.SubscriberDB {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "subs.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(models.SubscriberToken{}, models.SubscriberPolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	return events.NewSubscriberDB(db)
+}
+
+func TestSubscriptionAuth(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	sd := testSubscriberDB(t)
+
+	const lxm = "com.atproto.sync.subscribeRepos"
+
+	key, doc := testKey(t)
+	sa := &events.SubscriptionAuth{
+		Subscribers: sd,
+		ServiceAuth: &serviceauth.Validator{
+			Dir:        &testResolver{docs: map[string]*godid.Document{"did:plc:alice": doc}},
+			ServiceDID: "did:web:bgs.test",
+			RequireLxm: true,
+		},
+	}
+
+	// anonymous subscribers have no policy
+	sub, p, err := sa.Authenticate(ctx, "", lxm)
+	assert.NoError(err)
+	assert.Equal("", sub)
+	assert.Nil(p)
+
+	tok, err := sd.CreateToken(ctx, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bwCap := int64(1 << 20)
+	assert.NoError(sd.SetPolicy(ctx, "token:acme", &events.SubscriptionPolicy{
+		Collections:  []string{"app.bsky.feed.post"},
+		BandwidthCap: &bwCap,
+	}))
+
+	sub, p, err = sa.Authenticate(ctx, "Bearer "+tok, lxm)
+	assert.NoError(err)
+	assert.Equal("token:acme", sub)
+	if assert.NotNil(p) {
+		assert.Equal([]string{"app.bsky.feed.post"}, p.Collections)
+		assert.Equal(bwCap, *p.BandwidthCap)
+		assert.Nil(p.Repos)
+	}
+
+	// once there are policies, not authenticating can't be a way around
+	// them
+	_, _, err = sa.Authenticate(ctx, "", lxm)
+	assert.ErrorIs(err, xrpcerr.AuthRequired(""))
+
+	sa.Anonymous = &events.SubscriptionPolicy{Repos: []string{"did:plc:public"}}
+	sub, p, err = sa.Authenticate(ctx, "", lxm)
+	assert.NoError(err)
+	assert.Equal("", sub)
+	assert.Equal(sa.Anonymous, p)
+
+	// a new token replaces the old one
+	if _, err := sd.CreateToken(ctx, "acme"); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = sa.Authenticate(ctx, "Bearer "+tok, lxm)
+	assert.ErrorIs(err, xrpcerr.AuthRequired(""))
+
+	jwt, err := serviceauth.CreateToken(key, "did:plc:alice", "did:web:bgs.test", lxm, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// any account can get a service auth token, so without a policy of
+	// their own they are anonymous
+	sub, p, err = sa.Authenticate(ctx, "Bearer "+jwt, lxm)
+	assert.NoError(err)
+	assert.Equal("did:plc:alice", sub)
+	assert.Equal(sa.Anonymous, p)
+
+	anon := sa.Anonymous
+	sa.Anonymous = nil
+	_, _, err = sa.Authenticate(ctx, "Bearer "+jwt, lxm)
+	assert.ErrorIs(err, xrpcerr.AuthRequired(""))
+
+	assert.NoError(sd.SetPolicy(ctx, "did:plc:alice", &events.SubscriptionPolicy{Collections: []string{"app.bsky.graph.follow"}}))
+	sub, p, err = sa.Authenticate(ctx, "Bearer "+jwt, lxm)
+	assert.NoError(err)
+	assert.Equal("did:plc:alice", sub)
+	if assert.NotNil(p) {
+		assert.Equal([]string{"app.bsky.graph.follow"}, p.Collections)
+	}
+	assert.NoError(sd.SetPolicy(ctx, "did:plc:alice", nil))
+	sa.Anonymous = anon
+
+	// service auth tokens are bound to the stream they are for
+	_, _, err = sa.Authenticate(ctx, "Bearer "+jwt, "com.atproto.label.subscribeLabels")
+	assert.Error(err)
+
+	serviceAuth := sa.ServiceAuth
+	sa.ServiceAuth = nil
+	_, _, err = sa.Authenticate(ctx, "Bearer "+jwt, lxm)
+	assert.Error(err)
+
+	sa.RequireAuth = true
+	_, _, err = sa.Authenticate(ctx, "", lxm)
+	assert.Error(err)
+	sa.ServiceAuth = serviceAuth
+	_, _, err = sa.Authenticate(ctx, "Bearer "+jwt, lxm)
+	assert.ErrorIs(err, xrpcerr.AuthRequired(""))
+
+	assert.ErrorIs(sd.SetPolicy(ctx, "token:acme", &events.SubscriptionPolicy{Repos: []string{"alice"}}), events.ErrInvalidPolicy)
+	assert.NoError(sd.SetPolicy(ctx, "token:acme", nil))
+	policies, err := sd.Policies(ctx)
+	assert.NoError(err)
+	assert.Empty(policies)
+}
@@ -0,0 +1,263 @@
+package events
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+// SubscriberIdleTimeout is how long the usage of a subscriber without any
+// connections is kept, after which its totals start again from zero
+var SubscriberIdleTimeout = 24 * time.Hour
+
+// BandwidthTracker accounts for the events and bytes sent to each subscriber
+// of a stream, across all of their connections, and caps the rate they are
+// sent at. Subscribers are whatever the server identifies them by, such as
+// their IP and user agent or the name of the token they authenticated with.
+type BandwidthTracker struct {
+	lk         sync.Mutex
+	defaultCap int64
+	caps       map[string]int64
+	policyCaps map[string]int64
+	subs       map[string]*SubscriberUsage
+	lastPrune  time.Time
+}
+
+// SubscriberUsage is the usage of one subscriber, shared by its connections
+type SubscriberUsage struct {
+	subscriber string
+
+	events atomic.Int64
+	bytes  atomic.Int64
+
+	// conns and idleSince are guarded by the tracker's lock
+	conns     int
+	idleSince time.Time
+
+	// limiter is nil for subscribers without a cap
+	limiter atomic.Pointer[rate.Limiter]
+
+	eventsCounter prometheus.Counter
+	bytesCounter  prometheus.Counter
+}
+
+// SubscriberStats is a snapshot of the usage of a subscriber
+type SubscriberStats struct {
+	Subscriber  string `json:"subscriber"`
+	Connections int    `json:"connections"`
+	EventsSent  int64  `json:"events_sent"`
+	BytesSent   int64  `json:"bytes_sent"`
+
+	// Cap is the most bytes per second the subscriber is sent, or zero
+	Cap int64 `json:"cap"`
+}
+
+// NewBandwidthTracker returns a tracker capping subscribers to defaultCap
+// bytes per second, unless set otherwise for them. Zero means no cap.
+func NewBandwidthTracker(defaultCap int64) *BandwidthTracker {
+	return &BandwidthTracker{
+		defaultCap: defaultCap,
+		caps:       make(map[string]int64),
+		policyCaps: make(map[string]int64),
+		subs:       make(map[string]*SubscriberUsage),
+		lastPrune:  time.Now(),
+	}
+}
+
+// Connect returns the usage of a subscriber for a new connection, to count
+// what is sent on it. The returned function must be called once the
+// connection is closed.
+func (bt *BandwidthTracker) Connect(subscriber string) (*SubscriberUsage, func()) {
+	bt.lk.Lock()
+	defer bt.lk.Unlock()
+
+	if time.Since(bt.lastPrune) > time.Minute {
+		bt.pruneIdle()
+	}
+
+	su, ok := bt.subs[subscriber]
+	if !ok {
+		su = &SubscriberUsage{
+			subscriber:    subscriber,
+			eventsCounter: subscriberEventsSent.WithLabelValues(subscriber),
+			bytesCounter:  subscriberBytesSent.WithLabelValues(subscriber),
+		}
+		su.setCap(bt.capFor(subscriber))
+		bt.subs[subscriber] = su
+	}
+	su.conns++
+
+	var once sync.Once
+	return su, func() {
+		once.Do(func() {
+			bt.lk.Lock()
+			defer bt.lk.Unlock()
+			su.conns--
+			if su.conns == 0 {
+				su.idleSince = time.Now()
+			}
+		})
+	}
+}
+
+func (bt *BandwidthTracker) pruneIdle() {
+	for k, su := range bt.subs {
+		if su.conns == 0 && time.Since(su.idleSince) > SubscriberIdleTimeout {
+			delete(bt.subs, k)
+			subscriberEventsSent.DeleteLabelValues(k)
+			subscriberBytesSent.DeleteLabelValues(k)
+		}
+	}
+	bt.lastPrune = time.Now()
+}
+
+func (bt *BandwidthTracker) capFor(subscriber string) int64 {
+	if c, ok := bt.caps[subscriber]; ok {
+		return c
+	}
+	if c, ok := bt.policyCaps[subscriber]; ok {
+		return c
+	}
+	return bt.defaultCap
+}
+
+// SetDefaultCap sets the cap of subscribers which don't have their own, in
+// bytes per second. Zero means no cap.
+func (bt *BandwidthTracker) SetDefaultCap(bytesPerSec int64) {
+	bt.lk.Lock()
+	defer bt.lk.Unlock()
+
+	bt.defaultCap = bytesPerSec
+	for k, su := range bt.subs {
+		su.setCap(bt.capFor(k))
+	}
+}
+
+// SetCap sets the cap of a subscriber, in bytes per second, or has it use the
+// default cap if bytesPerSec is nil. Zero means no cap. It applies to the
+// subscriber's open connections straight away.
+func (bt *BandwidthTracker) SetCap(subscriber string, bytesPerSec *int64) {
+	bt.lk.Lock()
+	defer bt.lk.Unlock()
+
+	if bytesPerSec == nil {
+		delete(bt.caps, subscriber)
+	} else {
+		bt.caps[subscriber] = *bytesPerSec
+	}
+
+	if su, ok := bt.subs[subscriber]; ok {
+		su.setCap(bt.capFor(subscriber))
+	}
+}
+
+// SetPolicyCap sets the cap a subscriber's policy gives it, in bytes per
+// second, or none if bytesPerSec is nil. It is used in place of the default
+// cap, but not of one set with SetCap.
+func (bt *BandwidthTracker) SetPolicyCap(subscriber string, bytesPerSec *int64) {
+	bt.lk.Lock()
+	defer bt.lk.Unlock()
+
+	if bytesPerSec == nil {
+		delete(bt.policyCaps, subscriber)
+	} else {
+		bt.policyCaps[subscriber] = *bytesPerSec
+	}
+
+	if su, ok := bt.subs[subscriber]; ok {
+		su.setCap(bt.capFor(subscriber))
+	}
+}
+
+// Usage returns the usage of every subscriber seen recently, busiest first
+func (bt *BandwidthTracker) Usage() []SubscriberStats {
+	bt.lk.Lock()
+	defer bt.lk.Unlock()
+
+	out := make([]SubscriberStats, 0, len(bt.subs))
+	for k, su := range bt.subs {
+		out = append(out, SubscriberStats{
+			Subscriber:  k,
+			Connections: su.conns,
+			EventsSent:  su.events.Load(),
+			BytesSent:   su.bytes.Load(),
+			Cap:         bt.capFor(k),
+		})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].BytesSent != out[j].BytesSent {
+			return out[i].BytesSent > out[j].BytesSent
+		}
+		return out[i].Subscriber < out[j].Subscriber
+	})
+	return out
+}
+
+func (su *SubscriberUsage) setCap(bytesPerSec int64) {
+	if bytesPerSec <= 0 {
+		su.limiter.Store(nil)
+		return
+	}
+
+	// a second's worth of burst, so that a subscriber which has kept up can
+	// take a burst of events straight away
+	if l := su.limiter.Load(); l != nil {
+		l.SetLimit(rate.Limit(bytesPerSec))
+		l.SetBurst(int(bytesPerSec))
+		return
+	}
+	su.limiter.Store(rate.NewLimiter(rate.Limit(bytesPerSec), int(bytesPerSec)))
+}
+
+// Subscriber returns who the usage is of
+func (su *SubscriberUsage) Subscriber() string {
+	return su.subscriber
+}
+
+// Sent counts an event of n bytes sent to the subscriber, and then waits
+// for as long as it takes the subscriber to be under its cap again, or for
+// ctx to be done
+func (su *SubscriberUsage) Sent(ctx context.Context, n int) error {
+	su.events.Add(1)
+	su.bytes.Add(int64(n))
+	su.eventsCounter.Inc()
+	su.bytesCounter.Add(float64(n))
+
+	l := su.limiter.Load()
+	if l == nil {
+		return nil
+	}
+
+	// events larger than the burst are waited for a burst at a time
+	for n > 0 {
+		chunk := n
+		if b := l.Burst(); chunk > b {
+			chunk = b
+		}
+		if err := l.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// CountingWriter counts the bytes written through it, for measuring what is
+// sent to subscribers
+type CountingWriter struct {
+	W io.Writer
+	N int
+}
+
+func (cw *CountingWriter) Write(b []byte) (int, error) {
+	n, err := cw.W.Write(b)
+	cw.N += n
+	return n, err
+}
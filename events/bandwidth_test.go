@@ -0,0 +1,78 @@
+package events_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBandwidthTracker(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	bt := events.NewBandwidthTracker(0)
+
+	a1, done1 := bt.Connect("alice")
+	a2, done2 := bt.Connect("alice")
+	b, doneB := bt.Connect("bob")
+	defer doneB()
+
+	assert.NoError(a1.Sent(ctx, 100))
+	assert.NoError(a2.Sent(ctx, 50))
+	assert.NoError(b.Sent(ctx, 10))
+
+	usage := bt.Usage()
+	assert.Equal([]events.SubscriberStats{
+		{Subscriber: "alice", Connections: 2, EventsSent: 2, BytesSent: 150},
+		{Subscriber: "bob", Connections: 1, EventsSent: 1, BytesSent: 10},
+	}, usage)
+
+	// totals carry on across connections
+	done1()
+	done1()
+	done2()
+	a3, done3 := bt.Connect("alice")
+	defer done3()
+	assert.NoError(a3.Sent(ctx, 1))
+	assert.Equal(int64(151), bt.Usage()[0].BytesSent)
+	assert.Equal(1, bt.Usage()[0].Connections)
+}
+
+func TestBandwidthTrackerCaps(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	bt := events.NewBandwidthTracker(1000)
+	su, done := bt.Connect("alice")
+	defer done()
+
+	// the first second's worth goes straight out
+	start := time.Now()
+	assert.NoError(su.Sent(ctx, 1000))
+	assert.Less(time.Since(start), 100*time.Millisecond)
+
+	// and then the subscriber is held back
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	assert.Error(su.Sent(tctx, 500))
+
+	// lifting the cap applies to the open connection
+	var none int64
+	bt.SetCap("alice", &none)
+	start = time.Now()
+	assert.NoError(su.Sent(ctx, 1<<20))
+	assert.Less(time.Since(start), 100*time.Millisecond)
+
+	bt.SetCap("alice", nil)
+	other, doneOther := bt.Connect("bob")
+	defer doneOther()
+	for _, s := range bt.Usage() {
+		assert.Equal(int64(1000), s.Cap, s.Subscriber)
+	}
+
+	// events larger than the cap are still sent, slowly
+	assert.NoError(other.Sent(ctx, 1010))
+}
@@ -0,0 +1,111 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// latencyBuckets is how many buckets a BatchSizer's histogram has, doubling
+// from a microsecond, so that the last is for anything above ~8s
+const latencyBuckets = 24
+
+// latencyDecayAt is how many observations the histogram holds before every
+// bucket is halved, so that it follows the database as its load changes
+const latencyDecayAt = 256
+
+// BatchSizer picks how many events to write to the database at once, from a
+// histogram of how long each event has taken to write in recent flushes. Its
+// size is how many events a flush can write within the target latency, so
+// that a queue building up in a burst of commits is written in transactions
+// as large as the database can take, rather than in many small ones falling
+// further behind, or in ones too large to keep up with the stream.
+type BatchSizer struct {
+	lk sync.Mutex
+
+	min    int
+	max    int
+	target time.Duration
+
+	size    int
+	buckets [latencyBuckets]float64
+	count   float64
+}
+
+func NewBatchSizer(min, max int, target time.Duration) *BatchSizer {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	return &BatchSizer{
+		min:    min,
+		max:    max,
+		target: target,
+		size:   min,
+	}
+}
+
+// Size returns how many queued events should be flushed together
+func (bs *BatchSizer) Size() int {
+	bs.lk.Lock()
+	defer bs.lk.Unlock()
+	return bs.size
+}
+
+// Observe records a flush of n events taking d, and returns the new size
+func (bs *BatchSizer) Observe(n int, d time.Duration) int {
+	bs.lk.Lock()
+	defer bs.lk.Unlock()
+
+	if n <= 0 {
+		return bs.size
+	}
+
+	if bs.count >= latencyDecayAt {
+		for i := range bs.buckets {
+			bs.buckets[i] /= 2
+		}
+		bs.count /= 2
+	}
+	bs.buckets[latencyBucket(d/time.Duration(n))]++
+	bs.count++
+
+	size := bs.max
+	if perEvent := bs.percentile(0.9); perEvent > 0 {
+		if fits := int(bs.target / perEvent); fits < size {
+			size = fits
+		}
+	}
+	if size < bs.min {
+		size = bs.min
+	}
+	if size > bs.max {
+		size = bs.max
+	}
+
+	bs.size = size
+	return size
+}
+
+// percentile returns the upper bound of the bucket holding the given
+// fraction of observations
+func (bs *BatchSizer) percentile(p float64) time.Duration {
+	var seen float64
+	for i, c := range bs.buckets {
+		seen += c
+		if seen >= p*bs.count {
+			return time.Microsecond << i
+		}
+	}
+	return time.Microsecond << (latencyBuckets - 1)
+}
+
+func latencyBucket(d time.Duration) int {
+	for i := 0; i < latencyBuckets-1; i++ {
+		if d <= time.Microsecond<<i {
+			return i
+		}
+	}
+	return latencyBuckets - 1
+}
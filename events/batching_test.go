@@ -0,0 +1,40 @@
+package events_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/events"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchSizer(t *testing.T) {
+	assert := assert.New(t)
+
+	bs := events.NewBatchSizer(10, 500, 50*time.Millisecond)
+	assert.Equal(10, bs.Size())
+
+	// a fast database takes the largest batches
+	for i := 0; i < 20; i++ {
+		bs.Observe(100, time.Millisecond)
+	}
+	assert.Equal(500, bs.Size())
+
+	// as it slows down, batches shrink to fit the target
+	for i := 0; i < 1000; i++ {
+		bs.Observe(100, 100*time.Millisecond)
+	}
+	size := bs.Size()
+	assert.Less(size, 100)
+	assert.GreaterOrEqual(size, 10)
+
+	// and never below the minimum
+	for i := 0; i < 1000; i++ {
+		bs.Observe(10, time.Second)
+	}
+	assert.Equal(10, bs.Size())
+
+	// empty flushes aren't counted
+	assert.Equal(10, bs.Observe(0, time.Hour))
+}
@@ -20,6 +20,7 @@ type RepoStreamCallbacks struct {
 	RepoInfo      func(evt *comatproto.SyncSubscribeRepos_Info) error
 	RepoMigrate   func(evt *comatproto.SyncSubscribeRepos_Migrate) error
 	RepoTombstone func(evt *comatproto.SyncSubscribeRepos_Tombstone) error
+	RepoAccount   func(evt *comatproto.SyncSubscribeRepos_Account) error
 	LabelLabels   func(evt *label.SubscribeLabels_Labels) error
 	LabelInfo     func(evt *label.SubscribeLabels_Info) error
 	Error         func(evt *ErrorFrame) error
@@ -37,6 +38,8 @@ func (rsc *RepoStreamCallbacks) EventHandler(ctx context.Context, xev *XRPCStrea
 		return rsc.RepoMigrate(xev.RepoMigrate)
 	case xev.RepoTombstone != nil && rsc.RepoTombstone != nil:
 		return rsc.RepoTombstone(xev.RepoTombstone)
+	case xev.RepoAccount != nil && rsc.RepoAccount != nil:
+		return rsc.RepoAccount(xev.RepoAccount)
 	case xev.LabelLabels != nil && rsc.LabelLabels != nil:
 		return rsc.LabelLabels(xev.LabelLabels)
 	case xev.LabelInfo != nil && rsc.LabelInfo != nil:
@@ -60,6 +63,12 @@ func (sr *instrumentedReader) Read(p []byte) (int, error) {
 	return n, err
 }
 
+// CloseWebsocket sends a close frame with the given code and reason, as a
+// connection should before being closed
+func CloseWebsocket(con *websocket.Conn, code int, reason string) error {
+	return con.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second*5))
+}
+
 func HandleRepoStream(ctx context.Context, con *websocket.Conn, sched Scheduler) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -78,6 +87,9 @@ func HandleRepoStream(ctx context.Context, con *websocket.Conn, sched Scheduler)
 					log.Warnf("failed to ping: %s", err)
 				}
 			case <-ctx.Done():
+				if err := CloseWebsocket(con, websocket.CloseNormalClosure, ""); err != nil {
+					log.Debugf("failed to send close frame: %s", err)
+				}
 				con.Close()
 				return
 			}
@@ -206,7 +218,23 @@ func HandleRepoStream(ctx context.Context, con *websocket.Conn, sched Scheduler)
 				}); err != nil {
 					return err
 				}
-			case "#labebatch":
+			case "#account":
+				var evt comatproto.SyncSubscribeRepos_Account
+				if err := evt.UnmarshalCBOR(r); err != nil {
+					return err
+				}
+
+				if evt.Seq < lastSeq {
+					log.Errorf("Got events out of order from stream (seq = %d, prev = %d)", evt.Seq, lastSeq)
+				}
+				lastSeq = evt.Seq
+
+				if err := sched.AddWork(ctx, evt.Did, &XRPCStreamEvent{
+					RepoAccount: &evt,
+				}); err != nil {
+					return err
+				}
+			case "#labels", "#labebatch":
 				var evt label.SubscribeLabels_Labels
 				if err := evt.UnmarshalCBOR(r); err != nil {
 					return fmt.Errorf("reading Labels event: %w", err)
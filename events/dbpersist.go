@@ -33,6 +33,11 @@ type Options struct {
 	DIDCacheSize         int
 	PlaybackBatchSize    int
 	HydrationConcurrency int
+
+	// TargetFlushLatency, if set, has batches sized to be flushed within it,
+	// between MinBatchSize and MaxBatchSize, rather than flushed once they
+	// reach MinBatchSize
+	TargetFlushLatency time.Duration
 }
 
 func DefaultOptions() *Options {
@@ -59,6 +64,7 @@ type DbPersistence struct {
 
 	batch        []*PersistenceBatchItem
 	batchOptions Options
+	batchSizer   *BatchSizer
 	lastFlush    time.Time
 
 	uidCache *lru.ARCCache
@@ -85,6 +91,18 @@ func NewDbPersistence(db *gorm.DB, cs *carstore.CarStore, options *Options) (*Db
 		return nil, err
 	}
 
+	p, err := newDbPersistence(db, cs, options)
+	if err != nil {
+		return nil, err
+	}
+
+	go p.batchFlusher()
+
+	return p, nil
+}
+
+// newDbPersistence sets up a DbPersistence without starting to flush batches
+func newDbPersistence(db *gorm.DB, cs *carstore.CarStore, options *Options) (*DbPersistence, error) {
 	if options == nil {
 		options = DefaultOptions()
 	}
@@ -107,8 +125,10 @@ func NewDbPersistence(db *gorm.DB, cs *carstore.CarStore, options *Options) (*Db
 		uidCache:     uidCache,
 		didCache:     didCache,
 	}
-
-	go p.batchFlusher()
+	if options.TargetFlushLatency > 0 {
+		p.batchSizer = NewBatchSizer(options.MinBatchSize, options.MaxBatchSize, options.TargetFlushLatency)
+		dbBatchTargetSize.Set(float64(p.batchSizer.Size()))
+	}
 
 	return &p, nil
 }
@@ -117,17 +137,26 @@ func (p *DbPersistence) batchFlusher() {
 	for {
 		time.Sleep(p.batchOptions.CheckBatchInterval)
 
-		p.lk.Lock()
-		needsFlush := len(p.batch) > 0 &&
-			(len(p.batch) >= p.batchOptions.MinBatchSize ||
-				time.Since(p.lastFlush) >= p.batchOptions.MaxTimeBetweenFlush)
-		p.lk.Unlock()
+		minSize := p.batchOptions.MinBatchSize
+		if p.batchSizer != nil {
+			minSize = p.batchSizer.Size()
+		}
 
-		if needsFlush {
-			if err := p.Flush(context.Background()); err != nil {
+		p.lk.Lock()
+		var reason string
+		switch {
+		case len(p.batch) == 0:
+		case len(p.batch) >= minSize:
+			reason = "size"
+		case time.Since(p.lastFlush) >= p.batchOptions.MaxTimeBetweenFlush:
+			reason = "interval"
+		}
+		if reason != "" {
+			if err := p.flushBatchLocked(context.Background(), reason); err != nil {
 				log.Errorf("failed to flush batch: %s", err)
 			}
 		}
+		p.lk.Unlock()
 	}
 }
 
@@ -138,10 +167,12 @@ func (p *DbPersistence) SetEventBroadcaster(brc func(*XRPCStreamEvent)) {
 func (p *DbPersistence) Flush(ctx context.Context) error {
 	p.lk.Lock()
 	defer p.lk.Unlock()
-	return p.flushBatchLocked(ctx)
+	return p.flushBatchLocked(ctx, "explicit")
 }
 
-func (p *DbPersistence) flushBatchLocked(ctx context.Context) error {
+// flushBatchLocked writes out the batch, recording why it was flushed in the
+// batch metrics
+func (p *DbPersistence) flushBatchLocked(ctx context.Context, reason string) error {
 	// TODO: we technically don't need to hold the lock through the database
 	// operation, all we need to do is swap the batch out, and ensure nobody
 	// else tries to enter this function to flush another batch while we are
@@ -152,9 +183,17 @@ func (p *DbPersistence) flushBatchLocked(ctx context.Context) error {
 		records[i] = item.Record
 	}
 
+	start := time.Now()
 	if err := p.db.CreateInBatches(records, 50).Error; err != nil {
 		return fmt.Errorf("failed to create records: %w", err)
 	}
+	took := time.Since(start)
+
+	dbBatchFlushes.WithLabelValues(reason).Observe(float64(len(records)))
+	dbBatchFlushDuration.WithLabelValues(reason).Observe(took.Seconds())
+	if p.batchSizer != nil {
+		dbBatchTargetSize.Set(float64(p.batchSizer.Observe(len(records), took)))
+	}
 
 	for i, item := range records {
 		e := p.batch[i].Event
@@ -171,6 +210,7 @@ func (p *DbPersistence) flushBatchLocked(ctx context.Context) error {
 
 	p.batch = []*PersistenceBatchItem{}
 	p.lastFlush = time.Now()
+	dbBatchQueueDepth.Set(0)
 
 	return nil
 }
@@ -182,11 +222,18 @@ func (p *DbPersistence) AddItemToBatch(ctx context.Context, rec *RepoEventRecord
 		Record: rec,
 		Event:  evt,
 	})
+	dbBatchQueueDepth.Set(float64(len(p.batch)))
 
 	if len(p.batch) >= p.batchOptions.MaxBatchSize {
-		if err := p.flushBatchLocked(ctx); err != nil {
+		if err := p.flushBatchLocked(ctx, "full"); err != nil {
 			return fmt.Errorf("failed to flush batch at max size: %w", err)
 		}
+	} else if p.batchSizer != nil && len(p.batch) >= p.batchSizer.Size() {
+		// the queue is as deep as can be flushed within the target latency,
+		// so flushing now rather than at the next check keeps up with bursts
+		if err := p.flushBatchLocked(ctx, "size"); err != nil {
+			return fmt.Errorf("failed to flush batch at adaptive size: %w", err)
+		}
 	}
 
 	return nil
@@ -541,6 +588,12 @@ func (p *DbPersistence) RebaseRepoEvents(ctx context.Context, usr models.Uid) er
 	return p.deleteAllEventsForUser(ctx, usr)
 }
 
-func (p *DbPersistence) Shutdown(context.Context) error {
-	return nil
+func (p *DbPersistence) Shutdown(ctx context.Context) error {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	if len(p.batch) == 0 {
+		return nil
+	}
+	return p.flushBatchLocked(ctx, "shutdown")
 }
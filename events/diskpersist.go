@@ -485,6 +485,13 @@ func (p *DiskPersistence) uidForDid(ctx context.Context, did string) (models.Uid
 	return u.Uid, nil
 }
 
+// LastSeq returns the sequence number of the last event persisted
+func (p *DiskPersistence) LastSeq() int64 {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	return p.curSeq - 1
+}
+
 func (p *DiskPersistence) Playback(ctx context.Context, since int64, cb func(*XRPCStreamEvent) error) error {
 	base := since - (since % p.eventsPerFile)
 	var logs []LogFileRef
@@ -597,6 +604,11 @@ func (p *DiskPersistence) TakeDownRepo(ctx context.Context, usr models.Uid) erro
 		}
 	*/
 
+	// events still in the buffer would be written out after the takedown
+	if err := p.Flush(ctx); err != nil {
+		return err
+	}
+
 	return p.forEachShardWithUserEvents(ctx, usr, func(ctx context.Context, fn string) error {
 		if err := p.deleteEventsForUser(ctx, usr, fn); err != nil {
 			return err
@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	comatproto "github.com/bluesky-social/indigo/api/atproto"
 	label "github.com/bluesky-social/indigo/api/label"
@@ -29,12 +31,22 @@ type EventManager struct {
 	bufferSize int
 
 	persister EventPersistence
+
+	// lastSeq is the highest sequence number broadcast
+	lastSeq atomic.Int64
+
+	// closed by CloseSubscribers, with active counting the subscriptions
+	// still open
+	closing   chan struct{}
+	closeOnce sync.Once
+	active    sync.WaitGroup
 }
 
 func NewEventManager(persister EventPersistence) *EventManager {
 	em := &EventManager{
 		bufferSize: 32 << 10,
 		persister:  persister,
+		closing:    make(chan struct{}),
 	}
 
 	persister.SetEventBroadcaster(em.broadcastEvent)
@@ -54,20 +66,57 @@ type Operation struct {
 	evt *XRPCStreamEvent
 }
 
+// Shutdown flushes and closes the event persister. Subscribers should be
+// closed with CloseSubscribers first.
 func (em *EventManager) Shutdown(ctx context.Context) error {
 	return em.persister.Shutdown(ctx)
 }
 
+// Closing returns a channel which is closed when CloseSubscribers is called.
+// Subscription handlers should close their connection to the client, with
+// CloseWebsocket, and cancel their subscription once it is.
+func (em *EventManager) Closing() <-chan struct{} {
+	return em.closing
+}
+
+// CloseSubscribers asks every subscription handler to close its connection,
+// and waits for all subscriptions to be cancelled or for ctx to be done
+func (em *EventManager) CloseSubscribers(ctx context.Context) error {
+	em.closeOnce.Do(func() {
+		close(em.closing)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		em.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for subscribers to close: %w", ctx.Err())
+	}
+}
+
 func (em *EventManager) broadcastEvent(evt *XRPCStreamEvent) {
 	em.subsLk.Lock()
 	defer em.subsLk.Unlock()
 
+	if seq := evt.Sequence(); seq > em.lastSeq.Load() {
+		em.lastSeq.Store(seq)
+	}
+
 	// TODO: for a larger fanout we should probably have dedicated goroutines
 	// for subsets of the subscriber set, and tiered channels to distribute
 	// events out to them, or some similar architecture
 	// Alternatively, we might just want to not allow too many subscribers
 	// directly to the bgs, and have rebroadcasting proxies instead
 	for _, s := range em.subs {
+		if seq := evt.Sequence(); seq >= 0 && seq <= s.lastSeq {
+			continue
+		}
 		if s.filter(evt) {
 			s.enqueuedCounter.Inc()
 			select {
@@ -84,6 +133,15 @@ func (em *EventManager) broadcastEvent(evt *XRPCStreamEvent) {
 	}
 }
 
+// LastSeq returns the sequence number of the latest event, as known to the
+// persister if it keeps track, or else the latest broadcast since starting
+func (em *EventManager) LastSeq() int64 {
+	if p, ok := em.persister.(interface{ LastSeq() int64 }); ok {
+		return p.LastSeq()
+	}
+	return em.lastSeq.Load()
+}
+
 func (em *EventManager) persistAndSendEvent(ctx context.Context, evt *XRPCStreamEvent) {
 	if err := em.persister.Persist(ctx, evt); err != nil {
 		log.Errorf("failed to persist outbound event: %s", err)
@@ -97,6 +155,10 @@ type Subscriber struct {
 
 	done chan struct{}
 
+	// lastSeq is the last event sent by playback. Broadcast events up to it
+	// are dropped, as the subscriber already has them.
+	lastSeq int64
+
 	ident            string
 	enqueuedCounter  prometheus.Counter
 	broadcastCounter prometheus.Counter
@@ -119,6 +181,7 @@ type XRPCStreamEvent struct {
 	RepoInfo      *comatproto.SyncSubscribeRepos_Info
 	RepoMigrate   *comatproto.SyncSubscribeRepos_Migrate
 	RepoTombstone *comatproto.SyncSubscribeRepos_Tombstone
+	RepoAccount   *comatproto.SyncSubscribeRepos_Account
 	LabelLabels   *label.SubscribeLabels_Labels
 	LabelInfo     *label.SubscribeLabels_Info
 
@@ -128,6 +191,72 @@ type XRPCStreamEvent struct {
 	PrivRelevantPds []uint     `json:"-" cborgen:"-"`
 }
 
+// Sequence returns the sequence number of the event, or -1 for events which
+// don't have one
+func (evt *XRPCStreamEvent) Sequence() int64 {
+	switch {
+	case evt.RepoCommit != nil:
+		return evt.RepoCommit.Seq
+	case evt.RepoHandle != nil:
+		return evt.RepoHandle.Seq
+	case evt.RepoMigrate != nil:
+		return evt.RepoMigrate.Seq
+	case evt.RepoTombstone != nil:
+		return evt.RepoTombstone.Seq
+	case evt.RepoAccount != nil:
+		return evt.RepoAccount.Seq
+	case evt.LabelLabels != nil:
+		return evt.LabelLabels.Seq
+	default:
+		return -1
+	}
+}
+
+// Time returns when the event was emitted, from its time field, or the zero
+// time for events without one
+func (evt *XRPCStreamEvent) Time() time.Time {
+	var ts string
+	switch {
+	case evt.RepoCommit != nil:
+		ts = evt.RepoCommit.Time
+	case evt.RepoHandle != nil:
+		ts = evt.RepoHandle.Time
+	case evt.RepoMigrate != nil:
+		ts = evt.RepoMigrate.Time
+	case evt.RepoTombstone != nil:
+		ts = evt.RepoTombstone.Time
+	case evt.RepoAccount != nil:
+		ts = evt.RepoAccount.Time
+	default:
+		return time.Time{}
+	}
+
+	t, err := time.Parse(time.RFC3339, ts)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// Repo returns the DID of the repo the event is about, or "" for events
+// which aren't about a single repo, such as info frames and labels
+func (evt *XRPCStreamEvent) Repo() string {
+	switch {
+	case evt.RepoCommit != nil:
+		return evt.RepoCommit.Repo
+	case evt.RepoHandle != nil:
+		return evt.RepoHandle.Did
+	case evt.RepoMigrate != nil:
+		return evt.RepoMigrate.Did
+	case evt.RepoTombstone != nil:
+		return evt.RepoTombstone.Did
+	case evt.RepoAccount != nil:
+		return evt.RepoAccount.Did
+	default:
+		return ""
+	}
+}
+
 type ErrorFrame struct {
 	Error   string `cborgen:"error"`
 	Message string `cborgen:"message"`
@@ -148,23 +277,30 @@ func (em *EventManager) Subscribe(ctx context.Context, ident string, filter func
 		filter = func(*XRPCStreamEvent) bool { return true }
 	}
 
+	em.active.Add(1)
+
 	done := make(chan struct{})
 	sub := &Subscriber{
 		ident:            ident,
 		outgoing:         make(chan *XRPCStreamEvent, em.bufferSize),
 		filter:           filter,
 		done:             done,
+		lastSeq:          -1,
 		enqueuedCounter:  eventsEnqueued.WithLabelValues(ident),
 		broadcastCounter: eventsBroadcast.WithLabelValues(ident),
 	}
 
 	go func() {
 		if since != nil {
+			sub.lastSeq = *since
 			if err := em.persister.Playback(ctx, *since, func(e *XRPCStreamEvent) error {
 				select {
 				case <-done:
 					return ErrPlaybackShutdown
 				case sub.outgoing <- e:
+					if seq := e.Sequence(); seq > sub.lastSeq {
+						sub.lastSeq = seq
+					}
 					return nil
 				}
 			}); err != nil {
@@ -186,9 +322,13 @@ func (em *EventManager) Subscribe(ctx context.Context, ident string, filter func
 		em.addSubscriber(sub)
 	}()
 
+	var cleanupOnce sync.Once
 	cleanup := func() {
-		close(done)
-		em.rmSubscriber(sub)
+		cleanupOnce.Do(func() {
+			close(done)
+			em.rmSubscriber(sub)
+			em.active.Done()
+		})
 	}
 
 	return sub.outgoing, cleanup, nil
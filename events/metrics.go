@@ -24,3 +24,65 @@ var eventsBroadcast = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "indigo_events_broadcast_total",
 	Help: "Total number of events broadcast to subscribers",
 }, []string{"pool"})
+
+var replicaSeq = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "indigo_replica_last_seq",
+	Help: "Sequence number of the last event a read replica has broadcast",
+})
+
+var replicaPollErrors = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "indigo_replica_poll_errors_total",
+	Help: "Total number of failed polls of a read replica for new events",
+})
+
+var subscriptionsConnected = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "indigo_subscription_connected",
+	Help: "Whether a stream subscription is connected to its host",
+}, []string{"host"})
+
+var subscriptionDisconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "indigo_subscription_disconnects_total",
+	Help: "Total number of failed connections of stream subscriptions, by reason",
+}, []string{"host", "reason"})
+
+var commitSignatureChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "indigo_commit_signature_checks_total",
+	Help: "Total number of commit signatures checked by consumers, by result",
+}, []string{"result"})
+
+var subscriberEventsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "indigo_subscriber_events_sent_total",
+	Help: "Total number of events sent to each stream subscriber",
+}, []string{"subscriber"})
+
+var subscriberBytesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "indigo_subscriber_bytes_sent_total",
+	Help: "Total bytes of events sent to each stream subscriber",
+}, []string{"subscriber"})
+
+var postgresEventsPersisted = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "indigo_postgres_events_persisted_total",
+	Help: "Total number of events persisted to postgres and announced with NOTIFY",
+})
+
+var dbBatchFlushes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "indigo_db_persist_flush_batch_size",
+	Help:    "Number of events in each batch flushed to the database, by why it was flushed",
+	Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+}, []string{"reason"})
+
+var dbBatchFlushDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "indigo_db_persist_flush_duration_seconds",
+	Help:    "How long batches of events take to flush to the database, by why they were flushed",
+	Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+}, []string{"reason"})
+
+var dbBatchQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "indigo_db_persist_queue_depth",
+	Help: "Number of events waiting to be flushed to the database",
+})
+
+var dbBatchTargetSize = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "indigo_db_persist_batch_target_size",
+	Help: "Number of queued events the adaptive batching flushes at",
+})
@@ -48,6 +48,8 @@ func (mp *MemPersister) Persist(ctx context.Context, e *XRPCStreamEvent) error {
 		e.RepoMigrate.Seq = mp.seq
 	case e.RepoTombstone != nil:
 		e.RepoTombstone.Seq = mp.seq
+	case e.RepoAccount != nil:
+		e.RepoAccount.Seq = mp.seq
 	case e.LabelLabels != nil:
 		e.LabelLabels.Seq = mp.seq
 	default:
@@ -60,6 +62,13 @@ func (mp *MemPersister) Persist(ctx context.Context, e *XRPCStreamEvent) error {
 	return nil
 }
 
+// LastSeq returns the sequence number of the last event persisted
+func (mp *MemPersister) LastSeq() int64 {
+	mp.lk.Lock()
+	defer mp.lk.Unlock()
+	return mp.seq
+}
+
 func (mp *MemPersister) Playback(ctx context.Context, since int64, cb func(*XRPCStreamEvent) error) error {
 	mp.lk.Lock()
 	l := len(mp.buf)
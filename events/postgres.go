@@ -0,0 +1,449 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	label "github.com/bluesky-social/indigo/api/label"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/models"
+
+	"github.com/jackc/pgx/v5"
+	"gorm.io/gorm"
+)
+
+// DefaultPostgresChannel is the channel new events are announced on, with
+// NOTIFY, unless configured otherwise
+const DefaultPostgresChannel = "indigo_events"
+
+// PostgresEventRecord is an event as PostgresPersistence stores it: the CBOR
+// of the event as it is sent to subscribers, with the sequence number left
+// out, as it is the row's
+type PostgresEventRecord struct {
+	Seq  int64      `gorm:"primarykey"`
+	Kind string     // the event's message type, eg #commit
+	Repo string     `gorm:"index"`
+	Uid  models.Uid `gorm:"index"`
+	Time time.Time
+	Data []byte
+}
+
+// PostgresPersistence persists events, complete with their blocks, to a
+// Postgres table, and announces each with NOTIFY, so that consumers in other
+// processes can follow them with a PostgresSubscription without a connection
+// to the producer, its carstore or a message broker. It's meant for small
+// deployments, where the database is already shared: every event is a write.
+type PostgresPersistence struct {
+	db      *gorm.DB
+	channel string
+	// lockID is the advisory lock taken while an event is written, so that
+	// events are numbered and committed in the same order, and consumers
+	// reading past the last event they saw never miss one committed late
+	lockID int64
+
+	broadcast func(*XRPCStreamEvent)
+
+	lk  sync.Mutex
+	seq int64
+}
+
+// NewPostgresPersistence creates the events table in db if needed, and
+// announces new events on channel, or DefaultPostgresChannel if it's empty
+func NewPostgresPersistence(ctx context.Context, db *gorm.DB, channel string) (*PostgresPersistence, error) {
+	if db.Dialector.Name() != "postgres" {
+		return nil, fmt.Errorf("postgres event persistence needs a postgres database, not %s", db.Dialector.Name())
+	}
+	if err := db.AutoMigrate(&PostgresEventRecord{}); err != nil {
+		return nil, err
+	}
+	if channel == "" {
+		channel = DefaultPostgresChannel
+	}
+
+	var seq int64
+	if err := db.WithContext(ctx).Model(&PostgresEventRecord{}).Select("coalesce(max(seq), 0)").Scan(&seq).Error; err != nil {
+		return nil, fmt.Errorf("finding the last event: %w", err)
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte("indigo events " + channel))
+
+	return &PostgresPersistence{
+		db:      db,
+		channel: channel,
+		lockID:  int64(h.Sum64()),
+		seq:     seq,
+	}, nil
+}
+
+func (p *PostgresPersistence) Persist(ctx context.Context, e *XRPCStreamEvent) error {
+	kind, data, err := marshalStreamEvent(e)
+	if err != nil {
+		return err
+	}
+
+	rec := PostgresEventRecord{
+		Kind: kind,
+		Repo: e.Repo(),
+		Uid:  e.PrivUid,
+		Time: time.Now(),
+		Data: data,
+	}
+
+	// events are broadcast here in the order they are numbered too
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	if err := p.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", p.lockID).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&rec).Error; err != nil {
+			return err
+		}
+		// the notification is only delivered once the event is committed
+		return tx.Exec("SELECT pg_notify(?, ?)", p.channel, strconv.FormatInt(rec.Seq, 10)).Error
+	}); err != nil {
+		return fmt.Errorf("persisting event: %w", err)
+	}
+
+	setSequence(e, rec.Seq)
+	p.seq = rec.Seq
+	postgresEventsPersisted.Inc()
+
+	p.broadcast(e)
+	return nil
+}
+
+// LastSeq returns the sequence number of the last event persisted
+func (p *PostgresPersistence) LastSeq() int64 {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	return p.seq
+}
+
+func (p *PostgresPersistence) Playback(ctx context.Context, since int64, cb func(*XRPCStreamEvent) error) error {
+	_, err := readPostgresEvents(ctx, p.db, since, 500, cb)
+	return err
+}
+
+func (p *PostgresPersistence) TakeDownRepo(ctx context.Context, usr models.Uid) error {
+	return p.db.WithContext(ctx).Where("uid = ?", usr).Delete(&PostgresEventRecord{}).Error
+}
+
+func (p *PostgresPersistence) RebaseRepoEvents(ctx context.Context, usr models.Uid) error {
+	// the same as a takedown, as with DbPersistence
+	return p.TakeDownRepo(ctx, usr)
+}
+
+func (p *PostgresPersistence) Flush(ctx context.Context) error {
+	return nil
+}
+
+func (p *PostgresPersistence) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func (p *PostgresPersistence) SetEventBroadcaster(brc func(*XRPCStreamEvent)) {
+	p.broadcast = brc
+}
+
+// readPostgresEvents calls cb with the events after since, in batches,
+// returning the sequence number of the last
+func readPostgresEvents(ctx context.Context, db *gorm.DB, since int64, batchSize int, cb func(*XRPCStreamEvent) error) (int64, error) {
+	last := since
+	for {
+		var recs []PostgresEventRecord
+		if err := db.WithContext(ctx).Where("seq > ?", last).Order("seq").Limit(batchSize).Find(&recs).Error; err != nil {
+			return last, err
+		}
+
+		for i := range recs {
+			evt, err := unmarshalStreamEvent(recs[i].Kind, recs[i].Data)
+			if err != nil {
+				return last, fmt.Errorf("reading event %d: %w", recs[i].Seq, err)
+			}
+			setSequence(evt, recs[i].Seq)
+			if err := cb(evt); err != nil {
+				return last, err
+			}
+			last = recs[i].Seq
+		}
+
+		if len(recs) < batchSize {
+			return last, nil
+		}
+	}
+}
+
+// marshalStreamEvent returns the message type and CBOR of an event with a
+// sequence number
+func marshalStreamEvent(e *XRPCStreamEvent) (string, []byte, error) {
+	var kind string
+	var obj lexutil.CBOR
+	switch {
+	case e.RepoCommit != nil:
+		kind, obj = "#commit", e.RepoCommit
+	case e.RepoHandle != nil:
+		kind, obj = "#handle", e.RepoHandle
+	case e.RepoMigrate != nil:
+		kind, obj = "#migrate", e.RepoMigrate
+	case e.RepoTombstone != nil:
+		kind, obj = "#tombstone", e.RepoTombstone
+	case e.RepoAccount != nil:
+		kind, obj = "#account", e.RepoAccount
+	case e.LabelLabels != nil:
+		kind, obj = "#labels", e.LabelLabels
+	default:
+		return "", nil, fmt.Errorf("event can't be persisted")
+	}
+
+	var buf bytes.Buffer
+	if err := obj.MarshalCBOR(&buf); err != nil {
+		return "", nil, fmt.Errorf("marshaling %s event: %w", kind, err)
+	}
+	return kind, buf.Bytes(), nil
+}
+
+func unmarshalStreamEvent(kind string, data []byte) (*XRPCStreamEvent, error) {
+	var evt XRPCStreamEvent
+	var obj lexutil.CBOR
+	switch kind {
+	case "#commit":
+		evt.RepoCommit = new(comatproto.SyncSubscribeRepos_Commit)
+		obj = evt.RepoCommit
+	case "#handle":
+		evt.RepoHandle = new(comatproto.SyncSubscribeRepos_Handle)
+		obj = evt.RepoHandle
+	case "#migrate":
+		evt.RepoMigrate = new(comatproto.SyncSubscribeRepos_Migrate)
+		obj = evt.RepoMigrate
+	case "#tombstone":
+		evt.RepoTombstone = new(comatproto.SyncSubscribeRepos_Tombstone)
+		obj = evt.RepoTombstone
+	case "#account":
+		evt.RepoAccount = new(comatproto.SyncSubscribeRepos_Account)
+		obj = evt.RepoAccount
+	case "#labels":
+		evt.LabelLabels = new(label.SubscribeLabels_Labels)
+		obj = evt.LabelLabels
+	default:
+		return nil, fmt.Errorf("unrecognized event kind %q", kind)
+	}
+
+	if err := obj.UnmarshalCBOR(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	return &evt, nil
+}
+
+func setSequence(e *XRPCStreamEvent, seq int64) {
+	switch {
+	case e.RepoCommit != nil:
+		e.RepoCommit.Seq = seq
+	case e.RepoHandle != nil:
+		e.RepoHandle.Seq = seq
+	case e.RepoMigrate != nil:
+		e.RepoMigrate.Seq = seq
+	case e.RepoTombstone != nil:
+		e.RepoTombstone.Seq = seq
+	case e.RepoAccount != nil:
+		e.RepoAccount.Seq = seq
+	case e.LabelLabels != nil:
+		e.LabelLabels.Seq = seq
+	}
+}
+
+type PostgresSubscriptionConfig struct {
+	// DB is the database the events are read from, and ConnString the
+	// connection string of the one LISTEN is sent on, as connections from a
+	// pool can't be kept waiting for notifications
+	DB         *gorm.DB
+	ConnString string
+
+	// Channel is the channel the PostgresPersistence announces events on,
+	// DefaultPostgresChannel if empty
+	Channel string
+
+	// Handler is called with each event, in order. Errors are logged, and the
+	// event skipped, as with Subscription.
+	Handler func(context.Context, *XRPCStreamEvent) error
+
+	// LoadCursor returns the sequence number to resume after, or 0 to start
+	// with new events, unless FromStart is set, when every event in the table
+	// is handled first
+	LoadCursor func(context.Context) (int64, error)
+	FromStart  bool
+
+	// SaveCursor is called with the sequence number of the last event handled
+	// at most every CursorSaveInterval while it changes, and once the
+	// subscription has stopped
+	SaveCursor         func(context.Context, int64) error
+	CursorSaveInterval time.Duration
+
+	// PollInterval is how often the table is checked for events without a
+	// notification, which are missed while LISTEN is reconnecting
+	PollInterval time.Duration
+
+	// BatchSize is how many events are read at a time
+	BatchSize int
+
+	// Sample, if set, only has the events of a sample of repos handled
+	Sample *Sample
+}
+
+// PostgresSubscription follows the events persisted by a PostgresPersistence,
+// reading new ones as they are announced
+type PostgresSubscription struct {
+	cfg PostgresSubscriptionConfig
+
+	lk     sync.Mutex
+	cursor int64
+}
+
+func NewPostgresSubscription(cfg PostgresSubscriptionConfig) (*PostgresSubscription, error) {
+	if cfg.DB == nil || cfg.ConnString == "" {
+		return nil, fmt.Errorf("postgres subscription needs a database and a connection string")
+	}
+	if cfg.Handler == nil {
+		return nil, fmt.Errorf("subscription has no handler")
+	}
+
+	if cfg.Channel == "" {
+		cfg.Channel = DefaultPostgresChannel
+	}
+	if cfg.CursorSaveInterval == 0 {
+		cfg.CursorSaveInterval = 10 * time.Second
+	}
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = 5 * time.Second
+	}
+	if cfg.BatchSize == 0 {
+		cfg.BatchSize = 500
+	}
+
+	return &PostgresSubscription{cfg: cfg}, nil
+}
+
+// Cursor returns the sequence number of the last event handled
+func (s *PostgresSubscription) Cursor() int64 {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.cursor
+}
+
+// Run handles events until ctx is done, and then saves the cursor. It only
+// returns an error if the cursor can't be loaded.
+func (s *PostgresSubscription) Run(ctx context.Context) error {
+	var cursor int64
+	if s.cfg.LoadCursor != nil {
+		c, err := s.cfg.LoadCursor(ctx)
+		if err != nil {
+			return fmt.Errorf("loading cursor: %w", err)
+		}
+		cursor = c
+	}
+	if cursor == 0 && !s.cfg.FromStart {
+		if err := s.cfg.DB.WithContext(ctx).Model(&PostgresEventRecord{}).Select("coalesce(max(seq), 0)").Scan(&cursor).Error; err != nil {
+			return fmt.Errorf("finding the last event: %w", err)
+		}
+	}
+	s.setCursor(cursor)
+
+	saved, savedAt := cursor, time.Now()
+	saveCursor := func(ctx context.Context) {
+		c := s.Cursor()
+		if s.cfg.SaveCursor == nil || c == saved {
+			return
+		}
+		if err := s.cfg.SaveCursor(ctx, c); err != nil {
+			log.Errorw("failed to save postgres subscription cursor", "cursor", c, "err", err)
+			return
+		}
+		saved, savedAt = c, time.Now()
+	}
+
+	var conn *pgx.Conn
+	for ctx.Err() == nil {
+		if conn == nil {
+			c, err := s.listen(ctx)
+			if err != nil && ctx.Err() == nil {
+				// events are still polled for until LISTEN is back
+				log.Warnw("failed to listen for postgres events", "channel", s.cfg.Channel, "err", err)
+			}
+			conn = c
+		}
+
+		if err := s.catchUp(ctx); err != nil && ctx.Err() == nil {
+			log.Errorw("failed to read postgres events", "cursor", s.Cursor(), "err", err)
+		}
+		if time.Since(savedAt) >= s.cfg.CursorSaveInterval {
+			saveCursor(ctx)
+		}
+
+		waitCtx, cancel := context.WithTimeout(ctx, s.cfg.PollInterval)
+		if conn != nil {
+			_, err := conn.WaitForNotification(waitCtx)
+			if err != nil && waitCtx.Err() == nil {
+				log.Warnw("lost postgres events connection", "channel", s.cfg.Channel, "err", err)
+				conn.Close(context.Background())
+				conn = nil
+			}
+		} else {
+			<-waitCtx.Done()
+		}
+		cancel()
+	}
+
+	if conn != nil {
+		conn.Close(context.Background())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	saveCursor(ctx)
+	return nil
+}
+
+func (s *PostgresSubscription) listen(ctx context.Context) (*pgx.Conn, error) {
+	conn, err := pgx.Connect(ctx, s.cfg.ConnString)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{s.cfg.Channel}.Sanitize()); err != nil {
+		conn.Close(context.Background())
+		return nil, err
+	}
+	return conn, nil
+}
+
+// catchUp handles every event after the cursor
+func (s *PostgresSubscription) catchUp(ctx context.Context) error {
+	_, err := readPostgresEvents(ctx, s.cfg.DB, s.Cursor(), s.cfg.BatchSize, func(evt *XRPCStreamEvent) error {
+		seq := evt.Sequence()
+		if evt = s.cfg.Sample.Filter(evt); evt != nil {
+			if err := s.cfg.Handler(ctx, evt); err != nil {
+				log.Errorw("failed to handle event", "seq", seq, "err", err)
+			}
+		}
+		s.setCursor(seq)
+		return ctx.Err()
+	})
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+func (s *PostgresSubscription) setCursor(c int64) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.cursor = c
+}
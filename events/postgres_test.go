@@ -0,0 +1,107 @@
+package events_test
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	atproto "github.com/bluesky-social/indigo/api/atproto"
+	label "github.com/bluesky-social/indigo/api/label"
+	"github.com/bluesky-social/indigo/events"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestPostgresPersistenceNeedsPostgres(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := events.NewPostgresPersistence(context.Background(), db, ""); err == nil {
+		t.Fatal("expected postgres persistence on sqlite to be refused")
+	}
+}
+
+// TestPostgresPersistence needs a scratch postgres database, as
+// INDIGO_TEST_POSTGRES_URL, whose events table it empties
+func TestPostgresPersistence(t *testing.T) {
+	url := os.Getenv("INDIGO_TEST_POSTGRES_URL")
+	if url == "" {
+		t.Skip("INDIGO_TEST_POSTGRES_URL not set")
+	}
+	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, err := gorm.Open(postgres.Open(url))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := events.NewPostgresPersistence(ctx, db, "indigo_events_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("TRUNCATE postgres_event_records").Error; err != nil {
+		t.Fatal(err)
+	}
+	em := events.NewEventManager(p)
+
+	var lk sync.Mutex
+	var received []*events.XRPCStreamEvent
+	sub, err := events.NewPostgresSubscription(events.PostgresSubscriptionConfig{
+		DB:         db,
+		ConnString: url,
+		Channel:    "indigo_events_test",
+		FromStart:  true,
+		Handler: func(ctx context.Context, evt *events.XRPCStreamEvent) error {
+			lk.Lock()
+			defer lk.Unlock()
+			received = append(received, evt)
+			return nil
+		},
+		PollInterval: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sub.Run(ctx)
+	}()
+
+	assert.NoError(em.AddEvent(ctx, &events.XRPCStreamEvent{RepoHandle: &atproto.SyncSubscribeRepos_Handle{Did: "did:plc:alice", Handle: "alice.test"}}))
+	assert.NoError(em.AddEvent(ctx, &events.XRPCStreamEvent{LabelLabels: &label.SubscribeLabels_Labels{Labels: []*label.Label{{Uri: "did:plc:alice", Val: "spam"}}}}))
+
+	var played []*events.XRPCStreamEvent
+	assert.NoError(p.Playback(ctx, 0, func(evt *events.XRPCStreamEvent) error {
+		played = append(played, evt)
+		return nil
+	}))
+	if assert.Len(played, 2) {
+		assert.Equal("alice.test", played[0].RepoHandle.Handle)
+		assert.Equal("spam", played[1].LabelLabels.Labels[0].Val)
+		assert.Equal(played[0].Sequence()+1, played[1].Sequence())
+		assert.Equal(played[1].Sequence(), p.LastSeq())
+	}
+
+	// the subscription is woken by the notifications, well before it polls
+	deadline := time.Now().Add(10 * time.Second)
+	for sub.Cursor() != p.LastSeq() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	lk.Lock()
+	defer lk.Unlock()
+	if assert.Len(received, 2) {
+		assert.Equal("did:plc:alice", received[0].RepoHandle.Did)
+		assert.Equal(p.LastSeq(), received[1].Sequence())
+	}
+}
@@ -0,0 +1,175 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/carstore"
+	"github.com/bluesky-social/indigo/models"
+
+	"gorm.io/gorm"
+)
+
+var ErrReadOnlyReplica = fmt.Errorf("events can not be written to a read-only replica")
+
+// ReplicaOptions are the options of a ReplicaPersistence, on top of the
+// DbPersistence ones used for playback
+type ReplicaOptions struct {
+	Options
+
+	// PollInterval is how often the database is checked for new events
+	PollInterval time.Duration
+}
+
+func DefaultReplicaOptions() *ReplicaOptions {
+	return &ReplicaOptions{
+		Options:      *DefaultOptions(),
+		PollInterval: 200 * time.Millisecond,
+	}
+}
+
+// ReplicaPersistence serves the events persisted by the DbPersistence of an
+// ingesting BGS, from a replica of its database and the carstore it writes, so
+// that more instances can serve the firehose. It never persists events itself:
+// new events are found by polling the database, and are broadcast with the
+// sequence numbers the ingesting BGS gave them, so consumers can move between
+// instances with the same cursor. A consumer with a cursor the replica hasn't
+// reached yet is sent nothing until it has.
+type ReplicaPersistence struct {
+	p    *DbPersistence
+	opts ReplicaOptions
+
+	broadcast func(*XRPCStreamEvent)
+
+	lk sync.Mutex
+	// seq is the last event broadcast
+	seq int64
+
+	startOnce sync.Once
+	shutdown  chan struct{}
+	done      chan struct{}
+}
+
+// NewReplicaPersistence follows the events table in db, which the ingesting BGS
+// writes, from its current end. cs should be a read-only view of the ingesting
+// BGS's carstore, see carstore.NewReadOnlyCarStore.
+func NewReplicaPersistence(ctx context.Context, db *gorm.DB, cs *carstore.CarStore, options *ReplicaOptions) (*ReplicaPersistence, error) {
+	if options == nil {
+		options = DefaultReplicaOptions()
+	}
+
+	p, err := newDbPersistence(db, cs, &options.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	var seq int64
+	if err := db.WithContext(ctx).Model(&RepoEventRecord{}).Select("coalesce(max(seq), 0)").Scan(&seq).Error; err != nil {
+		return nil, fmt.Errorf("finding the last event: %w", err)
+	}
+	replicaSeq.Set(float64(seq))
+
+	return &ReplicaPersistence{
+		p:        p,
+		opts:     *options,
+		seq:      seq,
+		shutdown: make(chan struct{}),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// SetEventBroadcaster sets where new events are sent, and starts polling for
+// them
+func (r *ReplicaPersistence) SetEventBroadcaster(brc func(*XRPCStreamEvent)) {
+	r.broadcast = brc
+	r.startOnce.Do(func() {
+		go r.follow()
+	})
+}
+
+func (r *ReplicaPersistence) follow() {
+	defer close(r.done)
+
+	t := time.NewTicker(r.opts.PollInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-r.shutdown:
+			return
+		case <-t.C:
+		}
+
+		if err := r.poll(context.Background()); err != nil {
+			// events not read yet, such as those whose shards haven't made
+			// it to shared storage, are read on the next poll
+			log.Errorf("failed to read new events from replica: %s", err)
+			replicaPollErrors.Inc()
+		}
+	}
+}
+
+// poll broadcasts the events persisted since the last poll
+func (r *ReplicaPersistence) poll(ctx context.Context) error {
+	return r.p.Playback(ctx, r.LastSeq(), func(evt *XRPCStreamEvent) error {
+		r.broadcast(evt)
+
+		r.lk.Lock()
+		r.seq = evt.Sequence()
+		r.lk.Unlock()
+
+		replicaSeq.Set(float64(evt.Sequence()))
+		return nil
+	})
+}
+
+// LastSeq returns the sequence number of the last event broadcast
+func (r *ReplicaPersistence) LastSeq() int64 {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	return r.seq
+}
+
+func (r *ReplicaPersistence) Playback(ctx context.Context, since int64, cb func(*XRPCStreamEvent) error) error {
+	return r.p.Playback(ctx, since, cb)
+}
+
+func (r *ReplicaPersistence) Persist(ctx context.Context, e *XRPCStreamEvent) error {
+	return ErrReadOnlyReplica
+}
+
+func (r *ReplicaPersistence) TakeDownRepo(ctx context.Context, usr models.Uid) error {
+	return ErrReadOnlyReplica
+}
+
+func (r *ReplicaPersistence) RebaseRepoEvents(ctx context.Context, usr models.Uid) error {
+	return ErrReadOnlyReplica
+}
+
+func (r *ReplicaPersistence) Flush(ctx context.Context) error {
+	return nil
+}
+
+// Shutdown stops polling for new events
+func (r *ReplicaPersistence) Shutdown(ctx context.Context) error {
+	select {
+	case <-r.shutdown:
+		return nil
+	default:
+		close(r.shutdown)
+	}
+
+	// polling is only started once there is a broadcaster
+	r.startOnce.Do(func() {
+		close(r.done)
+	})
+
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for replica to stop polling: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,139 @@
+package events_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	atproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/carstore"
+	"github.com/bluesky-social/indigo/events"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/repomgr"
+	"github.com/bluesky-social/indigo/util"
+)
+
+func TestReplicaPersistence(t *testing.T) {
+	ctx := context.Background()
+	db, cardb, cs, tempPath, err := setupDBs(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempPath)
+
+	db.AutoMigrate(&models.ActorInfo{})
+	db.Create(&models.ActorInfo{Uid: 1, Did: "did:example:123"})
+
+	mgr := repomgr.NewRepoManager(cs, &util.FakeKeyManager{})
+	if err := mgr.InitNewActor(ctx, 1, "alice", "did:example:123", "Alice", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	primary, err := events.NewDbPersistence(db, cs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	primaryEvents := events.NewEventManager(primary)
+
+	addEvent := func() {
+		_, rcid, err := mgr.CreateRecord(ctx, 1, "app.bsky.feed.post", &bsky.FeedPost{
+			Text:      "hello world",
+			CreatedAt: time.Now().Format(util.ISO8601),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		head, err := mgr.GetRepoRoot(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cidLink := lexutil.LexLink(rcid)
+		if err := primaryEvents.AddEvent(ctx, &events.XRPCStreamEvent{
+			RepoCommit: &atproto.SyncSubscribeRepos_Commit{
+				Repo:   "did:example:123",
+				Commit: lexutil.LexLink(head),
+				Ops:    []*atproto.SyncSubscribeRepos_RepoOp{{Action: "create", Cid: &cidLink, Path: "app.bsky.feed.post/1"}},
+				Time:   time.Now().Format(util.ISO8601),
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := primary.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	addEvent()
+	addEvent()
+
+	rcs, err := carstore.NewReadOnlyCarStore(cardb, filepath.Join(tempPath, "carstore"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := events.DefaultReplicaOptions()
+	opts.PollInterval = 10 * time.Millisecond
+	replica, err := events.NewReplicaPersistence(ctx, db, rcs, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Shutdown(ctx)
+	if replica.LastSeq() != 2 {
+		t.Fatalf("expected the replica to start at the last event, got %d", replica.LastSeq())
+	}
+	replicaEvents := events.NewEventManager(replica)
+
+	if err := replica.Persist(ctx, &events.XRPCStreamEvent{}); err != events.ErrReadOnlyReplica {
+		t.Fatalf("expected writes to the replica to fail, got %v", err)
+	}
+
+	// one consumer replays from the start, the other has a cursor from an
+	// instance further along than the replica
+	since, ahead := int64(0), int64(3)
+	replayed, cancel, err := replicaEvents.Subscribe(ctx, "replayed", nil, &since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	caughtUp, cancel2, err := replicaEvents.Subscribe(ctx, "ahead", nil, &ahead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel2()
+
+	next := func(ch <-chan *events.XRPCStreamEvent) int64 {
+		select {
+		case evt := <-ch:
+			if evt.RepoCommit == nil || len(evt.RepoCommit.Blocks) == 0 {
+				t.Fatalf("expected a commit with its blocks, got %+v", evt)
+			}
+			return evt.RepoCommit.Seq
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for an event")
+			return 0
+		}
+	}
+
+	for _, want := range []int64{1, 2} {
+		if seq := next(replayed); seq != want {
+			t.Fatalf("expected event %d to be replayed, got %d", want, seq)
+		}
+	}
+
+	// the subscriptions are added once playback is done
+	time.Sleep(50 * time.Millisecond)
+	addEvent()
+	addEvent()
+
+	for _, want := range []int64{3, 4} {
+		if seq := next(replayed); seq != want {
+			t.Fatalf("expected event %d to be broadcast, got %d", want, seq)
+		}
+	}
+	if seq := next(caughtUp); seq != 4 {
+		t.Fatalf("expected events up to the cursor to be skipped, got %d", seq)
+	}
+}
@@ -0,0 +1,90 @@
+package events
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// SampleParam is the query parameter of stream subscriptions asking to be
+// sent only a sample of the stream's repos, as a fraction, eg sample=0.01
+const SampleParam = "sample"
+
+// ErrInvalidSample is returned, wrapped, by ParseSample for sample rates
+// outside (0, 1]
+var ErrInvalidSample = errors.New("invalid sample rate")
+
+// Sample is a deterministic fraction of the repos of a stream. A repo is in
+// the sample if the FNV-1a hash of its DID, as a fraction of the hash space,
+// is below the rate, so every subscriber with the same rate is sent the same
+// repos, and a sample contains every smaller one.
+type Sample struct {
+	rate float64
+}
+
+// NewSample returns the sample of a fraction of repos, which must be in
+// (0, 1]
+func NewSample(rate float64) (*Sample, error) {
+	if !(rate > 0 && rate <= 1) {
+		return nil, fmt.Errorf("%w: %v is not in (0, 1]", ErrInvalidSample, rate)
+	}
+	return &Sample{rate: rate}, nil
+}
+
+// ParseSample parses the sample query parameter of a subscription, returning
+// nil, which is every repo, if it is empty
+func ParseSample(s string) (*Sample, error) {
+	if s == "" {
+		return nil, nil
+	}
+	rate, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidSample, s)
+	}
+	return NewSample(rate)
+}
+
+// Rate returns the fraction of repos in the sample
+func (s *Sample) Rate() float64 {
+	if s == nil {
+		return 1
+	}
+	return s.rate
+}
+
+func (s *Sample) String() string {
+	return strconv.FormatFloat(s.Rate(), 'g', -1, 64)
+}
+
+// Includes reports whether the repo with a DID is in the sample
+func (s *Sample) Includes(did string) bool {
+	if s == nil || s.rate >= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(did))
+	// the top 53 bits, which a float64 holds exactly
+	return float64(h.Sum64()>>11)/(1<<53) < s.rate
+}
+
+// Filter returns the event if its repo is in the sample, or nil if it isn't.
+// Label events are sent with only the labels on accounts in the sample and
+// their records, and events which aren't about a repo are always sent.
+func (s *Sample) Filter(evt *XRPCStreamEvent) *XRPCStreamEvent {
+	if s == nil || s.rate >= 1 {
+		return evt
+	}
+	if evt.LabelLabels != nil {
+		return filterLabels(evt, func(did, coll string) bool {
+			return s.Includes(did)
+		})
+	}
+
+	did := evt.Repo()
+	if did == "" || s.Includes(did) {
+		return evt
+	}
+	return nil
+}
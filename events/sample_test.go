@@ -0,0 +1,93 @@
+package events_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	atproto "github.com/bluesky-social/indigo/api/atproto"
+	label "github.com/bluesky-social/indigo/api/label"
+	"github.com/bluesky-social/indigo/events"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSample(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := events.ParseSample("")
+	assert.NoError(err)
+	assert.Nil(s)
+	assert.Equal(1.0, s.Rate())
+
+	s, err = events.ParseSample("0.01")
+	assert.NoError(err)
+	assert.Equal(0.01, s.Rate())
+	assert.Equal("0.01", s.String())
+
+	for _, bad := range []string{"0", "-0.5", "1.5", "NaN", "half"} {
+		_, err := events.ParseSample(bad)
+		assert.True(errors.Is(err, events.ErrInvalidSample), bad)
+	}
+}
+
+func TestSampleIncludes(t *testing.T) {
+	assert := assert.New(t)
+
+	tenth, err := events.NewSample(0.1)
+	assert.NoError(err)
+	hundredth, err := events.NewSample(0.01)
+	assert.NoError(err)
+
+	var inTenth, inHundredth int
+	for i := 0; i < 100_000; i++ {
+		did := fmt.Sprintf("did:plc:%08d", i)
+		if tenth.Includes(did) {
+			inTenth++
+		}
+		if hundredth.Includes(did) {
+			inHundredth++
+			// smaller samples are contained in larger ones
+			assert.True(tenth.Includes(did), did)
+		}
+	}
+	assert.InDelta(10_000, inTenth, 500)
+	assert.InDelta(1_000, inHundredth, 150)
+
+	var all *events.Sample
+	assert.True(all.Includes("did:plc:anyone"))
+}
+
+func TestSampleFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := events.NewSample(0.5)
+	assert.NoError(err)
+
+	// find one repo in the sample and one out of it
+	var in, out string
+	for i := 0; in == "" || out == ""; i++ {
+		did := fmt.Sprintf("did:plc:%d", i)
+		if s.Includes(did) {
+			in = did
+		} else {
+			out = did
+		}
+	}
+
+	assert.NotNil(s.Filter(commitEvent(in, "app.bsky.feed.post/1")))
+	assert.Nil(s.Filter(commitEvent(out, "app.bsky.feed.post/1")))
+	assert.Nil(s.Filter(&events.XRPCStreamEvent{RepoHandle: &atproto.SyncSubscribeRepos_Handle{Did: out}}))
+	assert.NotNil(s.Filter(&events.XRPCStreamEvent{RepoInfo: &atproto.SyncSubscribeRepos_Info{Name: "OutdatedCursor"}}))
+
+	labels := &events.XRPCStreamEvent{LabelLabels: &label.SubscribeLabels_Labels{Seq: 7, Labels: []*label.Label{
+		{Uri: "at://" + in + "/app.bsky.feed.post/1", Val: "spam"},
+		{Uri: out, Val: "spam"},
+	}}}
+	filtered := s.Filter(labels)
+	if assert.NotNil(filtered) && assert.Len(filtered.LabelLabels.Labels, 1) {
+		assert.Equal("at://"+in+"/app.bsky.feed.post/1", filtered.LabelLabels.Labels[0].Uri)
+		assert.Equal(int64(7), filtered.LabelLabels.Seq)
+	}
+	assert.Len(labels.LabelLabels.Labels, 2)
+}
@@ -0,0 +1,409 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bluesky-social/indigo/util/cursorstore"
+	"github.com/gorilla/websocket"
+)
+
+// SubscriptionState is where a Subscription is in connecting to its stream
+type SubscriptionState int
+
+const (
+	// SubscriptionConnecting is before each attempt to dial the stream
+	SubscriptionConnecting SubscriptionState = iota
+	// SubscriptionConnected is once the stream has been dialed
+	SubscriptionConnected
+	// SubscriptionDisconnected is after a connection, or an attempt to make
+	// one, has failed, while waiting to retry
+	SubscriptionDisconnected
+	// SubscriptionStopped is once the subscription's context is done
+	SubscriptionStopped
+)
+
+func (s SubscriptionState) String() string {
+	switch s {
+	case SubscriptionConnecting:
+		return "connecting"
+	case SubscriptionConnected:
+		return "connected"
+	case SubscriptionDisconnected:
+		return "disconnected"
+	case SubscriptionStopped:
+		return "stopped"
+	default:
+		return "unknown"
+	}
+}
+
+// ErrLivenessTimeout ends connections on which no events have arrived for the
+// subscription's LivenessTimeout
+var ErrLivenessTimeout = errors.New("no events received within liveness timeout")
+
+type SubscriptionConfig struct {
+	// URL is the stream endpoint, eg
+	// wss://bsky.network/xrpc/com.atproto.sync.subscribeRepos. The cursor
+	// parameter is set on it for every connection.
+	URL    string
+	Header http.Header
+	Dialer *websocket.Dialer
+
+	// Handler is called with each event. Errors are logged, and the event
+	// skipped, rather than ending the connection, as the same event would
+	// only be sent again.
+	Handler func(context.Context, *XRPCStreamEvent) error
+
+	// NewScheduler creates the scheduler for each connection, which calls do
+	// with each event. By default events are handled one at a time, in the
+	// order they arrive. With schedulers handling events concurrently, the
+	// cursor is the highest sequence number handled, with possibly some
+	// events below it not yet handled.
+	NewScheduler func(ident string, do func(context.Context, *XRPCStreamEvent) error) Scheduler
+
+	// LoadCursor returns the sequence number to resume the stream after, or
+	// 0 to start with live events. It is called once, when the subscription
+	// is run; reconnections resume after the last event handled.
+	LoadCursor func(context.Context) (int64, error)
+
+	// FromStart has subscriptions without a cursor replay every event the
+	// host still has, with cursor=0, rather than start with live events
+	FromStart bool
+
+	// Sample, if set, asks the host to only send the events of a sample of
+	// repos. Events from hosts which don't sample are sampled as they
+	// arrive, so the handler only ever sees the sample.
+	Sample *Sample
+
+	// SaveCursor is called with the sequence number of the last event
+	// handled every CursorSaveInterval while it changes, and once the
+	// subscription has stopped
+	SaveCursor         func(context.Context, int64) error
+	CursorSaveInterval time.Duration
+
+	// Cursors, if set, is told of every event handled, so that it reports
+	// the lag of the subscription, and loads and saves the cursor in place
+	// of LoadCursor and SaveCursor where they aren't set
+	Cursors *cursorstore.Tracker
+
+	// MinBackoff and MaxBackoff bound the delay before redialing, which
+	// doubles with every failed connection, and is jittered
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// LivenessTimeout is how long to wait for an event before the connection
+	// is assumed to be dead and redialed. Zero disables the check.
+	LivenessTimeout time.Duration
+
+	// OnStateChange, if set, is called with every change of the connection
+	// state, and the error that ended the connection when disconnected
+	OnStateChange func(state SubscriptionState, err error)
+}
+
+// Subscription consumes an event stream, redialing it with backoff whenever
+// the connection fails, resuming after the last event handled
+type Subscription struct {
+	cfg  SubscriptionConfig
+	host string
+
+	cursor    atomic.Int64
+	lastEvent atomic.Int64
+}
+
+func NewSubscription(cfg SubscriptionConfig) (*Subscription, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing stream url: %w", err)
+	}
+	if cfg.Handler == nil {
+		return nil, fmt.Errorf("subscription has no handler")
+	}
+
+	if cfg.Dialer == nil {
+		cfg.Dialer = websocket.DefaultDialer
+	}
+	if cfg.NewScheduler == nil {
+		cfg.NewScheduler = func(ident string, do func(context.Context, *XRPCStreamEvent) error) Scheduler {
+			return &inlineScheduler{do: do}
+		}
+	}
+	if cfg.Cursors != nil {
+		if cfg.LoadCursor == nil {
+			cfg.LoadCursor = cfg.Cursors.Load
+		}
+		if cfg.SaveCursor == nil {
+			cfg.SaveCursor = func(ctx context.Context, _ int64) error {
+				return cfg.Cursors.Flush(ctx)
+			}
+		}
+	}
+	if cfg.CursorSaveInterval == 0 {
+		cfg.CursorSaveInterval = 10 * time.Second
+	}
+	if cfg.MinBackoff == 0 {
+		cfg.MinBackoff = time.Second
+	}
+	if cfg.MaxBackoff == 0 {
+		cfg.MaxBackoff = 30 * time.Second
+	}
+
+	return &Subscription{
+		cfg:  cfg,
+		host: u.Host,
+	}, nil
+}
+
+// Cursor returns the sequence number of the last event handled
+func (s *Subscription) Cursor() int64 {
+	return s.cursor.Load()
+}
+
+// Run consumes the stream until ctx is done, and then saves the cursor. It
+// only returns an error if the cursor can't be loaded.
+func (s *Subscription) Run(ctx context.Context) error {
+	if s.cfg.LoadCursor != nil {
+		c, err := s.cfg.LoadCursor(ctx)
+		if err != nil {
+			return fmt.Errorf("loading cursor: %w", err)
+		}
+		s.cursor.Store(c)
+	}
+
+	saved := s.cursor.Load()
+	saveCursor := func(ctx context.Context) {
+		c := s.cursor.Load()
+		if s.cfg.SaveCursor == nil || c == saved {
+			return
+		}
+		if err := s.cfg.SaveCursor(ctx, c); err != nil {
+			log.Errorw("failed to save subscription cursor", "host", s.host, "cursor", c, "err", err)
+			return
+		}
+		saved = c
+	}
+
+	saverCtx, stopSaver := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t := time.NewTicker(s.cfg.CursorSaveInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-saverCtx.Done():
+				return
+			case <-t.C:
+				saveCursor(saverCtx)
+			}
+		}
+	}()
+
+	var attempt int
+	for ctx.Err() == nil {
+		s.setState(SubscriptionConnecting, nil)
+		received, err := s.connect(ctx)
+		if ctx.Err() != nil {
+			break
+		}
+
+		reason := "error"
+		if errors.Is(err, ErrLivenessTimeout) {
+			reason = "timeout"
+		}
+		subscriptionDisconnects.WithLabelValues(s.host, reason).Inc()
+		s.setState(SubscriptionDisconnected, err)
+
+		// only connections which got somewhere reset the backoff, so that
+		// a server accepting connections and then dropping them isn't
+		// redialed in a tight loop
+		if received {
+			attempt = 0
+		}
+		d := s.backoff(attempt)
+		attempt++
+
+		log.Warnw("subscription disconnected", "host", s.host, "err", err, "retry_in", d)
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+		}
+	}
+
+	stopSaver()
+	wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	saveCursor(ctx)
+
+	s.setState(SubscriptionStopped, nil)
+	return nil
+}
+
+func (s *Subscription) setState(state SubscriptionState, err error) {
+	log.Debugw("subscription state change", "host", s.host, "state", state, "err", err)
+	if s.cfg.OnStateChange != nil {
+		s.cfg.OnStateChange(state, err)
+	}
+}
+
+// backoff returns how long to wait before the given redial attempt. Half of
+// the delay is jitter, so that the subscribers of a stream which went away
+// don't all come back at once.
+func (s *Subscription) backoff(attempt int) time.Duration {
+	d := s.cfg.MaxBackoff
+	if attempt < 32 {
+		if b := s.cfg.MinBackoff << attempt; b > 0 && b < d {
+			d = b
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (s *Subscription) streamURL() (string, error) {
+	u, err := url.Parse(s.cfg.URL)
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	if c := s.cursor.Load(); c > 0 || s.cfg.FromStart {
+		q.Set("cursor", strconv.FormatInt(c, 10))
+	} else {
+		q.Del("cursor")
+	}
+	if s.cfg.Sample != nil {
+		q.Set(SampleParam, s.cfg.Sample.String())
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// connect dials the stream and handles its events until the connection ends,
+// returning whether any events were received
+func (s *Subscription) connect(ctx context.Context) (bool, error) {
+	u, err := s.streamURL()
+	if err != nil {
+		return false, err
+	}
+
+	con, res, err := s.cfg.Dialer.DialContext(ctx, u, s.cfg.Header)
+	if err != nil {
+		if res != nil {
+			return false, fmt.Errorf("dialing %s (status %d): %w", s.host, res.StatusCode, err)
+		}
+		return false, fmt.Errorf("dialing %s: %w", s.host, err)
+	}
+
+	connected := subscriptionsConnected.WithLabelValues(s.host)
+	connected.Inc()
+	defer connected.Dec()
+	s.setState(SubscriptionConnected, nil)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	s.lastEvent.Store(time.Now().UnixNano())
+	var timedOut atomic.Bool
+	if timeout := s.cfg.LivenessTimeout; timeout > 0 {
+		go func() {
+			t := time.NewTicker(timeout / 4)
+			defer t.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-t.C:
+				}
+
+				if time.Since(time.Unix(0, s.lastEvent.Load())) > timeout {
+					// ending the context closes the connection
+					timedOut.Store(true)
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+
+	sched := &subscriptionScheduler{
+		sub:  s,
+		next: s.cfg.NewScheduler(con.RemoteAddr().String(), s.handle),
+	}
+	err = HandleRepoStream(ctx, con, sched)
+	if timedOut.Load() {
+		err = ErrLivenessTimeout
+	}
+	return sched.received.Load(), err
+}
+
+func (s *Subscription) handle(ctx context.Context, evt *XRPCStreamEvent) error {
+	seq := evt.Sequence()
+	if s.cfg.Cursors != nil {
+		defer s.cfg.Cursors.Advance(seq, evt.Time())
+	}
+	if evt = s.cfg.Sample.Filter(evt); evt != nil {
+		if err := s.cfg.Handler(ctx, evt); err != nil {
+			log.Errorw("failed to handle event", "host", s.host, "seq", seq, "err", err)
+		}
+	}
+
+	for {
+		c := s.cursor.Load()
+		if seq <= c || s.cursor.CompareAndSwap(c, seq) {
+			return nil
+		}
+	}
+}
+
+// subscriptionScheduler watches the events of a connection on their way to
+// its scheduler
+type subscriptionScheduler struct {
+	sub      *Subscription
+	next     Scheduler
+	received atomic.Bool
+}
+
+func (ss *subscriptionScheduler) AddWork(ctx context.Context, repo string, val *XRPCStreamEvent) error {
+	ss.sub.lastEvent.Store(time.Now().UnixNano())
+	ss.received.Store(true)
+
+	if val.Error != nil {
+		if val.Error.Error == "FutureCursor" {
+			// the stream has been reset, or we were given a bad cursor,
+			// so start again with live events
+			ss.sub.cursor.Store(0)
+		}
+		return fmt.Errorf("error frame: %s: %s", val.Error.Error, val.Error.Message)
+	}
+
+	if ss.sub.cfg.Cursors != nil {
+		ss.sub.cfg.Cursors.Begin(val.Sequence())
+	}
+	return ss.next.AddWork(ctx, repo, val)
+}
+
+func (ss *subscriptionScheduler) Shutdown() {
+	ss.next.Shutdown()
+}
+
+// inlineScheduler handles each event as it is added
+type inlineScheduler struct {
+	do func(context.Context, *XRPCStreamEvent) error
+}
+
+func (is *inlineScheduler) AddWork(ctx context.Context, repo string, val *XRPCStreamEvent) error {
+	return is.do(ctx, val)
+}
+
+func (is *inlineScheduler) Shutdown() {}
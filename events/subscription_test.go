@@ -0,0 +1,155 @@
+package events_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	atproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSubscriptionReconnects(t *testing.T) {
+	var lk sync.Mutex
+	var cursors []string
+
+	// the first connection sends three events and drops, the second sends
+	// one more and then goes quiet, and later ones stay quiet
+	var conns int
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		con, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer con.Close()
+
+		lk.Lock()
+		cursors = append(cursors, r.URL.Query().Get("cursor"))
+		conns++
+		n := conns
+		lk.Unlock()
+
+		start, _ := strconv.ParseInt(r.URL.Query().Get("cursor"), 10, 64)
+		send := func(seq int64) {
+			wc, err := con.NextWriter(websocket.BinaryMessage)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			header := events.EventHeader{Op: events.EvtKindMessage, MsgType: "#handle"}
+			if err := header.MarshalCBOR(wc); err != nil {
+				t.Error(err)
+			}
+			evt := atproto.SyncSubscribeRepos_Handle{Did: "did:plc:foo", Handle: "foo.test", Seq: seq, Time: "2023-01-01T00:00:00Z"}
+			if err := evt.MarshalCBOR(wc); err != nil {
+				t.Error(err)
+			}
+			wc.Close()
+		}
+
+		switch n {
+		case 1:
+			for i := int64(1); i <= 3; i++ {
+				send(start + i)
+			}
+		case 2:
+			send(start + 1)
+			fallthrough
+		default:
+			// wait for the client to give up on us
+			for {
+				if _, _, err := con.NextReader(); err != nil {
+					return
+				}
+			}
+		}
+	}))
+	defer srv.Close()
+
+	var seen []int64
+	var saved int64
+	states := make(chan events.SubscriptionState, 100)
+	var disconnectErrs []error
+	sub, err := events.NewSubscription(events.SubscriptionConfig{
+		URL: "ws" + strings.TrimPrefix(srv.URL, "http") + "/xrpc/com.atproto.sync.subscribeRepos",
+		Handler: func(ctx context.Context, evt *events.XRPCStreamEvent) error {
+			lk.Lock()
+			defer lk.Unlock()
+			seen = append(seen, evt.Sequence())
+			return nil
+		},
+		LoadCursor: func(context.Context) (int64, error) {
+			return 10, nil
+		},
+		SaveCursor: func(_ context.Context, c int64) error {
+			lk.Lock()
+			defer lk.Unlock()
+			saved = c
+			return nil
+		},
+		MinBackoff:      10 * time.Millisecond,
+		MaxBackoff:      20 * time.Millisecond,
+		LivenessTimeout: 200 * time.Millisecond,
+		OnStateChange: func(state events.SubscriptionState, err error) {
+			if state == events.SubscriptionDisconnected {
+				lk.Lock()
+				disconnectErrs = append(disconnectErrs, err)
+				lk.Unlock()
+			}
+			states <- state
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- sub.Run(ctx)
+	}()
+
+	// wait for the third connection, after the liveness timeout
+	deadline := time.After(5 * time.Second)
+	connected := 0
+	for connected < 3 {
+		select {
+		case s := <-states:
+			if s == events.SubscriptionConnected {
+				connected++
+			}
+		case <-deadline:
+			t.Fatal("timed out waiting for reconnections")
+		}
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	lk.Lock()
+	defer lk.Unlock()
+	if got := strings.Join(cursors[:3], ","); got != "10,13,14" {
+		t.Fatalf("expected each connection to resume after the last event, got cursors %s", got)
+	}
+	if len(seen) != 4 || seen[3] != 14 {
+		t.Fatalf("unexpected events handled: %v", seen)
+	}
+	if saved != 14 {
+		t.Fatalf("expected the cursor to be saved on stop, got %d", saved)
+	}
+	if len(disconnectErrs) < 2 || disconnectErrs[1] != events.ErrLivenessTimeout {
+		t.Fatalf("expected the quiet connection to time out, got %v", disconnectErrs)
+	}
+	if sub.Cursor() != 14 {
+		t.Fatalf("unexpected cursor %d", sub.Cursor())
+	}
+}
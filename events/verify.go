@@ -0,0 +1,289 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/did"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/bluesky-social/indigo/util/keyutil"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+	godid "github.com/whyrusleeping/go-did"
+)
+
+// ErrInvalidSignature is returned, wrapped, for commits whose signature
+// doesn't verify against their repo's key
+var ErrInvalidSignature = errors.New("invalid commit signature")
+
+// DefaultKeyRefetchInterval is how soon a repo's key can be refetched when a
+// commit fails to verify against the cached key
+const DefaultKeyRefetchInterval = time.Minute
+
+// SignatureVerifier checks the signatures of the commits in a repo stream
+// against the "#atproto" keys of their repos, which are resolved and cached.
+// Cached keys are dropped on the identity events of their repos (handle,
+// migrate, tombstone and account events), which come before any commits
+// signed with a new key.
+type SignatureVerifier struct {
+	Dir did.Resolver
+
+	// OnInvalid, if set, is called with each commit dropped by the handlers
+	// for failing verification
+	OnInvalid func(evt *comatproto.SyncSubscribeRepos_Commit, err error)
+
+	// RefetchInterval is how soon a repo's key may be refetched after a
+	// commit fails to verify, in case the key was rotated without an
+	// identity event being seen
+	RefetchInterval time.Duration
+
+	keys *lru.Cache
+
+	// fetchLk serializes fetches, so a burst of commits from one repo
+	// resolves its key once
+	fetchLk sync.Mutex
+}
+
+type cachedKey struct {
+	key     *godid.PubKey
+	fetched time.Time
+}
+
+// NewSignatureVerifier returns a verifier caching the keys of up to
+// cacheSize repos
+func NewSignatureVerifier(dir did.Resolver, cacheSize int) (*SignatureVerifier, error) {
+	keys, err := lru.New(cacheSize)
+	if err != nil {
+		return nil, err
+	}
+	return &SignatureVerifier{
+		Dir:             dir,
+		RefetchInterval: DefaultKeyRefetchInterval,
+		keys:            keys,
+	}, nil
+}
+
+// Verify checks the signature of a commit against its repo's key. TooBig
+// commits have no blocks to check, and pass; consumers fetching the repo
+// instead should check the commit they are given.
+func (sv *SignatureVerifier) Verify(ctx context.Context, evt *comatproto.SyncSubscribeRepos_Commit) error {
+	if evt.TooBig {
+		commitSignatureChecks.WithLabelValues("skipped").Inc()
+		return nil
+	}
+
+	err := sv.verify(ctx, evt)
+	switch {
+	case err == nil:
+		commitSignatureChecks.WithLabelValues("ok").Inc()
+	case errors.Is(err, ErrInvalidSignature):
+		commitSignatureChecks.WithLabelValues("invalid").Inc()
+	default:
+		commitSignatureChecks.WithLabelValues("error").Inc()
+	}
+	return err
+}
+
+func (sv *SignatureVerifier) verify(ctx context.Context, evt *comatproto.SyncSubscribeRepos_Commit) error {
+	sc, err := signedCommit(evt)
+	if err != nil {
+		return err
+	}
+	if sc.Did != evt.Repo {
+		return fmt.Errorf("%w: commit is for %s, not %s", ErrInvalidSignature, sc.Did, evt.Repo)
+	}
+
+	b, err := sc.Unsigned().BytesForSigning()
+	if err != nil {
+		return fmt.Errorf("encoding commit: %w", err)
+	}
+
+	ck, err := sv.repoKey(ctx, evt.Repo, false)
+	if err != nil {
+		return err
+	}
+
+	err = keyutil.Verify(ck.key, b, sc.Sig)
+	if err != nil && time.Since(ck.fetched) >= sv.RefetchInterval {
+		// the repo may have rotated its key since it was cached
+		ck, err = sv.repoKey(ctx, evt.Repo, true)
+		if err != nil {
+			return err
+		}
+		err = keyutil.Verify(ck.key, b, sc.Sig)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSignature, err)
+	}
+	return nil
+}
+
+// Invalidate drops the cached key of a repo, and its DID document if the
+// resolver caches them, so that the next commit resolves it again
+func (sv *SignatureVerifier) Invalidate(ctx context.Context, did string) {
+	sv.keys.Remove(did)
+
+	if p, ok := sv.Dir.(interface {
+		PurgeDid(context.Context, string) error
+	}); ok {
+		if err := p.PurgeDid(ctx, did); err != nil {
+			log.Warnw("failed to purge cached DID document", "did", did, "err", err)
+		}
+	}
+}
+
+// Handler wraps a stream event handler (as given to a Subscription), passing
+// it only the commits which verify, and invalidating keys on identity events
+func (sv *SignatureVerifier) Handler(next func(context.Context, *XRPCStreamEvent) error) func(context.Context, *XRPCStreamEvent) error {
+	return func(ctx context.Context, xev *XRPCStreamEvent) error {
+		switch {
+		case xev.RepoCommit != nil:
+			if !sv.check(ctx, xev.RepoCommit) {
+				return nil
+			}
+		case xev.RepoHandle != nil:
+			sv.Invalidate(ctx, xev.RepoHandle.Did)
+		case xev.RepoMigrate != nil:
+			sv.Invalidate(ctx, xev.RepoMigrate.Did)
+		case xev.RepoTombstone != nil:
+			sv.Invalidate(ctx, xev.RepoTombstone.Did)
+		case xev.RepoAccount != nil:
+			sv.Invalidate(ctx, xev.RepoAccount.Did)
+		}
+		return next(ctx, xev)
+	}
+}
+
+// Callbacks wraps the callbacks of RepoStreamCallbacks in the same way as
+// Handler
+func (sv *SignatureVerifier) Callbacks(rsc *RepoStreamCallbacks) *RepoStreamCallbacks {
+	ctx := context.Background()
+	out := *rsc
+
+	out.RepoCommit = func(evt *comatproto.SyncSubscribeRepos_Commit) error {
+		if !sv.check(ctx, evt) || rsc.RepoCommit == nil {
+			return nil
+		}
+		return rsc.RepoCommit(evt)
+	}
+	out.RepoHandle = func(evt *comatproto.SyncSubscribeRepos_Handle) error {
+		sv.Invalidate(ctx, evt.Did)
+		if rsc.RepoHandle == nil {
+			return nil
+		}
+		return rsc.RepoHandle(evt)
+	}
+	out.RepoMigrate = func(evt *comatproto.SyncSubscribeRepos_Migrate) error {
+		sv.Invalidate(ctx, evt.Did)
+		if rsc.RepoMigrate == nil {
+			return nil
+		}
+		return rsc.RepoMigrate(evt)
+	}
+	out.RepoTombstone = func(evt *comatproto.SyncSubscribeRepos_Tombstone) error {
+		sv.Invalidate(ctx, evt.Did)
+		if rsc.RepoTombstone == nil {
+			return nil
+		}
+		return rsc.RepoTombstone(evt)
+	}
+	out.RepoAccount = func(evt *comatproto.SyncSubscribeRepos_Account) error {
+		sv.Invalidate(ctx, evt.Did)
+		if rsc.RepoAccount == nil {
+			return nil
+		}
+		return rsc.RepoAccount(evt)
+	}
+	return &out
+}
+
+// check verifies a commit, passing it to OnInvalid if it fails
+func (sv *SignatureVerifier) check(ctx context.Context, evt *comatproto.SyncSubscribeRepos_Commit) bool {
+	err := sv.Verify(ctx, evt)
+	if err == nil {
+		return true
+	}
+
+	if sv.OnInvalid != nil {
+		sv.OnInvalid(evt, err)
+	} else {
+		log.Warnw("dropping commit failing signature verification", "repo", evt.Repo, "seq", evt.Seq, "err", err)
+	}
+	return false
+}
+
+func (sv *SignatureVerifier) repoKey(ctx context.Context, did string, refetch bool) (*cachedKey, error) {
+	if !refetch {
+		if ck, ok := sv.keys.Get(did); ok {
+			return ck.(*cachedKey), nil
+		}
+	}
+
+	sv.fetchLk.Lock()
+	defer sv.fetchLk.Unlock()
+
+	// another fetch may have finished while waiting
+	if ck, ok := sv.keys.Get(did); ok && (!refetch || time.Since(ck.(*cachedKey).fetched) < sv.RefetchInterval) {
+		return ck.(*cachedKey), nil
+	}
+
+	if refetch {
+		sv.Invalidate(ctx, did)
+	}
+
+	doc, err := sv.Dir.GetDocument(ctx, did)
+	if err != nil {
+		return nil, fmt.Errorf("resolving repo %q: %w", did, err)
+	}
+
+	key, err := keyutil.DocumentKey(doc, did, "#atproto")
+	if err != nil {
+		return nil, err
+	}
+
+	ck := &cachedKey{key: key, fetched: time.Now()}
+	sv.keys.Add(did, ck)
+	return ck, nil
+}
+
+// signedCommit reads a commit event's commit from its blocks
+func signedCommit(evt *comatproto.SyncSubscribeRepos_Commit) (*repo.SignedCommit, error) {
+	carr, err := car.NewCarReader(bytes.NewReader(evt.Blocks))
+	if err != nil {
+		return nil, fmt.Errorf("reading car slice: %w", err)
+	}
+
+	// the commit is the slice's root for streams not setting it
+	commit := cid.Cid(evt.Commit)
+	if !commit.Defined() && len(carr.Header.Roots) == 1 {
+		commit = carr.Header.Roots[0]
+	}
+
+	for {
+		blk, err := carr.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil, fmt.Errorf("commit %s is missing from the car slice", commit)
+			}
+			return nil, fmt.Errorf("reading car slice: %w", err)
+		}
+
+		if blk.Cid() != commit {
+			continue
+		}
+
+		var sc repo.SignedCommit
+		if err := sc.UnmarshalCBOR(bytes.NewReader(blk.RawData())); err != nil {
+			return nil, fmt.Errorf("decoding commit: %w", err)
+		}
+		return &sc, nil
+	}
+}
@@ -0,0 +1,211 @@
+package events_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"testing"
+
+	atproto "github.com/bluesky-social/indigo/api/atproto"
+	bsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/events"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/bluesky-social/indigo/util/keyutil"
+
+	blockformat "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	"github.com/stretchr/testify/assert"
+	godid "github.com/whyrusleeping/go-did"
+)
+
+type testResolver struct {
+	docs    map[string]*godid.Document
+	fetches int
+}
+
+func (tr *testResolver) GetDocument(ctx context.Context, d string) (*godid.Document, error) {
+	tr.fetches++
+	doc, ok := tr.docs[d]
+	if !ok {
+		return nil, fmt.Errorf("no such did: %s", d)
+	}
+	return doc, nil
+}
+
+func testKey(t *testing.T) (*godid.PrivKey, *godid.Document) {
+	key, err := godid.GeneratePrivKey(rand.Reader, godid.KeyTypeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm, err := godid.VerificationMethodFromKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.ID = "#atproto"
+
+	return key, &godid.Document{
+		VerificationMethod: []godid.VerificationMethod{*vm},
+	}
+}
+
+// recordingBlockstore keeps the blocks put in it, whose cids its keys lose
+type recordingBlockstore struct {
+	blockstore.Blockstore
+	blocks []blockformat.Block
+}
+
+func (rb *recordingBlockstore) Put(ctx context.Context, blk blockformat.Block) error {
+	rb.blocks = append(rb.blocks, blk)
+	return rb.Blockstore.Put(ctx, blk)
+}
+
+func (rb *recordingBlockstore) PutMany(ctx context.Context, blks []blockformat.Block) error {
+	rb.blocks = append(rb.blocks, blks...)
+	return rb.Blockstore.PutMany(ctx, blks)
+}
+
+// signedCommit returns a commit event for a new repo with a single post,
+// signed with key
+func signedCommit(t *testing.T, did string, key *godid.PrivKey) *atproto.SyncSubscribeRepos_Commit {
+	ctx := context.Background()
+	bs := &recordingBlockstore{Blockstore: blockstore.NewBlockstore(datastore.NewMapDatastore())}
+
+	r := repo.NewRepo(ctx, did, bs)
+	if _, _, err := r.CreateRecord(ctx, "app.bsky.feed.post", &bsky.FeedPost{Text: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	root, err := r.Commit(ctx, func(_ context.Context, _ string, msg []byte) ([]byte, error) {
+		return keyutil.Sign(key, msg)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{root}, Version: 1}, buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, blk := range bs.blocks {
+		if err := carutil.LdWrite(buf, blk.Cid().Bytes(), blk.RawData()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return &atproto.SyncSubscribeRepos_Commit{
+		Repo:   did,
+		Commit: lexutil.LexLink(root),
+		Blocks: buf.Bytes(),
+	}
+}
+
+func TestSignatureVerifier(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	aliceKey, aliceDoc := testKey(t)
+	bobKey, bobDoc := testKey(t)
+	dir := &testResolver{docs: map[string]*godid.Document{
+		"did:plc:alice": aliceDoc,
+		"did:plc:bob":   bobDoc,
+	}}
+
+	sv, err := events.NewSignatureVerifier(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(sv.Verify(ctx, signedCommit(t, "did:plc:alice", aliceKey)))
+	assert.NoError(sv.Verify(ctx, signedCommit(t, "did:plc:alice", aliceKey)))
+	assert.Equal(1, dir.fetches, "keys should be cached")
+
+	// signed with another repo's key
+	assert.ErrorIs(sv.Verify(ctx, signedCommit(t, "did:plc:alice", bobKey)), events.ErrInvalidSignature)
+
+	// a commit for another repo than the event's
+	evt := signedCommit(t, "did:plc:bob", bobKey)
+	evt.Repo = "did:plc:alice"
+	assert.ErrorIs(sv.Verify(ctx, evt), events.ErrInvalidSignature)
+
+	assert.Error(sv.Verify(ctx, signedCommit(t, "did:plc:unknown", bobKey)))
+	assert.NoError(sv.Verify(ctx, &atproto.SyncSubscribeRepos_Commit{Repo: "did:plc:alice", TooBig: true}))
+}
+
+func TestSignatureVerifierHandler(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	oldKey, oldDoc := testKey(t)
+	dir := &testResolver{docs: map[string]*godid.Document{"did:plc:alice": oldDoc}}
+	sv, err := events.NewSignatureVerifier(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var invalid []error
+	sv.OnInvalid = func(evt *atproto.SyncSubscribeRepos_Commit, err error) {
+		invalid = append(invalid, err)
+	}
+
+	var got []*events.XRPCStreamEvent
+	h := sv.Handler(func(ctx context.Context, xev *events.XRPCStreamEvent) error {
+		got = append(got, xev)
+		return nil
+	})
+
+	assert.NoError(h(ctx, &events.XRPCStreamEvent{RepoCommit: signedCommit(t, "did:plc:alice", oldKey)}))
+	assert.Len(got, 1)
+
+	newKey, newDoc := testKey(t)
+	dir.docs["did:plc:alice"] = newDoc
+
+	// the cached key was fetched too recently to refetch
+	rotated := &events.XRPCStreamEvent{RepoCommit: signedCommit(t, "did:plc:alice", newKey)}
+	assert.NoError(h(ctx, rotated))
+	assert.Len(got, 1)
+	assert.Len(invalid, 1)
+	assert.ErrorIs(invalid[0], events.ErrInvalidSignature)
+	assert.Equal(1, dir.fetches)
+
+	// until an identity event drops it
+	assert.NoError(h(ctx, &events.XRPCStreamEvent{RepoHandle: &atproto.SyncSubscribeRepos_Handle{Did: "did:plc:alice", Handle: "alice.test"}}))
+	assert.NoError(h(ctx, rotated))
+	assert.Len(got, 3)
+	assert.Len(invalid, 1)
+	assert.Equal(2, dir.fetches)
+}
+
+func TestSignatureVerifierCallbacks(t *testing.T) {
+	key, doc := testKey(t)
+	otherKey, _ := testKey(t)
+	sv, err := events.NewSignatureVerifier(&testResolver{docs: map[string]*godid.Document{"did:plc:alice": doc}}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sv.OnInvalid = func(evt *atproto.SyncSubscribeRepos_Commit, err error) {}
+
+	var commits int
+	rsc := sv.Callbacks(&events.RepoStreamCallbacks{
+		RepoCommit: func(evt *atproto.SyncSubscribeRepos_Commit) error {
+			commits++
+			return nil
+		},
+	})
+
+	ctx := context.Background()
+	for _, k := range []*godid.PrivKey{key, otherKey} {
+		if err := rsc.EventHandler(ctx, &events.XRPCStreamEvent{RepoCommit: signedCommit(t, "did:plc:alice", k)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.Equal(t, 1, commits)
+
+	// callbacks which weren't set are still safe to call
+	assert.NoError(t, rsc.EventHandler(ctx, &events.XRPCStreamEvent{RepoTombstone: &atproto.SyncSubscribeRepos_Tombstone{Did: "did:plc:alice"}}))
+}
@@ -33,6 +33,8 @@ func (yp *YoloPersister) Persist(ctx context.Context, e *XRPCStreamEvent) error
 		e.RepoMigrate.Seq = yp.seq
 	case e.RepoTombstone != nil:
 		e.RepoTombstone.Seq = yp.seq
+	case e.RepoAccount != nil:
+		e.RepoAccount.Seq = yp.seq
 	case e.LabelLabels != nil:
 		e.LabelLabels.Seq = yp.seq
 	default:
@@ -0,0 +1,536 @@
+// Deterministic datasets: a follow graph and a schedule of posts, replies,
+// likes and reposts over a span of time, all derived from a seed, so that the
+// same dataset can be loaded into any number of test environments.
+
+package fakedata
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/brianvoe/gofakeit/v6"
+)
+
+// The kinds of dataset actions
+const (
+	ActionFollow = "follow"
+	ActionPost   = "post"
+	ActionLike   = "like"
+	ActionRepost = "repost"
+)
+
+type DatasetConfig struct {
+	Seed int64 `json:"seed"`
+	// Accounts is the total number of accounts, of which Celebrities are
+	// celebrities (many followers, twice the posts)
+	Accounts    int           `json:"accounts"`
+	Celebrities int           `json:"celebrities"`
+	Start       time.Time     `json:"start"`
+	Duration    time.Duration `json:"duration"`
+	// PostsPerDay is the mean number of posts (including replies) per account
+	// and day. Some accounts post a lot more than others.
+	PostsPerDay float64 `json:"postsPerDay"`
+	// FollowsPerAccount is the mean number of accounts followed
+	FollowsPerAccount float64 `json:"followsPerAccount"`
+	// FracReply, FracImage and FracMention are the fractions of posts which
+	// are replies, have an image, and mention an account
+	FracReply   float64 `json:"fracReply"`
+	FracImage   float64 `json:"fracImage"`
+	FracMention float64 `json:"fracMention"`
+	// FracLike and FracRepost are the fractions of the followers of an author
+	// who like and repost each of their posts
+	FracLike   float64 `json:"fracLike"`
+	FracRepost float64 `json:"fracRepost"`
+}
+
+func DefaultDatasetConfig() DatasetConfig {
+	return DatasetConfig{
+		Seed:              1,
+		Accounts:          100,
+		Celebrities:       10,
+		Start:             time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+		Duration:          24 * time.Hour,
+		PostsPerDay:       5,
+		FollowsPerAccount: 30,
+		FracReply:         0.3,
+		FracImage:         0.15,
+		FracMention:       0.1,
+		FracLike:          0.05,
+		FracRepost:        0.01,
+	}
+}
+
+func (cfg *DatasetConfig) check() error {
+	if cfg.Accounts < 2 {
+		return fmt.Errorf("need at least 2 accounts")
+	}
+	if cfg.Celebrities < 0 || cfg.Celebrities > cfg.Accounts {
+		return fmt.Errorf("more celebrities than total accounts!")
+	}
+	if cfg.Duration <= 0 {
+		return fmt.Errorf("dataset duration must be positive")
+	}
+	if cfg.PostsPerDay < 0 || cfg.FollowsPerAccount < 0 {
+		return fmt.Errorf("posts per day and follows per account can't be negative")
+	}
+	for _, f := range []float64{cfg.FracReply, cfg.FracImage, cfg.FracMention, cfg.FracLike, cfg.FracRepost} {
+		if f < 0 || f > 1 {
+			return fmt.Errorf("fractions must be between 0 and 1, got %f", f)
+		}
+	}
+	return nil
+}
+
+type DatasetAccount struct {
+	// 0-based index, in the order of AccountCatalog.Combined (celebrities
+	// first)
+	Index       int    `json:"index"`
+	AccountType string `json:"accountType"`
+	// Activity scales how much the account posts, around 1
+	Activity float64 `json:"activity"`
+}
+
+// DatasetAction is something an account does at a point in time. Accounts
+// are referred to by index, and posts by ID: posts get IDs from 1 in the order
+// they are made.
+type DatasetAction struct {
+	Time  time.Time `json:"time"`
+	Kind  string    `json:"kind"`
+	Actor int       `json:"actor"`
+	// Subject is the account followed
+	Subject *int `json:"subject,omitempty"`
+	// Post is the post made, liked or reposted
+	Post int `json:"post,omitempty"`
+	// Parent and Root are the posts a reply is to
+	Parent int `json:"parent,omitempty"`
+	Root   int `json:"root,omitempty"`
+	// Text and Mention (an account) are for posts
+	Text    string `json:"text,omitempty"`
+	Mention *int   `json:"mention,omitempty"`
+	// Image is the seed of the image of a post (see DatasetImage), if it has
+	// one
+	Image int64 `json:"image,omitempty"`
+}
+
+type Dataset struct {
+	Config   DatasetConfig
+	Accounts []DatasetAccount
+	// Actions are ordered by time
+	Actions []DatasetAction
+}
+
+// CountPosts returns the number of posts made in the dataset
+func (ds *Dataset) CountPosts() int {
+	n := 0
+	for _, act := range ds.Actions {
+		if act.Kind == ActionPost {
+			n++
+		}
+	}
+	return n
+}
+
+// popularityExponent shapes how follows concentrate on popular accounts: the
+// account ranked n gets follows in proportion to 1/n^popularityExponent
+const popularityExponent = 0.8
+
+// replyWindow is how many of the latest posts replies are picked from
+const replyWindow = 500
+
+type datasetPost struct {
+	author int
+	root   int
+	time   time.Time
+}
+
+type datasetFollower struct {
+	actor int
+	time  time.Time
+}
+
+type datasetGen struct {
+	cfg   DatasetConfig
+	rng   *rand.Rand
+	faker *gofakeit.Faker
+	ds    *Dataset
+
+	// popularity is the cumulative follow weight of accounts
+	popularity []float64
+	following  [][]int
+	followers  [][]datasetFollower
+	follows    []map[int]bool
+	posts      []datasetPost
+}
+
+// GenDataset generates a dataset. The same config always generates the same
+// dataset.
+func GenDataset(cfg DatasetConfig) (*Dataset, error) {
+	if err := cfg.check(); err != nil {
+		return nil, err
+	}
+
+	rng := rand.New(rand.NewSource(cfg.Seed))
+	g := &datasetGen{
+		cfg:   cfg,
+		rng:   rng,
+		faker: gofakeit.NewUnlocked(rng.Int63() | 1),
+		ds:    &Dataset{Config: cfg},
+	}
+	g.genAccounts()
+	g.genFollows()
+	g.genPosts()
+	g.genInteractions()
+
+	for i := range g.ds.Actions {
+		g.ds.Actions[i].Time = g.ds.Actions[i].Time.Truncate(time.Millisecond)
+	}
+	sort.SliceStable(g.ds.Actions, func(i, j int) bool {
+		return g.ds.Actions[i].Time.Before(g.ds.Actions[j].Time)
+	})
+	return g.ds, nil
+}
+
+func (g *datasetGen) end() time.Time {
+	return g.cfg.Start.Add(g.cfg.Duration)
+}
+
+func (g *datasetGen) genAccounts() {
+	n := g.cfg.Accounts
+	g.following = make([][]int, n)
+	g.followers = make([][]datasetFollower, n)
+	g.follows = make([]map[int]bool, n)
+
+	// celebrities are the most popular accounts, and the popularity of the
+	// rest is shuffled
+	rank := make([]int, n)
+	for i, r := range g.rng.Perm(n - g.cfg.Celebrities) {
+		rank[g.cfg.Celebrities+i] = g.cfg.Celebrities + r
+	}
+	for i := 0; i < g.cfg.Celebrities; i++ {
+		rank[i] = i
+	}
+
+	g.popularity = make([]float64, n)
+	total := 0.0
+	for i := 0; i < n; i++ {
+		accountType := "regular"
+		// log-normal, with a mean of 1
+		activity := math.Exp(g.rng.NormFloat64() - 0.5)
+		if i < g.cfg.Celebrities {
+			accountType = "celebrity"
+			activity *= 2
+		}
+		g.ds.Accounts = append(g.ds.Accounts, DatasetAccount{
+			Index:       i,
+			AccountType: accountType,
+			Activity:    activity,
+		})
+
+		total += 1 / math.Pow(float64(rank[i]+1), popularityExponent)
+		g.popularity[i] = total
+		g.follows[i] = make(map[int]bool)
+	}
+}
+
+// pickPopular picks an account, weighted by popularity
+func (g *datasetGen) pickPopular() int {
+	total := g.popularity[len(g.popularity)-1]
+	return sort.SearchFloat64s(g.popularity, g.rng.Float64()*total)
+}
+
+// poisson samples a poisson distribution with mean lambda
+func (g *datasetGen) poisson(lambda float64) int {
+	if lambda <= 0 {
+		return 0
+	}
+	if lambda > 30 {
+		// normal approximation
+		n := int(math.Round(lambda + math.Sqrt(lambda)*g.rng.NormFloat64()))
+		if n < 0 {
+			return 0
+		}
+		return n
+	}
+	l := math.Exp(-lambda)
+	k := 0
+	for p := g.rng.Float64(); p > l; p *= g.rng.Float64() {
+		k++
+	}
+	return k
+}
+
+func (g *datasetGen) genFollows() {
+	n := g.cfg.Accounts
+	for actor := 0; actor < n; actor++ {
+		count := int(g.rng.ExpFloat64() * g.cfg.FollowsPerAccount)
+		if count > n-1 {
+			count = n - 1
+		}
+		for tries := 0; len(g.following[actor]) < count && tries < 4*count; tries++ {
+			tgt := g.pickPopular()
+			if tgt == actor || g.follows[actor][tgt] {
+				continue
+			}
+			// most of the graph is in place before posting picks up
+			t := g.cfg.Start.Add(time.Duration(g.rng.Float64() * float64(g.cfg.Duration) / 10))
+			g.follows[actor][tgt] = true
+			g.following[actor] = append(g.following[actor], tgt)
+			g.followers[tgt] = append(g.followers[tgt], datasetFollower{actor: actor, time: t})
+
+			subject := tgt
+			g.ds.Actions = append(g.ds.Actions, DatasetAction{
+				Time:    t,
+				Kind:    ActionFollow,
+				Actor:   actor,
+				Subject: &subject,
+			})
+		}
+	}
+}
+
+// postTime picks the time of a post, following a daily cycle peaking in the
+// evening (UTC)
+func (g *datasetGen) postTime() time.Time {
+	for {
+		t := g.cfg.Start.Add(time.Duration(g.rng.Float64() * float64(g.cfg.Duration)))
+		hour := float64(t.Hour()) + float64(t.Minute())/60
+		weight := (1 + 0.6*math.Cos(2*math.Pi*(hour-20)/24)) / 1.6
+		if g.rng.Float64() < weight {
+			return t
+		}
+	}
+}
+
+// pickParent picks a recent post for actor to reply to, preferring the posts
+// of accounts they follow. Returns 0 if there are none.
+func (g *datasetGen) pickParent(actor int) int {
+	if len(g.posts) == 0 {
+		return 0
+	}
+	from := len(g.posts) - replyWindow
+	if from < 0 {
+		from = 0
+	}
+	fallback := 0
+	for tries := 0; tries < 20; tries++ {
+		id := from + g.rng.Intn(len(g.posts)-from) + 1
+		author := g.posts[id-1].author
+		if author == actor {
+			continue
+		}
+		if g.follows[actor][author] {
+			return id
+		}
+		if fallback == 0 {
+			fallback = id
+		}
+	}
+	return fallback
+}
+
+func (g *datasetGen) genPosts() {
+	type slot struct {
+		actor int
+		time  time.Time
+	}
+	var slots []slot
+	days := g.cfg.Duration.Hours() / 24
+	for _, acc := range g.ds.Accounts {
+		count := g.poisson(g.cfg.PostsPerDay * days * acc.Activity)
+		for i := 0; i < count; i++ {
+			slots = append(slots, slot{actor: acc.Index, time: g.postTime()})
+		}
+	}
+	sort.SliceStable(slots, func(i, j int) bool {
+		return slots[i].time.Before(slots[j].time)
+	})
+
+	for _, s := range slots {
+		act := DatasetAction{
+			Time:  s.time,
+			Kind:  ActionPost,
+			Actor: s.actor,
+			Post:  len(g.posts) + 1,
+		}
+		post := datasetPost{author: s.actor, root: act.Post, time: s.time}
+
+		if g.cfg.FracReply > 0 && g.rng.Float64() < g.cfg.FracReply {
+			if parent := g.pickParent(s.actor); parent != 0 {
+				act.Parent = parent
+				act.Root = g.posts[parent-1].root
+				post.root = act.Root
+			}
+		}
+
+		act.Text = g.faker.Sentence(3 + g.rng.Intn(15))
+		if len(act.Text) > 200 {
+			act.Text = act.Text[0:200]
+		}
+
+		if g.cfg.FracMention > 0 && g.rng.Float64() < g.cfg.FracMention {
+			var tgt int
+			if following := g.following[s.actor]; len(following) > 0 {
+				tgt = following[g.rng.Intn(len(following))]
+			} else {
+				tgt = g.pickPopular()
+			}
+			if tgt != s.actor {
+				act.Mention = &tgt
+			}
+		}
+
+		if g.cfg.FracImage > 0 && g.rng.Float64() < g.cfg.FracImage {
+			act.Image = g.rng.Int63() | 1
+		}
+
+		g.posts = append(g.posts, post)
+		g.ds.Actions = append(g.ds.Actions, act)
+	}
+}
+
+// genInteractions has followers of the authors of posts like and repost them,
+// some time after they are made (or they followed)
+func (g *datasetGen) genInteractions() {
+	for i, post := range g.posts {
+		followers := g.followers[post.author]
+		g.interact(i+1, post, followers, ActionLike, g.cfg.FracLike, 2*time.Hour)
+		g.interact(i+1, post, followers, ActionRepost, g.cfg.FracRepost, time.Hour)
+	}
+}
+
+func (g *datasetGen) interact(id int, post datasetPost, followers []datasetFollower, kind string, frac float64, meanDelay time.Duration) {
+	if len(followers) == 0 || frac <= 0 {
+		return
+	}
+	count := g.poisson(frac * float64(len(followers)))
+	if count > len(followers) {
+		count = len(followers)
+	}
+	seen := make(map[int]bool, count)
+	for tries := 0; len(seen) < count && tries < 4*count; tries++ {
+		f := followers[g.rng.Intn(len(followers))]
+		if seen[f.actor] {
+			continue
+		}
+		seen[f.actor] = true
+
+		from := post.time
+		if f.time.After(from) {
+			from = f.time
+		}
+		t := from.Add(time.Duration(g.rng.ExpFloat64() * float64(meanDelay)))
+		if !t.Before(g.end()) {
+			continue
+		}
+		g.ds.Actions = append(g.ds.Actions, DatasetAction{
+			Time:  t,
+			Kind:  kind,
+			Actor: f.actor,
+			Post:  id,
+		})
+	}
+}
+
+type datasetHeader struct {
+	Config   DatasetConfig    `json:"config"`
+	Accounts []DatasetAccount `json:"accounts"`
+}
+
+// Write writes a dataset as JSON lines: a header with the config and the
+// accounts, then an action per line
+func (ds *Dataset) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(&datasetHeader{Config: ds.Config, Accounts: ds.Accounts}); err != nil {
+		return err
+	}
+	for i := range ds.Actions {
+		if err := enc.Encode(&ds.Actions[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ReadDataset(path string) (*Dataset, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	var hdr datasetHeader
+	if err := decoder.Decode(&hdr); err != nil {
+		return nil, fmt.Errorf("parse dataset header: %w", err)
+	}
+	ds := &Dataset{Config: hdr.Config, Accounts: hdr.Accounts}
+	for decoder.More() {
+		var act DatasetAction
+		if err := decoder.Decode(&act); err != nil {
+			return nil, fmt.Errorf("parse DatasetAction: %w", err)
+		}
+		for _, idx := range []*int{&act.Actor, act.Subject, act.Mention} {
+			if idx != nil && (*idx < 0 || *idx >= len(ds.Accounts)) {
+				return nil, fmt.Errorf("action with unknown account: %d", *idx)
+			}
+		}
+		ds.Actions = append(ds.Actions, act)
+	}
+	log.Infof("loaded dataset: accounts=%d actions=%d", len(ds.Accounts), len(ds.Actions))
+	return ds, nil
+}
+
+// DatasetImage generates the JPEG image of a seed: a gradient with a few
+// circles, which compresses about as well as a photo does
+func DatasetImage(seed int64) []byte {
+	rng := rand.New(rand.NewSource(seed))
+	sizes := [][2]int{{800, 800}, {1000, 750}, {750, 1000}, {1200, 675}}
+	size := sizes[rng.Intn(len(sizes))]
+	w, h := size[0], size[1]
+
+	randColor := func() color.RGBA {
+		return color.RGBA{uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)), 0xff}
+	}
+	top, bottom := randColor(), randColor()
+	type circle struct {
+		x, y, r int
+		c       color.RGBA
+	}
+	circles := make([]circle, 3+rng.Intn(6))
+	for i := range circles {
+		circles[i] = circle{x: rng.Intn(w), y: rng.Intn(h), r: 20 + rng.Intn(w/4), c: randColor()}
+	}
+
+	mix := func(a, b uint8, f float64) uint8 {
+		return uint8(float64(a)*(1-f) + float64(b)*f)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		f := float64(y) / float64(h)
+		bg := color.RGBA{mix(top.R, bottom.R, f), mix(top.G, bottom.G, f), mix(top.B, bottom.B, f), 0xff}
+		for x := 0; x < w; x++ {
+			c := bg
+			for _, cl := range circles {
+				dx, dy := x-cl.x, y-cl.y
+				if dx*dx+dy*dy < cl.r*cl.r {
+					c = cl.c
+				}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	jpeg.Encode(buf, img, &jpeg.Options{Quality: 85})
+	return buf.Bytes()
+}
@@ -0,0 +1,143 @@
+package fakedata
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenDatasetDeterministic(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := DefaultDatasetConfig()
+	a, err := GenDataset(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := GenDataset(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(reflect.DeepEqual(a, b), "same config should generate the same dataset")
+
+	cfg.Seed = 2
+	c, err := GenDataset(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(reflect.DeepEqual(a.Actions, c.Actions), "different seeds should generate different datasets")
+}
+
+func TestGenDatasetShape(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := DefaultDatasetConfig()
+	cfg.Accounts = 300
+	cfg.Celebrities = 5
+	ds, err := GenDataset(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	end := cfg.Start.Add(cfg.Duration)
+	followers := make([]int, cfg.Accounts)
+	follows := make(map[[2]int]bool)
+	posts := make(map[int]int)
+	counts := make(map[string]int)
+	for i, act := range ds.Actions {
+		counts[act.Kind]++
+		if i > 0 && act.Time.Before(ds.Actions[i-1].Time) {
+			t.Fatalf("actions out of order at %d", i)
+		}
+		if act.Time.Before(cfg.Start) || !act.Time.Before(end) {
+			t.Fatalf("action outside of the dataset time span: %s", act.Time)
+		}
+
+		switch act.Kind {
+		case ActionFollow:
+			key := [2]int{act.Actor, *act.Subject}
+			assert.NotEqual(act.Actor, *act.Subject, "self follow")
+			assert.False(follows[key], "duplicate follow")
+			follows[key] = true
+			followers[*act.Subject]++
+		case ActionPost:
+			// posts are numbered in order, and replies are to earlier posts
+			assert.Equal(len(posts)+1, act.Post)
+			if act.Parent != 0 {
+				assert.Contains(posts, act.Parent)
+				assert.Contains(posts, act.Root)
+				assert.NotEqual(act.Actor, posts[act.Parent], "reply to self")
+			}
+			if act.Mention != nil {
+				assert.NotEqual(act.Actor, *act.Mention, "mention of self")
+			}
+			posts[act.Post] = act.Actor
+		case ActionLike, ActionRepost:
+			author, ok := posts[act.Post]
+			assert.True(ok, "like or repost of a post not made yet")
+			assert.True(follows[[2]int{act.Actor, author}], "like or repost by a non-follower")
+		default:
+			t.Fatalf("unexpected action kind: %s", act.Kind)
+		}
+	}
+
+	for _, kind := range []string{ActionFollow, ActionPost, ActionLike, ActionRepost} {
+		assert.NotZero(counts[kind], kind)
+	}
+
+	// celebrities have more followers than most
+	celebFollowers := 0
+	for i := 0; i < cfg.Celebrities; i++ {
+		celebFollowers += followers[i]
+	}
+	total := 0
+	for _, n := range followers {
+		total += n
+	}
+	assert.Greater(float64(celebFollowers)/float64(cfg.Celebrities), 3*float64(total)/float64(cfg.Accounts))
+}
+
+func TestDatasetRoundTrip(t *testing.T) {
+	cfg := DefaultDatasetConfig()
+	cfg.Accounts = 20
+	cfg.Celebrities = 2
+	ds, err := GenDataset(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := ds.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "dataset.json")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := ReadDataset(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ds.Accounts, read.Accounts)
+	assert.Equal(t, len(ds.Actions), len(read.Actions))
+	for i := range ds.Actions {
+		if !ds.Actions[i].Time.Equal(read.Actions[i].Time) {
+			t.Fatalf("action %d time changed: %s != %s", i, ds.Actions[i].Time, read.Actions[i].Time)
+		}
+		read.Actions[i].Time = ds.Actions[i].Time
+	}
+	assert.Equal(t, ds.Actions, read.Actions)
+}
+
+func TestDatasetImage(t *testing.T) {
+	a := DatasetImage(42)
+	assert.Equal(t, a, DatasetImage(42))
+	assert.NotEqual(t, a, DatasetImage(43))
+	// JPEG magic
+	assert.Equal(t, []byte{0xff, 0xd8}, a[:2])
+}
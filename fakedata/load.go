@@ -0,0 +1,296 @@
+package fakedata
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/xrpc"
+
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"golang.org/x/sync/errgroup"
+)
+
+// DatasetLoader makes the actions of a dataset in a PDS, as the accounts of
+// a catalog (dataset account N is catalog.Combined()[N]).
+type DatasetLoader struct {
+	PdsHost string
+	Catalog *AccountCatalog
+	Dataset *Dataset
+	// Jobs is the number of parallel workers. Each account's actions are
+	// made by one worker, in order.
+	Jobs int
+	// Speedup paces actions to the dataset schedule, sped up by this factor
+	// (eg 60 for an hour of activity a minute), with the current time as
+	// their creation time. If zero, actions are made as fast as possible,
+	// back-dated to the dataset schedule.
+	Speedup float64
+
+	accounts []AccountContext
+	posts    []loadedPost
+	done     int64
+}
+
+type loadedPost struct {
+	ref  *comatproto.RepoStrongRef
+	made chan struct{}
+}
+
+// Run makes all the actions of the dataset, and returns after the last one,
+// or the first error
+func (dl *DatasetLoader) Run(ctx context.Context) error {
+	dl.accounts = dl.Catalog.Combined()
+	if len(dl.accounts) < len(dl.Dataset.Accounts) {
+		return fmt.Errorf("dataset has more accounts than catalog: %d > %d", len(dl.Dataset.Accounts), len(dl.accounts))
+	}
+	for _, acc := range dl.Dataset.Accounts {
+		if dl.accounts[acc.Index].AccountType != acc.AccountType {
+			log.Warnf("account %d is a %s in the dataset, but a %s in the catalog", acc.Index, acc.AccountType, dl.accounts[acc.Index].AccountType)
+			break
+		}
+	}
+
+	dl.posts = make([]loadedPost, dl.Dataset.CountPosts())
+	for i := range dl.posts {
+		dl.posts[i].made = make(chan struct{})
+	}
+
+	jobs := dl.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	eg, ctx := errgroup.WithContext(ctx)
+	queues := make([]chan *DatasetAction, jobs)
+	for i := range queues {
+		queue := make(chan *DatasetAction, 100)
+		queues[i] = queue
+		eg.Go(func() error {
+			return dl.work(ctx, queue)
+		})
+	}
+
+	t1 := MeasureIterations("load dataset")
+	eg.Go(func() error {
+		defer func() {
+			for _, q := range queues {
+				close(q)
+			}
+		}()
+		return dl.dispatch(ctx, queues)
+	})
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go dl.logProgress(stop)
+
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	t1(len(dl.Dataset.Actions))
+	return nil
+}
+
+func (dl *DatasetLoader) logProgress(stop chan struct{}) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			log.Infof("dataset progress: actions=%d/%d", atomic.LoadInt64(&dl.done), len(dl.Dataset.Actions))
+		}
+	}
+}
+
+// dispatch queues actions to the workers of their accounts, on schedule if
+// paced
+func (dl *DatasetLoader) dispatch(ctx context.Context, queues []chan *DatasetAction) error {
+	start := time.Now()
+	for i := range dl.Dataset.Actions {
+		act := &dl.Dataset.Actions[i]
+		if dl.Speedup > 0 {
+			at := start.Add(time.Duration(float64(act.Time.Sub(dl.Dataset.Config.Start)) / dl.Speedup))
+			if wait := time.Until(at); wait > 0 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(wait):
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case queues[act.Actor%len(queues)] <- act:
+		}
+	}
+	return nil
+}
+
+func (dl *DatasetLoader) work(ctx context.Context, queue chan *DatasetAction) error {
+	clients := make(map[int]*xrpc.Client)
+	for act := range queue {
+		xrpcc, ok := clients[act.Actor]
+		if !ok {
+			var err error
+			xrpcc, err = AccountXrpcClient(dl.PdsHost, &dl.accounts[act.Actor])
+			if err != nil {
+				return fmt.Errorf("logging in account %d: %w", act.Actor, err)
+			}
+			clients[act.Actor] = xrpcc
+		}
+
+		createdAt := act.Time
+		if dl.Speedup > 0 {
+			createdAt = time.Now()
+		}
+		if err := dl.makeAction(ctx, xrpcc, act, createdAt.UTC().Format(time.RFC3339)); err != nil {
+			return fmt.Errorf("%s by account %d: %w", act.Kind, act.Actor, err)
+		}
+		atomic.AddInt64(&dl.done, 1)
+	}
+	return nil
+}
+
+// waitPost waits for a post to have been made by another worker. Posts are
+// always made before the actions referring to them are dispatched, so this
+// can't deadlock.
+func (dl *DatasetLoader) waitPost(ctx context.Context, id int) (*comatproto.RepoStrongRef, error) {
+	if id < 1 || id > len(dl.posts) {
+		return nil, fmt.Errorf("unknown post: %d", id)
+	}
+	p := &dl.posts[id-1]
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-p.made:
+		return p.ref, nil
+	}
+}
+
+func (dl *DatasetLoader) createRecord(ctx context.Context, xrpcc *xrpc.Client, collection string, rec cbg.CBORMarshaler) (*comatproto.RepoStrongRef, error) {
+	resp, err := comatproto.RepoCreateRecord(ctx, xrpcc, &comatproto.RepoCreateRecord_Input{
+		Collection: collection,
+		Repo:       xrpcc.Auth.Did,
+		Record:     &lexutil.LexiconTypeDecoder{Val: rec},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &comatproto.RepoStrongRef{Uri: resp.Uri, Cid: resp.Cid}, nil
+}
+
+func (dl *DatasetLoader) makeAction(ctx context.Context, xrpcc *xrpc.Client, act *DatasetAction, createdAt string) error {
+	switch act.Kind {
+	case ActionFollow:
+		if act.Subject == nil {
+			return fmt.Errorf("follow without subject")
+		}
+		_, err := dl.createRecord(ctx, xrpcc, "app.bsky.graph.follow", &appbsky.GraphFollow{
+			CreatedAt: createdAt,
+			Subject:   dl.accounts[*act.Subject].Auth.Did,
+		})
+		return err
+	case ActionPost:
+		return dl.makePost(ctx, xrpcc, act, createdAt)
+	case ActionLike:
+		subject, err := dl.waitPost(ctx, act.Post)
+		if err != nil {
+			return err
+		}
+		_, err = dl.createRecord(ctx, xrpcc, "app.bsky.feed.like", &appbsky.FeedLike{
+			CreatedAt: createdAt,
+			Subject:   subject,
+		})
+		return err
+	case ActionRepost:
+		subject, err := dl.waitPost(ctx, act.Post)
+		if err != nil {
+			return err
+		}
+		_, err = dl.createRecord(ctx, xrpcc, "app.bsky.feed.repost", &appbsky.FeedRepost{
+			CreatedAt: createdAt,
+			Subject:   subject,
+		})
+		return err
+	default:
+		return fmt.Errorf("unhandled action kind: %s", act.Kind)
+	}
+}
+
+func (dl *DatasetLoader) makePost(ctx context.Context, xrpcc *xrpc.Client, act *DatasetAction, createdAt string) error {
+	if act.Post < 1 || act.Post > len(dl.posts) {
+		return fmt.Errorf("unknown post: %d", act.Post)
+	}
+
+	post := appbsky.FeedPost{
+		Text:      act.Text,
+		CreatedAt: createdAt,
+	}
+
+	if act.Parent != 0 {
+		parent, err := dl.waitPost(ctx, act.Parent)
+		if err != nil {
+			return err
+		}
+		root, err := dl.waitPost(ctx, act.Root)
+		if err != nil {
+			return err
+		}
+		post.Reply = &appbsky.FeedPost_ReplyRef{
+			Parent: parent,
+			Root:   root,
+		}
+	}
+
+	if act.Mention != nil {
+		tgt := dl.accounts[*act.Mention]
+		mention := "@" + tgt.Auth.Handle
+		post.Text = mention + " " + post.Text
+		post.Facets = []*appbsky.RichtextFacet{{
+			Features: []*appbsky.RichtextFacet_Features_Elem{{
+				RichtextFacet_Mention: &appbsky.RichtextFacet_Mention{
+					Did: tgt.Auth.Did,
+				},
+			}},
+			Index: &appbsky.RichtextFacet_ByteSlice{
+				ByteStart: 0,
+				ByteEnd:   int64(len(mention)),
+			},
+		}}
+	}
+
+	if act.Image != 0 {
+		resp, err := comatproto.RepoUploadBlob(ctx, xrpcc, bytes.NewReader(DatasetImage(act.Image)))
+		if err != nil {
+			return err
+		}
+		post.Embed = &appbsky.FeedPost_Embed{
+			EmbedImages: &appbsky.EmbedImages{
+				Images: []*appbsky.EmbedImages_Image{{
+					Alt: act.Text,
+					Image: &lexutil.LexBlob{
+						Ref:      resp.Blob.Ref,
+						MimeType: "image/jpeg",
+						Size:     resp.Blob.Size,
+					},
+				}},
+			},
+		}
+	}
+
+	ref, err := dl.createRecord(ctx, xrpcc, "app.bsky.feed.post", &post)
+	if err != nil {
+		return err
+	}
+	p := &dl.posts[act.Post-1]
+	p.ref = ref
+	close(p.made)
+	return nil
+}
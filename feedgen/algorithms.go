@@ -0,0 +1,77 @@
+package feedgen
+
+import (
+	"context"
+	"strings"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/util/extract"
+)
+
+// StoredFeed is the Skeleton of algorithms whose feed is just the posts they
+// chose with Index, newest first
+func StoredFeed(ctx context.Context, store *Store, req *SkeletonRequest) (*appbsky.FeedGetFeedSkeleton_Output, error) {
+	return store.FeedPage(ctx, req.Feed, req.Cursor, req.Limit)
+}
+
+// TagFeed is a feed of the posts with any of a set of hashtags
+type TagFeed struct {
+	FeedName string
+	Tags     []string
+}
+
+// NewTagFeed returns a feed of the posts with any of the hashtags, which are
+// given with or without the #
+func NewTagFeed(name string, tags []string) *TagFeed {
+	tf := &TagFeed{FeedName: name}
+	for _, t := range tags {
+		tf.Tags = append(tf.Tags, strings.ToLower(strings.TrimPrefix(t, "#")))
+	}
+	return tf
+}
+
+func (tf *TagFeed) Name() string {
+	return tf.FeedName
+}
+
+func (tf *TagFeed) Index(ctx context.Context, post *Post, rec *appbsky.FeedPost) bool {
+	c, _ := extract.Record(rec)
+	for _, have := range c.Tags {
+		for _, want := range tf.Tags {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (tf *TagFeed) Skeleton(ctx context.Context, store *Store, req *SkeletonRequest) (*appbsky.FeedGetFeedSkeleton_Output, error) {
+	return StoredFeed(ctx, store, req)
+}
+
+// AuthorFeed is a feed of the posts, not replies, of a set of accounts
+type AuthorFeed struct {
+	FeedName string
+	DIDs     []string
+}
+
+func (af *AuthorFeed) Name() string {
+	return af.FeedName
+}
+
+func (af *AuthorFeed) Index(ctx context.Context, post *Post, rec *appbsky.FeedPost) bool {
+	if rec.Reply != nil {
+		return false
+	}
+	for _, d := range af.DIDs {
+		if post.Did == d {
+			return true
+		}
+	}
+	return false
+}
+
+func (af *AuthorFeed) Skeleton(ctx context.Context, store *Store, req *SkeletonRequest) (*appbsky.FeedGetFeedSkeleton_Output, error) {
+	return StoredFeed(ctx, store, req)
+}
@@ -0,0 +1,159 @@
+// Package feedgen hosts custom feeds: it serves app.bsky.feed.getFeedSkeleton
+// for a set of feed algorithms, from posts it indexes off the firehose. Each
+// feed is an Algorithm, which chooses the posts it wants as they are indexed
+// and pages through them when asked for its skeleton.
+//
+// A feed generator is published in two parts: the service's DID document,
+// which points at where it is hosted (see DIDDocument), and an
+// app.bsky.feed.generator record for each feed in the repo of the account
+// offering it (see Publish).
+package feedgen
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/did"
+	"github.com/bluesky-social/indigo/util/syntax"
+
+	logging "github.com/ipfs/go-log"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+var log = logging.Logger("feedgen")
+
+// Algorithm is a feed. Algorithms are given every post indexed, and keep
+// those they want in their feed with Index; Skeleton pages through them.
+type Algorithm interface {
+	// Name is the record key of the feed's generator record, which is the
+	// last part of the feed's at:// URI
+	Name() string
+
+	// Index returns whether the post belongs in the feed. It is called once
+	// for each post created.
+	Index(ctx context.Context, post *Post, rec *appbsky.FeedPost) bool
+
+	// Skeleton returns a page of the feed
+	Skeleton(ctx context.Context, store *Store, req *SkeletonRequest) (*appbsky.FeedGetFeedSkeleton_Output, error)
+}
+
+// SkeletonRequest is a getFeedSkeleton request for a feed
+type SkeletonRequest struct {
+	// Feed is the name of the feed asked for
+	Feed string
+
+	// Viewer is the DID of the account the feed is for, from the request's
+	// service auth token, or empty for unauthenticated requests
+	Viewer string
+
+	// Cursor is the cursor of the page to return, as given by the previous
+	// page, or empty for the first page
+	Cursor string
+
+	// Limit is the most posts to return, between 1 and 100
+	Limit int
+}
+
+// Config configures a feed generator Server
+type Config struct {
+	// ServiceDID is the DID of the feed generator service, which service
+	// auth tokens are addressed to, eg did:web:feeds.example.com
+	ServiceDID string
+
+	// PublisherDID is the DID of the account whose repo has the feeds'
+	// generator records. Only feeds under it are served.
+	PublisherDID string
+
+	// Endpoint is the URL the service is hosted at, which its did:web
+	// document points to, eg https://feeds.example.com
+	Endpoint string
+
+	Algorithms []Algorithm
+
+	// Resolver resolves the keys of the accounts making requests, to check
+	// their service auth tokens
+	Resolver did.Resolver
+
+	// RequireAuth refuses requests without a service auth token. Otherwise
+	// they are served with no viewer.
+	RequireAuth bool
+}
+
+// Server hosts the feeds of its algorithms
+type Server struct {
+	cfg   Config
+	store *Store
+	algos map[string]Algorithm
+
+	echo *echo.Echo
+}
+
+func NewServer(db *gorm.DB, cfg Config) (*Server, error) {
+	if _, err := syntax.ParseDID(cfg.ServiceDID); err != nil {
+		return nil, fmt.Errorf("service DID: %w", err)
+	}
+	if _, err := syntax.ParseDID(cfg.PublisherDID); err != nil {
+		return nil, fmt.Errorf("publisher DID: %w", err)
+	}
+
+	algos := make(map[string]Algorithm, len(cfg.Algorithms))
+	for _, a := range cfg.Algorithms {
+		if _, err := syntax.ParseRecordKey(a.Name()); err != nil {
+			return nil, fmt.Errorf("feed name %q: %w", a.Name(), err)
+		}
+		if algos[a.Name()] != nil {
+			return nil, fmt.Errorf("feed %q given twice", a.Name())
+		}
+		algos[a.Name()] = a
+	}
+
+	store, err := NewStore(db)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{
+		cfg:   cfg,
+		store: store,
+		algos: algos,
+	}, nil
+}
+
+// Store returns the store of indexed posts
+func (s *Server) Store() *Store {
+	return s.store
+}
+
+// FeedURI returns the at:// URI of one of the server's feeds
+func (s *Server) FeedURI(name string) string {
+	return FeedURI(s.cfg.PublisherDID, name)
+}
+
+// FeedURI returns the at:// URI of a feed, which is that of its generator
+// record in the publisher's repo
+func FeedURI(publisher, name string) string {
+	return "at://" + publisher + "/app.bsky.feed.generator/" + name
+}
+
+// pruneInterval is how often posts older than the retention are deleted
+const pruneInterval = time.Hour
+
+// RunPruner deletes posts indexed longer ago than retention every hour,
+// until ctx is done
+func (s *Server) RunPruner(ctx context.Context, retention time.Duration) error {
+	t := time.NewTicker(pruneInterval)
+	defer t.Stop()
+	for {
+		if err := s.store.Prune(ctx, time.Now().Add(-retention)); err != nil && ctx.Err() == nil {
+			log.Errorw("failed to prune posts", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
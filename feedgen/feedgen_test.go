@@ -0,0 +1,119 @@
+package feedgen_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/feedgen"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+const publisher = "did:plc:publisher"
+
+func testServer(t *testing.T) (*feedgen.Server, string) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "feedgen.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := feedgen.NewServer(db, feedgen.Config{
+		ServiceDID:   "did:web:feeds.example.com",
+		PublisherDID: publisher,
+		Endpoint:     "https://feeds.example.com",
+		Algorithms:   []feedgen.Algorithm{feedgen.NewTagFeed("cats", []string{"#Cats", "kittens"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.RunAPIWithListener(li)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	})
+	return srv, "http://" + li.Addr().String()
+}
+
+func getJSON(t *testing.T, u string, out any) int {
+	res, err := http.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode
+}
+
+func TestTagFeed(t *testing.T) {
+	assert := assert.New(t)
+	tf := feedgen.NewTagFeed("cats", []string{"#Cats", "kittens"})
+
+	assert.True(tf.Index(context.Background(), &feedgen.Post{}, &appbsky.FeedPost{Text: "look #KITTENS"}))
+	assert.False(tf.Index(context.Background(), &feedgen.Post{}, &appbsky.FeedPost{Text: "cats without a tag"}))
+}
+
+func TestFeedSkeleton(t *testing.T) {
+	assert := assert.New(t)
+	srv, base := testServer(t)
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		p := &feedgen.Post{Uri: fmt.Sprintf("at://did:plc:alice/app.bsky.feed.post/%d", i), Did: "did:plc:alice", IndexedAt: time.Now()}
+		assert.NoError(srv.Store().AddPost(ctx, p, []string{"cats"}))
+	}
+	assert.NoError(srv.Store().DeletePost(ctx, "at://did:plc:alice/app.bsky.feed.post/3"))
+
+	feed := url.QueryEscape(feedgen.FeedURI(publisher, "cats"))
+	var page appbsky.FeedGetFeedSkeleton_Output
+	assert.Equal(200, getJSON(t, base+"/xrpc/app.bsky.feed.getFeedSkeleton?limit=2&feed="+feed, &page))
+	if assert.Len(page.Feed, 2) && assert.NotNil(page.Cursor) {
+		assert.Equal("at://did:plc:alice/app.bsky.feed.post/4", page.Feed[0].Post)
+		assert.Equal("at://did:plc:alice/app.bsky.feed.post/2", page.Feed[1].Post)
+
+		var next appbsky.FeedGetFeedSkeleton_Output
+		assert.Equal(200, getJSON(t, base+"/xrpc/app.bsky.feed.getFeedSkeleton?limit=2&feed="+feed+"&cursor="+*page.Cursor, &next))
+		if assert.Len(next.Feed, 2) {
+			assert.Equal("at://did:plc:alice/app.bsky.feed.post/1", next.Feed[0].Post)
+			assert.Equal("at://did:plc:alice/app.bsky.feed.post/0", next.Feed[1].Post)
+		}
+	}
+
+	var errBody struct {
+		Error string `json:"error"`
+	}
+	other := url.QueryEscape(feedgen.FeedURI("did:plc:someone", "cats"))
+	assert.Equal(400, getJSON(t, base+"/xrpc/app.bsky.feed.getFeedSkeleton?feed="+other, &errBody))
+	assert.Equal("UnknownFeed", errBody.Error)
+	assert.Equal(400, getJSON(t, base+"/xrpc/app.bsky.feed.getFeedSkeleton?cursor=nope&feed="+feed, &errBody))
+
+	var desc appbsky.FeedDescribeFeedGenerator_Output
+	assert.Equal(200, getJSON(t, base+"/xrpc/app.bsky.feed.describeFeedGenerator", &desc))
+	assert.Equal("did:web:feeds.example.com", desc.Did)
+	if assert.Len(desc.Feeds, 1) {
+		assert.Equal(feedgen.FeedURI(publisher, "cats"), desc.Feeds[0].Uri)
+	}
+
+	var doc feedgen.DIDDocumentBody
+	assert.Equal(200, getJSON(t, base+"/.well-known/did.json", &doc))
+	if assert.Len(doc.Service, 1) {
+		assert.Equal("#bsky_fg", doc.Service[0].ID)
+		assert.Equal("https://feeds.example.com", doc.Service[0].ServiceEndpoint)
+	}
+}
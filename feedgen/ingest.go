@@ -0,0 +1,130 @@
+package feedgen
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/bluesky-social/indigo/repomgr"
+	"github.com/bluesky-social/indigo/util"
+)
+
+// firehoseLivenessTimeout is how long the firehose subscription waits for an
+// event before redialing
+const firehoseLivenessTimeout = 5 * time.Minute
+
+// Subscribe indexes posts from a firehose, such as
+// wss://bsky.network/xrpc/com.atproto.sync.subscribeRepos, until ctx is
+// done, resuming from the cursor saved for its host
+func (s *Server) Subscribe(ctx context.Context, firehose string) error {
+	u, err := url.Parse(firehose)
+	if err != nil {
+		return fmt.Errorf("parsing firehose url: %w", err)
+	}
+	host := u.Host
+
+	sub, err := events.NewSubscription(events.SubscriptionConfig{
+		URL:     firehose,
+		Handler: s.handleEvent,
+		LoadCursor: func(ctx context.Context) (int64, error) {
+			return s.store.LoadCursor(ctx, host)
+		},
+		SaveCursor: func(ctx context.Context, seq int64) error {
+			return s.store.SaveCursor(ctx, host, seq)
+		},
+		LivenessTimeout: firehoseLivenessTimeout,
+		OnStateChange: func(state events.SubscriptionState, err error) {
+			log.Infow("firehose subscription state change", "host", host, "state", state, "err", err)
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return sub.Run(ctx)
+}
+
+func (s *Server) handleEvent(ctx context.Context, xev *events.XRPCStreamEvent) error {
+	switch {
+	case xev.RepoCommit != nil:
+		return s.handleCommit(ctx, xev.RepoCommit)
+	case xev.RepoTombstone != nil:
+		return s.store.DeleteAccount(ctx, xev.RepoTombstone.Did)
+	}
+	return nil
+}
+
+func (s *Server) handleCommit(ctx context.Context, evt *comatproto.SyncSubscribeRepos_Commit) error {
+	if evt.TooBig {
+		log.Warnw("skipping too big commit", "repo", evt.Repo, "seq", evt.Seq)
+		return nil
+	}
+
+	var r *repo.Repo
+	for _, op := range evt.Ops {
+		if !strings.HasPrefix(op.Path, "app.bsky.feed.post/") {
+			continue
+		}
+		uri := "at://" + evt.Repo + "/" + op.Path
+
+		switch repomgr.EventKind(op.Action) {
+		case repomgr.EvtKindCreateRecord:
+			if r == nil {
+				var err error
+				r, err = repo.ReadRepoFromCar(ctx, bytes.NewReader(evt.Blocks))
+				if err != nil {
+					return fmt.Errorf("reading repo from car (seq %d): %w", evt.Seq, err)
+				}
+			}
+			rcid, rec, err := r.GetRecord(ctx, op.Path)
+			if err != nil {
+				return fmt.Errorf("getting record %s: %w", uri, err)
+			}
+			fp, ok := rec.(*appbsky.FeedPost)
+			if !ok {
+				continue
+			}
+
+			post := &Post{
+				Uri:       uri,
+				Cid:       rcid.String(),
+				Did:       evt.Repo,
+				IndexedAt: time.Now(),
+			}
+			if t, err := time.Parse(util.ISO8601, fp.CreatedAt); err == nil {
+				post.CreatedAt = t
+			}
+			if err := s.indexPost(ctx, post, fp); err != nil {
+				return fmt.Errorf("indexing %s: %w", uri, err)
+			}
+
+		case repomgr.EvtKindDeleteRecord:
+			if err := s.store.DeletePost(ctx, uri); err != nil {
+				return fmt.Errorf("deleting %s: %w", uri, err)
+			}
+		}
+	}
+	return nil
+}
+
+// indexPost stores a post in the feeds whose algorithms want it, and drops
+// it if none do
+func (s *Server) indexPost(ctx context.Context, post *Post, rec *appbsky.FeedPost) error {
+	var feeds []string
+	for name, algo := range s.algos {
+		if algo.Index(ctx, post, rec) {
+			feeds = append(feeds, name)
+			postsIndexed.WithLabelValues(name).Inc()
+		}
+	}
+	if len(feeds) == 0 {
+		return nil
+	}
+	return s.store.AddPost(ctx, post, feeds)
+}
@@ -0,0 +1,16 @@
+package feedgen
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var postsIndexed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "feedgen_posts_indexed_total",
+	Help: "Total number of posts added to each feed",
+}, []string{"feed"})
+
+var skeletonsServed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "feedgen_skeletons_served_total",
+	Help: "Total number of feed skeleton pages served, by feed",
+}, []string{"feed"})
@@ -0,0 +1,87 @@
+package feedgen
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+// ServiceID is the id of the feed generator service in DID documents
+const ServiceID = "#bsky_fg"
+
+// DIDService is a service entry of a DID document
+type DIDService struct {
+	ID              string `json:"id"`
+	Type            string `json:"type"`
+	ServiceEndpoint string `json:"serviceEndpoint"`
+}
+
+// DIDDocumentBody is the DID document of a did:web feed generator
+type DIDDocumentBody struct {
+	Context []string     `json:"@context"`
+	ID      string       `json:"id"`
+	Service []DIDService `json:"service"`
+}
+
+// DIDDocument returns the document for a did:web feed generator, served at
+// /.well-known/did.json of the domain, pointing at the endpoint it is hosted
+// at. Feed generators with did:plc identities put the same service entry in
+// their PLC operations.
+func DIDDocument(serviceDID, endpoint string) *DIDDocumentBody {
+	return &DIDDocumentBody{
+		Context: []string{"https://www.w3.org/ns/did/v1"},
+		ID:      serviceDID,
+		Service: []DIDService{{
+			ID:              ServiceID,
+			Type:            "BskyFeedGenerator",
+			ServiceEndpoint: endpoint,
+		}},
+	}
+}
+
+// FeedInfo is how a feed is described in its generator record
+type FeedInfo struct {
+	Name        string
+	DisplayName string
+	Description string
+}
+
+// GeneratorRecord returns the app.bsky.feed.generator record announcing a
+// feed hosted by the service
+func GeneratorRecord(serviceDID string, info FeedInfo) *appbsky.FeedGenerator {
+	rec := &appbsky.FeedGenerator{
+		Did:         serviceDID,
+		DisplayName: info.DisplayName,
+		CreatedAt:   time.Now().UTC().Format(util.ISO8601),
+	}
+	if info.Description != "" {
+		rec.Description = &info.Description
+	}
+	return rec
+}
+
+// Publish writes the generator record of a feed to the repo of the account
+// the client is logged in as, replacing any it already has, and returns the
+// feed's URI
+func Publish(ctx context.Context, c *xrpc.Client, serviceDID string, info FeedInfo) (string, error) {
+	if c.Auth == nil || c.Auth.Did == "" {
+		return "", fmt.Errorf("publishing feeds needs a logged in client")
+	}
+
+	out, err := comatproto.RepoPutRecord(ctx, c, &comatproto.RepoPutRecord_Input{
+		Collection: "app.bsky.feed.generator",
+		Repo:       c.Auth.Did,
+		Rkey:       info.Name,
+		Record:     &lexutil.LexiconTypeDecoder{Val: GeneratorRecord(serviceDID, info)},
+	})
+	if err != nil {
+		return "", fmt.Errorf("writing generator record for %s: %w", info.Name, err)
+	}
+	return out.Uri, nil
+}
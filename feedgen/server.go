@@ -0,0 +1,157 @@
+package feedgen
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/util/logutil"
+	"github.com/bluesky-social/indigo/util/serviceauth"
+	"github.com/bluesky-social/indigo/util/version"
+	"github.com/bluesky-social/indigo/util/xrpcerr"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// logger is for structured logs carrying the fields of the request being
+// handled
+var logger = logutil.Logger("feedgen")
+
+// ErrUnknownFeed is returned for feeds the server doesn't host
+var ErrUnknownFeed = errors.New("unknown feed")
+
+// ErrInvalidCursor is returned for cursors which no page of a feed gave
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// defaultSkeletonLimit and maxSkeletonLimit bound the number of posts in a
+// page of a feed, as the lexicon does
+const (
+	defaultSkeletonLimit = 50
+	maxSkeletonLimit     = 100
+)
+
+// RunAPI serves the feeds on listen
+func (s *Server) RunAPI(listen string) error {
+	li, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	return s.RunAPIWithListener(li)
+}
+
+// RunAPIWithListener is like RunAPI, on a listener the caller already has
+// open, such as one on a random port in tests
+func (s *Server) RunAPIWithListener(li net.Listener) error {
+	e := echo.New()
+	s.echo = e
+	e.HideBanner = true
+	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
+		Format: "method=${method} uri=${uri} status=${status} latency=${latency_human}\n",
+	}))
+	e.Use(echo.WrapMiddleware(logutil.Middleware))
+	e.HTTPErrorHandler = xrpcerr.ErrorHandler(logger,
+		xrpcerr.Map(ErrUnknownFeed, http.StatusBadRequest, "UnknownFeed"),
+		xrpcerr.Map(ErrInvalidCursor, http.StatusBadRequest, "InvalidRequest"),
+	)
+
+	auth := serviceauth.Middleware(serviceauth.Config{
+		Validator: &serviceauth.Validator{
+			Dir:        s.cfg.Resolver,
+			ServiceDID: s.cfg.ServiceDID,
+		},
+		Skipper: func(c echo.Context) bool {
+			return !s.cfg.RequireAuth && c.Request().Header.Get("Authorization") == ""
+		},
+	})
+
+	e.GET("/xrpc/_health", s.HandleHealthCheck)
+	e.GET("/xrpc/app.bsky.feed.getFeedSkeleton", s.HandleGetFeedSkeleton, auth)
+	e.GET("/xrpc/app.bsky.feed.describeFeedGenerator", s.HandleDescribeFeedGenerator)
+	if strings.HasPrefix(s.cfg.ServiceDID, "did:web:") {
+		e.GET("/.well-known/did.json", s.HandleDIDDocument)
+	}
+
+	log.Infof("starting feed generator XRPC daemon at: %s", li.Addr())
+	e.Listener = li
+	return e.StartServer(e.Server)
+}
+
+// Shutdown stops serving the API
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.echo == nil {
+		return nil
+	}
+	return s.echo.Shutdown(ctx)
+}
+
+type HealthStatus struct {
+	Status  string `json:"status"`
+	Version string `json:"version"`
+	Message string `json:"msg,omitempty"`
+}
+
+func (s *Server) HandleHealthCheck(c echo.Context) error {
+	if err := s.store.db.Exec("SELECT 1").Error; err != nil {
+		log.Errorf("healthcheck can't connect to database: %v", err)
+		return c.JSON(500, HealthStatus{Status: "error", Version: version.Version, Message: "can't connect to database"})
+	}
+	return c.JSON(200, HealthStatus{Status: "ok", Version: version.Version})
+}
+
+func (s *Server) HandleGetFeedSkeleton(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	puri, err := util.ParseAtUri(c.QueryParam("feed"))
+	if err != nil {
+		return xrpcerr.InvalidRequest("invalid feed: %s", err)
+	}
+	algo := s.algos[puri.Rkey]
+	if algo == nil || puri.Did != s.cfg.PublisherDID || puri.Collection != "app.bsky.feed.generator" {
+		return ErrUnknownFeed
+	}
+
+	limit := defaultSkeletonLimit
+	if l := c.QueryParam("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > maxSkeletonLimit {
+			return xrpcerr.InvalidRequest("limit must be between 1 and %d", maxSkeletonLimit)
+		}
+	}
+
+	req := &SkeletonRequest{
+		Feed:   algo.Name(),
+		Cursor: c.QueryParam("cursor"),
+		Limit:  limit,
+	}
+	if claims := serviceauth.GetClaims(c); claims != nil {
+		req.Viewer, _, _ = strings.Cut(claims.Iss, "#")
+	}
+
+	out, err := algo.Skeleton(ctx, s.store, req)
+	if err != nil {
+		return err
+	}
+	skeletonsServed.WithLabelValues(algo.Name()).Inc()
+	return c.JSON(200, out)
+}
+
+func (s *Server) HandleDescribeFeedGenerator(c echo.Context) error {
+	out := &appbsky.FeedDescribeFeedGenerator_Output{
+		Did:   s.cfg.ServiceDID,
+		Feeds: []*appbsky.FeedDescribeFeedGenerator_Feed{},
+	}
+	for _, a := range s.cfg.Algorithms {
+		out.Feeds = append(out.Feeds, &appbsky.FeedDescribeFeedGenerator_Feed{Uri: s.FeedURI(a.Name())})
+	}
+	return c.JSON(200, out)
+}
+
+func (s *Server) HandleDIDDocument(c echo.Context) error {
+	return c.JSON(200, DIDDocument(s.cfg.ServiceDID, s.cfg.Endpoint))
+}
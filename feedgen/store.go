@@ -0,0 +1,146 @@
+package feedgen
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Post is an indexed post. Posts are numbered in the order they are indexed,
+// which is the order feeds list them in.
+type Post struct {
+	ID  uint64 `gorm:"primaryKey"`
+	Uri string `gorm:"uniqueIndex;not null"`
+	Cid string
+	Did string `gorm:"index"`
+
+	// CreatedAt is the time the post says it was created at, which may be
+	// anything
+	CreatedAt time.Time
+	IndexedAt time.Time `gorm:"index"`
+}
+
+// FeedItem puts a post in a feed
+type FeedItem struct {
+	Feed   string `gorm:"primaryKey"`
+	PostID uint64 `gorm:"primaryKey"`
+}
+
+// FirehoseCursor is the sequence number of the last event indexed from a
+// firehose host
+type FirehoseCursor struct {
+	Host string `gorm:"primaryKey"`
+	Seq  int64
+}
+
+// Store keeps the posts of the feeds, and the firehose cursor
+type Store struct {
+	db *gorm.DB
+}
+
+func NewStore(db *gorm.DB) (*Store, error) {
+	if err := db.AutoMigrate(&Post{}, &FeedItem{}, &FirehoseCursor{}); err != nil {
+		return nil, fmt.Errorf("migrating feed store: %w", err)
+	}
+	return &Store{db: db}, nil
+}
+
+// AddPost stores a post in the given feeds. Posts already indexed are left
+// where they are in the feeds, so are not bumped by updates.
+func (st *Store) AddPost(ctx context.Context, p *Post, feeds []string) error {
+	return st.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(p).Error; err != nil {
+			return err
+		}
+		if p.ID == 0 {
+			if err := tx.Select("id").Where("uri = ?", p.Uri).Take(p).Error; err != nil {
+				return err
+			}
+		}
+
+		items := make([]FeedItem, len(feeds))
+		for i, f := range feeds {
+			items[i] = FeedItem{Feed: f, PostID: p.ID}
+		}
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&items).Error
+	})
+}
+
+// DeletePost removes a post from the store and its feeds
+func (st *Store) DeletePost(ctx context.Context, uri string) error {
+	return st.deletePosts(ctx, st.db.Where("uri = ?", uri))
+}
+
+// DeleteAccount removes every post of an account
+func (st *Store) DeleteAccount(ctx context.Context, did string) error {
+	return st.deletePosts(ctx, st.db.Where("did = ?", did))
+}
+
+// Prune removes the posts indexed before a time
+func (st *Store) Prune(ctx context.Context, before time.Time) error {
+	return st.deletePosts(ctx, st.db.Where("indexed_at < ?", before))
+}
+
+func (st *Store) deletePosts(ctx context.Context, where *gorm.DB) error {
+	return st.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		ids := tx.Model(&Post{}).Select("id").Where(where)
+		if err := tx.Where("post_id IN (?)", ids).Delete(&FeedItem{}).Error; err != nil {
+			return err
+		}
+		return tx.Where(where).Delete(&Post{}).Error
+	})
+}
+
+// FeedPage returns a page of the posts in a feed, newest first, as a feed
+// skeleton. The cursor is the number of the last post of the page before,
+// or empty for the first page.
+func (st *Store) FeedPage(ctx context.Context, feed, cursor string, limit int) (*appbsky.FeedGetFeedSkeleton_Output, error) {
+	q := st.db.WithContext(ctx).Model(&Post{}).
+		Joins("JOIN feed_items ON feed_items.post_id = posts.id").
+		Where("feed_items.feed = ?", feed)
+	if cursor != "" {
+		before, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+		q = q.Where("posts.id < ?", before)
+	}
+
+	var posts []Post
+	if err := q.Order("posts.id desc").Limit(limit).Find(&posts).Error; err != nil {
+		return nil, err
+	}
+
+	out := &appbsky.FeedGetFeedSkeleton_Output{Feed: []*appbsky.FeedDefs_SkeletonFeedPost{}}
+	for _, p := range posts {
+		out.Feed = append(out.Feed, &appbsky.FeedDefs_SkeletonFeedPost{Post: p.Uri})
+	}
+	if len(posts) == limit {
+		next := strconv.FormatUint(posts[len(posts)-1].ID, 10)
+		out.Cursor = &next
+	}
+	return out, nil
+}
+
+// LoadCursor returns the cursor saved for a firehose host, or 0
+func (st *Store) LoadCursor(ctx context.Context, host string) (int64, error) {
+	var fc FirehoseCursor
+	if err := st.db.WithContext(ctx).Where("host = ?", host).Find(&fc).Error; err != nil {
+		return 0, err
+	}
+	return fc.Seq, nil
+}
+
+// SaveCursor saves the cursor of a firehose host
+func (st *Store) SaveCursor(ctx context.Context, host string, seq int64) error {
+	return st.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "host"}},
+		DoUpdates: clause.AssignmentColumns([]string{"seq"}),
+	}).Create(&FirehoseCursor{Host: host, Seq: seq}).Error
+}
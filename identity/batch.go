@@ -0,0 +1,120 @@
+package identity
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/bluesky-social/indigo/did"
+)
+
+// Identity is the result of resolving a DID or handle
+type Identity struct {
+	// Input is the DID or handle that was resolved
+	Input string
+
+	Did string
+	Doc *did.Document
+
+	// Handle is the handle claimed by the DID document. It is only set if
+	// it resolves back to the DID, or if the Resolver has no handle
+	// resolver to check it with.
+	Handle string
+
+	Err error
+}
+
+// Resolve resolves a DID to its document, or a handle to its DID and then
+// its document, filling in the verified handle either way
+func (r *Resolver) Resolve(ctx context.Context, ident string) *Identity {
+	out := &Identity{Input: ident}
+
+	d := ident
+	if !strings.HasPrefix(ident, "did:") {
+		hd, err := r.ResolveHandleToDid(ctx, ident)
+		if err != nil {
+			out.Err = err
+			return out
+		}
+		d = hd
+	}
+	out.Did = d
+
+	doc, err := r.GetDocument(ctx, d)
+	if err != nil {
+		out.Err = err
+		return out
+	}
+	out.Doc = doc
+
+	for _, aka := range doc.AlsoKnownAs {
+		h, ok := strings.CutPrefix(aka, "at://")
+		if !ok {
+			continue
+		}
+
+		if r.Handles == nil {
+			out.Handle = h
+			break
+		}
+
+		if hd, err := r.ResolveHandleToDid(ctx, h); err == nil && hd == d {
+			out.Handle = h
+			break
+		}
+	}
+
+	if out.Handle == "" && d != ident {
+		out.Err = fmt.Errorf("did document for %s does not claim handle %q", d, ident)
+	}
+
+	return out
+}
+
+// ResolveBatch resolves many DIDs and handles, with at most parallelism
+// resolutions in flight. The results are in the same order as idents, and
+// lookups share the cache as usual.
+func (r *Resolver) ResolveBatch(ctx context.Context, idents []string, parallelism int) []*Identity {
+	out := make([]*Identity, len(idents))
+
+	in := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism || i == 0; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ix := range in {
+				out[ix] = r.Resolve(ctx, idents[ix])
+			}
+		}()
+	}
+
+	for ix := range idents {
+		in <- ix
+	}
+	close(in)
+	wg.Wait()
+
+	return out
+}
+
+// ResolveStream resolves every DID or handle read from idents until it is
+// closed, with at most parallelism resolutions in flight, sending results to
+// out as they finish. out is closed once everything has been resolved. Use
+// this rather than ResolveBatch for inputs too large to hold in memory.
+func (r *Resolver) ResolveStream(ctx context.Context, idents <-chan string, parallelism int, out chan<- *Identity) {
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism || i == 0; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ident := range idents {
+				out <- r.Resolve(ctx, ident)
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(out)
+}
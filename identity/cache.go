@@ -0,0 +1,87 @@
+package identity
+
+import (
+	"context"
+	"time"
+
+	"github.com/bluesky-social/indigo/did"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// Entry is a cached resolution result: a DID document, the DID a handle
+// resolved to, or the error that resolving either gave
+type Entry struct {
+	Doc *did.Document `json:"doc,omitempty"`
+	Did string        `json:"did,omitempty"`
+	Err string        `json:"err,omitempty"`
+
+	// NotFound is set on failures which were definite, see
+	// api.ErrHandleNotFound
+	NotFound bool      `json:"notFound,omitempty"`
+	CachedAt time.Time `json:"cachedAt"`
+}
+
+// Cache stores resolution results for a Resolver. Entries may be dropped at
+// any time, but must not be returned after their TTL.
+type Cache interface {
+	// Get returns the entry for key, or nil if there isn't one
+	Get(ctx context.Context, key string) (*Entry, error)
+	Set(ctx context.Context, key string, e *Entry, ttl time.Duration) error
+	Delete(ctx context.Context, key string) error
+}
+
+// Locker is implemented by caches shared between processes. While one process
+// holds the lock on a key it resolves that identity, and the others wait for
+// its result to show up in the cache rather than all resolving it at once.
+type Locker interface {
+	// TryLock takes the lock on key for at most ttl, returning false if
+	// someone else holds it
+	TryLock(ctx context.Context, key string, ttl time.Duration) (unlock func(), ok bool, err error)
+}
+
+// MemCache is an in process Cache holding a bounded number of entries
+type MemCache struct {
+	cache *lru.ARCCache
+}
+
+type memEntry struct {
+	entry   *Entry
+	expires time.Time
+}
+
+func NewMemCache(size int) *MemCache {
+	c, err := lru.NewARC(size)
+	if err != nil {
+		panic(err)
+	}
+
+	return &MemCache{cache: c}
+}
+
+func (mc *MemCache) Get(ctx context.Context, key string) (*Entry, error) {
+	v, ok := mc.cache.Get(key)
+	if !ok {
+		return nil, nil
+	}
+
+	me := v.(*memEntry)
+	if time.Now().After(me.expires) {
+		mc.cache.Remove(key)
+		return nil, nil
+	}
+
+	return me.entry, nil
+}
+
+func (mc *MemCache) Set(ctx context.Context, key string, e *Entry, ttl time.Duration) error {
+	mc.cache.Add(key, &memEntry{
+		entry:   e,
+		expires: time.Now().Add(ttl),
+	})
+	return nil
+}
+
+func (mc *MemCache) Delete(ctx context.Context, key string) error {
+	mc.cache.Remove(key)
+	return nil
+}
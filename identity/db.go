@@ -0,0 +1,205 @@
+package identity
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DbEntry is an Entry persisted by a DbCache
+type DbEntry struct {
+	CacheKey  string `gorm:"primaryKey"`
+	Entry     []byte
+	Failed    bool
+	CachedAt  time.Time
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+func (DbEntry) TableName() string {
+	return "identity_cache_entries"
+}
+
+// DbCache is a Cache kept in a database, so that resolved identities survive
+// restarts, with another Cache (usually a MemCache) in front of it for the
+// entries in use. A DbCache is a Locker if the cache in front of it is.
+type DbCache struct {
+	db    *gorm.DB
+	front Cache
+}
+
+// NewDbCache creates a DbCache, creating its table in db if needed. front may
+// be nil to read every entry from the database.
+func NewDbCache(db *gorm.DB, front Cache) (*DbCache, error) {
+	if err := db.AutoMigrate(&DbEntry{}); err != nil {
+		return nil, err
+	}
+
+	return &DbCache{db: db, front: front}, nil
+}
+
+func (dc *DbCache) Get(ctx context.Context, key string) (*Entry, error) {
+	if dc.front != nil {
+		e, err := dc.front.Get(ctx, key)
+		if err != nil {
+			log.Warnw("reading identity cache", "key", key, "err", err)
+		}
+		if e != nil {
+			return e, nil
+		}
+	}
+
+	// misses are common, so aren't looked up with Take, which logs them
+	var rows []DbEntry
+	if err := dc.db.WithContext(ctx).Where("cache_key = ? AND expires_at > ?", key, time.Now()).Limit(1).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	row := rows[0]
+
+	var e Entry
+	if err := json.Unmarshal(row.Entry, &e); err != nil {
+		return nil, fmt.Errorf("decoding cached identity %q: %w", key, err)
+	}
+
+	if dc.front != nil {
+		if err := dc.front.Set(ctx, key, &e, time.Until(row.ExpiresAt)); err != nil {
+			log.Warnw("writing identity cache", "key", key, "err", err)
+		}
+	}
+
+	return &e, nil
+}
+
+func (dc *DbCache) Set(ctx context.Context, key string, e *Entry, ttl time.Duration) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if dc.front != nil {
+		if err := dc.front.Set(ctx, key, e, ttl); err != nil {
+			log.Warnw("writing identity cache", "key", key, "err", err)
+		}
+	}
+
+	row := DbEntry{
+		CacheKey:  key,
+		Entry:     b,
+		Failed:    e.Err != "",
+		CachedAt:  e.CachedAt,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	return dc.db.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(&row).Error
+}
+
+func (dc *DbCache) Delete(ctx context.Context, key string) error {
+	if dc.front != nil {
+		if err := dc.front.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	return dc.db.WithContext(ctx).Where("cache_key = ?", key).Delete(&DbEntry{}).Error
+}
+
+// TryLock passes through to the cache in front, and always succeeds if that
+// isn't a Locker
+func (dc *DbCache) TryLock(ctx context.Context, key string, ttl time.Duration) (func(), bool, error) {
+	if lk, ok := dc.front.(Locker); ok {
+		return lk.TryLock(ctx, key, ttl)
+	}
+
+	return nil, true, nil
+}
+
+// Expiring returns the keys of up to limit successfully resolved entries that
+// expire before t, soonest first
+func (dc *DbCache) Expiring(ctx context.Context, t time.Time, limit int) ([]string, error) {
+	var keys []string
+	err := dc.db.WithContext(ctx).Model(&DbEntry{}).
+		Where("failed = ? AND expires_at > ? AND expires_at < ?", false, time.Now(), t).
+		Order("expires_at").Limit(limit).
+		Pluck("cache_key", &keys).Error
+	return keys, err
+}
+
+// DeleteExpired drops the entries that have expired from the database
+func (dc *DbCache) DeleteExpired(ctx context.Context) (int64, error) {
+	res := dc.db.WithContext(ctx).Where("expires_at <= ?", time.Now()).Delete(&DbEntry{})
+	return res.RowsAffected, res.Error
+}
+
+// KeepWarm re-resolves the identities in c before they expire, so that they
+// don't all have to be resolved again when the process restarts, until ctx is
+// done. Every interval, up to batch of the entries expiring within the next
+// StaleTTL/2 are refreshed, and expired entries are deleted. Identities that
+// fail to resolve are left to expire.
+func (r *Resolver) KeepWarm(ctx context.Context, c *DbCache, interval time.Duration, batch int) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		if _, err := c.DeleteExpired(ctx); err != nil {
+			log.Warnw("deleting expired identities", "err", err)
+		}
+
+		keys, err := c.Expiring(ctx, time.Now().Add(r.StaleTTL/2), batch)
+		if err != nil {
+			log.Warnw("listing expiring identities", "err", err)
+			continue
+		}
+
+		for _, key := range keys {
+			if ctx.Err() != nil {
+				return
+			}
+			r.refreshKey(ctx, key)
+		}
+	}
+}
+
+// refreshKey resolves the identity cached as key again
+func (r *Resolver) refreshKey(ctx context.Context, key string) {
+	var kind string
+	var fetch func(context.Context) (*Entry, error)
+	if handle, ok := strings.CutPrefix(key, "handle:"); ok && r.Handles != nil {
+		kind, fetch = "handle", r.fetchHandle(handle)
+	} else if didstr, ok := strings.CutPrefix(key, "did:"); ok {
+		kind, fetch = "did", r.fetchDid(didstr)
+	} else {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	// unlike a lookup, a failure here doesn't replace what is cached, so an
+	// outage of the underlying resolver doesn't empty the cache
+	_, err, _ := r.group.Do(key, func() (interface{}, error) {
+		e, err := fetch(ctx)
+		if err != nil {
+			return nil, err
+		}
+		e.CachedAt = time.Now()
+		return e, r.Cache.Set(ctx, key, e, r.TTL+r.StaleTTL)
+	})
+	if err != nil {
+		warmRefreshesTotal.WithLabelValues(kind, "error").Inc()
+		log.Debugw("refreshing expiring identity", "key", key, "err", err)
+		return
+	}
+	warmRefreshesTotal.WithLabelValues(kind, "ok").Inc()
+}
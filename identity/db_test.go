@@ -0,0 +1,100 @@
+package identity
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/did"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestDbCache(t *testing.T) {
+	ctx := context.Background()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "identity.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := did.ParseDID("did:plc:foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// documents have to round trip through JSON, so need their ID
+	fake := &countingResolver{docs: map[string]*did.Document{"did:plc:foo": {ID: id, AlsoKnownAs: []string{"at://foo.test"}}}}
+	dc, err := NewDbCache(db, NewMemCache(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewResolver(fake, fake, dc)
+	if _, err := r.GetDocument(ctx, "did:plc:foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ResolveHandleToDid(ctx, "foo.test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restarted process starts with an empty memory cache, but finds what
+	// was resolved before in the database
+	dc2, err := NewDbCache(db, NewMemCache(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2 := NewResolver(fake, fake, dc2)
+	if _, err := r2.GetDocument(ctx, "did:plc:foo"); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := r2.ResolveHandleToDid(ctx, "foo.test"); err != nil || d != "did:plc:foo" {
+		t.Fatalf("wrong handle resolution after restart: %q %v", d, err)
+	}
+	if n := fake.count(); n != 2 {
+		t.Fatalf("expected no lookups after restart, got %d", n-2)
+	}
+
+	// entries close to expiring are refreshed, even if nothing looks them up
+	r2.StaleTTL = 4 * time.Hour
+	keys, err := dc2.Expiring(ctx, time.Now().Add(2*time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expected both entries to be expiring, got %v", keys)
+	}
+	warmCtx, cancel := context.WithCancel(ctx)
+	go r2.KeepWarm(warmCtx, dc2, 10*time.Millisecond, 10)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if n := fake.count(); n < 4 {
+		t.Fatalf("expected both entries to be refreshed, got %d lookups", n-2)
+	}
+
+	// a refresh that fails leaves the cached entry alone
+	delete(fake.docs, "did:plc:foo")
+	r2.refreshKey(ctx, "did:did:plc:foo")
+	if e, err := r2.CachedDid(ctx, "did:plc:foo"); err != nil || e == nil || e.Doc == nil {
+		t.Fatalf("expected the document to still be cached: %+v %v", e, err)
+	}
+
+	if err := r2.PurgeDid(ctx, "did:plc:foo"); err != nil {
+		t.Fatal(err)
+	}
+	if e, err := r.CachedDid(ctx, "did:plc:foo"); err != nil {
+		t.Fatal(err)
+	} else if e == nil {
+		t.Fatal("expected the other process to still have the document in memory")
+	}
+	if e, err := dc2.Get(ctx, "did:did:plc:foo"); err != nil || e != nil {
+		t.Fatalf("expected the purged document to be gone: %+v %v", e, err)
+	}
+
+	// expired entries are dropped
+	if err := dc2.Set(ctx, "handle:old.test", &Entry{Did: "did:plc:old", CachedAt: time.Now()}, -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := dc2.DeleteExpired(ctx); err != nil || n != 1 {
+		t.Fatalf("expected one expired entry to be deleted, got %d %v", n, err)
+	}
+}
@@ -0,0 +1,21 @@
+package identity
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var lookupsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "identity_lookups_total",
+	Help: "Total number of identity lookups, by kind (did or handle) and cache result",
+}, []string{"kind", "result"})
+
+var resolveErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "identity_resolve_errors_total",
+	Help: "Total number of failed identity resolutions, by kind",
+}, []string{"kind"})
+
+var warmRefreshesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "identity_warm_refreshes_total",
+	Help: "Total number of persisted identities refreshed before expiring, by kind and result",
+}, []string{"kind", "result"})
@@ -0,0 +1,99 @@
+package identity
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// unlockScript deletes the lock in KEYS[1] only if it still holds our token
+// ARGV[1], so a lock that expired and was taken by someone else is left alone
+var unlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// RedisCache keeps resolution results in redis, so that every instance of a
+// service shares them
+type RedisCache struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisCache connects to the redis server at the given URL (eg
+// redis://localhost:6379/0). All keys are prefixed with prefix.
+func NewRedisCache(redisURL string, prefix string) (*RedisCache, error) {
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing redis url: %w", err)
+	}
+
+	return &RedisCache{
+		client: redis.NewClient(opts),
+		prefix: prefix,
+	}, nil
+}
+
+func (rc *RedisCache) Get(ctx context.Context, key string) (*Entry, error) {
+	b, err := rc.client.Get(ctx, rc.prefix+key).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var e Entry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, fmt.Errorf("decoding cached identity: %w", err)
+	}
+
+	return &e, nil
+}
+
+func (rc *RedisCache) Set(ctx context.Context, key string, e *Entry, ttl time.Duration) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return rc.client.Set(ctx, rc.prefix+key, b, ttl).Err()
+}
+
+func (rc *RedisCache) Delete(ctx context.Context, key string) error {
+	return rc.client.Del(ctx, rc.prefix+key).Err()
+}
+
+func (rc *RedisCache) TryLock(ctx context.Context, key string, ttl time.Duration) (func(), bool, error) {
+	var tok [16]byte
+	if _, err := rand.Read(tok[:]); err != nil {
+		return nil, false, err
+	}
+	token := hex.EncodeToString(tok[:])
+	lkey := rc.prefix + "lock:" + key
+
+	ok, err := rc.client.SetNX(ctx, lkey, token, ttl).Result()
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	unlock := func() {
+		// the lookup's context may be done by now
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		if err := unlockScript.Run(ctx, rc.client, []string{lkey}, token).Err(); err != nil {
+			log.Warnw("releasing identity lock", "key", key, "err", err)
+		}
+	}
+
+	return unlock, true, nil
+}
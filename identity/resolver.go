@@ -0,0 +1,274 @@
+// Package identity resolves DIDs to DID documents and handles to DIDs, with
+// caching shared by everything in a service that needs either.
+package identity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/api"
+	"github.com/bluesky-social/indigo/did"
+
+	logging "github.com/ipfs/go-log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/singleflight"
+)
+
+var log = logging.Logger("identity")
+
+// ErrCachedFailure wraps a resolution error that was served from the cache
+var ErrCachedFailure = errors.New("identity resolution failed recently")
+
+// Resolver caches the results of an underlying DID and handle resolver. It
+// satisfies both did.Resolver and api.HandleResolver, so can be used in place
+// of either.
+//
+// Results are fresh for TTL. For StaleTTL after that they are still returned
+// straight away, but are refreshed in the background. Failures are cached for
+// NegativeTTL, so that bad identities don't get looked up over and over.
+// Concurrent lookups of the same identity share a single resolution. If the
+// cache is a Locker, this holds across processes too: lookups wait up to
+// LockWait for another process that is already resolving the same identity.
+type Resolver struct {
+	Dids    did.Resolver
+	Handles api.HandleResolver
+	Cache   Cache
+
+	TTL         time.Duration
+	StaleTTL    time.Duration
+	NegativeTTL time.Duration
+	LockWait    time.Duration
+
+	group singleflight.Group
+}
+
+// NewResolver creates a Resolver with default TTLs. handles may be nil if
+// only DIDs will be resolved.
+func NewResolver(dids did.Resolver, handles api.HandleResolver, cache Cache) *Resolver {
+	return &Resolver{
+		Dids:        dids,
+		Handles:     handles,
+		Cache:       cache,
+		TTL:         5 * time.Minute,
+		StaleTTL:    time.Hour,
+		NegativeTTL: time.Minute,
+		LockWait:    5 * time.Second,
+	}
+}
+
+func (r *Resolver) GetDocument(ctx context.Context, didstr string) (*did.Document, error) {
+	ctx, span := otel.Tracer("identity").Start(ctx, "GetDocument")
+	defer span.End()
+	span.SetAttributes(attribute.String("did", didstr))
+
+	e, err := r.lookup(ctx, "did", "did:"+didstr, r.fetchDid(didstr))
+	if err != nil {
+		return nil, err
+	}
+
+	return e.Doc, nil
+}
+
+func (r *Resolver) ResolveHandleToDid(ctx context.Context, handle string) (string, error) {
+	ctx, span := otel.Tracer("identity").Start(ctx, "ResolveHandleToDid")
+	defer span.End()
+	span.SetAttributes(attribute.String("handle", handle))
+
+	if r.Handles == nil {
+		return "", errors.New("identity resolver has no handle resolver")
+	}
+
+	// handles are case insensitive
+	handle = strings.ToLower(handle)
+
+	e, err := r.lookup(ctx, "handle", "handle:"+handle, r.fetchHandle(handle))
+	if err != nil {
+		return "", err
+	}
+
+	return e.Did, nil
+}
+
+func (r *Resolver) fetchDid(didstr string) func(context.Context) (*Entry, error) {
+	return func(ctx context.Context) (*Entry, error) {
+		doc, err := r.Dids.GetDocument(ctx, didstr)
+		if err != nil {
+			return nil, err
+		}
+		return &Entry{Doc: doc}, nil
+	}
+}
+
+func (r *Resolver) fetchHandle(handle string) func(context.Context) (*Entry, error) {
+	return func(ctx context.Context) (*Entry, error) {
+		d, err := r.Handles.ResolveHandleToDid(ctx, handle)
+		if err != nil {
+			return nil, err
+		}
+		return &Entry{Did: d}, nil
+	}
+}
+
+// CachedDid returns the cached entry for a DID, or nil if there isn't one,
+// without resolving it
+func (r *Resolver) CachedDid(ctx context.Context, didstr string) (*Entry, error) {
+	return r.Cache.Get(ctx, "did:"+didstr)
+}
+
+// CachedHandle returns the cached entry for a handle, or nil if there isn't
+// one, without resolving it
+func (r *Resolver) CachedHandle(ctx context.Context, handle string) (*Entry, error) {
+	return r.Cache.Get(ctx, "handle:"+strings.ToLower(handle))
+}
+
+// PurgeDid drops any cached document for a DID, for when it is known to have
+// changed
+func (r *Resolver) PurgeDid(ctx context.Context, didstr string) error {
+	return r.Cache.Delete(ctx, "did:"+didstr)
+}
+
+// PurgeHandle drops any cached resolution of a handle
+func (r *Resolver) PurgeHandle(ctx context.Context, handle string) error {
+	return r.Cache.Delete(ctx, "handle:"+strings.ToLower(handle))
+}
+
+func (r *Resolver) lookup(ctx context.Context, kind, key string, fetch func(context.Context) (*Entry, error)) (*Entry, error) {
+	e, err := r.Cache.Get(ctx, key)
+	if err != nil {
+		// the cache being down shouldn't stop us from resolving
+		log.Warnw("reading identity cache", "key", key, "err", err)
+		e = nil
+	}
+
+	if e != nil {
+		age := time.Since(e.CachedAt)
+		switch {
+		case e.Err != "" && age < r.NegativeTTL:
+			lookupsTotal.WithLabelValues(kind, "negative").Inc()
+			return nil, errors.Join(ErrCachedFailure, cachedErr(e))
+		case e.Err == "" && age < r.TTL:
+			lookupsTotal.WithLabelValues(kind, "hit").Inc()
+			return e, nil
+		case e.Err == "" && age < r.TTL+r.StaleTTL:
+			lookupsTotal.WithLabelValues(kind, "stale").Inc()
+			go r.refresh(kind, key, fetch)
+			return e, nil
+		}
+	}
+
+	lookupsTotal.WithLabelValues(kind, "miss").Inc()
+
+	v, err, _ := r.group.Do(key, func() (interface{}, error) {
+		return r.fetchAndStore(ctx, kind, key, fetch)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v.(*Entry), nil
+}
+
+// cachedErr recreates the error of a negative cache entry
+func cachedErr(e *Entry) error {
+	if e.NotFound {
+		return fmt.Errorf("%w (%s)", api.ErrHandleNotFound, e.Err)
+	}
+	return errors.New(e.Err)
+}
+
+func (r *Resolver) refresh(kind, key string, fetch func(context.Context) (*Entry, error)) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err, _ := r.group.Do(key, func() (interface{}, error) {
+		return r.fetchAndStore(ctx, kind, key, fetch)
+	})
+	if err != nil {
+		log.Debugw("refreshing stale identity", "key", key, "err", err)
+	}
+}
+
+func (r *Resolver) fetchAndStore(ctx context.Context, kind, key string, fetch func(context.Context) (*Entry, error)) (*Entry, error) {
+	if lk, ok := r.Cache.(Locker); ok && r.LockWait > 0 {
+		unlock, e, err := r.lockOrWait(ctx, lk, kind, key)
+		if e != nil || err != nil {
+			return e, err
+		}
+		if unlock != nil {
+			defer unlock()
+		}
+	}
+
+	e, err := fetch(ctx)
+	if err != nil {
+		resolveErrorsTotal.WithLabelValues(kind).Inc()
+
+		// a cancelled lookup says nothing about the identity
+		if ctx.Err() == nil && r.NegativeTTL > 0 {
+			neg := &Entry{Err: err.Error(), NotFound: errors.Is(err, api.ErrHandleNotFound), CachedAt: time.Now()}
+			if serr := r.Cache.Set(ctx, key, neg, r.NegativeTTL); serr != nil {
+				log.Warnw("writing identity cache", "key", key, "err", serr)
+			}
+		}
+		return nil, err
+	}
+
+	e.CachedAt = time.Now()
+	if err := r.Cache.Set(ctx, key, e, r.TTL+r.StaleTTL); err != nil {
+		log.Warnw("writing identity cache", "key", key, "err", err)
+	}
+
+	return e, nil
+}
+
+// lockOrWait takes the shared lock on key. If another process holds it, this
+// waits for that process to cache its result and returns that instead. If the
+// wait runs out, or the lock can't be used at all, it returns nothing and the
+// caller resolves the identity itself.
+func (r *Resolver) lockOrWait(ctx context.Context, lk Locker, kind, key string) (func(), *Entry, error) {
+	// the lock outlives a single lookup's timeout, in case its holder dies
+	unlock, ok, err := lk.TryLock(ctx, key, 2*r.LockWait)
+	if err != nil {
+		log.Warnw("taking identity lock", "key", key, "err", err)
+		return nil, nil, nil
+	}
+	if ok {
+		return unlock, nil, nil
+	}
+
+	start := time.Now()
+	t := time.NewTicker(50 * time.Millisecond)
+	defer t.Stop()
+
+	for time.Since(start) < r.LockWait {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+
+		// anything still there from before is stale, so wait for a fresh
+		// entry
+		e, err := r.Cache.Get(ctx, key)
+		if err != nil || e == nil {
+			continue
+		}
+
+		age := time.Since(e.CachedAt)
+		switch {
+		case e.Err != "" && age < r.NegativeTTL:
+			lookupsTotal.WithLabelValues(kind, "waited").Inc()
+			return nil, nil, errors.Join(ErrCachedFailure, errors.New(e.Err))
+		case e.Err == "" && age < r.TTL:
+			lookupsTotal.WithLabelValues(kind, "waited").Inc()
+			return nil, e, nil
+		}
+	}
+
+	lookupsTotal.WithLabelValues(kind, "lock_timeout").Inc()
+	return nil, nil, nil
+}
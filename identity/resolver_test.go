@@ -0,0 +1,261 @@
+package identity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/api"
+	"github.com/bluesky-social/indigo/did"
+)
+
+type countingResolver struct {
+	calls int32
+	delay time.Duration
+	docs  map[string]*did.Document
+}
+
+func (cr *countingResolver) GetDocument(ctx context.Context, didstr string) (*did.Document, error) {
+	atomic.AddInt32(&cr.calls, 1)
+	time.Sleep(cr.delay)
+	doc, ok := cr.docs[didstr]
+	if !ok {
+		return nil, fmt.Errorf("no such did: %s", didstr)
+	}
+	return doc, nil
+}
+
+func (cr *countingResolver) ResolveHandleToDid(ctx context.Context, handle string) (string, error) {
+	atomic.AddInt32(&cr.calls, 1)
+	switch handle {
+	case "foo.test":
+		return "did:plc:foo", nil
+	case "gone.test":
+		return "", fmt.Errorf("%w: %s", api.ErrHandleNotFound, handle)
+	}
+	return "", fmt.Errorf("no such handle: %s", handle)
+}
+
+func (cr *countingResolver) count() int32 {
+	return atomic.LoadInt32(&cr.calls)
+}
+
+func TestResolverCaching(t *testing.T) {
+	ctx := context.Background()
+	fake := &countingResolver{docs: map[string]*did.Document{"did:plc:foo": {}}}
+	r := NewResolver(fake, fake, NewMemCache(100))
+
+	for i := 0; i < 3; i++ {
+		if _, err := r.GetDocument(ctx, "did:plc:foo"); err != nil {
+			t.Fatal(err)
+		}
+		d, err := r.ResolveHandleToDid(ctx, "Foo.Test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d != "did:plc:foo" {
+			t.Fatalf("wrong did for handle: %s", d)
+		}
+	}
+	if n := fake.count(); n != 2 {
+		t.Fatalf("expected one lookup each, got %d", n)
+	}
+
+	// failures are cached too
+	for i := 0; i < 3; i++ {
+		if _, err := r.GetDocument(ctx, "did:plc:bar"); err == nil {
+			t.Fatal("expected unknown did to fail")
+		} else if i > 0 && !errors.Is(err, ErrCachedFailure) {
+			t.Fatalf("expected cached failure, got %v", err)
+		}
+	}
+	if n := fake.count(); n != 3 {
+		t.Fatalf("expected the failure to be cached, got %d lookups", n)
+	}
+
+	if err := r.PurgeDid(ctx, "did:plc:foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.GetDocument(ctx, "did:plc:foo"); err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.count(); n != 4 {
+		t.Fatalf("expected purged did to be looked up again, got %d lookups", n)
+	}
+
+	// cached failures stay distinguishable as definite or not
+	for i := 0; i < 2; i++ {
+		if _, err := r.ResolveHandleToDid(ctx, "gone.test"); !errors.Is(err, api.ErrHandleNotFound) {
+			t.Fatalf("expected handle not found, got %v", err)
+		}
+		if _, err := r.ResolveHandleToDid(ctx, "down.test"); err == nil || errors.Is(err, api.ErrHandleNotFound) {
+			t.Fatalf("expected an indefinite failure, got %v", err)
+		}
+	}
+}
+
+func TestResolverStale(t *testing.T) {
+	ctx := context.Background()
+	fake := &countingResolver{docs: map[string]*did.Document{"did:plc:foo": {}}}
+	r := NewResolver(fake, nil, NewMemCache(100))
+	r.TTL = time.Millisecond
+
+	if _, err := r.GetDocument(ctx, "did:plc:foo"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// served from the cache, but refreshed behind the scenes
+	fake.delay = 50 * time.Millisecond
+	start := time.Now()
+	if _, err := r.GetDocument(ctx, "did:plc:foo"); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 40*time.Millisecond {
+		t.Fatal("stale lookup waited for the refresh")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if n := fake.count(); n != 2 {
+		t.Fatalf("expected a background refresh, got %d lookups", n)
+	}
+}
+
+func TestResolverSingleflight(t *testing.T) {
+	ctx := context.Background()
+	fake := &countingResolver{delay: 50 * time.Millisecond, docs: map[string]*did.Document{"did:plc:foo": {}}}
+	r := NewResolver(fake, nil, NewMemCache(100))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := r.GetDocument(ctx, "did:plc:foo"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := fake.count(); n != 1 {
+		t.Fatalf("expected concurrent lookups to be shared, got %d", n)
+	}
+}
+
+// sharedCache stands in for redis, shared by resolvers in different processes
+type sharedCache struct {
+	*MemCache
+
+	lk    sync.Mutex
+	locks map[string]bool
+}
+
+func (sc *sharedCache) TryLock(ctx context.Context, key string, ttl time.Duration) (func(), bool, error) {
+	sc.lk.Lock()
+	defer sc.lk.Unlock()
+
+	if sc.locks[key] {
+		return nil, false, nil
+	}
+	sc.locks[key] = true
+
+	return func() {
+		sc.lk.Lock()
+		defer sc.lk.Unlock()
+		delete(sc.locks, key)
+	}, true, nil
+}
+
+func TestResolverSharedLock(t *testing.T) {
+	ctx := context.Background()
+	fake := &countingResolver{delay: 100 * time.Millisecond, docs: map[string]*did.Document{"did:plc:foo": {}}}
+	cache := &sharedCache{MemCache: NewMemCache(100), locks: make(map[string]bool)}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		// separate resolvers don't share a singleflight group
+		r := NewResolver(fake, nil, cache)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := r.GetDocument(ctx, "did:plc:foo"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := fake.count(); n != 1 {
+		t.Fatalf("expected lookups across resolvers to be shared, got %d", n)
+	}
+
+	// waiting gives up eventually, and resolves anyway
+	unlock, _, _ := cache.TryLock(ctx, "did:did:plc:bar", time.Minute)
+	defer unlock()
+
+	r := NewResolver(fake, nil, cache)
+	r.LockWait = 100 * time.Millisecond
+	if _, err := r.GetDocument(ctx, "did:plc:bar"); err == nil {
+		t.Fatal("expected unknown did to fail")
+	}
+	if n := fake.count(); n != 2 {
+		t.Fatalf("expected a lookup after the lock wait ran out, got %d", n)
+	}
+}
+
+func TestResolveBatch(t *testing.T) {
+	ctx := context.Background()
+	fake := &countingResolver{docs: map[string]*did.Document{
+		"did:plc:foo": {AlsoKnownAs: []string{"at://foo.test"}},
+		"did:plc:baz": {AlsoKnownAs: []string{"at://bar.test"}},
+	}}
+	r := NewResolver(fake, fake, NewMemCache(100))
+
+	idents := []string{"did:plc:foo", "foo.test", "did:plc:baz", "did:plc:nope", "did:plc:foo"}
+	res := r.ResolveBatch(ctx, idents, 3)
+	if len(res) != len(idents) {
+		t.Fatalf("expected %d results, got %d", len(idents), len(res))
+	}
+
+	for i, id := range res {
+		if id.Input != idents[i] {
+			t.Fatalf("results out of order: %s != %s", id.Input, idents[i])
+		}
+	}
+
+	if res[0].Err != nil || res[0].Handle != "foo.test" || res[1].Did != "did:plc:foo" || res[1].Handle != "foo.test" {
+		t.Fatalf("unexpected results for foo: %+v %+v", res[0], res[1])
+	}
+
+	// claims a handle that doesn't point back at it
+	if res[2].Err != nil || res[2].Handle != "" {
+		t.Fatalf("expected unverified handle to be left out: %+v", res[2])
+	}
+
+	if res[3].Err == nil {
+		t.Fatal("expected unknown did to fail")
+	}
+
+	in := make(chan string)
+	out := make(chan *Identity)
+	go r.ResolveStream(ctx, in, 2, out)
+	go func() {
+		for _, id := range idents {
+			in <- id
+		}
+		close(in)
+	}()
+
+	var n int
+	for range out {
+		n++
+	}
+	if n != len(idents) {
+		t.Fatalf("expected %d streamed results, got %d", len(idents), n)
+	}
+}
@@ -0,0 +1,98 @@
+package indexer
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	bsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/carstore"
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/repomgr"
+	"github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/xrpc"
+
+	"github.com/ipfs/go-cid"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestFetchNewRepoStreams(t *testing.T) {
+	tt := testIndexer(t)
+	defer tt.Cleanup()
+	// without aggregations, repos we have none of are streamed in whole
+	tt.ix.doAggregations = false
+
+	ctx := context.Background()
+
+	// the repo as its PDS has it
+	dir := t.TempDir()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(dir, "car.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "carstore"), 0775); err != nil {
+		t.Fatal(err)
+	}
+	cs, err := carstore.NewCarStore(db, filepath.Join(dir, "carstore"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := repomgr.NewRepoManager(cs, &util.FakeKeyManager{})
+	if err := src.InitNewActor(ctx, 1, "alice.test", "did:plc:alice", "alice", "FAKE", "userboy"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, _, err := src.CreateRecord(ctx, 1, "app.bsky.feed.post", &bsky.FeedPost{
+			CreatedAt: time.Now().Format(util.ISO8601),
+			Text:      "hello",
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	head, err := src.GetRepoRoot(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if xrpc.RequestMethod(r) != "com.atproto.sync.getRepo" || r.URL.Query().Get("did") != "did:plc:alice" {
+			http.NotFound(w, r)
+			return
+		}
+		buf := new(bytes.Buffer)
+		if err := src.ReadRepo(ctx, 1, cid.Undef, cid.Undef, buf); err != nil {
+			t.Error(err)
+		}
+		w.Header().Set("Content-Type", "application/vnd.ipld.car")
+		w.Write(buf.Bytes())
+	}))
+	defer srv.Close()
+
+	if err := tt.ix.db.AutoMigrate(&models.PDS{}); err != nil {
+		t.Fatal(err)
+	}
+	pds := models.PDS{Host: strings.TrimPrefix(srv.URL, "http://")}
+	if err := tt.ix.db.Create(&pds).Error; err != nil {
+		t.Fatal(err)
+	}
+	ai := &models.ActorInfo{Uid: 7, Did: "did:plc:alice", Handle: "alice.test", PDS: pds.ID}
+
+	if err := tt.ix.FetchAndIndexRepo(ctx, &crawlWork{act: ai, initScrape: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := tt.rm.GetRepoRoot(ctx, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != head {
+		t.Fatalf("expected fetched repo to be at %s, got %s", head, got)
+	}
+}
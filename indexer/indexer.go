@@ -5,6 +5,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"time"
 
 	comatproto "github.com/bluesky-social/indigo/api/atproto"
@@ -12,10 +13,12 @@ import (
 	"github.com/bluesky-social/indigo/did"
 	"github.com/bluesky-social/indigo/events"
 	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/lex/validate"
 	"github.com/bluesky-social/indigo/models"
 	"github.com/bluesky-social/indigo/notifs"
 	"github.com/bluesky-social/indigo/repomgr"
 	"github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/util/extract"
 	"github.com/bluesky-social/indigo/xrpc"
 
 	"github.com/ipfs/go-cid"
@@ -45,6 +48,10 @@ type Indexer struct {
 
 	doAggregations bool
 
+	// RecordValidator, if set, is used to check records before they are
+	// indexed. Records that fail are still passed on, but not indexed.
+	RecordValidator *validate.Validator
+
 	SendRemoteFollow       func(context.Context, string, uint) error
 	CreateExternalUser     func(context.Context, string) (*models.ActorInfo, error)
 	ApplyPDSClientSettings func(*xrpc.Client)
@@ -54,6 +61,7 @@ func NewIndexer(db *gorm.DB, notifman notifs.NotificationManager, evtman *events
 	db.AutoMigrate(&models.FeedPost{})
 	db.AutoMigrate(&models.ActorInfo{})
 	db.AutoMigrate(&models.FollowRecord{})
+	db.AutoMigrate(&models.BlockRecord{})
 	db.AutoMigrate(&models.VoteRecord{})
 	db.AutoMigrate(&models.RepostRecord{})
 
@@ -108,9 +116,9 @@ func (ix *Indexer) HandleRepoEvent(ctx context.Context, evt *repomgr.RepoEvent)
 		return err
 	}
 
-	toobig := false
+	toobig := evt.TooBig
 	slice := evt.RepoSlice
-	if len(slice) > MaxEventSliceLength || len(outops) > MaxOpsSliceLength {
+	if toobig || len(slice) > MaxEventSliceLength || len(outops) > MaxOpsSliceLength {
 		slice = nil
 		outops = nil
 		toobig = true
@@ -143,6 +151,13 @@ func (ix *Indexer) HandleRepoEvent(ctx context.Context, evt *repomgr.RepoEvent)
 }
 
 func (ix *Indexer) handleRepoOp(ctx context.Context, evt *repomgr.RepoEvent, op *repomgr.RepoOp) error {
+	if ix.RecordValidator != nil && op.Record != nil {
+		if err := ix.RecordValidator.ValidateRecord(op.Collection, op.Record); err != nil {
+			log.Warnw("not indexing invalid record", "uid", evt.User, "collection", op.Collection, "rkey", op.Rkey, "err", err)
+			return nil
+		}
+	}
+
 	switch op.Kind {
 	case repomgr.EvtKindCreateRecord:
 		if err := ix.crawlRecordReferences(ctx, op); err != nil {
@@ -216,6 +231,8 @@ func (ix *Indexer) handleRecordDelete(ctx context.Context, evt *repomgr.RepoEven
 		return ix.handleRecordDeleteFeedLike(ctx, evt, op)
 	case "app.bsky.graph.follow":
 		return ix.handleRecordDeleteGraphFollow(ctx, evt, op)
+	case "app.bsky.graph.block":
+		return ix.db.Where("blocker = ? AND rkey = ?", evt.User, op.Rkey).Delete(&models.BlockRecord{}).Error
 	case "app.bsky.graph.confirmation":
 		return nil
 	default:
@@ -306,6 +323,8 @@ func (ix *Indexer) handleRecordCreate(ctx context.Context, evt *repomgr.RepoEven
 		return nil, ix.handleRecordCreateFeedLike(ctx, rec, evt, op)
 	case *bsky.GraphFollow:
 		return out, ix.handleRecordCreateGraphFollow(ctx, rec, evt, op)
+	case *bsky.GraphBlock:
+		return out, ix.handleRecordCreateGraphBlock(ctx, rec, evt, op)
 	case *bsky.ActorProfile:
 		log.Infof("TODO: got actor profile record creation, need to do something with this")
 	default:
@@ -456,6 +475,21 @@ func (ix *Indexer) handleRecordCreateGraphFollow(ctx context.Context, rec *bsky.
 	return nil
 }
 
+func (ix *Indexer) handleRecordCreateGraphBlock(ctx context.Context, rec *bsky.GraphBlock, evt *repomgr.RepoEvent, op *repomgr.RepoOp) error {
+	subj, err := ix.GetUserOrMissing(ctx, rec.Subject)
+	if err != nil {
+		return fmt.Errorf("failed to lookup user: %w", err)
+	}
+
+	// 'blocker' blocked 'target'
+	return ix.db.Create(&models.BlockRecord{
+		Blocker: evt.User,
+		Target:  subj.Uid,
+		Rkey:    op.Rkey,
+		Cid:     op.RecCid.String(),
+	}).Error
+}
+
 func (ix *Indexer) handleRecordUpdate(ctx context.Context, evt *repomgr.RepoEvent, op *repomgr.RepoOp, local bool) error {
 	log.Infow("record update event", "collection", op.Collection)
 
@@ -587,18 +621,39 @@ func (ix *Indexer) handleRecordCreateFeedPost(ctx context.Context, user models.U
 		_ = rootref
 	}
 
-	var mentions []*models.ActorInfo
+	var mentioned []string
 	for _, e := range rec.Entities {
 		if e.Type == "mention" {
-			ai, err := ix.GetUserOrMissing(ctx, e.Value)
-			if err != nil {
-				return err
-			}
+			mentioned = append(mentioned, e.Value)
+		}
+	}
+	if content, ok := extract.Record(rec); ok {
+		mentioned = append(mentioned, content.Mentions...)
+	}
 
+	var mentions []*models.ActorInfo
+	seen := make(map[models.Uid]bool)
+	for _, did := range mentioned {
+		ai, err := ix.GetUserOrMissing(ctx, did)
+		if err != nil {
+			return err
+		}
+
+		if !seen[ai.Uid] {
+			seen[ai.Uid] = true
 			mentions = append(mentions, ai)
 		}
 	}
 
+	var quoted *models.FeedPost
+	if quri := quotedPostUri(rec); quri != "" {
+		qp, err := ix.GetPostOrMissing(ctx, quri)
+		if err != nil {
+			return err
+		}
+		quoted = qp
+	}
+
 	var maybe models.FeedPost
 	if err := ix.db.Find(&maybe, "rkey = ? AND author = ?", rkey, user).Error; err != nil {
 		return err
@@ -631,7 +686,7 @@ func (ix *Indexer) handleRecordCreateFeedPost(ctx context.Context, user models.U
 		}
 	}
 
-	if err := ix.addNewPostNotification(ctx, rec, &fp, mentions); err != nil {
+	if err := ix.addNewPostNotification(ctx, rec, &fp, mentions, quoted); err != nil {
 		return err
 	}
 
@@ -743,7 +798,31 @@ func (ix *Indexer) LookupUserByHandle(ctx context.Context, handle string) (*mode
 	return &ai, nil
 }
 
-func (ix *Indexer) addNewPostNotification(ctx context.Context, post *bsky.FeedPost, fp *models.FeedPost, mentions []*models.ActorInfo) error {
+// quotedPostUri returns the URI of the post a post quotes, if it embeds one
+func quotedPostUri(post *bsky.FeedPost) string {
+	if post.Embed == nil {
+		return ""
+	}
+
+	var ref *bsky.EmbedRecord
+	switch {
+	case post.Embed.EmbedRecord != nil:
+		ref = post.Embed.EmbedRecord
+	case post.Embed.EmbedRecordWithMedia != nil:
+		ref = post.Embed.EmbedRecordWithMedia.Record
+	}
+	if ref == nil || ref.Record == nil {
+		return ""
+	}
+
+	puri, err := util.ParseAtUri(ref.Record.Uri)
+	if err != nil || puri.Collection != "app.bsky.feed.post" {
+		return ""
+	}
+	return ref.Record.Uri
+}
+
+func (ix *Indexer) addNewPostNotification(ctx context.Context, post *bsky.FeedPost, fp *models.FeedPost, mentions []*models.ActorInfo, quoted *models.FeedPost) error {
 	if post.Reply != nil {
 		replyto, err := ix.GetPost(ctx, post.Reply.Parent.Uri)
 		if err != nil {
@@ -762,6 +841,12 @@ func (ix *Indexer) addNewPostNotification(ctx context.Context, post *bsky.FeedPo
 		}
 	}
 
+	if quoted != nil {
+		if err := ix.notifman.AddQuote(ctx, fp.Author, fp.ID, quoted); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -895,6 +980,13 @@ func (ix *Indexer) FetchAndIndexRepo(ctx context.Context, job *crawlWork) error
 		from = curHead.String()
 	} else {
 		span.SetAttributes(attribute.Bool("full", true))
+
+		// indexing records needs the ops of every commit, but otherwise a
+		// repo we have none of is streamed straight into the carstore, so
+		// that however large it is it isn't held in memory
+		if !ix.doAggregations {
+			return ix.streamNewRepo(ctx, c, ai)
+		}
 	}
 
 	// TODO: max size on these? A malicious PDS could just send us a petabyte sized repo here and kill us
@@ -916,3 +1008,26 @@ func (ix *Indexer) FetchAndIndexRepo(ctx context.Context, job *crawlWork) error
 
 	return nil
 }
+
+// streamNewRepo fetches the whole repo of a user we have no repo for, and
+// imports it as it arrives
+func (ix *Indexer) streamNewRepo(ctx context.Context, c *xrpc.Client, ai *models.ActorInfo) error {
+	log.Infow("SyncGetRepo (streaming)", "did", ai.Did, "user", ai.Handle)
+
+	pr, pw := io.Pipe()
+	// stops the download if the import gives up early
+	defer pr.Close()
+
+	go func() {
+		_, err := c.DownloadStream(ctx, "com.atproto.sync.getRepo", map[string]interface{}{"did": ai.Did}, pw, nil)
+		if err != nil {
+			err = fmt.Errorf("failed to fetch repo: %w", err)
+		}
+		pw.CloseWithError(err)
+	}()
+
+	if err := ix.repomgr.ImportRepoStream(ctx, ai.Uid, ai.Did, pr); err != nil {
+		return fmt.Errorf("importing fetched repo: %w", err)
+	}
+	return nil
+}
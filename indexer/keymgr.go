@@ -4,6 +4,9 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/bluesky-social/indigo/util/keyutil"
+	"github.com/bluesky-social/indigo/util/signer"
+
 	did "github.com/whyrusleeping/go-did"
 	"go.opentelemetry.io/otel"
 )
@@ -11,7 +14,7 @@ import (
 type KeyManager struct {
 	didr DidResolver
 
-	signingKey *did.PrivKey
+	signer signer.Signer
 }
 
 type DidResolver interface {
@@ -19,12 +22,28 @@ type DidResolver interface {
 }
 
 func NewKeyManager(didr DidResolver, k *did.PrivKey) *KeyManager {
+	km := &KeyManager{didr: didr}
+	if k != nil {
+		km.signer = signer.NewKeySigner(k)
+	}
+	return km
+}
+
+// NewKeyManagerWithSigner returns a key manager signing with a key which may
+// be held outside of the process, such as in a KMS
+func NewKeyManagerWithSigner(didr DidResolver, s signer.Signer) *KeyManager {
 	return &KeyManager{
-		didr:       didr,
-		signingKey: k,
+		didr:   didr,
+		signer: s,
 	}
 }
 
+// SetSigner replaces the signing key. It must be called before the key
+// manager is used.
+func (km *KeyManager) SetSigner(s signer.Signer) {
+	km.signer = s
+}
+
 func (km *KeyManager) VerifyUserSignature(ctx context.Context, did string, sig []byte, msg []byte) error {
 	ctx, span := otel.Tracer("keymgr").Start(ctx, "verifySignature")
 	defer span.End()
@@ -34,7 +53,7 @@ func (km *KeyManager) VerifyUserSignature(ctx context.Context, did string, sig [
 		return err
 	}
 
-	err = k.Verify(msg, sig)
+	err = keyutil.Verify(k, msg, sig)
 	if err != nil {
 		log.Warnw("signature failed to verify", "err", err, "did", did, "pubKey", k, "sigBytes", sig, "msgBytes", msg)
 	}
@@ -52,7 +71,7 @@ func (km *KeyManager) getKey(ctx context.Context, did string) (*did.PubKey, erro
 		return nil, err
 	}
 
-	pubk, err := doc.GetPublicKey("#atproto")
+	pubk, err := keyutil.DocumentKey(doc, did, "#atproto")
 	if err != nil {
 		return nil, err
 	}
@@ -61,9 +80,9 @@ func (km *KeyManager) getKey(ctx context.Context, did string) (*did.PubKey, erro
 }
 
 func (km *KeyManager) SignForUser(ctx context.Context, did string, msg []byte) ([]byte, error) {
-	if km.signingKey == nil {
+	if km.signer == nil {
 		return nil, fmt.Errorf("key manager does not have a signing key, cannot sign")
 	}
 
-	return km.signingKey.Sign(msg)
+	return km.signer.Sign(ctx, msg)
 }
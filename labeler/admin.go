@@ -9,15 +9,22 @@ import (
 	appbsky "github.com/bluesky-social/indigo/api/bsky"
 	lexutil "github.com/bluesky-social/indigo/lex/util"
 	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/util/syntax"
 )
 
 // This is probably only a temporary method
 func (s *Server) hydrateRepoView(ctx context.Context, did, indexedAt string) *comatproto.AdminDefs_RepoView {
+	handle, err := s.handles.get(ctx, did)
+	if err != nil {
+		logger.WarnCtx(ctx, "failed to look up cached handle", "did", did, "err", err)
+		handle = syntax.HandleInvalid
+	}
+
 	return &comatproto.AdminDefs_RepoView{
 		// TODO(bnewbold): populate more, or more correctly, from some backend?
 		Did:            did,
 		Email:          nil,
-		Handle:         "TODO",
+		Handle:         handle,
 		IndexedAt:      indexedAt,
 		Moderation:     nil,
 		RelatedRecords: nil,
@@ -50,6 +57,8 @@ func (s *Server) hydrateModerationActionViews(ctx context.Context, rows []models
 	var out []*comatproto.AdminDefs_ActionView
 
 	for _, row := range rows {
+		// the views point into row, so it can't be shared between iterations
+		row := row
 
 		resolvedReportIds := []int64{}
 		var resolutionRows []models.ModerationReportResolution
@@ -120,6 +129,7 @@ func (s *Server) hydrateModerationActionDetails(ctx context.Context, rows []mode
 
 	var out []*comatproto.AdminDefs_ActionViewDetail
 	for _, row := range rows {
+		row := row
 
 		var reportRows []models.ModerationReport
 		result := s.db.Joins("left join moderation_report_resolutions on moderation_report_resolutions.report_id = moderation_reports.id").Where("moderation_report_resolutions.action_id = ?", row.ID).Find(&reportRows)
@@ -192,6 +202,7 @@ func (s *Server) hydrateModerationReportViews(ctx context.Context, rows []models
 
 	var out []*comatproto.AdminDefs_ReportView
 	for _, row := range rows {
+		row := row
 		var resolvedByActionIds []int64
 		var actionRows []models.ModerationAction
 		result := s.db.Joins("left join moderation_report_resolutions on moderation_report_resolutions.action_id = moderation_actions.id").Where("moderation_report_resolutions.report_id = ?", row.ID).Where("moderation_actions.reversed_at IS NULL").Find(&actionRows)
@@ -241,6 +252,7 @@ func (s *Server) hydrateModerationReportDetails(ctx context.Context, rows []mode
 
 	var out []*comatproto.AdminDefs_ReportViewDetail
 	for _, row := range rows {
+		row := row
 		var actionRows []models.ModerationAction
 		result := s.db.Joins("left join moderation_report_resolutions on moderation_report_resolutions.action_id = moderation_actions.id").Where("moderation_report_resolutions.report_id = ?", row.ID).Where("moderation_actions.reversed_at IS NULL").Find(&actionRows)
 		if result.Error != nil {
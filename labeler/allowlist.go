@@ -0,0 +1,307 @@
+package labeler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	didres "github.com/bluesky-social/indigo/did"
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/xrpc"
+
+	"github.com/labstack/echo/v4"
+	"github.com/whyrusleeping/go-did"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	allowKindDid  = "did"
+	allowKindHost = "host"
+)
+
+var errConfiguredEntry = errors.New("configured when labelmaker starts, and can't be removed at runtime")
+
+// allowList is the set of repos processed in allow-list mode: those of
+// particular DIDs, and of every account hosted on particular PDSs. Entries
+// are either configured when the server starts, or added at runtime with
+// the admin endpoints, in which case they are persisted.
+type allowList struct {
+	// dir resolves DIDs to the PDS hosting them, for host entries
+	dir didres.Resolver
+
+	lk sync.RWMutex
+	// the values are whether the entry was configured, rather than added
+	// at runtime
+	dids  map[string]bool
+	hosts map[string]bool
+}
+
+// EnableAllowList only processes repo events for the DIDs in dids, and for
+// accounts on the PDS hosts in hosts, instead of the whole firehose. More can
+// be added (and removed) at runtime with the admin endpoints. dir is used to
+// find the PDS of accounts, and is only needed if there are host entries.
+// Must be called before SubscribeBGS.
+func (s *Server) EnableAllowList(dir didres.Resolver, dids, hosts []string) error {
+	al := &allowList{
+		dir:   dir,
+		dids:  make(map[string]bool),
+		hosts: make(map[string]bool),
+	}
+
+	var rows []models.LabelerAllowEntry
+	if err := s.db.Find(&rows).Error; err != nil {
+		return fmt.Errorf("loading allow-list: %w", err)
+	}
+	for _, row := range rows {
+		switch row.Kind {
+		case allowKindDid:
+			al.dids[row.Value] = false
+		case allowKindHost:
+			al.hosts[row.Value] = false
+		}
+	}
+
+	for _, d := range dids {
+		d, err := normalizeAllowDid(d)
+		if err != nil {
+			return err
+		}
+		al.dids[d] = true
+	}
+	for _, h := range hosts {
+		h, err := normalizeAllowHost(h)
+		if err != nil {
+			return err
+		}
+		al.hosts[h] = true
+	}
+
+	log.Infof("allow-list mode enabled dids=%d hosts=%d", len(al.dids), len(al.hosts))
+	s.allowList = al
+	return nil
+}
+
+func normalizeAllowDid(d string) (string, error) {
+	if _, err := did.ParseDID(d); err != nil || !strings.HasPrefix(d, "did:") {
+		return "", fmt.Errorf("invalid DID in allow-list: %q", d)
+	}
+	return d, nil
+}
+
+// normalizeAllowHost accepts a PDS host with or without a scheme, and returns
+// just the host (and port, if any), which is what PDS endpoints are compared
+// by
+func normalizeAllowHost(h string) (string, error) {
+	raw := h
+	if !strings.Contains(h, "://") {
+		h = "https://" + h
+	}
+	u, err := url.Parse(h)
+	if err != nil || u.Host == "" || (u.Path != "" && u.Path != "/") {
+		return "", fmt.Errorf("invalid PDS host in allow-list: %q", raw)
+	}
+	return strings.ToLower(u.Host), nil
+}
+
+// allowed checks whether the repo of an account should be processed. Accounts
+// whose PDS can't be found aren't processed.
+func (s *Server) allowed(ctx context.Context, repoDid string) bool {
+	al := s.allowList
+	if al == nil {
+		return true
+	}
+
+	al.lk.RLock()
+	_, ok := al.dids[repoDid]
+	anyHosts := len(al.hosts) > 0
+	al.lk.RUnlock()
+	if ok {
+		return true
+	}
+	if !anyHosts || al.dir == nil {
+		return false
+	}
+
+	host, err := al.pdsHost(ctx, repoDid)
+	if err != nil {
+		logger.WarnCtx(ctx, "failed to find PDS for allow-list", "err", err)
+		return false
+	}
+
+	al.lk.RLock()
+	defer al.lk.RUnlock()
+	_, ok = al.hosts[host]
+	return ok
+}
+
+func (al *allowList) pdsHost(ctx context.Context, repoDid string) (string, error) {
+	doc, err := al.dir.GetDocument(ctx, repoDid)
+	if err != nil {
+		return "", err
+	}
+	endpoint, err := xrpc.ServiceEndpoint(doc, "atproto_pds")
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("bad PDS endpoint %q: %w", endpoint, err)
+	}
+	return strings.ToLower(u.Host), nil
+}
+
+type allowListEntry struct {
+	Value string `json:"value"`
+	// Configured entries are set when labelmaker starts, and can't be
+	// removed at runtime
+	Configured bool `json:"configured"`
+}
+
+type allowListView struct {
+	Enabled bool             `json:"enabled"`
+	Dids    []allowListEntry `json:"dids"`
+	Hosts   []allowListEntry `json:"hosts"`
+}
+
+type allowListChange struct {
+	Dids  []string `json:"dids"`
+	Hosts []string `json:"hosts"`
+}
+
+func entryList(m map[string]bool) []allowListEntry {
+	out := make([]allowListEntry, 0, len(m))
+	for v, configured := range m {
+		out = append(out, allowListEntry{Value: v, Configured: configured})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Value < out[j].Value })
+	return out
+}
+
+func (s *Server) allowListView() allowListView {
+	al := s.allowList
+	if al == nil {
+		return allowListView{Dids: []allowListEntry{}, Hosts: []allowListEntry{}}
+	}
+
+	al.lk.RLock()
+	defer al.lk.RUnlock()
+	return allowListView{
+		Enabled: true,
+		Dids:    entryList(al.dids),
+		Hosts:   entryList(al.hosts),
+	}
+}
+
+// bindAllowListChange reads and normalizes the changes to the allow-list in a
+// request
+func (s *Server) bindAllowListChange(c echo.Context) ([]models.LabelerAllowEntry, error) {
+	if s.allowList == nil {
+		return nil, fmt.Errorf("allow-list mode is not enabled")
+	}
+
+	var body allowListChange
+	if err := c.Bind(&body); err != nil {
+		return nil, err
+	}
+
+	var out []models.LabelerAllowEntry
+	for _, d := range body.Dids {
+		d, err := normalizeAllowDid(d)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, models.LabelerAllowEntry{Kind: allowKindDid, Value: d})
+	}
+	for _, h := range body.Hosts {
+		h, err := normalizeAllowHost(h)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, models.LabelerAllowEntry{Kind: allowKindHost, Value: h})
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no dids or hosts given")
+	}
+	return out, nil
+}
+
+func (al *allowList) entries(kind string) map[string]bool {
+	if kind == allowKindDid {
+		return al.dids
+	}
+	return al.hosts
+}
+
+func (s *Server) HandleGetAllowList(c echo.Context) error {
+	return c.JSON(200, s.allowListView())
+}
+
+// HandleAddAllowList adds DIDs and PDS hosts to the allow-list, persisting
+// them
+func (s *Server) HandleAddAllowList(c echo.Context) error {
+	entries, err := s.bindAllowListChange(c)
+	if err != nil {
+		return adminError(c, 400, err)
+	}
+	if err := s.allowList.add(c.Request().Context(), s.db, entries); err != nil {
+		return err
+	}
+	return c.JSON(200, s.allowListView())
+}
+
+// HandleRemoveAllowList removes DIDs and PDS hosts which were added at
+// runtime from the allow-list
+func (s *Server) HandleRemoveAllowList(c echo.Context) error {
+	entries, err := s.bindAllowListChange(c)
+	if err != nil {
+		return adminError(c, 400, err)
+	}
+	if err := s.allowList.remove(c.Request().Context(), s.db, entries); err != nil {
+		if errors.Is(err, errConfiguredEntry) {
+			return adminError(c, 400, err)
+		}
+		return err
+	}
+	return c.JSON(200, s.allowListView())
+}
+
+func (al *allowList) add(ctx context.Context, db *gorm.DB, entries []models.LabelerAllowEntry) error {
+	al.lk.Lock()
+	defer al.lk.Unlock()
+
+	if err := db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&entries).Error; err != nil {
+		return err
+	}
+	for _, e := range entries {
+		m := al.entries(e.Kind)
+		if _, ok := m[e.Value]; !ok {
+			m[e.Value] = false
+		}
+		log.Infof("added to allow-list %s=%s", e.Kind, e.Value)
+	}
+	return nil
+}
+
+func (al *allowList) remove(ctx context.Context, db *gorm.DB, entries []models.LabelerAllowEntry) error {
+	al.lk.Lock()
+	defer al.lk.Unlock()
+
+	for _, e := range entries {
+		if al.entries(e.Kind)[e.Value] {
+			return fmt.Errorf("%s %s is %w", e.Kind, e.Value, errConfiguredEntry)
+		}
+	}
+	for _, e := range entries {
+		if err := db.WithContext(ctx).Where("kind = ? AND value = ?", e.Kind, e.Value).Delete(&models.LabelerAllowEntry{}).Error; err != nil {
+			return err
+		}
+		delete(al.entries(e.Kind), e.Value)
+		log.Infof("removed from allow-list %s=%s", e.Kind, e.Value)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package labeler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/whyrusleeping/go-did"
+)
+
+// pdsResolver resolves DIDs to documents naming their PDS
+type pdsResolver map[string]string
+
+func (r pdsResolver) GetDocument(ctx context.Context, didstr string) (*did.Document, error) {
+	endpoint, ok := r[didstr]
+	if !ok {
+		return nil, fmt.Errorf("no such DID: %s", didstr)
+	}
+	var doc did.Document
+	err := json.Unmarshal([]byte(fmt.Sprintf(`{
+		"id": %q,
+		"service": [{"id": "#atproto_pds", "type": "AtprotoPersonalDataServer", "serviceEndpoint": %q}]
+	}`, didstr, endpoint)), &doc)
+	return &doc, err
+}
+
+func TestAllowList(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	lm := testLabelMaker(t)
+
+	// everything is processed until allow-list mode is enabled
+	assert.True(lm.allowed(ctx, "did:plc:anyone"))
+
+	dir := pdsResolver{
+		"did:plc:member":   "https://pds.community.example",
+		"did:plc:local":    "http://localhost:2583",
+		"did:plc:outsider": "https://bsky.social",
+	}
+	err := lm.EnableAllowList(dir, []string{"did:plc:listed"}, []string{"https://PDS.community.example/", "localhost:2583"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for d, want := range map[string]bool{
+		"did:plc:listed":   true,
+		"did:plc:member":   true,
+		"did:plc:local":    true,
+		"did:plc:outsider": false,
+		"did:plc:missing":  false,
+	} {
+		assert.Equal(want, lm.allowed(ctx, d), d)
+	}
+
+	assert.Error(lm.EnableAllowList(dir, []string{"alice.example"}, nil))
+	assert.Error(lm.EnableAllowList(dir, nil, []string{"https://pds.example/xrpc"}))
+}
+
+func TestAllowListAdmin(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	e := echo.New()
+	lm := testLabelMaker(t)
+
+	rec := dashboardRequest(t, e, http.MethodPost, "/admin/allowlist/add", `{"dids": ["did:plc:new"]}`, lm.HandleAddAllowList)
+	assert.Equal(400, rec.Code)
+	assert.Contains(rec.Body.String(), "not enabled")
+
+	dir := pdsResolver{"did:plc:member": "https://pds.community.example"}
+	if err := lm.EnableAllowList(dir, []string{"did:plc:listed"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.False(lm.allowed(ctx, "did:plc:new"))
+	assert.False(lm.allowed(ctx, "did:plc:member"))
+
+	rec = dashboardRequest(t, e, http.MethodPost, "/admin/allowlist/add",
+		`{"dids": ["did:plc:new"], "hosts": ["pds.community.example"]}`, lm.HandleAddAllowList)
+	assert.Equal(200, rec.Code)
+	var view allowListView
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &view))
+	assert.True(view.Enabled)
+	assert.Equal([]allowListEntry{{Value: "did:plc:listed", Configured: true}, {Value: "did:plc:new"}}, view.Dids)
+	assert.Equal([]allowListEntry{{Value: "pds.community.example"}}, view.Hosts)
+	assert.True(lm.allowed(ctx, "did:plc:new"))
+	assert.True(lm.allowed(ctx, "did:plc:member"))
+
+	// adding again is harmless
+	rec = dashboardRequest(t, e, http.MethodPost, "/admin/allowlist/add", `{"dids": ["did:plc:new"]}`, lm.HandleAddAllowList)
+	assert.Equal(200, rec.Code)
+
+	rec = dashboardRequest(t, e, http.MethodPost, "/admin/allowlist/add", `{"dids": ["bob.example"]}`, lm.HandleAddAllowList)
+	assert.Equal(400, rec.Code)
+
+	// entries added at runtime persist
+	if err := lm.EnableAllowList(dir, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(lm.allowed(ctx, "did:plc:new"))
+	assert.True(lm.allowed(ctx, "did:plc:member"))
+	assert.False(lm.allowed(ctx, "did:plc:listed"))
+
+	if err := lm.EnableAllowList(dir, []string{"did:plc:listed"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	rec = dashboardRequest(t, e, http.MethodPost, "/admin/allowlist/remove", `{"dids": ["did:plc:listed"]}`, lm.HandleRemoveAllowList)
+	assert.Equal(400, rec.Code)
+	assert.Contains(rec.Body.String(), "can't be removed")
+	assert.True(lm.allowed(ctx, "did:plc:listed"))
+
+	rec = dashboardRequest(t, e, http.MethodPost, "/admin/allowlist/remove",
+		`{"dids": ["did:plc:new"], "hosts": ["https://pds.community.example"]}`, lm.HandleRemoveAllowList)
+	assert.Equal(200, rec.Code)
+	assert.False(lm.allowed(ctx, "did:plc:new"))
+	assert.False(lm.allowed(ctx, "did:plc:member"))
+
+	if err := lm.EnableAllowList(dir, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	rec = dashboardRequest(t, e, http.MethodGet, "/admin/allowlist", "", lm.HandleGetAllowList)
+	view = allowListView{}
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &view))
+	assert.Len(view.Dids, 0)
+	assert.Len(view.Hosts, 0)
+}
@@ -10,6 +10,8 @@ import (
 	"github.com/bluesky-social/indigo/events"
 	"github.com/bluesky-social/indigo/models"
 	util "github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/util/invalidation"
+	"github.com/bluesky-social/indigo/util/labelsig"
 
 	"gorm.io/gorm/clause"
 )
@@ -17,12 +19,28 @@ import (
 // Persist to database (and repo), and emit events.
 func (s *Server) CommitLabels(ctx context.Context, labels []*label.Label, negate bool) error {
 
-	now := time.Now()
+	if !negate {
+		// labels with values clients don't know of would be ignored, but
+		// negations have to go out for whatever values were put on before
+		labels = s.declaredLabels(labels)
+	}
+
+	now := time.Now().UTC()
 	nowStr := now.Format(util.ISO8601)
 	var labelRows []models.Label
 
 	for _, l := range labels {
 		l.Cts = nowStr
+		if negate {
+			// the repo record is what lets clients check the label, so it
+			// has to say it is a negation too
+			l.Neg = true
+		}
+		if s.signer != nil {
+			if err := labelsig.Sign(ctx, l, s.signer); err != nil {
+				return err
+			}
+		}
 
 		path, _, err := s.repoman.CreateRecord(ctx, s.user.UserId, "com.atproto.label.label", l)
 		if err != nil {
@@ -39,6 +57,7 @@ func (s *Server) CommitLabels(ctx context.Context, labels []*label.Label, negate
 			Val:       l.Val,
 			Neg:       nil,
 			RepoRKey:  &rkey,
+			Sig:       l.Sig,
 			CreatedAt: now,
 		}
 		if negate {
@@ -72,5 +91,14 @@ func (s *Server) CommitLabels(ctx context.Context, labels []*label.Label, negate
 		}
 	}
 
+	// ... and tell other services, whose caches of moderation state are stale
+	if s.invalidations != nil {
+		for _, l := range labels {
+			if err := s.invalidations.Publish(ctx, invalidation.LabelAdded("labelmaker", l)); err != nil {
+				log.Warnw("failed to publish label", "uri", l.Uri, "val", l.Val, "err", err)
+			}
+		}
+	}
+
 	return nil
 }
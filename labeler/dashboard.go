@@ -0,0 +1,448 @@
+package labeler
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"time"
+
+	atproto "github.com/bluesky-social/indigo/api/atproto"
+	label "github.com/bluesky-social/indigo/api/label"
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/util"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	"gorm.io/gorm"
+)
+
+// The admin dashboard is a page of plain HTML and JavaScript, served under
+// /admin/, which only uses the JSON endpoints under /admin/api/. Both are
+// behind the admin password, as the other admin routes.
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// dashboardActions are the moderation actions the review queue can take on
+// the subject of reports, by the names the dashboard uses
+var dashboardActions = map[string]string{
+	"acknowledge": "com.atproto.admin.defs#acknowledge",
+	"flag":        "com.atproto.admin.defs#flag",
+	"takedown":    "com.atproto.admin.defs#takedown",
+}
+
+func (s *Server) RegisterDashboardHandlers(e *echo.Echo) error {
+	static, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		return err
+	}
+	files := http.StripPrefix("/admin/", http.FileServer(http.FS(static)))
+
+	e.GET("/admin", func(c echo.Context) error {
+		return c.Redirect(http.StatusMovedPermanently, "/admin/")
+	})
+	e.GET("/admin/", echo.WrapHandler(files))
+	e.GET("/admin/assets/*", echo.WrapHandler(files))
+
+	e.GET("/admin/api/stats", s.HandleDashboardStats)
+	e.GET("/admin/api/labels", s.HandleDashboardLabels)
+	e.GET("/admin/api/reports", s.HandleDashboardReports)
+	e.POST("/admin/api/reports/resolve", s.HandleDashboardResolveReports)
+	e.GET("/admin/api/rules", s.HandleDashboardGetRules)
+	e.PUT("/admin/api/rules", s.HandleDashboardPutRules)
+	e.GET("/admin/api/profileHistory", s.HandleProfileHistory)
+	return nil
+}
+
+// adminError responds with an error the dashboard (or other admin clients)
+// can show
+func adminError(c echo.Context, code int, err error) error {
+	return c.JSON(code, map[string]string{"error": http.StatusText(code), "message": err.Error()})
+}
+
+func queryLimit(c echo.Context, def, max int) (int, error) {
+	p := c.QueryParam("limit")
+	if p == "" {
+		return def, nil
+	}
+	limit, err := strconv.Atoi(p)
+	if err != nil || limit <= 0 {
+		return 0, fmt.Errorf("invalid limit: %q", p)
+	}
+	if limit > max {
+		limit = max
+	}
+	return limit, nil
+}
+
+type dashboardLabelCounts struct {
+	Total    int64 `json:"total"`
+	LastHour int64 `json:"lastHour"`
+	LastDay  int64 `json:"lastDay"`
+}
+
+type dashboardStats struct {
+	Did         string               `json:"did"`
+	Handle      string               `json:"handle"`
+	Labels      dashboardLabelCounts `json:"labels"`
+	OpenReports int64                `json:"openReports"`
+	Rules       int                  `json:"rules"`
+	Throughput  []sourceThroughput   `json:"throughput"`
+}
+
+func (s *Server) HandleDashboardStats(c echo.Context) error {
+	ctx, span := otel.Tracer("server").Start(c.Request().Context(), "HandleDashboardStats")
+	defer span.End()
+
+	now := time.Now()
+	out := dashboardStats{
+		Did:        s.user.Did,
+		Handle:     s.user.Handle,
+		Throughput: s.throughput.snapshot(now, s.configuredSources()),
+	}
+
+	db := s.db.WithContext(ctx)
+	if err := db.Model(&models.Label{}).Count(&out.Labels.Total).Error; err != nil {
+		return err
+	}
+	if err := db.Model(&models.Label{}).Where("created_at > ?", now.Add(-time.Hour)).Count(&out.Labels.LastHour).Error; err != nil {
+		return err
+	}
+	if err := db.Model(&models.Label{}).Where("created_at > ?", now.Add(-24*time.Hour)).Count(&out.Labels.LastDay).Error; err != nil {
+		return err
+	}
+	if err := s.openReports(ctx).Count(&out.OpenReports).Error; err != nil {
+		return err
+	}
+	if e := s.rules.Load(); e != nil {
+		out.Rules = len(e.RuleSet().Rules)
+	}
+
+	return c.JSON(200, out)
+}
+
+type dashboardLabel struct {
+	ID     uint64  `json:"id"`
+	Src    string  `json:"src"`
+	Uri    string  `json:"uri"`
+	Cid    *string `json:"cid,omitempty"`
+	Val    string  `json:"val"`
+	Neg    bool    `json:"neg"`
+	Signed bool    `json:"signed"`
+	Cts    string  `json:"cts"`
+}
+
+type dashboardLabels struct {
+	Labels []dashboardLabel `json:"labels"`
+	Cursor string           `json:"cursor,omitempty"`
+}
+
+// HandleDashboardLabels lists the most recent labels, newest first,
+// optionally only those with a value (val) or on a subject (uri)
+func (s *Server) HandleDashboardLabels(c echo.Context) error {
+	ctx, span := otel.Tracer("server").Start(c.Request().Context(), "HandleDashboardLabels")
+	defer span.End()
+
+	limit, err := queryLimit(c, 50, 500)
+	if err != nil {
+		return adminError(c, 400, err)
+	}
+
+	q := s.db.WithContext(ctx).Order("id desc").Limit(limit)
+	if cursor := c.QueryParam("cursor"); cursor != "" {
+		id, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return adminError(c, 400, fmt.Errorf("invalid cursor: %q", cursor))
+		}
+		q = q.Where("id < ?", id)
+	}
+	if val := c.QueryParam("val"); val != "" {
+		q = q.Where("val = ?", val)
+	}
+	if uri := c.QueryParam("uri"); uri != "" {
+		q = q.Where("uri = ?", uri)
+	}
+
+	var rows []models.Label
+	if err := q.Find(&rows).Error; err != nil {
+		return err
+	}
+
+	out := dashboardLabels{Labels: make([]dashboardLabel, 0, len(rows))}
+	for _, row := range rows {
+		out.Labels = append(out.Labels, dashboardLabel{
+			ID:     row.ID,
+			Src:    row.SourceDid,
+			Uri:    row.Uri,
+			Cid:    row.Cid,
+			Val:    row.Val,
+			Neg:    row.Neg != nil && *row.Neg,
+			Signed: len(row.Sig) > 0,
+			Cts:    row.CreatedAt.UTC().Format(util.ISO8601),
+		})
+	}
+	if len(rows) == limit {
+		out.Cursor = strconv.FormatUint(rows[len(rows)-1].ID, 10)
+	}
+	return c.JSON(200, out)
+}
+
+type dashboardReport struct {
+	ID          uint64  `json:"id"`
+	SubjectType string  `json:"subjectType"`
+	SubjectDid  string  `json:"subjectDid"`
+	SubjectUri  *string `json:"subjectUri,omitempty"`
+	SubjectCid  *string `json:"subjectCid,omitempty"`
+	ReasonType  string  `json:"reasonType"`
+	Reason      *string `json:"reason,omitempty"`
+	ReportedBy  string  `json:"reportedBy"`
+	CreatedAt   string  `json:"createdAt"`
+}
+
+type dashboardReports struct {
+	Reports []dashboardReport `json:"reports"`
+	Cursor  string            `json:"cursor,omitempty"`
+}
+
+// openReports selects the reports no moderation action resolved yet
+func (s *Server) openReports(ctx context.Context) *gorm.DB {
+	return s.db.WithContext(ctx).Model(&models.ModerationReport{}).
+		Where("id NOT IN (?)", s.db.Model(&models.ModerationReportResolution{}).Select("report_id"))
+}
+
+// HandleDashboardReports lists the review queue: the unresolved reports,
+// oldest first
+func (s *Server) HandleDashboardReports(c echo.Context) error {
+	ctx, span := otel.Tracer("server").Start(c.Request().Context(), "HandleDashboardReports")
+	defer span.End()
+
+	limit, err := queryLimit(c, 50, 500)
+	if err != nil {
+		return adminError(c, 400, err)
+	}
+
+	q := s.openReports(ctx).Order("id").Limit(limit)
+	if cursor := c.QueryParam("cursor"); cursor != "" {
+		id, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return adminError(c, 400, fmt.Errorf("invalid cursor: %q", cursor))
+		}
+		q = q.Where("id > ?", id)
+	}
+
+	var rows []models.ModerationReport
+	if err := q.Find(&rows).Error; err != nil {
+		return err
+	}
+
+	out := dashboardReports{Reports: make([]dashboardReport, 0, len(rows))}
+	for _, row := range rows {
+		out.Reports = append(out.Reports, dashboardReport{
+			ID:          row.ID,
+			SubjectType: row.SubjectType,
+			SubjectDid:  row.SubjectDid,
+			SubjectUri:  row.SubjectUri,
+			SubjectCid:  row.SubjectCid,
+			ReasonType:  row.ReasonType,
+			Reason:      row.Reason,
+			ReportedBy:  row.ReportedByDid,
+			CreatedAt:   row.CreatedAt.UTC().Format(util.ISO8601),
+		})
+	}
+	if len(rows) == limit {
+		out.Cursor = strconv.FormatUint(rows[len(rows)-1].ID, 10)
+	}
+	return c.JSON(200, out)
+}
+
+type dashboardResolveInput struct {
+	ReportIds []uint64 `json:"reportIds"`
+	// Action is acknowledge, flag or takedown
+	Action string `json:"action"`
+	// Labels are the values of labels to put on the reports' subjects
+	Labels []string `json:"labels,omitempty"`
+	Reason string   `json:"reason"`
+}
+
+type dashboardResolveOutput struct {
+	ActionIds []int64 `json:"actionIds"`
+}
+
+// HandleDashboardResolveReports takes a moderation action on the subjects of
+// reports from the review queue, optionally labeling them, and resolves the
+// reports. Reports about different subjects get an action each.
+func (s *Server) HandleDashboardResolveReports(c echo.Context) error {
+	ctx, span := otel.Tracer("server").Start(c.Request().Context(), "HandleDashboardResolveReports")
+	defer span.End()
+
+	var body dashboardResolveInput
+	if err := c.Bind(&body); err != nil {
+		return adminError(c, 400, err)
+	}
+	action, ok := dashboardActions[body.Action]
+	if !ok {
+		return adminError(c, 400, fmt.Errorf("unknown action %q (expected acknowledge, flag or takedown)", body.Action))
+	}
+	if body.Reason == "" {
+		return adminError(c, 400, fmt.Errorf("a reason is required"))
+	}
+	if len(body.ReportIds) == 0 {
+		return adminError(c, 400, fmt.Errorf("no reports to resolve"))
+	}
+	if err := s.checkLabelValues(body.Labels); err != nil {
+		return adminError(c, 400, err)
+	}
+
+	var rows []models.ModerationReport
+	if err := s.openReports(ctx).Where("id IN ?", body.ReportIds).Order("id").Find(&rows).Error; err != nil {
+		return err
+	}
+	if len(rows) != len(body.ReportIds) {
+		return adminError(c, 400, fmt.Errorf("some of the reports are already resolved, or don't exist"))
+	}
+
+	type subjectKey struct {
+		typ, did, uri, cid string
+	}
+	var order []subjectKey
+	bySubject := make(map[subjectKey][]models.ModerationReport)
+	for _, row := range rows {
+		k := subjectKey{typ: row.SubjectType, did: row.SubjectDid}
+		if row.SubjectUri != nil {
+			k.uri = *row.SubjectUri
+		}
+		if row.SubjectCid != nil {
+			k.cid = *row.SubjectCid
+		}
+		if _, ok := bySubject[k]; !ok {
+			order = append(order, k)
+		}
+		bySubject[k] = append(bySubject[k], row)
+	}
+
+	out := dashboardResolveOutput{ActionIds: []int64{}}
+	for _, k := range order {
+		reports := bySubject[k]
+		actionID, err := s.resolveSubjectReports(ctx, reports, action, body.Labels, body.Reason)
+		if err != nil {
+			return err
+		}
+		out.ActionIds = append(out.ActionIds, actionID)
+	}
+	return c.JSON(200, out)
+}
+
+// resolveSubjectReports takes an action on the subject of reports (which
+// must all have the same subject), labels it, and resolves the reports with
+// the action
+func (s *Server) resolveSubjectReports(ctx context.Context, reports []models.ModerationReport, action string, vals []string, reason string) (int64, error) {
+	first := reports[0]
+
+	var subj atproto.AdminTakeModerationAction_Input_Subject
+	labelURI := "at://" + first.SubjectDid
+	switch first.SubjectType {
+	case "com.atproto.repo.repoRef":
+		subj.AdminDefs_RepoRef = &atproto.AdminDefs_RepoRef{Did: first.SubjectDid}
+	case "com.atproto.repo.recordRef":
+		if first.SubjectUri == nil || first.SubjectCid == nil {
+			return 0, fmt.Errorf("report %d has an incomplete record subject", first.ID)
+		}
+		subj.RepoStrongRef = &atproto.RepoStrongRef{Uri: *first.SubjectUri, Cid: *first.SubjectCid}
+		labelURI = *first.SubjectUri
+	default:
+		return 0, fmt.Errorf("unsupported report subject type: %s", first.SubjectType)
+	}
+
+	av, err := s.handleComAtprotoAdminTakeModerationAction(ctx, &atproto.AdminTakeModerationAction_Input{
+		Action:          action,
+		CreateLabelVals: vals,
+		CreatedBy:       s.user.Did,
+		Reason:          reason,
+		Subject:         &subj,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if len(vals) > 0 {
+		var labels []*label.Label
+		for _, val := range vals {
+			labels = append(labels, &label.Label{
+				Src: s.user.Did,
+				Uri: labelURI,
+				Cid: first.SubjectCid,
+				Val: val,
+			})
+		}
+		s.throughput.add(sourceModerator, len(labels), time.Now())
+		if err := s.CommitLabels(ctx, labels, false); err != nil {
+			return 0, err
+		}
+	}
+
+	ids := make([]int64, 0, len(reports))
+	for _, r := range reports {
+		ids = append(ids, int64(r.ID))
+	}
+	if _, err := s.handleComAtprotoAdminResolveModerationReports(ctx, &atproto.AdminResolveModerationReports_Input{
+		ActionId:  av.Id,
+		CreatedBy: s.user.Did,
+		ReportIds: ids,
+	}); err != nil {
+		return 0, err
+	}
+
+	log.Infof("resolved reports from dashboard action=%s actionId=%d reports=%v labels=%v", action, av.Id, ids, vals)
+	return av.Id, nil
+}
+
+type dashboardRuleView struct {
+	Name        string   `json:"name"`
+	Collections []string `json:"collections,omitempty"`
+	Actions     []string `json:"actions"`
+}
+
+type dashboardRules struct {
+	// YAML is the rules as they can be edited, empty if no rules are
+	// configured
+	YAML string `json:"yaml"`
+	// File is where changes to the rules are saved, if anywhere
+	File  string              `json:"file,omitempty"`
+	Rules []dashboardRuleView `json:"rules"`
+}
+
+func (s *Server) HandleDashboardGetRules(c echo.Context) error {
+	b, file, err := s.currentRules()
+	if err != nil {
+		return err
+	}
+
+	out := dashboardRules{YAML: string(b), File: file, Rules: []dashboardRuleView{}}
+	if e := s.rules.Load(); e != nil {
+		for _, r := range e.RuleSet().Rules {
+			rv := dashboardRuleView{Name: r.Name, Collections: r.Collections, Actions: []string{}}
+			for _, a := range r.Actions {
+				rv.Actions = append(rv.Actions, a.Kind())
+			}
+			out.Rules = append(out.Rules, rv)
+		}
+	}
+	return c.JSON(200, out)
+}
+
+// HandleDashboardPutRules replaces the rules with the YAML request body. The
+// rules are checked before they replace the old ones.
+func (s *Server) HandleDashboardPutRules(c echo.Context) error {
+	b, err := io.ReadAll(io.LimitReader(c.Request().Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if err := s.ReplaceRules(b); err != nil {
+		return adminError(c, 400, err)
+	}
+	return s.HandleDashboardGetRules(c)
+}
@@ -0,0 +1,250 @@
+// labelmaker admin dashboard. Everything here goes through the JSON
+// endpoints under /admin/api/, with the browser's basic auth credentials.
+'use strict';
+
+const api = '/admin/api';
+
+async function request(method, path, body, contentType) {
+  const opts = { method, headers: {} };
+  if (body !== undefined) {
+    opts.headers['Content-Type'] = contentType || 'application/json';
+    opts.body = contentType ? body : JSON.stringify(body);
+  }
+  const resp = await fetch(api + path, opts);
+  let out = null;
+  try {
+    out = await resp.json();
+  } catch (e) {
+    // errors from outside the dashboard handlers have no body
+  }
+  if (!resp.ok) {
+    throw new Error((out && out.message) || resp.status + ' ' + resp.statusText);
+  }
+  return out;
+}
+
+function showError(err) {
+  const el = document.getElementById('error');
+  if (!err) {
+    el.hidden = true;
+    return;
+  }
+  el.textContent = err.message || String(err);
+  el.hidden = false;
+}
+
+function el(tag, attrs, ...children) {
+  const e = document.createElement(tag);
+  for (const [k, v] of Object.entries(attrs || {})) {
+    if (k === 'class') {
+      e.className = v;
+    } else {
+      e.setAttribute(k, v);
+    }
+  }
+  for (const c of children) {
+    e.append(c === null || c === undefined ? '' : c);
+  }
+  return e;
+}
+
+function time(s) {
+  return new Date(s).toLocaleString();
+}
+
+function sparkline(values) {
+  const ns = 'http://www.w3.org/2000/svg';
+  const svg = document.createElementNS(ns, 'svg');
+  svg.setAttribute('class', 'spark');
+  svg.setAttribute('viewBox', '0 0 ' + (values.length - 1) + ' 10');
+  svg.setAttribute('preserveAspectRatio', 'none');
+  const top = Math.max(1, ...values);
+  const line = document.createElementNS(ns, 'polyline');
+  line.setAttribute('vector-effect', 'non-scaling-stroke');
+  line.setAttribute('points', values.map((v, i) => i + ',' + (10 - (v / top) * 10)).join(' '));
+  svg.append(line);
+  return svg;
+}
+
+// overview
+
+async function loadStats() {
+  const stats = await request('GET', '/stats');
+  document.getElementById('identity').textContent = stats.handle + ' (' + stats.did + ')';
+  document.getElementById('stat-total').textContent = stats.labels.total;
+  document.getElementById('stat-hour').textContent = stats.labels.lastHour;
+  document.getElementById('stat-day').textContent = stats.labels.lastDay;
+  document.getElementById('stat-reports').textContent = stats.openReports;
+  document.getElementById('stat-rules').textContent = stats.rules;
+
+  const body = document.getElementById('throughput');
+  body.replaceChildren(...stats.throughput.map((t) =>
+    el('tr', {}, el('td', {}, t.source), el('td', {}, t.lastHour), el('td', {}, sparkline(t.perMinute)))));
+}
+
+// labels
+
+let labelCursor = '';
+
+async function loadLabels(more) {
+  const form = document.getElementById('label-filter');
+  const params = new URLSearchParams();
+  for (const name of ['val', 'uri']) {
+    if (form.elements[name].value) {
+      params.set(name, form.elements[name].value.trim());
+    }
+  }
+  if (more && labelCursor) {
+    params.set('cursor', labelCursor);
+  }
+
+  const out = await request('GET', '/labels?' + params);
+  const rows = out.labels.map((l) =>
+    el('tr', {},
+      el('td', {}, time(l.cts)),
+      el('td', { class: l.neg ? 'neg' : '' }, l.val),
+      el('td', { class: 'mono' }, l.uri, l.cid ? el('div', { class: 'muted' }, l.cid) : null),
+      el('td', { class: 'mono' }, l.src),
+      el('td', { class: 'muted' }, l.signed ? 'signed' : '')));
+
+  const body = document.getElementById('label-rows');
+  if (more) {
+    body.append(...rows);
+  } else {
+    body.replaceChildren(...rows);
+  }
+  labelCursor = out.cursor || '';
+  document.getElementById('labels-more').hidden = !labelCursor;
+}
+
+// review queue
+
+let reportCursor = '';
+
+function reportSubject(r) {
+  const history = el('a', { href: '#profiles', class: 'muted' }, 'profile history');
+  history.addEventListener('click', handle(() => loadProfile(r.subjectDid)));
+  if (r.subjectUri) {
+    return el('span', {}, r.subjectUri, el('div', { class: 'muted' }, r.subjectCid), history);
+  }
+  return el('span', {}, r.subjectDid, el('div', {}, history));
+}
+
+async function loadReports(more) {
+  const params = new URLSearchParams();
+  if (more && reportCursor) {
+    params.set('cursor', reportCursor);
+  }
+
+  const out = await request('GET', '/reports?' + params);
+  const rows = out.reports.map((r) =>
+    el('tr', {},
+      el('td', {}, el('input', { type: 'checkbox', value: r.id, class: 'report-select' })),
+      el('td', {}, time(r.createdAt)),
+      el('td', { class: 'mono' }, reportSubject(r)),
+      el('td', {}, r.reasonType.replace(/^com\.atproto\.moderation\.defs#/, ''),
+        r.reason ? el('div', { class: 'muted' }, r.reason) : null),
+      el('td', { class: 'mono' }, r.reportedBy)));
+
+  const body = document.getElementById('report-rows');
+  if (more) {
+    body.append(...rows);
+  } else {
+    body.replaceChildren(...rows);
+  }
+  reportCursor = out.cursor || '';
+  document.getElementById('reports-more').hidden = !reportCursor;
+}
+
+async function resolveReports(ev) {
+  ev.preventDefault();
+  const form = ev.target;
+  const ids = [...document.querySelectorAll('.report-select:checked')].map((c) => Number(c.value));
+  if (ids.length === 0) {
+    throw new Error('select the reports to resolve first');
+  }
+  const labels = form.elements.labels.value.split(',').map((s) => s.trim()).filter((s) => s);
+
+  await request('POST', '/reports/resolve', {
+    reportIds: ids,
+    action: form.elements.action.value,
+    labels,
+    reason: form.elements.reason.value,
+  });
+  form.reset();
+  document.getElementById('select-all').checked = false;
+  await Promise.all([loadReports(false), loadStats(), loadLabels(false)]);
+}
+
+// profile history
+
+async function loadProfile(did) {
+  document.getElementById('profile-lookup').elements.did.value = did;
+  const out = await request('GET', '/profileHistory?' + new URLSearchParams({ did }));
+  const changed = (v, field) => (v.changed.includes(field) ? 'changed' : '');
+  document.getElementById('profile-rows').replaceChildren(...out.versions.map((v) =>
+    el('tr', {},
+      el('td', {}, time(v.seenAt)),
+      el('td', { class: changed(v, 'display_name') }, v.displayName),
+      el('td', { class: changed(v, 'description') }, v.description),
+      el('td', { class: 'mono ' + changed(v, 'avatar') }, v.avatarCid),
+      el('td', { class: 'muted' }, v.changed.join(', ') || 'first seen'))));
+}
+
+// rules
+
+async function showRules(out) {
+  document.getElementById('rules-yaml').value = out.yaml;
+  document.getElementById('rules-file').textContent = out.file
+    ? 'saved to ' + out.file
+    : 'not backed by a file: changes last until labelmaker restarts';
+  document.getElementById('rule-list').replaceChildren(...out.rules.map((r) =>
+    el('li', {}, el('strong', {}, r.name), ' ',
+      el('span', { class: 'muted' }, (r.collections || ['all collections']).join(', ') + ' → ' + r.actions.join(', ')))));
+}
+
+async function loadRules() {
+  showRules(await request('GET', '/rules'));
+}
+
+async function saveRules() {
+  const status = document.getElementById('rules-status');
+  const yaml = document.getElementById('rules-yaml').value;
+  showRules(await request('PUT', '/rules', yaml, 'application/yaml'));
+  status.textContent = 'saved at ' + new Date().toLocaleTimeString();
+}
+
+// wiring
+
+function handle(fn) {
+  return async (ev) => {
+    try {
+      showError(null);
+      await fn(ev);
+    } catch (err) {
+      showError(err);
+    }
+  };
+}
+
+document.getElementById('label-filter').addEventListener('submit', handle((ev) => {
+  ev.preventDefault();
+  return loadLabels(false);
+}));
+document.getElementById('labels-more').addEventListener('click', handle(() => loadLabels(true)));
+document.getElementById('reports-more').addEventListener('click', handle(() => loadReports(true)));
+document.getElementById('resolve').addEventListener('submit', handle(resolveReports));
+document.getElementById('profile-lookup').addEventListener('submit', handle((ev) => {
+  ev.preventDefault();
+  return loadProfile(ev.target.elements.did.value.trim());
+}));
+document.getElementById('select-all').addEventListener('change', (ev) => {
+  for (const c of document.querySelectorAll('.report-select')) {
+    c.checked = ev.target.checked;
+  }
+});
+document.getElementById('rules-save').addEventListener('click', handle(saveRules));
+document.getElementById('rules-reset').addEventListener('click', handle(loadRules));
+
+handle(() => Promise.all([loadStats(), loadLabels(false), loadReports(false), loadRules()]))();
+setInterval(handle(loadStats), 30000);
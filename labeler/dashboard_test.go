@@ -0,0 +1,243 @@
+package labeler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/models"
+)
+
+func TestThroughput(t *testing.T) {
+	assert := assert.New(t)
+	tp := newThroughput()
+	start := time.Unix(1700000000, 0).Truncate(time.Minute)
+
+	tp.add(sourceKeyword, 2, start)
+	tp.add(sourceKeyword, 1, start.Add(30*time.Second))
+	tp.add(sourceKeyword, 4, start.Add(5*time.Minute))
+	tp.add(sourceHiveAI, 0, start)
+
+	snap := tp.snapshot(start.Add(5*time.Minute), []string{sourceSQRL})
+	if assert.Len(snap, 2) {
+		assert.Equal(sourceKeyword, snap[0].Source)
+		assert.Equal(int64(7), snap[0].LastHour)
+		assert.Equal(int64(4), snap[0].PerMinute[throughputMinutes-1])
+		assert.Equal(int64(3), snap[0].PerMinute[throughputMinutes-6])
+		assert.Equal(sourceSQRL, snap[1].Source)
+		assert.Equal(int64(0), snap[1].LastHour)
+		assert.Len(snap[1].PerMinute, throughputMinutes)
+	}
+
+	// the first minute falls out of the window, and an hour later so does
+	// everything else
+	snap = tp.snapshot(start.Add(time.Hour), nil)
+	assert.Equal(int64(4), snap[0].LastHour)
+	tp.add(sourceKeyword, 1, start.Add(2*time.Hour))
+	snap = tp.snapshot(start.Add(2*time.Hour), nil)
+	assert.Equal(int64(1), snap[0].LastHour)
+
+	// counts older than the window are dropped
+	tp.add(sourceKeyword, 10, start)
+	snap = tp.snapshot(start.Add(2*time.Hour), nil)
+	assert.Equal(int64(1), snap[0].LastHour)
+}
+
+func dashboardRequest(t *testing.T, e *echo.Echo, method, path, body string, h echo.HandlerFunc) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" && strings.HasPrefix(body, "{") {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	recorder := httptest.NewRecorder()
+	if err := h(e.NewContext(req, recorder)); err != nil {
+		t.Fatal(err)
+	}
+	return recorder
+}
+
+func TestDashboardReviewQueue(t *testing.T) {
+	assert := assert.New(t)
+	e := echo.New()
+	lm := testLabelMaker(t)
+
+	rt := "com.atproto.moderation.defs#reasonSpam"
+	uri := "at://did:plc:123/app.bsky.feed.post/bcd234"
+	cid := "bafyreie5cvv4h45feadgeuwhbcutmh6t2ceseocckahdoe6uat64zmz454"
+	record := comatproto.ModerationCreateReport_Input{
+		ReasonType: &rt,
+		Subject: &comatproto.ModerationCreateReport_Input_Subject{
+			RepoStrongRef: &comatproto.RepoStrongRef{Uri: uri, Cid: cid},
+		},
+	}
+	first := testCreateReport(t, e, lm, &record)
+	second := testCreateReport(t, e, lm, &record)
+	repo := testCreateReport(t, e, lm, &comatproto.ModerationCreateReport_Input{
+		ReasonType: &rt,
+		Subject: &comatproto.ModerationCreateReport_Input_Subject{
+			AdminDefs_RepoRef: &comatproto.AdminDefs_RepoRef{Did: "did:plc:456"},
+		},
+	})
+
+	var queue dashboardReports
+	rec := dashboardRequest(t, e, http.MethodGet, "/admin/api/reports?limit=2", "", lm.HandleDashboardReports)
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &queue))
+	if assert.Len(queue.Reports, 2) {
+		assert.Equal(uint64(first.Id), queue.Reports[0].ID)
+		assert.Equal(uri, *queue.Reports[0].SubjectUri)
+		assert.Equal(uint64(second.Id), queue.Reports[1].ID)
+	}
+	assert.Equal("2", queue.Cursor)
+
+	rec = dashboardRequest(t, e, http.MethodPost, "/admin/api/reports/resolve",
+		`{"reportIds": [1, 2], "action": "delete", "reason": "spam"}`, lm.HandleDashboardResolveReports)
+	assert.Equal(400, rec.Code)
+	assert.Contains(rec.Body.String(), "unknown action")
+
+	rec = dashboardRequest(t, e, http.MethodPost, "/admin/api/reports/resolve",
+		`{"reportIds": [1, 2], "action": "takedown", "labels": ["spam"], "reason": "crypto spam"}`, lm.HandleDashboardResolveReports)
+	assert.Equal(200, rec.Code)
+	var resolved dashboardResolveOutput
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &resolved))
+	assert.Len(resolved.ActionIds, 1)
+
+	action := testGetAction(t, e, lm, resolved.ActionIds[0])
+	assert.Equal("com.atproto.admin.defs#takedown", *action.Action)
+	assert.Len(action.ResolvedReports, 2)
+
+	var labels []models.Label
+	assert.NoError(lm.db.Find(&labels).Error)
+	if assert.Len(labels, 1) {
+		assert.Equal(uri, labels[0].Uri)
+		assert.Equal("spam", labels[0].Val)
+		assert.Equal(cid, *labels[0].Cid)
+	}
+
+	// resolved reports leave the queue, and can't be resolved again
+	rec = dashboardRequest(t, e, http.MethodGet, "/admin/api/reports", "", lm.HandleDashboardReports)
+	queue = dashboardReports{}
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &queue))
+	if assert.Len(queue.Reports, 1) {
+		assert.Equal(uint64(repo.Id), queue.Reports[0].ID)
+		assert.Nil(queue.Reports[0].SubjectUri)
+	}
+	rec = dashboardRequest(t, e, http.MethodPost, "/admin/api/reports/resolve",
+		`{"reportIds": [2], "action": "acknowledge", "reason": "again"}`, lm.HandleDashboardResolveReports)
+	assert.Equal(400, rec.Code)
+
+	var stats dashboardStats
+	rec = dashboardRequest(t, e, http.MethodGet, "/admin/api/stats", "", lm.HandleDashboardStats)
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &stats))
+	assert.Equal(lm.user.Did, stats.Did)
+	assert.Equal(int64(1), stats.Labels.Total)
+	assert.Equal(int64(1), stats.Labels.LastHour)
+	assert.Equal(int64(1), stats.OpenReports)
+	if assert.Len(stats.Throughput, 1) {
+		assert.Equal(sourceModerator, stats.Throughput[0].Source)
+		assert.Equal(int64(1), stats.Throughput[0].LastHour)
+	}
+
+	var recent dashboardLabels
+	rec = dashboardRequest(t, e, http.MethodGet, "/admin/api/labels?val=spam", "", lm.HandleDashboardLabels)
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &recent))
+	if assert.Len(recent.Labels, 1) {
+		assert.Equal(lm.user.Did, recent.Labels[0].Src)
+	}
+	recent = dashboardLabels{}
+	rec = dashboardRequest(t, e, http.MethodGet, "/admin/api/labels?val=nudity", "", lm.HandleDashboardLabels)
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &recent))
+	assert.Len(recent.Labels, 0)
+}
+
+func TestDashboardRules(t *testing.T) {
+	assert := assert.New(t)
+	e := echo.New()
+	lm := testLabelMaker(t)
+
+	var out dashboardRules
+	rec := dashboardRequest(t, e, http.MethodGet, "/admin/api/rules", "", lm.HandleDashboardGetRules)
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &out))
+	assert.Equal("", out.YAML)
+	assert.Len(out.Rules, 0)
+
+	fname := filepath.Join(t.TempDir(), "rules.yaml")
+	orig := `rules:
+  - name: crypto
+    collections: [app.bsky.feed.post]
+    when: {field: text, contains: airdrop}
+    actions:
+      - label: spam
+`
+	if err := os.WriteFile(fname, []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := lm.LoadRulesFile(fname, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = dashboardRequest(t, e, http.MethodGet, "/admin/api/rules", "", lm.HandleDashboardGetRules)
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &out))
+	assert.Equal(orig, out.YAML)
+	assert.Equal(fname, out.File)
+	if assert.Len(out.Rules, 1) {
+		assert.Equal("crypto", out.Rules[0].Name)
+		assert.Equal([]string{"label"}, out.Rules[0].Actions)
+	}
+
+	// broken rules are refused, leaving the old ones in place
+	rec = dashboardRequest(t, e, http.MethodPut, "/admin/api/rules", "rules:\n  - name: broken\n    actions: [{}]\n", lm.HandleDashboardPutRules)
+	assert.Equal(400, rec.Code)
+	assert.Contains(rec.Body.String(), "message")
+	b, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(orig, string(b))
+	assert.Equal("crypto", lm.rules.Load().RuleSet().Rules[0].Name)
+
+	updated := strings.Replace(orig, "airdrop", "giveaway", 1)
+	rec = dashboardRequest(t, e, http.MethodPut, "/admin/api/rules", updated, lm.HandleDashboardPutRules)
+	assert.Equal(200, rec.Code)
+	b, err = os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(updated, string(b))
+	assert.Equal("giveaway", lm.rules.Load().RuleSet().Rules[0].When.Contains)
+}
+
+func TestDashboardStatic(t *testing.T) {
+	assert := assert.New(t)
+	e := echo.New()
+	lm := testLabelMaker(t)
+	if err := lm.RegisterDashboardHandlers(e); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]string{
+		"/admin/":               "<title>labelmaker admin</title>",
+		"/admin/assets/app.js":  "/admin/api",
+		"/admin/assets/missing": "404",
+	} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if want == "404" {
+			assert.Equal(404, rec.Code, path)
+			continue
+		}
+		assert.Equal(200, rec.Code, path)
+		assert.Contains(rec.Body.String(), want, path)
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin", nil))
+	assert.Equal(http.StatusMovedPermanently, rec.Code)
+}
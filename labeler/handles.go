@@ -0,0 +1,56 @@
+package labeler
+
+import (
+	"context"
+	"errors"
+
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/util/syntax"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// handleCache keeps the handles of accounts announced in #handle events, for
+// showing moderators who they are looking at
+type handleCache struct {
+	db *gorm.DB
+}
+
+// record saves the new handle of an account. Handles are unique, so any
+// other account still cached with the handle has lost it. The invalid
+// handle, sent for accounts whose handle no longer verifies, tombstones the
+// account's handle.
+func (hc *handleCache) record(ctx context.Context, did, handle string) error {
+	if handle == "" || handle == syntax.HandleInvalid {
+		logger.InfoCtx(ctx, "tombstoning handle")
+		return hc.db.WithContext(ctx).Delete(&models.LabelerHandle{}, "did = ?", did).Error
+	}
+
+	return hc.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Delete(&models.LabelerHandle{}, "handle = ? AND did != ?", handle, did)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected > 0 {
+			logger.InfoCtx(ctx, "tombstoned stale handle", "handle", handle, "accounts", res.RowsAffected)
+		}
+
+		row := models.LabelerHandle{Did: did, Handle: handle}
+		return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&row).Error
+	})
+}
+
+// get returns the cached handle of an account, or the invalid handle if none
+// is known
+func (hc *handleCache) get(ctx context.Context, did string) (string, error) {
+	var row models.LabelerHandle
+	err := hc.db.WithContext(ctx).Take(&row, "did = ?", did).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return syntax.HandleInvalid, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return row.Handle, nil
+}
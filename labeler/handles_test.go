@@ -0,0 +1,46 @@
+package labeler
+
+import (
+	"context"
+	"testing"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleCache(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	lm := testLabelMaker(t)
+
+	handle := func(did, h string) {
+		evt := &events.XRPCStreamEvent{RepoHandle: &comatproto.SyncSubscribeRepos_Handle{Did: did, Handle: h}}
+		if err := lm.handleBgsRepoEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cached := func(did string) string {
+		h, err := lm.handles.get(ctx, did)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	assert.Equal("handle.invalid", lm.hydrateRepoView(ctx, "did:plc:alice", "").Handle)
+
+	handle("did:plc:alice", "alice.example.com")
+	handle("did:plc:alice", "alice.test")
+	assert.Equal("alice.test", cached("did:plc:alice"))
+	assert.Equal("alice.test", lm.hydrateRepoView(ctx, "did:plc:alice", "").Handle)
+
+	// bob taking alice's handle tombstones it for alice
+	handle("did:plc:bob", "alice.test")
+	assert.Equal("alice.test", cached("did:plc:bob"))
+	assert.Equal("handle.invalid", cached("did:plc:alice"))
+
+	handle("did:plc:bob", "handle.invalid")
+	assert.Equal("handle.invalid", cached("did:plc:bob"))
+}
@@ -85,12 +85,12 @@ func testCreateReport(t *testing.T, e *echo.Echo, lm *Server, input *comatproto.
 	if err != nil {
 		t.Fatal(err)
 	}
-	req := httptest.NewRequest(http.MethodPost, "/xrpc/com.atproto.report.create", strings.NewReader(string(reportJSON)))
+	req := httptest.NewRequest(http.MethodPost, "/xrpc/com.atproto.moderation.createReport", strings.NewReader(string(reportJSON)))
 	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 	recorder := httptest.NewRecorder()
 	c := e.NewContext(req, recorder)
 
-	assert.NoError(lm.HandleComAtprotoReportCreate(c))
+	assert.NoError(lm.HandleComAtprotoModerationCreateReport(c))
 	assert.Equal(200, recorder.Code)
 
 	var out comatproto.ModerationCreateReport_Output
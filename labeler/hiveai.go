@@ -49,6 +49,9 @@ func NewHiveAILabeler(token string) HiveAILabeler {
 	}
 }
 
+// hiveAILabelValues are the values of all the labels SummarizeLabels returns
+var hiveAILabelValues = []string{"porn", "nude", "gore", "corpse", "self-harm"}
+
 func (resp *HiveAIResp) SummarizeLabels() []string {
 	var labels []string
 
@@ -0,0 +1,234 @@
+package labeler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/util/phash"
+	"github.com/bluesky-social/indigo/util/version"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// DefaultHashMaxDistance is how many bits image hashes can differ by and still
+// match, if not configured otherwise
+const DefaultHashMaxDistance = 30
+
+// HashList is a list of hashes of known images, eg of known abuse material,
+// with the labels to apply to images matching them
+type HashList interface {
+	// Match returns the labels of the hashes in the list h matches
+	Match(ctx context.Context, h phash.Hash) ([]string, error)
+}
+
+// ImageHashLabeler labels images whose perceptual hash matches a hash list.
+// Hashes are computed locally and cached per blob CID, so images never leave
+// the labelmaker, and images posted again are not downloaded again.
+type ImageHashLabeler struct {
+	Lists []HashList
+
+	hashes *lru.Cache
+}
+
+func NewImageHashLabeler(lists []HashList, cacheSize int) (*ImageHashLabeler, error) {
+	c, err := lru.New(cacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ImageHashLabeler{
+		Lists:  lists,
+		hashes: c,
+	}, nil
+}
+
+// CachedHash returns the hash of a blob, if it was already computed
+func (ihl *ImageHashLabeler) CachedHash(blob lexutil.LexBlob) (phash.Hash, bool) {
+	v, ok := ihl.hashes.Get(blob.Ref.String())
+	if !ok {
+		return phash.Hash{}, false
+	}
+	return v.(phash.Hash), true
+}
+
+func (ihl *ImageHashLabeler) LabelBlob(ctx context.Context, blob lexutil.LexBlob, blobBytes []byte) ([]string, error) {
+	h, ok := ihl.CachedHash(blob)
+	if !ok {
+		var err error
+		h, err = phash.Decode(bytes.NewReader(blobBytes))
+		if err != nil {
+			return nil, fmt.Errorf("hashing blob %s: %w", blob.Ref, err)
+		}
+		ihl.hashes.Add(blob.Ref.String(), h)
+	}
+	log.Debugf("image hash cid=%s hash=%s", blob.Ref, h)
+
+	return ihl.LabelHash(ctx, h)
+}
+
+// LabelHash returns the labels of all the lists an image hash matches
+func (ihl *ImageHashLabeler) LabelHash(ctx context.Context, h phash.Hash) ([]string, error) {
+	var labels []string
+	for _, l := range ihl.Lists {
+		vals, err := l.Match(ctx, h)
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, vals...)
+	}
+	if len(labels) > 0 {
+		log.Infof("image hash matched hash=%s labels=%v", h, labels)
+	}
+	return dedupeStrings(labels), nil
+}
+
+// HashListEntry is a hash in a hash list, and the label of images matching it
+type HashListEntry struct {
+	Hash  phash.Hash
+	Label string
+}
+
+// FileHashList is a hash list kept in memory, as loaded from a file
+type FileHashList struct {
+	Entries     []HashListEntry
+	MaxDistance int
+}
+
+// LoadHashListFile reads a hash list file, which has a hash (in hex) and the
+// label to apply on each line, separated by whitespace. Empty lines and lines
+// starting with # are skipped.
+func LoadHashListFile(path string, maxDistance int) (*FileHashList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseHashList(f, maxDistance)
+}
+
+func ParseHashList(r io.Reader, maxDistance int) (*FileHashList, error) {
+	hl := &FileHashList{MaxDistance: maxDistance}
+
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("hash list line %d: expected a hash and a label", n)
+		}
+		h, err := phash.Parse(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("hash list line %d: %w", n, err)
+		}
+		hl.Entries = append(hl.Entries, HashListEntry{Hash: h, Label: fields[1]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading hash list: %w", err)
+	}
+	return hl, nil
+}
+
+func (hl *FileHashList) Match(ctx context.Context, h phash.Hash) ([]string, error) {
+	var labels []string
+	for _, e := range hl.Entries {
+		if e.Hash.Distance(h) <= hl.MaxDistance {
+			labels = append(labels, e.Label)
+		}
+	}
+	return labels, nil
+}
+
+// RemoteHashList checks hashes against a hash matching service, for lists
+// which are not handed out. The service is sent the hash as JSON:
+//
+//	{"hash": "<hex>", "maxDistance": 30}
+//
+// and responds with the matching entries:
+//
+//	{"matches": [{"label": "csam", "distance": 4}]}
+type RemoteHashList struct {
+	Client      http.Client
+	Endpoint    string
+	ApiToken    string
+	MaxDistance int
+}
+
+type RemoteHashListReq struct {
+	Hash        string `json:"hash"`
+	MaxDistance int    `json:"maxDistance"`
+}
+
+type RemoteHashListResp struct {
+	Matches []RemoteHashListResp_Match `json:"matches"`
+}
+
+type RemoteHashListResp_Match struct {
+	Label    string `json:"label"`
+	Distance int    `json:"distance"`
+}
+
+func NewRemoteHashList(url, token string, maxDistance int) *RemoteHashList {
+	return &RemoteHashList{
+		Client:      *util.RobustHTTPClient(),
+		Endpoint:    url,
+		ApiToken:    token,
+		MaxDistance: maxDistance,
+	}
+}
+
+func (rhl *RemoteHashList) Match(ctx context.Context, h phash.Hash) ([]string, error) {
+	body, err := json.Marshal(RemoteHashListReq{Hash: h.String(), MaxDistance: rhl.MaxDistance})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", rhl.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "labelmaker/"+version.Version)
+	if rhl.ApiToken != "" {
+		req.Header.Set("Authorization", "Bearer "+rhl.ApiToken)
+	}
+
+	res, err := rhl.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("hash list request failed: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("hash list request failed  statusCode=%d", res.StatusCode)
+	}
+
+	var respObj RemoteHashListResp
+	if err := json.NewDecoder(res.Body).Decode(&respObj); err != nil {
+		return nil, fmt.Errorf("failed to parse hash list resp JSON: %v", err)
+	}
+
+	var labels []string
+	for _, m := range respObj.Matches {
+		// don't rely on the service to respect the distance
+		if m.Distance <= rhl.MaxDistance {
+			labels = append(labels, m.Label)
+		}
+	}
+	return labels, nil
+}
@@ -0,0 +1,175 @@
+package labeler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/util/phash"
+
+	"github.com/ipfs/go-cid"
+)
+
+// testPNG encodes a checkerboard image with squares of the given size
+func testPNG(t *testing.T, square int) []byte {
+	img := image.NewGray(image.Rect(0, 0, 256, 256))
+	for y := 0; y < 256; y++ {
+		for x := 0; x < 256; x++ {
+			if (x/square+y/square)%2 == 0 {
+				img.SetGray(x, y, color.Gray{Y: 255})
+			}
+		}
+	}
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testPNGHash(t *testing.T, square int) phash.Hash {
+	h, err := phash.Decode(bytes.NewReader(testPNG(t, square)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestParseHashList(t *testing.T) {
+	known := testPNGHash(t, 32)
+	list := "# known images\n\n" + known.String() + " csam\n" + strings.Repeat("00", 32) + "\tspam\n"
+
+	hl, err := ParseHashList(strings.NewReader(list), DefaultHashMaxDistance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hl.Entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(hl.Entries))
+	}
+
+	labels, err := hl.Match(context.TODO(), known)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(labels, []string{"csam"}) {
+		t.Fatalf("unexpected labels: %v", labels)
+	}
+
+	labels, err = hl.Match(context.TODO(), testPNGHash(t, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(labels) != 0 {
+		t.Fatalf("expected a different image not to match, got %v", labels)
+	}
+
+	for _, bad := range []string{"abcd csam", known.String(), known.String() + " csam extra"} {
+		if _, err := ParseHashList(strings.NewReader(bad), DefaultHashMaxDistance); err == nil {
+			t.Fatalf("expected an error parsing %q", bad)
+		}
+	}
+}
+
+func TestImageHashLabeler(t *testing.T) {
+	ctx := context.TODO()
+	known := testPNGHash(t, 32)
+	hl := &FileHashList{
+		Entries:     []HashListEntry{{Hash: known, Label: "csam"}},
+		MaxDistance: DefaultHashMaxDistance,
+	}
+	ihl, err := NewImageHashLabeler([]HashList{hl}, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := cid.Decode("bafkreiccldh766hwcnuxnf2wh6jgzepf2nlu2lvcllt63eww5p6chi4ity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := lexutil.LexBlob{Ref: lexutil.LexLink(c), MimeType: "image/png"}
+
+	if _, ok := ihl.CachedHash(blob); ok {
+		t.Fatal("expected no hash cached yet")
+	}
+	labels, err := ihl.LabelBlob(ctx, blob, testPNG(t, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(labels, []string{"csam"}) {
+		t.Fatalf("unexpected labels: %v", labels)
+	}
+
+	h, ok := ihl.CachedHash(blob)
+	if !ok || h != known {
+		t.Fatal("expected the hash of the blob to be cached")
+	}
+	// the cached hash is used, rather than hashing the bytes again
+	if _, err := ihl.LabelBlob(ctx, blob, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	c2, err := cid.Decode("bafkreie7q3iidccmpvszul7kudcvvuavuo7u6gzlbobczuk5nqk3b4akba")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ihl.LabelBlob(ctx, lexutil.LexBlob{Ref: lexutil.LexLink(c2), MimeType: "image/png"}, []byte("not an image")); err == nil {
+		t.Fatal("expected an error labeling a blob which is not an image")
+	}
+}
+
+func TestRemoteHashList(t *testing.T) {
+	known := testPNGHash(t, 32)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req RemoteHashListReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var resp RemoteHashListResp
+		if req.Hash == known.String() {
+			resp.Matches = []RemoteHashListResp_Match{
+				{Label: "csam", Distance: 0},
+				// beyond the configured distance
+				{Label: "other", Distance: 200},
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+
+	rhl := NewRemoteHashList(srv.URL, "secret", DefaultHashMaxDistance)
+	labels, err := rhl.Match(context.TODO(), known)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(labels, []string{"csam"}) {
+		t.Fatalf("unexpected labels: %v", labels)
+	}
+
+	labels, err = rhl.Match(context.TODO(), testPNGHash(t, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(labels) != 0 {
+		t.Fatalf("expected no labels, got %v", labels)
+	}
+
+	rhl.ApiToken = "wrong"
+	if _, err := rhl.Match(context.TODO(), known); err == nil {
+		t.Fatal("expected an error when the service rejects the request")
+	}
+}
@@ -0,0 +1,31 @@
+package labeler
+
+import (
+	"context"
+
+	"github.com/bluesky-social/indigo/util/invalidation"
+)
+
+// SetInvalidationBus has the labels the labelmaker applies published to b,
+// and the handles and keys it has cached of accounts updated as other
+// services say they change. Must be called before SubscribeBGS.
+func (s *Server) SetInvalidationBus(b invalidation.Bus) {
+	s.invalidations = b
+	b.Subscribe(s.handleInvalidation)
+}
+
+func (s *Server) handleInvalidation(ctx context.Context, m invalidation.Message) {
+	if m.Kind != invalidation.KindIdentity {
+		return
+	}
+
+	if s.sigVerifier != nil {
+		s.sigVerifier.Invalidate(ctx, m.Did)
+	}
+	// messages without a handle only say the identity needs resolving again
+	if m.Handle != "" {
+		if err := s.handles.record(ctx, m.Did, m.Handle); err != nil {
+			log.Warnw("failed to record handle", "did", m.Did, "handle", m.Handle, "err", err)
+		}
+	}
+}
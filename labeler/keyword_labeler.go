@@ -5,39 +5,134 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
 	"strings"
 
 	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/util/ahocorasick"
+	"github.com/bluesky-social/indigo/util/extract"
+	"github.com/bluesky-social/indigo/util/textnorm"
 )
 
 type KeywordLabeler struct {
 	Keywords []string `json:"keywords"`
 	Value    string   `json:"value"`
+	// Normalize are the textnorm steps text (and the keywords) are normalized
+	// with before matching, eg ["zero_width", "nfkc", "confusables"]
+	Normalize textnorm.Steps `json:"normalize,omitempty"`
 }
 
 func (kl KeywordLabeler) LabelText(txt string) []string {
-	txt = strings.ToLower(txt)
+	txt = strings.ToLower(kl.Normalize.Apply(txt))
 	for _, word := range kl.Keywords {
-		if strings.Contains(txt, word) {
+		if strings.Contains(txt, kl.Normalize.Apply(word)) {
 			return []string{kl.Value}
 		}
 	}
 	return []string{}
 }
 
+// LabelRecord matches the text and image alt text of any record type the
+// extract package knows, and labels nothing else
+func (kl KeywordLabeler) LabelRecord(rec any) []string {
+	c, ok := extract.Record(rec)
+	if !ok {
+		return []string{}
+	}
+	return kl.LabelText(c.All())
+}
+
 func (kl KeywordLabeler) LabelPost(p appbsky.FeedPost) []string {
-	return kl.LabelText(p.Text)
+	return kl.LabelRecord(&p)
 }
 
 func (kl KeywordLabeler) LabelProfile(ap appbsky.ActorProfile) []string {
-	var txt string
-	if ap.DisplayName != nil {
-		txt += *ap.DisplayName
+	return kl.LabelRecord(&ap)
+}
+
+// keywordMatcher runs many keyword labelers at once. The keywords of all of
+// them are compiled into an Aho-Corasick automaton for each set of
+// normalization steps they use, so that matching a text takes a pass over it
+// per set, however many keywords there are.
+type keywordMatcher struct {
+	values []string
+	groups []keywordGroup
+}
+
+// keywordGroup are the keywords of the labelers with the same normalization
+// steps
+type keywordGroup struct {
+	normalize textnorm.Steps
+	matcher   *ahocorasick.Matcher
+
+	// labelers has the index of the labeler of each keyword
+	labelers []int
+}
+
+func newKeywordMatcher(kwl []KeywordLabeler) *keywordMatcher {
+	km := &keywordMatcher{values: make([]string, len(kwl))}
+
+	byKey := map[string]int{}
+	var keywords [][]string
+	for i, kl := range kwl {
+		km.values[i] = kl.Value
+
+		key := stepsKey(kl.Normalize)
+		g, ok := byKey[key]
+		if !ok {
+			g = len(km.groups)
+			byKey[key] = g
+			km.groups = append(km.groups, keywordGroup{normalize: kl.Normalize})
+			keywords = append(keywords, nil)
+		}
+		for _, word := range kl.Keywords {
+			keywords[g] = append(keywords[g], kl.Normalize.Apply(word))
+			km.groups[g].labelers = append(km.groups[g].labelers, i)
+		}
 	}
-	if ap.Description != nil {
-		txt += *ap.Description
+	for g := range km.groups {
+		km.groups[g].matcher = ahocorasick.New(keywords[g])
 	}
-	return kl.LabelText(txt)
+
+	return km
+}
+
+// stepsKey identifies a set of normalization steps, which run in the same
+// order however they are listed
+func stepsKey(steps textnorm.Steps) string {
+	s := append([]string(nil), steps...)
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+// LabelText returns the value of each labeler with a keyword in txt, in the
+// order of the labelers, as KeywordLabeler.LabelText would for each in turn
+func (km *keywordMatcher) LabelText(txt string) []string {
+	matched := make([]bool, len(km.values))
+	for _, g := range km.groups {
+		g.matcher.Each(strings.ToLower(g.normalize.Apply(txt)), func(kw int) bool {
+			matched[g.labelers[kw]] = true
+			return true
+		})
+	}
+
+	out := []string{}
+	for i, ok := range matched {
+		if ok {
+			out = append(out, km.values[i])
+		}
+	}
+	return out
+}
+
+// LabelRecord matches the text and image alt text of any record type the
+// extract package knows, and labels nothing else
+func (km *keywordMatcher) LabelRecord(rec any) []string {
+	c, ok := extract.Record(rec)
+	if !ok {
+		return []string{}
+	}
+	return km.LabelText(c.All())
 }
 
 func LoadKeywordFile(fpath string) ([]KeywordLabeler, error) {
@@ -58,6 +153,11 @@ func LoadKeywordFile(fpath string) ([]KeywordLabeler, error) {
 	if err := json.Unmarshal(raw, &kwl); err != nil {
 		return nil, fmt.Errorf("failed to parse Keyword file: %v", err)
 	}
+	for _, kl := range kwl {
+		if err := kl.Normalize.Check(); err != nil {
+			return nil, fmt.Errorf("keyword labeler %q: %v", kl.Value, err)
+		}
+	}
 
 	return kwl, nil
 }
@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	bsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/util/textnorm"
 )
 
 func TestKeywordFilter(t *testing.T) {
@@ -51,3 +52,82 @@ func TestKeywordFilter(t *testing.T) {
 		}
 	}
 }
+
+func TestKeywordFilterNormalize(t *testing.T) {
+	var kl = KeywordLabeler{Value: "rude", Keywords: []string{"sex"}, Normalize: textnorm.Steps{textnorm.ZeroWidth, textnorm.NFKC, textnorm.Confusables, textnorm.Leetspeak}}
+
+	postCases := []struct {
+		record   bsky.FeedPost
+		expected []string
+	}{
+		{bsky.FeedPost{Text: "boring inoffensive tweet"}, []string{}},
+		{bsky.FeedPost{Text: "s\u200bex"}, []string{"rude"}},
+		{bsky.FeedPost{Text: "ＳＥＸ"}, []string{"rude"}},
+		{bsky.FeedPost{Text: "ѕех"}, []string{"rude"}},
+		{bsky.FeedPost{Text: "$3x"}, []string{"rude"}},
+	}
+
+	for _, c := range postCases {
+		vals := kl.LabelPost(c.record)
+		if !reflect.DeepEqual(vals, c.expected) {
+			t.Log(fmt.Sprintf("labels expected:%s got:%s", c.expected, vals))
+			t.Fail()
+		}
+	}
+}
+
+func TestKeywordFilterRecords(t *testing.T) {
+	var kl = KeywordLabeler{Value: "rude", Keywords: []string{"sex"}}
+
+	post := &bsky.FeedPost{
+		Text: "nothing to see here",
+		Embed: &bsky.FeedPost_Embed{EmbedImages: &bsky.EmbedImages{
+			Images: []*bsky.EmbedImages_Image{{Alt: "sexy times"}},
+		}},
+	}
+	if vals := kl.LabelRecord(post); !reflect.DeepEqual(vals, []string{"rude"}) {
+		t.Errorf("expected image alt text to be matched, got %s", vals)
+	}
+
+	if vals := kl.LabelRecord(&bsky.GraphList{Name: "Sex Pistols fans"}); !reflect.DeepEqual(vals, []string{"rude"}) {
+		t.Errorf("expected list names to be matched, got %s", vals)
+	}
+
+	if vals := kl.LabelRecord(&bsky.FeedLike{}); len(vals) != 0 {
+		t.Errorf("expected nothing from a like, got %s", vals)
+	}
+}
+
+func TestKeywordMatcher(t *testing.T) {
+	kwl := []KeywordLabeler{
+		{Value: "rude", Keywords: []string{"🍆", "sex"}},
+		{Value: "meta", Keywords: []string{"bluesky", "atproto"}},
+		{Value: "rude-normalized", Keywords: []string{"sex"}, Normalize: textnorm.Steps{textnorm.Leetspeak, textnorm.ZeroWidth}},
+		{Value: "spam", Keywords: []string{"free money"}, Normalize: textnorm.Steps{textnorm.ZeroWidth, textnorm.Leetspeak}},
+		{Value: "rude", Keywords: []string{"sexy"}},
+	}
+	km := newKeywordMatcher(kwl)
+
+	// the steps of the last two normalizing labelers are the same, however
+	// they are listed
+	if len(km.groups) != 2 {
+		t.Errorf("expected keywords in 2 groups, got %d", len(km.groups))
+	}
+
+	for _, txt := range []string{
+		"boring inoffensive tweet",
+		"I love Aubergine 🍆",
+		"SeXyTiMe on Bluesky",
+		"$3x and fr33 m0ney",
+		"s\u200bex",
+		"atproto",
+	} {
+		want := []string{}
+		for _, kl := range kwl {
+			want = append(want, kl.LabelText(txt)...)
+		}
+		if got := km.LabelText(txt); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: expected %s, got %s", txt, want, got)
+		}
+	}
+}
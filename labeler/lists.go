@@ -0,0 +1,295 @@
+package labeler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	label "github.com/bluesky-social/indigo/api/label"
+	didres "github.com/bluesky-social/indigo/did"
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/xrpc"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	listCollection     = "app.bsky.graph.list"
+	listItemCollection = "app.bsky.graph.listitem"
+)
+
+// ListLabel has the members of a moderation list (an app.bsky.graph.list)
+// labeled, on their accounts, for as long as they are on the list
+type ListLabel struct {
+	ListUri string
+	Label   string
+}
+
+// ParseListLabel parses a list label written as listUri=label, eg
+// "at://did:plc:abc/app.bsky.graph.list/3k4duaz5vfs2b=impersonation"
+func ParseListLabel(s string) (ListLabel, error) {
+	var ll ListLabel
+	uri, val, ok := strings.Cut(s, "=")
+	if !ok || val == "" {
+		return ll, fmt.Errorf("invalid list label %q: expected listUri=label", s)
+	}
+	parsed, err := util.ParseAtUri(uri)
+	if err != nil || parsed.Collection != listCollection {
+		return ll, fmt.Errorf("invalid list label %q: expected the URI of an %s record", s, listCollection)
+	}
+
+	ll.ListUri = uri
+	ll.Label = val
+	return ll, nil
+}
+
+// listLabeler is the lists whose members are labeled
+type listLabeler struct {
+	// dir resolves the DIDs of the lists' owners to their PDS, which the
+	// lists are read from
+	dir didres.Resolver
+	// labels are the labels of the lists' members, by list URI
+	labels map[string]string
+	// owners are the DIDs of the repos the lists are in
+	owners map[string]bool
+}
+
+// AddListLabels has the members of moderation lists labeled. The lists are
+// read from their owners' PDSs (found with dir), to catch up on members added
+// and removed while the labelmaker wasn't running, and their members are then
+// followed in the firehose, whether or not their owners are on the allow-list.
+// Labels put on by lists which are no longer configured are taken off. Must
+// be called before SubscribeBGS.
+func (s *Server) AddListLabels(ctx context.Context, dir didres.Resolver, lists []ListLabel) error {
+	ll := &listLabeler{
+		dir:    dir,
+		labels: make(map[string]string),
+		owners: make(map[string]bool),
+	}
+	var uris []string
+	for _, l := range lists {
+		parsed, err := util.ParseAtUri(l.ListUri)
+		if err != nil {
+			return err
+		}
+		log.Infof("configuring list label list=%s label=%s", l.ListUri, l.Label)
+		ll.labels[l.ListUri] = l.Label
+		ll.owners[parsed.Did] = true
+		uris = append(uris, l.ListUri)
+	}
+	s.lists = ll
+
+	q := s.db.WithContext(ctx)
+	if len(uris) > 0 {
+		q = q.Where("list_uri NOT IN ?", uris)
+	}
+	var stale []models.LabelerListItem
+	if err := q.Find(&stale).Error; err != nil {
+		return fmt.Errorf("loading list members: %w", err)
+	}
+	for _, row := range stale {
+		if err := s.removeListItem(ctx, row.Uri); err != nil {
+			return err
+		}
+	}
+
+	for _, l := range lists {
+		if err := s.syncList(ctx, l); err != nil {
+			// the firehose still keeps the list up to date from now on
+			log.Warnf("failed to read list, members added or removed since it was last read may be mislabeled list=%s err=%s", l.ListUri, err)
+		}
+	}
+	return nil
+}
+
+// syncList reads the members of a list from its owner's PDS, and labels and
+// unlabels the accounts added and removed since it was last seen
+func (s *Server) syncList(ctx context.Context, l ListLabel) error {
+	parsed, err := util.ParseAtUri(l.ListUri)
+	if err != nil {
+		return err
+	}
+	doc, err := s.lists.dir.GetDocument(ctx, parsed.Did)
+	if err != nil {
+		return err
+	}
+	endpoint, err := xrpc.ServiceEndpoint(doc, "atproto_pds")
+	if err != nil {
+		return err
+	}
+	c := &xrpc.Client{
+		Client: util.RobustHTTPClient(),
+		Host:   endpoint,
+	}
+
+	if _, err := comatproto.RepoGetRecord(ctx, c, "", parsed.Collection, parsed.Did, parsed.Rkey); err != nil {
+		return fmt.Errorf("resolving list: %w", err)
+	}
+
+	// the listitem records of all of the owner's lists are in the same
+	// collection
+	members := make(map[string]string)
+	cursor := ""
+	for {
+		out, err := comatproto.RepoListRecords(ctx, c, listItemCollection, cursor, 100, parsed.Did, false, "", "")
+		if err != nil {
+			return fmt.Errorf("listing list items: %w", err)
+		}
+		for _, rec := range out.Records {
+			if rec.Value == nil {
+				continue
+			}
+			item, ok := rec.Value.Val.(*appbsky.GraphListitem)
+			if ok && item.List == l.ListUri {
+				members[rec.Uri] = item.Subject
+			}
+		}
+		if out.Cursor == nil || *out.Cursor == "" || len(out.Records) == 0 {
+			break
+		}
+		cursor = *out.Cursor
+	}
+	log.Infof("read list list=%s members=%d", l.ListUri, len(members))
+
+	var rows []models.LabelerListItem
+	if err := s.db.WithContext(ctx).Where("list_uri = ?", l.ListUri).Find(&rows).Error; err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if _, ok := members[row.Uri]; ok {
+			delete(members, row.Uri)
+			continue
+		}
+		if err := s.removeListItem(ctx, row.Uri); err != nil {
+			return err
+		}
+	}
+	for uri, subject := range members {
+		if err := s.addListItem(ctx, uri, l.ListUri, subject); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleListItems follows the members of labeled lists in the commits of
+// their owners' repos. The app never updates list items, so only creates and
+// deletes are followed.
+func (s *Server) handleListItems(ctx context.Context, evt *comatproto.SyncSubscribeRepos_Commit) error {
+	if s.lists == nil || !s.lists.owners[evt.Repo] {
+		return nil
+	}
+
+	var sliceRepo *repo.Repo
+	for _, op := range evt.Ops {
+		if !strings.HasPrefix(op.Path, listItemCollection+"/") {
+			continue
+		}
+		uri := "at://" + evt.Repo + "/" + op.Path
+		switch op.Action {
+		case "create":
+			if sliceRepo == nil {
+				r, err := repo.ReadRepoFromCar(ctx, bytes.NewReader(evt.Blocks))
+				if err != nil {
+					return fmt.Errorf("reading list item commit: %w", err)
+				}
+				sliceRepo = r
+			}
+			_, rec, err := sliceRepo.GetRecord(ctx, op.Path)
+			if err != nil {
+				return fmt.Errorf("record not in CAR slice: %s", uri)
+			}
+			item, ok := rec.(*appbsky.GraphListitem)
+			if !ok {
+				continue
+			}
+			if err := s.addListItem(ctx, uri, item.List, item.Subject); err != nil {
+				return err
+			}
+		case "delete":
+			if err := s.removeListItem(ctx, uri); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addListItem records that an account was put on a list, and labels it if it
+// wasn't labeled already
+func (s *Server) addListItem(ctx context.Context, uri, listUri, subject string) error {
+	val, ok := s.lists.labels[listUri]
+	if !ok {
+		return nil
+	}
+	if !strings.HasPrefix(subject, "did:") {
+		logger.WarnCtx(ctx, "ignoring list item with invalid subject", "uri", uri, "subject", subject)
+		return nil
+	}
+
+	labeled, err := s.listLabeled(ctx, subject, val)
+	if err != nil {
+		return err
+	}
+	row := models.LabelerListItem{
+		Uri:        uri,
+		ListUri:    listUri,
+		SubjectDid: subject,
+		Val:        val,
+	}
+	res := s.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&row)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 || labeled {
+		return nil
+	}
+
+	logger.InfoCtx(ctx, "labeling list member", "list", listUri, "subject", subject, "label", val)
+	return s.CommitLabels(ctx, []*label.Label{s.listLabel(subject, val)}, false)
+}
+
+// removeListItem records that an account was taken off a list, and takes its
+// label off unless another list still puts it on
+func (s *Server) removeListItem(ctx context.Context, uri string) error {
+	var row models.LabelerListItem
+	err := s.db.WithContext(ctx).Where("uri = ?", uri).Take(&row).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.db.WithContext(ctx).Delete(&row).Error; err != nil {
+		return err
+	}
+
+	labeled, err := s.listLabeled(ctx, row.SubjectDid, row.Val)
+	if err != nil || labeled {
+		return err
+	}
+	logger.InfoCtx(ctx, "unlabeling former list member", "list", row.ListUri, "subject", row.SubjectDid, "label", row.Val)
+	return s.CommitLabels(ctx, []*label.Label{s.listLabel(row.SubjectDid, row.Val)}, true)
+}
+
+// listLabeled checks whether an account is on any list labeling it val
+func (s *Server) listLabeled(ctx context.Context, subject, val string) (bool, error) {
+	var n int64
+	err := s.db.WithContext(ctx).Model(&models.LabelerListItem{}).Where("subject_did = ? AND val = ?", subject, val).Count(&n).Error
+	return n > 0, err
+}
+
+func (s *Server) listLabel(subject, val string) *label.Label {
+	return &label.Label{
+		Src: s.user.Did,
+		Uri: "at://" + subject,
+		Val: val,
+	}
+}
@@ -0,0 +1,150 @@
+package labeler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// listLabels returns the values of the labels on an account, in the order
+// they were made, with those of negations prefixed with "-"
+func listLabels(t *testing.T, lm *Server, did string) []string {
+	var rows []models.Label
+	if err := lm.db.Where("uri = ?", "at://"+did).Order("id").Find(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	out := []string{}
+	for _, row := range rows {
+		if row.Neg != nil && *row.Neg {
+			out = append(out, "-"+row.Val)
+		} else {
+			out = append(out, row.Val)
+		}
+	}
+	return out
+}
+
+func TestListLabels(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	lm := testLabelMaker(t)
+
+	owner := "did:plc:mods"
+	listUri := "at://" + owner + "/app.bsky.graph.list/3k4duaz5vfs2b"
+	otherUri := "at://" + owner + "/app.bsky.graph.list/3k4duaz5vfs2c"
+	item := func(rkey string) string { return "at://" + owner + "/app.bsky.graph.listitem/" + rkey }
+
+	pds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/xrpc/com.atproto.repo.getRecord":
+			json.NewEncoder(w).Encode(comatproto.RepoGetRecord_Output{
+				Uri:   listUri,
+				Value: &lexutil.LexiconTypeDecoder{Val: &appbsky.GraphList{Name: "impersonators"}},
+			})
+		case "/xrpc/com.atproto.repo.listRecords":
+			out := comatproto.RepoListRecords_Output{}
+			if r.URL.Query().Get("cursor") == "" {
+				next := "page2"
+				out.Cursor = &next
+				out.Records = []*comatproto.RepoListRecords_Record{
+					{Uri: item("a"), Value: &lexutil.LexiconTypeDecoder{Val: &appbsky.GraphListitem{List: listUri, Subject: "did:plc:alice"}}},
+					// on another of the owner's lists
+					{Uri: item("x"), Value: &lexutil.LexiconTypeDecoder{Val: &appbsky.GraphListitem{List: otherUri, Subject: "did:plc:xavier"}}},
+				}
+			} else if r.URL.Query().Get("cursor") == "page2" {
+				out.Records = []*comatproto.RepoListRecords_Record{
+					{Uri: item("b"), Value: &lexutil.LexiconTypeDecoder{Val: &appbsky.GraphListitem{List: listUri, Subject: "did:plc:bob"}}},
+				}
+			}
+			json.NewEncoder(w).Encode(out)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer pds.Close()
+
+	// carol was removed from the list while the labelmaker wasn't running,
+	// and a list which isn't labeled any more put dave on
+	for _, row := range []models.LabelerListItem{
+		{Uri: item("c"), ListUri: listUri, SubjectDid: "did:plc:carol", Val: "impersonation"},
+		{Uri: item("d"), ListUri: "at://did:plc:old/app.bsky.graph.list/1", SubjectDid: "did:plc:dave", Val: "old"},
+	} {
+		row := row
+		if err := lm.db.Create(&row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ll, err := ParseListLabel(listUri + "=impersonation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lm.AddListLabels(ctx, pdsResolver{owner: pds.URL}, []ListLabel{ll})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal([]string{"impersonation"}, listLabels(t, lm, "did:plc:alice"))
+	assert.Equal([]string{"impersonation"}, listLabels(t, lm, "did:plc:bob"))
+	assert.Equal([]string{"-impersonation"}, listLabels(t, lm, "did:plc:carol"))
+	assert.Equal([]string{"-old"}, listLabels(t, lm, "did:plc:dave"))
+	assert.Equal([]string{}, listLabels(t, lm, "did:plc:xavier"))
+
+	// alice is put on the list a second time, and is only unlabeled once
+	// both items are gone
+	assert.NoError(lm.addListItem(ctx, item("a2"), listUri, "did:plc:alice"))
+	assert.NoError(lm.removeListItem(ctx, item("a")))
+	assert.Equal([]string{"impersonation"}, listLabels(t, lm, "did:plc:alice"))
+	assert.NoError(lm.removeListItem(ctx, item("a2")))
+	assert.Equal([]string{"impersonation", "-impersonation"}, listLabels(t, lm, "did:plc:alice"))
+
+	// items of other lists, and items seen again, are ignored
+	assert.NoError(lm.addListItem(ctx, item("x"), otherUri, "did:plc:xavier"))
+	assert.NoError(lm.addListItem(ctx, item("b"), listUri, "did:plc:bob"))
+	assert.NoError(lm.removeListItem(ctx, item("missing")))
+	assert.Equal([]string{}, listLabels(t, lm, "did:plc:xavier"))
+	assert.Equal([]string{"impersonation"}, listLabels(t, lm, "did:plc:bob"))
+
+	// events from other repos are skipped without reading them
+	assert.NoError(lm.handleListItems(ctx, &comatproto.SyncSubscribeRepos_Commit{
+		Repo:   "did:plc:someone",
+		Ops:    []*comatproto.SyncSubscribeRepos_RepoOp{{Action: "create", Path: "app.bsky.graph.listitem/z"}},
+		Blocks: []byte("not a CAR"),
+	}))
+	assert.NoError(lm.handleListItems(ctx, &comatproto.SyncSubscribeRepos_Commit{
+		Repo: owner,
+		Ops:  []*comatproto.SyncSubscribeRepos_RepoOp{{Action: "delete", Path: "app.bsky.graph.listitem/b"}},
+	}))
+	assert.Equal([]string{"impersonation", "-impersonation"}, listLabels(t, lm, "did:plc:bob"))
+}
+
+func TestParseListLabel(t *testing.T) {
+	ll, err := ParseListLabel("at://did:plc:mods/app.bsky.graph.list/3k4duaz5vfs2b=impersonation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ll.ListUri != "at://did:plc:mods/app.bsky.graph.list/3k4duaz5vfs2b" || ll.Label != "impersonation" {
+		t.Fatalf("unexpected list label %+v", ll)
+	}
+
+	for _, s := range []string{
+		"at://did:plc:mods/app.bsky.graph.list/3k4duaz5vfs2b",
+		"at://did:plc:mods/app.bsky.graph.list/3k4duaz5vfs2b=",
+		"at://did:plc:mods/app.bsky.feed.post/3k4duaz5vfs2b=spam",
+		"did:plc:mods=spam",
+	} {
+		if _, err := ParseListLabel(s); err == nil {
+			t.Errorf("expected an error parsing %q", s)
+		}
+	}
+}
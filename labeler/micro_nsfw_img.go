@@ -34,6 +34,10 @@ func NewMicroNSFWImgLabeler(url string) MicroNSFWImgLabeler {
 	}
 }
 
+// microNSFWImgLabelValues are the values of all the labels SummarizeLabels
+// returns
+var microNSFWImgLabelValues = []string{"porn", "hentai", "sexy"}
+
 func (resp *MicroNSFWImgResp) SummarizeLabels() []string {
 	var labels []string
 
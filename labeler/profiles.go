@@ -0,0 +1,168 @@
+package labeler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/rules"
+	"github.com/bluesky-social/indigo/util"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	"gorm.io/gorm"
+)
+
+// profileHistory keeps the versions of accounts' profiles (the display name,
+// description and avatar) seen in repo events, for moderators to look back
+// at, and for profile_changes rules
+type profileHistory struct {
+	db *gorm.DB
+}
+
+var _ rules.ProfileHistory = (*profileHistory)(nil)
+
+func optionalString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// record saves the version of a profile in a record, if it differs from the
+// last version of the account's profile that was seen. Parts of profiles
+// which aren't kept, such as the banner, don't count as changes.
+func (ph *profileHistory) record(ctx context.Context, did, cidStr string, prof *appbsky.ActorProfile, t time.Time) error {
+	v := models.ProfileVersion{
+		Did:         did,
+		Cid:         cidStr,
+		DisplayName: prof.DisplayName,
+		Description: prof.Description,
+		CreatedAt:   t,
+	}
+	if prof.Avatar != nil {
+		avatar := prof.Avatar.Ref.String()
+		v.AvatarCid = &avatar
+	}
+
+	var last models.ProfileVersion
+	err := ph.db.WithContext(ctx).Where("did = ?", did).Order("id desc").Limit(1).Take(&last).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		// the first version seen has nothing to have changed from
+	case err != nil:
+		return err
+	default:
+		if last.Cid == cidStr {
+			// the same record again, as when the firehose is replayed
+			return nil
+		}
+		v.DisplayNameChanged = optionalString(v.DisplayName) != optionalString(last.DisplayName)
+		v.DescriptionChanged = optionalString(v.Description) != optionalString(last.Description)
+		v.AvatarChanged = optionalString(v.AvatarCid) != optionalString(last.AvatarCid)
+		if !v.DisplayNameChanged && !v.DescriptionChanged && !v.AvatarChanged {
+			return nil
+		}
+	}
+
+	return ph.db.WithContext(ctx).Create(&v).Error
+}
+
+// ProfileChanges counts the changes to a part of an account's profile since a
+// time, or to any part if field is empty
+func (ph *profileHistory) ProfileChanges(ctx context.Context, did, field string, since time.Time) (int, error) {
+	q := ph.db.WithContext(ctx).Model(&models.ProfileVersion{}).Where("did = ? AND created_at >= ?", did, since)
+	switch field {
+	case "":
+		q = q.Where("display_name_changed OR description_changed OR avatar_changed")
+	case rules.ProfileFieldDisplayName:
+		q = q.Where("display_name_changed")
+	case rules.ProfileFieldDescription:
+		q = q.Where("description_changed")
+	case rules.ProfileFieldAvatar:
+		q = q.Where("avatar_changed")
+	default:
+		return 0, fmt.Errorf("unknown profile field %q", field)
+	}
+
+	var n int64
+	if err := q.Count(&n).Error; err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+type profileVersionView struct {
+	Cid         string   `json:"cid"`
+	DisplayName *string  `json:"displayName,omitempty"`
+	Description *string  `json:"description,omitempty"`
+	AvatarCid   *string  `json:"avatarCid,omitempty"`
+	Changed     []string `json:"changed"`
+	SeenAt      string   `json:"seenAt"`
+}
+
+type profileHistoryView struct {
+	Did      string               `json:"did"`
+	Versions []profileVersionView `json:"versions"`
+	Cursor   string               `json:"cursor,omitempty"`
+}
+
+// HandleProfileHistory lists the versions of an account's profile
+// (did), newest first, for moderators to see what it was called before
+func (s *Server) HandleProfileHistory(c echo.Context) error {
+	ctx, span := otel.Tracer("server").Start(c.Request().Context(), "HandleProfileHistory")
+	defer span.End()
+
+	did := c.QueryParam("did")
+	if did == "" {
+		return adminError(c, 400, fmt.Errorf("did param is required"))
+	}
+	limit, err := queryLimit(c, 50, 500)
+	if err != nil {
+		return adminError(c, 400, err)
+	}
+
+	q := s.db.WithContext(ctx).Where("did = ?", did).Order("id desc").Limit(limit)
+	if cursor := c.QueryParam("cursor"); cursor != "" {
+		id, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return adminError(c, 400, fmt.Errorf("invalid cursor: %q", cursor))
+		}
+		q = q.Where("id < ?", id)
+	}
+
+	var rows []models.ProfileVersion
+	if err := q.Find(&rows).Error; err != nil {
+		return err
+	}
+
+	out := profileHistoryView{Did: did, Versions: make([]profileVersionView, 0, len(rows))}
+	for _, row := range rows {
+		v := profileVersionView{
+			Cid:         row.Cid,
+			DisplayName: row.DisplayName,
+			Description: row.Description,
+			AvatarCid:   row.AvatarCid,
+			Changed:     []string{},
+			SeenAt:      row.CreatedAt.UTC().Format(util.ISO8601),
+		}
+		if row.DisplayNameChanged {
+			v.Changed = append(v.Changed, rules.ProfileFieldDisplayName)
+		}
+		if row.DescriptionChanged {
+			v.Changed = append(v.Changed, rules.ProfileFieldDescription)
+		}
+		if row.AvatarChanged {
+			v.Changed = append(v.Changed, rules.ProfileFieldAvatar)
+		}
+		out.Versions = append(out.Versions, v)
+	}
+	if len(rows) == limit {
+		out.Cursor = strconv.FormatUint(rows[len(rows)-1].ID, 10)
+	}
+	return c.JSON(200, out)
+}
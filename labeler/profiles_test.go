@@ -0,0 +1,145 @@
+package labeler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/rules"
+
+	"github.com/ipfs/go-cid"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProfileHistory(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	lm := testLabelMaker(t)
+	ph := lm.profiles
+
+	did := "did:plc:shapeshifter"
+	start := time.Now().Add(-2 * time.Hour)
+	name := func(s string) *string { return &s }
+	avatar, err := cid.Decode("bafkreiclp443lavogvhj3d2ob2cxbfuscni2k5jk7bebjzg7khl3esabwq")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions := []struct {
+		cid  string
+		prof appbsky.ActorProfile
+	}{
+		{"bafyreia", appbsky.ActorProfile{DisplayName: name("Alice")}},
+		// the same record again changes nothing
+		{"bafyreia", appbsky.ActorProfile{DisplayName: name("Alice")}},
+		{"bafyreib", appbsky.ActorProfile{DisplayName: name("Bob")}},
+		// nor does a new banner
+		{"bafyreic", appbsky.ActorProfile{DisplayName: name("Bob"), Banner: &lexutil.LexBlob{Ref: lexutil.LexLink(avatar)}}},
+		{"bafyreid", appbsky.ActorProfile{DisplayName: name("Carol"), Avatar: &lexutil.LexBlob{Ref: lexutil.LexLink(avatar)}}},
+		{"bafyreie", appbsky.ActorProfile{DisplayName: name("Carol"), Description: name("official support"), Avatar: &lexutil.LexBlob{Ref: lexutil.LexLink(avatar)}}},
+	}
+	for i, v := range versions {
+		v := v
+		if err := ph.record(ctx, did, v.cid, &v.prof, start.Add(time.Duration(i)*30*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for field, want := range map[string]int{
+		"":                            3,
+		rules.ProfileFieldDisplayName: 2,
+		rules.ProfileFieldAvatar:      1,
+		rules.ProfileFieldDescription: 1,
+	} {
+		n, err := ph.ProfileChanges(ctx, did, field, start)
+		assert.NoError(err)
+		assert.Equal(want, n, field)
+	}
+	// Bob's rename was an hour after the start
+	n, err := ph.ProfileChanges(ctx, did, rules.ProfileFieldDisplayName, start.Add(time.Hour+time.Minute))
+	assert.NoError(err)
+	assert.Equal(1, n)
+	n, err = ph.ProfileChanges(ctx, "did:plc:other", "", start)
+	assert.NoError(err)
+	assert.Equal(0, n)
+
+	e := echo.New()
+	rec := dashboardRequest(t, e, http.MethodGet, "/admin/api/profileHistory?did="+did, "", lm.HandleProfileHistory)
+	assert.Equal(200, rec.Code)
+	var out profileHistoryView
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &out))
+	if assert.Len(out.Versions, 4) {
+		assert.Equal("bafyreie", out.Versions[0].Cid)
+		assert.Equal([]string{rules.ProfileFieldDescription}, out.Versions[0].Changed)
+		assert.Equal([]string{rules.ProfileFieldDisplayName, rules.ProfileFieldAvatar}, out.Versions[1].Changed)
+		assert.Equal(avatar.String(), *out.Versions[1].AvatarCid)
+		assert.Equal("Alice", *out.Versions[3].DisplayName)
+		assert.Equal([]string{}, out.Versions[3].Changed)
+	}
+
+	rec = dashboardRequest(t, e, http.MethodGet, "/admin/api/profileHistory?did="+did+"&limit=3", "", lm.HandleProfileHistory)
+	out = profileHistoryView{}
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &out))
+	assert.Len(out.Versions, 3)
+	rec = dashboardRequest(t, e, http.MethodGet, "/admin/api/profileHistory?did="+did+"&cursor="+out.Cursor, "", lm.HandleProfileHistory)
+	out = profileHistoryView{}
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &out))
+	if assert.Len(out.Versions, 1) {
+		assert.Equal("bafyreia", out.Versions[0].Cid)
+	}
+
+	rec = dashboardRequest(t, e, http.MethodGet, "/admin/api/profileHistory", "", lm.HandleProfileHistory)
+	assert.Equal(400, rec.Code)
+}
+
+func TestProfileChangesRule(t *testing.T) {
+	ctx := context.Background()
+	lm := testLabelMaker(t)
+
+	rs, err := rules.ParseRuleSet([]byte(`
+rules:
+  - name: renamed
+    collections: [app.bsky.actor.profile]
+    when:
+      profile_changes: {window: 1h, more_than: 1, field: display_name}
+    actions:
+      - label: "repo:renamed"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := rules.NewEngine(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lm.AddRules(e)
+
+	did := "did:plc:shapeshifter"
+	path := "app.bsky.actor.profile/self"
+	uri := "at://" + did + "/" + path
+	var vals []string
+	for i, n := range []string{"Alice", "Bob", "Carol"} {
+		n := n
+		prof := &appbsky.ActorProfile{DisplayName: &n}
+		cidStr := []string{"bafyreia", "bafyreib", "bafyreic"}[i]
+		if err := lm.profiles.record(ctx, did, cidStr, prof, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		vals, err = lm.applyRules(ctx, did, "update", path, uri, cidStr, prof)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < 2 && len(vals) != 0 {
+			t.Fatalf("change %d: expected no labels, got %v", i, vals)
+		}
+	}
+	if !reflect.DeepEqual(vals, []string{"repo:renamed"}) {
+		t.Fatalf("expected the second rename to be labeled, got %v", vals)
+	}
+}
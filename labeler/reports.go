@@ -0,0 +1,162 @@
+package labeler
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	label "github.com/bluesky-social/indigo/api/label"
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/xrpc"
+
+	"gorm.io/gorm"
+)
+
+// ReportThreshold has a label applied to subjects once enough different
+// accounts reported them for a reason, without waiting for a moderator
+type ReportThreshold struct {
+	ReasonType string
+	Reporters  int
+	Label      string
+}
+
+// ParseReportThreshold parses a threshold written as reasonType=count:label,
+// eg "com.atproto.moderation.defs#reasonSpam=5:spam"
+func ParseReportThreshold(s string) (ReportThreshold, error) {
+	var rt ReportThreshold
+	reasonType, rest, ok := strings.Cut(s, "=")
+	if !ok || reasonType == "" {
+		return rt, fmt.Errorf("invalid report threshold %q: expected reasonType=count:label", s)
+	}
+	count, val, ok := strings.Cut(rest, ":")
+	if !ok || val == "" {
+		return rt, fmt.Errorf("invalid report threshold %q: expected reasonType=count:label", s)
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n <= 0 {
+		return rt, fmt.Errorf("invalid report threshold %q: count must be a positive integer", s)
+	}
+
+	rt.ReasonType = reasonType
+	rt.Reporters = n
+	rt.Label = val
+	return rt, nil
+}
+
+// SetReportThresholds configures the labels applied to subjects reported by
+// many accounts
+func (s *Server) SetReportThresholds(thresholds []ReportThreshold) {
+	for _, rt := range thresholds {
+		log.Infof("configuring report threshold reasonType=%s reporters=%d label=%s", rt.ReasonType, rt.Reporters, rt.Label)
+	}
+	s.reportThresholds = thresholds
+}
+
+// SetReportForwarding has reports forwarded to another moderation service,
+// eg the one of the app view, after they are persisted. If token is set it is
+// sent as a bearer token.
+func (s *Server) SetReportForwarding(url, token string) {
+	log.Infof("configuring report forwarding url=%s", url)
+	c := &xrpc.Client{
+		Client: util.RobustHTTPClient(),
+		Host:   url,
+	}
+	if token != "" {
+		c.Auth = &xrpc.AuthInfo{AccessJwt: token}
+	}
+	s.reportForwardClient = c
+}
+
+// subjectReports selects the unresolved reports on the subject of row
+func (s *Server) subjectReports(ctx context.Context, row *models.ModerationReport) *gorm.DB {
+	q := s.db.WithContext(ctx).Model(&models.ModerationReport{}).
+		Where("subject_type = ? AND subject_did = ?", row.SubjectType, row.SubjectDid).
+		Where("id NOT IN (?)", s.db.Model(&models.ModerationReportResolution{}).Select("report_id"))
+	if row.SubjectUri != nil {
+		q = q.Where("subject_uri = ?", *row.SubjectUri)
+	}
+	if row.SubjectCid != nil {
+		q = q.Where("subject_cid = ?", *row.SubjectCid)
+	}
+	return q
+}
+
+// applyReportThresholds labels the subject of a new report if it crossed a
+// report threshold. Labels are only applied once.
+func (s *Server) applyReportThresholds(ctx context.Context, row *models.ModerationReport) error {
+	var labels []*label.Label
+	for _, rt := range s.reportThresholds {
+		if rt.ReasonType != row.ReasonType {
+			continue
+		}
+
+		var reporters int64
+		err := s.subjectReports(ctx, row).
+			Where("reason_type = ?", rt.ReasonType).
+			Distinct("reported_by_did").
+			Count(&reporters).Error
+		if err != nil {
+			return fmt.Errorf("counting reports: %w", err)
+		}
+		if reporters < int64(rt.Reporters) {
+			continue
+		}
+
+		l := &label.Label{
+			Src: s.user.Did,
+			Uri: "at://" + row.SubjectDid,
+			Val: rt.Label,
+			Cid: row.SubjectCid,
+		}
+		if row.SubjectUri != nil {
+			l.Uri = *row.SubjectUri
+		}
+
+		q := s.db.WithContext(ctx).Model(&models.Label{}).
+			Where("uri = ? AND source_did = ? AND val = ?", l.Uri, l.Src, l.Val)
+		if l.Cid != nil {
+			q = q.Where("cid = ?", *l.Cid)
+		}
+		var existing int64
+		if err := q.Count(&existing).Error; err != nil {
+			return fmt.Errorf("checking existing labels: %w", err)
+		}
+		if existing > 0 {
+			continue
+		}
+
+		log.Infof("report threshold crossed uri=%s reasonType=%s reporters=%d label=%s", l.Uri, rt.ReasonType, reporters, rt.Label)
+		labels = append(labels, l)
+	}
+
+	s.throughput.add(sourceReportThreshold, len(labels), time.Now())
+	return s.CommitLabels(ctx, labels, false)
+}
+
+// reportForwardTimeout is how long forwarding a report to the upstream
+// moderation service may take
+const reportForwardTimeout = 30 * time.Second
+
+// forwardReport sends a report to the upstream moderation service, as a report
+// of the labelmaker's, which names the original reporter
+func (s *Server) forwardReport(ctx context.Context, row *models.ModerationReport, body *comatproto.ModerationCreateReport_Input) error {
+	reason := fmt.Sprintf("reported to %s by %s", s.user.Did, row.ReportedByDid)
+	if row.Reason != nil && *row.Reason != "" {
+		reason += ": " + *row.Reason
+	}
+
+	out, err := comatproto.ModerationCreateReport(ctx, s.reportForwardClient, &comatproto.ModerationCreateReport_Input{
+		ReasonType: body.ReasonType,
+		Reason:     &reason,
+		Subject:    body.Subject,
+	})
+	if err != nil {
+		return fmt.Errorf("forwarding report %d: %w", row.ID, err)
+	}
+	log.Infof("forwarded report id=%d upstreamId=%d", row.ID, out.Id)
+	return nil
+}
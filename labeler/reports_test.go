@@ -0,0 +1,171 @@
+package labeler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/models"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseReportThreshold(t *testing.T) {
+	assert := assert.New(t)
+
+	rt, err := ParseReportThreshold("com.atproto.moderation.defs#reasonSpam=5:spam")
+	assert.NoError(err)
+	assert.Equal(ReportThreshold{ReasonType: "com.atproto.moderation.defs#reasonSpam", Reporters: 5, Label: "spam"}, rt)
+
+	for _, bad := range []string{"", "spam", "=5:spam", "reasonSpam=5", "reasonSpam=five:spam", "reasonSpam=0:spam", "reasonSpam=5:"} {
+		_, err := ParseReportThreshold(bad)
+		assert.Error(err, bad)
+	}
+}
+
+func TestLabelMakerReportThreshold(t *testing.T) {
+	assert := assert.New(t)
+	e := echo.New()
+	lm := testLabelMaker(t)
+
+	rt := "com.atproto.moderation.defs#reasonSpam"
+	lm.SetReportThresholds([]ReportThreshold{{ReasonType: rt, Reporters: 2, Label: "spam"}})
+
+	uri := "at://did:plc:123/app.bsky.feed.post/abc"
+	cid := "bafyreiclp443lavogvhj3d2ob2cxbfuscni2k5jk7bebjzg7khl3esabwq"
+	report := comatproto.ModerationCreateReport_Input{
+		ReasonType: &rt,
+		Subject: &comatproto.ModerationCreateReport_Input_Subject{
+			RepoStrongRef: &comatproto.RepoStrongRef{Uri: uri, Cid: cid},
+		},
+	}
+
+	countLabels := func() int64 {
+		var n int64
+		assert.NoError(lm.db.Model(&models.Label{}).Where("uri = ? AND val = ?", uri, "spam").Count(&n).Error)
+		return n
+	}
+
+	// the same account reporting twice doesn't cross the threshold
+	testCreateReport(t, e, lm, &report)
+	testCreateReport(t, e, lm, &report)
+	assert.Equal(int64(0), countLabels())
+
+	// another account's report does
+	assert.NoError(lm.db.Create(&models.ModerationReport{
+		SubjectType:   "com.atproto.repo.recordRef",
+		SubjectDid:    "did:plc:123",
+		SubjectUri:    &uri,
+		SubjectCid:    &cid,
+		ReasonType:    rt,
+		ReportedByDid: "did:plc:other",
+	}).Error)
+	testCreateReport(t, e, lm, &report)
+	assert.Equal(int64(1), countLabels())
+
+	// and the label is only applied once
+	testCreateReport(t, e, lm, &report)
+	assert.Equal(int64(1), countLabels())
+
+	// reports for other reasons don't count
+	other := "com.atproto.moderation.defs#reasonRude"
+	report.ReasonType = &other
+	report.Subject.RepoStrongRef.Uri = "at://did:plc:123/app.bsky.feed.post/def"
+	testCreateReport(t, e, lm, &report)
+	var n int64
+	assert.NoError(lm.db.Model(&models.Label{}).Count(&n).Error)
+	assert.Equal(int64(1), n)
+}
+
+func TestLabelMakerReportForwarding(t *testing.T) {
+	assert := assert.New(t)
+	e := echo.New()
+	lm := testLabelMaker(t)
+
+	var mu sync.Mutex
+	var forwarded []comatproto.ModerationCreateReport_Input
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/xrpc/com.atproto.moderation.createReport" || r.Header.Get("Authorization") != "Bearer upstream-token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var in comatproto.ModerationCreateReport_Input
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		forwarded = append(forwarded, in)
+		mu.Unlock()
+		json.NewEncoder(w).Encode(comatproto.ModerationCreateReport_Output{Id: 42, ReasonType: in.ReasonType, Subject: &comatproto.ModerationCreateReport_Output_Subject{AdminDefs_RepoRef: in.Subject.AdminDefs_RepoRef}})
+	}))
+	defer upstream.Close()
+	lm.SetReportForwarding(upstream.URL, "upstream-token")
+
+	rt := "com.atproto.moderation.defs#reasonSpam"
+	reason := "buying followers"
+	testCreateReport(t, e, lm, &comatproto.ModerationCreateReport_Input{
+		ReasonType: &rt,
+		Reason:     &reason,
+		Subject: &comatproto.ModerationCreateReport_Input_Subject{
+			AdminDefs_RepoRef: &comatproto.AdminDefs_RepoRef{Did: "did:plc:123"},
+		},
+	})
+	lm.reportForwards.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if assert.Equal(1, len(forwarded)) {
+		assert.Equal(rt, *forwarded[0].ReasonType)
+		assert.Equal("reported to did:plc:testdummy by did:plc:testdummy: buying followers", *forwarded[0].Reason)
+		assert.Equal("did:plc:123", forwarded[0].Subject.AdminDefs_RepoRef.Did)
+	}
+}
+
+func TestLabelMakerListReportsBySubject(t *testing.T) {
+	assert := assert.New(t)
+	e := echo.New()
+	lm := testLabelMaker(t)
+
+	rt := "spam"
+	testCreateReport(t, e, lm, &comatproto.ModerationCreateReport_Input{
+		ReasonType: &rt,
+		Subject: &comatproto.ModerationCreateReport_Input_Subject{
+			AdminDefs_RepoRef: &comatproto.AdminDefs_RepoRef{Did: "did:plc:123"},
+		},
+	})
+	uri := "at://did:plc:123/app.bsky.feed.post/abc"
+	testCreateReport(t, e, lm, &comatproto.ModerationCreateReport_Input{
+		ReasonType: &rt,
+		Subject: &comatproto.ModerationCreateReport_Input_Subject{
+			RepoStrongRef: &comatproto.RepoStrongRef{Uri: uri, Cid: "bafyreiclp443lavogvhj3d2ob2cxbfuscni2k5jk7bebjzg7khl3esabwq"},
+		},
+	})
+
+	list := func(subject string) []*comatproto.AdminDefs_ReportView {
+		req := httptest.NewRequest(http.MethodGet, "/xrpc/com.atproto.admin.getModerationReports?subject="+subject, nil)
+		recorder := httptest.NewRecorder()
+		c := e.NewContext(req, recorder)
+		assert.NoError(lm.HandleComAtprotoAdminGetModerationReports(c))
+		var out comatproto.AdminGetModerationReports_Output
+		if err := json.NewDecoder(strings.NewReader(recorder.Body.String())).Decode(&out); err != nil {
+			t.Fatal(err)
+		}
+		return out.Reports
+	}
+
+	assert.Equal(2, len(list("")))
+	repoReports := list("did:plc:123")
+	if assert.Equal(1, len(repoReports)) {
+		assert.NotNil(repoReports[0].Subject.AdminDefs_RepoRef)
+	}
+	recordReports := list(uri)
+	if assert.Equal(1, len(recordReports)) {
+		assert.Equal(uri, recordReports[0].Subject.RepoStrongRef.Uri)
+	}
+}
@@ -0,0 +1,208 @@
+package labeler
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/rules"
+	"github.com/bluesky-social/indigo/util/counters"
+	"github.com/bluesky-social/indigo/util/logutil"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	"gopkg.in/yaml.v3"
+)
+
+// escalationReasonType is the reason type of the reports filed for accounts
+// rules escalate for takedown
+const escalationReasonType = "com.atproto.moderation.defs#reasonViolation"
+
+// AddRules has records checked against a rule engine. Label actions are
+// applied like the labels of the other labelers, and report and escalate
+// actions file moderation reports from the labelmaker repo, for moderators
+// to act on. profile_changes conditions look at the server's profile history,
+// and parent and root conditions at its thread context, if it has one.
+func (s *Server) AddRules(e *rules.Engine) {
+	log.Infof("configuring rules")
+	s.configureRules(e)
+	s.rules.Store(e)
+}
+
+// configureRules gives a rule engine what the server knows besides records
+func (s *Server) configureRules(e *rules.Engine) {
+	e.SetProfileHistory(s.profiles)
+	if s.thread != nil {
+		e.SetThreadContext(s.thread)
+	}
+}
+
+// LoadRulesFile has records checked against the rules in a YAML file, as with
+// AddRules, counting velocities in c. Rules changed with the admin dashboard
+// are written back to the file.
+func (s *Server) LoadRulesFile(path string, c counters.Store) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	s.rulesLk.Lock()
+	defer s.rulesLk.Unlock()
+
+	e, err := compileRules(b, c)
+	if err != nil {
+		return err
+	}
+	if err := s.checkRuleLabels(e.RuleSet()); err != nil {
+		return err
+	}
+	s.rulesFile = path
+	s.rulesYAML = b
+	s.AddRules(e)
+	return nil
+}
+
+// ReplaceRules swaps the rules records are checked against for the ones in
+// b, as YAML. Velocities keep being counted where they were, and the rules
+// are saved to the rules file, if they were loaded from one.
+func (s *Server) ReplaceRules(b []byte) error {
+	s.rulesLk.Lock()
+	defer s.rulesLk.Unlock()
+
+	var c counters.Store
+	if old := s.rules.Load(); old != nil {
+		c = old.Counters()
+	}
+	e, err := compileRules(b, c)
+	if err != nil {
+		return err
+	}
+	if err := s.checkRuleLabels(e.RuleSet()); err != nil {
+		return err
+	}
+
+	if s.rulesFile != "" {
+		// write a new file and rename it over the old one, so a crash can't
+		// leave half of the rules
+		tmp := s.rulesFile + ".tmp"
+		if err := os.WriteFile(tmp, b, 0644); err != nil {
+			return fmt.Errorf("saving rules: %w", err)
+		}
+		if err := os.Rename(tmp, s.rulesFile); err != nil {
+			return fmt.Errorf("saving rules: %w", err)
+		}
+	}
+
+	s.rulesYAML = b
+	s.configureRules(e)
+	s.rules.Store(e)
+	log.Infof("replaced rules count=%d", len(e.RuleSet().Rules))
+	return nil
+}
+
+func compileRules(b []byte, c counters.Store) (*rules.Engine, error) {
+	rs, err := rules.ParseRuleSet(b)
+	if err != nil {
+		return nil, err
+	}
+	e, err := rules.NewEngine(rs)
+	if err != nil {
+		return nil, err
+	}
+	if c != nil {
+		e.SetCounters(c)
+	}
+	return e, nil
+}
+
+// currentRules returns the YAML of the rules, and the file they are saved
+// in, if any. Rules added with AddRules are re-encoded from their rule set.
+func (s *Server) currentRules() ([]byte, string, error) {
+	s.rulesLk.Lock()
+	defer s.rulesLk.Unlock()
+
+	e := s.rules.Load()
+	if e == nil {
+		return nil, s.rulesFile, nil
+	}
+	if s.rulesYAML != nil {
+		return s.rulesYAML, s.rulesFile, nil
+	}
+	b, err := yaml.Marshal(e.RuleSet())
+	return b, s.rulesFile, err
+}
+
+// applyRules evaluates the rules against a record, files the reports they
+// call for, and returns the values of the labels they call for
+func (s *Server) applyRules(ctx context.Context, did, action, path, uri, cidStr string, rec cbg.CBORMarshaler) ([]string, error) {
+	collection, rkey, _ := strings.Cut(path, "/")
+	engine := s.rules.Load()
+	if engine == nil || !engine.Wants(collection) {
+		return nil, nil
+	}
+
+	fields, err := rules.RecordFields(rec)
+	if err != nil {
+		return nil, fmt.Errorf("reading record for rules: %w", err)
+	}
+	if s.thread != nil && collection == "app.bsky.feed.post" {
+		s.thread.add(uri, cidStr, fields)
+	}
+
+	res, err := engine.Evaluate(ctx, &rules.Event{
+		Did:        did,
+		Action:     action,
+		Collection: collection,
+		Rkey:       rkey,
+		Cid:        cidStr,
+		Record:     fields,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("evaluating rules: %w", err)
+	}
+
+	for _, a := range res.Actions {
+		actx := logutil.WithFields(ctx, "rule", a.Rule)
+		switch {
+		case a.Flag != "":
+			logger.InfoCtx(actx, "record flagged by rule", "uri", uri, "flag", a.Flag)
+		case a.Report != nil:
+			reason := fmt.Sprintf("reported by rule %s", a.Rule)
+			if a.Report.Reason != "" {
+				reason += ": " + a.Report.Reason
+			}
+			row := models.ModerationReport{
+				SubjectType:   "com.atproto.repo.recordRef",
+				SubjectDid:    did,
+				SubjectUri:    &uri,
+				SubjectCid:    &cidStr,
+				ReasonType:    a.Report.ReasonType,
+				Reason:        &reason,
+				ReportedByDid: s.user.Did,
+			}
+			if err := s.db.WithContext(ctx).Create(&row).Error; err != nil {
+				return nil, fmt.Errorf("filing report for rule %s: %w", a.Rule, err)
+			}
+			logger.InfoCtx(actx, "rule reported record", "uri", uri, "report", row.ID)
+		case a.Escalate != "":
+			reason := fmt.Sprintf("escalated for %s by rule %s, on %s", a.Escalate, a.Rule, uri)
+			row := models.ModerationReport{
+				SubjectType:   "com.atproto.repo.repoRef",
+				SubjectDid:    did,
+				ReasonType:    escalationReasonType,
+				Reason:        &reason,
+				ReportedByDid: s.user.Did,
+			}
+			if err := s.db.WithContext(ctx).Create(&row).Error; err != nil {
+				return nil, fmt.Errorf("filing escalation for rule %s: %w", a.Rule, err)
+			}
+			logger.WarnCtx(actx, "rule escalated account", "uri", uri, "escalation", a.Escalate, "report", row.ID)
+		}
+	}
+
+	labels := res.Labels()
+	s.throughput.add(sourceRules, len(labels), time.Now())
+	return labels, nil
+}
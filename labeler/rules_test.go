@@ -0,0 +1,78 @@
+package labeler
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/rules"
+)
+
+func TestLabelMakerRules(t *testing.T) {
+	lm := testLabelMaker(t)
+
+	rs, err := rules.ParseRuleSet([]byte(`
+rules:
+  - name: crypto
+    collections: [app.bsky.feed.post]
+    when: {field: text, contains: airdrop}
+    actions:
+      - label: spam
+      - label: "repo:spammer"
+      - report: {reason_type: "com.atproto.moderation.defs#reasonSpam"}
+      - escalate: takedown
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := rules.NewEngine(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lm.AddRules(e)
+
+	ctx := context.Background()
+	did := "did:plc:spammer"
+	path := "app.bsky.feed.post/3jzfcijpj2z2a"
+	uri := "at://" + did + "/" + path
+	cidStr := "bafyreiclp443lavogvhj3d2ob2cxbfuscni2k5jk7bebjzg7khl3esabwq"
+
+	vals, err := lm.applyRules(ctx, did, "create", path, uri, cidStr, &appbsky.FeedPost{Text: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vals) != 0 {
+		t.Fatalf("expected no labels, got %v", vals)
+	}
+
+	vals, err = lm.applyRules(ctx, did, "create", path, uri, cidStr, &appbsky.FeedPost{Text: "big AIRDROP"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vals, []string{"spam", "repo:spammer"}) {
+		t.Fatalf("unexpected labels %v", vals)
+	}
+
+	var reports []models.ModerationReport
+	if err := lm.db.Order("id").Find(&reports).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 2 {
+		t.Fatalf("expected a report and an escalation, got %d reports", len(reports))
+	}
+
+	rep := reports[0]
+	if rep.SubjectType != "com.atproto.repo.recordRef" || *rep.SubjectUri != uri || *rep.SubjectCid != cidStr {
+		t.Fatalf("report is not about the record: %+v", rep)
+	}
+	if rep.ReasonType != "com.atproto.moderation.defs#reasonSpam" || rep.ReportedByDid != lm.user.Did {
+		t.Fatalf("unexpected report %+v", rep)
+	}
+
+	esc := reports[1]
+	if esc.SubjectType != "com.atproto.repo.repoRef" || esc.SubjectDid != did || esc.ReasonType != escalationReasonType {
+		t.Fatalf("unexpected escalation %+v", esc)
+	}
+}
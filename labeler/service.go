@@ -5,25 +5,41 @@ import (
 	"context"
 	"crypto/subtle"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/bluesky-social/indigo/api"
 	comatproto "github.com/bluesky-social/indigo/api/atproto"
 	appbsky "github.com/bluesky-social/indigo/api/bsky"
 	label "github.com/bluesky-social/indigo/api/label"
-	"github.com/bluesky-social/indigo/bgs"
 	"github.com/bluesky-social/indigo/carstore"
 	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/events/schedulers/autoscaling"
 	"github.com/bluesky-social/indigo/indexer"
 	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/lex/validate"
 	"github.com/bluesky-social/indigo/models"
 	"github.com/bluesky-social/indigo/pds"
 	"github.com/bluesky-social/indigo/repo"
 	"github.com/bluesky-social/indigo/repomgr"
+	"github.com/bluesky-social/indigo/rules"
+	"github.com/bluesky-social/indigo/util/cursorstore"
+	"github.com/bluesky-social/indigo/util/invalidation"
+	"github.com/bluesky-social/indigo/util/logutil"
+	"github.com/bluesky-social/indigo/util/phash"
+	"github.com/bluesky-social/indigo/util/ratelimit"
+	"github.com/bluesky-social/indigo/util/serviceauth"
+	"github.com/bluesky-social/indigo/util/signer"
+	"github.com/bluesky-social/indigo/util/xrpcerr"
+	"github.com/bluesky-social/indigo/xrpc"
 	cbg "github.com/whyrusleeping/cbor-gen"
 
 	logging "github.com/ipfs/go-log"
@@ -35,21 +51,85 @@ import (
 
 var log = logging.Logger("labelmaker")
 
+// logger is for structured logs carrying the fields of the event or request
+// being handled
+var logger = logutil.Logger("labelmaker")
+
 type Server struct {
 	db                  *gorm.DB
 	cs                  *carstore.CarStore
 	repoman             *repomgr.RepoManager
-	bgsSlurper          *bgs.Slurper
+	bgsCancel           context.CancelFunc
+	bgsDone             chan struct{}
 	evtmgr              *events.EventManager
 	echo                *echo.Echo
 	user                *RepoConfig
+	signer              signer.Signer
 	blobPdsURL          string
 	xrpcProxyURL        *url.URL
 	xrpcProxyAuthHeader string
 	kwLabelers          []KeywordLabeler
+	kwMatcher           *keywordMatcher
 	muNSFWImgLabeler    *MicroNSFWImgLabeler
 	hiveAILabeler       *HiveAILabeler
 	sqrlLabeler         *SQRLLabeler
+	imageHashLabeler    *ImageHashLabeler
+	rules               atomic.Pointer[rules.Engine]
+	rulesLk             sync.Mutex
+	rulesFile           string
+	rulesYAML           []byte
+	vocabulary          *LabelVocabulary
+	vocabularyCreatedAt string
+	throughput          *throughput
+	allowList           *allowList
+	profiles            *profileHistory
+	handles             *handleCache
+	thread              *ThreadContext
+	lists               *listLabeler
+	reportThresholds    []ReportThreshold
+	reportForwardClient *xrpc.Client
+	reportForwards      sync.WaitGroup
+	rateLimitStore      ratelimit.Store
+	rateLimits          map[string]ratelimit.Limit
+	ipExtractor         echo.IPExtractor
+	serviceAuth         *serviceauth.Validator
+	requestValidator    *validate.Validator
+	sigVerifier         *events.SignatureVerifier
+	cursors             cursorstore.Store
+	subscribers         *events.SubscriberDB
+	subscriberAuth      events.SubscriptionAuth
+	bandwidth           *events.BandwidthTracker
+	invalidations       invalidation.Bus
+}
+
+// reportPaths are the paths reports are created at: the current method, and
+// the old name it is still served under
+var reportPaths = []string{
+	"/xrpc/com.atproto.moderation.createReport",
+	"/xrpc/com.atproto.report.create",
+}
+
+// reportMethods are the methods service auth tokens for reports are bound
+// to, for the report paths not named after theirs
+var reportMethods = map[string]string{
+	"/xrpc/com.atproto.report.create": "com.atproto.moderation.createReport",
+}
+
+func isReportPath(path string) bool {
+	for _, p := range reportPaths {
+		if path == p {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultRateLimits are applied per client IP to endpoints which are open to
+// the public
+var DefaultRateLimits = map[string]ratelimit.Limit{
+	"/xrpc/com.atproto.moderation.createReport": {Count: 100, Period: time.Hour},
+	"/xrpc/com.atproto.report.create":           {Count: 100, Period: time.Hour},
+	"/xrpc/com.atproto.label.queryLabels":       {Count: 3000, Period: 5 * time.Minute},
 }
 
 type RepoConfig struct {
@@ -57,12 +137,14 @@ type RepoConfig struct {
 	Did        string
 	Password   string
 	SigningKey *did.PrivKey
-	UserId     models.Uid
+	// Signer, if set, signs repo commits and labels instead of SigningKey,
+	// for keys held in a KMS or HSM
+	Signer signer.Signer
+	UserId models.Uid
 }
 
-// In addition to configuring the service, will connect to upstream BGS and start processing events. Won't handle HTTP or WebSocket endpoints until RunAPI() is called.
-// 'useWss' is a flag to use SSL for outbound WebSocket connections
-func NewServer(db *gorm.DB, cs *carstore.CarStore, repoUser RepoConfig, plcURL, blobPdsURL, xrpcProxyURL, xrpcProxyAdminPassword string, useWss bool) (*Server, error) {
+// Configures the service. Won't process events until SubscribeBGS() is called, or handle HTTP or WebSocket endpoints until RunAPI() is called.
+func NewServer(db *gorm.DB, cs *carstore.CarStore, repoUser RepoConfig, plcURL, blobPdsURL, xrpcProxyURL, xrpcProxyAdminPassword string) (*Server, error) {
 
 	db.AutoMigrate(models.PDS{})
 	db.AutoMigrate(models.Label{})
@@ -70,11 +152,26 @@ func NewServer(db *gorm.DB, cs *carstore.CarStore, repoUser RepoConfig, plcURL,
 	db.AutoMigrate(models.ModerationActionSubjectBlobCid{})
 	db.AutoMigrate(models.ModerationReport{})
 	db.AutoMigrate(models.ModerationReportResolution{})
+	db.AutoMigrate(models.LabelerAllowEntry{})
+	db.AutoMigrate(models.ProfileVersion{})
+	db.AutoMigrate(models.LabelerHandle{})
+	db.AutoMigrate(models.LabelerListItem{})
+	db.AutoMigrate(models.SubscriberToken{})
+	db.AutoMigrate(models.SubscriberPolicy{})
 
 	didr := &api.PLCServer{Host: plcURL}
-	kmgr := indexer.NewKeyManager(didr, repoUser.SigningKey)
+	sig := repoUser.Signer
+	if sig == nil && repoUser.SigningKey != nil {
+		sig = signer.NewKeySigner(repoUser.SigningKey)
+	}
+	kmgr := indexer.NewKeyManagerWithSigner(didr, sig)
 	evtmgr := events.NewEventManager(events.NewMemPersister())
 	repoman := repomgr.NewRepoManager(cs, kmgr)
+	tids, err := repomgr.NewTIDSource(context.Background(), db, 0)
+	if err != nil {
+		return nil, err
+	}
+	repoman.SetTIDSource(tids)
 
 	if repoUser.Password == "" || repoUser.Did == "" || repoUser.Handle == "" {
 		return nil, fmt.Errorf("bad labeler repo config (empty string)")
@@ -86,15 +183,33 @@ func NewServer(db *gorm.DB, cs *carstore.CarStore, repoUser RepoConfig, plcURL,
 	}
 	xrpcProxyAuthHeader := "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:"+xrpcProxyAdminPassword))
 
+	rlstore, err := ratelimit.NewMemoryStore(100_000)
+	if err != nil {
+		return nil, err
+	}
+
 	s := &Server{
 		db:                  db,
 		repoman:             repoman,
 		evtmgr:              evtmgr,
 		user:                &repoUser,
+		signer:              sig,
 		blobPdsURL:          blobPdsURL,
 		xrpcProxyURL:        proxyURL,
 		xrpcProxyAuthHeader: xrpcProxyAuthHeader,
-		// sluper configured below
+		rateLimitStore:      rlstore,
+		rateLimits:          DefaultRateLimits,
+		ipExtractor:         echo.ExtractIPDirect(),
+		throughput:          newThroughput(),
+		profiles:            &profileHistory{db: db},
+		handles:             &handleCache{db: db},
+		subscribers:         events.NewSubscriberDB(db),
+		bandwidth:           events.NewBandwidthTracker(0),
+	}
+	s.subscriberAuth.Subscribers = s.subscribers
+
+	if s.cursors, err = cursorstore.NewDBStore(db); err != nil {
+		return nil, err
 	}
 
 	// ensure that local labelmaker repo exists
@@ -110,18 +225,94 @@ func NewServer(db *gorm.DB, cs *carstore.CarStore, repoUser RepoConfig, plcURL,
 		log.Infof("found labelmaker repo: %s", head)
 	}
 
-	slurp, err := bgs.NewSlurper(db, s.handleBgsRepoEvent, useWss)
-	if err != nil {
-		return nil, err
-	}
-	s.bgsSlurper = slurp
-
 	return s, nil
 }
 
+// SetRateLimits replaces the rate limit store and per-endpoint limits. Must be
+// called before RunAPI.
+func (s *Server) SetRateLimits(store ratelimit.Store, limits map[string]ratelimit.Limit) {
+	s.rateLimitStore = store
+	s.rateLimits = limits
+}
+
+// SetIPExtractor sets how client IPs, which requests are rate limited by, are
+// found. It defaults to the address of the connection; see
+// ratelimit.IPExtractor. Must be called before RunAPI.
+func (s *Server) SetIPExtractor(ex echo.IPExtractor) {
+	s.ipExtractor = ex
+}
+
+// SetServiceAuth enables accepting reports authenticated with service auth
+// tokens (see com.atproto.server.getServiceAuth) issued by the reporting
+// account's PDS. Must be called before RunAPI.
+func (s *Server) SetServiceAuth(v *serviceauth.Validator) {
+	s.serviceAuth = v
+}
+
+// SetSubscriberServiceAuth enables label subscribers authenticating with
+// service auth tokens, who are known by their DID. As any account can get
+// one, those without a policy of their own are treated as anonymous. Must be
+// called before RunAPI.
+func (s *Server) SetSubscriberServiceAuth(v *serviceauth.Validator) {
+	s.subscriberAuth.ServiceAuth = v
+}
+
+// SetRequireSubscriberAuth refuses label subscribers which don't
+// authenticate, with a subscriber token or (if enabled with
+// SetSubscriberServiceAuth) a service auth token with a policy. Must be
+// called before RunAPI.
+func (s *Server) SetRequireSubscriberAuth(require bool) {
+	s.subscriberAuth.RequireAuth = require
+}
+
+// SetAnonymousSubscriptionPolicy applies p to label subscribers which don't
+// authenticate. Without one they are refused once any subscriber has a
+// policy. Must be called before RunAPI.
+func (s *Server) SetAnonymousSubscriptionPolicy(p *events.SubscriptionPolicy) {
+	s.subscriberAuth.Anonymous = p
+}
+
+// SetRequestValidator has the parameters and JSON inputs of XRPC calls
+// checked against their lexicons before they are handled. Must be called
+// before RunAPI.
+func (s *Server) SetRequestValidator(v *validate.Validator) {
+	s.requestValidator = v
+}
+
+// SetCursorStore keeps the cursor of the BGS subscription in cs, rather than
+// in the labelmaker's database. Must be called before SubscribeBGS.
+func (s *Server) SetCursorStore(cs cursorstore.Store) {
+	s.cursors = cs
+}
+
+// SetSignatureVerifier has the signatures of commits from the BGS checked
+// before their records are labeled, dropping those which fail. Must be called
+// before SubscribeBGS.
+func (s *Server) SetSignatureVerifier(v *events.SignatureVerifier) {
+	s.sigVerifier = v
+}
+
+// AddKeywordLabeler adds a keyword labeler to those records are matched
+// against, recompiling the keywords of all of them. Use SetKeywordLabelers to
+// configure many at once.
 func (s *Server) AddKeywordLabeler(kwl KeywordLabeler) {
 	log.Infof("configuring keyword labeler")
-	s.kwLabelers = append(s.kwLabelers, kwl)
+	s.SetKeywordLabelers(append(s.kwLabelers, kwl))
+}
+
+// SetKeywordLabelers replaces the keyword labelers records are matched
+// against. Their keywords are compiled together, so that matching a record
+// costs the same however many keywords there are. Must be called before
+// SubscribeBGS.
+func (s *Server) SetKeywordLabelers(kwl []KeywordLabeler) {
+	keywords := 0
+	for _, kl := range kwl {
+		keywords += len(kl.Keywords)
+	}
+	log.Infow("compiling keyword labelers", "labelers", len(kwl), "keywords", keywords)
+
+	s.kwLabelers = kwl
+	s.kwMatcher = newKeywordMatcher(kwl)
 }
 
 func (s *Server) AddMicroNSFWImgLabeler(url string) {
@@ -136,17 +327,92 @@ func (s *Server) AddHiveAILabeler(apiToken string) {
 	s.hiveAILabeler = &hal
 }
 
+func (s *Server) AddImageHashLabeler(ihl *ImageHashLabeler) {
+	log.Infof("configuring image hash labeler lists=%d", len(ihl.Lists))
+	s.imageHashLabeler = ihl
+}
+
 func (s *Server) AddSQRLLabeler(url string) {
 	log.Infof("configuring SQRL labeler url=%s", url)
 	sl := NewSQRLLabeler(url)
 	s.sqrlLabeler = &sl
 }
 
-// call this *after* all the labelers are configured
-func (s *Server) SubscribeBGS(ctx context.Context, bgsURL string, useWss bool) {
-	// subscribe our RepoEvent slurper to the BGS, to receive incoming records for labeler
+// call this *after* all the labelers are configured. The subscription is
+// redialed whenever it drops, resuming from the cursor saved for the BGS host,
+// until ctx is done or the server is shut down.
+func (s *Server) SubscribeBGS(ctx context.Context, bgsURL string, useWss bool) error {
 	log.Infof("subscribing to BGS: %s (SSL=%v)", bgsURL, useWss)
-	s.bgsSlurper.SubscribeToPds(ctx, bgsURL, useWss)
+
+	protocol := "ws"
+	if useWss {
+		protocol = "wss"
+	}
+
+	scalingSettings := autoscaling.AutoscaleSettings{
+		Concurrency:              1,
+		MaxConcurrency:           360,
+		AutoscaleFrequency:       time.Second,
+		ThroughputBucketCount:    60,
+		ThroughputBucketDuration: time.Second,
+	}
+
+	handler := s.handleBgsRepoEvent
+	if s.sigVerifier != nil {
+		handler = s.sigVerifier.Handler(handler)
+	}
+
+	cursors := cursorstore.NewTracker(s.cursors, "labelmaker/"+bgsURL)
+	sub, err := events.NewSubscription(events.SubscriptionConfig{
+		URL:     fmt.Sprintf("%s://%s/xrpc/com.atproto.sync.subscribeRepos", protocol, bgsURL),
+		Handler: handler,
+		NewScheduler: func(ident string, do func(context.Context, *events.XRPCStreamEvent) error) events.Scheduler {
+			return autoscaling.NewScheduler(scalingSettings, ident, do)
+		},
+		LoadCursor: func(ctx context.Context) (int64, error) {
+			return s.loadBGSCursor(ctx, cursors, bgsURL)
+		},
+		Cursors:         cursors,
+		LivenessTimeout: bgsLivenessTimeout,
+		OnStateChange: func(state events.SubscriptionState, err error) {
+			log.Infow("BGS subscription state change", "host", bgsURL, "state", state, "err", err)
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	s.bgsCancel = cancel
+	s.bgsDone = make(chan struct{})
+	go func() {
+		defer close(s.bgsDone)
+		if err := sub.Run(ctx); err != nil {
+			log.Errorf("BGS subscription failed: %s", err)
+		}
+	}()
+
+	return nil
+}
+
+// bgsLivenessTimeout is how long the BGS subscription waits for an event
+// before redialing
+const bgsLivenessTimeout = 5 * time.Minute
+
+// loadBGSCursor returns the cursor saved for a BGS host. Cursors used to be
+// kept in the host's PDS row, as the BGS's own subscriptions keep them, which
+// is read until one has been saved in the cursor store.
+func (s *Server) loadBGSCursor(ctx context.Context, cursors *cursorstore.Tracker, host string) (int64, error) {
+	seq, err := cursors.Load(ctx)
+	if err != nil || seq > 0 {
+		return seq, err
+	}
+
+	var peering models.PDS
+	if err := s.db.WithContext(ctx).Find(&peering, "host = ?", host).Error; err != nil {
+		return 0, err
+	}
+	return peering.Cursor, nil
 }
 
 // efficiency predicate to quickly discard events we know that we shouldn't even bother parsing
@@ -157,6 +423,9 @@ func (s *Server) wantAnyRecords(ctx context.Context, ra *comatproto.SyncSubscrib
 			continue
 		}
 		nsid := strings.SplitN(op.Path, "/", 2)[0]
+		if e := s.rules.Load(); e != nil && e.Wants(nsid) {
+			return true
+		}
 		switch nsid {
 		case "app.bsky.feed.post":
 			return true
@@ -174,18 +443,35 @@ func (s *Server) wantBlob(ctx context.Context, blob *lexutil.LexBlob) bool {
 	log.Debugf("wantBlob blob=%v", blob)
 	// images
 	if blob.MimeType == "image/png" || blob.MimeType == "image/jpeg" {
-		// only an image API is configured
-		if s.muNSFWImgLabeler != nil || s.hiveAILabeler != nil {
+		// only if an image labeler is configured
+		if s.muNSFWImgLabeler != nil || s.hiveAILabeler != nil || s.imageHashLabeler != nil {
 			return true
 		}
 	}
 	return false
 }
 
+// labeledCollections are the record types run through the labelers: posts
+// and profiles, and lists and feed generators for their text
+var labeledCollections = map[string]bool{
+	"app.bsky.feed.post":      true,
+	"app.bsky.actor.profile":  true,
+	"app.bsky.graph.list":     true,
+	"app.bsky.feed.generator": true,
+}
+
 func (s *Server) labelRecord(ctx context.Context, did, nsid, uri, cidStr string, rec cbg.CBORMarshaler) ([]string, error) {
-	log.Infof("labeling record: %v", uri)
+	logger.InfoCtx(ctx, "labeling record", "uri", uri)
 	var labelVals []string
 	var blobs []lexutil.LexBlob
+
+	// run through all the keyword labelers, saving any resulting labels
+	if s.kwMatcher != nil {
+		kwVals := s.kwMatcher.LabelRecord(rec)
+		s.throughput.add(sourceKeyword, len(kwVals), time.Now())
+		labelVals = append(labelVals, kwVals...)
+	}
+
 	switch nsid {
 	case "app.bsky.feed.post":
 		post, suc := rec.(*appbsky.FeedPost)
@@ -193,18 +479,12 @@ func (s *Server) labelRecord(ctx context.Context, did, nsid, uri, cidStr string,
 			return nil, fmt.Errorf("record failed to deserialize from CBOR: %s", rec)
 		}
 
-		// run through all the keyword labelers on posts, saving any resulting labels
-		for _, labeler := range s.kwLabelers {
-			for _, val := range labeler.LabelPost(*post) {
-				labelVals = append(labelVals, val)
-			}
-		}
-
 		if s.sqrlLabeler != nil {
 			sqrlVals, err := s.sqrlLabeler.LabelPost(ctx, *post)
 			if err != nil {
 				return nil, fmt.Errorf("failed to label post with SQRL: %v", err)
 			}
+			s.throughput.add(sourceSQRL, len(sqrlVals), time.Now())
 			labelVals = append(labelVals, sqrlVals...)
 		}
 
@@ -220,18 +500,12 @@ func (s *Server) labelRecord(ctx context.Context, did, nsid, uri, cidStr string,
 			return nil, fmt.Errorf("record failed to deserialize from CBOR: %s", rec)
 		}
 
-		// run through all the keyword labelers on posts, saving any resulting labels
-		for _, labeler := range s.kwLabelers {
-			for _, val := range labeler.LabelProfile(*profile) {
-				labelVals = append(labelVals, val)
-			}
-		}
-
 		if s.sqrlLabeler != nil {
 			sqrlVals, err := s.sqrlLabeler.LabelProfile(ctx, *profile)
 			if err != nil {
 				return nil, fmt.Errorf("failed to label profile with SQRL: %v", err)
 			}
+			s.throughput.add(sourceSQRL, len(sqrlVals), time.Now())
 			labelVals = append(labelVals, sqrlVals...)
 		}
 
@@ -254,6 +528,19 @@ func (s *Server) labelRecord(ctx context.Context, did, nsid, uri, cidStr string,
 			log.Infof("skipping blob: cid=%s", blob.Ref.String())
 			continue
 		}
+
+		// images which were already hashed don't need to be downloaded again,
+		// unless the image APIs need them
+		if h, ok := s.cachedImageHash(blob); ok {
+			blobLabels, err := s.imageHashLabeler.LabelHash(ctx, h)
+			if err != nil {
+				return nil, err
+			}
+			s.throughput.add(sourceImageHash, len(blobLabels), time.Now())
+			labelVals = append(labelVals, blobLabels...)
+			continue
+		}
+
 		// download image for process
 		blobBytes, err := s.downloadRepoBlob(ctx, did, &blob)
 		// TODO(bnewbold): instead of erroring, just log any download problems
@@ -319,6 +606,7 @@ func (s *Server) labelBlob(ctx context.Context, did string, blob lexutil.LexBlob
 		if err != nil {
 			return nil, err
 		}
+		s.throughput.add(sourceMicroNSFWImg, len(nsfwLabels), time.Now())
 		labelVals = append(labelVals, nsfwLabels...)
 	}
 
@@ -328,20 +616,57 @@ func (s *Server) labelBlob(ctx context.Context, did string, blob lexutil.LexBlob
 		if err != nil {
 			return nil, err
 		}
+		s.throughput.add(sourceHiveAI, len(hiveLabels), time.Now())
 		labelVals = append(labelVals, hiveLabels...)
 	}
 
+	if s.imageHashLabeler != nil {
+
+		hashLabels, err := s.imageHashLabeler.LabelBlob(ctx, blob, blobBytes)
+		if err != nil {
+			return nil, err
+		}
+		s.throughput.add(sourceImageHash, len(hashLabels), time.Now())
+		labelVals = append(labelVals, hashLabels...)
+	}
+
 	return labelVals, nil
 }
 
+// cachedImageHash returns the hash of a blob if the image hash labeler is the
+// only image labeler, and already hashed it
+func (s *Server) cachedImageHash(blob lexutil.LexBlob) (phash.Hash, bool) {
+	if s.imageHashLabeler == nil || s.muNSFWImgLabeler != nil || s.hiveAILabeler != nil {
+		return phash.Hash{}, false
+	}
+	return s.imageHashLabeler.CachedHash(blob)
+}
+
 // Process incoming repo events coming from BGS, which includes new and updated
 // records from any PDS. This function extracts records, handes them to the
 // labeling routine, and then persists and broadcasts any resulting labels
-func (s *Server) handleBgsRepoEvent(ctx context.Context, pds *models.PDS, evt *events.XRPCStreamEvent) error {
+func (s *Server) handleBgsRepoEvent(ctx context.Context, evt *events.XRPCStreamEvent) error {
+
+	if evt.RepoHandle != nil {
+		ctx = logutil.WithFields(ctx, "did", evt.RepoHandle.Did, "seq", evt.RepoHandle.Seq)
+		return s.handles.record(ctx, evt.RepoHandle.Did, evt.RepoHandle.Handle)
+	}
 
+	// only commits carry records
 	if evt.RepoCommit == nil {
-		// TODO(bnewbold): is this really invalid? do we need to handle Info and Error events here?
-		return fmt.Errorf("invalid repo commit event")
+		return nil
+	}
+
+	ctx = logutil.WithFields(ctx, "did", evt.RepoCommit.Repo, "seq", evt.RepoCommit.Seq)
+
+	// the members of labeled lists are followed whatever else is processed
+	if err := s.handleListItems(ctx, evt.RepoCommit); err != nil {
+		return err
+	}
+
+	// in allow-list mode, only some accounts are processed
+	if !s.allowed(ctx, evt.RepoCommit.Repo) {
+		return nil
 	}
 
 	// quick check if we can skip processing the CAR slice entirely
@@ -352,7 +677,7 @@ func (s *Server) handleBgsRepoEvent(ctx context.Context, pds *models.PDS, evt *e
 	// use an in-memory blockstore with repo wrapper to parse CAR slice
 	sliceRepo, err := repo.ReadRepoFromCar(ctx, bytes.NewReader(evt.RepoCommit.Blocks))
 	if err != nil {
-		log.Warnw("failed to parse CAR slice", "repoErr", err)
+		logger.WarnCtx(ctx, "failed to parse CAR slice", "repoErr", err)
 		return err
 	}
 
@@ -365,15 +690,35 @@ func (s *Server) handleBgsRepoEvent(ctx context.Context, pds *models.PDS, evt *e
 			continue
 		}
 
-		cid, rec, err := sliceRepo.GetRecord(ctx, op.Path)
+		// records of types the labelers do not know are still seen by the
+		// rules, which work on any record
+		cid, rec, err := sliceRepo.GetRawRecord(ctx, op.Path)
 		if err != nil {
 			return fmt.Errorf("record not in CAR slice: %s", uri)
 		}
 		cidStr := cid.String()
-		labelVals, err := s.labelRecord(ctx, evt.RepoCommit.Repo, nsid, uri, cidStr, rec)
+		opctx := logutil.WithFields(ctx, "nsid", nsid)
+
+		// profiles are recorded before the rules see them, so changes count
+		// towards profile_changes straight away
+		if prof, ok := rec.Val.(*appbsky.ActorProfile); ok && nsid == "app.bsky.actor.profile" {
+			if err := s.profiles.record(opctx, evt.RepoCommit.Repo, cidStr, prof, time.Now()); err != nil {
+				return fmt.Errorf("recording profile: %w", err)
+			}
+		}
+
+		var labelVals []string
+		if labeledCollections[nsid] {
+			labelVals, err = s.labelRecord(opctx, evt.RepoCommit.Repo, nsid, uri, cidStr, rec.Val)
+			if err != nil {
+				return err
+			}
+		}
+		ruleVals, err := s.applyRules(opctx, evt.RepoCommit.Repo, op.Action, op.Path, uri, cidStr, rec)
 		if err != nil {
 			return err
 		}
+		labelVals = dedupeStrings(append(labelVals, ruleVals...))
 		for _, val := range labelVals {
 			// apply labels with this pattern to the whole repo, not the record
 			if strings.HasPrefix(val, "repo:") {
@@ -418,12 +763,13 @@ func (s *Server) adminAuthMiddleware() echo.MiddlewareFunc {
 		Skipper: func(c echo.Context) bool {
 			path := c.Request().URL.Path
 			// all admin paths require auth
-			if strings.HasPrefix(path, "/xrpc/com.atproto.admin.") {
+			if strings.HasPrefix(path, "/xrpc/com.atproto.admin.") || path == "/admin" || strings.HasPrefix(path, "/admin/") {
 				return false
 			}
-			// TODO: will need more complex auth on this endpoint eventually
-			if strings.HasPrefix(path, "/xrpc/com.atproto.report.create") {
-				return false
+			// reports from other accounts are authenticated with service auth
+			// instead, if enabled
+			if isReportPath(path) {
+				return s.hasServiceAuth(c)
 			}
 			// everything else defaults open
 			return true
@@ -443,25 +789,51 @@ func (s *Server) adminAuthMiddleware() echo.MiddlewareFunc {
 	return middleware.BasicAuthWithConfig(config)
 }
 
+func (s *Server) hasServiceAuth(c echo.Context) bool {
+	return s.serviceAuth != nil && strings.HasPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+}
+
 func (s *Server) RunAPI(listen string) error {
+	li, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	return s.RunAPIWithListener(li)
+}
+
+// RunAPIWithListener is like RunAPI, on a listener the caller already has
+// open, such as one on a random port in tests
+func (s *Server) RunAPIWithListener(li net.Listener) error {
 	e := echo.New()
 	s.echo = e
 	e.HideBanner = true
+	e.IPExtractor = s.ipExtractor
 	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
 		Format: "method=${method} uri=${uri} status=${status} latency=${latency_human}\n",
 	}))
+	e.Use(echo.WrapMiddleware(logutil.Middleware))
 	e.Use(s.adminAuthMiddleware())
-
-	e.HTTPErrorHandler = func(err error, ctx echo.Context) {
-		code := 500
-		if he, ok := err.(*echo.HTTPError); ok {
-			code = he.Code
-		}
-		log.Warnw("HTTP request error", "statusCode", code, "path", ctx.Path(), "err", err)
-		ctx.Response().WriteHeader(code)
+	if s.serviceAuth != nil {
+		e.Use(serviceauth.Middleware(serviceauth.Config{
+			Validator: s.serviceAuth,
+			Skipper: func(c echo.Context) bool {
+				return !isReportPath(c.Path()) || !s.hasServiceAuth(c)
+			},
+			Methods: reportMethods,
+		}))
+	}
+	e.Use(ratelimit.Middleware(ratelimit.Config{
+		Store:  s.rateLimitStore,
+		Limits: s.rateLimits,
+	}))
+	if s.requestValidator != nil {
+		e.Use(validate.RequestMiddleware(s.requestValidator))
 	}
 
+	e.HTTPErrorHandler = xrpcerr.ErrorHandler(logger)
+
 	e.GET("/xrpc/_health", s.HandleHealthCheck)
+	e.GET("/xrpc/com.atproto.repo.getRecord", s.HandleGetLabelerService)
 	if err := s.RegisterHandlersComAtproto(e); err != nil {
 		return err
 	}
@@ -471,10 +843,61 @@ func (s *Server) RunAPI(listen string) error {
 	// single websocket endpoint
 	e.GET("/xrpc/com.atproto.label.subscribeLabels", s.EventsLabelsWebsocket)
 
-	log.Infof("starting labelmaker XRPC and WebSocket daemon at: %s", listen)
-	return e.Start(listen)
+	e.GET("/admin/log/getLevels", echo.WrapHandler(logutil.LevelsHandler()))
+	e.POST("/admin/log/setLevels", echo.WrapHandler(logutil.LevelsHandler()))
+	e.GET("/admin/allowlist", s.HandleGetAllowList)
+	e.POST("/admin/allowlist/add", s.HandleAddAllowList)
+	e.POST("/admin/allowlist/remove", s.HandleRemoveAllowList)
+	e.POST("/admin/subscribers/createToken", s.HandleCreateSubscriberToken)
+	e.GET("/admin/subscribers/policies", s.HandleListSubscriberPolicies)
+	e.POST("/admin/subscribers/setPolicy", s.HandleSetSubscriberPolicy)
+	e.GET("/admin/subscribers/usage", s.HandleGetSubscriberUsage)
+	if err := s.RegisterDashboardHandlers(e); err != nil {
+		return err
+	}
+
+	log.Infof("starting labelmaker XRPC and WebSocket daemon at: %s", li.Addr())
+	e.Listener = li
+	return e.StartServer(e.Server)
 }
 
+// Shutdown stops accepting requests, drains the BGS subscription and saves its
+// cursor, waits for reports being forwarded, and then closes the connections
+// of label subscribers
 func (s *Server) Shutdown(ctx context.Context) error {
-	return s.echo.Shutdown(ctx)
+	var errs []error
+	if s.echo != nil {
+		if err := s.echo.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("stopping http server: %w", err))
+		}
+	}
+
+	if s.bgsCancel != nil {
+		s.bgsCancel()
+		select {
+		case <-s.bgsDone:
+		case <-ctx.Done():
+			errs = append(errs, fmt.Errorf("waiting for BGS subscription to stop: %w", ctx.Err()))
+		}
+	}
+
+	forwarded := make(chan struct{})
+	go func() {
+		s.reportForwards.Wait()
+		close(forwarded)
+	}()
+	select {
+	case <-forwarded:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("waiting for reports to be forwarded: %w", ctx.Err()))
+	}
+
+	if err := s.evtmgr.Shutdown(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := s.evtmgr.CloseSubscribers(ctx); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
 }
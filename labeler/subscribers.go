@@ -0,0 +1,72 @@
+package labeler
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bluesky-social/indigo/events"
+
+	"github.com/labstack/echo/v4"
+)
+
+// HandleCreateSubscriberToken creates a token for a label subscriber to
+// authenticate with, replacing any it had before
+func (s *Server) HandleCreateSubscriberToken(c echo.Context) error {
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return adminError(c, 400, err)
+	}
+	if body.Name == "" {
+		return adminError(c, 400, fmt.Errorf("no name given"))
+	}
+
+	tok, err := s.subscribers.CreateToken(c.Request().Context(), body.Name)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(200, map[string]string{
+		"subscriber": "token:" + body.Name,
+		"token":      tok,
+	})
+}
+
+func (s *Server) HandleListSubscriberPolicies(c echo.Context) error {
+	policies, err := s.subscribers.Policies(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	return c.JSON(200, policies)
+}
+
+// HandleSetSubscriberPolicy sets the policy of an authenticated label
+// subscriber, or removes it if the policy is null. Policies apply from the
+// subscriber's next connection. It returns the policies after the change.
+func (s *Server) HandleSetSubscriberPolicy(c echo.Context) error {
+	var body struct {
+		Subscriber string                     `json:"subscriber"`
+		Policy     *events.SubscriptionPolicy `json:"policy"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return adminError(c, 400, err)
+	}
+	if body.Subscriber == "" {
+		return adminError(c, 400, fmt.Errorf("no subscriber given"))
+	}
+
+	if err := s.subscribers.SetPolicy(c.Request().Context(), body.Subscriber, body.Policy); err != nil {
+		if errors.Is(err, events.ErrInvalidPolicy) {
+			return adminError(c, 400, err)
+		}
+		return err
+	}
+	return s.HandleListSubscriberPolicies(c)
+}
+
+// HandleGetSubscriberUsage returns the events and bytes sent to each label
+// subscriber
+func (s *Server) HandleGetSubscriberUsage(c echo.Context) error {
+	return c.JSON(200, s.bandwidth.Usage())
+}
@@ -0,0 +1,109 @@
+package labeler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/rules"
+	"github.com/bluesky-social/indigo/util/ratelimit"
+	"github.com/bluesky-social/indigo/xrpc"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// DefaultThreadFetchBudget is how many posts the thread context fetches from
+// the appview, if not configured otherwise
+var DefaultThreadFetchBudget = ratelimit.Limit{Count: 600, Period: time.Minute}
+
+// ThreadContext finds the posts replied to, for the parent and root
+// conditions of rules. Posts the labelmaker saw recently are kept in a
+// bounded cache; others are fetched from an appview, up to a budget, past
+// which they are treated as not found, so that a flood of replies can't
+// flood the appview too.
+type ThreadContext struct {
+	client *xrpc.Client
+	posts  *lru.Cache
+	budget ratelimit.Store
+	limit  ratelimit.Limit
+}
+
+var _ rules.ThreadContext = (*ThreadContext)(nil)
+
+// NewThreadContext caches up to cacheSize posts, and fetches the others from
+// the appview at appviewURL, if set, up to limit posts per period
+func NewThreadContext(appviewURL string, cacheSize int, limit ratelimit.Limit) (*ThreadContext, error) {
+	c, err := lru.New(cacheSize)
+	if err != nil {
+		return nil, err
+	}
+	budget, err := ratelimit.NewMemoryStore(1)
+	if err != nil {
+		return nil, err
+	}
+
+	tc := &ThreadContext{
+		posts:  c,
+		budget: budget,
+		limit:  limit,
+	}
+	if appviewURL != "" {
+		tc.client = &xrpc.Client{Host: appviewURL}
+	}
+	return tc, nil
+}
+
+// add caches a post seen in a repo event, for replies to it
+func (tc *ThreadContext) add(uri, cidStr string, fields map[string]any) {
+	tc.posts.Add(uri, &rules.Post{Uri: uri, Cid: cidStr, Record: fields})
+}
+
+// Post returns the post at uri from the cache, or from the appview. Posts
+// the appview doesn't have are cached too, so they aren't fetched again.
+func (tc *ThreadContext) Post(ctx context.Context, uri string) (*rules.Post, error) {
+	if v, ok := tc.posts.Get(uri); ok {
+		return v.(*rules.Post), nil
+	}
+	if tc.client == nil {
+		return nil, nil
+	}
+
+	res, err := tc.budget.Take(ctx, "fetch", tc.limit)
+	if err != nil {
+		return nil, err
+	}
+	if !res.Allowed {
+		log.Debugf("thread context fetch budget spent, not fetching uri=%s", uri)
+		return nil, nil
+	}
+
+	// an appview outage shouldn't hold up labeling, so failed fetches are
+	// only logged, and not cached
+	out, err := appbsky.FeedGetPosts(ctx, tc.client, []string{uri})
+	if err != nil {
+		log.Warnf("thread context failed to fetch post uri=%s err=%s", uri, err)
+		return nil, nil
+	}
+	var post *rules.Post
+	for _, pv := range out.Posts {
+		if pv.Uri != uri || pv.Record == nil {
+			continue
+		}
+		fields, err := rules.RecordFields(pv.Record)
+		if err != nil {
+			return nil, fmt.Errorf("reading fetched post: %w", err)
+		}
+		post = &rules.Post{Uri: uri, Cid: pv.Cid, Record: fields}
+	}
+	tc.posts.Add(uri, post)
+	return post, nil
+}
+
+// AddThreadContext has the parent and root conditions of rules look up posts
+// in tc, and the posts the labelmaker sees added to it. Must be called before
+// rules are added.
+func (s *Server) AddThreadContext(tc *ThreadContext) {
+	log.Infof("configuring thread context")
+	s.thread = tc
+}
@@ -0,0 +1,140 @@
+package labeler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/rules"
+	"github.com/bluesky-social/indigo/util/ratelimit"
+)
+
+func TestThreadContext(t *testing.T) {
+	ctx := context.Background()
+	known := "at://did:plc:target/app.bsky.feed.post/1"
+	fetches := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/xrpc/app.bsky.feed.getPosts" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		uri := r.URL.Query().Get("uris")
+		fetches[uri]++
+
+		out := appbsky.FeedGetPosts_Output{Posts: []*appbsky.FeedDefs_PostView{}}
+		if uri == known {
+			out.Posts = append(out.Posts, &appbsky.FeedDefs_PostView{
+				Uri:    known,
+				Cid:    "bafyreia",
+				Record: &lexutil.LexiconTypeDecoder{Val: &appbsky.FeedPost{Text: "an announcement"}},
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}))
+	defer srv.Close()
+
+	tc, err := NewThreadContext(srv.URL, 100, ratelimit.Limit{Count: 3, Period: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// posts are fetched once, whether or not the appview has them
+	for i := 0; i < 2; i++ {
+		post, err := tc.Post(ctx, known)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if post == nil || post.Cid != "bafyreia" || post.Record["text"] != "an announcement" {
+			t.Fatalf("unexpected post %+v", post)
+		}
+		post, err = tc.Post(ctx, "at://did:plc:gone/app.bsky.feed.post/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if post != nil {
+			t.Fatalf("expected no post, got %+v", post)
+		}
+	}
+	if fetches[known] != 1 || fetches["at://did:plc:gone/app.bsky.feed.post/1"] != 1 {
+		t.Fatalf("expected each post to be fetched once, got %v", fetches)
+	}
+
+	// posts seen locally are never fetched
+	local := "at://did:plc:local/app.bsky.feed.post/1"
+	tc.add(local, "bafyreib", map[string]any{"text": "local"})
+	if post, err := tc.Post(ctx, local); err != nil || post == nil || post.Cid != "bafyreib" {
+		t.Fatalf("expected the local post, got %+v (%v)", post, err)
+	}
+
+	// one fetch is left in the budget
+	for i, uri := range []string{"at://did:plc:a/app.bsky.feed.post/1", "at://did:plc:b/app.bsky.feed.post/1"} {
+		if _, err := tc.Post(ctx, uri); err != nil {
+			t.Fatal(err)
+		}
+		if want := 1 - i; fetches[uri] != want {
+			t.Fatalf("%s: expected %d fetches, got %d", uri, want, fetches[uri])
+		}
+	}
+}
+
+func TestThreadContextRule(t *testing.T) {
+	ctx := context.Background()
+	lm := testLabelMaker(t)
+	tc, err := NewThreadContext("", 100, DefaultThreadFetchBudget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lm.AddThreadContext(tc)
+
+	rs, err := rules.ParseRuleSet([]byte(`
+rules:
+  - name: reply-to-target
+    collections: [app.bsky.feed.post]
+    when:
+      all:
+        - field: text
+          contains: loser
+        - parent: {field: text, contains: announcement}
+    actions:
+      - label: harassment
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := rules.NewEngine(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lm.AddRules(e)
+
+	// the parent is seen by the labelmaker first, so it is in the cache
+	parentPath := "app.bsky.feed.post/3jzfcijpj2z2a"
+	parentUri := "at://did:plc:target/" + parentPath
+	if _, err := lm.applyRules(ctx, "did:plc:target", "create", parentPath, parentUri, "bafyreia", &appbsky.FeedPost{Text: "an announcement"}); err != nil {
+		t.Fatal(err)
+	}
+
+	replyPath := "app.bsky.feed.post/3jzfcijpj2z2b"
+	reply := &appbsky.FeedPost{
+		Text: "loser",
+		Reply: &appbsky.FeedPost_ReplyRef{
+			Parent: &comatproto.RepoStrongRef{Uri: parentUri, Cid: "bafyreia"},
+			Root:   &comatproto.RepoStrongRef{Uri: parentUri, Cid: "bafyreia"},
+		},
+	}
+	vals, err := lm.applyRules(ctx, "did:plc:troll", "create", replyPath, "at://did:plc:troll/"+replyPath, "bafyreib", reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vals, []string{"harassment"}) {
+		t.Fatalf("expected the reply to be labeled, got %v", vals)
+	}
+}
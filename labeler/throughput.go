@@ -0,0 +1,161 @@
+package labeler
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// The names labels are counted under in the dashboard's throughput, for the
+// labeler (or other source) which produced them
+const (
+	sourceKeyword         = "keyword"
+	sourceSQRL            = "sqrl"
+	sourceMicroNSFWImg    = "micro-nsfw-img"
+	sourceHiveAI          = "hiveai"
+	sourceImageHash       = "image-hash"
+	sourceRules           = "rules"
+	sourceReportThreshold = "report-threshold"
+	sourceModerator       = "moderator"
+)
+
+// throughputMinutes is how far back throughput is kept
+const throughputMinutes = 60
+
+// minuteCounts counts labels in a ring of one minute buckets
+type minuteCounts struct {
+	counts [throughputMinutes]int64
+	// last is the newest minute written to
+	last int64
+}
+
+func minuteOf(t time.Time) int64 {
+	return t.Unix() / 60
+}
+
+func (mc *minuteCounts) add(m, n int64) {
+	if m <= mc.last-throughputMinutes {
+		return
+	}
+	if m > mc.last {
+		// clear the minutes skipped over, which hold counts from an hour ago
+		from := mc.last + 1
+		if m-from >= throughputMinutes {
+			from = m - throughputMinutes + 1
+		}
+		for i := from; i <= m; i++ {
+			mc.counts[i%throughputMinutes] = 0
+		}
+		mc.last = m
+	}
+	mc.counts[m%throughputMinutes] += n
+}
+
+// series returns the counts of the hour ending at minute m, oldest first
+func (mc *minuteCounts) series(m int64) []int64 {
+	out := make([]int64, throughputMinutes)
+	for i := range out {
+		b := m - throughputMinutes + 1 + int64(i)
+		if b > mc.last || b <= mc.last-throughputMinutes {
+			continue
+		}
+		out[i] = mc.counts[b%throughputMinutes]
+	}
+	return out
+}
+
+// throughput counts the labels produced by each labeler over the last hour,
+// for the admin dashboard. It is safe for concurrent use.
+type throughput struct {
+	lk      sync.Mutex
+	sources map[string]*minuteCounts
+}
+
+func newThroughput() *throughput {
+	return &throughput{sources: make(map[string]*minuteCounts)}
+}
+
+// add counts n labels from source at t
+func (tp *throughput) add(source string, n int, t time.Time) {
+	if n == 0 {
+		return
+	}
+	m := minuteOf(t)
+
+	tp.lk.Lock()
+	defer tp.lk.Unlock()
+
+	mc, ok := tp.sources[source]
+	if !ok {
+		mc = &minuteCounts{last: m}
+		tp.sources[source] = mc
+	}
+	mc.add(m, int64(n))
+}
+
+// sourceThroughput is the labels a source produced in each minute of the
+// last hour, oldest first
+type sourceThroughput struct {
+	Source    string  `json:"source"`
+	PerMinute []int64 `json:"perMinute"`
+	LastHour  int64   `json:"lastHour"`
+}
+
+// snapshot returns the throughput of every source which produced labels,
+// and of the sources in always even if they produced none, by name
+func (tp *throughput) snapshot(now time.Time, always []string) []sourceThroughput {
+	m := minuteOf(now)
+
+	tp.lk.Lock()
+	defer tp.lk.Unlock()
+
+	names := make(map[string]bool)
+	for _, name := range always {
+		names[name] = true
+	}
+	for name := range tp.sources {
+		names[name] = true
+	}
+
+	out := make([]sourceThroughput, 0, len(names))
+	for name := range names {
+		st := sourceThroughput{Source: name, PerMinute: make([]int64, throughputMinutes)}
+		if mc, ok := tp.sources[name]; ok {
+			st.PerMinute = mc.series(m)
+		}
+		for _, n := range st.PerMinute {
+			st.LastHour += n
+		}
+		out = append(out, st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Source < out[j].Source })
+	return out
+}
+
+// configuredSources returns the labelers the server is running, which are
+// shown in the dashboard even before they produce labels
+func (s *Server) configuredSources() []string {
+	var out []string
+	if len(s.kwLabelers) > 0 {
+		out = append(out, sourceKeyword)
+	}
+	if s.sqrlLabeler != nil {
+		out = append(out, sourceSQRL)
+	}
+	if s.muNSFWImgLabeler != nil {
+		out = append(out, sourceMicroNSFWImg)
+	}
+	if s.hiveAILabeler != nil {
+		out = append(out, sourceHiveAI)
+	}
+	if s.imageHashLabeler != nil {
+		out = append(out, sourceImageHash)
+	}
+	if s.rules.Load() != nil {
+		out = append(out, sourceRules)
+	}
+	if len(s.reportThresholds) > 0 {
+		out = append(out, sourceReportThreshold)
+	}
+	return out
+}
@@ -1,17 +1,14 @@
 package labeler
 
 import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 
-	"github.com/lestrrat-go/jwx/v2/jwa"
-	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/bluesky-social/indigo/util/keyutil"
+
 	"github.com/whyrusleeping/go-did"
 )
 
@@ -34,25 +31,20 @@ func LoadOrCreateKeyFile(kfile, kid string) (*did.PrivKey, error) {
 	return ParseSecretKey(string(kb))
 }
 
+// CreateKeyFile writes a new P-256 private key to kfile, as a JWK
 func CreateKeyFile(kfile, kid string) error {
+	return CreateKeyFileWithType(kfile, kid, did.KeyTypeP256)
+}
 
-	raw, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil {
-		return fmt.Errorf("failed to generate new ECDSA private key: %s", err)
-	}
-
-	key, err := jwk.FromRaw(raw)
+// CreateKeyFileWithType writes a new private key of the given type (P-256
+// or secp256k1) to kfile, as a JWK
+func CreateKeyFileWithType(kfile, kid, keyType string) error {
+	key, err := did.GeneratePrivKey(rand.Reader, keyType)
 	if err != nil {
-		return fmt.Errorf("failed to create ECDSA key: %s", err)
+		return fmt.Errorf("failed to generate new private key: %w", err)
 	}
 
-	if _, ok := key.(jwk.ECDSAPrivateKey); !ok {
-		return fmt.Errorf("expected jwk.ECDSAPrivateKey, got %T", key)
-	}
-
-	key.Set(jwk.KeyIDKey, kid)
-
-	buf, err := json.MarshalIndent(key, "", "  ")
+	buf, err := keyutil.MarshalJWK(key, kid)
 	if err != nil {
 		return fmt.Errorf("failed to marshal key into JSON: %w", err)
 	}
@@ -63,35 +55,10 @@ func CreateKeyFile(kfile, kid string) error {
 	return os.WriteFile(kfile, buf, 0664)
 }
 
+// ParseSecretKey parses a P-256 or secp256k1 private key, as a JWK, PEM, or
+// multibase string
 func ParseSecretKey(val string) (*did.PrivKey, error) {
-
-	sk, err := jwk.ParseKey([]byte(val))
-	if err != nil {
-		return nil, err
-	}
-
-	var spk ecdsa.PrivateKey
-	if err := sk.Raw(&spk); err != nil {
-		return nil, err
-	}
-	curve, ok := sk.Get("crv")
-	if !ok {
-		return nil, fmt.Errorf("need a curve set")
-	}
-
-	var out string
-	kts := string(curve.(jwa.EllipticCurveAlgorithm))
-	switch kts {
-	case "P-256":
-		out = did.KeyTypeP256
-	default:
-		return nil, fmt.Errorf("unrecognized key type: %s", kts)
-	}
-
-	return &did.PrivKey{
-		Raw:  &spk,
-		Type: out,
-	}, nil
+	return keyutil.ParsePrivateKey([]byte(val))
 }
 
 func dedupeStrings(in []string) []string {
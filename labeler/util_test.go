@@ -2,8 +2,11 @@ package labeler
 
 import (
 	"fmt"
+	"path/filepath"
 	"reflect"
 	"testing"
+
+	"github.com/whyrusleeping/go-did"
 )
 
 func TestDedupeStrings(t *testing.T) {
@@ -25,3 +28,35 @@ func TestDedupeStrings(t *testing.T) {
 		}
 	}
 }
+
+func TestLoadOrCreateKeyFile(t *testing.T) {
+	kfile := filepath.Join(t.TempDir(), "keys", "labelmaker.key")
+
+	created, err := LoadOrCreateKeyFile(kfile, "auto-labelmaker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Type != did.KeyTypeP256 {
+		t.Fatalf("expected a new P-256 key, got %s", created.Type)
+	}
+
+	loaded, err := LoadOrCreateKeyFile(kfile, "auto-labelmaker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Public().Equal(created.Public()) {
+		t.Fatal("expected the existing key to be loaded")
+	}
+
+	k256file := filepath.Join(t.TempDir(), "k256.key")
+	if err := CreateKeyFileWithType(k256file, "auto-labelmaker", did.KeyTypeSecp256k1); err != nil {
+		t.Fatal(err)
+	}
+	k256, err := LoadOrCreateKeyFile(k256file, "auto-labelmaker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k256.Type != did.KeyTypeSecp256k1 {
+		t.Fatalf("expected a secp256k1 key, got %s", k256.Type)
+	}
+}
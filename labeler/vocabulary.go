@@ -0,0 +1,356 @@
+package labeler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	label "github.com/bluesky-social/indigo/api/label"
+	"github.com/bluesky-social/indigo/rules"
+	"github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/util/xrpcerr"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+)
+
+// labelerServiceCollection is the collection of the record declaring the
+// label values a labeler emits, which has the rkey "self"
+const labelerServiceCollection = "app.bsky.labeler.service"
+
+// GlobalLabelValues are the label values all clients understand, which a
+// labeler may emit without defining them
+var GlobalLabelValues = []string{"!hide", "!warn", "!no-unauthenticated", "porn", "sexual", "nudity", "graphic-media"}
+
+// ErrUndeclaredLabelValue is what configuring a labeler with a label value
+// which isn't in the label vocabulary fails with
+var ErrUndeclaredLabelValue = errors.New("undeclared label value")
+
+// custom label values are lowercase letters and hyphens, so that they can't
+// be mistaken for global ones
+var labelValueRegex = regexp.MustCompile(`^[a-z-]{1,100}$`)
+
+// LabelValueDefinition defines a custom label value, and how clients should
+// present what it is put on, as in app.bsky.labeler.defs#labelValueDefinition
+type LabelValueDefinition struct {
+	Identifier string `json:"identifier"`
+	// Severity is inform, alert or none
+	Severity string `json:"severity"`
+	// Blurs is content, media or none
+	Blurs string `json:"blurs"`
+	// DefaultSetting is ignore, warn or hide, warn if left out
+	DefaultSetting string `json:"defaultSetting,omitempty"`
+	// AdultOnly is whether only adult accounts may choose not to hide what
+	// the label is put on
+	AdultOnly bool               `json:"adultOnly,omitempty"`
+	Locales   []LabelValueLocale `json:"locales"`
+}
+
+// LabelValueLocale is the name and description of a label value in a
+// language, for clients to show their users
+type LabelValueLocale struct {
+	Lang        string `json:"lang"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// LabelerPolicies are the label values a labeler emits: LabelValues lists
+// all of them, and LabelValueDefinitions defines those which aren't global
+type LabelerPolicies struct {
+	LabelValues           []string               `json:"labelValues"`
+	LabelValueDefinitions []LabelValueDefinition `json:"labelValueDefinitions,omitempty"`
+}
+
+// LabelerService is the app.bsky.labeler.service record of a labeler
+type LabelerService struct {
+	LexiconTypeID string          `json:"$type"`
+	Policies      LabelerPolicies `json:"policies"`
+	CreatedAt     string          `json:"createdAt"`
+}
+
+// LabelVocabulary is the label values a labeler declares it emits. Clients
+// ignore labels with values a labeler hasn't declared.
+type LabelVocabulary struct {
+	policies LabelerPolicies
+	values   map[string]bool
+}
+
+// NewLabelVocabulary checks the policies of a labeler and returns its
+// vocabulary. Defined values which are left out of LabelValues are added to
+// it.
+func NewLabelVocabulary(p LabelerPolicies) (*LabelVocabulary, error) {
+	global := make(map[string]bool)
+	for _, v := range GlobalLabelValues {
+		global[v] = true
+	}
+
+	v := &LabelVocabulary{values: make(map[string]bool)}
+	defs := append([]LabelValueDefinition(nil), p.LabelValueDefinitions...)
+	for i := range defs {
+		def := &defs[i]
+		if err := def.check(); err != nil {
+			return nil, err
+		}
+		if global[def.Identifier] {
+			return nil, fmt.Errorf("label value %q is global, and can't be redefined", def.Identifier)
+		}
+		if v.values[def.Identifier] {
+			return nil, fmt.Errorf("label value %q is defined twice", def.Identifier)
+		}
+		v.values[def.Identifier] = true
+	}
+
+	v.policies.LabelValueDefinitions = defs
+	listed := make(map[string]bool)
+	for _, val := range p.LabelValues {
+		if !global[val] && !v.values[val] {
+			return nil, fmt.Errorf("label value %q is neither global nor defined", val)
+		}
+		if !listed[val] {
+			listed[val] = true
+			v.policies.LabelValues = append(v.policies.LabelValues, val)
+		}
+		v.values[val] = true
+	}
+	for _, def := range defs {
+		if !listed[def.Identifier] {
+			v.policies.LabelValues = append(v.policies.LabelValues, def.Identifier)
+		}
+	}
+	return v, nil
+}
+
+func (def *LabelValueDefinition) check() error {
+	if !labelValueRegex.MatchString(def.Identifier) {
+		return fmt.Errorf("invalid label value %q: custom values are up to 100 lowercase letters and hyphens", def.Identifier)
+	}
+	switch def.Severity {
+	case "inform", "alert", "none":
+	default:
+		return fmt.Errorf("label value %q: severity must be inform, alert or none", def.Identifier)
+	}
+	switch def.Blurs {
+	case "content", "media", "none":
+	default:
+		return fmt.Errorf("label value %q: blurs must be content, media or none", def.Identifier)
+	}
+	switch def.DefaultSetting {
+	case "":
+		def.DefaultSetting = "warn"
+	case "ignore", "warn", "hide":
+	default:
+		return fmt.Errorf("label value %q: defaultSetting must be ignore, warn or hide", def.Identifier)
+	}
+	if len(def.Locales) == 0 {
+		return fmt.Errorf("label value %q: needs a name and description in at least one language", def.Identifier)
+	}
+	for _, l := range def.Locales {
+		if l.Lang == "" || l.Name == "" {
+			return fmt.Errorf("label value %q: locales need a lang and a name", def.Identifier)
+		}
+	}
+	return nil
+}
+
+// LoadLabelVocabularyFile reads a labeler's policies from a JSON file, in the
+// form of the policies of its app.bsky.labeler.service record
+func LoadLabelVocabularyFile(path string) (*LabelVocabulary, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p LabelerPolicies
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("parsing label vocabulary %s: %w", path, err)
+	}
+	return NewLabelVocabulary(p)
+}
+
+// Declares reports whether val is a declared label value
+func (v *LabelVocabulary) Declares(val string) bool {
+	return v.values[val]
+}
+
+// Policies returns the policies the vocabulary was made from
+func (v *LabelVocabulary) Policies() LabelerPolicies {
+	return v.policies
+}
+
+// check fails if any of the values, which are label values with the places
+// they are configured in, aren't declared
+func (v *LabelVocabulary) check(values map[string][]string) error {
+	var undeclared []string
+	for val, sources := range values {
+		if !v.Declares(val) {
+			undeclared = append(undeclared, fmt.Sprintf("%q (%s)", val, strings.Join(sources, ", ")))
+		}
+	}
+	if len(undeclared) == 0 {
+		return nil
+	}
+	sort.Strings(undeclared)
+	return fmt.Errorf("%w: %s", ErrUndeclaredLabelValue, strings.Join(undeclared, "; "))
+}
+
+// emittedValues collects label values, and where they are configured.
+// Values with the "repo:" prefix are collected without it, as the prefix
+// only says what labels go on.
+type emittedValues map[string][]string
+
+func (ev emittedValues) add(val, source string) {
+	val = strings.TrimPrefix(val, "repo:")
+	ev[val] = append(ev[val], source)
+}
+
+// ruleLabelValues returns the values of the labels the rules of a rule set
+// put on
+func ruleLabelValues(rs *rules.RuleSet) emittedValues {
+	ev := make(emittedValues)
+	for _, r := range rs.Rules {
+		for _, a := range r.Actions {
+			if a.Label != "" {
+				ev.add(a.Label, "rule "+r.Name)
+			}
+		}
+	}
+	return ev
+}
+
+// configuredLabelValues returns the label values the server's labelers can
+// put on, as far as they are known up front. SQRL and remote hash lists can
+// return any values, and labels with undeclared values from them are
+// dropped as they are committed.
+func (s *Server) configuredLabelValues() emittedValues {
+	ev := make(emittedValues)
+	for _, kl := range s.kwLabelers {
+		ev.add(kl.Value, "keyword labeler")
+	}
+	if e := s.rules.Load(); e != nil {
+		for val, sources := range ruleLabelValues(e.RuleSet()) {
+			for _, src := range sources {
+				ev.add(val, src)
+			}
+		}
+	}
+	if s.lists != nil {
+		for uri, val := range s.lists.labels {
+			ev.add(val, "list "+uri)
+		}
+	}
+	for _, rt := range s.reportThresholds {
+		ev.add(rt.Label, "report threshold "+rt.ReasonType)
+	}
+	if s.imageHashLabeler != nil {
+		for _, hl := range s.imageHashLabeler.Lists {
+			if fhl, ok := hl.(*FileHashList); ok {
+				for _, e := range fhl.Entries {
+					ev.add(e.Label, "image hash list")
+				}
+			}
+		}
+	}
+	if s.hiveAILabeler != nil {
+		for _, val := range hiveAILabelValues {
+			ev.add(val, "thehive.ai")
+		}
+	}
+	if s.muNSFWImgLabeler != nil {
+		for _, val := range microNSFWImgLabelValues {
+			ev.add(val, "micro-nsfw-img")
+		}
+	}
+	return ev
+}
+
+// SetLabelVocabulary declares the label values the labelmaker emits, which
+// are served as its app.bsky.labeler.service record. It fails if any of the
+// labelers configured so far put on labels with other values; rules replaced
+// later are checked as well, and labels with undeclared values from
+// classifiers are dropped. Must be called after the labelers are configured,
+// and before SubscribeBGS.
+func (s *Server) SetLabelVocabulary(v *LabelVocabulary) error {
+	if err := v.check(s.configuredLabelValues()); err != nil {
+		return err
+	}
+	log.Infof("configuring label vocabulary values=%v", v.policies.LabelValues)
+	s.vocabulary = v
+	s.vocabularyCreatedAt = time.Now().UTC().Format(util.ISO8601)
+	return nil
+}
+
+// checkRuleLabels fails if the rules of a rule set put on labels with values
+// outside the label vocabulary, if there is one
+func (s *Server) checkRuleLabels(rs *rules.RuleSet) error {
+	if s.vocabulary == nil {
+		return nil
+	}
+	return s.vocabulary.check(ruleLabelValues(rs))
+}
+
+// checkLabelValues fails if any of vals, which moderators asked for, is
+// outside the label vocabulary, if there is one
+func (s *Server) checkLabelValues(vals []string) error {
+	if s.vocabulary == nil {
+		return nil
+	}
+	ev := make(emittedValues)
+	for _, val := range vals {
+		ev.add(val, "moderator")
+	}
+	return s.vocabulary.check(ev)
+}
+
+// declaredLabels returns the labels which have declared values, logging the
+// others, which clients would ignore
+func (s *Server) declaredLabels(labels []*label.Label) []*label.Label {
+	if s.vocabulary == nil {
+		return labels
+	}
+	out := labels[:0:0]
+	for _, l := range labels {
+		if !s.vocabulary.Declares(l.Val) {
+			log.Warnf("dropping label with undeclared value uri=%s val=%s", l.Uri, l.Val)
+			continue
+		}
+		out = append(out, l)
+	}
+	return out
+}
+
+type labelerServiceRecord struct {
+	Uri   string          `json:"uri"`
+	Value *LabelerService `json:"value"`
+}
+
+// HandleGetLabelerService serves the labelmaker's app.bsky.labeler.service
+// record, as com.atproto.repo.getRecord does. It is the only record the
+// labelmaker serves that way.
+func (s *Server) HandleGetLabelerService(c echo.Context) error {
+	_, span := otel.Tracer("server").Start(c.Request().Context(), "HandleGetLabelerService")
+	defer span.End()
+
+	repo := c.QueryParam("repo")
+	collection := c.QueryParam("collection")
+	rkey := c.QueryParam("rkey")
+	if repo == "" || collection == "" || rkey == "" {
+		return xrpcerr.InvalidRequest("repo, collection and rkey params are required")
+	}
+	if (repo != s.user.Did && repo != s.user.Handle) || collection != labelerServiceCollection || rkey != "self" || s.vocabulary == nil {
+		return xrpcerr.New(http.StatusBadRequest, "RecordNotFound", "record not found")
+	}
+
+	return c.JSON(200, labelerServiceRecord{
+		Uri: "at://" + s.user.Did + "/" + labelerServiceCollection + "/self",
+		Value: &LabelerService{
+			LexiconTypeID: labelerServiceCollection,
+			Policies:      s.vocabulary.Policies(),
+			CreatedAt:     s.vocabularyCreatedAt,
+		},
+	})
+}
@@ -0,0 +1,162 @@
+package labeler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+
+	label "github.com/bluesky-social/indigo/api/label"
+	"github.com/bluesky-social/indigo/rules"
+	"github.com/bluesky-social/indigo/util/xrpcerr"
+)
+
+var testSpamDefinition = LabelValueDefinition{
+	Identifier: "spam",
+	Severity:   "inform",
+	Blurs:      "none",
+	Locales:    []LabelValueLocale{{Lang: "en", Name: "Spam", Description: "Unwanted, repeated content"}},
+}
+
+func TestNewLabelVocabulary(t *testing.T) {
+	v, err := NewLabelVocabulary(LabelerPolicies{
+		LabelValues:           []string{"porn", "porn"},
+		LabelValueDefinitions: []LabelValueDefinition{testSpamDefinition},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := v.Policies()
+	if !reflect.DeepEqual(p.LabelValues, []string{"porn", "spam"}) {
+		t.Fatalf("unexpected label values %v", p.LabelValues)
+	}
+	if p.LabelValueDefinitions[0].DefaultSetting != "warn" {
+		t.Fatalf("expected default setting to default to warn, got %q", p.LabelValueDefinitions[0].DefaultSetting)
+	}
+	if !v.Declares("spam") || !v.Declares("porn") || v.Declares("nudity") {
+		t.Fatal("unexpected declared values")
+	}
+
+	bad := []LabelerPolicies{
+		{LabelValues: []string{"undefined"}},
+		{LabelValueDefinitions: []LabelValueDefinition{testSpamDefinition, testSpamDefinition}},
+		{LabelValueDefinitions: []LabelValueDefinition{{Identifier: "porn", Severity: "alert", Blurs: "media", Locales: testSpamDefinition.Locales}}},
+		{LabelValueDefinitions: []LabelValueDefinition{{Identifier: "Spam", Severity: "inform", Blurs: "none", Locales: testSpamDefinition.Locales}}},
+		{LabelValueDefinitions: []LabelValueDefinition{{Identifier: "spam", Severity: "loud", Blurs: "none", Locales: testSpamDefinition.Locales}}},
+		{LabelValueDefinitions: []LabelValueDefinition{{Identifier: "spam", Severity: "inform", Blurs: "none"}}},
+	}
+	for _, p := range bad {
+		if _, err := NewLabelVocabulary(p); err == nil {
+			t.Fatalf("expected policies %+v to be refused", p)
+		}
+	}
+}
+
+func TestLabelVocabularyRules(t *testing.T) {
+	lm := testLabelMaker(t)
+
+	rs, err := rules.ParseRuleSet([]byte(`
+rules:
+  - name: crypto
+    collections: [app.bsky.feed.post]
+    when: {field: text, contains: airdrop}
+    actions:
+      - label: spam
+      - label: "repo:scam"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := rules.NewEngine(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lm.AddRules(e)
+
+	v, err := NewLabelVocabulary(LabelerPolicies{LabelValueDefinitions: []LabelValueDefinition{testSpamDefinition}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lm.SetLabelVocabulary(v); !errors.Is(err, ErrUndeclaredLabelValue) {
+		t.Fatalf("expected undeclared label value error, got %v", err)
+	}
+
+	scam := testSpamDefinition
+	scam.Identifier = "scam"
+	v, err = NewLabelVocabulary(LabelerPolicies{LabelValueDefinitions: []LabelValueDefinition{testSpamDefinition, scam}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lm.SetLabelVocabulary(v); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := lm.ReplaceRules([]byte(`
+rules:
+  - name: crypto
+    collections: [app.bsky.feed.post]
+    when: {field: text, contains: airdrop}
+    actions:
+      - label: crypto
+`)); !errors.Is(err, ErrUndeclaredLabelValue) {
+		t.Fatalf("expected undeclared label value error, got %v", err)
+	}
+
+	labels := lm.declaredLabels([]*label.Label{
+		{Uri: "at://did:plc:abc", Val: "scam"},
+		{Uri: "at://did:plc:abc", Val: "crypto"},
+	})
+	if len(labels) != 1 || labels[0].Val != "scam" {
+		t.Fatalf("expected only the declared label, got %v", labels)
+	}
+}
+
+func TestHandleGetLabelerService(t *testing.T) {
+	lm := testLabelMaker(t)
+	e := echo.New()
+
+	get := func(query string) (*httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest(http.MethodGet, "/xrpc/com.atproto.repo.getRecord?"+query, nil)
+		recorder := httptest.NewRecorder()
+		return recorder, lm.HandleGetLabelerService(e.NewContext(req, recorder))
+	}
+
+	query := "repo=" + lm.user.Did + "&collection=app.bsky.labeler.service&rkey=self"
+	if _, err := get(query); xrpcerr.Status(err) != 400 {
+		t.Fatalf("expected no record without a vocabulary, got %v", err)
+	}
+
+	v, err := NewLabelVocabulary(LabelerPolicies{LabelValueDefinitions: []LabelValueDefinition{testSpamDefinition}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lm.SetLabelVocabulary(v); err != nil {
+		t.Fatal(err)
+	}
+
+	rec, err := get(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != 200 {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+	var out labelerServiceRecord
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Uri != "at://"+lm.user.Did+"/app.bsky.labeler.service/self" {
+		t.Fatalf("unexpected uri %s", out.Uri)
+	}
+	if out.Value.LexiconTypeID != "app.bsky.labeler.service" || !reflect.DeepEqual(out.Value.Policies.LabelValues, []string{"spam"}) {
+		t.Fatalf("unexpected record %+v", out.Value)
+	}
+
+	if _, err := get("repo=" + lm.user.Did + "&collection=app.bsky.feed.post&rkey=self"); xrpcerr.Status(err) != 400 {
+		t.Fatalf("expected other records not to be found, got %v", err)
+	}
+}
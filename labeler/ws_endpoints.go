@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"strconv"
 
+	label "github.com/bluesky-social/indigo/api/label"
 	"github.com/bluesky-social/indigo/events"
 	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/util/xrpcerr"
 
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
@@ -20,9 +22,24 @@ func (s *Server) EventsLabelsWebsocket(c echo.Context) error {
 		}
 		since = &sval
 	}
+	sample, err := events.ParseSample(c.QueryParam(events.SampleParam))
+	if err != nil {
+		return xrpcerr.InvalidRequest("%s", err)
+	}
 
 	ctx := c.Request().Context()
 
+	// subscribers which don't authenticate are accounted for by address
+	subscriber, policy, err := s.subscriberAuth.Authenticate(ctx, c.Request().Header.Get("Authorization"), "com.atproto.label.subscribeLabels")
+	if err != nil {
+		return err
+	}
+	if subscriber == "" {
+		subscriber = c.RealIP() + "-" + c.Request().UserAgent()
+	}
+
+	since, outdated := policy.Cursor(since, s.evtmgr.LastSeq())
+
 	conn, err := websocket.Upgrade(c.Response().Writer, c.Request(), c.Response().Header(), 1<<10, 1<<10)
 	if err != nil {
 		return fmt.Errorf("upgrading websocket: %w", err)
@@ -38,43 +55,81 @@ func (s *Server) EventsLabelsWebsocket(c echo.Context) error {
 	}
 	defer cancel()
 
+	var policyCap *int64
+	if policy != nil {
+		policyCap = policy.BandwidthCap
+	}
+	s.bandwidth.SetPolicyCap(subscriber, policyCap)
+	usage, disconnect := s.bandwidth.Connect(subscriber)
+	defer disconnect()
+
+	// subscribers whose cursor was moved forward are told so first
+	var next *events.XRPCStreamEvent
+	if outdated {
+		msg := fmt.Sprintf("cursor is further back than this subscriber may replay, sending from %d", *since)
+		next = &events.XRPCStreamEvent{LabelInfo: &label.SubscribeLabels_Info{
+			Name:    "OutdatedCursor",
+			Message: &msg,
+		}}
+	}
+
 	header := events.EventHeader{Op: events.EvtKindMessage}
 	for {
-		select {
-		case evt := <-evts:
-			wc, err := conn.NextWriter(websocket.BinaryMessage)
-			if err != nil {
-				return err
+		evt := next
+		next = nil
+		if evt == nil {
+			select {
+			case evt = <-evts:
+			case <-s.evtmgr.Closing():
+				if err := events.CloseWebsocket(conn, websocket.CloseGoingAway, "server shutting down"); err != nil {
+					log.Warnf("failed to close label subscriber connection: %s", err)
+				}
+				return nil
+			case <-ctx.Done():
+				return nil
 			}
+		}
 
-			var obj lexutil.CBOR
-
-			switch {
-			case evt.Error != nil:
-				header.Op = events.EvtKindErrorFrame
-				obj = evt.Error
-			case evt.LabelInfo != nil:
-				header.MsgType = "#info"
-				obj = evt.LabelInfo
-			case evt.LabelLabels != nil:
-				header.MsgType = "#labels"
-				obj = evt.LabelLabels
-			default:
-				return fmt.Errorf("unrecognized event kind")
-			}
+		if evt = sample.Filter(policy.Filter(evt)); evt == nil {
+			continue
+		}
 
-			if err := header.MarshalCBOR(wc); err != nil {
-				return fmt.Errorf("failed to write header: %w", err)
-			}
+		wc, err := conn.NextWriter(websocket.BinaryMessage)
+		if err != nil {
+			return err
+		}
 
-			if err := obj.MarshalCBOR(wc); err != nil {
-				return fmt.Errorf("failed to write event: %w", err)
-			}
+		var obj lexutil.CBOR
 
-			if err := wc.Close(); err != nil {
-				return fmt.Errorf("failed to flush-close our event write: %w", err)
-			}
-		case <-ctx.Done():
+		switch {
+		case evt.Error != nil:
+			header.Op = events.EvtKindErrorFrame
+			obj = evt.Error
+		case evt.LabelInfo != nil:
+			header.MsgType = "#info"
+			obj = evt.LabelInfo
+		case evt.LabelLabels != nil:
+			header.MsgType = "#labels"
+			obj = evt.LabelLabels
+		default:
+			return fmt.Errorf("unrecognized event kind")
+		}
+
+		cw := &events.CountingWriter{W: wc}
+		if err := header.MarshalCBOR(cw); err != nil {
+			return fmt.Errorf("failed to write header: %w", err)
+		}
+
+		if err := obj.MarshalCBOR(cw); err != nil {
+			return fmt.Errorf("failed to write event: %w", err)
+		}
+
+		if err := wc.Close(); err != nil {
+			return fmt.Errorf("failed to flush-close our event write: %w", err)
+		}
+
+		// holds subscribers over their cap back from the next event
+		if err := usage.Sent(ctx, cw.N); err != nil {
 			return nil
 		}
 	}
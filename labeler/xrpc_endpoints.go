@@ -25,7 +25,9 @@ func (s *Server) RegisterHandlersComAtproto(e *echo.Echo) error {
 	e.POST("/xrpc/com.atproto.admin.resolveModerationReports", s.HandleComAtprotoAdminResolveModerationReports)
 	e.POST("/xrpc/com.atproto.admin.reverseModerationAction", s.HandleComAtprotoAdminReverseModerationAction)
 	e.POST("/xrpc/com.atproto.admin.takeModerationAction", s.HandleComAtprotoAdminTakeModerationAction)
-	e.POST("/xrpc/com.atproto.report.create", s.HandleComAtprotoReportCreate)
+	for _, path := range reportPaths {
+		e.POST(path, s.HandleComAtprotoModerationCreateReport)
+	}
 
 	// label-specific
 	e.GET("/xrpc/com.atproto.label.queryLabels", s.HandleComAtprotoLabelQueryLabels)
@@ -244,8 +246,8 @@ func (s *Server) HandleComAtprotoAdminTakeModerationAction(c echo.Context) error
 	return c.JSON(200, out)
 }
 
-func (s *Server) HandleComAtprotoReportCreate(c echo.Context) error {
-	ctx, span := otel.Tracer("server").Start(c.Request().Context(), "HandleComAtprotoReportCreate")
+func (s *Server) HandleComAtprotoModerationCreateReport(c echo.Context) error {
+	ctx, span := otel.Tracer("server").Start(c.Request().Context(), "HandleComAtprotoModerationCreateReport")
 	defer span.End()
 
 	var body atproto.ModerationCreateReport_Input
@@ -254,8 +256,8 @@ func (s *Server) HandleComAtprotoReportCreate(c echo.Context) error {
 	}
 	var out *atproto.ModerationCreateReport_Output
 	var handleErr error
-	// func (s *Server) handleComAtprotoReportCreate(ctx context.Context,body *atproto.ModerationCreateReport_Input) (*atproto.ModerationCreateReport_Output, error)
-	out, handleErr = s.handleComAtprotoReportCreate(ctx, &body)
+	// func (s *Server) handleComAtprotoModerationCreateReport(ctx context.Context,body *atproto.ModerationCreateReport_Input) (*atproto.ModerationCreateReport_Output, error)
+	out, handleErr = s.handleComAtprotoModerationCreateReport(ctx, &body)
 	if handleErr != nil {
 		return handleErr
 	}
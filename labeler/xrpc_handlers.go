@@ -11,8 +11,10 @@ import (
 	label "github.com/bluesky-social/indigo/api/label"
 	"github.com/bluesky-social/indigo/models"
 	"github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/util/aturi"
+	"github.com/bluesky-social/indigo/util/serviceauth"
+	"github.com/bluesky-social/indigo/util/xrpcerr"
 
-	"github.com/labstack/echo/v4"
 	"gorm.io/gorm"
 )
 
@@ -91,7 +93,8 @@ func (s *Server) handleComAtprotoLabelQueryLabels(ctx context.Context, cursor st
 			Cid: row.Cid,
 			Val: row.Val,
 			Neg: neg,
-			Cts: row.CreatedAt.Format(util.ISO8601),
+			Cts: row.CreatedAt.UTC().Format(util.ISO8601),
+			Sig: row.Sig,
 		})
 	}
 	out := label.QueryLabels_Output{
@@ -132,13 +135,13 @@ func (s *Server) handleComAtprotoAdminGetModerationActions(ctx context.Context,
 	if cursor != "" {
 		cursorID, err := strconv.Atoi(cursor)
 		if err != nil {
-			return nil, echo.NewHTTPError(400, "invalid cursor param: %v", cursor)
+			return nil, xrpcerr.InvalidRequest("invalid cursor param: %v", cursor)
 		}
 		q = q.Where("id < ?", cursorID)
 	}
 
 	if subject != "" {
-		q = q.Where("subject = ?", subject)
+		q = whereSubject(q, subject)
 	}
 
 	var actionRows []models.ModerationAction
@@ -194,13 +197,13 @@ func (s *Server) handleComAtprotoAdminGetModerationReports(ctx context.Context,
 	if cursor != "" {
 		cursorID, err := strconv.Atoi(cursor)
 		if err != nil {
-			return nil, echo.NewHTTPError(400, "invalid cursor param: %v", cursor)
+			return nil, xrpcerr.InvalidRequest("invalid cursor param: %v", cursor)
 		}
 		q = q.Where("id < ?", cursorID)
 	}
 
 	if subject != "" {
-		q = q.Where("subject = ?", subject)
+		q = whereSubject(q, subject)
 	}
 
 	var reportRows []models.ModerationReport
@@ -246,10 +249,10 @@ func (s *Server) handleComAtprotoAdminGetModerationReports(ctx context.Context,
 func (s *Server) handleComAtprotoAdminResolveModerationReports(ctx context.Context, body *atproto.AdminResolveModerationReports_Input) (*atproto.AdminDefs_ActionView, error) {
 
 	if body.CreatedBy == "" {
-		return nil, echo.NewHTTPError(400, "createdBy param must be non-empty")
+		return nil, xrpcerr.InvalidRequest("createdBy param must be non-empty")
 	}
 	if len(body.ReportIds) == 0 {
-		return nil, echo.NewHTTPError(400, "at least one reportId required")
+		return nil, xrpcerr.InvalidRequest("at least one reportId required")
 	}
 
 	var rows []models.ModerationReportResolution
@@ -286,24 +289,24 @@ func (s *Server) fetchSingleModerationAction(ctx context.Context, actionId int64
 func (s *Server) handleComAtprotoAdminReverseModerationAction(ctx context.Context, body *atproto.AdminReverseModerationAction_Input) (*atproto.AdminDefs_ActionView, error) {
 
 	if body.CreatedBy == "" {
-		return nil, echo.NewHTTPError(400, "createBy param must be non-empty")
+		return nil, xrpcerr.InvalidRequest("createBy param must be non-empty")
 	}
 	if body.Reason == "" {
-		return nil, echo.NewHTTPError(400, "reason param was provided, but empty string")
+		return nil, xrpcerr.InvalidRequest("reason param was provided, but empty string")
 	}
 
 	row := models.ModerationAction{ID: uint64(body.Id)}
 	result := s.db.First(&row)
 	if result.Error != nil {
 		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			return nil, echo.NewHTTPError(404, "moderation action not found: %d", body.Id)
+			return nil, xrpcerr.NotFound("moderation action not found: %d", body.Id)
 		} else {
 			return nil, result.Error
 		}
 	}
 
 	if row.ReversedAt != nil {
-		return nil, echo.NewHTTPError(400, "action has already been reversed actionId=%d", body.Id)
+		return nil, xrpcerr.InvalidRequest("action has already been reversed actionId=%d", body.Id)
 	}
 
 	now := time.Now()
@@ -319,27 +322,35 @@ func (s *Server) handleComAtprotoAdminReverseModerationAction(ctx context.Contex
 	return s.fetchSingleModerationAction(ctx, body.Id)
 }
 
+// whereSubject filters moderation reports or actions by subject, which is a
+// DID for repos or an AT-URI for records
+func whereSubject(q *gorm.DB, subject string) *gorm.DB {
+	if strings.HasPrefix(subject, "at://") {
+		return q.Where("subject_uri = ?", subject)
+	}
+	return q.Where("subject_did = ? AND subject_type = ?", subject, "com.atproto.repo.repoRef")
+}
+
+// didFromURI returns the DID of the account an at:// URI is in, or "" if the
+// URI isn't valid or is by handle
 func didFromURI(uri string) string {
-	parts := strings.SplitN(uri, "/", 4)
-	if len(parts) < 3 {
+	u, err := aturi.Parse(uri)
+	if err != nil {
 		return ""
 	}
-	if strings.HasPrefix(parts[2], "did:") {
-		return parts[2]
-	}
-	return ""
+	return u.DID()
 }
 
 func (s *Server) handleComAtprotoAdminTakeModerationAction(ctx context.Context, body *atproto.AdminTakeModerationAction_Input) (*atproto.AdminDefs_ActionView, error) {
 
 	if body.Action == "" {
-		return nil, echo.NewHTTPError(400, "action param must be non-empty")
+		return nil, xrpcerr.InvalidRequest("action param must be non-empty")
 	}
 	if body.CreatedBy == "" {
-		return nil, echo.NewHTTPError(400, "createBy param must be non-empty")
+		return nil, xrpcerr.InvalidRequest("createBy param must be non-empty")
 	}
 	if body.Reason == "" {
-		return nil, echo.NewHTTPError(400, "reason param was provided, but empty string")
+		return nil, xrpcerr.InvalidRequest("reason param was provided, but empty string")
 	}
 
 	row := models.ModerationAction{
@@ -358,13 +369,13 @@ func (s *Server) handleComAtprotoAdminTakeModerationAction(ctx context.Context,
 		}
 	} else if body.Subject.RepoStrongRef != nil {
 		if body.Subject.RepoStrongRef.Cid == "" {
-			return nil, echo.NewHTTPError(400, "this implementation requires a strong record ref (aka, with CID) in reports")
+			return nil, xrpcerr.InvalidRequest("this implementation requires a strong record ref (aka, with CID) in reports")
 		}
 		row.SubjectType = "com.atproto.repo.recordRef"
 		row.SubjectUri = &body.Subject.RepoStrongRef.Uri
 		row.SubjectDid = didFromURI(body.Subject.RepoStrongRef.Uri)
 		if row.SubjectDid == "" {
-			return nil, echo.NewHTTPError(400, "expected URI with a DID: ", row.SubjectUri)
+			return nil, xrpcerr.InvalidRequest("expected URI with a DID: %s", *row.SubjectUri)
 		}
 		row.SubjectCid = &body.Subject.RepoStrongRef.Cid
 		outSubj.RepoStrongRef = &atproto.RepoStrongRef{
@@ -373,7 +384,7 @@ func (s *Server) handleComAtprotoAdminTakeModerationAction(ctx context.Context,
 			Cid:           *row.SubjectCid,
 		}
 	} else {
-		return nil, echo.NewHTTPError(400, "report subject must be a repoRef or a recordRef")
+		return nil, xrpcerr.InvalidRequest("report subject must be a repoRef or a recordRef")
 	}
 
 	result := s.db.Create(&row)
@@ -408,25 +419,30 @@ func (s *Server) handleComAtprotoAdminTakeModerationAction(ctx context.Context,
 	return &out, nil
 }
 
-func (s *Server) handleComAtprotoReportCreate(ctx context.Context, body *atproto.ModerationCreateReport_Input) (*atproto.ModerationCreateReport_Output, error) {
+func (s *Server) handleComAtprotoModerationCreateReport(ctx context.Context, body *atproto.ModerationCreateReport_Input) (*atproto.ModerationCreateReport_Output, error) {
 
 	if body.ReasonType == nil || *body.ReasonType == "" {
-		return nil, echo.NewHTTPError(400, "reasonType is required")
+		return nil, xrpcerr.InvalidRequest("reasonType is required")
 	}
 	if body.Subject == nil {
-		return nil, echo.NewHTTPError(400, "Subject is required")
+		return nil, xrpcerr.InvalidRequest("Subject is required")
+	}
+
+	// reports made with admin auth are from the labelmaker user
+	reportedBy := s.user.Did
+	if claims := serviceauth.FromContext(ctx); claims != nil {
+		reportedBy, _, _ = strings.Cut(claims.Iss, "#")
 	}
 
 	row := models.ModerationReport{
-		ReasonType: *body.ReasonType,
-		Reason:     body.Reason,
-		// TODO(bnewbold): temporarily, all reports from labelmaker user
-		ReportedByDid: s.user.Did,
+		ReasonType:    *body.ReasonType,
+		Reason:        body.Reason,
+		ReportedByDid: reportedBy,
 	}
 	var outSubj atproto.ModerationCreateReport_Output_Subject
 	if body.Subject.AdminDefs_RepoRef != nil {
 		if body.Subject.AdminDefs_RepoRef.Did == "" {
-			return nil, echo.NewHTTPError(400, "DID is required for repo reports")
+			return nil, xrpcerr.InvalidRequest("DID is required for repo reports")
 		}
 		row.SubjectType = "com.atproto.repo.repoRef"
 		row.SubjectDid = body.Subject.AdminDefs_RepoRef.Did
@@ -436,16 +452,16 @@ func (s *Server) handleComAtprotoReportCreate(ctx context.Context, body *atproto
 		}
 	} else if body.Subject.RepoStrongRef != nil {
 		if body.Subject.RepoStrongRef.Uri == "" {
-			return nil, echo.NewHTTPError(400, "URI required for record reports")
+			return nil, xrpcerr.InvalidRequest("URI required for record reports")
 		}
 		if body.Subject.RepoStrongRef.Cid == "" {
-			return nil, echo.NewHTTPError(400, "this implementation requires a strong record ref (aka, with CID) in reports")
+			return nil, xrpcerr.InvalidRequest("this implementation requires a strong record ref (aka, with CID) in reports")
 		}
 		row.SubjectType = "com.atproto.repo.recordRef"
 		row.SubjectUri = &body.Subject.RepoStrongRef.Uri
 		row.SubjectDid = didFromURI(body.Subject.RepoStrongRef.Uri)
 		if row.SubjectDid == "" {
-			return nil, echo.NewHTTPError(400, "expected URI with a DID: ", row.SubjectUri)
+			return nil, xrpcerr.InvalidRequest("expected URI with a DID: %s", *row.SubjectUri)
 		}
 		row.SubjectCid = &body.Subject.RepoStrongRef.Cid
 		outSubj.RepoStrongRef = &atproto.RepoStrongRef{
@@ -454,7 +470,7 @@ func (s *Server) handleComAtprotoReportCreate(ctx context.Context, body *atproto
 			Cid:           *row.SubjectCid,
 		}
 	} else {
-		return nil, echo.NewHTTPError(400, "report subject must be a repoRef or a recordRef")
+		return nil, xrpcerr.InvalidRequest("report subject must be a repoRef or a recordRef")
 	}
 
 	result := s.db.Create(&row)
@@ -462,6 +478,23 @@ func (s *Server) handleComAtprotoReportCreate(ctx context.Context, body *atproto
 		return nil, result.Error
 	}
 
+	// the report is already persisted, so these are only logged
+	if err := s.applyReportThresholds(ctx, &row); err != nil {
+		log.Errorf("failed to apply report thresholds report=%d: %v", row.ID, err)
+	}
+	if s.reportForwardClient != nil {
+		// a slow upstream shouldn't hold up the reporter
+		s.reportForwards.Add(1)
+		go func() {
+			defer s.reportForwards.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), reportForwardTimeout)
+			defer cancel()
+			if err := s.forwardReport(ctx, &row, body); err != nil {
+				log.Errorf("failed to forward report: %v", err)
+			}
+		}()
+	}
+
 	out := atproto.ModerationCreateReport_Output{
 		Id:         int64(row.ID),
 		CreatedAt:  row.CreatedAt.Format(time.RFC3339),
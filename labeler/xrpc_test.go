@@ -12,6 +12,8 @@ import (
 
 	comatproto "github.com/bluesky-social/indigo/api/atproto"
 	label "github.com/bluesky-social/indigo/api/label"
+	"github.com/bluesky-social/indigo/util/labelsig"
+	"github.com/bluesky-social/indigo/util/xrpcerr"
 
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
@@ -70,14 +72,13 @@ func TestLabelMakerXRPCReportRepoBad(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		req := httptest.NewRequest(http.MethodPost, "/xrpc/com.atproto.report.create", strings.NewReader(string(reportJSON)))
+		req := httptest.NewRequest(http.MethodPost, "/xrpc/com.atproto.moderation.createReport", strings.NewReader(string(reportJSON)))
 		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 		recorder := httptest.NewRecorder()
 		c := e.NewContext(req, recorder)
-		err = lm.HandleComAtprotoReportCreate(c)
+		err = lm.HandleComAtprotoModerationCreateReport(c)
 		if err != nil {
-			httpError, _ := err.(*echo.HTTPError)
-			assert.Equal(row.statusCode, httpError.Code)
+			assert.Equal(row.statusCode, xrpcerr.Status(err))
 		} else {
 			assert.Equal(row.statusCode, recorder.Code)
 		}
@@ -149,14 +150,13 @@ func TestLabelMakerXRPCReportRecordBad(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		req := httptest.NewRequest(http.MethodPost, "/xrpc/com.atproto.report.create", strings.NewReader(string(reportJSON)))
+		req := httptest.NewRequest(http.MethodPost, "/xrpc/com.atproto.moderation.createReport", strings.NewReader(string(reportJSON)))
 		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 		recorder := httptest.NewRecorder()
 		c := e.NewContext(req, recorder)
-		err = lm.HandleComAtprotoReportCreate(c)
+		err = lm.HandleComAtprotoModerationCreateReport(c)
 		if err != nil {
-			httpError, _ := err.(*echo.HTTPError)
-			assert.Equal(row.statusCode, httpError.Code)
+			assert.Equal(row.statusCode, xrpcerr.Status(err))
 		} else {
 			assert.Equal(row.statusCode, recorder.Code)
 		}
@@ -312,6 +312,10 @@ func TestLabelMakerXRPCLabelQuery(t *testing.T) {
 	assert.NoError(err)
 	assert.Equal(1, len(out3.Labels))
 	assert.Equal(&l3, out3.Labels[0])
+
+	// labels are signed with the repo key
+	assert.NotEmpty(out3.Labels[0].Sig)
+	assert.NoError(labelsig.VerifyWithKey(out3.Labels[0], lm.user.SigningKey.Public()))
 }
 
 func TestDidFromURI(t *testing.T) {
@@ -321,8 +325,9 @@ func TestDidFromURI(t *testing.T) {
 		expected string
 	}{
 		{input: "", expected: ""},
-		{input: "at://did:plc:fake/com.example/abc234", expected: "did:plc:fake"},
-		{input: "at://example.com/com.example/abc234", expected: ""},
+		{input: "at://did:plc:fake/com.example.record/abc234", expected: "did:plc:fake"},
+		{input: "at://example.com/com.example.record/abc234", expected: ""},
+		{input: "at://did:plc:fake/com.example/abc234", expected: ""},
 		{input: "at://did:plc:fake", expected: "did:plc:fake"},
 	}
 
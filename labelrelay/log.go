@@ -0,0 +1,195 @@
+package labelrelay
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	label "github.com/bluesky-social/indigo/api/label"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/models"
+
+	"gorm.io/gorm"
+)
+
+// Source is a labeler whose label stream the relay subscribes to
+type Source struct {
+	ID uint64 `gorm:"primaryKey"`
+
+	// Host is the base URL of the labeler's stream, such as
+	// wss://labeler.example.com
+	Host string `gorm:"uniqueIndex;not null"`
+
+	// Cursor is the sequence number of the last event relayed from the
+	// source, in the source's own sequence
+	Cursor int64
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// RelayedEvent is a labels event from a source, in the merged log. Seq is
+// the event's sequence number in the merged stream, and SourceSeq the one the
+// source gave it.
+type RelayedEvent struct {
+	Seq       int64  `gorm:"primaryKey;autoIncrement"`
+	SourceID  uint64 `gorm:"index:idx_relayed_source_seq"`
+	SourceSeq int64  `gorm:"index:idx_relayed_source_seq"`
+
+	// Labels is the CBOR encoding of the event's labels
+	Labels []byte
+
+	CreatedAt time.Time `gorm:"index"`
+}
+
+// Log is the merged log of the labels relayed from every source, which
+// re-sequences them in the order they are appended. It is the persister of
+// the relay's event manager, so only has labels events.
+type Log struct {
+	db *gorm.DB
+
+	// lk serializes appends, so that events are broadcast in the order of
+	// their sequence numbers
+	lk        sync.Mutex
+	lastSeq   int64
+	broadcast func(*events.XRPCStreamEvent)
+}
+
+// NewLog returns the log kept in db, which must have been migrated with the
+// Source and RelayedEvent tables
+func NewLog(db *gorm.DB) (*Log, error) {
+	var last RelayedEvent
+	if err := db.Order("seq desc").Limit(1).Find(&last).Error; err != nil {
+		return nil, err
+	}
+	return &Log{db: db, lastSeq: last.Seq}, nil
+}
+
+// Append adds an event from a source to the log, moving the source's cursor
+// to sourceSeq in the same transaction, and broadcasts it with its new
+// sequence number. Events from the source's cursor or before are dropped.
+// Events not from a source have a nil src.
+func (l *Log) Append(ctx context.Context, src *Source, sourceSeq int64, labels []*label.Label) error {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	var srcID uint64
+	if src != nil {
+		if sourceSeq <= src.Cursor {
+			return nil
+		}
+		srcID = src.ID
+	}
+
+	buf := new(bytes.Buffer)
+	if err := (&label.SubscribeLabels_Labels{Labels: labels}).MarshalCBOR(buf); err != nil {
+		return fmt.Errorf("encoding labels: %w", err)
+	}
+
+	re := RelayedEvent{
+		SourceID:  srcID,
+		SourceSeq: sourceSeq,
+		Labels:    buf.Bytes(),
+	}
+	if err := l.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&re).Error; err != nil {
+			return err
+		}
+		if src == nil {
+			return nil
+		}
+		return tx.Model(&Source{}).Where("id = ?", src.ID).UpdateColumn("cursor", sourceSeq).Error
+	}); err != nil {
+		return err
+	}
+
+	if src != nil {
+		src.Cursor = sourceSeq
+	}
+	l.lastSeq = re.Seq
+	if l.broadcast != nil {
+		l.broadcast(&events.XRPCStreamEvent{LabelLabels: &label.SubscribeLabels_Labels{Seq: re.Seq, Labels: labels}})
+	}
+	return nil
+}
+
+// SourceCursor returns src's cursor, which Append moves under the log's lock
+func (l *Log) SourceCursor(src *Source) int64 {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	return src.Cursor
+}
+
+// LastSeq returns the sequence number of the last event in the log
+func (l *Log) LastSeq() int64 {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	return l.lastSeq
+}
+
+// Persist appends labels events which don't come from a source, such as
+// those the relay's operator adds itself
+func (l *Log) Persist(ctx context.Context, e *events.XRPCStreamEvent) error {
+	if e.LabelLabels == nil {
+		return fmt.Errorf("label relay log only has labels events")
+	}
+	return l.Append(ctx, nil, 0, e.LabelLabels.Labels)
+}
+
+// playbackBatchSize is how many events Playback reads from the database at a
+// time
+const playbackBatchSize = 1000
+
+func (l *Log) Playback(ctx context.Context, since int64, cb func(*events.XRPCStreamEvent) error) error {
+	for {
+		var batch []RelayedEvent
+		if err := l.db.WithContext(ctx).Where("seq > ?", since).Order("seq asc").Limit(playbackBatchSize).Find(&batch).Error; err != nil {
+			return err
+		}
+
+		for _, re := range batch {
+			var evt label.SubscribeLabels_Labels
+			if err := evt.UnmarshalCBOR(bytes.NewReader(re.Labels)); err != nil {
+				return fmt.Errorf("decoding relayed event %d: %w", re.Seq, err)
+			}
+			evt.Seq = re.Seq
+			if err := cb(&events.XRPCStreamEvent{LabelLabels: &evt}); err != nil {
+				return err
+			}
+			since = re.Seq
+		}
+
+		if len(batch) < playbackBatchSize {
+			return nil
+		}
+	}
+}
+
+// Prune deletes the events appended before a time. Subscribers with cursors
+// before the oldest event left are sent from there.
+func (l *Log) Prune(ctx context.Context, before time.Time) (int64, error) {
+	res := l.db.WithContext(ctx).Where("created_at < ?", before).Delete(&RelayedEvent{})
+	return res.RowsAffected, res.Error
+}
+
+func (l *Log) TakeDownRepo(ctx context.Context, usr models.Uid) error {
+	return fmt.Errorf("repo takedowns are not supported by the label relay log")
+}
+
+func (l *Log) RebaseRepoEvents(ctx context.Context, usr models.Uid) error {
+	return fmt.Errorf("repo rebases are not supported by the label relay log")
+}
+
+func (l *Log) Flush(ctx context.Context) error {
+	return nil
+}
+
+func (l *Log) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func (l *Log) SetEventBroadcaster(brc func(*events.XRPCStreamEvent)) {
+	l.broadcast = brc
+}
@@ -0,0 +1,21 @@
+package labelrelay
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var eventsRelayed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "labelrelay_events_relayed_total",
+	Help: "Total number of labels events appended to the merged log, by source",
+}, []string{"source"})
+
+var labelsRelayed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "labelrelay_labels_relayed_total",
+	Help: "Total number of labels appended to the merged log, by source",
+}, []string{"source"})
+
+var labelsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "labelrelay_labels_rejected_total",
+	Help: "Total number of labels dropped for failing signature checks, by source",
+}, []string{"source"})
@@ -0,0 +1,418 @@
+// Package labelrelay aggregates the label streams of many labelers into one.
+// A Relay subscribes to the subscribeLabels stream of each of its sources,
+// appends their events to a merged log with sequence numbers of its own, and
+// serves the merged log as a subscribeLabels stream, so that consumers of
+// many labelers can follow them all with a single connection and cursor.
+package labelrelay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	label "github.com/bluesky-social/indigo/api/label"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/util/labelsig"
+
+	logging "github.com/ipfs/go-log"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+var log = logging.Logger("labelrelay")
+
+// sourceLivenessTimeout is how long a source subscription waits for an event
+// before redialing. Labelers can be quiet for a while, so this is generous.
+const sourceLivenessTimeout = 30 * time.Minute
+
+// ErrUnknownSource is returned for sources the relay doesn't subscribe to
+var ErrUnknownSource = errors.New("unknown label source")
+
+// ErrInvalidSource is returned for label source hosts which can't be
+// subscribed to
+var ErrInvalidSource = errors.New("invalid label source")
+
+// Relay subscribes to the label streams of its sources, and re-serves them
+// merged into one
+type Relay struct {
+	db     *gorm.DB
+	log    *Log
+	events *events.EventManager
+
+	verifier *labelsig.Verifier
+
+	// retention is how long relayed events are kept, or forever if zero
+	retention time.Duration
+
+	// ctx is that of Start, which source subscriptions are run under
+	ctx  context.Context
+	subs map[string]*sourceSub
+	lk   sync.Mutex
+	wg   sync.WaitGroup
+
+	stopBackground chan struct{}
+
+	echo *echo.Echo
+}
+
+type sourceSub struct {
+	src    *Source
+	sub    *events.Subscription
+	state  events.SubscriptionState
+	cancel context.CancelFunc
+}
+
+// SourceStatus is the state of a source, as listed by Sources
+type SourceStatus struct {
+	Host string `json:"host"`
+
+	// Cursor is the last event relayed from the source, in its sequence
+	Cursor int64 `json:"cursor"`
+
+	// LastSeq is the sequence number, in the merged stream, of the last
+	// event relayed from the source, or zero if none are left in the log
+	LastSeq int64 `json:"lastSeq"`
+
+	State string `json:"state"`
+}
+
+// Migrate creates or updates the tables the relay keeps in its database, as
+// NewRelay does itself
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(&Source{}, &RelayedEvent{})
+}
+
+// NewRelay returns a relay keeping its sources and merged log in db. Sources
+// aren't subscribed to until Start is called.
+func NewRelay(db *gorm.DB) (*Relay, error) {
+	if err := Migrate(db); err != nil {
+		return nil, err
+	}
+
+	l, err := NewLog(db)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Relay{
+		db:             db,
+		log:            l,
+		events:         events.NewEventManager(l),
+		subs:           make(map[string]*sourceSub),
+		stopBackground: make(chan struct{}),
+	}, nil
+}
+
+// SetVerifier has the signatures of relayed labels checked, dropping those
+// which fail. Must be called before Start.
+func (r *Relay) SetVerifier(v *labelsig.Verifier) {
+	r.verifier = v
+}
+
+// SetRetention sets how long relayed events are kept for, or forever if d is
+// zero. Must be called before Start.
+func (r *Relay) SetRetention(d time.Duration) {
+	r.retention = d
+}
+
+// NormalizeHost returns the stream base URL for a labeler host, which is
+// wss:// unless the host has a scheme of its own
+func NormalizeHost(host string) (string, error) {
+	host = strings.TrimSuffix(strings.TrimSpace(host), "/")
+	if host == "" {
+		return "", fmt.Errorf("%w: empty host", ErrInvalidSource)
+	}
+	if !strings.Contains(host, "://") {
+		return "wss://" + host, nil
+	}
+	if !strings.HasPrefix(host, "wss://") && !strings.HasPrefix(host, "ws://") {
+		return "", fmt.Errorf("%w: %q must be a ws:// or wss:// URL", ErrInvalidSource, host)
+	}
+	return host, nil
+}
+
+// AddSource adds a labeler to subscribe to, starting straight away if the
+// relay has been started. Sources stay added across restarts. Adding a source
+// which is already added does nothing.
+func (r *Relay) AddSource(ctx context.Context, host string) error {
+	host, err := NormalizeHost(host)
+	if err != nil {
+		return err
+	}
+
+	src := Source{Host: host}
+	if err := r.db.WithContext(ctx).Where(Source{Host: host}).FirstOrCreate(&src).Error; err != nil {
+		return err
+	}
+
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	if r.ctx != nil {
+		return r.startSourceLocked(&src)
+	}
+	return nil
+}
+
+// RemoveSource stops subscribing to a labeler. The events already relayed
+// from it stay in the log.
+func (r *Relay) RemoveSource(ctx context.Context, host string) error {
+	host, err := NormalizeHost(host)
+	if err != nil {
+		return err
+	}
+
+	res := r.db.WithContext(ctx).Where("host = ?", host).Delete(&Source{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrUnknownSource
+	}
+
+	r.lk.Lock()
+	ss, ok := r.subs[host]
+	delete(r.subs, host)
+	r.lk.Unlock()
+
+	if ok {
+		ss.cancel()
+	}
+	return nil
+}
+
+// Start subscribes to every source, until ctx is done or Shutdown is called
+func (r *Relay) Start(ctx context.Context) error {
+	var srcs []Source
+	if err := r.db.WithContext(ctx).Find(&srcs).Error; err != nil {
+		return err
+	}
+
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	if r.ctx != nil {
+		return fmt.Errorf("label relay already started")
+	}
+	r.ctx = ctx
+
+	for i := range srcs {
+		if err := r.startSourceLocked(&srcs[i]); err != nil {
+			return err
+		}
+	}
+
+	if r.retention > 0 {
+		go r.runPruner()
+	}
+	return nil
+}
+
+// startSourceLocked subscribes to a source, must be called with r.lk held
+func (r *Relay) startSourceLocked(src *Source) error {
+	if _, ok := r.subs[src.Host]; ok {
+		return nil
+	}
+
+	ss := &sourceSub{src: src}
+	sub, err := events.NewSubscription(events.SubscriptionConfig{
+		URL: src.Host + "/xrpc/com.atproto.label.subscribeLabels",
+		Handler: func(ctx context.Context, xev *events.XRPCStreamEvent) error {
+			return r.handleSourceEvent(ctx, src, xev)
+		},
+		LoadCursor: func(ctx context.Context) (int64, error) {
+			return r.log.SourceCursor(src), nil
+		},
+		// new sources are relayed from the start of their streams
+		FromStart:       true,
+		LivenessTimeout: sourceLivenessTimeout,
+		OnStateChange: func(state events.SubscriptionState, err error) {
+			r.lk.Lock()
+			ss.state = state
+			r.lk.Unlock()
+			log.Infow("label source subscription state change", "host", src.Host, "state", state, "err", err)
+		},
+	})
+	if err != nil {
+		return err
+	}
+	ss.sub = sub
+
+	ctx, cancel := context.WithCancel(r.ctx)
+	ss.cancel = cancel
+	r.subs[src.Host] = ss
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		if err := sub.Run(ctx); err != nil {
+			log.Errorw("label source subscription failed", "host", src.Host, "err", err)
+		}
+	}()
+	return nil
+}
+
+func (r *Relay) handleSourceEvent(ctx context.Context, src *Source, xev *events.XRPCStreamEvent) error {
+	switch {
+	case xev.LabelLabels != nil:
+		evt := xev.LabelLabels
+		labels := evt.Labels
+		if r.verifier != nil {
+			labels = r.verifier.Filter(ctx, labels)
+			labelsRejected.WithLabelValues(src.Host).Add(float64(len(evt.Labels) - len(labels)))
+		}
+
+		// events whose labels were all dropped still move the cursor
+		if err := r.log.Append(ctx, src, evt.Seq, labels); err != nil {
+			return fmt.Errorf("appending event %d from %s: %w", evt.Seq, src.Host, err)
+		}
+		eventsRelayed.WithLabelValues(src.Host).Inc()
+		labelsRelayed.WithLabelValues(src.Host).Add(float64(len(labels)))
+	case xev.LabelInfo != nil:
+		log.Infow("label source info", "host", src.Host, "name", xev.LabelInfo.Name, "message", xev.LabelInfo.Message)
+	case xev.Error != nil:
+		log.Warnw("label source sent an error", "host", src.Host, "error", xev.Error.Error, "message", xev.Error.Message)
+	}
+	return nil
+}
+
+// AddLabels appends labels which don't come from any source to the merged
+// stream
+func (r *Relay) AddLabels(ctx context.Context, labels []*label.Label) error {
+	return r.events.AddEvent(ctx, &events.XRPCStreamEvent{LabelLabels: &label.SubscribeLabels_Labels{Labels: labels}})
+}
+
+// Sources returns the state of every source
+func (r *Relay) Sources(ctx context.Context) ([]SourceStatus, error) {
+	var srcs []Source
+	if err := r.db.WithContext(ctx).Order("host asc").Find(&srcs).Error; err != nil {
+		return nil, err
+	}
+
+	out := make([]SourceStatus, 0, len(srcs))
+	for _, src := range srcs {
+		st := SourceStatus{Host: src.Host, Cursor: src.Cursor, State: "stopped"}
+
+		r.lk.Lock()
+		ss, ok := r.subs[src.Host]
+		if ok {
+			st.State = ss.state.String()
+		}
+		r.lk.Unlock()
+		if ok {
+			st.Cursor = r.log.SourceCursor(ss.src)
+		}
+
+		var last RelayedEvent
+		if err := r.db.WithContext(ctx).Where("source_id = ?", src.ID).Order("seq desc").Limit(1).Find(&last).Error; err != nil {
+			return nil, err
+		}
+		st.LastSeq = last.Seq
+
+		out = append(out, st)
+	}
+	return out, nil
+}
+
+// MergedCursor returns the cursor in the merged stream to resume from for a
+// consumer which has followed each source directly, up to the given cursors
+// in their own sequences: the last one before any event from a source which
+// the consumer doesn't have yet. Events it already has from other sources may
+// be sent again after it. Sources missing from cursors are taken to have been
+// followed up to nothing.
+func (r *Relay) MergedCursor(ctx context.Context, cursors map[string]int64) (int64, error) {
+	var srcs []Source
+	if err := r.db.WithContext(ctx).Find(&srcs).Error; err != nil {
+		return 0, err
+	}
+
+	known := make(map[string]bool, len(srcs))
+	merged := r.log.LastSeq()
+	for _, src := range srcs {
+		known[src.Host] = true
+
+		// the first event from this source which the consumer doesn't have
+		var next RelayedEvent
+		if err := r.db.WithContext(ctx).Where("source_id = ? AND source_seq > ?", src.ID, cursors[src.Host]).Order("seq asc").Limit(1).Find(&next).Error; err != nil {
+			return 0, err
+		}
+		if next.Seq != 0 && next.Seq-1 < merged {
+			merged = next.Seq - 1
+		}
+	}
+
+	for host := range cursors {
+		if !known[host] {
+			return 0, fmt.Errorf("%w: %s", ErrUnknownSource, host)
+		}
+	}
+	return merged, nil
+}
+
+// pruneInterval is how often events past the retention period are deleted
+const pruneInterval = time.Hour
+
+func (r *Relay) runPruner() {
+	t := time.NewTicker(pruneInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.stopBackground:
+			return
+		case <-t.C:
+		}
+
+		n, err := r.log.Prune(context.Background(), time.Now().Add(-r.retention))
+		if err != nil {
+			log.Errorf("failed to prune relayed events: %s", err)
+			continue
+		}
+		if n > 0 {
+			log.Infow("pruned relayed events", "count", n)
+		}
+	}
+}
+
+// Shutdown stops the HTTP server and the source subscriptions, and closes the
+// connections of subscribers
+func (r *Relay) Shutdown(ctx context.Context) error {
+	var errs []error
+	if r.echo != nil {
+		if err := r.echo.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("stopping http server: %w", err))
+		}
+	}
+
+	r.lk.Lock()
+	for _, ss := range r.subs {
+		ss.cancel()
+	}
+	r.lk.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("waiting for source subscriptions to stop: %w", ctx.Err()))
+	}
+
+	select {
+	case <-r.stopBackground:
+	default:
+		close(r.stopBackground)
+	}
+
+	if err := r.events.CloseSubscribers(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := r.events.Shutdown(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,185 @@
+package labelrelay_test
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	label "github.com/bluesky-social/indigo/api/label"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/events/schedulers/sequential"
+	"github.com/bluesky-social/indigo/labelrelay"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func testDB(t *testing.T, name string) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), name+".sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// testRelay starts serving a relay on a random port, returning its stream base
+// URL
+func testRelay(t *testing.T, db *gorm.DB) (*labelrelay.Relay, string) {
+	r, err := labelrelay.NewRelay(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.RunAPIWithListener(li, "")
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		r.Shutdown(ctx)
+	})
+	return r, "ws://" + li.Addr().String()
+}
+
+func addLabel(t *testing.T, r *labelrelay.Relay, src, val string) {
+	l := &label.Label{Src: src, Uri: "did:plc:alice", Val: val, Cts: "2023-01-01T00:00:00Z"}
+	if err := r.AddLabels(context.Background(), []*label.Label{l}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForCursors waits for the relay to have relayed each source up to the
+// given cursor
+func waitForCursors(t *testing.T, r *labelrelay.Relay, want map[string]int64) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		srcs, err := r.Sources(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]int64)
+		for _, s := range srcs {
+			got[s.Host] = s.Cursor
+		}
+		if assert.ObjectsAreEqual(want, got) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("sources never caught up: want %v, got %v", want, got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// readMerged reads n events from a relay's stream, from a cursor
+func readMerged(t *testing.T, host string, cursor string, n int) []*label.SubscribeLabels_Labels {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	con, _, err := websocket.DefaultDialer.DialContext(ctx, host+"/xrpc/com.atproto.label.subscribeLabels?cursor="+cursor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out []*label.SubscribeLabels_Labels
+	rsc := &events.RepoStreamCallbacks{
+		LabelLabels: func(evt *label.SubscribeLabels_Labels) error {
+			out = append(out, evt)
+			if len(out) == n {
+				cancel()
+				con.Close()
+			}
+			return nil
+		},
+	}
+	events.HandleRepoStream(ctx, con, sequential.NewScheduler("test", rsc.EventHandler))
+	if len(out) != n {
+		t.Fatalf("expected %d events, got %d", n, len(out))
+	}
+	return out
+}
+
+func TestRelay(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	src1, host1 := testRelay(t, testDB(t, "src1"))
+	src2, host2 := testRelay(t, testDB(t, "src2"))
+	addLabel(t, src1, "did:plc:one", "a")
+	addLabel(t, src2, "did:plc:two", "b")
+	addLabel(t, src1, "did:plc:one", "c")
+
+	aggdb := testDB(t, "agg")
+	agg, err := labelrelay.NewRelay(aggdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(agg.AddSource(ctx, host1))
+	assert.NoError(agg.AddSource(ctx, host2))
+	assert.ErrorIs(agg.AddSource(ctx, "https://labeler.test"), labelrelay.ErrInvalidSource)
+
+	aggCtx, aggCancel := context.WithCancel(ctx)
+	if err := agg.Start(aggCtx); err != nil {
+		t.Fatal(err)
+	}
+	waitForCursors(t, agg, map[string]int64{host1: 2, host2: 1})
+
+	// events tell which labeler they are from by their labels' src, and are
+	// re-sequenced in the order they were relayed
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go agg.RunAPIWithListener(li, "")
+	merged := readMerged(t, "ws://"+li.Addr().String(), "0", 3)
+	vals := make(map[string]string)
+	for i, evt := range merged {
+		assert.Equal(int64(i+1), evt.Seq)
+		vals[evt.Labels[0].Val] = evt.Labels[0].Src
+	}
+	assert.Equal(map[string]string{"a": "did:plc:one", "b": "did:plc:two", "c": "did:plc:one"}, vals)
+
+	// consumers of the sources' own streams can carry on from the merged one
+	c, err := agg.MergedCursor(ctx, map[string]int64{host1: 2, host2: 1})
+	assert.NoError(err)
+	assert.Equal(int64(3), c)
+	c, err = agg.MergedCursor(ctx, map[string]int64{host1: 2})
+	assert.NoError(err)
+	assert.Less(c, int64(3), "a source with no cursor is sent from the start")
+	assert.Equal("b", merged[c].Labels[0].Val)
+	_, err = agg.MergedCursor(ctx, map[string]int64{"wss://other.test": 1})
+	assert.ErrorIs(err, labelrelay.ErrUnknownSource)
+
+	sctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	assert.NoError(agg.Shutdown(sctx))
+	aggCancel()
+
+	// a restarted relay resumes each source from its cursor, without relaying
+	// any event twice
+	addLabel(t, src2, "did:plc:two", "d")
+	agg, host := testRelay(t, aggdb)
+	if err := agg.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitForCursors(t, agg, map[string]int64{host1: 2, host2: 2})
+
+	merged = readMerged(t, host, "3", 1)
+	assert.Equal(int64(4), merged[0].Seq)
+	assert.Equal("d", merged[0].Labels[0].Val)
+
+	assert.NoError(agg.RemoveSource(ctx, host1))
+	assert.ErrorIs(agg.RemoveSource(ctx, host1), labelrelay.ErrUnknownSource)
+	srcs, err := agg.Sources(ctx)
+	assert.NoError(err)
+	if assert.Len(srcs, 1) {
+		assert.Equal(host2, srcs[0].Host)
+		assert.Equal(int64(4), srcs[0].LastSeq)
+	}
+}
@@ -0,0 +1,225 @@
+package labelrelay
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/util/logutil"
+	"github.com/bluesky-social/indigo/util/version"
+	"github.com/bluesky-social/indigo/util/xrpcerr"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// logger is for structured logs carrying the fields of the request being
+// handled
+var logger = logutil.Logger("labelrelay")
+
+// RunAPI serves the merged label stream, and the status of the relay's
+// sources, on listen. Sources can only be added and removed over HTTP if an
+// admin password is given.
+func (r *Relay) RunAPI(listen, adminPassword string) error {
+	li, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	return r.RunAPIWithListener(li, adminPassword)
+}
+
+// RunAPIWithListener is like RunAPI, on a listener the caller already has
+// open, such as one on a random port in tests
+func (r *Relay) RunAPIWithListener(li net.Listener, adminPassword string) error {
+	e := echo.New()
+	r.echo = e
+	e.HideBanner = true
+	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
+		Format: "method=${method} uri=${uri} status=${status} latency=${latency_human}\n",
+	}))
+	e.Use(echo.WrapMiddleware(logutil.Middleware))
+	e.HTTPErrorHandler = xrpcerr.ErrorHandler(logger)
+
+	e.GET("/xrpc/_health", r.HandleHealthCheck)
+	e.GET("/xrpc/com.atproto.label.subscribeLabels", r.EventsLabelsWebsocket)
+	e.GET("/sources", r.HandleListSources)
+	e.POST("/sources/cursor", r.HandleMergedCursor)
+
+	if adminPassword != "" {
+		admin := e.Group("/admin", middleware.BasicAuthWithConfig(middleware.BasicAuthConfig{
+			Validator: func(username, password string, c echo.Context) (bool, error) {
+				if subtle.ConstantTimeCompare([]byte(username), []byte("admin")) == 1 &&
+					subtle.ConstantTimeCompare([]byte(password), []byte(adminPassword)) == 1 {
+					return true, nil
+				}
+				log.Warnw("auth failed", "username", username)
+				return false, nil
+			},
+			Realm: "LabelRelay",
+		}))
+		admin.POST("/sources/add", r.HandleAddSource)
+		admin.POST("/sources/remove", r.HandleRemoveSource)
+	}
+
+	log.Infof("starting label relay XRPC and WebSocket daemon at: %s", li.Addr())
+	e.Listener = li
+	return e.StartServer(e.Server)
+}
+
+type HealthStatus struct {
+	Status  string `json:"status"`
+	Version string `json:"version"`
+	Message string `json:"msg,omitempty"`
+}
+
+func (r *Relay) HandleHealthCheck(c echo.Context) error {
+	if err := r.db.Exec("SELECT 1").Error; err != nil {
+		log.Errorf("healthcheck can't connect to database: %v", err)
+		return c.JSON(500, HealthStatus{Status: "error", Version: version.Version, Message: "can't connect to database"})
+	}
+	return c.JSON(200, HealthStatus{Status: "ok", Version: version.Version})
+}
+
+func (r *Relay) HandleListSources(c echo.Context) error {
+	srcs, err := r.Sources(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	return c.JSON(200, srcs)
+}
+
+// HandleMergedCursor translates the cursors a consumer has for each source's
+// own stream into one for the merged stream, so that consumers can move from
+// following labelers directly to following the relay
+func (r *Relay) HandleMergedCursor(c echo.Context) error {
+	var body struct {
+		Cursors map[string]int64 `json:"cursors"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return xrpcerr.InvalidRequest("invalid body: %s", err)
+	}
+
+	cursors := make(map[string]int64, len(body.Cursors))
+	for host, cur := range body.Cursors {
+		h, err := NormalizeHost(host)
+		if err != nil {
+			return xrpcerr.InvalidRequest("%s", err)
+		}
+		cursors[h] = cur
+	}
+
+	merged, err := r.MergedCursor(c.Request().Context(), cursors)
+	if err != nil {
+		if errors.Is(err, ErrUnknownSource) {
+			return xrpcerr.InvalidRequest("%s", err)
+		}
+		return err
+	}
+	return c.JSON(200, map[string]int64{"cursor": merged})
+}
+
+type sourceRequest struct {
+	Host string `json:"host"`
+}
+
+func (r *Relay) HandleAddSource(c echo.Context) error {
+	var body sourceRequest
+	if err := c.Bind(&body); err != nil {
+		return xrpcerr.InvalidRequest("invalid body: %s", err)
+	}
+	if err := r.AddSource(c.Request().Context(), body.Host); err != nil {
+		if errors.Is(err, ErrInvalidSource) {
+			return xrpcerr.InvalidRequest("%s", err)
+		}
+		return err
+	}
+	return r.HandleListSources(c)
+}
+
+func (r *Relay) HandleRemoveSource(c echo.Context) error {
+	var body sourceRequest
+	if err := c.Bind(&body); err != nil {
+		return xrpcerr.InvalidRequest("invalid body: %s", err)
+	}
+	if err := r.RemoveSource(c.Request().Context(), body.Host); err != nil {
+		if errors.Is(err, ErrUnknownSource) {
+			return xrpcerr.NotFound("%s", err)
+		}
+		if errors.Is(err, ErrInvalidSource) {
+			return xrpcerr.InvalidRequest("%s", err)
+		}
+		return err
+	}
+	return r.HandleListSources(c)
+}
+
+// EventsLabelsWebsocket serves the merged stream. Cursors are sequence
+// numbers in the merged stream, not those of any source.
+func (r *Relay) EventsLabelsWebsocket(c echo.Context) error {
+	var since *int64
+	if sinceVal := c.QueryParam("cursor"); sinceVal != "" {
+		sval, err := strconv.ParseInt(sinceVal, 10, 64)
+		if err != nil {
+			return xrpcerr.InvalidRequest("invalid cursor: %q", sinceVal)
+		}
+		since = &sval
+	}
+
+	ctx := c.Request().Context()
+
+	conn, err := websocket.Upgrade(c.Response().Writer, c.Request(), c.Response().Header(), 1<<10, 1<<10)
+	if err != nil {
+		return fmt.Errorf("upgrading websocket: %w", err)
+	}
+
+	ident := c.RealIP() + "-" + c.Request().UserAgent()
+
+	evts, cancel, err := r.events.Subscribe(ctx, ident, func(evt *events.XRPCStreamEvent) bool {
+		return true
+	}, since)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	header := events.EventHeader{Op: events.EvtKindMessage, MsgType: "#labels"}
+	for {
+		var evt *events.XRPCStreamEvent
+		select {
+		case evt = <-evts:
+		case <-r.events.Closing():
+			if err := events.CloseWebsocket(conn, websocket.CloseGoingAway, "server shutting down"); err != nil {
+				log.Warnf("failed to close label subscriber connection: %s", err)
+			}
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+
+		// the merged log only has labels events
+		if evt.LabelLabels == nil {
+			continue
+		}
+
+		wc, err := conn.NextWriter(websocket.BinaryMessage)
+		if err != nil {
+			return err
+		}
+
+		if err := header.MarshalCBOR(wc); err != nil {
+			return fmt.Errorf("failed to write header: %w", err)
+		}
+
+		if err := evt.LabelLabels.MarshalCBOR(wc); err != nil {
+			return fmt.Errorf("failed to write event: %w", err)
+		}
+
+		if err := wc.Close(); err != nil {
+			return fmt.Errorf("failed to flush-close our event write: %w", err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package lex
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// CborTypes returns the names of the generated object types in the schemas
+// under prefix that need CBOR encoders from cbor-gen. Union types are not
+// included, as lexgen writes their encoders itself.
+func CborTypes(schemas []*Schema, prefix string, defmap map[string]*ExtDef) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, s := range schemas {
+		if !strings.HasPrefix(s.ID, prefix) {
+			continue
+		}
+
+		for _, t := range s.AllTypes(prefix, defmap) {
+			if t.NeedsCbor && t.Type.Type == "object" && !seen[t.Name] {
+				seen[t.Name] = true
+				out = append(out, t.Name)
+			}
+		}
+	}
+
+	sort.Strings(out)
+	return out
+}
+
+// GenCborEncoders generates cbor_gen.go for the package of generated types in
+// dir, whose import path is importPath. As cbor-gen works from the compiled
+// types, this writes placeholder encoders so that the package builds, then
+// runs a generator program against it that replaces them. The generator is
+// left in dir as gen_cbor.go, and can be re-run with "go run gen_cbor.go".
+func GenCborEncoders(dir, pkg, importPath string, types []string) error {
+	if len(types) == 0 {
+		return nil
+	}
+
+	// any existing encoders may be for an older set of types, and stop the
+	// package from building
+	if err := writeCborPlaceholders(filepath.Join(dir, "cbor_gen.go"), pkg, types); err != nil {
+		return err
+	}
+
+	genfile := filepath.Join(dir, "gen_cbor.go")
+	if err := writeCborGenProgram(genfile, pkg, importPath, types); err != nil {
+		return err
+	}
+
+	cmd := exec.Command("go", "run", "gen_cbor.go")
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("running cbor generator: %w\n%s", err, out)
+	}
+
+	return nil
+}
+
+func writeCborPlaceholders(fname, pkg string, types []string) error {
+	buf := new(bytes.Buffer)
+	pf := printerf(buf)
+
+	pf("// Code generated by cmd/lexgen; DO NOT EDIT.\n\n")
+	pf("// Placeholder encoders, replaced by running gen_cbor.go\n\n")
+	pf("package %s\n\n", pkg)
+	pf("import (\n\t\"fmt\"\n\t\"io\"\n)\n\n")
+
+	for _, t := range types {
+		pf("func (t *%s) MarshalCBOR(w io.Writer) error {\n\treturn fmt.Errorf(\"cbor encoding for %s has not been generated\")\n}\n\n", t, t)
+		pf("func (t *%s) UnmarshalCBOR(r io.Reader) error {\n\treturn fmt.Errorf(\"cbor decoding for %s has not been generated\")\n}\n\n", t, t)
+	}
+
+	return writeCodeFile(buf.Bytes(), fname)
+}
+
+func writeCborGenProgram(fname, pkg, importPath string, types []string) error {
+	buf := new(bytes.Buffer)
+	pf := printerf(buf)
+
+	pf("// Code generated by cmd/lexgen; DO NOT EDIT.\n\n")
+	pf("//go:build ignore\n\n")
+	pf("package main\n\n")
+	pf("import (\n")
+	pf("\t%s %q\n", pkg, importPath)
+	pf("\tcbg \"github.com/whyrusleeping/cbor-gen\"\n")
+	pf(")\n\n")
+	pf("func main() {\n")
+	pf("\tif err := cbg.WriteMapEncodersToFile(\"cbor_gen.go\", %q,\n", pkg)
+	for _, t := range types {
+		pf("\t\t%s.%s{},\n", pkg, t)
+	}
+	pf("\t); err != nil {\n\t\tpanic(err)\n\t}\n}\n")
+
+	return writeCodeFile(buf.Bytes(), fname)
+}
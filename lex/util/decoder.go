@@ -3,13 +3,17 @@ package util
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
 	"strings"
 
+	logging "github.com/ipfs/go-log"
 	cbg "github.com/whyrusleeping/cbor-gen"
 )
 
+var log = logging.Logger("lexutil")
+
 var lexTypesMap map[string]reflect.Type
 
 func init() {
@@ -48,7 +52,7 @@ func JsonDecodeValue(b []byte) (any, error) {
 
 	t, ok := lexTypesMap[tstr]
 	if !ok {
-		return nil, fmt.Errorf("unrecognized type: %q", tstr)
+		return nil, fmt.Errorf("handling %q: %w", tstr, ErrUnrecognizedType)
 	}
 
 	val := reflect.New(t)
@@ -97,10 +101,24 @@ type LexiconTypeDecoder struct {
 	Val cbg.CBORMarshaler
 }
 
+// UnmarshalJSON decodes a record into its registered type. Records of other
+// types are kept as a *RawRecord, which is logged and counted, as it may
+// mean a type is missing from the registry.
 func (ltd *LexiconTypeDecoder) UnmarshalJSON(b []byte) error {
 	val, err := JsonDecodeValue(b)
 	if err != nil {
-		return err
+		if !errors.Is(err, ErrUnrecognizedType) {
+			return err
+		}
+
+		rr := new(RawRecord)
+		if err := rr.UnmarshalJSON(b); err != nil {
+			return err
+		}
+		log.Infow("keeping record of unregistered type as a raw record", "type", rr.Type)
+		unknownRecordsDecoded.Inc()
+		ltd.Val = rr
+		return nil
 	}
 
 	ltd.Val = val.(cbg.CBORMarshaler)
@@ -112,6 +130,9 @@ func (ltd *LexiconTypeDecoder) MarshalJSON() ([]byte, error) {
 	if ltd == nil || ltd.Val == nil {
 		return nil, fmt.Errorf("LexiconTypeDecoder MarshalJSON called on a nil")
 	}
+	if rr, ok := ltd.Val.(*RawRecord); ok {
+		return rr.MarshalJSON()
+	}
 	v := reflect.ValueOf(ltd.Val)
 	t := v.Type()
 	sf, ok := t.Elem().FieldByName("LexiconTypeID")
@@ -0,0 +1,11 @@
+package util
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var unknownRecordsDecoded = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "lexutil_unknown_records_decoded_total",
+	Help: "The total number of records of unregistered types decoded from JSON, which are kept as raw records",
+})
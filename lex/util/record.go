@@ -0,0 +1,257 @@
+package util
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+// RawRecord is a record of any type that keeps its original DAG-CBOR
+// encoding. Records of unregistered types, and fields our generated types do
+// not know about, survive decoding and re-encoding (as CBOR or JSON)
+// unchanged, which matters for anything passing records on to others.
+type RawRecord struct {
+	// Type is the $type of the record
+	Type string
+
+	// Raw is the DAG-CBOR encoding of the record, and is what gets written
+	// out
+	Raw []byte
+
+	// Val is the record decoded into its registered Go type, or nil if the
+	// type is not registered or the record does not decode into it. Changes
+	// to Val are not written out unless passed to SetVal.
+	Val CBOR
+}
+
+// NewRawRecord wraps an encoded record
+func NewRawRecord(raw []byte) (*RawRecord, error) {
+	rr := &RawRecord{}
+	if err := rr.setRaw(raw); err != nil {
+		return nil, err
+	}
+	return rr, nil
+}
+
+func (rr *RawRecord) setRaw(raw []byte) error {
+	typ, err := CborTypeExtract(raw)
+	if err != nil {
+		return fmt.Errorf("reading record type: %w", err)
+	}
+
+	rr.Type = typ
+	rr.Raw = raw
+	rr.Val = nil
+
+	// a record that has drifted from our schema is still kept, just without
+	// a decoded value
+	val, err := CborDecodeValue(raw)
+	if err == nil {
+		rr.Val = val
+	}
+
+	return nil
+}
+
+// SetVal replaces the record with v, discarding the original encoding
+func (rr *RawRecord) SetVal(v CBOR) error {
+	buf := new(bytes.Buffer)
+	if err := v.MarshalCBOR(buf); err != nil {
+		return err
+	}
+	return rr.setRaw(buf.Bytes())
+}
+
+func (rr *RawRecord) MarshalCBOR(w io.Writer) error {
+	if rr == nil || rr.Raw == nil {
+		return fmt.Errorf("RawRecord MarshalCBOR called on an empty record")
+	}
+	_, err := w.Write(rr.Raw)
+	return err
+}
+
+func (rr *RawRecord) UnmarshalCBOR(r io.Reader) error {
+	var d cbg.Deferred
+	if err := d.UnmarshalCBOR(r); err != nil {
+		return err
+	}
+	return rr.setRaw(d.Raw)
+}
+
+func (rr *RawRecord) MarshalJSON() ([]byte, error) {
+	if rr == nil || rr.Raw == nil {
+		return nil, fmt.Errorf("RawRecord MarshalJSON called on an empty record")
+	}
+
+	var v any
+	if err := cbor.DecodeInto(rr.Raw, &v); err != nil {
+		return nil, fmt.Errorf("decoding record: %w", err)
+	}
+
+	return json.Marshal(cborToJSONValue(v))
+}
+
+func (rr *RawRecord) UnmarshalJSON(b []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+
+	cv, err := jsonToCborValue(v)
+	if err != nil {
+		return err
+	}
+
+	raw, err := cbor.DumpObject(cv)
+	if err != nil {
+		return fmt.Errorf("encoding record: %w", err)
+	}
+
+	return rr.setRaw(raw)
+}
+
+// CborBlobRefs returns the CIDs of the blobs referenced by a DAG-CBOR
+// encoded record of any type, in blob objects or legacy blob objects. Other
+// links in the record, such as the CIDs in strong refs, are not blobs and are
+// skipped.
+func CborBlobRefs(raw []byte) ([]cid.Cid, error) {
+	var v any
+	if err := cbor.DecodeInto(raw, &v); err != nil {
+		return nil, fmt.Errorf("decoding record: %w", err)
+	}
+
+	var out []cid.Cid
+	walkBlobRefs(v, func(c cid.Cid) {
+		out = append(out, c)
+	})
+	return out, nil
+}
+
+func walkBlobRefs(v any, fn func(cid.Cid)) {
+	switch v := v.(type) {
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = e
+		}
+		walkBlobRefs(m, fn)
+	case map[string]any:
+		if v["$type"] == "blob" {
+			if c, ok := v["ref"].(cid.Cid); ok {
+				fn(c)
+			}
+			return
+		}
+		if _, ok := v["$type"]; !ok {
+			// legacy blobs are {cid, mimeType}, with the cid as a string
+			ls, ok := v["cid"].(string)
+			_, hasMime := v["mimeType"].(string)
+			if ok && hasMime {
+				if c, err := cid.Decode(ls); err == nil {
+					fn(c)
+				}
+				return
+			}
+		}
+		for _, e := range v {
+			walkBlobRefs(e, fn)
+		}
+	case []any:
+		for _, e := range v {
+			walkBlobRefs(e, fn)
+		}
+	}
+}
+
+// cborToJSONValue converts a generically decoded DAG-CBOR value to the atproto
+// JSON representation, with links as {"$link": ...} and bytes as
+// {"$bytes": ...}
+func cborToJSONValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			out[k] = cborToJSONValue(e)
+		}
+		return out
+	case map[any]any:
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			out[fmt.Sprint(k)] = cborToJSONValue(e)
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			out[i] = cborToJSONValue(e)
+		}
+		return out
+	case cid.Cid:
+		return map[string]any{"$link": v.String()}
+	case []byte:
+		return map[string]any{"$bytes": base64.RawStdEncoding.EncodeToString(v)}
+	default:
+		return v
+	}
+}
+
+// jsonToCborValue is the inverse of cborToJSONValue, for JSON decoded with
+// UseNumber. Only integers are allowed, as DAG-CBOR records have no floats.
+func jsonToCborValue(v any) (any, error) {
+	switch v := v.(type) {
+	case map[string]any:
+		if len(v) == 1 {
+			if l, ok := v["$link"].(string); ok {
+				c, err := cid.Decode(l)
+				if err != nil {
+					return nil, fmt.Errorf("invalid $link: %w", err)
+				}
+				return c, nil
+			}
+			if s, ok := v["$bytes"].(string); ok {
+				b, err := base64.RawStdEncoding.DecodeString(s)
+				if err != nil {
+					return nil, fmt.Errorf("invalid $bytes: %w", err)
+				}
+				return b, nil
+			}
+		}
+
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			ce, err := jsonToCborValue(e)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = ce
+		}
+		return out, nil
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			ce, err := jsonToCborValue(e)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = ce
+		}
+		return out, nil
+	case json.Number:
+		i, err := v.Int64()
+		if err != nil {
+			return nil, fmt.Errorf("records may only contain integers, not %s", v)
+		}
+		return i, nil
+	default:
+		return v, nil
+	}
+}
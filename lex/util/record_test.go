@@ -0,0 +1,143 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	RegisterType("com.example.basic", &basicSchema{})
+}
+
+func TestRawRecordUnknownType(t *testing.T) {
+	assert := assert.New(t)
+
+	jsonStr := `{
+		"$type": "com.example.unknown",
+		"text": "hello",
+		"count": 3,
+		"nested": {"list": [1, "two", null], "flag": true},
+		"link": {"$link": "bafyreiclp443lavogvhj3d2ob2cxbfuscni2k5jk7bebjzg7khl3esabwq"},
+		"data": {"$bytes": "nFERjvLLiw9qm45JrqH9QTzyC2Lu1Xb4ne6+sBrCzI0"}
+	}`
+
+	var ltd LexiconTypeDecoder
+	if err := json.Unmarshal([]byte(jsonStr), &ltd); err != nil {
+		t.Fatal(err)
+	}
+
+	rr, ok := ltd.Val.(*RawRecord)
+	if !ok {
+		t.Fatalf("expected unknown type to decode to a raw record, got %T", ltd.Val)
+	}
+	assert.Equal("com.example.unknown", rr.Type)
+	assert.Nil(rr.Val)
+
+	out, err := json.Marshal(&ltd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.JSONEq(jsonStr, string(out))
+
+	// CBOR should pass through byte for byte
+	buf := new(bytes.Buffer)
+	if err := rr.MarshalCBOR(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var back RawRecord
+	if err := back.UnmarshalCBOR(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(rr.Raw, back.Raw)
+
+	if err := json.Unmarshal([]byte(`{"$type": "com.example.unknown", "n": 1.5}`), &ltd); err == nil {
+		t.Fatal("expected floats to be rejected")
+	}
+}
+
+func TestRawRecordKnownType(t *testing.T) {
+	assert := assert.New(t)
+
+	jsonStr := `{
+		"$type": "com.example.basic",
+		"string": "abc",
+		"unicode": "a~öñ©⽘☎𓋓😀👩‍👩‍👧‍👧",
+		"integer": 123,
+		"bool": true,
+		"null": null,
+		"array": ["abc", "def", "ghi"],
+		"object": {"string": "abc", "number": 123, "bool": true, "arr": ["abc"], "extra": "nested unknown field"},
+		"extra": {"a": [1, 2]}
+	}`
+
+	var rr RawRecord
+	if err := json.Unmarshal([]byte(jsonStr), &rr); err != nil {
+		t.Fatal(err)
+	}
+
+	val, ok := rr.Val.(*basicSchema)
+	if !ok {
+		t.Fatalf("expected known type to be decoded, got %T", rr.Val)
+	}
+	assert.Equal("abc", val.String)
+	assert.Equal(int64(123), val.Object.Number)
+
+	// re-encoding the decoded value alone would lose the unknown fields
+	out, err := json.Marshal(&rr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.JSONEq(jsonStr, string(out))
+
+	// unless it is replaced
+	val.String = "xyz"
+	if err := rr.SetVal(val); err != nil {
+		t.Fatal(err)
+	}
+	out, err = json.Marshal(&rr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]any
+	if err := json.Unmarshal(out, &m); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal("xyz", m["string"])
+	assert.NotContains(m, "extra")
+}
+
+func TestCborBlobRefs(t *testing.T) {
+	assert := assert.New(t)
+
+	const blob = "bafkreiclp443lavogvhj3d2ob2cxbfuscni2k5jk7bebjzg7khl3esabwq"
+	const legacy = "bafkreihbkfmwxscbsrfsqbbhskmdtdvaorfgjlkwy4c6zuysq3kbbejeim"
+	const other = "bafyreiclp443lavogvhj3d2ob2cxbfuscni2k5jk7bebjzg7khl3esabwq"
+
+	var rr RawRecord
+	if err := json.Unmarshal([]byte(`{
+		"$type": "com.example.unknown",
+		"subject": {"uri": "at://did:plc:alice/com.example.unknown/1", "cid": "`+other+`"},
+		"link": {"$link": "`+other+`"},
+		"images": [
+			{"image": {"$type": "blob", "ref": {"$link": "`+blob+`"}, "mimeType": "image/png", "size": 3}},
+			{"image": {"cid": "`+legacy+`", "mimeType": "image/jpeg"}}
+		]
+	}`), &rr); err != nil {
+		t.Fatal(err)
+	}
+
+	cids, err := CborBlobRefs(rr.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, c := range cids {
+		got = append(got, c.String())
+	}
+	assert.ElementsMatch([]string{blob, legacy}, got)
+}
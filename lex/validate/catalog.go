@@ -0,0 +1,176 @@
+// Package validate checks records against lexicon schemas loaded at runtime.
+//
+// The generated types in api/ only enforce the shape of a record. This
+// package enforces the rest of the schema: required fields, string formats
+// and lengths, integer ranges, and union membership. The parameters and JSON
+// inputs of XRPC calls are checked the same way, see RequestMiddleware.
+package validate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Def is a single lexicon definition, or a field within one
+type Def struct {
+	Type        string `json:"type"`
+	Description string `json:"description"`
+
+	// records
+	Key    string `json:"key"`
+	Record *Def   `json:"record"`
+
+	// objects
+	Properties map[string]*Def `json:"properties"`
+	Required   []string        `json:"required"`
+	Nullable   []string        `json:"nullable"`
+
+	// arrays
+	Items *Def `json:"items"`
+
+	// refs and unions
+	Ref    string   `json:"ref"`
+	Refs   []string `json:"refs"`
+	Closed bool     `json:"closed"`
+
+	// strings, and the length of arrays and bytes
+	Format       string   `json:"format"`
+	MinLength    *int     `json:"minLength"`
+	MaxLength    *int     `json:"maxLength"`
+	MinGraphemes *int     `json:"minGraphemes"`
+	MaxGraphemes *int     `json:"maxGraphemes"`
+	KnownValues  []string `json:"knownValues"`
+
+	// integers
+	Minimum *int64 `json:"minimum"`
+	Maximum *int64 `json:"maximum"`
+
+	Enum  []any `json:"enum"`
+	Const any   `json:"const"`
+
+	// blobs
+	Accept  []string `json:"accept"`
+	MaxSize *int64   `json:"maxSize"`
+
+	// queries and procedures
+	Parameters *Def  `json:"parameters"`
+	Input      *Body `json:"input"`
+
+	// docID is the lexicon the def is from, for resolving local refs
+	docID string
+}
+
+// Body is the input of a procedure
+type Body struct {
+	Encoding string `json:"encoding"`
+	Schema   *Def   `json:"schema"`
+}
+
+type lexiconDoc struct {
+	Lexicon int             `json:"lexicon"`
+	ID      string          `json:"id"`
+	Defs    map[string]*Def `json:"defs"`
+}
+
+// Catalog is a set of lexicon definitions. It is not safe to add schemas to a
+// catalog while it is in use.
+type Catalog struct {
+	defs map[string]*Def
+}
+
+func NewCatalog() *Catalog {
+	return &Catalog{
+		defs: make(map[string]*Def),
+	}
+}
+
+// AddSchema adds the definitions from a lexicon JSON document to the catalog
+func (c *Catalog) AddSchema(data []byte) error {
+	var doc lexiconDoc
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("parsing lexicon: %w", err)
+	}
+
+	if doc.Lexicon != 1 {
+		return fmt.Errorf("unsupported lexicon version %d in %q", doc.Lexicon, doc.ID)
+	}
+
+	if doc.ID == "" {
+		return fmt.Errorf("lexicon has no id")
+	}
+
+	for name, d := range doc.Defs {
+		setDocID(d, doc.ID)
+
+		k := doc.ID
+		if name != "main" {
+			k = doc.ID + "#" + name
+		}
+		c.defs[k] = d
+	}
+
+	return nil
+}
+
+// LoadDirectory adds every lexicon JSON file found under dir to the catalog
+func (c *Catalog) LoadDirectory(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() || !strings.HasSuffix(path, ".json") {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		if err := c.AddSchema(data); err != nil {
+			return fmt.Errorf("loading %s: %w", path, err)
+		}
+
+		return nil
+	})
+}
+
+// Resolve looks up a definition by its full reference, eg "app.bsky.feed.post"
+// or "app.bsky.richtext.facet#mention"
+func (c *Catalog) Resolve(ref string) (*Def, bool) {
+	d, ok := c.defs[strings.TrimSuffix(ref, "#main")]
+	return d, ok
+}
+
+func (c *Catalog) resolveFrom(d *Def, ref string) (*Def, bool) {
+	return c.Resolve(fullRef(d.docID, ref))
+}
+
+func fullRef(docID, ref string) string {
+	if strings.HasPrefix(ref, "#") {
+		ref = docID + ref
+	}
+	return strings.TrimSuffix(ref, "#main")
+}
+
+func setDocID(d *Def, id string) {
+	if d == nil {
+		return
+	}
+
+	d.docID = id
+	setDocID(d.Record, id)
+	setDocID(d.Items, id)
+	setDocID(d.Parameters, id)
+	if d.Input != nil {
+		setDocID(d.Input.Schema, id)
+	}
+	for _, p := range d.Properties {
+		setDocID(p, id)
+	}
+}
@@ -0,0 +1,104 @@
+package validate
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"time"
+	"unicode"
+
+	"github.com/bluesky-social/indigo/util/aturi"
+	"github.com/bluesky-social/indigo/util/syntax"
+
+	"github.com/ipfs/go-cid"
+)
+
+var languageRegex = regexp.MustCompile(`^(i|[a-z]{2,3})(-[a-zA-Z0-9]+)*$`)
+
+var formats = map[string]func(string) error{
+	"datetime":      checkDatetime,
+	"uri":           checkURI,
+	"at-uri":        checkAtURI,
+	"did":           syntaxCheck(syntax.ParseDID),
+	"handle":        syntaxCheck(syntax.ParseHandle),
+	"at-identifier": syntaxCheck(syntax.ParseAtIdentifier),
+	"nsid":          syntaxCheck(syntax.ParseNSID),
+	"cid":           checkCid,
+	"language":      regexCheck(languageRegex),
+	"tid":           syntaxCheck(syntax.ParseTID),
+	"record-key":    syntaxCheck(syntax.ParseRecordKey),
+}
+
+func regexCheck(re *regexp.Regexp) func(string) error {
+	return func(s string) error {
+		if !re.MatchString(s) {
+			return fmt.Errorf("%q is not well formed", s)
+		}
+		return nil
+	}
+}
+
+func syntaxCheck[T any](parse func(string) (T, error)) func(string) error {
+	return func(s string) error {
+		_, err := parse(s)
+		return err
+	}
+}
+
+func checkDatetime(s string) error {
+	// RFC 3339 requires a timezone, which is what we want
+	if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+		return fmt.Errorf("%q is not an RFC 3339 datetime", s)
+	}
+	return nil
+}
+
+func checkURI(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" {
+		return fmt.Errorf("%q has no scheme", s)
+	}
+	return nil
+}
+
+func checkCid(s string) error {
+	_, err := cid.Decode(s)
+	return err
+}
+
+// checkAtURI checks for at://authority[/collection[/rkey]], in the
+// restricted syntax of the aturi package
+func checkAtURI(s string) error {
+	_, err := aturi.Parse(s)
+	return err
+}
+
+// countGraphemes approximates the number of user visible characters in s by
+// not counting combining marks, joiners and variation selectors. This is
+// exact for most text, and only ever undercounts.
+func countGraphemes(s string) int {
+	var n int
+	joined := false
+	for _, r := range s {
+		switch {
+		case r == '\u200d':
+			// a zero width joiner merges the next character into this one
+			joined = true
+			continue
+		case unicode.In(r, unicode.Mn, unicode.Me, unicode.Variation_Selector):
+			continue
+		case r >= 0x1F3FB && r <= 0x1F3FF:
+			// emoji skin tone modifiers
+			continue
+		}
+
+		if !joined {
+			n++
+		}
+		joined = false
+	}
+	return n
+}
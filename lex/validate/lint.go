@@ -0,0 +1,340 @@
+package validate
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	if s == SeverityWarning {
+		return "warning"
+	}
+	return "error"
+}
+
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Diagnostic is a single problem found by LintRecord
+type Diagnostic struct {
+	Path     string   `json:"path"`
+	Severity Severity `json:"severity"`
+	Msg      string   `json:"msg"`
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s: %s", d.Severity, d.Path, d.Msg)
+}
+
+// BlobRef is a blob referenced from a record
+type BlobRef struct {
+	Path     string `json:"path"`
+	Cid      string `json:"cid"`
+	MimeType string `json:"mimeType"`
+
+	// Size is -1 for legacy blobs, which do not record it
+	Size int64 `json:"size"`
+}
+
+// LintResult is everything found by LintRecord
+type LintResult struct {
+	Diagnostics []Diagnostic `json:"diagnostics"`
+	Blobs       []BlobRef    `json:"blobs"`
+}
+
+// Errors returns the number of error diagnostics
+func (lr *LintResult) Errors() int {
+	var n int
+	for _, d := range lr.Diagnostics {
+		if d.Severity == SeverityError {
+			n++
+		}
+	}
+	return n
+}
+
+// LintRecord checks a record like ValidateRecord, but rather than stopping at
+// the first problem it reports every one it can find, warns about fields
+// the schema does not define and data it could not check, and lists the
+// blobs the record refers to.
+func (v *Validator) LintRecord(collection string, rec any) (*LintResult, error) {
+	val, err := toValue(rec)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &linter{v: v, res: &LintResult{}}
+
+	obj, ok := val.(map[string]any)
+	if !ok {
+		l.errorf("$", "record must be an object")
+		return l.res, nil
+	}
+
+	if t, ok := obj["$type"].(string); !ok || t == "" {
+		l.warnf("$", "record has no $type")
+	} else if t != collection {
+		l.errorf("$", "record has type %q, expected %q", t, collection)
+	}
+
+	d, ok := v.Catalog.Resolve(collection)
+	switch {
+	case !ok && v.Mode == Strict:
+		l.errorf("$", "%s: %s", ErrUnknownLexicon, collection)
+	case !ok:
+		l.warnf("$", "no lexicon for %s, the record was not checked", collection)
+	case d.Type != "record" || d.Record == nil:
+		l.errorf("$", "%s is not a record type", collection)
+	default:
+		l.lint("$", d.Record, obj)
+	}
+
+	// blobs are not always found by walking the schema, eg in unknown fields
+	// or open union members we have no lexicon for
+	l.findBlobs("$", obj)
+	sort.Slice(l.res.Blobs, func(i, j int) bool {
+		return l.res.Blobs[i].Path < l.res.Blobs[j].Path
+	})
+
+	return l.res, nil
+}
+
+type linter struct {
+	v   *Validator
+	res *LintResult
+}
+
+func (l *linter) errorf(path string, format string, args ...any) {
+	l.res.Diagnostics = append(l.res.Diagnostics, Diagnostic{Path: path, Severity: SeverityError, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (l *linter) warnf(path string, format string, args ...any) {
+	l.res.Diagnostics = append(l.res.Diagnostics, Diagnostic{Path: path, Severity: SeverityWarning, Msg: fmt.Sprintf(format, args...)})
+}
+
+// check runs the single value validation, recording its error if any
+func (l *linter) check(path string, d *Def, val any) {
+	if err := l.v.validate(path, d, val); err != nil {
+		if verr, ok := err.(*ValidationError); ok {
+			l.errorf(verr.Path, "%s", verr.Msg)
+		} else {
+			l.errorf(path, "%s", err)
+		}
+	}
+}
+
+func (l *linter) lint(path string, d *Def, val any) {
+	switch d.Type {
+	case "object":
+		obj, ok := val.(map[string]any)
+		if !ok {
+			l.errorf(path, "expected an object")
+			return
+		}
+		l.lintObject(path, d, obj)
+
+	case "ref":
+		rd, ok := l.v.Catalog.resolveFrom(d, d.Ref)
+		if !ok {
+			l.errorf(path, "unknown ref %q", d.Ref)
+			return
+		}
+		l.lint(path, rd, val)
+
+	case "union":
+		l.lintUnion(path, d, val)
+
+	case "array":
+		arr, ok := val.([]any)
+		if !ok {
+			l.errorf(path, "expected an array")
+			return
+		}
+
+		// check the array's own constraints, then each item in full
+		shallow := *d
+		shallow.Items = nil
+		l.check(path, &shallow, arr)
+
+		if d.Items != nil {
+			for i, it := range arr {
+				l.lint(fmt.Sprintf("%s[%d]", path, i), d.Items, it)
+			}
+		}
+
+	case "record":
+		l.lint(path, d.Record, val)
+
+	case "blob":
+		l.check(path, d, val)
+		l.lintBlob(path, val)
+
+	default:
+		l.check(path, d, val)
+	}
+}
+
+func (l *linter) lintObject(path string, d *Def, obj map[string]any) {
+	nullable := make(map[string]bool)
+	for _, n := range d.Nullable {
+		nullable[n] = true
+	}
+
+	for _, r := range d.Required {
+		fv, ok := obj[r]
+		if !ok || (fv == nil && !nullable[r]) {
+			l.errorf(path+"."+r, "required field is missing")
+		}
+	}
+
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fv := obj[k]
+		pd, ok := d.Properties[k]
+		if !ok {
+			if k != "$type" {
+				l.warnf(path+"."+k, "field is not in the schema")
+			}
+			continue
+		}
+		if fv == nil {
+			continue
+		}
+		l.lint(path+"."+k, pd, fv)
+	}
+}
+
+func (l *linter) lintUnion(path string, d *Def, val any) {
+	obj, ok := val.(map[string]any)
+	if !ok {
+		l.errorf(path, "expected an object")
+		return
+	}
+
+	t, ok := obj["$type"].(string)
+	if !ok || t == "" {
+		l.errorf(path, "union member has no $type")
+		return
+	}
+	t = strings.TrimSuffix(t, "#main")
+
+	member := false
+	for _, r := range d.Refs {
+		if fullRef(d.docID, r) == t {
+			member = true
+			break
+		}
+	}
+	if !member && d.Closed {
+		l.errorf(path, "%q is not a member of the union", t)
+		return
+	}
+
+	rd, ok := l.v.Catalog.Resolve(t)
+	if !ok {
+		switch {
+		case member:
+			l.errorf(path, "unknown ref %q", t)
+		case l.v.Mode == Strict:
+			l.errorf(path, "unknown union member %q", t)
+		default:
+			l.warnf(path, "no lexicon for union member %q, it was not checked", t)
+		}
+		return
+	}
+
+	l.lint(path, rd, obj)
+}
+
+// lintBlob warns about blob refs that are valid, but that a PDS would not
+// have created
+func (l *linter) lintBlob(path string, val any) {
+	obj, ok := val.(map[string]any)
+	if !ok {
+		return
+	}
+
+	if obj["$type"] != "blob" {
+		if l.v.Mode != Strict {
+			l.warnf(path, "legacy blob, without a size")
+		}
+		return
+	}
+
+	ref, _ := obj["ref"].(map[string]any)
+	link, _ := ref["$link"].(string)
+	c, err := cid.Decode(link)
+	if err != nil {
+		return
+	}
+
+	if c.Prefix().Codec != cid.Raw {
+		l.warnf(path, "blob ref %s is not a raw CID", c)
+	}
+	if c.Prefix().MhType != multihash.SHA2_256 {
+		l.warnf(path, "blob ref %s is not a sha2-256 hash", c)
+	}
+	if n, ok := obj["size"].(json.Number); ok && n.String() == "0" {
+		l.warnf(path, "blob is empty")
+	}
+}
+
+func (l *linter) findBlobs(path string, val any) {
+	switch val := val.(type) {
+	case map[string]any:
+		if br, ok := blobRef(path, val); ok {
+			l.res.Blobs = append(l.res.Blobs, br)
+			return
+		}
+		for k, fv := range val {
+			l.findBlobs(path+"."+k, fv)
+		}
+	case []any:
+		for i, it := range val {
+			l.findBlobs(fmt.Sprintf("%s[%d]", path, i), it)
+		}
+	}
+}
+
+func blobRef(path string, obj map[string]any) (BlobRef, bool) {
+	mime, _ := obj["mimeType"].(string)
+
+	if obj["$type"] == "blob" {
+		ref, _ := obj["ref"].(map[string]any)
+		link, ok := ref["$link"].(string)
+		if !ok {
+			return BlobRef{}, false
+		}
+
+		var size int64
+		if n, ok := obj["size"].(json.Number); ok {
+			size, _ = n.Int64()
+		}
+		return BlobRef{Path: path, Cid: link, MimeType: mime, Size: size}, true
+	}
+
+	// legacy blobs are just a cid and mime type
+	if c, ok := obj["cid"].(string); ok && mime != "" && len(obj) == 2 {
+		return BlobRef{Path: path, Cid: c, MimeType: mime, Size: -1}, true
+	}
+
+	return BlobRef{}, false
+}
@@ -0,0 +1,88 @@
+package validate
+
+import (
+	"testing"
+)
+
+func TestLintRecord(t *testing.T) {
+	v := NewValidator(testCatalog(t), Lenient)
+
+	rec := map[string]any{
+		"$type":     "app.bsky.feed.post",
+		"createdAt": "yesterday",
+		"langs":     []any{"en", "fr", "de", "es"},
+		"via":       "gosky",
+		"embed": map[string]any{
+			"$type": "app.bsky.embed.images",
+			"images": []any{map[string]any{
+				"alt": "a cat",
+				"image": map[string]any{
+					"$type":    "blob",
+					"ref":      map[string]any{"$link": "bafyreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm"},
+					"mimeType": "image/jpeg",
+					"size":     1234,
+				},
+			}},
+		},
+	}
+
+	res, err := v.LintRecord("app.bsky.feed.post", rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]Severity{
+		"$.text":                  SeverityError,
+		"$.createdAt":             SeverityError,
+		"$.langs":                 SeverityError,
+		"$.via":                   SeverityWarning,
+		"$.embed.images[0].image": SeverityWarning,
+	}
+	got := make(map[string]Severity)
+	for _, d := range res.Diagnostics {
+		got[d.Path] = d.Severity
+	}
+	for p, sev := range want {
+		if s, ok := got[p]; !ok || s != sev {
+			t.Errorf("expected %s at %s, got %v", sev, p, res.Diagnostics)
+		}
+	}
+	if len(res.Diagnostics) != len(want) {
+		t.Errorf("expected %d diagnostics, got %v", len(want), res.Diagnostics)
+	}
+	if res.Errors() != 3 {
+		t.Errorf("expected 3 errors, got %d", res.Errors())
+	}
+
+	if len(res.Blobs) != 1 || res.Blobs[0].Path != "$.embed.images[0].image" || res.Blobs[0].Size != 1234 {
+		t.Fatalf("unexpected blobs: %v", res.Blobs)
+	}
+}
+
+func TestLintUnknown(t *testing.T) {
+	cat := testCatalog(t)
+
+	rec := map[string]any{
+		"$type": "com.example.thing",
+		"pic":   map[string]any{"cid": "bafkreiblkobl6arfg3j7eft3akdhn2hmr2qmzfkefcgu4agnswvssg4a6a", "mimeType": "image/png"},
+	}
+
+	res, err := NewValidator(cat, Lenient).LintRecord("com.example.thing", rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Errors() != 0 || len(res.Diagnostics) != 1 {
+		t.Fatalf("expected a single warning, got %v", res.Diagnostics)
+	}
+	if len(res.Blobs) != 1 || res.Blobs[0].Size != -1 {
+		t.Fatalf("expected to find the legacy blob, got %v", res.Blobs)
+	}
+
+	res, err = NewValidator(cat, Strict).LintRecord("com.example.thing", rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Errors() != 1 {
+		t.Fatalf("expected an error in strict mode, got %v", res.Diagnostics)
+	}
+}
@@ -0,0 +1,198 @@
+package validate
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bluesky-social/indigo/util/xrpcerr"
+
+	"github.com/labstack/echo/v4"
+)
+
+// method looks up the lexicon of an XRPC query or procedure
+func (v *Validator) method(nsid string) (*Def, error) {
+	d, ok := v.Catalog.Resolve(nsid)
+	if !ok {
+		if v.Mode == Strict {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownLexicon, nsid)
+		}
+		return nil, nil
+	}
+
+	if d.Type != "query" && d.Type != "procedure" {
+		return nil, fmt.Errorf("%s is not a query or procedure", nsid)
+	}
+
+	return d, nil
+}
+
+// ValidateParams checks the query parameters of a call to an XRPC method
+// against its lexicon. Parameters the lexicon doesn't declare are ignored.
+func (v *Validator) ValidateParams(nsid string, q url.Values) error {
+	d, err := v.method(nsid)
+	if err != nil || d == nil || d.Parameters == nil {
+		return err
+	}
+
+	return v.validateParams(d.Parameters, q)
+}
+
+func (v *Validator) validateParams(d *Def, q url.Values) error {
+	for _, r := range d.Required {
+		if !q.Has(r) {
+			return &ValidationError{Path: r, Msg: "required parameter is missing"}
+		}
+	}
+
+	keys := make([]string, 0, len(d.Properties))
+	for k := range d.Properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		vals, ok := q[k]
+		if !ok {
+			continue
+		}
+
+		pd := d.Properties[k]
+		if pd.Type != "array" && len(vals) > 1 {
+			return &ValidationError{Path: k, Msg: "expected a single value"}
+		}
+
+		val, err := paramValue(k, pd, vals)
+		if err != nil {
+			return err
+		}
+
+		if err := v.validate(k, pd, val); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// paramValue converts query parameter values into the generic form we
+// validate, the same as a JSON value of the parameter's type
+func paramValue(path string, d *Def, vals []string) (any, error) {
+	switch d.Type {
+	case "array":
+		out := make([]any, 0, len(vals))
+		for i, s := range vals {
+			if d.Items == nil {
+				out = append(out, s)
+				continue
+			}
+			it, err := paramValue(fmt.Sprintf("%s[%d]", path, i), d.Items, []string{s})
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, it)
+		}
+		return out, nil
+
+	case "integer":
+		if _, err := strconv.ParseInt(vals[0], 10, 64); err != nil {
+			return nil, &ValidationError{Path: path, Msg: "expected an integer"}
+		}
+		return json.Number(vals[0]), nil
+
+	case "boolean":
+		switch vals[0] {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		default:
+			return nil, &ValidationError{Path: path, Msg: "expected a boolean"}
+		}
+
+	default:
+		return vals[0], nil
+	}
+}
+
+// ValidateInput checks the JSON input of a call to an XRPC procedure against
+// its lexicon. Inputs of other encodings, such as blob uploads, are not
+// checked.
+func (v *Validator) ValidateInput(nsid string, body []byte) error {
+	d, err := v.method(nsid)
+	if err != nil || d == nil || !hasJSONInput(d) {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+
+	var val any
+	if err := dec.Decode(&val); err != nil {
+		return &ValidationError{Path: "$", Msg: fmt.Sprintf("invalid JSON: %s", err)}
+	}
+
+	return v.validate("$", d.Input.Schema, val)
+}
+
+func hasJSONInput(d *Def) bool {
+	return d.Type == "procedure" && d.Input != nil && d.Input.Schema != nil && d.Input.Encoding == "application/json"
+}
+
+// RequestMiddleware rejects calls to XRPC methods whose parameters or JSON
+// input don't match the method's lexicon, before they reach the handler.
+// Methods that aren't in the validator's catalog are passed through in either
+// mode, so that a server can still serve what it has no lexicons for.
+func RequestMiddleware(v *Validator) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			nsid, ok := strings.CutPrefix(c.Request().URL.Path, "/xrpc/")
+			if !ok {
+				return next(c)
+			}
+
+			d, ok := v.Catalog.Resolve(nsid)
+			if !ok || (d.Type != "query" && d.Type != "procedure") {
+				return next(c)
+			}
+
+			if d.Parameters != nil {
+				if err := v.validateParams(d.Parameters, c.QueryParams()); err != nil {
+					return xrpcerr.InvalidRequest("%s", err)
+				}
+			}
+
+			if hasJSONInput(d) && c.Request().Method == http.MethodPost {
+				if ct := c.Request().Header.Get(echo.HeaderContentType); ct != "" {
+					if mt, _, err := mime.ParseMediaType(ct); err != nil || mt != echo.MIMEApplicationJSON {
+						return xrpcerr.InvalidRequest("wrong request encoding %q, expected %s", ct, echo.MIMEApplicationJSON)
+					}
+				}
+
+				body, err := io.ReadAll(c.Request().Body)
+				if err != nil {
+					var mbe *http.MaxBytesError
+					if errors.As(err, &mbe) {
+						return xrpcerr.New(http.StatusRequestEntityTooLarge, xrpcerr.NamePayloadTooLarge, "request body is too large")
+					}
+					return xrpcerr.InvalidRequest("reading request body: %s", err)
+				}
+				c.Request().Body = io.NopCloser(bytes.NewReader(body))
+
+				if err := v.ValidateInput(nsid, body); err != nil {
+					return xrpcerr.InvalidRequest("%s", err)
+				}
+			}
+
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package validate
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/bluesky-social/indigo/util/xrpcerr"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/exp/slog"
+)
+
+const testListRecordsLexicon = `{
+  "lexicon": 1,
+  "id": "com.atproto.repo.listRecords",
+  "defs": {
+    "main": {
+      "type": "query",
+      "parameters": {
+        "type": "params",
+        "required": ["repo", "collection"],
+        "properties": {
+          "repo": {"type": "string", "format": "at-identifier"},
+          "collection": {"type": "string", "format": "nsid"},
+          "limit": {"type": "integer", "minimum": 1, "maximum": 100},
+          "reverse": {"type": "boolean"},
+          "cids": {"type": "array", "maxLength": 2, "items": {"type": "string", "format": "cid"}}
+        }
+      }
+    }
+  }
+}`
+
+const testCreateRecordLexicon = `{
+  "lexicon": 1,
+  "id": "com.atproto.repo.createRecord",
+  "defs": {
+    "main": {
+      "type": "procedure",
+      "input": {
+        "encoding": "application/json",
+        "schema": {
+          "type": "object",
+          "required": ["repo", "collection", "record"],
+          "properties": {
+            "repo": {"type": "string", "format": "at-identifier"},
+            "collection": {"type": "string", "format": "nsid"},
+            "rkey": {"type": "string", "maxLength": 15},
+            "record": {"type": "unknown"},
+            "swapCommit": {"type": "ref", "ref": "#cid"}
+          }
+        }
+      }
+    },
+    "cid": {"type": "string", "format": "cid"}
+  }
+}`
+
+func testMethodCatalog(t *testing.T) *Catalog {
+	cat := testCatalog(t)
+	for _, s := range []string{testListRecordsLexicon, testCreateRecordLexicon} {
+		if err := cat.AddSchema([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cat
+}
+
+func TestValidateParams(t *testing.T) {
+	v := NewValidator(testMethodCatalog(t), Lenient)
+
+	good := url.Values{
+		"repo":       {"did:plc:abc"},
+		"collection": {"app.bsky.feed.post"},
+		"limit":      {"50"},
+		"reverse":    {"true"},
+		"cids":       {"bafyreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm"},
+		"unknown":    {"ignored"},
+	}
+	if err := v.ValidateParams("com.atproto.repo.listRecords", good); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, q := range map[string]string{
+		"missing repo":   "collection=app.bsky.feed.post",
+		"bad collection": "repo=did:plc:abc&collection=nope",
+		"limit too big":  "repo=did:plc:abc&collection=app.bsky.feed.post&limit=101",
+		"bad limit":      "repo=did:plc:abc&collection=app.bsky.feed.post&limit=ten",
+		"bad boolean":    "repo=did:plc:abc&collection=app.bsky.feed.post&reverse=yes",
+		"repeated":       "repo=did:plc:abc&repo=did:plc:def&collection=app.bsky.feed.post",
+		"bad item":       "repo=did:plc:abc&collection=app.bsky.feed.post&cids=nope",
+		"too many items": "repo=did:plc:abc&collection=app.bsky.feed.post&cids=a&cids=b&cids=c",
+	} {
+		vals, err := url.ParseQuery(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var verr *ValidationError
+		if err := v.ValidateParams("com.atproto.repo.listRecords", vals); !errors.As(err, &verr) {
+			t.Fatalf("%s: expected a validation error, got %v", name, err)
+		}
+	}
+
+	if err := v.ValidateParams("com.example.unknown", nil); err != nil {
+		t.Fatalf("expected unknown methods to be accepted in lenient mode, got %v", err)
+	}
+	strict := NewValidator(v.Catalog, Strict)
+	if err := strict.ValidateParams("com.example.unknown", nil); !errors.Is(err, ErrUnknownLexicon) {
+		t.Fatalf("expected unknown methods to be rejected in strict mode, got %v", err)
+	}
+}
+
+func TestRequestMiddleware(t *testing.T) {
+	v := NewValidator(testMethodCatalog(t), Strict)
+
+	e := echo.New()
+	e.HTTPErrorHandler = xrpcerr.ErrorHandler(slog.Default())
+	e.Use(RequestMiddleware(v))
+
+	var got string
+	handler := func(c echo.Context) error {
+		var in struct {
+			Repo string `json:"repo"`
+		}
+		if c.Request().Method == http.MethodPost {
+			if err := c.Bind(&in); err != nil {
+				return err
+			}
+		}
+		got = in.Repo
+		return c.NoContent(http.StatusOK)
+	}
+	e.GET("/xrpc/com.atproto.repo.listRecords", handler)
+	e.POST("/xrpc/com.atproto.repo.createRecord", handler)
+	e.GET("/xrpc/_health", handler)
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{http.MethodGet, "/xrpc/com.atproto.repo.listRecords?repo=did:plc:abc&collection=app.bsky.feed.post", "", 200},
+		{http.MethodGet, "/xrpc/com.atproto.repo.listRecords?repo=did:plc:abc&collection=app.bsky.feed.post&limit=0", "", 400},
+		{http.MethodGet, "/xrpc/com.atproto.repo.listRecords?collection=app.bsky.feed.post", "", 400},
+		{http.MethodPost, "/xrpc/com.atproto.repo.createRecord", `{"repo":"did:plc:abc","collection":"app.bsky.feed.post","record":{}}`, 200},
+		{http.MethodPost, "/xrpc/com.atproto.repo.createRecord", `{"repo":"did:plc:abc","collection":"app.bsky.feed.post"}`, 400},
+		{http.MethodPost, "/xrpc/com.atproto.repo.createRecord", `{"repo":"did:plc:abc","collection":"app.bsky.feed.post","record":{},"swapCommit":"nope"}`, 400},
+		{http.MethodPost, "/xrpc/com.atproto.repo.createRecord", `{"repo":`, 400},
+		// methods the catalog doesn't have are left to their handlers
+		{http.MethodGet, "/xrpc/_health", "", 200},
+	} {
+		got = ""
+		req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+		if tc.body != "" {
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		if rec.Code != tc.status {
+			t.Fatalf("%s %s: expected status %d, got %d: %s", tc.method, tc.path, tc.status, rec.Code, rec.Body.String())
+		}
+		if tc.status == 400 && !strings.Contains(rec.Body.String(), xrpcerr.NameInvalidRequest) {
+			t.Fatalf("expected an InvalidRequest error, got %s", rec.Body.String())
+		}
+		// the handler still gets the body after it has been checked
+		if tc.status == 200 && tc.method == http.MethodPost && got != "did:plc:abc" {
+			t.Fatalf("expected the handler to read the input, got %q", got)
+		}
+	}
+}
@@ -0,0 +1,444 @@
+package validate
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ipfs/go-cid"
+)
+
+// Mode controls how a Validator treats data it has no schema for
+type Mode int
+
+const (
+	// Lenient accepts records of unknown collections, and members of open
+	// unions whose type is not in the catalog, without checking them
+	Lenient Mode = iota
+
+	// Strict rejects anything that can not be checked against a known
+	// schema, and legacy blobs
+	Strict
+)
+
+// ErrUnknownLexicon is returned in strict mode for records of collections
+// that are not in the catalog
+var ErrUnknownLexicon = errors.New("unknown lexicon")
+
+// ValidationError describes where in a record validation failed
+type ValidationError struct {
+	Path string
+	Msg  string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Path + ": " + e.Msg
+}
+
+type Validator struct {
+	Catalog *Catalog
+	Mode    Mode
+}
+
+func NewValidator(cat *Catalog, mode Mode) *Validator {
+	return &Validator{
+		Catalog: cat,
+		Mode:    mode,
+	}
+}
+
+// ValidateRecord checks a record of the given collection against its
+// lexicon. The record may be one of the generated types, or the result of
+// decoding the record's JSON into a map.
+func (v *Validator) ValidateRecord(collection string, rec any) error {
+	d, ok := v.Catalog.Resolve(collection)
+	if !ok {
+		if v.Mode == Strict {
+			return fmt.Errorf("%w: %s", ErrUnknownLexicon, collection)
+		}
+		return nil
+	}
+
+	if d.Type != "record" || d.Record == nil {
+		return fmt.Errorf("%s is not a record type", collection)
+	}
+
+	val, err := toValue(rec)
+	if err != nil {
+		return err
+	}
+
+	obj, ok := val.(map[string]any)
+	if !ok {
+		return &ValidationError{Path: "$", Msg: "record must be an object"}
+	}
+
+	if t, ok := obj["$type"].(string); ok && t != "" && t != collection {
+		return &ValidationError{Path: "$", Msg: fmt.Sprintf("record has type %q, expected %q", t, collection)}
+	}
+
+	return v.validate("$", d.Record, obj)
+}
+
+// toValue converts a record into the generic form we validate, with integers
+// as json.Number so that they are not confused with floats
+func toValue(rec any) (any, error) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return nil, fmt.Errorf("serializing record: %w", err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	var out any
+	if err := dec.Decode(&out); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func (v *Validator) validate(path string, d *Def, val any) error {
+	fail := func(format string, args ...any) error {
+		return &ValidationError{Path: path, Msg: fmt.Sprintf(format, args...)}
+	}
+
+	switch d.Type {
+	case "object":
+		obj, ok := val.(map[string]any)
+		if !ok {
+			return fail("expected an object")
+		}
+		return v.validateObject(path, d, obj)
+
+	case "ref":
+		rd, ok := v.Catalog.resolveFrom(d, d.Ref)
+		if !ok {
+			return fail("unknown ref %q", d.Ref)
+		}
+		return v.validate(path, rd, val)
+
+	case "union":
+		return v.validateUnion(path, d, val)
+
+	case "string":
+		s, ok := val.(string)
+		if !ok {
+			return fail("expected a string")
+		}
+		return v.validateString(path, d, s)
+
+	case "integer":
+		n, ok := val.(json.Number)
+		if !ok {
+			return fail("expected an integer")
+		}
+		i, err := n.Int64()
+		if err != nil {
+			return fail("expected an integer")
+		}
+		if d.Minimum != nil && i < *d.Minimum {
+			return fail("must be at least %d", *d.Minimum)
+		}
+		if d.Maximum != nil && i > *d.Maximum {
+			return fail("must be at most %d", *d.Maximum)
+		}
+		if d.Const != nil && !numEquals(d.Const, i) {
+			return fail("must be %v", d.Const)
+		}
+		if len(d.Enum) > 0 && !enumHas(d.Enum, func(e any) bool { return numEquals(e, i) }) {
+			return fail("%d is not an allowed value", i)
+		}
+
+	case "boolean":
+		b, ok := val.(bool)
+		if !ok {
+			return fail("expected a boolean")
+		}
+		if c, ok := d.Const.(bool); ok && c != b {
+			return fail("must be %t", c)
+		}
+
+	case "array":
+		arr, ok := val.([]any)
+		if !ok {
+			return fail("expected an array")
+		}
+		if d.MinLength != nil && len(arr) < *d.MinLength {
+			return fail("must have at least %d items", *d.MinLength)
+		}
+		if d.MaxLength != nil && len(arr) > *d.MaxLength {
+			return fail("must have at most %d items", *d.MaxLength)
+		}
+		if d.Items != nil {
+			for i, it := range arr {
+				if err := v.validate(fmt.Sprintf("%s[%d]", path, i), d.Items, it); err != nil {
+					return err
+				}
+			}
+		}
+
+	case "blob":
+		return v.validateBlob(path, d, val)
+
+	case "cid-link":
+		obj, ok := val.(map[string]any)
+		if !ok {
+			return fail("expected a cid link")
+		}
+		l, ok := obj["$link"].(string)
+		if !ok {
+			return fail("expected a cid link")
+		}
+		if _, err := cid.Decode(l); err != nil {
+			return fail("invalid cid: %s", err)
+		}
+
+	case "bytes":
+		obj, ok := val.(map[string]any)
+		if !ok {
+			return fail("expected bytes")
+		}
+		s, ok := obj["$bytes"].(string)
+		if !ok {
+			return fail("expected bytes")
+		}
+		b, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "="))
+		if err != nil {
+			return fail("invalid base64: %s", err)
+		}
+		if d.MinLength != nil && len(b) < *d.MinLength {
+			return fail("must be at least %d bytes", *d.MinLength)
+		}
+		if d.MaxLength != nil && len(b) > *d.MaxLength {
+			return fail("must be at most %d bytes", *d.MaxLength)
+		}
+
+	case "unknown":
+		if _, ok := val.(map[string]any); !ok {
+			return fail("expected an object")
+		}
+
+	case "record":
+		return v.validate(path, d.Record, val)
+
+	default:
+		return fail("can not validate a value of type %q", d.Type)
+	}
+
+	return nil
+}
+
+func (v *Validator) validateObject(path string, d *Def, obj map[string]any) error {
+	nullable := make(map[string]bool)
+	for _, n := range d.Nullable {
+		nullable[n] = true
+	}
+
+	for _, r := range d.Required {
+		fv, ok := obj[r]
+		if !ok || (fv == nil && !nullable[r]) {
+			return &ValidationError{Path: path + "." + r, Msg: "required field is missing"}
+		}
+	}
+
+	// check in a stable order, so errors are reproducible
+	keys := make([]string, 0, len(d.Properties))
+	for k := range d.Properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		pd := d.Properties[k]
+		fv, ok := obj[k]
+		if !ok || fv == nil {
+			// null is the same as missing for optional fields, which is
+			// how the generated types serialize them
+			continue
+		}
+
+		if err := v.validate(path+"."+k, pd, fv); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (v *Validator) validateUnion(path string, d *Def, val any) error {
+	obj, ok := val.(map[string]any)
+	if !ok {
+		return &ValidationError{Path: path, Msg: "expected an object"}
+	}
+
+	t, ok := obj["$type"].(string)
+	if !ok || t == "" {
+		return &ValidationError{Path: path, Msg: "union member has no $type"}
+	}
+	t = strings.TrimSuffix(t, "#main")
+
+	for _, r := range d.Refs {
+		if fullRef(d.docID, r) != t {
+			continue
+		}
+
+		rd, ok := v.Catalog.Resolve(t)
+		if !ok {
+			return &ValidationError{Path: path, Msg: fmt.Sprintf("unknown ref %q", t)}
+		}
+		return v.validate(path, rd, obj)
+	}
+
+	if d.Closed {
+		return &ValidationError{Path: path, Msg: fmt.Sprintf("%q is not a member of the union", t)}
+	}
+
+	// open unions may contain anything, but we check what we can
+	rd, ok := v.Catalog.Resolve(t)
+	if !ok {
+		if v.Mode == Strict {
+			return &ValidationError{Path: path, Msg: fmt.Sprintf("unknown union member %q", t)}
+		}
+		return nil
+	}
+
+	return v.validate(path, rd, obj)
+}
+
+func (v *Validator) validateString(path string, d *Def, s string) error {
+	fail := func(format string, args ...any) error {
+		return &ValidationError{Path: path, Msg: fmt.Sprintf(format, args...)}
+	}
+
+	// lengths are in bytes of UTF-8
+	if d.MinLength != nil && len(s) < *d.MinLength {
+		return fail("must be at least %d bytes", *d.MinLength)
+	}
+	if d.MaxLength != nil && len(s) > *d.MaxLength {
+		return fail("must be at most %d bytes", *d.MaxLength)
+	}
+
+	if d.MinGraphemes != nil || d.MaxGraphemes != nil {
+		if !utf8.ValidString(s) {
+			return fail("invalid utf-8")
+		}
+		n := countGraphemes(s)
+		if d.MinGraphemes != nil && n < *d.MinGraphemes {
+			return fail("must be at least %d characters", *d.MinGraphemes)
+		}
+		if d.MaxGraphemes != nil && n > *d.MaxGraphemes {
+			return fail("must be at most %d characters", *d.MaxGraphemes)
+		}
+	}
+
+	if c, ok := d.Const.(string); ok && c != s {
+		return fail("must be %q", c)
+	}
+
+	if len(d.Enum) > 0 && !enumHas(d.Enum, func(e any) bool { return e == s }) {
+		return fail("%q is not an allowed value", s)
+	}
+
+	if d.Format != "" {
+		check, ok := formats[d.Format]
+		if !ok {
+			if v.Mode == Strict {
+				return fail("unknown string format %q", d.Format)
+			}
+			return nil
+		}
+		if err := check(s); err != nil {
+			return fail("invalid %s: %s", d.Format, err)
+		}
+	}
+
+	return nil
+}
+
+func (v *Validator) validateBlob(path string, d *Def, val any) error {
+	fail := func(format string, args ...any) error {
+		return &ValidationError{Path: path, Msg: fmt.Sprintf(format, args...)}
+	}
+
+	obj, ok := val.(map[string]any)
+	if !ok {
+		return fail("expected a blob")
+	}
+
+	mime, _ := obj["mimeType"].(string)
+	if mime == "" {
+		return fail("blob has no mimeType")
+	}
+
+	if obj["$type"] == "blob" {
+		ref, ok := obj["ref"].(map[string]any)
+		if !ok {
+			return fail("blob has no ref")
+		}
+		l, _ := ref["$link"].(string)
+		if _, err := cid.Decode(l); err != nil {
+			return fail("invalid blob ref: %s", err)
+		}
+
+		n, ok := obj["size"].(json.Number)
+		if !ok {
+			return fail("blob has no size")
+		}
+		size, err := n.Int64()
+		if err != nil || size < 0 {
+			return fail("invalid blob size")
+		}
+		if d.MaxSize != nil && size > *d.MaxSize {
+			return fail("blob is larger than %d bytes", *d.MaxSize)
+		}
+	} else {
+		if v.Mode == Strict {
+			return fail("legacy blobs are not allowed")
+		}
+		c, _ := obj["cid"].(string)
+		if _, err := cid.Decode(c); err != nil {
+			return fail("invalid blob cid: %s", err)
+		}
+	}
+
+	if len(d.Accept) > 0 && !acceptsMime(d.Accept, mime) {
+		return fail("blob type %q is not accepted", mime)
+	}
+
+	return nil
+}
+
+func acceptsMime(accept []string, mime string) bool {
+	for _, a := range accept {
+		if a == "*/*" || a == mime {
+			return true
+		}
+		if strings.HasSuffix(a, "/*") && strings.HasPrefix(mime, strings.TrimSuffix(a, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+func enumHas(enum []any, eq func(any) bool) bool {
+	for _, e := range enum {
+		if eq(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// numEquals compares a number from a schema (decoded as a float64) with an
+// integer value
+func numEquals(sv any, i int64) bool {
+	f, ok := sv.(float64)
+	return ok && f == float64(i)
+}
@@ -0,0 +1,196 @@
+package validate
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/api/bsky"
+)
+
+const testPostLexicon = `{
+  "lexicon": 1,
+  "id": "app.bsky.feed.post",
+  "defs": {
+    "main": {
+      "type": "record",
+      "key": "tid",
+      "record": {
+        "type": "object",
+        "required": ["text", "createdAt"],
+        "properties": {
+          "text": {"type": "string", "maxLength": 3000, "maxGraphemes": 300},
+          "createdAt": {"type": "string", "format": "datetime"},
+          "langs": {"type": "array", "maxLength": 3, "items": {"type": "string", "format": "language"}},
+          "reply": {"type": "ref", "ref": "#replyRef"},
+          "embed": {"type": "union", "refs": ["app.bsky.embed.images"]}
+        }
+      }
+    },
+    "replyRef": {
+      "type": "object",
+      "required": ["root", "parent"],
+      "properties": {
+        "root": {"type": "ref", "ref": "com.atproto.repo.strongRef"},
+        "parent": {"type": "ref", "ref": "com.atproto.repo.strongRef"}
+      }
+    }
+  }
+}`
+
+const testStrongRefLexicon = `{
+  "lexicon": 1,
+  "id": "com.atproto.repo.strongRef",
+  "defs": {
+    "main": {
+      "type": "object",
+      "required": ["uri", "cid"],
+      "properties": {
+        "uri": {"type": "string", "format": "at-uri"},
+        "cid": {"type": "string", "format": "cid"}
+      }
+    }
+  }
+}`
+
+const testImagesLexicon = `{
+  "lexicon": 1,
+  "id": "app.bsky.embed.images",
+  "defs": {
+    "main": {
+      "type": "object",
+      "required": ["images"],
+      "properties": {
+        "images": {"type": "array", "maxLength": 4, "items": {"type": "ref", "ref": "#image"}}
+      }
+    },
+    "image": {
+      "type": "object",
+      "required": ["image", "alt"],
+      "properties": {
+        "image": {"type": "blob", "accept": ["image/*"], "maxSize": 1000000},
+        "alt": {"type": "string"}
+      }
+    }
+  }
+}`
+
+func testCatalog(t *testing.T) *Catalog {
+	cat := NewCatalog()
+	for _, s := range []string{testPostLexicon, testStrongRefLexicon, testImagesLexicon} {
+		if err := cat.AddSchema([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cat
+}
+
+func TestValidateRecord(t *testing.T) {
+	v := NewValidator(testCatalog(t), Lenient)
+
+	good := &bsky.FeedPost{
+		LexiconTypeID: "app.bsky.feed.post",
+		Text:          "hello world",
+		CreatedAt:     "2023-04-01T12:00:00.000Z",
+		Langs:         []string{"en", "pt-BR"},
+		Reply: &bsky.FeedPost_ReplyRef{
+			Root:   &atproto.RepoStrongRef{Uri: "at://did:plc:abc/app.bsky.feed.post/3jzfcijpj2z2a", Cid: "bafyreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm"},
+			Parent: &atproto.RepoStrongRef{Uri: "at://did:plc:abc/app.bsky.feed.post/3jzfcijpj2z2a", Cid: "bafyreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm"},
+		},
+	}
+	if err := v.ValidateRecord("app.bsky.feed.post", good); err != nil {
+		t.Fatal(err)
+	}
+
+	withImage := map[string]any{
+		"$type":     "app.bsky.feed.post",
+		"text":      "look",
+		"createdAt": "2023-04-01T12:00:00Z",
+		"embed": map[string]any{
+			"$type": "app.bsky.embed.images",
+			"images": []any{map[string]any{
+				"alt": "a cat",
+				"image": map[string]any{
+					"$type":    "blob",
+					"ref":      map[string]any{"$link": "bafkreiblkobl6arfg3j7eft3akdhn2hmr2qmzfkefcgu4agnswvssg4a6a"},
+					"mimeType": "image/jpeg",
+					"size":     1234,
+				},
+			}},
+		},
+	}
+	if err := v.ValidateRecord("app.bsky.feed.post", withImage); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, rec := range map[string]map[string]any{
+		"missing text":  {"createdAt": "2023-04-01T12:00:00Z"},
+		"bad datetime":  {"text": "hi", "createdAt": "yesterday"},
+		"wrong type":    {"text": 5, "createdAt": "2023-04-01T12:00:00Z"},
+		"too many lang": {"text": "hi", "createdAt": "2023-04-01T12:00:00Z", "langs": []any{"en", "fr", "de", "es"}},
+		"bad reply":     {"text": "hi", "createdAt": "2023-04-01T12:00:00Z", "reply": map[string]any{"root": map[string]any{"uri": "http://x", "cid": "nope"}}},
+		"bad blob": {"text": "hi", "createdAt": "2023-04-01T12:00:00Z", "embed": map[string]any{
+			"$type": "app.bsky.embed.images",
+			"images": []any{map[string]any{"alt": "", "image": map[string]any{
+				"$type":    "blob",
+				"ref":      map[string]any{"$link": "bafkreiblkobl6arfg3j7eft3akdhn2hmr2qmzfkefcgu4agnswvssg4a6a"},
+				"mimeType": "video/mp4",
+				"size":     1234,
+			}}},
+		}},
+	} {
+		var verr *ValidationError
+		if err := v.ValidateRecord("app.bsky.feed.post", rec); !errors.As(err, &verr) {
+			t.Fatalf("%s: expected a validation error, got %v", name, err)
+		}
+	}
+}
+
+func TestGraphemeLength(t *testing.T) {
+	v := NewValidator(testCatalog(t), Lenient)
+
+	// each of these is three bytes but a single character
+	var text string
+	for i := 0; i < 300; i++ {
+		text += "e\u0301"
+	}
+	rec := map[string]any{"text": text, "createdAt": "2023-04-01T12:00:00Z"}
+	if err := v.ValidateRecord("app.bsky.feed.post", rec); err != nil {
+		t.Fatal(err)
+	}
+
+	rec["text"] = text + "b"
+	if err := v.ValidateRecord("app.bsky.feed.post", rec); err == nil {
+		t.Fatal("expected post over the grapheme limit to fail")
+	}
+
+	if n := countGraphemes("👩‍👩‍👧‍👦é👍🏽"); n != 3 {
+		t.Fatalf("expected 3 graphemes, got %d", n)
+	}
+}
+
+func TestModes(t *testing.T) {
+	cat := testCatalog(t)
+	lenient := NewValidator(cat, Lenient)
+	strict := NewValidator(cat, Strict)
+
+	unknown := map[string]any{"$type": "com.example.thing", "foo": "bar"}
+	if err := lenient.ValidateRecord("com.example.thing", unknown); err != nil {
+		t.Fatal(err)
+	}
+	if err := strict.ValidateRecord("com.example.thing", unknown); !errors.Is(err, ErrUnknownLexicon) {
+		t.Fatalf("expected unknown lexicon error, got %v", err)
+	}
+
+	openMember := map[string]any{
+		"text":      "hi",
+		"createdAt": "2023-04-01T12:00:00Z",
+		"embed":     map[string]any{"$type": "com.example.embed", "x": 1},
+	}
+	if err := lenient.ValidateRecord("app.bsky.feed.post", openMember); err != nil {
+		t.Fatal(err)
+	}
+	if err := strict.ValidateRecord("app.bsky.feed.post", openMember); err == nil {
+		t.Fatal("expected unknown union member to fail in strict mode")
+	}
+}
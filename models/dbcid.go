@@ -6,6 +6,8 @@ import (
 	"fmt"
 
 	"github.com/ipfs/go-cid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
 )
 
 // NB: copied from my estuary code
@@ -62,3 +64,12 @@ func (dbc *DbCID) UnmarshalJSON(b []byte) error {
 func (dbc *DbCID) GormDataType() string {
 	return "bytes"
 }
+
+// GormDBDataType gives mysql a sized column, as it can't index the longblob
+// columns "bytes" would otherwise be
+func (dbc *DbCID) GormDBDataType(db *gorm.DB, field *schema.Field) string {
+	if db.Dialector.Name() == "mysql" {
+		return "varbinary(128)"
+	}
+	return ""
+}
@@ -99,6 +99,14 @@ type FollowRecord struct {
 	Cid      string
 }
 
+type BlockRecord struct {
+	gorm.Model
+	Blocker Uid `gorm:"index"`
+	Target  Uid `gorm:"index"`
+	Rkey    string
+	Cid     string
+}
+
 type PDS struct {
 	gorm.Model
 
@@ -108,6 +116,9 @@ type PDS struct {
 	Cursor     int64
 	Registered bool
 	Blocked    bool
+	// Relay is set for upstreams which are relays, whose firehose carries the
+	// repos of many PDSs
+	Relay bool
 }
 
 func ClientForPds(pds *PDS) *xrpc.Client {
@@ -133,11 +144,90 @@ type Label struct {
 	Cid       *string `gorm:"uniqueIndex:idx_uri_src_val_cid"`
 	Neg       *bool
 	RepoRKey  *string `gorm:"uniqueIndex:idx_src_rkey"`
+	// Sig is the label's signature by its source, if it was signed
+	Sig       []byte
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// LabelerAllowEntry is a repo DID, or a PDS host, whose accounts a labeler
+// in allow-list mode processes the records of. Kind is "did" or "host".
+type LabelerAllowEntry struct {
+	ID        uint64 `gorm:"primaryKey"`
+	Kind      string `gorm:"uniqueIndex:idx_kind_value;not null"`
+	Value     string `gorm:"uniqueIndex:idx_kind_value;not null"`
 	CreatedAt time.Time
+}
+
+// LabelerListItem is a member of a moderation list whose members a labeler
+// labels, as last seen in the list owner's repo. Uri is that of the listitem
+// record, and Val the label the list's members get.
+type LabelerListItem struct {
+	ID         uint64 `gorm:"primaryKey"`
+	Uri        string `gorm:"uniqueIndex;not null"`
+	ListUri    string `gorm:"index;not null"`
+	SubjectDid string `gorm:"index:idx_list_item_subject_val;not null"`
+	Val        string `gorm:"index:idx_list_item_subject_val;not null"`
+	CreatedAt  time.Time
+}
+
+// LabelerHandle is the handle of an account, as last announced in a #handle
+// event seen by the labelmaker. Accounts without a valid handle have none.
+type LabelerHandle struct {
+	Did       string `gorm:"primaryKey"`
+	Handle    string `gorm:"index;not null"`
 	UpdatedAt time.Time
 }
 
+// ProfileVersion is a version of an account's profile, as seen by the
+// labelmaker. The Changed fields are whether each part of the profile differs
+// from the previous version seen, and are all false for the first one.
+type ProfileVersion struct {
+	ID                 uint64 `gorm:"primaryKey"`
+	Did                string `gorm:"index:idx_profile_did_created;not null"`
+	Cid                string `gorm:"not null"`
+	DisplayName        *string
+	Description        *string
+	AvatarCid          *string
+	DisplayNameChanged bool
+	DescriptionChanged bool
+	AvatarChanged      bool
+	CreatedAt          time.Time `gorm:"index:idx_profile_did_created"`
+}
+
 type DomainBan struct {
 	gorm.Model
 	Domain string
 }
+
+// SubscriberToken is an API key a firehose subscriber authenticates with,
+// so that it is known by name rather than by its address
+type SubscriberToken struct {
+	gorm.Model
+	Name  string `gorm:"uniqueIndex"`
+	Token string `gorm:"index"`
+}
+
+// SubscriberPolicy limits what an authenticated firehose subscriber is sent.
+// Subscriber is "token:" and the name of the subscriber's token, or the DID
+// it authenticated with through service auth. Collections and Repos are comma
+// separated, and empty for no filter.
+type SubscriberPolicy struct {
+	ID           uint64 `gorm:"primaryKey"`
+	Subscriber   string `gorm:"uniqueIndex;not null"`
+	Collections  string
+	Repos        string
+	BandwidthCap *int64
+	ReplayDepth  *int64
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// TIDClockMark is the high-water mark of a TID clock, in microseconds since
+// the Unix epoch: every TID the clock has generated is for a time before it,
+// so after a restart it carries on from there
+type TIDClockMark struct {
+	ClockID   uint `gorm:"primaryKey;autoIncrement:false"`
+	Mark      int64
+	UpdatedAt time.Time
+}
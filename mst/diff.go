@@ -17,188 +17,289 @@ type DiffOp struct {
 	NewCid cid.Cid
 }
 
-// TODO: this code isn't great, should be rewritten on top of the baseline datastructures once functional and correct
+// TreeDiff is the record level difference between two trees, along with the
+// tree nodes needed to prove it
+type TreeDiff struct {
+	// Ops are the record creations ("add"), updates ("mut") and deletions
+	// ("del") needed to get from the old tree to the new one, in key order
+	Ops []*DiffOp
+
+	// NewNodes are the CIDs of the nodes of the new tree that do not appear
+	// in the old one. Given the old tree, they (and the new record blocks)
+	// are sufficient to walk the new tree to every changed key, including
+	// the positions of deleted keys.
+	NewNodes []cid.Cid
+}
+
+// DiffTrees computes the record level diff between two trees. Either root may
+// be cid.Undef, which is treated as an empty tree.
 func DiffTrees(ctx context.Context, bs blockstore.Blockstore, from, to cid.Cid) ([]*DiffOp, error) {
+	d, err := DiffTreesWithProof(ctx, bs, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.Ops, nil
+}
+
+// DiffTreesWithProof computes the record level diff between two trees, and
+// collects the nodes that cover it. Subtrees that are the same in both trees
+// are skipped without being loaded.
+func DiffTreesWithProof(ctx context.Context, bs blockstore.Blockstore, from, to cid.Cid) (*TreeDiff, error) {
 	cst := util.CborStore(bs)
 
-	if from == cid.Undef {
-		return identityDiff(ctx, bs, to)
+	// an undefined root is an empty tree; we don't bother loading one as it
+	// would not be in the blockstore
+	var fw, tw *treeWalker
+	var err error
+	if from.Defined() {
+		fw, err = newTreeWalker(ctx, LoadMST(cst, from))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		fw = &treeWalker{}
+	}
+
+	if to.Defined() {
+		tw, err = newTreeWalker(ctx, LoadMST(cst, to))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		tw = &treeWalker{}
 	}
 
-	ft := LoadMST(cst, from)
-	tt := LoadMST(cst, to)
+	out := &TreeDiff{}
 
-	fents, err := ft.getEntries(ctx)
-	if err != nil {
-		return nil, err
+	// stepping into a node of the new tree means its contents differ from
+	// the old tree, so it is part of the proof
+	stepIntoNew := func() error {
+		ptr, err := tw.curr().Tree.GetPointer(ctx)
+		if err != nil {
+			return err
+		}
+		out.NewNodes = append(out.NewNodes, ptr)
+
+		return tw.stepInto(ctx)
 	}
 
-	tents, err := tt.getEntries(ctx)
-	if err != nil {
-		return nil, err
+	added := func(e nodeEntry) {
+		out.Ops = append(out.Ops, &DiffOp{
+			Op:     "add",
+			Rpath:  e.Key,
+			NewCid: e.Val,
+		})
 	}
 
-	var ixf, ixt int
-	var out []*DiffOp
-	for ixf < len(fents) && ixt < len(tents) {
-		ef := fents[ixf]
-		et := tents[ixt]
+	deleted := func(e nodeEntry) {
+		out.Ops = append(out.Ops, &DiffOp{
+			Op:     "del",
+			Rpath:  e.Key,
+			OldCid: e.Val,
+		})
+	}
 
-		if nodeEntriesEqual(&ef, &et) {
-			ixf++
-			ixt++
-			continue
-		}
+	for !fw.done() && !tw.done() {
+		ef := fw.curr()
+		et := tw.curr()
 
+		// if both are leaves, record the change for the lowest key and walk
+		// that side forward
 		if ef.isLeaf() && et.isLeaf() {
-			if ef.Key == et.Key {
-				if ef.Val == et.Val {
-					return nil, fmt.Errorf("hang on, why are these leaves equal?")
+			switch {
+			case ef.Key == et.Key:
+				if ef.Val != et.Val {
+					out.Ops = append(out.Ops, &DiffOp{
+						Op:     "mut",
+						Rpath:  ef.Key,
+						OldCid: ef.Val,
+						NewCid: et.Val,
+					})
 				}
-
-				out = append(out, &DiffOp{
-					Op:     "mut",
-					Rpath:  ef.Key,
-					OldCid: ef.Val,
-					NewCid: et.Val,
-				})
-				ixf++
-				ixt++
-				continue
+				fw.advance()
+				tw.advance()
+			case ef.Key < et.Key:
+				deleted(ef)
+				fw.advance()
+			default:
+				added(et)
+				tw.advance()
 			}
-			// different keys... what do?
-
-			// if the 'to' key is earlier than the 'from' key, call it an insert
-			// otherwise call it a deletion?
-
-			if ef.Key > et.Key {
-				out = append(out, &DiffOp{
-					Op:     "add",
-					Rpath:  et.Key,
-					NewCid: et.Val,
-				})
-				// only walk forward the pointer that was 'behind'
-				ixt++
+			continue
+		}
+
+		// next, get both sides onto the same layer. If the higher side is at
+		// a tree, step into it. If it is at a leaf, that leaf can not be
+		// within the subtree the lower side is at, so walk through that
+		// instead.
+		if fw.layer() > tw.layer() {
+			if ef.isLeaf() {
+				err = stepIntoNew()
 			} else {
-				out = append(out, &DiffOp{
-					Op:     "del",
-					Rpath:  ef.Key,
-					OldCid: ef.Val,
-				})
-				// only walk forward the pointer that was 'behind'
-				ixf++
+				err = fw.stepInto(ctx)
+			}
+			if err != nil {
+				return nil, err
 			}
-
-			// call it an insertion?
 			continue
 		}
 
-		if ef.isTree() {
-			sub, err := ef.Tree.getEntries(ctx)
+		if tw.layer() > fw.layer() {
+			if et.isLeaf() {
+				err = fw.stepInto(ctx)
+			} else {
+				err = stepIntoNew()
+			}
 			if err != nil {
 				return nil, err
 			}
-
-			fents = append(sub, fents[ixf+1:]...)
-			ixf = 0
 			continue
 		}
 
-		if et.isTree() {
-			sub, err := et.Tree.getEntries(ctx)
+		// on the same layer, identical subtrees can be skipped entirely
+		if ef.isTree() && et.isTree() {
+			fptr, err := ef.Tree.GetPointer(ctx)
+			if err != nil {
+				return nil, err
+			}
+			tptr, err := et.Tree.GetPointer(ctx)
 			if err != nil {
 				return nil, err
 			}
 
-			tents = append(sub, tents[ixt+1:]...)
-			ixt = 0
+			if fptr == tptr {
+				fw.advance()
+				tw.advance()
+				continue
+			}
+
+			if err := fw.stepInto(ctx); err != nil {
+				return nil, err
+			}
+			if err := stepIntoNew(); err != nil {
+				return nil, err
+			}
 			continue
 		}
-	}
-
-	for ; ixf < len(fents); ixf++ {
-		// deletions
 
-		e := fents[ixf]
-		if e.isLeaf() {
-			out = append(out, &DiffOp{
-				Op:     "del",
-				Rpath:  e.Key,
-				OldCid: e.Val,
-			})
-
-		} else if e.isTree() {
-			if err := e.Tree.WalkLeavesFrom(ctx, "", func(key string, val cid.Cid) error {
-				out = append(out, &DiffOp{
-					Op:     "del",
-					Rpath:  key,
-					OldCid: val,
-				})
-				return nil
-			}); err != nil {
+		// otherwise one side is a tree and the other a leaf, look inside the
+		// tree
+		if ef.isTree() {
+			if err := fw.stepInto(ctx); err != nil {
 				return nil, err
 			}
+		} else if err := stepIntoNew(); err != nil {
+			return nil, err
 		}
 	}
 
-	for ; ixt < len(tents); ixt++ {
-		// insertions
+	// whatever is left on either side was removed or added
+	for !fw.done() {
+		e := fw.curr()
+		if e.isLeaf() {
+			deleted(e)
+			fw.advance()
+		} else if err := fw.stepInto(ctx); err != nil {
+			return nil, err
+		}
+	}
 
-		e := tents[ixt]
+	for !tw.done() {
+		e := tw.curr()
 		if e.isLeaf() {
-			out = append(out, &DiffOp{
-				Op:     "add",
-				Rpath:  e.Key,
-				NewCid: e.Val,
-			})
-
-		} else if e.isTree() {
-			if err := e.Tree.WalkLeavesFrom(ctx, "", func(key string, val cid.Cid) error {
-				out = append(out, &DiffOp{
-					Op:     "add",
-					Rpath:  key,
-					NewCid: val,
-				})
-				return nil
-			}); err != nil {
-				return nil, err
-			}
+			added(e)
+			tw.advance()
+		} else if err := stepIntoNew(); err != nil {
+			return nil, err
 		}
 	}
 
 	return out, nil
 }
 
-func nodeEntriesEqual(a, b *nodeEntry) bool {
-	if !(a.Key == b.Key && a.Val == b.Val) {
-		return false
-	}
+type walkerFrame struct {
+	entries []nodeEntry
+	ix      int
+	layer   int
+}
 
-	if a.Tree == nil && b.Tree == nil {
-		return true
-	}
+// treeWalker walks the entries of a tree in key order, optionally stepping
+// into subtrees
+type treeWalker struct {
+	stack []*walkerFrame
+}
 
-	if a.Tree != nil && b.Tree != nil && a.Tree.pointer == b.Tree.pointer {
-		return true
+// newTreeWalker returns a walker positioned at the root of the tree, so that
+// it may be compared with (and skipped over) as a whole
+func newTreeWalker(ctx context.Context, root *MerkleSearchTree) (*treeWalker, error) {
+	layer, err := root.getLayer(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	return false
+	return &treeWalker{
+		stack: []*walkerFrame{{
+			entries: []nodeEntry{mkTreeEntry(root)},
+			layer:   layer + 1,
+		}},
+	}, nil
 }
 
-func identityDiff(ctx context.Context, bs blockstore.Blockstore, root cid.Cid) ([]*DiffOp, error) {
-	cst := util.CborStore(bs)
-	tt := LoadMST(cst, root)
+func (tw *treeWalker) done() bool {
+	return len(tw.stack) == 0
+}
 
-	var ops []*DiffOp
-	if err := tt.WalkLeavesFrom(ctx, "", func(key string, val cid.Cid) error {
-		ops = append(ops, &DiffOp{
-			Op:     "add",
-			Rpath:  key,
-			NewCid: val,
-		})
+func (tw *treeWalker) top() *walkerFrame {
+	return tw.stack[len(tw.stack)-1]
+}
+
+func (tw *treeWalker) curr() nodeEntry {
+	top := tw.top()
+	return top.entries[top.ix]
+}
+
+// layer is the layer of the node the current entry is in
+func (tw *treeWalker) layer() int {
+	return tw.top().layer
+}
+
+// advance moves past the current entry (without stepping into it, if it is
+// a subtree)
+func (tw *treeWalker) advance() {
+	for !tw.done() {
+		top := tw.top()
+		top.ix++
+		if top.ix < len(top.entries) {
+			return
+		}
+
+		// finished this node, move past it in its parent
+		tw.stack = tw.stack[:len(tw.stack)-1]
+	}
+}
+
+// stepInto moves to the first entry of the current subtree
+func (tw *treeWalker) stepInto(ctx context.Context) error {
+	e := tw.curr()
+	if !e.isTree() {
+		return fmt.Errorf("can only step into tree entries")
+	}
+
+	entries, err := e.Tree.getEntries(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(entries) == 0 {
+		tw.advance()
 		return nil
-	}); err != nil {
-		return nil, err
 	}
-	return ops, nil
+
+	tw.stack = append(tw.stack, &walkerFrame{
+		entries: entries,
+		layer:   tw.layer() - 1,
+	})
+
+	return nil
 }
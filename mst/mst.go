@@ -985,4 +985,44 @@ func (mst *MerkleSearchTree) WalkLeavesFrom(ctx context.Context, from string, cb
 // TODO: Typescript: MST.reachableLeaves() -> Leaf[]
 
 // TODO: Typescript: MST.writeToCarStream(car) -> ()
-// TODO: Typescript: MST.cidsForPath(car) -> CID[]
+
+// CidsForPath returns the CIDs of the nodes on the path to a key, followed by
+// the value at that key if it exists. Together these blocks prove the
+// membership or non-membership of the key.
+// Typescript: MST.cidsForPath(car) -> CID[]
+func (mst *MerkleSearchTree) CidsForPath(ctx context.Context, key string) ([]cid.Cid, error) {
+	ptr, err := mst.GetPointer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cids := []cid.Cid{ptr}
+
+	index, err := mst.findGtOrEqualLeafIndex(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	found, err := mst.atIndex(index)
+	if err != nil {
+		return nil, err
+	}
+
+	if !found.isUndefined() && found.isLeaf() && found.Key == key {
+		return append(cids, found.Val), nil
+	}
+
+	prev, err := mst.atIndex(index - 1)
+	if err != nil {
+		return nil, err
+	}
+
+	if !prev.isUndefined() && prev.isTree() {
+		sub, err := prev.Tree.CidsForPath(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		return append(cids, sub...), nil
+	}
+
+	return cids, nil
+}
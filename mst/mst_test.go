@@ -633,3 +633,95 @@ func BenchmarkCountPrefixLen(b *testing.B) {
 		}
 	}
 }
+
+func treeNodes(t testing.TB, tree *MerkleSearchTree) []cid.Cid {
+	ptr := mustCidTree(t, tree)
+	out := []cid.Cid{ptr}
+
+	ents, err := tree.getEntries(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range ents {
+		if e.isTree() {
+			out = append(out, treeNodes(t, e.Tree)...)
+		}
+	}
+
+	return out
+}
+
+func TestDiffProof(t *testing.T) {
+	ctx := context.TODO()
+
+	a := map[string]string{}
+	for i := int64(0); i < 1000; i++ {
+		a[randKey(i)] = randStr(72385739 - i)
+	}
+
+	b := maps.Clone(a)
+	for i := int64(0); i < 5; i++ {
+		b[randKey(5000+i)] = randStr(2293825 - i)
+		delete(b, randKey(i*100))
+		b[randKey(i*100+1)] = randStr(1234 + i)
+	}
+
+	bs := memBs()
+	msta := cidMapToMst(t, bs, mapToCidMap(a))
+	mstb := cidMapToMst(t, bs, mapToCidMap(b))
+	cida := mustCidTree(t, msta)
+	cidb := mustCidTree(t, mstb)
+
+	diff, err := DiffTreesWithProof(ctx, bs, cida, cidb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !compareDiffs(diff.Ops, diffMaps(mapToCidMap(a), mapToCidMap(b))) {
+		t.Fatal("diffs not equal")
+	}
+
+	oldNodes := treeNodes(t, LoadMST(util.CborStore(bs), cida))
+	if len(diff.NewNodes) == 0 || len(diff.NewNodes) >= len(treeNodes(t, LoadMST(util.CborStore(bs), cidb))) {
+		t.Fatalf("expected proof to be a strict subset of the new tree, got %d nodes", len(diff.NewNodes))
+	}
+
+	// the old tree and the proof should be enough to look up every change
+	// in the new tree
+	pbs := memBs()
+	for _, c := range append(oldNodes, diff.NewNodes...) {
+		blk, err := bs.Get(ctx, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pbs.Put(ctx, blk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pt := LoadMST(util.CborStore(pbs), cidb)
+	for _, op := range diff.Ops {
+		val, err := pt.Get(ctx, op.Rpath)
+		switch op.Op {
+		case "del":
+			if err != ErrNotFound {
+				t.Fatalf("expected %s to be deleted: %v", op.Rpath, err)
+			}
+		default:
+			if err != nil {
+				t.Fatal(err)
+			}
+			if val != op.NewCid {
+				t.Fatalf("wrong value for %s", op.Rpath)
+			}
+		}
+	}
+
+	same, err := DiffTreesWithProof(ctx, bs, cidb, cidb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(same.Ops) != 0 || len(same.NewNodes) != 0 {
+		t.Fatal("expected no diff between identical trees")
+	}
+}
@@ -0,0 +1,147 @@
+package mst
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+)
+
+// NodeBounds constrain the contents of a tree node, as determined by the
+// nodes above it
+type NodeBounds struct {
+	// Layer is the layer the keys of the node must be on, or -1 if not yet
+	// known (for the root of a tree)
+	Layer int
+
+	// After and Before are the (exclusive) range the keys of the node must
+	// fall within. An empty bound is open.
+	After  string
+	Before string
+}
+
+// RootBounds are the bounds for the root node of a tree
+var RootBounds = NodeBounds{Layer: -1}
+
+// SubtreeRef is a link from a checked node to one of its subtrees
+type SubtreeRef struct {
+	Cid    cid.Cid
+	Bounds NodeBounds
+}
+
+// LeafRef is a key/value pair in a checked node
+type LeafRef struct {
+	Key string
+	Val cid.Cid
+}
+
+// CheckNode decodes a serialized tree node and checks that it is well formed
+// given its bounds: keys must be valid, sorted, within bounds and all on the
+// node's layer, and empty nodes may only appear where needed to skip a layer.
+// It returns the node's subtrees, along with the bounds each must be checked
+// against, and its leaves. This allows a tree to be validated one node at a
+// time, without loading it.
+func CheckNode(raw []byte, b NodeBounds) ([]SubtreeRef, []LeafRef, error) {
+	var nd nodeData
+	if err := nd.UnmarshalCBOR(bytes.NewReader(raw)); err != nil {
+		return nil, nil, fmt.Errorf("decoding tree node: %w", err)
+	}
+
+	isRoot := b.Layer < 0
+
+	if len(nd.Entries) == 0 {
+		switch {
+		case nd.Left == nil && isRoot:
+			// the empty tree
+			return nil, nil, nil
+		case nd.Left == nil:
+			return nil, nil, fmt.Errorf("empty tree node below the root")
+		case isRoot:
+			return nil, nil, fmt.Errorf("root tree node has no keys")
+		case b.Layer == 0:
+			return nil, nil, fmt.Errorf("tree node at layer 0 has a subtree")
+		}
+
+		return []SubtreeRef{{
+			Cid:    *nd.Left,
+			Bounds: NodeBounds{Layer: b.Layer - 1, After: b.After, Before: b.Before},
+		}}, nil, nil
+	}
+
+	var subtrees []SubtreeRef
+	var leaves []LeafRef
+
+	layer := b.Layer
+	var lastKey string
+	for i, e := range nd.Entries {
+		if e.PrefixLen < 0 || int(e.PrefixLen) > len(lastKey) || (i == 0 && e.PrefixLen != 0) {
+			return nil, nil, fmt.Errorf("invalid key prefix length %d", e.PrefixLen)
+		}
+
+		key := lastKey[:e.PrefixLen] + string(e.KeySuffix)
+		if err := ensureValidMstKey(key); err != nil {
+			return nil, nil, err
+		}
+
+		if i > 0 && key <= lastKey {
+			return nil, nil, fmt.Errorf("tree node keys out of order at %q", key)
+		}
+
+		if (b.After != "" && key <= b.After) || (b.Before != "" && key >= b.Before) {
+			return nil, nil, fmt.Errorf("key %q is outside of its subtree", key)
+		}
+
+		kl := leadingZerosOnHash(key)
+		if layer < 0 {
+			layer = kl
+		}
+		if kl != layer {
+			return nil, nil, fmt.Errorf("key %q belongs on layer %d, not %d", key, kl, layer)
+		}
+
+		if !e.Val.Defined() {
+			return nil, nil, fmt.Errorf("key %q has no value", key)
+		}
+
+		leaves = append(leaves, LeafRef{Key: key, Val: e.Val})
+		lastKey = key
+	}
+
+	if layer == 0 && (nd.Left != nil || hasEntrySubtree(nd.Entries)) {
+		return nil, nil, fmt.Errorf("tree node at layer 0 has a subtree")
+	}
+
+	if nd.Left != nil {
+		subtrees = append(subtrees, SubtreeRef{
+			Cid:    *nd.Left,
+			Bounds: NodeBounds{Layer: layer - 1, After: b.After, Before: leaves[0].Key},
+		})
+	}
+
+	for i, e := range nd.Entries {
+		if e.Tree == nil {
+			continue
+		}
+
+		before := b.Before
+		if i+1 < len(leaves) {
+			before = leaves[i+1].Key
+		}
+
+		subtrees = append(subtrees, SubtreeRef{
+			Cid:    *e.Tree,
+			Bounds: NodeBounds{Layer: layer - 1, After: leaves[i].Key, Before: before},
+		})
+	}
+
+	return subtrees, leaves, nil
+}
+
+func hasEntrySubtree(ents []treeEntry) bool {
+	for _, e := range ents {
+		if e.Tree != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -2,7 +2,9 @@ package notifs
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
 	appbskytypes "github.com/bluesky-social/indigo/api/bsky"
@@ -15,22 +17,39 @@ import (
 )
 
 type NotificationManager interface {
-	GetNotifications(ctx context.Context, user models.Uid) ([]*appbskytypes.NotificationListNotifications_Notification, error)
-	GetCount(ctx context.Context, user models.Uid) (int64, error)
+	// GetNotifications returns a page of a user's notifications, newest
+	// first, and the cursor of the next page, which is empty after the last
+	GetNotifications(ctx context.Context, user models.Uid, cursor string, limit int) ([]*appbskytypes.NotificationListNotifications_Notification, string, error)
+
+	// GetCount returns the number of notifications a user has not seen: those
+	// since seenAt, or since they last updated their seen time if seenAt is
+	// zero
+	GetCount(ctx context.Context, user models.Uid, seenAt time.Time) (int64, error)
 	UpdateSeen(ctx context.Context, usr models.Uid, seen time.Time) error
 	AddReplyTo(ctx context.Context, user models.Uid, replyid uint, replyto *models.FeedPost) error
 	AddMention(ctx context.Context, user models.Uid, postid uint, mentioned models.Uid) error
+	AddQuote(ctx context.Context, user models.Uid, postid uint, quoted *models.FeedPost) error
 	AddUpVote(ctx context.Context, voter models.Uid, postid uint, voteid uint, postauthor models.Uid) error
 	AddFollow(ctx context.Context, follower, followed models.Uid, recid uint) error
 	AddRepost(ctx context.Context, op models.Uid, repost uint, reposter models.Uid) error
+
+	// Prune deletes the notifications created before a time, returning how
+	// many there were
+	Prune(ctx context.Context, before time.Time) (int64, error)
 }
 
+// ErrInvalidCursor is returned for cursors which no page of notifications
+// gave
+var ErrInvalidCursor = errors.New("invalid notifications cursor")
+
 var _ NotificationManager = (*DBNotifMan)(nil)
 
 type DBNotifMan struct {
 	db *gorm.DB
 
 	getRecord GetRecord
+
+	isLocal func(ctx context.Context, user models.Uid) (bool, error)
 }
 type GetRecord func(ctx context.Context, user models.Uid, collection string, rkey string, maybeCid cid.Cid) (cid.Cid, cbg.CBORMarshaler, error)
 
@@ -45,17 +64,25 @@ func NewNotificationManager(db *gorm.DB, getrec GetRecord) *DBNotifMan {
 	}
 }
 
+// SetLocalFilter limits notifications to the users isLocal accepts, such as
+// the accounts hosted by a PDS, which are the only ones who can list them.
+// Without one, notifications are kept for everyone.
+func (nm *DBNotifMan) SetLocalFilter(isLocal func(ctx context.Context, user models.Uid) (bool, error)) {
+	nm.isLocal = isLocal
+}
+
 const (
 	NotifKindReply   = 1
 	NotifKindMention = 2
 	NotifKindUpVote  = 3
 	NotifKindFollow  = 4
 	NotifKindRepost  = 5
+	NotifKindQuote   = 6
 )
 
 type NotifRecord struct {
 	gorm.Model
-	For     models.Uid
+	For     models.Uid `gorm:"index"`
 	Kind    int64
 	Record  uint
 	Who     models.Uid
@@ -79,34 +106,45 @@ type HydratedNotification struct {
 	ReasonSubject *string
 }
 
-func (nm *DBNotifMan) GetNotifications(ctx context.Context, user models.Uid) ([]*appbskytypes.NotificationListNotifications_Notification, error) {
+func (nm *DBNotifMan) lastSeen(user models.Uid) (time.Time, error) {
 	var lastSeen time.Time
 	if err := nm.db.Model(NotifSeen{}).Where("usr = ?", user).Select("last_seen").Scan(&lastSeen).Error; err != nil {
-		return nil, err
+		return time.Time{}, err
 	}
+	return lastSeen, nil
+}
 
-	var notifs []NotifRecord
-	if err := nm.db.Order("created_at desc").Find(&notifs, "for = ?", user).Error; err != nil {
-		return nil, err
+func (nm *DBNotifMan) GetNotifications(ctx context.Context, user models.Uid, cursor string, limit int) ([]*appbskytypes.NotificationListNotifications_Notification, string, error) {
+	lastSeen, err := nm.lastSeen(user)
+	if err != nil {
+		return nil, "", err
 	}
 
-	/*
-		Record        any                `json:"record" cborgen:"record"`
-		IsRead        bool               `json:"isRead" cborgen:"isRead"`
-		IndexedAt     string             `json:"indexedAt" cborgen:"indexedAt"`
-		Uri           string             `json:"uri" cborgen:"uri"`
-		Cid           string             `json:"cid" cborgen:"cid"`
-		Author        *ActorRef_WithInfo `json:"author" cborgen:"author"`
-		Reason        string             `json:"reason" cborgen:"reason"`
-		ReasonSubject *string            `json:"reasonSubject" cborgen:"reasonSubject"`
-	*/
+	// the cursor is the ID of the last notification of the previous page
+	q := nm.db.Where(`"for" = ?`, user)
+	if cursor != "" {
+		before, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+		q = q.Where("id < ?", before)
+	}
+
+	var notifs []NotifRecord
+	if err := q.Order("id desc").Limit(limit).Find(&notifs).Error; err != nil {
+		return nil, "", err
+	}
 
 	out := []*appbskytypes.NotificationListNotifications_Notification{}
 
 	for _, n := range notifs {
 		hn, err := nm.hydrateNotification(ctx, &n, lastSeen)
 		if err != nil {
-			return nil, err
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				// the record, or what it was about, has since been deleted
+				continue
+			}
+			return nil, "", err
 		}
 
 		// TODO: muting
@@ -114,24 +152,29 @@ func (nm *DBNotifMan) GetNotifications(ctx context.Context, user models.Uid) ([]
 
 		out = append(out, hn)
 	}
-	return out, nil
+
+	var next string
+	if len(notifs) == limit && limit > 0 {
+		next = strconv.FormatUint(uint64(notifs[len(notifs)-1].ID), 10)
+	}
+	return out, next, nil
 }
 
 func (nm *DBNotifMan) hydrateNotification(ctx context.Context, nrec *NotifRecord, lastSeen time.Time) (*appbskytypes.NotificationListNotifications_Notification, error) {
 
 	switch nrec.Kind {
 	case NotifKindReply:
-		return nm.hydrateNotificationReply(ctx, nrec, lastSeen)
+		return nm.hydrateNotificationPost(ctx, nrec, lastSeen, "reply")
+	case NotifKindMention:
+		return nm.hydrateNotificationPost(ctx, nrec, lastSeen, "mention")
+	case NotifKindQuote:
+		return nm.hydrateNotificationPost(ctx, nrec, lastSeen, "quote")
 	case NotifKindFollow:
 		return nm.hydrateNotificationFollow(ctx, nrec, lastSeen)
 	case NotifKindUpVote:
 		return nm.hydrateNotificationUpVote(ctx, nrec, lastSeen)
 	case NotifKindRepost:
 		return nm.hydrateNotificationRepost(ctx, nrec, lastSeen)
-		/*
-			case NotifKindMention:
-				return nm.hydrateNotificationMention(ctx, nrec, lastSeen)
-		*/
 	default:
 		return nil, fmt.Errorf("attempted to hydrate unknown notif kind: %d", nrec.Kind)
 	}
@@ -145,9 +188,24 @@ func (nm *DBNotifMan) getActor(ctx context.Context, act models.Uid) (*models.Act
 	return &ai, nil
 }
 
+// postUri returns the at:// URI of a post, which is not deleted
+func (nm *DBNotifMan) postUri(ctx context.Context, postid uint) (string, *models.FeedPost, error) {
+	var fp models.FeedPost
+	if err := nm.db.First(&fp, "id = ? AND NOT deleted", postid).Error; err != nil {
+		return "", nil, err
+	}
+
+	author, err := nm.getActor(ctx, fp.Author)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return "at://" + author.Did + "/app.bsky.feed.post/" + fp.Rkey, &fp, nil
+}
+
 func (nm *DBNotifMan) hydrateNotificationUpVote(ctx context.Context, nrec *NotifRecord, lastSeen time.Time) (*appbskytypes.NotificationListNotifications_Notification, error) {
-	var votedOn models.FeedPost
-	if err := nm.db.First(&votedOn, "id = ?", nrec.Record).Error; err != nil {
+	rsub, _, err := nm.postUri(ctx, nrec.ReplyTo)
+	if err != nil {
 		return nil, err
 	}
 
@@ -161,43 +219,36 @@ func (nm *DBNotifMan) hydrateNotificationUpVote(ctx context.Context, nrec *Notif
 		return nil, err
 	}
 
-	_, rec, err := nm.getRecord(ctx, voter.Uid, "app.bsky.feed.vote", vote.Rkey, cid.Undef)
+	_, rec, err := nm.getRecord(ctx, voter.Uid, "app.bsky.feed.like", vote.Rkey, cid.Undef)
 	if err != nil {
-		return nil, fmt.Errorf("getting vote: %w", err)
+		return nil, fmt.Errorf("getting like: %w", err)
 	}
 
-	postAuthor, err := nm.getActor(ctx, votedOn.Author)
-	if err != nil {
-		return nil, err
-	}
-
-	rsub := "at://" + postAuthor.Did + "/app.bsky.feed.post/" + votedOn.Rkey
-
 	return &appbskytypes.NotificationListNotifications_Notification{
 		Record:        &lexutil.LexiconTypeDecoder{Val: rec},
 		IsRead:        nrec.CreatedAt.Before(lastSeen),
 		IndexedAt:     nrec.CreatedAt.Format(time.RFC3339),
-		Uri:           "at://" + voter.Did + "/app.bsky.feed.vote/" + vote.Rkey,
+		Uri:           "at://" + voter.Did + "/app.bsky.feed.like/" + vote.Rkey,
 		Cid:           vote.Cid,
 		Author:        voter.ActorView(),
-		Reason:        "vote",
+		Reason:        "like",
 		ReasonSubject: &rsub,
 	}, nil
 }
 
 func (nm *DBNotifMan) hydrateNotificationRepost(ctx context.Context, nrec *NotifRecord, lastSeen time.Time) (*appbskytypes.NotificationListNotifications_Notification, error) {
-	var reposted models.FeedPost
-	if err := nm.db.First(&reposted, "id = ?", nrec.Record).Error; err != nil {
+	var repost models.RepostRecord
+	if err := nm.db.First(&repost, "id = ?", nrec.Record).Error; err != nil {
 		return nil, err
 	}
 
-	reposter, err := nm.getActor(ctx, nrec.Who)
+	rsub, _, err := nm.postUri(ctx, repost.Post)
 	if err != nil {
 		return nil, err
 	}
 
-	var repost models.RepostRecord
-	if err := nm.db.First(&repost, "id = ?", nrec.Record).Error; err != nil {
+	reposter, err := nm.getActor(ctx, nrec.Who)
+	if err != nil {
 		return nil, err
 	}
 
@@ -206,13 +257,6 @@ func (nm *DBNotifMan) hydrateNotificationRepost(ctx context.Context, nrec *Notif
 		return nil, fmt.Errorf("getting repost: %w", err)
 	}
 
-	postAuthor, err := nm.getActor(ctx, repost.Author)
-	if err != nil {
-		return nil, err
-	}
-
-	rsub := "at://" + postAuthor.Did + "/app.bsky.feed.post/" + reposted.Rkey
-
 	return &appbskytypes.NotificationListNotifications_Notification{
 		Record:        &lexutil.LexiconTypeDecoder{rec},
 		IsRead:        nrec.CreatedAt.Before(lastSeen),
@@ -225,25 +269,27 @@ func (nm *DBNotifMan) hydrateNotificationRepost(ctx context.Context, nrec *Notif
 	}, nil
 }
 
-func (nm *DBNotifMan) hydrateNotificationReply(ctx context.Context, nrec *NotifRecord, lastSeen time.Time) (*appbskytypes.NotificationListNotifications_Notification, error) {
-	var fp models.FeedPost
-	if err := nm.db.First(&fp, "id = ?", nrec.Record).Error; err != nil {
-		return nil, err
-	}
-
-	var replyTo models.FeedPost
-	if err := nm.db.First(&replyTo, "id = ?", nrec.ReplyTo).Error; err != nil {
+// hydrateNotificationPost hydrates the notifications which are posts:
+// replies, mentions and quotes. Replies and quotes have the post they are
+// about as their subject.
+func (nm *DBNotifMan) hydrateNotificationPost(ctx context.Context, nrec *NotifRecord, lastSeen time.Time, reason string) (*appbskytypes.NotificationListNotifications_Notification, error) {
+	uri, fp, err := nm.postUri(ctx, nrec.Record)
+	if err != nil {
 		return nil, err
 	}
 
-	var author models.ActorInfo
-	if err := nm.db.First(&author, "id = ?", fp.Author).Error; err != nil {
+	author, err := nm.getActor(ctx, fp.Author)
+	if err != nil {
 		return nil, err
 	}
 
-	var opAuthor models.ActorInfo
-	if err := nm.db.First(&opAuthor, "id = ?", replyTo.Author).Error; err != nil {
-		return nil, err
+	var rsub *string
+	if nrec.ReplyTo != 0 {
+		subj, _, err := nm.postUri(ctx, nrec.ReplyTo)
+		if err != nil {
+			return nil, err
+		}
+		rsub = &subj
 	}
 
 	_, rec, err := nm.getRecord(ctx, author.Uid, "app.bsky.feed.post", fp.Rkey, cid.Undef)
@@ -251,17 +297,15 @@ func (nm *DBNotifMan) hydrateNotificationReply(ctx context.Context, nrec *NotifR
 		return nil, err
 	}
 
-	rsub := "at://" + opAuthor.Did + "/app.bsky.feed.post/" + replyTo.Rkey
-
 	return &appbskytypes.NotificationListNotifications_Notification{
 		Record:        &lexutil.LexiconTypeDecoder{rec},
 		IsRead:        nrec.CreatedAt.Before(lastSeen),
 		IndexedAt:     nrec.CreatedAt.Format(time.RFC3339),
-		Uri:           "at://" + author.Did + "/app.bsky.feed.post/" + fp.Rkey,
+		Uri:           uri,
 		Cid:           fp.Cid,
 		Author:        author.ActorView(),
-		Reason:        "reply",
-		ReasonSubject: &rsub,
+		Reason:        reason,
+		ReasonSubject: rsub,
 	}, nil
 }
 
@@ -271,8 +315,8 @@ func (nm *DBNotifMan) hydrateNotificationFollow(ctx context.Context, nrec *Notif
 		return nil, err
 	}
 
-	var follower models.ActorInfo
-	if err := nm.db.First(&follower, "id = ?", nrec.Who).Error; err != nil {
+	follower, err := nm.getActor(ctx, nrec.Who)
+	if err != nil {
 		return nil, err
 	}
 
@@ -293,16 +337,18 @@ func (nm *DBNotifMan) hydrateNotificationFollow(ctx context.Context, nrec *Notif
 
 }
 
-func (nm *DBNotifMan) GetCount(ctx context.Context, user models.Uid) (int64, error) {
+func (nm *DBNotifMan) GetCount(ctx context.Context, user models.Uid, seenAt time.Time) (int64, error) {
 	// TODO: sql count is inefficient
-	var lseen time.Time
-	if err := nm.db.Model(NotifSeen{}).Where("usr = ?", user).Select("last_seen").Scan(&lseen).Error; err != nil {
-		return 0, err
+	if seenAt.IsZero() {
+		lseen, err := nm.lastSeen(user)
+		if err != nil {
+			return 0, err
+		}
+		seenAt = lseen
 	}
 
 	var c int64
-	//seen := nm.db.Model(NotifSeen{}).Where("usr = ?", user).Select("last_seen")
-	if err := nm.db.Model(NotifRecord{}).Where("for = ? AND created_at > ?", user, lseen).Count(&c).Error; err != nil {
+	if err := nm.db.Model(NotifRecord{}).Where(`"for" = ? AND created_at > ?`, user, seenAt).Count(&c).Error; err != nil {
 		return 0, err
 	}
 
@@ -313,7 +359,7 @@ func (nm *DBNotifMan) UpdateSeen(ctx context.Context, usr models.Uid, seen time.
 	if err := nm.db.Clauses(clause.OnConflict{
 		Columns:   []clause.Column{{Name: "usr"}},
 		DoUpdates: clause.AssignmentColumns([]string{"last_seen"}),
-	}).Create(NotifSeen{
+	}).Create(&NotifSeen{
 		Usr:      usr,
 		LastSeen: seen,
 	}).Error; err != nil {
@@ -323,49 +369,83 @@ func (nm *DBNotifMan) UpdateSeen(ctx context.Context, usr models.Uid, seen time.
 	return nil
 }
 
+func (nm *DBNotifMan) Prune(ctx context.Context, before time.Time) (int64, error) {
+	res := nm.db.WithContext(ctx).Unscoped().Where("created_at < ?", before).Delete(&NotifRecord{})
+	return res.RowsAffected, res.Error
+}
+
+// add stores a notification, unless it is of a user's own doing, or for a
+// user the local filter refuses
+func (nm *DBNotifMan) add(ctx context.Context, n *NotifRecord) error {
+	if n.For == n.Who {
+		return nil
+	}
+	if nm.isLocal != nil {
+		ok, err := nm.isLocal(ctx, n.For)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+	}
+
+	return nm.db.Create(n).Error
+}
+
 func (nm *DBNotifMan) AddReplyTo(ctx context.Context, user models.Uid, replyid uint, replyto *models.FeedPost) error {
-	return nm.db.Create(&NotifRecord{
+	return nm.add(ctx, &NotifRecord{
 		Kind:    NotifKindReply,
 		For:     replyto.Author,
 		Who:     user,
 		ReplyTo: replyto.ID,
 		Record:  replyid,
-	}).Error
+	})
 }
 
 func (nm *DBNotifMan) AddMention(ctx context.Context, user models.Uid, postid uint, mentioned models.Uid) error {
-	return nm.db.Create(&NotifRecord{
+	return nm.add(ctx, &NotifRecord{
 		For:    mentioned,
 		Kind:   NotifKindMention,
 		Record: postid,
 		Who:    user,
-	}).Error
+	})
+}
+
+func (nm *DBNotifMan) AddQuote(ctx context.Context, user models.Uid, postid uint, quoted *models.FeedPost) error {
+	return nm.add(ctx, &NotifRecord{
+		Kind:    NotifKindQuote,
+		For:     quoted.Author,
+		Who:     user,
+		ReplyTo: quoted.ID,
+		Record:  postid,
+	})
 }
 
 func (nm *DBNotifMan) AddUpVote(ctx context.Context, voter models.Uid, postid uint, voteid uint, postauthor models.Uid) error {
-	return nm.db.Create(&NotifRecord{
+	return nm.add(ctx, &NotifRecord{
 		For:     postauthor,
 		Kind:    NotifKindUpVote,
 		ReplyTo: postid,
 		Record:  voteid,
 		Who:     voter,
-	}).Error
+	})
 }
 
 func (nm *DBNotifMan) AddFollow(ctx context.Context, follower, followed models.Uid, recid uint) error {
-	return nm.db.Create(&NotifRecord{
+	return nm.add(ctx, &NotifRecord{
 		Kind:   NotifKindFollow,
 		For:    followed,
 		Who:    follower,
 		Record: recid,
-	}).Error
+	})
 }
 
 func (nm *DBNotifMan) AddRepost(ctx context.Context, op models.Uid, repost uint, reposter models.Uid) error {
-	return nm.db.Create(&NotifRecord{
+	return nm.add(ctx, &NotifRecord{
 		Kind:   NotifKindRepost,
 		For:    op,
 		Record: repost,
 		Who:    reposter,
-	}).Error
+	})
 }
@@ -14,11 +14,11 @@ type NullNotifs struct {
 
 var _ NotificationManager = (*NullNotifs)(nil)
 
-func (nn *NullNotifs) GetNotifications(ctx context.Context, user models.Uid) ([]*appbskytypes.NotificationListNotifications_Notification, error) {
-	return nil, fmt.Errorf("no notifications engine loaded")
+func (nn *NullNotifs) GetNotifications(ctx context.Context, user models.Uid, cursor string, limit int) ([]*appbskytypes.NotificationListNotifications_Notification, string, error) {
+	return nil, "", fmt.Errorf("no notifications engine loaded")
 }
 
-func (nn *NullNotifs) GetCount(ctx context.Context, user models.Uid) (int64, error) {
+func (nn *NullNotifs) GetCount(ctx context.Context, user models.Uid, seenAt time.Time) (int64, error) {
 	return 0, fmt.Errorf("no notifications engine loaded")
 }
 
@@ -34,6 +34,10 @@ func (nn *NullNotifs) AddMention(ctx context.Context, user models.Uid, postid ui
 	return nil
 }
 
+func (nn *NullNotifs) AddQuote(ctx context.Context, user models.Uid, postid uint, quoted *models.FeedPost) error {
+	return nil
+}
+
 func (nn *NullNotifs) AddUpVote(ctx context.Context, voter models.Uid, postid uint, voteid uint, postauthor models.Uid) error {
 	return nil
 }
@@ -45,3 +49,7 @@ func (nn *NullNotifs) AddFollow(ctx context.Context, follower, followed models.U
 func (nn *NullNotifs) AddRepost(ctx context.Context, op models.Uid, repost uint, reposter models.Uid) error {
 	return nil
 }
+
+func (nn *NullNotifs) Prune(ctx context.Context, before time.Time) (int64, error) {
+	return 0, nil
+}
@@ -0,0 +1,272 @@
+package pds
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/util/xrpcerr"
+	"gorm.io/gorm"
+)
+
+const (
+	AccountStatusDeactivated = "deactivated"
+	AccountStatusDeleted     = "deleted"
+)
+
+// AccountDeletionGracePeriod is how long the repo and blobs of a deleted
+// account are kept around before they are purged
+var AccountDeletionGracePeriod = 7 * 24 * time.Hour
+
+// AccountDeleteTokenTTL is how long a token from requestAccountDelete may be
+// used to confirm the deletion
+var AccountDeleteTokenTTL = 15 * time.Minute
+
+// accountPurgeInterval is how often we look for deleted accounts whose grace
+// period has passed
+var accountPurgeInterval = time.Hour
+
+var ErrInvalidAccountDeleteToken = fmt.Errorf("invalid or expired account deletion token")
+
+// AccountDeleteToken is a single use token emailed to a user to confirm that
+// they want their account deleted
+type AccountDeleteToken struct {
+	gorm.Model
+	Usr       models.Uid `gorm:"index"`
+	Token     string
+	ExpiresAt time.Time
+}
+
+// Active reports whether the account is neither deactivated nor deleted
+func (u *User) Active() bool {
+	return u.Status == ""
+}
+
+// checkRepoAvailable returns the error sync endpoints should respond with
+// when the given users repo is not being served
+func checkRepoAvailable(u *User) error {
+	switch u.Status {
+	case "":
+		return nil
+	case AccountStatusDeactivated:
+		return xrpcerr.New(http.StatusBadRequest, "RepoDeactivated", "repo has been deactivated")
+	case AccountStatusDeleted:
+		return xrpcerr.New(http.StatusBadRequest, "RepoDeleted", "repo has been deleted")
+	default:
+		return fmt.Errorf("unrecognized account status %q for %s", u.Status, u.Did)
+	}
+}
+
+// deactivatedAccountPaths are the only endpoints a deactivated account may
+// use; everything else is rejected until the account is reactivated
+var deactivatedAccountPaths = map[string]bool{
+	"/xrpc/com.atproto.server.activateAccount":      true,
+	"/xrpc/com.atproto.server.getSession":           true,
+	"/xrpc/com.atproto.server.refreshSession":       true,
+	"/xrpc/com.atproto.server.requestAccountDelete": true,
+}
+
+// checkAccountAccess returns an error if the given user is not allowed to
+// call the endpoint at path because of the status of their account
+func checkAccountAccess(u *User, path string) error {
+	switch u.Status {
+	case AccountStatusDeleted:
+		return xrpcerr.New(http.StatusUnauthorized, "AccountDeleted", "account has been deleted")
+	case AccountStatusDeactivated:
+		if !deactivatedAccountPaths[path] {
+			return xrpcerr.New(http.StatusForbidden, "AccountDeactivated", "account is deactivated")
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) emitAccountEvent(ctx context.Context, u *User) error {
+	evt := &comatproto.SyncSubscribeRepos_Account{
+		Did:    u.Did,
+		Active: u.Active(),
+		Time:   time.Now().Format(util.ISO8601),
+	}
+	if !u.Active() {
+		status := u.Status
+		evt.Status = &status
+	}
+
+	if err := s.events.AddEvent(ctx, &events.XRPCStreamEvent{RepoAccount: evt}); err != nil {
+		return fmt.Errorf("failed to push account event: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Server) setAccountStatus(ctx context.Context, u *User, status string, deleteAfter *time.Time) error {
+	if err := s.db.Model(User{}).Where("id = ?", u.ID).Updates(map[string]any{
+		"status":       status,
+		"delete_after": deleteAfter,
+	}).Error; err != nil {
+		return fmt.Errorf("failed to update account status: %w", err)
+	}
+
+	u.Status = status
+	u.DeleteAfter = deleteAfter
+
+	return s.emitAccountEvent(ctx, u)
+}
+
+func (s *Server) handleComAtprotoServerDeactivateAccount(ctx context.Context, body *comatproto.ServerDeactivateAccount_Input) error {
+	u, err := s.getUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	if u.Status == AccountStatusDeactivated {
+		return nil
+	}
+
+	// TODO: body.DeleteAfter is only a hint, and we keep deactivated accounts
+	// around until they are reactivated or explicitly deleted
+	return s.setAccountStatus(ctx, u, AccountStatusDeactivated, nil)
+}
+
+func (s *Server) handleComAtprotoServerActivateAccount(ctx context.Context) error {
+	u, err := s.getUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	if u.Active() {
+		return nil
+	}
+
+	return s.setAccountStatus(ctx, u, "", nil)
+}
+
+func (s *Server) handleComAtprotoServerRequestAccountDelete(ctx context.Context) error {
+	u, err := s.getUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	if u.Email == "" {
+		return fmt.Errorf("account has no email address to send a confirmation token to")
+	}
+
+	tok := &AccountDeleteToken{
+		Usr:       u.ID,
+		Token:     generateEmailToken(),
+		ExpiresAt: time.Now().Add(AccountDeleteTokenTTL),
+	}
+	if err := s.db.Create(tok).Error; err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Your account deletion confirmation token is: %s\n\nIt expires in %s. If you did not request this, you can ignore this email.", tok.Token, AccountDeleteTokenTTL)
+	if err := s.mailer.SendMail(ctx, u.Email, "Confirm account deletion", body); err != nil {
+		return fmt.Errorf("failed to send account deletion email: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Server) handleComAtprotoServerDeleteAccount(ctx context.Context, body *comatproto.ServerDeleteAccount_Input) error {
+	u, err := s.lookupUserByDid(ctx, body.Did)
+	if err != nil {
+		return err
+	}
+
+	if body.Password != u.Password {
+		return ErrInvalidUsernameOrPassword
+	}
+
+	if u.Status == AccountStatusDeleted {
+		return nil
+	}
+
+	var tok AccountDeleteToken
+	if err := s.db.Find(&tok, "usr = ? AND token = ? AND expires_at > ?", u.ID, body.Token, time.Now()).Error; err != nil {
+		return err
+	}
+
+	if tok.ID == 0 {
+		return ErrInvalidAccountDeleteToken
+	}
+
+	if err := s.db.Unscoped().Where("usr = ?", u.ID).Delete(&AccountDeleteToken{}).Error; err != nil {
+		return err
+	}
+
+	deleteAfter := time.Now().Add(AccountDeletionGracePeriod)
+	if err := s.setAccountStatus(ctx, u, AccountStatusDeleted, &deleteAfter); err != nil {
+		return err
+	}
+
+	if err := s.events.AddEvent(ctx, &events.XRPCStreamEvent{
+		RepoTombstone: &comatproto.SyncSubscribeRepos_Tombstone{
+			Did:  u.Did,
+			Time: time.Now().Format(util.ISO8601),
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to push tombstone event: %w", err)
+	}
+
+	return nil
+}
+
+// PurgeDeletedAccounts permanently removes the repo data, blobs and
+// preferences of every deleted account whose grace period has passed. The
+// user row is kept so that sync endpoints continue to report the repo as
+// deleted.
+func (s *Server) PurgeDeletedAccounts(ctx context.Context) error {
+	var users []User
+	if err := s.db.Find(&users, "status = ? AND delete_after < ?", AccountStatusDeleted, time.Now()).Error; err != nil {
+		return err
+	}
+
+	for i := range users {
+		u := &users[i]
+		if err := s.purgeAccount(ctx, u); err != nil {
+			return fmt.Errorf("purging account %s: %w", u.Did, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) purgeAccount(ctx context.Context, u *User) error {
+	log.Infow("purging deleted account", "did", u.Did)
+
+	if err := s.repoman.TakeDownRepo(ctx, u.ID); err != nil {
+		return fmt.Errorf("deleting repo data: %w", err)
+	}
+
+	if err := s.deleteUserBlobs(ctx, u); err != nil {
+		return err
+	}
+
+	if err := s.db.Unscoped().Where("usr = ?", u.ID).Delete(&Preferences{}).Error; err != nil {
+		return err
+	}
+
+	return s.db.Model(User{}).Where("id = ?", u.ID).UpdateColumn("delete_after", nil).Error
+}
+
+func (s *Server) runAccountPurger(ctx context.Context) {
+	t := time.NewTicker(accountPurgeInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := s.PurgeDeletedAccounts(ctx); err != nil {
+				log.Errorw("failed to purge deleted accounts", "err", err)
+			}
+		}
+	}
+}
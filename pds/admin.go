@@ -0,0 +1,88 @@
+package pds
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strings"
+
+	"github.com/bluesky-social/indigo/util/xrpcerr"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// SetAdminToken sets the bearer token required to use the /admin API. The
+// admin API is disabled until a token is set.
+func (s *Server) SetAdminToken(tok string) {
+	s.adminToken = tok
+}
+
+func (s *Server) checkAdminAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(e echo.Context) error {
+		if s.adminToken == "" {
+			return echo.ErrForbidden
+		}
+
+		authheader := e.Request().Header.Get("Authorization")
+		pref := "Bearer "
+		if !strings.HasPrefix(authheader, pref) {
+			return echo.ErrForbidden
+		}
+
+		token := authheader[len(pref):]
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			return echo.ErrForbidden
+		}
+
+		return next(e)
+	}
+}
+
+func (s *Server) handleAdminDisableEmailAuthFactor(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	var body map[string]string
+	if err := e.Bind(&body); err != nil {
+		return err
+	}
+	did, ok := body["did"]
+	if !ok {
+		return xrpcerr.InvalidRequest("must specify did parameter in body")
+	}
+
+	if err := s.DisableEmailAuthFactor(ctx, did); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return xrpcerr.NotFound("account not found")
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (s *Server) handleAdminSetBlobQuota(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	var body struct {
+		Did   string `json:"did"`
+		Quota *int64 `json:"quota"`
+	}
+	if err := e.Bind(&body); err != nil {
+		return err
+	}
+	if body.Did == "" {
+		return xrpcerr.InvalidRequest("must specify did parameter in body")
+	}
+	if body.Quota != nil && *body.Quota < 0 {
+		return xrpcerr.InvalidRequest("quota must not be negative")
+	}
+
+	if err := s.SetAccountBlobQuota(ctx, body.Did, body.Quota); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return xrpcerr.NotFound("account not found")
+		}
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,173 @@
+package pds
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/util/xrpcerr"
+	"gorm.io/gorm"
+)
+
+// AuthFactorCodeTTL is how long an emailed sign in code remains valid
+var AuthFactorCodeTTL = 15 * time.Minute
+
+// MaxAuthFactorAttempts is how many wrong guesses are allowed against a single
+// code before it is invalidated and the user has to request a new one
+const MaxAuthFactorAttempts = 5
+
+// AuthFactorCode is a one time code emailed to a user with EmailAuthFactor
+// enabled. Only the most recently issued code for a user is valid.
+type AuthFactorCode struct {
+	gorm.Model
+	Usr       models.Uid `gorm:"index"`
+	Code      string
+	ExpiresAt time.Time
+	Attempts  int
+}
+
+var (
+	errAuthFactorTokenRequired = xrpcerr.New(http.StatusUnauthorized, "AuthFactorTokenRequired", "a sign in code has been sent to your email address")
+	errInvalidAuthFactorToken  = xrpcerr.New(http.StatusUnauthorized, "InvalidToken", "invalid sign in code")
+	errExpiredAuthFactorToken  = xrpcerr.New(http.StatusUnauthorized, "ExpiredToken", "sign in code has expired")
+)
+
+// sendAuthFactorCode issues a new code for the user, replacing any codes
+// previously issued, and emails it to them
+func (s *Server) sendAuthFactorCode(ctx context.Context, u *User) error {
+	if u.Email == "" {
+		return fmt.Errorf("account has no email address to send a sign in code to")
+	}
+
+	if err := s.db.Unscoped().Where("usr = ?", u.ID).Delete(&AuthFactorCode{}).Error; err != nil {
+		return err
+	}
+
+	code := &AuthFactorCode{
+		Usr:       u.ID,
+		Code:      generateEmailToken(),
+		ExpiresAt: time.Now().Add(AuthFactorCodeTTL),
+	}
+	if err := s.db.Create(code).Error; err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Your sign in code is: %s\n\nIt expires in %s. If you did not try to sign in, someone may know your password.", code.Code, AuthFactorCodeTTL)
+	if err := s.mailer.SendMail(ctx, u.Email, "Sign in code", body); err != nil {
+		return fmt.Errorf("failed to send sign in code: %w", err)
+	}
+
+	return nil
+}
+
+// checkAuthFactorCode validates a code previously sent with
+// sendAuthFactorCode. Codes are single use, and are invalidated after
+// MaxAuthFactorAttempts wrong guesses.
+func (s *Server) checkAuthFactorCode(ctx context.Context, u *User, given string) error {
+	var code AuthFactorCode
+	if err := s.db.Order("id desc").Limit(1).Find(&code, "usr = ?", u.ID).Error; err != nil {
+		return err
+	}
+
+	if code.ID == 0 {
+		return errInvalidAuthFactorToken
+	}
+
+	if time.Now().After(code.ExpiresAt) || code.Attempts >= MaxAuthFactorAttempts {
+		return errExpiredAuthFactorToken
+	}
+
+	if subtle.ConstantTimeCompare([]byte(code.Code), []byte(given)) != 1 {
+		if err := s.db.Model(AuthFactorCode{}).Where("id = ?", code.ID).UpdateColumn("attempts", gorm.Expr("attempts + 1")).Error; err != nil {
+			return err
+		}
+		return errInvalidAuthFactorToken
+	}
+
+	return s.db.Unscoped().Where("usr = ?", u.ID).Delete(&AuthFactorCode{}).Error
+}
+
+// checkSessionAuthFactor is the second step of createSession for users with
+// EmailAuthFactor enabled. If no token was given, a new one is emailed.
+func (s *Server) checkSessionAuthFactor(ctx context.Context, u *User, token *string) error {
+	if !u.EmailAuthFactor {
+		return nil
+	}
+
+	if token == nil || *token == "" {
+		if err := s.sendAuthFactorCode(ctx, u); err != nil {
+			return err
+		}
+		return errAuthFactorTokenRequired
+	}
+
+	return s.checkAuthFactorCode(ctx, u, *token)
+}
+
+func (s *Server) handleComAtprotoServerRequestEmailUpdate(ctx context.Context) (*comatproto.ServerRequestEmailUpdate_Output, error) {
+	u, err := s.getUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !u.EmailAuthFactor {
+		return &comatproto.ServerRequestEmailUpdate_Output{TokenRequired: false}, nil
+	}
+
+	if err := s.sendAuthFactorCode(ctx, u); err != nil {
+		return nil, err
+	}
+
+	return &comatproto.ServerRequestEmailUpdate_Output{TokenRequired: true}, nil
+}
+
+func (s *Server) handleComAtprotoServerUpdateEmail(ctx context.Context, body *comatproto.ServerUpdateEmail_Input) error {
+	u, err := s.getUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	// changing the email address, or turning off the second factor, must be
+	// confirmed through the current address when the second factor is on
+	if u.EmailAuthFactor {
+		if body.Token == nil || *body.Token == "" {
+			return errAuthFactorTokenRequired
+		}
+		if err := s.checkAuthFactorCode(ctx, u, *body.Token); err != nil {
+			return err
+		}
+	}
+
+	if body.Email == "" {
+		return fmt.Errorf("must specify an email address")
+	}
+
+	authFactor := u.EmailAuthFactor
+	if body.EmailAuthFactor != nil {
+		authFactor = *body.EmailAuthFactor
+	}
+
+	return s.db.Model(User{}).Where("id = ?", u.ID).Updates(map[string]any{
+		"email":             body.Email,
+		"email_auth_factor": authFactor,
+	}).Error
+}
+
+// DisableEmailAuthFactor turns off the emailed second factor for the given
+// account, for admins to recover users who can no longer access their email
+func (s *Server) DisableEmailAuthFactor(ctx context.Context, did string) error {
+	u, err := s.lookupUserByDid(ctx, did)
+	if err != nil {
+		return err
+	}
+
+	if err := s.db.Model(User{}).Where("id = ?", u.ID).UpdateColumn("email_auth_factor", false).Error; err != nil {
+		return err
+	}
+
+	return s.db.Unscoped().Where("usr = ?", u.ID).Delete(&AuthFactorCode{}).Error
+}
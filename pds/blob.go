@@ -0,0 +1,663 @@
+package pds
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/blobs"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/repomgr"
+	"github.com/bluesky-social/indigo/util/imgproc"
+	"github.com/bluesky-social/indigo/util/xrpcerr"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+	"github.com/labstack/echo/v4"
+	"github.com/multiformats/go-multihash"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"go.opentelemetry.io/otel"
+	"gorm.io/gorm"
+)
+
+// MaxBlobSize is the largest blob we will accept through uploadBlob
+const MaxBlobSize = 5 << 20
+
+var ErrBlobStoreNotConfigured = fmt.Errorf("no blob store configured for this server")
+var ErrBlobTooLarge = fmt.Errorf("blob exceeds maximum size")
+var ErrBlobQuotaExceeded = fmt.Errorf("blob would exceed the account's storage quota")
+
+// OrphanBlobGracePeriod is how long a blob can go unreferenced by any of its
+// user's records before it is garbage collected. This leaves time between a
+// blob being uploaded and the record using it being created.
+var OrphanBlobGracePeriod = 6 * time.Hour
+
+// blobGCInterval is how often we look for orphaned blobs
+var blobGCInterval = time.Hour
+
+// Blob tracks a blob uploaded by a user. The contents of the blob live in the
+// servers blob store, keyed by the users DID and the blob CID. UpdatedAt is
+// bumped whenever a record referencing the blob goes away, and the grace
+// period of orphaned blobs counts from it.
+type Blob struct {
+	gorm.Model
+	Usr      models.Uid `gorm:"uniqueIndex:idx_blob_usr_cid"`
+	Cid      string     `gorm:"uniqueIndex:idx_blob_usr_cid"`
+	MimeType string
+	Size     int64
+}
+
+// RecordBlob tracks a reference to a blob from one of a user's records. The
+// blob may not have been uploaded yet, as is the case for migrated repos.
+type RecordBlob struct {
+	ID    uint       `gorm:"primarykey"`
+	Usr   models.Uid `gorm:"index:idx_record_blob_usr_cid;index:idx_record_blob_usr_rpath"`
+	Cid   string     `gorm:"index:idx_record_blob_usr_cid"`
+	Rpath string     `gorm:"index:idx_record_blob_usr_rpath"`
+}
+
+func (s *Server) storeBlob(ctx context.Context, u *User, r io.Reader, mimeType string) (*lexutil.LexBlob, error) {
+	if s.blobs == nil {
+		return nil, ErrBlobStoreNotConfigured
+	}
+
+	br := bufio.NewReaderSize(r, sniffLen)
+	head, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("reading blob: %w", err)
+	}
+
+	if vt := detectVideoType(head); vt != "" || isVideo(imgproc.NormalizeMimeType(mimeType)) {
+		mt, err := checkVideoType(mimeType, vt)
+		if err != nil {
+			return nil, err
+		}
+		return s.storeVideo(ctx, u, br, mt)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(br, MaxBlobSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("reading blob: %w", err)
+	}
+
+	if len(data) > MaxBlobSize {
+		return nil, ErrBlobTooLarge
+	}
+
+	if s.images != nil {
+		// blobs already referenced by the account's records, as those of
+		// a migrated repo are, must keep the CID they are referenced by,
+		// so are stored as they are
+		referenced, err := s.blobReferenced(ctx, u, data)
+		if err != nil {
+			return nil, err
+		}
+
+		if !referenced {
+			data, mimeType, err = s.processImage(data, mimeType)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return s.putBlob(ctx, u, data, mimeType)
+}
+
+// blobReferenced checks whether any of the user's records reference the blob
+// with the given contents
+func (s *Server) blobReferenced(ctx context.Context, u *User, data []byte) (bool, error) {
+	bcid, err := cid.NewPrefixV1(cid.Raw, multihash.SHA2_256).Sum(data)
+	if err != nil {
+		return false, err
+	}
+
+	var n int64
+	if err := s.db.Model(RecordBlob{}).Where("usr = ? AND cid = ?", u.ID, bcid.String()).Count(&n).Error; err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// putBlob stores a blob held in memory
+func (s *Server) putBlob(ctx context.Context, u *User, data []byte, mimeType string) (*lexutil.LexBlob, error) {
+	bcid, err := cid.NewPrefixV1(cid.Raw, multihash.SHA2_256).Sum(data)
+	if err != nil {
+		return nil, err
+	}
+
+	created, err := s.reserveBlob(ctx, u, bcid.String(), mimeType, int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.blobs.PutBlob(ctx, bcid.String(), u.Did, data); err != nil {
+		if created {
+			s.releaseBlob(ctx, u, bcid.String())
+		}
+		return nil, fmt.Errorf("writing blob to store: %w", err)
+	}
+
+	if err := s.storeImageVariants(ctx, u, bcid.String(), data, mimeType); err != nil {
+		return nil, fmt.Errorf("storing image variants: %w", err)
+	}
+
+	return &lexutil.LexBlob{
+		Ref:      lexutil.LexLink(bcid),
+		MimeType: mimeType,
+		Size:     int64(len(data)),
+	}, nil
+}
+
+// storeVideo streams a video into the blob store, if it can take streams,
+// hashing it on the way
+func (s *Server) storeVideo(ctx context.Context, u *User, r io.Reader, mimeType string) (*lexutil.LexBlob, error) {
+	sbs, ok := s.blobs.(blobs.StreamingBlobStore)
+	if !ok {
+		// without streaming, videos are held to the size of other blobs
+		data, err := io.ReadAll(io.LimitReader(r, MaxBlobSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("reading blob: %w", err)
+		}
+		if len(data) > MaxBlobSize {
+			return nil, ErrBlobTooLarge
+		}
+		return s.putBlob(ctx, u, data, mimeType)
+	}
+
+	pb, err := sbs.CreateBlob(ctx, u.Did)
+	if err != nil {
+		return nil, fmt.Errorf("writing blob to store: %w", err)
+	}
+	defer pb.Abort()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(pb, h), io.LimitReader(r, s.maxVideoSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("writing blob to store: %w", err)
+	}
+	if size > s.maxVideoSize {
+		return nil, ErrBlobTooLarge
+	}
+
+	mh, err := multihash.Encode(h.Sum(nil), multihash.SHA2_256)
+	if err != nil {
+		return nil, err
+	}
+	bcid := cid.NewCidV1(cid.Raw, mh)
+
+	// the size is only known once it has all been written
+	created, err := s.reserveBlob(ctx, u, bcid.String(), mimeType, size)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := pb.Commit(bcid.String()); err != nil {
+		if created {
+			s.releaseBlob(ctx, u, bcid.String())
+		}
+		return nil, fmt.Errorf("writing blob to store: %w", err)
+	}
+
+	return &lexutil.LexBlob{
+		Ref:      lexutil.LexLink(bcid),
+		MimeType: mimeType,
+		Size:     size,
+	}, nil
+}
+
+// reserveBlob records a blob before it is written to the blob store,
+// returning ErrBlobQuotaExceeded if it would take the user over their quota.
+// The quota is checked in the same transaction as the blob is recorded in, so
+// that concurrent uploads can't together exceed it. Blobs the user already
+// has don't count again; it returns whether the blob is new to the user, in
+// which case releaseBlob undoes the reservation if it can't be stored.
+func (s *Server) reserveBlob(ctx context.Context, u *User, c string, mimeType string, size int64) (bool, error) {
+	quota := s.blobQuota
+	if u.BlobQuota != nil {
+		quota = *u.BlobQuota
+	}
+
+	var created bool
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if quota > 0 {
+			// writing to the user's row holds off their other uploads
+			// until this transaction is done
+			if err := tx.Model(User{}).Where("id = ?", u.ID).UpdateColumn("blob_quota", gorm.Expr("blob_quota")).Error; err != nil {
+				return err
+			}
+		}
+
+		// uploading the same blob twice is fine, this is expected when a
+		// migrating user re-uploads every blob listed by listMissingBlobs
+		var existing Blob
+		if err := tx.Find(&existing, "usr = ? AND cid = ?", u.ID, c).Error; err != nil {
+			return err
+		}
+		if existing.ID != 0 {
+			return nil
+		}
+
+		if quota > 0 {
+			var used int64
+			if err := tx.Model(Blob{}).Where("usr = ?", u.ID).Select("COALESCE(SUM(size), 0)").Scan(&used).Error; err != nil {
+				return err
+			}
+			if used+size > quota {
+				return ErrBlobQuotaExceeded
+			}
+		}
+
+		created = true
+		return tx.Create(&Blob{
+			Usr:      u.ID,
+			Cid:      c,
+			MimeType: mimeType,
+			Size:     size,
+		}).Error
+	})
+	return created, err
+}
+
+// releaseBlob removes the record of a blob reserved by reserveBlob which
+// could not be stored
+func (s *Server) releaseBlob(ctx context.Context, u *User, c string) {
+	if err := s.db.Unscoped().Where("usr = ? AND cid = ?", u.ID, c).Delete(&Blob{}).Error; err != nil {
+		log.Errorw("failed to release blob reservation", "did", u.Did, "cid", c, "err", err)
+	}
+}
+
+// SetDefaultBlobQuota sets the total size of blobs accounts may store, unless
+// a quota has been set for the account. Zero means no quota.
+func (s *Server) SetDefaultBlobQuota(n int64) {
+	s.blobQuota = n
+}
+
+// SetAccountBlobQuota sets the total size of blobs an account may store, or
+// has it use the default quota if quota is nil. Zero means no quota.
+func (s *Server) SetAccountBlobQuota(ctx context.Context, did string, quota *int64) error {
+	res := s.db.Model(User{}).Where("did = ?", did).UpdateColumn("blob_quota", quota)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// openBlob opens a blob of a user for reading, along with what is tracked of
+// it. Blob stores which can't stream are read into memory.
+func (s *Server) openBlob(ctx context.Context, u *User, c string) (io.ReadSeekCloser, *Blob, error) {
+	if s.blobs == nil {
+		return nil, nil, ErrBlobStoreNotConfigured
+	}
+
+	var b Blob
+	if err := s.db.Find(&b, "usr = ? AND cid = ?", u.ID, c).Error; err != nil {
+		return nil, nil, err
+	}
+
+	if b.ID == 0 {
+		return nil, nil, xrpcerr.NotFound("blob %s not found for %s", c, u.Did)
+	}
+
+	if sbs, ok := s.blobs.(blobs.StreamingBlobStore); ok {
+		f, err := sbs.OpenBlob(ctx, c, u.Did)
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, &b, nil
+	}
+
+	data, err := s.blobs.GetBlob(ctx, c, u.Did)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nopCloser{bytes.NewReader(data)}, &b, nil
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
+
+// HandleGetBlob serves com.atproto.sync.getBlob in place of the generated
+// handler, which can only send whole blobs, so that players can request
+// ranges of videos
+func (s *Server) HandleGetBlob(c echo.Context) error {
+	ctx, span := otel.Tracer("server").Start(c.Request().Context(), "HandleGetBlob")
+	defer span.End()
+
+	u, err := s.lookupUserByDid(ctx, c.QueryParam("did"))
+	if err != nil {
+		return err
+	}
+
+	if err := checkRepoAvailable(u); err != nil {
+		return err
+	}
+
+	f, b, err := s.openBlob(ctx, u, c.QueryParam("cid"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// blobs are served from the same origin as the API, so should never be
+	// rendered as anything but media
+	mimeType := "application/octet-stream"
+	if isVideo(b.MimeType) || (strings.HasPrefix(b.MimeType, "image/") && imgproc.Decodable(b.MimeType)) {
+		mimeType = b.MimeType
+	}
+
+	h := c.Response().Header()
+	h.Set(echo.HeaderContentType, mimeType)
+	h.Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	h.Set(echo.HeaderXContentTypeOptions, "nosniff")
+	h.Set("ETag", `"`+b.Cid+`"`)
+	h.Set("Cache-Control", "public, max-age=31536000, immutable")
+
+	http.ServeContent(c.Response(), c.Request(), "", b.CreatedAt, f)
+	return nil
+}
+
+func (s *Server) loadBlob(ctx context.Context, u *User, c string) ([]byte, error) {
+	if s.blobs == nil {
+		return nil, ErrBlobStoreNotConfigured
+	}
+
+	var b Blob
+	if err := s.db.Find(&b, "usr = ? AND cid = ?", u.ID, c).Error; err != nil {
+		return nil, err
+	}
+
+	if b.ID == 0 {
+		return nil, fmt.Errorf("blob %s not found for %s", c, u.Did)
+	}
+
+	return s.blobs.GetBlob(ctx, c, u.Did)
+}
+
+func (s *Server) listUserBlobs(ctx context.Context, u *User) ([]string, error) {
+	var cids []string
+	if err := s.db.Model(Blob{}).Where("usr = ?", u.ID).Order("cid asc").Pluck("cid", &cids).Error; err != nil {
+		return nil, err
+	}
+
+	return cids, nil
+}
+
+// deleteUserBlobs removes every blob belonging to the given user from both the
+// blob store and the database
+func (s *Server) deleteUserBlobs(ctx context.Context, u *User) error {
+	cids, err := s.listUserBlobs(ctx, u)
+	if err != nil {
+		return err
+	}
+
+	if len(cids) > 0 && s.blobs == nil {
+		return ErrBlobStoreNotConfigured
+	}
+
+	for _, c := range cids {
+		if err := s.blobs.DeleteBlob(ctx, c, u.Did); err != nil {
+			return fmt.Errorf("deleting blob %s: %w", c, err)
+		}
+	}
+
+	if err := s.deleteBlobVariants(ctx, u.ID, u.Did, ""); err != nil {
+		return err
+	}
+
+	if err := s.db.Where("usr = ?", u.ID).Delete(&RecordBlob{}).Error; err != nil {
+		return err
+	}
+
+	return s.db.Unscoped().Where("usr = ?", u.ID).Delete(&Blob{}).Error
+}
+
+// recordBlobCids returns the blobs referenced by a record. Records of types
+// we have no Go type for are left as raw blocks in the event's slice, so
+// references are found in the record's encoding whatever its type.
+func recordBlobCids(op *repomgr.RepoOp, slice []byte) ([]cid.Cid, error) {
+	if op.Record != nil {
+		m, ok := op.Record.(cbg.CBORMarshaler)
+		if !ok {
+			return nil, fmt.Errorf("record of type %T can't be encoded", op.Record)
+		}
+
+		buf := new(bytes.Buffer)
+		if err := m.MarshalCBOR(buf); err != nil {
+			return nil, err
+		}
+		return lexutil.CborBlobRefs(buf.Bytes())
+	}
+
+	if op.RecCid == nil {
+		return nil, fmt.Errorf("op has neither a record nor its cid")
+	}
+
+	raw, err := sliceBlock(slice, *op.RecCid)
+	if err != nil {
+		return nil, err
+	}
+	return lexutil.CborBlobRefs(raw)
+}
+
+// sliceBlock reads the block c from a repo event's car slice
+func sliceBlock(slice []byte, c cid.Cid) ([]byte, error) {
+	carr, err := car.NewCarReader(bytes.NewReader(slice))
+	if err != nil {
+		return nil, fmt.Errorf("reading car slice: %w", err)
+	}
+
+	for {
+		blk, err := carr.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil, fmt.Errorf("record %s is missing from the car slice", c)
+			}
+			return nil, fmt.Errorf("reading car slice: %w", err)
+		}
+		if blk.Cid() == c {
+			return blk.RawData(), nil
+		}
+	}
+}
+
+// handleBlobRefs tracks the blob references of a repo event. If that fails,
+// the user is marked as unindexed, so that their blobs aren't collected until
+// their references have been rebuilt from their repo.
+func (s *Server) handleBlobRefs(ctx context.Context, evt *repomgr.RepoEvent) {
+	err := s.trackBlobRefs(ctx, evt)
+	if err == nil {
+		return
+	}
+	log.Errorw("tracking blob references failed", "user", evt.User, "err", err)
+	blobRefTrackingFailures.Inc()
+
+	if err := s.db.Model(User{}).Where("id = ?", evt.User).UpdateColumn("blob_refs_indexed", false).Error; err != nil {
+		log.Errorw("failed to mark blob references unindexed", "user", evt.User, "err", err)
+	}
+}
+
+// trackBlobRefs updates the blob references of the records changed by a repo
+// event
+func (s *Server) trackBlobRefs(ctx context.Context, evt *repomgr.RepoEvent) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		for _, op := range evt.Ops {
+			rpath := op.Collection + "/" + op.Rkey
+
+			var old []string
+			if err := tx.Model(RecordBlob{}).Where("usr = ? AND rpath = ?", evt.User, rpath).Pluck("cid", &old).Error; err != nil {
+				return err
+			}
+			if len(old) > 0 {
+				if err := tx.Where("usr = ? AND rpath = ?", evt.User, rpath).Delete(&RecordBlob{}).Error; err != nil {
+					return err
+				}
+
+				// restart the grace period of blobs which may now be orphaned
+				if err := tx.Model(Blob{}).Where("usr = ? AND cid IN ?", evt.User, old).Update("updated_at", time.Now()).Error; err != nil {
+					return err
+				}
+			}
+
+			if op.Kind == repomgr.EvtKindDeleteRecord {
+				continue
+			}
+
+			cids, err := recordBlobCids(&op, evt.RepoSlice)
+			if err != nil {
+				return fmt.Errorf("finding blobs of %s: %w", rpath, err)
+			}
+
+			seen := make(map[cid.Cid]bool)
+			for _, c := range cids {
+				if seen[c] {
+					continue
+				}
+				seen[c] = true
+
+				if err := tx.Create(&RecordBlob{Usr: evt.User, Cid: c.String(), Rpath: rpath}).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// reindexBlobRefs rebuilds the blob references of a user from their repo, for
+// repos which were imported rather than built up from events
+func (s *Server) reindexBlobRefs(ctx context.Context, u *User) error {
+	refs, err := s.repoman.ListRecordBlobs(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("usr = ?", u.ID).Delete(&RecordBlob{}).Error; err != nil {
+			return err
+		}
+
+		seen := make(map[RecordBlob]bool)
+		for _, ref := range refs {
+			rb := RecordBlob{Usr: u.ID, Cid: ref.Blob.String(), Rpath: ref.Rpath}
+			if seen[rb] {
+				continue
+			}
+			seen[rb] = true
+
+			if err := tx.Create(&rb).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Model(User{}).Where("id = ?", u.ID).UpdateColumn("blob_refs_indexed", true).Error
+	})
+}
+
+// CollectOrphanBlobs deletes the blobs which have gone unreferenced by any of
+// their user's records for longer than the grace period, returning how many
+// were deleted and their total size
+func (s *Server) CollectOrphanBlobs(ctx context.Context, grace time.Duration) (int, int64, error) {
+	if s.blobs == nil {
+		return 0, 0, ErrBlobStoreNotConfigured
+	}
+
+	start := time.Now()
+	defer func() {
+		blobGCDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	// the blobs of users from before references were tracked, or whose
+	// references failed to be tracked, may look orphaned until their
+	// references are indexed. Users which still can't be indexed are left
+	// out of this pass.
+	var unindexed []User
+	if err := s.db.Where("NOT blob_refs_indexed AND id IN (SELECT usr FROM blobs)").Find(&unindexed).Error; err != nil {
+		return 0, 0, err
+	}
+	for i := range unindexed {
+		if err := s.reindexBlobRefs(ctx, &unindexed[i]); err != nil {
+			log.Errorw("failed to index blob references", "did", unindexed[i].Did, "err", err)
+		}
+	}
+
+	var orphans []struct {
+		ID   uint
+		Usr  models.Uid
+		Cid  string
+		Size int64
+		Did  string
+	}
+	if err := s.db.Model(Blob{}).
+		Select("blobs.id, blobs.usr, blobs.cid, blobs.size, users.did").
+		Joins("JOIN users ON users.id = blobs.usr").
+		Where("users.blob_refs_indexed").
+		Where("blobs.updated_at < ?", time.Now().Add(-grace)).
+		Where("NOT EXISTS (SELECT 1 FROM record_blobs WHERE record_blobs.usr = blobs.usr AND record_blobs.cid = blobs.cid)").
+		Scan(&orphans).Error; err != nil {
+		return 0, 0, err
+	}
+
+	var n int
+	var reclaimed int64
+	for _, o := range orphans {
+		// the blob may have been referenced again since it was found, so
+		// the check is repeated as its row is deleted
+		res := s.db.Unscoped().
+			Where("id = ?", o.ID).
+			Where("NOT EXISTS (SELECT 1 FROM record_blobs WHERE record_blobs.usr = blobs.usr AND record_blobs.cid = blobs.cid)").
+			Delete(&Blob{})
+		if res.Error != nil {
+			return n, reclaimed, res.Error
+		}
+		if res.RowsAffected == 0 {
+			continue
+		}
+
+		if err := s.blobs.DeleteBlob(ctx, o.Cid, o.Did); err != nil {
+			return n, reclaimed, fmt.Errorf("deleting blob %s: %w", o.Cid, err)
+		}
+		if err := s.deleteBlobVariants(ctx, o.Usr, o.Did, o.Cid); err != nil {
+			return n, reclaimed, err
+		}
+
+		n++
+		reclaimed += o.Size
+		orphanBlobsCollected.Inc()
+		orphanBlobBytesReclaimed.Add(float64(o.Size))
+	}
+
+	return n, reclaimed, nil
+}
+
+func (s *Server) runBlobGC(ctx context.Context) {
+	t := time.NewTicker(blobGCInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			n, reclaimed, err := s.CollectOrphanBlobs(ctx, OrphanBlobGracePeriod)
+			if err != nil {
+				log.Errorw("failed to collect orphaned blobs", "err", err)
+			}
+			if n > 0 {
+				log.Infow("collected orphaned blobs", "blobs", n, "bytes", reclaimed)
+			}
+		}
+	}
+}
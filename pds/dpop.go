@@ -0,0 +1,175 @@
+package pds
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/labstack/echo/v4"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// dpopNonceWindow is how often the server issued DPoP nonce rotates. A nonce
+// is accepted for the window it was issued in and the one after.
+const dpopNonceWindow = 3 * time.Minute
+
+// dpopMaxAge bounds how far the iat of a DPoP proof may be from the current
+// time, which also bounds how long we need to remember proof jtis for
+const dpopMaxAge = 5 * time.Minute
+
+var errUseDPoPNonce = fmt.Errorf("use_dpop_nonce")
+
+// dpopVerifier checks DPoP proofs (RFC 9449) presented to the OAuth and
+// resource endpoints of the PDS
+type dpopVerifier struct {
+	nonceKey []byte
+	seenJtis *lru.Cache
+}
+
+func newDPoPVerifier(secret []byte) (*dpopVerifier, error) {
+	seen, err := lru.New(100_000)
+	if err != nil {
+		return nil, err
+	}
+
+	key := sha256.Sum256(append([]byte("dpop-nonce:"), secret...))
+
+	return &dpopVerifier{
+		nonceKey: key[:],
+		seenJtis: seen,
+	}, nil
+}
+
+func (dv *dpopVerifier) nonceFor(window int64) string {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(window))
+
+	mac := hmac.New(sha256.New, dv.nonceKey)
+	mac.Write(buf)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func currentNonceWindow() int64 {
+	return time.Now().UnixNano() / int64(dpopNonceWindow)
+}
+
+// Nonce returns the nonce clients should currently put in their proofs
+func (dv *dpopVerifier) Nonce() string {
+	return dv.nonceFor(currentNonceWindow())
+}
+
+func (dv *dpopVerifier) validNonce(n string) bool {
+	w := currentNonceWindow()
+	return hmac.Equal([]byte(n), []byte(dv.nonceFor(w))) || hmac.Equal([]byte(n), []byte(dv.nonceFor(w-1)))
+}
+
+// Verify checks the given DPoP proof against the request it was sent with,
+// returning the JWK thumbprint of the key that signed it. If accessToken is
+// set, the proof must be bound to it through the ath claim. errUseDPoPNonce
+// is returned if the client needs to retry with a fresh nonce.
+func (dv *dpopVerifier) Verify(proof string, method, url string, accessToken string) (string, error) {
+	if proof == "" {
+		return "", fmt.Errorf("missing DPoP proof")
+	}
+
+	msg, err := jws.Parse([]byte(proof))
+	if err != nil {
+		return "", fmt.Errorf("invalid DPoP proof: %w", err)
+	}
+
+	if len(msg.Signatures()) != 1 {
+		return "", fmt.Errorf("DPoP proof must have exactly one signature")
+	}
+
+	hdr := msg.Signatures()[0].ProtectedHeaders()
+	if hdr.Type() != "dpop+jwt" {
+		return "", fmt.Errorf("DPoP proof has wrong typ %q", hdr.Type())
+	}
+
+	if hdr.Algorithm() != jwa.ES256 {
+		return "", fmt.Errorf("unsupported DPoP proof algorithm %q", hdr.Algorithm())
+	}
+
+	key := hdr.JWK()
+	if key == nil {
+		return "", fmt.Errorf("DPoP proof is missing jwk header")
+	}
+
+	if _, ok := key.(jwk.ECDSAPrivateKey); ok {
+		return "", fmt.Errorf("DPoP proof jwk must be a public key")
+	}
+
+	tok, err := jwt.Parse([]byte(proof), jwt.WithKey(hdr.Algorithm(), key), jwt.WithValidate(false))
+	if err != nil {
+		return "", fmt.Errorf("invalid DPoP proof signature: %w", err)
+	}
+
+	if claimString(tok, "htm") != method {
+		return "", fmt.Errorf("DPoP proof htm does not match request method")
+	}
+
+	if claimString(tok, "htu") != url {
+		return "", fmt.Errorf("DPoP proof htu does not match request url")
+	}
+
+	if d := time.Since(tok.IssuedAt()); d > dpopMaxAge || d < -dpopMaxAge {
+		return "", fmt.Errorf("DPoP proof iat is too far from the current time")
+	}
+
+	if accessToken != "" {
+		ath := sha256.Sum256([]byte(accessToken))
+		if claimString(tok, "ath") != base64.RawURLEncoding.EncodeToString(ath[:]) {
+			return "", fmt.Errorf("DPoP proof is not bound to the access token")
+		}
+	}
+
+	if !dv.validNonce(claimString(tok, "nonce")) {
+		return "", errUseDPoPNonce
+	}
+
+	jti := tok.JwtID()
+	if jti == "" {
+		return "", fmt.Errorf("DPoP proof is missing jti")
+	}
+
+	if seen, _ := dv.seenJtis.ContainsOrAdd(jti, true); seen {
+		return "", fmt.Errorf("DPoP proof has already been used")
+	}
+
+	tp, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(tp), nil
+}
+
+func claimString(tok jwt.Token, name string) string {
+	v, ok := tok.Get(name)
+	if !ok {
+		return ""
+	}
+
+	s, _ := v.(string)
+	return s
+}
+
+// requestOrigin is the scheme and host the request was made to, which we use
+// as both our OAuth issuer and resource server identifier
+func requestOrigin(c echo.Context) string {
+	return c.Scheme() + "://" + c.Request().Host
+}
+
+// requestHtu is the url a DPoP proof for this request should carry in its htu
+// claim; the request url without query or fragment
+func requestHtu(c echo.Context) string {
+	return requestOrigin(c) + c.Request().URL.Path
+}
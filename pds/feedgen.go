@@ -11,6 +11,7 @@ import (
 	"github.com/bluesky-social/indigo/indexer"
 	lexutil "github.com/bluesky-social/indigo/lex/util"
 	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/util/visibility"
 
 	"github.com/ipfs/go-cid"
 	"go.opentelemetry.io/otel"
@@ -22,6 +23,8 @@ type FeedGenerator struct {
 	ix *indexer.Indexer
 
 	readRecord ReadRecordFunc
+
+	vis *visibility.Filter
 }
 
 func NewFeedGenerator(db *gorm.DB, ix *indexer.Indexer, readRecord ReadRecordFunc) (*FeedGenerator, error) {
@@ -29,6 +32,7 @@ func NewFeedGenerator(db *gorm.DB, ix *indexer.Indexer, readRecord ReadRecordFun
 		db:         db,
 		ix:         ix,
 		readRecord: readRecord,
+		vis:        &visibility.Filter{Graph: &blockSource{db: db}},
 	}, nil
 }
 
@@ -214,6 +218,11 @@ func (fg *FeedGenerator) GetTimeline(ctx context.Context, user *User, algo strin
 }
 
 func (fg *FeedGenerator) personalizeFeed(ctx context.Context, feed []*bsky.FeedDefs_FeedViewPost, viewer *User) ([]*bsky.FeedDefs_FeedViewPost, error) {
+	feed, err := fg.filterFeed(ctx, feed, viewer)
+	if err != nil {
+		return nil, err
+	}
+
 	for _, p := range feed {
 
 		// TODO: its inefficient to have to call 'GetPost' again here when we could instead be doing that inside the 'hydrateFeed' call earlier.
@@ -238,10 +247,14 @@ func (fg *FeedGenerator) personalizeFeed(ctx context.Context, feed []*bsky.FeedD
 	return feed, nil
 }
 
-func (fg *FeedGenerator) GetAuthorFeed(ctx context.Context, user *User, before string, limit int) ([]*bsky.FeedDefs_FeedViewPost, error) {
+func (fg *FeedGenerator) GetAuthorFeed(ctx context.Context, viewer, user *User, before string, limit int) ([]*bsky.FeedDefs_FeedViewPost, error) {
 	ctx, span := otel.Tracer("feedgen").Start(context.Background(), "GetAuthorFeed")
 	defer span.End()
 
+	if err := fg.checkProfileVisible(ctx, viewer, user); err != nil {
+		return nil, err
+	}
+
 	// for memory efficiency, should probably return the actual type that goes out to the user...
 	// bsky.FeedGetAuthorFeed_FeedItem
 
@@ -260,7 +273,7 @@ func (fg *FeedGenerator) GetAuthorFeed(ctx context.Context, user *User, before s
 		return nil, fmt.Errorf("hydrating feed: %w", err)
 	}
 
-	return fg.personalizeFeed(ctx, fout, user)
+	return fg.personalizeFeed(ctx, fout, viewer)
 }
 
 func (fg *FeedGenerator) GetActorProfileByID(ctx context.Context, actor uint) (*models.ActorInfo, error) {
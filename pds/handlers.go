@@ -3,14 +3,21 @@ package pds
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"strings"
 	"time"
 
 	comatprototypes "github.com/bluesky-social/indigo/api/atproto"
 	appbskytypes "github.com/bluesky-social/indigo/api/bsky"
 	lexutil "github.com/bluesky-social/indigo/lex/util"
 	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/notifs"
+	"github.com/bluesky-social/indigo/repomgr"
+	"github.com/bluesky-social/indigo/util/serviceauth"
+	"github.com/bluesky-social/indigo/util/xrpcerr"
 	"github.com/ipfs/go-cid"
 	"github.com/lestrrat-go/jwx/v2/jwt"
 )
@@ -41,7 +48,7 @@ func (s *Server) handleAppBskyActorGetSuggestions(ctx context.Context, cursor st
 }
 
 func (s *Server) handleAppBskyFeedGetAuthorFeed(ctx context.Context, author string, before string, filter string, limit int) (*appbskytypes.FeedGetAuthorFeed_Output, error) {
-	_, err := s.getUser(ctx)
+	u, err := s.getUser(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -52,7 +59,7 @@ func (s *Server) handleAppBskyFeedGetAuthorFeed(ctx context.Context, author stri
 		return nil, err
 	}
 
-	feed, err := s.feedgen.GetAuthorFeed(ctx, target, before, limit)
+	feed, err := s.feedgen.GetAuthorFeed(ctx, u, target, before, limit)
 	if err != nil {
 		return nil, err
 	}
@@ -228,14 +235,19 @@ func (s *Server) handleAppBskyNotificationGetUnreadCount(ctx context.Context, se
 		return nil, err
 	}
 
-	// TODO: use seenAt
+	var seen time.Time
+	if seenAt != "" {
+		seen, err = time.Parse(time.RFC3339, seenAt)
+		if err != nil {
+			return nil, xrpcerr.InvalidRequest("invalid time format for 'seenAt': %s", err)
+		}
+	}
 
-	count, err := s.notifman.GetCount(ctx, u.ID)
+	count, err := s.notifman.GetCount(ctx, u.ID, seen)
 	if err != nil {
 		return nil, fmt.Errorf("notification getCount: %w", err)
 	}
 
-	fmt.Println("notif count: ", u.Handle, count)
 	return &appbskytypes.NotificationGetUnreadCount_Output{
 		Count: count,
 	}, nil
@@ -247,17 +259,28 @@ func (s *Server) handleAppBskyNotificationListNotifications(ctx context.Context,
 		return nil, err
 	}
 
+	if limit < 1 || limit > 100 {
+		return nil, xrpcerr.InvalidRequest("limit must be between 1 and 100")
+	}
+
 	// TODO: use seenAt
 	_ = seenAt
 
-	notifs, err := s.notifman.GetNotifications(ctx, u.ID)
+	list, next, err := s.notifman.GetNotifications(ctx, u.ID, cursor, limit)
 	if err != nil {
+		if errors.Is(err, notifs.ErrInvalidCursor) {
+			return nil, xrpcerr.InvalidRequest("invalid cursor")
+		}
 		return nil, err
 	}
 
-	return &appbskytypes.NotificationListNotifications_Output{
-		Notifications: notifs,
-	}, nil
+	out := &appbskytypes.NotificationListNotifications_Output{
+		Notifications: list,
+	}
+	if next != "" {
+		out.Cursor = &next
+	}
+	return out, nil
 }
 
 func (s *Server) handleAppBskyNotificationUpdateSeen(ctx context.Context, input *appbskytypes.NotificationUpdateSeen_Input) error {
@@ -294,16 +317,26 @@ func (s *Server) handleComAtprotoServerCreateAccount(ctx context.Context, body *
 		// handle is available, lets go
 	}
 
+	// an account being migrated here from another PDS brings its own DID,
+	// and its repo is expected to arrive afterwards via importRepo
+	migrating := body.Did != nil && *body.Did != ""
+	if migrating {
+		if err := s.checkMigrationAuth(ctx, *body.Did); err != nil {
+			return nil, err
+		}
+	}
+
 	var recoveryKey string
 	if body.RecoveryKey != nil {
 		recoveryKey = *body.RecoveryKey
 	}
 
 	u := User{
-		Handle:      body.Handle,
-		Password:    body.Password,
-		RecoveryKey: recoveryKey,
-		Email:       body.Email,
+		Handle:          body.Handle,
+		Password:        body.Password,
+		RecoveryKey:     recoveryKey,
+		Email:           body.Email,
+		BlobRefsIndexed: true,
 	}
 	if err := s.db.Create(&u).Error; err != nil {
 		return nil, err
@@ -313,9 +346,14 @@ func (s *Server) handleComAtprotoServerCreateAccount(ctx context.Context, body *
 		recoveryKey = s.signingKey.Public().DID()
 	}
 
-	d, err := s.plc.CreateDID(ctx, s.signingKey, recoveryKey, body.Handle, s.serviceUrl)
-	if err != nil {
-		return nil, fmt.Errorf("create did: %w", err)
+	var d string
+	if migrating {
+		d = *body.Did
+	} else {
+		d, err = s.plc.CreateDID(ctx, s.signer, recoveryKey, body.Handle, s.serviceUrl)
+		if err != nil {
+			return nil, fmt.Errorf("create did: %w", err)
+		}
 	}
 
 	u.Did = d
@@ -332,8 +370,10 @@ func (s *Server) handleComAtprotoServerCreateAccount(ctx context.Context, body *
 		return nil, err
 	}
 
-	if err := s.repoman.InitNewActor(ctx, u.ID, u.Handle, u.Did, "", UserActorDeclCid, UserActorDeclType); err != nil {
-		return nil, err
+	if !migrating {
+		if err := s.repoman.InitNewActor(ctx, u.ID, u.Handle, u.Did, "", UserActorDeclCid, UserActorDeclType); err != nil {
+			return nil, err
+		}
 	}
 
 	tok, err := s.createAuthTokenForUser(ctx, body.Handle, d)
@@ -349,6 +389,34 @@ func (s *Server) handleComAtprotoServerCreateAccount(ctx context.Context, body *
 	}, nil
 }
 
+// checkMigrationAuth checks that whoever is creating an account with an
+// existing DID controls it. They must present a service auth token for
+// createAccount on this PDS, issued by the DID and signed with its current
+// signing key, as the old PDS gives out from getServiceAuth.
+func (s *Server) checkMigrationAuth(ctx context.Context, did string) error {
+	auth, _ := ctx.Value("auth").(string)
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return xrpcerr.New(http.StatusUnauthorized, "AuthMissing", "migrating an account requires a service auth token from its did")
+	}
+
+	v := &serviceauth.Validator{
+		Dir:        s.plc,
+		ServiceDID: s.serviceDid(),
+		RequireLxm: true,
+	}
+	claims, err := v.Validate(ctx, strings.TrimPrefix(auth, "Bearer "), "com.atproto.server.createAccount")
+	if err != nil {
+		log.Warnw("rejected migration service auth token", "did", did, "err", err)
+		return xrpcerr.New(http.StatusUnauthorized, "InvalidToken", "invalid service auth token")
+	}
+
+	if claims.Iss != did {
+		return xrpcerr.New(http.StatusUnauthorized, "InvalidToken", "service auth token was not issued by the migrating did")
+	}
+
+	return nil
+}
+
 func (s *Server) handleComAtprotoServerCreateInviteCode(ctx context.Context, body *comatprototypes.ServerCreateInviteCode_Input) (*comatprototypes.ServerCreateInviteCode_Output, error) {
 	u, err := s.getUser(ctx)
 	if err != nil {
@@ -360,24 +428,95 @@ func (s *Server) handleComAtprotoServerCreateInviteCode(ctx context.Context, bod
 	return nil, fmt.Errorf("invite codes not currently supported")
 }
 
-func (s *Server) handleComAtprotoServerRequestAccountDelete(ctx context.Context) error {
+func (s *Server) handleComAtprotoServerRequestPasswordReset(ctx context.Context, body *comatprototypes.ServerRequestPasswordReset_Input) error {
 	panic("not yet implemented")
 }
 
-func (s *Server) handleComAtprotoServerDeleteAccount(ctx context.Context, body *comatprototypes.ServerDeleteAccount_Input) error {
+func (s *Server) handleComAtprotoServerResetPassword(ctx context.Context, body *comatprototypes.ServerResetPassword_Input) error {
 	panic("not yet implemented")
 }
 
-func (s *Server) handleComAtprotoServerRequestPasswordReset(ctx context.Context, body *comatprototypes.ServerRequestPasswordReset_Input) error {
-	panic("not yet implemented")
+func (s *Server) handleComAtprotoRepoUploadBlob(ctx context.Context, r io.Reader, contentType string) (*comatprototypes.RepoUploadBlob_Output, error) {
+	u, err := s.getUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	blob, err := s.storeBlob(ctx, u, r, contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	return &comatprototypes.RepoUploadBlob_Output{
+		Blob: blob,
+	}, nil
 }
 
-func (s *Server) handleComAtprotoServerResetPassword(ctx context.Context, body *comatprototypes.ServerResetPassword_Input) error {
-	panic("not yet implemented")
+func (s *Server) handleComAtprotoRepoImportRepo(ctx context.Context, r io.Reader) error {
+	u, err := s.getUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	head, err := s.repoman.GetRepoRoot(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+
+	if head.Defined() {
+		return fmt.Errorf("repo for %s already exists, can only import into a newly migrated account", u.Did)
+	}
+
+	if err := s.repoman.ImportRepoStream(ctx, u.ID, u.Did, r); err != nil {
+		return err
+	}
+
+	return s.reindexBlobRefs(ctx, u)
 }
 
-func (s *Server) handleComAtprotoRepoUploadBlob(ctx context.Context, r io.Reader, contentType string) (*comatprototypes.RepoUploadBlob_Output, error) {
-	panic("not yet implemented")
+func (s *Server) handleComAtprotoRepoListMissingBlobs(ctx context.Context, cursor string, limit int) (*comatprototypes.RepoListMissingBlobs_Output, error) {
+	u, err := s.getUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if limit < 1 || limit > 1000 {
+		return nil, xrpcerr.InvalidRequest("limit must be between 1 and 1000")
+	}
+
+	var missing []struct {
+		Cid   string
+		Rpath string
+	}
+	if err := s.db.Model(RecordBlob{}).
+		Select("cid, min(rpath) AS rpath").
+		Where("usr = ? AND cid > ?", u.ID, cursor).
+		Where("NOT EXISTS (SELECT 1 FROM blobs WHERE blobs.usr = record_blobs.usr AND blobs.cid = record_blobs.cid AND blobs.deleted_at IS NULL)").
+		Group("cid").
+		Order("cid asc").
+		Limit(limit + 1).
+		Scan(&missing).Error; err != nil {
+		return nil, err
+	}
+
+	out := &comatprototypes.RepoListMissingBlobs_Output{
+		Blobs: []*comatprototypes.RepoListMissingBlobs_RecordBlob{},
+	}
+
+	if len(missing) > limit {
+		missing = missing[:limit]
+		next := missing[len(missing)-1].Cid
+		out.Cursor = &next
+	}
+
+	for _, m := range missing {
+		out.Blobs = append(out.Blobs, &comatprototypes.RepoListMissingBlobs_RecordBlob{
+			Cid:       m.Cid,
+			RecordUri: "at://" + u.Did + "/" + m.Rpath,
+		})
+	}
+
+	return out, nil
 }
 
 func (s *Server) handleComAtprotoIdentityResolveHandle(ctx context.Context, handle string) (*comatprototypes.IdentityResolveHandle_Output, error) {
@@ -402,7 +541,27 @@ func (s *Server) handleComAtprotoRepoApplyWrites(ctx context.Context, body *coma
 		return fmt.Errorf("writes for non-user actors not supported (DID mismatch)")
 	}
 
-	return s.repoman.BatchWrite(ctx, u.ID, body.Writes)
+	writes, err := repomgr.WritesFromApplyWrites(body.Writes)
+	if err != nil {
+		return repoWriteError(err)
+	}
+	for i := range writes {
+		if err := s.validateWrite(&writes[i], body.Validate); err != nil {
+			return err
+		}
+	}
+
+	swapCommit, err := repomgr.ParseSwap(body.SwapCommit)
+	if err != nil {
+		return repoWriteError(err)
+	}
+
+	_, res, err := s.repoman.ApplyWrites(ctx, u.ID, writes, swapCommit)
+	if err != nil {
+		return repoWriteError(err)
+	}
+	s.applyRules(ctx, u, writes, res)
+	return nil
 }
 
 func (s *Server) handleComAtprotoRepoCreateRecord(ctx context.Context, input *comatprototypes.RepoCreateRecord_Input) (*comatprototypes.RepoCreateRecord_Output, error) {
@@ -411,14 +570,34 @@ func (s *Server) handleComAtprotoRepoCreateRecord(ctx context.Context, input *co
 		return nil, fmt.Errorf("get user: %w", err)
 	}
 
-	rpath, recid, err := s.repoman.CreateRecord(ctx, u.ID, input.Collection, input.Record.Val)
+	w := repomgr.Write{
+		Kind:       repomgr.EvtKindCreateRecord,
+		Collection: input.Collection,
+	}
+	if input.Rkey != nil {
+		w.Rkey = *input.Rkey
+	}
+	if input.Record != nil {
+		w.Record = input.Record.Val
+	}
+	if err := s.validateWrite(&w, input.Validate); err != nil {
+		return nil, err
+	}
+
+	swapCommit, err := repomgr.ParseSwap(input.SwapCommit)
 	if err != nil {
-		return nil, fmt.Errorf("record create: %w", err)
+		return nil, repoWriteError(err)
 	}
 
+	_, res, err := s.repoman.ApplyWrites(ctx, u.ID, []repomgr.Write{w}, swapCommit)
+	if err != nil {
+		return nil, repoWriteError(fmt.Errorf("record create: %w", err))
+	}
+	s.applyRules(ctx, u, []repomgr.Write{w}, res)
+
 	return &comatprototypes.RepoCreateRecord_Output{
-		Uri: "at://" + u.Did + "/" + rpath,
-		Cid: recid.String(),
+		Uri: "at://" + u.Did + "/" + res[0].Path(),
+		Cid: res[0].Cid.String(),
 	}, nil
 }
 
@@ -432,7 +611,49 @@ func (s *Server) handleComAtprotoRepoDeleteRecord(ctx context.Context, input *co
 		return fmt.Errorf("specified DID did not match authed user")
 	}
 
-	return s.repoman.DeleteRecord(ctx, u.ID, input.Collection, input.Rkey)
+	swapCommit, err := repomgr.ParseSwap(input.SwapCommit)
+	if err != nil {
+		return repoWriteError(err)
+	}
+	swapRecord, err := repomgr.ParseSwap(input.SwapRecord)
+	if err != nil {
+		return repoWriteError(err)
+	}
+
+	_, _, err = s.repoman.ApplyWrites(ctx, u.ID, []repomgr.Write{{
+		Kind:       repomgr.EvtKindDeleteRecord,
+		Collection: input.Collection,
+		Rkey:       input.Rkey,
+		SwapRecord: swapRecord,
+	}}, swapCommit)
+	return repoWriteError(err)
+}
+
+// validateWrite checks the record of a create or update against its lexicon,
+// unless the caller asked for it not to be
+func (s *Server) validateWrite(w *repomgr.Write, validate *bool) error {
+	if s.validator == nil || w.Record == nil || (validate != nil && !*validate) {
+		return nil
+	}
+	if err := s.validator.ValidateRecord(w.Collection, w.Record); err != nil {
+		return xrpcerr.New(http.StatusBadRequest, "InvalidRecord", err.Error())
+	}
+	return nil
+}
+
+// repoWriteError sends the errors of writes which can't be applied as the
+// XRPC errors of the repo write methods, keeping their messages
+func repoWriteError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, repomgr.ErrInvalidSwap):
+		return xrpcerr.New(http.StatusBadRequest, "InvalidSwap", err.Error()).Wrap(err)
+	case errors.Is(err, repomgr.ErrInvalidWrite):
+		return xrpcerr.InvalidRequest("%s", err).Wrap(err)
+	default:
+		return err
+	}
 }
 
 func (s *Server) handleComAtprotoRepoGetRecord(ctx context.Context, c string, collection string, repo string, rkey string) (*comatprototypes.RepoGetRecord_Output, error) {
@@ -450,7 +671,8 @@ func (s *Server) handleComAtprotoRepoGetRecord(ctx context.Context, c string, co
 		maybeCid = cc
 	}
 
-	reccid, rec, err := s.repoman.GetRecord(ctx, targetUser.ID, collection, rkey, maybeCid)
+	// the raw record keeps any fields (or types) we don't know about
+	reccid, rec, err := s.repoman.GetRawRecord(ctx, targetUser.ID, collection, rkey, maybeCid)
 	if err != nil {
 		return nil, fmt.Errorf("repoman GetRecord: %w", err)
 	}
@@ -468,7 +690,45 @@ func (s *Server) handleComAtprotoRepoListRecords(ctx context.Context, collection
 }
 
 func (s *Server) handleComAtprotoRepoPutRecord(ctx context.Context, input *comatprototypes.RepoPutRecord_Input) (*comatprototypes.RepoPutRecord_Output, error) {
-	panic("not yet implemented")
+	u, err := s.getUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Did != input.Repo {
+		return nil, fmt.Errorf("specified DID did not match authed user")
+	}
+
+	w := repomgr.Write{
+		Kind:       repomgr.EvtKindUpdateRecord,
+		Collection: input.Collection,
+		Rkey:       input.Rkey,
+	}
+	if input.Record != nil {
+		w.Record = input.Record.Val
+	}
+	if err := s.validateWrite(&w, input.Validate); err != nil {
+		return nil, err
+	}
+
+	swapCommit, err := repomgr.ParseSwap(input.SwapCommit)
+	if err != nil {
+		return nil, repoWriteError(err)
+	}
+	if w.SwapRecord, err = repomgr.ParseSwap(input.SwapRecord); err != nil {
+		return nil, repoWriteError(err)
+	}
+
+	_, res, err := s.repoman.ApplyWrites(ctx, u.ID, []repomgr.Write{w}, swapCommit)
+	if err != nil {
+		return nil, repoWriteError(err)
+	}
+	s.applyRules(ctx, u, []repomgr.Write{w}, res)
+
+	return &comatprototypes.RepoPutRecord_Output{
+		Uri: "at://" + u.Did + "/" + res[0].Path(),
+		Cid: res[0].Cid.String(),
+	}, nil
 }
 
 func (s *Server) handleComAtprotoServerDescribeServer(ctx context.Context) (*comatprototypes.ServerDescribeServer_Output, error) {
@@ -494,16 +754,25 @@ func (s *Server) handleComAtprotoServerCreateSession(ctx context.Context, body *
 		return nil, ErrInvalidUsernameOrPassword
 	}
 
+	if u.Status == AccountStatusDeleted {
+		return nil, xrpcerr.New(http.StatusUnauthorized, "AccountDeleted", "account has been deleted")
+	}
+
+	if err := s.checkSessionAuthFactor(ctx, u, body.AuthFactorToken); err != nil {
+		return nil, err
+	}
+
 	tok, err := s.createAuthTokenForUser(ctx, body.Identifier, u.Did)
 	if err != nil {
 		return nil, err
 	}
 
 	return &comatprototypes.ServerCreateSession_Output{
-		Handle:     body.Identifier,
-		Did:        u.Did,
-		AccessJwt:  tok.AccessJwt,
-		RefreshJwt: tok.RefreshJwt,
+		Handle:          body.Identifier,
+		Did:             u.Did,
+		AccessJwt:       tok.AccessJwt,
+		RefreshJwt:      tok.RefreshJwt,
+		EmailAuthFactor: &u.EmailAuthFactor,
 	}, nil
 }
 
@@ -518,11 +787,58 @@ func (s *Server) handleComAtprotoServerGetSession(ctx context.Context) (*comatpr
 	}
 
 	return &comatprototypes.ServerGetSession_Output{
-		Handle: u.Handle,
-		Did:    u.Did,
+		Handle:          u.Handle,
+		Did:             u.Did,
+		EmailAuthFactor: &u.EmailAuthFactor,
 	}, nil
 }
 
+// protectedServiceAuthMethods may not be called with a service auth token,
+// as they would let the holder act as the account itself
+var protectedServiceAuthMethods = []string{
+	"com.atproto.admin.",
+	"com.atproto.identity.",
+	"com.atproto.server.createAccount",
+	"com.atproto.server.deleteAccount",
+	"com.atproto.server.getServiceAuth",
+	"com.atproto.server.updateEmail",
+}
+
+func (s *Server) handleComAtprotoServerGetServiceAuth(ctx context.Context, aud string, exp int, lxm string) (*comatprototypes.ServerGetServiceAuth_Output, error) {
+	u, err := s.getUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if aud == "" {
+		return nil, xrpcerr.InvalidRequest("must specify aud")
+	}
+
+	for _, m := range protectedServiceAuthMethods {
+		if strings.HasPrefix(lxm, m) {
+			return nil, xrpcerr.InvalidRequest("cannot request service auth for %s", lxm)
+		}
+	}
+
+	expires := time.Now().Add(time.Minute)
+	if exp != 0 {
+		expires = time.Unix(int64(exp), 0)
+		if time.Until(expires) > serviceauth.MaxLifetime {
+			return nil, xrpcerr.InvalidRequest("requested exp too far in the future")
+		}
+		if expires.Before(time.Now()) {
+			return nil, xrpcerr.InvalidRequest("requested exp is in the past")
+		}
+	}
+
+	tok, err := serviceauth.CreateTokenWithSigner(ctx, s.signer, u.Did, aud, lxm, expires)
+	if err != nil {
+		return nil, err
+	}
+
+	return &comatprototypes.ServerGetServiceAuth_Output{Token: tok}, nil
+}
+
 func (s *Server) handleComAtprotoServerRefreshSession(ctx context.Context) (*comatprototypes.ServerRefreshSession_Output, error) {
 	u, err := s.getUser(ctx)
 	if err != nil {
@@ -579,6 +895,10 @@ func (s *Server) handleComAtprotoSyncGetHead(ctx context.Context, did string) (*
 		return nil, err
 	}
 
+	if err := checkRepoAvailable(user); err != nil {
+		return nil, err
+	}
+
 	root, err := s.repoman.GetRepoRoot(ctx, user.ID)
 	if err != nil {
 		return nil, err
@@ -590,7 +910,31 @@ func (s *Server) handleComAtprotoSyncGetHead(ctx context.Context, did string) (*
 }
 
 func (s *Server) handleComAtprotoSyncGetRecord(ctx context.Context, collection string, commit string, did string, rkey string) (io.Reader, error) {
-	panic("not yet implemented")
+	var commitCid cid.Cid
+	if commit != "" {
+		cc, err := cid.Decode(commit)
+		if err != nil {
+			return nil, err
+		}
+
+		commitCid = cc
+	}
+
+	targetUser, err := s.lookupUser(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkRepoAvailable(targetUser); err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	if err := s.repoman.ReadRecordProof(ctx, targetUser.ID, commitCid, collection, rkey, buf); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
 }
 
 func (s *Server) handleComAtprotoSyncGetRepo(ctx context.Context, did string, earliest, latest string) (io.Reader, error) {
@@ -619,6 +963,10 @@ func (s *Server) handleComAtprotoSyncGetRepo(ctx context.Context, did string, ea
 		return nil, err
 	}
 
+	if err := checkRepoAvailable(targetUser); err != nil {
+		return nil, err
+	}
+
 	buf := new(bytes.Buffer)
 	if err := s.repoman.ReadRepo(ctx, targetUser.ID, earlyCid, lateCid, buf); err != nil {
 		return nil, err
@@ -678,11 +1026,49 @@ func (s *Server) handleComAtprotoSyncRequestCrawl(ctx context.Context, host stri
 }
 
 func (s *Server) handleComAtprotoSyncGetBlob(ctx context.Context, cid string, did string) (io.Reader, error) {
-	panic("nyi")
+	u, err := s.lookupUserByDid(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkRepoAvailable(u); err != nil {
+		return nil, err
+	}
+
+	data, err := s.loadBlob(ctx, u, cid)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(data), nil
 }
 
 func (s *Server) handleComAtprotoSyncListBlobs(ctx context.Context, did string, earliest string, latest string) (*comatprototypes.SyncListBlobs_Output, error) {
-	panic("nyi")
+	if earliest != "" || latest != "" {
+		return nil, fmt.Errorf("listing blobs for a commit range is not supported")
+	}
+
+	u, err := s.lookupUserByDid(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkRepoAvailable(u); err != nil {
+		return nil, err
+	}
+
+	cids, err := s.listUserBlobs(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+
+	if cids == nil {
+		cids = []string{}
+	}
+
+	return &comatprototypes.SyncListBlobs_Output{
+		Cids: cids,
+	}, nil
 }
 
 func (s *Server) handleAppBskyActorSearchActors(ctx context.Context, cursor string, limit int, term string) (*appbskytypes.ActorSearchActors_Output, error) {
@@ -761,12 +1147,27 @@ func (s *Server) handleComAtprotoServerListAppPasswords(ctx context.Context) (*c
 func (s *Server) handleComAtprotoServerRevokeAppPassword(ctx context.Context, body *comatprototypes.ServerRevokeAppPassword_Input) error {
 	panic("nyi")
 }
-func (s *Server) handleAppBskyActorGetPreferences(ctx context.Context) (*appbskytypes.ActorGetPreferences_Output, error) {
-	panic("nyi")
+func (s *Server) handleAppBskyActorGetPreferences(ctx context.Context) (*rawPreferences, error) {
+	u, err := s.getUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	prefs, err := s.getPreferences(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rawPreferences{Preferences: prefs}, nil
 }
 
-func (s *Server) handleAppBskyActorPutPreferences(ctx context.Context, body *appbskytypes.ActorPutPreferences_Input) error {
-	panic("nyi")
+func (s *Server) handleAppBskyActorPutPreferences(ctx context.Context, body *rawPreferences) error {
+	u, err := s.getUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	return s.putPreferences(ctx, u, body.Preferences)
 }
 func (s *Server) handleAppBskyFeedGetPosts(ctx context.Context, uris []string) (*appbskytypes.FeedGetPosts_Output, error) {
 	panic("nyi")
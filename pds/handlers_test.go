@@ -1,18 +1,38 @@
 package pds
 
 import (
+	"bytes"
 	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/bluesky-social/indigo/api/atproto"
+	bsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/blobs"
 	"github.com/bluesky-social/indigo/carstore"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
 	"github.com/bluesky-social/indigo/plc"
+	"github.com/bluesky-social/indigo/repomgr"
 	"github.com/bluesky-social/indigo/util/cliutil"
+	"github.com/bluesky-social/indigo/util/serviceauth"
+	"github.com/bluesky-social/indigo/util/xrpcerr"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	"github.com/multiformats/go-multihash"
 	"github.com/whyrusleeping/go-did"
 	"gorm.io/gorm"
 )
@@ -124,3 +144,1086 @@ func TestHandleComAtprotoSessionCreate(t *testing.T) {
 		t.Fatalf("expected error %s, got %s\n", ErrInvalidUsernameOrPassword, err)
 	}
 }
+
+func TestBlobUploadAndMissingBlobs(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	dir, err := os.MkdirTemp("", "pdsblobs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s.SetBlobStore(&blobs.DiskBlobStore{Dir: dir})
+
+	ctx := context.Background()
+	o, err := s.handleComAtprotoServerCreateAccount(ctx, &atproto.ServerCreateAccount_Input{
+		Email:    "test@foo.com",
+		Password: "password",
+		Handle:   "testman.test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := s.lookupUserByDid(ctx, o.Did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = context.WithValue(ctx, "user", u)
+
+	data := []byte("not really an image")
+	bcid, err := cid.NewPrefixV1(cid.Raw, multihash.SHA2_256).Sum(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	post := &bsky.FeedPost{
+		Text:      "look at this",
+		CreatedAt: "2023-07-01T00:00:00.000Z",
+		Embed: &bsky.FeedPost_Embed{
+			EmbedImages: &bsky.EmbedImages{
+				Images: []*bsky.EmbedImages_Image{{
+					Alt: "test",
+					Image: &lexutil.LexBlob{
+						Ref:      lexutil.LexLink(bcid),
+						MimeType: "image/jpeg",
+						Size:     int64(len(data)),
+					},
+				}},
+			},
+		},
+	}
+	if _, _, err := s.repoman.CreateRecord(ctx, u.ID, "app.bsky.feed.post", post); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, limit := range []int{0, -1, 1001} {
+		if _, err := s.handleComAtprotoRepoListMissingBlobs(ctx, "", limit); xrpcerr.Status(err) != http.StatusBadRequest {
+			t.Fatalf("limit %d: expected a bad request, got %v", limit, err)
+		}
+	}
+
+	missing, err := s.handleComAtprotoRepoListMissingBlobs(ctx, "", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing.Blobs) != 1 || missing.Blobs[0].Cid != bcid.String() {
+		t.Fatalf("expected blob %s to be missing, got %v", bcid, missing.Blobs)
+	}
+
+	up, err := s.handleComAtprotoRepoUploadBlob(ctx, bytes.NewReader(data), "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up.Blob.Ref.String() != bcid.String() {
+		t.Fatalf("uploaded blob had unexpected cid: %s", up.Blob.Ref)
+	}
+
+	missing, err = s.handleComAtprotoRepoListMissingBlobs(ctx, "", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing.Blobs) != 0 {
+		t.Fatalf("expected no missing blobs, got %d", len(missing.Blobs))
+	}
+
+	r, err := s.handleComAtprotoSyncGetBlob(ctx, bcid.String(), u.Did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatal("blob contents did not round trip")
+	}
+}
+
+func TestPreferencesRoundTrip(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	o, err := s.handleComAtprotoServerCreateAccount(ctx, &atproto.ServerCreateAccount_Input{
+		Email:    "test@foo.com",
+		Password: "password",
+		Handle:   "testman.test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := s.lookupUserByDid(ctx, o.Did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = context.WithValue(ctx, "user", u)
+
+	empty, err := s.handleAppBskyActorGetPreferences(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(empty.Preferences) != 0 {
+		t.Fatal("expected no preferences for new account")
+	}
+
+	prefs := []json.RawMessage{
+		json.RawMessage(`{"$type":"app.bsky.actor.defs#savedFeedsPref","pinned":["at://did:plc:a/app.bsky.feed.generator/b"],"saved":["at://did:plc:a/app.bsky.feed.generator/b"]}`),
+		json.RawMessage(`{"$type":"app.bsky.actor.defs#someFuturePref","thing":42}`),
+	}
+	if err := s.handleAppBskyActorPutPreferences(ctx, &rawPreferences{Preferences: prefs}); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := s.handleAppBskyActorGetPreferences(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Preferences) != 2 {
+		t.Fatalf("expected 2 preferences, got %d", len(out.Preferences))
+	}
+	if string(out.Preferences[1]) != string(prefs[1]) {
+		t.Fatalf("unknown preference type was not preserved: %s", out.Preferences[1])
+	}
+
+	bad := [][]json.RawMessage{
+		{json.RawMessage(`{"thing":42}`)},
+		{json.RawMessage(`{"$type":"com.example.pref"}`)},
+		{json.RawMessage(`{"$type":"app.bsky.actor.defs#contentLabelPref","label":"nsfw","visibility":"maybe"}`)},
+		{json.RawMessage(`{"$type":"app.bsky.actor.defs#savedFeedsPref","pinned":["at://x"],"saved":[]}`)},
+	}
+	for _, b := range bad {
+		if err := s.handleAppBskyActorPutPreferences(ctx, &rawPreferences{Preferences: b}); err == nil {
+			t.Fatalf("expected invalid preferences to be rejected: %s", b[0])
+		}
+	}
+}
+
+type testMailer struct {
+	to   string
+	body string
+}
+
+func (tm *testMailer) SendMail(ctx context.Context, to, subject, body string) error {
+	tm.to = to
+	tm.body = body
+	return nil
+}
+
+// startTestAPI serves the API of s on a local port, returning its URL
+func startTestAPI(t *testing.T, s *Server) string {
+	t.Helper()
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { li.Close() })
+	go s.RunAPIWithListener(li)
+
+	u := "http://" + li.Addr().String()
+	for i := 0; ; i++ {
+		resp, err := http.Get(u + "/xrpc/_health")
+		if err == nil {
+			resp.Body.Close()
+			return u
+		}
+		if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeleteAccountRateLimit(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	_, did := testAccount(t, s, "alice.test")
+	u := startTestAPI(t, s)
+
+	// deleteAccount checks passwords without a session, so guessing them
+	// is limited like createSession
+	lim := DefaultRateLimits["/xrpc/com.atproto.server.deleteAccount"]
+	if lim.Count == 0 {
+		t.Fatal("expected deleteAccount to be rate limited")
+	}
+	body := fmt.Sprintf(`{"did":%q,"password":"guess","token":"123"}`, did)
+	for i := 0; i <= lim.Count; i++ {
+		resp, err := http.Post(u+"/xrpc/com.atproto.server.deleteAccount", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if i < lim.Count && resp.StatusCode == http.StatusTooManyRequests {
+			t.Fatalf("request %d was rate limited", i+1)
+		}
+		if i == lim.Count && resp.StatusCode != http.StatusTooManyRequests {
+			t.Fatalf("expected request %d to be rate limited, got %d", i+1, resp.StatusCode)
+		}
+	}
+}
+
+func TestRateLimitIgnoresForwardedFor(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	u := startTestAPI(t, s)
+
+	// clients can't get more attempts by claiming to be someone else
+	lim := DefaultRateLimits["/xrpc/com.atproto.server.createSession"]
+	for i := 0; i <= lim.Count; i++ {
+		req, err := http.NewRequest("POST", u+"/xrpc/com.atproto.server.createSession", strings.NewReader(`{"identifier":"alice.test","password":"guess"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("198.51.100.%d", i))
+		req.Header.Set("X-Real-IP", fmt.Sprintf("198.51.100.%d", i))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if limited := resp.StatusCode == http.StatusTooManyRequests; limited != (i == lim.Count) {
+			t.Fatalf("request %d: unexpected status %d", i+1, resp.StatusCode)
+		}
+	}
+}
+
+func TestAccountDeactivateAndDelete(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	mailer := &testMailer{}
+	s.SetMailer(mailer)
+	s.SetBlobStore(&blobs.DiskBlobStore{Dir: t.TempDir()})
+
+	ctx := context.Background()
+	o, err := s.handleComAtprotoServerCreateAccount(ctx, &atproto.ServerCreateAccount_Input{
+		Email:    "test@foo.com",
+		Password: "password",
+		Handle:   "testman.test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := s.lookupUserByDid(ctx, o.Did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uctx := context.WithValue(ctx, "user", u)
+
+	if _, err := s.handleComAtprotoRepoUploadBlob(uctx, bytes.NewReader([]byte("some blob")), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.handleComAtprotoServerDeactivateAccount(uctx, &atproto.ServerDeactivateAccount_Input{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.handleComAtprotoSyncGetHead(ctx, o.Did); err == nil {
+		t.Fatal("expected deactivated repo to be unavailable")
+	}
+	if err := checkAccountAccess(u, "/xrpc/com.atproto.repo.createRecord"); err == nil {
+		t.Fatal("expected deactivated account to be unable to write")
+	}
+
+	if err := s.handleComAtprotoServerActivateAccount(uctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.handleComAtprotoSyncGetHead(ctx, o.Did); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.handleComAtprotoServerRequestAccountDelete(uctx); err != nil {
+		t.Fatal(err)
+	}
+	if mailer.to != "test@foo.com" {
+		t.Fatalf("deletion token sent to wrong address: %q", mailer.to)
+	}
+
+	var tok AccountDeleteToken
+	if err := s.db.Find(&tok, "usr = ?", u.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains([]byte(mailer.body), []byte(tok.Token)) {
+		t.Fatal("email did not contain deletion token")
+	}
+
+	if err := s.handleComAtprotoServerDeleteAccount(ctx, &atproto.ServerDeleteAccount_Input{
+		Did:      o.Did,
+		Password: "password",
+		Token:    "wrong-token",
+	}); err == nil {
+		t.Fatal("expected wrong token to be rejected")
+	}
+
+	if err := s.handleComAtprotoServerDeleteAccount(ctx, &atproto.ServerDeleteAccount_Input{
+		Did:      o.Did,
+		Password: "password",
+		Token:    tok.Token,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.handleComAtprotoSyncListBlobs(ctx, o.Did, "", ""); err == nil {
+		t.Fatal("expected deleted repo to be unavailable")
+	}
+
+	// nothing should be purged during the grace period
+	if err := s.PurgeDeletedAccounts(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if cids, err := s.listUserBlobs(ctx, u); err != nil || len(cids) != 1 {
+		t.Fatalf("blobs purged during grace period: %v %v", cids, err)
+	}
+
+	if err := s.db.Model(User{}).Where("id = ?", u.ID).UpdateColumn("delete_after", time.Now().Add(-time.Minute)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PurgeDeletedAccounts(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if cids, err := s.listUserBlobs(ctx, u); err != nil || len(cids) != 0 {
+		t.Fatalf("blobs not purged: %v %v", cids, err)
+	}
+
+	du, err := s.lookupUserByDid(ctx, o.Did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if du.Status != AccountStatusDeleted || du.DeleteAfter != nil {
+		t.Fatalf("unexpected account state after purge: %q %v", du.Status, du.DeleteAfter)
+	}
+}
+
+func TestEmailAuthFactor(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	mailer := &testMailer{}
+	s.SetMailer(mailer)
+
+	ctx := context.Background()
+	o, err := s.handleComAtprotoServerCreateAccount(ctx, &atproto.ServerCreateAccount_Input{
+		Email:    "test@foo.com",
+		Password: "password",
+		Handle:   "testman.test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := s.lookupUserByDid(ctx, o.Did)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enable := true
+	if err := s.handleComAtprotoServerUpdateEmail(context.WithValue(ctx, "user", u), &atproto.ServerUpdateEmail_Input{
+		Email:           "test@foo.com",
+		EmailAuthFactor: &enable,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	login := func(token *string) error {
+		_, err := s.handleComAtprotoServerCreateSession(ctx, &atproto.ServerCreateSession_Input{
+			Identifier:      "testman.test",
+			Password:        "password",
+			AuthFactorToken: token,
+		})
+		return err
+	}
+
+	if err := login(nil); err != errAuthFactorTokenRequired {
+		t.Fatalf("expected auth factor to be required, got %v", err)
+	}
+
+	var code AuthFactorCode
+	if err := s.db.Find(&code, "usr = ?", u.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if code.ID == 0 || !bytes.Contains([]byte(mailer.body), []byte(code.Code)) {
+		t.Fatal("sign in code was not emailed")
+	}
+
+	wrong := "wrong-code"
+	for i := 0; i < MaxAuthFactorAttempts; i++ {
+		if err := login(&wrong); err != errInvalidAuthFactorToken {
+			t.Fatalf("expected invalid token, got %v", err)
+		}
+	}
+	if err := login(&code.Code); err != errExpiredAuthFactorToken {
+		t.Fatalf("expected code to be invalidated after too many attempts, got %v", err)
+	}
+
+	if err := login(nil); err != errAuthFactorTokenRequired {
+		t.Fatal(err)
+	}
+	code = AuthFactorCode{}
+	if err := s.db.Find(&code, "usr = ?", u.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := login(&code.Code); err != nil {
+		t.Fatal(err)
+	}
+	if err := login(&code.Code); err == nil {
+		t.Fatal("expected sign in code to be single use")
+	}
+
+	if err := s.DisableEmailAuthFactor(ctx, o.Did); err != nil {
+		t.Fatal(err)
+	}
+	if err := login(nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type testDocResolver map[string]*did.Document
+
+func (tr testDocResolver) GetDocument(ctx context.Context, d string) (*did.Document, error) {
+	doc, ok := tr[d]
+	if !ok {
+		return nil, fmt.Errorf("no such did: %s", d)
+	}
+	return doc, nil
+}
+
+func TestGetServiceAuth(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	o, err := s.handleComAtprotoServerCreateAccount(ctx, &atproto.ServerCreateAccount_Input{
+		Email:    "test@foo.com",
+		Password: "password",
+		Handle:   "testman.test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := s.lookupUserByDid(ctx, o.Did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = context.WithValue(ctx, "user", u)
+
+	const aud = "did:web:labeler.test"
+	const lxm = "com.atproto.moderation.createReport"
+	out, err := s.handleComAtprotoServerGetServiceAuth(ctx, aud, 0, lxm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm, err := did.VerificationMethodFromKey(s.signingKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.ID = "#atproto"
+
+	v := &serviceauth.Validator{
+		Dir:        testDocResolver{o.Did: {VerificationMethod: []did.VerificationMethod{*vm}}},
+		ServiceDID: aud,
+		RequireLxm: true,
+	}
+	claims, err := v.Validate(ctx, out.Token, lxm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Iss != o.Did {
+		t.Fatalf("expected token to be issued by the account, got %q", claims.Iss)
+	}
+
+	if _, err := s.handleComAtprotoServerGetServiceAuth(ctx, aud, 0, "com.atproto.identity.updateHandle"); err == nil {
+		t.Fatal("expected service auth for identity methods to be refused")
+	}
+
+	if _, err := s.handleComAtprotoServerGetServiceAuth(ctx, aud, int(time.Now().Add(2*time.Hour).Unix()), lxm); err == nil {
+		t.Fatal("expected overly long lived token to be refused")
+	}
+}
+
+// docsPlc resolves the DIDs in docs itself, and everything else with the
+// wrapped client
+type docsPlc struct {
+	plc.PLCClient
+	docs testDocResolver
+}
+
+func (dp docsPlc) GetDocument(ctx context.Context, d string) (*did.Document, error) {
+	if doc, ok := dp.docs[d]; ok {
+		return doc, nil
+	}
+	return dp.PLCClient.GetDocument(ctx, d)
+}
+
+func TestCreateAccountMigrationAuth(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	s.serviceUrl = "https://pds.test"
+
+	const migrating = "did:plc:migrating"
+	const lxm = "com.atproto.server.createAccount"
+
+	raw, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := &did.PrivKey{Raw: raw, Type: did.KeyTypeP256}
+	vm, err := did.VerificationMethodFromKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.ID = "#atproto"
+	s.plc = docsPlc{
+		PLCClient: s.plc,
+		docs:      testDocResolver{migrating: {VerificationMethod: []did.VerificationMethod{*vm}}},
+	}
+
+	otherRaw, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey := &did.PrivKey{Raw: otherRaw, Type: did.KeyTypeP256}
+
+	token := func(key *did.PrivKey, iss, aud, lxm string) string {
+		tok, err := serviceauth.CreateToken(key, iss, aud, lxm, time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "Bearer " + tok
+	}
+
+	create := func(auth string) error {
+		ctx := context.WithValue(context.Background(), "auth", auth)
+		d := migrating
+		_, err := s.handleComAtprotoServerCreateAccount(ctx, &atproto.ServerCreateAccount_Input{
+			Email:    "migrating@foo.com",
+			Password: "password",
+			Handle:   "migrating.test",
+			Did:      &d,
+		})
+		return err
+	}
+
+	for name, auth := range map[string]string{
+		"no token":      "",
+		"wrong key":     token(otherKey, migrating, s.serviceDid(), lxm),
+		"wrong issuer":  token(key, "did:plc:someoneelse", s.serviceDid(), lxm),
+		"wrong service": token(key, migrating, "did:web:other.test", lxm),
+		"wrong method":  token(key, migrating, s.serviceDid(), "com.atproto.repo.createRecord"),
+		"unbound":       token(key, migrating, s.serviceDid(), ""),
+	} {
+		if err := create(auth); err == nil {
+			t.Fatalf("%s: expected migration to be refused", name)
+		}
+	}
+
+	var n int64
+	if err := s.db.Model(&User{}).Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("expected no accounts to be created by refused migrations, found %d", n)
+	}
+
+	if err := create(token(key, migrating, s.serviceDid(), lxm)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.lookupUserByDid(context.Background(), migrating); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecordSwaps(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	o, err := s.handleComAtprotoServerCreateAccount(ctx, &atproto.ServerCreateAccount_Input{
+		Email:    "test@foo.com",
+		Password: "password",
+		Handle:   "testman.test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := s.lookupUserByDid(ctx, o.Did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = context.WithValue(ctx, "user", u)
+
+	isInvalidSwap := func(err error) bool {
+		var xe *xrpcerr.Error
+		return errors.As(err, &xe) && xe.Status == http.StatusBadRequest && xe.Name == "InvalidSwap"
+	}
+	post := func(text string) *lexutil.LexiconTypeDecoder {
+		return &lexutil.LexiconTypeDecoder{Val: &bsky.FeedPost{Text: text, CreatedAt: "2023-06-01T12:00:00.000Z"}}
+	}
+
+	head, err := s.handleComAtprotoSyncGetHead(ctx, o.Did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rkey := "3jzfcijpj2z2a"
+	created, err := s.handleComAtprotoRepoCreateRecord(ctx, &atproto.RepoCreateRecord_Input{
+		Collection: "app.bsky.feed.post",
+		Repo:       o.Did,
+		Rkey:       &rkey,
+		Record:     post("first"),
+		SwapCommit: &head.Root,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the head has moved on since
+	_, err = s.handleComAtprotoRepoCreateRecord(ctx, &atproto.RepoCreateRecord_Input{
+		Collection: "app.bsky.feed.post",
+		Repo:       o.Did,
+		Record:     post("second"),
+		SwapCommit: &head.Root,
+	})
+	if !isInvalidSwap(err) {
+		t.Fatalf("expected InvalidSwap for a stale commit, got %v", err)
+	}
+
+	updated, err := s.handleComAtprotoRepoPutRecord(ctx, &atproto.RepoPutRecord_Input{
+		Collection: "app.bsky.feed.post",
+		Repo:       o.Did,
+		Rkey:       rkey,
+		Record:     post("edited"),
+		SwapRecord: &created.Cid,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a second edit based on the first version loses the race
+	_, err = s.handleComAtprotoRepoPutRecord(ctx, &atproto.RepoPutRecord_Input{
+		Collection: "app.bsky.feed.post",
+		Repo:       o.Did,
+		Rkey:       rkey,
+		Record:     post("edited again"),
+		SwapRecord: &created.Cid,
+	})
+	if !isInvalidSwap(err) {
+		t.Fatalf("expected InvalidSwap for a stale record, got %v", err)
+	}
+
+	err = s.handleComAtprotoRepoDeleteRecord(ctx, &atproto.RepoDeleteRecord_Input{
+		Collection: "app.bsky.feed.post",
+		Repo:       o.Did,
+		Rkey:       rkey,
+		SwapRecord: &created.Cid,
+	})
+	if !isInvalidSwap(err) {
+		t.Fatalf("expected InvalidSwap deleting a stale record, got %v", err)
+	}
+
+	head, err = s.handleComAtprotoSyncGetHead(ctx, o.Did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.handleComAtprotoRepoApplyWrites(ctx, &atproto.RepoApplyWrites_Input{
+		Repo:       o.Did,
+		SwapCommit: &head.Root,
+		Writes: []*atproto.RepoApplyWrites_Input_Writes_Elem{{
+			RepoApplyWrites_Delete: &atproto.RepoApplyWrites_Delete{Collection: "app.bsky.feed.post", Rkey: rkey},
+		}, {
+			RepoApplyWrites_Create: &atproto.RepoApplyWrites_Create{Collection: "app.bsky.feed.post", Value: post("replacement")},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.handleComAtprotoRepoDeleteRecord(ctx, &atproto.RepoDeleteRecord_Input{
+		Collection: "app.bsky.feed.post",
+		Repo:       o.Did,
+		Rkey:       rkey,
+		SwapRecord: &updated.Cid,
+	})
+	if !isInvalidSwap(err) {
+		t.Fatalf("expected InvalidSwap deleting a deleted record, got %v", err)
+	}
+
+	badCid := "not-a-cid"
+	_, err = s.handleComAtprotoRepoPutRecord(ctx, &atproto.RepoPutRecord_Input{
+		Collection: "app.bsky.feed.post",
+		Repo:       o.Did,
+		Rkey:       rkey,
+		Record:     post("edited"),
+		SwapCommit: &badCid,
+	})
+	var xe *xrpcerr.Error
+	if !errors.As(err, &xe) || xe.Name != xrpcerr.NameInvalidRequest {
+		t.Fatalf("expected InvalidRequest for an unparseable swap, got %v", err)
+	}
+}
+
+func TestOrphanBlobGC(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	s.SetBlobStore(&blobs.DiskBlobStore{Dir: t.TempDir()})
+
+	ctx := context.Background()
+	o, err := s.handleComAtprotoServerCreateAccount(ctx, &atproto.ServerCreateAccount_Input{
+		Email:    "test@foo.com",
+		Password: "password",
+		Handle:   "testman.test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := s.lookupUserByDid(ctx, o.Did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = context.WithValue(ctx, "user", u)
+
+	used, err := s.handleComAtprotoRepoUploadBlob(ctx, bytes.NewReader([]byte("used")), "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unused, err := s.handleComAtprotoRepoUploadBlob(ctx, bytes.NewReader([]byte("never used")), "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	post := &bsky.FeedPost{
+		Text:      "look at this",
+		CreatedAt: "2023-07-01T00:00:00.000Z",
+		Embed: &bsky.FeedPost_Embed{
+			EmbedImages: &bsky.EmbedImages{
+				Images: []*bsky.EmbedImages_Image{{Alt: "test", Image: used.Blob}},
+			},
+		},
+	}
+	rpath, _, err := s.repoman.CreateRecord(ctx, u.ID, "app.bsky.feed.post", post)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// still within the grace period
+	if n, _, err := s.CollectOrphanBlobs(ctx, time.Hour); err != nil || n != 0 {
+		t.Fatalf("expected nothing to be collected, got %d (%v)", n, err)
+	}
+
+	n, reclaimed, err := s.CollectOrphanBlobs(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || reclaimed != unused.Blob.Size {
+		t.Fatalf("expected only the unused blob to be collected, got %d blobs of %d bytes", n, reclaimed)
+	}
+	if _, err := s.loadBlob(ctx, u, unused.Blob.Ref.String()); err == nil {
+		t.Fatal("unused blob is still there")
+	}
+	if _, err := s.loadBlob(ctx, u, used.Blob.Ref.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	// users from before blob references were tracked are indexed first
+	if err := s.db.Where("usr = ?", u.ID).Delete(&RecordBlob{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.Model(User{}).Where("id = ?", u.ID).UpdateColumn("blob_refs_indexed", false).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n, _, err := s.CollectOrphanBlobs(ctx, 0); err != nil || n != 0 {
+		t.Fatalf("expected the used blob to be kept, got %d collected (%v)", n, err)
+	}
+
+	parts := strings.SplitN(rpath, "/", 2)
+	if err := s.repoman.DeleteRecord(ctx, u.ID, parts[0], parts[1]); err != nil {
+		t.Fatal(err)
+	}
+	if n, _, err := s.CollectOrphanBlobs(ctx, 0); err != nil || n != 1 {
+		t.Fatalf("expected the blob of the deleted record to be collected, got %d (%v)", n, err)
+	}
+	if _, err := s.loadBlob(ctx, u, used.Blob.Ref.String()); err == nil {
+		t.Fatal("blob of deleted record is still there")
+	}
+}
+
+func TestBlobQuotaConcurrentUploads(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	s.SetBlobStore(&blobs.DiskBlobStore{Dir: t.TempDir()})
+	s.SetDefaultBlobQuota(10)
+
+	ctx, did := testAccount(t, s, "testman.test")
+	u, err := s.lookupUserByDid(ctx, did)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only two of these fit, however they interleave
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = s.putBlob(ctx, u, []byte(fmt.Sprintf("blb%d", i)), "application/octet-stream")
+		}(i)
+	}
+	wg.Wait()
+
+	var stored int
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			stored++
+		case !errors.Is(err, ErrBlobQuotaExceeded):
+			t.Fatal(err)
+		}
+	}
+	if stored != 2 {
+		t.Fatalf("expected 2 uploads to fit in the quota, got %d", stored)
+	}
+
+	var used int64
+	if err := s.db.Model(Blob{}).Where("usr = ?", u.ID).Select("COALESCE(SUM(size), 0)").Scan(&used).Error; err != nil {
+		t.Fatal(err)
+	}
+	if used != 8 {
+		t.Fatalf("expected 8 bytes of blobs, got %d", used)
+	}
+}
+
+func TestTrackUnknownRecordBlobs(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	ctx, did := testAccount(t, s, "testman.test")
+	u, err := s.lookupUserByDid(ctx, did)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const blob = "bafkreiclp443lavogvhj3d2ob2cxbfuscni2k5jk7bebjzg7khl3esabwq"
+	var rr lexutil.RawRecord
+	if err := json.Unmarshal([]byte(`{
+		"$type": "com.example.unknown",
+		"image": {"$type": "blob", "ref": {"$link": "`+blob+`"}, "mimeType": "image/png", "size": 3}
+	}`), &rr); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := cid.NewPrefixV1(cid.DagCBOR, multihash.SHA2_256).Sum(rr.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{rc}, Version: 1}, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := carutil.LdWrite(buf, rc.Bytes(), rr.Raw); err != nil {
+		t.Fatal(err)
+	}
+
+	// records of types we don't know come without a decoded record
+	evt := &repomgr.RepoEvent{
+		User:      u.ID,
+		RepoSlice: buf.Bytes(),
+		Ops: []repomgr.RepoOp{{
+			Kind:       repomgr.EvtKindCreateRecord,
+			Collection: "com.example.unknown",
+			Rkey:       "1",
+			RecCid:     &rc,
+		}},
+	}
+	s.handleBlobRefs(ctx, evt)
+
+	var refs []string
+	if err := s.db.Model(RecordBlob{}).Where("usr = ? AND rpath = ?", u.ID, "com.example.unknown/1").Pluck("cid", &refs).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 1 || refs[0] != blob {
+		t.Fatalf("expected the record to reference %s, got %v", blob, refs)
+	}
+
+	// a failure leaves the user to be reindexed before their blobs are
+	// collected
+	evt.RepoSlice = nil
+	s.handleBlobRefs(ctx, evt)
+
+	if err := s.db.First(u, u.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if u.BlobRefsIndexed {
+		t.Fatal("expected the user's blob references to be marked unindexed")
+	}
+}
+
+// testAccount creates an account, returning a context logged in as it and
+// its DID
+func testAccount(t *testing.T, s *Server, handle string) (context.Context, string) {
+	t.Helper()
+	ctx := context.Background()
+	o, err := s.handleComAtprotoServerCreateAccount(ctx, &atproto.ServerCreateAccount_Input{
+		Email:    handle + "@foo.com",
+		Password: "password",
+		Handle:   handle,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := s.lookupUserByDid(ctx, o.Did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return context.WithValue(ctx, "user", u), o.Did
+}
+
+func testCreateRecord(t *testing.T, s *Server, ctx context.Context, repo, collection string, rec lexutil.CBOR) *atproto.RepoCreateRecord_Output {
+	t.Helper()
+	out, err := s.handleComAtprotoRepoCreateRecord(ctx, &atproto.RepoCreateRecord_Input{
+		Collection: collection,
+		Repo:       repo,
+		Record:     &lexutil.LexiconTypeDecoder{Val: rec},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestNotifications(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	account := func(handle string) (context.Context, string) {
+		return testAccount(t, s, handle)
+	}
+	create := func(ctx context.Context, repo, collection string, rec lexutil.CBOR) *atproto.RepoCreateRecord_Output {
+		return testCreateRecord(t, s, ctx, repo, collection, rec)
+	}
+
+	actx, alice := account("alice.test")
+	bctx, bob := account("bob.test")
+	now := "2023-06-01T12:00:00.000Z"
+
+	post := create(actx, alice, "app.bsky.feed.post", &bsky.FeedPost{Text: "hello", CreatedAt: now})
+	ref := &atproto.RepoStrongRef{Uri: post.Uri, Cid: post.Cid}
+	create(actx, alice, "app.bsky.feed.like", &bsky.FeedLike{Subject: ref, CreatedAt: now})
+	create(bctx, bob, "app.bsky.feed.like", &bsky.FeedLike{Subject: ref, CreatedAt: now})
+	create(bctx, bob, "app.bsky.graph.follow", &bsky.GraphFollow{Subject: alice, CreatedAt: now})
+	create(bctx, bob, "app.bsky.feed.post", &bsky.FeedPost{
+		Text:      "look",
+		CreatedAt: now,
+		Embed:     &bsky.FeedPost_Embed{EmbedRecord: &bsky.EmbedRecord{Record: ref}},
+		Facets: []*bsky.RichtextFacet{{
+			Index:    &bsky.RichtextFacet_ByteSlice{ByteStart: 0, ByteEnd: 4},
+			Features: []*bsky.RichtextFacet_Features_Elem{{RichtextFacet_Mention: &bsky.RichtextFacet_Mention{Did: alice}}},
+		}},
+	})
+
+	// alice's own like doesn't notify her
+	var reasons []string
+	var cursor string
+	for {
+		page, err := s.handleAppBskyNotificationListNotifications(actx, cursor, 2, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range page.Notifications {
+			reasons = append(reasons, n.Reason)
+			if n.Author.Did != bob {
+				t.Fatalf("notification by %s, not bob", n.Author.Did)
+			}
+		}
+		if page.Cursor == nil {
+			break
+		}
+		cursor = *page.Cursor
+	}
+	if strings.Join(reasons, ",") != "quote,mention,follow,like" {
+		t.Fatalf("unexpected notifications: %v", reasons)
+	}
+
+	_, err := s.handleAppBskyNotificationListNotifications(actx, "nope", 2, "")
+	if xrpcerr.Status(err) != http.StatusBadRequest {
+		t.Fatalf("expected a bad request for an invalid cursor, got %v", err)
+	}
+
+	count, err := s.handleAppBskyNotificationGetUnreadCount(actx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count.Count != 4 {
+		t.Fatalf("expected 4 unread notifications, got %d", count.Count)
+	}
+
+	seen := time.Now().Add(time.Second).Format(time.RFC3339)
+	if err := s.handleAppBskyNotificationUpdateSeen(actx, &bsky.NotificationUpdateSeen_Input{SeenAt: seen}); err != nil {
+		t.Fatal(err)
+	}
+	count, err = s.handleAppBskyNotificationGetUnreadCount(actx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count.Count != 0 {
+		t.Fatalf("expected no unread notifications after updateSeen, got %d", count.Count)
+	}
+
+	n, err := s.notifman.Prune(ctx, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Fatalf("expected 4 notifications pruned, got %d", n)
+	}
+}
+
+func TestBlockedFeeds(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	actx, alice := testAccount(t, s, "alice.test")
+	bctx, bob := testAccount(t, s, "bob.test")
+	cctx, carol := testAccount(t, s, "carol.test")
+	now := "2023-06-01T12:00:00.000Z"
+
+	testCreateRecord(t, s, actx, alice, "app.bsky.feed.post", &bsky.FeedPost{Text: "hello from alice", CreatedAt: now})
+	testCreateRecord(t, s, bctx, bob, "app.bsky.feed.post", &bsky.FeedPost{Text: "hello from bob", CreatedAt: now})
+	testCreateRecord(t, s, cctx, carol, "app.bsky.graph.follow", &bsky.GraphFollow{Subject: alice, CreatedAt: now})
+	testCreateRecord(t, s, cctx, carol, "app.bsky.graph.follow", &bsky.GraphFollow{Subject: bob, CreatedAt: now})
+	testCreateRecord(t, s, bctx, bob, "app.bsky.graph.block", &bsky.GraphBlock{Subject: carol, CreatedAt: now})
+
+	tl, err := s.handleAppBskyFeedGetTimeline(cctx, "", "", 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tl.Feed) != 1 || tl.Feed[0].Post.Author.Did != alice {
+		t.Fatalf("expected only alice's post in carol's timeline, got %d posts", len(tl.Feed))
+	}
+
+	isError := func(err error, name string) bool {
+		var xe *xrpcerr.Error
+		return errors.As(err, &xe) && xe.Name == name
+	}
+	_, err = s.handleAppBskyFeedGetAuthorFeed(cctx, bob, "", "", 50)
+	if !isError(err, "BlockedByActor") {
+		t.Fatalf("expected BlockedByActor for carol viewing bob, got %v", err)
+	}
+	_, err = s.handleAppBskyFeedGetAuthorFeed(bctx, carol, "", "", 50)
+	if !isError(err, "BlockedActor") {
+		t.Fatalf("expected BlockedActor for bob viewing carol, got %v", err)
+	}
+	if _, err := s.handleAppBskyFeedGetAuthorFeed(actx, bob, "", "", 50); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,237 @@
+package pds
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/util/imgproc"
+	"github.com/bluesky-social/indigo/util/xrpcerr"
+
+	"github.com/labstack/echo/v4"
+)
+
+var ErrImageTooLarge = fmt.Errorf("image exceeds maximum size")
+
+// ImageConfig configures how uploaded images are checked and processed
+type ImageConfig struct {
+	// MaxSize is the largest image accepted, in bytes, if set
+	MaxSize int64
+
+	// MaxDimension is the largest width or height accepted, in pixels, if
+	// set. Only applies to the formats which can be decoded.
+	MaxDimension int
+
+	// StripMetadata removes EXIF and other metadata from JPEG and PNG
+	// images before they are stored
+	StripMetadata bool
+
+	// Variants are the sizes of the resized copies to store of each image,
+	// as the most pixels in either dimension
+	Variants []int
+}
+
+// DefaultImageConfig matches the limits of images embedded in posts
+var DefaultImageConfig = ImageConfig{
+	MaxSize:       1_000_000,
+	MaxDimension:  8192,
+	StripMetadata: true,
+}
+
+// BlobVariant tracks a resized copy of an image blob, stored next to it in
+// the blob store
+type BlobVariant struct {
+	ID           uint       `gorm:"primarykey"`
+	Usr          models.Uid `gorm:"uniqueIndex:idx_blob_variant"`
+	Cid          string     `gorm:"uniqueIndex:idx_blob_variant"`
+	MaxDimension int        `gorm:"uniqueIndex:idx_blob_variant"`
+	MimeType     string
+	Size         int64
+}
+
+// variantKey is the blob store key of a variant
+func variantKey(c string, maxDim int) string {
+	return c + "@" + strconv.Itoa(maxDim)
+}
+
+// SetImageConfig has uploaded images checked and processed as configured.
+// Blobs which are not images, going by both their declared and actual type,
+// and blobs already referenced by the account's records (such as those of a
+// migrated repo), are stored as they are.
+func (s *Server) SetImageConfig(cfg *ImageConfig) {
+	s.images = cfg
+}
+
+// processImage checks that an upload is of the type it claims to be, and if
+// it is an image applies the image config to it
+func (s *Server) processImage(data []byte, mimeType string) ([]byte, string, error) {
+	declared := imgproc.NormalizeMimeType(mimeType)
+	actual := imgproc.DetectMimeType(data)
+
+	if !strings.HasPrefix(declared, "image/") && !strings.HasPrefix(actual, "image/") {
+		return data, mimeType, nil
+	}
+
+	// clients not saying what they are uploading get the type it is
+	switch declared {
+	case "", "*/*", "application/octet-stream":
+		declared = actual
+	}
+	if declared != actual {
+		return nil, "", xrpcerr.InvalidRequest("blob declared as %q is %q", mimeType, actual)
+	}
+
+	cfg := s.images
+	if cfg.MaxSize > 0 && int64(len(data)) > cfg.MaxSize {
+		return nil, "", ErrImageTooLarge
+	}
+
+	if imgproc.Decodable(actual) {
+		ic, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, "", xrpcerr.InvalidRequest("invalid %s image: %s", actual, err)
+		}
+		if cfg.MaxDimension > 0 && (ic.Width > cfg.MaxDimension || ic.Height > cfg.MaxDimension) {
+			return nil, "", xrpcerr.InvalidRequest("image is %dx%d, larger than %d pixels across", ic.Width, ic.Height, cfg.MaxDimension)
+		}
+	}
+
+	if cfg.StripMetadata {
+		stripped, err := imgproc.StripMetadata(data, actual)
+		if err != nil {
+			return nil, "", xrpcerr.InvalidRequest("invalid %s image: %s", actual, err)
+		}
+		data = stripped
+	}
+
+	return data, actual, nil
+}
+
+// storeImageVariants stores the configured variants of an image blob, which
+// are only made of images larger than them
+func (s *Server) storeImageVariants(ctx context.Context, u *User, c string, data []byte, mimeType string) error {
+	if s.images == nil || len(s.images.Variants) == 0 || !imgproc.Decodable(mimeType) {
+		return nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("decoding image: %w", err)
+	}
+
+	for _, maxDim := range s.images.Variants {
+		resized := imgproc.Resize(img, maxDim)
+		if resized == img {
+			continue
+		}
+
+		buf := new(bytes.Buffer)
+		mt, err := imgproc.Encode(buf, resized, mimeType)
+		if err != nil {
+			return fmt.Errorf("encoding %d pixel variant: %w", maxDim, err)
+		}
+
+		if err := s.blobs.PutBlob(ctx, variantKey(c, maxDim), u.Did, buf.Bytes()); err != nil {
+			return fmt.Errorf("writing variant to store: %w", err)
+		}
+
+		v := BlobVariant{Usr: u.ID, Cid: c, MaxDimension: maxDim}
+		if err := s.db.Where(&v).Assign(BlobVariant{MimeType: mt, Size: int64(buf.Len())}).FirstOrCreate(&v).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteBlobVariants removes the variants of a blob, or of all the user's
+// blobs if c is empty, from the blob store and the database
+func (s *Server) deleteBlobVariants(ctx context.Context, usr models.Uid, did string, c string) error {
+	q := s.db.Where("usr = ?", usr)
+	if c != "" {
+		q = q.Where("cid = ?", c)
+	}
+
+	var variants []BlobVariant
+	if err := q.Find(&variants).Error; err != nil {
+		return err
+	}
+
+	for _, v := range variants {
+		if err := s.blobs.DeleteBlob(ctx, variantKey(v.Cid, v.MaxDimension), did); err != nil {
+			return fmt.Errorf("deleting variant of blob %s: %w", v.Cid, err)
+		}
+		if err := s.db.Delete(&v).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// HandleBlobVariant serves a resized copy of an image blob, falling back to
+// the blob itself for images which were no larger than the variant
+func (s *Server) HandleBlobVariant(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if s.blobs == nil {
+		return ErrBlobStoreNotConfigured
+	}
+
+	maxDim, err := strconv.Atoi(c.Param("size"))
+	if err != nil {
+		return xrpcerr.InvalidRequest("invalid variant size %q", c.Param("size"))
+	}
+
+	u, err := s.lookupUserByDid(ctx, c.Param("did"))
+	if err != nil {
+		return err
+	}
+	if err := checkRepoAvailable(u); err != nil {
+		return err
+	}
+
+	var b Blob
+	if err := s.db.Find(&b, "usr = ? AND cid = ?", u.ID, c.Param("cid")).Error; err != nil {
+		return err
+	}
+	if b.ID == 0 {
+		return xrpcerr.NotFound("blob not found")
+	}
+
+	var v BlobVariant
+	if err := s.db.Find(&v, "usr = ? AND cid = ? AND max_dimension = ?", u.ID, b.Cid, maxDim).Error; err != nil {
+		return err
+	}
+
+	key, mimeType := b.Cid, b.MimeType
+	if v.ID != 0 {
+		key, mimeType = variantKey(b.Cid, maxDim), v.MimeType
+	} else if !s.isImageVariant(maxDim) || !imgproc.Decodable(b.MimeType) {
+		return xrpcerr.NotFound("no %d pixel variant of blob", maxDim)
+	}
+
+	data, err := s.blobs.GetBlob(ctx, key, u.Did)
+	if err != nil {
+		return err
+	}
+
+	return c.Blob(http.StatusOK, mimeType, data)
+}
+
+func (s *Server) isImageVariant(maxDim int) bool {
+	if s.images == nil {
+		return false
+	}
+	for _, v := range s.images.Variants {
+		if v == maxDim {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,218 @@
+package pds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/blobs"
+	"github.com/bluesky-social/indigo/util/xrpcerr"
+
+	"github.com/ipfs/go-cid"
+	"github.com/labstack/echo/v4"
+	"github.com/multiformats/go-multihash"
+)
+
+// testJPEG returns a w by h JPEG with an EXIF segment
+func testJPEG(t *testing.T, w, h int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 100, A: 255})
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	payload := []byte("Exif\x00\x00gps 1.2,3.4")
+	exif := append([]byte{0xff, 0xe1, 0, byte(len(payload) + 2)}, payload...)
+	return append(append(append([]byte{}, data[:2]...), exif...), data[2:]...)
+}
+
+func TestImageUploads(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	s.SetBlobStore(&blobs.DiskBlobStore{Dir: t.TempDir()})
+	s.SetImageConfig(&ImageConfig{
+		MaxSize:       100_000,
+		MaxDimension:  200,
+		StripMetadata: true,
+		Variants:      []int{50, 500},
+	})
+
+	ctx := context.Background()
+	o, err := s.handleComAtprotoServerCreateAccount(ctx, &atproto.ServerCreateAccount_Input{
+		Email:    "test@foo.com",
+		Password: "password",
+		Handle:   "testman.test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := s.lookupUserByDid(ctx, o.Did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = context.WithValue(ctx, "user", u)
+
+	up, err := s.handleComAtprotoRepoUploadBlob(ctx, bytes.NewReader(testJPEG(t, 120, 80)), "image/jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up.Blob.MimeType != "image/jpeg" {
+		t.Fatalf("unexpected mime type %q", up.Blob.MimeType)
+	}
+
+	stored, err := s.loadBlob(ctx, u, up.Blob.Ref.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, []byte("gps")) {
+		t.Fatal("EXIF was not stripped")
+	}
+	if int64(len(stored)) != up.Blob.Size {
+		t.Fatalf("blob size %d doesn't match stored size %d", up.Blob.Size, len(stored))
+	}
+
+	variant := func(size string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest("GET", "/", nil), rec)
+		c.SetParamNames("did", "cid", "size")
+		c.SetParamValues(u.Did, up.Blob.Ref.String(), size)
+		if err := s.HandleBlobVariant(c); err != nil {
+			var xe *xrpcerr.Error
+			if !errors.As(err, &xe) {
+				t.Fatal(err)
+			}
+			rec.Code = xe.Status
+		}
+		return rec
+	}
+
+	rec := variant("50")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	cfg, err := jpeg.DecodeConfig(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != 50 || cfg.Height != 33 {
+		t.Fatalf("unexpected variant size %dx%d", cfg.Width, cfg.Height)
+	}
+
+	// images already smaller than a variant are served as they are
+	if rec := variant("500"); rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), stored) {
+		t.Fatalf("expected the original image, got status %d", rec.Code)
+	}
+	if rec := variant("64"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected no 64 pixel variant, got status %d", rec.Code)
+	}
+
+	for name, tc := range map[string]struct {
+		data     []byte
+		mimeType string
+		status   int
+	}{
+		"wrong type":    {testJPEG(t, 10, 10), "image/png", http.StatusBadRequest},
+		"not an image":  {[]byte("just some text"), "image/jpeg", http.StatusBadRequest},
+		"too wide":      {testJPEG(t, 300, 10), "image/jpeg", http.StatusBadRequest},
+		"too large":     {append(testJPEG(t, 10, 10), make([]byte, 100_000)...), "image/jpeg", http.StatusRequestEntityTooLarge},
+		"unparseable":   {[]byte("\xff\xd8\xff\xe0garbage"), "image/jpeg", http.StatusBadRequest},
+		"untyped image": {testJPEG(t, 10, 10), "application/octet-stream", 0},
+		"not an upload": {[]byte("plain text"), "text/plain", 0},
+	} {
+		_, err := s.handleComAtprotoRepoUploadBlob(ctx, bytes.NewReader(tc.data), tc.mimeType)
+		if tc.status == 0 {
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+			continue
+		}
+
+		status := 0
+		var xe *xrpcerr.Error
+		if errors.As(err, &xe) {
+			status = xe.Status
+		} else if errors.Is(err, ErrImageTooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		if status != tc.status {
+			t.Errorf("%s: expected status %d, got %v", name, tc.status, err)
+		}
+	}
+
+	// variants go with their blob
+	if _, _, err := s.CollectOrphanBlobs(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	var n int64
+	if err := s.db.Model(BlobVariant{}).Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("expected variants to be collected along with their blobs, %d left", n)
+	}
+}
+
+func TestReferencedImagesKeepTheirCid(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	s.SetBlobStore(&blobs.DiskBlobStore{Dir: t.TempDir()})
+	s.SetImageConfig(&ImageConfig{StripMetadata: true})
+
+	ctx := context.Background()
+	o, err := s.handleComAtprotoServerCreateAccount(ctx, &atproto.ServerCreateAccount_Input{
+		Email:    "test@foo.com",
+		Password: "password",
+		Handle:   "testman.test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := s.lookupUserByDid(ctx, o.Did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = context.WithValue(ctx, "user", u)
+
+	// as for a blob of a migrated repo, which is referenced before it is
+	// uploaded
+	data := testJPEG(t, 20, 20)
+	bcid, err := cid.NewPrefixV1(cid.Raw, multihash.SHA2_256).Sum(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.Create(&RecordBlob{Usr: u.ID, Cid: bcid.String(), Rpath: "app.bsky.feed.post/1"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	up, err := s.handleComAtprotoRepoUploadBlob(ctx, bytes.NewReader(data), "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up.Blob.Ref.String() != bcid.String() {
+		t.Fatalf("referenced blob was stored as %s, not %s", up.Blob.Ref, bcid)
+	}
+
+	stored, err := s.loadBlob(ctx, u, bcid.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, data) {
+		t.Fatal("referenced blob was altered")
+	}
+}
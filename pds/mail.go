@@ -0,0 +1,39 @@
+package pds
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"strings"
+)
+
+// Mailer sends email to the users of this PDS, eg to deliver confirmation
+// tokens for sensitive account operations
+type Mailer interface {
+	SendMail(ctx context.Context, to, subject, body string) error
+}
+
+// logMailer is the default Mailer. It writes messages to the log instead of
+// sending them, which is only suitable for development servers.
+type logMailer struct{}
+
+func (logMailer) SendMail(ctx context.Context, to, subject, body string) error {
+	log.Warnw("no mailer configured, logging email instead of sending", "to", to, "subject", subject, "body", body)
+	return nil
+}
+
+// SetMailer sets the mailer used to email users. Until a mailer is set, emails
+// are written to the log.
+func (s *Server) SetMailer(m Mailer) {
+	s.mailer = m
+}
+
+// generateEmailToken returns a short random token that is easy for a user to
+// copy out of an email, eg "abcde-fghij"
+func generateEmailToken() string {
+	b := make([]byte, 10)
+	rand.Read(b)
+
+	tok := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+	return tok[:5] + "-" + tok[5:10]
+}
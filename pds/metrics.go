@@ -0,0 +1,32 @@
+package pds
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var orphanBlobsCollected = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "pds_orphan_blobs_collected_total",
+	Help: "The total number of blobs deleted for no longer being referenced by any record",
+})
+
+var orphanBlobBytesReclaimed = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "pds_orphan_blob_bytes_reclaimed_total",
+	Help: "The total size of the blobs deleted for no longer being referenced by any record",
+})
+
+var blobGCDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "pds_blob_gc_duration_seconds",
+	Help:    "How long each pass of the orphaned blob collector took",
+	Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+})
+
+var blobRefTrackingFailures = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "pds_blob_ref_tracking_failures_total",
+	Help: "The total number of repo events whose blob references could not be tracked",
+})
+
+var ruleActionsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pds_rule_actions_total",
+	Help: "The total number of actions called for by rules on written records, by rule and kind of action",
+}, []string{"rule", "kind"})
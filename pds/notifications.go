@@ -0,0 +1,33 @@
+package pds
+
+import (
+	"context"
+	"time"
+)
+
+// NotificationRetention is how long notifications are kept before they are
+// pruned. Zero keeps them forever.
+var NotificationRetention = 30 * 24 * time.Hour
+
+// notifPruneInterval is how often we prune old notifications
+var notifPruneInterval = time.Hour
+
+func (s *Server) runNotificationPruner(ctx context.Context) {
+	t := time.NewTicker(notifPruneInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			n, err := s.notifman.Prune(ctx, time.Now().Add(-NotificationRetention))
+			if err != nil {
+				log.Errorw("failed to prune notifications", "err", err)
+			}
+			if n > 0 {
+				log.Infow("pruned notifications", "notifications", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,653 @@
+package pds
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/models"
+	"github.com/labstack/echo/v4"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"gorm.io/gorm"
+)
+
+const (
+	oauthRequestTTL      = 5 * time.Minute
+	oauthCodeTTL         = time.Minute
+	oauthAccessTokenTTL  = 30 * time.Minute
+	oauthRefreshTokenTTL = 14 * 24 * time.Hour
+
+	oauthRequestURIPrefix = "urn:ietf:params:oauth:request_uri:"
+	oauthCSRFCookie       = "oauth-csrf"
+)
+
+// OAuthRequest is an authorization request pushed by a client through PAR.
+// Once the user signs in and approves it, Code is set and may be exchanged
+// once at the token endpoint.
+type OAuthRequest struct {
+	gorm.Model
+	RequestURI    string `gorm:"uniqueIndex"`
+	ClientID      string
+	RedirectURI   string
+	Scope         string
+	State         string
+	CodeChallenge string
+	LoginHint     string
+	DPoPJkt       string
+	ExpiresAt     time.Time
+
+	Usr  models.Uid
+	Code *string `gorm:"uniqueIndex"`
+}
+
+// OAuthRefreshToken is an issued refresh token. Only a hash of the token is
+// stored. Refresh tokens are single use and bound to the DPoP key of the
+// client they were issued to.
+type OAuthRefreshToken struct {
+	gorm.Model
+	TokenHash string     `gorm:"uniqueIndex"`
+	Usr       models.Uid `gorm:"index"`
+	ClientID  string
+	Scope     string
+	DPoPJkt   string
+	ExpiresAt time.Time
+}
+
+type oauthError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+type oauthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+	Sub          string `json:"sub"`
+}
+
+func writeOAuthError(c echo.Context, code int, err string, desc string) error {
+	return c.JSON(code, oauthError{Error: err, Description: desc})
+}
+
+// writeDPoPError responds to a request with a bad DPoP proof. The current
+// nonce has already been set on the response by the caller.
+func writeDPoPError(c echo.Context, err error) error {
+	if errors.Is(err, errUseDPoPNonce) {
+		return writeOAuthError(c, 400, "use_dpop_nonce", "authorization server requires nonce in DPoP proof")
+	}
+
+	return writeOAuthError(c, 400, "invalid_dpop_proof", err.Error())
+}
+
+func randomOAuthToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func hashOAuthToken(tok string) string {
+	h := sha256.Sum256([]byte(tok))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// oauthAccessTokenKey is the key access tokens are signed with. It is derived
+// from, but distinct from, the key for legacy session tokens so that an
+// access token can never be presented as a (non DPoP bound) session token.
+func (s *Server) oauthAccessTokenKey() []byte {
+	k := sha256.Sum256(append([]byte("oauth-access-token:"), s.jwtSigningKey...))
+	return k[:]
+}
+
+func (s *Server) RegisterHandlersOAuth(e *echo.Echo) {
+	e.GET("/.well-known/oauth-authorization-server", s.handleOAuthServerMetadata)
+	e.GET("/.well-known/oauth-protected-resource", s.handleOAuthResourceMetadata)
+	e.POST("/oauth/par", s.handleOAuthPAR)
+	e.GET("/oauth/authorize", s.handleOAuthAuthorizePage)
+	e.POST("/oauth/authorize", s.handleOAuthAuthorizeSubmit)
+	e.POST("/oauth/token", s.handleOAuthToken)
+	e.POST("/oauth/introspect", s.handleOAuthIntrospect)
+	e.POST("/oauth/revoke", s.handleOAuthRevoke)
+}
+
+func (s *Server) handleOAuthServerMetadata(c echo.Context) error {
+	iss := requestOrigin(c)
+	return c.JSON(200, map[string]any{
+		"issuer":                                         iss,
+		"authorization_endpoint":                         iss + "/oauth/authorize",
+		"token_endpoint":                                 iss + "/oauth/token",
+		"pushed_authorization_request_endpoint":          iss + "/oauth/par",
+		"introspection_endpoint":                         iss + "/oauth/introspect",
+		"revocation_endpoint":                            iss + "/oauth/revoke",
+		"require_pushed_authorization_requests":          true,
+		"response_types_supported":                       []string{"code"},
+		"grant_types_supported":                          []string{"authorization_code", "refresh_token"},
+		"code_challenge_methods_supported":               []string{"S256"},
+		"token_endpoint_auth_methods_supported":          []string{"none"},
+		"scopes_supported":                               []string{"atproto", "transition:generic"},
+		"dpop_signing_alg_values_supported":              []string{"ES256"},
+		"client_id_metadata_document_supported":          true,
+		"authorization_response_iss_parameter_supported": true,
+	})
+}
+
+func (s *Server) handleOAuthResourceMetadata(c echo.Context) error {
+	iss := requestOrigin(c)
+	return c.JSON(200, map[string]any{
+		"resource":                 iss,
+		"authorization_servers":    []string{iss},
+		"scopes_supported":         []string{"atproto", "transition:generic"},
+		"bearer_methods_supported": []string{"header"},
+	})
+}
+
+func (s *Server) handleOAuthPAR(c echo.Context) error {
+	ctx := c.Request().Context()
+	c.Response().Header().Set("DPoP-Nonce", s.dpop.Nonce())
+
+	jkt, err := s.dpop.Verify(c.Request().Header.Get("DPoP"), "POST", requestHtu(c), "")
+	if err != nil {
+		return writeDPoPError(c, err)
+	}
+
+	client, err := s.oauthClients(ctx, c.FormValue("client_id"))
+	if err != nil {
+		return writeOAuthError(c, 400, "invalid_client", err.Error())
+	}
+
+	if c.FormValue("response_type") != "code" {
+		return writeOAuthError(c, 400, "unsupported_response_type", "only the code response type is supported")
+	}
+
+	redirect := c.FormValue("redirect_uri")
+	if !client.allowsRedirect(redirect) {
+		return writeOAuthError(c, 400, "invalid_request", "redirect_uri is not registered for this client")
+	}
+
+	if c.FormValue("code_challenge_method") != "S256" || c.FormValue("code_challenge") == "" {
+		return writeOAuthError(c, 400, "invalid_request", "an S256 code_challenge is required")
+	}
+
+	scope := c.FormValue("scope")
+	if !hasScope(scope, "atproto") {
+		return writeOAuthError(c, 400, "invalid_scope", "scope must include atproto")
+	}
+	for _, sc := range strings.Fields(scope) {
+		if !hasScope(client.Scope, sc) {
+			return writeOAuthError(c, 400, "invalid_scope", fmt.Sprintf("client did not register scope %q", sc))
+		}
+	}
+
+	req := &OAuthRequest{
+		RequestURI:    oauthRequestURIPrefix + randomOAuthToken(),
+		ClientID:      client.ClientID,
+		RedirectURI:   redirect,
+		Scope:         scope,
+		State:         c.FormValue("state"),
+		CodeChallenge: c.FormValue("code_challenge"),
+		LoginHint:     c.FormValue("login_hint"),
+		DPoPJkt:       jkt,
+		ExpiresAt:     time.Now().Add(oauthRequestTTL),
+	}
+	if err := s.db.Create(req).Error; err != nil {
+		return err
+	}
+
+	return c.JSON(201, map[string]any{
+		"request_uri": req.RequestURI,
+		"expires_in":  int(oauthRequestTTL.Seconds()),
+	})
+}
+
+// lookupPendingOAuthRequest finds an unexpired authorization request that has
+// not yet been approved
+func (s *Server) lookupPendingOAuthRequest(ctx context.Context, requestURI, clientID string) (*OAuthRequest, error) {
+	var req OAuthRequest
+	if err := s.db.Find(&req, "request_uri = ? AND client_id = ?", requestURI, clientID).Error; err != nil {
+		return nil, err
+	}
+
+	if req.ID == 0 || req.Code != nil || time.Now().After(req.ExpiresAt) {
+		return nil, fmt.Errorf("unknown or expired authorization request")
+	}
+
+	return &req, nil
+}
+
+var oauthAuthorizeTmpl = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Sign in to {{.ClientName}}</title></head>
+<body>
+<h1>Sign in</h1>
+<p><b>{{.ClientName}}</b> is asking for access to your account ({{.Scope}}).</p>
+{{if .Error}}<p style="color: red">{{.Error}}</p>{{end}}
+<form method="post" action="/oauth/authorize">
+<input type="hidden" name="client_id" value="{{.ClientID}}">
+<input type="hidden" name="request_uri" value="{{.RequestURI}}">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<label>Handle <input name="identifier" value="{{.Identifier}}" autocomplete="username"></label><br>
+<label>Password <input name="password" type="password" autocomplete="current-password"></label><br>
+{{if .NeedCode}}<label>Sign in code <input name="auth_factor_token" autocomplete="one-time-code"></label><br>{{end}}
+<button name="action" value="allow">Allow</button>
+<button name="action" value="deny">Deny</button>
+</form>
+</body>
+</html>
+`))
+
+type oauthAuthorizePage struct {
+	ClientID   string
+	ClientName string
+	RequestURI string
+	Scope      string
+	CSRF       string
+	Identifier string
+	NeedCode   bool
+	Error      string
+}
+
+func (s *Server) renderOAuthAuthorizePage(c echo.Context, page *oauthAuthorizePage) error {
+	client, err := s.oauthClients(c.Request().Context(), page.ClientID)
+	if err != nil {
+		return writeOAuthError(c, 400, "invalid_client", err.Error())
+	}
+
+	page.ClientName = client.ClientName
+	if page.ClientName == "" {
+		page.ClientName = client.ClientID
+	}
+
+	c.Response().Header().Set("Content-Type", "text/html; charset=utf-8")
+	c.Response().Header().Set("X-Frame-Options", "DENY")
+	c.Response().WriteHeader(200)
+	return oauthAuthorizeTmpl.Execute(c.Response(), page)
+}
+
+func (s *Server) handleOAuthAuthorizePage(c echo.Context) error {
+	clientID := c.QueryParam("client_id")
+	req, err := s.lookupPendingOAuthRequest(c.Request().Context(), c.QueryParam("request_uri"), clientID)
+	if err != nil {
+		return writeOAuthError(c, 400, "invalid_request", err.Error())
+	}
+
+	csrf := randomOAuthToken()
+	c.SetCookie(&http.Cookie{
+		Name:     oauthCSRFCookie,
+		Value:    csrf,
+		Path:     "/oauth",
+		HttpOnly: true,
+		Secure:   c.Scheme() == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return s.renderOAuthAuthorizePage(c, &oauthAuthorizePage{
+		ClientID:   clientID,
+		RequestURI: req.RequestURI,
+		Scope:      req.Scope,
+		CSRF:       csrf,
+		Identifier: req.LoginHint,
+	})
+}
+
+func (s *Server) handleOAuthAuthorizeSubmit(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	cookie, err := c.Cookie(oauthCSRFCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(c.FormValue("csrf"))) != 1 {
+		return writeOAuthError(c, 400, "invalid_request", "invalid csrf token")
+	}
+
+	req, err := s.lookupPendingOAuthRequest(ctx, c.FormValue("request_uri"), c.FormValue("client_id"))
+	if err != nil {
+		return writeOAuthError(c, 400, "invalid_request", err.Error())
+	}
+
+	if c.FormValue("action") != "allow" {
+		if err := s.db.Unscoped().Delete(req).Error; err != nil {
+			return err
+		}
+		return s.redirectOAuthResponse(c, req, url.Values{"error": {"access_denied"}})
+	}
+
+	page := &oauthAuthorizePage{
+		ClientID:   req.ClientID,
+		RequestURI: req.RequestURI,
+		Scope:      req.Scope,
+		CSRF:       cookie.Value,
+		Identifier: c.FormValue("identifier"),
+	}
+
+	u, err := s.lookupUser(ctx, c.FormValue("identifier"))
+	if err != nil || u.Password != c.FormValue("password") || u.Status == AccountStatusDeleted {
+		page.Error = "Invalid handle or password"
+		return s.renderOAuthAuthorizePage(c, page)
+	}
+
+	var tok *string
+	if v := c.FormValue("auth_factor_token"); v != "" {
+		tok = &v
+	}
+	if err := s.checkSessionAuthFactor(ctx, u, tok); err != nil {
+		page.NeedCode = true
+		page.Error = "Invalid sign in code"
+		if errors.Is(err, errAuthFactorTokenRequired) {
+			page.Error = "A sign in code has been sent to your email"
+		}
+		return s.renderOAuthAuthorizePage(c, page)
+	}
+
+	code := randomOAuthToken()
+	if err := s.db.Model(OAuthRequest{}).Where("id = ?", req.ID).Updates(map[string]any{
+		"usr":        u.ID,
+		"code":       code,
+		"expires_at": time.Now().Add(oauthCodeTTL),
+	}).Error; err != nil {
+		return err
+	}
+
+	return s.redirectOAuthResponse(c, req, url.Values{"code": {code}})
+}
+
+func (s *Server) redirectOAuthResponse(c echo.Context, req *OAuthRequest, params url.Values) error {
+	ru, err := url.Parse(req.RedirectURI)
+	if err != nil {
+		return err
+	}
+
+	params.Set("iss", requestOrigin(c))
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+
+	q := ru.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	ru.RawQuery = q.Encode()
+
+	return c.Redirect(http.StatusSeeOther, ru.String())
+}
+
+func (s *Server) handleOAuthToken(c echo.Context) error {
+	c.Response().Header().Set("DPoP-Nonce", s.dpop.Nonce())
+	c.Response().Header().Set("Cache-Control", "no-store")
+
+	jkt, err := s.dpop.Verify(c.Request().Header.Get("DPoP"), "POST", requestHtu(c), "")
+	if err != nil {
+		return writeDPoPError(c, err)
+	}
+
+	clientID := c.FormValue("client_id")
+
+	switch c.FormValue("grant_type") {
+	case "authorization_code":
+		code := c.FormValue("code")
+
+		var req OAuthRequest
+		if err := s.db.Find(&req, "code = ?", code).Error; err != nil {
+			return err
+		}
+
+		if req.ID == 0 || code == "" || time.Now().After(req.ExpiresAt) {
+			return writeOAuthError(c, 400, "invalid_grant", "unknown or expired code")
+		}
+
+		// codes are single use, so consume it before doing anything else
+		res := s.db.Unscoped().Delete(&OAuthRequest{}, req.ID)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected != 1 {
+			return writeOAuthError(c, 400, "invalid_grant", "code has already been used")
+		}
+
+		if req.ClientID != clientID || req.RedirectURI != c.FormValue("redirect_uri") {
+			return writeOAuthError(c, 400, "invalid_grant", "code was not issued to this client")
+		}
+
+		verifier := sha256.Sum256([]byte(c.FormValue("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(verifier[:]) != req.CodeChallenge {
+			return writeOAuthError(c, 400, "invalid_grant", "invalid code_verifier")
+		}
+
+		if req.DPoPJkt != jkt {
+			return writeOAuthError(c, 400, "invalid_dpop_proof", "DPoP key does not match the authorization request")
+		}
+
+		return s.issueOAuthTokens(c, req.Usr, clientID, req.Scope, jkt)
+
+	case "refresh_token":
+		var rt OAuthRefreshToken
+		if err := s.db.Find(&rt, "token_hash = ?", hashOAuthToken(c.FormValue("refresh_token"))).Error; err != nil {
+			return err
+		}
+
+		if rt.ID == 0 || time.Now().After(rt.ExpiresAt) {
+			return writeOAuthError(c, 400, "invalid_grant", "unknown or expired refresh token")
+		}
+
+		if rt.ClientID != clientID {
+			return writeOAuthError(c, 400, "invalid_grant", "refresh token was not issued to this client")
+		}
+
+		if rt.DPoPJkt != jkt {
+			return writeOAuthError(c, 400, "invalid_dpop_proof", "DPoP key does not match the refresh token")
+		}
+
+		res := s.db.Unscoped().Delete(&OAuthRefreshToken{}, rt.ID)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected != 1 {
+			return writeOAuthError(c, 400, "invalid_grant", "refresh token has already been used")
+		}
+
+		return s.issueOAuthTokens(c, rt.Usr, clientID, rt.Scope, jkt)
+
+	default:
+		return writeOAuthError(c, 400, "unsupported_grant_type", "")
+	}
+}
+
+func (s *Server) issueOAuthTokens(c echo.Context, uid models.Uid, clientID, scope, jkt string) error {
+	var u User
+	if err := s.db.Find(&u, "id = ?", uid).Error; err != nil {
+		return err
+	}
+
+	if u.ID == 0 || u.Status == AccountStatusDeleted {
+		return writeOAuthError(c, 400, "invalid_grant", "account is not available")
+	}
+
+	now := time.Now()
+	iss := requestOrigin(c)
+
+	tok := jwt.New()
+	tok.Set(jwt.IssuerKey, iss)
+	tok.Set(jwt.AudienceKey, iss)
+	tok.Set(jwt.SubjectKey, u.Did)
+	tok.Set(jwt.IssuedAtKey, now.Unix())
+	tok.Set(jwt.ExpirationKey, now.Add(oauthAccessTokenTTL).Unix())
+	tok.Set(jwt.JwtIDKey, randomOAuthToken())
+	tok.Set("scope", scope)
+	tok.Set("client_id", clientID)
+	tok.Set("cnf", map[string]string{"jkt": jkt})
+
+	hdrs := jws.NewHeaders()
+	hdrs.Set(jws.TypeKey, "at+jwt")
+
+	access, err := jwt.Sign(tok, jwt.WithKey(jwa.HS256, s.oauthAccessTokenKey(), jws.WithProtectedHeaders(hdrs)))
+	if err != nil {
+		return fmt.Errorf("signing access token: %w", err)
+	}
+
+	refresh := randomOAuthToken()
+	if err := s.db.Create(&OAuthRefreshToken{
+		TokenHash: hashOAuthToken(refresh),
+		Usr:       u.ID,
+		ClientID:  clientID,
+		Scope:     scope,
+		DPoPJkt:   jkt,
+		ExpiresAt: now.Add(oauthRefreshTokenTTL),
+	}).Error; err != nil {
+		return err
+	}
+
+	return c.JSON(200, oauthTokenResponse{
+		AccessToken:  string(access),
+		TokenType:    "DPoP",
+		ExpiresIn:    int(oauthAccessTokenTTL.Seconds()),
+		RefreshToken: refresh,
+		Scope:        scope,
+		Sub:          u.Did,
+	})
+}
+
+// parseOAuthAccessToken verifies an access token we issued, returning it if
+// it is valid and unexpired
+func (s *Server) parseOAuthAccessToken(access string) (jwt.Token, error) {
+	tok, err := jwt.Parse([]byte(access), jwt.WithKey(jwa.HS256, s.oauthAccessTokenKey()), jwt.WithValidate(true))
+	if err != nil {
+		return nil, err
+	}
+
+	if tok.Subject() == "" {
+		return nil, fmt.Errorf("access token has no subject")
+	}
+
+	return tok, nil
+}
+
+func accessTokenJkt(tok jwt.Token) string {
+	v, ok := tok.Get("cnf")
+	if !ok {
+		return ""
+	}
+
+	cnf, ok := v.(map[string]any)
+	if !ok {
+		return ""
+	}
+
+	jkt, _ := cnf["jkt"].(string)
+	return jkt
+}
+
+func (s *Server) handleOAuthIntrospect(c echo.Context) error {
+	token := c.FormValue("token")
+
+	if tok, err := s.parseOAuthAccessToken(token); err == nil {
+		return c.JSON(200, map[string]any{
+			"active":     true,
+			"token_type": "DPoP",
+			"sub":        tok.Subject(),
+			"scope":      claimString(tok, "scope"),
+			"client_id":  claimString(tok, "client_id"),
+			"iss":        tok.Issuer(),
+			"iat":        tok.IssuedAt().Unix(),
+			"exp":        tok.Expiration().Unix(),
+			"cnf":        map[string]string{"jkt": accessTokenJkt(tok)},
+		})
+	}
+
+	var rt OAuthRefreshToken
+	if err := s.db.Find(&rt, "token_hash = ?", hashOAuthToken(token)).Error; err != nil {
+		return err
+	}
+
+	if rt.ID == 0 || time.Now().After(rt.ExpiresAt) {
+		return c.JSON(200, map[string]any{"active": false})
+	}
+
+	var u User
+	if err := s.db.Find(&u, "id = ?", rt.Usr).Error; err != nil {
+		return err
+	}
+
+	return c.JSON(200, map[string]any{
+		"active":     true,
+		"token_type": "refresh_token",
+		"sub":        u.Did,
+		"scope":      rt.Scope,
+		"client_id":  rt.ClientID,
+		"iat":        rt.CreatedAt.Unix(),
+		"exp":        rt.ExpiresAt.Unix(),
+	})
+}
+
+func (s *Server) handleOAuthRevoke(c echo.Context) error {
+	if err := s.db.Unscoped().Where("token_hash = ?", hashOAuthToken(c.FormValue("token"))).Delete(&OAuthRefreshToken{}).Error; err != nil {
+		return err
+	}
+
+	// as per RFC 7009, revoking an unknown token is not an error
+	return c.NoContent(200)
+}
+
+func writeResourceAuthError(c echo.Context, err string, desc string) error {
+	c.Response().Header().Set("WWW-Authenticate", fmt.Sprintf("DPoP error=%q, error_description=%q", err, desc))
+	return writeOAuthError(c, 401, err, desc)
+}
+
+// oauthAuthMiddleware authenticates requests carrying a DPoP bound OAuth
+// access token, setting up the request context the same way
+// userCheckMiddleware does for legacy session tokens. Requests using any
+// other kind of auth are passed through untouched.
+func (s *Server) oauthAuthMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		authz := c.Request().Header.Get("Authorization")
+		if !strings.HasPrefix(authz, "DPoP ") {
+			return next(c)
+		}
+
+		c.Response().Header().Set("DPoP-Nonce", s.dpop.Nonce())
+
+		access := strings.TrimPrefix(authz, "DPoP ")
+		tok, err := s.parseOAuthAccessToken(access)
+		if err != nil {
+			return writeResourceAuthError(c, "invalid_token", err.Error())
+		}
+
+		jkt, err := s.dpop.Verify(c.Request().Header.Get("DPoP"), c.Request().Method, requestHtu(c), access)
+		if err != nil {
+			if errors.Is(err, errUseDPoPNonce) {
+				return writeResourceAuthError(c, "use_dpop_nonce", "resource server requires nonce in DPoP proof")
+			}
+			return writeResourceAuthError(c, "invalid_dpop_proof", err.Error())
+		}
+
+		if jkt != accessTokenJkt(tok) {
+			return writeResourceAuthError(c, "invalid_token", "access token is bound to a different key")
+		}
+
+		ctx := c.Request().Context()
+		u, err := s.lookupUserByDid(ctx, tok.Subject())
+		if err != nil {
+			return err
+		}
+
+		if err := checkAccountAccess(u, c.Path()); err != nil {
+			return err
+		}
+
+		// oauth scopes grant the same access as a legacy access token
+		ctx = context.WithValue(ctx, "authScope", "com.atproto.access")
+		ctx = context.WithValue(ctx, "user", u)
+		ctx = context.WithValue(ctx, "did", u.Did)
+
+		c.SetRequest(c.Request().WithContext(ctx))
+		return next(c)
+	}
+}
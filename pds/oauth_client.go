@@ -0,0 +1,187 @@
+package pds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// OAuthClientMetadata is the subset of a clients metadata document (see
+// draft-parecki-oauth-client-id-metadata-document) that we make use of
+type OAuthClientMetadata struct {
+	ClientID                string   `json:"client_id"`
+	ClientName              string   `json:"client_name,omitempty"`
+	ClientURI               string   `json:"client_uri,omitempty"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	GrantTypes              []string `json:"grant_types,omitempty"`
+	ResponseTypes           []string `json:"response_types,omitempty"`
+	Scope                   string   `json:"scope,omitempty"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method,omitempty"`
+	ApplicationType         string   `json:"application_type,omitempty"`
+	DPoPBoundAccessTokens   bool     `json:"dpop_bound_access_tokens"`
+}
+
+// maxClientMetadataSize bounds how much we will read when fetching a clients
+// metadata document
+const maxClientMetadataSize = 64 << 10
+
+var oauthClientHttp = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+// resolveOAuthClient returns the metadata for the given client. Clients are
+// identified by the https URL of their metadata document, except for
+// development clients which use a loopback client_id of "http://localhost".
+func resolveOAuthClient(ctx context.Context, clientID string) (*OAuthClientMetadata, error) {
+	u, err := url.Parse(clientID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client_id: %w", err)
+	}
+
+	if u.Scheme == "http" && u.Hostname() == "localhost" {
+		return loopbackClientMetadata(clientID, u)
+	}
+
+	if u.Scheme != "https" || u.Host == "" || u.Fragment != "" {
+		return nil, fmt.Errorf("client_id must be an https url")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", clientID, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := oauthClientHttp.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching client metadata: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("fetching client metadata: status %d", resp.StatusCode)
+	}
+
+	var md OAuthClientMetadata
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxClientMetadataSize)).Decode(&md); err != nil {
+		return nil, fmt.Errorf("decoding client metadata: %w", err)
+	}
+
+	if md.ClientID != clientID {
+		return nil, fmt.Errorf("client metadata has mismatched client_id %q", md.ClientID)
+	}
+
+	if err := validateOAuthClient(&md); err != nil {
+		return nil, err
+	}
+
+	return &md, nil
+}
+
+// loopbackClientMetadata builds the implicit metadata for a development
+// client. Redirect URIs and scope may be given as query parameters on the
+// client_id.
+func loopbackClientMetadata(clientID string, u *url.URL) (*OAuthClientMetadata, error) {
+	if u.Port() != "" || (u.Path != "" && u.Path != "/") {
+		return nil, fmt.Errorf("loopback client_id must be exactly http://localhost")
+	}
+
+	md := &OAuthClientMetadata{
+		ClientID:                clientID,
+		ClientName:              "Loopback client",
+		RedirectURIs:            u.Query()["redirect_uri"],
+		Scope:                   u.Query().Get("scope"),
+		TokenEndpointAuthMethod: "none",
+		ApplicationType:         "native",
+		DPoPBoundAccessTokens:   true,
+	}
+
+	if len(md.RedirectURIs) == 0 {
+		md.RedirectURIs = []string{"http://127.0.0.1/", "http://[::1]/"}
+	}
+	for _, r := range md.RedirectURIs {
+		if !isLoopbackRedirect(r) {
+			return nil, fmt.Errorf("loopback client redirect_uri %q must be on http://127.0.0.1 or http://[::1]", r)
+		}
+	}
+
+	if md.Scope == "" {
+		md.Scope = "atproto"
+	}
+
+	return md, validateOAuthClient(md)
+}
+
+// isLoopbackRedirect reports whether a redirect uri is to a loopback IP over
+// http, which are the only redirects loopback clients can use, as anyone can
+// claim a loopback client_id
+func isLoopbackRedirect(redirect string) bool {
+	u, err := url.Parse(redirect)
+	if err != nil || u.Scheme != "http" || u.User != nil {
+		return false
+	}
+	h := u.Hostname()
+	return h == "127.0.0.1" || h == "::1"
+}
+
+func validateOAuthClient(md *OAuthClientMetadata) error {
+	if len(md.RedirectURIs) == 0 {
+		return fmt.Errorf("client metadata must include redirect_uris")
+	}
+
+	if !md.DPoPBoundAccessTokens {
+		return fmt.Errorf("client must use DPoP bound access tokens")
+	}
+
+	// TODO: confidential clients authenticating with private_key_jwt
+	if md.TokenEndpointAuthMethod != "" && md.TokenEndpointAuthMethod != "none" {
+		return fmt.Errorf("unsupported token_endpoint_auth_method %q", md.TokenEndpointAuthMethod)
+	}
+
+	if !hasScope(md.Scope, "atproto") {
+		return fmt.Errorf("client metadata scope must include atproto")
+	}
+
+	return nil
+}
+
+// allowsRedirect reports whether the client registered the given redirect
+// uri. As per RFC 8252, the port of loopback IP redirects is not compared.
+func (md *OAuthClientMetadata) allowsRedirect(redirect string) bool {
+	ru, err := url.Parse(redirect)
+	if err != nil {
+		return false
+	}
+
+	for _, r := range md.RedirectURIs {
+		if r == redirect {
+			return true
+		}
+
+		if !isLoopbackRedirect(r) {
+			continue
+		}
+		cu, _ := url.Parse(r)
+
+		if ru.Scheme == cu.Scheme && ru.Hostname() == cu.Hostname() && ru.Path == cu.Path {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasScope(scopes string, scope string) bool {
+	for _, s := range strings.Fields(scopes) {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,295 @@
+package pds
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/labstack/echo/v4"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+type testDPoPClient struct {
+	t     *testing.T
+	key   *ecdsa.PrivateKey
+	nonce string
+}
+
+func (dc *testDPoPClient) proof(method, htu, access string) string {
+	pub, err := jwk.FromRaw(&dc.key.PublicKey)
+	if err != nil {
+		dc.t.Fatal(err)
+	}
+
+	hdrs := jws.NewHeaders()
+	hdrs.Set(jws.TypeKey, "dpop+jwt")
+	hdrs.Set(jws.JWKKey, pub)
+
+	tok := jwt.New()
+	tok.Set("htm", method)
+	tok.Set("htu", htu)
+	tok.Set(jwt.IssuedAtKey, time.Now().Unix())
+	tok.Set(jwt.JwtIDKey, randomOAuthToken())
+	if dc.nonce != "" {
+		tok.Set("nonce", dc.nonce)
+	}
+	if access != "" {
+		ath := sha256.Sum256([]byte(access))
+		tok.Set("ath", base64.RawURLEncoding.EncodeToString(ath[:]))
+	}
+
+	b, err := jwt.Sign(tok, jwt.WithKey(jwa.ES256, dc.key, jws.WithProtectedHeaders(hdrs)))
+	if err != nil {
+		dc.t.Fatal(err)
+	}
+
+	return string(b)
+}
+
+func TestOAuthFlow(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	if _, err := s.handleComAtprotoServerCreateAccount(ctx, &atproto.ServerCreateAccount_Input{
+		Email:    "test@foo.com",
+		Password: "password",
+		Handle:   "testman.test",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	const clientID = "https://client.example/metadata.json"
+	const redirect = "https://client.example/callback"
+	s.oauthClients = func(ctx context.Context, id string) (*OAuthClientMetadata, error) {
+		md := &OAuthClientMetadata{
+			ClientID:              clientID,
+			RedirectURIs:          []string{redirect},
+			Scope:                 "atproto transition:generic",
+			DPoPBoundAccessTokens: true,
+		}
+		if id != clientID {
+			t.Fatalf("unexpected client %q", id)
+		}
+		return md, validateOAuthClient(md)
+	}
+
+	e := echo.New()
+	s.RegisterHandlersOAuth(e)
+	e.GET("/xrpc/com.atproto.server.getSession", s.HandleComAtprotoServerGetSession, s.oauthAuthMiddleware)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc := &testDPoPClient{t: t, key: key}
+
+	const origin = "http://example.com"
+	post := func(path string, form url.Values, hdrs map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for k, v := range hdrs {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	verifier := randomOAuthToken()
+	challenge := sha256.Sum256([]byte(verifier))
+	par := url.Values{
+		"client_id":             {clientID},
+		"response_type":         {"code"},
+		"redirect_uri":          {redirect},
+		"scope":                 {"atproto transition:generic"},
+		"state":                 {"some-state"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	rec := post("/oauth/par", par, map[string]string{"DPoP": dc.proof("POST", origin+"/oauth/par", "")})
+	if rec.Code != 400 || !strings.Contains(rec.Body.String(), "use_dpop_nonce") {
+		t.Fatalf("expected nonce to be required: %d %s", rec.Code, rec.Body.String())
+	}
+	dc.nonce = rec.Header().Get("DPoP-Nonce")
+
+	rec = post("/oauth/par", par, map[string]string{"DPoP": dc.proof("POST", origin+"/oauth/par", "")})
+	if rec.Code != 201 {
+		t.Fatalf("par failed: %d %s", rec.Code, rec.Body.String())
+	}
+	var parOut struct {
+		RequestURI string `json:"request_uri"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &parOut); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/oauth/authorize?"+url.Values{
+		"client_id":   {clientID},
+		"request_uri": {parOut.RequestURI},
+	}.Encode(), nil)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("authorize page failed: %d %s", rec.Code, rec.Body.String())
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatal("expected csrf cookie")
+	}
+	csrf := cookies[0].Value
+
+	login := url.Values{
+		"client_id":   {clientID},
+		"request_uri": {parOut.RequestURI},
+		"csrf":        {csrf},
+		"identifier":  {"testman.test"},
+		"password":    {"wrong"},
+		"action":      {"allow"},
+	}
+	cookieHdr := map[string]string{"Cookie": oauthCSRFCookie + "=" + csrf}
+	rec = post("/oauth/authorize", login, cookieHdr)
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), "Invalid handle or password") {
+		t.Fatalf("expected login to fail: %d", rec.Code)
+	}
+
+	login.Set("password", "password")
+	rec = post("/oauth/authorize", login, cookieHdr)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("expected redirect after login: %d %s", rec.Code, rec.Body.String())
+	}
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc.Query().Get("state") != "some-state" || loc.Query().Get("iss") != origin {
+		t.Fatalf("bad redirect: %s", loc)
+	}
+
+	exchange := url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {clientID},
+		"redirect_uri":  {redirect},
+		"code":          {loc.Query().Get("code")},
+		"code_verifier": {verifier},
+	}
+	rec = post("/oauth/token", exchange, map[string]string{"DPoP": dc.proof("POST", origin+"/oauth/token", "")})
+	if rec.Code != 200 {
+		t.Fatalf("token exchange failed: %d %s", rec.Code, rec.Body.String())
+	}
+	var toks oauthTokenResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &toks); err != nil {
+		t.Fatal(err)
+	}
+	if toks.TokenType != "DPoP" || toks.AccessToken == "" || toks.RefreshToken == "" {
+		t.Fatalf("bad token response: %+v", toks)
+	}
+
+	rec = post("/oauth/token", exchange, map[string]string{"DPoP": dc.proof("POST", origin+"/oauth/token", "")})
+	if rec.Code != 400 {
+		t.Fatal("expected code to be single use")
+	}
+
+	getSession := func(access string, proof string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/xrpc/com.atproto.server.getSession", nil)
+		req.Header.Set("Authorization", "DPoP "+access)
+		req.Header.Set("DPoP", proof)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec = getSession(toks.AccessToken, dc.proof("GET", origin+"/xrpc/com.atproto.server.getSession", toks.AccessToken))
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), "testman.test") {
+		t.Fatalf("authenticated request failed: %d %s", rec.Code, rec.Body.String())
+	}
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &testDPoPClient{t: t, key: otherKey, nonce: dc.nonce}
+	rec = getSession(toks.AccessToken, other.proof("GET", origin+"/xrpc/com.atproto.server.getSession", toks.AccessToken))
+	if rec.Code != 401 {
+		t.Fatalf("expected token to be bound to the original key: %d", rec.Code)
+	}
+
+	refresh := url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {clientID},
+		"refresh_token": {toks.RefreshToken},
+	}
+	rec = post("/oauth/token", refresh, map[string]string{"DPoP": dc.proof("POST", origin+"/oauth/token", "")})
+	if rec.Code != 200 {
+		t.Fatalf("refresh failed: %d %s", rec.Code, rec.Body.String())
+	}
+	var refreshed oauthTokenResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &refreshed); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = post("/oauth/token", refresh, map[string]string{"DPoP": dc.proof("POST", origin+"/oauth/token", "")})
+	if rec.Code != 400 {
+		t.Fatal("expected refresh token to be single use")
+	}
+
+	rec = post("/oauth/introspect", url.Values{"token": {refreshed.RefreshToken}}, nil)
+	if !strings.Contains(rec.Body.String(), `"active":true`) {
+		t.Fatalf("expected refresh token to be active: %s", rec.Body.String())
+	}
+
+	post("/oauth/revoke", url.Values{"token": {refreshed.RefreshToken}}, nil)
+	rec = post("/oauth/introspect", url.Values{"token": {refreshed.RefreshToken}}, nil)
+	if !strings.Contains(rec.Body.String(), `"active":false`) {
+		t.Fatalf("expected revoked token to be inactive: %s", rec.Body.String())
+	}
+}
+
+func TestLoopbackClientRedirects(t *testing.T) {
+	ctx := context.Background()
+
+	md, err := resolveOAuthClient(ctx, "http://localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !md.allowsRedirect("http://127.0.0.1:8080/") || !md.allowsRedirect("http://[::1]:1234/") {
+		t.Errorf("expected the default loopback redirects on any port, got %v", md.RedirectURIs)
+	}
+
+	md, err = resolveOAuthClient(ctx, "http://localhost?redirect_uri="+url.QueryEscape("http://127.0.0.1:4000/callback"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !md.allowsRedirect("http://127.0.0.1:5000/callback") || md.allowsRedirect("http://127.0.0.1:4000/other") {
+		t.Errorf("expected only the given path to be allowed, got %v", md.RedirectURIs)
+	}
+
+	// anyone can use a loopback client_id, so it can't send codes elsewhere
+	for _, redirect := range []string{
+		"https://evil.example/cb",
+		"http://localhost/cb",
+		"https://127.0.0.1/cb",
+		"http://127.0.0.1.evil.example/cb",
+		"http://user@127.0.0.1/cb",
+	} {
+		clientID := "http://localhost?redirect_uri=" + url.QueryEscape(redirect)
+		if _, err := resolveOAuthClient(ctx, clientID); err == nil {
+			t.Errorf("%s: expected the redirect to be refused", redirect)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package pds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	appbskytypes "github.com/bluesky-social/indigo/api/bsky"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/models"
+	"gorm.io/gorm"
+)
+
+// MaxPreferencesSize is the largest preferences document we will store for a
+// single account
+const MaxPreferencesSize = 64 << 10
+
+// PreferencesNamespace is the only namespace preferences may be stored under
+// by this PDS
+const PreferencesNamespace = "app.bsky"
+
+// Preferences holds the private preferences of an account. The preferences
+// are stored as the JSON array the client gave us, rather than as our
+// generated types, so that preference types we do not know about yet survive
+// a round trip through the PDS.
+type Preferences struct {
+	gorm.Model
+	Usr  models.Uid `gorm:"uniqueIndex"`
+	Data []byte
+}
+
+// rawPreferences is the body of both getPreferences and putPreferences. It
+// stands in for the generated ActorGetPreferences_Output and
+// ActorPutPreferences_Input, which drop unrecognized union members.
+type rawPreferences struct {
+	Preferences []json.RawMessage `json:"preferences"`
+}
+
+var contentLabelVisibilities = map[string]bool{
+	"show":   true,
+	"warn":   true,
+	"hide":   true,
+	"ignore": true,
+}
+
+// validatePreference checks that a single preference is namespaced correctly,
+// and that known preference types are well formed. Unknown types within the
+// namespace are accepted as-is.
+func validatePreference(raw json.RawMessage) error {
+	typ, err := lexutil.TypeExtract(raw)
+	if err != nil {
+		return fmt.Errorf("preference must be an object with a $type: %w", err)
+	}
+
+	if typ == "" {
+		return fmt.Errorf("preference is missing $type")
+	}
+
+	if !strings.HasPrefix(typ, PreferencesNamespace+".") {
+		return fmt.Errorf("preference %q is not in the %s namespace", typ, PreferencesNamespace)
+	}
+
+	var elem appbskytypes.ActorDefs_Preferences_Elem
+	if err := json.Unmarshal(raw, &elem); err != nil {
+		return fmt.Errorf("invalid %q preference: %w", typ, err)
+	}
+
+	switch {
+	case elem.ActorDefs_ContentLabelPref != nil:
+		clp := elem.ActorDefs_ContentLabelPref
+		if clp.Label == "" {
+			return fmt.Errorf("content label preference must specify a label")
+		}
+		if !contentLabelVisibilities[clp.Visibility] {
+			return fmt.Errorf("invalid visibility %q for content label preference", clp.Visibility)
+		}
+	case elem.ActorDefs_SavedFeedsPref != nil:
+		sfp := elem.ActorDefs_SavedFeedsPref
+		saved := make(map[string]bool)
+		for _, f := range sfp.Saved {
+			saved[f] = true
+		}
+		for _, f := range sfp.Pinned {
+			if !saved[f] {
+				return fmt.Errorf("pinned feed %q must also be saved", f)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) getPreferences(ctx context.Context, u *User) ([]json.RawMessage, error) {
+	var p Preferences
+	if err := s.db.Find(&p, "usr = ?", u.ID).Error; err != nil {
+		return nil, err
+	}
+
+	out := []json.RawMessage{}
+	if p.ID == 0 {
+		return out, nil
+	}
+
+	if err := json.Unmarshal(p.Data, &out); err != nil {
+		return nil, fmt.Errorf("stored preferences for %s are corrupt: %w", u.Did, err)
+	}
+
+	return out, nil
+}
+
+func (s *Server) putPreferences(ctx context.Context, u *User, prefs []json.RawMessage) error {
+	for _, p := range prefs {
+		if err := validatePreference(p); err != nil {
+			return err
+		}
+	}
+
+	if prefs == nil {
+		prefs = []json.RawMessage{}
+	}
+
+	data, err := json.Marshal(prefs)
+	if err != nil {
+		return err
+	}
+
+	if len(data) > MaxPreferencesSize {
+		return fmt.Errorf("preferences too large (%d > %d bytes)", len(data), MaxPreferencesSize)
+	}
+
+	var p Preferences
+	if err := s.db.Find(&p, "usr = ?", u.ID).Error; err != nil {
+		return err
+	}
+
+	if p.ID == 0 {
+		return s.db.Create(&Preferences{Usr: u.ID, Data: data}).Error
+	}
+
+	return s.db.Model(Preferences{}).Where("id = ?", p.ID).Update("data", data).Error
+}
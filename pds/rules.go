@@ -0,0 +1,72 @@
+package pds
+
+import (
+	"context"
+
+	"github.com/bluesky-social/indigo/repomgr"
+	"github.com/bluesky-social/indigo/rules"
+	"github.com/bluesky-social/indigo/util/logutil"
+)
+
+// SetRules has the records written through the PDS checked against a rule
+// engine, along with the IP address of the client writing them, which only
+// the PDS knows. The PDS does not label, take reports or take down accounts,
+// so the actions of matching rules are only logged and counted. Must be
+// called before RunAPI.
+func (s *Server) SetRules(e *rules.Engine) {
+	s.rules = e
+}
+
+// applyRules checks the records created or updated by writes, which have
+// been applied with the results res, against the rules, if there are any.
+// Failures are logged rather than returned, as the writes have been made by
+// then.
+func (s *Server) applyRules(ctx context.Context, u *User, writes []repomgr.Write, res []repomgr.WriteResult) {
+	if s.rules == nil {
+		return
+	}
+	ip, _ := ctx.Value("ip").(string)
+
+	for i, w := range writes {
+		var action string
+		switch w.Kind {
+		case repomgr.EvtKindCreateRecord:
+			action = "create"
+		case repomgr.EvtKindUpdateRecord:
+			action = "update"
+		default:
+			continue
+		}
+		if !s.rules.Wants(w.Collection) {
+			continue
+		}
+
+		path := res[i].Path()
+		fields, err := rules.RecordFields(w.Record)
+		if err != nil {
+			logger.WarnCtx(ctx, "failed to read record for rules", "path", path, "err", err)
+			continue
+		}
+
+		r, err := s.rules.Evaluate(ctx, &rules.Event{
+			Did:            u.Did,
+			Action:         action,
+			Collection:     res[i].Collection,
+			Rkey:           res[i].Rkey,
+			Cid:            res[i].Cid.String(),
+			IP:             ip,
+			Record:         fields,
+			AccountCreated: u.CreatedAt,
+		})
+		if err != nil {
+			logger.WarnCtx(ctx, "failed to evaluate rules", "path", path, "err", err)
+			continue
+		}
+		for _, a := range r.Actions {
+			ruleActionsCounter.WithLabelValues(a.Rule, a.Kind()).Inc()
+
+			actx := logutil.WithFields(ctx, "rule", a.Rule, "path", path)
+			logger.InfoCtx(actx, "rule matched record", "action", a.Kind())
+		}
+	}
+}
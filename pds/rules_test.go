@@ -0,0 +1,72 @@
+package pds
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	bsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/rules"
+	"github.com/bluesky-social/indigo/util/counters"
+)
+
+// keyRecorder records the keys of the velocities counted in it
+type keyRecorder struct {
+	counters.Store
+
+	lk   sync.Mutex
+	keys []string
+}
+
+func (kr *keyRecorder) Incr(ctx context.Context, key string, w counters.Window, t time.Time) error {
+	kr.lk.Lock()
+	kr.keys = append(kr.keys, key)
+	kr.lk.Unlock()
+	return kr.Store.Incr(ctx, key, w, t)
+}
+
+func TestRulesSeeClientIP(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	rs, err := rules.ParseRuleSet([]byte(`
+rules:
+  - name: busy-ip
+    when:
+      ip_rate: {window: 1h, more_than: 1}
+    actions:
+      - flag: busy-ip
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := rules.NewEngine(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem, err := counters.NewMemoryStore(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr := &keyRecorder{Store: mem}
+	e.SetCounters(kr)
+	s.SetRules(e)
+
+	for _, handle := range []string{"alice.test", "bob.test"} {
+		ctx, did := testAccount(t, s, handle)
+		ctx = context.WithValue(ctx, "ip", "10.0.0.1")
+		testCreateRecord(t, s, ctx, did, "app.bsky.feed.post", &bsky.FeedPost{Text: "hello", CreatedAt: time.Now().Format(time.RFC3339)})
+	}
+
+	n := 0
+	for _, k := range kr.keys {
+		if strings.HasSuffix(k, counters.IPKey("", "10.0.0.1")) {
+			n++
+		}
+	}
+	if n != 2 {
+		t.Fatalf("expected both posts to be counted for the client IP, got keys %v", kr.keys)
+	}
+}
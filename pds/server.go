@@ -15,16 +15,25 @@ import (
 	"github.com/bluesky-social/indigo/api/atproto"
 	comatproto "github.com/bluesky-social/indigo/api/atproto"
 	bsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/blobs"
 	"github.com/bluesky-social/indigo/carstore"
 	"github.com/bluesky-social/indigo/events"
 	"github.com/bluesky-social/indigo/indexer"
 	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/lex/validate"
 	"github.com/bluesky-social/indigo/models"
 	"github.com/bluesky-social/indigo/notifs"
 	"github.com/bluesky-social/indigo/plc"
 	"github.com/bluesky-social/indigo/repomgr"
+	"github.com/bluesky-social/indigo/rules"
 	"github.com/bluesky-social/indigo/util"
 	bsutil "github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/util/invalidation"
+	"github.com/bluesky-social/indigo/util/logutil"
+	"github.com/bluesky-social/indigo/util/ratelimit"
+	"github.com/bluesky-social/indigo/util/signer"
+	"github.com/bluesky-social/indigo/util/syntax"
+	"github.com/bluesky-social/indigo/util/xrpcerr"
 	"github.com/bluesky-social/indigo/xrpc"
 	gojwt "github.com/golang-jwt/jwt"
 	"github.com/gorilla/websocket"
@@ -39,6 +48,10 @@ import (
 
 var log = logging.Logger("pds")
 
+// logger is for structured logs carrying the fields of the request being
+// handled
+var logger = logutil.Logger("pds")
+
 type Server struct {
 	db             *gorm.DB
 	cs             *carstore.CarStore
@@ -47,7 +60,14 @@ type Server struct {
 	notifman       notifs.NotificationManager
 	indexer        *indexer.Indexer
 	events         *events.EventManager
+	blobs          blobs.BlobStore
+	images         *ImageConfig
+	maxVideoSize   int64
+	blobQuota      int64
+	mailer         Mailer
 	signingKey     *did.PrivKey
+	signer         signer.Signer
+	keyman         *indexer.KeyManager
 	echo           *echo.Echo
 	jwtSigningKey  []byte
 	enforcePeering bool
@@ -56,6 +76,36 @@ type Server struct {
 	serviceUrl   string
 
 	plc plc.PLCClient
+
+	validator        *validate.Validator
+	requestValidator *validate.Validator
+
+	rateLimitStore ratelimit.Store
+	rateLimits     map[string]ratelimit.Limit
+	ipExtractor    echo.IPExtractor
+
+	adminToken string
+
+	// invalidations tells other services of handle changes, if set
+	invalidations invalidation.Bus
+
+	rules *rules.Engine
+
+	dpop         *dpopVerifier
+	oauthClients func(ctx context.Context, clientID string) (*OAuthClientMetadata, error)
+
+	stopBackground func()
+}
+
+// DefaultRateLimits are the limits applied to auth-sensitive and expensive
+// endpoints, counted per account (or per IP for unauthenticated requests)
+var DefaultRateLimits = map[string]ratelimit.Limit{
+	"/xrpc/com.atproto.server.createSession": {Count: 30, Period: 5 * time.Minute},
+	"/xrpc/com.atproto.server.deleteAccount": {Count: 30, Period: 5 * time.Minute},
+	"/xrpc/com.atproto.server.createAccount": {Count: 100, Period: 5 * time.Minute},
+	"/xrpc/com.atproto.repo.uploadBlob":      {Count: 100, Period: time.Minute},
+	"/xrpc/com.atproto.repo.createRecord":    {Count: 1500, Period: time.Hour},
+	"/oauth/authorize":                       {Count: 30, Period: 5 * time.Minute},
 }
 
 const UserActorDeclCid = "bafyreid27zk7lbis4zw5fz4podbvbs4fc5ivwji3dmrwa6zggnj4bnd57u"
@@ -71,13 +121,34 @@ const serverListenerBootTimeout = 5 * time.Second
 func NewServer(db *gorm.DB, cs *carstore.CarStore, serkey *did.PrivKey, handleSuffix, serviceUrl string, didr plc.PLCClient, jwtkey []byte) (*Server, error) {
 	db.AutoMigrate(&User{})
 	db.AutoMigrate(&Peering{})
+	db.AutoMigrate(&Blob{})
+	db.AutoMigrate(&RecordBlob{})
+	db.AutoMigrate(&BlobVariant{})
+	db.AutoMigrate(&Preferences{})
+	db.AutoMigrate(&AccountDeleteToken{})
+	db.AutoMigrate(&AuthFactorCode{})
+	db.AutoMigrate(&OAuthRequest{})
+	db.AutoMigrate(&OAuthRefreshToken{})
 
 	evtman := events.NewEventManager(events.NewMemPersister())
 
 	kmgr := indexer.NewKeyManager(didr, serkey)
 
 	repoman := repomgr.NewRepoManager(cs, kmgr)
+	tids, err := repomgr.NewTIDSource(context.Background(), db, 0)
+	if err != nil {
+		return nil, err
+	}
+	repoman.SetTIDSource(tids)
 	notifman := notifs.NewNotificationManager(db, repoman.GetRecord)
+	// only accounts hosted here can list their notifications
+	notifman.SetLocalFilter(func(ctx context.Context, uid models.Uid) (bool, error) {
+		var n int64
+		if err := db.Model(User{}).Where("id = ?", uid).Count(&n).Error; err != nil {
+			return false, err
+		}
+		return n > 0, nil
+	})
 
 	ix, err := indexer.NewIndexer(db, notifman, evtman, didr, repoman, false, true)
 	if err != nil {
@@ -86,6 +157,8 @@ func NewServer(db *gorm.DB, cs *carstore.CarStore, serkey *did.PrivKey, handleSu
 
 	s := &Server{
 		signingKey:     serkey,
+		signer:         signer.NewKeySigner(serkey),
+		keyman:         kmgr,
 		db:             db,
 		cs:             cs,
 		notifman:       notifman,
@@ -97,9 +170,27 @@ func NewServer(db *gorm.DB, cs *carstore.CarStore, serkey *did.PrivKey, handleSu
 		serviceUrl:     serviceUrl,
 		jwtSigningKey:  jwtkey,
 		enforcePeering: false,
+		mailer:         logMailer{},
+		maxVideoSize:   DefaultMaxVideoSize,
 	}
 
+	dpop, err := newDPoPVerifier(jwtkey)
+	if err != nil {
+		return nil, err
+	}
+	s.dpop = dpop
+	s.oauthClients = resolveOAuthClient
+
+	rlstore, err := ratelimit.NewMemoryStore(100_000)
+	if err != nil {
+		return nil, err
+	}
+	s.rateLimitStore = rlstore
+	s.rateLimits = DefaultRateLimits
+	s.ipExtractor = echo.ExtractIPDirect()
+
 	repoman.SetEventHandler(func(ctx context.Context, evt *repomgr.RepoEvent) {
+		s.handleBlobRefs(ctx, evt)
 		if err := ix.HandleRepoEvent(ctx, evt); err != nil {
 			log.Errorw("handle repo event failed", "user", evt.User, "err", err)
 		}
@@ -118,7 +209,68 @@ func NewServer(db *gorm.DB, cs *carstore.CarStore, serkey *did.PrivKey, handleSu
 	return s, nil
 }
 
+// SetBlobStore sets the store used to hold uploaded blobs. Blob upload and
+// retrieval endpoints will fail until a blob store is set.
+func (s *Server) SetBlobStore(bs blobs.BlobStore) {
+	s.blobs = bs
+}
+
+// SetRecordValidator enables lexicon validation of created records, unless
+// the client asks for it to be skipped
+func (s *Server) SetRecordValidator(v *validate.Validator) {
+	s.validator = v
+}
+
+// SetRequestValidator has the parameters and JSON inputs of XRPC calls
+// checked against their lexicons before they are handled. Must be called
+// before the API is started.
+func (s *Server) SetRequestValidator(v *validate.Validator) {
+	s.requestValidator = v
+}
+
+// SetSigner moves repo commit and service auth signing to a key which may be
+// held outside of the process, such as in a KMS or HSM. Accounts created
+// afterwards get it as their atproto signing key; the DID documents of
+// existing accounts need updating to it. The server key is still the rotation
+// key of new accounts. Must be called before the API is started.
+func (s *Server) SetSigner(sig signer.Signer) {
+	s.signer = sig
+	s.keyman.SetSigner(sig)
+}
+
+// SetRateLimits replaces the rate limit store and per-endpoint limits. Must be
+// called before the API is started.
+func (s *Server) SetRateLimits(store ratelimit.Store, limits map[string]ratelimit.Limit) {
+	s.rateLimitStore = store
+	s.rateLimits = limits
+}
+
+// SetIPExtractor sets how client IPs, which unauthenticated requests are rate
+// limited by, are found. It defaults to the address of the connection; see
+// ratelimit.IPExtractor. Must be called before the API is started.
+func (s *Server) SetIPExtractor(ex echo.IPExtractor) {
+	s.ipExtractor = ex
+}
+
+// SetInvalidationBus has handle changes published to b, so that other
+// services drop what they have cached of the account's identity
+func (s *Server) SetInvalidationBus(b invalidation.Bus) {
+	s.invalidations = b
+}
+
+func (s *Server) rateLimitKey(c echo.Context) string {
+	if u, err := s.getUser(c.Request().Context()); err == nil {
+		return u.Did
+	}
+
+	return c.RealIP()
+}
+
 func (s *Server) Shutdown(ctx context.Context) error {
+	if s.stopBackground != nil {
+		s.stopBackground()
+	}
+
 	return s.echo.Shutdown(ctx)
 }
 
@@ -292,12 +444,19 @@ func (s *Server) RunAPIWithListener(listen net.Listener) error {
 	e := echo.New()
 	s.echo = e
 	e.HideBanner = true
+	e.IPExtractor = s.ipExtractor
 	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
 		Format: "method=${method}, uri=${uri}, status=${status} latency=${latency_human}\n",
 	}))
+	e.Use(echo.WrapMiddleware(logutil.Middleware))
 
 	cfg := middleware.JWTConfig{
 		Skipper: func(c echo.Context) bool {
+			// DPoP bound oauth tokens are checked by oauthAuthMiddleware
+			if strings.HasPrefix(c.Request().Header.Get("Authorization"), "DPoP ") {
+				return true
+			}
+
 			switch c.Path() {
 			case "/xrpc/_health":
 				return true
@@ -308,9 +467,15 @@ func (s *Server) RunAPIWithListener(listen net.Listener) error {
 			case "/xrpc/com.atproto.identity.resolveHandle":
 				return true
 			case "/xrpc/com.atproto.server.createAccount":
+				// accounts migrating here bring a service auth token for
+				// their DID, see checkMigrationAuth
+				ctx := context.WithValue(c.Request().Context(), "auth", c.Request().Header.Get("Authorization"))
+				c.SetRequest(c.Request().WithContext(ctx))
 				return true
 			case "/xrpc/com.atproto.server.createSession":
 				return true
+			case "/xrpc/com.atproto.server.deleteAccount":
+				return true
 			case "/xrpc/com.atproto.server.describeServer":
 				return true
 			case "/xrpc/app.bsky.actor.getProfile":
@@ -319,6 +484,8 @@ func (s *Server) RunAPIWithListener(listen net.Listener) error {
 			case "/xrpc/com.atproto.sync.getRepo":
 				fmt.Println("TODO: currently not requiring auth on get repo endpoint")
 				return true
+			case "/xrpc/com.atproto.sync.getBlob", "/xrpc/com.atproto.sync.listBlobs", "/img/:did/:cid/:size":
+				return true
 			case "/xrpc/com.atproto.peering.follow", "/events":
 				auth := c.Request().Header.Get("Authorization")
 
@@ -330,38 +497,58 @@ func (s *Server) RunAPIWithListener(listen net.Listener) error {
 				return true
 			case "/.well-known/atproto-did":
 				return true
+			case "/.well-known/oauth-authorization-server", "/.well-known/oauth-protected-resource":
+				return true
 			default:
-				return false
+				// the admin API has its own auth, see checkAdminAuth, and
+				// the oauth endpoints are how clients get tokens at all
+				return strings.HasPrefix(c.Path(), "/admin/") || strings.HasPrefix(c.Path(), "/oauth/")
 			}
 		},
 		SigningKey: s.jwtSigningKey,
 	}
 
-	e.HTTPErrorHandler = func(err error, ctx echo.Context) {
-		fmt.Printf("HANDLER ERROR: (%s) %s\n", ctx.Path(), err)
-
-		// TODO: need to properly figure out where http error codes for error
-		// types get decided. This spot is reasonable, but maybe a bit weird.
-		// reviewers, please advise
-		if errors.Is(err, ErrNoSuchUser) {
-			ctx.Response().WriteHeader(404)
-			return
-		}
+	e.HTTPErrorHandler = xrpcerr.ErrorHandler(logger, errorMappings...)
 
-		ctx.Response().WriteHeader(500)
+	e.Use(s.oauthAuthMiddleware, middleware.JWTWithConfig(cfg), s.userCheckMiddleware)
+	e.Use(ratelimit.Middleware(ratelimit.Config{
+		Store:   s.rateLimitStore,
+		Limits:  s.rateLimits,
+		KeyFunc: s.rateLimitKey,
+	}))
+	if s.requestValidator != nil {
+		e.Use(validate.RequestMiddleware(s.requestValidator))
 	}
-
-	e.Use(middleware.JWTWithConfig(cfg), s.userCheckMiddleware)
 	s.RegisterHandlersComAtproto(e)
+	e.GET("/xrpc/com.atproto.sync.getBlob", s.HandleGetBlob)
 	s.RegisterHandlersAppBsky(e)
+	s.RegisterHandlersOAuth(e)
 	e.GET("/xrpc/com.atproto.sync.subscribeRepos", s.EventsHandler)
 	e.GET("/xrpc/_health", s.HandleHealthCheck)
 	e.GET("/.well-known/atproto-did", s.HandleResolveDid)
+	e.GET("/img/:did/:cid/:size", s.HandleBlobVariant)
+
+	admin := e.Group("/admin", s.checkAdminAuth)
+	admin.POST("/account/disableEmailAuthFactor", s.handleAdminDisableEmailAuthFactor)
+	admin.POST("/account/setBlobQuota", s.handleAdminSetBlobQuota)
+	admin.GET("/log/getLevels", echo.WrapHandler(logutil.LevelsHandler()))
+	admin.POST("/log/setLevels", echo.WrapHandler(logutil.LevelsHandler()))
 
 	// In order to support booting on random ports in tests, we need to tell the
 	// Echo instance it's already got a port, and then use its StartServer
 	// method to re-use that listener.
 	e.Listener = listen
+
+	bctx, cancel := context.WithCancel(context.Background())
+	s.stopBackground = cancel
+	go s.runAccountPurger(bctx)
+	if NotificationRetention > 0 {
+		go s.runNotificationPruner(bctx)
+	}
+	if s.blobs != nil {
+		go s.runBlobGC(bctx)
+	}
+
 	srv := &http.Server{}
 	return e.StartServer(srv)
 }
@@ -407,6 +594,26 @@ type User struct {
 	Email       string
 	Did         string `gorm:"uniqueIndex"`
 	PDS         uint
+
+	// Status is empty for active accounts, otherwise one of the
+	// AccountStatus constants
+	Status string
+
+	// DeleteAfter is set on deleted accounts, and is when the repo data and
+	// blobs of the account will be purged
+	DeleteAfter *time.Time
+
+	// EmailAuthFactor requires a code emailed to the user as a second step
+	// when creating a session
+	EmailAuthFactor bool
+
+	// BlobQuota overrides the server's default quota on the total size of
+	// the user's blobs, if set
+	BlobQuota *int64
+
+	// BlobRefsIndexed is set once the blobs referenced by the user's records
+	// are tracked, which orphaned blob collection waits for
+	BlobRefsIndexed bool
 }
 
 type RefreshToken struct {
@@ -488,6 +695,16 @@ func (s *Server) lookupUser(ctx context.Context, didorhandle string) (*User, err
 	return s.lookupUserByHandle(ctx, didorhandle)
 }
 
+// serviceDid is the did:web of the PDS, which service auth tokens for it are
+// addressed to
+func (s *Server) serviceDid() string {
+	host := s.serviceUrl
+	if u, err := url.Parse(s.serviceUrl); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	return "did:web:" + strings.ReplaceAll(host, ":", "%3A")
+}
+
 func (s *Server) lookupUserByDid(ctx context.Context, did string) (*User, error) {
 	var u User
 	if err := s.db.First(&u, "did = ?", did).Error; err != nil {
@@ -499,6 +716,18 @@ func (s *Server) lookupUserByDid(ctx context.Context, did string) (*User, error)
 
 var ErrNoSuchUser = fmt.Errorf("no such user")
 
+// errorMappings are the XRPC errors sent for the errors of the PDS which are
+// returned from deeper than its handlers
+var errorMappings = []xrpcerr.Mapping{
+	xrpcerr.Map(ErrNoSuchUser, http.StatusNotFound, xrpcerr.NameNotFound),
+	xrpcerr.Map(ErrInvalidUsernameOrPassword, http.StatusUnauthorized, xrpcerr.NameAuthRequired),
+	xrpcerr.Map(ErrInvalidAccountDeleteToken, http.StatusBadRequest, "InvalidToken"),
+	xrpcerr.Map(ErrBlobTooLarge, http.StatusRequestEntityTooLarge, xrpcerr.NamePayloadTooLarge),
+	xrpcerr.Map(ErrImageTooLarge, http.StatusRequestEntityTooLarge, xrpcerr.NamePayloadTooLarge),
+	xrpcerr.Map(ErrBlobQuotaExceeded, http.StatusRequestEntityTooLarge, xrpcerr.NamePayloadTooLarge),
+	xrpcerr.Map(ErrBlobStoreNotConfigured, http.StatusNotImplemented, xrpcerr.NameMethodNotImplemented),
+}
+
 func (s *Server) lookupUserByHandle(ctx context.Context, handle string) (*User, error) {
 	var u User
 	if err := s.db.Find(&u, "handle = ?", handle).Error; err != nil {
@@ -531,9 +760,15 @@ func (s *Server) userCheckMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 			return err
 		}
 
+		if err := checkAccountAccess(u, c.Path()); err != nil {
+			return err
+		}
+
 		ctx = context.WithValue(ctx, "authScope", scope)
 		ctx = context.WithValue(ctx, "user", u)
 		ctx = context.WithValue(ctx, "did", did)
+		ctx = context.WithValue(ctx, "ip", c.RealIP())
+		ctx = logutil.WithFields(ctx, "did", did)
 
 		c.SetRequest(c.Request().WithContext(ctx))
 		return next(c)
@@ -579,6 +814,10 @@ func validateEmail(email string) error {
 }
 
 func (s *Server) validateHandle(handle string) error {
+	if _, err := syntax.ParseHandle(handle); err != nil {
+		return err
+	}
+
 	if !strings.HasSuffix(handle, s.handleSuffix) {
 		return fmt.Errorf("invalid handle")
 	}
@@ -670,6 +909,9 @@ func (s *Server) EventsHandler(c echo.Context) error {
 		case evt.RepoTombstone != nil:
 			header.MsgType = "#tombstone"
 			obj = evt.RepoTombstone
+		case evt.RepoAccount != nil:
+			header.MsgType = "#account"
+			obj = evt.RepoAccount
 		default:
 			return fmt.Errorf("unrecognized event kind")
 		}
@@ -724,5 +966,11 @@ func (s *Server) UpdateUserHandle(ctx context.Context, u *User, handle string) e
 		return fmt.Errorf("failed to push event: %s", err)
 	}
 
+	if s.invalidations != nil {
+		if err := s.invalidations.Publish(ctx, invalidation.IdentityChanged("pds", u.Did, handle)); err != nil {
+			log.Warnw("failed to publish handle change", "did", u.Did, "err", err)
+		}
+	}
+
 	return nil
 }
@@ -54,9 +54,9 @@ func (s *Server) RegisterHandlersAppBsky(e *echo.Echo) error {
 func (s *Server) HandleAppBskyActorGetPreferences(c echo.Context) error {
 	ctx, span := otel.Tracer("server").Start(c.Request().Context(), "HandleAppBskyActorGetPreferences")
 	defer span.End()
-	var out *appbskytypes.ActorGetPreferences_Output
+	var out *rawPreferences
 	var handleErr error
-	// func (s *Server) handleAppBskyActorGetPreferences(ctx context.Context) (*appbskytypes.ActorGetPreferences_Output, error)
+	// func (s *Server) handleAppBskyActorGetPreferences(ctx context.Context) (*rawPreferences, error)
 	out, handleErr = s.handleAppBskyActorGetPreferences(ctx)
 	if handleErr != nil {
 		return handleErr
@@ -122,12 +122,14 @@ func (s *Server) HandleAppBskyActorPutPreferences(c echo.Context) error {
 	ctx, span := otel.Tracer("server").Start(c.Request().Context(), "HandleAppBskyActorPutPreferences")
 	defer span.End()
 
-	var body appbskytypes.ActorPutPreferences_Input
+	// preferences are bound as raw JSON so that unknown preference types are
+	// preserved, see rawPreferences
+	var body rawPreferences
 	if err := c.Bind(&body); err != nil {
 		return err
 	}
 	var handleErr error
-	// func (s *Server) handleAppBskyActorPutPreferences(ctx context.Context,body *appbskytypes.ActorPutPreferences_Input) error
+	// func (s *Server) handleAppBskyActorPutPreferences(ctx context.Context,body *rawPreferences) error
 	handleErr = s.handleAppBskyActorPutPreferences(ctx, &body)
 	if handleErr != nil {
 		return handleErr
@@ -900,26 +902,33 @@ func (s *Server) RegisterHandlersComAtproto(e *echo.Echo) error {
 	e.POST("/xrpc/com.atproto.repo.deleteRecord", s.HandleComAtprotoRepoDeleteRecord)
 	e.GET("/xrpc/com.atproto.repo.describeRepo", s.HandleComAtprotoRepoDescribeRepo)
 	e.GET("/xrpc/com.atproto.repo.getRecord", s.HandleComAtprotoRepoGetRecord)
+	e.POST("/xrpc/com.atproto.repo.importRepo", s.HandleComAtprotoRepoImportRepo)
+	e.GET("/xrpc/com.atproto.repo.listMissingBlobs", s.HandleComAtprotoRepoListMissingBlobs)
 	e.GET("/xrpc/com.atproto.repo.listRecords", s.HandleComAtprotoRepoListRecords)
 	e.POST("/xrpc/com.atproto.repo.putRecord", s.HandleComAtprotoRepoPutRecord)
 	e.POST("/xrpc/com.atproto.repo.rebaseRepo", s.HandleComAtprotoRepoRebaseRepo)
 	e.POST("/xrpc/com.atproto.repo.uploadBlob", s.HandleComAtprotoRepoUploadBlob)
+	e.POST("/xrpc/com.atproto.server.activateAccount", s.HandleComAtprotoServerActivateAccount)
 	e.POST("/xrpc/com.atproto.server.createAccount", s.HandleComAtprotoServerCreateAccount)
 	e.POST("/xrpc/com.atproto.server.createAppPassword", s.HandleComAtprotoServerCreateAppPassword)
 	e.POST("/xrpc/com.atproto.server.createInviteCode", s.HandleComAtprotoServerCreateInviteCode)
 	e.POST("/xrpc/com.atproto.server.createInviteCodes", s.HandleComAtprotoServerCreateInviteCodes)
 	e.POST("/xrpc/com.atproto.server.createSession", s.HandleComAtprotoServerCreateSession)
+	e.POST("/xrpc/com.atproto.server.deactivateAccount", s.HandleComAtprotoServerDeactivateAccount)
 	e.POST("/xrpc/com.atproto.server.deleteAccount", s.HandleComAtprotoServerDeleteAccount)
 	e.POST("/xrpc/com.atproto.server.deleteSession", s.HandleComAtprotoServerDeleteSession)
 	e.GET("/xrpc/com.atproto.server.describeServer", s.HandleComAtprotoServerDescribeServer)
 	e.GET("/xrpc/com.atproto.server.getAccountInviteCodes", s.HandleComAtprotoServerGetAccountInviteCodes)
+	e.GET("/xrpc/com.atproto.server.getServiceAuth", s.HandleComAtprotoServerGetServiceAuth)
 	e.GET("/xrpc/com.atproto.server.getSession", s.HandleComAtprotoServerGetSession)
 	e.GET("/xrpc/com.atproto.server.listAppPasswords", s.HandleComAtprotoServerListAppPasswords)
 	e.POST("/xrpc/com.atproto.server.refreshSession", s.HandleComAtprotoServerRefreshSession)
 	e.POST("/xrpc/com.atproto.server.requestAccountDelete", s.HandleComAtprotoServerRequestAccountDelete)
+	e.POST("/xrpc/com.atproto.server.requestEmailUpdate", s.HandleComAtprotoServerRequestEmailUpdate)
 	e.POST("/xrpc/com.atproto.server.requestPasswordReset", s.HandleComAtprotoServerRequestPasswordReset)
 	e.POST("/xrpc/com.atproto.server.resetPassword", s.HandleComAtprotoServerResetPassword)
 	e.POST("/xrpc/com.atproto.server.revokeAppPassword", s.HandleComAtprotoServerRevokeAppPassword)
+	e.POST("/xrpc/com.atproto.server.updateEmail", s.HandleComAtprotoServerUpdateEmail)
 	e.GET("/xrpc/com.atproto.sync.getBlob", s.HandleComAtprotoSyncGetBlob)
 	e.GET("/xrpc/com.atproto.sync.getBlocks", s.HandleComAtprotoSyncGetBlocks)
 	e.GET("/xrpc/com.atproto.sync.getCheckout", s.HandleComAtprotoSyncGetCheckout)
@@ -1463,6 +1472,44 @@ func (s *Server) HandleComAtprotoRepoGetRecord(c echo.Context) error {
 	return c.JSON(200, out)
 }
 
+func (s *Server) HandleComAtprotoRepoImportRepo(c echo.Context) error {
+	ctx, span := otel.Tracer("server").Start(c.Request().Context(), "HandleComAtprotoRepoImportRepo")
+	defer span.End()
+	body := c.Request().Body
+	var handleErr error
+	// func (s *Server) handleComAtprotoRepoImportRepo(ctx context.Context,r io.Reader) error
+	handleErr = s.handleComAtprotoRepoImportRepo(ctx, body)
+	if handleErr != nil {
+		return handleErr
+	}
+	return nil
+}
+
+func (s *Server) HandleComAtprotoRepoListMissingBlobs(c echo.Context) error {
+	ctx, span := otel.Tracer("server").Start(c.Request().Context(), "HandleComAtprotoRepoListMissingBlobs")
+	defer span.End()
+	cursor := c.QueryParam("cursor")
+
+	var limit int
+	if p := c.QueryParam("limit"); p != "" {
+		var err error
+		limit, err = strconv.Atoi(p)
+		if err != nil {
+			return err
+		}
+	} else {
+		limit = 500
+	}
+	var out *comatprototypes.RepoListMissingBlobs_Output
+	var handleErr error
+	// func (s *Server) handleComAtprotoRepoListMissingBlobs(ctx context.Context,cursor string,limit int) (*comatprototypes.RepoListMissingBlobs_Output, error)
+	out, handleErr = s.handleComAtprotoRepoListMissingBlobs(ctx, cursor, limit)
+	if handleErr != nil {
+		return handleErr
+	}
+	return c.JSON(200, out)
+}
+
 func (s *Server) HandleComAtprotoRepoListRecords(c echo.Context) error {
 	ctx, span := otel.Tracer("server").Start(c.Request().Context(), "HandleComAtprotoRepoListRecords")
 	defer span.End()
@@ -1551,6 +1598,18 @@ func (s *Server) HandleComAtprotoRepoUploadBlob(c echo.Context) error {
 	return c.JSON(200, out)
 }
 
+func (s *Server) HandleComAtprotoServerActivateAccount(c echo.Context) error {
+	ctx, span := otel.Tracer("server").Start(c.Request().Context(), "HandleComAtprotoServerActivateAccount")
+	defer span.End()
+	var handleErr error
+	// func (s *Server) handleComAtprotoServerActivateAccount(ctx context.Context) error
+	handleErr = s.handleComAtprotoServerActivateAccount(ctx)
+	if handleErr != nil {
+		return handleErr
+	}
+	return nil
+}
+
 func (s *Server) HandleComAtprotoServerCreateAccount(c echo.Context) error {
 	ctx, span := otel.Tracer("server").Start(c.Request().Context(), "HandleComAtprotoServerCreateAccount")
 	defer span.End()
@@ -1641,6 +1700,23 @@ func (s *Server) HandleComAtprotoServerCreateSession(c echo.Context) error {
 	return c.JSON(200, out)
 }
 
+func (s *Server) HandleComAtprotoServerDeactivateAccount(c echo.Context) error {
+	ctx, span := otel.Tracer("server").Start(c.Request().Context(), "HandleComAtprotoServerDeactivateAccount")
+	defer span.End()
+
+	var body comatprototypes.ServerDeactivateAccount_Input
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	var handleErr error
+	// func (s *Server) handleComAtprotoServerDeactivateAccount(ctx context.Context,body *comatprototypes.ServerDeactivateAccount_Input) error
+	handleErr = s.handleComAtprotoServerDeactivateAccount(ctx, &body)
+	if handleErr != nil {
+		return handleErr
+	}
+	return nil
+}
+
 func (s *Server) HandleComAtprotoServerDeleteAccount(c echo.Context) error {
 	ctx, span := otel.Tracer("server").Start(c.Request().Context(), "HandleComAtprotoServerDeleteAccount")
 	defer span.End()
@@ -1718,6 +1794,30 @@ func (s *Server) HandleComAtprotoServerGetAccountInviteCodes(c echo.Context) err
 	return c.JSON(200, out)
 }
 
+func (s *Server) HandleComAtprotoServerGetServiceAuth(c echo.Context) error {
+	ctx, span := otel.Tracer("server").Start(c.Request().Context(), "HandleComAtprotoServerGetServiceAuth")
+	defer span.End()
+	aud := c.QueryParam("aud")
+
+	var exp int
+	if p := c.QueryParam("exp"); p != "" {
+		var err error
+		exp, err = strconv.Atoi(p)
+		if err != nil {
+			return err
+		}
+	}
+	lxm := c.QueryParam("lxm")
+	var out *comatprototypes.ServerGetServiceAuth_Output
+	var handleErr error
+	// func (s *Server) handleComAtprotoServerGetServiceAuth(ctx context.Context,aud string,exp int,lxm string) (*comatprototypes.ServerGetServiceAuth_Output, error)
+	out, handleErr = s.handleComAtprotoServerGetServiceAuth(ctx, aud, exp, lxm)
+	if handleErr != nil {
+		return handleErr
+	}
+	return c.JSON(200, out)
+}
+
 func (s *Server) HandleComAtprotoServerGetSession(c echo.Context) error {
 	ctx, span := otel.Tracer("server").Start(c.Request().Context(), "HandleComAtprotoServerGetSession")
 	defer span.End()
@@ -1769,6 +1869,19 @@ func (s *Server) HandleComAtprotoServerRequestAccountDelete(c echo.Context) erro
 	return nil
 }
 
+func (s *Server) HandleComAtprotoServerRequestEmailUpdate(c echo.Context) error {
+	ctx, span := otel.Tracer("server").Start(c.Request().Context(), "HandleComAtprotoServerRequestEmailUpdate")
+	defer span.End()
+	var out *comatprototypes.ServerRequestEmailUpdate_Output
+	var handleErr error
+	// func (s *Server) handleComAtprotoServerRequestEmailUpdate(ctx context.Context) (*comatprototypes.ServerRequestEmailUpdate_Output, error)
+	out, handleErr = s.handleComAtprotoServerRequestEmailUpdate(ctx)
+	if handleErr != nil {
+		return handleErr
+	}
+	return c.JSON(200, out)
+}
+
 func (s *Server) HandleComAtprotoServerRequestPasswordReset(c echo.Context) error {
 	ctx, span := otel.Tracer("server").Start(c.Request().Context(), "HandleComAtprotoServerRequestPasswordReset")
 	defer span.End()
@@ -1820,6 +1933,23 @@ func (s *Server) HandleComAtprotoServerRevokeAppPassword(c echo.Context) error {
 	return nil
 }
 
+func (s *Server) HandleComAtprotoServerUpdateEmail(c echo.Context) error {
+	ctx, span := otel.Tracer("server").Start(c.Request().Context(), "HandleComAtprotoServerUpdateEmail")
+	defer span.End()
+
+	var body comatprototypes.ServerUpdateEmail_Input
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	var handleErr error
+	// func (s *Server) handleComAtprotoServerUpdateEmail(ctx context.Context,body *comatprototypes.ServerUpdateEmail_Input) error
+	handleErr = s.handleComAtprotoServerUpdateEmail(ctx, &body)
+	if handleErr != nil {
+		return handleErr
+	}
+	return nil
+}
+
 func (s *Server) HandleComAtprotoSyncGetBlob(c echo.Context) error {
 	ctx, span := otel.Tracer("server").Start(c.Request().Context(), "HandleComAtprotoSyncGetBlob")
 	defer span.End()
@@ -0,0 +1,82 @@
+package pds
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/bluesky-social/indigo/util/imgproc"
+	"github.com/bluesky-social/indigo/util/xrpcerr"
+)
+
+// DefaultMaxVideoSize is the largest video accepted through uploadBlob, for
+// blob stores which can stream uploads
+const DefaultMaxVideoSize = 100 << 20
+
+// sniffLen is how much of an upload is looked at to tell its type
+const sniffLen = 512
+
+// SetMaxVideoSize sets the largest video accepted through uploadBlob. Videos
+// are only accepted at this size by blob stores which can stream them, and
+// are held to MaxBlobSize by others.
+func (s *Server) SetMaxVideoSize(n int64) {
+	s.maxVideoSize = n
+}
+
+// detectVideoType returns the MIME type of the common video containers, from
+// the start of a file, or "" for anything else
+func detectVideoType(head []byte) string {
+	switch {
+	case len(head) >= 12 && string(head[4:8]) == "ftyp":
+		// ISO base media files, named after their major brand
+		brand := string(head[8:12])
+		switch {
+		case brand == "qt  ":
+			return "video/quicktime"
+		case strings.HasPrefix(brand, "3gp"), strings.HasPrefix(brand, "3g2"):
+			return "video/3gpp"
+		case brand == "M4A ", brand == "M4B ", brand == "heic", brand == "heix", brand == "avif", brand == "mif1":
+			// audio and images share the container
+			return ""
+		default:
+			return "video/mp4"
+		}
+	case len(head) >= 8 && (string(head[4:8]) == "moov" || string(head[4:8]) == "mdat" || string(head[4:8]) == "wide"):
+		// QuickTime files from before ftyp boxes
+		return "video/quicktime"
+	case bytes.HasPrefix(head, []byte("\x1a\x45\xdf\xa3")):
+		// EBML, which has the document type in its header
+		if bytes.Contains(head, []byte("webm")) {
+			return "video/webm"
+		}
+		return "video/x-matroska"
+	case len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "AVI ":
+		return "video/x-msvideo"
+	case len(head) > 188 && head[0] == 0x47 && head[188] == 0x47:
+		// MPEG transport streams are 188 byte packets of sync byte and data
+		return "video/mp2t"
+	default:
+		return ""
+	}
+}
+
+// checkVideoType returns the type to store a video upload as, given the type
+// it was declared as and the type it was detected to be
+func checkVideoType(mimeType, detected string) (string, error) {
+	declared := imgproc.NormalizeMimeType(mimeType)
+	switch declared {
+	case "", "*/*", "application/octet-stream":
+		declared = detected
+	}
+
+	if detected == "" {
+		return "", xrpcerr.InvalidRequest("blob declared as %q is not a recognized video format", mimeType)
+	}
+	if declared != detected {
+		return "", xrpcerr.InvalidRequest("blob declared as %q is %q", mimeType, detected)
+	}
+	return detected, nil
+}
+
+func isVideo(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "video/")
+}
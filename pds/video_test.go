@@ -0,0 +1,163 @@
+package pds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/blobs"
+	"github.com/bluesky-social/indigo/util/xrpcerr"
+
+	"github.com/labstack/echo/v4"
+)
+
+// testVideo returns an MP4-looking file of n bytes, which differs with seed
+func testVideo(n int, seed byte) []byte {
+	data := make([]byte, n)
+	copy(data, "\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom")
+	for i := 24; i < n; i++ {
+		data[i] = byte(i) ^ seed
+	}
+	return data
+}
+
+func TestDetectVideoType(t *testing.T) {
+	for mt, head := range map[string][]byte{
+		"video/mp4":        testVideo(64, 0),
+		"video/quicktime":  []byte("\x00\x00\x00\x14ftypqt  \x00\x00\x00\x00"),
+		"video/3gpp":       []byte("\x00\x00\x00\x14ftyp3gp5\x00\x00\x00\x00"),
+		"video/webm":       []byte("\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x84webm"),
+		"video/x-matroska": []byte("\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x88matroska"),
+		"video/x-msvideo":  []byte("RIFF\x00\x10\x00\x00AVI LIST"),
+		"":                 []byte("\x00\x00\x00\x14ftypM4A \x00\x00\x00\x00"),
+	} {
+		if got := detectVideoType(head); got != mt {
+			t.Errorf("expected %q, got %q", mt, got)
+		}
+	}
+	if got := detectVideoType([]byte("just some text")); got != "" {
+		t.Errorf("text detected as %q", got)
+	}
+}
+
+func TestVideoUploads(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	s.SetBlobStore(&blobs.DiskBlobStore{Dir: t.TempDir()})
+	s.SetMaxVideoSize(8 << 10)
+	s.SetDefaultBlobQuota(12 << 10)
+
+	ctx := context.Background()
+	o, err := s.handleComAtprotoServerCreateAccount(ctx, &atproto.ServerCreateAccount_Input{
+		Email:    "test@foo.com",
+		Password: "password",
+		Handle:   "testman.test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := s.lookupUserByDid(ctx, o.Did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = context.WithValue(ctx, "user", u)
+
+	// larger than other blobs may be
+	video := testVideo(7<<10, 1)
+	up, err := s.handleComAtprotoRepoUploadBlob(ctx, bytes.NewReader(video), "video/mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up.Blob.Size != int64(len(video)) || up.Blob.MimeType != "video/mp4" {
+		t.Fatalf("unexpected blob %v", up.Blob)
+	}
+
+	stored, err := s.loadBlob(ctx, u, up.Blob.Ref.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, video) {
+		t.Fatal("video did not round trip")
+	}
+
+	// uploads are stored under the cid of their contents
+	again, err := s.putBlob(ctx, u, video, "video/mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Ref != up.Blob.Ref {
+		t.Fatalf("streamed upload has cid %s, expected %s", up.Blob.Ref, again.Ref)
+	}
+
+	status := func(err error) int {
+		var xe *xrpcerr.Error
+		switch {
+		case errors.As(err, &xe):
+			return xe.Status
+		case errors.Is(err, ErrBlobTooLarge), errors.Is(err, ErrBlobQuotaExceeded):
+			return http.StatusRequestEntityTooLarge
+		case err != nil:
+			return http.StatusInternalServerError
+		}
+		return http.StatusOK
+	}
+
+	_, err = s.handleComAtprotoRepoUploadBlob(ctx, bytes.NewReader(testVideo(1<<10, 2)), "video/webm")
+	if status(err) != http.StatusBadRequest {
+		t.Fatalf("expected a mismatched type to be rejected, got %v", err)
+	}
+	_, err = s.handleComAtprotoRepoUploadBlob(ctx, bytes.NewReader([]byte("not a video")), "video/mp4")
+	if status(err) != http.StatusBadRequest {
+		t.Fatalf("expected an unrecognized video to be rejected, got %v", err)
+	}
+	_, err = s.handleComAtprotoRepoUploadBlob(ctx, bytes.NewReader(testVideo(9<<10, 3)), "video/mp4")
+	if !errors.Is(err, ErrBlobTooLarge) {
+		t.Fatalf("expected ErrBlobTooLarge, got %v", err)
+	}
+
+	// over quota, unless the video is already stored
+	_, err = s.handleComAtprotoRepoUploadBlob(ctx, bytes.NewReader(testVideo(6<<10, 4)), "application/octet-stream")
+	if !errors.Is(err, ErrBlobQuotaExceeded) {
+		t.Fatalf("expected ErrBlobQuotaExceeded, got %v", err)
+	}
+	if _, err := s.handleComAtprotoRepoUploadBlob(ctx, bytes.NewReader(video), "video/mp4"); err != nil {
+		t.Fatal(err)
+	}
+
+	quota := int64(1 << 20)
+	if err := s.SetAccountBlobQuota(ctx, u.Did, &quota); err != nil {
+		t.Fatal(err)
+	}
+	u, err = s.lookupUserByDid(ctx, u.Did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = context.WithValue(ctx, "user", u)
+	if _, err := s.handleComAtprotoRepoUploadBlob(ctx, bytes.NewReader(testVideo(6<<10, 4)), "application/octet-stream"); err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	s.RegisterHandlersComAtproto(e)
+	e.GET("/xrpc/com.atproto.sync.getBlob", s.HandleGetBlob)
+
+	req := httptest.NewRequest("GET", "/xrpc/com.atproto.sync.getBlob?did="+u.Did+"&cid="+up.Blob.Ref.String(), nil)
+	req.Header.Set("Range", "bytes=100-199")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("expected a partial response, got %d: %s", rec.Code, rec.Body)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), video[100:200]) {
+		t.Fatal("unexpected range contents")
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "video/mp4" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+}
@@ -0,0 +1,95 @@
+package pds
+
+import (
+	"context"
+	"net/http"
+
+	bsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/util/visibility"
+	"github.com/bluesky-social/indigo/util/xrpcerr"
+
+	"gorm.io/gorm"
+)
+
+// blockSource hydrates visibility decisions from the blocks the indexer
+// keeps. Mutes are not kept yet, so never apply.
+type blockSource struct {
+	db *gorm.DB
+}
+
+var _ visibility.GraphSource = (*blockSource)(nil)
+
+func (bs *blockSource) Relationships(ctx context.Context, viewer string, dids []string) (map[string]*visibility.Subject, error) {
+	var blocks []struct {
+		Blocker string
+		Target  string
+	}
+	if err := bs.db.WithContext(ctx).Table("block_records").
+		Select("b.did AS blocker, t.did AS target").
+		Joins("JOIN actor_infos b ON b.uid = block_records.blocker").
+		Joins("JOIN actor_infos t ON t.uid = block_records.target").
+		Where("block_records.deleted_at IS NULL").
+		Where("(b.did = ? AND t.did IN ?) OR (t.did = ? AND b.did IN ?)", viewer, dids, viewer, dids).
+		Scan(&blocks).Error; err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]*visibility.Subject)
+	subject := func(did string) *visibility.Subject {
+		if out[did] == nil {
+			out[did] = &visibility.Subject{Did: did}
+		}
+		return out[did]
+	}
+	for _, b := range blocks {
+		if b.Blocker == viewer {
+			subject(b.Target).Blocking = true
+		} else {
+			subject(b.Blocker).BlockedBy = true
+		}
+	}
+	return out, nil
+}
+
+// feedItemSubjects returns the accounts a feed item shows: the author of the
+// post, and whoever reposted it
+func feedItemSubjects(fvp *bsky.FeedDefs_FeedViewPost) []string {
+	subjects := []string{fvp.Post.Author.Did}
+	if fvp.Reason != nil && fvp.Reason.FeedDefs_ReasonRepost != nil {
+		subjects = append(subjects, fvp.Reason.FeedDefs_ReasonRepost.By.Did)
+	}
+	return subjects
+}
+
+// filterFeed leaves out the feed items a viewer isn't shown
+func (fg *FeedGenerator) filterFeed(ctx context.Context, feed []*bsky.FeedDefs_FeedViewPost, viewer *User) ([]*bsky.FeedDefs_FeedViewPost, error) {
+	var dids []string
+	for _, fvp := range feed {
+		dids = append(dids, feedItemSubjects(fvp)...)
+	}
+
+	decisions, err := fg.vis.Decide(ctx, viewer.Did, visibility.ContextFeed, dids, nil)
+	if err != nil {
+		return nil, err
+	}
+	return visibility.Visible(decisions, feed, feedItemSubjects), nil
+}
+
+// checkProfileVisible returns the error for an author whose profile content
+// a viewer isn't shown, because of a block either way
+func (fg *FeedGenerator) checkProfileVisible(ctx context.Context, viewer, author *User) error {
+	decisions, err := fg.vis.Decide(ctx, viewer.Did, visibility.ContextProfile, []string{author.Did}, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range decisions[author.Did].Reasons {
+		switch r {
+		case visibility.Blocking:
+			return xrpcerr.New(http.StatusBadRequest, "BlockedActor", "requester has blocked actor")
+		case visibility.BlockedBy:
+			return xrpcerr.New(http.StatusBadRequest, "BlockedByActor", "requester is blocked by actor")
+		}
+	}
+	return nil
+}
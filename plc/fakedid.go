@@ -5,6 +5,8 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 
+	"github.com/bluesky-social/indigo/util/signer"
+
 	"github.com/whyrusleeping/go-did"
 	"gorm.io/gorm"
 )
@@ -66,7 +68,12 @@ func (fd *FakeDid) GetDocument(ctx context.Context, udid string) (*did.Document,
 	}, nil
 }
 
-func (fd *FakeDid) CreateDID(ctx context.Context, sigkey *did.PrivKey, recovery string, handle string, service string) (string, error) {
+func (fd *FakeDid) CreateDID(ctx context.Context, sigkey signer.Signer, recovery string, handle string, service string) (string, error) {
+	pub, err := sigkey.Public(ctx)
+	if err != nil {
+		return "", err
+	}
+
 	buf := make([]byte, 8)
 	rand.Read(buf)
 	d := "did:plc:" + hex.EncodeToString(buf)
@@ -75,8 +82,8 @@ func (fd *FakeDid) CreateDID(ctx context.Context, sigkey *did.PrivKey, recovery
 		Handle:      handle,
 		Did:         d,
 		Service:     service,
-		PubKeyMbase: sigkey.Public().MultibaseString(),
-		KeyType:     sigkey.KeyType(),
+		PubKeyMbase: pub.MultibaseString(),
+		KeyType:     pub.Type,
 	}).Error; err != nil {
 		return "", err
 	}
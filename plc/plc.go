@@ -4,11 +4,11 @@ import (
 	"context"
 
 	didres "github.com/bluesky-social/indigo/did"
-	"github.com/whyrusleeping/go-did"
+	"github.com/bluesky-social/indigo/util/signer"
 )
 
 type PLCClient interface {
 	didres.Resolver
-	CreateDID(ctx context.Context, sigkey *did.PrivKey, recovery string, handle string, service string) (string, error)
+	CreateDID(ctx context.Context, sigkey signer.Signer, recovery string, handle string, service string) (string, error)
 	UpdateUserHandle(ctx context.Context, didstr string, nhandle string) error
 }
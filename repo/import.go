@@ -0,0 +1,246 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/bluesky-social/indigo/mst"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	car "github.com/ipld/go-car"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"go.opentelemetry.io/otel"
+)
+
+// BlockSink is where an Importer writes blocks. Blocks that arrive before
+// anything references them are read back out of the sink once they are
+// needed, so it must be able to return anything that has been Put.
+type BlockSink interface {
+	Put(ctx context.Context, blk blocks.Block) error
+	Get(ctx context.Context, k cid.Cid) (blocks.Block, error)
+}
+
+// Importer validates a repo CAR file while streaming it into a BlockSink.
+// Only the CIDs of blocks are kept in memory, so repos of any size can be
+// imported.
+type Importer struct {
+	cr   *car.CarReader
+	root cid.Cid
+}
+
+// ImportResult summarizes a successful import
+type ImportResult struct {
+	Commit  SignedCommit
+	Records int
+	Blocks  int
+
+	// Unreferenced is the number of blocks in the CAR that are not part of
+	// the current commit, such as history. They are written to the sink
+	// unvalidated.
+	Unreferenced int
+}
+
+type importKind int
+
+const (
+	importCommit importKind = iota
+	importNode
+	importRecord
+)
+
+type importExpect struct {
+	kind   importKind
+	bounds mst.NodeBounds
+}
+
+// NewImporter reads the header of a repo CAR file. The CAR must have a single
+// root, the signed commit being imported.
+func NewImporter(r io.Reader) (*Importer, error) {
+	cr, err := car.NewCarReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading car header: %w", err)
+	}
+
+	if len(cr.Header.Roots) != 1 {
+		return nil, fmt.Errorf("repo car must have exactly one root, has %d", len(cr.Header.Roots))
+	}
+
+	return &Importer{
+		cr:   cr,
+		root: cr.Header.Roots[0],
+	}, nil
+}
+
+// Root is the CID of the commit being imported
+func (imp *Importer) Root() cid.Cid {
+	return imp.root
+}
+
+// Run reads the rest of the CAR into sink. Every block is checked against its
+// CID, and the blocks of the current commit are validated as soon as they are
+// reachable: the commit must be for did and signed as checked by verify, every
+// tree node must be well formed, and every record must be DAG-CBOR. Run fails
+// if any block of the current commit is missing.
+func (imp *Importer) Run(ctx context.Context, sink BlockSink, did string, verify func(ctx context.Context, did string, sig, msg []byte) error) (*ImportResult, error) {
+	ctx, span := otel.Tracer("repo").Start(ctx, "Import")
+	defer span.End()
+
+	res := &ImportResult{}
+
+	expected := map[cid.Cid]importExpect{
+		imp.root: {kind: importCommit},
+	}
+	// blocks that have been written but not yet referenced by anything
+	unclaimed := make(map[cid.Cid]bool)
+	// blocks that have been validated, in case they are referenced again
+	done := make(map[cid.Cid]bool)
+
+	var check func(blk blocks.Block, exp importExpect) error
+	check = func(blk blocks.Block, exp importExpect) error {
+		delete(expected, blk.Cid())
+		done[blk.Cid()] = true
+
+		var refs []cid.Cid
+		switch exp.kind {
+		case importCommit:
+			sc, err := imp.checkCommit(ctx, blk, did, verify)
+			if err != nil {
+				return err
+			}
+			res.Commit = *sc
+
+			refs = append(refs, sc.Data)
+			expected[sc.Data] = importExpect{kind: importNode, bounds: mst.RootBounds}
+
+		case importNode:
+			subtrees, leaves, err := mst.CheckNode(blk.RawData(), exp.bounds)
+			if err != nil {
+				return fmt.Errorf("invalid tree node %s: %w", blk.Cid(), err)
+			}
+
+			for _, st := range subtrees {
+				if _, ok := expected[st.Cid]; ok || done[st.Cid] {
+					return fmt.Errorf("tree node %s appears more than once in the tree", st.Cid)
+				}
+				refs = append(refs, st.Cid)
+				expected[st.Cid] = importExpect{kind: importNode, bounds: st.Bounds}
+			}
+
+			for _, l := range leaves {
+				res.Records++
+				// the same record may appear under several keys
+				if done[l.Val] {
+					continue
+				}
+				if _, ok := expected[l.Val]; ok {
+					continue
+				}
+				refs = append(refs, l.Val)
+				expected[l.Val] = importExpect{kind: importRecord}
+			}
+
+		case importRecord:
+			if blk.Cid().Prefix().Codec != cid.DagCBOR {
+				return fmt.Errorf("record %s is not dag-cbor", blk.Cid())
+			}
+
+			if err := cbg.ScanForLinks(bytes.NewReader(blk.RawData()), func(cid.Cid) {}); err != nil {
+				return fmt.Errorf("invalid record %s: %w", blk.Cid(), err)
+			}
+		}
+
+		// anything newly referenced that we already have can be checked now
+		for _, r := range refs {
+			if !unclaimed[r] {
+				continue
+			}
+			delete(unclaimed, r)
+
+			rblk, err := sink.Get(ctx, r)
+			if err != nil {
+				return fmt.Errorf("reading back block %s: %w", r, err)
+			}
+
+			if err := check(rblk, expected[r]); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	for {
+		blk, err := imp.cr.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("reading car: %w", err)
+		}
+
+		chk, err := blk.Cid().Prefix().Sum(blk.RawData())
+		if err != nil {
+			return nil, err
+		}
+		if !chk.Equals(blk.Cid()) {
+			return nil, fmt.Errorf("block %s does not match its CID", blk.Cid())
+		}
+
+		if done[blk.Cid()] || unclaimed[blk.Cid()] {
+			continue
+		}
+
+		if err := sink.Put(ctx, blk); err != nil {
+			return nil, fmt.Errorf("writing block: %w", err)
+		}
+		res.Blocks++
+
+		exp, ok := expected[blk.Cid()]
+		if !ok {
+			unclaimed[blk.Cid()] = true
+			continue
+		}
+
+		if err := check(blk, exp); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(expected) > 0 {
+		for k := range expected {
+			return nil, fmt.Errorf("repo car is missing %d blocks (including %s)", len(expected), k)
+		}
+	}
+
+	res.Unreferenced = len(unclaimed)
+
+	return res, nil
+}
+
+func (imp *Importer) checkCommit(ctx context.Context, blk blocks.Block, did string, verify func(ctx context.Context, did string, sig, msg []byte) error) (*SignedCommit, error) {
+	var sc SignedCommit
+	if err := sc.UnmarshalCBOR(bytes.NewReader(blk.RawData())); err != nil {
+		return nil, fmt.Errorf("decoding commit: %w", err)
+	}
+
+	if sc.Version != ATP_REPO_VERSION {
+		return nil, fmt.Errorf("unsupported repo version: %d", sc.Version)
+	}
+
+	if sc.Did != did {
+		return nil, fmt.Errorf("imported repo commit was for %q, expected %q", sc.Did, did)
+	}
+
+	sb, err := sc.Unsigned().BytesForSigning()
+	if err != nil {
+		return nil, fmt.Errorf("commit serialization failed: %w", err)
+	}
+
+	if err := verify(ctx, did, sc.Sig, sb); err != nil {
+		return nil, fmt.Errorf("commit signature check failed: %w", err)
+	}
+
+	return &sc, nil
+}
@@ -0,0 +1,183 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/bluesky-social/indigo/mst"
+	"github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/util/keyutil"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	car "github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	godid "github.com/whyrusleeping/go-did"
+	"go.opentelemetry.io/otel"
+)
+
+// maxProofBlocks bounds the size of a record proof we are willing to verify.
+// A proof is one block per tree layer plus the commit and record, so this is
+// far more than any real repo needs.
+const maxProofBlocks = 64
+
+// RecordProofBlocks returns the minimal set of blocks proving the value (or
+// absence) of rpath in the repo at the given commit: the commit itself, the
+// tree nodes on the path to the key, and the record if it exists.
+func RecordProofBlocks(ctx context.Context, bs blockstore.Blockstore, commit cid.Cid, rpath string) ([]blocks.Block, error) {
+	ctx, span := otel.Tracer("repo").Start(ctx, "RecordProofBlocks")
+	defer span.End()
+
+	r, err := OpenRepo(ctx, bs, commit, false)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := r.getMst(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := t.CidsForPath(ctx, rpath)
+	if err != nil {
+		return nil, fmt.Errorf("finding path to %q: %w", rpath, err)
+	}
+
+	var out []blocks.Block
+	for _, c := range append([]cid.Cid{commit}, path...) {
+		blk, err := bs.Get(ctx, c)
+		if err != nil {
+			return nil, fmt.Errorf("getting proof block %s: %w", c, err)
+		}
+		out = append(out, blk)
+	}
+
+	return out, nil
+}
+
+// WriteRecordProof writes a CAR file proving the value (or absence) of rpath
+// at the given commit, as served by com.atproto.sync.getRecord. The root of
+// the CAR is the commit.
+func WriteRecordProof(ctx context.Context, bs blockstore.Blockstore, commit cid.Cid, rpath string, w io.Writer) error {
+	blks, err := RecordProofBlocks(ctx, bs, commit, rpath)
+	if err != nil {
+		return err
+	}
+
+	if err := car.WriteHeader(&car.CarHeader{
+		Roots:   []cid.Cid{commit},
+		Version: 1,
+	}, w); err != nil {
+		return err
+	}
+
+	for _, blk := range blks {
+		if err := carutil.LdWrite(w, blk.Cid().Bytes(), blk.RawData()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ProvenRecord is the result of verifying a record proof
+type ProvenRecord struct {
+	// Commit is the commit the proof is for
+	Commit cid.Cid
+
+	// Cid is the CID of the record, or cid.Undef if the proof shows there is
+	// no record at the path
+	Cid cid.Cid
+
+	// Raw is the CBOR encoding of the record, if it exists
+	Raw []byte
+}
+
+// VerifyRecordProof checks a proof CAR (as written by WriteRecordProof) for
+// rpath in the repo of did, whose commits are signed by key. It does not need
+// any other repo data. A proof that the record does not exist is valid, and
+// results in ProvenRecord.Cid being undefined.
+func VerifyRecordProof(ctx context.Context, r io.Reader, did string, key *godid.PubKey, rpath string) (*ProvenRecord, error) {
+	ctx, span := otel.Tracer("repo").Start(ctx, "VerifyRecordProof")
+	defer span.End()
+
+	cr, err := car.NewCarReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading proof: %w", err)
+	}
+
+	if len(cr.Header.Roots) != 1 {
+		return nil, fmt.Errorf("proof must have exactly one root")
+	}
+	commit := cr.Header.Roots[0]
+
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	for n := 0; ; n++ {
+		blk, err := cr.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("reading proof: %w", err)
+		}
+
+		if n >= maxProofBlocks {
+			return nil, fmt.Errorf("proof has too many blocks")
+		}
+
+		// the CAR reader does not check that blocks match their CIDs, and
+		// everything below relies on it
+		chk, err := blk.Cid().Prefix().Sum(blk.RawData())
+		if err != nil {
+			return nil, err
+		}
+		if !chk.Equals(blk.Cid()) {
+			return nil, fmt.Errorf("proof block %s does not match its CID", blk.Cid())
+		}
+
+		if err := bs.Put(ctx, blk); err != nil {
+			return nil, err
+		}
+	}
+
+	var sc SignedCommit
+	if err := util.CborStore(bs).Get(ctx, commit, &sc); err != nil {
+		return nil, fmt.Errorf("loading proof commit: %w", err)
+	}
+
+	if sc.Did != did {
+		return nil, fmt.Errorf("proof commit is for %q, not %q", sc.Did, did)
+	}
+
+	sb, err := sc.Unsigned().BytesForSigning()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := keyutil.Verify(key, sb, sc.Sig); err != nil {
+		return nil, fmt.Errorf("invalid commit signature: %w", err)
+	}
+
+	// walking to the key fails if any node on the path is missing
+	rcid, err := mst.LoadMST(util.CborStore(bs), sc.Data).Get(ctx, rpath)
+	if err != nil {
+		if errors.Is(err, mst.ErrNotFound) {
+			return &ProvenRecord{Commit: commit}, nil
+		}
+		return nil, fmt.Errorf("incomplete proof for %q: %w", rpath, err)
+	}
+
+	blk, err := bs.Get(ctx, rcid)
+	if err != nil {
+		return nil, fmt.Errorf("proof does not include record %s", rcid)
+	}
+
+	return &ProvenRecord{
+		Commit: commit,
+		Cid:    rcid,
+		Raw:    blk.RawData(),
+	}, nil
+}
@@ -222,6 +222,32 @@ func (r *Repo) PutRecord(ctx context.Context, rpath string, rec CborMarshaler) (
 	return k, nil
 }
 
+// UpdateRecord replaces the record at rpath, which must exist, unlike
+// PutRecord which only adds records
+func (r *Repo) UpdateRecord(ctx context.Context, rpath string, rec CborMarshaler) (cid.Cid, error) {
+	ctx, span := otel.Tracer("repo").Start(ctx, "UpdateRecord")
+	defer span.End()
+
+	r.dirty = true
+	t, err := r.getMst(ctx)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("failed to get mst: %w", err)
+	}
+
+	k, err := r.cst.Put(ctx, rec)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	nmst, err := t.Update(ctx, rpath, k)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("mst.Update failed: %w", err)
+	}
+
+	r.mst = nmst
+	return k, nil
+}
+
 func (r *Repo) DeleteRecord(ctx context.Context, rpath string) error {
 	ctx, span := otel.Tracer("repo").Start(ctx, "DeleteRecord")
 	defer span.End()
@@ -329,6 +355,16 @@ func (r *Repo) ForEach(ctx context.Context, prefix string, cb func(k string, v c
 	return nil
 }
 
+// GetRecordCid returns the cid of the record at rpath, without reading the
+// record, or mst.ErrNotFound if there is none
+func (r *Repo) GetRecordCid(ctx context.Context, rpath string) (cid.Cid, error) {
+	t, err := r.getMst(ctx)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("getting repo mst: %w", err)
+	}
+	return t.Get(ctx, rpath)
+}
+
 func (r *Repo) GetRecord(ctx context.Context, rpath string) (cid.Cid, cbg.CBORMarshaler, error) {
 	ctx, span := otel.Tracer("repo").Start(ctx, "GetRecord")
 	defer span.End()
@@ -356,6 +392,35 @@ func (r *Repo) GetRecord(ctx context.Context, rpath string) (cid.Cid, cbg.CBORMa
 	return cc, rec, nil
 }
 
+// GetRawRecord is like GetRecord, but keeps the record exactly as stored, and
+// works for records of any type
+func (r *Repo) GetRawRecord(ctx context.Context, rpath string) (cid.Cid, *lexutil.RawRecord, error) {
+	ctx, span := otel.Tracer("repo").Start(ctx, "GetRawRecord")
+	defer span.End()
+
+	mst, err := r.getMst(ctx)
+	if err != nil {
+		return cid.Undef, nil, fmt.Errorf("getting repo mst: %w", err)
+	}
+
+	cc, err := mst.Get(ctx, rpath)
+	if err != nil {
+		return cid.Undef, nil, fmt.Errorf("resolving rpath within mst: %w", err)
+	}
+
+	blk, err := r.bs.Get(ctx, cc)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+
+	rec, err := lexutil.NewRawRecord(blk.RawData())
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+
+	return cc, rec, nil
+}
+
 func (r *Repo) DiffSince(ctx context.Context, oldrepo cid.Cid) ([]*mst.DiffOp, error) {
 	ctx, span := otel.Tracer("repo").Start(ctx, "DiffSince")
 	defer span.End()
@@ -392,11 +457,64 @@ func (r *Repo) DiffSince(ctx context.Context, oldrepo cid.Cid) ([]*mst.DiffOp, e
 	return mst.DiffTrees(ctx, r.bs, oldTree, curptr)
 }
 
-func (r *Repo) CopyDataTo(ctx context.Context, bs blockstore.Blockstore) error {
+// CommitDiff is the record level difference between two commits
+type CommitDiff struct {
+	Ops []*mst.DiffOp
+
+	// Blocks are the CIDs of the blocks that, along with the blocks of the
+	// old commit, cover the new commit: the new commit itself, the tree nodes
+	// it does not share with the old commit, and any new record values.
+	// These are the blocks that a commit event needs to include for
+	// consumers to verify it.
+	Blocks []cid.Cid
+}
+
+// DiffCommits computes the difference between two commits in bs. from may be
+// cid.Undef, in which case the diff is against an empty repo.
+func DiffCommits(ctx context.Context, bs blockstore.Blockstore, from, to cid.Cid) (*CommitDiff, error) {
+	ctx, span := otel.Tracer("repo").Start(ctx, "DiffCommits")
+	defer span.End()
+
+	var oldTree cid.Cid
+	if from.Defined() {
+		old, err := OpenRepo(ctx, bs, from, false)
+		if err != nil {
+			return nil, err
+		}
+		oldTree = old.DataCid()
+	}
+
+	cur, err := OpenRepo(ctx, bs, to, false)
+	if err != nil {
+		return nil, err
+	}
+
+	td, err := mst.DiffTreesWithProof(ctx, bs, oldTree, cur.DataCid())
+	if err != nil {
+		return nil, err
+	}
+
+	out := &CommitDiff{
+		Ops:    td.Ops,
+		Blocks: append([]cid.Cid{to}, td.NewNodes...),
+	}
+
+	for _, op := range td.Ops {
+		if op.NewCid.Defined() {
+			out.Blocks = append(out.Blocks, op.NewCid)
+		}
+	}
+
+	return out, nil
+}
+
+// CopyDataTo writes the repo's tree and records to bs. Only the CIDs of copied
+// blocks are held in memory.
+func (r *Repo) CopyDataTo(ctx context.Context, bs BlockSink) error {
 	return copyRecCbor(ctx, r.bs, bs, r.sc.Data, make(map[cid.Cid]struct{}))
 }
 
-func copyRecCbor(ctx context.Context, from, to blockstore.Blockstore, c cid.Cid, seen map[cid.Cid]struct{}) error {
+func copyRecCbor(ctx context.Context, from blockstore.Blockstore, to BlockSink, c cid.Cid, seen map[cid.Cid]struct{}) error {
 	if _, ok := seen[c]; ok {
 		return nil
 	}
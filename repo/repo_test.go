@@ -1,12 +1,21 @@
 package repo
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
 	"fmt"
 	"os"
 	"testing"
 
+	bsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/util/keyutil"
 	cid "github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	car "github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	godid "github.com/whyrusleeping/go-did"
 )
 
 func TestRepo(t *testing.T) {
@@ -30,3 +39,170 @@ func TestRepo(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestDiffCommits(t *testing.T) {
+	ctx := context.TODO()
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	signer := func(context.Context, string, []byte) ([]byte, error) {
+		return []byte("sig"), nil
+	}
+
+	r := NewRepo(ctx, "did:plc:test", bs)
+	var rpaths []string
+	for i := 0; i < 50; i++ {
+		rpath := fmt.Sprintf("app.bsky.feed.post/%04d", i)
+		if _, err := r.PutRecord(ctx, rpath, &bsky.FeedPost{Text: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+		rpaths = append(rpaths, rpath)
+	}
+
+	first, err := r.Commit(ctx, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.DeleteRecord(ctx, rpaths[3]); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.DeleteRecord(ctx, rpaths[7]); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := r.PutRecord(ctx, rpaths[7], &bsky.FeedPost{Text: "edited"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, err := r.PutRecord(ctx, "app.bsky.feed.post/9999", &bsky.FeedPost{Text: "new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := r.Commit(ctx, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := DiffCommits(ctx, bs, first, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ops := map[string]int{}
+	for _, op := range diff.Ops {
+		ops[op.Op]++
+	}
+	if len(diff.Ops) != 3 || ops["add"] != 1 || ops["mut"] != 1 || ops["del"] != 1 {
+		t.Fatalf("unexpected diff ops: %v", ops)
+	}
+
+	blocks := map[cid.Cid]bool{}
+	for _, c := range diff.Blocks {
+		blocks[c] = true
+	}
+	if !blocks[second] || !blocks[updated] || !blocks[created] || !blocks[r.DataCid()] {
+		t.Fatal("expected commit, new root and new records in diff blocks")
+	}
+
+	full, err := DiffCommits(ctx, bs, cid.Undef, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(full.Ops) != len(rpaths) {
+		t.Fatalf("expected every record to be created, got %d ops", len(full.Ops))
+	}
+}
+
+func TestRecordProof(t *testing.T) {
+	ctx := context.TODO()
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+
+	key, err := godid.GeneratePrivKey(rand.Reader, godid.KeyTypeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := func(ctx context.Context, did string, b []byte) ([]byte, error) {
+		return keyutil.Sign(key, b)
+	}
+
+	r := NewRepo(ctx, "did:plc:test", bs)
+	for i := 0; i < 200; i++ {
+		if _, err := r.PutRecord(ctx, fmt.Sprintf("app.bsky.feed.post/%04d", i), &bsky.FeedPost{Text: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	commit, err := r.Commit(ctx, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proof := func(rpath string) []byte {
+		buf := new(bytes.Buffer)
+		if err := WriteRecordProof(ctx, bs, commit, rpath, buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	exists := proof("app.bsky.feed.post/0042")
+	pr, err := VerifyRecordProof(ctx, bytes.NewReader(exists), "did:plc:test", key.Public(), "app.bsky.feed.post/0042")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pr.Commit != commit || !pr.Cid.Defined() {
+		t.Fatal("expected proof of existing record")
+	}
+
+	var post bsky.FeedPost
+	if err := post.UnmarshalCBOR(bytes.NewReader(pr.Raw)); err != nil {
+		t.Fatal(err)
+	}
+	if post.Text != "42" {
+		t.Fatalf("wrong record contents: %q", post.Text)
+	}
+
+	missing := proof("app.bsky.feed.post/9999")
+	pr, err = VerifyRecordProof(ctx, bytes.NewReader(missing), "did:plc:test", key.Public(), "app.bsky.feed.post/9999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pr.Cid.Defined() {
+		t.Fatal("expected proof of absence")
+	}
+
+	// a proof for one key can not be used to claim another key is absent
+	if _, err := VerifyRecordProof(ctx, bytes.NewReader(missing), "did:plc:test", key.Public(), "app.bsky.feed.post/0042"); err == nil {
+		t.Fatal("expected proof to be incomplete for a different key")
+	}
+
+	other, err := godid.GeneratePrivKey(rand.Reader, godid.KeyTypeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyRecordProof(ctx, bytes.NewReader(exists), "did:plc:test", other.Public(), "app.bsky.feed.post/0042"); err == nil {
+		t.Fatal("expected proof signed by another key to be rejected")
+	}
+
+	// swap the record block for a different one under the same CID
+	blks, err := RecordProofBlocks(ctx, bs, commit, "app.bsky.feed.post/0042")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{commit}, Version: 1}, buf); err != nil {
+		t.Fatal(err)
+	}
+	for i, blk := range blks {
+		data := blk.RawData()
+		if i == len(blks)-1 {
+			data = append([]byte{}, data...)
+			data[len(data)-1] ^= 1
+		}
+		if err := carutil.LdWrite(buf, blk.Cid().Bytes(), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := VerifyRecordProof(ctx, buf, "did:plc:test", key.Public(), "app.bsky.feed.post/0042"); err == nil {
+		t.Fatal("expected tampered record to be rejected")
+	}
+}
@@ -1,41 +1,13 @@
 package repo
 
 import (
-	"math/rand"
-	"sync"
-	"time"
+	"github.com/bluesky-social/indigo/util/syntax"
 )
 
-const alpha = "234567abcdefghijklmnopqrstuvwxyz"
-
-func s32encode(i uint64) string {
-	var s string
-	for i > 0 {
-		c := i & 0x1f
-		i = i >> 5
-		s = alpha[c:c+1] + s
-	}
-	return s
-}
-
-func init() {
-	clockId = uint64(rand.Int() & 0x1f)
-}
-
-var lastTime uint64
-var clockId uint64
-var ltLock sync.Mutex
+var tidClock = syntax.NewRandomTIDClock()
 
+// NextTID returns a TID for the current time, greater than any returned
+// before by this process
 func NextTID() string {
-	t := uint64(time.Now().UnixMicro())
-
-	ltLock.Lock()
-	if lastTime == t {
-		t++
-	}
-
-	lastTime = t
-	ltLock.Unlock()
-
-	return s32encode(uint64(t)) + s32encode(clockId)
+	return tidClock.Next().String()
 }
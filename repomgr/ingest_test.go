@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	atproto "github.com/bluesky-social/indigo/api/atproto"
@@ -208,19 +209,50 @@ func TestRebase(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	var rkeys []string
 	for i := 0; i < 5; i++ {
-		_, _, err := repoman.CreateRecord(ctx, 1, "app.bsky.feed.post", &bsky.FeedPost{
+		rpath, _, err := repoman.CreateRecord(ctx, 1, "app.bsky.feed.post", &bsky.FeedPost{
 			Text: fmt.Sprintf("hello friend %d", i),
 		})
 		if err != nil {
 			t.Fatal(err)
 		}
+		rkeys = append(rkeys, strings.TrimPrefix(rpath, "app.bsky.feed.post/"))
 	}
 
+	var evts []*RepoEvent
+	repoman.SetEventHandler(func(ctx context.Context, evt *RepoEvent) {
+		evts = append(evts, evt)
+	})
+
 	if err := repoman.DoRebase(ctx, 1); err != nil {
 		t.Fatal(err)
 	}
 
+	if len(evts) != 1 || !evts[0].Rebase {
+		t.Fatalf("expected a single rebase event, got %v", evts)
+	}
+
+	// the history should be gone, leaving a single shard holding the commit
+	// and current records
+	stats, err := cs.Stat(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].Root != evts[0].NewRoot.String() {
+		t.Fatalf("expected only the rebased shard to remain, got %v", stats)
+	}
+
+	for i, rkey := range rkeys {
+		_, rec, err := repoman.GetRecord(ctx, 1, "app.bsky.feed.post", rkey, cid.Undef)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if txt := rec.(*bsky.FeedPost).Text; txt != fmt.Sprintf("hello friend %d", i) {
+			t.Fatalf("wrong record after rebase: %q", txt)
+		}
+	}
+
 	_, _, err = repoman.CreateRecord(ctx, 1, "app.bsky.feed.post", &bsky.FeedPost{
 		Text: "after the rebase",
 	})
@@ -228,3 +260,80 @@ func TestRebase(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestImportRepoStream(t *testing.T) {
+	dir, err := os.MkdirTemp("", "integtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	did := "did:plc:beepboop"
+	cs := testCarstore(t, dir)
+	repoman := NewRepoManager(cs, &util.FakeKeyManager{})
+
+	var evts []*RepoEvent
+	repoman.SetEventHandler(func(ctx context.Context, evt *RepoEvent) {
+		evts = append(evts, evt)
+	})
+
+	dir2, err := os.MkdirTemp("", "integtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs2 := testCarstore(t, dir2)
+
+	ctx := context.TODO()
+	var prev *cid.Cid
+	var tid string
+	for i := 0; i < 5; i++ {
+		var head cid.Cid
+		_, head, tid = doPost(t, cs2, did, prev, i)
+		prev = &head
+	}
+
+	buf := new(bytes.Buffer)
+	if err := cs2.ReadUserCar(ctx, 1, cid.Undef, *prev, true, buf); err != nil {
+		t.Fatal(err)
+	}
+	full := buf.Bytes()
+
+	if err := repoman.ImportRepoStream(ctx, 1, "did:plc:other", bytes.NewReader(full)); err == nil {
+		t.Fatal("expected import for the wrong did to fail")
+	}
+
+	if err := repoman.ImportRepoStream(ctx, 1, did, bytes.NewReader(full[:len(full)-10])); err == nil {
+		t.Fatal("expected truncated import to fail")
+	}
+
+	head, err := repoman.GetRepoRoot(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Defined() {
+		t.Fatal("failed imports should not have set a head")
+	}
+
+	if err := repoman.ImportRepoStream(ctx, 1, did, bytes.NewReader(full)); err != nil {
+		t.Fatal(err)
+	}
+
+	head, err = repoman.GetRepoRoot(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head != *prev {
+		t.Fatalf("expected head to be %s, got %s", *prev, head)
+	}
+
+	_, rec, err := repoman.GetRecord(ctx, 1, "app.bsky.feed.post", tid, cid.Undef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.(*bsky.FeedPost).Text != "hello friend 4" {
+		t.Fatal("imported record has the wrong contents")
+	}
+
+	if len(evts) != 1 || !evts[0].TooBig || evts[0].NewRoot != head {
+		t.Fatal("expected a single too big event for the import")
+	}
+}
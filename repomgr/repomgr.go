@@ -49,6 +49,13 @@ func (rm *RepoManager) SetEventHandler(cb func(context.Context, *RepoEvent)) {
 	rm.events = cb
 }
 
+// SetTIDSource has the record keys of records created without one generated
+// by ts, rather than by a clock which only keeps them increasing while the
+// process is running
+func (rm *RepoManager) SetTIDSource(ts *TIDSource) {
+	rm.tids = ts
+}
+
 type RepoManager struct {
 	cs   *carstore.CarStore
 	kmgr KeyManager
@@ -57,6 +64,9 @@ type RepoManager struct {
 	userLocks map[models.Uid]*userLock
 
 	events func(context.Context, *RepoEvent)
+
+	// tids generates record keys, or repo.NextTID if unset
+	tids *TIDSource
 }
 
 type ActorInfo struct {
@@ -74,6 +84,10 @@ type RepoEvent struct {
 	PDS       uint
 	Ops       []RepoOp
 	Rebase    bool
+
+	// TooBig is set when the change is too large to describe in the event,
+	// such as a streamed import, and consumers must fetch the repo instead
+	TooBig bool
 }
 
 type RepoOp struct {
@@ -161,7 +175,12 @@ func (rm *RepoManager) CreateRecord(ctx context.Context, user models.Uid, collec
 		return "", cid.Undef, err
 	}
 
-	cc, tid, err := r.CreateRecord(ctx, collection, rec)
+	tid, err := rm.nextRkey(ctx)
+	if err != nil {
+		return "", cid.Undef, err
+	}
+
+	cc, err := r.PutRecord(ctx, collection+"/"+tid, rec)
 	if err != nil {
 		return "", cid.Undef, err
 	}
@@ -345,7 +364,7 @@ func (rm *RepoManager) InitNewActor(ctx context.Context, user models.Uid, handle
 		DisplayName: &displayname,
 	}
 
-	_, err = r.PutRecord(ctx, "app.bsky.actor.profile/self", profile)
+	pcid, err := r.PutRecord(ctx, "app.bsky.actor.profile/self", profile)
 	if err != nil {
 		return fmt.Errorf("setting initial actor profile: %w", err)
 	}
@@ -369,6 +388,7 @@ func (rm *RepoManager) InitNewActor(ctx context.Context, user models.Uid, handle
 				Collection: "app.bsky.actor.profile",
 				Rkey:       "self",
 				Record:     profile,
+				RecCid:     &pcid,
 			}},
 			RepoSlice: rslice,
 		})
@@ -416,6 +436,119 @@ func (rm *RepoManager) GetRecord(ctx context.Context, user models.Uid, collectio
 	return ocid, val, nil
 }
 
+// GetRawRecord is like GetRecord, but keeps the record exactly as stored, and
+// works for records of any type
+func (rm *RepoManager) GetRawRecord(ctx context.Context, user models.Uid, collection string, rkey string, maybeCid cid.Cid) (cid.Cid, *lexutil.RawRecord, error) {
+	bs, err := rm.cs.ReadOnlySession(user)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+
+	head, err := rm.cs.GetUserRepoHead(ctx, user)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+
+	r, err := repo.OpenRepo(ctx, bs, head, true)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+
+	ocid, val, err := r.GetRawRecord(ctx, collection+"/"+rkey)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+
+	if maybeCid.Defined() && ocid != maybeCid {
+		return cid.Undef, nil, fmt.Errorf("record at specified key had different CID than expected")
+	}
+
+	return ocid, val, nil
+}
+
+// ReadRecordProof writes a CAR proving the value (or absence) of a record in
+// the users repo at the given commit. If commit is undefined, the current head
+// is used.
+func (rm *RepoManager) ReadRecordProof(ctx context.Context, user models.Uid, commit cid.Cid, collection string, rkey string, w io.Writer) error {
+	ctx, span := otel.Tracer("repoman").Start(ctx, "ReadRecordProof")
+	defer span.End()
+
+	bs, err := rm.cs.ReadOnlySession(user)
+	if err != nil {
+		return err
+	}
+
+	if !commit.Defined() {
+		head, err := rm.cs.GetUserRepoHead(ctx, user)
+		if err != nil {
+			return err
+		}
+		commit = head
+	}
+
+	return repo.WriteRecordProof(ctx, bs, commit, collection+"/"+rkey, w)
+}
+
+type RecordBlobRef struct {
+	Rpath string
+	Blob  cid.Cid
+}
+
+// ListRecordBlobs walks every record in the given users repo and returns each
+// blob referenced by a record, along with the path of the referencing record.
+// Records are decoded generically so that blobs are found regardless of the
+// record schema, and only blob objects count, not other links (such as those
+// of strong refs).
+func (rm *RepoManager) ListRecordBlobs(ctx context.Context, user models.Uid) ([]RecordBlobRef, error) {
+	ctx, span := otel.Tracer("repoman").Start(ctx, "ListRecordBlobs")
+	defer span.End()
+
+	bs, err := rm.cs.ReadOnlySession(user)
+	if err != nil {
+		return nil, err
+	}
+
+	head, err := rm.cs.GetUserRepoHead(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	if !head.Defined() {
+		return nil, nil
+	}
+
+	r, err := repo.OpenRepo(ctx, bs, head, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []RecordBlobRef
+	if err := r.ForEach(ctx, "", func(k string, v cid.Cid) error {
+		blk, err := bs.Get(ctx, v)
+		if err != nil {
+			return fmt.Errorf("getting record %q: %w", k, err)
+		}
+
+		cids, err := lexutil.CborBlobRefs(blk.RawData())
+		if err != nil {
+			return fmt.Errorf("decoding record %q: %w", k, err)
+		}
+
+		for _, c := range cids {
+			out = append(out, RecordBlobRef{
+				Rpath: k,
+				Blob:  c,
+			})
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
 func (rm *RepoManager) GetProfile(ctx context.Context, uid models.Uid) (*bsky.ActorProfile, error) {
 	bs, err := rm.cs.ReadOnlySession(uid)
 	if err != nil {
@@ -549,16 +682,35 @@ func (rm *RepoManager) DoRebase(ctx context.Context, uid models.Uid) error {
 
 	r.Truncate()
 
+	// the new commit is the only block that ends up in the delta session, the
+	// rest of the repo is streamed straight from the old shards into the new
+	// one, so repos with enormous histories don't need to fit in memory
 	nroot, err := r.Commit(ctx, rm.kmgr.SignForUser)
 	if err != nil {
 		return err
 	}
 
-	if err := r.CopyDataTo(ctx, ds); err != nil {
+	robj, err := ds.Get(ctx, nroot)
+	if err != nil {
+		return err
+	}
+
+	sw, err := rm.cs.NewShardWriter(ctx, uid, &head, nroot)
+	if err != nil {
+		return err
+	}
+
+	if err := sw.Put(ctx, robj); err != nil {
+		sw.Abort()
+		return err
+	}
+
+	if err := r.CopyDataTo(ctx, sw); err != nil {
+		sw.Abort()
 		return err
 	}
 
-	if err := ds.CloseAsRebase(ctx, nroot); err != nil {
+	if err := sw.CloseAsRebase(ctx); err != nil {
 		return fmt.Errorf("finalizing rebase: %w", err)
 	}
 
@@ -568,10 +720,6 @@ func (rm *RepoManager) DoRebase(ctx context.Context, uid models.Uid) error {
 		return err
 	}
 
-	robj, err := ds.Get(ctx, nroot)
-	if err != nil {
-		return err
-	}
 	_, err = carstore.LdWrite(buf, robj.Cid().Bytes(), robj.RawData())
 	if err != nil {
 		return err
@@ -619,6 +767,21 @@ func (rm *RepoManager) HandleExternalUserEvent(ctx context.Context, pdsid uint,
 	ctx, span := otel.Tracer("repoman").Start(ctx, "HandleExternalUserEvent")
 	defer span.End()
 
+	return rm.handleExternalUserEvent(ctx, pdsid, uid, did, prev, carslice, ops, true)
+}
+
+// HandleVerifiedExternalUserEvent is HandleExternalUserEvent for commits which
+// VerifyExternalCommit has passed, at VerifyLight or above, whose signature
+// isn't checked again
+func (rm *RepoManager) HandleVerifiedExternalUserEvent(ctx context.Context, pdsid uint, uid models.Uid, did string, prev *cid.Cid, carslice []byte, ops []*atproto.SyncSubscribeRepos_RepoOp) error {
+	ctx, span := otel.Tracer("repoman").Start(ctx, "HandleVerifiedExternalUserEvent")
+	defer span.End()
+
+	return rm.handleExternalUserEvent(ctx, pdsid, uid, did, prev, carslice, ops, false)
+}
+
+func (rm *RepoManager) handleExternalUserEvent(ctx context.Context, pdsid uint, uid models.Uid, did string, prev *cid.Cid, carslice []byte, ops []*atproto.SyncSubscribeRepos_RepoOp, checkSig bool) error {
+
 	log.Infow("HandleExternalUserEvent", "pds", pdsid, "uid", uid, "prev", prev)
 
 	unlock := rm.lockUser(ctx, uid)
@@ -634,8 +797,10 @@ func (rm *RepoManager) HandleExternalUserEvent(ctx context.Context, pdsid uint,
 		return fmt.Errorf("opening external user repo (%d, root=%s): %w", uid, root, err)
 	}
 
-	if err := rm.CheckRepoSig(ctx, r, did); err != nil {
-		return err
+	if checkSig {
+		if err := rm.CheckRepoSig(ctx, r, did); err != nil {
+			return err
+		}
 	}
 
 	var evtops []RepoOp
@@ -703,115 +868,28 @@ func (rm *RepoManager) HandleExternalUserEvent(ctx context.Context, pdsid uint,
 	return nil
 }
 
-func rkeyForCollection(collection string) string {
-	return repo.NextTID()
-}
-
-func (rm *RepoManager) BatchWrite(ctx context.Context, user models.Uid, writes []*atproto.RepoApplyWrites_Input_Writes_Elem) error {
-	ctx, span := otel.Tracer("repoman").Start(ctx, "BatchWrite")
-	defer span.End()
-
-	unlock := rm.lockUser(ctx, user)
-	defer unlock()
-
-	head, err := rm.cs.GetUserRepoHead(ctx, user)
-	if err != nil {
-		return err
+// nextRkey returns the record key for a record created without one, a TID
+func (rm *RepoManager) nextRkey(ctx context.Context) (string, error) {
+	if rm.tids == nil {
+		return repo.NextTID(), nil
 	}
-
-	ds, err := rm.cs.NewDeltaSession(ctx, user, &head)
-	if err != nil {
-		return err
-	}
-
-	r, err := repo.OpenRepo(ctx, ds, head, true)
+	tid, err := rm.tids.Next(ctx)
 	if err != nil {
-		return err
-	}
-
-	var ops []RepoOp
-	for _, w := range writes {
-		switch {
-		case w.RepoApplyWrites_Create != nil:
-			c := w.RepoApplyWrites_Create
-			var rkey string
-			if c.Rkey != nil {
-				rkey = *c.Rkey
-			} else {
-				rkey = rkeyForCollection(c.Collection)
-			}
-
-			nsid := c.Collection + "/" + rkey
-			cc, err := r.PutRecord(ctx, nsid, c.Value.Val)
-			if err != nil {
-				return err
-			}
-
-			ops = append(ops, RepoOp{
-				Kind:       EvtKindCreateRecord,
-				Collection: c.Collection,
-				Rkey:       rkey,
-				RecCid:     &cc,
-				Record:     c.Value.Val,
-			})
-		case w.RepoApplyWrites_Update != nil:
-			u := w.RepoApplyWrites_Update
-
-			cc, err := r.PutRecord(ctx, u.Collection+"/"+u.Rkey, u.Value.Val)
-			if err != nil {
-				return err
-			}
-
-			ops = append(ops, RepoOp{
-				Kind:       EvtKindUpdateRecord,
-				Collection: u.Collection,
-				Rkey:       u.Rkey,
-				RecCid:     &cc,
-				Record:     u.Value.Val,
-			})
-		case w.RepoApplyWrites_Delete != nil:
-			d := w.RepoApplyWrites_Delete
-
-			if err := r.DeleteRecord(ctx, d.Collection+"/"+d.Rkey); err != nil {
-				return err
-			}
-
-			ops = append(ops, RepoOp{
-				Kind:       EvtKindDeleteRecord,
-				Collection: d.Collection,
-				Rkey:       d.Rkey,
-			})
-		default:
-			return fmt.Errorf("no operation set in write enum")
-		}
+		return "", err
 	}
+	return tid.String(), nil
+}
 
-	nroot, err := r.Commit(ctx, rm.kmgr.SignForUser)
+// BatchWrite applies the writes of a com.atproto.repo.applyWrites call, as
+// ApplyWrites does
+func (rm *RepoManager) BatchWrite(ctx context.Context, user models.Uid, writes []*atproto.RepoApplyWrites_Input_Writes_Elem) error {
+	ws, err := WritesFromApplyWrites(writes)
 	if err != nil {
 		return err
 	}
 
-	rslice, err := ds.CloseWithRoot(ctx, nroot)
-	if err != nil {
-		return fmt.Errorf("close with root: %w", err)
-	}
-
-	var oldroot *cid.Cid
-	if head.Defined() {
-		oldroot = &head
-	}
-
-	if rm.events != nil {
-		rm.events(ctx, &RepoEvent{
-			User:      user,
-			OldRoot:   oldroot,
-			NewRoot:   nroot,
-			RepoSlice: rslice,
-			Ops:       ops,
-		})
-	}
-
-	return nil
+	_, _, err = rm.ApplyWrites(ctx, user, ws, nil)
+	return err
 }
 
 func (rm *RepoManager) ImportNewRepo(ctx context.Context, user models.Uid, repoDid string, r io.Reader, oldest cid.Cid) error {
@@ -838,6 +916,9 @@ func (rm *RepoManager) ImportNewRepo(ctx context.Context, user models.Uid, repoD
 		}
 
 		scom := r.SignedCommit()
+		if scom.Did != repoDid {
+			return fmt.Errorf("imported repo commit was for %q, expected %q", scom.Did, repoDid)
+		}
 
 		usc := scom.Unsigned()
 		sb, err := usc.BytesForSigning()
@@ -944,6 +1025,51 @@ func processOp(ctx context.Context, bs blockstore.Blockstore, op *mst.DiffOp) (*
 	}
 }
 
+// ImportRepoStream imports a full repo CAR for a user that does not yet have
+// a repo, without holding it in memory. The CAR is validated as it is written
+// straight into a new shard, and nothing is stored unless the whole import
+// succeeds. As the import may be arbitrarily large, the resulting event
+// carries no blocks or ops.
+func (rm *RepoManager) ImportRepoStream(ctx context.Context, user models.Uid, repoDid string, r io.Reader) error {
+	ctx, span := otel.Tracer("repoman").Start(ctx, "ImportRepoStream")
+	defer span.End()
+
+	unlock := rm.lockUser(ctx, user)
+	defer unlock()
+
+	imp, err := repo.NewImporter(r)
+	if err != nil {
+		return err
+	}
+
+	sw, err := rm.cs.NewShardWriter(ctx, user, nil, imp.Root())
+	if err != nil {
+		return err
+	}
+
+	res, err := imp.Run(ctx, sw, repoDid, rm.kmgr.VerifyUserSignature)
+	if err != nil {
+		sw.Abort()
+		return fmt.Errorf("importing repo: %w", err)
+	}
+
+	if err := sw.Close(ctx); err != nil {
+		return fmt.Errorf("writing imported repo: %w", err)
+	}
+
+	log.Infow("imported repo", "did", repoDid, "records", res.Records, "blocks", res.Blocks, "unreferenced", res.Unreferenced)
+
+	if rm.events != nil {
+		rm.events(ctx, &RepoEvent{
+			User:    user,
+			NewRoot: imp.Root(),
+			TooBig:  true,
+		})
+	}
+
+	return nil
+}
+
 func (rm *RepoManager) processNewRepo(ctx context.Context, user models.Uid, r io.Reader, until cid.Cid, cb func(ctx context.Context, old, nu cid.Cid, finish func(context.Context) ([]byte, error), bs blockstore.Blockstore) error) error {
 	ctx, span := otel.Tracer("repoman").Start(ctx, "processNewRepo")
 	defer span.End()
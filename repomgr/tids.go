@@ -0,0 +1,71 @@
+package repomgr
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/util/syntax"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// tidMarkLease is how far ahead of the TIDs it has generated a TIDSource
+// persists its high-water mark, so that it only writes it once in a while
+const tidMarkLease = 10 * time.Second
+
+// TIDSource generates the record keys of records created without one. Its
+// TIDs are strictly increasing, even across restarts and when the system
+// clock steps backwards: it persists a high-water mark ahead of the TIDs it
+// generates, and carries on from the mark after a restart. Two generators
+// must never run with the same clock ID against the same repos, as their TIDs
+// could collide.
+type TIDSource struct {
+	db      *gorm.DB
+	clockID uint
+	clock   *syntax.TIDClock
+
+	lk   sync.Mutex
+	mark int64
+}
+
+// NewTIDSource returns a TID source with the high-water mark for clockID kept
+// in db
+func NewTIDSource(ctx context.Context, db *gorm.DB, clockID uint) (*TIDSource, error) {
+	if err := db.AutoMigrate(&models.TIDClockMark{}); err != nil {
+		return nil, err
+	}
+
+	var m models.TIDClockMark
+	if err := db.WithContext(ctx).Where("clock_id = ?", clockID).Limit(1).Find(&m).Error; err != nil {
+		return nil, fmt.Errorf("loading TID clock mark: %w", err)
+	}
+
+	return &TIDSource{
+		db:      db,
+		clockID: clockID,
+		clock:   syntax.NewTIDClockAfter(clockID, m.Mark),
+		mark:    m.Mark,
+	}, nil
+}
+
+// Next returns the next TID. It only fails if TIDs have caught up with the
+// high-water mark, and the new mark can't be persisted.
+func (ts *TIDSource) Next(ctx context.Context) (syntax.TID, error) {
+	ts.lk.Lock()
+	defer ts.lk.Unlock()
+
+	tid := ts.clock.Next()
+	if t := tid.Time().UnixMicro(); t >= ts.mark {
+		mark := t + tidMarkLease.Microseconds()
+		row := models.TIDClockMark{ClockID: ts.clockID, Mark: mark}
+		if err := ts.db.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(&row).Error; err != nil {
+			return "", fmt.Errorf("persisting TID clock mark: %w", err)
+		}
+		ts.mark = mark
+	}
+	return tid, nil
+}
@@ -0,0 +1,126 @@
+package repomgr
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/util/syntax"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestTIDSource(t *testing.T) {
+	ctx := context.TODO()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "tids.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts, err := NewTIDSource(ctx, db, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var last syntax.TID
+	for i := 0; i < 1000; i++ {
+		tid, err := ts.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tid <= last {
+			t.Fatalf("TID %s not after %s", tid, last)
+		}
+		if tid.ClockID() != 3 {
+			t.Fatalf("TID %s has clock ID %d", tid, tid.ClockID())
+		}
+		last = tid
+	}
+
+	var m models.TIDClockMark
+	if err := db.First(&m, "clock_id = ?", 3).Error; err != nil {
+		t.Fatal(err)
+	}
+	if m.Mark <= last.Time().UnixMicro() {
+		t.Fatalf("mark %d isn't ahead of the last TID %s", m.Mark, last)
+	}
+
+	// a restarted source carries on from the mark, whatever the clock says
+	ts, err = NewTIDSource(ctx, db, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tid, err := ts.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tid.Time().UnixMicro() <= m.Mark {
+		t.Fatalf("TID %s after restart isn't after the mark %d", tid, m.Mark)
+	}
+
+	// other clock IDs have marks of their own
+	other, err := NewTIDSource(ctx, db, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.mark != 0 {
+		t.Fatalf("new clock ID has mark %d", other.mark)
+	}
+}
+
+func TestTIDSourceRecordKeys(t *testing.T) {
+	ctx := context.TODO()
+	dir := t.TempDir()
+	repoman := NewRepoManager(testCarstore(t, dir), &util.FakeKeyManager{})
+	if err := repoman.InitNewActor(ctx, 1, "hello.world", "did:plc:foobar", "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(dir, "tids.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a mark left in the future, as by a clock which was stepped back after
+	// it was written
+	ahead := time.Now().Add(time.Hour).UnixMicro()
+	if err := db.AutoMigrate(&models.TIDClockMark{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&models.TIDClockMark{ClockID: 0, Mark: ahead}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	ts, err := NewTIDSource(ctx, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repoman.SetTIDSource(ts)
+
+	rpath, _, err := repoman.CreateRecord(ctx, 1, "app.bsky.feed.post", &bsky.FeedPost{Text: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, res, err := repoman.ApplyWrites(ctx, 1, []Write{
+		{Kind: EvtKindCreateRecord, Collection: "app.bsky.feed.post", Record: &bsky.FeedPost{Text: "again"}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := syntax.ParseTID(rpath[len("app.bsky.feed.post/"):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Time().UnixMicro() <= ahead {
+		t.Fatalf("record key %s isn't after the mark", first)
+	}
+	if syntax.TID(res[0].Rkey) <= first {
+		t.Fatalf("record key %s isn't after %s", res[0].Rkey, first)
+	}
+}
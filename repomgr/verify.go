@@ -0,0 +1,290 @@
+package repomgr
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	atproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/mst"
+	"github.com/bluesky-social/indigo/repo"
+
+	blockformat "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipld/go-car"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// VerifyLevel is how thoroughly commits from other hosts are checked before
+// they are stored
+type VerifyLevel int
+
+const (
+	// VerifyNone leaves commits to the signature check made as they are
+	// imported
+	VerifyNone VerifyLevel = iota
+
+	// VerifyLight checks that the slice of a commit holds a commit on the
+	// given prev, signed with the repo's key, and the records of the ops
+	// creating or updating them, with the cids given by the ops
+	VerifyLight
+
+	// VerifyFull also checks that the ops of a commit are exactly the
+	// difference between the previous tree and the new one, and that the
+	// slice has the tree nodes needed to tell. This reads the previous tree
+	// from the carstore.
+	VerifyFull
+)
+
+func ParseVerifyLevel(s string) (VerifyLevel, error) {
+	switch s {
+	case "none":
+		return VerifyNone, nil
+	case "light":
+		return VerifyLight, nil
+	case "full":
+		return VerifyFull, nil
+	default:
+		return VerifyNone, fmt.Errorf("unknown verification level %q (expected none, light or full)", s)
+	}
+}
+
+func (l VerifyLevel) String() string {
+	switch l {
+	case VerifyNone:
+		return "none"
+	case VerifyLight:
+		return "light"
+	case VerifyFull:
+		return "full"
+	default:
+		return fmt.Sprintf("VerifyLevel(%d)", int(l))
+	}
+}
+
+// ErrInvalidCommit is returned, wrapped, by VerifyExternalCommit for commits
+// which fail verification
+var ErrInvalidCommit = errors.New("invalid commit")
+
+// VerifyExternalCommit checks the car slice and ops of a commit from another
+// host, as HandleExternalUserEvent would be given them, at the given level.
+// Nothing is stored. Commits which don't build on the repo's current head
+// can't be checked against the previous tree, and are left for the import to
+// fail with carstore.ErrRepoBaseMismatch.
+func (rm *RepoManager) VerifyExternalCommit(ctx context.Context, uid models.Uid, did string, prev *cid.Cid, carslice []byte, ops []*atproto.SyncSubscribeRepos_RepoOp, level VerifyLevel) error {
+	if level == VerifyNone {
+		return nil
+	}
+
+	ctx, span := otel.Tracer("repoman").Start(ctx, "VerifyExternalCommit")
+	defer span.End()
+	span.SetAttributes(attribute.String("level", level.String()))
+
+	invalid := func(format string, args ...any) error {
+		return fmt.Errorf("%w: %s", ErrInvalidCommit, fmt.Sprintf(format, args...))
+	}
+
+	carr, err := car.NewCarReader(bytes.NewReader(carslice))
+	if err != nil {
+		return invalid("reading car slice: %s", err)
+	}
+	if len(carr.Header.Roots) != 1 {
+		return invalid("car slice must have a single root (has %d)", len(carr.Header.Roots))
+	}
+	root := carr.Header.Roots[0]
+
+	slice := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	for {
+		blk, err := carr.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return invalid("reading car slice: %s", err)
+		}
+
+		if err := slice.Put(ctx, blk); err != nil {
+			return err
+		}
+	}
+
+	r, err := repo.OpenRepo(ctx, slice, root, true)
+	if err != nil {
+		return invalid("reading commit: %s", err)
+	}
+
+	sc := r.SignedCommit()
+	if !cidPtrEqual(sc.Prev, prev) {
+		return invalid("commit is on %s, not %s", cidPtrString(sc.Prev), cidPtrString(prev))
+	}
+
+	if err := rm.CheckRepoSig(ctx, r, did); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidCommit, err)
+	}
+
+	// the record cids of the ops, as found in the new tree
+	want := make(map[string]*atproto.SyncSubscribeRepos_RepoOp, len(ops))
+	recs := make(map[string]cid.Cid, len(ops))
+	for _, op := range ops {
+		if len(strings.SplitN(op.Path, "/", 2)) != 2 {
+			return invalid("invalid op path %q, must have collection and rkey", op.Path)
+		}
+
+		switch EventKind(op.Action) {
+		case EvtKindCreateRecord, EvtKindUpdateRecord:
+			// the import reads records by path, so the slice must have the
+			// path to each one as well as the record itself
+			rc, _, err := r.GetRawRecord(ctx, op.Path)
+			if err != nil {
+				return invalid("reading record of %s %s from car slice: %s", op.Action, op.Path, err)
+			}
+			if op.Cid != nil && cid.Cid(*op.Cid) != rc {
+				return invalid("op on %s has record %s, but the commit has %s", op.Path, cid.Cid(*op.Cid), rc)
+			}
+			recs[op.Path] = rc
+		case EvtKindDeleteRecord:
+		default:
+			return invalid("unrecognized op action %q", op.Action)
+		}
+
+		want[op.Path] = op
+	}
+
+	if level < VerifyFull {
+		return nil
+	}
+
+	head, err := rm.cs.GetUserRepoHead(ctx, uid)
+	if err != nil {
+		return fmt.Errorf("looking up repo head: %w", err)
+	}
+	expected := cid.Undef
+	if prev != nil {
+		expected = *prev
+	}
+	if head != expected {
+		span.SetAttributes(attribute.Bool("base_mismatch", true))
+		return nil
+	}
+
+	base, err := rm.cs.ReadOnlySession(uid)
+	if err != nil {
+		return err
+	}
+
+	var prevData cid.Cid
+	if prev != nil {
+		pr, err := repo.OpenRepo(ctx, base, *prev, true)
+		if err != nil {
+			return fmt.Errorf("opening previous commit: %w", err)
+		}
+		prevData = pr.DataCid()
+	}
+
+	// tree nodes missing from the slice aren't in the carstore either, so
+	// an incomplete slice fails the diff
+	diff, err := mst.DiffTrees(ctx, &layeredBlockstore{top: slice, base: base}, prevData, r.DataCid())
+	if err != nil {
+		return invalid("diffing trees: %s", err)
+	}
+
+	for _, d := range diff {
+		op, ok := want[d.Rpath]
+		if !ok {
+			return invalid("change to %s is missing from the ops", d.Rpath)
+		}
+		delete(want, d.Rpath)
+
+		var kind EventKind
+		switch d.Op {
+		case "add":
+			kind = EvtKindCreateRecord
+		case "mut":
+			kind = EvtKindUpdateRecord
+		case "del":
+			kind = EvtKindDeleteRecord
+		}
+		if EventKind(op.Action) != kind {
+			return invalid("op on %s is a %s, but the tree has a %s", d.Rpath, op.Action, kind)
+		}
+		if kind != EvtKindDeleteRecord && recs[d.Rpath] != d.NewCid {
+			return invalid("op on %s has record %s, but the tree has %s", d.Rpath, recs[d.Rpath], d.NewCid)
+		}
+	}
+	for path := range want {
+		return invalid("op on %s doesn't change the tree", path)
+	}
+
+	return nil
+}
+
+func cidPtrEqual(a, b *cid.Cid) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func cidPtrString(c *cid.Cid) string {
+	if c == nil {
+		return "nothing"
+	}
+	return c.String()
+}
+
+// layeredBlockstore reads blocks from top, and then from base. It can't be
+// written to.
+type layeredBlockstore struct {
+	top  blockstore.Blockstore
+	base blockstore.Blockstore
+}
+
+var _ blockstore.Blockstore = (*layeredBlockstore)(nil)
+
+var errReadOnlyBlockstore = errors.New("cannot write to layered blockstore")
+
+func (lb *layeredBlockstore) Get(ctx context.Context, c cid.Cid) (blockformat.Block, error) {
+	if has, err := lb.top.Has(ctx, c); err == nil && has {
+		return lb.top.Get(ctx, c)
+	}
+	return lb.base.Get(ctx, c)
+}
+
+func (lb *layeredBlockstore) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	if has, err := lb.top.Has(ctx, c); err != nil || has {
+		return has, err
+	}
+	return lb.base.Has(ctx, c)
+}
+
+func (lb *layeredBlockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	if has, err := lb.top.Has(ctx, c); err == nil && has {
+		return lb.top.GetSize(ctx, c)
+	}
+	return lb.base.GetSize(ctx, c)
+}
+
+func (lb *layeredBlockstore) Put(context.Context, blockformat.Block) error {
+	return errReadOnlyBlockstore
+}
+
+func (lb *layeredBlockstore) PutMany(context.Context, []blockformat.Block) error {
+	return errReadOnlyBlockstore
+}
+
+func (lb *layeredBlockstore) DeleteBlock(context.Context, cid.Cid) error {
+	return errReadOnlyBlockstore
+}
+
+func (lb *layeredBlockstore) AllKeysChan(context.Context) (<-chan cid.Cid, error) {
+	return nil, fmt.Errorf("AllKeysChan not implemented")
+}
+
+func (lb *layeredBlockstore) HashOnRead(bool) {}
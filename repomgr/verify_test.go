@@ -0,0 +1,124 @@
+package repomgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	atproto "github.com/bluesky-social/indigo/api/atproto"
+	bsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/carstore"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/bluesky-social/indigo/util"
+	"github.com/ipfs/go-cid"
+)
+
+// commitPost adds a post to the repo at prev, returning the commit's slice,
+// its root and op
+func commitPost(t *testing.T, cs *carstore.CarStore, did string, prev *cid.Cid, postid int) ([]byte, cid.Cid, *atproto.SyncSubscribeRepos_RepoOp) {
+	ctx := context.TODO()
+	ds, err := cs.NewDeltaSession(ctx, 1, prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := repo.NewRepo(ctx, did, ds)
+	if prev != nil {
+		if r, err = repo.OpenRepo(ctx, ds, *prev, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rcid, tid, err := r.CreateRecord(ctx, "app.bsky.feed.post", &bsky.FeedPost{
+		Text: fmt.Sprintf("hello friend %d", postid),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := r.Commit(ctx, func(context.Context, string, []byte) ([]byte, error) { return []byte("signature"), nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slice, err := ds.CloseWithRoot(ctx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link := lexutil.LexLink(rcid)
+	return slice, root, &atproto.SyncSubscribeRepos_RepoOp{
+		Action: "create",
+		Path:   "app.bsky.feed.post/" + tid,
+		Cid:    &link,
+	}
+}
+
+func TestVerifyExternalCommit(t *testing.T) {
+	ctx := context.TODO()
+	did := "did:plc:beepboop"
+
+	repoman := NewRepoManager(testCarstore(t, t.TempDir()), &util.FakeKeyManager{})
+	source := testCarstore(t, t.TempDir())
+
+	slice1, head1, op1 := commitPost(t, source, did, nil, 1)
+	ops1 := []*atproto.SyncSubscribeRepos_RepoOp{op1}
+	if err := repoman.VerifyExternalCommit(ctx, 1, did, nil, slice1, ops1, VerifyFull); err != nil {
+		t.Fatal(err)
+	}
+	if err := repoman.HandleVerifiedExternalUserEvent(ctx, 1, 1, did, nil, slice1, ops1); err != nil {
+		t.Fatal(err)
+	}
+
+	slice2, head2, op2 := commitPost(t, source, did, &head1, 2)
+	ops2 := []*atproto.SyncSubscribeRepos_RepoOp{op2}
+	if err := repoman.VerifyExternalCommit(ctx, 1, did, &head1, slice2, ops2, VerifyFull); err != nil {
+		t.Fatal(err)
+	}
+
+	// ops needn't carry their record cids
+	nocid := []*atproto.SyncSubscribeRepos_RepoOp{{Action: op2.Action, Path: op2.Path}}
+	if err := repoman.VerifyExternalCommit(ctx, 1, did, &head1, slice2, nocid, VerifyFull); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		did   string
+		prev  *cid.Cid
+		ops   []*atproto.SyncSubscribeRepos_RepoOp
+		light bool
+	}{
+		{"wrong did", "did:plc:other", &head1, ops2, false},
+		{"wrong prev", did, &head2, ops2, false},
+		{"missing record", did, &head1, []*atproto.SyncSubscribeRepos_RepoOp{{Action: "create", Path: "app.bsky.feed.post/abc", Cid: op1.Cid}}, false},
+		{"wrong record", did, &head1, []*atproto.SyncSubscribeRepos_RepoOp{{Action: "create", Path: op2.Path, Cid: op1.Cid}}, false},
+		{"missing op", did, &head1, nil, true},
+		{"extra op", did, &head1, append([]*atproto.SyncSubscribeRepos_RepoOp{{Action: "delete", Path: "app.bsky.feed.like/abc"}}, ops2...), true},
+		{"wrong action", did, &head1, []*atproto.SyncSubscribeRepos_RepoOp{{Action: "update", Path: op2.Path, Cid: op2.Cid}}, true},
+	} {
+		err := repoman.VerifyExternalCommit(ctx, 1, tc.did, tc.prev, slice2, tc.ops, VerifyLight)
+		if tc.light && err != nil {
+			t.Fatalf("%s: expected light verification to pass, got %s", tc.name, err)
+		}
+		if !tc.light && !errors.Is(err, ErrInvalidCommit) {
+			t.Fatalf("%s: expected light verification to fail, got %v", tc.name, err)
+		}
+
+		if err := repoman.VerifyExternalCommit(ctx, 1, tc.did, tc.prev, slice2, tc.ops, VerifyFull); !errors.Is(err, ErrInvalidCommit) {
+			t.Fatalf("%s: expected full verification to fail, got %v", tc.name, err)
+		}
+
+		if err := repoman.VerifyExternalCommit(ctx, 1, tc.did, tc.prev, slice2, tc.ops, VerifyNone); err != nil {
+			t.Fatalf("%s: expected nothing to be checked, got %s", tc.name, err)
+		}
+	}
+
+	// a commit beyond the head can't be diffed, and is left to the import
+	slice3, _, op3 := commitPost(t, source, did, &head2, 3)
+	if err := repoman.VerifyExternalCommit(ctx, 1, did, &head2, slice3, []*atproto.SyncSubscribeRepos_RepoOp{op3}, VerifyFull); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,303 @@
+package repomgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	atproto "github.com/bluesky-social/indigo/api/atproto"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/mst"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/bluesky-social/indigo/util/syntax"
+
+	"github.com/ipfs/go-cid"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// MaxBatchWrites is the most writes ApplyWrites applies in one commit
+const MaxBatchWrites = 200
+
+var (
+	// ErrInvalidWrite is returned, wrapped, by ApplyWrites for writes which
+	// can't be applied, such as creates of records which exist
+	ErrInvalidWrite = errors.New("invalid write")
+
+	// ErrInvalidSwap is returned, wrapped, by ApplyWrites when the repo's
+	// head or a record isn't what the caller said it should be
+	ErrInvalidSwap = errors.New("invalid swap")
+)
+
+// Write is a change to a record, applied by ApplyWrites
+type Write struct {
+	Kind       EventKind
+	Collection string
+
+	// Rkey may be left empty for creates, which are given a TID
+	Rkey string
+
+	// Record is the new record of creates and updates
+	Record cbg.CBORMarshaler
+
+	// SwapRecord, if set, is the cid the record must have for the write to
+	// be applied, or cid.Undef if the record must not exist. Swaps parsed
+	// with ParseSwap are never cid.Undef, as XRPC calls can't tell a null
+	// swapRecord from one left out.
+	SwapRecord *cid.Cid
+}
+
+// WriteResult is the outcome of a Write applied by ApplyWrites
+type WriteResult struct {
+	Kind       EventKind
+	Collection string
+	Rkey       string
+
+	// Cid is the cid of the new record, unset for deletes
+	Cid cid.Cid
+}
+
+// Path returns the path of the record in the repo
+func (wr *WriteResult) Path() string {
+	return wr.Collection + "/" + wr.Rkey
+}
+
+// check returns why a write can't be applied, before looking at the repo
+func (w *Write) check() error {
+	switch w.Kind {
+	case EvtKindCreateRecord, EvtKindUpdateRecord:
+		if w.Record == nil {
+			return fmt.Errorf("%s of %s/%s has no record", w.Kind, w.Collection, w.Rkey)
+		}
+	case EvtKindDeleteRecord:
+		if w.Record != nil {
+			return fmt.Errorf("delete of %s/%s has a record", w.Collection, w.Rkey)
+		}
+	default:
+		return fmt.Errorf("unrecognized write kind %q", w.Kind)
+	}
+
+	if _, err := syntax.ParseNSID(w.Collection); err != nil {
+		return fmt.Errorf("collection: %w", err)
+	}
+	if w.Rkey == "" && w.Kind == EvtKindCreateRecord {
+		return nil
+	}
+	if _, err := syntax.ParseRecordKey(w.Rkey); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ApplyWrites applies a batch of creates, updates and deletes to a repo in a
+// single commit, emitting a single event for them. Either every write is
+// applied, or (on error) none are. If swapCommit is set, the writes are only
+// applied if it is the repo's head. Creates fail if the record exists, and
+// deletes if it doesn't; updates create records which don't exist, and are
+// reported as creates.
+func (rm *RepoManager) ApplyWrites(ctx context.Context, user models.Uid, writes []Write, swapCommit *cid.Cid) (cid.Cid, []WriteResult, error) {
+	ctx, span := otel.Tracer("repoman").Start(ctx, "ApplyWrites")
+	defer span.End()
+	span.SetAttributes(attribute.Int("writes", len(writes)))
+
+	if len(writes) == 0 {
+		return cid.Undef, nil, fmt.Errorf("%w: no writes to apply", ErrInvalidWrite)
+	}
+	if len(writes) > MaxBatchWrites {
+		return cid.Undef, nil, fmt.Errorf("%w: too many writes (%d, at most %d)", ErrInvalidWrite, len(writes), MaxBatchWrites)
+	}
+	for i := range writes {
+		if err := writes[i].check(); err != nil {
+			return cid.Undef, nil, fmt.Errorf("%w: %s", ErrInvalidWrite, err)
+		}
+	}
+
+	unlock := rm.lockUser(ctx, user)
+	defer unlock()
+
+	head, err := rm.cs.GetUserRepoHead(ctx, user)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+
+	if swapCommit != nil && *swapCommit != head {
+		return cid.Undef, nil, fmt.Errorf("%w: repo head is %s, not %s", ErrInvalidSwap, head, *swapCommit)
+	}
+
+	// nothing is stored until the session is closed, so returning early
+	// leaves the repo as it was
+	ds, err := rm.cs.NewDeltaSession(ctx, user, &head)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+
+	r, err := repo.OpenRepo(ctx, ds, head, true)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+
+	seen := make(map[string]bool, len(writes))
+	results := make([]WriteResult, 0, len(writes))
+	ops := make([]RepoOp, 0, len(writes))
+	for _, w := range writes {
+		rkey := w.Rkey
+		if rkey == "" {
+			if rkey, err = rm.nextRkey(ctx); err != nil {
+				return cid.Undef, nil, err
+			}
+		}
+		rpath := w.Collection + "/" + rkey
+
+		if seen[rpath] {
+			return cid.Undef, nil, fmt.Errorf("%w: more than one write to %s", ErrInvalidWrite, rpath)
+		}
+		seen[rpath] = true
+
+		cur, err := r.GetRecordCid(ctx, rpath)
+		if err != nil && !errors.Is(err, mst.ErrNotFound) {
+			return cid.Undef, nil, fmt.Errorf("looking up %s: %w", rpath, err)
+		}
+
+		if w.SwapRecord != nil && *w.SwapRecord != cur {
+			if cur.Defined() {
+				return cid.Undef, nil, fmt.Errorf("%w: record %s is %s, not %s", ErrInvalidSwap, rpath, cur, *w.SwapRecord)
+			}
+			return cid.Undef, nil, fmt.Errorf("%w: record %s doesn't exist", ErrInvalidSwap, rpath)
+		}
+
+		// updates of records which don't exist are creates, as far as
+		// anyone reading the commit is concerned
+		kind := w.Kind
+		if kind == EvtKindUpdateRecord && !cur.Defined() {
+			kind = EvtKindCreateRecord
+		}
+
+		var rc cid.Cid
+		switch kind {
+		case EvtKindCreateRecord:
+			if cur.Defined() {
+				return cid.Undef, nil, fmt.Errorf("%w: record %s already exists", ErrInvalidWrite, rpath)
+			}
+			if rc, err = r.PutRecord(ctx, rpath, w.Record); err != nil {
+				return cid.Undef, nil, err
+			}
+		case EvtKindUpdateRecord:
+			if rc, err = r.UpdateRecord(ctx, rpath, w.Record); err != nil {
+				return cid.Undef, nil, err
+			}
+		case EvtKindDeleteRecord:
+			if !cur.Defined() {
+				return cid.Undef, nil, fmt.Errorf("%w: record %s doesn't exist", ErrInvalidWrite, rpath)
+			}
+			if err := r.DeleteRecord(ctx, rpath); err != nil {
+				return cid.Undef, nil, err
+			}
+		}
+
+		results = append(results, WriteResult{
+			Kind:       kind,
+			Collection: w.Collection,
+			Rkey:       rkey,
+			Cid:        rc,
+		})
+
+		op := RepoOp{
+			Kind:       kind,
+			Collection: w.Collection,
+			Rkey:       rkey,
+			Record:     w.Record,
+		}
+		if rc.Defined() {
+			op.RecCid = &rc
+		}
+		ops = append(ops, op)
+	}
+
+	nroot, err := r.Commit(ctx, rm.kmgr.SignForUser)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+
+	rslice, err := ds.CloseWithRoot(ctx, nroot)
+	if err != nil {
+		return cid.Undef, nil, fmt.Errorf("close with root: %w", err)
+	}
+
+	var oldroot *cid.Cid
+	if head.Defined() {
+		oldroot = &head
+	}
+
+	if rm.events != nil {
+		rm.events(ctx, &RepoEvent{
+			User:      user,
+			OldRoot:   oldroot,
+			NewRoot:   nroot,
+			RepoSlice: rslice,
+			Ops:       ops,
+		})
+	}
+
+	return nroot, results, nil
+}
+
+// WritesFromApplyWrites converts the writes of a com.atproto.repo.applyWrites
+// call for ApplyWrites
+func WritesFromApplyWrites(writes []*atproto.RepoApplyWrites_Input_Writes_Elem) ([]Write, error) {
+	out := make([]Write, 0, len(writes))
+	for _, w := range writes {
+		switch {
+		case w.RepoApplyWrites_Create != nil:
+			c := w.RepoApplyWrites_Create
+			var rkey string
+			if c.Rkey != nil {
+				rkey = *c.Rkey
+			}
+			out = append(out, Write{
+				Kind:       EvtKindCreateRecord,
+				Collection: c.Collection,
+				Rkey:       rkey,
+				Record:     decoderRecord(c.Value),
+			})
+		case w.RepoApplyWrites_Update != nil:
+			u := w.RepoApplyWrites_Update
+			out = append(out, Write{
+				Kind:       EvtKindUpdateRecord,
+				Collection: u.Collection,
+				Rkey:       u.Rkey,
+				Record:     decoderRecord(u.Value),
+			})
+		case w.RepoApplyWrites_Delete != nil:
+			d := w.RepoApplyWrites_Delete
+			out = append(out, Write{
+				Kind:       EvtKindDeleteRecord,
+				Collection: d.Collection,
+				Rkey:       d.Rkey,
+			})
+		default:
+			return nil, fmt.Errorf("%w: no operation set in write enum", ErrInvalidWrite)
+		}
+	}
+	return out, nil
+}
+
+func decoderRecord(d *lexutil.LexiconTypeDecoder) cbg.CBORMarshaler {
+	if d == nil {
+		return nil
+	}
+	return d.Val
+}
+
+// ParseSwap parses the swapCommit or swapRecord of an XRPC call
+func ParseSwap(s *string) (*cid.Cid, error) {
+	if s == nil {
+		return nil, nil
+	}
+	c, err := cid.Decode(*s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid swap cid %q: %s", ErrInvalidWrite, *s, err)
+	}
+	return &c, nil
+}
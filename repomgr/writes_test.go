@@ -0,0 +1,115 @@
+package repomgr
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	bsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/util"
+	"github.com/ipfs/go-cid"
+)
+
+func TestApplyWrites(t *testing.T) {
+	ctx := context.TODO()
+	repoman := NewRepoManager(testCarstore(t, t.TempDir()), &util.FakeKeyManager{})
+	if err := repoman.InitNewActor(ctx, 1, "hello.world", "did:plc:foobar", "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	var evts []*RepoEvent
+	repoman.SetEventHandler(func(ctx context.Context, evt *RepoEvent) {
+		evts = append(evts, evt)
+	})
+
+	post := func(text string) *bsky.FeedPost {
+		return &bsky.FeedPost{Text: text}
+	}
+
+	_, res, err := repoman.ApplyWrites(ctx, 1, []Write{
+		{Kind: EvtKindCreateRecord, Collection: "app.bsky.feed.post", Rkey: "one", Record: post("one")},
+		{Kind: EvtKindCreateRecord, Collection: "app.bsky.feed.post", Record: post("two")},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || res[0].Path() != "app.bsky.feed.post/one" || res[1].Rkey == "" || !res[1].Cid.Defined() {
+		t.Fatalf("unexpected results: %v", res)
+	}
+
+	head, err := repoman.GetRepoRoot(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a batch applied on the head, with the record swapped as expected
+	root, res2, err := repoman.ApplyWrites(ctx, 1, []Write{
+		{Kind: EvtKindUpdateRecord, Collection: "app.bsky.feed.post", Rkey: "one", Record: post("uno"), SwapRecord: &res[0].Cid},
+		{Kind: EvtKindDeleteRecord, Collection: "app.bsky.feed.post", Rkey: res[1].Rkey},
+		{Kind: EvtKindUpdateRecord, Collection: "app.bsky.feed.post", Rkey: "three", Record: post("three"), SwapRecord: &cid.Undef},
+	}, &head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evts) != 2 || len(evts[1].Ops) != 3 || evts[1].NewRoot != root || *evts[1].OldRoot != head {
+		t.Fatalf("expected a single event for each batch, got %v", evts)
+	}
+	if op := evts[1].Ops[0]; op.Kind != EvtKindUpdateRecord || *op.RecCid != res2[0].Cid {
+		t.Fatalf("unexpected op: %v", op)
+	}
+	if evts[1].Ops[1].RecCid != nil {
+		t.Fatal("deletes shouldn't have a record cid")
+	}
+	// putting a record which doesn't exist creates it
+	if op := evts[1].Ops[2]; op.Kind != EvtKindCreateRecord || *op.RecCid != res2[2].Cid {
+		t.Fatalf("expected a put of a missing record to be a create, got %v", op)
+	}
+	if res2[2].Kind != EvtKindCreateRecord {
+		t.Fatalf("expected a put of a missing record to be a create, got %v", res2[2])
+	}
+
+	for _, tc := range []struct {
+		name       string
+		writes     []Write
+		swapCommit *cid.Cid
+		err        error
+	}{
+		{"stale commit", []Write{{Kind: EvtKindCreateRecord, Collection: "app.bsky.feed.post", Record: post("four")}}, &head, ErrInvalidSwap},
+		{"stale record", []Write{{Kind: EvtKindDeleteRecord, Collection: "app.bsky.feed.post", Rkey: "one", SwapRecord: &res[0].Cid}}, nil, ErrInvalidSwap},
+		{"existing record", []Write{
+			{Kind: EvtKindCreateRecord, Collection: "app.bsky.feed.post", Rkey: "four", Record: post("four")},
+			{Kind: EvtKindCreateRecord, Collection: "app.bsky.feed.post", Rkey: "one", Record: post("one")},
+		}, nil, ErrInvalidWrite},
+		{"missing record", []Write{{Kind: EvtKindDeleteRecord, Collection: "app.bsky.feed.post", Rkey: res[1].Rkey}}, nil, ErrInvalidWrite},
+		{"repeated record", []Write{
+			{Kind: EvtKindUpdateRecord, Collection: "app.bsky.feed.post", Rkey: "one", Record: post("un")},
+			{Kind: EvtKindDeleteRecord, Collection: "app.bsky.feed.post", Rkey: "one"},
+		}, nil, ErrInvalidWrite},
+		{"bad collection", []Write{{Kind: EvtKindCreateRecord, Collection: "post", Record: post("four")}}, nil, ErrInvalidWrite},
+		{"bad rkey", []Write{{Kind: EvtKindUpdateRecord, Collection: "app.bsky.feed.post", Rkey: "..", Record: post("four")}}, nil, ErrInvalidWrite},
+		{"no record", []Write{{Kind: EvtKindUpdateRecord, Collection: "app.bsky.feed.post", Rkey: "one"}}, nil, ErrInvalidWrite},
+		{"no writes", nil, nil, ErrInvalidWrite},
+	} {
+		if _, _, err := repoman.ApplyWrites(ctx, 1, tc.writes, tc.swapCommit); !errors.Is(err, tc.err) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.err, err)
+		}
+	}
+
+	// failed batches leave the repo as it was
+	if len(evts) != 2 {
+		t.Fatalf("failed batches shouldn't emit events, got %d", len(evts))
+	}
+	if cur, err := repoman.GetRepoRoot(ctx, 1); err != nil || cur != root {
+		t.Fatalf("expected the head to still be %s, got %s (%v)", root, cur, err)
+	}
+	if _, _, err := repoman.GetRecord(ctx, 1, "app.bsky.feed.post", "four", cid.Undef); err == nil {
+		t.Fatal("record from a failed batch was written")
+	}
+	_, rec, err := repoman.GetRecord(ctx, 1, "app.bsky.feed.post", "one", cid.Undef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txt := rec.(*bsky.FeedPost).Text; txt != "uno" {
+		t.Fatalf("unexpected record text %q", txt)
+	}
+}
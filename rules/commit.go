@@ -0,0 +1,76 @@
+package rules
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/repo"
+)
+
+// RecordFields returns rec as decoded from its JSON form, which is what
+// field conditions look into
+func RecordFields(rec any) (map[string]any, error) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	var out map[string]any
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CommitEvents returns an event for each record created or updated by evt
+// that the rules want, read from the blocks of the commit. accountCreated is
+// set on all the events. Their time is left for Evaluate to set, rather than
+// taken from the commit, as that is up to the PDS.
+func (e *Engine) CommitEvents(ctx context.Context, evt *comatproto.SyncSubscribeRepos_Commit, accountCreated time.Time) ([]*Event, error) {
+	var want []*comatproto.SyncSubscribeRepos_RepoOp
+	for _, op := range evt.Ops {
+		if op.Action != "create" && op.Action != "update" {
+			continue
+		}
+		col, _, _ := strings.Cut(op.Path, "/")
+		if e.Wants(col) {
+			want = append(want, op)
+		}
+	}
+	if len(want) == 0 {
+		return nil, nil
+	}
+
+	r, err := repo.ReadRepoFromCar(ctx, bytes.NewReader(evt.Blocks))
+	if err != nil {
+		return nil, fmt.Errorf("reading commit blocks: %w", err)
+	}
+
+	var out []*Event
+	for _, op := range want {
+		col, rkey, _ := strings.Cut(op.Path, "/")
+		rcid, rec, err := r.GetRawRecord(ctx, op.Path)
+		if err != nil {
+			return nil, fmt.Errorf("record %s not in commit: %w", op.Path, err)
+		}
+		fields, err := RecordFields(rec)
+		if err != nil {
+			return nil, fmt.Errorf("record %s: %w", op.Path, err)
+		}
+
+		out = append(out, &Event{
+			Did:            evt.Repo,
+			Action:         op.Action,
+			Collection:     col,
+			Rkey:           rkey,
+			Cid:            rcid.String(),
+			Record:         fields,
+			AccountCreated: accountCreated,
+		})
+	}
+	return out, nil
+}
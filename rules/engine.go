@@ -0,0 +1,489 @@
+package rules
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/util/counters"
+	"github.com/bluesky-social/indigo/util/textnorm"
+)
+
+// CounterSize is how many velocities are kept for, when they are kept in
+// memory
+var CounterSize = 100_000
+
+// Event is a record written by an account, to evaluate rules against
+type Event struct {
+	Did string
+	// Action is "create" or "update"; only creates count towards posting
+	// rates
+	Action     string
+	Collection string
+	Rkey       string
+	Cid        string
+	// IP is the address of the client that wrote the record, if known. Only
+	// the PDS sees it; records from a firehose don't carry it.
+	IP string
+	// Record is the record, as decoded from JSON. Rules testing fields of
+	// records do not match if it is nil.
+	Record map[string]any
+
+	// AccountCreated is when the account was created, or first seen by the
+	// service; account_age conditions do not match if it is zero
+	AccountCreated time.Time
+	// Time is when the record was written, the current time if zero
+	Time time.Time
+}
+
+// Result is the rules an event matched, and the actions they call for
+type Result struct {
+	Rules   []string
+	Actions []*MatchedAction
+}
+
+// MatchedAction is an action of a rule that matched
+type MatchedAction struct {
+	Rule string
+	*Action
+}
+
+// Labels returns the label values the result calls for, without duplicates
+func (r *Result) Labels() []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, a := range r.Actions {
+		if a.Label != "" && !seen[a.Label] {
+			seen[a.Label] = true
+			out = append(out, a.Label)
+		}
+	}
+	return out
+}
+
+// ProfileHistory is the history of accounts' profiles, as kept by the
+// service running the rules
+type ProfileHistory interface {
+	// ProfileChanges counts the changes to a part of the account's profile
+	// (one of the ProfileField constants) since a time, or to any part if
+	// field is empty
+	ProfileChanges(ctx context.Context, did, field string, since time.Time) (int, error)
+}
+
+// Post is a post replied to, as found by a ThreadContext
+type Post struct {
+	Uri string
+	Cid string
+	// Record is the post, as decoded from JSON
+	Record map[string]any
+}
+
+// ThreadContext finds the posts replied to, for parent and root conditions,
+// as the service running the rules can
+type ThreadContext interface {
+	// Post returns the post at uri, or nil if it can't be found
+	Post(ctx context.Context, uri string) (*Post, error)
+}
+
+// Engine evaluates the rules of a rule set. It is safe for concurrent use.
+type Engine struct {
+	set       *RuleSet
+	rules     []*compiledRule
+	normalize textnorm.Steps
+	// collections the rules apply to, nil if some apply to all
+	collections map[string]bool
+
+	didRates []rateSpec
+	ipRates  []rateSpec
+	fanouts  []fanoutSpec
+	counters counters.Store
+	profiles ProfileHistory
+	thread   ThreadContext
+}
+
+// NewEngine checks the rules of rs and compiles their regexes, and returns
+// an engine for them
+func NewEngine(rs *RuleSet) (*Engine, error) {
+	if err := rs.Normalize.Check(); err != nil {
+		return nil, fmt.Errorf("normalize: %w", err)
+	}
+	c := &compiler{
+		sets:      make(map[string][]*regexp.Regexp),
+		normalize: rs.Normalize,
+		didRates:  make(map[rateSpec]bool),
+		ipRates:   make(map[rateSpec]bool),
+		fanouts:   make(map[fanoutSpec]bool),
+	}
+	for name, exprs := range rs.RegexSets {
+		for _, expr := range exprs {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("regex set %q: %w", name, err)
+			}
+			c.sets[name] = append(c.sets[name], re)
+		}
+	}
+
+	e := &Engine{set: rs, normalize: rs.Normalize, collections: make(map[string]bool)}
+	names := make(map[string]bool)
+	for _, r := range rs.Rules {
+		cr, err := c.rule(r)
+		if err != nil {
+			return nil, err
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("more than one rule named %q", r.Name)
+		}
+		names[r.Name] = true
+
+		if cr.collections == nil {
+			e.collections = nil
+		} else if e.collections != nil {
+			for col := range cr.collections {
+				e.collections[col] = true
+			}
+		}
+		e.rules = append(e.rules, cr)
+	}
+
+	for spec := range c.didRates {
+		e.didRates = append(e.didRates, spec)
+	}
+	for spec := range c.ipRates {
+		e.ipRates = append(e.ipRates, spec)
+	}
+	for spec := range c.fanouts {
+		e.fanouts = append(e.fanouts, spec)
+	}
+	if e.collections != nil {
+		// records have to be seen to be counted
+		for _, spec := range append(e.didRates, e.ipRates...) {
+			e.collections[spec.collection] = true
+		}
+	}
+
+	ms, err := counters.NewMemoryStore(CounterSize)
+	if err != nil {
+		return nil, err
+	}
+	e.counters = ms
+	return e, nil
+}
+
+// SetCounters replaces the store velocities are counted in, which is in
+// memory unless set. Must be called before anything is evaluated.
+func (e *Engine) SetCounters(s counters.Store) {
+	e.counters = s
+}
+
+// Counters returns the store velocities are counted in, for an engine
+// replacing this one to keep counting in
+func (e *Engine) Counters() counters.Store {
+	return e.counters
+}
+
+// SetProfileHistory sets where profile_changes conditions look up changes to
+// profiles. Without one, they never pass. Must be called before anything is
+// evaluated.
+func (e *Engine) SetProfileHistory(h ProfileHistory) {
+	e.profiles = h
+}
+
+// SetThreadContext sets where parent and root conditions look up the posts
+// replied to. Without one, they never pass. Must be called before anything
+// is evaluated.
+func (e *Engine) SetThreadContext(tc ThreadContext) {
+	e.thread = tc
+}
+
+// RuleSet returns the rule set the engine was made from, which must not be
+// modified
+func (e *Engine) RuleSet() *RuleSet {
+	return e.set
+}
+
+// Wants reports whether any rule applies to records in collection, or counts
+// them for posting_rate or ip_rate, for callers to skip decoding the records no rule
+// looks at
+func (e *Engine) Wants(collection string) bool {
+	if len(e.rules) == 0 {
+		return false
+	}
+	return e.collections == nil || e.collections[collection]
+}
+
+// Evaluate counts ev towards the velocities the rules look at, and returns
+// the rules it matches. The result has no rules or actions if none match.
+func (e *Engine) Evaluate(ctx context.Context, ev *Event) (*Result, error) {
+	now := ev.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+	if ev.Action == "create" {
+		if err := e.count(ctx, ev, now); err != nil {
+			return nil, err
+		}
+	}
+
+	res := &Result{}
+	for _, r := range e.rules {
+		if r.collections != nil && !r.collections[ev.Collection] {
+			continue
+		}
+		ok, err := e.match(ctx, r.cond, ev, now)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", r.Name, err)
+		}
+		if !ok {
+			continue
+		}
+		res.Rules = append(res.Rules, r.Name)
+		for _, a := range r.Actions {
+			res.Actions = append(res.Actions, &MatchedAction{Rule: r.Name, Action: a})
+		}
+	}
+	return res, nil
+}
+
+func rateKey(collection string) string {
+	return "creates:" + collection
+}
+
+func fanoutKey(collection, field, text string) string {
+	return counters.TextKey("fanout:"+collection+":"+field, text)
+}
+
+// fanoutText returns the text of the record field, if it is long enough to
+// be counted
+func fanoutText(ev *Event, field string, minLength int) (string, bool) {
+	if ev.Record == nil {
+		return "", false
+	}
+	for _, v := range fieldValues(ev.Record, strings.Split(field, "."), nil) {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		norm := counters.NormalizeText(s)
+		if norm == "" || len([]rune(norm)) < minLength {
+			return "", false
+		}
+		return s, true
+	}
+	return "", false
+}
+
+// count counts a created record towards the velocities the rules look at
+func (e *Engine) count(ctx context.Context, ev *Event, now time.Time) error {
+	for _, spec := range e.didRates {
+		if spec.collection != ev.Collection {
+			continue
+		}
+		if err := e.counters.Incr(ctx, counters.DidKey(rateKey(spec.collection), ev.Did), counters.NewWindow(spec.window), now); err != nil {
+			return err
+		}
+	}
+	if ev.IP != "" {
+		for _, spec := range e.ipRates {
+			if spec.collection != ev.Collection {
+				continue
+			}
+			if err := e.counters.Incr(ctx, counters.IPKey(rateKey(spec.collection), ev.IP), counters.NewWindow(spec.window), now); err != nil {
+				return err
+			}
+		}
+	}
+	for _, spec := range e.fanouts {
+		text, ok := fanoutText(ev, spec.field, spec.minLength)
+		if !ok {
+			continue
+		}
+		if err := e.counters.AddDistinct(ctx, fanoutKey(ev.Collection, spec.field, text), counters.NewWindow(spec.window), ev.Did, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Engine) match(ctx context.Context, c *compiledCondition, ev *Event, now time.Time) (bool, error) {
+	switch {
+	case c.all != nil:
+		for _, sub := range c.all {
+			ok, err := e.match(ctx, sub, ev, now)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	case c.any != nil:
+		for _, sub := range c.any {
+			ok, err := e.match(ctx, sub, ev, now)
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	case c.not != nil:
+		ok, err := e.match(ctx, c.not, ev, now)
+		return !ok, err
+	case c.Field != "":
+		return e.matchField(c, ev.Record), nil
+	case c.AccountAge != nil:
+		if ev.AccountCreated.IsZero() {
+			return false, nil
+		}
+		age := now.Sub(ev.AccountCreated)
+		if c.AccountAge.LessThan > 0 && age >= c.AccountAge.LessThan {
+			return false, nil
+		}
+		if c.AccountAge.MoreThan > 0 && age <= c.AccountAge.MoreThan {
+			return false, nil
+		}
+		return true, nil
+	case c.PostingRate != nil:
+		spec, _ := rateOf(c.PostingRate)
+		n, err := e.counters.Count(ctx, counters.DidKey(rateKey(spec.collection), ev.Did), counters.NewWindow(spec.window), now)
+		return n > c.PostingRate.MoreThan, err
+	case c.IPRate != nil:
+		if ev.IP == "" {
+			return false, nil
+		}
+		spec, _ := rateOf(c.IPRate)
+		n, err := e.counters.Count(ctx, counters.IPKey(rateKey(spec.collection), ev.IP), counters.NewWindow(spec.window), now)
+		return n > c.IPRate.MoreThan, err
+	case c.TextFanout != nil:
+		spec, _ := fanoutOf(c.TextFanout)
+		text, ok := fanoutText(ev, spec.field, spec.minLength)
+		if !ok {
+			return false, nil
+		}
+		n, err := e.counters.CountDistinct(ctx, fanoutKey(ev.Collection, spec.field, text), counters.NewWindow(spec.window), now)
+		return n > c.TextFanout.MoreThan, err
+	case c.ProfileChanges != nil:
+		if e.profiles == nil {
+			return false, nil
+		}
+		n, err := e.profiles.ProfileChanges(ctx, ev.Did, c.ProfileChanges.Field, now.Add(-c.ProfileChanges.Window))
+		return n > c.ProfileChanges.MoreThan, err
+	case c.parent != nil:
+		return e.matchReplied(ctx, c.parent, ev, "parent", now)
+	case c.root != nil:
+		return e.matchReplied(ctx, c.root, ev, "root", now)
+	}
+	return false, nil
+}
+
+// matchReplied matches a condition against the post a reply is to, which is
+// the "parent" or "root" of the reply
+func (e *Engine) matchReplied(ctx context.Context, c *compiledCondition, ev *Event, which string, now time.Time) (bool, error) {
+	if e.thread == nil || ev.Record == nil {
+		return false, nil
+	}
+	var uri string
+	for _, v := range fieldValues(ev.Record, []string{"reply", which, "uri"}, nil) {
+		uri, _ = v.(string)
+	}
+	if uri == "" {
+		return false, nil
+	}
+	// the post's author is in its URI
+	parsed, err := util.ParseAtUri(uri)
+	if err != nil {
+		return false, nil
+	}
+
+	post, err := e.thread.Post(ctx, uri)
+	if err != nil {
+		return false, fmt.Errorf("finding %s %s: %w", which, uri, err)
+	}
+	if post == nil {
+		return false, nil
+	}
+	return e.match(ctx, c, &Event{
+		Did:        parsed.Did,
+		Action:     "create",
+		Collection: parsed.Collection,
+		Rkey:       parsed.Rkey,
+		Cid:        post.Cid,
+		Record:     post.Record,
+		Time:       ev.Time,
+	}, now)
+}
+
+func (e *Engine) matchField(c *compiledCondition, rec map[string]any) bool {
+	if rec == nil {
+		return false
+	}
+	vals := fieldValues(rec, strings.Split(c.Field, "."), nil)
+
+	if c.Exists != nil {
+		return (len(vals) > 0) == *c.Exists
+	}
+	for _, v := range vals {
+		s, ok := valueString(v)
+		if !ok {
+			continue
+		}
+		switch {
+		case c.Equals != nil:
+			if s == *c.Equals {
+				return true
+			}
+		case c.contains != "":
+			if strings.Contains(strings.ToLower(e.normalize.Apply(s)), c.contains) {
+				return true
+			}
+		default:
+			s = e.normalize.Apply(s)
+			for _, re := range c.regexes {
+				if re.MatchString(s) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// fieldValues appends the values at path in v to out, looking through every
+// element of arrays on the way
+func fieldValues(v any, path []string, out []any) []any {
+	switch v := v.(type) {
+	case []any:
+		for _, el := range v {
+			out = fieldValues(el, path, out)
+		}
+		return out
+	case map[string]any:
+		if len(path) == 0 {
+			return append(out, v)
+		}
+		next, ok := v[path[0]]
+		if !ok || next == nil {
+			return out
+		}
+		return fieldValues(next, path[1:], out)
+	default:
+		if len(path) == 0 {
+			return append(out, v)
+		}
+		return out
+	}
+}
+
+func valueString(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,510 @@
+// Package rules is a moderation rule engine, shared by the labelmaker and the
+// BGS. Rules are declared in YAML; each has a condition over the records
+// accounts write and the accounts themselves, and the actions to take when
+// it matches:
+//
+//	regex_sets:
+//	  crypto-spam:
+//	    - '(?i)\bairdrop\b'
+//	    - '(?i)free (btc|eth)'
+//	normalize: [zero_width, nfkc, confusables]
+//	rules:
+//	  - name: new-account-crypto
+//	    collections: [app.bsky.feed.post]
+//	    when:
+//	      all:
+//	        - field: text
+//	          matches_set: crypto-spam
+//	        - account_age: {less_than: 72h}
+//	    actions:
+//	      - label: spam
+//	      - report: {reason_type: "com.atproto.moderation.defs#reasonSpam", reason: crypto spam}
+//	  - name: flood
+//	    when:
+//	      posting_rate: {window: 10m, more_than: 100}
+//	    actions:
+//	      - flag: flood
+//	      - escalate: takedown
+//	  - name: copypasta
+//	    when:
+//	      text_fanout: {window: 1h, more_than: 50, min_length: 20}
+//	    actions:
+//	      - label: spam
+//	  - name: shapeshifter
+//	    when:
+//	      profile_changes: {window: 1h, more_than: 5, field: display_name}
+//	    actions:
+//	      - flag: shapeshifter
+//	  - name: pile-on
+//	    collections: [app.bsky.feed.post]
+//	    when:
+//	      all:
+//	        - account_age: {less_than: 24h}
+//	        - root: {field: text, contains: "#survivor"}
+//	    actions:
+//	      - flag: pile-on
+//
+// Evaluating rules has no side effects besides counting the velocities
+// (posting_rate, ip_rate and text_fanout) they look at, in a counters.Store,
+// so it is up to the service running them what the actions do. Profile
+// changes are not counted by the engine, but looked up in the ProfileHistory
+// of the service, if it keeps one; likewise, the posts replies are to are
+// looked up in its ThreadContext.
+package rules
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/util/textnorm"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RuleSet is a set of rules, as declared in YAML
+type RuleSet struct {
+	// RegexSets are named lists of regular expressions, which match a value
+	// if any of them does
+	RegexSets map[string][]string `yaml:"regex_sets,omitempty"`
+	// Normalize are the textnorm steps record fields are normalized with
+	// before contains, matches and matches_set look at them, eg [zero_width,
+	// nfkc, confusables], to see through trivial filter evasion. Values for
+	// contains are normalized the same way.
+	Normalize textnorm.Steps `yaml:"normalize,omitempty"`
+	Rules     []*Rule        `yaml:"rules"`
+}
+
+// Rule is a condition and the actions to take when it matches
+type Rule struct {
+	Name string `yaml:"name"`
+	// Collections are the collections of the records the rule applies to,
+	// or all of them if empty
+	Collections []string   `yaml:"collections,omitempty"`
+	When        *Condition `yaml:"when"`
+	Actions     []*Action  `yaml:"actions"`
+}
+
+// Condition is exactly one of: a combination of other conditions, a test
+// of a record field, a test of the account writing the record, or a test of
+// the post the record replies to.
+type Condition struct {
+	All []*Condition `yaml:"all,omitempty"`
+	Any []*Condition `yaml:"any,omitempty"`
+	Not *Condition   `yaml:"not,omitempty"`
+
+	// Field is a dotted path into the record, as JSON, eg "text" or
+	// "embed.external.uri". Paths through arrays look at every element, and
+	// the test passes if it does for any of the values found.
+	Field  string  `yaml:"field,omitempty"`
+	Equals *string `yaml:"equals,omitempty"`
+	// Contains is a substring to look for, ignoring case
+	Contains   string `yaml:"contains,omitempty"`
+	Matches    string `yaml:"matches,omitempty"`
+	MatchesSet string `yaml:"matches_set,omitempty"`
+	Exists     *bool  `yaml:"exists,omitempty"`
+
+	// AccountAge passes if the age of the account is in range. It never
+	// passes if the age is not known.
+	AccountAge *AgeRange `yaml:"account_age,omitempty"`
+
+	// PostingRate passes if the account created more than the given number
+	// of records in the window, counting the one being evaluated
+	PostingRate *PostingRate `yaml:"posting_rate,omitempty"`
+	// IPRate is like PostingRate, counting the records created by all
+	// accounts from the IP address of the event. It never passes if that is
+	// not known, which it only is to the PDS the record was written to.
+	IPRate *PostingRate `yaml:"ip_rate,omitempty"`
+	// TextFanout passes if more than the given number of accounts created
+	// records with the same text in the window, counting this one
+	TextFanout *TextFanout `yaml:"text_fanout,omitempty"`
+	// ProfileChanges passes if the account changed its profile more than
+	// the given number of times in the window. It never passes if the
+	// service keeps no profile history.
+	ProfileChanges *ProfileChanges `yaml:"profile_changes,omitempty"`
+
+	// Parent passes if the post the record replies to passes the condition,
+	// and Root if the post at the top of its thread does. They never pass
+	// for records which are not replies, or if the service can't find the
+	// post.
+	Parent *Condition `yaml:"parent,omitempty"`
+	Root   *Condition `yaml:"root,omitempty"`
+}
+
+// AgeRange is a range of durations; either bound may be left out
+type AgeRange struct {
+	LessThan time.Duration `yaml:"less_than,omitempty"`
+	MoreThan time.Duration `yaml:"more_than,omitempty"`
+}
+
+// PostingRate is a number of records created over a window of time
+type PostingRate struct {
+	Window   time.Duration `yaml:"window"`
+	MoreThan int           `yaml:"more_than"`
+	// Collection is the collection the records are counted in, posts if
+	// left out
+	Collection string `yaml:"collection,omitempty"`
+}
+
+// TextFanout is a number of accounts creating records with the same text
+// over a window of time. Texts differing only in case and whitespace are the
+// same.
+type TextFanout struct {
+	Window   time.Duration `yaml:"window"`
+	MoreThan int           `yaml:"more_than"`
+	// Field is the record field the text is in, "text" if left out
+	Field string `yaml:"field,omitempty"`
+	// MinLength is the length below which texts are not counted, as short
+	// ones are often the same by chance
+	MinLength int `yaml:"min_length,omitempty"`
+}
+
+// ProfileChanges is a number of changes to an account's profile over a
+// window of time
+type ProfileChanges struct {
+	Window   time.Duration `yaml:"window"`
+	MoreThan int           `yaml:"more_than"`
+	// Field is the part of the profile changes are counted to: one of
+	// display_name, avatar or description, or any of them if left out
+	Field string `yaml:"field,omitempty"`
+}
+
+// Action is exactly one of the things to do when a rule matches
+type Action struct {
+	// Label is the value of a label to put on the record. Values starting
+	// with "repo:" go on the account instead, as with other labelers.
+	Label string `yaml:"label,omitempty"`
+	// Flag marks the record for attention, without a label or report
+	Flag   string  `yaml:"flag,omitempty"`
+	Report *Report `yaml:"report,omitempty"`
+	// Escalate asks for the account to be dealt with by a moderator.
+	// "takedown" is the only escalation so far.
+	Escalate string `yaml:"escalate,omitempty"`
+}
+
+// Report is a moderation report about the record
+type Report struct {
+	ReasonType string `yaml:"reason_type"`
+	Reason     string `yaml:"reason,omitempty"`
+}
+
+const (
+	EscalateTakedown = "takedown"
+
+	// DefaultRateCollection is the collection posting_rate and ip_rate count
+	// records in, if they do not say
+	DefaultRateCollection = "app.bsky.feed.post"
+	// DefaultFanoutField is the field text_fanout looks at, if it does not
+	// say
+	DefaultFanoutField = "text"
+
+	// The parts of profiles profile_changes can count changes to
+	ProfileFieldDisplayName = "display_name"
+	ProfileFieldAvatar      = "avatar"
+	ProfileFieldDescription = "description"
+)
+
+// Kind returns which of label, flag, report or escalate a is
+func (a *Action) Kind() string {
+	switch {
+	case a.Label != "":
+		return "label"
+	case a.Flag != "":
+		return "flag"
+	case a.Report != nil:
+		return "report"
+	case a.Escalate != "":
+		return "escalate"
+	default:
+		return ""
+	}
+}
+
+// ParseRuleSet parses a rule set from YAML
+func ParseRuleSet(b []byte) (*RuleSet, error) {
+	var rs RuleSet
+	if err := yaml.Unmarshal(b, &rs); err != nil {
+		return nil, fmt.Errorf("parsing rules: %w", err)
+	}
+	return &rs, nil
+}
+
+// LoadRuleSetFile reads a rule set from a YAML file
+func LoadRuleSetFile(path string) (*RuleSet, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRuleSet(b)
+}
+
+// LoadFile reads the rules in a YAML file, and returns an engine for them
+func LoadFile(path string) (*Engine, error) {
+	rs, err := LoadRuleSetFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewEngine(rs)
+}
+
+type compiledRule struct {
+	*Rule
+	collections map[string]bool
+	cond        *compiledCondition
+}
+
+type compiledCondition struct {
+	*Condition
+	all, any     []*compiledCondition
+	not          *compiledCondition
+	parent, root *compiledCondition
+	regexes      []*regexp.Regexp
+	contains     string
+}
+
+// rateSpec is a velocity of record creation that has to be counted
+type rateSpec struct {
+	collection string
+	window     time.Duration
+}
+
+// fanoutSpec is a text fanout that has to be counted, for records in any
+// collection
+type fanoutSpec struct {
+	field     string
+	window    time.Duration
+	minLength int
+}
+
+type compiler struct {
+	sets      map[string][]*regexp.Regexp
+	normalize textnorm.Steps
+
+	// the velocities the conditions look at, which every event has to be
+	// counted towards
+	didRates map[rateSpec]bool
+	ipRates  map[rateSpec]bool
+	fanouts  map[fanoutSpec]bool
+}
+
+func (c *compiler) rule(r *Rule) (*compiledRule, error) {
+	if r.Name == "" {
+		return nil, fmt.Errorf("rule has no name")
+	}
+	if r.When == nil {
+		return nil, fmt.Errorf("rule %q has no condition", r.Name)
+	}
+	if len(r.Actions) == 0 {
+		return nil, fmt.Errorf("rule %q has no actions", r.Name)
+	}
+	for i, a := range r.Actions {
+		if err := checkAction(a); err != nil {
+			return nil, fmt.Errorf("rule %q: action %d: %w", r.Name, i, err)
+		}
+	}
+
+	cond, err := c.condition(r.When)
+	if err != nil {
+		return nil, fmt.Errorf("rule %q: %w", r.Name, err)
+	}
+
+	cr := &compiledRule{Rule: r, cond: cond}
+	if len(r.Collections) > 0 {
+		cr.collections = make(map[string]bool)
+		for _, col := range r.Collections {
+			cr.collections[col] = true
+		}
+	}
+	return cr, nil
+}
+
+func checkAction(a *Action) error {
+	if a == nil {
+		return fmt.Errorf("empty action")
+	}
+	n := 0
+	for _, set := range []bool{a.Label != "", a.Flag != "", a.Report != nil, a.Escalate != ""} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return fmt.Errorf("must be exactly one of label, flag, report or escalate")
+	}
+	if a.Report != nil && a.Report.ReasonType == "" {
+		return fmt.Errorf("report has no reason_type")
+	}
+	if a.Escalate != "" && a.Escalate != EscalateTakedown {
+		return fmt.Errorf("unknown escalation %q", a.Escalate)
+	}
+	return nil
+}
+
+func (c *compiler) condition(cond *Condition) (*compiledCondition, error) {
+	if cond == nil {
+		return nil, fmt.Errorf("empty condition")
+	}
+
+	n := 0
+	for _, set := range []bool{
+		len(cond.All) > 0,
+		len(cond.Any) > 0,
+		cond.Not != nil,
+		cond.Field != "",
+		cond.AccountAge != nil,
+		cond.PostingRate != nil,
+		cond.IPRate != nil,
+		cond.TextFanout != nil,
+		cond.ProfileChanges != nil,
+		cond.Parent != nil,
+		cond.Root != nil,
+	} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return nil, fmt.Errorf("condition must be exactly one of all, any, not, field, account_age, posting_rate, ip_rate, text_fanout, profile_changes, parent or root")
+	}
+
+	cc := &compiledCondition{Condition: cond}
+	switch {
+	case len(cond.All) > 0:
+		for _, sub := range cond.All {
+			s, err := c.condition(sub)
+			if err != nil {
+				return nil, err
+			}
+			cc.all = append(cc.all, s)
+		}
+	case len(cond.Any) > 0:
+		for _, sub := range cond.Any {
+			s, err := c.condition(sub)
+			if err != nil {
+				return nil, err
+			}
+			cc.any = append(cc.any, s)
+		}
+	case cond.Not != nil:
+		s, err := c.condition(cond.Not)
+		if err != nil {
+			return nil, err
+		}
+		cc.not = s
+	case cond.Field != "":
+		if err := c.fieldTest(cc); err != nil {
+			return nil, fmt.Errorf("field %q: %w", cond.Field, err)
+		}
+	case cond.AccountAge != nil:
+		if cond.AccountAge.LessThan == 0 && cond.AccountAge.MoreThan == 0 {
+			return nil, fmt.Errorf("account_age needs less_than or more_than")
+		}
+	case cond.PostingRate != nil:
+		spec, err := rateOf(cond.PostingRate)
+		if err != nil {
+			return nil, fmt.Errorf("posting_rate: %w", err)
+		}
+		c.didRates[spec] = true
+	case cond.IPRate != nil:
+		spec, err := rateOf(cond.IPRate)
+		if err != nil {
+			return nil, fmt.Errorf("ip_rate: %w", err)
+		}
+		c.ipRates[spec] = true
+	case cond.TextFanout != nil:
+		spec, err := fanoutOf(cond.TextFanout)
+		if err != nil {
+			return nil, fmt.Errorf("text_fanout: %w", err)
+		}
+		c.fanouts[spec] = true
+	case cond.ProfileChanges != nil:
+		if err := checkProfileChanges(cond.ProfileChanges); err != nil {
+			return nil, fmt.Errorf("profile_changes: %w", err)
+		}
+	case cond.Parent != nil:
+		s, err := c.condition(cond.Parent)
+		if err != nil {
+			return nil, fmt.Errorf("parent: %w", err)
+		}
+		cc.parent = s
+	case cond.Root != nil:
+		s, err := c.condition(cond.Root)
+		if err != nil {
+			return nil, fmt.Errorf("root: %w", err)
+		}
+		cc.root = s
+	}
+	return cc, nil
+}
+
+func (c *compiler) fieldTest(cc *compiledCondition) error {
+	n := 0
+	for _, set := range []bool{
+		cc.Equals != nil,
+		cc.Contains != "",
+		cc.Matches != "",
+		cc.MatchesSet != "",
+		cc.Exists != nil,
+	} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return fmt.Errorf("must have exactly one of equals, contains, matches, matches_set or exists")
+	}
+
+	switch {
+	case cc.Contains != "":
+		cc.contains = strings.ToLower(c.normalize.Apply(cc.Contains))
+	case cc.Matches != "":
+		re, err := regexp.Compile(cc.Matches)
+		if err != nil {
+			return err
+		}
+		cc.regexes = []*regexp.Regexp{re}
+	case cc.MatchesSet != "":
+		set, ok := c.sets[cc.MatchesSet]
+		if !ok {
+			return fmt.Errorf("unknown regex set %q", cc.MatchesSet)
+		}
+		cc.regexes = set
+	}
+	return nil
+}
+
+func rateOf(pr *PostingRate) (rateSpec, error) {
+	if pr.Window <= 0 {
+		return rateSpec{}, fmt.Errorf("needs a window")
+	}
+	col := pr.Collection
+	if col == "" {
+		col = DefaultRateCollection
+	}
+	return rateSpec{collection: col, window: pr.Window}, nil
+}
+
+func fanoutOf(tf *TextFanout) (fanoutSpec, error) {
+	if tf.Window <= 0 {
+		return fanoutSpec{}, fmt.Errorf("needs a window")
+	}
+	field := tf.Field
+	if field == "" {
+		field = DefaultFanoutField
+	}
+	return fanoutSpec{field: field, window: tf.Window, minLength: tf.MinLength}, nil
+}
+
+func checkProfileChanges(pc *ProfileChanges) error {
+	if pc.Window <= 0 {
+		return fmt.Errorf("needs a window")
+	}
+	switch pc.Field {
+	case "", ProfileFieldDisplayName, ProfileFieldAvatar, ProfileFieldDescription:
+		return nil
+	default:
+		return fmt.Errorf("unknown field %q (expected display_name, avatar or description)", pc.Field)
+	}
+}
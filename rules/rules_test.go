@@ -0,0 +1,655 @@
+package rules
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+)
+
+const testRules = `
+regex_sets:
+  crypto:
+    - '(?i)\bairdrop\b'
+    - '(?i)free (btc|eth)'
+rules:
+  - name: new-account-crypto
+    collections: [app.bsky.feed.post]
+    when:
+      all:
+        - field: text
+          matches_set: crypto
+        - account_age: {less_than: 72h}
+    actions:
+      - label: spam
+      - report: {reason_type: "com.atproto.moderation.defs#reasonSpam", reason: crypto spam}
+  - name: crypto
+    collections: [app.bsky.feed.post]
+    when:
+      field: text
+      matches_set: crypto
+    actions:
+      - flag: crypto
+  - name: bad-link
+    when:
+      any:
+        - field: embed.external.uri
+          contains: "EVIL.example"
+        - field: facets.features.uri
+          matches: '^https://evil\.example/'
+    actions:
+      - label: "repo:bad-links"
+  - name: flood
+    when:
+      all:
+        - posting_rate: {window: 10m, more_than: 3}
+        - not:
+            account_age: {more_than: 8760h}
+    actions:
+      - escalate: takedown
+  - name: named
+    collections: [app.bsky.actor.profile]
+    when:
+      field: displayName
+      exists: true
+    actions:
+      - flag: named
+`
+
+func testEngine(t *testing.T) *Engine {
+	t.Helper()
+	rs, err := ParseRuleSet([]byte(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewEngine(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func postEvent(t *testing.T, post *appbsky.FeedPost, created, now time.Time) *Event {
+	t.Helper()
+	fields, err := RecordFields(post)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Event{
+		Did:            "did:plc:alice",
+		Action:         "create",
+		Collection:     "app.bsky.feed.post",
+		Record:         fields,
+		AccountCreated: created,
+		Time:           now,
+	}
+}
+
+func (ev *Event) withDid(did string) *Event {
+	ev.Did = did
+	return ev
+}
+
+func TestEvaluate(t *testing.T) {
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	old := now.Add(-24 * 400 * time.Hour)
+	young := now.Add(-time.Hour)
+
+	cases := []struct {
+		name    string
+		post    *appbsky.FeedPost
+		created time.Time
+		rules   []string
+	}{
+		{"boring", &appbsky.FeedPost{Text: "hello world"}, young, nil},
+		{"crypto from a new account", &appbsky.FeedPost{Text: "AIRDROP today"}, young, []string{"new-account-crypto", "crypto"}},
+		{"crypto from an old account", &appbsky.FeedPost{Text: "free btc"}, old, []string{"crypto"}},
+		{"crypto from an unknown account", &appbsky.FeedPost{Text: "free eth"}, time.Time{}, []string{"crypto"}},
+		{"words containing the keyword", &appbsky.FeedPost{Text: "airdropped"}, young, nil},
+		{
+			"external embed",
+			&appbsky.FeedPost{
+				Text: "look",
+				Embed: &appbsky.FeedPost_Embed{EmbedExternal: &appbsky.EmbedExternal{
+					External: &appbsky.EmbedExternal_External{Uri: "https://evil.example/x"},
+				}},
+			},
+			old,
+			[]string{"bad-link"},
+		},
+		{
+			"link facet",
+			&appbsky.FeedPost{
+				Text: "look",
+				Facets: []*appbsky.RichtextFacet{
+					{Features: []*appbsky.RichtextFacet_Features_Elem{
+						{RichtextFacet_Mention: &appbsky.RichtextFacet_Mention{Did: "did:plc:bob"}},
+					}},
+					{Features: []*appbsky.RichtextFacet_Features_Elem{
+						{RichtextFacet_Link: &appbsky.RichtextFacet_Link{Uri: "https://evil.example/y"}},
+					}},
+				},
+			},
+			old,
+			[]string{"bad-link"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// a fresh engine each time, so the posts do not add up to a flood
+			e := testEngine(t)
+			res, err := e.Evaluate(context.Background(), postEvent(t, c.post, c.created, now))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(res.Rules, c.rules) {
+				t.Fatalf("expected rules %v, got %v", c.rules, res.Rules)
+			}
+		})
+	}
+}
+
+func TestActions(t *testing.T) {
+	e := testEngine(t)
+	now := time.Now()
+
+	res, err := e.Evaluate(context.Background(), postEvent(t, &appbsky.FeedPost{Text: "airdrop"}, now.Add(-time.Hour), now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, a := range res.Actions {
+		kinds = append(kinds, a.Rule+":"+a.Kind())
+	}
+	expected := []string{"new-account-crypto:label", "new-account-crypto:report", "crypto:flag"}
+	if !reflect.DeepEqual(kinds, expected) {
+		t.Fatalf("expected actions %v, got %v", expected, kinds)
+	}
+	if labels := res.Labels(); !reflect.DeepEqual(labels, []string{"spam"}) {
+		t.Fatalf("expected spam label, got %v", labels)
+	}
+	if r := res.Actions[1].Report; r.ReasonType != "com.atproto.moderation.defs#reasonSpam" || r.Reason != "crypto spam" {
+		t.Fatalf("unexpected report %+v", r)
+	}
+}
+
+func TestPostingRate(t *testing.T) {
+	e := testEngine(t)
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	created := start.Add(-time.Hour)
+
+	eval := func(ev *Event) []string {
+		t.Helper()
+		res, err := e.Evaluate(context.Background(), ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.Rules
+	}
+	post := func(at time.Time) []string {
+		return eval(postEvent(t, &appbsky.FeedPost{Text: "hi"}, created, at))
+	}
+
+	for i := 0; i < 3; i++ {
+		if rules := post(start.Add(time.Duration(i) * time.Minute)); rules != nil {
+			t.Fatalf("post %d: expected no rules, got %v", i, rules)
+		}
+	}
+	if rules := post(start.Add(3 * time.Minute)); !reflect.DeepEqual(rules, []string{"flood"}) {
+		t.Fatalf("expected a flood, got %v", rules)
+	}
+
+	// updates are not counted
+	ev := postEvent(t, &appbsky.FeedPost{Text: "hi"}, created, start.Add(4*time.Minute))
+	ev.Action = "update"
+	if rules := eval(ev); !reflect.DeepEqual(rules, []string{"flood"}) {
+		t.Fatalf("expected the flood to go on, got %v", rules)
+	}
+
+	// nor are other accounts
+	ev = postEvent(t, &appbsky.FeedPost{Text: "hi"}, created, start.Add(4*time.Minute))
+	ev.Did = "did:plc:bob"
+	if rules := eval(ev); rules != nil {
+		t.Fatalf("expected no rules for another account, got %v", rules)
+	}
+
+	// the first posts fall out of the window
+	if rules := post(start.Add(11*time.Minute + 30*time.Second)); rules != nil {
+		t.Fatalf("expected the flood to be over, got %v", rules)
+	}
+}
+
+func TestVelocities(t *testing.T) {
+	rs, err := ParseRuleSet([]byte(`
+rules:
+  - name: busy-ip
+    when:
+      ip_rate: {window: 1h, more_than: 2, collection: app.bsky.graph.follow}
+    actions:
+      - flag: busy-ip
+  - name: copypasta
+    collections: [app.bsky.feed.post]
+    when:
+      text_fanout: {window: 1h, more_than: 2, min_length: 5}
+    actions:
+      - label: spam
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewEngine(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	eval := func(ev *Event) []string {
+		t.Helper()
+		res, err := e.Evaluate(ctx, ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.Rules
+	}
+
+	// follows from the same IP add up, whichever account they are from
+	for i, did := range []string{"did:plc:a", "did:plc:b", "did:plc:c"} {
+		rules := eval(&Event{Did: did, Action: "create", Collection: "app.bsky.graph.follow", IP: "10.0.0.1", Time: now})
+		if i < 2 && rules != nil {
+			t.Fatalf("follow %d: expected no rules, got %v", i, rules)
+		}
+		if i == 2 && !reflect.DeepEqual(rules, []string{"busy-ip"}) {
+			t.Fatalf("expected a busy IP, got %v", rules)
+		}
+	}
+	if rules := eval(&Event{Did: "did:plc:d", Action: "create", Collection: "app.bsky.graph.follow", IP: "10.0.0.2", Time: now}); rules != nil {
+		t.Fatalf("expected no rules for another IP, got %v", rules)
+	}
+	if rules := eval(&Event{Did: "did:plc:d", Action: "create", Collection: "app.bsky.graph.follow", Time: now}); rules != nil {
+		t.Fatalf("expected no rules without an IP, got %v", rules)
+	}
+
+	// the same text from different accounts, but not the same account
+	// over and over
+	post := func(did, text string) []string {
+		return eval(postEvent(t, &appbsky.FeedPost{Text: text}, time.Time{}, now).withDid(did))
+	}
+	for i := 0; i < 3; i++ {
+		if rules := post("did:plc:a", "Buy my stuff"); rules != nil {
+			t.Fatalf("repeat %d: expected no rules, got %v", i, rules)
+		}
+	}
+	if rules := post("did:plc:b", "buy my   STUFF"); rules != nil {
+		t.Fatalf("expected no rules for a second account, got %v", rules)
+	}
+	if rules := post("did:plc:c", "buy my stuff"); !reflect.DeepEqual(rules, []string{"copypasta"}) {
+		t.Fatalf("expected copypasta, got %v", rules)
+	}
+
+	// short texts are not counted
+	for _, did := range []string{"did:plc:a", "did:plc:b", "did:plc:c", "did:plc:d"} {
+		if rules := post(did, "gm"); rules != nil {
+			t.Fatalf("expected no rules for a short text, got %v", rules)
+		}
+	}
+}
+
+func TestWants(t *testing.T) {
+	e := testEngine(t)
+	if !e.Wants("app.bsky.graph.follow") {
+		t.Fatal("rules for all collections should want follows")
+	}
+
+	rs, err := ParseRuleSet([]byte(`
+rules:
+  - name: named
+    collections: [app.bsky.actor.profile]
+    when:
+      all:
+        - field: displayName
+          exists: true
+        - posting_rate: {window: 1h, more_than: 10}
+    actions:
+      - flag: busy
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err = NewEngine(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for col, want := range map[string]bool{
+		"app.bsky.actor.profile": true,
+		"app.bsky.feed.post":     true,
+		"app.bsky.graph.follow":  false,
+	} {
+		if e.Wants(col) != want {
+			t.Errorf("Wants(%q) should be %v", col, want)
+		}
+	}
+}
+
+// fakeProfiles is a profile history of the times each field of an account's
+// profile changed
+type fakeProfiles map[string]map[string][]time.Time
+
+func (fp fakeProfiles) ProfileChanges(ctx context.Context, did, field string, since time.Time) (int, error) {
+	n := 0
+	for f, times := range fp[did] {
+		if field != "" && f != field {
+			continue
+		}
+		for _, t := range times {
+			if !t.Before(since) {
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+func TestProfileChanges(t *testing.T) {
+	rs, err := ParseRuleSet([]byte(`
+rules:
+  - name: renamed
+    when:
+      profile_changes: {window: 1h, more_than: 2, field: display_name}
+    actions:
+      - flag: renamed
+  - name: restless
+    when:
+      profile_changes: {window: 10m, more_than: 3}
+    actions:
+      - flag: restless
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewEngine(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	eval := func(did string) []string {
+		t.Helper()
+		res, err := e.Evaluate(context.Background(), postEvent(t, &appbsky.FeedPost{Text: "hi"}, now, now).withDid(did))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.Rules
+	}
+
+	// without a history, nothing matches
+	if rules := eval("did:plc:alice"); rules != nil {
+		t.Fatalf("expected no rules without a profile history, got %v", rules)
+	}
+
+	ago := func(d time.Duration) time.Time { return now.Add(-d) }
+	e.SetProfileHistory(fakeProfiles{
+		"did:plc:alice": {
+			ProfileFieldDisplayName: {ago(50 * time.Minute), ago(30 * time.Minute), ago(time.Minute)},
+		},
+		"did:plc:bob": {
+			ProfileFieldDisplayName: {ago(2 * time.Hour), ago(90 * time.Minute), ago(time.Minute)},
+			ProfileFieldAvatar:      {ago(5 * time.Minute), ago(4 * time.Minute), ago(3 * time.Minute)},
+		},
+	})
+
+	for did, want := range map[string][]string{
+		"did:plc:alice": {"renamed"},
+		"did:plc:bob":   {"restless"},
+		"did:plc:carol": nil,
+	} {
+		if rules := eval(did); !reflect.DeepEqual(rules, want) {
+			t.Errorf("%s: expected %v, got %v", did, want, rules)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	rs, err := ParseRuleSet([]byte(`
+regex_sets:
+  crypto:
+    - '(?i)\bairdrop\b'
+normalize: [zero_width, nfkc, confusables, leetspeak]
+rules:
+  - name: crypto
+    when: {field: text, matches_set: crypto}
+    actions: [{flag: crypto}]
+  - name: scam
+    when: {field: text, contains: "$CAM"}
+    actions: [{flag: scam}]
+  - name: exact
+    when: {field: text, equals: "1337"}
+    actions: [{flag: exact}]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewEngine(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	for text, want := range map[string][]string{
+		"free ａｉｒｄｒｏｐ":        {"crypto"},
+		"free a\u200birdrop":  {"crypto"},
+		"free аirdrоp":        {"crypto"},
+		"4irdr0p, not a sc4m": {"crypto", "scam"},
+		"airdropping soon":    nil,
+		// equals is exact
+		"1337": {"exact"},
+		"ieet": nil,
+	} {
+		res, err := e.Evaluate(context.Background(), postEvent(t, &appbsky.FeedPost{Text: text}, now, now))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(res.Rules, want) {
+			t.Errorf("%q: expected %v, got %v", text, want, res.Rules)
+		}
+	}
+}
+
+// fakeThread is a thread context of the posts at some URIs, counting the
+// lookups of each
+type fakeThread struct {
+	posts   map[string]*appbsky.FeedPost
+	lookups map[string]int
+}
+
+func (ft *fakeThread) Post(ctx context.Context, uri string) (*Post, error) {
+	ft.lookups[uri]++
+	post, ok := ft.posts[uri]
+	if !ok {
+		return nil, nil
+	}
+	fields, err := RecordFields(post)
+	if err != nil {
+		return nil, err
+	}
+	return &Post{Uri: uri, Cid: "bafyreia", Record: fields}, nil
+}
+
+func TestThreadConditions(t *testing.T) {
+	rs, err := ParseRuleSet([]byte(`
+rules:
+  - name: reply-to-target
+    collections: [app.bsky.feed.post]
+    when:
+      all:
+        - field: text
+          contains: loser
+        - parent:
+            field: text
+            contains: announcement
+    actions:
+      - flag: harassment
+  - name: deep-in-thread
+    when:
+      root:
+        all:
+          - field: text
+            contains: survivor
+          - not: {field: reply, exists: true}
+    actions:
+      - flag: sensitive-thread
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewEngine(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := "at://did:plc:target/app.bsky.feed.post/1"
+	parent := "at://did:plc:target/app.bsky.feed.post/2"
+	missing := "at://did:plc:gone/app.bsky.feed.post/3"
+	ft := &fakeThread{
+		posts: map[string]*appbsky.FeedPost{
+			root:   {Text: "a survivor story"},
+			parent: {Text: "an announcement", Reply: &appbsky.FeedPost_ReplyRef{Root: &comatproto.RepoStrongRef{Uri: root}, Parent: &comatproto.RepoStrongRef{Uri: root}}},
+		},
+		lookups: make(map[string]int),
+	}
+	reply := func(to, top string) *appbsky.FeedPost_ReplyRef {
+		return &appbsky.FeedPost_ReplyRef{Parent: &comatproto.RepoStrongRef{Uri: to}, Root: &comatproto.RepoStrongRef{Uri: top}}
+	}
+
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	eval := func(post *appbsky.FeedPost) []string {
+		t.Helper()
+		res, err := e.Evaluate(context.Background(), postEvent(t, post, now, now))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.Rules
+	}
+
+	// without a thread context, nothing matches
+	if rules := eval(&appbsky.FeedPost{Text: "loser", Reply: reply(parent, root)}); rules != nil {
+		t.Fatalf("expected no rules without a thread context, got %v", rules)
+	}
+
+	e.SetThreadContext(ft)
+	cases := []struct {
+		name string
+		post *appbsky.FeedPost
+		want []string
+	}{
+		{"not a reply", &appbsky.FeedPost{Text: "loser"}, nil},
+		{"reply to target", &appbsky.FeedPost{Text: "loser", Reply: reply(parent, root)}, []string{"reply-to-target", "deep-in-thread"}},
+		{"polite reply", &appbsky.FeedPost{Text: "congrats", Reply: reply(parent, root)}, []string{"deep-in-thread"}},
+		{"reply to root", &appbsky.FeedPost{Text: "loser", Reply: reply(root, root)}, []string{"deep-in-thread"}},
+		{"missing parent", &appbsky.FeedPost{Text: "loser", Reply: reply(missing, missing)}, nil},
+	}
+	for _, c := range cases {
+		if rules := eval(c.post); !reflect.DeepEqual(rules, c.want) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.want, rules)
+		}
+	}
+
+	// posts are only looked up once the rest of the condition passes, so the
+	// polite reply never needed its parent
+	if n := ft.lookups[parent]; n != 1 {
+		t.Errorf("expected 1 lookup of the parent, got %d", n)
+	}
+}
+
+func TestInvalidRules(t *testing.T) {
+	cases := map[string]string{
+		"no name": `
+rules:
+  - when: {field: text, exists: true}
+    actions: [{flag: x}]`,
+		"no actions": `
+rules:
+  - name: a
+    when: {field: text, exists: true}`,
+		"two tests": `
+rules:
+  - name: a
+    when: {field: text, exists: true, contains: x}
+    actions: [{flag: x}]`,
+		"two kinds of condition": `
+rules:
+  - name: a
+    when: {field: text, exists: true, account_age: {less_than: 1h}}
+    actions: [{flag: x}]`,
+		"unknown regex set": `
+rules:
+  - name: a
+    when: {field: text, matches_set: nope}
+    actions: [{flag: x}]`,
+		"bad regex": `
+rules:
+  - name: a
+    when: {field: text, matches: "("}
+    actions: [{flag: x}]`,
+		"two actions in one": `
+rules:
+  - name: a
+    when: {field: text, exists: true}
+    actions: [{flag: x, label: y}]`,
+		"unknown escalation": `
+rules:
+  - name: a
+    when: {field: text, exists: true}
+    actions: [{escalate: exile}]`,
+		"duplicate names": `
+rules:
+  - name: a
+    when: {field: text, exists: true}
+    actions: [{flag: x}]
+  - name: a
+    when: {field: text, exists: true}
+    actions: [{flag: y}]`,
+		"no window": `
+rules:
+  - name: a
+    when: {posting_rate: {more_than: 1}}
+    actions: [{flag: x}]`,
+		"unknown profile field": `
+rules:
+  - name: a
+    when: {profile_changes: {window: 1h, more_than: 1, field: banner}}
+    actions: [{flag: x}]`,
+		"unknown normalization": `
+normalize: [nfkc, rot13]
+rules:
+  - name: a
+    when: {field: text, contains: x}
+    actions: [{flag: x}]`,
+		"invalid parent": `
+rules:
+  - name: a
+    when: {parent: {field: text}}
+    actions: [{flag: x}]`,
+		"profile changes with no window": `
+rules:
+  - name: a
+    when: {profile_changes: {more_than: 1}}
+    actions: [{flag: x}]`,
+	}
+
+	for name, y := range cases {
+		rs, err := ParseRuleSet([]byte(strings.TrimSpace(y)))
+		if err != nil {
+			t.Errorf("%s: failed to parse: %s", name, err)
+			continue
+		}
+		if _, err := NewEngine(rs); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
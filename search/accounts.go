@@ -0,0 +1,234 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/identity"
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+// account statuses, as sent in #account events. The content of accounts
+// with any status but active is removed from the index.
+const (
+	AccountStatusActive      = ""
+	AccountStatusDeactivated = "deactivated"
+	AccountStatusSuspended   = "suspended"
+	AccountStatusTakendown   = "takendown"
+	AccountStatusDeleted     = "deleted"
+)
+
+var reconcileBatchSize = 100
+
+// setAccountStatus records a change in the status of an account, removing
+// its documents when it stops being active, and indexing its repo again
+// when it is reactivated
+func (s *Server) setAccountStatus(ctx context.Context, did, status string) error {
+	u, err := s.getOrCreateUser(ctx, did)
+	if err != nil {
+		return err
+	}
+	if u.Status == status {
+		return nil
+	}
+
+	log.Infow("account status changed", "did", did, "from", u.Status, "to", status)
+	if err := s.db.Model(User{}).Where("id = ?", u.ID).Update("status", status).Error; err != nil {
+		return err
+	}
+
+	// the cached user may be in use by other indexer workers, so it is
+	// replaced rather than changed
+	nu := *u
+	nu.Status = status
+	s.userCache.Add(did, &nu)
+
+	if !nu.Active() {
+		return s.removeAccount(ctx, &nu)
+	}
+	return s.indexRepo(ctx, &nu, "")
+}
+
+// removeAccount removes everything indexed for u
+func (s *Server) removeAccount(ctx context.Context, u *User) error {
+	if err := s.backend.DeleteAccount(ctx, u); err != nil {
+		return fmt.Errorf("removing documents of %s: %w", u.Did, err)
+	}
+	if err := s.db.Unscoped().Where("uid = ?", u.ID).Delete(&PostRef{}).Error; err != nil {
+		return err
+	}
+	return s.db.Where("uid = ?", u.ID).Delete(&Follow{}).Error
+}
+
+// AccountChecker looks up the current status of an account for the
+// reconciler, as one of the AccountStatus values
+type AccountChecker interface {
+	AccountStatus(ctx context.Context, did string) (string, error)
+}
+
+// SetAccountChecker replaces the default checking of account statuses
+// against the BGS
+func (s *Server) SetAccountChecker(c AccountChecker) {
+	s.accountChecker = c
+}
+
+// syncAccountChecker checks accounts by fetching the head of their repo,
+// which fails with an error naming the status of inactive accounts
+type syncAccountChecker struct {
+	xrpcc *xrpc.Client
+}
+
+var accountStatusErrors = map[string]string{
+	"RepoDeactivated": AccountStatusDeactivated,
+	"RepoSuspended":   AccountStatusSuspended,
+	"RepoTakendown":   AccountStatusTakendown,
+	"RepoDeleted":     AccountStatusDeleted,
+}
+
+func (c *syncAccountChecker) AccountStatus(ctx context.Context, did string) (string, error) {
+	_, err := comatproto.SyncGetHead(ctx, c.xrpcc, did)
+	if err == nil {
+		return AccountStatusActive, nil
+	}
+
+	var xe *xrpc.XRPCError
+	if errors.As(err, &xe) {
+		if status, ok := accountStatusErrors[xe.ErrStr]; ok {
+			return status, nil
+		}
+	}
+	return "", err
+}
+
+// HandleChecker looks up the current handle of an account for the
+// reconciler, which is empty if the account has no handle resolving back to
+// it. Errors are for failures to find out, not for missing handles.
+type HandleChecker interface {
+	AccountHandle(ctx context.Context, did string) (string, error)
+}
+
+// SetHandleChecker replaces the default resolving of account handles with
+// the server's identity resolver
+func (s *Server) SetHandleChecker(c HandleChecker) {
+	s.handleChecker = c
+}
+
+// resolverHandleChecker checks handles with an identity resolver, which only
+// gives handles that resolve back to the DID
+type resolverHandleChecker struct {
+	dir *identity.Resolver
+}
+
+func (c *resolverHandleChecker) AccountHandle(ctx context.Context, did string) (string, error) {
+	ident := c.dir.Resolve(ctx, did)
+	if ident.Err != nil {
+		return "", ident.Err
+	}
+	return ident.Handle, nil
+}
+
+// RunReconciler checks the status and handle of every account in the index
+// each interval, to catch changes the indexer missed, and removes anything
+// indexed for inactive accounts since they were removed
+func (s *Server) RunReconciler(ctx context.Context, interval time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+
+		if err := s.reconcileAccounts(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Errorw("failed to reconcile accounts", "err", err)
+		}
+	}
+}
+
+func (s *Server) reconcileAccounts(ctx context.Context) error {
+	start := time.Now()
+	var checked, changed, failed int
+
+	var lastID uint
+	for {
+		var users []User
+		if err := s.db.WithContext(ctx).Where("id > ?", lastID).Order("id").Limit(reconcileBatchSize).Find(&users).Error; err != nil {
+			return err
+		}
+		if len(users) == 0 {
+			break
+		}
+
+		for i := range users {
+			u := &users[i]
+			lastID = u.ID
+
+			status, err := s.accountChecker.AccountStatus(ctx, u.Did)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				log.Debugw("failed to check account status", "did", u.Did, "err", err)
+				failed++
+				continue
+			}
+			checked++
+
+			switch {
+			case status != u.Status:
+				changed++
+				err = s.setAccountStatus(ctx, u.Did, status)
+			case !u.Active():
+				err = s.removeAccount(ctx, u)
+			}
+			if err != nil {
+				log.Warnw("failed to reconcile account", "did", u.Did, "status", status, "err", err)
+				failed++
+			}
+
+			if status == AccountStatusActive && s.handleChecker != nil {
+				hchanged, err := s.reconcileHandle(ctx, u)
+				if err != nil {
+					if ctx.Err() != nil {
+						return ctx.Err()
+					}
+					log.Debugw("failed to reconcile account handle", "did", u.Did, "err", err)
+					failed++
+				} else if hchanged {
+					changed++
+				}
+			}
+		}
+	}
+
+	log.Infow("reconciled accounts", "checked", checked, "changed", changed, "failed", failed, "took", time.Since(start))
+	return nil
+}
+
+// reconcileHandle updates the handle of u if it no longer matches the one the
+// handle checker finds, reporting whether it did
+func (s *Server) reconcileHandle(ctx context.Context, u *User) (bool, error) {
+	handle, err := s.handleChecker.AccountHandle(ctx, u.Did)
+	if err != nil {
+		return false, err
+	}
+
+	// u is as it was when the batch was read, which an earlier account in
+	// the batch may have taken the handle from since
+	cur, err := s.getOrCreateUser(ctx, u.Did)
+	if err != nil {
+		return false, err
+	}
+	if handle == cur.Handle {
+		return false, nil
+	}
+	return true, s.updateUserHandle(ctx, u.Did, handle)
+}
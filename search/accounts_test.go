@@ -0,0 +1,222 @@
+package search
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	bsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/xrpc"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/ipfs/go-cid"
+	"gorm.io/driver/sqlite"
+	gorm "gorm.io/gorm"
+)
+
+func TestSyncAccountChecker(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("did") {
+		case "did:plc:active":
+			w.Write([]byte(`{"root":"bafyreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm"}`))
+		case "did:plc:takendown":
+			w.WriteHeader(400)
+			w.Write([]byte(`{"error":"RepoTakendown","message":"repo has been taken down"}`))
+		default:
+			w.WriteHeader(400)
+			w.Write([]byte(`{"error":"RepoNotFound","message":"no such repo"}`))
+		}
+	}))
+	defer srv.Close()
+
+	c := &syncAccountChecker{xrpcc: &xrpc.Client{Host: srv.URL}}
+	ctx := context.Background()
+
+	if st, err := c.AccountStatus(ctx, "did:plc:active"); err != nil || st != AccountStatusActive {
+		t.Errorf("expected active account, got %q, %v", st, err)
+	}
+	if st, err := c.AccountStatus(ctx, "did:plc:takendown"); err != nil || st != AccountStatusTakendown {
+		t.Errorf("expected taken down account, got %q, %v", st, err)
+	}
+	if _, err := c.AccountStatus(ctx, "did:plc:broken"); err == nil {
+		t.Error("expected other errors to be returned")
+	}
+}
+
+// deleteRecorder is a Backend recording the accounts deleted from it, and
+// the handles updated in it
+type deleteRecorder struct {
+	Backend
+	deleted []string
+	handles map[string]string
+}
+
+func (b *deleteRecorder) UpdateHandle(ctx context.Context, u *User) error {
+	if b.handles == nil {
+		b.handles = make(map[string]string)
+	}
+	b.handles[u.Did] = u.Handle
+	return nil
+}
+
+func (b *deleteRecorder) DeleteAccount(ctx context.Context, u *User) error {
+	b.deleted = append(b.deleted, u.Did)
+	return nil
+}
+
+func (b *deleteRecorder) IndexPost(ctx context.Context, u *User, rec *bsky.FeedPost, tid string) error {
+	return nil
+}
+
+type staticAccountChecker map[string]string
+
+func (c staticAccountChecker) AccountStatus(ctx context.Context, did string) (string, error) {
+	return c[did], nil
+}
+
+func TestReconcileAccounts(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "palomar.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &deleteRecorder{}
+	ucache, _ := lru.New(10)
+	s := &Server{
+		db:        db,
+		backend:   backend,
+		userCache: ucache,
+		accountChecker: staticAccountChecker{
+			"did:plc:takendown": AccountStatusTakendown,
+			"did:plc:deleted":   AccountStatusDeleted,
+		},
+	}
+
+	for _, u := range []*User{
+		{Did: "did:plc:active"},
+		{Did: "did:plc:takendown"},
+		{Did: "did:plc:deleted", Status: AccountStatusDeleted},
+	} {
+		if err := db.Create(u).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := s.indexPost(ctx, u, &bsky.FeedPost{}, "app.bsky.feed.post/1", cid.MustParse("bafyreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.reconcileAccounts(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// taken down now, and swept again as it was already deleted
+	if len(backend.deleted) != 2 || backend.deleted[0] != "did:plc:takendown" || backend.deleted[1] != "did:plc:deleted" {
+		t.Fatalf("unexpected deleted accounts: %v", backend.deleted)
+	}
+
+	var u User
+	if err := db.First(&u, "did = ?", "did:plc:takendown").Error; err != nil {
+		t.Fatal(err)
+	}
+	if u.Active() || u.Status != AccountStatusTakendown {
+		t.Errorf("expected account to be marked taken down, got %q", u.Status)
+	}
+
+	var refs int64
+	if err := db.Model(&PostRef{}).Where("uid = ?", u.ID).Count(&refs).Error; err != nil {
+		t.Fatal(err)
+	}
+	if refs != 0 {
+		t.Errorf("expected post refs of the removed account to be gone, got %d", refs)
+	}
+}
+
+type staticHandleChecker map[string]string
+
+func (c staticHandleChecker) AccountHandle(ctx context.Context, did string) (string, error) {
+	return c[did], nil
+}
+
+func TestReconcileHandles(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "palomar.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &deleteRecorder{}
+	ucache, _ := lru.New(10)
+	s := &Server{
+		db:             db,
+		backend:        backend,
+		userCache:      ucache,
+		accountChecker: staticAccountChecker{},
+		handleChecker: staticHandleChecker{
+			"did:plc:alice": "alice.test",
+			"did:plc:bob":   "bob.test",
+			"did:plc:carol": "",
+		},
+	}
+
+	for _, u := range []*User{
+		{Did: "did:plc:alice", Handle: "bob.test"},
+		{Did: "did:plc:bob", Handle: "bob.example"},
+		{Did: "did:plc:carol", Handle: "alice.test"},
+	} {
+		if err := db.Create(u).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// bob's old handle is cached, and has to be replaced
+	if _, err := s.getOrCreateUser(ctx, "did:plc:bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.reconcileAccounts(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for did, handle := range map[string]string{
+		"did:plc:alice": "alice.test",
+		"did:plc:bob":   "bob.test",
+		"did:plc:carol": "",
+	} {
+		var u User
+		if err := db.First(&u, "did = ?", did).Error; err != nil {
+			t.Fatal(err)
+		}
+		if u.Handle != handle {
+			t.Errorf("expected %s to have handle %q, got %q", did, handle, u.Handle)
+		}
+		if backend.handles[did] != handle {
+			t.Errorf("expected %s to be indexed with handle %q, got %q", did, handle, backend.handles[did])
+		}
+		cu, err := s.getOrCreateUser(ctx, did)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cu.Handle != handle {
+			t.Errorf("expected cached %s to have handle %q, got %q", did, handle, cu.Handle)
+		}
+	}
+
+	// a handle given up by its account is tombstoned
+	if err := s.updateUserHandle(ctx, "did:plc:alice", "handle.invalid"); err != nil {
+		t.Fatal(err)
+	}
+	if backend.handles["did:plc:alice"] != "" {
+		t.Errorf("expected invalid handle to be cleared, got %q", backend.handles["did:plc:alice"])
+	}
+}
@@ -0,0 +1,57 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	bsky "github.com/bluesky-social/indigo/api/bsky"
+)
+
+// ErrUnsupportedQuery is returned by backends for searches using features
+// they do not implement
+var ErrUnsupportedQuery = errors.New("not supported by this search backend")
+
+// Backend stores the post and profile documents the indexer produces, and
+// searches them. Posts are identified by the uid of their author and their
+// repo path, and profiles by the uid alone; the Server keeps the users and
+// post CIDs in its own database.
+type Backend interface {
+	// EnsureIndices creates whatever the backend stores documents in, if it
+	// does not exist yet
+	EnsureIndices(ctx context.Context) error
+
+	IndexPost(ctx context.Context, u *User, rec *bsky.FeedPost, tid string) error
+	DeletePost(ctx context.Context, u *User, tid string) error
+	// IndexProfile indexes a profile for both profile and typeahead search
+	IndexProfile(ctx context.Context, u *User, rec *bsky.ActorProfile) error
+	// UpdateHandle updates the handle indexed for u, which may not have a
+	// profile indexed yet
+	UpdateHandle(ctx context.Context, u *User) error
+	// DeleteProfile removes u from profile and typeahead search
+	DeleteProfile(ctx context.Context, u *User) error
+	// DeleteAccount removes every document of u, for accounts that are no
+	// longer active
+	DeleteAccount(ctx context.Context, u *User) error
+
+	SearchPosts(ctx context.Context, pq *PostQuery, offset, size int) ([]PostHit, error)
+	SearchProfiles(ctx context.Context, q string, size int) ([]ProfileHit, error)
+	// SearchTypeahead finds accounts by a prefix of their handle or of a
+	// word of their display name, ranking those in boosts, a list of DIDs,
+	// first
+	SearchTypeahead(ctx context.Context, q string, boosts []string, size int) ([]*TypeaheadResult, error)
+}
+
+// PostHit is a post found by a search, with the document indexed for it
+type PostHit struct {
+	Uid uint
+	Tid string
+	Doc json.RawMessage
+}
+
+// ProfileHit is a profile found by a search, with the profile record as
+// JSON
+type ProfileHit struct {
+	Uid     uint
+	Profile json.RawMessage
+}
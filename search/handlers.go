@@ -2,6 +2,7 @@ package search
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
@@ -18,8 +19,7 @@ type ActorSearchResp struct {
 }
 
 func (s *Server) handleFromDid(ctx context.Context, did string) (string, error) {
-	phr := &api.ProdHandleResolver{}
-	handle, _, err := api.ResolveDidToHandle(ctx, s.xrpcc, s.plc, phr, did)
+	handle, _, err := api.ResolveDidToHandle(ctx, s.xrpcc, s.dir, s.dir, did)
 	if err != nil {
 		return "", err
 	}
@@ -64,7 +64,21 @@ func (s *Server) handleSearchRequestPosts(e echo.Context) error {
 		count = v
 	}
 
-	out, err := s.SearchPosts(ctx, q, offset, count)
+	pq, err := ParsePostQuery(q)
+	if err != nil {
+		return &echo.HTTPError{
+			Code:    400,
+			Message: fmt.Sprintf("invalid search query: %s", err),
+		}
+	}
+
+	out, err := s.SearchPostQuery(ctx, pq, offset, count)
+	if errors.Is(err, ErrUnsupportedQuery) || errors.Is(err, ErrUnresolvedHandle) {
+		return &echo.HTTPError{
+			Code:    400,
+			Message: fmt.Sprintf("invalid search query: %s", err),
+		}
+	}
 	if err != nil {
 		return err
 	}
@@ -90,3 +104,38 @@ func (s *Server) handleSearchRequestProfiles(e echo.Context) error {
 
 	return e.JSON(200, out)
 }
+
+func (s *Server) handleSearchRequestTypeahead(e echo.Context) error {
+	ctx, span := otel.Tracer("search").Start(e.Request().Context(), "handleSearchRequestTypeahead")
+	defer span.End()
+
+	q := strings.TrimSpace(e.QueryParam("q"))
+	if q == "" {
+		return e.JSON(400, map[string]any{
+			"error": "must pass non-empty search query",
+		})
+	}
+
+	limit := 10
+	if q := strings.TrimSpace(e.QueryParam("limit")); q != "" {
+		v, err := strconv.Atoi(q)
+		if err != nil || v < 1 || v > 100 {
+			return &echo.HTTPError{
+				Code:    400,
+				Message: fmt.Sprintf("invalid value for 'limit': %q", q),
+			}
+		}
+
+		limit = v
+	}
+
+	// the viewer is only used to rank results, so it is taken on trust
+	viewer := strings.TrimSpace(e.QueryParam("viewer"))
+
+	out, err := s.SearchTypeahead(ctx, q, viewer, limit)
+	if err != nil {
+		return err
+	}
+
+	return e.JSON(200, out)
+}
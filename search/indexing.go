@@ -5,29 +5,186 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	bsky "github.com/bluesky-social/indigo/api/bsky"
 	"github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/util/syntax"
 	"github.com/ipfs/go-cid"
 
+	es "github.com/opensearch-project/opensearch-go/v2"
 	esapi "github.com/opensearch-project/opensearch-go/v2/opensearchapi"
 )
 
+// postsSettings maps the fields the post query operators match as keywords,
+// which dynamic mapping would make text
+var postsSettings = map[string]any{
+	"mappings": map[string]any{
+		"properties": postProperties(),
+	},
+}
+
+// postProperties maps the fields of post documents, including the text
+// field of each language analyzer
+func postProperties() map[string]any {
+	props := languageTextMappings()
+	for k, v := range map[string]any{
+		"text":      map[string]any{"type": "text"},
+		"createdAt": map[string]any{"type": "long"},
+		"user":      map[string]any{"type": "text"},
+		"did":       map[string]any{"type": "keyword"},
+		"handle":    map[string]any{"type": "keyword"},
+		"mentions":  map[string]any{"type": "keyword"},
+		"has":       map[string]any{"type": "keyword"},
+		"langs":     map[string]any{"type": "keyword"},
+		"domains":   map[string]any{"type": "keyword"},
+		"tags":      map[string]any{"type": "keyword"},
+	} {
+		props[k] = v
+	}
+	return props
+}
+
+// indexSettings are the settings and mappings each index is created with.
+// Changes to them only apply to existing deployments once reindexed, see
+// StartReindex.
+var indexSettings = map[string]map[string]any{
+	"posts":        postsSettings,
+	"profiles":     {},
+	typeaheadIndex: typeaheadSettings,
+}
+
+// EnsureIndices creates the posts, profiles and typeahead indices, with
+// their mappings, if they do not exist. The posts index of an older palomar
+// has to be reindexed for the post query operators to work.
+func (b *OpenSearchBackend) EnsureIndices(ctx context.Context) error {
+	for _, index := range []string{"posts", "profiles", typeaheadIndex} {
+		if err := ensureIndex(ctx, b.escli, index, indexSettings[index]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EnsureIndices prepares the server's backend for indexing
+func (s *Server) EnsureIndices(ctx context.Context) error {
+	return s.backend.EnsureIndices(ctx)
+}
+
+func ensureIndex(ctx context.Context, escli *es.Client, index string, settings map[string]any) error {
+	res, err := esapi.IndicesExistsRequest{
+		Index: []string{index},
+	}.Do(ctx, escli)
+	if err != nil {
+		return fmt.Errorf("checking for %s index: %w", index, err)
+	}
+	res.Body.Close()
+	if res.StatusCode == 200 {
+		return nil
+	}
+
+	b, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("creating %s index", index)
+	res, err = esapi.IndicesCreateRequest{
+		Index: index,
+		Body:  bytes.NewReader(b),
+	}.Do(ctx, escli)
+	if err != nil {
+		return fmt.Errorf("creating %s index: %w", index, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("creating %s index: %s", index, res.String())
+	}
+
+	return nil
+}
+
 func (s *Server) deletePost(ctx context.Context, u *User, path string) error {
 	log.Infof("deleting post: %s", path)
-	req := esapi.DeleteRequest{
-		Index:      "posts",
-		DocumentID: encodeDocumentID(u.ID, path),
-		Refresh:    "true",
+	return s.backend.DeletePost(ctx, u, path)
+}
+
+func (b *OpenSearchBackend) DeletePost(ctx context.Context, u *User, tid string) error {
+	for _, index := range b.writeIndices("posts") {
+		req := esapi.DeleteRequest{
+			Index:      index,
+			DocumentID: encodeDocumentID(u.ID, tid),
+			Refresh:    "true",
+		}
+
+		res, err := req.Do(ctx, b.escli)
+		if err != nil {
+			return fmt.Errorf("failed to delete post: %w", err)
+		}
+
+		fmt.Println(res)
+	}
+
+	return nil
+}
+
+func (s *Server) deleteProfile(ctx context.Context, u *User) error {
+	log.Infof("deleting profile: %s", u.Did)
+	return s.backend.DeleteProfile(ctx, u)
+}
+
+func (b *OpenSearchBackend) DeleteProfile(ctx context.Context, u *User) error {
+	for _, index := range append(b.writeIndices("profiles"), b.writeIndices(typeaheadIndex)...) {
+		req := esapi.DeleteRequest{
+			Index:      index,
+			DocumentID: fmt.Sprint(u.ID),
+			Refresh:    "true",
+		}
+
+		res, err := req.Do(ctx, b.escli)
+		if err != nil {
+			return fmt.Errorf("failed to delete profile: %w", err)
+		}
+		res.Body.Close()
+		if res.IsError() && res.StatusCode != 404 {
+			return fmt.Errorf("deleting profile from %s: %s", index, res.String())
+		}
 	}
 
-	res, err := req.Do(ctx, s.escli)
+	return nil
+}
+
+func (b *OpenSearchBackend) DeleteAccount(ctx context.Context, u *User) error {
+	if err := b.DeleteProfile(ctx, u); err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"query": map[string]any{
+			"term": map[string]any{"did": u.Did},
+		},
+	})
 	if err != nil {
-		return fmt.Errorf("failed to delete post: %w", err)
+		return err
+	}
+
+	refresh := true
+	req := esapi.DeleteByQueryRequest{
+		Index:     b.writeIndices("posts"),
+		Body:      bytes.NewReader(body),
+		Conflicts: "proceed",
+		Refresh:   &refresh,
 	}
 
-	fmt.Println(res)
+	res, err := req.Do(ctx, b.escli)
+	if err != nil {
+		return fmt.Errorf("failed to delete posts: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("deleting posts of %s: %s", u.Did, res.String())
+	}
 
 	return nil
 }
@@ -41,95 +198,182 @@ func (s *Server) indexPost(ctx context.Context, u *User, rec *bsky.FeedPost, tid
 		return err
 	}
 
-	ts, err := time.Parse(util.ISO8601, rec.CreatedAt)
+	log.Infof("Indexing post")
+	return s.backend.IndexPost(ctx, u, rec, tid)
+}
+
+func (b *OpenSearchBackend) IndexPost(ctx context.Context, u *User, rec *bsky.FeedPost, tid string) error {
+	doc, err := openSearchPostDocument(u, rec, tid)
 	if err != nil {
-		return fmt.Errorf("post (%d, %s) had invalid timestamp (%q): %w", u.ID, tid, rec.CreatedAt, err)
+		return err
 	}
 
-	blob := map[string]any{
-		"text":      rec.Text,
-		"createdAt": ts.UnixNano(),
-		"user":      u.Handle,
+	for _, index := range b.writeIndices("posts") {
+		req := esapi.IndexRequest{
+			Index:      index,
+			DocumentID: encodeDocumentID(u.ID, tid),
+			Body:       bytes.NewReader(doc),
+			Refresh:    "true",
+		}
+
+		res, err := req.Do(ctx, b.escli)
+		if err != nil {
+			return fmt.Errorf("failed to send indexing request: %w", err)
+		}
+
+		fmt.Println(res)
 	}
-	b, err := json.Marshal(blob)
+
+	return nil
+}
+
+func postDocument(u *User, rec *bsky.FeedPost, tid string) ([]byte, error) {
+	blob, _, err := postFields(u, rec, tid)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return json.Marshal(blob)
+}
 
-	log.Infof("Indexing post")
-	req := esapi.IndexRequest{
-		Index:      "posts",
-		DocumentID: encodeDocumentID(u.ID, tid),
-		Body:       bytes.NewReader(b),
-		Refresh:    "true",
+// openSearchPostDocument is postDocument with the text repeated in the
+// field analyzed for the post's language
+func openSearchPostDocument(u *User, rec *bsky.FeedPost, tid string) ([]byte, error) {
+	blob, lang, err := postFields(u, rec, tid)
+	if err != nil {
+		return nil, err
+	}
+	if f := textField(lang); f != "" {
+		blob[f] = rec.Text
 	}
+	return json.Marshal(blob)
+}
 
-	res, err := req.Do(ctx, s.escli)
+// postFields returns the fields of the document for a post, and the
+// language of the post
+func postFields(u *User, rec *bsky.FeedPost, tid string) (map[string]any, string, error) {
+	ts, err := time.Parse(util.ISO8601, rec.CreatedAt)
 	if err != nil {
-		return fmt.Errorf("failed to send indexing request: %w", err)
+		return nil, "", fmt.Errorf("post (%d, %s) had invalid timestamp (%q): %w", u.ID, tid, rec.CreatedAt, err)
 	}
 
-	fmt.Println(res)
+	pf := extractPostFacets(rec)
+	lang, detected := postLanguage(rec)
+	if detected {
+		// so lang: finds untagged posts too
+		pf.Langs = []string{lang}
+	}
 
-	return nil
+	blob := map[string]any{
+		"text":      rec.Text,
+		"createdAt": ts.UnixNano(),
+		"user":      u.Handle,
+		"did":       u.Did,
+		"handle":    strings.ToLower(u.Handle),
+		"mentions":  pf.Mentions,
+		"has":       pf.Has,
+		"langs":     pf.Langs,
+		"domains":   pf.Domains,
+		"tags":      pf.Tags,
+	}
+	return blob, lang, nil
 }
 
 func (s *Server) indexProfile(ctx context.Context, u *User, rec *bsky.ActorProfile) error {
-	b, err := json.Marshal(rec)
-	if err != nil {
-		return err
-	}
-
 	n := ""
 	if rec.DisplayName != nil {
 		n = *rec.DisplayName
 	}
 
-	blob := map[string]string{
-		"displayName": n,
-		"handle":      u.Handle,
-		"did":         u.Did,
-	}
+	log.Infof("Indexing profile: %s", n)
+	return s.backend.IndexProfile(ctx, u, rec)
+}
 
-	if rec.Description != nil {
-		blob["description"] = *rec.Description
+func (b *OpenSearchBackend) IndexProfile(ctx context.Context, u *User, rec *bsky.ActorProfile) error {
+	doc, err := json.Marshal(rec)
+	if err != nil {
+		return err
 	}
 
-	log.Infof("Indexing profile: %s", n)
-	req := esapi.IndexRequest{
-		Index:      "profiles",
-		DocumentID: fmt.Sprint(u.ID),
-		Body:       bytes.NewReader(b),
-		Refresh:    "true",
-	}
+	for _, index := range b.writeIndices("profiles") {
+		req := esapi.IndexRequest{
+			Index:      index,
+			DocumentID: fmt.Sprint(u.ID),
+			Body:       bytes.NewReader(doc),
+			Refresh:    "true",
+		}
 
-	res, err := req.Do(context.Background(), s.escli)
-	if err != nil {
-		return fmt.Errorf("failed to send indexing request: %w", err)
+		res, err := req.Do(ctx, b.escli)
+		if err != nil {
+			return fmt.Errorf("failed to send indexing request: %w", err)
+		}
+		fmt.Println(res)
 	}
-	fmt.Println(res)
 
+	if err := b.indexTypeahead(ctx, u, rec); err != nil {
+		return fmt.Errorf("indexing typeahead: %w", err)
+	}
 	return nil
 }
 
+// updateUserHandle records a change in the handle of an account. Handles
+// are unique, so any other account still indexed with the handle has lost it.
+// The invalid handle, sent for accounts whose handle no longer verifies,
+// clears the account's handle.
 func (s *Server) updateUserHandle(ctx context.Context, did, handle string) error {
+	if handle == syntax.HandleInvalid {
+		handle = ""
+	}
+
 	u, err := s.getOrCreateUser(ctx, did)
 	if err != nil {
 		return err
 	}
 
+	if handle != "" {
+		var stale []User
+		if err := s.db.Where("handle = ? AND did != ?", handle, did).Find(&stale).Error; err != nil {
+			return err
+		}
+		for i := range stale {
+			if cu, ok := s.userCache.Get(stale[i].Did); ok {
+				stale[i] = *cu.(*User)
+			}
+			if err := s.setUserHandle(ctx, &stale[i], ""); err != nil {
+				return fmt.Errorf("clearing stale handle of %s: %w", stale[i].Did, err)
+			}
+		}
+	}
+
+	if u.Handle == handle {
+		return nil
+	}
+	return s.setUserHandle(ctx, u, handle)
+}
+
+// setUserHandle sets the handle of u, in the database, the user cache and the
+// backend
+func (s *Server) setUserHandle(ctx context.Context, u *User, handle string) error {
+	log.Infow("account handle changed", "did", u.Did, "from", u.Handle, "to", handle)
 	if err := s.db.Model(User{}).Where("id = ?", u.ID).Update("handle", handle).Error; err != nil {
 		return err
 	}
 
-	u.Handle = handle
+	// the cached user may be in use by other indexer workers, so it is
+	// replaced rather than changed
+	nu := *u
+	nu.Handle = handle
+	s.userCache.Add(u.Did, &nu)
+
+	return s.backend.UpdateHandle(ctx, &nu)
+}
 
-	b, err := json.Marshal(map[string]any{
+func (b *OpenSearchBackend) UpdateHandle(ctx context.Context, u *User) error {
+	body, err := json.Marshal(map[string]any{
 		"script": map[string]any{
 			"source": "ctx._source.handle = params.handle",
 			"lang":   "painless",
 			"params": map[string]any{
-				"handle": handle,
+				"handle": u.Handle,
 			},
 		},
 	})
@@ -137,18 +381,20 @@ func (s *Server) updateUserHandle(ctx context.Context, did, handle string) error
 		return err
 	}
 
-	req := esapi.UpdateRequest{
-		Index:      "profiles",
-		DocumentID: fmt.Sprint(u.ID),
-		Body:       bytes.NewReader(b),
-		Refresh:    "true",
-	}
+	for _, index := range b.writeIndices("profiles") {
+		req := esapi.UpdateRequest{
+			Index:      index,
+			DocumentID: fmt.Sprint(u.ID),
+			Body:       bytes.NewReader(body),
+			Refresh:    "true",
+		}
 
-	res, err := req.Do(context.Background(), s.escli)
-	if err != nil {
-		return fmt.Errorf("failed to send indexing request: %w", err)
+		res, err := req.Do(ctx, b.escli)
+		if err != nil {
+			return fmt.Errorf("failed to send indexing request: %w", err)
+		}
+		fmt.Println(res)
 	}
-	fmt.Println(res)
 
-	return nil
+	return b.updateTypeaheadHandle(ctx, u)
 }
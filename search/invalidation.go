@@ -0,0 +1,78 @@
+package search
+
+import (
+	"context"
+
+	"github.com/bluesky-social/indigo/util/invalidation"
+)
+
+// SetInvalidationBus has the handles and statuses of indexed accounts updated
+// as other services say they change, without waiting for the firehose or the
+// reconciler
+func (s *Server) SetInvalidationBus(b invalidation.Bus) {
+	b.Subscribe(s.handleInvalidation)
+}
+
+func (s *Server) handleInvalidation(ctx context.Context, m invalidation.Message) {
+	switch m.Kind {
+	case invalidation.KindIdentity:
+		if s.dir != nil {
+			if err := s.dir.PurgeDid(ctx, m.Did); err != nil {
+				log.Warnw("failed to purge cached identity", "did", m.Did, "err", err)
+			}
+		}
+		if s.sigVerifier != nil {
+			s.sigVerifier.Invalidate(ctx, m.Did)
+		}
+		if m.Handle == "" {
+			return
+		}
+
+		u, err := s.indexedUser(ctx, m.Did)
+		if err != nil || u == nil {
+			return
+		}
+		if err := s.updateUserHandle(ctx, m.Did, m.Handle); err != nil {
+			log.Warnw("failed to update handle", "did", m.Did, "handle", m.Handle, "err", err)
+		}
+
+	case invalidation.KindTakedown:
+		u, err := s.indexedUser(ctx, m.Did)
+		if err != nil || u == nil {
+			return
+		}
+
+		status := AccountStatusTakendown
+		if m.Reversed {
+			// only undo the takedown, the account may be inactive otherwise
+			if u.Status != AccountStatusTakendown {
+				return
+			}
+			status = ""
+		}
+
+		// removing or reindexing the account's documents takes a while
+		go func() {
+			if err := s.setAccountStatus(context.Background(), m.Did, status); err != nil {
+				log.Errorw("failed to apply takedown", "did", m.Did, "reversed", m.Reversed, "err", err)
+			}
+		}()
+	}
+}
+
+// indexedUser returns the indexed account with the DID, or nil if there
+// isn't one
+func (s *Server) indexedUser(ctx context.Context, did string) (*User, error) {
+	if cu, ok := s.userCache.Get(did); ok {
+		return cu.(*User), nil
+	}
+
+	var u User
+	if err := s.db.WithContext(ctx).Find(&u, "did = ?", did).Error; err != nil {
+		return nil, err
+	}
+	if u.ID == 0 {
+		return nil, nil
+	}
+	return &u, nil
+}
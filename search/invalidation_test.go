@@ -0,0 +1,66 @@
+package search
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/bluesky-social/indigo/util/invalidation"
+
+	lru "github.com/hashicorp/golang-lru"
+	"gorm.io/driver/sqlite"
+	gorm "gorm.io/gorm"
+)
+
+func TestInvalidationHandles(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "palomar.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &deleteRecorder{}
+	ucache, _ := lru.New(10)
+	s := &Server{
+		db:        db,
+		backend:   backend,
+		userCache: ucache,
+	}
+	if err := db.Create(&User{Did: "did:plc:alice", Handle: "alice.example"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	bus := invalidation.NewMemBus()
+	s.SetInvalidationBus(bus)
+
+	if err := bus.Publish(ctx, invalidation.IdentityChanged("pds", "did:plc:alice", "alice.test")); err != nil {
+		t.Fatal(err)
+	}
+	// accounts which aren't indexed are left alone
+	if err := bus.Publish(ctx, invalidation.IdentityChanged("pds", "did:plc:bob", "bob.test")); err != nil {
+		t.Fatal(err)
+	}
+
+	var u User
+	if err := db.First(&u, "did = ?", "did:plc:alice").Error; err != nil {
+		t.Fatal(err)
+	}
+	if u.Handle != "alice.test" {
+		t.Errorf("expected handle alice.test, got %q", u.Handle)
+	}
+	if backend.handles["did:plc:alice"] != "alice.test" {
+		t.Errorf("expected alice to be indexed with handle alice.test, got %q", backend.handles["did:plc:alice"])
+	}
+
+	var n int64
+	if err := db.Model(&User{}).Where("did = ?", "did:plc:bob").Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("expected bob not to be indexed, found %d users", n)
+	}
+}
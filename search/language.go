@@ -0,0 +1,141 @@
+package search
+
+import (
+	"sort"
+	"strings"
+
+	bsky "github.com/bluesky-social/indigo/api/bsky"
+
+	"github.com/abadojack/whatlanggo"
+)
+
+// languageAnalyzers are the OpenSearch analyzers posts are analyzed with
+// for each language, by ISO 639-1 code, on top of the standard analyzer
+// every post gets. The analyzer for a post's language gets a field of its
+// own, named by textField.
+var languageAnalyzers = map[string]string{
+	"ca": "catalan",
+	"cs": "czech",
+	"da": "danish",
+	"de": "german",
+	"el": "greek",
+	"en": "english",
+	"es": "spanish",
+	"fi": "finnish",
+	"fr": "french",
+	"hu": "hungarian",
+	"it": "italian",
+	"ja": "cjk",
+	"ko": "cjk",
+	"nb": "norwegian",
+	"nl": "dutch",
+	"nn": "norwegian",
+	"no": "norwegian",
+	"pt": "portuguese",
+	"ro": "romanian",
+	"ru": "russian",
+	"sv": "swedish",
+	"tr": "turkish",
+	"zh": "cjk",
+}
+
+// detection is limited to the languages there are analyzers for, which
+// also makes it more accurate for them. Catalan can only be tagged.
+var detectOptions = whatlanggo.Options{
+	Whitelist: map[whatlanggo.Lang]bool{
+		whatlanggo.Ces: true,
+		whatlanggo.Dan: true,
+		whatlanggo.Deu: true,
+		whatlanggo.Ell: true,
+		whatlanggo.Eng: true,
+		whatlanggo.Spa: true,
+		whatlanggo.Fin: true,
+		whatlanggo.Fra: true,
+		whatlanggo.Hun: true,
+		whatlanggo.Ita: true,
+		whatlanggo.Jpn: true,
+		whatlanggo.Kor: true,
+		whatlanggo.Nob: true,
+		whatlanggo.Nld: true,
+		whatlanggo.Por: true,
+		whatlanggo.Ron: true,
+		whatlanggo.Rus: true,
+		whatlanggo.Swe: true,
+		whatlanggo.Tur: true,
+		whatlanggo.Cmn: true,
+	},
+}
+
+// minDetectConfidence is the confidence below which a detected language is
+// ignored. Detection of short posts in Latin script is mostly a guess.
+const minDetectConfidence = 0.5
+
+// detectLanguage returns the ISO 639-1 code of the language text is in, or
+// "" if it can not be told
+func detectLanguage(text string) string {
+	info := whatlanggo.DetectWithOptions(text, detectOptions)
+	if info.Confidence < minDetectConfidence {
+		return ""
+	}
+	return info.Lang.Iso6391()
+}
+
+// postLanguage returns the language a post is analyzed as: the first it is
+// tagged with, or else the one detected from its text. detected is true in
+// the latter case.
+func postLanguage(rec *bsky.FeedPost) (lang string, detected bool) {
+	if len(rec.Langs) > 0 {
+		// the primary subtag, eg pt for pt-BR
+		tag, _, _ := strings.Cut(strings.ToLower(rec.Langs[0]), "-")
+		return tag, false
+	}
+
+	if lang := detectLanguage(rec.Text); lang != "" {
+		return lang, true
+	}
+	return "", false
+}
+
+// textField returns the post field analyzed for lang, or "" if there is no
+// analyzer for it
+func textField(lang string) string {
+	if a, ok := languageAnalyzers[lang]; ok {
+		return "text_" + a
+	}
+	return ""
+}
+
+// postTextFields returns the fields to search text in for posts in langs,
+// or posts in any language if it is empty
+func postTextFields(langs []string) []string {
+	fields := map[string]bool{}
+	if len(langs) == 0 {
+		for _, a := range languageAnalyzers {
+			fields["text_"+a] = true
+		}
+	}
+	for _, l := range langs {
+		if f := textField(l); f != "" {
+			fields[f] = true
+		}
+	}
+
+	out := []string{"text"}
+	for f := range fields {
+		out = append(out, f)
+	}
+	sort.Strings(out[1:])
+	return out
+}
+
+// languageTextMappings maps the per-language text fields of posts
+func languageTextMappings() map[string]any {
+	out := map[string]any{}
+	for _, a := range languageAnalyzers {
+		out["text_"+a] = map[string]any{
+			"type":     "text",
+			"analyzer": a,
+		}
+	}
+	return out
+}
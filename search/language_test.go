@@ -0,0 +1,78 @@
+package search
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	bsky "github.com/bluesky-social/indigo/api/bsky"
+)
+
+func TestPostLanguage(t *testing.T) {
+	for _, tc := range []struct {
+		rec      *bsky.FeedPost
+		lang     string
+		detected bool
+	}{
+		{&bsky.FeedPost{Text: "just had the best coffee of my life", Langs: []string{"pt-BR"}}, "pt", false},
+		{&bsky.FeedPost{Text: "Ich habe heute einen schönen Spaziergang gemacht"}, "de", true},
+		{&bsky.FeedPost{Text: "今日はいい天気ですね"}, "ja", true},
+		{&bsky.FeedPost{Text: "오늘 날씨가 좋네요"}, "ko", true},
+		{&bsky.FeedPost{Text: "lol"}, "", false},
+	} {
+		lang, detected := postLanguage(tc.rec)
+		if lang != tc.lang || detected != tc.detected {
+			t.Errorf("%q: got %q (detected %v), want %q (detected %v)", tc.rec.Text, lang, detected, tc.lang, tc.detected)
+		}
+	}
+}
+
+func TestPostTextFields(t *testing.T) {
+	if got := postTextFields([]string{"ja", "zh", "xx"}); !reflect.DeepEqual(got, []string{"text", "text_cjk"}) {
+		t.Errorf("unexpected fields for CJK languages: %v", got)
+	}
+
+	all := postTextFields(nil)
+	if all[0] != "text" || len(all) != len(languageTextMappings())+1 {
+		t.Errorf("expected the standard field and every language field, got %v", all)
+	}
+	props := postProperties()
+	for _, f := range all {
+		if _, ok := props[f]; !ok {
+			t.Errorf("field %s is not mapped", f)
+		}
+	}
+}
+
+func TestOpenSearchPostDocument(t *testing.T) {
+	u := &User{Did: "did:plc:alice", Handle: "alice.test"}
+	rec := &bsky.FeedPost{Text: "Ich habe heute einen schönen Spaziergang gemacht", CreatedAt: "2023-01-01T00:00:00.000Z"}
+
+	doc, lang, err := postFields(u, rec, "app.bsky.feed.post/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lang != "de" || !reflect.DeepEqual(doc["langs"], []string{"de"}) {
+		t.Errorf("expected detected language to be indexed, got %q, %v", lang, doc["langs"])
+	}
+
+	for _, tc := range []struct {
+		doc  func(*User, *bsky.FeedPost, string) ([]byte, error)
+		want bool
+	}{
+		{openSearchPostDocument, true},
+		{postDocument, false},
+	} {
+		b, err := tc.doc(u, rec, "app.bsky.feed.post/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fields map[string]any
+		if err := json.Unmarshal(b, &fields); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := fields["text_german"]; ok != tc.want {
+			t.Errorf("expected language field in document to be %v, got %s", tc.want, b)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package search
+
+import (
+	"sync"
+
+	es "github.com/opensearch-project/opensearch-go/v2"
+)
+
+// OpenSearchBackend is the full featured Backend, keeping posts, profiles
+// and the typeahead in OpenSearch indices of those names. It is the only
+// backend that can be reindexed.
+type OpenSearchBackend struct {
+	escli *es.Client
+
+	// reindexing maps each index being reindexed to its target, which
+	// writes to it are duplicated to
+	reindexLk  sync.Mutex
+	reindexing map[string]string
+}
+
+func NewOpenSearchBackend(escli *es.Client) *OpenSearchBackend {
+	return &OpenSearchBackend{
+		escli:      escli,
+		reindexing: make(map[string]string),
+	}
+}
+
+// writeIndices returns the indices a write to index has to go to, which is
+// it and the target of any reindex of it
+func (b *OpenSearchBackend) writeIndices(index string) []string {
+	b.reindexLk.Lock()
+	defer b.reindexLk.Unlock()
+
+	if t, ok := b.reindexing[index]; ok {
+		return []string{index, t}
+	}
+	return []string{index}
+}
@@ -0,0 +1,399 @@
+package search
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	bsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/util/extract"
+)
+
+// ErrUnresolvedHandle is returned for searches with a from: or mentions:
+// handle which can't be resolved to an account
+var ErrUnresolvedHandle = errors.New("handle could not be resolved")
+
+// PostQuery is a parsed post search. The query syntax is a list of terms
+// separated by spaces, each of which is one of
+//
+//	word              the post text contains the word
+//	"some words"      the post text contains the exact phrase
+//	from:HANDLE       the post is by the account, given as a handle or DID
+//	mentions:HANDLE   the post mentions the account, given as a handle or DID
+//	has:KIND          the post has an image, link, quote, mention, or is a reply
+//	lang:CODE         the post is tagged with the language, eg lang:en
+//	domain:DOMAIN     the post links to the domain, or a subdomain of it
+//	tag:TAG           the post has the hashtag, given with or without the #
+//	since:DATE        the post was created on or after the date
+//	until:DATE        the post was created before the date
+//
+// Any term but since: and until: can be negated with a leading -, as in
+// -from:alice.bsky.social or -"some words". Operator values may be quoted,
+// and @ is dropped from handles. Dates are YYYY-MM-DD, in UTC, or RFC 3339
+// timestamps. A term with an unknown operator, such as a URL, is searched for
+// as text.
+//
+// All terms must match, except that repeating an operator other than the
+// dates matches any of its values, so from:a from:b finds posts by either.
+type PostQuery struct {
+	Words      []string
+	Phrases    []string
+	NotWords   []string
+	NotPhrases []string
+
+	Filters []PostFilter
+
+	Since *time.Time
+	Until *time.Time
+}
+
+// PostFilter is an operator term of a PostQuery
+type PostFilter struct {
+	Op     string
+	Value  string
+	Negate bool
+}
+
+// postFilterFields are the fields of a post document each filter operator
+// matches
+var postFilterFields = map[string]string{
+	"from":     "did",
+	"mentions": "mentions",
+	"has":      "has",
+	"lang":     "langs",
+	"domain":   "domains",
+	"tag":      "tags",
+}
+
+var postHasKinds = map[string]bool{
+	"image":   true,
+	"link":    true,
+	"quote":   true,
+	"mention": true,
+	"reply":   true,
+}
+
+// ParsePostQuery parses the query syntax documented on PostQuery
+func ParsePostQuery(q string) (*PostQuery, error) {
+	pq := &PostQuery{}
+
+	for _, t := range splitQueryTerms(q) {
+		if t.quoted {
+			if t.negate {
+				pq.NotPhrases = append(pq.NotPhrases, t.text)
+			} else {
+				pq.Phrases = append(pq.Phrases, t.text)
+			}
+			continue
+		}
+
+		negate := false
+		if len(t.text) > 1 && strings.HasPrefix(t.text, "-") {
+			negate = true
+			t.text = t.text[1:]
+		}
+
+		op, val, ok := strings.Cut(t.text, ":")
+		op = strings.ToLower(op)
+		if ok && (postFilterFields[op] != "" || op == "since" || op == "until") {
+			if val == "" {
+				return nil, fmt.Errorf("%s: needs a value", op)
+			}
+
+			switch op {
+			case "since", "until":
+				if negate {
+					return nil, fmt.Errorf("%s: can not be negated", op)
+				}
+				ts, err := parseQueryDate(val)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", op, err)
+				}
+				if op == "since" {
+					pq.Since = &ts
+				} else {
+					pq.Until = &ts
+				}
+				continue
+
+			case "from", "mentions":
+				val = strings.TrimPrefix(val, "@")
+				if !strings.HasPrefix(val, "did:") {
+					val = strings.ToLower(val)
+				}
+
+			case "has":
+				val = strings.ToLower(val)
+				if !postHasKinds[val] {
+					return nil, fmt.Errorf("has: unknown kind %q", val)
+				}
+
+			case "lang", "domain":
+				val = strings.ToLower(val)
+
+			case "tag":
+				val = strings.ToLower(strings.TrimPrefix(val, "#"))
+			}
+
+			pq.Filters = append(pq.Filters, PostFilter{Op: op, Value: val, Negate: negate})
+			continue
+		}
+
+		if negate {
+			pq.NotWords = append(pq.NotWords, t.text)
+		} else {
+			pq.Words = append(pq.Words, t.text)
+		}
+	}
+
+	if pq.Since != nil && pq.Until != nil && !pq.Since.Before(*pq.Until) {
+		return nil, fmt.Errorf("since: must be before until:")
+	}
+
+	return pq, nil
+}
+
+// Empty is true if the query matches every post
+func (pq *PostQuery) Empty() bool {
+	return len(pq.Words) == 0 && len(pq.Phrases) == 0 && len(pq.NotWords) == 0 &&
+		len(pq.NotPhrases) == 0 && len(pq.Filters) == 0 && pq.Since == nil && pq.Until == nil
+}
+
+type queryTerm struct {
+	text   string
+	quoted bool
+	negate bool
+}
+
+// splitQueryTerms splits a query on spaces, keeping quoted parts together
+func splitQueryTerms(q string) []queryTerm {
+	var out []queryTerm
+	var cur strings.Builder
+	inQuote, phrase := false, false
+
+	flush := func() {
+		t := cur.String()
+		if phrase {
+			neg := strings.HasPrefix(t, "-")
+			t = strings.TrimSpace(strings.TrimPrefix(t, "-"))
+			if t != "" {
+				out = append(out, queryTerm{text: t, quoted: true, negate: neg})
+			}
+		} else if t != "" {
+			out = append(out, queryTerm{text: t})
+		}
+		cur.Reset()
+		phrase = false
+	}
+
+	for _, r := range q {
+		switch {
+		case r == '"':
+			if !inQuote && (cur.Len() == 0 || cur.String() == "-") {
+				// a quote opening a term makes it a phrase, one later in
+				// the term, as in from:"x", just quotes part of it
+				phrase = true
+			}
+			inQuote = !inQuote
+		case unicode.IsSpace(r) && !inQuote:
+			flush()
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	flush()
+
+	return out
+}
+
+func parseQueryDate(s string) (time.Time, error) {
+	if ts, err := time.Parse("2006-01-02", s); err == nil {
+		return ts, nil
+	}
+	if ts, err := time.Parse(time.RFC3339, s); err == nil {
+		return ts, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q, expected YYYY-MM-DD", s)
+}
+
+// OpenSearchQuery returns the bool query matching the posts pq describes
+func (pq *PostQuery) OpenSearchQuery() map[string]any {
+	var must, filter, mustNot []any
+
+	// text is matched with the analyzers of the languages asked for with
+	// lang:, or all of them, as well as the standard analyzer
+	var langs []string
+	for _, f := range pq.Filters {
+		if f.Op == "lang" && !f.Negate {
+			langs = append(langs, f.Value)
+		}
+	}
+	fields := postTextFields(langs)
+	matchText := func(q string, phrase bool) map[string]any {
+		mm := map[string]any{
+			"query":  q,
+			"fields": fields,
+		}
+		if phrase {
+			mm["type"] = "phrase"
+		} else {
+			mm["operator"] = "and"
+		}
+		return map[string]any{"multi_match": mm}
+	}
+
+	if len(pq.Words) > 0 {
+		must = append(must, matchText(strings.Join(pq.Words, " "), false))
+	}
+	for _, p := range pq.Phrases {
+		must = append(must, matchText(p, true))
+	}
+	for _, w := range pq.NotWords {
+		mustNot = append(mustNot, matchText(w, false))
+	}
+	for _, p := range pq.NotPhrases {
+		mustNot = append(mustNot, matchText(p, true))
+	}
+
+	// repeats of an operator match any of their values
+	var ops []string
+	vals := make(map[string][]string)
+	notVals := make(map[string][]string)
+	for _, f := range pq.Filters {
+		if vals[f.Op] == nil && notVals[f.Op] == nil {
+			ops = append(ops, f.Op)
+		}
+		if f.Negate {
+			notVals[f.Op] = append(notVals[f.Op], f.Value)
+		} else {
+			vals[f.Op] = append(vals[f.Op], f.Value)
+		}
+	}
+	for _, op := range ops {
+		if v := vals[op]; len(v) > 0 {
+			filter = append(filter, postFilterClause(op, v))
+		}
+		if v := notVals[op]; len(v) > 0 {
+			mustNot = append(mustNot, postFilterClause(op, v))
+		}
+	}
+
+	if pq.Since != nil || pq.Until != nil {
+		rng := map[string]any{}
+		if pq.Since != nil {
+			rng["gte"] = pq.Since.UnixNano()
+		}
+		if pq.Until != nil {
+			rng["lt"] = pq.Until.UnixNano()
+		}
+		filter = append(filter, map[string]any{
+			"range": map[string]any{"createdAt": rng},
+		})
+	}
+
+	bq := map[string]any{}
+	if len(must) > 0 {
+		bq["must"] = must
+	} else {
+		bq["must"] = []any{map[string]any{"match_all": map[string]any{}}}
+	}
+	if len(filter) > 0 {
+		bq["filter"] = filter
+	}
+	if len(mustNot) > 0 {
+		bq["must_not"] = mustNot
+	}
+
+	return map[string]any{"bool": bq}
+}
+
+// postFilterClause matches posts with any of the values for op
+func postFilterClause(op string, vals []string) map[string]any {
+	if op != "from" {
+		return map[string]any{
+			"terms": map[string]any{postFilterFields[op]: vals},
+		}
+	}
+
+	// handles that could not be resolved to a DID are matched against the
+	// handle the post was indexed with
+	var dids, handles []string
+	for _, v := range vals {
+		if strings.HasPrefix(v, "did:") {
+			dids = append(dids, v)
+		} else {
+			handles = append(handles, v)
+		}
+	}
+
+	var should []any
+	if len(dids) > 0 {
+		should = append(should, map[string]any{"terms": map[string]any{"did": dids}})
+	}
+	if len(handles) > 0 {
+		should = append(should, map[string]any{"terms": map[string]any{"handle": handles}})
+	}
+	if len(should) == 1 {
+		return should[0].(map[string]any)
+	}
+	return map[string]any{
+		"bool": map[string]any{
+			"should":               should,
+			"minimum_should_match": 1,
+		},
+	}
+}
+
+// postFacets are the fields of a post document the query operators match
+type postFacets struct {
+	Mentions []string
+	Has      []string
+	Langs    []string
+	Domains  []string
+	Tags     []string
+}
+
+func extractPostFacets(rec *bsky.FeedPost) *postFacets {
+	c, _ := extract.Record(rec)
+	pf := &postFacets{
+		Mentions: c.Mentions,
+		Domains:  c.Domains(),
+		Tags:     c.Tags,
+	}
+	has := map[string]bool{
+		"link":    len(c.Links) > 0,
+		"mention": len(c.Mentions) > 0,
+	}
+
+	if e := rec.Embed; e != nil {
+		if e.EmbedImages != nil {
+			has["image"] = true
+		}
+		if e.EmbedRecord != nil {
+			has["quote"] = true
+		}
+		if rwm := e.EmbedRecordWithMedia; rwm != nil {
+			has["quote"] = true
+			if rwm.Media != nil && rwm.Media.EmbedImages != nil {
+				has["image"] = true
+			}
+		}
+	}
+
+	if rec.Reply != nil {
+		has["reply"] = true
+	}
+
+	for _, l := range rec.Langs {
+		pf.Langs = append(pf.Langs, strings.ToLower(l))
+	}
+	for _, k := range []string{"image", "link", "quote", "mention", "reply"} {
+		if has[k] {
+			pf.Has = append(pf.Has, k)
+		}
+	}
+
+	return pf
+}
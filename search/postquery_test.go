@@ -0,0 +1,162 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/api"
+	bsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/identity"
+)
+
+func TestParsePostQuery(t *testing.T) {
+	pq, err := ParsePostQuery(`cats "small dogs" -birds -"big fish" from:@Alice.bsky.social -from:did:plc:abc mentions:bob.test has:Image lang:EN domain:example.com tag:#Go since:2023-01-01 until:2023-02-01T12:00:00Z https://x.test`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	since := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2023, 2, 1, 12, 0, 0, 0, time.UTC)
+	want := &PostQuery{
+		Words:      []string{"cats", "https://x.test"},
+		Phrases:    []string{"small dogs"},
+		NotWords:   []string{"birds"},
+		NotPhrases: []string{"big fish"},
+		Filters: []PostFilter{
+			{Op: "from", Value: "alice.bsky.social"},
+			{Op: "from", Value: "did:plc:abc", Negate: true},
+			{Op: "mentions", Value: "bob.test"},
+			{Op: "has", Value: "image"},
+			{Op: "lang", Value: "en"},
+			{Op: "domain", Value: "example.com"},
+			{Op: "tag", Value: "go"},
+		},
+		Since: &since,
+		Until: &until,
+	}
+	if !reflect.DeepEqual(pq, want) {
+		t.Fatalf("got %+v\nwant %+v", pq, want)
+	}
+}
+
+func TestParsePostQueryQuoting(t *testing.T) {
+	pq, err := ParsePostQuery(`from:"alice.test" "unterminated phrase`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pq.Filters) != 1 || pq.Filters[0].Value != "alice.test" {
+		t.Fatalf("expected a quoted operator value, got %+v", pq.Filters)
+	}
+	if len(pq.Phrases) != 1 || pq.Phrases[0] != "unterminated phrase" {
+		t.Fatalf("expected the rest of the query as a phrase, got %+v", pq.Phrases)
+	}
+
+	pq, err = ParsePostQuery("   ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pq.Empty() {
+		t.Fatalf("expected an empty query, got %+v", pq)
+	}
+}
+
+func TestParsePostQueryErrors(t *testing.T) {
+	for _, q := range []string{
+		"from:",
+		"has:sound",
+		"since:yesterday",
+		"-since:2023-01-01",
+		"since:2023-02-01 until:2023-01-01",
+	} {
+		if _, err := ParsePostQuery(q); err == nil {
+			t.Errorf("expected %q to fail to parse", q)
+		}
+	}
+}
+
+func TestPostQueryOpenSearch(t *testing.T) {
+	pq, err := ParsePostQuery(`cats from:did:plc:abc from:bob.test -has:reply lang:de`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(pq.OpenSearchQuery())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"bool":{` +
+		`"filter":[{"bool":{"minimum_should_match":1,"should":[{"terms":{"did":["did:plc:abc"]}},{"terms":{"handle":["bob.test"]}}]}},{"terms":{"langs":["de"]}}],` +
+		`"must":[{"multi_match":{"fields":["text","text_german"],"operator":"and","query":"cats"}}],` +
+		`"must_not":[{"terms":{"has":["reply"]}}]}}`
+	if string(b) != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", b, want)
+	}
+
+	empty, err := ParsePostQuery("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = json.Marshal(empty.OpenSearchQuery())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"bool":{"must":[{"match_all":{}}]}}` {
+		t.Fatalf("unexpected query for empty search: %s", b)
+	}
+}
+
+func TestExtractPostFacets(t *testing.T) {
+	rec := &bsky.FeedPost{
+		Text:  "hi @bob #Cats",
+		Langs: []string{"en-US"},
+		Facets: []*bsky.RichtextFacet{{
+			Features: []*bsky.RichtextFacet_Features_Elem{
+				{RichtextFacet_Mention: &bsky.RichtextFacet_Mention{Did: "did:plc:bob"}},
+				{RichtextFacet_Link: &bsky.RichtextFacet_Link{Uri: "https://www.News.Example.com/a"}},
+			},
+		}},
+		Embed: &bsky.FeedPost_Embed{
+			EmbedRecordWithMedia: &bsky.EmbedRecordWithMedia{
+				Media: &bsky.EmbedRecordWithMedia_Media{EmbedImages: &bsky.EmbedImages{}},
+			},
+		},
+	}
+
+	pf := extractPostFacets(rec)
+	sort.Strings(pf.Domains)
+	want := &postFacets{
+		Mentions: []string{"did:plc:bob"},
+		Has:      []string{"image", "link", "quote", "mention"},
+		Langs:    []string{"en-us"},
+		Domains:  []string{"example.com", "news.example.com"},
+		Tags:     []string{"cats"},
+	}
+	if !reflect.DeepEqual(pf, want) {
+		t.Fatalf("got %+v, want %+v", pf, want)
+	}
+}
+
+type noHandles struct{}
+
+func (noHandles) ResolveHandleToDid(ctx context.Context, handle string) (string, error) {
+	return "", fmt.Errorf("%w: %s", api.ErrHandleNotFound, handle)
+}
+
+func TestSearchUnresolvedHandle(t *testing.T) {
+	s := &Server{dir: identity.NewResolver(nil, noHandles{}, identity.NewMemCache(10))}
+
+	pq, err := ParsePostQuery("cats mentions:nobody.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SearchPostQuery(context.Background(), pq, 0, 10); !errors.Is(err, ErrUnresolvedHandle) {
+		t.Fatalf("expected ErrUnresolvedHandle, got %v", err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strconv"
 
 	es "github.com/opensearch-project/opensearch-go/v2"
 )
@@ -44,29 +45,40 @@ type PostSearchResult struct {
 	Post any        `json:"post"`
 }
 
-func doSearchPosts(ctx context.Context, escli *es.Client, q string, offset int, size int) (*EsSearchResponse, error) {
+func (b *OpenSearchBackend) SearchPosts(ctx context.Context, pq *PostQuery, offset int, size int) ([]PostHit, error) {
 	query := map[string]interface{}{
 		"sort": map[string]any{
 			"createdAt": map[string]any{
 				"order": "desc",
 			},
 		},
-		"query": map[string]interface{}{
-			"match": map[string]interface{}{
-				"text": map[string]any{
-					"query":    q,
-					"operator": "and",
-				},
-			},
+		"query": pq.OpenSearchQuery(),
+		"size":  size,
+		"from":  offset,
+		// the text is repeated in its language's field, see textField
+		"_source": map[string]any{
+			"excludes": []string{"text_*"},
 		},
-		"size": size,
-		"from": offset,
 	}
 
-	return doSearch(ctx, escli, "posts", query)
+	resp, err := doSearchSized(ctx, b.escli, "posts", query, size)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []PostHit{}
+	for _, r := range resp.Hits.Hits {
+		uid, tid, err := decodeDocumentID(r.ID)
+		if err != nil {
+			return nil, fmt.Errorf("decoding document id: %w", err)
+		}
+		out = append(out, PostHit{Uid: uid, Tid: tid, Doc: r.Source})
+	}
+
+	return out, nil
 }
 
-func doSearchProfiles(ctx context.Context, escli *es.Client, q string) (*EsSearchResponse, error) {
+func (b *OpenSearchBackend) SearchProfiles(ctx context.Context, q string, size int) ([]ProfileHit, error) {
 	query := map[string]interface{}{
 		"query": map[string]interface{}{
 			"multi_match": map[string]interface{}{
@@ -77,13 +89,27 @@ func doSearchProfiles(ctx context.Context, escli *es.Client, q string) (*EsSearc
 		},
 	}
 
-	return doSearch(ctx, escli, "profiles", query)
+	resp, err := doSearchSized(ctx, b.escli, "profiles", query, size)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []ProfileHit{}
+	for _, r := range resp.Hits.Hits {
+		uid, err := strconv.Atoi(r.ID)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, ProfileHit{Uid: uint(uid), Profile: r.Source})
+	}
+
+	return out, nil
 }
 
-func doSearch(ctx context.Context, escli *es.Client, index string, query interface{}) (*EsSearchResponse, error) {
+func doSearchSized(ctx context.Context, escli *es.Client, index string, query interface{}, size int) (*EsSearchResponse, error) {
 	var buf bytes.Buffer
 	if err := json.NewEncoder(&buf).Encode(query); err != nil {
-		log.Fatalf("Error encoding query: %s", err)
+		return nil, fmt.Errorf("encoding query: %w", err)
 	}
 
 	// Perform the search request.
@@ -92,13 +118,17 @@ func doSearch(ctx context.Context, escli *es.Client, index string, query interfa
 		escli.Search.WithIndex(index),
 		escli.Search.WithBody(&buf),
 		escli.Search.WithTrackTotalHits(true),
-		escli.Search.WithSize(30),
+		escli.Search.WithSize(size),
 	)
 	if err != nil {
-		log.Fatalf("Error getting response: %s", err)
+		return nil, fmt.Errorf("search request: %w", err)
 	}
 	defer res.Body.Close()
 
+	if res.IsError() {
+		return nil, fmt.Errorf("search failed: %s", res.String())
+	}
+
 	var out EsSearchResponse
 	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
 		return nil, fmt.Errorf("decoding search response: %w", err)
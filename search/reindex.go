@@ -0,0 +1,473 @@
+package search
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	bsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/repo"
+
+	"github.com/ipfs/go-cid"
+	"github.com/labstack/echo/v4"
+	esapi "github.com/opensearch-project/opensearch-go/v2/opensearchapi"
+)
+
+const (
+	ReindexBackfilling = "backfilling"
+	ReindexDone        = "done"
+	ReindexFailed      = "failed"
+)
+
+var (
+	ErrReindexRunning     = errors.New("a reindex of this index is already running")
+	ErrReindexerStopped   = errors.New("the reindexer is not running")
+	ErrReindexUnsupported = errors.New("only the OpenSearch backend can be reindexed")
+	ErrUnknownIndex       = errors.New("unknown index")
+	reindexUserBatchSize  = 100
+)
+
+// Reindex is a rebuild of one of the search indices into a new index
+// created with the current mapping. While it runs, the indexer writes to
+// both the old and new index, and the repos of every known user are fetched
+// to backfill the new one. Once backfilled, the index name is atomically
+// made an alias of the new index, and the old one is deleted.
+type Reindex struct {
+	ID         uint       `gorm:"primarykey" json:"id"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+
+	// Index is the name searches use, and Target the index replacing it
+	Index  string `json:"index"`
+	Target string `json:"target"`
+	State  string `gorm:"index" json:"state"`
+	Error  string `json:"error,omitempty"`
+
+	// users are backfilled in order of ID, so LastUid is where to resume
+	TotalUsers int64 `json:"totalUsers"`
+	DoneUsers  int64 `json:"doneUsers"`
+	LastUid    uint  `json:"lastUid"`
+	// Failures counts repos that could not be fetched or read
+	Failures int64 `json:"failures"`
+}
+
+// loadReindexes restores dual writes for reindexes interrupted by a restart
+func (s *Server) loadReindexes() error {
+	es, ok := s.backend.(*OpenSearchBackend)
+	if !ok {
+		return nil
+	}
+
+	var running []Reindex
+	if err := s.db.Where("state = ?", ReindexBackfilling).Find(&running).Error; err != nil {
+		return err
+	}
+
+	for _, r := range running {
+		es.reindexing[r.Index] = r.Target
+	}
+	return nil
+}
+
+// StartReindex creates a new index for index, with its current mapping,
+// and queues it to be backfilled by RunReindexer
+func (s *Server) StartReindex(ctx context.Context, index string) (*Reindex, error) {
+	es, ok := s.backend.(*OpenSearchBackend)
+	if !ok {
+		return nil, ErrReindexUnsupported
+	}
+	settings, ok := indexSettings[index]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownIndex, index)
+	}
+	if !s.reindexerRunning.Load() {
+		return nil, ErrReindexerStopped
+	}
+
+	es.reindexLk.Lock()
+	defer es.reindexLk.Unlock()
+
+	if _, ok := es.reindexing[index]; ok {
+		return nil, ErrReindexRunning
+	}
+
+	r := &Reindex{
+		Index:  index,
+		Target: fmt.Sprintf("%s-%d", index, time.Now().Unix()),
+		State:  ReindexBackfilling,
+	}
+	if err := ensureIndex(ctx, es.escli, r.Target, settings); err != nil {
+		return nil, err
+	}
+
+	if err := s.db.Model(&User{}).Count(&r.TotalUsers).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Create(r).Error; err != nil {
+		return nil, err
+	}
+
+	// live writes start going to the new index before the backfill starts,
+	// so nothing is missed between the two
+	es.reindexing[index] = r.Target
+
+	select {
+	case s.reindexCh <- r.ID:
+	default:
+		// the reindexer picks up anything left running when it starts
+		log.Warnw("reindex queue full, reindex will resume on restart", "id", r.ID)
+	}
+
+	log.Infow("started reindex", "index", index, "target", r.Target, "users", r.TotalUsers)
+	return r, nil
+}
+
+// RunReindexer backfills reindexes until ctx is cancelled, first resuming
+// any left running by a previous process
+func (s *Server) RunReindexer(ctx context.Context) error {
+	es, ok := s.backend.(*OpenSearchBackend)
+	if !ok {
+		return ErrReindexUnsupported
+	}
+
+	s.reindexerRunning.Store(true)
+	defer s.reindexerRunning.Store(false)
+
+	var running []Reindex
+	if err := s.db.Where("state = ?", ReindexBackfilling).Order("id").Find(&running).Error; err != nil {
+		return err
+	}
+	for i := range running {
+		if ctx.Err() != nil {
+			return nil
+		}
+		s.runReindex(ctx, es, &running[i])
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case id := <-s.reindexCh:
+			var r Reindex
+			if err := s.db.First(&r, id).Error; err != nil {
+				log.Errorw("failed to load reindex", "id", id, "err", err)
+				continue
+			}
+			if r.State == ReindexBackfilling {
+				s.runReindex(ctx, es, &r)
+			}
+		}
+	}
+}
+
+func (s *Server) runReindex(ctx context.Context, es *OpenSearchBackend, r *Reindex) {
+	log.Infow("backfilling reindex", "index", r.Index, "target", r.Target, "from", r.LastUid)
+
+	err := s.backfillReindex(ctx, es, r)
+	if err == nil {
+		err = flipAlias(ctx, es.escli, r.Index, r.Target)
+	}
+	if ctx.Err() != nil {
+		// left running, to be resumed from its last saved progress
+		return
+	}
+
+	now := time.Now()
+	r.FinishedAt = &now
+	if err != nil {
+		log.Errorw("reindex failed", "index", r.Index, "target", r.Target, "err", err)
+		r.State = ReindexFailed
+		r.Error = err.Error()
+	} else {
+		log.Infow("reindex done", "index", r.Index, "target", r.Target, "failures", r.Failures)
+		r.State = ReindexDone
+	}
+	if err := s.db.Save(r).Error; err != nil {
+		log.Errorw("failed to save reindex", "id", r.ID, "err", err)
+	}
+
+	es.reindexLk.Lock()
+	delete(es.reindexing, r.Index)
+	es.reindexLk.Unlock()
+
+	if r.State == ReindexFailed {
+		// the old index is still in use, and the new one is incomplete
+		if err := deleteIndices(ctx, es.escli, []string{r.Target}); err != nil {
+			log.Errorw("failed to delete index of failed reindex", "target", r.Target, "err", err)
+		}
+	}
+}
+
+func (s *Server) backfillReindex(ctx context.Context, es *OpenSearchBackend, r *Reindex) error {
+	for {
+		var users []User
+		if err := s.db.Where("id > ?", r.LastUid).Order("id").Limit(reindexUserBatchSize).Find(&users).Error; err != nil {
+			return err
+		}
+		if len(users) == 0 {
+			break
+		}
+
+		for i := range users {
+			u := &users[i]
+			if err := s.backfillUser(ctx, es, r, u); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				log.Warnw("failed to backfill repo", "did", u.Did, "err", err)
+				r.Failures++
+			}
+			r.LastUid = u.ID
+			r.DoneUsers++
+		}
+
+		if err := s.db.Model(r).Updates(map[string]any{
+			"last_uid":   r.LastUid,
+			"done_users": r.DoneUsers,
+			"failures":   r.Failures,
+		}).Error; err != nil {
+			return fmt.Errorf("saving reindex progress: %w", err)
+		}
+	}
+
+	res, err := esapi.IndicesRefreshRequest{Index: []string{r.Target}}.Do(ctx, es.escli)
+	if err != nil {
+		return fmt.Errorf("refreshing %s: %w", r.Target, err)
+	}
+	res.Body.Close()
+
+	return nil
+}
+
+// backfillUser writes the documents for a user's records to the target of
+// r. Documents already written there by the indexer are newer, and kept.
+func (s *Server) backfillUser(ctx context.Context, es *OpenSearchBackend, r *Reindex, u *User) error {
+	if !u.Active() {
+		return nil
+	}
+
+	prefix := "app.bsky.actor.profile/"
+	if r.Index == "posts" {
+		prefix = "app.bsky.feed.post/"
+	}
+
+	repodata, err := comatproto.SyncGetRepo(ctx, s.bgsxrpc, u.Did, "", "")
+	if err != nil {
+		return err
+	}
+
+	rr, err := repo.ReadRepoFromCar(ctx, bytes.NewReader(repodata))
+	if err != nil {
+		return err
+	}
+
+	return rr.ForEach(ctx, prefix, func(k string, v cid.Cid) error {
+		if !strings.HasPrefix(k, prefix) {
+			return repo.ErrDoneIterating
+		}
+
+		_, rec, err := rr.GetRecord(ctx, k)
+		if err != nil {
+			log.Errorf("failed to get record from repo checkout: %s", err)
+			return nil
+		}
+
+		var docID string
+		var doc []byte
+		switch rec := rec.(type) {
+		case *bsky.FeedPost:
+			docID = encodeDocumentID(u.ID, k)
+			doc, err = openSearchPostDocument(u, rec, k)
+		case *bsky.ActorProfile:
+			docID = fmt.Sprint(u.ID)
+			if r.Index == typeaheadIndex {
+				doc, err = typeaheadDocument(u, rec)
+			} else {
+				doc, err = json.Marshal(rec)
+			}
+		default:
+			return nil
+		}
+		if err != nil {
+			log.Warnw("skipping record in backfill", "did", u.Did, "path", k, "err", err)
+			return nil
+		}
+
+		res, err := esapi.CreateRequest{
+			Index:      r.Target,
+			DocumentID: docID,
+			Body:       bytes.NewReader(doc),
+		}.Do(ctx, es.escli)
+		if err != nil {
+			return fmt.Errorf("backfilling %s: %w", k, err)
+		}
+		defer res.Body.Close()
+		if res.IsError() && res.StatusCode != http.StatusConflict {
+			return fmt.Errorf("backfilling %s: %s", k, res.String())
+		}
+		return nil
+	})
+}
+
+// flipAlias atomically points the alias name at target, replacing either
+// the indices it is currently an alias of, which are then deleted, or a
+// plain index of that name, as made by older palomar versions
+func flipAlias(ctx context.Context, escli esapi.Transport, name, target string) error {
+	res, err := esapi.IndicesGetAliasRequest{Name: []string{name}}.Do(ctx, escli)
+	if err != nil {
+		return fmt.Errorf("getting alias %s: %w", name, err)
+	}
+	defer res.Body.Close()
+
+	var old []string
+	var actions []any
+	switch {
+	case res.StatusCode == http.StatusOK:
+		var aliases map[string]any
+		if err := json.NewDecoder(res.Body).Decode(&aliases); err != nil {
+			return fmt.Errorf("decoding aliases of %s: %w", name, err)
+		}
+		for index := range aliases {
+			if index == target {
+				continue
+			}
+			old = append(old, index)
+			actions = append(actions, map[string]any{
+				"remove": map[string]any{"index": index, "alias": name},
+			})
+		}
+	case res.StatusCode == http.StatusNotFound:
+		exists, err := esapi.IndicesExistsRequest{Index: []string{name}}.Do(ctx, escli)
+		if err != nil {
+			return fmt.Errorf("checking for index %s: %w", name, err)
+		}
+		exists.Body.Close()
+		if exists.StatusCode == http.StatusOK {
+			// deleted in the same request the alias is added in
+			actions = append(actions, map[string]any{
+				"remove_index": map[string]any{"index": name},
+			})
+		}
+	default:
+		return fmt.Errorf("getting alias %s: %s", name, res.String())
+	}
+
+	actions = append(actions, map[string]any{
+		"add": map[string]any{"index": target, "alias": name},
+	})
+
+	b, err := json.Marshal(map[string]any{"actions": actions})
+	if err != nil {
+		return err
+	}
+	ures, err := esapi.IndicesUpdateAliasesRequest{Body: bytes.NewReader(b)}.Do(ctx, escli)
+	if err != nil {
+		return fmt.Errorf("updating alias %s: %w", name, err)
+	}
+	defer ures.Body.Close()
+	if ures.IsError() {
+		return fmt.Errorf("updating alias %s: %s", name, ures.String())
+	}
+	log.Infow("flipped index alias", "alias", name, "target", target, "replaced", old)
+
+	if len(old) > 0 {
+		if err := deleteIndices(ctx, escli, old); err != nil {
+			// the alias has moved, so this only leaves some disk in use
+			log.Errorw("failed to delete replaced indices", "indices", old, "err", err)
+		}
+	}
+
+	return nil
+}
+
+func deleteIndices(ctx context.Context, escli esapi.Transport, indices []string) error {
+	res, err := esapi.IndicesDeleteRequest{Index: indices}.Do(ctx, escli)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("%s", res.String())
+	}
+	return nil
+}
+
+type reindexStatus struct {
+	*Reindex
+	Progress float64 `json:"progress"`
+}
+
+func (s *Server) handleAdminStartReindex(e echo.Context) error {
+	r, err := s.StartReindex(e.Request().Context(), e.Param("index"))
+	switch {
+	case errors.Is(err, ErrUnknownIndex), errors.Is(err, ErrReindexUnsupported):
+		return &echo.HTTPError{Code: http.StatusBadRequest, Message: err.Error()}
+	case errors.Is(err, ErrReindexRunning):
+		return &echo.HTTPError{Code: http.StatusConflict, Message: err.Error()}
+	case errors.Is(err, ErrReindexerStopped):
+		return &echo.HTTPError{Code: http.StatusServiceUnavailable, Message: err.Error()}
+	case err != nil:
+		return err
+	}
+
+	return e.JSON(200, reindexStatus{Reindex: r})
+}
+
+func (s *Server) handleAdminListReindexes(e echo.Context) error {
+	var rows []*Reindex
+	if err := s.db.Order("id desc").Limit(20).Find(&rows).Error; err != nil {
+		return err
+	}
+
+	out := []reindexStatus{}
+	for _, r := range rows {
+		st := reindexStatus{Reindex: r}
+		switch {
+		case r.State == ReindexDone:
+			st.Progress = 1
+		case r.TotalUsers > 0:
+			// users created since the start are backfilled too, so this
+			// can go a little over
+			st.Progress = float64(r.DoneUsers) / float64(r.TotalUsers)
+		}
+		out = append(out, st)
+	}
+
+	return e.JSON(200, out)
+}
+
+// SetAdminToken sets the bearer token for the /admin endpoints, which are
+// disabled if it is empty
+func (s *Server) SetAdminToken(tok string) {
+	s.adminToken = tok
+}
+
+func (s *Server) checkAdminAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(e echo.Context) error {
+		if s.adminToken == "" {
+			return echo.ErrForbidden
+		}
+
+		authheader := e.Request().Header.Get("Authorization")
+		pref := "Bearer "
+		if !strings.HasPrefix(authheader, pref) {
+			return echo.ErrForbidden
+		}
+
+		token := authheader[len(pref):]
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			return echo.ErrForbidden
+		}
+
+		return next(e)
+	}
+}
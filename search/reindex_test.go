@@ -0,0 +1,136 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	gorm "gorm.io/gorm"
+)
+
+func TestWriteIndices(t *testing.T) {
+	b := NewOpenSearchBackend(nil)
+	b.reindexing["posts"] = "posts-1700000000"
+
+	if got := b.writeIndices("posts"); !reflect.DeepEqual(got, []string{"posts", "posts-1700000000"}) {
+		t.Fatalf("expected writes to both indices during a reindex, got %v", got)
+	}
+	if got := b.writeIndices("profiles"); !reflect.DeepEqual(got, []string{"profiles"}) {
+		t.Fatalf("expected writes to the index alone, got %v", got)
+	}
+}
+
+// fakeOpenSearch answers requests with handle, recording them as
+// "METHOD path body"
+type fakeOpenSearch struct {
+	reqs   []string
+	handle func(method, path string) (int, string)
+}
+
+func (f *fakeOpenSearch) Perform(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		body, _ = io.ReadAll(req.Body)
+	}
+	f.reqs = append(f.reqs, strings.TrimSpace(req.Method+" "+req.URL.Path+" "+string(body)))
+
+	code, resp := f.handle(req.Method, req.URL.Path)
+	return &http.Response{
+		StatusCode: code,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(resp)),
+	}, nil
+}
+
+func TestFlipAlias(t *testing.T) {
+	ctx := context.Background()
+
+	// the alias moves from the index it points at, which is then deleted
+	f := &fakeOpenSearch{handle: func(method, path string) (int, string) {
+		if method == "GET" && path == "/_alias/posts" {
+			return http.StatusOK, `{"posts-1": {"aliases": {"posts": {}}}}`
+		}
+		return http.StatusOK, `{"acknowledged": true}`
+	}}
+	if err := flipAlias(ctx, f, "posts", "posts-2"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"GET /_alias/posts",
+		`POST /_aliases {"actions":[{"remove":{"alias":"posts","index":"posts-1"}},{"add":{"alias":"posts","index":"posts-2"}}]}`,
+		"DELETE /posts-1",
+	}
+	if !reflect.DeepEqual(f.reqs, want) {
+		t.Fatalf("unexpected requests:\n%s", strings.Join(f.reqs, "\n"))
+	}
+
+	// a plain index of the alias's name is removed in the same request
+	f = &fakeOpenSearch{handle: func(method, path string) (int, string) {
+		if method == "GET" && path == "/_alias/posts" {
+			return http.StatusNotFound, `{}`
+		}
+		return http.StatusOK, `{"acknowledged": true}`
+	}}
+	if err := flipAlias(ctx, f, "posts", "posts-2"); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		"GET /_alias/posts",
+		"HEAD /posts",
+		`POST /_aliases {"actions":[{"remove_index":{"index":"posts"}},{"add":{"alias":"posts","index":"posts-2"}}]}`,
+	}
+	if !reflect.DeepEqual(f.reqs, want) {
+		t.Fatalf("unexpected requests:\n%s", strings.Join(f.reqs, "\n"))
+	}
+}
+
+func TestStartReindexChecks(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "palomar.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{db: db, backend: NewSQLiteBackend(db)}
+	if _, err := s.StartReindex(ctx, "posts"); !errors.Is(err, ErrReindexUnsupported) {
+		t.Fatalf("expected ErrReindexUnsupported, got %v", err)
+	}
+
+	b := NewOpenSearchBackend(nil)
+	s.backend = b
+	if _, err := s.StartReindex(ctx, "nope"); !errors.Is(err, ErrUnknownIndex) {
+		t.Fatalf("expected ErrUnknownIndex, got %v", err)
+	}
+	if _, err := s.StartReindex(ctx, "posts"); !errors.Is(err, ErrReindexerStopped) {
+		t.Fatalf("expected ErrReindexerStopped, got %v", err)
+	}
+
+	// reindexes left running resume their dual writes on restart
+	if err := db.Create(&Reindex{Index: "posts", Target: "posts-1", State: ReindexBackfilling}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&Reindex{Index: "profiles", Target: "profiles-1", State: ReindexDone}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.loadReindexes(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(b.reindexing, map[string]string{"posts": "posts-1"}) {
+		t.Fatalf("expected only the running reindex to be restored, got %v", b.reindexing)
+	}
+
+	s.reindexerRunning.Store(true)
+	if _, err := s.StartReindex(ctx, "posts"); !errors.Is(err, ErrReindexRunning) {
+		t.Fatalf("expected ErrReindexRunning, got %v", err)
+	}
+}
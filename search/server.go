@@ -9,15 +9,18 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
-	api "github.com/bluesky-social/indigo/api"
 	comatproto "github.com/bluesky-social/indigo/api/atproto"
 	bsky "github.com/bluesky-social/indigo/api/bsky"
 	"github.com/bluesky-social/indigo/events"
 	"github.com/bluesky-social/indigo/events/schedulers/autoscaling"
+	"github.com/bluesky-social/indigo/identity"
 	lexutil "github.com/bluesky-social/indigo/lex/util"
 	"github.com/bluesky-social/indigo/repo"
 	"github.com/bluesky-social/indigo/repomgr"
+	"github.com/bluesky-social/indigo/util/cursorstore"
 	"github.com/bluesky-social/indigo/util/version"
 	"github.com/bluesky-social/indigo/xrpc"
 
@@ -29,22 +32,38 @@ import (
 	logging "github.com/ipfs/go-log"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
-	es "github.com/opensearch-project/opensearch-go/v2"
 	gorm "gorm.io/gorm"
 )
 
 var log = logging.Logger("search")
 
 type Server struct {
-	escli   *es.Client
+	backend Backend
 	db      *gorm.DB
 	bgshost string
 	xrpcc   *xrpc.Client
 	bgsxrpc *xrpc.Client
-	plc     *api.PLCServer
+	dir     *identity.Resolver
 	echo    *echo.Echo
 
 	userCache *lru.Cache
+
+	// cursors keeps the indexer's position in the firehose
+	cursors cursorstore.Store
+
+	typeaheadRanker TypeaheadRanker
+	accountChecker  AccountChecker
+	handleChecker   HandleChecker
+
+	// reindexes of an OpenSearchBackend, see StartReindex
+	reindexCh        chan uint
+	reindexerRunning atomic.Bool
+
+	adminToken string
+
+	// sigVerifier, if set, checks the signatures of commits before they are
+	// indexed
+	sigVerifier *events.SignatureVerifier
 }
 
 type PostRef struct {
@@ -59,29 +78,54 @@ type User struct {
 	Did       string `gorm:"index"`
 	Handle    string
 	LastCrawl string
+	// Status is empty for active accounts, and otherwise one of the
+	// AccountStatus values
+	Status string `gorm:"index"`
+}
+
+// Active reports whether the account's content should be searchable
+func (u *User) Active() bool {
+	return u.Status == ""
 }
 
+// LastSeq is where the indexer's cursor was kept before the cursor store. It
+// is only read now, to resume from until a cursor has been saved.
 type LastSeq struct {
 	ID  uint `gorm:"primarykey"`
 	Seq int64
 }
 
-func NewServer(db *gorm.DB, escli *es.Client, plcHost, pdsHost, bgsHost string) (*Server, error) {
-
+// Migrate creates or updates the tables the search server keeps in db, which
+// NewServer does itself
+func Migrate(db *gorm.DB) error {
 	log.Info("Migrating database")
-	db.AutoMigrate(&PostRef{})
-	db.AutoMigrate(&User{})
-	db.AutoMigrate(&LastSeq{})
+
+	// follows used to be stored again each time they were seen, so the
+	// duplicates go before the index making them unique is added
+	if db.Migrator().HasIndex(&Follow{}, "idx_follow_uid_rkey") {
+		if err := db.Exec("DELETE FROM follows WHERE id NOT IN (SELECT MIN(id) FROM follows GROUP BY uid, rkey)").Error; err != nil {
+			return fmt.Errorf("removing duplicate follows: %w", err)
+		}
+		if err := db.Migrator().DropIndex(&Follow{}, "idx_follow_uid_rkey"); err != nil {
+			return err
+		}
+	}
+
+	return db.AutoMigrate(&PostRef{}, &User{}, &LastSeq{}, &Follow{}, &Reindex{}, &cursorstore.StreamCursor{})
+}
+
+// NewServer creates a server indexing into and searching backend, which is
+// either an OpenSearchBackend or a SQLiteBackend
+func NewServer(db *gorm.DB, backend Backend, dir *identity.Resolver, pdsHost, bgsHost string) (*Server, error) {
+	if err := Migrate(db); err != nil {
+		return nil, err
+	}
 
 	// TODO: robust client
 	xc := &xrpc.Client{
 		Host: pdsHost,
 	}
 
-	plc := &api.PLCServer{
-		Host: plcHost,
-	}
-
 	bgsws := bgsHost
 	if !strings.HasPrefix(bgsws, "ws") {
 		return nil, fmt.Errorf("specified bgs host must include 'ws://' or 'wss://'")
@@ -94,36 +138,72 @@ func NewServer(db *gorm.DB, escli *es.Client, plcHost, pdsHost, bgsHost string)
 
 	ucache, _ := lru.New(100000)
 	s := &Server{
-		escli:     escli,
+		backend:   backend,
 		db:        db,
 		bgshost:   bgsHost,
 		xrpcc:     xc,
 		bgsxrpc:   bgsxrpc,
-		plc:       plc,
+		dir:       dir,
 		userCache: ucache,
+
+		typeaheadRanker: &followRanker{db: db},
+		accountChecker:  &syncAccountChecker{xrpcc: bgsxrpc},
+
+		reindexCh: make(chan uint, 8),
+	}
+
+	cursors, err := cursorstore.NewDBStore(db)
+	if err != nil {
+		return nil, err
 	}
+	s.cursors = cursors
+
+	if dir != nil {
+		s.handleChecker = &resolverHandleChecker{dir: dir}
+	}
+
+	if err := s.loadReindexes(); err != nil {
+		return nil, fmt.Errorf("loading reindexes: %w", err)
+	}
+
 	return s, nil
 }
 
-func (s *Server) getLastCursor() (int64, error) {
+// SetSignatureVerifier has the signatures of commits from the firehose checked
+// before they are indexed, dropping those which fail. Must be called before
+// RunIndexer.
+func (s *Server) SetSignatureVerifier(v *events.SignatureVerifier) {
+	s.sigVerifier = v
+}
+
+// SetCursorStore keeps the indexer's cursor in cs, rather than in the
+// database. Must be called before RunIndexer.
+func (s *Server) SetCursorStore(cs cursorstore.Store) {
+	s.cursors = cs
+}
+
+// cursorSaveInterval is how often the indexer saves its cursor
+const cursorSaveInterval = 5 * time.Second
+
+// loadCursor returns the cursor to resume the firehose after. Cursors used to
+// be kept in the last_seqs table, which is read until one has been saved in
+// the cursor store.
+func (s *Server) loadCursor(ctx context.Context, cursors *cursorstore.Tracker) (int64, error) {
+	cur, err := cursors.Load(ctx)
+	if err != nil || cur > 0 {
+		return cur, err
+	}
+
 	var lastSeq LastSeq
 	if err := s.db.Find(&lastSeq).Error; err != nil {
 		return 0, err
 	}
-
-	if lastSeq.ID == 0 {
-		return 0, s.db.Create(&lastSeq).Error
-	}
-
 	return lastSeq.Seq, nil
 }
 
-func (s *Server) updateLastCursor(curs int64) error {
-	return s.db.Model(LastSeq{}).Where("id = 1").Update("seq", curs).Error
-}
-
 func (s *Server) RunIndexer(ctx context.Context) error {
-	cur, err := s.getLastCursor()
+	cursors := cursorstore.NewTracker(s.cursors, "palomar/"+s.bgshost)
+	cur, err := s.loadCursor(ctx, cursors)
 	if err != nil {
 		return fmt.Errorf("get last cursor: %w", err)
 	}
@@ -194,15 +274,82 @@ func (s *Server) RunIndexer(ctx context.Context) error {
 			}
 			return nil
 		},
+		RepoAccount: func(evt *comatproto.SyncSubscribeRepos_Account) error {
+			status := AccountStatusActive
+			if !evt.Active {
+				status = AccountStatusDeactivated
+				if evt.Status != nil && *evt.Status != "" {
+					status = *evt.Status
+				}
+			}
+			if err := s.setAccountStatus(ctx, evt.Did, status); err != nil {
+				log.Errorf("failed to update account status: %s", err)
+			}
+			return nil
+		},
+		RepoTombstone: func(evt *comatproto.SyncSubscribeRepos_Tombstone) error {
+			if err := s.setAccountStatus(ctx, evt.Did, AccountStatusDeleted); err != nil {
+				log.Errorf("failed to remove deleted account: %s", err)
+			}
+			return nil
+		},
 	}
 
-	return events.HandleRepoStream(
-		ctx, con, autoscaling.NewScheduler(
-			autoscaling.DefaultAutoscaleSettings(),
-			s.bgshost,
-			rsc.EventHandler,
-		),
+	if s.sigVerifier != nil {
+		rsc = s.sigVerifier.Callbacks(rsc)
+	}
+
+	saverCtx, stopSaver := context.WithCancel(ctx)
+	saverDone := make(chan struct{})
+	go func() {
+		defer close(saverDone)
+		cursors.Run(saverCtx, cursorSaveInterval)
+	}()
+
+	// the scheduler has finished with every event it was given by the time
+	// this returns, so the cursor saved after it is safe to resume from
+	err = events.HandleRepoStream(
+		ctx, con, &cursorScheduler{
+			cursors: cursors,
+			next: autoscaling.NewScheduler(
+				autoscaling.DefaultAutoscaleSettings(),
+				s.bgshost,
+				func(ctx context.Context, xev *events.XRPCStreamEvent) error {
+					// events which fail hold the cursor back, so that
+					// they are handled again on restart
+					if err := rsc.EventHandler(ctx, xev); err != nil {
+						return err
+					}
+					cursors.Advance(xev.Sequence(), xev.Time())
+					return nil
+				},
+			),
+		},
 	)
+
+	stopSaver()
+	<-saverDone
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// cursorScheduler tells the cursor tracker of each event as it is handed to
+// the scheduler, so that the cursor never passes events still being handled
+type cursorScheduler struct {
+	cursors *cursorstore.Tracker
+	next    events.Scheduler
+}
+
+func (cs *cursorScheduler) AddWork(ctx context.Context, repo string, val *events.XRPCStreamEvent) error {
+	cs.cursors.Begin(val.Sequence())
+	return cs.next.AddWork(ctx, repo, val)
+}
+
+func (cs *cursorScheduler) Shutdown() {
+	cs.next.Shutdown()
 }
 
 func (s *Server) handleOp(ctx context.Context, op repomgr.EventKind, seq int64, path string, did string, rcid *cid.Cid, rec any) error {
@@ -213,6 +360,11 @@ func (s *Server) handleOp(ctx context.Context, op repomgr.EventKind, seq int64,
 		if err != nil {
 			return fmt.Errorf("checking user: %w", err)
 		}
+		if !u.Active() {
+			// inactive accounts are kept out of the index, and indexed from
+			// their repo if they are reactivated
+			rec = nil
+		}
 		switch rec := rec.(type) {
 		case *bsky.FeedPost:
 			if err := s.indexPost(ctx, u, rec, path, *rcid); err != nil {
@@ -222,6 +374,12 @@ func (s *Server) handleOp(ctx context.Context, op repomgr.EventKind, seq int64,
 			if err := s.indexProfile(ctx, u, rec); err != nil {
 				return fmt.Errorf("indexing profile: %w", err)
 			}
+		case *bsky.GraphFollow:
+			if op == repomgr.EvtKindCreateRecord {
+				if err := s.indexFollow(ctx, u, rec, path); err != nil {
+					return fmt.Errorf("indexing follow: %w", err)
+				}
+			}
 		default:
 		}
 
@@ -232,42 +390,52 @@ func (s *Server) handleOp(ctx context.Context, op repomgr.EventKind, seq int64,
 		}
 
 		switch {
-		// TODO: handle profile deletes, its an edge case, but worth doing still
 		case strings.Contains(path, "app.bsky.feed.post"):
 			if err := s.deletePost(ctx, u, path); err != nil {
 				return err
 			}
+		case strings.HasPrefix(path, "app.bsky.actor.profile/"):
+			if err := s.deleteProfile(ctx, u); err != nil {
+				return err
+			}
+		case strings.HasPrefix(path, "app.bsky.graph.follow/"):
+			if err := s.deleteFollow(ctx, u, path); err != nil {
+				return err
+			}
 		}
 
 	}
 
-	if seq%50 == 0 {
-		if err := s.updateLastCursor(seq); err != nil {
-			log.Error("Failed to update cursor: ", err)
-		}
-	}
-
 	return nil
 }
 
 func (s *Server) processTooBigCommit(ctx context.Context, evt *comatproto.SyncSubscribeRepos_Commit) error {
-	repodata, err := comatproto.SyncGetRepo(ctx, s.bgsxrpc, evt.Repo, "", evt.Commit.String())
+	u, err := s.getOrCreateUser(ctx, evt.Repo)
 	if err != nil {
 		return err
 	}
+	if !u.Active() {
+		return nil
+	}
 
-	r, err := repo.ReadRepoFromCar(ctx, bytes.NewReader(repodata))
+	return s.indexRepo(ctx, u, evt.Commit.String())
+}
+
+// indexRepo fetches the repo of u from the BGS, at commit if it is set, and
+// indexes every record in it
+func (s *Server) indexRepo(ctx context.Context, u *User, commit string) error {
+	repodata, err := comatproto.SyncGetRepo(ctx, s.bgsxrpc, u.Did, "", commit)
 	if err != nil {
 		return err
 	}
 
-	u, err := s.getOrCreateUser(ctx, evt.Repo)
+	r, err := repo.ReadRepoFromCar(ctx, bytes.NewReader(repodata))
 	if err != nil {
 		return err
 	}
 
 	return r.ForEach(ctx, "", func(k string, v cid.Cid) error {
-		if strings.HasPrefix(k, "app.bsky.feed.post") || strings.HasPrefix(k, "app.bsky.actor.profile") {
+		if strings.HasPrefix(k, "app.bsky.feed.post") || strings.HasPrefix(k, "app.bsky.actor.profile") || strings.HasPrefix(k, "app.bsky.graph.follow/") {
 			rcid, rec, err := r.GetRecord(ctx, k)
 			if err != nil {
 				log.Errorf("failed to get record from repo checkout: %s", err)
@@ -283,6 +451,10 @@ func (s *Server) processTooBigCommit(ctx context.Context, evt *comatproto.SyncSu
 				if err := s.indexProfile(ctx, u, rec); err != nil {
 					return fmt.Errorf("indexing profile: %w", err)
 				}
+			case *bsky.GraphFollow:
+				if err := s.indexFollow(ctx, u, rec, k); err != nil {
+					return fmt.Errorf("indexing follow: %w", err)
+				}
 			default:
 			}
 
@@ -291,22 +463,40 @@ func (s *Server) processTooBigCommit(ctx context.Context, evt *comatproto.SyncSu
 	})
 }
 
+// SearchPosts finds posts matching srch, in the syntax documented on
+// PostQuery
 func (s *Server) SearchPosts(ctx context.Context, srch string, offset, size int) ([]PostSearchResult, error) {
-	resp, err := doSearchPosts(ctx, s.escli, srch, offset, size)
+	pq, err := ParsePostQuery(srch)
 	if err != nil {
 		return nil, err
 	}
+	return s.SearchPostQuery(ctx, pq, offset, size)
+}
 
-	out := []PostSearchResult{}
-	for _, r := range resp.Hits.Hits {
-		uid, tid, err := decodeDocumentID(r.ID)
-		if err != nil {
-			return nil, fmt.Errorf("decoding document id: %w", err)
+func (s *Server) SearchPostQuery(ctx context.Context, pq *PostQuery, offset, size int) ([]PostSearchResult, error) {
+	// posts are indexed with the DIDs of their author and mentions, which
+	// do not change with handles
+	for i, f := range pq.Filters {
+		if (f.Op != "from" && f.Op != "mentions") || strings.HasPrefix(f.Value, "did:") {
+			continue
+		}
+		id := s.dir.Resolve(ctx, f.Value)
+		if id.Err != nil {
+			return nil, fmt.Errorf("%s: %w: %s: %s", f.Op, ErrUnresolvedHandle, f.Value, id.Err)
 		}
+		pq.Filters[i].Value = id.Did
+	}
 
+	hits, err := s.backend.SearchPosts(ctx, pq, offset, size)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []PostSearchResult{}
+	for _, r := range hits {
 		var p PostRef
-		if err := s.db.First(&p, "tid = ? AND uid = ?", tid, uid).Error; err != nil {
-			log.Infof("failed to find post in database that is referenced by elasticsearch: %s", r.ID)
+		if err := s.db.First(&p, "tid = ? AND uid = ?", r.Tid, r.Uid).Error; err != nil {
+			log.Infof("failed to find post in database that is referenced by the search backend: %d %s", r.Uid, r.Tid)
 			return nil, err
 		}
 
@@ -314,9 +504,13 @@ func (s *Server) SearchPosts(ctx context.Context, srch string, offset, size int)
 		if err := s.db.First(&u, "id = ?", p.Uid).Error; err != nil {
 			return nil, err
 		}
+		if !u.Active() {
+			// left in the index until the reconciler gets to it
+			continue
+		}
 
 		var rec map[string]any
-		if err := json.Unmarshal(r.Source, &rec); err != nil {
+		if err := json.Unmarshal(r.Doc, &rec); err != nil {
 			return nil, err
 		}
 
@@ -391,25 +585,23 @@ func decodeDocumentID(docid string) (uint, string, error) {
 }
 
 func (s *Server) SearchProfiles(ctx context.Context, srch string) ([]*ActorSearchResp, error) {
-	resp, err := doSearchProfiles(ctx, s.escli, srch)
+	hits, err := s.backend.SearchProfiles(ctx, srch, 30)
 	if err != nil {
 		return nil, err
 	}
 
 	out := []*ActorSearchResp{}
-	for _, r := range resp.Hits.Hits {
-		uid, err := strconv.Atoi(r.ID)
-		if err != nil {
-			return nil, err
-		}
-
+	for _, r := range hits {
 		var u User
-		if err := s.db.First(&u, "id = ?", uid).Error; err != nil {
+		if err := s.db.First(&u, "id = ?", r.Uid).Error; err != nil {
 			return nil, err
 		}
+		if !u.Active() {
+			continue
+		}
 
 		var rec bsky.ActorProfile
-		if err := json.Unmarshal(r.Source, &rec); err != nil {
+		if err := json.Unmarshal(r.Profile, &rec); err != nil {
 			return nil, err
 		}
 
@@ -469,6 +661,11 @@ func (s *Server) RunAPI(listen string) error {
 	e.GET("/_health", s.handleHealthCheck)
 	e.GET("/search/posts", s.handleSearchRequestPosts)
 	e.GET("/search/profiles", s.handleSearchRequestProfiles)
+	e.GET("/search/actors/typeahead", s.handleSearchRequestTypeahead)
+
+	admin := e.Group("/admin", s.checkAdminAuth)
+	admin.GET("/reindex", s.handleAdminListReindexes)
+	admin.POST("/reindex/:index", s.handleAdminStartReindex)
 	s.echo = e
 
 	log.Infof("starting search API daemon at: %s", listen)
@@ -476,5 +673,8 @@ func (s *Server) RunAPI(listen string) error {
 }
 
 func (s *Server) Shutdown(ctx context.Context) error {
+	if s.echo == nil {
+		return nil
+	}
 	return s.echo.Shutdown(ctx)
 }
@@ -0,0 +1,362 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	bsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/util"
+
+	gorm "gorm.io/gorm"
+)
+
+// SQLiteBackend is a Backend keeping posts and profiles in SQLite FTS5
+// tables, for small deployments that do not want to run OpenSearch. Post
+// search supports text, phrases, negation, and the from:, since: and until:
+// operators, and results are sorted by date only; profile and typeahead
+// search rank matches with bm25.
+//
+// FTS5 is only compiled into the sqlite driver with the sqlite_fts5 build
+// tag, so palomar has to be built with -tags sqlite_fts5 to use it.
+type SQLiteBackend struct {
+	db *gorm.DB
+}
+
+// NewSQLiteBackend creates a backend storing its tables in db, which has to
+// be a SQLite database. It may be the same database as the server's.
+func NewSQLiteBackend(db *gorm.DB) *SQLiteBackend {
+	return &SQLiteBackend{db: db}
+}
+
+// the FTS tables are keyed by the rowid of the corresponding row in
+// search_posts or search_profiles
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS search_posts (
+		id INTEGER PRIMARY KEY,
+		uid INTEGER NOT NULL,
+		tid TEXT NOT NULL,
+		did TEXT NOT NULL,
+		handle TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		doc TEXT NOT NULL,
+		UNIQUE (uid, tid)
+	)`,
+	`CREATE INDEX IF NOT EXISTS search_posts_created_at ON search_posts (created_at)`,
+	`CREATE VIRTUAL TABLE IF NOT EXISTS search_posts_fts USING fts5(text, tokenize = 'unicode61 remove_diacritics 2')`,
+	`CREATE TABLE IF NOT EXISTS search_profiles (
+		uid INTEGER PRIMARY KEY,
+		did TEXT NOT NULL,
+		handle TEXT NOT NULL,
+		profile TEXT
+	)`,
+	`CREATE VIRTUAL TABLE IF NOT EXISTS search_profiles_fts USING fts5(handle, display_name, description, tokenize = 'unicode61 remove_diacritics 2')`,
+}
+
+func (b *SQLiteBackend) EnsureIndices(ctx context.Context) error {
+	for _, stmt := range sqliteSchema {
+		if err := b.db.WithContext(ctx).Exec(stmt).Error; err != nil {
+			if strings.Contains(err.Error(), "no such module: fts5") {
+				return fmt.Errorf("sqlite search backend needs palomar built with -tags sqlite_fts5: %w", err)
+			}
+			return fmt.Errorf("creating sqlite search tables: %w", err)
+		}
+	}
+	return nil
+}
+
+func (b *SQLiteBackend) IndexPost(ctx context.Context, u *User, rec *bsky.FeedPost, tid string) error {
+	doc, err := postDocument(u, rec, tid)
+	if err != nil {
+		return err
+	}
+	// postDocument has already checked the timestamp
+	ts, _ := time.Parse(util.ISO8601, rec.CreatedAt)
+
+	return b.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var id int64
+		if err := tx.Raw(`INSERT INTO search_posts (uid, tid, did, handle, created_at, doc) VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (uid, tid) DO UPDATE SET did = excluded.did, handle = excluded.handle, created_at = excluded.created_at, doc = excluded.doc
+			RETURNING id`,
+			u.ID, tid, u.Did, strings.ToLower(u.Handle), ts.UnixNano(), string(doc)).Scan(&id).Error; err != nil {
+			return fmt.Errorf("indexing post: %w", err)
+		}
+
+		if err := tx.Exec(`DELETE FROM search_posts_fts WHERE rowid = ?`, id).Error; err != nil {
+			return err
+		}
+		return tx.Exec(`INSERT INTO search_posts_fts (rowid, text) VALUES (?, ?)`, id, rec.Text).Error
+	})
+}
+
+func (b *SQLiteBackend) DeletePost(ctx context.Context, u *User, tid string) error {
+	return b.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(`DELETE FROM search_posts_fts WHERE rowid IN (SELECT id FROM search_posts WHERE uid = ? AND tid = ?)`, u.ID, tid).Error; err != nil {
+			return err
+		}
+		return tx.Exec(`DELETE FROM search_posts WHERE uid = ? AND tid = ?`, u.ID, tid).Error
+	})
+}
+
+func (b *SQLiteBackend) IndexProfile(ctx context.Context, u *User, rec *bsky.ActorProfile) error {
+	doc, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	return b.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(`INSERT INTO search_profiles (uid, did, handle, profile) VALUES (?, ?, ?, ?)
+			ON CONFLICT (uid) DO UPDATE SET did = excluded.did, handle = excluded.handle, profile = excluded.profile`,
+			u.ID, u.Did, u.Handle, string(doc)).Error; err != nil {
+			return fmt.Errorf("indexing profile: %w", err)
+		}
+		return writeProfileText(tx, u, rec)
+	})
+}
+
+func (b *SQLiteBackend) UpdateHandle(ctx context.Context, u *User) error {
+	return b.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(`INSERT INTO search_profiles (uid, did, handle) VALUES (?, ?, ?)
+			ON CONFLICT (uid) DO UPDATE SET did = excluded.did, handle = excluded.handle`,
+			u.ID, u.Did, u.Handle).Error; err != nil {
+			return fmt.Errorf("updating handle: %w", err)
+		}
+
+		var profile *string
+		if err := tx.Raw(`SELECT profile FROM search_profiles WHERE uid = ?`, u.ID).Scan(&profile).Error; err != nil {
+			return err
+		}
+		var rec *bsky.ActorProfile
+		if profile != nil {
+			rec = &bsky.ActorProfile{}
+			if err := json.Unmarshal([]byte(*profile), rec); err != nil {
+				return fmt.Errorf("decoding indexed profile: %w", err)
+			}
+		}
+		return writeProfileText(tx, u, rec)
+	})
+}
+
+func (b *SQLiteBackend) DeleteProfile(ctx context.Context, u *User) error {
+	return b.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(`DELETE FROM search_profiles_fts WHERE rowid = ?`, u.ID).Error; err != nil {
+			return err
+		}
+		return tx.Exec(`DELETE FROM search_profiles WHERE uid = ?`, u.ID).Error
+	})
+}
+
+func (b *SQLiteBackend) DeleteAccount(ctx context.Context, u *User) error {
+	return b.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, stmt := range []string{
+			`DELETE FROM search_posts_fts WHERE rowid IN (SELECT id FROM search_posts WHERE uid = ?)`,
+			`DELETE FROM search_posts WHERE uid = ?`,
+			`DELETE FROM search_profiles_fts WHERE rowid = ?`,
+			`DELETE FROM search_profiles WHERE uid = ?`,
+		} {
+			if err := tx.Exec(stmt, u.ID).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// writeProfileText replaces the searchable text of u's profile, which may be
+// nil for accounts only known by handle
+func writeProfileText(tx *gorm.DB, u *User, rec *bsky.ActorProfile) error {
+	var name, desc string
+	if rec != nil && rec.DisplayName != nil {
+		name = *rec.DisplayName
+	}
+	if rec != nil && rec.Description != nil {
+		desc = *rec.Description
+	}
+
+	if err := tx.Exec(`DELETE FROM search_profiles_fts WHERE rowid = ?`, u.ID).Error; err != nil {
+		return err
+	}
+	return tx.Exec(`INSERT INTO search_profiles_fts (rowid, handle, display_name, description) VALUES (?, ?, ?, ?)`,
+		u.ID, u.Handle, name, desc).Error
+}
+
+// ftsString quotes s as an FTS5 string, which matches its words as a phrase
+func ftsString(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// ftsSearchable is false for text with no words an FTS5 query could match
+func ftsSearchable(s string) bool {
+	return strings.IndexFunc(s, func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsNumber(r)
+	}) >= 0
+}
+
+func (b *SQLiteBackend) SearchPosts(ctx context.Context, pq *PostQuery, offset, size int) ([]PostHit, error) {
+	var match, notMatch []string
+	for _, w := range pq.Words {
+		if ftsSearchable(w) {
+			match = append(match, ftsString(w))
+		}
+	}
+	for _, p := range pq.Phrases {
+		if ftsSearchable(p) {
+			match = append(match, ftsString(p))
+		}
+	}
+	for _, w := range append(append([]string{}, pq.NotWords...), pq.NotPhrases...) {
+		if ftsSearchable(w) {
+			notMatch = append(notMatch, ftsString(w))
+		}
+	}
+
+	var where []string
+	var args []any
+	if len(match) > 0 {
+		where = append(where, `id IN (SELECT rowid FROM search_posts_fts WHERE search_posts_fts MATCH ?)`)
+		args = append(args, strings.Join(match, " AND "))
+	}
+	if len(notMatch) > 0 {
+		where = append(where, `id NOT IN (SELECT rowid FROM search_posts_fts WHERE search_posts_fts MATCH ?)`)
+		args = append(args, strings.Join(notMatch, " OR "))
+	}
+
+	for _, f := range pq.Filters {
+		if f.Op != "from" {
+			return nil, fmt.Errorf("%s: %w", f.Op, ErrUnsupportedQuery)
+		}
+	}
+	for _, negate := range []bool{false, true} {
+		var dids, handles []string
+		for _, f := range pq.Filters {
+			if f.Negate != negate {
+				continue
+			}
+			if strings.HasPrefix(f.Value, "did:") {
+				dids = append(dids, f.Value)
+			} else {
+				handles = append(handles, f.Value)
+			}
+		}
+
+		// as with OpenSearch, handles that could not be resolved are
+		// matched against the handle the post was indexed with
+		var or []string
+		if len(dids) > 0 {
+			or = append(or, `did IN ?`)
+			args = append(args, dids)
+		}
+		if len(handles) > 0 {
+			or = append(or, `handle IN ?`)
+			args = append(args, handles)
+		}
+		if len(or) == 0 {
+			continue
+		}
+
+		cond := "(" + strings.Join(or, " OR ") + ")"
+		if negate {
+			cond = "NOT " + cond
+		}
+		where = append(where, cond)
+	}
+
+	if pq.Since != nil {
+		where = append(where, `created_at >= ?`)
+		args = append(args, pq.Since.UnixNano())
+	}
+	if pq.Until != nil {
+		where = append(where, `created_at < ?`)
+		args = append(args, pq.Until.UnixNano())
+	}
+
+	q := `SELECT uid, tid, doc FROM search_posts`
+	if len(where) > 0 {
+		q += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	q += ` ORDER BY created_at DESC LIMIT ? OFFSET ?`
+	args = append(args, size, offset)
+
+	var rows []struct {
+		Uid uint
+		Tid string
+		Doc string
+	}
+	if err := b.db.WithContext(ctx).Raw(q, args...).Scan(&rows).Error; err != nil {
+		return nil, fmt.Errorf("searching posts: %w", err)
+	}
+
+	out := []PostHit{}
+	for _, r := range rows {
+		out = append(out, PostHit{Uid: r.Uid, Tid: r.Tid, Doc: json.RawMessage(r.Doc)})
+	}
+	return out, nil
+}
+
+func (b *SQLiteBackend) SearchProfiles(ctx context.Context, q string, size int) ([]ProfileHit, error) {
+	var terms []string
+	for _, w := range strings.Fields(q) {
+		if ftsSearchable(w) {
+			terms = append(terms, ftsString(w))
+		}
+	}
+	if len(terms) == 0 {
+		return []ProfileHit{}, nil
+	}
+
+	var rows []struct {
+		Uid     uint
+		Profile string
+	}
+	if err := b.db.WithContext(ctx).Raw(`SELECT p.uid, p.profile FROM search_profiles_fts f
+		JOIN search_profiles p ON p.uid = f.rowid
+		WHERE search_profiles_fts MATCH ? AND p.profile IS NOT NULL
+		ORDER BY f.rank LIMIT ?`,
+		strings.Join(terms, " OR "), size).Scan(&rows).Error; err != nil {
+		return nil, fmt.Errorf("searching profiles: %w", err)
+	}
+
+	out := []ProfileHit{}
+	for _, r := range rows {
+		out = append(out, ProfileHit{Uid: r.Uid, Profile: json.RawMessage(r.Profile)})
+	}
+	return out, nil
+}
+
+func (b *SQLiteBackend) SearchTypeahead(ctx context.Context, q string, boosts []string, size int) ([]*TypeaheadResult, error) {
+	// the handle has to start with the whole query, and the display name
+	// has words starting with each word of it
+	var words []string
+	for _, w := range strings.Fields(q) {
+		if ftsSearchable(w) {
+			words = append(words, ftsString(w)+"*")
+		}
+	}
+	if len(words) == 0 {
+		return []*TypeaheadResult{}, nil
+	}
+	match := fmt.Sprintf(`display_name : (%s)`, strings.Join(words, " AND "))
+	if strings.IndexFunc(q, unicode.IsSpace) < 0 {
+		match = fmt.Sprintf(`handle : ^%s* OR %s`, ftsString(q), match)
+	}
+
+	order := `f.rank`
+	args := []any{match}
+	if len(boosts) > 0 {
+		order = `p.did IN ? DESC, f.rank`
+		args = append(args, boosts)
+	}
+	args = append(args, size)
+
+	out := []*TypeaheadResult{}
+	if err := b.db.WithContext(ctx).Raw(`SELECT p.did, p.handle, f.display_name FROM search_profiles_fts f
+		JOIN search_profiles p ON p.uid = f.rowid
+		WHERE search_profiles_fts MATCH ?
+		ORDER BY `+order+` LIMIT ?`, args...).Scan(&out).Error; err != nil {
+		return nil, fmt.Errorf("searching typeahead: %w", err)
+	}
+	return out, nil
+}
@@ -0,0 +1,178 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	bsky "github.com/bluesky-social/indigo/api/bsky"
+
+	"gorm.io/driver/sqlite"
+	gorm "gorm.io/gorm"
+)
+
+// testSQLiteBackend needs the sqlite_fts5 build tag, and is skipped
+// without it. make test runs the search tests with it.
+func testSQLiteBackend(t *testing.T) *SQLiteBackend {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "search.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewSQLiteBackend(db)
+	if err := b.EnsureIndices(context.Background()); err != nil {
+		if strings.Contains(err.Error(), "sqlite_fts5") {
+			t.Skip("sqlite driver built without FTS5, run with -tags sqlite_fts5")
+		}
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestSQLiteSearchPosts(t *testing.T) {
+	ctx := context.Background()
+	b := testSQLiteBackend(t)
+
+	alice := &User{Did: "did:plc:alice", Handle: "Alice.test"}
+	alice.ID = 1
+	bob := &User{Did: "did:plc:bob", Handle: "bob.test"}
+	bob.ID = 2
+
+	for _, p := range []struct {
+		u    *User
+		tid  string
+		text string
+		ts   string
+	}{
+		{alice, "app.bsky.feed.post/1", "small dogs are great", "2023-01-01T00:00:00.000Z"},
+		{alice, "app.bsky.feed.post/2", "cats and small birds", "2023-01-02T00:00:00.000Z"},
+		{bob, "app.bsky.feed.post/3", "dogs that are small", "2023-01-03T00:00:00.000Z"},
+	} {
+		if err := b.IndexPost(ctx, p.u, &bsky.FeedPost{Text: p.text, CreatedAt: p.ts}, p.tid); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	search := func(q string) []string {
+		t.Helper()
+		pq, err := ParsePostQuery(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hits, err := b.SearchPosts(ctx, pq, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []string
+		for _, h := range hits {
+			out = append(out, h.Tid)
+		}
+		return out
+	}
+
+	for q, want := range map[string]string{
+		"small":                               "app.bsky.feed.post/3 app.bsky.feed.post/2 app.bsky.feed.post/1",
+		`"small dogs"`:                        "app.bsky.feed.post/1",
+		"small -birds":                        "app.bsky.feed.post/3 app.bsky.feed.post/1",
+		"dogs from:alice.test":                "app.bsky.feed.post/1",
+		"small -from:did:plc:alice":           "app.bsky.feed.post/3",
+		"from:did:plc:alice since:2023-01-02": "app.bsky.feed.post/2",
+		"until:2023-01-02":                    "app.bsky.feed.post/1",
+	} {
+		if got := strings.Join(search(q), " "); got != want {
+			t.Errorf("%s: got %q, want %q", q, got, want)
+		}
+	}
+
+	if err := b.DeletePost(ctx, alice, "app.bsky.feed.post/1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := search(`"small dogs"`); len(got) != 0 {
+		t.Errorf("expected deleted post to be gone, got %v", got)
+	}
+
+	pq, err := ParsePostQuery("has:image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.SearchPosts(ctx, pq, 0, 10); !errors.Is(err, ErrUnsupportedQuery) {
+		t.Errorf("expected has: to be unsupported, got %v", err)
+	}
+}
+
+func TestSQLiteSearchProfiles(t *testing.T) {
+	ctx := context.Background()
+	b := testSQLiteBackend(t)
+
+	str := func(s string) *string { return &s }
+	alice := &User{Did: "did:plc:alice", Handle: "alice.test"}
+	alice.ID = 1
+	alfred := &User{Did: "did:plc:alfred", Handle: "alfred.test"}
+	alfred.ID = 2
+	carol := &User{Did: "did:plc:carol", Handle: "carol.test"}
+	carol.ID = 3
+
+	if err := b.IndexProfile(ctx, alice, &bsky.ActorProfile{DisplayName: str("Alice Smith"), Description: str("likes gardening")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.IndexProfile(ctx, alfred, &bsky.ActorProfile{DisplayName: str("Alfred")}); err != nil {
+		t.Fatal(err)
+	}
+	// known only by handle, for typeahead
+	if err := b.UpdateHandle(ctx, carol); err != nil {
+		t.Fatal(err)
+	}
+
+	hits, err := b.SearchProfiles(ctx, "gardening", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || hits[0].Uid != alice.ID {
+		t.Fatalf("unexpected profile hits: %+v", hits)
+	}
+
+	typeahead := func(q string, boosts []string) []string {
+		t.Helper()
+		res, err := b.SearchTypeahead(ctx, q, boosts, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []string
+		for _, r := range res {
+			out = append(out, r.Handle)
+		}
+		return out
+	}
+
+	if got := strings.Join(typeahead("al", []string{"did:plc:alfred"}), " "); got != "alfred.test alice.test" {
+		t.Errorf("expected boosted account first, got %q", got)
+	}
+	if got := strings.Join(typeahead("smi", nil), " "); got != "alice.test" {
+		t.Errorf("expected display name prefix match, got %q", got)
+	}
+	if got := strings.Join(typeahead("carol.te", nil), " "); got != "carol.test" {
+		t.Errorf("expected handle prefix match, got %q", got)
+	}
+	if got := typeahead("test", nil); len(got) != 0 {
+		t.Errorf("expected handles to only match from the start, got %v", got)
+	}
+
+	alice.Handle = "alice2.test"
+	if err := b.UpdateHandle(ctx, alice); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(typeahead("alice2", nil), " "); got != "alice2.test" {
+		t.Errorf("expected updated handle, got %q", got)
+	}
+	res, err := b.SearchTypeahead(ctx, "alice2", nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].DisplayName != "Alice Smith" {
+		t.Errorf("expected display name to be kept across handle updates, got %+v", res)
+	}
+}
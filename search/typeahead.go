@@ -0,0 +1,333 @@
+package search
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	bsky "github.com/bluesky-social/indigo/api/bsky"
+
+	esapi "github.com/opensearch-project/opensearch-go/v2/opensearchapi"
+	gorm "gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const typeaheadIndex = "typeahead"
+
+// typeaheadSettings index handles whole, and display names by word, as every
+// prefix of up to 20 characters, so that a partially typed name matches with
+// a plain term lookup
+var typeaheadSettings = map[string]any{
+	"settings": map[string]any{
+		"analysis": map[string]any{
+			"filter": map[string]any{
+				"typeahead_edge_ngram": map[string]any{
+					"type":     "edge_ngram",
+					"min_gram": 1,
+					"max_gram": 20,
+				},
+			},
+			"analyzer": map[string]any{
+				"typeahead_handle": map[string]any{
+					"type":      "custom",
+					"tokenizer": "keyword",
+					"filter":    []string{"lowercase", "typeahead_edge_ngram"},
+				},
+				"typeahead_handle_search": map[string]any{
+					"type":      "custom",
+					"tokenizer": "keyword",
+					"filter":    []string{"lowercase"},
+				},
+				"typeahead_name": map[string]any{
+					"type":      "custom",
+					"tokenizer": "standard",
+					"filter":    []string{"lowercase", "asciifolding", "typeahead_edge_ngram"},
+				},
+				"typeahead_name_search": map[string]any{
+					"type":      "custom",
+					"tokenizer": "standard",
+					"filter":    []string{"lowercase", "asciifolding"},
+				},
+			},
+		},
+	},
+	"mappings": map[string]any{
+		"properties": map[string]any{
+			"did": map[string]any{
+				"type": "keyword",
+			},
+			"handle": map[string]any{
+				"type":            "text",
+				"analyzer":        "typeahead_handle",
+				"search_analyzer": "typeahead_handle_search",
+			},
+			"displayName": map[string]any{
+				"type":            "text",
+				"analyzer":        "typeahead_name",
+				"search_analyzer": "typeahead_name_search",
+			},
+		},
+	},
+}
+
+// TypeaheadRanker picks the accounts to rank first in a viewer's typeahead
+// results, eg those they follow
+type TypeaheadRanker interface {
+	TypeaheadBoosts(ctx context.Context, viewer string) ([]string, error)
+}
+
+// maxTypeaheadBoosts caps the DIDs passed to a single query
+const maxTypeaheadBoosts = 1000
+
+// Follow is a follow record seen by the indexer, kept to rank typeahead
+// results by the viewer's follows
+type Follow struct {
+	ID      uint   `gorm:"primarykey"`
+	Uid     uint   `gorm:"uniqueIndex:idx_follow_uid_rkey_uniq"`
+	Rkey    string `gorm:"uniqueIndex:idx_follow_uid_rkey_uniq"`
+	Subject string
+}
+
+// followRanker boosts accounts the viewer follows, from the follows the
+// indexer has seen
+type followRanker struct {
+	db *gorm.DB
+}
+
+func (fr *followRanker) TypeaheadBoosts(ctx context.Context, viewer string) ([]string, error) {
+	var subjects []string
+	if err := fr.db.WithContext(ctx).Model(&Follow{}).
+		Joins("JOIN users ON users.id = follows.uid").
+		Where("users.did = ?", viewer).
+		Limit(maxTypeaheadBoosts).
+		Pluck("follows.subject", &subjects).Error; err != nil {
+		return nil, err
+	}
+	return subjects, nil
+}
+
+// SetTypeaheadRanker replaces the default ranking of typeahead results by
+// the viewer's follows. A nil ranker ranks by match alone.
+func (s *Server) SetTypeaheadRanker(r TypeaheadRanker) {
+	s.typeaheadRanker = r
+}
+
+func (b *OpenSearchBackend) indexTypeahead(ctx context.Context, u *User, rec *bsky.ActorProfile) error {
+	doc, err := typeaheadDocument(u, rec)
+	if err != nil {
+		return err
+	}
+
+	for _, index := range b.writeIndices(typeaheadIndex) {
+		req := esapi.IndexRequest{
+			Index:      index,
+			DocumentID: fmt.Sprint(u.ID),
+			Body:       bytes.NewReader(doc),
+		}
+
+		res, err := req.Do(ctx, b.escli)
+		if err != nil {
+			return fmt.Errorf("failed to send typeahead indexing request: %w", err)
+		}
+		res.Body.Close()
+		if res.IsError() {
+			return fmt.Errorf("typeahead indexing failed: %s", res.String())
+		}
+	}
+
+	return nil
+}
+
+func typeaheadDocument(u *User, rec *bsky.ActorProfile) ([]byte, error) {
+	blob := map[string]string{
+		"did":    u.Did,
+		"handle": u.Handle,
+	}
+	if rec != nil && rec.DisplayName != nil {
+		blob["displayName"] = *rec.DisplayName
+	}
+
+	return json.Marshal(blob)
+}
+
+// updateTypeaheadHandle changes the handle of an account already in the
+// typeahead index, adding it if needed
+func (b *OpenSearchBackend) updateTypeaheadHandle(ctx context.Context, u *User) error {
+	body, err := json.Marshal(map[string]any{
+		"doc": map[string]any{
+			"did":    u.Did,
+			"handle": u.Handle,
+		},
+		"doc_as_upsert": true,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, index := range b.writeIndices(typeaheadIndex) {
+		req := esapi.UpdateRequest{
+			Index:      index,
+			DocumentID: fmt.Sprint(u.ID),
+			Body:       bytes.NewReader(body),
+		}
+
+		res, err := req.Do(ctx, b.escli)
+		if err != nil {
+			return fmt.Errorf("failed to send typeahead update request: %w", err)
+		}
+		res.Body.Close()
+		if res.IsError() {
+			return fmt.Errorf("typeahead update failed: %s", res.String())
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) indexFollow(ctx context.Context, u *User, rec *bsky.GraphFollow, path string) error {
+	_, rkey, _ := strings.Cut(path, "/")
+
+	// follows are seen again when repos are rescanned
+	return s.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&Follow{
+		Uid:     u.ID,
+		Rkey:    rkey,
+		Subject: rec.Subject,
+	}).Error
+}
+
+func (s *Server) deleteFollow(ctx context.Context, u *User, path string) error {
+	_, rkey, _ := strings.Cut(path, "/")
+	return s.db.WithContext(ctx).Where("uid = ? AND rkey = ?", u.ID, rkey).Delete(&Follow{}).Error
+}
+
+type TypeaheadResult struct {
+	Did         string `json:"did"`
+	Handle      string `json:"handle"`
+	DisplayName string `json:"displayName,omitempty"`
+}
+
+func (b *OpenSearchBackend) SearchTypeahead(ctx context.Context, q string, boosts []string, size int) ([]*TypeaheadResult, error) {
+	bq := map[string]any{
+		"must": map[string]any{
+			"bool": map[string]any{
+				"should": []any{
+					map[string]any{
+						"match": map[string]any{
+							"handle": map[string]any{
+								"query": q,
+								"boost": 2,
+							},
+						},
+					},
+					map[string]any{
+						"match": map[string]any{
+							"displayName": map[string]any{
+								"query":    q,
+								"operator": "and",
+							},
+						},
+					},
+				},
+				"minimum_should_match": 1,
+			},
+		},
+	}
+	if len(boosts) > 0 {
+		bq["should"] = []any{
+			map[string]any{
+				"terms": map[string]any{
+					"did":   boosts,
+					"boost": 10,
+				},
+			},
+		}
+	}
+
+	query := map[string]any{
+		"query": map[string]any{
+			"bool": bq,
+		},
+		"size": size,
+	}
+
+	resp, err := doSearchSized(ctx, b.escli, typeaheadIndex, query, size)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []*TypeaheadResult{}
+	for _, r := range resp.Hits.Hits {
+		var tr TypeaheadResult
+		if err := json.Unmarshal(r.Source, &tr); err != nil {
+			return nil, err
+		}
+		out = append(out, &tr)
+	}
+
+	return out, nil
+}
+
+// SearchTypeahead finds accounts whose handle, or a word of whose display
+// name, starts with q. If viewer is set, the results are ranked by the
+// server's TypeaheadRanker for them.
+func (s *Server) SearchTypeahead(ctx context.Context, q string, viewer string, size int) ([]*TypeaheadResult, error) {
+	q = strings.TrimPrefix(strings.TrimSpace(q), "@")
+	if q == "" {
+		return []*TypeaheadResult{}, nil
+	}
+
+	var boosts []string
+	if viewer != "" && s.typeaheadRanker != nil {
+		b, err := s.typeaheadRanker.TypeaheadBoosts(ctx, viewer)
+		if err != nil {
+			// ranking is best effort, the results are still useful without it
+			log.Warnw("failed to get typeahead boosts", "viewer", viewer, "err", err)
+		} else {
+			boosts = b
+		}
+	}
+
+	res, err := s.backend.SearchTypeahead(ctx, q, boosts, size)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.filterInactive(ctx, res)
+}
+
+// filterInactive drops results for accounts that are not active, which the
+// backend may still have documents for
+func (s *Server) filterInactive(ctx context.Context, res []*TypeaheadResult) ([]*TypeaheadResult, error) {
+	if len(res) == 0 {
+		return res, nil
+	}
+
+	dids := make([]string, 0, len(res))
+	for _, r := range res {
+		dids = append(dids, r.Did)
+	}
+
+	var inactive []string
+	if err := s.db.WithContext(ctx).Model(&User{}).
+		Where("did IN ? AND status <> ''", dids).
+		Pluck("did", &inactive).Error; err != nil {
+		return nil, err
+	}
+	if len(inactive) == 0 {
+		return res, nil
+	}
+
+	skip := make(map[string]bool, len(inactive))
+	for _, d := range inactive {
+		skip[d] = true
+	}
+	out := res[:0]
+	for _, r := range res {
+		if !skip[r.Did] {
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
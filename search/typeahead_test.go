@@ -0,0 +1,66 @@
+package search
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	bsky "github.com/bluesky-social/indigo/api/bsky"
+
+	"gorm.io/driver/sqlite"
+	gorm "gorm.io/gorm"
+)
+
+// legacyFollow is Follow as it was before follows were unique
+type legacyFollow struct {
+	ID      uint   `gorm:"primarykey"`
+	Uid     uint   `gorm:"index:idx_follow_uid_rkey"`
+	Rkey    string `gorm:"index:idx_follow_uid_rkey"`
+	Subject string
+}
+
+func (legacyFollow) TableName() string {
+	return "follows"
+}
+
+func TestIndexFollowOnce(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "palomar.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// duplicates from before follows were unique are cleared out
+	if err := db.AutoMigrate(&legacyFollow{}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := db.Create(&legacyFollow{Uid: 1, Rkey: "a", Subject: "did:plc:bob"}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{db: db}
+	u := &User{Model: gorm.Model{ID: 1}}
+	rec := &bsky.GraphFollow{Subject: "did:plc:bob"}
+	for i := 0; i < 2; i++ {
+		if err := s.indexFollow(ctx, u, rec, "app.bsky.graph.follow/a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.indexFollow(ctx, u, &bsky.GraphFollow{Subject: "did:plc:carol"}, "app.bsky.graph.follow/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	var n int64
+	if err := db.Model(&Follow{}).Where("uid = ?", 1).Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 follows, got %d", n)
+	}
+}
@@ -0,0 +1,125 @@
+package socialgraph
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/bluesky-social/indigo/repomgr"
+)
+
+// firehoseLivenessTimeout is how long the firehose subscription waits for an
+// event before redialing
+const firehoseLivenessTimeout = 5 * time.Minute
+
+// Subscribe indexes the graph from a firehose, such as
+// wss://bsky.network/xrpc/com.atproto.sync.subscribeRepos, until ctx is
+// done, resuming from the cursor saved for its host
+func (g *Graph) Subscribe(ctx context.Context, firehose string) error {
+	u, err := url.Parse(firehose)
+	if err != nil {
+		return fmt.Errorf("parsing firehose url: %w", err)
+	}
+	host := u.Host
+
+	sub, err := events.NewSubscription(events.SubscriptionConfig{
+		URL:     firehose,
+		Handler: g.handleEvent,
+		LoadCursor: func(ctx context.Context) (int64, error) {
+			return g.LoadCursor(ctx, host)
+		},
+		SaveCursor: func(ctx context.Context, seq int64) error {
+			return g.SaveCursor(ctx, host, seq)
+		},
+		LivenessTimeout: firehoseLivenessTimeout,
+		OnStateChange: func(state events.SubscriptionState, err error) {
+			log.Infow("firehose subscription state change", "host", host, "state", state, "err", err)
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return sub.Run(ctx)
+}
+
+func (g *Graph) handleEvent(ctx context.Context, xev *events.XRPCStreamEvent) error {
+	switch {
+	case xev.RepoCommit != nil:
+		return g.handleCommit(ctx, xev.RepoCommit)
+	case xev.RepoTombstone != nil:
+		return g.DeleteAccount(ctx, xev.RepoTombstone.Did)
+	}
+	return nil
+}
+
+func (g *Graph) handleCommit(ctx context.Context, evt *comatproto.SyncSubscribeRepos_Commit) error {
+	if evt.TooBig {
+		log.Warnw("skipping too big commit", "repo", evt.Repo, "seq", evt.Seq)
+		return nil
+	}
+
+	var r *repo.Repo
+	for _, op := range evt.Ops {
+		kind, _, _ := strings.Cut(op.Path, "/")
+		if kind != KindFollow && kind != KindBlock && kind != KindListItem {
+			continue
+		}
+		uri := edgeUri(evt.Repo, op.Path)
+
+		switch repomgr.EventKind(op.Action) {
+		case repomgr.EvtKindCreateRecord:
+			if r == nil {
+				var err error
+				r, err = repo.ReadRepoFromCar(ctx, bytes.NewReader(evt.Blocks))
+				if err != nil {
+					return fmt.Errorf("reading repo from car (seq %d): %w", evt.Seq, err)
+				}
+			}
+			_, rec, err := r.GetRecord(ctx, op.Path)
+			if err != nil {
+				return fmt.Errorf("getting record %s: %w", uri, err)
+			}
+
+			e := recordEdge(rec)
+			if e == nil {
+				continue
+			}
+			e.Uri = uri
+			e.Actor = evt.Repo
+			if err := g.AddEdge(ctx, e); err != nil {
+				return fmt.Errorf("indexing %s: %w", uri, err)
+			}
+			edgesIndexed.WithLabelValues(e.Kind).Inc()
+
+		case repomgr.EvtKindDeleteRecord:
+			if err := g.DeleteEdge(ctx, uri); err != nil {
+				return fmt.Errorf("deleting %s: %w", uri, err)
+			}
+		}
+	}
+	return nil
+}
+
+// recordEdge returns the edge of a graph record, without its URI and actor,
+// or nil if it is not one
+func recordEdge(rec any) *Edge {
+	switch rec := rec.(type) {
+	case *appbsky.GraphFollow:
+		return &Edge{Kind: KindFollow, Subject: rec.Subject}
+	case *appbsky.GraphBlock:
+		return &Edge{Kind: KindBlock, Subject: rec.Subject}
+	case *appbsky.GraphListitem:
+		if !validList(rec.List) {
+			return nil
+		}
+		return &Edge{Kind: KindListItem, Subject: rec.Subject, List: rec.List}
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+package socialgraph
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var edgesIndexed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "socialgraph_edges_indexed_total",
+	Help: "Total number of follows, blocks and list items indexed, by kind",
+}, []string{"kind"})
+
+var queriesServed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "socialgraph_queries_served_total",
+	Help: "Total number of XRPC graph queries served, by method",
+}, []string{"method"})
@@ -0,0 +1,196 @@
+package socialgraph
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/bluesky-social/indigo/util/logutil"
+	"github.com/bluesky-social/indigo/util/syntax"
+	"github.com/bluesky-social/indigo/util/version"
+	"github.com/bluesky-social/indigo/util/xrpcerr"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// logger is for structured logs carrying the fields of the request being
+// handled
+var logger = logutil.Logger("socialgraph")
+
+// defaultPageLimit and maxPageLimit bound the number of accounts in a page
+// of followers or follows, as the lexicons do
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 100
+)
+
+// maxRelationships is the most accounts relationships can be asked for at
+// once
+const maxRelationships = 30
+
+// Server serves queries of a Graph over XRPC. Follower and follow lists are
+// skeletons of DIDs, for the caller to hydrate.
+type Server struct {
+	graph *Graph
+
+	echo *echo.Echo
+}
+
+func NewServer(g *Graph) *Server {
+	return &Server{graph: g}
+}
+
+// RunAPI serves the API on listen
+func (s *Server) RunAPI(listen string) error {
+	li, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	return s.RunAPIWithListener(li)
+}
+
+// RunAPIWithListener is like RunAPI, on a listener the caller already has
+// open, such as one on a random port in tests
+func (s *Server) RunAPIWithListener(li net.Listener) error {
+	e := echo.New()
+	s.echo = e
+	e.HideBanner = true
+	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
+		Format: "method=${method} uri=${uri} status=${status} latency=${latency_human}\n",
+	}))
+	e.Use(echo.WrapMiddleware(logutil.Middleware))
+	e.HTTPErrorHandler = xrpcerr.ErrorHandler(logger,
+		xrpcerr.Map(ErrInvalidCursor, http.StatusBadRequest, "InvalidRequest"),
+	)
+
+	e.GET("/xrpc/_health", s.HandleHealthCheck)
+	e.GET("/xrpc/app.bsky.graph.getRelationships", s.HandleGetRelationships)
+	e.GET("/xrpc/app.bsky.unspecced.getFollowersSkeleton", s.HandleGetFollowersSkeleton)
+	e.GET("/xrpc/app.bsky.unspecced.getFollowsSkeleton", s.HandleGetFollowsSkeleton)
+
+	log.Infof("starting social graph XRPC daemon at: %s", li.Addr())
+	e.Listener = li
+	return e.StartServer(e.Server)
+}
+
+// Shutdown stops serving the API
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.echo == nil {
+		return nil
+	}
+	return s.echo.Shutdown(ctx)
+}
+
+type HealthStatus struct {
+	Status  string `json:"status"`
+	Version string `json:"version"`
+	Message string `json:"msg,omitempty"`
+}
+
+func (s *Server) HandleHealthCheck(c echo.Context) error {
+	if err := s.graph.db.Exec("SELECT 1").Error; err != nil {
+		log.Errorf("healthcheck can't connect to database: %v", err)
+		return c.JSON(500, HealthStatus{Status: "error", Version: version.Version, Message: "can't connect to database"})
+	}
+	return c.JSON(200, HealthStatus{Status: "ok", Version: version.Version})
+}
+
+// RelationshipsOutput is the output of app.bsky.graph.getRelationships
+type RelationshipsOutput struct {
+	Actor         string          `json:"actor"`
+	Relationships []*Relationship `json:"relationships"`
+}
+
+func (s *Server) HandleGetRelationships(c echo.Context) error {
+	actor, err := syntax.ParseDID(c.QueryParam("actor"))
+	if err != nil {
+		return xrpcerr.InvalidRequest("invalid actor: %s", err)
+	}
+
+	others := c.QueryParams()["others"]
+	if len(others) > maxRelationships {
+		return xrpcerr.InvalidRequest("at most %d others can be given", maxRelationships)
+	}
+	for _, o := range others {
+		if _, err := syntax.ParseDID(o); err != nil {
+			return xrpcerr.InvalidRequest("invalid DID in others: %s", err)
+		}
+	}
+
+	rels, err := s.graph.Relationships(c.Request().Context(), actor.String(), others)
+	if err != nil {
+		return err
+	}
+	queriesServed.WithLabelValues("getRelationships").Inc()
+	return c.JSON(200, &RelationshipsOutput{Actor: actor.String(), Relationships: rels})
+}
+
+// FollowersSkeletonOutput is the output of
+// app.bsky.unspecced.getFollowersSkeleton
+type FollowersSkeletonOutput struct {
+	Actor     string   `json:"actor"`
+	Cursor    *string  `json:"cursor,omitempty"`
+	Followers []string `json:"followers"`
+}
+
+// FollowsSkeletonOutput is the output of
+// app.bsky.unspecced.getFollowsSkeleton
+type FollowsSkeletonOutput struct {
+	Actor   string   `json:"actor"`
+	Cursor  *string  `json:"cursor,omitempty"`
+	Follows []string `json:"follows"`
+}
+
+func (s *Server) HandleGetFollowersSkeleton(c echo.Context) error {
+	actor, limit, err := pageParams(c)
+	if err != nil {
+		return err
+	}
+
+	dids, next, err := s.graph.Followers(c.Request().Context(), actor, c.QueryParam("cursor"), limit)
+	if err != nil {
+		return err
+	}
+	queriesServed.WithLabelValues("getFollowersSkeleton").Inc()
+	return c.JSON(200, &FollowersSkeletonOutput{Actor: actor, Cursor: cursorPtr(next), Followers: dids})
+}
+
+func (s *Server) HandleGetFollowsSkeleton(c echo.Context) error {
+	actor, limit, err := pageParams(c)
+	if err != nil {
+		return err
+	}
+
+	dids, next, err := s.graph.Follows(c.Request().Context(), actor, c.QueryParam("cursor"), limit)
+	if err != nil {
+		return err
+	}
+	queriesServed.WithLabelValues("getFollowsSkeleton").Inc()
+	return c.JSON(200, &FollowsSkeletonOutput{Actor: actor, Cursor: cursorPtr(next), Follows: dids})
+}
+
+// pageParams returns the actor and limit of a paged query
+func pageParams(c echo.Context) (string, int, error) {
+	actor, err := syntax.ParseDID(c.QueryParam("actor"))
+	if err != nil {
+		return "", 0, xrpcerr.InvalidRequest("invalid actor: %s", err)
+	}
+
+	limit := defaultPageLimit
+	if l := c.QueryParam("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return "", 0, xrpcerr.InvalidRequest("limit must be between 1 and %d", maxPageLimit)
+		}
+	}
+	return actor.String(), limit, nil
+}
+
+func cursorPtr(cursor string) *string {
+	if cursor == "" {
+		return nil
+	}
+	return &cursor
+}
@@ -0,0 +1,238 @@
+// Package socialgraph keeps the social graph of the network: the follows and
+// blocks between accounts, and the members of lists, such as moderation
+// lists, as indexed from the firehose. It answers relationship queries from
+// Go, for labelers and feed generators indexing alongside it, and over XRPC
+// (see Server).
+package socialgraph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/bluesky-social/indigo/util"
+
+	logging "github.com/ipfs/go-log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var log = logging.Logger("socialgraph")
+
+// ErrInvalidCursor is returned for cursors which no page gave
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// The kinds of edges, which are the collections of their records
+const (
+	KindFollow   = "app.bsky.graph.follow"
+	KindBlock    = "app.bsky.graph.block"
+	KindListItem = "app.bsky.graph.listitem"
+)
+
+// Edge is a record relating an account to another: a follow, a block, or a
+// list item. Edges are numbered in the order they are indexed, which is the
+// order they are paged through in, newest first.
+type Edge struct {
+	ID   uint64 `gorm:"primaryKey"`
+	Uri  string `gorm:"uniqueIndex;not null"`
+	Kind string `gorm:"index:idx_edge_actor,priority:1;index:idx_edge_subject,priority:1;not null"`
+
+	// Actor is the DID of the account whose record it is
+	Actor string `gorm:"index:idx_edge_actor,priority:2;not null"`
+
+	// Subject is the DID of the account followed, blocked, or listed
+	Subject string `gorm:"index:idx_edge_subject,priority:2;not null"`
+
+	// List is the at:// URI of the list of a list item
+	List string `gorm:"index"`
+}
+
+// FirehoseCursor is the sequence number of the last event indexed from a
+// firehose host
+type FirehoseCursor struct {
+	Host string `gorm:"primaryKey"`
+	Seq  int64
+}
+
+// Graph is the store of the social graph
+type Graph struct {
+	db *gorm.DB
+}
+
+func NewGraph(db *gorm.DB) (*Graph, error) {
+	if err := db.AutoMigrate(&Edge{}, &FirehoseCursor{}); err != nil {
+		return nil, fmt.Errorf("migrating social graph: %w", err)
+	}
+	return &Graph{db: db}, nil
+}
+
+// AddEdge stores an edge, keeping the first one indexed for a record
+func (g *Graph) AddEdge(ctx context.Context, e *Edge) error {
+	return g.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(e).Error
+}
+
+// DeleteEdge removes the edge of a record, if there is one
+func (g *Graph) DeleteEdge(ctx context.Context, uri string) error {
+	return g.db.WithContext(ctx).Where("uri = ?", uri).Delete(&Edge{}).Error
+}
+
+// DeleteAccount removes the edges of an account's records. Those of others'
+// records with it as their subject are kept, as the records are.
+func (g *Graph) DeleteAccount(ctx context.Context, did string) error {
+	return g.db.WithContext(ctx).Where("actor = ?", did).Delete(&Edge{}).Error
+}
+
+// Followers returns a page of the DIDs of the accounts following an account,
+// newest first, and the cursor of the next page, which is empty after the
+// last
+func (g *Graph) Followers(ctx context.Context, did, cursor string, limit int) ([]string, string, error) {
+	return g.page(ctx, g.db.Where("kind = ? AND subject = ?", KindFollow, did), "actor", cursor, limit)
+}
+
+// Follows returns a page of the DIDs of the accounts an account follows,
+// like Followers
+func (g *Graph) Follows(ctx context.Context, did, cursor string, limit int) ([]string, string, error) {
+	return g.page(ctx, g.db.Where("kind = ? AND actor = ?", KindFollow, did), "subject", cursor, limit)
+}
+
+// ListMembers returns a page of the DIDs of the accounts on a list, like
+// Followers
+func (g *Graph) ListMembers(ctx context.Context, list, cursor string, limit int) ([]string, string, error) {
+	return g.page(ctx, g.db.Where("kind = ? AND list = ?", KindListItem, list), "subject", cursor, limit)
+}
+
+// page returns a page of the given column of the edges where selects, by
+// the edge number cursor
+func (g *Graph) page(ctx context.Context, where *gorm.DB, column, cursor string, limit int) ([]string, string, error) {
+	q := g.db.WithContext(ctx).Model(&Edge{}).Where(where)
+	if cursor != "" {
+		before, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+		q = q.Where("id < ?", before)
+	}
+
+	var edges []Edge
+	if err := q.Select("id", column).Order("id desc").Limit(limit).Find(&edges).Error; err != nil {
+		return nil, "", err
+	}
+
+	out := make([]string, len(edges))
+	for i, e := range edges {
+		if column == "actor" {
+			out[i] = e.Actor
+		} else {
+			out[i] = e.Subject
+		}
+	}
+
+	var next string
+	if len(edges) == limit {
+		next = strconv.FormatUint(edges[len(edges)-1].ID, 10)
+	}
+	return out, next, nil
+}
+
+// Relationship is how an actor and another account are related, by the
+// at:// URIs of the records relating them, as in app.bsky.graph.defs
+type Relationship struct {
+	Did string `json:"did"`
+
+	// Following is the actor's follow of the account
+	Following string `json:"following,omitempty"`
+
+	// FollowedBy is the account's follow of the actor
+	FollowedBy string `json:"followedBy,omitempty"`
+
+	// Blocking is the actor's block of the account
+	Blocking string `json:"blocking,omitempty"`
+
+	// BlockedBy is the account's block of the actor
+	BlockedBy string `json:"blockedBy,omitempty"`
+}
+
+// Relationships returns how an actor is related to each of others, in order
+func (g *Graph) Relationships(ctx context.Context, actor string, others []string) ([]*Relationship, error) {
+	var edges []Edge
+	if err := g.db.WithContext(ctx).
+		Where("kind IN ?", []string{KindFollow, KindBlock}).
+		Where(g.db.Where("actor = ? AND subject IN ?", actor, others).Or("subject = ? AND actor IN ?", actor, others)).
+		Find(&edges).Error; err != nil {
+		return nil, err
+	}
+
+	rels := make(map[string]*Relationship, len(others))
+	out := make([]*Relationship, len(others))
+	for i, o := range others {
+		if rels[o] == nil {
+			rels[o] = &Relationship{Did: o}
+		}
+		out[i] = rels[o]
+	}
+	for _, e := range edges {
+		switch {
+		case e.Actor == actor && e.Kind == KindFollow:
+			rels[e.Subject].Following = e.Uri
+		case e.Actor == actor && e.Kind == KindBlock:
+			rels[e.Subject].Blocking = e.Uri
+		case e.Kind == KindFollow:
+			rels[e.Actor].FollowedBy = e.Uri
+		case e.Kind == KindBlock:
+			rels[e.Actor].BlockedBy = e.Uri
+		}
+	}
+	return out, nil
+}
+
+// Blocked returns whether either of two accounts blocks the other
+func (g *Graph) Blocked(ctx context.Context, a, b string) (bool, error) {
+	var n int64
+	if err := g.db.WithContext(ctx).Model(&Edge{}).
+		Where("kind = ?", KindBlock).
+		Where(g.db.Where("actor = ? AND subject = ?", a, b).Or("actor = ? AND subject = ?", b, a)).
+		Count(&n).Error; err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// Listed returns whether an account is on a list
+func (g *Graph) Listed(ctx context.Context, list, did string) (bool, error) {
+	var n int64
+	if err := g.db.WithContext(ctx).Model(&Edge{}).
+		Where("kind = ? AND list = ? AND subject = ?", KindListItem, list, did).
+		Count(&n).Error; err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// LoadCursor returns the cursor saved for a firehose host, or 0
+func (g *Graph) LoadCursor(ctx context.Context, host string) (int64, error) {
+	var fc FirehoseCursor
+	if err := g.db.WithContext(ctx).Where("host = ?", host).Find(&fc).Error; err != nil {
+		return 0, err
+	}
+	return fc.Seq, nil
+}
+
+// SaveCursor saves the cursor of a firehose host
+func (g *Graph) SaveCursor(ctx context.Context, host string, seq int64) error {
+	return g.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "host"}},
+		DoUpdates: clause.AssignmentColumns([]string{"seq"}),
+	}).Create(&FirehoseCursor{Host: host, Seq: seq}).Error
+}
+
+// edgeUri returns the at:// URI of a record in a repo
+func edgeUri(repo, path string) string {
+	return "at://" + repo + "/" + path
+}
+
+// validList returns whether a list item's list is a list record's URI
+func validList(uri string) bool {
+	puri, err := util.ParseAtUri(uri)
+	return err == nil && puri.Collection == "app.bsky.graph.list"
+}
@@ -0,0 +1,139 @@
+package socialgraph_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/socialgraph"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func testGraph(t *testing.T) *socialgraph.Graph {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "socialgraph.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := socialgraph.NewGraph(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func addEdge(t *testing.T, g *socialgraph.Graph, kind, actor, subject, rkey string) string {
+	uri := fmt.Sprintf("at://%s/%s/%s", actor, kind, rkey)
+	if err := g.AddEdge(context.Background(), &socialgraph.Edge{Uri: uri, Kind: kind, Actor: actor, Subject: subject}); err != nil {
+		t.Fatal(err)
+	}
+	return uri
+}
+
+func getJSON(t *testing.T, u string, out any) int {
+	res, err := http.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode
+}
+
+func TestRelationships(t *testing.T) {
+	assert := assert.New(t)
+	g := testGraph(t)
+	ctx := context.Background()
+
+	follow := addEdge(t, g, socialgraph.KindFollow, "did:plc:alice", "did:plc:bob", "1")
+	followBack := addEdge(t, g, socialgraph.KindFollow, "did:plc:bob", "did:plc:alice", "1")
+	block := addEdge(t, g, socialgraph.KindBlock, "did:plc:carol", "did:plc:alice", "1")
+
+	rels, err := g.Relationships(ctx, "did:plc:alice", []string{"did:plc:bob", "did:plc:carol", "did:plc:dan"})
+	assert.NoError(err)
+	assert.Equal([]*socialgraph.Relationship{
+		{Did: "did:plc:bob", Following: follow, FollowedBy: followBack},
+		{Did: "did:plc:carol", BlockedBy: block},
+		{Did: "did:plc:dan"},
+	}, rels)
+
+	blocked, err := g.Blocked(ctx, "did:plc:alice", "did:plc:carol")
+	assert.NoError(err)
+	assert.True(blocked)
+
+	assert.NoError(g.DeleteEdge(ctx, block))
+	blocked, err = g.Blocked(ctx, "did:plc:alice", "did:plc:carol")
+	assert.NoError(err)
+	assert.False(blocked)
+
+	list := "at://did:plc:carol/app.bsky.graph.list/mods"
+	assert.NoError(g.AddEdge(ctx, &socialgraph.Edge{Uri: "at://did:plc:carol/app.bsky.graph.listitem/1", Kind: socialgraph.KindListItem, Actor: "did:plc:carol", Subject: "did:plc:bob", List: list}))
+	listed, err := g.Listed(ctx, list, "did:plc:bob")
+	assert.NoError(err)
+	assert.True(listed)
+
+	assert.NoError(g.DeleteAccount(ctx, "did:plc:carol"))
+	listed, err = g.Listed(ctx, list, "did:plc:bob")
+	assert.NoError(err)
+	assert.False(listed)
+}
+
+func TestFollowersSkeleton(t *testing.T) {
+	assert := assert.New(t)
+	g := testGraph(t)
+
+	for i := 0; i < 5; i++ {
+		addEdge(t, g, socialgraph.KindFollow, fmt.Sprintf("did:plc:fan%d", i), "did:plc:alice", "1")
+	}
+	addEdge(t, g, socialgraph.KindBlock, "did:plc:hater", "did:plc:alice", "1")
+
+	srv := socialgraph.NewServer(g)
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.RunAPIWithListener(li)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	})
+	base := "http://" + li.Addr().String() + "/xrpc/"
+
+	var page socialgraph.FollowersSkeletonOutput
+	assert.Equal(200, getJSON(t, base+"app.bsky.unspecced.getFollowersSkeleton?actor=did:plc:alice&limit=3", &page))
+	assert.Equal([]string{"did:plc:fan4", "did:plc:fan3", "did:plc:fan2"}, page.Followers)
+	if assert.NotNil(page.Cursor) {
+		var next socialgraph.FollowersSkeletonOutput
+		assert.Equal(200, getJSON(t, base+"app.bsky.unspecced.getFollowersSkeleton?actor=did:plc:alice&limit=3&cursor="+*page.Cursor, &next))
+		assert.Equal([]string{"did:plc:fan1", "did:plc:fan0"}, next.Followers)
+		assert.Nil(next.Cursor)
+	}
+
+	var follows socialgraph.FollowsSkeletonOutput
+	assert.Equal(200, getJSON(t, base+"app.bsky.unspecced.getFollowsSkeleton?actor=did:plc:fan0", &follows))
+	assert.Equal([]string{"did:plc:alice"}, follows.Follows)
+
+	var rels socialgraph.RelationshipsOutput
+	assert.Equal(200, getJSON(t, base+"app.bsky.graph.getRelationships?actor=did:plc:alice&others=did:plc:fan1&others=did:plc:hater", &rels))
+	if assert.Len(rels.Relationships, 2) {
+		assert.NotEmpty(rels.Relationships[0].FollowedBy)
+		assert.NotEmpty(rels.Relationships[1].BlockedBy)
+	}
+
+	var errBody struct {
+		Error string `json:"error"`
+	}
+	assert.Equal(400, getJSON(t, base+"app.bsky.unspecced.getFollowersSkeleton?actor=alice", &errBody))
+	assert.Equal(400, getJSON(t, base+"app.bsky.unspecced.getFollowersSkeleton?actor=did:plc:alice&cursor=nope", &errBody))
+	assert.Equal("InvalidRequest", errBody.Error)
+}
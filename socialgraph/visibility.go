@@ -0,0 +1,32 @@
+package socialgraph
+
+import (
+	"context"
+
+	"github.com/bluesky-social/indigo/util/visibility"
+)
+
+// VisibilitySource hydrates visibility decisions from the blocks in a Graph.
+// Mutes are private to each viewer, and not in the graph.
+type VisibilitySource struct {
+	Graph *Graph
+}
+
+var _ visibility.GraphSource = (*VisibilitySource)(nil)
+
+func (vs *VisibilitySource) Relationships(ctx context.Context, viewer string, dids []string) (map[string]*visibility.Subject, error) {
+	rels, err := vs.Graph.Relationships(ctx, viewer, dids)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]*visibility.Subject, len(rels))
+	for _, r := range rels {
+		out[r.Did] = &visibility.Subject{
+			Did:       r.Did,
+			Blocking:  r.Blocking != "",
+			BlockedBy: r.BlockedBy != "",
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,141 @@
+package sonar
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// SampledOp is a repo operation of a sampled event, as written to parquet
+// files. Times are in milliseconds since the epoch.
+type SampledOp struct {
+	Seq         int64  `parquet:"name=seq, type=INT64"`
+	EventTime   int64  `parquet:"name=event_time, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	ProcessedAt int64  `parquet:"name=processed_at, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Repo        string `parquet:"name=repo, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	PDS         string `parquet:"name=pds, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Commit      string `parquet:"name=commit, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Action      string `parquet:"name=action, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Collection  string `parquet:"name=collection, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Rkey        string `parquet:"name=rkey, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Cid         string `parquet:"name=cid, type=BYTE_ARRAY, convertedtype=UTF8"`
+	// Record is the record as JSON, for creates and updates
+	Record string `parquet:"name=record, type=BYTE_ARRAY, convertedtype=UTF8"`
+	// BlocksSize is the size of the CAR slice of the event
+	BlocksSize int64 `parquet:"name=blocks_size, type=INT64"`
+}
+
+// Sampler writes a random sample of events to parquet files in a directory,
+// for offline analysis. Files are only renamed to *.parquet once complete.
+type Sampler struct {
+	Dir string
+	// Rate is the fraction of events sampled, from 0 to 1
+	Rate float64
+	// RowsPerFile is how many rows are written to each file before starting
+	// the next one
+	RowsPerFile int
+
+	lk      sync.Mutex
+	file    *os.File
+	writer  *writer.ParquetWriter
+	rows    int
+	fileSeq int
+}
+
+func NewSampler(dir string, rate float64, rowsPerFile int) (*Sampler, error) {
+	if rate <= 0 || rate > 1 {
+		return nil, fmt.Errorf("sample rate must be within (0, 1], got %f", rate)
+	}
+	if rowsPerFile <= 0 {
+		return nil, fmt.Errorf("rows per file must be positive")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating sample dir: %w", err)
+	}
+
+	return &Sampler{
+		Dir:         dir,
+		Rate:        rate,
+		RowsPerFile: rowsPerFile,
+	}, nil
+}
+
+// Sample decides whether an event is sampled
+func (sp *Sampler) Sample() bool {
+	return sp.Rate >= 1 || rand.Float64() < sp.Rate
+}
+
+func (sp *Sampler) tmpPath() string {
+	return filepath.Join(sp.Dir, fmt.Sprintf("sonar-%d-%d.parquet.tmp", time.Now().Unix(), sp.fileSeq))
+}
+
+// Write writes the ops of a sampled event
+func (sp *Sampler) Write(ops []SampledOp) error {
+	sp.lk.Lock()
+	defer sp.lk.Unlock()
+
+	if sp.writer == nil {
+		f, err := os.Create(sp.tmpPath())
+		if err != nil {
+			return fmt.Errorf("creating sample file: %w", err)
+		}
+		pw, err := writer.NewParquetWriterFromWriter(f, new(SampledOp), 1)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("creating sample writer: %w", err)
+		}
+		pw.CompressionType = parquet.CompressionCodec_ZSTD
+		sp.file = f
+		sp.writer = pw
+		sp.fileSeq++
+	}
+
+	for _, op := range ops {
+		if err := sp.writer.Write(op); err != nil {
+			return fmt.Errorf("writing sampled ops: %w", err)
+		}
+	}
+	sp.rows += len(ops)
+
+	if sp.rows >= sp.RowsPerFile {
+		return sp.finishFile()
+	}
+	return nil
+}
+
+// finishFile closes the current file, and gives it its final name
+func (sp *Sampler) finishFile() error {
+	if sp.writer == nil {
+		return nil
+	}
+
+	tmp := sp.file.Name()
+	werr := sp.writer.WriteStop()
+	ferr := sp.file.Close()
+	sp.writer, sp.file, sp.rows = nil, nil, 0
+	if werr != nil {
+		return fmt.Errorf("finishing sample file: %w", werr)
+	}
+	if ferr != nil {
+		return fmt.Errorf("closing sample file: %w", ferr)
+	}
+
+	final := tmp[:len(tmp)-len(".tmp")]
+	if err := os.Rename(tmp, final); err != nil {
+		return fmt.Errorf("renaming sample file: %w", err)
+	}
+	return nil
+}
+
+// Close finishes the file being written, if any
+func (sp *Sampler) Close() error {
+	sp.lk.Lock()
+	defer sp.lk.Unlock()
+	return sp.finishFile()
+}
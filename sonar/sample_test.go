@@ -0,0 +1,136 @@
+package sonar
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+)
+
+func TestSamplerFiles(t *testing.T) {
+	dir := t.TempDir()
+	sp, err := NewSampler(dir, 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UnixMilli()
+	op := func(seq int64, rkey string) SampledOp {
+		return SampledOp{
+			Seq:         seq,
+			EventTime:   now,
+			ProcessedAt: now,
+			Repo:        "did:plc:alice",
+			PDS:         "pds.example.com",
+			Action:      "create",
+			Collection:  "app.bsky.feed.post",
+			Rkey:        rkey,
+			Record:      `{"text":"hello"}`,
+		}
+	}
+
+	if !sp.Sample() {
+		t.Fatal("expected everything to be sampled at a rate of 1")
+	}
+	if err := sp.Write([]SampledOp{op(1, "a"), op(1, "b")}); err != nil {
+		t.Fatal(err)
+	}
+	// the file is only renamed once complete
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.parquet")); len(files) != 0 {
+		t.Fatalf("expected no complete files yet, got %v", files)
+	}
+	if err := sp.Write([]SampledOp{op(2, "c")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.Write([]SampledOp{op(3, "d")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files, got %v", files)
+	}
+
+	var rows []SampledOp
+	for _, f := range files {
+		rows = append(rows, readSampleFile(t, f)...)
+	}
+	if len(rows) != 4 {
+		t.Fatalf("expected 4 rows, got %d", len(rows))
+	}
+	seen := make(map[string]SampledOp)
+	for _, r := range rows {
+		seen[r.Rkey] = r
+	}
+	d, ok := seen["d"]
+	if !ok || d.Seq != 3 || d.Record != `{"text":"hello"}` || d.PDS != "pds.example.com" || d.EventTime != now {
+		t.Fatalf("unexpected row read back: %+v", d)
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Fatalf("expected no temporary files left, got %d files", len(entries))
+	}
+}
+
+func TestSamplerRate(t *testing.T) {
+	if _, err := NewSampler(t.TempDir(), 0, 10); err == nil {
+		t.Fatal("expected a sample rate of 0 to be rejected")
+	}
+	if _, err := NewSampler(t.TempDir(), 1.5, 10); err == nil {
+		t.Fatal("expected a sample rate above 1 to be rejected")
+	}
+}
+
+// localFile is a parquet source of a local file
+type localFile struct {
+	*os.File
+}
+
+func (lf *localFile) Open(name string) (source.ParquetFile, error) {
+	if name == "" {
+		name = lf.Name()
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &localFile{f}, nil
+}
+
+func (lf *localFile) Create(name string) (source.ParquetFile, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &localFile{f}, nil
+}
+
+func readSampleFile(t *testing.T, path string) []SampledOp {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	pr, err := reader.NewParquetReader(&localFile{f}, new(SampledOp), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.ReadStop()
+
+	rows := make([]SampledOp, pr.GetNumRows())
+	if err := pr.Read(&rows); err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
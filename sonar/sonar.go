@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"net/url"
 	"os"
 	"strings"
 	"sync"
@@ -17,18 +18,31 @@ import (
 	"github.com/labstack/gommon/log"
 
 	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/identity"
 	"github.com/bluesky-social/indigo/repo"
 	"github.com/bluesky-social/indigo/repomgr"
+	"github.com/bluesky-social/indigo/util/cursorstore"
 	"go.opentelemetry.io/otel"
 	"go.uber.org/zap"
 )
 
 type Sonar struct {
-	SocketURL  string
-	Progress   *Progress
-	ProgMux    sync.Mutex
-	Logger     *zap.SugaredLogger
-	CursorFile string
+	SocketURL string
+	Progress  *Progress
+	ProgMux   sync.Mutex
+	Logger    *zap.SugaredLogger
+
+	// Cursors keeps the sequence number sonar resumes from
+	Cursors *cursorstore.Tracker
+
+	// Stats has the rates of events by type, of ops by collection and
+	// action, and of commits by PDS host
+	Stats *Stats
+	// Resolver looks up the PDS hosts of repos, which are only counted if
+	// set
+	Resolver *identity.Resolver
+	// Sampler writes a sample of commits to parquet files, if set
+	Sampler *Sampler
 }
 
 type Progress struct {
@@ -36,67 +50,49 @@ type Progress struct {
 	LastSeqProcessedAt time.Time `json:"last_seq_processed_at"`
 }
 
-func (s *Sonar) WriteCursorFile() error {
-	// Marshal the cursor file
-	s.ProgMux.Lock()
-	data, err := json.Marshal(s.Progress)
-	s.ProgMux.Unlock()
+// ReadCursorFile reads the cursor file written by versions of sonar before
+// the cursor store
+func ReadCursorFile(path string) (*Progress, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return fmt.Errorf("failed to marshal cursor file: %+v", err)
+		return nil, fmt.Errorf("failed to read cursor file: %+v", err)
 	}
 
-	// Write the cursor file
-	err = os.WriteFile(s.CursorFile, data, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to write cursor file: %+v", err)
+	var p Progress
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal cursor file: %+v", err)
 	}
 
-	return nil
+	return &p, nil
 }
 
-func (s *Sonar) ReadCursorFile() error {
-	// Read the cursor file
-	data, err := os.ReadFile(s.CursorFile)
-	if err != nil {
-		return fmt.Errorf("failed to read cursor file: %+v", err)
-	}
-
-	// Unmarshal the cursor file
+// advance records the progress of sonar through the stream
+func (s *Sonar) advance(seq int64, emitted time.Time, processedAt time.Time) {
 	s.ProgMux.Lock()
-	err = json.Unmarshal(data, s.Progress)
+	s.Progress.LastSeq = seq
+	s.Progress.LastSeqProcessedAt = processedAt
 	s.ProgMux.Unlock()
-	if err != nil {
-		return fmt.Errorf("failed to unmarshal cursor file: %+v", err)
-	}
 
-	return nil
+	s.Cursors.Advance(seq, emitted)
 }
 
-func NewSonar(logger *zap.SugaredLogger, cursorFile string, socketURL string) (*Sonar, error) {
+func NewSonar(ctx context.Context, logger *zap.SugaredLogger, cursors *cursorstore.Tracker, socketURL string) (*Sonar, error) {
 	s := Sonar{
 		SocketURL: socketURL,
 		Progress: &Progress{
 			LastSeq: -1,
 		},
-		Logger:     logger,
-		ProgMux:    sync.Mutex{},
-		CursorFile: cursorFile,
+		Logger:  logger,
+		ProgMux: sync.Mutex{},
+		Cursors: cursors,
+		Stats:   NewStats(),
 	}
 
-	// Check to see if the cursor file exists
-	if _, err := os.Stat(cursorFile); os.IsNotExist(err) {
-		logger.Infof("cursor file does not exist, creating %s", cursorFile)
-		// Create the cursor file
-		err := s.WriteCursorFile()
-		if err != nil {
-			return nil, fmt.Errorf("failed to write cursor file: %+v", err)
-		}
-	} else {
-		// Read the cursor file
-		err := s.ReadCursorFile()
-		if err != nil {
-			logger.Errorf("read cursor file, will start drinking from live: %+v", err.Error())
-		}
+	seq, err := cursors.Load(ctx)
+	if err != nil {
+		logger.Errorf("failed to load cursor, will start drinking from live: %+v", err)
+	} else if seq > 0 {
+		s.Progress.LastSeq = seq
 	}
 
 	return &s, nil
@@ -106,6 +102,8 @@ func (s *Sonar) HandleStreamEvent(ctx context.Context, xe *events.XRPCStreamEven
 	ctx, span := otel.Tracer("sonar").Start(ctx, "HandleStreamEvent")
 	defer span.End()
 
+	s.Stats.Add(DimEvent, eventType(xe), time.Now())
+
 	switch {
 	case xe.RepoCommit != nil:
 		eventsProcessedCounter.WithLabelValues("repo_commit", s.SocketURL).Inc()
@@ -113,12 +111,9 @@ func (s *Sonar) HandleStreamEvent(ctx context.Context, xe *events.XRPCStreamEven
 	case xe.RepoHandle != nil:
 		eventsProcessedCounter.WithLabelValues("repo_handle", s.SocketURL).Inc()
 		now := time.Now()
-		s.ProgMux.Lock()
-		s.Progress.LastSeq = xe.RepoHandle.Seq
-		s.Progress.LastSeqProcessedAt = now
-		s.ProgMux.Unlock()
 		// Parse time from the event time string
 		t, err := time.Parse(time.RFC3339, xe.RepoHandle.Time)
+		s.advance(xe.RepoHandle.Seq, t, now)
 		if err != nil {
 			log.Errorf("error parsing time: %+v", err)
 			return nil
@@ -132,12 +127,9 @@ func (s *Sonar) HandleStreamEvent(ctx context.Context, xe *events.XRPCStreamEven
 	case xe.RepoMigrate != nil:
 		eventsProcessedCounter.WithLabelValues("repo_migrate", s.SocketURL).Inc()
 		now := time.Now()
-		s.ProgMux.Lock()
-		s.Progress.LastSeq = xe.RepoMigrate.Seq
-		s.Progress.LastSeqProcessedAt = time.Now()
-		s.ProgMux.Unlock()
 		// Parse time from the event time string
 		t, err := time.Parse(time.RFC3339, xe.RepoMigrate.Time)
+		s.advance(xe.RepoMigrate.Seq, t, now)
 		if err != nil {
 			log.Errorf("error parsing time: %+v", err)
 			return nil
@@ -148,6 +140,8 @@ func (s *Sonar) HandleStreamEvent(ctx context.Context, xe *events.XRPCStreamEven
 		lastSeqGauge.WithLabelValues(s.SocketURL).Set(float64(xe.RepoHandle.Seq))
 	case xe.RepoTombstone != nil:
 		eventsProcessedCounter.WithLabelValues("repo_tombstone", s.SocketURL).Inc()
+	case xe.RepoAccount != nil:
+		eventsProcessedCounter.WithLabelValues("repo_account", s.SocketURL).Inc()
 	case xe.LabelInfo != nil:
 		eventsProcessedCounter.WithLabelValues("label_info", s.SocketURL).Inc()
 	case xe.LabelLabels != nil:
@@ -158,16 +152,63 @@ func (s *Sonar) HandleStreamEvent(ctx context.Context, xe *events.XRPCStreamEven
 	return nil
 }
 
+// eventType is the type of a stream event, as in the metric labels
+func eventType(xe *events.XRPCStreamEvent) string {
+	switch {
+	case xe.RepoCommit != nil:
+		return "repo_commit"
+	case xe.RepoHandle != nil:
+		return "repo_handle"
+	case xe.RepoInfo != nil:
+		return "repo_info"
+	case xe.RepoMigrate != nil:
+		return "repo_migrate"
+	case xe.RepoTombstone != nil:
+		return "repo_tombstone"
+	case xe.RepoAccount != nil:
+		return "repo_account"
+	case xe.LabelInfo != nil:
+		return "label_info"
+	case xe.LabelLabels != nil:
+		return "label_labels"
+	case xe.Error != nil:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// pdsHost returns the host of the PDS of a repo, "unknown" if it can't be
+// resolved, or nothing without a resolver
+func (s *Sonar) pdsHost(ctx context.Context, did string) string {
+	if s.Resolver == nil {
+		return ""
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	doc, err := s.Resolver.GetDocument(ctx, did)
+	if err != nil {
+		return "unknown"
+	}
+	for _, svc := range doc.Service {
+		if strings.HasSuffix(svc.ID.String(), "#atproto_pds") {
+			if u, err := url.Parse(svc.ServiceEndpoint); err == nil && u.Host != "" {
+				return u.Host
+			}
+		}
+	}
+	return "unknown"
+}
+
 func (s *Sonar) HandleRepoCommit(ctx context.Context, evt *comatproto.SyncSubscribeRepos_Commit) error {
 	ctx, span := otel.Tracer("sonar").Start(ctx, "HandleRepoCommit")
 	defer span.End()
 
 	processedAt := time.Now()
 
-	s.ProgMux.Lock()
-	s.Progress.LastSeq = evt.Seq
-	s.Progress.LastSeqProcessedAt = processedAt
-	s.ProgMux.Unlock()
+	emitted, _ := time.Parse(time.RFC3339, evt.Time)
+	s.advance(evt.Seq, emitted, processedAt)
 
 	lastSeqGauge.WithLabelValues(s.SocketURL).Set(float64(evt.Seq))
 
@@ -195,13 +236,42 @@ func (s *Sonar) HandleRepoCommit(ctx context.Context, evt *comatproto.SyncSubscr
 	lastEvtProcessedAtGauge.WithLabelValues(s.SocketURL).Set(float64(processedAt.UnixNano()))
 	lastEvtCreatedEvtProcessedGapGauge.WithLabelValues(s.SocketURL).Set(float64(processedAt.Sub(evtCreatedAt).Seconds()))
 
+	pds := s.pdsHost(ctx, evt.Repo)
+	if pds != "" {
+		s.Stats.Add(DimPDS, pds, processedAt)
+	}
+
+	var sampled []SampledOp
+	sample := s.Sampler != nil && s.Sampler.Sample()
+
 	for _, op := range evt.Ops {
-		collection := strings.Split(op.Path, "/")[0]
+		collection, rkey, _ := strings.Cut(op.Path, "/")
 
 		ek := repomgr.EventKind(op.Action)
 		log = log.With("action", op.Action, "collection", collection)
 
 		opsProcessedCounter.WithLabelValues(op.Action, collection, s.SocketURL).Inc()
+		s.Stats.Add(DimCollection, collection, processedAt)
+		s.Stats.Add(DimOp, op.Action, processedAt)
+
+		if sample {
+			so := SampledOp{
+				Seq:         evt.Seq,
+				EventTime:   evtCreatedAt.UnixMilli(),
+				ProcessedAt: processedAt.UnixMilli(),
+				Repo:        evt.Repo,
+				PDS:         pds,
+				Commit:      evt.Commit.String(),
+				Action:      op.Action,
+				Collection:  collection,
+				Rkey:        rkey,
+				BlocksSize:  int64(len(evt.Blocks)),
+			}
+			if op.Cid != nil {
+				so.Cid = op.Cid.String()
+			}
+			sampled = append(sampled, so)
+		}
 
 		switch ek {
 		case repomgr.EvtKindCreateRecord, repomgr.EvtKindUpdateRecord:
@@ -220,6 +290,12 @@ func (s *Sonar) HandleRepoCommit(ctx context.Context, evt *comatproto.SyncSubscr
 				break
 			}
 
+			if sample {
+				if b, err := json.Marshal(rec); err == nil {
+					sampled[len(sampled)-1].Record = string(b)
+				}
+			}
+
 			var recCreatedAt time.Time
 			var parseError error
 
@@ -273,6 +349,12 @@ func (s *Sonar) HandleRepoCommit(ctx context.Context, evt *comatproto.SyncSubscr
 		}
 	}
 
+	if len(sampled) > 0 {
+		if err := s.Sampler.Write(sampled); err != nil {
+			log.Errorf("failed to write sampled ops: %+v", err)
+		}
+	}
+
 	eventProcessingDurationHistogram.WithLabelValues(s.SocketURL).Observe(time.Since(processedAt).Seconds())
 	return nil
 }
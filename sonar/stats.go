@@ -0,0 +1,194 @@
+package sonar
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The dimensions events are counted by
+const (
+	DimEvent      = "event"
+	DimCollection = "collection"
+	DimOp         = "op"
+	DimPDS        = "pds"
+)
+
+// StatsWindows are the sliding windows rates are computed over
+var StatsWindows = []time.Duration{time.Minute, 5 * time.Minute, time.Hour}
+
+// statsBucket is the granularity of the windows. Rates cover the current,
+// partial, bucket and the ones before it, so they lag by up to a bucket.
+const statsBucket = 10 * time.Second
+
+// statsBuckets is how many buckets are kept, enough for the longest window
+const statsBuckets = int(time.Hour / statsBucket)
+
+// series counts events in a ring of buckets
+type series struct {
+	counts [statsBuckets]int64
+	// last is the index of the newest bucket written to
+	last int64
+}
+
+func bucketOf(t time.Time) int64 {
+	return t.UnixNano() / int64(statsBucket)
+}
+
+func (s *series) add(t time.Time, n int64) {
+	b := bucketOf(t)
+	if b < s.last-int64(statsBuckets)+1 {
+		// too old for any window
+		return
+	}
+	if b > s.last {
+		// clear the buckets skipped over since the last write, which hold
+		// counts from a full ring ago
+		from := s.last + 1
+		if b-from >= int64(statsBuckets) {
+			from = b - int64(statsBuckets) + 1
+		}
+		for i := from; i <= b; i++ {
+			s.counts[i%int64(statsBuckets)] = 0
+		}
+		s.last = b
+	}
+	s.counts[b%int64(statsBuckets)] += n
+}
+
+// sum returns the number of events in the window ending at now
+func (s *series) sum(now time.Time, window time.Duration) int64 {
+	b := bucketOf(now)
+	n := int64(window / statsBucket)
+	var total int64
+	for i := b - n + 1; i <= b; i++ {
+		if i > s.last || i <= s.last-int64(statsBuckets) {
+			continue
+		}
+		total += s.counts[i%int64(statsBuckets)]
+	}
+	return total
+}
+
+// Stats counts events by dimension (eg collection) and value (eg
+// app.bsky.feed.post), for the rates over StatsWindows. It is safe for
+// concurrent use, and is a prometheus collector of the rates.
+type Stats struct {
+	// MaxMetricValues limits the values of each dimension exported as
+	// metrics to the busiest ones (in the longest window), since there can
+	// be many PDS hosts. The JSON snapshots have all of them.
+	MaxMetricValues int
+
+	lk     sync.Mutex
+	series map[string]map[string]*series
+
+	rateDesc *prometheus.Desc
+}
+
+func NewStats() *Stats {
+	return &Stats{
+		MaxMetricValues: 100,
+		series:          make(map[string]map[string]*series),
+		rateDesc: prometheus.NewDesc("sonar_event_rate",
+			"Events per second over a sliding window, by dimension (event, collection, op or pds) and value",
+			[]string{"dimension", "value", "window"}, nil),
+	}
+}
+
+// Add counts an event at t
+func (st *Stats) Add(dim, val string, t time.Time) {
+	st.lk.Lock()
+	defer st.lk.Unlock()
+
+	vals, ok := st.series[dim]
+	if !ok {
+		vals = make(map[string]*series)
+		st.series[dim] = vals
+	}
+	s, ok := vals[val]
+	if !ok {
+		s = &series{last: bucketOf(t)}
+		vals[val] = s
+	}
+	s.add(t, 1)
+}
+
+// StatsSnapshot are the rates at a point in time
+type StatsSnapshot struct {
+	Time    time.Time `json:"time"`
+	Windows []string  `json:"windows"`
+	// Rates are in events per second, by dimension, value and window
+	Rates map[string]map[string]map[string]float64 `json:"rates"`
+}
+
+// Snapshot returns the rates in the windows ending at now. Values without
+// events in the longest window are dropped.
+func (st *Stats) Snapshot(now time.Time) *StatsSnapshot {
+	snap := &StatsSnapshot{
+		Time:  now,
+		Rates: make(map[string]map[string]map[string]float64),
+	}
+	for _, w := range StatsWindows {
+		snap.Windows = append(snap.Windows, w.String())
+	}
+	longest := StatsWindows[len(StatsWindows)-1]
+
+	st.lk.Lock()
+	defer st.lk.Unlock()
+
+	for dim, vals := range st.series {
+		rates := make(map[string]map[string]float64)
+		for val, s := range vals {
+			if s.sum(now, longest) == 0 {
+				delete(vals, val)
+				continue
+			}
+			byWindow := make(map[string]float64, len(StatsWindows))
+			for _, w := range StatsWindows {
+				byWindow[w.String()] = float64(s.sum(now, w)) / w.Seconds()
+			}
+			rates[val] = byWindow
+		}
+		snap.Rates[dim] = rates
+	}
+	return snap
+}
+
+// Top returns the values of a dimension with the highest rates in a window,
+// highest first
+func (snap *StatsSnapshot) Top(dim string, window time.Duration, n int) []string {
+	rates := snap.Rates[dim]
+	vals := make([]string, 0, len(rates))
+	for val := range rates {
+		vals = append(vals, val)
+	}
+	w := window.String()
+	sort.Slice(vals, func(i, j int) bool {
+		if rates[vals[i]][w] != rates[vals[j]][w] {
+			return rates[vals[i]][w] > rates[vals[j]][w]
+		}
+		return vals[i] < vals[j]
+	})
+	if len(vals) > n {
+		vals = vals[:n]
+	}
+	return vals
+}
+
+func (st *Stats) Describe(ch chan<- *prometheus.Desc) {
+	ch <- st.rateDesc
+}
+
+func (st *Stats) Collect(ch chan<- prometheus.Metric) {
+	snap := st.Snapshot(time.Now())
+	longest := StatsWindows[len(StatsWindows)-1]
+	for dim, rates := range snap.Rates {
+		for _, val := range snap.Top(dim, longest, st.MaxMetricValues) {
+			for w, rate := range rates[val] {
+				ch <- prometheus.MustNewConstMetric(st.rateDesc, prometheus.GaugeValue, rate, dim, val, w)
+			}
+		}
+	}
+}
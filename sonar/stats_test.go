@@ -0,0 +1,66 @@
+package sonar
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatsWindows(t *testing.T) {
+	st := NewStats()
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	// 60 posts a minute for the first 10 minutes, and one like at the start
+	for i := 0; i < 600; i++ {
+		st.Add(DimCollection, "app.bsky.feed.post", start.Add(time.Duration(i)*time.Second))
+	}
+	st.Add(DimCollection, "app.bsky.feed.like", start)
+
+	rate := func(snap *StatsSnapshot, val string, w time.Duration) float64 {
+		return snap.Rates[DimCollection][val][w.String()]
+	}
+
+	snap := st.Snapshot(start.Add(10*time.Minute - time.Second))
+	if r := rate(snap, "app.bsky.feed.post", time.Minute); r != 1 {
+		t.Fatalf("expected a rate of 1/s over a minute, got %f", r)
+	}
+	if r := rate(snap, "app.bsky.feed.post", 5*time.Minute); r != 1 {
+		t.Fatalf("expected a rate of 1/s over 5 minutes, got %f", r)
+	}
+	if r := rate(snap, "app.bsky.feed.post", time.Hour); r != 600.0/3600 {
+		t.Fatalf("expected a rate of 600/h over an hour, got %f", r)
+	}
+	if r := rate(snap, "app.bsky.feed.like", time.Minute); r != 0 {
+		t.Fatalf("expected the like to have left the last minute, got %f", r)
+	}
+
+	top := snap.Top(DimCollection, time.Hour, 1)
+	if len(top) != 1 || top[0] != "app.bsky.feed.post" {
+		t.Fatalf("expected posts to be the top collection, got %v", top)
+	}
+
+	// values without events in the last hour are dropped
+	snap = st.Snapshot(start.Add(2 * time.Hour))
+	if len(snap.Rates[DimCollection]) != 0 {
+		t.Fatalf("expected old values to be dropped, got %v", snap.Rates[DimCollection])
+	}
+}
+
+func TestSeriesRing(t *testing.T) {
+	var s series
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	s.last = bucketOf(start)
+
+	s.add(start, 5)
+	// a full ring later, the bucket is reused and the old count cleared
+	later := start.Add(time.Hour)
+	s.add(later, 1)
+	if n := s.sum(later, time.Hour); n != 1 {
+		t.Fatalf("expected old counts to be cleared, got %d", n)
+	}
+
+	// events too old for any window are ignored
+	s.add(start, 3)
+	if n := s.sum(later, time.Hour); n != 1 {
+		t.Fatalf("expected old events to be ignored, got %d", n)
+	}
+}
@@ -0,0 +1,136 @@
+package testing
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	atproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/backfill"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestBGSBackfill(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping BGS test in 'short' test mode")
+	}
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	didr := TestPLC(t)
+	p1 := MustSetupPDS(t, ".tpds", didr)
+	p1.Run(t)
+
+	b1 := MustSetupBGS(t, didr)
+	b1.Run(t)
+
+	b1.tr.TrialHosts = []string{p1.RawHost()}
+
+	p1.RequestScraping(t, b1)
+
+	time.Sleep(time.Millisecond * 50)
+	es := b1.Events(t, 0)
+	defer es.Cancel()
+
+	bob := p1.MustNewUser(t, "bob.tpds")
+	alice := p1.MustNewUser(t, "alice.tpds")
+	carol := p1.MustNewUser(t, "carol.tpds")
+
+	bob.Post(t, "cats for cats")
+	alice.Post(t, "no i like dogs")
+	carol.Post(t, "im a bad person who deserves to be taken down")
+	es.WaitFor(6)
+
+	assert.NoError(b1.bgs.TakeDownRepo(ctx, carol.did))
+
+	bc := &backfill.BGSClient{Host: "http://" + b1.Host()}
+
+	// all repos, paginated
+	page, err := bc.ListRepos(ctx, "", 2, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(page.Repos, 2) && assert.NotNil(page.Cursor) {
+		assert.Equal(bob.did, page.Repos[0].Did)
+		assert.Equal("http://"+p1.RawHost(), page.Repos[0].Pds)
+		assert.True(page.Repos[0].Active)
+		assert.NotEmpty(page.Repos[0].Head)
+
+		page, err = bc.ListRepos(ctx, *page.Cursor, 2, "", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(page.Repos, 1) {
+			assert.Equal(carol.did, page.Repos[0].Did)
+			assert.False(page.Repos[0].Active)
+			assert.Empty(page.Repos[0].Head)
+		}
+	}
+
+	// filtered by activity and host
+	page, err = bc.ListRepos(ctx, "", 10, p1.RawHost(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(page.Repos, 2)
+	page, err = bc.ListRepos(ctx, "", 10, "pds.elsewhere.test", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(page.Repos, 0)
+
+	// the lexicon's listRepos only has active repos
+	lr, err := atproto.SyncListRepos(ctx, &xrpc.Client{Host: bc.Host}, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(lr.Repos, 2)
+
+	repos, heads, err := bc.GetSnapshot(ctx, []string{bob.did, alice.did, carol.did})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(repos, 2)
+	assert.Contains(heads, bob.did)
+	assert.NotContains(heads, carol.did)
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "backfill.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backfill.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	store := backfill.NewGormStore(db, "test")
+
+	var lk sync.Mutex
+	posts := make(map[string]int)
+	b := backfill.NewBackfiller("test", store, func(ctx context.Context, did, path string, rcid cid.Cid, rec *lexutil.RawRecord) error {
+		lk.Lock()
+		defer lk.Unlock()
+		if rec.Type == "app.bsky.feed.post" {
+			posts[did]++
+		}
+		return nil
+	}, nil)
+
+	if err := b.Bootstrap(ctx, bc, ""); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(map[string]int{bob.did: 1, alice.did: 1}, posts)
+
+	j, err := store.GetJob(ctx, bob.did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(backfill.StateComplete, j.State)
+	assert.Equal(heads[bob.did].String(), j.Head)
+	assert.Equal("http://"+p1.RawHost(), j.PDS)
+}
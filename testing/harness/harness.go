@@ -0,0 +1,279 @@
+// Package harness runs a PDS, a BGS and a labeler in-process, wired together
+// and on temporary storage, for tests of behaviors across services that would
+// otherwise need docker-compose.
+//
+//	h := harness.New(t, harness.Config{})
+//	bob := h.NewUser("bob")
+//	post := bob.Post(t, "the cat")
+//	h.WaitForRecord(post.Uri)
+//	h.WaitForLabel(post.Uri, "definite-article")
+package harness
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	label "github.com/bluesky-social/indigo/api/label"
+	"github.com/bluesky-social/indigo/carstore"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/labeler"
+	"github.com/bluesky-social/indigo/plc"
+	indigotest "github.com/bluesky-social/indigo/testing"
+	"github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/util/aturi"
+	"github.com/bluesky-social/indigo/xrpc"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// DefaultTimeout is how long the Wait helpers wait for events by default
+const DefaultTimeout = 10 * time.Second
+
+// LabelerAdminPassword is the admin password of the labeler
+const LabelerAdminPassword = "test-admin-pass"
+
+type Config struct {
+	// HandleSuffix is the handle domain of the PDS, ".test" by default
+	HandleSuffix string
+	// KeywordLabels has the labeler label posts containing keywords, by
+	// label value. If empty, posts with "the" are labeled
+	// "definite-article".
+	KeywordLabels map[string][]string
+	// ConfigureLabeler, if set, is called before the labeler subscribes to
+	// the BGS, to add labelers or rules
+	ConfigureLabeler func(*labeler.Server)
+	// NoLabeler skips starting a labeler
+	NoLabeler bool
+	// Timeout is how long the Wait helpers wait, DefaultTimeout if zero
+	Timeout time.Duration
+}
+
+// Harness is a running PDS, a BGS crawling it, and a labeler consuming the
+// BGS. Everything is shut down when the test ends.
+type Harness struct {
+	T       *testing.T
+	PLC     *plc.FakeDid
+	PDS     *indigotest.TestPDS
+	BGS     *indigotest.TestBGS
+	Labeler *labeler.Server
+	// LabelerHost is the base URL of the labeler
+	LabelerHost string
+
+	Timeout time.Duration
+
+	suffix string
+	// Repos has all the events of the BGS firehose, from the start
+	Repos *Stream
+	// Labels has all the events of the labeler's label stream
+	Labels *Stream
+}
+
+func New(t *testing.T, cfg Config) *Harness {
+	t.Helper()
+
+	h := &Harness{
+		T:       t,
+		Timeout: cfg.Timeout,
+		suffix:  cfg.HandleSuffix,
+	}
+	if h.Timeout == 0 {
+		h.Timeout = DefaultTimeout
+	}
+	if h.suffix == "" {
+		h.suffix = ".test"
+	}
+
+	h.PLC = indigotest.TestPLC(t)
+
+	h.PDS = indigotest.MustSetupPDS(t, h.suffix, h.PLC)
+	h.PDS.Run(t)
+	t.Cleanup(h.PDS.Cleanup)
+
+	h.BGS = indigotest.MustSetupBGS(t, h.PLC)
+	h.BGS.Run(t)
+	h.BGS.ResolveHandlesOn(h.PDS)
+	h.PDS.RequestScraping(t, h.BGS)
+
+	h.Repos = h.subscribe("ws://" + h.BGS.Host() + "/xrpc/com.atproto.sync.subscribeRepos")
+
+	if !cfg.NoLabeler {
+		h.startLabeler(cfg)
+		h.Labels = h.subscribe(strings.Replace(h.LabelerHost, "http://", "ws://", 1) + "/xrpc/com.atproto.label.subscribeLabels")
+	}
+
+	return h
+}
+
+func (h *Harness) startLabeler(cfg Config) {
+	t := h.T
+	t.Helper()
+
+	dir := t.TempDir()
+	sharddir := filepath.Join(dir, "shards")
+	if err := os.MkdirAll(sharddir, 0775); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(dir, "labelmaker.sqlite")), &gorm.Config{SkipDefaultTransaction: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := carstore.NewCarStore(db, sharddir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serkey, err := labeler.LoadOrCreateKeyFile(filepath.Join(dir, "labelmaker.key"), "auto-labelmaker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repoUser := labeler.RepoConfig{
+		Handle:     "labelmaker" + h.suffix,
+		Did:        "did:plc:testlabelmaker",
+		Password:   LabelerAdminPassword,
+		SigningKey: serkey,
+		UserId:     1,
+	}
+
+	lm, err := labeler.NewServer(db, cs, repoUser, "http://did-plc-test.dummy", h.PDS.HTTPHost(), h.PDS.HTTPHost(), "test-dummy-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kwl := cfg.KeywordLabels
+	if len(kwl) == 0 {
+		kwl = map[string][]string{"definite-article": {"the"}}
+	}
+	for val, keywords := range kwl {
+		lm.AddKeywordLabeler(labeler.KeywordLabeler{Value: val, Keywords: keywords})
+	}
+	if cfg.ConfigureLabeler != nil {
+		cfg.ConfigureLabeler(lm)
+	}
+
+	li, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		if err := lm.RunAPIWithListener(li); err != nil {
+			fmt.Println(err)
+		}
+	}()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = lm.Shutdown(ctx)
+	})
+
+	if err := lm.SubscribeBGS(context.Background(), h.BGS.Host(), false); err != nil {
+		h.T.Fatal(err)
+	}
+
+	h.Labeler = lm
+	h.LabelerHost = "http://" + li.Addr().String()
+}
+
+// NewUser creates an account on the PDS. The handle gets the PDS suffix if
+// it has no domain.
+func (h *Harness) NewUser(handle string) *indigotest.TestUser {
+	h.T.Helper()
+	if !strings.Contains(handle, ".") {
+		handle += h.suffix
+	}
+	return h.PDS.MustNewUser(h.T, handle)
+}
+
+// LabelerClient returns a client of the labeler, authenticated as admin
+func (h *Harness) LabelerClient() *xrpc.Client {
+	pw := LabelerAdminPassword
+	return &xrpc.Client{
+		Client:     util.TestingHTTPClient(),
+		Host:       h.LabelerHost,
+		AdminToken: &pw,
+	}
+}
+
+// WaitForCommit waits for a commit on the BGS firehose matching a predicate
+func (h *Harness) WaitForCommit(desc string, match func(evt *comatproto.SyncSubscribeRepos_Commit) bool) *comatproto.SyncSubscribeRepos_Commit {
+	h.T.Helper()
+	evt := h.Repos.WaitFor(h.T, h.Timeout, desc, func(evt *events.XRPCStreamEvent) bool {
+		return evt.RepoCommit != nil && match(evt.RepoCommit)
+	})
+	return evt.RepoCommit
+}
+
+// WaitForRecord waits for the commit of a record (by at:// URI) to reach the
+// BGS firehose
+func (h *Harness) WaitForRecord(uri string) *comatproto.SyncSubscribeRepos_Commit {
+	h.T.Helper()
+	did, path, ok := splitURI(uri)
+	if !ok {
+		h.T.Fatalf("not a record URI: %s", uri)
+	}
+	return h.WaitForCommit("commit of "+uri, func(evt *comatproto.SyncSubscribeRepos_Commit) bool {
+		if evt.Repo != did {
+			return false
+		}
+		for _, op := range evt.Ops {
+			if op.Path == path {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// WaitForLabel waits for the labeler to emit a label with a value on a
+// subject (record or repo URI)
+func (h *Harness) WaitForLabel(uri, val string) *label.Label {
+	h.T.Helper()
+	if h.Labels == nil {
+		h.T.Fatal("harness has no labeler")
+	}
+
+	var found *label.Label
+	h.Labels.WaitFor(h.T, h.Timeout, fmt.Sprintf("label %s on %s", val, uri), func(evt *events.XRPCStreamEvent) bool {
+		if evt.LabelLabels == nil {
+			return false
+		}
+		for _, l := range evt.LabelLabels.Labels {
+			if l.Uri == uri && l.Val == val && !l.Neg {
+				found = l
+				return true
+			}
+		}
+		return false
+	})
+	return found
+}
+
+// Eventually polls a condition until it holds, failing the test if it doesn't
+// within the timeout
+func (h *Harness) Eventually(desc string, cond func() bool) {
+	h.T.Helper()
+	deadline := time.Now().Add(h.Timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			h.T.Fatalf("timed out after %s waiting for %s", h.Timeout, desc)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// splitURI splits an at:// record URI into the repo DID and record path
+func splitURI(uri string) (string, string, bool) {
+	u, err := aturi.ParseRecord(uri)
+	if err != nil || !u.IsDID() {
+		return "", "", false
+	}
+	return u.Authority, u.Path(), true
+}
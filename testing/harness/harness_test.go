@@ -0,0 +1,55 @@
+package harness
+
+import (
+	"context"
+	"testing"
+
+	label "github.com/bluesky-social/indigo/api/label"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHarnessLabels(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping harness test in 'short' test mode")
+	}
+	assert := assert.New(t)
+	h := New(t, Config{})
+
+	bob := h.NewUser("bob")
+	alice := h.NewUser("alice")
+	assert.Equal("bob.test", bob.Handle())
+
+	bp := bob.Post(t, "the cat sat")
+	ap := alice.Post(t, "dogs are great")
+	h.WaitForRecord(bp.Uri)
+	h.WaitForRecord(ap.Uri)
+
+	l := h.WaitForLabel(bp.Uri, "definite-article")
+	assert.Equal(bp.Cid, *l.Cid)
+
+	// the labeler handles each repo's events in order, so once alice's
+	// next post is labeled, her unlabeled post has been seen and got no
+	// label
+	next := alice.Post(t, "the end")
+	h.WaitForLabel(next.Uri, "definite-article")
+	out, err := label.QueryLabels(context.TODO(), h.LabelerClient(), "", 20, nil, []string{ap.Uri})
+	assert.NoError(err)
+	assert.Empty(out.Labels)
+
+	follow := alice.Follow(t, bob.DID())
+	commit := h.WaitForRecord(follow)
+	assert.Equal(alice.DID(), commit.Repo)
+}
+
+func TestSplitURI(t *testing.T) {
+	did, path, ok := splitURI("at://did:plc:abc/app.bsky.feed.post/123")
+	assert.True(t, ok)
+	assert.Equal(t, "did:plc:abc", did)
+	assert.Equal(t, "app.bsky.feed.post/123", path)
+
+	_, _, ok = splitURI("at://did:plc:abc")
+	assert.False(t, ok)
+	_, _, ok = splitURI("https://example.com/x/y")
+	assert.False(t, ok)
+}
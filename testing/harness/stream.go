@@ -0,0 +1,136 @@
+package harness
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/events/schedulers/sequential"
+
+	"github.com/gorilla/websocket"
+)
+
+// Stream keeps all the events of a subscription (a firehose or label
+// stream), so that tests can wait for events without racing them
+type Stream struct {
+	lk     sync.Mutex
+	events []*events.XRPCStreamEvent
+	// changed is closed and replaced when events arrive
+	changed chan struct{}
+	err     error
+
+	cancel func()
+}
+
+// subscribe connects to a subscription endpoint, retrying until it is up
+func (h *Harness) subscribe(url string) *Stream {
+	t := h.T
+	t.Helper()
+
+	var con *websocket.Conn
+	deadline := time.Now().Add(h.Timeout)
+	for {
+		c, _, err := websocket.DefaultDialer.Dial(url, http.Header{})
+		if err == nil {
+			con = c
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connecting to %s: %s", url, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Stream{
+		changed: make(chan struct{}),
+		cancel:  cancel,
+	}
+	t.Cleanup(s.Close)
+
+	go func() {
+		<-ctx.Done()
+		con.Close()
+	}()
+
+	go func() {
+		sched := sequential.NewScheduler("harness", func(ctx context.Context, evt *events.XRPCStreamEvent) error {
+			s.add(evt)
+			return nil
+		})
+		err := events.HandleRepoStream(ctx, con, sched)
+		if ctx.Err() == nil {
+			s.fail(fmt.Errorf("stream %s ended: %w", url, err))
+		}
+	}()
+
+	return s
+}
+
+func (s *Stream) add(evt *events.XRPCStreamEvent) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.events = append(s.events, evt)
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *Stream) fail(err error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.err = err
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// All returns the events received so far
+func (s *Stream) All() []*events.XRPCStreamEvent {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	out := make([]*events.XRPCStreamEvent, len(s.events))
+	copy(out, s.events)
+	return out
+}
+
+// WaitFor returns the first event, received so far or in the future, which
+// matches a predicate. The test fails if there is none within the timeout.
+func (s *Stream) WaitFor(t *testing.T, timeout time.Duration, desc string, match func(*events.XRPCStreamEvent) bool) *events.XRPCStreamEvent {
+	t.Helper()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	seen := 0
+	for {
+		s.lk.Lock()
+		evts := s.events[seen:]
+		changed := s.changed
+		err := s.err
+		s.lk.Unlock()
+
+		for _, evt := range evts {
+			if match(evt) {
+				return evt
+			}
+		}
+		seen += len(evts)
+		if err != nil {
+			t.Fatalf("waiting for %s: %s", desc, err)
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			t.Fatalf("timed out after %s waiting for %s (%d events seen)", timeout, desc, seen)
+		}
+	}
+}
+
+// Close disconnects the stream
+func (s *Stream) Close() {
+	s.cancel()
+}
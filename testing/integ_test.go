@@ -12,6 +12,7 @@ import (
 
 	atproto "github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/repo"
+	"github.com/bluesky-social/indigo/rules"
 	"github.com/bluesky-social/indigo/xrpc"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-log/v2"
@@ -275,6 +276,16 @@ func TestHandleChange(t *testing.T) {
 	fmt.Println(initevt.RepoCommit)
 	hcevt := evts.Next()
 	fmt.Println(hcevt.RepoHandle)
+	if assert.NotNil(hcevt.RepoHandle) {
+		assert.Equal(u.DID(), hcevt.RepoHandle.Did)
+		assert.Equal("catbear.pdsuno", hcevt.RepoHandle.Handle)
+	}
+
+	ai, err := b1.bgs.Index.LookupUserByDid(context.TODO(), u.DID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal("catbear.pdsuno", ai.Handle)
 }
 
 func TestBGSTakedown(t *testing.T) {
@@ -332,6 +343,118 @@ func TestBGSTakedown(t *testing.T) {
 	assert.Equal(alice.did, last.RepoCommit.Repo)
 }
 
+func TestBGSUpstreamRelays(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping BGS test in 'short' test mode")
+	}
+	assert := assert.New(t)
+
+	didr := TestPLC(t)
+	p1 := MustSetupPDS(t, ".tpds", didr)
+	p1.Run(t)
+
+	// two relays subscribed to the PDS, and one chained on to both of them
+	r1 := MustSetupBGS(t, didr)
+	r1.Run(t)
+	r1.ResolveHandlesOn(p1)
+	r2 := MustSetupBGS(t, didr)
+	r2.Run(t)
+	r2.ResolveHandlesOn(p1)
+	p1.RequestScraping(t, r1)
+	p1.RequestScraping(t, r2)
+
+	mirror := MustSetupBGS(t, didr)
+	mirror.Run(t)
+	mirror.ResolveHandlesOn(p1)
+	for _, r := range []*TestBGS{r1, r2} {
+		if err := mirror.bgs.AddUpstreamRelay(context.TODO(), r.Host()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(time.Millisecond * 50)
+	es := mirror.Events(t, 0)
+
+	bob := p1.MustNewUser(t, "bob.tpds")
+	alice := p1.MustNewUser(t, "alice.tpds")
+	bob.Post(t, "cats for cats")
+	alice.Post(t, "no i like dogs")
+
+	// each commit is passed on once, though both relays send it
+	evts := es.WaitFor(4)
+	time.Sleep(time.Millisecond * 200)
+	assert.Equal(4, len(es.All()))
+	assert.Equal(bob.did, evts[0].RepoCommit.Repo)
+	assert.Equal(alice.did, evts[3].RepoCommit.Repo)
+
+	// events keep arriving with one of the relays gone
+	errs := r1.bgs.Shutdown(context.TODO())
+	assert.Empty(errs)
+	bob.Post(t, "still here")
+	last := es.Next()
+	assert.Equal(bob.did, last.RepoCommit.Repo)
+}
+
+func TestBGSRulesTakedown(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping BGS test in 'short' test mode")
+	}
+	assert := assert.New(t)
+
+	rs, err := rules.ParseRuleSet([]byte(`
+rules:
+  - name: crypto
+    collections: [app.bsky.feed.post]
+    when: {field: text, contains: airdrop}
+    actions:
+      - escalate: takedown
+`))
+	assert.NoError(err)
+	engine, err := rules.NewEngine(rs)
+	assert.NoError(err)
+
+	didr := TestPLC(t)
+	p1 := MustSetupPDS(t, ".tpds", didr)
+	p1.Run(t)
+
+	b1 := MustSetupBGS(t, didr)
+	b1.bgs.SetRules(engine)
+	b1.Run(t)
+
+	b1.tr.TrialHosts = []string{p1.RawHost()}
+
+	p1.RequestScraping(t, b1)
+
+	time.Sleep(time.Millisecond * 50)
+	es1 := b1.Events(t, 0)
+
+	bob := p1.MustNewUser(t, "bob.tpds")
+	alice := p1.MustNewUser(t, "alice.tpds")
+
+	bob.Post(t, "cats for cats")
+	alice.Post(t, "no i like dogs")
+	bob.Post(t, "huge AIRDROP, click now")
+
+	expCount := 5
+	evts1 := es1.WaitFor(expCount)
+	assert.Equal(expCount, len(evts1))
+
+	// the rule took bob down, so their events are dropped
+	bob.Post(t, "im gonna sneak through being banned")
+	time.Sleep(time.Millisecond * 50)
+	alice.Post(t, "im a normal person")
+
+	es2 := b1.Events(t, 0)
+	time.Sleep(time.Millisecond * 50)
+	evts2 := es2.WaitFor(3)
+	for _, e := range evts2 {
+		if e.RepoCommit.Repo == bob.did {
+			t.Fatal("events from bob were not removed")
+		}
+	}
+	assert.Equal(alice.did, evts2[len(evts2)-1].RepoCommit.Repo)
+}
+
 func TestRebase(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping BGS test in 'short' test mode")
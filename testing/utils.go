@@ -21,6 +21,7 @@ import (
 	atproto "github.com/bluesky-social/indigo/api/atproto"
 	bsky "github.com/bluesky-social/indigo/api/bsky"
 	"github.com/bluesky-social/indigo/bgs"
+	"github.com/bluesky-social/indigo/blobs"
 	"github.com/bluesky-social/indigo/carstore"
 	"github.com/bluesky-social/indigo/events"
 	"github.com/bluesky-social/indigo/events/schedulers/sequential"
@@ -36,6 +37,7 @@ import (
 	"github.com/bluesky-social/indigo/xrpc"
 	"github.com/ipfs/go-cid"
 	"github.com/multiformats/go-multihash"
+	cbg "github.com/whyrusleeping/cbor-gen"
 	"github.com/whyrusleeping/go-did"
 
 	"net/url"
@@ -141,6 +143,8 @@ func SetupPDS(ctx context.Context, suffix string, plc plc.PLCClient) (*TestPDS,
 		return nil, err
 	}
 
+	srv.SetBlobStore(&blobs.DiskBlobStore{Dir: filepath.Join(dir, "blobs")})
+
 	return &TestPDS{
 		dir:      dir,
 		server:   srv,
@@ -249,6 +253,36 @@ func (u *TestUser) DID() string {
 	return u.did
 }
 
+func (u *TestUser) Handle() string {
+	return u.handle
+}
+
+// Client returns an XRPC client authenticated as the user, for the calls
+// without helpers here
+func (u *TestUser) Client() *xrpc.Client {
+	return u.client
+}
+
+// CreateRecord creates a record of any type in the user's repo
+func (u *TestUser) CreateRecord(t *testing.T, collection string, rec cbg.CBORMarshaler) *atproto.RepoStrongRef {
+	t.Helper()
+
+	ctx := context.TODO()
+	resp, err := atproto.RepoCreateRecord(ctx, u.client, &atproto.RepoCreateRecord_Input{
+		Collection: collection,
+		Repo:       u.did,
+		Record:     &lexutil.LexiconTypeDecoder{Val: rec},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &atproto.RepoStrongRef{
+		Cid: resp.Cid,
+		Uri: resp.Uri,
+	}
+}
+
 func (u *TestUser) Post(t *testing.T, body string) *atproto.RepoStrongRef {
 	t.Helper()
 
@@ -453,6 +487,8 @@ func SetupBGS(ctx context.Context, didr plc.PLCClient) (*TestBGS, error) {
 	if err != nil {
 		return nil, err
 	}
+	// check everything the test PDSs send as thoroughly as we can
+	b.SetCommitVerification(repomgr.VerifyFull, 4)
 
 	var lc net.ListenConfig
 	listener, err := lc.Listen(ctx, "tcp", "localhost:0")
@@ -477,6 +513,12 @@ func (b *TestBGS) Run(t *testing.T) {
 	time.Sleep(time.Millisecond * 10)
 }
 
+// ResolveHandlesOn has the BGS resolve handles by asking a PDS, since test
+// handles are not in DNS
+func (b *TestBGS) ResolveHandlesOn(p *TestPDS) {
+	b.tr.TrialHosts = append(b.tr.TrialHosts, p.RawHost())
+}
+
 func (b *TestBGS) BanDomain(t *testing.T, d string) {
 	t.Helper()
 
@@ -0,0 +1,146 @@
+// Package ahocorasick finds which of a set of patterns occur in a text, in
+// one pass over the text whatever the number of patterns, with an
+// Aho-Corasick automaton. It is for matching texts against large keyword
+// lists, where checking each keyword in turn is too slow.
+//
+// Patterns and texts are matched as bytes, so a pattern occurs in a text
+// exactly when strings.Contains would say it does.
+package ahocorasick
+
+import (
+	"sort"
+)
+
+type edge struct {
+	b  byte
+	to int32
+}
+
+type node struct {
+	// edges are the transitions out of the node, sorted by byte
+	edges []edge
+
+	// fail is the node of the longest proper suffix of this node's prefix
+	// which is also a prefix of some pattern
+	fail int32
+
+	// dict is the nearest node on the fail chain which ends patterns, or
+	// -1 if there is none
+	dict int32
+
+	// patterns are the indexes of the patterns ending at the node
+	patterns []int32
+}
+
+func (n *node) next(b byte) (int32, bool) {
+	i := sort.Search(len(n.edges), func(i int) bool { return n.edges[i].b >= b })
+	if i < len(n.edges) && n.edges[i].b == b {
+		return n.edges[i].to, true
+	}
+	return 0, false
+}
+
+// Matcher is a compiled set of patterns. It is safe for concurrent use.
+type Matcher struct {
+	nodes []node
+
+	// root is the transitions out of the root node, which every
+	// mismatch falls back to, as a table
+	root [256]int32
+}
+
+// New compiles the patterns. Patterns are identified by their index in
+// patterns when matched, and may repeat. The empty pattern occurs in every
+// text.
+func New(patterns []string) *Matcher {
+	m := &Matcher{nodes: []node{{dict: -1}}}
+
+	for i, p := range patterns {
+		cur := int32(0)
+		for j := 0; j < len(p); j++ {
+			n := &m.nodes[cur]
+			to, ok := n.next(p[j])
+			if !ok {
+				to = int32(len(m.nodes))
+				k := sort.Search(len(n.edges), func(k int) bool { return n.edges[k].b >= p[j] })
+				n.edges = append(n.edges, edge{})
+				copy(n.edges[k+1:], n.edges[k:])
+				n.edges[k] = edge{b: p[j], to: to}
+				m.nodes = append(m.nodes, node{dict: -1})
+			}
+			cur = to
+		}
+		m.nodes[cur].patterns = append(m.nodes[cur].patterns, int32(i))
+	}
+
+	for _, e := range m.nodes[0].edges {
+		m.root[e.b] = e.to
+	}
+
+	// fail links are found breadth first, as each depends on those of
+	// shorter prefixes. Those of the root's children are the root.
+	queue := make([]int32, 0, len(m.nodes))
+	for _, e := range m.nodes[0].edges {
+		queue = append(queue, e.to)
+	}
+	for len(queue) > 0 {
+		u := queue[0]
+		queue = queue[1:]
+		for _, e := range m.nodes[u].edges {
+			f := m.step(m.nodes[u].fail, e.b)
+			c := &m.nodes[e.to]
+			c.fail = f
+			if len(m.nodes[f].patterns) > 0 {
+				c.dict = f
+			} else {
+				c.dict = m.nodes[f].dict
+			}
+			queue = append(queue, e.to)
+		}
+	}
+
+	return m
+}
+
+// step returns the state after reading b in state s
+func (m *Matcher) step(s int32, b byte) int32 {
+	for s != 0 {
+		if to, ok := m.nodes[s].next(b); ok {
+			return to
+		}
+		s = m.nodes[s].fail
+	}
+	return m.root[b]
+}
+
+// Each calls fn with the index of each pattern occurring in text, until fn
+// returns false. Patterns are passed once for each place they occur.
+func (m *Matcher) Each(text string, fn func(pattern int) bool) {
+	for _, p := range m.nodes[0].patterns {
+		if !fn(int(p)) {
+			return
+		}
+	}
+
+	s := int32(0)
+	for i := 0; i < len(text); i++ {
+		s = m.step(s, text[i])
+		for o := s; o > 0; o = m.nodes[o].dict {
+			for _, p := range m.nodes[o].patterns {
+				if !fn(int(p)) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Contains reports whether any of the patterns occur in text
+func (m *Matcher) Contains(text string) bool {
+	found := false
+	m.Each(text, func(int) bool {
+		found = true
+		return false
+	})
+	return found
+}
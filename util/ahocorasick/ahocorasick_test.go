@@ -0,0 +1,108 @@
+package ahocorasick
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// found returns the distinct patterns m finds in text, sorted
+func found(m *Matcher, text string) []int {
+	seen := map[int]bool{}
+	m.Each(text, func(p int) bool {
+		seen[p] = true
+		return true
+	})
+	out := []int{}
+	for p := range seen {
+		out = append(out, p)
+	}
+	sort.Ints(out)
+	return out
+}
+
+// contained returns the patterns strings.Contains finds in text
+func contained(patterns []string, text string) []int {
+	out := []int{}
+	for i, p := range patterns {
+		if strings.Contains(text, p) {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+func TestMatcher(t *testing.T) {
+	patterns := []string{"he", "she", "his", "hers", "🍆", "she"}
+	m := New(patterns)
+
+	cases := map[string][]int{
+		"":              {},
+		"ushers":        {0, 1, 3, 5},
+		"this":          {2},
+		"nothing here":  {0},
+		"aubergine 🍆":   {4},
+		"h e r s":       {},
+		"hishershe":     {0, 1, 2, 3, 5},
+		"SHE, in caps":  {},
+		"shshshehehehe": {0, 1, 5},
+	}
+	for text, want := range cases {
+		if got := found(m, text); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: expected %v, got %v", text, want, got)
+		}
+		if got := m.Contains(text); got != (len(want) > 0) {
+			t.Errorf("%q: expected Contains to be %v", text, len(want) > 0)
+		}
+	}
+
+	if got := found(New([]string{"", "x"}), "abc"); !reflect.DeepEqual(got, []int{0}) {
+		t.Errorf("expected the empty pattern to be found, got %v", got)
+	}
+}
+
+func TestMatcherRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	word := func(n int) string {
+		b := make([]byte, 1+rng.Intn(n))
+		for i := range b {
+			b[i] = "abc"[rng.Intn(3)]
+		}
+		return string(b)
+	}
+
+	for i := 0; i < 100; i++ {
+		patterns := make([]string, 1+rng.Intn(20))
+		for j := range patterns {
+			patterns[j] = word(5)
+		}
+		m := New(patterns)
+		for j := 0; j < 20; j++ {
+			text := word(30)
+			if got, want := found(m, text), contained(patterns, text); !reflect.DeepEqual(got, want) {
+				t.Fatalf("patterns %q in %q: expected %v, got %v", patterns, text, want, got)
+			}
+		}
+	}
+}
+
+func BenchmarkMatcher(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+	patterns := make([]string, 50_000)
+	for i := range patterns {
+		w := make([]byte, 5+rng.Intn(10))
+		for j := range w {
+			w[j] = byte('a' + rng.Intn(26))
+		}
+		patterns[i] = string(w)
+	}
+	m := New(patterns)
+	text := strings.Repeat("the quick brown fox jumps over the lazy dog ", 7)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Contains(text)
+	}
+}
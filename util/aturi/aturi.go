@@ -0,0 +1,239 @@
+// Package aturi parses, validates and builds at:// URIs, in the restricted
+// syntax atproto uses to refer to accounts, collections and records:
+//
+//	at://<did or handle>[/<collection NSID>[/<record key>]][#<fragment>]
+package aturi
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/bluesky-social/indigo/util/syntax"
+)
+
+// MaxLength is the longest an at:// URI may be
+const MaxLength = 8 * 1024
+
+// The errors parsing fails with, wrapped in an *Error
+var (
+	ErrScheme       = errors.New("must start with at://")
+	ErrTooLong      = fmt.Errorf("longer than %d bytes", MaxLength)
+	ErrAuthority    = errors.New("authority is not a valid DID or handle")
+	ErrCollection   = errors.New("collection is not a valid NSID")
+	ErrRecordKey    = errors.New("invalid record key")
+	ErrPath         = errors.New("invalid path")
+	ErrQuery        = errors.New("query parameters are not supported")
+	ErrFragment     = errors.New("fragment must start with /")
+	ErrNotRecordURI = errors.New("not the URI of a record")
+)
+
+// Error is the error parsing an at:// URI fails with. Err is one of the
+// package's Err values.
+type Error struct {
+	URI string
+	Err error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("invalid at-uri %q: %s", e.URI, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// URI is a parsed at:// URI. Collection and RecordKey are empty for URIs of
+// accounts, and RecordKey for URIs of collections. Fragment doesn't include
+// the leading #.
+type URI struct {
+	Authority  string
+	Collection string
+	RecordKey  string
+	Fragment   string
+}
+
+// Parse parses and validates an at:// URI, normalizing it: handles are
+// lowercased, as are the domain parts of collection NSIDs
+func Parse(s string) (*URI, error) {
+	u, err := parse(s)
+	if err != nil {
+		return nil, &Error{URI: s, Err: err}
+	}
+	return u, nil
+}
+
+// ParseRecord is like Parse, for URIs which must refer to a record
+func ParseRecord(s string) (*URI, error) {
+	u, err := Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.RecordKey == "" {
+		return nil, &Error{URI: s, Err: ErrNotRecordURI}
+	}
+	return u, nil
+}
+
+func parse(s string) (*URI, error) {
+	if len(s) > MaxLength {
+		return nil, ErrTooLong
+	}
+
+	rest, ok := strings.CutPrefix(s, "at://")
+	if !ok {
+		return nil, ErrScheme
+	}
+
+	var u URI
+	rest, frag, hasFrag := strings.Cut(rest, "#")
+	if hasFrag {
+		if !strings.HasPrefix(frag, "/") {
+			return nil, ErrFragment
+		}
+		u.Fragment = frag
+	}
+	if strings.Contains(rest, "?") {
+		return nil, ErrQuery
+	}
+
+	parts := strings.Split(rest, "/")
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("%w: too many segments", ErrPath)
+	}
+	for _, p := range parts[1:] {
+		if p == "" {
+			return nil, fmt.Errorf("%w: empty segment", ErrPath)
+		}
+	}
+
+	if err := u.setAuthority(parts[0]); err != nil {
+		return nil, err
+	}
+	if len(parts) > 1 {
+		if err := u.setCollection(parts[1]); err != nil {
+			return nil, err
+		}
+	}
+	if len(parts) > 2 {
+		if err := u.setRecordKey(parts[2]); err != nil {
+			return nil, err
+		}
+	}
+	return &u, nil
+}
+
+func (u *URI) setAuthority(a string) error {
+	id, err := syntax.ParseAtIdentifier(a)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrAuthority, err)
+	}
+	u.Authority = id
+	return nil
+}
+
+func (u *URI) setCollection(c string) error {
+	nsid, err := syntax.ParseNSID(c)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrCollection, err)
+	}
+	u.Collection = nsid.String()
+	return nil
+}
+
+func (u *URI) setRecordKey(k string) error {
+	rkey, err := syntax.ParseRecordKey(k)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrRecordKey, err)
+	}
+	u.RecordKey = rkey.String()
+	return nil
+}
+
+// New builds the URI of an account, or of a collection or record in its repo
+// if collection and rkey are given, validating and normalizing the parts as
+// Parse does
+func New(authority, collection, rkey string) (*URI, error) {
+	s := "at://" + authority
+	if collection != "" {
+		s += "/" + collection
+		if rkey != "" {
+			s += "/" + rkey
+		}
+	} else if rkey != "" {
+		return nil, &Error{URI: s + "//" + rkey, Err: fmt.Errorf("%w: record key without a collection", ErrPath)}
+	}
+	return Parse(s)
+}
+
+// IsDID reports whether the URI's authority is a DID, rather than a handle
+func (u *URI) IsDID() bool {
+	return strings.HasPrefix(u.Authority, "did:")
+}
+
+// DID returns the URI's authority if it's a DID, or "" if it's a handle
+func (u *URI) DID() string {
+	if u.IsDID() {
+		return u.Authority
+	}
+	return ""
+}
+
+// IsRecord reports whether the URI refers to a record
+func (u *URI) IsRecord() bool {
+	return u.RecordKey != ""
+}
+
+// Path returns the URI's path within the repo, collection/rkey, as records
+// are keyed in repos and commit ops. It is empty for URIs of accounts.
+func (u *URI) Path() string {
+	if u.RecordKey != "" {
+		return u.Collection + "/" + u.RecordKey
+	}
+	return u.Collection
+}
+
+func (u *URI) String() string {
+	s := "at://" + u.Authority
+	if p := u.Path(); p != "" {
+		s += "/" + p
+	}
+	if u.Fragment != "" {
+		s += "#" + u.Fragment
+	}
+	return s
+}
+
+// Resolve resolves a URI reference against u, as a browser would resolve a
+// link on the page at u (RFC 3986, section 5.2). ref may be a whole at://
+// URI, a path from the authority such as /app.bsky.feed.post/3k2a, a path
+// relative to u such as 3k2a or ../app.bsky.graph.follow, or a fragment.
+func (u *URI) Resolve(ref string) (*URI, error) {
+	if strings.HasPrefix(ref, "at://") {
+		return Parse(ref)
+	}
+
+	ref, frag, hasFrag := strings.Cut(ref, "#")
+
+	var p string
+	switch {
+	case ref == "":
+		p = "/" + u.Path()
+	case strings.HasPrefix(ref, "/"):
+		p = ref
+	default:
+		// relative paths replace the last segment of u's path
+		base := "/" + u.Path()
+		p = base[:strings.LastIndexByte(base, '/')+1] + ref
+	}
+
+	s := "at://" + u.Authority
+	if p = path.Clean(p); p != "/" {
+		s += p
+	}
+	if hasFrag {
+		s += "#" + frag
+	}
+	return Parse(s)
+}
@@ -0,0 +1,124 @@
+package aturi
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	assert := assert.New(t)
+
+	u, err := Parse("at://did:plc:abc123/app.bsky.feed.post/3k2akbnqeh42p")
+	if assert.NoError(err) {
+		assert.Equal("did:plc:abc123", u.Authority)
+		assert.Equal("app.bsky.feed.post", u.Collection)
+		assert.Equal("3k2akbnqeh42p", u.RecordKey)
+		assert.True(u.IsDID())
+		assert.True(u.IsRecord())
+		assert.Equal("app.bsky.feed.post/3k2akbnqeh42p", u.Path())
+	}
+
+	// handles and NSID domains are case insensitive
+	u, err = Parse("at://Alice.Example.COM/COM.Example.fooBar/self#/text")
+	if assert.NoError(err) {
+		assert.Equal("at://alice.example.com/com.example.fooBar/self#/text", u.String())
+		assert.False(u.IsDID())
+		assert.Equal("", u.DID())
+	}
+
+	for _, s := range []string{"at://did:web:example.com", "at://did:plc:abc/com.example.foo", "at://did:plc:abc/com.example.foo/a:b~c_d.e-f"} {
+		u, err := Parse(s)
+		if assert.NoError(err, s) {
+			assert.Equal(s, u.String())
+		}
+	}
+
+	cases := []struct {
+		uri string
+		err error
+	}{
+		{"https://example.com", ErrScheme},
+		{"at://", ErrAuthority},
+		{"at://did:plc:", ErrAuthority},
+		{"at://not_a_handle/com.example.foo", ErrAuthority},
+		{"at://did:plc:abc/foo", ErrCollection},
+		{"at://did:plc:abc/com.example.foo/..", ErrRecordKey},
+		{"at://did:plc:abc/com.example.foo/a%20b", ErrRecordKey},
+		{"at://did:plc:abc/com.example.foo/abc/def", ErrPath},
+		{"at://did:plc:abc/", ErrPath},
+		{"at://did:plc:abc//abc", ErrPath},
+		{"at://did:plc:abc/com.example.foo?x=1", ErrQuery},
+		{"at://did:plc:abc#frag", ErrFragment},
+		{"at://did:plc:abc/com.example.foo/" + strings.Repeat("a", MaxLength), ErrTooLong},
+	}
+	for _, tc := range cases {
+		_, err := Parse(tc.uri)
+		assert.ErrorIs(err, tc.err, tc.uri)
+		var perr *Error
+		if assert.ErrorAs(err, &perr) {
+			assert.Equal(tc.uri, perr.URI)
+		}
+	}
+
+	_, err = ParseRecord("at://did:plc:abc/com.example.foo")
+	assert.ErrorIs(err, ErrNotRecordURI)
+}
+
+func TestNew(t *testing.T) {
+	assert := assert.New(t)
+
+	u, err := New("did:plc:abc", "app.bsky.graph.follow", "3k2a")
+	assert.NoError(err)
+	assert.Equal("at://did:plc:abc/app.bsky.graph.follow/3k2a", u.String())
+
+	u, err = New("did:plc:abc", "", "")
+	assert.NoError(err)
+	assert.Equal("at://did:plc:abc", u.String())
+
+	_, err = New("did:plc:abc", "", "3k2a")
+	assert.ErrorIs(err, ErrPath)
+	_, err = New("did:plc:abc", "app.bsky.graph.follow", "a/b")
+	assert.ErrorIs(err, ErrPath)
+}
+
+func TestResolve(t *testing.T) {
+	assert := assert.New(t)
+
+	base, err := Parse("at://did:plc:abc/app.bsky.feed.post/3k2a#/text")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]string{
+		"":                                 "at://did:plc:abc/app.bsky.feed.post/3k2a",
+		"#/embed":                          "at://did:plc:abc/app.bsky.feed.post/3k2a#/embed",
+		"3k2b":                             "at://did:plc:abc/app.bsky.feed.post/3k2b",
+		"./3k2b#/text":                     "at://did:plc:abc/app.bsky.feed.post/3k2b#/text",
+		"../app.bsky.feed.like":            "at://did:plc:abc/app.bsky.feed.like",
+		"../app.bsky.feed.like/3k2c":       "at://did:plc:abc/app.bsky.feed.like/3k2c",
+		"..":                               "at://did:plc:abc",
+		"/app.bsky.actor.profile/self":     "at://did:plc:abc/app.bsky.actor.profile/self",
+		"/":                                "at://did:plc:abc",
+		"at://bob.test/app.bsky.feed.post": "at://bob.test/app.bsky.feed.post",
+	}
+	for ref, want := range cases {
+		u, err := base.Resolve(ref)
+		if assert.NoError(err, ref) {
+			assert.Equal(want, u.String(), ref)
+		}
+	}
+
+	// references to collections are relative to the account
+	coll, err := Parse("at://did:plc:abc/app.bsky.feed.post")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := coll.Resolve("app.bsky.feed.like/3k2c")
+	assert.NoError(err)
+	assert.Equal("at://did:plc:abc/app.bsky.feed.like/3k2c", u.String())
+
+	_, err = base.Resolve("a/b/c")
+	assert.ErrorIs(err, ErrPath)
+}
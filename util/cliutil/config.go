@@ -0,0 +1,229 @@
+package cliutil
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFlag names a YAML, TOML or JSON file of flag values. Keys are flag
+// names, and nested tables are joined with "-", so
+//
+//	[identity]
+//	redis-url = "redis://localhost:6379"
+//
+// sets --identity-redis-url. Values given as flags or environment variables
+// take precedence over the file, which takes precedence over flag defaults.
+var ConfigFlag = &cli.StringFlag{
+	Name:    "config",
+	Usage:   "path to a yaml, toml or json config file",
+	EnvVars: []string{"CONFIG_FILE"},
+}
+
+// LoadConfig applies the file named by --config to the flags of the context's
+// command. Use it as the Before hook of the app, and of any subcommand with
+// its own flags that should be configurable.
+func LoadConfig(cctx *cli.Context) error {
+	path := cctx.String("config")
+	if path == "" {
+		return nil
+	}
+
+	vals, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range localFlags(cctx) {
+		name := f.Names()[0]
+		v, ok := vals[name]
+		if !ok || cctx.IsSet(name) {
+			continue
+		}
+
+		for _, s := range v {
+			if err := cctx.Set(name, s); err != nil {
+				return fmt.Errorf("config %s: invalid value for %s: %w", path, name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ConfigCommand has subcommands for working with config files
+var ConfigCommand = &cli.Command{
+	Name:  "config",
+	Usage: "work with config files",
+	Subcommands: []*cli.Command{
+		{
+			Name:      "validate",
+			Usage:     "check that every setting in a config file is a known flag with a valid value",
+			ArgsUsage: "[file]",
+			Action: func(cctx *cli.Context) error {
+				path := cctx.Args().First()
+				if path == "" {
+					path = cctx.String("config")
+				}
+				if path == "" {
+					return fmt.Errorf("no config file given")
+				}
+
+				if err := ValidateConfig(cctx.App, path); err != nil {
+					return err
+				}
+
+				fmt.Printf("%s is valid\n", path)
+				return nil
+			},
+		},
+	},
+}
+
+// ValidateConfig checks the config file at path against every flag of app and
+// its commands
+func ValidateConfig(app *cli.App, path string) error {
+	vals, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+
+	flags := make(map[string]cli.Flag)
+	var collect func(fs []cli.Flag, cmds []*cli.Command)
+	collect = func(fs []cli.Flag, cmds []*cli.Command) {
+		for _, f := range fs {
+			for _, n := range f.Names() {
+				flags[n] = f
+			}
+		}
+		for _, c := range cmds {
+			collect(c.Flags, c.Subcommands)
+		}
+	}
+	collect(app.Flags, app.Commands)
+
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	for _, k := range keys {
+		f, ok := flags[k]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown setting %q", k))
+			continue
+		}
+
+		// parse the value as the flag would, without touching the real flag
+		fs := flag.NewFlagSet(k, flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		if err := f.Apply(fs); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", k, err))
+			continue
+		}
+		for _, s := range vals[k] {
+			if err := fs.Set(k, s); err != nil {
+				errs = append(errs, fmt.Errorf("invalid value for %s: %w", k, err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func localFlags(cctx *cli.Context) []cli.Flag {
+	// the app's own context has no parent
+	if len(cctx.Lineage()) > 1 && cctx.Command != nil {
+		return cctx.Command.Flags
+	}
+	return cctx.App.Flags
+}
+
+// readConfigFile returns the flag values in a config file, with every value as
+// the strings that would be passed to the flag
+func readConfigFile(path string) (map[string][]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]any
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &raw)
+	case ".toml":
+		err = toml.Unmarshal(b, &raw)
+	case ".json":
+		err = json.Unmarshal(b, &raw)
+	default:
+		return nil, fmt.Errorf("unsupported config file type %q", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing config %s: %w", path, err)
+	}
+
+	out := make(map[string][]string)
+	if err := flattenConfig("", raw, out); err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+
+	return out, nil
+}
+
+func flattenConfig(prefix string, m map[string]any, out map[string][]string) error {
+	for k, v := range m {
+		name := k
+		if prefix != "" {
+			name = prefix + "-" + k
+		}
+
+		switch v := v.(type) {
+		case map[string]any:
+			if err := flattenConfig(name, v, out); err != nil {
+				return err
+			}
+		case []any:
+			for _, e := range v {
+				s, err := configString(e)
+				if err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				out[name] = append(out[name], s)
+			}
+		default:
+			s, err := configString(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			out[name] = []string{s}
+		}
+	}
+	return nil
+}
+
+func configString(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool, int, int64, uint64:
+		return fmt.Sprint(v), nil
+	case float64:
+		// json numbers, which should print without an exponent
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", v)
+	}
+}
@@ -0,0 +1,85 @@
+package cliutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "test.toml")
+
+	var name, envd, ttl, bind string
+	var port int
+	var hosts []string
+	app := &cli.App{
+		Flags: []cli.Flag{
+			ConfigFlag,
+			&cli.StringFlag{Name: "name", Value: "default"},
+			&cli.StringFlag{Name: "envd", EnvVars: []string{"TEST_CONFIG_ENVD"}},
+			&cli.IntFlag{Name: "port"},
+			&cli.StringSliceFlag{Name: "hosts"},
+			&cli.StringFlag{Name: "identity-ttl"},
+		},
+		Before: LoadConfig,
+		Commands: []*cli.Command{
+			{
+				Name:   "run",
+				Flags:  []cli.Flag{&cli.StringFlag{Name: "run-bind"}},
+				Before: LoadConfig,
+				Action: func(cctx *cli.Context) error {
+					name = cctx.String("name")
+					envd = cctx.String("envd")
+					port = cctx.Int("port")
+					hosts = cctx.StringSlice("hosts")
+					ttl = cctx.String("identity-ttl")
+					bind = cctx.String("run-bind")
+					return nil
+				},
+			},
+			ConfigCommand,
+		},
+	}
+
+	t.Setenv("TEST_CONFIG_ENVD", "from-env")
+	if err := os.WriteFile(conf, []byte(`
+envd = "from-file"
+name = "from-file"
+port = 1234
+hosts = ["a", "b"]
+
+[identity]
+ttl = "10m"
+
+[run]
+bind = ":9000"
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.Run([]string{"test", "--config", conf, "--name", "from-flag", "run"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if name != "from-flag" || envd != "from-env" {
+		t.Fatalf("flags and env should override the file, got %q and %q", name, envd)
+	}
+	if port != 1234 || len(hosts) != 2 || ttl != "10m" || bind != ":9000" {
+		t.Fatalf("config file values not applied: %d %v %q %q", port, hosts, ttl, bind)
+	}
+
+	if err := ValidateConfig(app, conf); err != nil {
+		t.Fatal(err)
+	}
+
+	bad := filepath.Join(dir, "bad.yaml")
+	if err := os.WriteFile(bad, []byte("port: abc\nnope: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateConfig(app, bad); err == nil {
+		t.Fatal("expected invalid config to fail validation")
+	}
+}
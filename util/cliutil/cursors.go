@@ -0,0 +1,40 @@
+package cliutil
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bluesky-social/indigo/util/cursorstore"
+	"github.com/urfave/cli/v2"
+	"gorm.io/gorm"
+)
+
+// CursorStoreFlag selects where OpenCursorStore keeps stream cursors
+var CursorStoreFlag = &cli.StringFlag{
+	Name:    "cursor-store",
+	Usage:   "where to keep stream cursors: file:// and the path of a JSON file, a sqlite:// or postgres:// database URL, or a redis:// URL",
+	EnvVars: []string{"CURSOR_STORE"},
+}
+
+// OpenCursorStore opens the cursor store given with CursorStoreFlag. Without
+// one, cursors are kept in db, or if db is nil, not kept at all and nil is
+// returned. Redis keys are prefixed with "cursor/".
+func OpenCursorStore(cctx *cli.Context, db *gorm.DB) (cursorstore.Store, error) {
+	u := cctx.String("cursor-store")
+	switch {
+	case u == "" && db == nil:
+		return nil, nil
+	case u == "":
+		return cursorstore.NewDBStore(db)
+	case strings.HasPrefix(u, "file://"):
+		return cursorstore.NewFileStore(strings.TrimPrefix(u, "file://"))
+	case strings.HasPrefix(u, "redis://") || strings.HasPrefix(u, "rediss://"):
+		return cursorstore.NewRedisStore(u, "cursor/")
+	}
+
+	cdb, err := SetupDatabase(u, 4)
+	if err != nil {
+		return nil, fmt.Errorf("cursor store: %w", err)
+	}
+	return cursorstore.NewDBStore(cdb)
+}
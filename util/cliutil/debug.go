@@ -0,0 +1,142 @@
+package cliutil
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	rpprof "runtime/pprof"
+	"time"
+
+	"github.com/bluesky-social/indigo/util/logutil"
+	"github.com/urfave/cli/v2"
+)
+
+var debugLog = logutil.Logger("debug")
+
+// DebugFlags configure the listener started by StartDebugServer, which is
+// disabled unless defaultBind or --debug-bind is set
+func DebugFlags(defaultBind string) []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "debug-bind",
+			Aliases: []string{"debug-listen"},
+			Usage:   "address to serve pprof, expvar and runtime debug endpoints on, which should not be publicly reachable (disabled if empty)",
+			Value:   defaultBind,
+			EnvVars: []string{"DEBUG_BIND"},
+		},
+	}
+}
+
+// DebugMux returns a mux serving
+//
+//	/debug/pprof/       pprof profiles, as net/http/pprof
+//	/debug/vars         expvar variables, including memstats
+//	/debug/gc           GC and memory stats, running a GC first on POST
+//	/debug/goroutines   a dump of every goroutine's stack
+func DebugMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/gc", handleDebugGC)
+	mux.HandleFunc("/debug/goroutines", handleGoroutineDump)
+	return mux
+}
+
+type gcStats struct {
+	NumGC         int64         `json:"numGC"`
+	LastGC        time.Time     `json:"lastGC"`
+	PauseTotal    time.Duration `json:"pauseTotalNs"`
+	RecentPauses  []string      `json:"recentPauses"`
+	HeapAlloc     uint64        `json:"heapAlloc"`
+	HeapInuse     uint64        `json:"heapInuse"`
+	HeapObjects   uint64        `json:"heapObjects"`
+	HeapReleased  uint64        `json:"heapReleased"`
+	Sys           uint64        `json:"sys"`
+	NextGC        uint64        `json:"nextGC"`
+	GCCPUFraction float64       `json:"gcCPUFraction"`
+	NumGoroutine  int           `json:"numGoroutine"`
+}
+
+func handleDebugGC(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		runtime.GC()
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var gs debug.GCStats
+	debug.ReadGCStats(&gs)
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	out := gcStats{
+		NumGC:         gs.NumGC,
+		LastGC:        gs.LastGC,
+		PauseTotal:    gs.PauseTotal,
+		HeapAlloc:     ms.HeapAlloc,
+		HeapInuse:     ms.HeapInuse,
+		HeapObjects:   ms.HeapObjects,
+		HeapReleased:  ms.HeapReleased,
+		Sys:           ms.Sys,
+		NextGC:        ms.NextGC,
+		GCCPUFraction: ms.GCCPUFraction,
+		NumGoroutine:  runtime.NumGoroutine(),
+	}
+	for i, p := range gs.Pause {
+		if i == 10 {
+			break
+		}
+		out.RecentPauses = append(out.RecentPauses, p.String())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+func handleGoroutineDump(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rpprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+// StartDebugServer serves DebugMux, along with any daemon specific handlers
+// added by register, on --debug-bind in the background. It returns a nil
+// server if the listener is disabled.
+func StartDebugServer(cctx *cli.Context, register ...func(mux *http.ServeMux)) (*http.Server, error) {
+	bind := cctx.String("debug-bind")
+	if bind == "" {
+		return nil, nil
+	}
+
+	mux := DebugMux()
+	for _, r := range register {
+		r(mux)
+	}
+
+	li, err := net.Listen("tcp", bind)
+	if err != nil {
+		return nil, fmt.Errorf("debug listener: %w", err)
+	}
+
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if err := srv.Serve(li); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			debugLog.Error("debug server failed", "err", err)
+		}
+	}()
+	debugLog.Info("serving debug endpoints", "addr", li.Addr().String())
+
+	return srv, nil
+}
@@ -0,0 +1,51 @@
+package cliutil
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugMux(t *testing.T) {
+	srv := httptest.NewServer(DebugMux())
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/debug/gc", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats gcStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if stats.NumGC == 0 || stats.NumGoroutine == 0 {
+		t.Fatalf("expected a forced GC to show up in stats: %+v", stats)
+	}
+
+	for path, expect := range map[string]string{
+		"/debug/vars":               `"memstats"`,
+		"/debug/goroutines":         "goroutine ",
+		"/debug/pprof/":             "heap",
+		"/debug/pprof/heap?debug=1": "heap profile",
+	} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 {
+			t.Errorf("%s: status %d", path, resp.StatusCode)
+		}
+		if !strings.Contains(string(body), expect) {
+			t.Errorf("%s: expected %q in response", path, expect)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package cliutil
+
+import (
+	"github.com/bluesky-social/indigo/api"
+	"github.com/bluesky-social/indigo/did"
+	"github.com/bluesky-social/indigo/identity"
+	cli "github.com/urfave/cli/v2"
+)
+
+// IdentityCacheFlags configure the identity cache built by
+// NewIdentityResolver
+var IdentityCacheFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:    "identity-redis-url",
+		Usage:   "redis server to share the identity cache through, instead of keeping it in memory",
+		EnvVars: []string{"IDENTITY_REDIS_URL"},
+	},
+	&cli.DurationFlag{
+		Name:    "identity-cache-ttl",
+		Usage:   "how long resolved identities are fresh for",
+		EnvVars: []string{"IDENTITY_CACHE_TTL"},
+	},
+	&cli.DurationFlag{
+		Name:    "identity-cache-stale-ttl",
+		Usage:   "how long after going stale identities are still served while being refreshed",
+		EnvVars: []string{"IDENTITY_CACHE_STALE_TTL"},
+	},
+	&cli.DurationFlag{
+		Name:    "identity-cache-negative-ttl",
+		Usage:   "how long failed resolutions are cached for",
+		EnvVars: []string{"IDENTITY_CACHE_NEGATIVE_TTL"},
+	},
+}
+
+// NewIdentityResolver creates a caching identity resolver configured by
+// IdentityCacheFlags. Redis keys are prefixed with prefix, and memSize bounds
+// the in memory cache used without redis.
+func NewIdentityResolver(cctx *cli.Context, dids did.Resolver, handles api.HandleResolver, prefix string, memSize int) (*identity.Resolver, error) {
+	var cache identity.Cache = identity.NewMemCache(memSize)
+	if url := cctx.String("identity-redis-url"); url != "" {
+		rc, err := identity.NewRedisCache(url, prefix)
+		if err != nil {
+			return nil, err
+		}
+		cache = rc
+	}
+
+	r := identity.NewResolver(dids, handles, cache)
+	if cctx.IsSet("identity-cache-ttl") {
+		r.TTL = cctx.Duration("identity-cache-ttl")
+	}
+	if cctx.IsSet("identity-cache-stale-ttl") {
+		r.StaleTTL = cctx.Duration("identity-cache-stale-ttl")
+	}
+	if cctx.IsSet("identity-cache-negative-ttl") {
+		r.NegativeTTL = cctx.Duration("identity-cache-negative-ttl")
+	}
+
+	return r, nil
+}
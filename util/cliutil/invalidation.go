@@ -0,0 +1,23 @@
+package cliutil
+
+import (
+	"github.com/bluesky-social/indigo/util/invalidation"
+	"github.com/urfave/cli/v2"
+)
+
+// InvalidationBusFlag selects the bus OpenInvalidationBus connects to
+var InvalidationBusFlag = &cli.StringFlag{
+	Name:    "invalidation-bus",
+	Usage:   "redis URL to share cache invalidations with other services through; without one they are only passed within the process",
+	EnvVars: []string{"INVALIDATION_BUS"},
+}
+
+// OpenInvalidationBus connects to the redis server given with
+// InvalidationBusFlag, or without one returns an in-process bus
+func OpenInvalidationBus(cctx *cli.Context) (invalidation.Bus, error) {
+	u := cctx.String("invalidation-bus")
+	if u == "" {
+		return invalidation.NewMemBus(), nil
+	}
+	return invalidation.NewRedisBus(u, invalidation.DefaultChannel)
+}
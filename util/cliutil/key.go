@@ -1,74 +1,41 @@
 package cliutil
 
 import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
-	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 
-	"github.com/lestrrat-go/jwx/v2/jwa"
-	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/bluesky-social/indigo/util/keyutil"
+
 	"github.com/whyrusleeping/go-did"
 )
 
-// LoadKeyFromFile reads the private key from file
+// LoadKeyFromFile reads the private key from file. P-256 and secp256k1 keys
+// are accepted, as a JWK, PEM, or multibase string.
 func LoadKeyFromFile(kfile string) (*did.PrivKey, error) {
 	kb, err := os.ReadFile(kfile)
 	if err != nil {
 		return nil, err
 	}
 
-	sk, err := jwk.ParseKey(kb)
-	if err != nil {
-		return nil, err
-	}
-
-	var spk ecdsa.PrivateKey
-	if err := sk.Raw(&spk); err != nil {
-		return nil, err
-	}
-	curve, ok := sk.Get("crv")
-	if !ok {
-		return nil, fmt.Errorf("need a curve set")
-	}
-
-	var out string
-	kts := string(curve.(jwa.EllipticCurveAlgorithm))
-	switch kts {
-	case "P-256":
-		out = did.KeyTypeP256
-	default:
-		return nil, fmt.Errorf("unrecognized key type: %s", kts)
-	}
-
-	return &did.PrivKey{
-		Raw:  &spk,
-		Type: out,
-	}, nil
+	return keyutil.ParsePrivateKey(kb)
 }
 
 // GenerateKeyToFile makes the private key and store it into the file
 func GenerateKeyToFile(fname string) error {
-	raw, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil {
-		return fmt.Errorf("failed to generate new ECDSA private key: %s", err)
-	}
+	return GenerateKeyToFileWithType(fname, did.KeyTypeP256)
+}
 
-	key, err := jwk.FromRaw(raw)
+// GenerateKeyToFileWithType makes a private key of the given type (P-256 or
+// secp256k1) and stores it into the file, as a JWK
+func GenerateKeyToFileWithType(fname, keyType string) error {
+	key, err := did.GeneratePrivKey(rand.Reader, keyType)
 	if err != nil {
-		return fmt.Errorf("failed to create ECDSA key: %s", err)
-	}
-
-	if _, ok := key.(jwk.ECDSAPrivateKey); !ok {
-		return fmt.Errorf("expected jwk.ECDSAPrivateKey, got %T", key)
+		return fmt.Errorf("failed to generate new private key: %w", err)
 	}
 
-	key.Set(jwk.KeyIDKey, "mykey")
-
-	buf, err := json.MarshalIndent(key, "", "  ")
+	buf, err := keyutil.MarshalJWK(key, "mykey")
 	if err != nil {
 		return fmt.Errorf("failed to marshal key into JSON: %w", err)
 	}
@@ -28,3 +28,21 @@ func TestKeyGenerationAndLoading(t *testing.T) {
 		t.Fatalf("unexpected type of the key %s", key.KeyType())
 	}
 }
+
+func TestLoadKeyFromFileTypes(t *testing.T) {
+	tempdir := t.TempDir()
+
+	for _, kt := range []string{did.KeyTypeP256, did.KeyTypeSecp256k1} {
+		fkey := filepath.Join(tempdir, kt+".key")
+		if err := GenerateKeyToFileWithType(fkey, kt); err != nil {
+			t.Fatal(err)
+		}
+		key, err := LoadKeyFromFile(fkey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.Type != kt {
+			t.Fatalf("expected a %s key, got %s", kt, key.Type)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package cliutil
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/bluesky-social/indigo/util/logutil"
+	golog "github.com/ipfs/go-log/v2"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/exp/slog"
+)
+
+// LogFlags configure logging through SetupLogging
+var LogFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:    "log-format",
+		Usage:   "log output format, text or json",
+		Value:   "text",
+		EnvVars: []string{"LOG_FORMAT"},
+	},
+	&cli.StringFlag{
+		Name:    "log-level",
+		Usage:   "log level, optionally with per subsystem overrides, eg info,bgs=debug,events=warn (defaults to info, or GOLOG_LOG_LEVEL)",
+		EnvVars: []string{"LOG_LEVEL"},
+	},
+}
+
+// SetupLogging configures logutil, and the go-log loggers alongside it, from
+// LogFlags
+func SetupLogging(cctx *cli.Context) error {
+	var h slog.Handler
+	switch f := cctx.String("log-format"); f {
+	case "text":
+		h = slog.HandlerOptions{Level: slog.LevelDebug}.NewTextHandler(os.Stderr)
+	case "json":
+		h = slog.HandlerOptions{Level: slog.LevelDebug}.NewJSONHandler(os.Stderr)
+
+		cfg := golog.GetConfig()
+		cfg.Format = golog.JSONOutput
+		golog.SetupLogging(cfg)
+	default:
+		return fmt.Errorf("unknown log format %q", f)
+	}
+	logutil.SetHandler(h)
+
+	if cctx.IsSet("log-level") {
+		if err := logutil.SetLevels(cctx.String("log-level")); err != nil {
+			return fmt.Errorf("invalid log level: %w", err)
+		}
+	}
+
+	return nil
+}
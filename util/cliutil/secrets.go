@@ -0,0 +1,256 @@
+package cliutil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/urfave/cli/v2"
+)
+
+// SecretProvider fetches the secret named by ref, which is a flag value with
+// the provider's scheme and "://" removed. A ref can end in "#field" to pick
+// one field out of a secret holding a JSON object.
+type SecretProvider interface {
+	GetSecret(ctx context.Context, ref string) (string, error)
+}
+
+var (
+	secretProvidersLk sync.RWMutex
+	secretProviders   = map[string]SecretProvider{
+		"file":  FileSecrets{},
+		"awssm": &AWSSecrets{},
+		"vault": &VaultSecrets{},
+	}
+)
+
+// RegisterSecretProvider makes secrets fetched by p usable from flag values
+// starting with scheme://
+func RegisterSecretProvider(scheme string, p SecretProvider) {
+	secretProvidersLk.Lock()
+	defer secretProvidersLk.Unlock()
+	secretProviders[scheme] = p
+}
+
+// ResolveSecret returns the secret named by val if it starts with the scheme
+// of a secret provider, such as
+//
+//	file:///run/secrets/signing-key
+//	awssm://labelmaker/prod#signing_key
+//	vault://secret/data/labelmaker#signing_key
+//
+// and otherwise returns val unchanged
+func ResolveSecret(ctx context.Context, val string) (string, error) {
+	scheme, ref, ok := strings.Cut(val, "://")
+	if !ok {
+		return val, nil
+	}
+
+	secretProvidersLk.RLock()
+	p, ok := secretProviders[scheme]
+	secretProvidersLk.RUnlock()
+	if !ok {
+		return val, nil
+	}
+
+	ref, field, _ := strings.Cut(ref, "#")
+	secret, err := p.GetSecret(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+
+	if field == "" {
+		return secret, nil
+	}
+	return secretField(secret, field)
+}
+
+// ResolveSecretFlags replaces the values of the named flags with the secrets
+// they refer to, as by ResolveSecret. Use it in a Before hook, after
+// LoadConfig so that config files can refer to secrets too.
+func ResolveSecretFlags(cctx *cli.Context, names ...string) error {
+	for _, name := range names {
+		val := cctx.String(name)
+		if val == "" {
+			continue
+		}
+
+		secret, err := ResolveSecret(cctx.Context, val)
+		if err != nil {
+			// the value is a reference rather than a secret, so it's safe to show
+			return fmt.Errorf("resolving secret for --%s (%s): %w", name, val, err)
+		}
+		if secret == val {
+			continue
+		}
+
+		if err := cctx.Set(name, secret); err != nil {
+			return fmt.Errorf("setting secret for --%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func secretField(secret, field string) (string, error) {
+	var obj map[string]any
+	if err := json.Unmarshal([]byte(secret), &obj); err != nil {
+		return "", fmt.Errorf("secret is not a JSON object, so has no field %q", field)
+	}
+
+	v, ok := obj[field]
+	if !ok {
+		return "", fmt.Errorf("secret has no field %q", field)
+	}
+
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	default:
+		// nested values, such as a JWK, are passed on as JSON
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+}
+
+// FileSecrets reads secrets from files, such as those mounted by docker or
+// kubernetes, with a trailing newline removed
+type FileSecrets struct{}
+
+func (FileSecrets) GetSecret(ctx context.Context, ref string) (string, error) {
+	b, err := os.ReadFile(ref)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// AWSSecrets fetches secrets from AWS Secrets Manager by name or ARN, using
+// the default AWS credentials and region
+type AWSSecrets struct {
+	once   sync.Once
+	client *secretsmanager.Client
+	err    error
+}
+
+func (s *AWSSecrets) GetSecret(ctx context.Context, ref string) (string, error) {
+	s.once.Do(func() {
+		cfg, err := awsconfig.LoadDefaultConfig(ctx)
+		if err != nil {
+			s.err = fmt.Errorf("loading aws config: %w", err)
+			return
+		}
+		s.client = secretsmanager.NewFromConfig(cfg)
+	})
+	if s.err != nil {
+		return "", s.err
+	}
+
+	out, err := s.client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(ref),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case out.SecretString != nil:
+		return *out.SecretString, nil
+	case out.SecretBinary != nil:
+		return string(out.SecretBinary), nil
+	default:
+		return "", fmt.Errorf("secret %s has no value", ref)
+	}
+}
+
+// VaultSecrets fetches secrets from a Vault KV engine (version 1 or 2) at the
+// path given, eg secret/data/labelmaker for the labelmaker secret of a KV v2
+// engine mounted at secret. Addr and Token default to the VAULT_ADDR and
+// VAULT_TOKEN environment variables.
+//
+// A secret is returned as a JSON object of all its fields, so refs should
+// usually pick out one field.
+type VaultSecrets struct {
+	Addr   string
+	Token  string
+	Client *http.Client
+}
+
+func (v *VaultSecrets) GetSecret(ctx context.Context, ref string) (string, error) {
+	addr := v.Addr
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	if addr == "" {
+		return "", fmt.Errorf("no vault address configured, set VAULT_ADDR")
+	}
+	token := v.Token
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+
+	u, err := url.JoinPath(addr, "v1", ref)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return "", err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+
+	c := v.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("vault request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("vault request failed: status=%d", resp.StatusCode)
+	}
+
+	var out struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", fmt.Errorf("invalid vault response: %w", err)
+	}
+
+	// KV v2 nests the secret's fields under data, alongside its metadata
+	data := out.Data
+	if inner, ok := data["data"]; ok {
+		if _, ok := data["metadata"]; ok {
+			data = nil
+			if err := json.Unmarshal(inner, &data); err != nil {
+				return "", fmt.Errorf("invalid vault response: %w", err)
+			}
+		}
+	}
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,100 @@
+package cliutil
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+func TestResolveSecret(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "secret")
+	if err := os.WriteFile(path, []byte("hunter2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	jpath := filepath.Join(dir, "secret.json")
+	if err := os.WriteFile(jpath, []byte(`{"password":"hunter3","jwk":{"kty":"EC"}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "tok" {
+			w.WriteHeader(403)
+			return
+		}
+		if r.URL.Path != "/v1/secret/data/labelmaker" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write([]byte(`{"data":{"data":{"token":"abc"},"metadata":{"version":3}}}`))
+	}))
+	defer vault.Close()
+	RegisterSecretProvider("testvault", &VaultSecrets{Addr: vault.URL, Token: "tok"})
+
+	ctx := context.Background()
+	cases := []struct {
+		val    string
+		expect string
+		fail   bool
+	}{
+		{val: "plain value", expect: "plain value"},
+		{val: "https://not.a.secret", expect: "https://not.a.secret"},
+		{val: "file://" + path, expect: "hunter2"},
+		{val: "file://" + jpath + "#password", expect: "hunter3"},
+		{val: "file://" + jpath + "#jwk", expect: `{"kty":"EC"}`},
+		{val: "file://" + jpath + "#missing", fail: true},
+		{val: "file://" + filepath.Join(dir, "nope"), fail: true},
+		{val: "testvault://secret/data/labelmaker#token", expect: "abc"},
+		{val: "testvault://secret/data/other#token", fail: true},
+	}
+
+	for _, c := range cases {
+		out, err := ResolveSecret(ctx, c.val)
+		if c.fail {
+			if err == nil {
+				t.Errorf("%s: expected error, got %q", c.val, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", c.val, err)
+			continue
+		}
+		if out != c.expect {
+			t.Errorf("%s: expected %q, got %q", c.val, c.expect, out)
+		}
+	}
+}
+
+func TestResolveSecretFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(path, []byte("s3cret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var got string
+	app := &cli.App{
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "admin-key"},
+		},
+		Before: func(cctx *cli.Context) error {
+			return ResolveSecretFlags(cctx, "admin-key")
+		},
+		Action: func(cctx *cli.Context) error {
+			got = cctx.String("admin-key")
+			return nil
+		},
+	}
+
+	if err := app.Run([]string{"test", "--admin-key", "file://" + path}); err != nil {
+		t.Fatal(err)
+	}
+	if got != "s3cret" {
+		t.Fatalf("expected secret from file, got %q", got)
+	}
+}
@@ -0,0 +1,204 @@
+package cliutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bluesky-social/indigo/util/logutil"
+	"github.com/urfave/cli/v2"
+)
+
+var shutdownLog = logutil.Logger("shutdown")
+
+// ShutdownFlags configure the ShutdownManager made by NewShutdownManager
+var ShutdownFlags = []cli.Flag{
+	&cli.DurationFlag{
+		Name:    "shutdown-timeout",
+		Usage:   "how long to wait for a graceful shutdown before exiting anyway",
+		Value:   30 * time.Second,
+		EnvVars: []string{"SHUTDOWN_TIMEOUT"},
+	},
+}
+
+// ShutdownManager stops a daemon cleanly on SIGINT or SIGTERM. Steps are run
+// one at a time in the order they were added, so a daemon should add them in
+// the order things need to stop: consumers drained first, then the stores
+// they write to flushed, and so on.
+type ShutdownManager struct {
+	Timeout time.Duration
+
+	ctx    context.Context
+	cancel func()
+
+	lk      sync.Mutex
+	steps   []shutdownStep
+	started bool
+
+	// the first error from a background func returning before shutdown
+	failed   chan struct{}
+	failOnce sync.Once
+	failErr  error
+}
+
+type shutdownStep struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+func NewShutdownManager(timeout time.Duration) *ShutdownManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ShutdownManager{
+		Timeout: timeout,
+		ctx:     ctx,
+		cancel:  cancel,
+		failed:  make(chan struct{}),
+	}
+}
+
+// NewShutdownManagerFromFlags creates a ShutdownManager configured by
+// ShutdownFlags
+func NewShutdownManagerFromFlags(cctx *cli.Context) *ShutdownManager {
+	return NewShutdownManager(cctx.Duration("shutdown-timeout"))
+}
+
+// Context returns a context which is cancelled once shutdown begins
+func (m *ShutdownManager) Context() context.Context {
+	return m.ctx
+}
+
+// Add adds a shutdown step. Every step is run even if earlier ones fail, but
+// once the timeout has passed the remaining steps are skipped.
+func (m *ShutdownManager) Add(name string, fn func(ctx context.Context) error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.steps = append(m.steps, shutdownStep{name: name, fn: fn})
+}
+
+// Go runs fn in the background with the manager's context, and adds a step
+// which waits for it to return. If fn returns before shutdown has begun, such
+// as a server failing to start, that starts the shutdown and its error is
+// returned by Wait. Once shutdown has begun, context cancellation and
+// http.ErrServerClosed errors from fn are expected and ignored.
+func (m *ShutdownManager) Go(name string, fn func(ctx context.Context) error) {
+	done := make(chan error, 1)
+	go func() {
+		err := fn(m.ctx)
+		if m.ctx.Err() == nil {
+			m.failOnce.Do(func() {
+				if err == nil {
+					err = fmt.Errorf("%s stopped", name)
+				}
+				m.failErr = fmt.Errorf("%s: %w", name, err)
+				close(m.failed)
+			})
+			err = nil
+		}
+		done <- err
+	}()
+
+	m.Add(name, func(ctx context.Context) error {
+		select {
+		case err := <-done:
+			if errors.Is(err, context.Canceled) || errors.Is(err, http.ErrServerClosed) {
+				return nil
+			}
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+// Wait blocks until the process gets SIGINT or SIGTERM, or a func started
+// with Go returns, and then shuts down. A second signal exits immediately.
+func (m *ShutdownManager) Wait() error {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	var cause error
+	select {
+	case sig := <-sigs:
+		shutdownLog.Info("received signal, shutting down", "signal", sig.String())
+	case <-m.failed:
+		cause = m.failErr
+		shutdownLog.Error("shutting down after failure", "err", cause)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-sigs:
+			shutdownLog.Warn("received second signal, exiting without finishing shutdown")
+			os.Exit(1)
+		case <-done:
+		}
+	}()
+
+	return errors.Join(cause, m.Shutdown())
+}
+
+// Shutdown cancels the manager's context and runs the shutdown steps. It only
+// runs once, later calls return nil.
+func (m *ShutdownManager) Shutdown() error {
+	m.lk.Lock()
+	if m.started {
+		m.lk.Unlock()
+		return nil
+	}
+	m.started = true
+	steps := m.steps
+	m.lk.Unlock()
+
+	m.cancel()
+
+	ctx := context.Background()
+	if m.Timeout > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, m.Timeout)
+		defer cancel()
+	}
+
+	var errs []error
+	for i, st := range steps {
+		if ctx.Err() != nil {
+			for _, skipped := range steps[i:] {
+				errs = append(errs, fmt.Errorf("%s: shutdown timed out before it ran", skipped.name))
+			}
+			break
+		}
+
+		start := time.Now()
+		if err := runStep(ctx, st); err != nil {
+			shutdownLog.Error("shutdown step failed", "step", st.name, "err", err)
+			errs = append(errs, fmt.Errorf("%s: %w", st.name, err))
+			continue
+		}
+		shutdownLog.Info("shutdown step complete", "step", st.name, "took", time.Since(start))
+	}
+
+	return errors.Join(errs...)
+}
+
+// runStep runs a step, giving up on it when ctx is done even if it ignores ctx
+func runStep(ctx context.Context, st shutdownStep) error {
+	res := make(chan error, 1)
+	go func() {
+		res <- st.fn(ctx)
+	}()
+
+	select {
+	case err := <-res:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,77 @@
+package cliutil
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdownOrder(t *testing.T) {
+	sm := NewShutdownManager(time.Second)
+
+	var order []string
+	sm.Go("consumer", func(ctx context.Context) error {
+		<-ctx.Done()
+		order = append(order, "consumer")
+		return ctx.Err()
+	})
+	sm.Add("flush", func(ctx context.Context) error {
+		order = append(order, "flush")
+		return nil
+	})
+	sm.Go("server", func(ctx context.Context) error {
+		return errors.New("listen failed")
+	})
+
+	err := sm.Wait()
+	if err == nil || !strings.Contains(err.Error(), "listen failed") {
+		t.Fatalf("expected the server failure to be returned, got %v", err)
+	}
+
+	if strings.Join(order, ",") != "consumer,flush" {
+		t.Fatalf("steps ran out of order: %v", order)
+	}
+
+	if sm.Context().Err() == nil {
+		t.Fatal("expected context to be cancelled")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	sm := NewShutdownManager(50 * time.Millisecond)
+
+	sm.Go("server", func(ctx context.Context) error {
+		<-ctx.Done()
+		return http.ErrServerClosed
+	})
+	sm.Add("stuck", func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+	var ran bool
+	sm.Add("after", func(ctx context.Context) error {
+		ran = true
+		return nil
+	})
+
+	err := sm.Shutdown()
+	if err == nil {
+		t.Fatal("expected timeout error")
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected stuck step to time out, got %v", err)
+	}
+	if strings.Contains(err.Error(), "server") {
+		t.Fatalf("expected server closed error to be ignored, got %v", err)
+	}
+	if ran {
+		t.Fatal("expected steps after the timeout to be skipped")
+	}
+
+	if err := sm.Shutdown(); err != nil {
+		t.Fatalf("expected second shutdown to be a no-op, got %v", err)
+	}
+}
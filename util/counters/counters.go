@@ -0,0 +1,114 @@
+// Package counters tracks how fast things happen, for abuse detection: how
+// many posts an account made in the last hour, how many follows came from an
+// IP address in the last day, or how many accounts posted the same text.
+//
+// Counts are over sliding windows, which are kept in slices of time
+// (buckets), so they are approximate: a count is of the buckets the window
+// ends in and the ones before it, back to the one the window starts in, which
+// is left out. That is, it covers between one bucket less than the window and
+// the whole window.
+package counters
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// DefaultBuckets is how many buckets windows made with NewWindow have
+const DefaultBuckets = 12
+
+// Window is a sliding window of time, kept as Buckets buckets of equal size
+type Window struct {
+	Period  time.Duration
+	Buckets int
+}
+
+// NewWindow returns a window over period, with DefaultBuckets buckets
+func NewWindow(period time.Duration) Window {
+	return Window{Period: period, Buckets: DefaultBuckets}
+}
+
+var (
+	// Hourly is the window of per hour velocities, eg posts/hour
+	Hourly = NewWindow(time.Hour)
+	// Daily is the window of per day velocities, eg follows/day
+	Daily = NewWindow(24 * time.Hour)
+)
+
+func (w Window) bucketSize() time.Duration {
+	if w.Buckets <= 0 {
+		return w.Period
+	}
+	return w.Period / time.Duration(w.Buckets)
+}
+
+// bucket returns the index of the bucket t is in
+func (w Window) bucket(t time.Time) int64 {
+	return t.UnixNano() / int64(w.bucketSize())
+}
+
+// first returns the index of the oldest bucket in the window ending at now
+func (w Window) first(now time.Time) int64 {
+	n := int64(w.Buckets)
+	if n <= 0 {
+		n = 1
+	}
+	return w.bucket(now) - n + 1
+}
+
+func (w Window) String() string {
+	return fmt.Sprintf("%s/%d", w.Period, w.Buckets)
+}
+
+// Store keeps counts. Implementations must be safe for concurrent use.
+type Store interface {
+	// Incr counts an event for key at t
+	Incr(ctx context.Context, key string, w Window, t time.Time) error
+	// Count returns the number of events counted for key in the window
+	// ending at now
+	Count(ctx context.Context, key string, w Window, now time.Time) (int, error)
+
+	// AddDistinct counts member for key at t. Each member is only counted
+	// once in a window.
+	AddDistinct(ctx context.Context, key string, w Window, member string, t time.Time) error
+	// CountDistinct returns the number of different members counted for key
+	// in the window ending at now. Stores may estimate it.
+	CountDistinct(ctx context.Context, key string, w Window, now time.Time) (int, error)
+}
+
+// NewStore returns a RedisStore if redisURL is set, otherwise a MemoryStore
+func NewStore(redisURL string, prefix string) (Store, error) {
+	if redisURL != "" {
+		return NewRedisStore(redisURL, prefix)
+	}
+
+	return NewMemoryStore(100_000)
+}
+
+// DidKey is the key of the velocity called name of an account
+func DidKey(name, did string) string {
+	return name + ":did:" + did
+}
+
+// IPKey is the key of the velocity called name of an IP address
+func IPKey(name, ip string) string {
+	return name + ":ip:" + ip
+}
+
+// TextKey is the key of the velocity called name of a text, eg how many
+// accounts posted it. Texts that only differ in case or whitespace have the
+// same key.
+func TextKey(name, text string) string {
+	h := sha256.Sum256([]byte(NormalizeText(text)))
+	return name + ":text:" + hex.EncodeToString(h[:16])
+}
+
+// NormalizeText lowercases text and collapses its whitespace
+func NormalizeText(text string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(text), unicode.IsSpace), " ")
+}
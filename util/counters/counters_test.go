@@ -0,0 +1,112 @@
+package counters
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryCount(t *testing.T) {
+	ctx := context.Background()
+	ms, err := NewMemoryStore(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// buckets of 10 minutes
+	w := Window{Period: time.Hour, Buckets: 6}
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 5; i++ {
+		if err := ms.Incr(ctx, "posts:did:alice", w, start.Add(time.Duration(i)*5*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ms.Incr(ctx, "posts:did:bob", w, start); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(key string, now time.Time, expected int) {
+		t.Helper()
+		n, err := ms.Count(ctx, key, w, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != expected {
+			t.Fatalf("count of %s at %s: expected %d, got %d", key, now.Sub(start), expected, n)
+		}
+	}
+
+	check("posts:did:alice", start.Add(20*time.Minute), 5)
+	check("posts:did:bob", start.Add(20*time.Minute), 1)
+	check("posts:did:carol", start.Add(20*time.Minute), 0)
+
+	// events after now are not in the window
+	check("posts:did:alice", start.Add(5*time.Minute), 2)
+
+	// the first bucket, with the posts at 0 and 5m, leaves the window an
+	// hour after it started
+	check("posts:did:alice", start.Add(59*time.Minute), 5)
+	check("posts:did:alice", start.Add(60*time.Minute), 3)
+	check("posts:did:alice", start.Add(2*time.Hour), 0)
+
+	// windows are counted separately
+	n, err := ms.Count(ctx, "posts:did:alice", Hourly, start.Add(20*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("expected no counts in another window, got %d", n)
+	}
+}
+
+func TestMemoryDistinct(t *testing.T) {
+	ctx := context.Background()
+	ms, err := NewMemoryStore(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := Window{Period: time.Hour, Buckets: 6}
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	key := TextKey("fanout", "Buy my stuff")
+
+	add := func(member string, at time.Duration) {
+		t.Helper()
+		if err := ms.AddDistinct(ctx, key, w, member, start.Add(at)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("did:plc:alice", 0)
+	add("did:plc:alice", 15*time.Minute)
+	add("did:plc:bob", 15*time.Minute)
+	add("did:plc:carol", 30*time.Minute)
+
+	n, err := ms.CountDistinct(ctx, key, w, start.Add(30*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 distinct members, got %d", n)
+	}
+
+	n, err = ms.CountDistinct(ctx, key, w, start.Add(75*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 distinct member left in the window, got %d", n)
+	}
+}
+
+func TestTextKey(t *testing.T) {
+	if TextKey("fanout", "Buy  my\nSTUFF ") != TextKey("fanout", "buy my stuff") {
+		t.Fatal("texts differing in case and whitespace should have the same key")
+	}
+	if TextKey("fanout", "buy my stuff") == TextKey("fanout", "buy my things") {
+		t.Fatal("different texts should have different keys")
+	}
+	if TextKey("fanout", "x") == TextKey("other", "x") {
+		t.Fatal("different velocities should have different keys")
+	}
+}
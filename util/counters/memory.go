@@ -0,0 +1,142 @@
+package counters
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+type series struct {
+	lk       sync.Mutex
+	counts   map[int64]int
+	distinct map[int64]map[string]struct{}
+}
+
+// prune drops the buckets before first
+func (s *series) prune(first int64) {
+	for b := range s.counts {
+		if b < first {
+			delete(s.counts, b)
+		}
+	}
+	for b := range s.distinct {
+		if b < first {
+			delete(s.distinct, b)
+		}
+	}
+}
+
+// MemoryStore keeps counts in process memory. It is only suitable for
+// single-instance deployments; use RedisStore to share counts between
+// instances.
+type MemoryStore struct {
+	lk     sync.Mutex
+	series *lru.Cache
+}
+
+// NewMemoryStore creates a store which keeps the counts of up to size keys,
+// evicting the least recently used once full.
+func NewMemoryStore(size int) (*MemoryStore, error) {
+	c, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MemoryStore{series: c}, nil
+}
+
+func seriesKey(key string, w Window) string {
+	return key + ":" + w.String()
+}
+
+func (ms *MemoryStore) getSeries(key string, w Window, create bool) *series {
+	ms.lk.Lock()
+	defer ms.lk.Unlock()
+
+	k := seriesKey(key, w)
+	v, ok := ms.series.Get(k)
+	if ok {
+		return v.(*series)
+	}
+	if !create {
+		return nil
+	}
+
+	s := &series{
+		counts:   make(map[int64]int),
+		distinct: make(map[int64]map[string]struct{}),
+	}
+	ms.series.Add(k, s)
+	return s
+}
+
+func (ms *MemoryStore) Incr(ctx context.Context, key string, w Window, t time.Time) error {
+	s := ms.getSeries(key, w, true)
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	s.prune(w.first(t))
+	s.counts[w.bucket(t)]++
+	return nil
+}
+
+func (ms *MemoryStore) Count(ctx context.Context, key string, w Window, now time.Time) (int, error) {
+	s := ms.getSeries(key, w, false)
+	if s == nil {
+		return 0, nil
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	first, last := w.first(now), w.bucket(now)
+	n := 0
+	for b, c := range s.counts {
+		if b >= first && b <= last {
+			n += c
+		}
+	}
+	return n, nil
+}
+
+func (ms *MemoryStore) AddDistinct(ctx context.Context, key string, w Window, member string, t time.Time) error {
+	s := ms.getSeries(key, w, true)
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	s.prune(w.first(t))
+	b := w.bucket(t)
+	members, ok := s.distinct[b]
+	if !ok {
+		members = make(map[string]struct{})
+		s.distinct[b] = members
+	}
+	members[member] = struct{}{}
+	return nil
+}
+
+func (ms *MemoryStore) CountDistinct(ctx context.Context, key string, w Window, now time.Time) (int, error) {
+	s := ms.getSeries(key, w, false)
+	if s == nil {
+		return 0, nil
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	first, last := w.first(now), w.bucket(now)
+	seen := make(map[string]struct{})
+	for b, members := range s.distinct {
+		if b < first || b > last {
+			continue
+		}
+		for m := range members {
+			seen[m] = struct{}{}
+		}
+	}
+	return len(seen), nil
+}
@@ -0,0 +1,129 @@
+package counters
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// incrScript counts an event in bucket ARGV[1] of the hash in KEYS[1], and
+// drops the buckets before ARGV[2], which have left the window.
+//
+// ARGV: bucket, first bucket, ttl (ms)
+var incrScript = redis.NewScript(`
+local first = tonumber(ARGV[2])
+for _, b in ipairs(redis.call("HKEYS", KEYS[1])) do
+	if tonumber(b) < first then
+		redis.call("HDEL", KEYS[1], b)
+	end
+end
+
+redis.call("HINCRBY", KEYS[1], ARGV[1], 1)
+redis.call("PEXPIRE", KEYS[1], ARGV[3])
+return 0
+`)
+
+// RedisStore keeps counts in redis, so that they are shared between all
+// instances of a service. Counts are kept in a hash per key, with a field per
+// bucket. Distinct members are kept in a HyperLogLog per bucket, so their
+// counts are estimates.
+type RedisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisStore connects to the redis server at the given URL (eg
+// redis://localhost:6379/0). All keys are prefixed with prefix.
+func NewRedisStore(redisURL string, prefix string) (*RedisStore, error) {
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing redis url: %w", err)
+	}
+
+	return &RedisStore{
+		client: redis.NewClient(opts),
+		prefix: prefix,
+	}, nil
+}
+
+// redisKey returns the key of the counts of key in w. The braces keep all the
+// keys of a series on the same redis cluster slot.
+func (rs *RedisStore) redisKey(key string, w Window) string {
+	return rs.prefix + "{" + seriesKey(key, w) + "}"
+}
+
+// ttl is how long counts are kept after the last change, long enough for the
+// oldest bucket to leave the window
+func ttl(w Window) time.Duration {
+	return w.Period + w.bucketSize()
+}
+
+func (rs *RedisStore) Incr(ctx context.Context, key string, w Window, t time.Time) error {
+	err := incrScript.Run(ctx, rs.client, []string{rs.redisKey(key, w)},
+		w.bucket(t),
+		w.first(t),
+		ttl(w).Milliseconds(),
+	).Err()
+	if err != nil {
+		return fmt.Errorf("running counter script: %w", err)
+	}
+	return nil
+}
+
+func (rs *RedisStore) Count(ctx context.Context, key string, w Window, now time.Time) (int, error) {
+	vals, err := rs.client.HGetAll(ctx, rs.redisKey(key, w)).Result()
+	if err != nil {
+		return 0, fmt.Errorf("reading counts: %w", err)
+	}
+
+	first, last := w.first(now), w.bucket(now)
+	n := 0
+	for f, v := range vals {
+		b, err := strconv.ParseInt(f, 10, 64)
+		if err != nil || b < first || b > last {
+			continue
+		}
+		c, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("invalid count in %s: %q", key, v)
+		}
+		n += c
+	}
+	return n, nil
+}
+
+func (rs *RedisStore) distinctKey(key string, w Window, bucket int64) string {
+	return rs.redisKey(key, w) + ":" + strconv.FormatInt(bucket, 10)
+}
+
+func (rs *RedisStore) AddDistinct(ctx context.Context, key string, w Window, member string, t time.Time) error {
+	k := rs.distinctKey(key, w, w.bucket(t))
+
+	pipe := rs.client.TxPipeline()
+	pipe.PFAdd(ctx, k, member)
+	pipe.PExpire(ctx, k, ttl(w))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("adding distinct member: %w", err)
+	}
+	return nil
+}
+
+func (rs *RedisStore) CountDistinct(ctx context.Context, key string, w Window, now time.Time) (int, error) {
+	var keys []string
+	for b := w.first(now); b <= w.bucket(now); b++ {
+		keys = append(keys, rs.distinctKey(key, w, b))
+	}
+
+	n, err := rs.client.PFCount(ctx, keys...).Result()
+	if err != nil {
+		return 0, fmt.Errorf("counting distinct members: %w", err)
+	}
+	return int(n), nil
+}
+
+func (rs *RedisStore) Close() error {
+	return rs.client.Close()
+}
@@ -0,0 +1,212 @@
+// Package cursorstore keeps the cursors of event stream consumers, so that
+// they resume where they left off when restarted. Cursors are kept in a
+// Store, by a key naming the consumer and the stream, in a JSON file, a
+// database (SQLite or Postgres), or redis. A Tracker follows the progress of
+// a consumer through a stream, saving its cursor every so often and
+// reporting how far behind the stream it is.
+package cursorstore
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log"
+)
+
+var log = logging.Logger("cursorstore")
+
+// Cursor is a consumer's position in a stream
+type Cursor struct {
+	// Seq is the sequence number of the last event handled
+	Seq int64 `json:"seq"`
+
+	// Time is when that event was emitted, from its time field, or zero if
+	// it isn't known
+	Time time.Time `json:"time,omitempty"`
+}
+
+// Store keeps cursors by key, eg "palomar/bsky.network"
+type Store interface {
+	// Load returns the cursor saved under key, or the zero Cursor if there
+	// isn't one
+	Load(ctx context.Context, key string) (Cursor, error)
+
+	// Save replaces the cursor saved under key. Saves are atomic: one which
+	// fails leaves the previous cursor in place, never part of the new one.
+	Save(ctx context.Context, key string, c Cursor) error
+
+	Close() error
+}
+
+// Tracker follows a consumer's progress through one stream. Events are
+// recorded with Advance as they are handled, and the cursor saved with Flush,
+// or every so often by Run. Consumers which handle events concurrently also
+// record them with Begin as they are handed out, in stream order, so that the
+// cursor never passes an event still being handled.
+type Tracker struct {
+	store Store
+	key   string
+
+	lk    sync.Mutex
+	cur   Cursor
+	saved Cursor
+	lag   time.Duration
+
+	// inflight are the events begun but not yet handled, and done the
+	// events handled while an earlier one was still in flight
+	inflight map[int64]struct{}
+	done     map[int64]time.Time
+}
+
+func NewTracker(store Store, key string) *Tracker {
+	return &Tracker{
+		store: store,
+		key:   key,
+	}
+}
+
+// Load reads the saved cursor, which Advance moves on from, and returns its
+// sequence number, or 0 if there is none
+func (t *Tracker) Load(ctx context.Context) (int64, error) {
+	c, err := t.store.Load(ctx, t.key)
+	if err != nil {
+		return 0, err
+	}
+
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	t.cur = c
+	t.saved = c
+	cursorSeq.WithLabelValues(t.key).Set(float64(c.Seq))
+	return c.Seq, nil
+}
+
+// Begin records that the event seq has been handed out to be handled. The
+// cursor doesn't move past it until it has been handled, so that events in
+// flight are handled again if the consumer stops before they are done.
+func (t *Tracker) Begin(seq int64) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if seq <= t.cur.Seq {
+		return
+	}
+
+	if t.inflight == nil {
+		t.inflight = make(map[int64]struct{})
+	}
+	t.inflight[seq] = struct{}{}
+}
+
+// Advance records that the event seq, emitted at emitted, has been handled.
+// The cursor moves to the latest event handled which has no events begun
+// before it still in flight, so events handled out of order, such as by
+// concurrent workers, never move it back or past one another. An event which
+// is begun but never handled, such as one which failed, holds the cursor
+// back, to be handled again when the consumer restarts. emitted may be zero
+// if the event has no time, in which case the lag stays as it was.
+func (t *Tracker) Advance(seq int64, emitted time.Time) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	delete(t.inflight, seq)
+	if seq <= t.cur.Seq {
+		return
+	}
+
+	if t.done == nil {
+		t.done = make(map[int64]time.Time)
+	}
+	t.done[seq] = emitted
+
+	low := int64(math.MaxInt64)
+	for s := range t.inflight {
+		if s < low {
+			low = s
+		}
+	}
+	if seq > low {
+		return
+	}
+
+	next := t.cur
+	for s, e := range t.done {
+		if s >= low {
+			continue
+		}
+		if s > next.Seq {
+			next = Cursor{Seq: s, Time: e}
+		}
+		delete(t.done, s)
+	}
+
+	t.cur = next
+	cursorSeq.WithLabelValues(t.key).Set(float64(next.Seq))
+	if !next.Time.IsZero() {
+		t.lag = time.Since(next.Time)
+		cursorLag.WithLabelValues(t.key).Set(t.lag.Seconds())
+	}
+}
+
+// Cursor returns the position of the last event handled with none before it
+// still in flight
+func (t *Tracker) Cursor() Cursor {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	return t.cur
+}
+
+// Lag returns how long after it was emitted the last event with a time was
+// handled, which is how far behind the stream the consumer is
+func (t *Tracker) Lag() time.Duration {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	return t.lag
+}
+
+// Flush saves the cursor, if it has moved since it was last saved or loaded
+func (t *Tracker) Flush(ctx context.Context) error {
+	t.lk.Lock()
+	c := t.cur
+	dirty := c != t.saved
+	t.lk.Unlock()
+	if !dirty {
+		return nil
+	}
+
+	if err := t.store.Save(ctx, t.key, c); err != nil {
+		cursorSaves.WithLabelValues(t.key, "error").Inc()
+		return err
+	}
+	cursorSaves.WithLabelValues(t.key, "ok").Inc()
+
+	t.lk.Lock()
+	// a concurrent flush may have saved a later cursor already
+	if c.Seq > t.saved.Seq {
+		t.saved = c
+	}
+	t.lk.Unlock()
+	return nil
+}
+
+// Run flushes the cursor every interval until ctx is done, and once more
+// after
+func (t *Tracker) Run(ctx context.Context, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			fctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := t.Flush(fctx); err != nil {
+				log.Errorw("failed to save cursor", "key", t.key, "err", err)
+			}
+			return
+		case <-tick.C:
+			if err := t.Flush(ctx); err != nil && ctx.Err() == nil {
+				log.Errorw("failed to save cursor", "key", t.key, "err", err)
+			}
+		}
+	}
+}
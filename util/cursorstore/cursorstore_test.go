@@ -0,0 +1,116 @@
+package cursorstore
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func testStore(t *testing.T, s Store) {
+	ctx := context.Background()
+
+	if c, err := s.Load(ctx, "test/missing"); err != nil || c != (Cursor{}) {
+		t.Fatalf("expected no cursor, got %+v, %v", c, err)
+	}
+
+	at := time.Date(2024, 3, 1, 12, 30, 0, 500, time.UTC)
+	for _, c := range []Cursor{{Seq: 10, Time: at}, {Seq: 12}} {
+		if err := s.Save(ctx, "test/host", c); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.Load(ctx, "test/host")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Seq != c.Seq || !got.Time.Equal(c.Time) {
+			t.Errorf("expected %+v, got %+v", c, got)
+		}
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cursors", "cursors.json")
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+
+	// cursors are read back after a restart
+	s, err = NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := s.Load(context.Background(), "test/host"); err != nil || c.Seq != 12 {
+		t.Errorf("expected saved cursor, got %+v, %v", c, err)
+	}
+}
+
+func TestDBStore(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "cursors.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewDBStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+}
+
+func TestTracker(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewFileStore(filepath.Join(t.TempDir(), "cursors.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(ctx, "test", Cursor{Seq: 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := NewTracker(s, "test")
+	if seq, err := tr.Load(ctx); err != nil || seq != 5 {
+		t.Fatalf("expected to resume after 5, got %d, %v", seq, err)
+	}
+
+	emitted := time.Now().Add(-time.Minute)
+	tr.Advance(7, emitted)
+	// handled late by another worker
+	tr.Advance(6, time.Now())
+	if c := tr.Cursor(); c.Seq != 7 {
+		t.Errorf("expected cursor not to move back, got %d", c.Seq)
+	}
+	if lag := tr.Lag(); lag < time.Minute || lag > 2*time.Minute {
+		t.Errorf("expected about a minute of lag, got %s", lag)
+	}
+
+	if err := tr.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := s.Load(ctx, "test"); err != nil || c.Seq != 7 || !c.Time.Equal(emitted) {
+		t.Errorf("expected flushed cursor, got %+v, %v", c, err)
+	}
+
+	// events handed out to concurrent workers hold the cursor back until
+	// they are done
+	for seq := int64(8); seq <= 11; seq++ {
+		tr.Begin(seq)
+	}
+	tr.Advance(9, time.Now())
+	if c := tr.Cursor(); c.Seq != 7 {
+		t.Errorf("expected cursor to wait for 8, got %d", c.Seq)
+	}
+	tr.Advance(8, time.Now())
+	tr.Advance(11, time.Now())
+	if c := tr.Cursor(); c.Seq != 9 {
+		t.Errorf("expected cursor to wait for 10, got %d", c.Seq)
+	}
+	tr.Advance(10, time.Now())
+	if c := tr.Cursor(); c.Seq != 11 {
+		t.Errorf("expected cursor at 11, got %d", c.Seq)
+	}
+}
@@ -0,0 +1,62 @@
+package cursorstore
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// StreamCursor is a cursor kept in a database by a DBStore
+type StreamCursor struct {
+	Key       string `gorm:"column:cursor_key;primaryKey"`
+	Seq       int64
+	Time      *time.Time
+	UpdatedAt time.Time
+}
+
+// DBStore keeps cursors in the stream_cursors table of a SQLite or Postgres
+// database, each saved with a single upsert
+type DBStore struct {
+	db *gorm.DB
+}
+
+// NewDBStore keeps cursors in db, creating their table if need be
+func NewDBStore(db *gorm.DB) (*DBStore, error) {
+	if err := db.AutoMigrate(&StreamCursor{}); err != nil {
+		return nil, err
+	}
+	return &DBStore{db: db}, nil
+}
+
+func (s *DBStore) Load(ctx context.Context, key string) (Cursor, error) {
+	var row StreamCursor
+	err := s.db.WithContext(ctx).Take(&row, "cursor_key = ?", key).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return Cursor{}, nil
+	}
+	if err != nil {
+		return Cursor{}, err
+	}
+
+	c := Cursor{Seq: row.Seq}
+	if row.Time != nil {
+		c.Time = *row.Time
+	}
+	return c, nil
+}
+
+func (s *DBStore) Save(ctx context.Context, key string, c Cursor) error {
+	row := StreamCursor{Key: key, Seq: c.Seq}
+	if !c.Time.IsZero() {
+		row.Time = &c.Time
+	}
+	return s.db.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(&row).Error
+}
+
+// Close does nothing, as the database belongs to the caller
+func (s *DBStore) Close() error {
+	return nil
+}
@@ -0,0 +1,101 @@
+package cursorstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStore keeps cursors in a JSON file, of an object with a cursor for each
+// key. The file is written to a temporary file and renamed into place, so a
+// crash while saving leaves the previous version.
+type FileStore struct {
+	path string
+
+	lk      sync.Mutex
+	cursors map[string]Cursor
+}
+
+// NewFileStore opens the cursor file at path, which is created on the first
+// save if it doesn't exist
+func NewFileStore(path string) (*FileStore, error) {
+	st := &FileStore{
+		path:    path,
+		cursors: make(map[string]Cursor),
+	}
+
+	b, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(b, &st.cursors); err != nil {
+			return nil, fmt.Errorf("reading cursor file %s: %w", path, err)
+		}
+	}
+	return st, nil
+}
+
+func (s *FileStore) Load(ctx context.Context, key string) (Cursor, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.cursors[key], nil
+}
+
+func (s *FileStore) Save(ctx context.Context, key string, c Cursor) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	prev, had := s.cursors[key]
+	s.cursors[key] = c
+	if err := s.write(); err != nil {
+		if had {
+			s.cursors[key] = prev
+		} else {
+			delete(s.cursors, key)
+		}
+		return err
+	}
+	return nil
+}
+
+// write replaces the file with the cursors
+func (s *FileStore) write() error {
+	b, err := json.Marshal(s.cursors)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, fs.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *FileStore) Close() error {
+	return nil
+}
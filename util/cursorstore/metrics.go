@@ -0,0 +1,21 @@
+package cursorstore
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var cursorSeq = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "stream_cursor_seq",
+	Help: "The sequence number of the last event handled by a stream consumer",
+}, []string{"key"})
+
+var cursorLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "stream_cursor_lag_seconds",
+	Help: "How long after it was emitted a stream consumer handled the last event it was sent",
+}, []string{"key"})
+
+var cursorSaves = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "stream_cursor_saves_total",
+	Help: "The total number of stream cursors saved, by result",
+}, []string{"key", "result"})
@@ -0,0 +1,65 @@
+package cursorstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisStore keeps cursors in redis, each in a hash written with a single
+// HSET
+type RedisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisStore connects to the redis server at the given URL (eg
+// redis://localhost:6379/0). All keys are prefixed with prefix.
+func NewRedisStore(redisURL string, prefix string) (*RedisStore, error) {
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing redis url: %w", err)
+	}
+
+	return &RedisStore{
+		client: redis.NewClient(opts),
+		prefix: prefix,
+	}, nil
+}
+
+func (s *RedisStore) Load(ctx context.Context, key string) (Cursor, error) {
+	vals, err := s.client.HGetAll(ctx, s.prefix+key).Result()
+	if errors.Is(err, redis.Nil) || (err == nil && len(vals) == 0) {
+		return Cursor{}, nil
+	}
+	if err != nil {
+		return Cursor{}, err
+	}
+
+	var c Cursor
+	if c.Seq, err = strconv.ParseInt(vals["seq"], 10, 64); err != nil {
+		return Cursor{}, fmt.Errorf("invalid cursor under %s: %w", key, err)
+	}
+	if t := vals["time"]; t != "" {
+		if c.Time, err = time.Parse(time.RFC3339Nano, t); err != nil {
+			return Cursor{}, fmt.Errorf("invalid cursor time under %s: %w", key, err)
+		}
+	}
+	return c, nil
+}
+
+func (s *RedisStore) Save(ctx context.Context, key string, c Cursor) error {
+	var t string
+	if !c.Time.IsZero() {
+		t = c.Time.Format(time.RFC3339Nano)
+	}
+	return s.client.HSet(ctx, s.prefix+key, "seq", c.Seq, "time", t).Err()
+}
+
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
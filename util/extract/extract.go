@@ -0,0 +1,179 @@
+// Package extract pulls the indexable content out of records: their text,
+// the alt text of their images, and the links, hashtags and mentions in
+// them. Search indexing and keyword labeling both work from it, so that
+// every record type they know is read the same way, and new types are added
+// here once.
+//
+// The record types known are:
+//
+//	app.bsky.feed.post       text, image alt text, links and mentions from
+//	                         facets, external embed links
+//	app.bsky.actor.profile   display name and description
+//	app.bsky.graph.list      name, description and its facets
+//	app.bsky.feed.generator  display name, description and its facets
+package extract
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+)
+
+// Content is what was extracted from a record
+type Content struct {
+	// Text is the record's own text fields, in lexicon order, leaving out
+	// any which are empty
+	Text []string
+	// AltText is the alt text of the record's images
+	AltText []string
+	// Links are the URIs of link facets and external embeds, in the order
+	// they appear, without repeats
+	Links []string
+	// Tags are the hashtags in the record's text, lowercased and without
+	// the #, without repeats
+	Tags []string
+	// Mentions are the DIDs of mention facets, without repeats
+	Mentions []string
+}
+
+// Record extracts the content of a record, which is one of the appbsky
+// record types, by value or pointer. It returns false for any other type.
+func Record(rec any) (*Content, bool) {
+	c := &Content{}
+	switch r := rec.(type) {
+	case *appbsky.FeedPost:
+		c.post(r)
+	case appbsky.FeedPost:
+		return Record(&r)
+	case *appbsky.ActorProfile:
+		c.textPtr(r.DisplayName)
+		c.textPtr(r.Description)
+	case appbsky.ActorProfile:
+		return Record(&r)
+	case *appbsky.GraphList:
+		c.text(r.Name)
+		c.textPtr(r.Description)
+		c.facets(r.DescriptionFacets)
+	case appbsky.GraphList:
+		return Record(&r)
+	case *appbsky.FeedGenerator:
+		c.text(r.DisplayName)
+		c.textPtr(r.Description)
+		c.facets(r.DescriptionFacets)
+	case appbsky.FeedGenerator:
+		return Record(&r)
+	default:
+		return nil, false
+	}
+	return c, true
+}
+
+// All returns the text and alt text together, one per line, for matching
+// against
+func (c *Content) All() string {
+	return strings.Join(append(append([]string{}, c.Text...), c.AltText...), "\n")
+}
+
+// Domains returns the lowercased host of each link, without a leading www.,
+// and every parent domain of it short of the top level one, so that links to
+// subdomains match their parents
+func (c *Content) Domains() []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, l := range c.Links {
+		u, err := url.Parse(l)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+		for strings.Contains(host, ".") {
+			if !seen[host] {
+				seen[host] = true
+				out = append(out, host)
+			}
+			_, host, _ = strings.Cut(host, ".")
+		}
+	}
+	return out
+}
+
+func (c *Content) post(p *appbsky.FeedPost) {
+	c.text(p.Text)
+	c.facets(p.Facets)
+
+	if e := p.Embed; e != nil {
+		c.images(e.EmbedImages)
+		c.external(e.EmbedExternal)
+		if rwm := e.EmbedRecordWithMedia; rwm != nil && rwm.Media != nil {
+			c.images(rwm.Media.EmbedImages)
+			c.external(rwm.Media.EmbedExternal)
+		}
+	}
+}
+
+func (c *Content) text(s string) {
+	if s == "" {
+		return
+	}
+	c.Text = append(c.Text, s)
+	for _, m := range hashtagRegex.FindAllStringSubmatch(s, -1) {
+		c.Tags = appendNew(c.Tags, strings.ToLower(m[1]))
+	}
+}
+
+func (c *Content) textPtr(s *string) {
+	if s != nil {
+		c.text(*s)
+	}
+}
+
+func (c *Content) facets(facets []*appbsky.RichtextFacet) {
+	for _, f := range facets {
+		if f == nil {
+			continue
+		}
+		for _, feat := range f.Features {
+			if feat == nil {
+				continue
+			}
+			if m := feat.RichtextFacet_Mention; m != nil && m.Did != "" {
+				c.Mentions = appendNew(c.Mentions, m.Did)
+			}
+			if l := feat.RichtextFacet_Link; l != nil && l.Uri != "" {
+				c.Links = appendNew(c.Links, l.Uri)
+			}
+		}
+	}
+}
+
+func (c *Content) images(ei *appbsky.EmbedImages) {
+	if ei == nil {
+		return
+	}
+	for _, img := range ei.Images {
+		if img != nil && img.Alt != "" {
+			c.AltText = append(c.AltText, img.Alt)
+		}
+	}
+}
+
+func (c *Content) external(ee *appbsky.EmbedExternal) {
+	if ee != nil && ee.External != nil && ee.External.Uri != "" {
+		c.Links = appendNew(c.Links, ee.External.Uri)
+	}
+}
+
+// hashtagRegex matches hashtags at the start of the text or after
+// whitespace, which aren't all digits
+var hashtagRegex = regexp.MustCompile(`(?:^|\s)#([\pL\pM\pN_]*[\pL\pM_][\pL\pM\pN_]*)`)
+
+func appendNew(list []string, s string) []string {
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
@@ -0,0 +1,79 @@
+package extract
+
+import (
+	"reflect"
+	"testing"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+)
+
+func TestRecord(t *testing.T) {
+	desc := "posts about #Go and #golang"
+	name := "Gopher"
+	cases := []struct {
+		rec  any
+		want *Content
+	}{
+		{
+			&appbsky.FeedPost{
+				Text: "#Cats are great, #cats #2024 not#atag",
+				Facets: []*appbsky.RichtextFacet{{
+					Features: []*appbsky.RichtextFacet_Features_Elem{
+						{RichtextFacet_Mention: &appbsky.RichtextFacet_Mention{Did: "did:plc:bob"}},
+						{RichtextFacet_Link: &appbsky.RichtextFacet_Link{Uri: "https://example.com/a"}},
+					},
+				}},
+				Embed: &appbsky.FeedPost_Embed{
+					EmbedRecordWithMedia: &appbsky.EmbedRecordWithMedia{
+						Media: &appbsky.EmbedRecordWithMedia_Media{EmbedImages: &appbsky.EmbedImages{
+							Images: []*appbsky.EmbedImages_Image{{Alt: "a cat"}, {Alt: ""}},
+						}},
+					},
+				},
+			},
+			&Content{
+				Text:     []string{"#Cats are great, #cats #2024 not#atag"},
+				AltText:  []string{"a cat"},
+				Links:    []string{"https://example.com/a"},
+				Tags:     []string{"cats"},
+				Mentions: []string{"did:plc:bob"},
+			},
+		},
+		{
+			appbsky.ActorProfile{DisplayName: &name, Description: &desc},
+			&Content{
+				Text: []string{"Gopher", "posts about #Go and #golang"},
+				Tags: []string{"go", "golang"},
+			},
+		},
+		{
+			&appbsky.FeedGenerator{DisplayName: "Go", Description: &desc},
+			&Content{
+				Text: []string{"Go", "posts about #Go and #golang"},
+				Tags: []string{"go", "golang"},
+			},
+		},
+	}
+
+	for i, c := range cases {
+		got, ok := Record(c.rec)
+		if !ok {
+			t.Fatalf("case %d: record type not known", i)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("case %d: got %+v, want %+v", i, got, c.want)
+		}
+	}
+
+	if _, ok := Record(&appbsky.FeedLike{}); ok {
+		t.Error("likes have no content to extract")
+	}
+}
+
+func TestDomains(t *testing.T) {
+	c := &Content{Links: []string{"https://www.News.Example.com/a", "https://example.com/b", "not a url"}}
+	want := []string{"news.example.com", "example.com"}
+	if got := c.Domains(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
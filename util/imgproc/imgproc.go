@@ -0,0 +1,258 @@
+// Package imgproc checks, cleans and resizes uploaded images. Only the image
+// formats of the standard library (GIF, JPEG and PNG) can be decoded; other
+// formats are recognized but otherwise passed through.
+package imgproc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"strings"
+
+	// image formats which can be decoded
+	_ "image/gif"
+)
+
+// ErrMalformed is returned, wrapped, for images which can't be parsed
+var ErrMalformed = errors.New("malformed image")
+
+// DetectMimeType returns the MIME type of data from its contents, without
+// parameters
+func DetectMimeType(data []byte) string {
+	mt := http.DetectContentType(data)
+	if i := strings.IndexByte(mt, ';'); i >= 0 {
+		mt = mt[:i]
+	}
+	return mt
+}
+
+// NormalizeMimeType lower cases a MIME type and drops its parameters, fixing
+// up the common misspelling of image/jpeg
+func NormalizeMimeType(mt string) string {
+	if i := strings.IndexByte(mt, ';'); i >= 0 {
+		mt = mt[:i]
+	}
+	mt = strings.ToLower(strings.TrimSpace(mt))
+	if mt == "image/jpg" || mt == "image/pjpeg" {
+		return "image/jpeg"
+	}
+	return mt
+}
+
+// Decodable reports whether images of a MIME type can be decoded
+func Decodable(mimeType string) bool {
+	switch mimeType {
+	case "image/gif", "image/jpeg", "image/png":
+		return true
+	default:
+		return false
+	}
+}
+
+// StripMetadata removes EXIF, XMP, text and other metadata from JPEG and PNG
+// images, without re-encoding them. Data of other types is returned as is.
+// The EXIF orientation goes with the rest, so JPEGs relying on it to be
+// displayed upright are best rotated before being uploaded.
+func StripMetadata(data []byte, mimeType string) ([]byte, error) {
+	switch mimeType {
+	case "image/jpeg":
+		return stripJPEG(data)
+	case "image/png":
+		return stripPNG(data)
+	default:
+		return data, nil
+	}
+}
+
+func stripJPEG(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, fmt.Errorf("%w: missing JPEG start of image", ErrMalformed)
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+
+	i := 2
+	for {
+		if i >= len(data) || data[i] != 0xff {
+			return nil, fmt.Errorf("%w: expected JPEG marker at offset %d", ErrMalformed, i)
+		}
+		// markers may be padded with any number of fill bytes
+		for i < len(data) && data[i] == 0xff {
+			i++
+		}
+		if i >= len(data) {
+			return nil, fmt.Errorf("%w: truncated JPEG", ErrMalformed)
+		}
+		marker := data[i]
+		i++
+
+		switch {
+		case marker == 0xd9:
+			// end of image, with nothing but the image data before it
+			out.Write([]byte{0xff, marker})
+			return out.Bytes(), nil
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7):
+			out.Write([]byte{0xff, marker})
+			continue
+		}
+
+		if i+2 > len(data) {
+			return nil, fmt.Errorf("%w: truncated JPEG segment", ErrMalformed)
+		}
+		n := int(binary.BigEndian.Uint16(data[i:]))
+		if n < 2 || i+n > len(data) {
+			return nil, fmt.Errorf("%w: JPEG segment overruns image", ErrMalformed)
+		}
+		seg := data[i : i+n]
+		i += n
+
+		if marker == 0xda {
+			// start of scan: the entropy coded data follows, which
+			// carries on until the end of the image
+			out.Write([]byte{0xff, marker})
+			out.Write(seg)
+			out.Write(data[i:])
+			return out.Bytes(), nil
+		}
+
+		if !keepJPEGSegment(marker, seg[2:]) {
+			continue
+		}
+		out.Write([]byte{0xff, marker})
+		out.Write(seg)
+	}
+}
+
+// keepJPEGSegment reports whether a segment is needed to display an image.
+// Of the application segments, JFIF (APP0), ICC profiles (APP2) and Adobe's
+// color transform (APP14) are kept; EXIF and XMP (APP1), the others and
+// comments are dropped.
+func keepJPEGSegment(marker byte, payload []byte) bool {
+	switch {
+	case marker == 0xe0, marker == 0xee:
+		return true
+	case marker == 0xe2:
+		return bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00"))
+	case marker >= 0xe1 && marker <= 0xef, marker == 0xfe:
+		return false
+	default:
+		return true
+	}
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// strippedPNGChunks are the ancillary chunks holding metadata
+var strippedPNGChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+func stripPNG(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, fmt.Errorf("%w: missing PNG signature", ErrMalformed)
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngSignature)
+
+	i := len(pngSignature)
+	for {
+		if i+8 > len(data) {
+			return nil, fmt.Errorf("%w: truncated PNG", ErrMalformed)
+		}
+		n := int(binary.BigEndian.Uint32(data[i:]))
+		typ := string(data[i+4 : i+8])
+
+		// length, type, data and checksum
+		end := i + 12 + n
+		if end > len(data) {
+			return nil, fmt.Errorf("%w: PNG chunk %q overruns image", ErrMalformed, typ)
+		}
+
+		if !strippedPNGChunks[typ] {
+			out.Write(data[i:end])
+		}
+		i = end
+
+		if typ == "IEND" {
+			return out.Bytes(), nil
+		}
+	}
+}
+
+// Resize scales an image down to fit within maxDim pixels in both width and
+// height, keeping its aspect ratio. Images which already fit are returned as
+// they are.
+func Resize(img image.Image, maxDim int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if maxDim <= 0 || (w <= maxDim && h <= maxDim) {
+		return img
+	}
+
+	nw, nh := maxDim, maxDim
+	if w > h {
+		nh = maxInt(1, h*maxDim/w)
+	} else {
+		nw = maxInt(1, w*maxDim/h)
+	}
+
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+
+	// each output pixel is the average of the (premultiplied) source pixels
+	// it covers, which is what you want when shrinking
+	dst := image.NewRGBA(image.Rect(0, 0, nw, nh))
+	for y := 0; y < nh; y++ {
+		y0, y1 := y*h/nh, maxInt((y+1)*h/nh, y*h/nh+1)
+		for x := 0; x < nw; x++ {
+			x0, x1 := x*w/nw, maxInt((x+1)*w/nw, x*w/nw+1)
+
+			var sum [4]uint64
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride+x0*4 : sy*src.Stride+x1*4]
+				for p := 0; p < len(row); p += 4 {
+					sum[0] += uint64(row[p])
+					sum[1] += uint64(row[p+1])
+					sum[2] += uint64(row[p+2])
+					sum[3] += uint64(row[p+3])
+				}
+			}
+
+			n := uint64((y1 - y0) * (x1 - x0))
+			o := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				dst.Pix[o+c] = uint8(sum[c] / n)
+			}
+		}
+	}
+	return dst
+}
+
+// Encode writes an image as a JPEG if mimeType is image/jpeg, and as a PNG
+// otherwise, returning the MIME type written
+func Encode(w io.Writer, img image.Image, mimeType string) (string, error) {
+	if mimeType == "image/jpeg" {
+		return "image/jpeg", jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+	}
+	return "image/png", png.Encode(w, img)
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
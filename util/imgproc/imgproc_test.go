@@ -0,0 +1,158 @@
+package imgproc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func testImage(w, h int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	return img
+}
+
+// withJPEGSegment inserts a segment after the start of image marker
+func withJPEGSegment(data []byte, marker byte, payload []byte) []byte {
+	seg := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(payload)+2))
+	seg = append(seg, payload...)
+
+	out := append([]byte{}, data[:2]...)
+	out = append(out, seg...)
+	return append(out, data[2:]...)
+}
+
+// withPNGChunk inserts a chunk after the IHDR chunk
+func withPNGChunk(data []byte, typ string, payload []byte) []byte {
+	chunk := make([]byte, 8, 12+len(payload))
+	binary.BigEndian.PutUint32(chunk, uint32(len(payload)))
+	copy(chunk[4:], typ)
+	chunk = append(chunk, payload...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	// signature and IHDR, which has 13 bytes of data
+	n := 8 + 12 + 13
+	out := append([]byte{}, data[:n]...)
+	out = append(out, chunk...)
+	return append(out, data[n:]...)
+}
+
+func TestStripJPEG(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, testImage(64, 48), nil); err != nil {
+		t.Fatal(err)
+	}
+	clean := buf.Bytes()
+
+	data := withJPEGSegment(clean, 0xe1, []byte("Exif\x00\x00secret location"))
+	data = withJPEGSegment(data, 0xfe, []byte("a comment"))
+	data = withJPEGSegment(data, 0xe2, []byte("ICC_PROFILE\x00\x01\x01profile"))
+
+	if mt := DetectMimeType(data); mt != "image/jpeg" {
+		t.Fatalf("detected %q", mt)
+	}
+
+	out, err := StripMetadata(data, "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(out, []byte("secret")) || bytes.Contains(out, []byte("comment")) {
+		t.Fatal("metadata was not stripped")
+	}
+	if !bytes.Contains(out, []byte("ICC_PROFILE")) {
+		t.Fatal("color profile was stripped")
+	}
+	if len(out) != len(clean)+len("ICC_PROFILE\x00\x01\x01profile")+4 {
+		t.Fatalf("expected only the metadata to be dropped, got %d bytes from %d", len(out), len(clean))
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != 64 || cfg.Height != 48 {
+		t.Fatalf("unexpected dimensions %dx%d", cfg.Width, cfg.Height)
+	}
+
+	if _, err := StripMetadata([]byte("not a jpeg"), "image/jpeg"); !errors.Is(err, ErrMalformed) {
+		t.Fatalf("expected ErrMalformed, got %v", err)
+	}
+	if _, err := StripMetadata(clean[:20], "image/jpeg"); !errors.Is(err, ErrMalformed) {
+		t.Fatalf("expected ErrMalformed for a truncated image, got %v", err)
+	}
+}
+
+func TestStripPNG(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, testImage(32, 32)); err != nil {
+		t.Fatal(err)
+	}
+	clean := buf.Bytes()
+
+	data := withPNGChunk(clean, "tEXt", []byte("Author\x00someone"))
+	data = withPNGChunk(data, "eXIf", []byte("MM\x00\x2asecret"))
+	if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := StripMetadata(data, "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, clean) {
+		t.Fatal("expected only the metadata chunks to be dropped")
+	}
+
+	if _, err := StripMetadata(clean[:40], "image/png"); !errors.Is(err, ErrMalformed) {
+		t.Fatalf("expected ErrMalformed for a truncated image, got %v", err)
+	}
+}
+
+func TestResize(t *testing.T) {
+	img := testImage(400, 100)
+
+	small := Resize(img, 100)
+	if b := small.Bounds(); b.Dx() != 100 || b.Dy() != 25 {
+		t.Fatalf("unexpected size %v", b)
+	}
+	if Resize(img, 400) != img {
+		t.Fatal("images which fit shouldn't be resized")
+	}
+
+	tall := Resize(testImage(10, 1000), 50)
+	if b := tall.Bounds(); b.Dx() != 1 || b.Dy() != 50 {
+		t.Fatalf("unexpected size %v", b)
+	}
+
+	// a flat color stays the same color
+	flat := image.NewRGBA(image.Rect(0, 0, 90, 90))
+	for i := range flat.Pix {
+		flat.Pix[i] = 200
+	}
+	if c := Resize(flat, 7).At(3, 3).(color.RGBA); c != (color.RGBA{200, 200, 200, 200}) {
+		t.Fatalf("unexpected color %v", c)
+	}
+}
+
+func TestNormalizeMimeType(t *testing.T) {
+	for in, out := range map[string]string{
+		"image/JPG":                "image/jpeg",
+		"image/png; charset=utf-8": "image/png",
+		" video/mp4 ":              "video/mp4",
+	} {
+		if got := NormalizeMimeType(in); got != out {
+			t.Errorf("NormalizeMimeType(%q) = %q, expected %q", in, got, out)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Package invalidation passes messages between services about changes which
+// make cached state stale: an account's identity changing, a repo being taken
+// down, or a label being applied. Services publish them to a Bus as they make
+// the changes, and services with caches of that state subscribe, dropping or
+// updating what they have cached.
+//
+// A MemBus passes messages between the components of one process, and a
+// RedisBus between every service connected to the same redis server. Neither
+// keeps messages for subscribers which aren't connected when they are
+// published, so caches should still expire on their own.
+package invalidation
+
+import (
+	"context"
+	"sync"
+
+	label "github.com/bluesky-social/indigo/api/label"
+
+	logging "github.com/ipfs/go-log"
+)
+
+var log = logging.Logger("invalidation")
+
+// Kind is what changed
+type Kind string
+
+const (
+	// KindIdentity is an account's DID document or handle changing
+	KindIdentity Kind = "identity"
+	// KindTakedown is a repo being taken down, or the takedown reversed
+	KindTakedown Kind = "takedown"
+	// KindLabel is a label being applied, or negated
+	KindLabel Kind = "label"
+)
+
+// Message describes a change
+type Message struct {
+	Kind Kind `json:"kind"`
+
+	// Source names the service which made the change, eg "bgs", so that
+	// it can skip its own messages
+	Source string `json:"source"`
+
+	// Did is the account changed, for identity and takedown messages
+	Did string `json:"did,omitempty"`
+
+	// Handle is the account's new handle, for identity messages if known.
+	// It is syntax.HandleInvalid if the account's handle no longer
+	// verifies.
+	Handle string `json:"handle,omitempty"`
+
+	// Reversed is set on takedown messages for takedowns being reversed
+	Reversed bool `json:"reversed,omitempty"`
+
+	// Uri is the subject of the label of label messages, a DID or an
+	// at:// URI, and Val and Neg its value and whether it is a negation
+	Uri string `json:"uri,omitempty"`
+	Val string `json:"val,omitempty"`
+	Neg bool   `json:"neg,omitempty"`
+}
+
+// IdentityChanged returns the message for the identity of did changing, to
+// handle if known
+func IdentityChanged(source, did, handle string) Message {
+	return Message{Kind: KindIdentity, Source: source, Did: did, Handle: handle}
+}
+
+// RepoTakenDown returns the message for the repo of did being taken down, or
+// its takedown being reversed
+func RepoTakenDown(source, did string, reversed bool) Message {
+	return Message{Kind: KindTakedown, Source: source, Did: did, Reversed: reversed}
+}
+
+// LabelAdded returns the message for l being applied
+func LabelAdded(source string, l *label.Label) Message {
+	return Message{Kind: KindLabel, Source: source, Uri: l.Uri, Val: l.Val, Neg: l.Neg}
+}
+
+// Handler is called with each message published to a bus. Handlers hold up
+// the publisher (of a MemBus) or later messages (of a RedisBus), so should
+// hand off anything slow.
+type Handler func(ctx context.Context, m Message)
+
+// Bus passes messages from publishers to every subscriber
+type Bus interface {
+	// Publish sends m to every subscriber, including those of this bus
+	Publish(ctx context.Context, m Message) error
+
+	// Subscribe has h called with every message published from now on,
+	// until the returned function is called
+	Subscribe(h Handler) (unsubscribe func())
+
+	Close() error
+}
+
+// subscribers are the handlers of a bus
+type subscribers struct {
+	lk       sync.Mutex
+	next     int
+	handlers map[int]Handler
+}
+
+func (s *subscribers) Subscribe(h Handler) func() {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if s.handlers == nil {
+		s.handlers = make(map[int]Handler)
+	}
+	id := s.next
+	s.next++
+	s.handlers[id] = h
+
+	return func() {
+		s.lk.Lock()
+		defer s.lk.Unlock()
+		delete(s.handlers, id)
+	}
+}
+
+// deliver passes m to every handler
+func (s *subscribers) deliver(ctx context.Context, m Message) {
+	messagesReceived.WithLabelValues(string(m.Kind)).Inc()
+
+	s.lk.Lock()
+	hs := make([]Handler, 0, len(s.handlers))
+	for _, h := range s.handlers {
+		hs = append(hs, h)
+	}
+	s.lk.Unlock()
+
+	for _, h := range hs {
+		h(ctx, m)
+	}
+}
+
+// MemBus passes messages between the components of one process. Messages
+// are handled before Publish returns.
+type MemBus struct {
+	subscribers
+}
+
+func NewMemBus() *MemBus {
+	return &MemBus{}
+}
+
+func (b *MemBus) Publish(ctx context.Context, m Message) error {
+	messagesPublished.WithLabelValues(string(m.Kind)).Inc()
+	b.deliver(ctx, m)
+	return nil
+}
+
+func (b *MemBus) Close() error {
+	return nil
+}
@@ -0,0 +1,47 @@
+package invalidation
+
+import (
+	"context"
+	"testing"
+
+	label "github.com/bluesky-social/indigo/api/label"
+)
+
+func TestMemBus(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemBus()
+
+	var got1, got2 []Message
+	unsub1 := b.Subscribe(func(ctx context.Context, m Message) { got1 = append(got1, m) })
+	b.Subscribe(func(ctx context.Context, m Message) { got2 = append(got2, m) })
+
+	m := IdentityChanged("bgs", "did:plc:alice", "alice.test")
+	if err := b.Publish(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	if len(got1) != 1 || got1[0] != m {
+		t.Fatalf("first subscriber got %+v", got1)
+	}
+	if len(got2) != 1 || got2[0] != m {
+		t.Fatalf("second subscriber got %+v", got2)
+	}
+
+	unsub1()
+	if err := b.Publish(ctx, RepoTakenDown("bgs", "did:plc:alice", false)); err != nil {
+		t.Fatal(err)
+	}
+	if len(got1) != 1 {
+		t.Fatalf("unsubscribed handler was called: %+v", got1)
+	}
+	if len(got2) != 2 || got2[1].Kind != KindTakedown {
+		t.Fatalf("second subscriber got %+v", got2)
+	}
+}
+
+func TestLabelAdded(t *testing.T) {
+	m := LabelAdded("labelmaker", &label.Label{Uri: "did:plc:alice", Val: "spam", Neg: true})
+	want := Message{Kind: KindLabel, Source: "labelmaker", Uri: "did:plc:alice", Val: "spam", Neg: true}
+	if m != want {
+		t.Fatalf("got %+v, want %+v", m, want)
+	}
+}
@@ -0,0 +1,21 @@
+package invalidation
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var messagesPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "invalidation_messages_published_total",
+	Help: "The total number of cache invalidation messages published, by kind",
+}, []string{"kind"})
+
+var messagesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "invalidation_messages_received_total",
+	Help: "The total number of cache invalidation messages received, by kind",
+}, []string{"kind"})
+
+var messagesDropped = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "invalidation_messages_dropped_total",
+	Help: "The total number of cache invalidation messages received which could not be decoded",
+})
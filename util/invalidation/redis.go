@@ -0,0 +1,91 @@
+package invalidation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultChannel is the redis channel services share messages on
+const DefaultChannel = "indigo:invalidation"
+
+// RedisBus passes messages between every service subscribed to the same
+// redis channel. Messages are handled in the order they were published, on a
+// goroutine of the bus.
+type RedisBus struct {
+	subscribers
+
+	client  *redis.Client
+	channel string
+	pubsub  *redis.PubSub
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// NewRedisBus connects to the redis server at the given URL (eg
+// redis://localhost:6379/0), and subscribes to channel
+func NewRedisBus(redisURL string, channel string) (*RedisBus, error) {
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing redis url: %w", err)
+	}
+
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithCancel(context.Background())
+	pubsub := client.Subscribe(ctx, channel)
+	// wait for the subscription, so that nothing published after this
+	// returns is missed
+	if _, err := pubsub.Receive(ctx); err != nil {
+		cancel()
+		pubsub.Close()
+		client.Close()
+		return nil, fmt.Errorf("subscribing to %s: %w", channel, err)
+	}
+
+	b := &RedisBus{
+		client:  client,
+		channel: channel,
+		pubsub:  pubsub,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	go b.run(ctx)
+	return b, nil
+}
+
+func (b *RedisBus) run(ctx context.Context) {
+	defer close(b.done)
+	for msg := range b.pubsub.Channel() {
+		var m Message
+		if err := json.Unmarshal([]byte(msg.Payload), &m); err != nil {
+			messagesDropped.Inc()
+			log.Warnw("invalid invalidation message", "channel", msg.Channel, "err", err)
+			continue
+		}
+		b.deliver(ctx, m)
+	}
+}
+
+func (b *RedisBus) Publish(ctx context.Context, m Message) error {
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := b.client.Publish(ctx, b.channel, payload).Err(); err != nil {
+		return fmt.Errorf("publishing invalidation: %w", err)
+	}
+	messagesPublished.WithLabelValues(string(m.Kind)).Inc()
+	return nil
+}
+
+func (b *RedisBus) Close() error {
+	b.cancel()
+	err := b.pubsub.Close()
+	<-b.done
+	if cerr := b.client.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
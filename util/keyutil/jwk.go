@@ -0,0 +1,155 @@
+package keyutil
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/whyrusleeping/go-did"
+)
+
+// jwx only handles secp256k1 when built with a tag, so EC JWKs (RFC 7518)
+// are handled here.
+
+type ecJWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	Kid string `json:"kid,omitempty"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	D   string `json:"d,omitempty"`
+}
+
+func jwkCurve(keyType string) (string, error) {
+	switch keyType {
+	case did.KeyTypeP256:
+		return "P-256", nil
+	case did.KeyTypeSecp256k1:
+		return "secp256k1", nil
+	default:
+		return "", ErrUnsupportedKeyType
+	}
+}
+
+func decodeJWK(b []byte) (*ecJWK, string, error) {
+	var jk ecJWK
+	if err := json.Unmarshal(b, &jk); err != nil {
+		return nil, "", fmt.Errorf("parsing JWK: %w", err)
+	}
+	if jk.Kty != "EC" {
+		return nil, "", fmt.Errorf("unsupported JWK key type %q (need EC)", jk.Kty)
+	}
+
+	var kt string
+	switch jk.Crv {
+	case "P-256":
+		kt = did.KeyTypeP256
+	case "secp256k1":
+		kt = did.KeyTypeSecp256k1
+	default:
+		return nil, "", fmt.Errorf("unrecognized key type: %s", jk.Crv)
+	}
+	return &jk, kt, nil
+}
+
+func (jk *ecJWK) publicKey(keyType string) (*did.PubKey, error) {
+	x, err := decodeCoord(jk.X)
+	if err != nil {
+		return nil, fmt.Errorf("JWK x: %w", err)
+	}
+	y, err := decodeCoord(jk.Y)
+	if err != nil {
+		return nil, fmt.Errorf("JWK y: %w", err)
+	}
+	return publicKeyFromPoint(keyType, append(append([]byte{4}, x...), y...))
+}
+
+func decodeCoord(s string) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 32 {
+		return nil, fmt.Errorf("expected 32 bytes, got %d", len(b))
+	}
+	return b, nil
+}
+
+// ParseJWK parses a P-256 or secp256k1 private key JWK
+func ParseJWK(b []byte) (*did.PrivKey, error) {
+	jk, kt, err := decodeJWK(b)
+	if err != nil {
+		return nil, err
+	}
+	if jk.D == "" {
+		return nil, fmt.Errorf("JWK is not a private key")
+	}
+
+	d, err := decodeCoord(jk.D)
+	if err != nil {
+		return nil, fmt.Errorf("JWK d: %w", err)
+	}
+	k, err := privateKeyFromScalar(kt, d)
+	if err != nil {
+		return nil, err
+	}
+
+	if jk.X != "" || jk.Y != "" {
+		pub, err := jk.publicKey(kt)
+		if err != nil {
+			return nil, err
+		}
+		if !pub.Equal(k.Public()) {
+			return nil, fmt.Errorf("JWK private key doesn't match its public key")
+		}
+	}
+	return k, nil
+}
+
+// ParsePublicJWK parses a P-256 or secp256k1 public key JWK. Private key
+// JWKs are accepted, and their public key returned.
+func ParsePublicJWK(b []byte) (*did.PubKey, error) {
+	jk, kt, err := decodeJWK(b)
+	if err != nil {
+		return nil, err
+	}
+	return jk.publicKey(kt)
+}
+
+// MarshalJWK encodes a private key as a JWK with the given key ID, which
+// may be empty
+func MarshalJWK(k *did.PrivKey, kid string) ([]byte, error) {
+	d, err := privateScalar(k)
+	if err != nil {
+		return nil, err
+	}
+	return marshalJWK(k.Public(), kid, d)
+}
+
+// MarshalPublicJWK encodes a public key as a JWK
+func MarshalPublicJWK(pub *did.PubKey, kid string) ([]byte, error) {
+	return marshalJWK(pub, kid, nil)
+}
+
+func marshalJWK(pub *did.PubKey, kid string, d []byte) ([]byte, error) {
+	crv, err := jwkCurve(pub.Type)
+	if err != nil {
+		return nil, err
+	}
+	point, err := uncompressedPoint(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	jk := ecJWK{
+		Kty: "EC",
+		Crv: crv,
+		Kid: kid,
+		X:   base64.RawURLEncoding.EncodeToString(point[1:33]),
+		Y:   base64.RawURLEncoding.EncodeToString(point[33:]),
+	}
+	if d != nil {
+		jk.D = base64.RawURLEncoding.EncodeToString(d)
+	}
+	return json.MarshalIndent(jk, "", "  ")
+}
@@ -0,0 +1,288 @@
+// Package keyutil handles the two kinds of key used for atproto signatures,
+// P-256 and secp256k1 (K-256), following the atproto cryptography spec:
+// signatures are ECDSA over a SHA-256 hash, as the 64 byte r||s with s in the
+// lower half of the curve order, and public keys are encoded as multibase
+// (base58btc) compressed points with a multicodec prefix, as in did:key.
+//
+// It also converts keys between JWK, PEM, and multibase encodings, and
+// parses any of them with ParsePrivateKey.
+package keyutil
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-varint"
+	"github.com/whyrusleeping/go-did"
+	secpEc "gitlab.com/yawning/secp256k1-voi/secec"
+)
+
+const (
+	// MulticodecP256Priv and MulticodecSecp256k1Priv prefix multibase
+	// encoded private keys
+	MulticodecP256Priv      = 0x1306
+	MulticodecSecp256k1Priv = 0x1301
+
+	// MultikeyType is the verification method type of current atproto DID
+	// documents, whose publicKeyMultibase has a multicodec prefix
+	MultikeyType = "Multikey"
+)
+
+var (
+	// ErrHighS is returned when verifying a signature whose s is in the
+	// upper half of the curve order, which atproto doesn't allow
+	ErrHighS = errors.New("signature is not in low-S form")
+
+	// ErrUnsupportedKeyType is returned for keys other than P-256 and
+	// secp256k1
+	ErrUnsupportedKeyType = errors.New("unsupported key type (need P-256 or secp256k1)")
+
+	orderP256      = elliptic.P256().Params().N
+	orderSecp256k1 = mustBigHex("fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141")
+)
+
+func mustBigHex(s string) *big.Int {
+	n, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		panic("bad big int: " + s)
+	}
+	return n
+}
+
+func curveOrder(keyType string) (*big.Int, error) {
+	switch keyType {
+	case did.KeyTypeP256:
+		return orderP256, nil
+	case did.KeyTypeSecp256k1:
+		return orderSecp256k1, nil
+	default:
+		return nil, ErrUnsupportedKeyType
+	}
+}
+
+// ParseKeyType returns the key type named by "p256" ("P-256") or "k256"
+// ("secp256k1"), as used in flags
+func ParseKeyType(s string) (string, error) {
+	switch strings.ToLower(s) {
+	case "p256", "p-256", "es256":
+		return did.KeyTypeP256, nil
+	case "k256", "k-256", "secp256k1", "es256k":
+		return did.KeyTypeSecp256k1, nil
+	default:
+		return "", fmt.Errorf("unknown key type %q (expected p256 or k256)", s)
+	}
+}
+
+// CompactSignature returns the atproto form of an ECDSA signature, as r||s
+// with s normalized to the lower half of the curve order
+func CompactSignature(keyType string, r, s *big.Int) ([]byte, error) {
+	n, err := curveOrder(keyType)
+	if err != nil {
+		return nil, err
+	}
+	if r.Sign() <= 0 || s.Sign() <= 0 || r.Cmp(n) >= 0 || s.Cmp(n) >= 0 {
+		return nil, fmt.Errorf("invalid signature scalars")
+	}
+
+	halfN := new(big.Int).Rsh(n, 1)
+	if s.Cmp(halfN) > 0 {
+		s = new(big.Int).Sub(n, s)
+	}
+
+	out := make([]byte, 64)
+	r.FillBytes(out[:32])
+	s.FillBytes(out[32:])
+	return out, nil
+}
+
+// NormalizeSignature returns an r||s signature in low-S form
+func NormalizeSignature(keyType string, sig []byte) ([]byte, error) {
+	if len(sig) != 64 {
+		return nil, fmt.Errorf("unexpected signature length: %d", len(sig))
+	}
+	return CompactSignature(keyType, new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+}
+
+// Sign signs msg with a local key, returning a low-S signature. go-did makes
+// P-256 signatures with either form of s.
+func Sign(k *did.PrivKey, msg []byte) ([]byte, error) {
+	sig, err := k.Sign(msg)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := curveOrder(k.Type); err != nil {
+		// other key types have no s to normalize
+		return sig, nil
+	}
+	return NormalizeSignature(k.Type, sig)
+}
+
+// Verify checks a signature of msg, rejecting signatures which are not in
+// low-S form
+func Verify(pub *did.PubKey, msg, sig []byte) error {
+	if n, err := curveOrder(pub.Type); err == nil {
+		if len(sig) != 64 {
+			return did.ErrInvalidSignature
+		}
+		if new(big.Int).SetBytes(sig[32:]).Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+			return ErrHighS
+		}
+	}
+	return pub.Verify(msg, sig)
+}
+
+// ParsePublicKey parses a did:key, or a multibase encoded public key with a
+// multicodec prefix
+func ParsePublicKey(s string) (*did.PubKey, error) {
+	var pub *did.PubKey
+	var err error
+	if strings.HasPrefix(s, "did:key:") {
+		pub, err = did.PubKeyFromDIDString(s)
+	} else {
+		pub, err = did.PubKeyFromMultibaseString(s)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := curveOrder(pub.Type); err != nil {
+		return nil, err
+	}
+	return pub, nil
+}
+
+// PrivateKeyMultibase encodes a private key as multibase (base58btc), with a
+// multicodec prefix, as atproto tools do
+func PrivateKeyMultibase(k *did.PrivKey) (string, error) {
+	var prefix uint64
+	switch k.Type {
+	case did.KeyTypeP256:
+		prefix = MulticodecP256Priv
+	case did.KeyTypeSecp256k1:
+		prefix = MulticodecSecp256k1Priv
+	default:
+		return "", ErrUnsupportedKeyType
+	}
+	raw, err := privateScalar(k)
+	if err != nil {
+		return "", err
+	}
+
+	buf := append(varint.ToUvarint(prefix), raw...)
+	return multibase.Encode(multibase.Base58BTC, buf)
+}
+
+// ParsePrivateKeyMultibase parses a multibase encoded private key with a
+// multicodec prefix
+func ParsePrivateKeyMultibase(s string) (*did.PrivKey, error) {
+	_, data, err := multibase.Decode(s)
+	if err != nil {
+		return nil, err
+	}
+	prefix, n, err := varint.FromUvarint(data)
+	if err != nil {
+		return nil, err
+	}
+
+	switch prefix {
+	case MulticodecP256Priv:
+		return privateKeyFromScalar(did.KeyTypeP256, data[n:])
+	case MulticodecSecp256k1Priv:
+		return privateKeyFromScalar(did.KeyTypeSecp256k1, data[n:])
+	default:
+		return nil, fmt.Errorf("not a private key multicodec: %x", prefix)
+	}
+}
+
+// privateKeyFromScalar returns the private key for a 32 byte big-endian
+// scalar
+func privateKeyFromScalar(keyType string, d []byte) (*did.PrivKey, error) {
+	if len(d) != 32 {
+		return nil, fmt.Errorf("private key must be 32 bytes, not %d", len(d))
+	}
+
+	switch keyType {
+	case did.KeyTypeP256:
+		// ecdh checks the scalar is in range
+		ek, err := ecdh.P256().NewPrivateKey(d)
+		if err != nil {
+			return nil, fmt.Errorf("invalid p256 private key: %w", err)
+		}
+		x, y := elliptic.Unmarshal(elliptic.P256(), ek.PublicKey().Bytes())
+		return &did.PrivKey{
+			Type: did.KeyTypeP256,
+			Raw: &ecdsa.PrivateKey{
+				PublicKey: ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y},
+				D:         new(big.Int).SetBytes(d),
+			},
+		}, nil
+	case did.KeyTypeSecp256k1:
+		sk, err := secpEc.NewPrivateKey(d)
+		if err != nil {
+			return nil, fmt.Errorf("invalid k256 private key: %w", err)
+		}
+		return &did.PrivKey{Type: did.KeyTypeSecp256k1, Raw: sk}, nil
+	default:
+		return nil, ErrUnsupportedKeyType
+	}
+}
+
+// ParsePrivateKey parses a private key as a JWK, PEM (PKCS#8 or SEC 1), or
+// multibase string
+func ParsePrivateKey(b []byte) (*did.PrivKey, error) {
+	b = bytes.TrimSpace(b)
+	switch {
+	case bytes.HasPrefix(b, []byte("{")):
+		return ParseJWK(b)
+	case bytes.HasPrefix(b, []byte("-----BEGIN")):
+		return ParsePrivateKeyPEM(b)
+	case len(b) > 0:
+		return ParsePrivateKeyMultibase(string(b))
+	default:
+		return nil, fmt.Errorf("empty private key")
+	}
+}
+
+// DocumentKey returns the public key of a verification method of a DID
+// document, by fragment ("#atproto"). Methods may be identified relative to
+// the document, or with the full DID.
+func DocumentKey(doc *did.Document, d, fragment string) (*did.PubKey, error) {
+	for i := range doc.VerificationMethod {
+		vm := &doc.VerificationMethod[i]
+		if vm.ID == fragment || vm.ID == d+fragment {
+			return VerificationMethodKey(vm)
+		}
+	}
+	return nil, fmt.Errorf("no %s key in DID document of %s", fragment, d)
+}
+
+// VerificationMethodKey returns the public key of a verification method,
+// either a Multikey or one of the older per-curve types
+func VerificationMethodKey(vm *did.VerificationMethod) (*did.PubKey, error) {
+	if vm.PublicKeyMultibase == nil {
+		return vm.GetPublicKey()
+	}
+
+	switch vm.Type {
+	case MultikeyType:
+		return ParsePublicKey(*vm.PublicKeyMultibase)
+	case did.KeyTypeP256, did.KeyTypeSecp256k1:
+		pub, err := vm.GetPublicKey()
+		if err == nil {
+			return pub, nil
+		}
+		// some documents give older types a multicodec prefixed key
+		if mpub, merr := ParsePublicKey(*vm.PublicKeyMultibase); merr == nil && mpub.Type == vm.Type {
+			return mpub, nil
+		}
+		return nil, err
+	default:
+		return vm.GetPublicKey()
+	}
+}
@@ -0,0 +1,285 @@
+package keyutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/stretchr/testify/assert"
+	"github.com/whyrusleeping/go-did"
+)
+
+var keyTypes = []string{did.KeyTypeP256, did.KeyTypeSecp256k1}
+
+func testKey(t *testing.T, kt string) *did.PrivKey {
+	k, err := did.GeneratePrivKey(rand.Reader, kt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func highS(t *testing.T, kt string, sig []byte) []byte {
+	n, err := curveOrder(kt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := append([]byte{}, sig...)
+	new(big.Int).Sub(n, new(big.Int).SetBytes(sig[32:])).FillBytes(out[32:])
+	return out
+}
+
+func TestSignVerifyLowS(t *testing.T) {
+	assert := assert.New(t)
+	msg := []byte("commit bytes")
+
+	for _, kt := range keyTypes {
+		k := testKey(t, kt)
+		for i := 0; i < 20; i++ {
+			sig, err := Sign(k, msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.NoError(Verify(k.Public(), msg, sig), kt)
+
+			// the flipped signature is valid ECDSA, but not allowed
+			assert.ErrorIs(Verify(k.Public(), msg, highS(t, kt, sig)), ErrHighS, kt)
+
+			norm, err := NormalizeSignature(kt, highS(t, kt, sig))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(sig, norm)
+		}
+
+		assert.Error(Verify(k.Public(), []byte("other"), mustSign(t, k, msg)))
+		assert.Error(Verify(k.Public(), msg, make([]byte, 63)))
+	}
+
+	_, err := NormalizeSignature(did.KeyTypeSecp256k1, make([]byte, 63))
+	assert.Error(err)
+	_, err = NormalizeSignature(did.KeyTypeSecp256k1, make([]byte, 64))
+	assert.Error(err)
+}
+
+func mustSign(t *testing.T, k *did.PrivKey, msg []byte) []byte {
+	sig, err := Sign(k, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func TestParsePublicKey(t *testing.T) {
+	assert := assert.New(t)
+
+	// from the atproto cryptography spec
+	for s, kt := range map[string]string{
+		"did:key:zDnaembgSGUhZULN2Caob4HLJPaxBh92N7rtH21TErzqf8HQo": did.KeyTypeP256,
+		"did:key:zQ3shqwJEJyMBsBXCWyCBpUBMqxcon9oHB7mCvx4sSpMdLJwc": did.KeyTypeSecp256k1,
+		"zDnaembgSGUhZULN2Caob4HLJPaxBh92N7rtH21TErzqf8HQo":         did.KeyTypeP256,
+	} {
+		pub, err := ParsePublicKey(s)
+		if assert.NoError(err, s) {
+			assert.Equal(kt, pub.Type)
+		}
+	}
+
+	ed := testKey(t, did.KeyTypeEd25519)
+	_, err := ParsePublicKey(ed.Public().DID())
+	assert.ErrorIs(err, ErrUnsupportedKeyType)
+}
+
+func TestPrivateKeyEncodings(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, kt := range keyTypes {
+		k := testKey(t, kt)
+
+		mb, err := PrivateKeyMultibase(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := MarshalPrivateKeyPEM(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j, err := MarshalJWK(k, "mykey")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, enc := range [][]byte{[]byte(mb), p, j, append([]byte("  "), j...)} {
+			parsed, err := ParsePrivateKey(enc)
+			if assert.NoError(err, string(enc)) {
+				assert.Equal(kt, parsed.Type)
+				assert.True(parsed.Public().Equal(k.Public()))
+			}
+		}
+
+		jpub, err := ParsePublicJWK(j)
+		if assert.NoError(err) {
+			assert.True(jpub.Equal(k.Public()))
+		}
+
+		pubPEM, err := MarshalPublicKeyPEM(k.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, err := ParsePublicKeyPEM(pubPEM)
+		if assert.NoError(err) {
+			assert.Equal(k.Public().DID(), pub.DID())
+		}
+	}
+
+	_, err := ParsePrivateKey([]byte(" \n"))
+	assert.Error(err)
+	_, err = ParsePrivateKey([]byte(testKey(t, did.KeyTypeP256).Public().MultibaseString()))
+	assert.Error(err, "public keys aren't private keys")
+}
+
+// P-256 keys should interoperate with the standard library and jwx
+func TestP256Interop(t *testing.T) {
+	assert := assert.New(t)
+	k := testKey(t, did.KeyTypeP256)
+	ek := k.Raw.(*ecdsa.PrivateKey)
+
+	p, err := MarshalPrivateKeyPEM(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(p)
+	std, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if assert.NoError(err) {
+		assert.True(ek.Equal(std))
+	}
+
+	sec1, err := x509.MarshalECPrivateKey(ek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParsePrivateKeyPEM(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1}))
+	if assert.NoError(err) {
+		assert.True(parsed.Public().Equal(k.Public()))
+	}
+
+	spki, err := x509.MarshalPKIXPublicKey(&ek.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := MarshalPublicKeyDER(k.Public())
+	if assert.NoError(err) {
+		assert.Equal(spki, der)
+	}
+
+	// files written by older versions, with jwx
+	jk, err := jwk.FromRaw(ek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jk.Set(jwk.KeyIDKey, "mykey")
+	buf, err := json.Marshal(jk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err = ParseJWK(buf)
+	if assert.NoError(err) {
+		assert.True(parsed.Public().Equal(k.Public()))
+	}
+
+	// and the JWKs written now should be readable by jwx
+	ours, err := MarshalJWK(k, "mykey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jk, err = jwk.ParseKey(ours)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back ecdsa.PrivateKey
+	if assert.NoError(jk.Raw(&back)) {
+		assert.True(ek.Equal(&back))
+	}
+}
+
+func TestParseJWKMismatch(t *testing.T) {
+	a := testKey(t, did.KeyTypeSecp256k1)
+	b := testKey(t, did.KeyTypeSecp256k1)
+
+	ja, err := MarshalJWK(a, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jb, err := MarshalPublicJWK(b.Public(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a's private key with b's public key
+	mixed := append(ja[:0:0], jb[:len(jb)-2]...)
+	mixed = append(mixed, []byte(`,"d":"`+jwkD(t, ja)+`"}`)...)
+	_, err = ParseJWK(mixed)
+	assert.ErrorContains(t, err, "doesn't match")
+
+	_, err = ParseJWK(jb)
+	assert.ErrorContains(t, err, "not a private key")
+}
+
+func jwkD(t *testing.T, b []byte) string {
+	jk, _, err := decodeJWK(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jk.D
+}
+
+func TestVerificationMethodKey(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, kt := range keyTypes {
+		k := testKey(t, kt)
+		mb := k.Public().MultibaseString()
+
+		legacy, err := did.VerificationMethodFromKey(k.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		legacy.ID = "#atproto"
+
+		multikey := did.VerificationMethod{ID: "did:plc:alice#atproto", Type: MultikeyType, PublicKeyMultibase: &mb}
+		prefixed := did.VerificationMethod{ID: "#atproto", Type: kt, PublicKeyMultibase: &mb}
+
+		for _, vm := range []did.VerificationMethod{*legacy, multikey, prefixed} {
+			doc := &did.Document{VerificationMethod: []did.VerificationMethod{vm}}
+			pub, err := DocumentKey(doc, "did:plc:alice", "#atproto")
+			if assert.NoError(err, vm.Type) {
+				assert.True(pub.Equal(k.Public()))
+			}
+			_, err = DocumentKey(doc, "did:plc:alice", "#atproto_label")
+			assert.Error(err)
+		}
+
+		// a Multikey whose key is of the wrong kind
+		edmb := testKey(t, did.KeyTypeEd25519).Public().MultibaseString()
+		_, err = VerificationMethodKey(&did.VerificationMethod{Type: MultikeyType, PublicKeyMultibase: &edmb})
+		assert.Error(err)
+	}
+}
+
+func TestParseKeyType(t *testing.T) {
+	kt, err := ParseKeyType("K256")
+	assert.NoError(t, err)
+	assert.Equal(t, did.KeyTypeSecp256k1, kt)
+
+	kt, err = ParseKeyType("p256")
+	assert.NoError(t, err)
+	assert.Equal(t, did.KeyTypeP256, kt)
+
+	_, err = ParseKeyType("ed25519")
+	assert.Error(t, err)
+}
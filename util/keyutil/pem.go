@@ -0,0 +1,291 @@
+package keyutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/whyrusleeping/go-did"
+	secpEc "gitlab.com/yawning/secp256k1-voi/secec"
+)
+
+// The x509 package doesn't know secp256k1, so keys are (un)marshaled from
+// ASN.1 here, for both curves.
+
+var (
+	oidPublicKeyECDSA = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	oidCurveP256      = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+	oidCurveSecp256k1 = asn1.ObjectIdentifier{1, 3, 132, 0, 10}
+)
+
+// subjectPublicKeyInfo is the X.509 public key structure (RFC 5280)
+type subjectPublicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+// pkcs8 is a PKCS#8 private key (RFC 5208)
+type pkcs8 struct {
+	Version    int
+	Algorithm  pkix.AlgorithmIdentifier
+	PrivateKey []byte
+}
+
+// ecPrivateKey is a SEC 1 private key (RFC 5915)
+type ecPrivateKey struct {
+	Version    int
+	PrivateKey []byte
+	Curve      asn1.ObjectIdentifier `asn1:"optional,explicit,tag:0"`
+	PublicKey  asn1.BitString        `asn1:"optional,explicit,tag:1"`
+}
+
+func curveKeyType(curve asn1.ObjectIdentifier) (string, error) {
+	switch {
+	case curve.Equal(oidCurveP256):
+		return did.KeyTypeP256, nil
+	case curve.Equal(oidCurveSecp256k1):
+		return did.KeyTypeSecp256k1, nil
+	default:
+		return "", fmt.Errorf("unsupported curve: %s", curve)
+	}
+}
+
+func keyTypeCurve(keyType string) (asn1.ObjectIdentifier, error) {
+	switch keyType {
+	case did.KeyTypeP256:
+		return oidCurveP256, nil
+	case did.KeyTypeSecp256k1:
+		return oidCurveSecp256k1, nil
+	default:
+		return nil, ErrUnsupportedKeyType
+	}
+}
+
+// PublicKeyFromECParams returns the public key for an uncompressed curve
+// point, on the curve named by DER encoded EC parameters (as found in
+// SubjectPublicKeyInfo, or the EC_PARAMS attribute of a PKCS#11 key)
+func PublicKeyFromECParams(params, point []byte) (*did.PubKey, error) {
+	var curve asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(params, &curve); err != nil {
+		return nil, fmt.Errorf("parsing key curve: %w", err)
+	}
+	kt, err := curveKeyType(curve)
+	if err != nil {
+		return nil, err
+	}
+	return publicKeyFromPoint(kt, point)
+}
+
+func publicKeyFromPoint(keyType string, point []byte) (*did.PubKey, error) {
+	switch keyType {
+	case did.KeyTypeP256:
+		x, y := elliptic.Unmarshal(elliptic.P256(), point)
+		if x == nil {
+			return nil, fmt.Errorf("invalid p256 public key")
+		}
+		return did.PubKeyFromCrypto(&ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y})
+	case did.KeyTypeSecp256k1:
+		pk, err := secpEc.NewPublicKey(point)
+		if err != nil {
+			return nil, fmt.Errorf("invalid k256 public key: %w", err)
+		}
+		return did.PubKeyFromCrypto(pk)
+	default:
+		return nil, ErrUnsupportedKeyType
+	}
+}
+
+// uncompressedPoint returns the SEC 1 uncompressed encoding of a public key
+func uncompressedPoint(pub *did.PubKey) ([]byte, error) {
+	switch pk := pub.Raw.(type) {
+	case *ecdsa.PublicKey:
+		return elliptic.Marshal(pk.Curve, pk.X, pk.Y), nil
+	case *secpEc.PublicKey:
+		return pk.Bytes(), nil
+	default:
+		return nil, ErrUnsupportedKeyType
+	}
+}
+
+// ParsePublicKeyDER parses a DER SubjectPublicKeyInfo holding a P-256 or
+// secp256k1 public key
+func ParsePublicKeyDER(der []byte) (*did.PubKey, error) {
+	var spki subjectPublicKeyInfo
+	rest, err := asn1.Unmarshal(der, &spki)
+	if err != nil {
+		return nil, fmt.Errorf("parsing public key: %w", err)
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("trailing data after public key")
+	}
+	if !spki.Algorithm.Algorithm.Equal(oidPublicKeyECDSA) {
+		return nil, fmt.Errorf("not an EC public key: %s", spki.Algorithm.Algorithm)
+	}
+	return PublicKeyFromECParams(spki.Algorithm.Parameters.FullBytes, spki.PublicKey.RightAlign())
+}
+
+// MarshalPublicKeyDER encodes a public key as a DER SubjectPublicKeyInfo
+func MarshalPublicKeyDER(pub *did.PubKey) ([]byte, error) {
+	curve, err := keyTypeCurve(pub.Type)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(curve)
+	if err != nil {
+		return nil, err
+	}
+	point, err := uncompressedPoint(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(subjectPublicKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidPublicKeyECDSA, Parameters: asn1.RawValue{FullBytes: params}},
+		PublicKey: asn1.BitString{Bytes: point, BitLength: 8 * len(point)},
+	})
+}
+
+// ParsePublicKeyPEM parses a "PUBLIC KEY" PEM block
+func ParsePublicKeyPEM(b []byte) (*did.PubKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	if block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("unexpected PEM block type %q", block.Type)
+	}
+	return ParsePublicKeyDER(block.Bytes)
+}
+
+// MarshalPublicKeyPEM encodes a public key as a "PUBLIC KEY" PEM block
+func MarshalPublicKeyPEM(pub *did.PubKey) ([]byte, error) {
+	der, err := MarshalPublicKeyDER(pub)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// ParsePrivateKeyPEM parses a PKCS#8 "PRIVATE KEY" or SEC 1 "EC PRIVATE
+// KEY" PEM block
+func ParsePrivateKeyPEM(b []byte) (*did.PrivKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		var pk pkcs8
+		if _, err := asn1.Unmarshal(block.Bytes, &pk); err != nil {
+			return nil, fmt.Errorf("parsing pkcs8 private key: %w", err)
+		}
+		if !pk.Algorithm.Algorithm.Equal(oidPublicKeyECDSA) {
+			return nil, fmt.Errorf("not an EC private key: %s", pk.Algorithm.Algorithm)
+		}
+		var curve asn1.ObjectIdentifier
+		if _, err := asn1.Unmarshal(pk.Algorithm.Parameters.FullBytes, &curve); err != nil {
+			return nil, fmt.Errorf("parsing private key curve: %w", err)
+		}
+		return parseECPrivateKey(curve, pk.PrivateKey)
+	case "EC PRIVATE KEY":
+		return parseECPrivateKey(nil, block.Bytes)
+	default:
+		return nil, fmt.Errorf("unexpected PEM block type %q", block.Type)
+	}
+}
+
+// parseECPrivateKey parses a SEC 1 private key. PKCS#8 keys give the curve
+// outside of the SEC 1 structure.
+func parseECPrivateKey(curve asn1.ObjectIdentifier, der []byte) (*did.PrivKey, error) {
+	var ecpk ecPrivateKey
+	if _, err := asn1.Unmarshal(der, &ecpk); err != nil {
+		return nil, fmt.Errorf("parsing EC private key: %w", err)
+	}
+	if ecpk.Version != 1 {
+		return nil, fmt.Errorf("unknown EC private key version %d", ecpk.Version)
+	}
+	if curve == nil {
+		curve = ecpk.Curve
+	}
+	kt, err := curveKeyType(curve)
+	if err != nil {
+		return nil, err
+	}
+
+	// leading zeros may have been dropped
+	d := ecpk.PrivateKey
+	if len(d) > 32 {
+		return nil, fmt.Errorf("private key too long")
+	}
+	d = append(make([]byte, 32-len(d)), d...)
+
+	k, err := privateKeyFromScalar(kt, d)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ecpk.PublicKey.Bytes) > 0 {
+		pub, err := publicKeyFromPoint(kt, ecpk.PublicKey.RightAlign())
+		if err != nil {
+			return nil, err
+		}
+		if !pub.Equal(k.Public()) {
+			return nil, fmt.Errorf("private key doesn't match its public key")
+		}
+	}
+	return k, nil
+}
+
+// MarshalPrivateKeyPEM encodes a private key as a PKCS#8 "PRIVATE KEY" PEM
+// block
+func MarshalPrivateKeyPEM(k *did.PrivKey) ([]byte, error) {
+	curve, err := keyTypeCurve(k.Type)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(curve)
+	if err != nil {
+		return nil, err
+	}
+	d, err := privateScalar(k)
+	if err != nil {
+		return nil, err
+	}
+	point, err := uncompressedPoint(k.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	inner, err := asn1.Marshal(ecPrivateKey{
+		Version:    1,
+		PrivateKey: d,
+		PublicKey:  asn1.BitString{Bytes: point, BitLength: 8 * len(point)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	der, err := asn1.Marshal(pkcs8{
+		Algorithm:  pkix.AlgorithmIdentifier{Algorithm: oidPublicKeyECDSA, Parameters: asn1.RawValue{FullBytes: params}},
+		PrivateKey: inner,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// privateScalar returns the 32 byte big-endian scalar of a private key
+func privateScalar(k *did.PrivKey) ([]byte, error) {
+	switch sk := k.Raw.(type) {
+	case *ecdsa.PrivateKey:
+		return sk.D.FillBytes(make([]byte, 32)), nil
+	case *secpEc.PrivateKey:
+		return sk.Bytes(), nil
+	default:
+		return nil, ErrUnsupportedKeyType
+	}
+}
@@ -0,0 +1,224 @@
+// Package labelsig signs labels, and verifies the signatures on labels
+// received from labelers.
+//
+// A label's signature is over the DAG-CBOR encoding of the label without its
+// sig field, made with the signing key of its src. Verifiers use the
+// "#atproto_label" key of the src's DID document, falling back to its
+// "#atproto" repo signing key, which is what labelmaker signs with.
+package labelsig
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	label "github.com/bluesky-social/indigo/api/label"
+	"github.com/bluesky-social/indigo/did"
+	"github.com/bluesky-social/indigo/util/keyutil"
+	"github.com/bluesky-social/indigo/util/signer"
+
+	lru "github.com/hashicorp/golang-lru"
+	logging "github.com/ipfs/go-log"
+	godid "github.com/whyrusleeping/go-did"
+)
+
+var log = logging.Logger("labelsig")
+
+var (
+	// ErrUnsigned is returned when verifying a label without a signature
+	ErrUnsigned = errors.New("label is not signed")
+
+	// ErrInvalidSignature is returned when a label's signature doesn't
+	// match its src's key
+	ErrInvalidSignature = errors.New("invalid label signature")
+)
+
+// SigningBytes returns the bytes a label's signature is made over
+func SigningBytes(l *label.Label) ([]byte, error) {
+	unsigned := *l
+	unsigned.Sig = nil
+
+	buf := new(bytes.Buffer)
+	if err := unsigned.MarshalCBOR(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Sign sets the signature of a label. It must be called after every other
+// field of the label is set.
+func Sign(ctx context.Context, l *label.Label, s signer.Signer) error {
+	b, err := SigningBytes(l)
+	if err != nil {
+		return fmt.Errorf("encoding label: %w", err)
+	}
+
+	sig, err := s.Sign(ctx, b)
+	if err != nil {
+		return fmt.Errorf("signing label: %w", err)
+	}
+	l.Sig = sig
+	return nil
+}
+
+// VerifyWithKey checks a label's signature against a public key
+func VerifyWithKey(l *label.Label, key *godid.PubKey) error {
+	if len(l.Sig) == 0 {
+		return ErrUnsigned
+	}
+
+	b, err := SigningBytes(l)
+	if err != nil {
+		return fmt.Errorf("encoding label: %w", err)
+	}
+	if err := keyutil.Verify(key, b, l.Sig); err != nil {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// DefaultRefetchInterval is how soon a labeler's key can be refetched when a
+// label fails to verify against the cached key
+const DefaultRefetchInterval = time.Minute
+
+// Verifier checks the signatures on labels against the keys of their
+// sources, which are resolved and cached
+type Verifier struct {
+	Dir did.Resolver
+
+	// AllowUnsigned passes labels that have no signature, for sources which
+	// don't sign labels yet
+	AllowUnsigned bool
+
+	// OnInvalid, if set, is called with each label rejected by Filter
+	OnInvalid func(l *label.Label, err error)
+
+	// RefetchInterval is how soon a source's key may be refetched after a
+	// label fails to verify, in case the key was rotated
+	RefetchInterval time.Duration
+
+	keys *lru.Cache
+
+	// fetchLk serializes fetches, so a burst of labels from one source
+	// resolves its key once
+	fetchLk sync.Mutex
+}
+
+type cachedKey struct {
+	key     *godid.PubKey
+	fetched time.Time
+}
+
+// NewVerifier returns a verifier caching the keys of up to cacheSize sources
+func NewVerifier(dir did.Resolver, cacheSize int) (*Verifier, error) {
+	keys, err := lru.New(cacheSize)
+	if err != nil {
+		return nil, err
+	}
+	return &Verifier{
+		Dir:             dir,
+		RefetchInterval: DefaultRefetchInterval,
+		keys:            keys,
+	}, nil
+}
+
+// Verify checks the signature of a label against the key of its src.
+// Unsigned labels fail with ErrUnsigned, even if AllowUnsigned is set.
+func (v *Verifier) Verify(ctx context.Context, l *label.Label) error {
+	if len(l.Sig) == 0 {
+		return ErrUnsigned
+	}
+	if l.Src == "" {
+		return fmt.Errorf("label has no src")
+	}
+
+	ck, err := v.sourceKey(ctx, l.Src, false)
+	if err != nil {
+		return err
+	}
+
+	err = VerifyWithKey(l, ck.key)
+	if err == nil || time.Since(ck.fetched) < v.RefetchInterval {
+		return err
+	}
+
+	// the source may have rotated its key since it was cached
+	ck, err = v.sourceKey(ctx, l.Src, true)
+	if err != nil {
+		return err
+	}
+	return VerifyWithKey(l, ck.key)
+}
+
+// Filter returns the labels which verify, passing the others to OnInvalid.
+// Unsigned labels are kept if AllowUnsigned is set.
+func (v *Verifier) Filter(ctx context.Context, labels []*label.Label) []*label.Label {
+	out := make([]*label.Label, 0, len(labels))
+	for _, l := range labels {
+		err := v.Verify(ctx, l)
+		if err == nil || (errors.Is(err, ErrUnsigned) && v.AllowUnsigned) {
+			out = append(out, l)
+			continue
+		}
+
+		if v.OnInvalid != nil {
+			v.OnInvalid(l, err)
+		} else {
+			log.Warnw("dropping label failing verification", "src", l.Src, "uri", l.Uri, "val", l.Val, "err", err)
+		}
+	}
+	return out
+}
+
+// LabelsHandler wraps a subscribeLabels event handler (as used in
+// events.RepoStreamCallbacks), passing it only the labels which verify
+func (v *Verifier) LabelsHandler(next func(evt *label.SubscribeLabels_Labels) error) func(evt *label.SubscribeLabels_Labels) error {
+	return func(evt *label.SubscribeLabels_Labels) error {
+		filtered := *evt
+		filtered.Labels = v.Filter(context.Background(), evt.Labels)
+		return next(&filtered)
+	}
+}
+
+func (v *Verifier) sourceKey(ctx context.Context, src string, refetch bool) (*cachedKey, error) {
+	if !refetch {
+		if ck, ok := v.keys.Get(src); ok {
+			return ck.(*cachedKey), nil
+		}
+	}
+
+	v.fetchLk.Lock()
+	defer v.fetchLk.Unlock()
+
+	// another fetch may have finished while waiting
+	if ck, ok := v.keys.Get(src); ok && (!refetch || time.Since(ck.(*cachedKey).fetched) < v.RefetchInterval) {
+		return ck.(*cachedKey), nil
+	}
+
+	doc, err := v.Dir.GetDocument(ctx, src)
+	if err != nil {
+		return nil, fmt.Errorf("resolving label src %q: %w", src, err)
+	}
+
+	key, err := labelKey(doc, src)
+	if err != nil {
+		return nil, err
+	}
+
+	ck := &cachedKey{key: key, fetched: time.Now()}
+	v.keys.Add(src, ck)
+	return ck, nil
+}
+
+// labelKey returns the key labels from a DID are signed with
+func labelKey(doc *godid.Document, d string) (*godid.PubKey, error) {
+	for _, id := range []string{"#atproto_label", "#atproto"} {
+		if key, err := keyutil.DocumentKey(doc, d, id); err == nil {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("no label signing key for %s", d)
+}
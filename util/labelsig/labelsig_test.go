@@ -0,0 +1,173 @@
+package labelsig
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"testing"
+
+	label "github.com/bluesky-social/indigo/api/label"
+	"github.com/bluesky-social/indigo/util/signer"
+
+	"github.com/stretchr/testify/assert"
+	godid "github.com/whyrusleeping/go-did"
+)
+
+type testResolver struct {
+	docs    map[string]*godid.Document
+	fetches int
+}
+
+func (tr *testResolver) GetDocument(ctx context.Context, d string) (*godid.Document, error) {
+	tr.fetches++
+	doc, ok := tr.docs[d]
+	if !ok {
+		return nil, fmt.Errorf("no such did: %s", d)
+	}
+	return doc, nil
+}
+
+func testSource(t *testing.T, kt, keyID string) (*godid.PrivKey, *godid.Document) {
+	key, err := godid.GeneratePrivKey(rand.Reader, kt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm, err := godid.VerificationMethodFromKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.ID = keyID
+
+	return key, &godid.Document{
+		VerificationMethod: []godid.VerificationMethod{*vm},
+	}
+}
+
+func signedLabel(t *testing.T, key *godid.PrivKey, src string) *label.Label {
+	c := "bafyreib2rxk3rybk3aobmv5cjuql3bm2twh4jo5uxgf5ttbxtwwsdzsmxy"
+	l := &label.Label{
+		Src: src,
+		Uri: "at://did:plc:alice/app.bsky.feed.post/3jzfcijpj2z2a",
+		Cid: &c,
+		Val: "spam",
+		Cts: "2023-06-01T12:00:00.000Z",
+	}
+	if err := Sign(context.Background(), l, signer.NewKeySigner(key)); err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestSignVerify(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, kt := range []string{godid.KeyTypeP256, godid.KeyTypeSecp256k1} {
+		key, _ := testSource(t, kt, "#atproto")
+		l := signedLabel(t, key, "did:plc:labeler")
+		assert.NotEmpty(l.Sig)
+		assert.NoError(VerifyWithKey(l, key.Public()))
+
+		tampered := *l
+		tampered.Neg = true
+		assert.ErrorIs(VerifyWithKey(&tampered, key.Public()), ErrInvalidSignature)
+
+		other, _ := testSource(t, kt, "#atproto")
+		assert.ErrorIs(VerifyWithKey(l, other.Public()), ErrInvalidSignature)
+
+		unsigned := *l
+		unsigned.Sig = nil
+		assert.ErrorIs(VerifyWithKey(&unsigned, key.Public()), ErrUnsigned)
+	}
+}
+
+func TestVerifier(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	labelerKey, labelerDoc := testSource(t, godid.KeyTypeP256, "#atproto_label")
+	repoKey, repoDoc := testSource(t, godid.KeyTypeSecp256k1, "did:plc:labelmaker#atproto")
+	dir := &testResolver{docs: map[string]*godid.Document{
+		"did:plc:labeler":    labelerDoc,
+		"did:plc:labelmaker": repoDoc,
+	}}
+
+	v, err := NewVerifier(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(v.Verify(ctx, signedLabel(t, labelerKey, "did:plc:labeler")))
+	assert.NoError(v.Verify(ctx, signedLabel(t, labelerKey, "did:plc:labeler")))
+	assert.NoError(v.Verify(ctx, signedLabel(t, repoKey, "did:plc:labelmaker")))
+	assert.Equal(2, dir.fetches, "keys should be cached")
+
+	// signed with another source's key
+	assert.ErrorIs(v.Verify(ctx, signedLabel(t, repoKey, "did:plc:labeler")), ErrInvalidSignature)
+	assert.Error(v.Verify(ctx, signedLabel(t, repoKey, "did:plc:unknown")))
+
+	var invalid []*label.Label
+	v.OnInvalid = func(l *label.Label, err error) {
+		invalid = append(invalid, l)
+	}
+	good := signedLabel(t, labelerKey, "did:plc:labeler")
+	bad := signedLabel(t, repoKey, "did:plc:labeler")
+	unsigned := &label.Label{Src: "did:plc:labeler", Uri: "at://did:plc:alice", Val: "spam"}
+
+	assert.Equal([]*label.Label{good}, v.Filter(ctx, []*label.Label{good, bad, unsigned}))
+	assert.Equal([]*label.Label{bad, unsigned}, invalid)
+
+	invalid = nil
+	v.AllowUnsigned = true
+	assert.Equal([]*label.Label{good, unsigned}, v.Filter(ctx, []*label.Label{good, bad, unsigned}))
+	assert.Equal([]*label.Label{bad}, invalid)
+}
+
+func TestVerifierKeyRotation(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	oldKey, oldDoc := testSource(t, godid.KeyTypeP256, "#atproto")
+	dir := &testResolver{docs: map[string]*godid.Document{"did:plc:labeler": oldDoc}}
+	v, err := NewVerifier(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(v.Verify(ctx, signedLabel(t, oldKey, "did:plc:labeler")))
+
+	newKey, newDoc := testSource(t, godid.KeyTypeP256, "#atproto")
+	dir.docs["did:plc:labeler"] = newDoc
+
+	// the cached key was fetched too recently to refetch
+	l := signedLabel(t, newKey, "did:plc:labeler")
+	assert.ErrorIs(v.Verify(ctx, l), ErrInvalidSignature)
+	assert.Equal(1, dir.fetches)
+
+	v.RefetchInterval = 0
+	assert.NoError(v.Verify(ctx, l))
+	assert.Equal(2, dir.fetches)
+}
+
+func TestLabelsHandler(t *testing.T) {
+	key, doc := testSource(t, godid.KeyTypeP256, "#atproto")
+	v, err := NewVerifier(&testResolver{docs: map[string]*godid.Document{"did:plc:labeler": doc}}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.OnInvalid = func(l *label.Label, err error) {}
+
+	good := signedLabel(t, key, "did:plc:labeler")
+	bad := *good
+	bad.Val = "other"
+
+	var got []*label.Label
+	h := v.LabelsHandler(func(evt *label.SubscribeLabels_Labels) error {
+		assert.Equal(t, int64(7), evt.Seq)
+		got = evt.Labels
+		return nil
+	})
+	if err := h(&label.SubscribeLabels_Labels{Seq: 7, Labels: []*label.Label{good, &bad}}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []*label.Label{good}, got)
+}
@@ -0,0 +1,64 @@
+package logutil
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Middleware attaches the nsid of XRPC requests to their context, for
+// anything logged while handling them
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if nsid, ok := strings.CutPrefix(r.URL.Path, "/xrpc/"); ok && nsid != "" {
+			r = r.WithContext(WithFields(r.Context(), "nsid", nsid))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// LevelsHandler serves the log levels of every subsystem on GET, and changes
+// them on POST, either from subsystem and level query parameters or from a
+// JSON object of subsystem to level. An empty level resets a subsystem to the
+// default. It should only be mounted behind admin auth.
+func LevelsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			changes := make(map[string]string)
+			if sub := r.URL.Query().Get("subsystem"); sub != "" {
+				changes[sub] = r.URL.Query().Get("level")
+			} else if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&changes); err != nil {
+				http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			// check everything before changing anything
+			for sub, lvl := range changes {
+				if lvl == "" && sub != "*" {
+					continue
+				}
+				if _, err := ParseLevel(lvl); err != nil {
+					http.Error(w, "invalid level for "+sub+": "+err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+
+			for sub, lvl := range changes {
+				if lvl == "" {
+					ResetLevel(sub)
+					continue
+				}
+				l, _ := ParseLevel(lvl)
+				SetLevel(sub, l)
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Levels())
+	})
+}
@@ -0,0 +1,259 @@
+// Package logutil is the shared structured logging setup. Each subsystem gets
+// its own logger, whose level can be changed while the service runs, and
+// fields such as the did, seq or nsid being worked on can be attached to a
+// context to show up on everything logged with it.
+//
+// Levels set here are applied to the go-log loggers of the same name too, so
+// that both kinds of logging in a service can be controlled in one place.
+package logutil
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	golog "github.com/ipfs/go-log/v2"
+	"golang.org/x/exp/slog"
+)
+
+var (
+	base atomic.Value
+
+	lk           sync.RWMutex
+	defaultLevel = slog.LevelInfo
+	levels       = make(map[string]slog.Level)
+	known        = make(map[string]bool)
+)
+
+type handlerBox struct {
+	h slog.Handler
+}
+
+func init() {
+	base.Store(handlerBox{slog.NewTextHandler(os.Stderr)})
+}
+
+// SetHandler sets where every subsystem logger writes to. Level filtering is
+// done before records reach h, so h should accept everything.
+func SetHandler(h slog.Handler) {
+	base.Store(handlerBox{h})
+}
+
+// Logger returns the logger for a subsystem. Loggers can be created before
+// SetHandler is called, such as in package variables.
+func Logger(subsystem string) *slog.Logger {
+	lk.Lock()
+	known[subsystem] = true
+	lk.Unlock()
+
+	return slog.New(&handler{subsystem: subsystem})
+}
+
+// Level returns the level a subsystem logs at
+func Level(subsystem string) slog.Level {
+	lk.RLock()
+	defer lk.RUnlock()
+
+	if l, ok := levels[subsystem]; ok {
+		return l
+	}
+	return defaultLevel
+}
+
+// SetLevel sets the level of one subsystem, or of every subsystem without its
+// own level if subsystem is "*"
+func SetLevel(subsystem string, level slog.Level) {
+	lk.Lock()
+	own := make(map[string]bool, len(levels))
+	if subsystem == "*" {
+		defaultLevel = level
+		for s := range levels {
+			own[s] = true
+		}
+	} else {
+		levels[subsystem] = level
+	}
+	lk.Unlock()
+
+	gl := gologLevel(level)
+	if subsystem == "*" {
+		for _, s := range golog.GetSubsystems() {
+			if !own[s] {
+				_ = golog.SetLogLevel(s, gl)
+			}
+		}
+		return
+	}
+
+	// most subsystems only exist in one of the two
+	_ = golog.SetLogLevel(subsystem, gl)
+}
+
+// ResetLevel drops a subsystem's own level, returning it to the default
+func ResetLevel(subsystem string) {
+	lk.Lock()
+	delete(levels, subsystem)
+	def := defaultLevel
+	lk.Unlock()
+
+	_ = golog.SetLogLevel(subsystem, gologLevel(def))
+}
+
+// Levels returns the level of every known subsystem, with the default under
+// "*"
+func Levels() map[string]string {
+	out := map[string]string{"*": Level("*").String()}
+
+	lk.RLock()
+	subs := make([]string, 0, len(known))
+	for s := range known {
+		subs = append(subs, s)
+	}
+	for s := range levels {
+		subs = append(subs, s)
+	}
+	lk.RUnlock()
+
+	subs = append(subs, golog.GetSubsystems()...)
+	sort.Strings(subs)
+	for _, s := range subs {
+		out[s] = Level(s).String()
+	}
+
+	return out
+}
+
+// ParseLevel parses debug, info, warn or error, in any case
+func ParseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(s))
+	return l, err
+}
+
+func gologLevel(l slog.Level) string {
+	switch {
+	case l < slog.LevelInfo:
+		return "debug"
+	case l < slog.LevelWarn:
+		return "info"
+	case l < slog.LevelError:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+type fieldsKey struct{}
+
+// WithFields returns a context carrying key/value pairs (as for
+// slog.Logger.With) that are added to every record logged with it
+func WithFields(ctx context.Context, args ...any) context.Context {
+	if len(args) == 0 {
+		return ctx
+	}
+
+	var r slog.Record
+	r.Add(args...)
+
+	attrs := append([]slog.Attr{}, Fields(ctx)...)
+	r.Attrs(func(a slog.Attr) {
+		attrs = append(attrs, a)
+	})
+
+	return context.WithValue(ctx, fieldsKey{}, attrs)
+}
+
+// Fields returns the fields attached to ctx by WithFields
+func Fields(ctx context.Context) []slog.Attr {
+	if ctx == nil {
+		return nil
+	}
+	attrs, _ := ctx.Value(fieldsKey{}).([]slog.Attr)
+	return attrs
+}
+
+// handler filters records by the level of its subsystem, and passes them on
+// to the current base handler with the subsystem and context fields added
+type handler struct {
+	subsystem string
+
+	// WithAttrs and WithGroup calls, replayed on the base handler
+	ops []func(slog.Handler) slog.Handler
+}
+
+func (h *handler) Enabled(ctx context.Context, l slog.Level) bool {
+	return l >= Level(h.subsystem)
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	bh := base.Load().(handlerBox).h.WithAttrs([]slog.Attr{slog.String("subsystem", h.subsystem)})
+	for _, op := range h.ops {
+		bh = op(bh)
+	}
+
+	if fields := Fields(ctx); len(fields) > 0 {
+		r = r.Clone()
+		r.AddAttrs(fields...)
+	}
+
+	return bh.Handle(ctx, r)
+}
+
+func (h *handler) with(op func(slog.Handler) slog.Handler) *handler {
+	ops := make([]func(slog.Handler) slog.Handler, len(h.ops), len(h.ops)+1)
+	copy(ops, h.ops)
+	return &handler{subsystem: h.subsystem, ops: append(ops, op)}
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(bh slog.Handler) slog.Handler { return bh.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.with(func(bh slog.Handler) slog.Handler { return bh.WithGroup(name) })
+}
+
+// parseLevelSpec parses a comma separated list of subsystem=level pairs
+func parseLevelSpec(spec string) (map[string]slog.Level, error) {
+	out := make(map[string]slog.Level)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		sub, lvl, ok := strings.Cut(part, "=")
+		if !ok {
+			sub, lvl = "*", part
+		}
+
+		l, err := ParseLevel(lvl)
+		if err != nil {
+			return nil, err
+		}
+		out[strings.TrimSpace(sub)] = l
+	}
+	return out, nil
+}
+
+// SetLevels applies a comma separated list of subsystem=level pairs, where a
+// bare level sets the default, eg "info,bgs=debug,events=warn"
+func SetLevels(spec string) error {
+	parsed, err := parseLevelSpec(spec)
+	if err != nil {
+		return err
+	}
+
+	if l, ok := parsed["*"]; ok {
+		SetLevel("*", l)
+	}
+	for s, l := range parsed {
+		if s != "*" {
+			SetLevel(s, l)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package logutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/exp/slog"
+)
+
+func captureJSON(t *testing.T) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	SetHandler(slog.HandlerOptions{Level: slog.LevelDebug}.NewJSONHandler(buf))
+	t.Cleanup(func() {
+		ResetLevel("logutil-test")
+		SetLevel("*", slog.LevelInfo)
+	})
+	return buf
+}
+
+func TestSubsystemLevels(t *testing.T) {
+	buf := captureJSON(t)
+	l := Logger("logutil-test")
+
+	l.Debug("hidden")
+	if buf.Len() != 0 {
+		t.Fatalf("debug should be filtered at the default level: %s", buf)
+	}
+
+	if err := SetLevels("warn,logutil-test=debug"); err != nil {
+		t.Fatal(err)
+	}
+	l.Debug("shown")
+	if !strings.Contains(buf.String(), "shown") {
+		t.Fatalf("expected debug record after override: %s", buf)
+	}
+
+	ResetLevel("logutil-test")
+	buf.Reset()
+	l.Info("hidden")
+	if buf.Len() != 0 {
+		t.Fatalf("info should be filtered at the warn default: %s", buf)
+	}
+
+	if err := SetLevels("bgs=loud"); err == nil {
+		t.Fatal("expected invalid level to fail")
+	}
+}
+
+func TestContextFields(t *testing.T) {
+	buf := captureJSON(t)
+	l := Logger("logutil-test").With("component", "x")
+
+	ctx := WithFields(context.Background(), "did", "did:plc:abc", "seq", 7)
+	ctx = WithFields(ctx, "nsid", "app.bsky.feed.post")
+	l.InfoCtx(ctx, "hello")
+
+	var rec map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]any{
+		"msg":       "hello",
+		"subsystem": "logutil-test",
+		"component": "x",
+		"did":       "did:plc:abc",
+		"seq":       float64(7),
+		"nsid":      "app.bsky.feed.post",
+	}
+	for k, v := range expect {
+		if rec[k] != v {
+			t.Errorf("expected %s=%v, got %v", k, v, rec[k])
+		}
+	}
+}
+
+func TestLevelsHandler(t *testing.T) {
+	captureJSON(t)
+	Logger("logutil-test")
+	h := LevelsHandler()
+
+	req := httptest.NewRequest("POST", "/admin/log/setLevels?subsystem=logutil-test&level=error", nil)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rr.Code, rr.Body)
+	}
+	if Level("logutil-test") != slog.LevelError {
+		t.Fatalf("level not changed: %s", Level("logutil-test"))
+	}
+
+	req = httptest.NewRequest("POST", "/admin/log/setLevels", strings.NewReader(`{"logutil-test":"nope"}`))
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected bad request, got %d", rr.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/admin/log/setLevels", strings.NewReader(`{"logutil-test":""}`))
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	var out map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out["logutil-test"] != "INFO" {
+		t.Fatalf("expected level reset to the default, got %v", out)
+	}
+}
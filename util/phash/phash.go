@@ -0,0 +1,201 @@
+// Package phash computes perceptual hashes of images, in the style of PDQ:
+// images which look the same have hashes which only differ in a few bits,
+// even after being resized, recompressed or slightly edited, so that known
+// images can be recognized without comparing their bytes.
+//
+// The image is reduced to a 64x64 grid of luminance, of which the lowest
+// 16x16 frequencies of the discrete cosine transform are kept. Each bit of
+// the 256 bit hash is whether a frequency is above the median of all of them.
+//
+// Hashes are only comparable with hashes computed by this package.
+package phash
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"math/bits"
+	"sort"
+
+	// image formats which can be decoded
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+const (
+	// Bits is the length of hashes, in bits
+	Bits = 256
+
+	// MaxPixels is the largest image, in pixels, Decode will decode, as
+	// decoded images take several bytes per pixel in memory
+	MaxPixels = 40_000_000
+
+	gridSize = 64
+	dctSize  = 16
+)
+
+// ErrTooLarge is returned by Decode for images of more than MaxPixels
+var ErrTooLarge = fmt.Errorf("image is larger than %d pixels", MaxPixels)
+
+// Hash is a perceptual hash of an image
+type Hash [Bits / 8]byte
+
+// Parse parses a hash written as hex, as returned by Hash.String
+func Parse(s string) (Hash, error) {
+	var h Hash
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return h, fmt.Errorf("invalid hash %q: %w", s, err)
+	}
+	if len(b) != len(h) {
+		return h, fmt.Errorf("invalid hash %q: expected %d bytes, got %d", s, len(h), len(b))
+	}
+	copy(h[:], b)
+	return h, nil
+}
+
+func (h Hash) String() string {
+	return hex.EncodeToString(h[:])
+}
+
+// Distance returns the number of bits h and o differ in. Hashes of the same
+// image are usually within 30 or so bits of each other, and hashes of
+// unrelated images around Bits/2.
+func (h Hash) Distance(o Hash) int {
+	d := 0
+	for i := range h {
+		d += bits.OnesCount8(h[i] ^ o[i])
+	}
+	return d
+}
+
+// Decode decodes a GIF, JPEG or PNG image and returns its hash. Images of
+// more than MaxPixels are refused with ErrTooLarge, going by their headers,
+// before they are decoded.
+func Decode(r io.Reader) (Hash, error) {
+	// the header is read again by image.Decode
+	head := new(bytes.Buffer)
+	cfg, _, err := image.DecodeConfig(io.TeeReader(r, head))
+	if err != nil {
+		return Hash{}, fmt.Errorf("decoding image: %w", err)
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > MaxPixels {
+		return Hash{}, fmt.Errorf("%dx%d: %w", cfg.Width, cfg.Height, ErrTooLarge)
+	}
+
+	img, _, err := image.Decode(io.MultiReader(head, r))
+	if err != nil {
+		return Hash{}, fmt.Errorf("decoding image: %w", err)
+	}
+	return FromImage(img), nil
+}
+
+// dctMatrix holds the cosines of the lowest dctSize frequencies, at each of
+// the gridSize points
+var dctMatrix = func() [dctSize][gridSize]float64 {
+	var m [dctSize][gridSize]float64
+	for i := 0; i < dctSize; i++ {
+		for k := 0; k < gridSize; k++ {
+			m[i][k] = math.Cos(math.Pi / (2 * gridSize) * float64(i) * float64(2*k+1))
+		}
+	}
+	return m
+}()
+
+// FromImage returns the hash of an image
+func FromImage(img image.Image) Hash {
+	grid := luminanceGrid(img)
+
+	// the transform is separable: first along the rows, then the columns
+	var rows [gridSize][dctSize]float64
+	for y := 0; y < gridSize; y++ {
+		for i := 0; i < dctSize; i++ {
+			var sum float64
+			for x := 0; x < gridSize; x++ {
+				sum += dctMatrix[i][x] * grid[y][x]
+			}
+			rows[y][i] = sum
+		}
+	}
+
+	var coefs [dctSize * dctSize]float64
+	for j := 0; j < dctSize; j++ {
+		for i := 0; i < dctSize; i++ {
+			var sum float64
+			for y := 0; y < gridSize; y++ {
+				sum += dctMatrix[j][y] * rows[y][i]
+			}
+			coefs[j*dctSize+i] = sum
+		}
+	}
+
+	sorted := coefs
+	sort.Float64s(sorted[:])
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+
+	var h Hash
+	for k, c := range coefs {
+		if c > median {
+			h[k/8] |= 1 << (k % 8)
+		}
+	}
+	return h
+}
+
+// luminanceGrid scales img to gridSize by gridSize, averaging the luminance
+// of the pixels (and parts of pixels) in each cell
+func luminanceGrid(img image.Image) [gridSize][gridSize]float64 {
+	var grid [gridSize][gridSize]float64
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w == 0 || h == 0 {
+		return grid
+	}
+
+	// scale the rows first, then the columns
+	rows := make([][gridSize]float64, h)
+	line := make([]float64, w)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			line[x] = 0.299*float64(r>>8) + 0.587*float64(g>>8) + 0.114*float64(b>>8)
+		}
+		rows[y] = scale(line)
+	}
+
+	col := make([]float64, h)
+	for x := 0; x < gridSize; x++ {
+		for y := 0; y < h; y++ {
+			col[y] = rows[y][x]
+		}
+		scaled := scale(col)
+		for y := 0; y < gridSize; y++ {
+			grid[y][x] = scaled[y]
+		}
+	}
+	return grid
+}
+
+// scale resamples vals to gridSize values, each the average of the span of
+// vals it covers
+func scale(vals []float64) [gridSize]float64 {
+	var out [gridSize]float64
+	n := float64(len(vals))
+	step := n / gridSize
+	for i := range out {
+		lo, hi := float64(i)*step, float64(i+1)*step
+		var sum float64
+		for k := int(lo); k < len(vals) && float64(k) < hi; k++ {
+			// the part of value k within [lo, hi)
+			cover := math.Min(hi, float64(k+1)) - math.Max(lo, float64(k))
+			sum += cover * vals[k]
+		}
+		out[i] = sum / step
+	}
+	return out
+}
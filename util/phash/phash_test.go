@@ -0,0 +1,117 @@
+package phash
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// testImage draws a pattern of shapes, which differs with seed, scaled to w
+// by h pixels
+func testImage(w, h int, seed int64) image.Image {
+	rnd := rand.New(rand.NewSource(seed))
+	type disc struct {
+		x, y, r float64
+		c       color.RGBA
+	}
+	discs := make([]disc, 40)
+	for i := range discs {
+		discs[i] = disc{
+			x: rnd.Float64(),
+			y: rnd.Float64(),
+			r: 0.05 + rnd.Float64()*0.2,
+			c: color.RGBA{R: uint8(rnd.Intn(256)), G: uint8(rnd.Intn(256)), B: uint8(rnd.Intn(256)), A: 255},
+		}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			fx, fy := (float64(x)+0.5)/float64(w), (float64(y)+0.5)/float64(h)
+			c := color.RGBA{A: 255}
+			for _, d := range discs {
+				if math.Hypot(fx-d.x, fy-d.y) < d.r {
+					c = d.c
+				}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestParse(t *testing.T) {
+	h := FromImage(testImage(100, 100, 1))
+	p, err := Parse(h.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != h {
+		t.Fatal("parsed hash differs from the original")
+	}
+
+	if _, err := Parse("abcd"); err == nil {
+		t.Fatal("expected an error parsing a short hash")
+	}
+	if _, err := Parse("zz"); err == nil {
+		t.Fatal("expected an error parsing an invalid hash")
+	}
+}
+
+func TestSimilarImages(t *testing.T) {
+	orig := FromImage(testImage(640, 480, 1))
+
+	// resized
+	if d := orig.Distance(FromImage(testImage(200, 150, 1))); d > 20 {
+		t.Fatalf("resized image too far from the original: %d", d)
+	}
+
+	// recompressed
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, testImage(640, 480, 1), &jpeg.Options{Quality: 30}); err != nil {
+		t.Fatal(err)
+	}
+	recompressed, err := Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := orig.Distance(recompressed); d > 20 {
+		t.Fatalf("recompressed image too far from the original: %d", d)
+	}
+
+	// some other image
+	if d := orig.Distance(FromImage(testImage(640, 480, 3))); d < 60 {
+		t.Fatalf("different image too close to the original: %d", d)
+	}
+}
+
+func TestDistance(t *testing.T) {
+	var a, b Hash
+	if a.Distance(b) != 0 {
+		t.Fatal("expected no distance between equal hashes")
+	}
+	b[0] = 0x0f
+	b[31] = 0x80
+	if d := a.Distance(b); d != 5 {
+		t.Fatalf("expected a distance of 5, got %d", d)
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	if _, err := Decode(bytes.NewReader([]byte("not an image"))); err == nil {
+		t.Fatal("expected an error decoding something which is not an image")
+	}
+}
+
+func TestDecodeTooLarge(t *testing.T) {
+	// a GIF header claiming 60000x60000 pixels, with none of them after it
+	hdr := []byte("GIF89a\x60\xea\x60\xea\x00\x00\x00")
+	if _, err := Decode(bytes.NewReader(hdr)); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("expected image to be refused as too large, got %v", err)
+	}
+}
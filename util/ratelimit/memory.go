@@ -0,0 +1,62 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+type bucket struct {
+	lk     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// MemoryStore keeps rate limit buckets in process memory. It is only suitable
+// for single-instance deployments; use RedisStore when running several
+// instances behind a load balancer.
+type MemoryStore struct {
+	lk      sync.Mutex
+	buckets *lru.Cache
+}
+
+// NewMemoryStore creates a store which tracks up to size buckets, evicting the
+// least recently used bucket once full.
+func NewMemoryStore(size int) (*MemoryStore, error) {
+	c, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MemoryStore{buckets: c}, nil
+}
+
+func (ms *MemoryStore) getBucket(key string) *bucket {
+	ms.lk.Lock()
+	defer ms.lk.Unlock()
+
+	v, ok := ms.buckets.Get(key)
+	if ok {
+		return v.(*bucket)
+	}
+
+	b := &bucket{}
+	ms.buckets.Add(key, b)
+	return b
+}
+
+func (ms *MemoryStore) Take(ctx context.Context, key string, lim Limit) (*Result, error) {
+	b := ms.getBucket(key)
+
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	now := time.Now()
+	tokens, res := takeToken(b.tokens, b.last, now, lim)
+	b.tokens = tokens
+	b.last = now
+
+	return res, nil
+}
@@ -0,0 +1,107 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"time"
+
+	logging "github.com/ipfs/go-log"
+	"github.com/labstack/echo/v4"
+)
+
+var log = logging.Logger("ratelimit")
+
+// Config configures the rate limiting middleware
+type Config struct {
+	Store Store
+
+	// Limits maps echo route paths (eg "/xrpc/com.atproto.server.createSession")
+	// to the limit applied to that route. Routes without an entry are not
+	// limited.
+	Limits map[string]Limit
+
+	// KeyFunc returns the identity a request is counted against, typically
+	// the authenticated account or the client IP. Defaults to the client IP.
+	KeyFunc func(c echo.Context) string
+}
+
+// IPKey counts requests against the IP address of the client, as found by
+// the echo instance's IPExtractor (see IPExtractor)
+func IPKey(c echo.Context) string {
+	return c.RealIP()
+}
+
+// IPExtractor returns how a service finds the IP addresses of its clients.
+// Without trusted proxies, it is the address of the connection, as echo's
+// default of believing X-Forwarded-For and X-Real-IP lets clients set their
+// IP to anything, and so get around per-IP limits. With trusted proxies,
+// given as CIDR ranges, X-Forwarded-For is followed back through proxies in
+// those ranges.
+func IPExtractor(trustedProxies []string) (echo.IPExtractor, error) {
+	if len(trustedProxies) == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
+
+	opts := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, p := range trustedProxies {
+		_, ipnet, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy range %q: %w", p, err)
+		}
+		opts = append(opts, echo.TrustIPRange(ipnet))
+	}
+	return echo.ExtractIPFromXFFHeader(opts...), nil
+}
+
+// Middleware returns an echo middleware enforcing the configured limits. Each
+// limited response carries RateLimit-* headers describing the state of the
+// bucket, and requests over the limit are rejected with a 429.
+func Middleware(cfg Config) echo.MiddlewareFunc {
+	keyf := cfg.KeyFunc
+	if keyf == nil {
+		keyf = IPKey
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			lim, ok := cfg.Limits[c.Path()]
+			if !ok {
+				return next(c)
+			}
+
+			key := c.Path() + ":" + keyf(c)
+			res, err := cfg.Store.Take(c.Request().Context(), key, lim)
+			if err != nil {
+				// fail open, a broken limiter shouldnt take the service down
+				log.Errorw("failed to check rate limit", "path", c.Path(), "err", err)
+				return next(c)
+			}
+
+			h := c.Response().Header()
+			h.Set("RateLimit-Limit", strconv.Itoa(lim.Count))
+			h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+			h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", lim.Count, ceilSeconds(lim.Period)))
+
+			if !res.Allowed {
+				h.Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+				return c.JSON(429, map[string]string{
+					"error":   "RateLimitExceeded",
+					"message": fmt.Sprintf("rate limit of %s exceeded", lim),
+				})
+			}
+
+			return next(c)
+		}
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,139 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limit describes a token bucket which holds up to Count tokens, and is
+// refilled at a rate of Count tokens every Period.
+type Limit struct {
+	Count  int
+	Period time.Duration
+}
+
+// ParseLimit parses a limit of the form "count/period", eg "30/5m"
+func ParseLimit(s string) (Limit, error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return Limit{}, fmt.Errorf("invalid rate limit %q, expected count/period", s)
+	}
+
+	count, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return Limit{}, fmt.Errorf("invalid rate limit count %q: %w", parts[0], err)
+	}
+
+	period, err := time.ParseDuration(parts[1])
+	if err != nil {
+		return Limit{}, fmt.Errorf("invalid rate limit period %q: %w", parts[1], err)
+	}
+
+	if count <= 0 || period <= 0 {
+		return Limit{}, fmt.Errorf("invalid rate limit %q, count and period must be positive", s)
+	}
+
+	return Limit{Count: count, Period: period}, nil
+}
+
+func (l Limit) String() string {
+	return fmt.Sprintf("%d/%s", l.Count, l.Period)
+}
+
+// refillInterval is how long it takes for a single token to be added back to
+// the bucket
+func (l Limit) refillInterval() time.Duration {
+	return l.Period / time.Duration(l.Count)
+}
+
+// Result is the outcome of attempting to take a token from a bucket
+type Result struct {
+	Allowed   bool
+	Remaining int
+
+	// Reset is how long until the bucket is completely full again
+	Reset time.Duration
+
+	// RetryAfter is how long until a token will be available, only set when
+	// the request was not allowed
+	RetryAfter time.Duration
+}
+
+// Store holds the state of rate limit buckets. Implementations must be safe
+// for concurrent use.
+type Store interface {
+	Take(ctx context.Context, key string, lim Limit) (*Result, error)
+}
+
+// takeToken applies the token bucket algorithm to a bucket that had the given
+// number of tokens at last, returning the new token count and outcome.
+func takeToken(tokens float64, last, now time.Time, lim Limit) (float64, *Result) {
+	if !last.IsZero() {
+		elapsed := now.Sub(last)
+		tokens += float64(elapsed) / float64(lim.refillInterval())
+	} else {
+		tokens = float64(lim.Count)
+	}
+
+	if tokens > float64(lim.Count) {
+		tokens = float64(lim.Count)
+	}
+
+	res := &Result{}
+	if tokens >= 1 {
+		tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = time.Duration((1 - tokens) * float64(lim.refillInterval()))
+	}
+
+	res.Remaining = int(tokens)
+	res.Reset = time.Duration((float64(lim.Count) - tokens) * float64(lim.refillInterval()))
+
+	return tokens, res
+}
+
+// ApplyOverrides returns a copy of base with the given overrides applied. Each
+// override is of the form "nsid=count/period", eg
+// "com.atproto.server.createSession=30/5m". A count of "off" removes the
+// limit for that method.
+func ApplyOverrides(base map[string]Limit, overrides []string) (map[string]Limit, error) {
+	out := make(map[string]Limit)
+	for k, v := range base {
+		out[k] = v
+	}
+
+	for _, o := range overrides {
+		parts := strings.SplitN(o, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid rate limit override %q, expected nsid=count/period", o)
+		}
+
+		path := "/xrpc/" + parts[0]
+		if parts[1] == "off" {
+			delete(out, path)
+			continue
+		}
+
+		lim, err := ParseLimit(parts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		out[path] = lim
+	}
+
+	return out, nil
+}
+
+// NewStore returns a RedisStore if redisURL is set, otherwise a MemoryStore
+func NewStore(redisURL string, prefix string) (Store, error) {
+	if redisURL != "" {
+		return NewRedisStore(redisURL, prefix)
+	}
+
+	return NewMemoryStore(100_000)
+}
@@ -0,0 +1,160 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestParseLimit(t *testing.T) {
+	lim, err := ParseLimit("30/5m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lim.Count != 30 || lim.Period != 5*time.Minute {
+		t.Fatalf("parsed wrong limit: %s", lim)
+	}
+
+	for _, bad := range []string{"", "30", "x/5m", "30/x", "0/5m", "-1/5m"} {
+		if _, err := ParseLimit(bad); err == nil {
+			t.Fatalf("expected error parsing %q", bad)
+		}
+	}
+}
+
+func TestTakeToken(t *testing.T) {
+	lim := Limit{Count: 2, Period: 2 * time.Second}
+	now := time.Now()
+
+	tokens, res := takeToken(0, time.Time{}, now, lim)
+	if !res.Allowed || res.Remaining != 1 {
+		t.Fatalf("first take: %+v", res)
+	}
+
+	tokens, res = takeToken(tokens, now, now, lim)
+	if !res.Allowed || res.Remaining != 0 {
+		t.Fatalf("second take: %+v", res)
+	}
+
+	tokens, res = takeToken(tokens, now, now, lim)
+	if res.Allowed {
+		t.Fatal("expected bucket to be empty")
+	}
+	if res.RetryAfter != time.Second {
+		t.Fatalf("expected retry after 1s, got %s", res.RetryAfter)
+	}
+
+	_, res = takeToken(tokens, now, now.Add(time.Second), lim)
+	if !res.Allowed {
+		t.Fatal("expected bucket to have refilled a token")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	ms, err := NewMemoryStore(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.Use(Middleware(Config{
+		Store: ms,
+		Limits: map[string]Limit{
+			"/limited": {Count: 1, Period: time.Hour},
+		},
+	}))
+	e.GET("/limited", func(c echo.Context) error { return c.String(200, "ok") })
+	e.GET("/open", func(c echo.Context) error { return c.String(200, "ok") })
+
+	do := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do("/limited"); rec.Code != 200 || rec.Header().Get("RateLimit-Remaining") != "0" {
+		t.Fatalf("first request: %d %v", rec.Code, rec.Header())
+	}
+
+	rec := do("/limited")
+	if rec.Code != 429 {
+		t.Fatalf("expected 429, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Fatal("expected Retry-After header")
+	}
+
+	for i := 0; i < 3; i++ {
+		if rec := do("/open"); rec.Code != 200 {
+			t.Fatalf("unlimited route was limited: %d", rec.Code)
+		}
+	}
+}
+
+func TestIPExtractor(t *testing.T) {
+	req := func(remote, xff string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remote + ":1234"
+		r.Header.Set("X-Forwarded-For", xff)
+		r.Header.Set("X-Real-IP", xff)
+		return r
+	}
+
+	// by default forwarding headers are ignored, even from local addresses
+	direct, err := IPExtractor(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, remote := range []string{"203.0.113.7", "127.0.0.1", "10.0.0.2"} {
+		if ip := direct(req(remote, "198.51.100.1")); ip != remote {
+			t.Errorf("expected %s, got %s", remote, ip)
+		}
+	}
+
+	proxied, err := IPExtractor([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := proxied(req("10.0.0.2", "198.51.100.1")); ip != "198.51.100.1" {
+		t.Errorf("expected the forwarded IP from a trusted proxy, got %s", ip)
+	}
+	if ip := proxied(req("203.0.113.7", "198.51.100.1")); ip != "203.0.113.7" {
+		t.Errorf("expected forwarding headers from others to be ignored, got %s", ip)
+	}
+	if ip := proxied(req("127.0.0.1", "198.51.100.1")); ip != "127.0.0.1" {
+		t.Errorf("expected only the configured ranges to be trusted, got %s", ip)
+	}
+
+	if _, err := IPExtractor([]string{"10.0.0.2"}); err == nil {
+		t.Error("expected an error for a proxy which isn't a CIDR range")
+	}
+}
+
+func TestApplyOverrides(t *testing.T) {
+	base := map[string]Limit{
+		"/xrpc/a.b.c": {Count: 1, Period: time.Second},
+		"/xrpc/d.e.f": {Count: 2, Period: time.Second},
+	}
+
+	out, err := ApplyOverrides(base, []string{"a.b.c=off", "d.e.f=5/1m", "g.h.i=10/1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := out["/xrpc/a.b.c"]; ok {
+		t.Fatal("expected limit to be removed")
+	}
+	if out["/xrpc/d.e.f"] != (Limit{Count: 5, Period: time.Minute}) {
+		t.Fatalf("override not applied: %s", out["/xrpc/d.e.f"])
+	}
+	if out["/xrpc/g.h.i"] != (Limit{Count: 10, Period: time.Hour}) {
+		t.Fatalf("new limit not added: %s", out["/xrpc/g.h.i"])
+	}
+	if len(base) != 2 || base["/xrpc/d.e.f"].Count != 2 {
+		t.Fatal("base limits were modified")
+	}
+}
@@ -0,0 +1,109 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// takeScript atomically refills and takes a token from the bucket stored in
+// KEYS[1]. It mirrors takeToken so that both stores behave identically.
+//
+// ARGV: count, refill interval (us), now (us), ttl (ms)
+var takeScript = redis.NewScript(`
+local count = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local state = redis.call("HMGET", KEYS[1], "tokens", "last")
+local tokens = count
+if state[1] and state[2] then
+	tokens = tonumber(state[1]) + (now - tonumber(state[2])) / interval
+	if tokens > count then
+		tokens = count
+	end
+end
+
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "last", tostring(now))
+redis.call("PEXPIRE", KEYS[1], ARGV[4])
+
+return {allowed, tostring(tokens)}
+`)
+
+// RedisStore keeps rate limit buckets in redis so that limits are shared
+// between all instances of a service.
+type RedisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisStore connects to the redis server at the given URL (eg
+// redis://localhost:6379/0). All bucket keys are prefixed with prefix.
+func NewRedisStore(redisURL string, prefix string) (*RedisStore, error) {
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing redis url: %w", err)
+	}
+
+	return &RedisStore{
+		client: redis.NewClient(opts),
+		prefix: prefix,
+	}, nil
+}
+
+func (rs *RedisStore) Take(ctx context.Context, key string, lim Limit) (*Result, error) {
+	interval := lim.refillInterval()
+
+	vals, err := takeScript.Run(ctx, rs.client, []string{rs.prefix + key},
+		lim.Count,
+		interval.Microseconds(),
+		time.Now().UnixMicro(),
+		lim.Period.Milliseconds(),
+	).Slice()
+	if err != nil {
+		return nil, fmt.Errorf("running rate limit script: %w", err)
+	}
+
+	if len(vals) != 2 {
+		return nil, fmt.Errorf("unexpected rate limit script result: %v", vals)
+	}
+
+	allowed, ok := vals[0].(int64)
+	if !ok {
+		return nil, fmt.Errorf("unexpected rate limit script result: %v", vals)
+	}
+
+	tstr, ok := vals[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("unexpected rate limit script result: %v", vals)
+	}
+
+	tokens, err := strconv.ParseFloat(tstr, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &Result{
+		Allowed:   allowed == 1,
+		Remaining: int(tokens),
+		Reset:     time.Duration((float64(lim.Count) - tokens) * float64(interval)),
+	}
+	if !res.Allowed {
+		res.RetryAfter = time.Duration((1 - tokens) * float64(interval))
+	}
+
+	return res, nil
+}
+
+func (rs *RedisStore) Close() error {
+	return rs.client.Close()
+}
@@ -0,0 +1,82 @@
+package serviceauth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/bluesky-social/indigo/util/xrpcerr"
+
+	logging "github.com/ipfs/go-log"
+	"github.com/labstack/echo/v4"
+)
+
+var log = logging.Logger("serviceauth")
+
+// ContextKey is the echo context key the validated token claims are stored
+// under by Middleware
+const ContextKey = "serviceAuth"
+
+type claimsCtxKey struct{}
+
+// Config configures the service auth middleware
+type Config struct {
+	Validator *Validator
+
+	// Skipper returns true for requests which should not be checked
+	Skipper func(c echo.Context) bool
+
+	// Methods maps the route paths of methods served under other names
+	// than their own, such as old names kept for compatibility, to the
+	// method tokens for them are bound to
+	Methods map[string]string
+}
+
+// Middleware returns an echo middleware requiring a valid service auth token
+// as a bearer token. The method a token is checked against is taken from the
+// xrpc route path, or from Config.Methods. The claims of the token can be retrieved from the request
+// with GetClaims, or from the request context with FromContext. Requests are
+// rejected with xrpcerr errors, so the server should use xrpcerr.ErrorHandler.
+func Middleware(cfg Config) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if cfg.Skipper != nil && cfg.Skipper(c) {
+				return next(c)
+			}
+
+			authz := c.Request().Header.Get("Authorization")
+			if !strings.HasPrefix(authz, "Bearer ") {
+				return xrpcerr.New(http.StatusUnauthorized, "AuthMissing", "service auth token required")
+			}
+
+			lxm, ok := cfg.Methods[c.Path()]
+			if !ok {
+				lxm = strings.TrimPrefix(c.Path(), "/xrpc/")
+			}
+
+			claims, err := cfg.Validator.Validate(c.Request().Context(), strings.TrimPrefix(authz, "Bearer "), lxm)
+			if err != nil {
+				log.Warnw("rejected service auth token", "path", c.Path(), "err", err)
+				return xrpcerr.New(http.StatusUnauthorized, "InvalidToken", "invalid service auth token")
+			}
+
+			c.Set(ContextKey, claims)
+			c.SetRequest(c.Request().WithContext(context.WithValue(c.Request().Context(), claimsCtxKey{}, claims)))
+			return next(c)
+		}
+	}
+}
+
+// GetClaims returns the service auth claims for a request that passed through
+// Middleware, or nil if the request was not service authenticated
+func GetClaims(c echo.Context) *Claims {
+	claims, _ := c.Get(ContextKey).(*Claims)
+	return claims
+}
+
+// FromContext returns the service auth claims stored in a request context by
+// Middleware, or nil if the request was not service authenticated
+func FromContext(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(claimsCtxKey{}).(*Claims)
+	return claims
+}
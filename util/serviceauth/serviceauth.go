@@ -0,0 +1,237 @@
+// Package serviceauth implements the short lived, asymmetrically signed JWTs
+// that atproto services use to authenticate requests to each other on behalf
+// of an account (see com.atproto.server.getServiceAuth).
+package serviceauth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/did"
+	"github.com/bluesky-social/indigo/util/keyutil"
+	"github.com/bluesky-social/indigo/util/signer"
+	godid "github.com/whyrusleeping/go-did"
+)
+
+// MaxLifetime is the longest a service auth token may be valid for
+const MaxLifetime = time.Hour
+
+// clockSkew is how far in the future we accept an iat to be
+const clockSkew = 30 * time.Second
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+// Claims are the claims carried in a service auth token
+type Claims struct {
+	// Iss is the account (or service, if it has a fragment) making the request
+	Iss string `json:"iss"`
+
+	// Aud is the DID of the service the token is intended for
+	Aud string `json:"aud"`
+
+	// Lxm is the lexicon method the token may be used for, if it is bound to
+	// one
+	Lxm string `json:"lxm,omitempty"`
+
+	Exp int64  `json:"exp"`
+	Iat int64  `json:"iat"`
+	Jti string `json:"jti,omitempty"`
+}
+
+func algForKeyType(kt string) (string, error) {
+	switch kt {
+	case godid.KeyTypeP256:
+		return "ES256", nil
+	case godid.KeyTypeSecp256k1:
+		return "ES256K", nil
+	default:
+		return "", fmt.Errorf("unsupported key type for service auth: %s", kt)
+	}
+}
+
+// CreateToken signs a service auth token for iss to present to aud. If lxm is
+// set, the token may only be used to call that method.
+func CreateToken(key *godid.PrivKey, iss, aud, lxm string, exp time.Time) (string, error) {
+	return CreateTokenWithSigner(context.Background(), signer.NewKeySigner(key), iss, aud, lxm, exp)
+}
+
+// CreateTokenWithSigner is CreateToken for a key which may be held outside
+// of the process
+func CreateTokenWithSigner(ctx context.Context, sig signer.Signer, iss, aud, lxm string, exp time.Time) (string, error) {
+	pub, err := sig.Public(ctx)
+	if err != nil {
+		return "", err
+	}
+	alg, err := algForKeyType(pub.Type)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	if exp.Sub(now) > MaxLifetime {
+		return "", fmt.Errorf("service auth tokens may be valid for at most %s", MaxLifetime)
+	}
+
+	jti := make([]byte, 16)
+	rand.Read(jti)
+
+	hb, err := json.Marshal(header{Alg: alg, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	cb, err := json.Marshal(Claims{
+		Iss: iss,
+		Aud: aud,
+		Lxm: lxm,
+		Exp: exp.Unix(),
+		Iat: now.Unix(),
+		Jti: base64.RawURLEncoding.EncodeToString(jti),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signing := base64.RawURLEncoding.EncodeToString(hb) + "." + base64.RawURLEncoding.EncodeToString(cb)
+
+	sb, err := sig.Sign(ctx, []byte(signing))
+	if err != nil {
+		return "", fmt.Errorf("signing service auth token: %w", err)
+	}
+
+	return signing + "." + base64.RawURLEncoding.EncodeToString(sb), nil
+}
+
+// Validator checks service auth tokens presented to a service
+type Validator struct {
+	Dir did.Resolver
+
+	// ServiceDID is the DID of the service doing the validation. Tokens must
+	// have it as their audience.
+	ServiceDID string
+
+	// RequireLxm rejects tokens that are not bound to a specific method
+	RequireLxm bool
+
+	// MaxLifetime, if set, rejects tokens issued to be valid (from iat to
+	// exp) for longer than it. Tokens valid for longer than the package
+	// MaxLifetime are always rejected.
+	MaxLifetime time.Duration
+}
+
+// Validate checks that the token was signed by its issuer, is intended for
+// this service, has not expired, and (if bound to a method) is being used for
+// lxm. It returns the claims of the token.
+func (v *Validator) Validate(ctx context.Context, token string, lxm string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed service auth token")
+	}
+
+	hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed service auth token header: %w", err)
+	}
+
+	var hdr header
+	if err := json.Unmarshal(hb, &hdr); err != nil {
+		return nil, fmt.Errorf("malformed service auth token header: %w", err)
+	}
+
+	cb, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed service auth token claims: %w", err)
+	}
+
+	var claims Claims
+	if err := json.Unmarshal(cb, &claims); err != nil {
+		return nil, fmt.Errorf("malformed service auth token claims: %w", err)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed service auth token signature: %w", err)
+	}
+
+	if claims.Aud != v.ServiceDID {
+		return nil, fmt.Errorf("service auth token is for %q, not this service", claims.Aud)
+	}
+
+	now := time.Now()
+	if now.After(time.Unix(claims.Exp, 0)) {
+		return nil, fmt.Errorf("service auth token has expired")
+	}
+
+	if time.Unix(claims.Iat, 0).After(now.Add(clockSkew)) {
+		return nil, fmt.Errorf("service auth token iat is in the future")
+	}
+
+	maxLifetime := MaxLifetime
+	if v.MaxLifetime > 0 && v.MaxLifetime < maxLifetime {
+		maxLifetime = v.MaxLifetime
+	}
+	if time.Duration(claims.Exp-claims.Iat)*time.Second > maxLifetime+clockSkew {
+		return nil, fmt.Errorf("service auth token is valid for longer than %s", maxLifetime)
+	}
+
+	if claims.Lxm != "" && claims.Lxm != lxm {
+		return nil, fmt.Errorf("service auth token is for method %q, not %q", claims.Lxm, lxm)
+	}
+
+	if claims.Lxm == "" && v.RequireLxm {
+		return nil, fmt.Errorf("service auth token must be bound to a method")
+	}
+
+	key, err := v.issuerKey(ctx, claims.Iss)
+	if err != nil {
+		return nil, err
+	}
+
+	alg, err := algForKeyType(key.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	if hdr.Alg != alg {
+		return nil, fmt.Errorf("service auth token alg %q does not match issuer key", hdr.Alg)
+	}
+
+	if err := keyutil.Verify(key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, fmt.Errorf("invalid service auth token signature: %w", err)
+	}
+
+	return &claims, nil
+}
+
+// issuerKey resolves the signing key for an issuer. Issuers are either a bare
+// account DID, or a DID with a service fragment such as
+// "did:plc:abc#atproto_labeler", in which case the key for that service is
+// used.
+func (v *Validator) issuerKey(ctx context.Context, iss string) (*godid.PubKey, error) {
+	d, svc, _ := strings.Cut(iss, "#")
+
+	keyID := "#atproto"
+	if svc == "atproto_labeler" {
+		keyID = "#atproto_label"
+	}
+
+	doc, err := v.Dir.GetDocument(ctx, d)
+	if err != nil {
+		return nil, fmt.Errorf("resolving service auth issuer %q: %w", d, err)
+	}
+
+	key, err := keyutil.DocumentKey(doc, d, keyID)
+	if err != nil {
+		return nil, fmt.Errorf("no %s key for service auth issuer %q", keyID, d)
+	}
+
+	return key, nil
+}
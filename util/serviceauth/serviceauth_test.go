@@ -0,0 +1,191 @@
+package serviceauth
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/util/xrpcerr"
+
+	"github.com/labstack/echo/v4"
+	godid "github.com/whyrusleeping/go-did"
+	"golang.org/x/exp/slog"
+)
+
+type testResolver map[string]*godid.Document
+
+func (tr testResolver) GetDocument(ctx context.Context, d string) (*godid.Document, error) {
+	doc, ok := tr[d]
+	if !ok {
+		return nil, fmt.Errorf("no such did: %s", d)
+	}
+	return doc, nil
+}
+
+func testIssuer(t *testing.T, kt string) (*godid.PrivKey, *godid.Document) {
+	key, err := godid.GeneratePrivKey(rand.Reader, kt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm, err := godid.VerificationMethodFromKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.ID = "#atproto"
+
+	return key, &godid.Document{
+		VerificationMethod: []godid.VerificationMethod{*vm},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	ctx := context.Background()
+
+	p256, p256Doc := testIssuer(t, godid.KeyTypeP256)
+	k256, k256Doc := testIssuer(t, godid.KeyTypeSecp256k1)
+	_, otherDoc := testIssuer(t, godid.KeyTypeP256)
+
+	v := &Validator{
+		Dir: testResolver{
+			"did:plc:alice":   p256Doc,
+			"did:plc:bob":     k256Doc,
+			"did:plc:mallory": otherDoc,
+		},
+		ServiceDID: "did:web:labeler.test",
+	}
+
+	const lxm = "com.atproto.moderation.createReport"
+	exp := time.Now().Add(time.Minute)
+
+	for _, tc := range []struct {
+		name string
+		key  *godid.PrivKey
+		iss  string
+		aud  string
+		lxm  string
+		exp  time.Time
+		ok   bool
+	}{
+		{name: "p256", key: p256, iss: "did:plc:alice", aud: v.ServiceDID, lxm: lxm, exp: exp, ok: true},
+		{name: "secp256k1", key: k256, iss: "did:plc:bob", aud: v.ServiceDID, lxm: lxm, exp: exp, ok: true},
+		{name: "unbound", key: p256, iss: "did:plc:alice", aud: v.ServiceDID, exp: exp, ok: true},
+		{name: "wrong aud", key: p256, iss: "did:plc:alice", aud: "did:web:other.test", lxm: lxm, exp: exp},
+		{name: "wrong lxm", key: p256, iss: "did:plc:alice", aud: v.ServiceDID, lxm: "com.atproto.repo.createRecord", exp: exp},
+		{name: "expired", key: p256, iss: "did:plc:alice", aud: v.ServiceDID, lxm: lxm, exp: time.Now().Add(-time.Minute)},
+		{name: "wrong key", key: p256, iss: "did:plc:mallory", aud: v.ServiceDID, lxm: lxm, exp: exp},
+		{name: "unknown issuer", key: p256, iss: "did:plc:nobody", aud: v.ServiceDID, lxm: lxm, exp: exp},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tok, err := CreateToken(tc.key, tc.iss, tc.aud, tc.lxm, tc.exp)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			claims, err := v.Validate(ctx, tok, lxm)
+			if tc.ok {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if claims.Iss != tc.iss {
+					t.Fatalf("expected iss %q, got %q", tc.iss, claims.Iss)
+				}
+			} else if err == nil {
+				t.Fatal("expected token to be rejected")
+			}
+		})
+	}
+
+	v.RequireLxm = true
+	tok, err := CreateToken(p256, "did:plc:alice", v.ServiceDID, "", exp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Validate(ctx, tok, lxm); err == nil {
+		t.Fatal("expected unbound token to be rejected when lxm is required")
+	}
+
+	if _, err := CreateToken(p256, "did:plc:alice", v.ServiceDID, lxm, time.Now().Add(MaxLifetime*2)); err == nil {
+		t.Fatal("expected overly long lived token to be refused")
+	}
+
+	v.MaxLifetime = 5 * time.Minute
+	tok, err = CreateToken(p256, "did:plc:alice", v.ServiceDID, lxm, time.Now().Add(30*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Validate(ctx, tok, lxm); err == nil {
+		t.Fatal("expected token valid for longer than the validator allows to be rejected")
+	}
+	tok, err = CreateToken(p256, "did:plc:alice", v.ServiceDID, lxm, time.Now().Add(5*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Validate(ctx, tok, lxm); err != nil {
+		t.Fatalf("expected token within the validator's lifetime to be accepted: %s", err)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	key, doc := testIssuer(t, godid.KeyTypeP256)
+	v := &Validator{
+		Dir:        testResolver{"did:plc:alice": doc},
+		ServiceDID: "did:web:labeler.test",
+	}
+
+	e := echo.New()
+	e.HTTPErrorHandler = xrpcerr.ErrorHandler(slog.Default())
+	e.Use(Middleware(Config{
+		Validator: v,
+		Methods:   map[string]string{"/xrpc/com.atproto.report.create": "com.atproto.moderation.createReport"},
+	}))
+	handler := func(c echo.Context) error {
+		if FromContext(c.Request().Context()).Iss != GetClaims(c).Iss {
+			t.Fatal("claims missing from request context")
+		}
+		return c.String(200, GetClaims(c).Iss)
+	}
+	e.POST("/xrpc/com.atproto.moderation.createReport", handler)
+	e.POST("/xrpc/com.atproto.report.create", handler)
+
+	path := "/xrpc/com.atproto.moderation.createReport"
+	call := func(tok string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, nil)
+		if tok != "" {
+			req.Header.Set("Authorization", "Bearer "+tok)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := call(""); rec.Code != 401 || !strings.Contains(rec.Body.String(), `"error":"AuthMissing"`) {
+		t.Fatalf("expected missing auth to be rejected: %d %s", rec.Code, rec.Body.String())
+	}
+
+	tok, err := CreateToken(key, "did:plc:alice", v.ServiceDID, "com.atproto.repo.createRecord", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := call(tok); rec.Code != 401 {
+		t.Fatalf("expected token for another method to be rejected: %d", rec.Code)
+	}
+
+	tok, err = CreateToken(key, "did:plc:alice", v.ServiceDID, "com.atproto.moderation.createReport", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := call(tok); rec.Code != 200 || rec.Body.String() != "did:plc:alice" {
+		t.Fatalf("expected valid token to be accepted: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// the method's old name is checked against the method
+	path = "/xrpc/com.atproto.report.create"
+	if rec := call(tok); rec.Code != 200 {
+		t.Fatalf("expected token for the method to be accepted under its old name: %d %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,119 @@
+package signer
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/bluesky-social/indigo/util/keyutil"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"github.com/whyrusleeping/go-did"
+)
+
+// kmsAPI is the part of the KMS client used, so tests can fake it
+type kmsAPI interface {
+	Sign(ctx context.Context, params *kms.SignInput, optFns ...func(*kms.Options)) (*kms.SignOutput, error)
+	GetPublicKey(ctx context.Context, params *kms.GetPublicKeyInput, optFns ...func(*kms.Options)) (*kms.GetPublicKeyOutput, error)
+}
+
+// KMSSigner signs with an asymmetric ECC_NIST_P256 or ECC_SECG_P256K1 key in
+// AWS KMS. The public key is fetched once and cached.
+type KMSSigner struct {
+	client kmsAPI
+	keyID  string
+
+	lk  sync.Mutex
+	pub *did.PubKey
+}
+
+// NewKMSSigner returns a signer for a KMS key by key ID, alias
+// ("alias/labelmaker") or ARN, and checks that the key can be used
+func NewKMSSigner(ctx context.Context, keyID string) (*KMSSigner, error) {
+	if keyID == "" {
+		return nil, fmt.Errorf("no kms key id")
+	}
+
+	var opts []func(*awsconfig.LoadOptions) error
+	if region := arnRegion(keyID); region != "" {
+		opts = append(opts, awsconfig.WithRegion(region))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("loading aws config: %w", err)
+	}
+
+	s := &KMSSigner{
+		client: kms.NewFromConfig(cfg),
+		keyID:  keyID,
+	}
+	if _, err := s.Public(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// arnRegion returns the region of a KMS key or alias ARN
+// (arn:aws:kms:<region>:<account>:key/<id>), or "" if keyID isn't one
+func arnRegion(keyID string) string {
+	parts := strings.SplitN(keyID, ":", 6)
+	if len(parts) < 6 || parts[0] != "arn" || parts[2] != "kms" {
+		return ""
+	}
+	return parts[3]
+}
+
+func (s *KMSSigner) Public(ctx context.Context) (*did.PubKey, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if s.pub != nil {
+		return s.pub, nil
+	}
+
+	out, err := s.client.GetPublicKey(ctx, &kms.GetPublicKeyInput{KeyId: aws.String(s.keyID)})
+	if err != nil {
+		return nil, fmt.Errorf("getting kms public key: %w", err)
+	}
+	if out.KeyUsage != types.KeyUsageTypeSignVerify {
+		return nil, fmt.Errorf("kms key %s is not a signing key (usage %s)", s.keyID, out.KeyUsage)
+	}
+	switch out.KeySpec {
+	case types.KeySpecEccNistP256, types.KeySpecEccSecgP256k1:
+	default:
+		return nil, fmt.Errorf("unsupported kms key spec %s (need ECC_NIST_P256 or ECC_SECG_P256K1)", out.KeySpec)
+	}
+
+	pub, err := keyutil.ParsePublicKeyDER(out.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infow("loaded kms signing key", "key", s.keyID, "did", pub.DID())
+	s.pub = pub
+	return pub, nil
+}
+
+func (s *KMSSigner) Sign(ctx context.Context, msg []byte) ([]byte, error) {
+	pub, err := s.Public(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.Sum256(msg)
+	out, err := s.client.Sign(ctx, &kms.SignInput{
+		KeyId:            aws.String(s.keyID),
+		Message:          h[:],
+		MessageType:      types.MessageTypeDigest,
+		SigningAlgorithm: types.SigningAlgorithmSpecEcdsaSha256,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("kms sign: %w", err)
+	}
+
+	return derSignatureToCompact(pub.Type, out.Signature)
+}
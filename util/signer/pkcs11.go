@@ -0,0 +1,200 @@
+//go:build cgo
+
+package signer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/bluesky-social/indigo/util/keyutil"
+
+	"github.com/miekg/pkcs11"
+	"github.com/whyrusleeping/go-did"
+)
+
+// PKCS11Signer signs with an EC key on a PKCS#11 token, such as an HSM. The
+// public key is read when the signer is opened.
+type PKCS11Signer struct {
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	key     pkcs11.ObjectHandle
+	pub     *did.PubKey
+
+	// a session can only do one operation at a time
+	lk sync.Mutex
+}
+
+// OpenPKCS11 opens a session on the token of a PKCS#11 URI, logs in with its
+// PIN, and finds its key
+func OpenPKCS11(uri string) (*PKCS11Signer, error) {
+	u, err := parsePKCS11URI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	p := pkcs11.New(u.ModulePath)
+	if p == nil {
+		return nil, fmt.Errorf("loading pkcs11 module %s failed", u.ModulePath)
+	}
+	if err := p.Initialize(); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED)) {
+		return nil, fmt.Errorf("initializing pkcs11 module: %w", err)
+	}
+
+	slot, err := findSlot(p, u)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := p.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return nil, fmt.Errorf("opening pkcs11 session: %w", err)
+	}
+	s := &PKCS11Signer{ctx: p, session: session}
+
+	if u.Pin != "" {
+		if err := p.Login(session, pkcs11.CKU_USER, u.Pin); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+			s.Close()
+			return nil, fmt.Errorf("pkcs11 login: %w", err)
+		}
+	}
+
+	s.key, err = s.findObject(u, pkcs11.CKO_PRIVATE_KEY)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	pubObj, err := s.findObject(u, pkcs11.CKO_PUBLIC_KEY)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.pub, err = s.readPublicKey(pubObj)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	log.Infow("loaded pkcs11 signing key", "token", u.Token, "object", u.Object, "did", s.pub.DID())
+	return s, nil
+}
+
+func findSlot(p *pkcs11.Ctx, u *pkcs11URI) (uint, error) {
+	if u.SlotID != nil {
+		return *u.SlotID, nil
+	}
+
+	slots, err := p.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("listing pkcs11 slots: %w", err)
+	}
+	for _, slot := range slots {
+		info, err := p.GetTokenInfo(slot)
+		if err != nil {
+			return 0, fmt.Errorf("getting pkcs11 token info: %w", err)
+		}
+		// labels are padded with spaces to 32 bytes
+		if strings.TrimRight(info.Label, " \x00") == u.Token {
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("no pkcs11 token labelled %q", u.Token)
+}
+
+func (s *PKCS11Signer) findObject(u *pkcs11URI, class uint) (pkcs11.ObjectHandle, error) {
+	tmpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+	}
+	if u.Object != "" {
+		tmpl = append(tmpl, pkcs11.NewAttribute(pkcs11.CKA_LABEL, u.Object))
+	}
+	if len(u.ID) != 0 {
+		tmpl = append(tmpl, pkcs11.NewAttribute(pkcs11.CKA_ID, u.ID))
+	}
+
+	if err := s.ctx.FindObjectsInit(s.session, tmpl); err != nil {
+		return 0, fmt.Errorf("finding pkcs11 key: %w", err)
+	}
+	objs, _, err := s.ctx.FindObjects(s.session, 2)
+	if ferr := s.ctx.FindObjectsFinal(s.session); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("finding pkcs11 key: %w", err)
+	}
+
+	kind := "private"
+	if class == pkcs11.CKO_PUBLIC_KEY {
+		kind = "public"
+	}
+	switch len(objs) {
+	case 0:
+		return 0, fmt.Errorf("no pkcs11 EC %s key matching object=%q id=%x", kind, u.Object, u.ID)
+	case 1:
+		return objs[0], nil
+	default:
+		return 0, fmt.Errorf("more than one pkcs11 EC %s key matching object=%q id=%x", kind, u.Object, u.ID)
+	}
+}
+
+func (s *PKCS11Signer) readPublicKey(obj pkcs11.ObjectHandle) (*did.PubKey, error) {
+	attrs, err := s.ctx.GetAttributeValue(s.session, obj, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading pkcs11 public key: %w", err)
+	}
+
+	var params, point []byte
+	for _, a := range attrs {
+		switch a.Type {
+		case pkcs11.CKA_EC_PARAMS:
+			params = a.Value
+		case pkcs11.CKA_EC_POINT:
+			point = a.Value
+		}
+	}
+
+	// the point should be a DER octet string, but some modules return it
+	// bare
+	var raw []byte
+	if rest, err := asn1.Unmarshal(point, &raw); err != nil || len(rest) != 0 {
+		raw = point
+	}
+	return keyutil.PublicKeyFromECParams(params, raw)
+}
+
+func (s *PKCS11Signer) Public(ctx context.Context) (*did.PubKey, error) {
+	return s.pub, nil
+}
+
+func (s *PKCS11Signer) Sign(ctx context.Context, msg []byte) ([]byte, error) {
+	h := sha256.Sum256(msg)
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if err := s.ctx.SignInit(s.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)}, s.key); err != nil {
+		return nil, fmt.Errorf("pkcs11 sign: %w", err)
+	}
+	sig, err := s.ctx.Sign(s.session, h[:])
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11 sign: %w", err)
+	}
+
+	return keyutil.NormalizeSignature(s.pub.Type, sig)
+}
+
+// Close ends the session with the token
+func (s *PKCS11Signer) Close() error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.ctx.CloseSession(s.session)
+}
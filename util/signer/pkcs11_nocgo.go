@@ -0,0 +1,32 @@
+//go:build !cgo
+
+package signer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/whyrusleeping/go-did"
+)
+
+// PKCS11Signer needs cgo to load PKCS#11 modules
+type PKCS11Signer struct{}
+
+func OpenPKCS11(uri string) (*PKCS11Signer, error) {
+	if _, err := parsePKCS11URI(uri); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("pkcs11 signing keys need a build with cgo enabled")
+}
+
+func (s *PKCS11Signer) Public(ctx context.Context) (*did.PubKey, error) {
+	return nil, fmt.Errorf("pkcs11 signing keys need a build with cgo enabled")
+}
+
+func (s *PKCS11Signer) Sign(ctx context.Context, msg []byte) ([]byte, error) {
+	return nil, fmt.Errorf("pkcs11 signing keys need a build with cgo enabled")
+}
+
+func (s *PKCS11Signer) Close() error {
+	return nil
+}
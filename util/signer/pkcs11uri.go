@@ -0,0 +1,96 @@
+package signer
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// pkcs11URI is the part of an RFC 7512 PKCS#11 URI used to find a key
+type pkcs11URI struct {
+	// Token is the label of the token holding the key
+	Token string
+	// SlotID picks the slot of the token, if set
+	SlotID *uint
+
+	// Object is the label of the key, and ID its CKA_ID. At least one is
+	// needed.
+	Object string
+	ID     []byte
+
+	ModulePath string
+	Pin        string
+}
+
+func parsePKCS11URI(s string) (*pkcs11URI, error) {
+	rest, ok := strings.CutPrefix(s, "pkcs11:")
+	if !ok {
+		return nil, fmt.Errorf("not a pkcs11 uri")
+	}
+	path, query, _ := strings.Cut(rest, "?")
+
+	var u pkcs11URI
+	for _, attr := range strings.Split(path, ";") {
+		if attr == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(attr, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid pkcs11 uri attribute: %q", attr)
+		}
+		v, err := url.PathUnescape(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pkcs11 uri attribute %s: %w", k, err)
+		}
+
+		switch k {
+		case "token":
+			u.Token = v
+		case "object":
+			u.Object = v
+		case "id":
+			u.ID = []byte(v)
+		case "slot-id":
+			id, err := strconv.ParseUint(v, 10, 0)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pkcs11 slot-id: %q", v)
+			}
+			slot := uint(id)
+			u.SlotID = &slot
+		case "type":
+			if v != "private" {
+				return nil, fmt.Errorf("pkcs11 uri must name a private key, not %s", v)
+			}
+		default:
+			// other attributes (manufacturer, serial, ...) further narrow
+			// down the token, and aren't needed to find it
+		}
+	}
+
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pkcs11 uri query: %w", err)
+	}
+	u.ModulePath = q.Get("module-path")
+	u.Pin = q.Get("pin-value")
+	if src := q.Get("pin-source"); src != "" && u.Pin == "" {
+		b, err := os.ReadFile(strings.TrimPrefix(src, "file:"))
+		if err != nil {
+			return nil, fmt.Errorf("reading pkcs11 pin: %w", err)
+		}
+		u.Pin = strings.TrimRight(string(b), "\r\n")
+	}
+
+	if u.ModulePath == "" {
+		return nil, fmt.Errorf("pkcs11 uri needs a module-path")
+	}
+	if u.Token == "" && u.SlotID == nil {
+		return nil, fmt.Errorf("pkcs11 uri needs a token or slot-id")
+	}
+	if u.Object == "" && len(u.ID) == 0 {
+		return nil, fmt.Errorf("pkcs11 uri needs an object or id")
+	}
+	return &u, nil
+}
@@ -0,0 +1,93 @@
+// Package signer abstracts the keys that repo commits (and service auth
+// tokens) are signed with, so that a key can be held by a managed service or
+// a hardware token rather than in process memory.
+//
+// Signatures are in the atproto format: an ECDSA signature over the SHA-256
+// hash of the message, as the 64 byte concatenation of r and s, with s in the
+// lower half of the curve order, as made by keyutil.Sign and checked by
+// keyutil.Verify.
+package signer
+
+import (
+	"context"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/bluesky-social/indigo/util/keyutil"
+
+	logging "github.com/ipfs/go-log"
+	"github.com/whyrusleeping/go-did"
+)
+
+var log = logging.Logger("signer")
+
+// Signer signs messages with a key which may not be held locally
+type Signer interface {
+	// Sign returns the signature of msg, in the atproto format
+	Sign(ctx context.Context, msg []byte) ([]byte, error)
+
+	// Public returns the public key of the signing key
+	Public(ctx context.Context) (*did.PubKey, error)
+}
+
+// Open returns a signer for a key held outside of the process, by its key
+// identifier:
+//
+//	awskms://<key id, alias or ARN>
+//	pkcs11:token=<label>;object=<label>?module-path=<path>&pin-value=<pin>
+//
+// AWS KMS keys are used with the default AWS credentials and region (or the
+// region of the key ARN). PKCS#11 identifiers are RFC 7512 URIs.
+func Open(ctx context.Context, keyID string) (Signer, error) {
+	var (
+		s   Signer
+		err error
+	)
+	switch {
+	case strings.HasPrefix(keyID, "awskms://"):
+		s, err = NewKMSSigner(ctx, strings.TrimPrefix(keyID, "awskms://"))
+	case strings.HasPrefix(keyID, "pkcs11:"):
+		s, err = OpenPKCS11(keyID)
+	default:
+		return nil, fmt.Errorf("unrecognized signing key identifier (expected awskms:// or pkcs11:)")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// KeySigner signs with a local private key
+type KeySigner struct {
+	key *did.PrivKey
+}
+
+func NewKeySigner(k *did.PrivKey) *KeySigner {
+	return &KeySigner{key: k}
+}
+
+func (s *KeySigner) Sign(ctx context.Context, msg []byte) ([]byte, error) {
+	return keyutil.Sign(s.key, msg)
+}
+
+func (s *KeySigner) Public(ctx context.Context) (*did.PubKey, error) {
+	return s.key.Public(), nil
+}
+
+// derSignatureToCompact converts an ASN.1 DER ECDSA signature, as returned
+// by KMS, to the atproto form
+func derSignatureToCompact(keyType string, der []byte) ([]byte, error) {
+	var sig struct {
+		R, S *big.Int
+	}
+	rest, err := asn1.Unmarshal(der, &sig)
+	if err != nil {
+		return nil, fmt.Errorf("parsing signature: %w", err)
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("trailing data after signature")
+	}
+	return keyutil.CompactSignature(keyType, sig.R, sig.S)
+}
@@ -0,0 +1,205 @@
+package signer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/bluesky-social/indigo/util/keyutil"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/whyrusleeping/go-did"
+	secpEc "gitlab.com/yawning/secp256k1-voi/secec"
+)
+
+// fakeKMS signs with a local key, returning DER signatures and SPKI public
+// keys as KMS does
+type fakeKMS struct {
+	key     *did.PrivKey
+	spec    types.KeySpec
+	pubGets int
+}
+
+func (f *fakeKMS) GetPublicKey(ctx context.Context, params *kms.GetPublicKeyInput, optFns ...func(*kms.Options)) (*kms.GetPublicKeyOutput, error) {
+	f.pubGets++
+	pk, err := keyutil.MarshalPublicKeyDER(f.key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &kms.GetPublicKeyOutput{
+		KeyId:     params.KeyId,
+		KeySpec:   f.spec,
+		KeyUsage:  types.KeyUsageTypeSignVerify,
+		PublicKey: pk,
+	}, nil
+}
+
+func (f *fakeKMS) Sign(ctx context.Context, params *kms.SignInput, optFns ...func(*kms.Options)) (*kms.SignOutput, error) {
+	if params.MessageType != types.MessageTypeDigest || len(params.Message) != sha256.Size {
+		return nil, fmt.Errorf("expected a sha256 digest")
+	}
+
+	var sig []byte
+	var err error
+	switch k := f.key.Raw.(type) {
+	case *ecdsa.PrivateKey:
+		sig, err = ecdsa.SignASN1(rand.Reader, k, params.Message)
+	case *secpEc.PrivateKey:
+		sig, err = k.Sign(rand.Reader, params.Message, &secpEc.ECDSAOptions{Encoding: secpEc.EncodingASN1})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &kms.SignOutput{KeyId: params.KeyId, Signature: sig}, nil
+}
+
+func TestKMSSigner(t *testing.T) {
+	for kt, spec := range map[string]types.KeySpec{
+		did.KeyTypeP256:      types.KeySpecEccNistP256,
+		did.KeyTypeSecp256k1: types.KeySpecEccSecgP256k1,
+	} {
+		t.Run(kt, func(t *testing.T) {
+			assert := assert.New(t)
+			ctx := context.Background()
+
+			key, err := did.GeneratePrivKey(rand.Reader, kt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fake := &fakeKMS{key: key, spec: spec}
+			s := &KMSSigner{client: fake, keyID: "alias/test"}
+
+			pub, err := s.Public(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(key.Public().DID(), pub.DID())
+
+			msg := []byte("commit bytes")
+			for i := 0; i < 20; i++ {
+				sig, err := s.Sign(ctx, msg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				assert.Len(sig, 64)
+				assert.NoError(keyutil.Verify(key.Public(), msg, sig))
+			}
+			assert.Equal(1, fake.pubGets, "public key should be cached")
+		})
+	}
+}
+
+func TestKMSSignerRejectsKeySpec(t *testing.T) {
+	key, err := did.GeneratePrivKey(rand.Reader, did.KeyTypeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &KMSSigner{client: &fakeKMS{key: key, spec: types.KeySpecRsa2048}, keyID: "alias/test"}
+	_, err = s.Sign(context.Background(), []byte("msg"))
+	assert.ErrorContains(t, err, "unsupported kms key spec")
+}
+
+func TestDERSignatureLowS(t *testing.T) {
+	assert := assert.New(t)
+
+	key, err := did.GeneratePrivKey(rand.Reader, did.KeyTypeSecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("hello")
+	sig, err := key.Sign(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// KMS may return s in the high half, which atproto verifiers reject
+	n, _ := new(big.Int).SetString("fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141", 16)
+	der, err := asn1.Marshal(struct{ R, S *big.Int }{
+		R: new(big.Int).SetBytes(sig[:32]),
+		S: new(big.Int).Sub(n, new(big.Int).SetBytes(sig[32:])),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	norm, err := derSignatureToCompact(did.KeyTypeSecp256k1, der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(sig, norm)
+	assert.NoError(keyutil.Verify(key.Public(), msg, norm))
+
+	_, err = derSignatureToCompact(did.KeyTypeSecp256k1, append(der, 0))
+	assert.Error(err)
+}
+
+func TestKeySigner(t *testing.T) {
+	key, err := did.GeneratePrivKey(rand.Reader, did.KeyTypeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewKeySigner(key)
+	sig, err := s.Sign(context.Background(), []byte("msg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := s.Public(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, keyutil.Verify(pub, []byte("msg"), sig))
+}
+
+func TestParsePKCS11URI(t *testing.T) {
+	assert := assert.New(t)
+
+	u, err := parsePKCS11URI("pkcs11:token=labelmaker%20prod;object=repo-key;id=%01%02;type=private?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-value=1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal("labelmaker prod", u.Token)
+	assert.Equal("repo-key", u.Object)
+	assert.Equal([]byte{1, 2}, u.ID)
+	assert.Equal("/usr/lib/softhsm/libsofthsm2.so", u.ModulePath)
+	assert.Equal("1234", u.Pin)
+	assert.Nil(u.SlotID)
+
+	u, err = parsePKCS11URI("pkcs11:slot-id=3;id=%aa?module-path=/lib/p11.so")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.NotNil(u.SlotID) {
+		assert.Equal(uint(3), *u.SlotID)
+	}
+	assert.Equal("", u.Pin)
+
+	for _, bad := range []string{
+		"pkcs12:token=a;object=b?module-path=/lib/p11.so",
+		"pkcs11:token=a;object=b",
+		"pkcs11:object=b?module-path=/lib/p11.so",
+		"pkcs11:token=a?module-path=/lib/p11.so",
+		"pkcs11:token=a;object=b;type=public?module-path=/lib/p11.so",
+		"pkcs11:token=a;object?module-path=/lib/p11.so",
+	} {
+		_, err := parsePKCS11URI(bad)
+		assert.Error(err, bad)
+	}
+}
+
+func TestArnRegion(t *testing.T) {
+	assert.Equal(t, "eu-west-2", arnRegion("arn:aws:kms:eu-west-2:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab"))
+	assert.Equal(t, "", arnRegion("alias/labelmaker"))
+	assert.Equal(t, "", arnRegion("1234abcd-12ab-34cd-56ef-1234567890ab"))
+}
+
+func TestOpenUnknown(t *testing.T) {
+	_, err := Open(context.Background(), "file:///tmp/key.json")
+	assert.Error(t, err)
+}
@@ -0,0 +1,162 @@
+// Package syntax validates and normalizes the string formats atproto
+// identifiers have: DIDs, handles, NSIDs, record keys and TIDs. Each Parse
+// function returns the value as its own type, normalized where the format is
+// case insensitive, or an error wrapping one of the package's Err values.
+package syntax
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrInvalidDID       = errors.New("invalid DID")
+	ErrInvalidHandle    = errors.New("invalid handle")
+	ErrInvalidNSID      = errors.New("invalid NSID")
+	ErrInvalidRecordKey = errors.New("invalid record key")
+	ErrInvalidTID       = errors.New("invalid TID")
+)
+
+var (
+	didRegex    = regexp.MustCompile(`^did:[a-z]+:[a-zA-Z0-9._:%-]*[a-zA-Z0-9._-]$`)
+	handleRegex = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)+[a-zA-Z]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+	nsidRegex   = regexp.MustCompile(`^[a-zA-Z]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)+(\.[a-zA-Z]([a-zA-Z0-9]{0,62})?)$`)
+	rkeyRegex   = regexp.MustCompile(`^[a-zA-Z0-9_~.:-]{1,512}$`)
+	tidRegex    = regexp.MustCompile(`^[234567abcdefghij][234567abcdefghijklmnopqrstuvwxyz]{12}$`)
+)
+
+// DID is a decentralized identifier, such as did:plc:ewvi7nxzyoun6zhxrhs64oiz
+type DID string
+
+// ParseDID validates a DID. DIDs are case sensitive, so aren't normalized.
+func ParseDID(s string) (DID, error) {
+	if len(s) > 2048 {
+		return "", fmt.Errorf("%w: longer than 2048 characters", ErrInvalidDID)
+	}
+	if !didRegex.MatchString(s) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidDID, s)
+	}
+	return DID(s), nil
+}
+
+// Method returns the DID method, such as plc or web
+func (d DID) Method() string {
+	m, _, _ := strings.Cut(strings.TrimPrefix(string(d), "did:"), ":")
+	return m
+}
+
+func (d DID) String() string {
+	return string(d)
+}
+
+// Handle is an account's domain name handle, such as alice.bsky.social
+type Handle string
+
+// HandleInvalid stands in for the handle of an account whose handle doesn't
+// resolve back to it, or was taken by another account. It is sent in #handle
+// events for accounts losing their handle.
+const HandleInvalid = "handle.invalid"
+
+// disallowedTLDs are top level domains which handles may syntactically have,
+// but which can't be resolved
+var disallowedTLDs = map[string]bool{
+	"alt":       true,
+	"arpa":      true,
+	"example":   true,
+	"internal":  true,
+	"invalid":   true,
+	"local":     true,
+	"localhost": true,
+	"onion":     true,
+}
+
+// ParseHandle validates a handle, normalizing it to lower case
+func ParseHandle(s string) (Handle, error) {
+	if len(s) > 253 {
+		return "", fmt.Errorf("%w: longer than 253 characters", ErrInvalidHandle)
+	}
+	if !handleRegex.MatchString(s) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidHandle, s)
+	}
+	return Handle(strings.ToLower(s)), nil
+}
+
+// TLD returns the handle's top level domain
+func (h Handle) TLD() string {
+	return string(h[strings.LastIndexByte(string(h), '.')+1:])
+}
+
+// AllowedTLD reports whether handles with this handle's top level domain can
+// be resolved. Handles on reserved domains such as .local and .example are
+// syntactically valid, but can't be.
+func (h Handle) AllowedTLD() bool {
+	return !disallowedTLDs[h.TLD()]
+}
+
+func (h Handle) String() string {
+	return string(h)
+}
+
+// ParseAtIdentifier validates a DID or a handle, as taken by methods which
+// accept either for an account. Handles are normalized as by ParseHandle.
+func ParseAtIdentifier(s string) (string, error) {
+	if strings.HasPrefix(s, "did:") {
+		d, err := ParseDID(s)
+		return string(d), err
+	}
+	h, err := ParseHandle(s)
+	return string(h), err
+}
+
+// NSID is a namespaced identifier, such as app.bsky.feed.post
+type NSID string
+
+// ParseNSID validates an NSID, normalizing its domain authority to lower case.
+// The name segment is case sensitive, so is left as it is.
+func ParseNSID(s string) (NSID, error) {
+	if len(s) > 317 {
+		return "", fmt.Errorf("%w: longer than 317 characters", ErrInvalidNSID)
+	}
+	if !nsidRegex.MatchString(s) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidNSID, s)
+	}
+	i := strings.LastIndexByte(s, '.')
+	if i > 253 {
+		return "", fmt.Errorf("%w: domain authority longer than 253 characters", ErrInvalidNSID)
+	}
+	return NSID(strings.ToLower(s[:i]) + s[i:]), nil
+}
+
+// Authority returns the NSID's domain authority, in the order of its
+// segments in the NSID, such as app.bsky.feed for app.bsky.feed.post
+func (n NSID) Authority() string {
+	return string(n[:strings.LastIndexByte(string(n), '.')])
+}
+
+// Name returns the last segment of the NSID, such as post for
+// app.bsky.feed.post
+func (n NSID) Name() string {
+	return string(n[strings.LastIndexByte(string(n), '.')+1:])
+}
+
+func (n NSID) String() string {
+	return string(n)
+}
+
+// RecordKey is the key of a record in its collection
+type RecordKey string
+
+// ParseRecordKey validates a record key. Record keys are case sensitive, so
+// aren't normalized.
+func ParseRecordKey(s string) (RecordKey, error) {
+	if s == "." || s == ".." || !rkeyRegex.MatchString(s) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidRecordKey, s)
+	}
+	return RecordKey(s), nil
+}
+
+func (k RecordKey) String() string {
+	return string(k)
+}
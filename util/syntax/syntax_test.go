@@ -0,0 +1,129 @@
+package syntax
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDID(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, s := range []string{"did:plc:ewvi7nxzyoun6zhxrhs64oiz", "did:web:example.com", "did:web:localhost%3A2583", "did:method:a:b:c"} {
+		d, err := ParseDID(s)
+		assert.NoError(err, s)
+		assert.Equal(s, d.String())
+	}
+
+	d, _ := ParseDID("did:web:example.com")
+	assert.Equal("web", d.Method())
+
+	for _, s := range []string{"", "did:", "did:plc:", "did:PLC:abc", "did:plc:abc:", "did:plc:abc%", "plc:abc", "did:plc:ab/c", "did:plc:" + strings.Repeat("a", 2048)} {
+		_, err := ParseDID(s)
+		assert.ErrorIs(err, ErrInvalidDID, s)
+	}
+}
+
+func TestParseHandle(t *testing.T) {
+	assert := assert.New(t)
+
+	h, err := ParseHandle("Alice.Bsky.Social")
+	assert.NoError(err)
+	assert.Equal(Handle("alice.bsky.social"), h)
+	assert.Equal("social", h.TLD())
+	assert.True(h.AllowedTLD())
+
+	h, err = ParseHandle("alice.example")
+	assert.NoError(err)
+	assert.False(h.AllowedTLD())
+
+	for _, s := range []string{"", "alice", "alice.", ".alice.test", "alice..test", "-alice.test", "alice.test-", "alice.1test", "al_ice.test", strings.Repeat("a", 64) + ".test", strings.Repeat("a.", 127) + "test"} {
+		_, err := ParseHandle(s)
+		assert.ErrorIs(err, ErrInvalidHandle, s)
+	}
+
+	id, err := ParseAtIdentifier("Alice.Test")
+	assert.NoError(err)
+	assert.Equal("alice.test", id)
+	_, err = ParseAtIdentifier("did:plc:")
+	assert.ErrorIs(err, ErrInvalidDID)
+}
+
+func TestParseNSID(t *testing.T) {
+	assert := assert.New(t)
+
+	n, err := ParseNSID("COM.Example.fooBar")
+	assert.NoError(err)
+	assert.Equal(NSID("com.example.fooBar"), n)
+	assert.Equal("com.example", n.Authority())
+	assert.Equal("fooBar", n.Name())
+
+	for _, s := range []string{"app.bsky.feed.post", "com.atproto.sync.subscribeRepos", "net.users.bob.ping", "a-0.b-1.c"} {
+		_, err := ParseNSID(s)
+		assert.NoError(err, s)
+	}
+
+	for _, s := range []string{"", "com.example", "com.example.", "com.example.foo-bar", "com.example.3foo", "1com.example.foo", "com..example.foo", "com.example.foo/bar", "com." + strings.Repeat("a", 64) + ".foo"} {
+		_, err := ParseNSID(s)
+		assert.ErrorIs(err, ErrInvalidNSID, s)
+	}
+}
+
+func TestParseRecordKey(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, s := range []string{"self", "3jzfcijpj2z2a", "a:b~c_d.e-f", "..."} {
+		_, err := ParseRecordKey(s)
+		assert.NoError(err, s)
+	}
+	for _, s := range []string{"", ".", "..", "a/b", "a b", "a%20b", strings.Repeat("a", 513)} {
+		_, err := ParseRecordKey(s)
+		assert.ErrorIs(err, ErrInvalidRecordKey, s)
+	}
+}
+
+func TestTID(t *testing.T) {
+	assert := assert.New(t)
+
+	ts := time.Date(2023, 4, 1, 12, 0, 0, 123456000, time.UTC)
+	tid := NewTID(ts.UnixMicro(), 7)
+	assert.Len(tid.String(), 13)
+	assert.True(ts.Equal(tid.Time()))
+	assert.Equal(uint(7), tid.ClockID())
+
+	parsed, err := ParseTID(tid.String())
+	assert.NoError(err)
+	assert.Equal(tid, parsed)
+	assert.Equal(TID("2222222222222"), NewTID(0, 0))
+	assert.Equal(TID("22222222223zz"), NewTID(1, 1023))
+
+	// string order is time order
+	assert.Less(string(NewTID(ts.UnixMicro(), 1023)), string(NewTID(ts.UnixMicro()+1, 0)))
+
+	for _, s := range []string{"", "3jzfcijpj2z2", "3jzfcijpj2z2aa", "kjzfcijpj2z2a", "3jzfcijpj2z2A", "3jzfcijpj2z21"} {
+		_, err := ParseTID(s)
+		assert.ErrorIs(err, ErrInvalidTID, s)
+	}
+}
+
+func TestTIDClock(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewTIDClock(5)
+	prev := c.Next()
+	for i := 0; i < 1000; i++ {
+		next := c.Next()
+		assert.Less(string(prev), string(next))
+		assert.Equal(uint(5), next.ClockID())
+		prev = next
+	}
+
+	// a clock which has run ahead of the system clock, as after the system
+	// clock steps back, carries on from where it got to
+	ahead := time.Now().Add(time.Hour).UnixMicro()
+	c.last = ahead
+	next := c.Next()
+	assert.Equal(ahead+1, next.Time().UnixMicro())
+}
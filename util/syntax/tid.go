@@ -0,0 +1,113 @@
+package syntax
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// s32Alphabet is the sortable base32 alphabet TIDs are encoded in, whose
+// characters are in ascending byte order
+const s32Alphabet = "234567abcdefghijklmnopqrstuvwxyz"
+
+// tidClockIDs is how many clock IDs there are, which take the low 10 bits
+// of a TID
+const tidClockIDs = 1 << 10
+
+// TID is a timestamp identifier, the record key records are created with by
+// default. TIDs sort in the order of their timestamps, both as strings and
+// as integers.
+type TID string
+
+// ParseTID validates a TID
+func ParseTID(s string) (TID, error) {
+	if !tidRegex.MatchString(s) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidTID, s)
+	}
+	return TID(s), nil
+}
+
+// NewTID returns the TID for a time, in microseconds since the Unix epoch, and
+// a clock ID (of which only the low 10 bits are used)
+func NewTID(unixMicro int64, clockID uint) TID {
+	v := uint64(unixMicro)<<10 | uint64(clockID%tidClockIDs)
+	v &^= 1 << 63
+
+	var b [13]byte
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i] = s32Alphabet[v&0x1f]
+		v >>= 5
+	}
+	return TID(b[:])
+}
+
+// Integer returns the TID as the integer it encodes
+func (t TID) Integer() uint64 {
+	var v uint64
+	for i := 0; i < len(t); i++ {
+		v = v<<5 | uint64(strings.IndexByte(s32Alphabet, t[i]))
+	}
+	return v
+}
+
+// Time returns the time the TID is for
+func (t TID) Time() time.Time {
+	return time.UnixMicro(int64(t.Integer() >> 10))
+}
+
+// ClockID returns the clock ID of the TID
+func (t TID) ClockID() uint {
+	return uint(t.Integer() % tidClockIDs)
+}
+
+func (t TID) String() string {
+	return string(t)
+}
+
+// TIDClock generates TIDs which are strictly increasing, even if the system
+// clock steps backwards: TIDs are never for a time before the last one
+// generated.
+type TIDClock struct {
+	clockID uint
+
+	lk   sync.Mutex
+	last int64
+}
+
+// NewTIDClock returns a clock generating TIDs with a clock ID. Generators
+// which could generate TIDs for the same records at the same time should
+// have different clock IDs.
+func NewTIDClock(clockID uint) *TIDClock {
+	return &TIDClock{clockID: clockID % tidClockIDs}
+}
+
+// NewTIDClockAfter returns a clock whose TIDs are all for times after after,
+// in microseconds since the Unix epoch, such as the last time a previous clock
+// with the same clock ID can have generated a TID for
+func NewTIDClockAfter(clockID uint, after int64) *TIDClock {
+	c := NewTIDClock(clockID)
+	c.last = after
+	return c
+}
+
+// NewRandomTIDClock returns a clock with a random clock ID
+func NewRandomTIDClock() *TIDClock {
+	return NewTIDClock(uint(rand.Intn(tidClockIDs)))
+}
+
+// Next returns a TID for the current time, or for just after the last TID
+// generated if the current time isn't after it
+func (c *TIDClock) Next() TID {
+	now := time.Now().UnixMicro()
+
+	c.lk.Lock()
+	if now <= c.last {
+		now = c.last + 1
+	}
+	c.last = now
+	c.lk.Unlock()
+
+	return NewTID(now, c.clockID)
+}
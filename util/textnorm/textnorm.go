@@ -0,0 +1,163 @@
+// Package textnorm normalizes text before it is matched against keywords and
+// regexes, so that filters aren't evaded by writing the same words
+// differently: in fullwidth or mathematical letters, with zero-width
+// characters between them, in lookalike letters from other scripts, or in
+// leetspeak.
+//
+// Normalization is a pipeline of steps, which are chosen by name:
+//
+//	zero_width     strip zero-width and other invisible characters
+//	nfkc           unicode compatibility normalization (NFKC), which folds
+//	               fullwidth, circled, superscript and styled letters
+//	transliterate  strip diacritics and spell out ligatures, eg é to e and
+//	               æ to ae
+//	confusables    fold letters which look like latin ones, eg Cyrillic а
+//	               to a
+//	leetspeak      read digits and symbols as the letters they stand in for,
+//	               eg 4 to a and $ to s
+//
+// Steps always run in that order, whatever order they are listed in, as each
+// relies on the ones before it.
+package textnorm
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	ZeroWidth     = "zero_width"
+	NFKC          = "nfkc"
+	Transliterate = "transliterate"
+	Confusables   = "confusables"
+	Leetspeak     = "leetspeak"
+)
+
+// order is the order steps run in
+var order = []string{ZeroWidth, NFKC, Transliterate, Confusables, Leetspeak}
+
+// Steps is a list of normalization steps, by name
+type Steps []string
+
+// Check returns an error if any of the steps is not known
+func (s Steps) Check() error {
+	for _, name := range s {
+		if _, ok := steps[name]; !ok {
+			return fmt.Errorf("unknown normalization step %q (expected one of %s)", name, strings.Join(order, ", "))
+		}
+	}
+	return nil
+}
+
+// Apply normalizes text with the steps. Unknown steps are skipped.
+func (s Steps) Apply(text string) string {
+	if len(s) == 0 {
+		return text
+	}
+	for _, name := range order {
+		for _, want := range s {
+			if want == name {
+				text = steps[name](text)
+				break
+			}
+		}
+	}
+	return text
+}
+
+var steps = map[string]func(string) string{
+	ZeroWidth:     stripZeroWidth,
+	NFKC:          norm.NFKC.String,
+	Transliterate: transliterate,
+	Confusables:   mapRunes(confusables),
+	Leetspeak:     mapRunes(leetspeak),
+}
+
+// zeroWidth are the invisible characters which can be put between letters
+// without showing
+var zeroWidth = map[rune]bool{
+	'\u00ad': true, // soft hyphen
+	'\u034f': true, // combining grapheme joiner
+	'\u061c': true, // arabic letter mark
+	'\u115f': true, // hangul choseong filler
+	'\u1160': true, // hangul jungseong filler
+	'\u180e': true, // mongolian vowel separator
+	'\u200b': true, // zero width space
+	'\u200c': true, // zero width non-joiner
+	'\u200d': true, // zero width joiner
+	'\u200e': true, // left-to-right mark
+	'\u200f': true, // right-to-left mark
+	'\u2060': true, // word joiner
+	'\u2061': true, // function application
+	'\u2062': true, // invisible times
+	'\u2063': true, // invisible separator
+	'\u2064': true, // invisible plus
+	'\u3164': true, // hangul filler
+	'\ufeff': true, // zero width no-break space
+}
+
+func stripZeroWidth(text string) string {
+	return strings.Map(func(r rune) rune {
+		// variation selectors and tags are invisible too
+		if zeroWidth[r] || unicode.Is(unicode.Variation_Selector, r) || (r >= 0xe0000 && r <= 0xe007f) {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+// ligatures are the letters NFD doesn't decompose, spelled out
+var ligatures = strings.NewReplacer(
+	"ß", "ss", "æ", "ae", "Æ", "AE", "œ", "oe", "Œ", "OE",
+	"ø", "o", "Ø", "O", "ł", "l", "Ł", "L", "đ", "d", "Đ", "D",
+	"þ", "th", "Þ", "TH", "ð", "d", "Ð", "D", "ı", "i", "ħ", "h", "Ħ", "H",
+)
+
+func transliterate(text string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	if out, _, err := transform.String(t, text); err == nil {
+		text = out
+	}
+	return ligatures.Replace(text)
+}
+
+func mapRunes(m map[rune]rune) func(string) string {
+	return func(text string) string {
+		return strings.Map(func(r rune) rune {
+			if to, ok := m[r]; ok {
+				return to
+			}
+			return r
+		}, text)
+	}
+}
+
+// confusables are letters of other scripts which look like latin letters,
+// and the letters they look like. It isn't the full list of unicode
+// confusables (UTS #39), which has many that only look alike in some fonts.
+var confusables = map[rune]rune{
+	// cyrillic
+	'а': 'a', 'А': 'A', 'В': 'B', 'с': 'c', 'С': 'C', 'ԁ': 'd', 'е': 'e', 'Е': 'E',
+	'һ': 'h', 'Н': 'H', 'і': 'i', 'І': 'I', 'ј': 'j', 'Ј': 'J', 'К': 'K', 'к': 'k',
+	'М': 'M', 'о': 'o', 'О': 'O', 'р': 'p', 'Р': 'P', 'ԛ': 'q', 'ѕ': 's', 'Ѕ': 'S',
+	'Т': 'T', 'у': 'y', 'У': 'Y', 'х': 'x', 'Х': 'X', 'ԝ': 'w', 'Ԝ': 'W', 'ү': 'y',
+	// greek
+	'α': 'a', 'Α': 'A', 'Β': 'B', 'ε': 'e', 'Ε': 'E', 'Ζ': 'Z', 'Η': 'H', 'ι': 'i',
+	'Ι': 'I', 'Κ': 'K', 'κ': 'k', 'Μ': 'M', 'Ν': 'N', 'ν': 'v', 'ο': 'o', 'Ο': 'O',
+	'ρ': 'p', 'Ρ': 'P', 'Τ': 'T', 'τ': 't', 'υ': 'u', 'Υ': 'Y', 'Χ': 'X', 'χ': 'x',
+	// latin letters from other blocks
+	'ɑ': 'a', 'ɡ': 'g', 'ɩ': 'i', 'ɪ': 'i', 'ʟ': 'l', 'ɴ': 'n', 'ʀ': 'r', 'ʏ': 'y',
+	'ꓲ': 'I', 'ǀ': 'l',
+}
+
+// leetspeak are the digits and symbols used for letters. Some stand in for
+// more than one (1 is i or l), and are read as the more common one.
+var leetspeak = map[rune]rune{
+	'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '8': 'b', '9': 'g',
+	'@': 'a', '$': 's', '!': 'i', '|': 'l', '+': 't', '€': 'e', '£': 'l',
+}
@@ -0,0 +1,40 @@
+package textnorm
+
+import (
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	all := Steps{Leetspeak, Confusables, Transliterate, NFKC, ZeroWidth}
+	cases := []struct {
+		steps Steps
+		in    string
+		out   string
+	}{
+		{nil, "ｆｒｅｅ\u200bbtc", "ｆｒｅｅ\u200bbtc"},
+		{Steps{ZeroWidth}, "fr\u200bee\u00adbt\ufeffc", "freebtc"},
+		{Steps{NFKC}, "ｆｒｅｅ 𝐛𝐭𝐜 ⓐⓘⓡⓓⓡⓞⓟ", "free btc airdrop"},
+		{Steps{Transliterate}, "crème brûlée, straße, Ærø", "creme brulee, strasse, AEro"},
+		{Steps{Confusables}, "аirdrоp frее", "airdrop free"},
+		{Steps{Leetspeak}, "41rdr0p fr33 $c4m", "airdrop free scam"},
+		// steps run in order: fullwidth digits are only leetspeak once they
+		// are folded
+		{all, "ｆｒ３\u200b３ ａіrdrоp", "free airdrop"},
+		// steps not asked for are left out
+		{Steps{ZeroWidth, NFKC}, "fr33 ѕcam", "fr33 ѕcam"},
+	}
+	for _, c := range cases {
+		if out := c.steps.Apply(c.in); out != c.out {
+			t.Errorf("%v %q: expected %q, got %q", c.steps, c.in, c.out, out)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	if err := (Steps{ZeroWidth, NFKC, Transliterate, Confusables, Leetspeak}).Check(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (Steps{NFKC, "nfd"}).Check(); err == nil {
+		t.Fatal("expected an error for an unknown step")
+	}
+}
@@ -1,30 +1,29 @@
 package util
 
 import (
-	"fmt"
-	"strings"
+	"github.com/bluesky-social/indigo/util/aturi"
 )
 
+// ParsedUri is the URI of a record. Did is the URI's authority, which may be
+// a handle.
 type ParsedUri struct {
 	Did        string
 	Collection string
 	Rkey       string
 }
 
+// ParseAtUri parses and validates the at:// URI of a record. See the aturi
+// package for URIs of accounts and collections, and for the errors it fails
+// with.
 func ParseAtUri(uri string) (*ParsedUri, error) {
-	if !strings.HasPrefix(uri, "at://") {
-		return nil, fmt.Errorf("AT uris must be prefixed with 'at://'")
-	}
-
-	trimmed := strings.TrimPrefix(uri, "at://")
-	parts := strings.Split(trimmed, "/")
-	if len(parts) != 3 {
-		return nil, fmt.Errorf("AT uris must have three parts: did, collection, tid")
+	u, err := aturi.ParseRecord(uri)
+	if err != nil {
+		return nil, err
 	}
 
 	return &ParsedUri{
-		Did:        parts[0],
-		Collection: parts[1],
-		Rkey:       parts[2],
+		Did:        u.Authority,
+		Collection: u.Collection,
+		Rkey:       u.RecordKey,
 	}, nil
 }
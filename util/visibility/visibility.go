@@ -0,0 +1,284 @@
+// Package visibility decides what a viewer is shown of other accounts and
+// their content, from the blocks and mutes between them and the labels on
+// the accounts, so that every view of an appview applies the same rules.
+//
+// The rules are a table, Rules, of the action to take for each condition in
+// each context content is shown in. Decide applies them to what is known of
+// a subject; Filter finds that out for many subjects at once.
+package visibility
+
+import (
+	"context"
+)
+
+// Context is where content is being shown
+type Context string
+
+const (
+	// ContextFeed is timelines and feeds
+	ContextFeed Context = "feed"
+
+	// ContextThread is the replies and parents of a post thread
+	ContextThread Context = "thread"
+
+	// ContextProfile is the subject's own profile and author feed
+	ContextProfile Context = "profile"
+
+	// ContextNotification is the viewer's notifications
+	ContextNotification Context = "notification"
+
+	// ContextList is lists of accounts, such as followers and search results
+	ContextList Context = "list"
+)
+
+// Action is what is done with a subject's content. Actions are ordered by
+// severity.
+type Action int
+
+const (
+	// Show shows the content
+	Show Action = iota
+
+	// Warn shows the content behind a warning, or shows that there is
+	// content without showing it
+	Warn
+
+	// Hide leaves the content out
+	Hide
+)
+
+func (a Action) String() string {
+	switch a {
+	case Show:
+		return "show"
+	case Warn:
+		return "warn"
+	case Hide:
+		return "hide"
+	default:
+		return "unknown"
+	}
+}
+
+// Condition is something about a subject, as seen by a viewer, that affects
+// what they are shown
+type Condition string
+
+const (
+	// Blocking is the viewer blocking the subject
+	Blocking Condition = "blocking"
+
+	// BlockedBy is the subject blocking the viewer
+	BlockedBy Condition = "blocked-by"
+
+	// Muted is the viewer muting the subject, directly or by a list
+	Muted Condition = "muted"
+
+	// LabelHide is a label on the subject which the viewer hides, or which
+	// hides it from everyone (!hide)
+	LabelHide Condition = "label-hide"
+
+	// LabelWarn is a label on the subject which the viewer is warned of, or
+	// which warns everyone (!warn)
+	LabelWarn Condition = "label-warn"
+)
+
+// Rules are the action taken on a condition in each context. Contexts not
+// given show the content.
+//
+// Blocks work both ways, and hide content except on the subject's profile,
+// where the block itself is shown. Mutes are one way, and quieter: muted
+// accounts are still found in threads, behind a warning, and in lists.
+var Rules = map[Condition]map[Context]Action{
+	Blocking: {
+		ContextFeed:         Hide,
+		ContextThread:       Hide,
+		ContextProfile:      Warn,
+		ContextNotification: Hide,
+		ContextList:         Warn,
+	},
+	BlockedBy: {
+		ContextFeed:         Hide,
+		ContextThread:       Hide,
+		ContextProfile:      Warn,
+		ContextNotification: Hide,
+		ContextList:         Warn,
+	},
+	Muted: {
+		ContextFeed:         Hide,
+		ContextThread:       Warn,
+		ContextNotification: Hide,
+	},
+	LabelHide: {
+		ContextFeed:         Hide,
+		ContextThread:       Hide,
+		ContextProfile:      Warn,
+		ContextNotification: Hide,
+		ContextList:         Hide,
+	},
+	LabelWarn: {
+		ContextFeed:         Warn,
+		ContextThread:       Warn,
+		ContextProfile:      Warn,
+		ContextNotification: Warn,
+		ContextList:         Warn,
+	},
+}
+
+// Subject is what is known of an account, as seen by a viewer
+type Subject struct {
+	Did string
+
+	Blocking  bool
+	BlockedBy bool
+	Muted     bool
+
+	// Labels are the values of the labels on the account
+	Labels []string
+}
+
+// LabelPrefs are a viewer's preferences for labels, by label value: "show",
+// "warn", "hide" or "ignore", as in app.bsky.actor.defs#contentLabelPref.
+// Labels without one are ignored.
+type LabelPrefs map[string]string
+
+// Decision is what to do with a subject's content, and why
+type Decision struct {
+	Action Action
+
+	// Reasons are the conditions which applied to the subject, whatever
+	// their action
+	Reasons []Condition
+}
+
+// Decide returns what a viewer is shown of a subject in a context. Viewers
+// are always shown their own content.
+func Decide(viewer string, c Context, subj *Subject, prefs LabelPrefs) Decision {
+	var d Decision
+	if viewer != "" && viewer == subj.Did {
+		return d
+	}
+
+	apply := func(cond Condition) {
+		d.Reasons = append(d.Reasons, cond)
+		if a := Rules[cond][c]; a > d.Action {
+			d.Action = a
+		}
+	}
+
+	if subj.Blocking {
+		apply(Blocking)
+	}
+	if subj.BlockedBy {
+		apply(BlockedBy)
+	}
+	if subj.Muted {
+		apply(Muted)
+	}
+
+	var hide, warn bool
+	for _, l := range subj.Labels {
+		switch {
+		case l == "!hide" || prefs[l] == "hide":
+			hide = true
+		case l == "!warn" || prefs[l] == "warn":
+			warn = true
+		}
+	}
+	if hide {
+		apply(LabelHide)
+	}
+	if warn {
+		apply(LabelWarn)
+	}
+
+	return d
+}
+
+// GraphSource hydrates how a viewer and subjects are related
+type GraphSource interface {
+	// Relationships returns the subjects, by DID, with their blocks and
+	// mutes with the viewer filled in. Subjects left out are unrelated.
+	Relationships(ctx context.Context, viewer string, dids []string) (map[string]*Subject, error)
+}
+
+// LabelSource hydrates the labels on accounts
+type LabelSource interface {
+	// Labels returns the values of the labels on each account, by DID
+	Labels(ctx context.Context, dids []string) (map[string][]string, error)
+}
+
+// Filter decides what viewers are shown of many subjects at once, hydrating
+// what it needs from its sources
+type Filter struct {
+	Graph GraphSource
+
+	// Labels may be nil, for appviews without labels
+	Labels LabelSource
+}
+
+// Decide returns the decision for each of the subjects, by DID
+func (f *Filter) Decide(ctx context.Context, viewer string, c Context, dids []string, prefs LabelPrefs) (map[string]Decision, error) {
+	dids = dedupe(dids)
+
+	subjects := map[string]*Subject{}
+	if viewer != "" && f.Graph != nil {
+		var err error
+		subjects, err = f.Graph.Relationships(ctx, viewer, dids)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var labels map[string][]string
+	if f.Labels != nil {
+		var err error
+		labels, err = f.Labels.Labels(ctx, dids)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	out := make(map[string]Decision, len(dids))
+	for _, did := range dids {
+		subj := Subject{Did: did}
+		if s := subjects[did]; s != nil {
+			subj = *s
+		}
+		subj.Labels = append(subj.Labels[:len(subj.Labels):len(subj.Labels)], labels[did]...)
+		out[did] = Decide(viewer, c, &subj, prefs)
+	}
+	return out, nil
+}
+
+// Visible returns the items whose subjects are not hidden, in order. Items
+// may have several subjects, such as a repost and the post reposted, and are
+// hidden if any of them are.
+func Visible[T any](decisions map[string]Decision, items []T, subjects func(T) []string) []T {
+	out := make([]T, 0, len(items))
+	for _, it := range items {
+		hidden := false
+		for _, did := range subjects(it) {
+			if decisions[did].Action == Hide {
+				hidden = true
+				break
+			}
+		}
+		if !hidden {
+			out = append(out, it)
+		}
+	}
+	return out
+}
+
+func dedupe(dids []string) []string {
+	seen := make(map[string]bool, len(dids))
+	out := make([]string, 0, len(dids))
+	for _, d := range dids {
+		if !seen[d] {
+			seen[d] = true
+			out = append(out, d)
+		}
+	}
+	return out
+}
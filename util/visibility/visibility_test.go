@@ -0,0 +1,93 @@
+package visibility
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecide(t *testing.T) {
+	prefs := LabelPrefs{"gore": "hide", "nudity": "warn", "spam": "ignore"}
+
+	tests := []struct {
+		name    string
+		ctx     Context
+		subj    Subject
+		action  Action
+		reasons []Condition
+	}{
+		{"unrelated", ContextFeed, Subject{Did: "did:plc:bob"}, Show, nil},
+		{"own content", ContextFeed, Subject{Did: "did:plc:alice", Blocking: true, Labels: []string{"!hide"}}, Show, nil},
+		{"blocking in feed", ContextFeed, Subject{Did: "did:plc:bob", Blocking: true}, Hide, []Condition{Blocking}},
+		{"blocking on profile", ContextProfile, Subject{Did: "did:plc:bob", Blocking: true}, Warn, []Condition{Blocking}},
+		{"blocked by in thread", ContextThread, Subject{Did: "did:plc:bob", BlockedBy: true}, Hide, []Condition{BlockedBy}},
+		{"blocked by in list", ContextList, Subject{Did: "did:plc:bob", BlockedBy: true}, Warn, []Condition{BlockedBy}},
+		{"muted in feed", ContextFeed, Subject{Did: "did:plc:bob", Muted: true}, Hide, []Condition{Muted}},
+		{"muted in thread", ContextThread, Subject{Did: "did:plc:bob", Muted: true}, Warn, []Condition{Muted}},
+		{"muted on profile", ContextProfile, Subject{Did: "did:plc:bob", Muted: true}, Show, []Condition{Muted}},
+		{"muted in notifications", ContextNotification, Subject{Did: "did:plc:bob", Muted: true}, Hide, []Condition{Muted}},
+		{"hidden label", ContextFeed, Subject{Did: "did:plc:bob", Labels: []string{"gore"}}, Hide, []Condition{LabelHide}},
+		{"hidden label on profile", ContextProfile, Subject{Did: "did:plc:bob", Labels: []string{"gore"}}, Warn, []Condition{LabelHide}},
+		{"warned label", ContextFeed, Subject{Did: "did:plc:bob", Labels: []string{"nudity"}}, Warn, []Condition{LabelWarn}},
+		{"ignored label", ContextFeed, Subject{Did: "did:plc:bob", Labels: []string{"spam", "unknown"}}, Show, nil},
+		{"!hide for everyone", ContextList, Subject{Did: "did:plc:bob", Labels: []string{"!hide"}}, Hide, []Condition{LabelHide}},
+		{"!warn for everyone", ContextThread, Subject{Did: "did:plc:bob", Labels: []string{"!warn"}}, Warn, []Condition{LabelWarn}},
+		{"most severe wins", ContextThread, Subject{Did: "did:plc:bob", Muted: true, Blocking: true}, Hide, []Condition{Blocking, Muted}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := Decide("did:plc:alice", tc.ctx, &tc.subj, prefs)
+			assert.Equal(t, tc.action, d.Action)
+			assert.Equal(t, tc.reasons, d.Reasons)
+		})
+	}
+}
+
+type testGraph map[string]*Subject
+
+func (g testGraph) Relationships(ctx context.Context, viewer string, dids []string) (map[string]*Subject, error) {
+	out := map[string]*Subject{}
+	for _, d := range dids {
+		if s := g[d]; s != nil {
+			out[d] = s
+		}
+	}
+	return out, nil
+}
+
+type testLabels map[string][]string
+
+func (l testLabels) Labels(ctx context.Context, dids []string) (map[string][]string, error) {
+	return l, nil
+}
+
+func TestFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	f := &Filter{
+		Graph:  testGraph{"did:plc:blocked": {Did: "did:plc:blocked", Blocking: true}},
+		Labels: testLabels{"did:plc:labeled": {"!hide"}},
+	}
+	dids := []string{"did:plc:bob", "did:plc:blocked", "did:plc:labeled", "did:plc:bob"}
+	decisions, err := f.Decide(context.Background(), "did:plc:alice", ContextFeed, dids, nil)
+	assert.NoError(err)
+	assert.Len(decisions, 3)
+
+	type item struct{ author, reposter string }
+	items := []item{
+		{"did:plc:bob", ""},
+		{"did:plc:blocked", ""},
+		{"did:plc:bob", "did:plc:labeled"},
+		{"did:plc:bob", "did:plc:bob"},
+	}
+	visible := Visible(decisions, items, func(it item) []string { return []string{it.author, it.reposter} })
+	assert.Equal([]item{{"did:plc:bob", ""}, {"did:plc:bob", "did:plc:bob"}}, visible)
+
+	// without a viewer, only labels apply
+	decisions, err = f.Decide(context.Background(), "", ContextFeed, dids, nil)
+	assert.NoError(err)
+	assert.Equal(Show, decisions["did:plc:blocked"].Action)
+	assert.Equal(Hide, decisions["did:plc:labeled"].Action)
+}
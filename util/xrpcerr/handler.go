@@ -0,0 +1,45 @@
+package xrpcerr
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/exp/slog"
+)
+
+// body is a lexicon error body
+type body struct {
+	Error   string `json:"error"`
+	Message string `json:"message,omitempty"`
+}
+
+// ErrorHandler returns an echo error handler sending handler errors as XRPC
+// errors, see From. Internal errors are logged with their cause at error
+// level, and other errors at info level. Nothing is sent for websocket
+// requests, whose connection has either been taken over or already been
+// answered by the upgrader.
+func ErrorHandler(logger *slog.Logger, mappings ...Mapping) echo.HTTPErrorHandler {
+	return func(err error, c echo.Context) {
+		xe := From(err, mappings...)
+
+		ctx := c.Request().Context()
+		if xe.Status >= 500 {
+			logger.ErrorCtx(ctx, "handler error", "path", c.Path(), "status", xe.Status, "error", xe.Name, "err", err)
+		} else {
+			logger.InfoCtx(ctx, "request error", "path", c.Path(), "status", xe.Status, "error", xe.Name, "err", err)
+		}
+
+		if c.Response().Committed || c.IsWebSocket() {
+			return
+		}
+
+		if c.Request().Method == http.MethodHead {
+			err = c.NoContent(xe.Status)
+		} else {
+			err = c.JSON(xe.Status, body{Error: xe.Name, Message: xe.Message})
+		}
+		if err != nil {
+			logger.ErrorCtx(ctx, "failed to write error response", "path", c.Path(), "err", err)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Package xrpcerr has the errors returned by XRPC handlers. ErrorHandler sends
+// them to clients as lexicon error bodies, {"error": name, "message": message},
+// and logs their internal causes, which are never sent.
+package xrpcerr
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Error names which any XRPC method may return
+const (
+	NameInvalidRequest       = "InvalidRequest"
+	NameAuthRequired         = "AuthenticationRequired"
+	NameForbidden            = "Forbidden"
+	NameNotFound             = "NotFound"
+	NameXRPCNotSupported     = "XRPCNotSupported"
+	NamePayloadTooLarge      = "PayloadTooLarge"
+	NameRateLimitExceeded    = "RateLimitExceeded"
+	NameInternalServerError  = "InternalServerError"
+	NameMethodNotImplemented = "MethodNotImplemented"
+	NameUpstreamFailure      = "UpstreamFailure"
+	NameNotEnoughResources   = "NotEnoughResources"
+	NameUpstreamTimeout      = "UpstreamTimeout"
+)
+
+// Error is an XRPC error response. Name is either one of the well-known names
+// above or one declared by the method's lexicon, such as RepoNotFound.
+type Error struct {
+	Status  int
+	Name    string
+	Message string
+
+	// Err is the internal cause of the error, which is logged but not sent
+	Err error
+}
+
+func (e *Error) Error() string {
+	s := e.Name
+	if e.Message != "" {
+		s += ": " + e.Message
+	}
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is matches errors with the same status and name, so that declared errors
+// can be checked for with errors.Is whatever their message or cause
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Status == e.Status && t.Name == e.Name
+}
+
+// Wrap returns a copy of e with err as its internal cause
+func (e *Error) Wrap(err error) *Error {
+	out := *e
+	out.Err = err
+	return &out
+}
+
+func New(status int, name, message string) *Error {
+	return &Error{
+		Status:  status,
+		Name:    name,
+		Message: message,
+	}
+}
+
+func InvalidRequest(format string, args ...any) *Error {
+	return New(http.StatusBadRequest, NameInvalidRequest, fmt.Sprintf(format, args...))
+}
+
+func AuthRequired(format string, args ...any) *Error {
+	return New(http.StatusUnauthorized, NameAuthRequired, fmt.Sprintf(format, args...))
+}
+
+func Forbidden(format string, args ...any) *Error {
+	return New(http.StatusForbidden, NameForbidden, fmt.Sprintf(format, args...))
+}
+
+func NotFound(format string, args ...any) *Error {
+	return New(http.StatusNotFound, NameNotFound, fmt.Sprintf(format, args...))
+}
+
+func MethodNotImplemented(format string, args ...any) *Error {
+	return New(http.StatusNotImplemented, NameMethodNotImplemented, fmt.Sprintf(format, args...))
+}
+
+// Internal wraps an unexpected error, whose details are only logged
+func Internal(err error) *Error {
+	return New(http.StatusInternalServerError, NameInternalServerError, "internal server error").Wrap(err)
+}
+
+// Mapping sends errors matching Target (with errors.Is) as XRPC errors with
+// the given status and name, for a service's own errors which are returned
+// from more than just its handlers
+type Mapping struct {
+	Target error
+	Status int
+	Name   string
+}
+
+// Map creates a Mapping. The message sent is the target's.
+func Map(target error, status int, name string) Mapping {
+	return Mapping{Target: target, Status: status, Name: name}
+}
+
+// echoNames are the names given to the errors echo and its middleware return
+var echoNames = map[int]string{
+	http.StatusBadRequest:            NameInvalidRequest,
+	http.StatusUnauthorized:          NameAuthRequired,
+	http.StatusForbidden:             NameForbidden,
+	http.StatusNotFound:              NameXRPCNotSupported,
+	http.StatusMethodNotAllowed:      NameInvalidRequest,
+	http.StatusRequestEntityTooLarge: NamePayloadTooLarge,
+	http.StatusUnsupportedMediaType:  NameInvalidRequest,
+	http.StatusTooManyRequests:       NameRateLimitExceeded,
+	http.StatusNotImplemented:        NameMethodNotImplemented,
+	http.StatusBadGateway:            NameUpstreamFailure,
+	http.StatusServiceUnavailable:    NameNotEnoughResources,
+	http.StatusGatewayTimeout:        NameUpstreamTimeout,
+}
+
+// From converts any error returned by a handler to the XRPC error sent for
+// it. Errors which are neither an *Error, a mapped error nor an
+// *echo.HTTPError are internal errors.
+func From(err error, mappings ...Mapping) *Error {
+	var xe *Error
+	if errors.As(err, &xe) {
+		return xe
+	}
+
+	for _, m := range mappings {
+		if errors.Is(err, m.Target) {
+			return New(m.Status, m.Name, m.Target.Error()).Wrap(err)
+		}
+	}
+
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		name, ok := echoNames[he.Code]
+		if !ok {
+			if he.Code < 500 {
+				name = NameInvalidRequest
+			} else {
+				name = NameInternalServerError
+			}
+		}
+		msg := http.StatusText(he.Code)
+		if s, ok := he.Message.(string); ok {
+			msg = s
+		}
+		return New(he.Code, name, msg).Wrap(he.Internal)
+	}
+
+	return Internal(err)
+}
+
+// Status returns the status of the response sent for an error
+func Status(err error, mappings ...Mapping) int {
+	return From(err, mappings...).Status
+}
@@ -0,0 +1,96 @@
+package xrpcerr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/exp/slog"
+)
+
+var errNoSuchThing = errors.New("no such thing")
+
+func TestErrorHandler(t *testing.T) {
+	e := echo.New()
+	e.HTTPErrorHandler = ErrorHandler(slog.Default(), Map(errNoSuchThing, http.StatusNotFound, "ThingNotFound"))
+
+	e.GET("/xrpc/test.invalid", func(c echo.Context) error {
+		return InvalidRequest("bad param %q", "x")
+	})
+	e.GET("/xrpc/test.mapped", func(c echo.Context) error {
+		return fmt.Errorf("looking up thing: %w", errNoSuchThing)
+	})
+	e.GET("/xrpc/test.internal", func(c echo.Context) error {
+		return fmt.Errorf("connecting to db at secret-host: refused")
+	})
+	e.GET("/xrpc/test.echo", func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "body too big")
+	})
+	e.GET("/xrpc/test.wrapped", func(c echo.Context) error {
+		return New(http.StatusBadRequest, "RepoDeactivated", "repo has been deactivated").Wrap(errors.New("status deactivated"))
+	})
+
+	for _, tc := range []struct {
+		path    string
+		status  int
+		name    string
+		message string
+	}{
+		{"/xrpc/test.invalid", 400, NameInvalidRequest, `bad param "x"`},
+		{"/xrpc/test.mapped", 404, "ThingNotFound", "no such thing"},
+		{"/xrpc/test.internal", 500, NameInternalServerError, "internal server error"},
+		{"/xrpc/test.echo", 413, NamePayloadTooLarge, "body too big"},
+		{"/xrpc/test.wrapped", 400, "RepoDeactivated", "repo has been deactivated"},
+		{"/xrpc/test.missing", 404, NameXRPCNotSupported, "Not Found"},
+	} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+
+		if rec.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.path, tc.status, rec.Code)
+		}
+		var b body
+		if err := json.Unmarshal(rec.Body.Bytes(), &b); err != nil {
+			t.Fatalf("%s: %s", tc.path, err)
+		}
+		if b.Error != tc.name || b.Message != tc.message {
+			t.Errorf("%s: unexpected body %+v", tc.path, b)
+		}
+		if strings.Contains(rec.Body.String(), "secret-host") {
+			t.Errorf("%s: internal details were sent: %s", tc.path, rec.Body.String())
+		}
+	}
+
+	// websocket upgrades answer for themselves
+	req := httptest.NewRequest(http.MethodGet, "/xrpc/test.internal", nil)
+	req.Header.Set("Upgrade", "websocket")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Body.Len() != 0 {
+		t.Errorf("expected nothing to be written for a websocket, got %q", rec.Body.String())
+	}
+}
+
+func TestErrorIs(t *testing.T) {
+	declared := New(http.StatusUnauthorized, "ExpiredToken", "token has expired")
+	err := fmt.Errorf("checking token: %w", New(http.StatusUnauthorized, "ExpiredToken", "another message"))
+	if !errors.Is(err, declared) {
+		t.Fatal("expected errors with the same status and name to match")
+	}
+	if errors.Is(err, New(http.StatusUnauthorized, "InvalidToken", "")) {
+		t.Fatal("expected errors with other names not to match")
+	}
+
+	cause := errors.New("cause")
+	if !errors.Is(Internal(cause), cause) {
+		t.Fatal("expected the cause to be unwrapped")
+	}
+	if got := Status(cause); got != 500 {
+		t.Fatalf("expected unknown errors to be internal, got %d", got)
+	}
+}
@@ -0,0 +1,95 @@
+package xrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// AuthManager holds the session for a Client, and refreshes it using the
+// refresh token whenever a request fails because the access token has
+// expired. It is safe for concurrent use: requests that fail at the same time
+// wait on a single refresh, then retry with the new token.
+type AuthManager struct {
+	lk        sync.Mutex
+	auth      AuthInfo
+	onRefresh func(ctx context.Context, auth *AuthInfo) error
+}
+
+// NewAuthManager creates an AuthManager starting from the given session.
+// onRefresh, if not nil, is called with the new session after every refresh
+// so that it can be persisted. If it returns an error the request that
+// triggered the refresh fails, but the new session is still used.
+func NewAuthManager(auth *AuthInfo, onRefresh func(ctx context.Context, auth *AuthInfo) error) *AuthManager {
+	return &AuthManager{
+		auth:      *auth,
+		onRefresh: onRefresh,
+	}
+}
+
+// AuthInfo returns a copy of the current session
+func (am *AuthManager) AuthInfo() *AuthInfo {
+	am.lk.Lock()
+	defer am.lk.Unlock()
+
+	auth := am.auth
+	return &auth
+}
+
+func (am *AuthManager) accessToken() string {
+	am.lk.Lock()
+	defer am.lk.Unlock()
+
+	return am.auth.AccessJwt
+}
+
+// refresh replaces the session, unless the expired access token has already
+// been replaced by another request
+func (am *AuthManager) refresh(ctx context.Context, c *Client, expired string) error {
+	am.lk.Lock()
+	defer am.lk.Unlock()
+
+	if am.auth.AccessJwt != expired {
+		return nil
+	}
+
+	// sessions belong to the PDS, so this must not be proxied
+	var out AuthInfo
+	if _, err := c.doRequest(WithProxy(ctx, ""), "POST", "", "com.atproto.server.refreshSession", "com.atproto.server.refreshSession", nil, "Bearer "+am.auth.RefreshJwt, &out); err != nil {
+		return err
+	}
+
+	if out.AccessJwt == "" || out.RefreshJwt == "" {
+		return fmt.Errorf("refreshSession response was missing tokens")
+	}
+
+	if out.Did == "" {
+		out.Did = am.auth.Did
+	}
+	if out.Handle == "" {
+		out.Handle = am.auth.Handle
+	}
+
+	am.auth = out
+
+	if am.onRefresh != nil {
+		auth := out
+		if err := am.onRefresh(ctx, &auth); err != nil {
+			return fmt.Errorf("persisting refreshed session: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// isExpiredToken reports whether a request failed because its access token
+// was no longer accepted
+func isExpiredToken(status int, err error) bool {
+	if status == 401 {
+		return true
+	}
+
+	var xe *XRPCError
+	return errors.As(err, &xe) && xe.ErrStr == "ExpiredToken"
+}
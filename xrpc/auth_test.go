@@ -0,0 +1,97 @@
+package xrpc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestAuthManagerRefresh(t *testing.T) {
+	var refreshes int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authz := r.Header.Get("Authorization")
+		switch r.URL.Path {
+		case "/xrpc/com.atproto.server.refreshSession":
+			if authz != "Bearer refresh1" {
+				w.WriteHeader(400)
+				json.NewEncoder(w).Encode(&XRPCError{ErrStr: "InvalidToken", Message: "bad refresh token"})
+				return
+			}
+			atomic.AddInt32(&refreshes, 1)
+			json.NewEncoder(w).Encode(&AuthInfo{AccessJwt: "access2", RefreshJwt: "refresh2", Did: "did:plc:foo"})
+		case "/xrpc/com.example.echo":
+			if authz != "Bearer access2" {
+				w.WriteHeader(400)
+				json.NewEncoder(w).Encode(&XRPCError{ErrStr: "ExpiredToken", Message: "token has expired"})
+				return
+			}
+			var body map[string]any
+			if r.Method == "POST" {
+				json.NewDecoder(r.Body).Decode(&body)
+			}
+			json.NewEncoder(w).Encode(body)
+		}
+	}))
+	defer srv.Close()
+
+	var persisted []*AuthInfo
+	var lk sync.Mutex
+	am := NewAuthManager(&AuthInfo{
+		AccessJwt:  "access1",
+		RefreshJwt: "refresh1",
+		Handle:     "foo.test",
+		Did:        "did:plc:foo",
+	}, func(ctx context.Context, auth *AuthInfo) error {
+		lk.Lock()
+		defer lk.Unlock()
+		persisted = append(persisted, auth)
+		return nil
+	})
+
+	c := &Client{
+		Host:        srv.URL,
+		AuthManager: am,
+	}
+
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var out map[string]any
+			if err := c.Do(ctx, Procedure, "application/json", "com.example.echo", nil, map[string]any{"a": "b"}, &out); err != nil {
+				errs <- err
+				return
+			}
+			if out["a"] != "b" {
+				errs <- &XRPCError{ErrStr: "BadBody", Message: "body was not resent"}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	if n := atomic.LoadInt32(&refreshes); n != 1 {
+		t.Fatalf("expected a single refresh, got %d", n)
+	}
+
+	if len(persisted) != 1 || persisted[0].RefreshJwt != "refresh2" {
+		t.Fatalf("expected the new session to be persisted once, got %v", persisted)
+	}
+
+	auth := am.AuthInfo()
+	if auth.AccessJwt != "access2" || auth.Handle != "foo.test" {
+		t.Fatalf("unexpected session after refresh: %+v", auth)
+	}
+}
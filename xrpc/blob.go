@@ -0,0 +1,132 @@
+package xrpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// StreamOptions controls a streamed upload or download
+type StreamOptions struct {
+	// Size is the length of an upload, if known. Servers can reject
+	// oversized blobs up front when it is set.
+	Size int64
+
+	// MaxSize, if set, fails transfers larger than this many bytes
+	MaxSize int64
+
+	// Progress, if set, is called with the number of bytes transferred so
+	// far as the transfer goes on
+	Progress func(n int64)
+}
+
+// uploadBody streams a request body, keeping track of the bytes sent
+type uploadBody struct {
+	r    io.Reader
+	size int64
+	max  int64
+	n    int64
+	cb   func(int64)
+}
+
+func (ub *uploadBody) Read(p []byte) (int, error) {
+	n, err := ub.r.Read(p)
+	ub.n += int64(n)
+	if ub.max > 0 && ub.n > ub.max {
+		return n, fmt.Errorf("upload is larger than the %d byte limit", ub.max)
+	}
+	if ub.cb != nil && n > 0 {
+		ub.cb(ub.n)
+	}
+	return n, err
+}
+
+// downloadWriter streams a response body into w, keeping track of the bytes
+// received
+type downloadWriter struct {
+	w   io.Writer
+	max int64
+	n   int64
+	cb  func(int64)
+}
+
+func (dw *downloadWriter) Write(p []byte) (int, error) {
+	if dw.max > 0 && dw.n+int64(len(p)) > dw.max {
+		return 0, fmt.Errorf("download is larger than the %d byte limit", dw.max)
+	}
+
+	n, err := dw.w.Write(p)
+	dw.n += int64(n)
+	if dw.cb != nil && n > 0 {
+		dw.cb(dw.n)
+	}
+	return n, err
+}
+
+func (dw *downloadWriter) readFrom(resp *http.Response) error {
+	if dw.max > 0 && resp.ContentLength > dw.max {
+		return fmt.Errorf("download of %d bytes is larger than the %d byte limit", resp.ContentLength, dw.max)
+	}
+
+	if _, err := io.Copy(dw, resp.Body); err != nil {
+		return fmt.Errorf("reading response body: %w", err)
+	}
+
+	if resp.ContentLength >= 0 && dw.n != resp.ContentLength {
+		return fmt.Errorf("reading length delimited response body (%d < %d): %w", dw.n, resp.ContentLength, io.ErrUnexpectedEOF)
+	}
+
+	return nil
+}
+
+// UploadStream calls a procedure that takes a blob, like
+// com.atproto.repo.uploadBlob, reading the blob from r as it is sent rather
+// than buffering it. The response is decoded into out. As r can only be read
+// once, the request is not retried.
+func (c *Client) UploadStream(ctx context.Context, method string, mimeType string, r io.Reader, opts *StreamOptions, out interface{}) error {
+	if opts == nil {
+		opts = &StreamOptions{}
+	}
+
+	if opts.MaxSize > 0 && opts.Size > opts.MaxSize {
+		return fmt.Errorf("upload of %d bytes is larger than the %d byte limit", opts.Size, opts.MaxSize)
+	}
+
+	size := int64(-1)
+	if opts.Size > 0 {
+		size = opts.Size
+	}
+
+	body := &uploadBody{
+		r:    r,
+		size: size,
+		max:  opts.MaxSize,
+		cb:   opts.Progress,
+	}
+
+	return c.Do(ctx, Procedure, mimeType, method, nil, body, out)
+}
+
+// DownloadStream calls a query that returns a blob, like
+// com.atproto.sync.getBlob, writing the blob to w as it arrives rather than
+// buffering it. It returns the number of bytes written.
+func (c *Client) DownloadStream(ctx context.Context, method string, params map[string]interface{}, w io.Writer, opts *StreamOptions) (int64, error) {
+	if opts == nil {
+		opts = &StreamOptions{}
+	}
+
+	dw := &downloadWriter{
+		w:   w,
+		max: opts.MaxSize,
+		cb:  opts.Progress,
+	}
+
+	// retries only happen before any of the body has arrived, so nothing
+	// is written twice
+	if err := c.Do(ctx, Query, "", method, params, nil, dw); err != nil {
+		return dw.n, err
+	}
+
+	return dw.n, nil
+}
@@ -0,0 +1,79 @@
+package xrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBlobStreaming(t *testing.T) {
+	blob := bytes.Repeat([]byte("blobdata"), 64*1024)
+
+	var uploaded []byte
+	var contentType string
+	var contentLength int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/xrpc/com.atproto.repo.uploadBlob":
+			contentType = r.Header.Get("Content-Type")
+			contentLength = r.ContentLength
+			b, err := io.ReadAll(r.Body)
+			if err != nil {
+				w.WriteHeader(400)
+				return
+			}
+			uploaded = b
+			json.NewEncoder(w).Encode(map[string]any{"size": len(b)})
+		case "/xrpc/com.atproto.sync.getBlob":
+			w.Write(blob)
+		}
+	}))
+	defer srv.Close()
+
+	c := &Client{
+		Client: http.DefaultClient,
+		Host:   srv.URL,
+	}
+	ctx := context.Background()
+
+	var progress []int64
+	opts := &StreamOptions{
+		Size:     int64(len(blob)),
+		Progress: func(n int64) { progress = append(progress, n) },
+	}
+
+	var out map[string]int
+	if err := c.UploadStream(ctx, "com.atproto.repo.uploadBlob", "video/mp4", io.MultiReader(bytes.NewReader(blob)), opts, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(uploaded, blob) || out["size"] != len(blob) {
+		t.Fatal("uploaded blob did not match")
+	}
+	if contentType != "video/mp4" || contentLength != int64(len(blob)) {
+		t.Fatalf("unexpected upload headers: %s %d", contentType, contentLength)
+	}
+	if len(progress) == 0 || progress[len(progress)-1] != int64(len(blob)) {
+		t.Fatalf("expected progress up to %d, got %v", len(blob), progress)
+	}
+
+	if err := c.UploadStream(ctx, "com.atproto.repo.uploadBlob", "video/mp4", io.MultiReader(bytes.NewReader(blob)), &StreamOptions{MaxSize: 1000}, &out); err == nil {
+		t.Fatal("expected oversized upload to fail")
+	}
+
+	buf := new(bytes.Buffer)
+	n, err := c.DownloadStream(ctx, "com.atproto.sync.getBlob", map[string]interface{}{"did": "did:plc:foo", "cid": "bafy"}, buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(blob)) || !bytes.Equal(buf.Bytes(), blob) {
+		t.Fatal("downloaded blob did not match")
+	}
+
+	if _, err := c.DownloadStream(ctx, "com.atproto.sync.getBlob", nil, io.Discard, &StreamOptions{MaxSize: 1000}); err == nil {
+		t.Fatal("expected oversized download to fail")
+	}
+}
@@ -0,0 +1,75 @@
+package xrpc
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Interceptor wraps every HTTP request a Client sends, including retries. It
+// can change the request before passing it to next, and inspect the response
+// or error that comes back.
+type Interceptor func(req *http.Request, next func(*http.Request) (*http.Response, error)) (*http.Response, error)
+
+// RequestMethod returns the NSID of the XRPC method a request is for
+func RequestMethod(req *http.Request) string {
+	return strings.TrimPrefix(req.URL.Path, "/xrpc/")
+}
+
+// roundTrip sends a single request through the client's interceptors. The
+// tracing interceptor always runs first, so that spans cover everything the
+// others do.
+func (c *Client) roundTrip(req *http.Request) (*http.Response, error) {
+	next := c.getClient().Do
+	for i := len(c.Interceptors) - 1; i >= 0; i-- {
+		next = chainInterceptor(c.Interceptors[i], next)
+	}
+
+	return tracingInterceptor(req, next)
+}
+
+func chainInterceptor(ic Interceptor, next func(*http.Request) (*http.Response, error)) func(*http.Request) (*http.Response, error) {
+	return func(req *http.Request) (*http.Response, error) {
+		return ic(req, next)
+	}
+}
+
+// tracingInterceptor creates a client span for each request, and passes the
+// trace on to the server
+func tracingInterceptor(req *http.Request, next func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	method := RequestMethod(req)
+	ctx, span := otel.Tracer("xrpc").Start(req.Context(), "xrpc."+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.RPCSystemKey.String("xrpc"),
+			semconv.RPCMethodKey.String(method),
+			semconv.HTTPMethodKey.String(req.Method),
+			attribute.String("xrpc.host", req.URL.Host),
+		),
+	)
+	defer span.End()
+
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := next(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+	if resp.StatusCode >= 400 {
+		span.SetStatus(codes.Error, fmt.Sprintf("status %d", resp.StatusCode))
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,79 @@
+package xrpc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestInterceptors(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	oldtp, oldprop := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		otel.SetTracerProvider(oldtp)
+		otel.SetTextMapPropagator(oldprop)
+	}()
+
+	var gotHeader, gotTrace string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHeader = r.Header.Get("X-Test")
+		gotTrace = r.Header.Get("traceparent")
+		json.NewEncoder(w).Encode(map[string]string{})
+	}))
+	defer srv.Close()
+
+	var order []string
+	var statuses []int
+	c := &Client{
+		Client: http.DefaultClient,
+		Host:   srv.URL,
+		Interceptors: []Interceptor{
+			func(req *http.Request, next func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+				order = append(order, "first")
+				req.Header.Set("X-Test", RequestMethod(req))
+				resp, err := next(req)
+				if err == nil {
+					statuses = append(statuses, resp.StatusCode)
+				}
+				return resp, err
+			},
+			func(req *http.Request, next func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+				order = append(order, "second")
+				if !trace.SpanFromContext(req.Context()).SpanContext().IsValid() {
+					t.Error("expected interceptors to run inside the request span")
+				}
+				return next(req)
+			},
+		},
+	}
+
+	if err := c.Do(context.Background(), Query, "", "com.example.get", map[string]any{"a": 1}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(order) != 2 || order[0] != "first" || order[1] != "second" {
+		t.Fatalf("interceptors ran out of order: %v", order)
+	}
+	if gotHeader != "com.example.get" || len(statuses) != 1 || statuses[0] != 200 {
+		t.Fatalf("interceptor did not see the request and response: %q %v", gotHeader, statuses)
+	}
+	if gotTrace == "" {
+		t.Fatal("expected trace context to be sent to the server")
+	}
+
+	spans := exp.GetSpans()
+	if len(spans) != 1 || spans[0].Name != "xrpc.com.example.get" || spans[0].SpanKind != trace.SpanKindClient {
+		t.Fatalf("unexpected spans: %v", spans)
+	}
+}
@@ -0,0 +1,40 @@
+package xrpc
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var attemptsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "xrpc_client_attempts_total",
+	Help: "The total number of xrpc requests sent, including retries, by method and response status",
+}, []string{"method", "status"})
+
+var attemptDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "xrpc_client_attempt_duration_seconds",
+	Help:    "A histogram of xrpc request latencies, per attempt",
+	Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+}, []string{"method"})
+
+var retriesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "xrpc_client_retries_total",
+	Help: "The total number of xrpc requests retried",
+}, []string{"method"})
+
+var hedgesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "xrpc_client_hedges_total",
+	Help: "The total number of hedged xrpc requests sent",
+}, []string{"method"})
+
+func observeAttempt(method string, status int, took time.Duration) {
+	label := strconv.Itoa(status)
+	if status == 0 {
+		label = "error"
+	}
+
+	attemptsCounter.WithLabelValues(method, label).Inc()
+	attemptDuration.WithLabelValues(method).Observe(took.Seconds())
+}
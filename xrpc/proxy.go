@@ -0,0 +1,73 @@
+package xrpc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/bluesky-social/indigo/did"
+)
+
+// ProxyHeader asks a PDS to forward the request to another service, named by
+// its DID and the id of the service in its DID document, such as
+// "did:web:api.bsky.app#bsky_appview"
+const ProxyHeader = "atproto-proxy"
+
+type proxyKey struct{}
+
+// WithProxy returns a context that sends requests made with it to the given
+// service, overriding the client's Proxy. An empty target sends them to the
+// client's host itself.
+func WithProxy(ctx context.Context, target string) context.Context {
+	return context.WithValue(ctx, proxyKey{}, target)
+}
+
+// ProxyTarget builds an atproto-proxy target from a service DID and the id of
+// the service in its DID document
+func ProxyTarget(serviceDid string, serviceID string) string {
+	return serviceDid + "#" + strings.TrimPrefix(serviceID, "#")
+}
+
+func (c *Client) proxyFor(ctx context.Context) string {
+	if target, ok := ctx.Value(proxyKey{}).(string); ok {
+		return target
+	}
+	return c.Proxy
+}
+
+// ServiceEndpoint returns the endpoint of the service with the given id, with
+// or without the leading '#', in a DID document
+func ServiceEndpoint(doc *did.Document, serviceID string) (string, error) {
+	want := "#" + strings.TrimPrefix(serviceID, "#")
+	for _, svc := range doc.Service {
+		id := svc.ID.String()
+		if i := strings.Index(id, "#"); i >= 0 {
+			id = id[i:]
+		}
+
+		if id == want {
+			if svc.ServiceEndpoint == "" {
+				return "", fmt.Errorf("service %q has no endpoint", serviceID)
+			}
+			return svc.ServiceEndpoint, nil
+		}
+	}
+
+	return "", fmt.Errorf("no service %q in DID document for %s", serviceID, doc.ID.String())
+}
+
+// ResolveProxyTarget checks that an atproto-proxy target names a service in
+// its DID document, and returns the service's endpoint
+func ResolveProxyTarget(ctx context.Context, res did.Resolver, target string) (string, error) {
+	sdid, serviceID, ok := strings.Cut(target, "#")
+	if !ok || sdid == "" || serviceID == "" {
+		return "", fmt.Errorf("proxy target %q must be a DID and service id, like did:web:example.com#service", target)
+	}
+
+	doc, err := res.GetDocument(ctx, sdid)
+	if err != nil {
+		return "", fmt.Errorf("resolving proxy service DID: %w", err)
+	}
+
+	return ServiceEndpoint(doc, serviceID)
+}
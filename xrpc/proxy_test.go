@@ -0,0 +1,88 @@
+package xrpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bluesky-social/indigo/did"
+)
+
+type testResolver map[string]*did.Document
+
+func (tr testResolver) GetDocument(ctx context.Context, didstr string) (*did.Document, error) {
+	doc, ok := tr[didstr]
+	if !ok {
+		return nil, fmt.Errorf("no such did")
+	}
+	return doc, nil
+}
+
+func TestProxyHeader(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get(ProxyHeader))
+		json.NewEncoder(w).Encode(map[string]string{})
+	}))
+	defer srv.Close()
+
+	c := &Client{
+		Client: http.DefaultClient,
+		Host:   srv.URL,
+		Proxy:  ProxyTarget("did:web:api.example.com", "#example_appview"),
+	}
+
+	ctx := context.Background()
+	for _, rctx := range []context.Context{
+		ctx,
+		WithProxy(ctx, "did:web:labeler.example.com#atproto_labeler"),
+		WithProxy(ctx, ""),
+	} {
+		if err := c.Do(rctx, Query, "", "com.example.get", nil, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []string{"did:web:api.example.com#example_appview", "did:web:labeler.example.com#atproto_labeler", ""}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("expected proxy headers %q, got %q", expected, got)
+	}
+}
+
+func TestResolveProxyTarget(t *testing.T) {
+	var doc did.Document
+	if err := json.Unmarshal([]byte(`{
+		"id": "did:web:api.example.com",
+		"service": [
+			{"id": "#atproto_labeler", "type": "AtprotoLabeler", "serviceEndpoint": "https://labels.example.com"},
+			{"id": "did:web:api.example.com#example_appview", "type": "ExampleAppView", "serviceEndpoint": "https://api.example.com"}
+		]
+	}`), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	res := testResolver{"did:web:api.example.com": &doc}
+	ctx := context.Background()
+
+	for target, expected := range map[string]string{
+		"did:web:api.example.com#atproto_labeler": "https://labels.example.com",
+		"did:web:api.example.com#example_appview": "https://api.example.com",
+	} {
+		ep, err := ResolveProxyTarget(ctx, res, target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ep != expected {
+			t.Fatalf("expected %s for %s, got %s", expected, target, ep)
+		}
+	}
+
+	for _, target := range []string{"did:web:api.example.com", "did:web:api.example.com#missing", "did:web:other.example.com#atproto_labeler"} {
+		if _, err := ResolveProxyTarget(ctx, res, target); err == nil {
+			t.Fatalf("expected %q to fail", target)
+		}
+	}
+}
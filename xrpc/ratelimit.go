@@ -0,0 +1,153 @@
+package xrpc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RateLimit is the rate limit a server reported in the RateLimit-* headers
+// of its last response
+type RateLimit struct {
+	Limit     int
+	Remaining int
+	Reset     time.Time
+	Policy    string
+}
+
+// maxRateLimitWaits bounds how many times a request rejected with a 429 is
+// retried in WaitForRateLimit mode
+const maxRateLimitWaits = 3
+
+// RateLimit returns the most recent rate limit reported by the server, or
+// nil if it hasn't reported one
+func (c *Client) RateLimit() *RateLimit {
+	c.rlk.Lock()
+	defer c.rlk.Unlock()
+
+	if c.rateLimit == nil {
+		return nil
+	}
+
+	rl := *c.rateLimit
+	return &rl
+}
+
+// parseRateLimit reads the rate limit headers of a response. RateLimit-Reset
+// is usually a unix timestamp, but is treated as a number of seconds from
+// now when it is too small to be one, as in the IETF draft.
+func parseRateLimit(resp *http.Response, now time.Time) *RateLimit {
+	h := resp.Header
+
+	var rl *RateLimit
+	if lim, err := strconv.Atoi(h.Get("RateLimit-Limit")); err == nil {
+		rl = &RateLimit{
+			Limit:     lim,
+			Remaining: lim,
+			Policy:    h.Get("RateLimit-Policy"),
+		}
+
+		if rem, err := strconv.Atoi(h.Get("RateLimit-Remaining")); err == nil {
+			rl.Remaining = rem
+		}
+
+		if reset, err := strconv.ParseInt(h.Get("RateLimit-Reset"), 10, 64); err == nil {
+			if reset > 1_000_000_000 {
+				rl.Reset = time.Unix(reset, 0)
+			} else {
+				rl.Reset = now.Add(time.Duration(reset) * time.Second)
+			}
+		}
+	}
+
+	if resp.StatusCode != http.StatusTooManyRequests {
+		return rl
+	}
+
+	// whatever the headers say, we are out of requests for now
+	if rl == nil {
+		rl = &RateLimit{}
+	}
+	rl.Remaining = 0
+
+	if ra, err := strconv.Atoi(h.Get("Retry-After")); err == nil {
+		rl.Reset = now.Add(time.Duration(ra) * time.Second)
+	} else if ra, err := http.ParseTime(h.Get("Retry-After")); err == nil {
+		rl.Reset = ra
+	}
+
+	return rl
+}
+
+func (c *Client) recordRateLimit(resp *http.Response) {
+	rl := parseRateLimit(resp, time.Now())
+	if rl == nil {
+		return
+	}
+
+	c.rlk.Lock()
+	defer c.rlk.Unlock()
+	c.rateLimit = rl
+}
+
+// waitForRateLimit blocks until the server's last reported rate limit resets,
+// if it has been used up
+func (c *Client) waitForRateLimit(ctx context.Context) error {
+	rl := c.RateLimit()
+	if rl == nil || rl.Remaining > 0 {
+		return nil
+	}
+
+	wait := time.Until(rl.Reset)
+	if wait <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// withRateLimit wraps attempt so that, in WaitForRateLimit mode, it holds off
+// until the rate limit resets and retries requests that were rejected for
+// going over it. Rejected requests were never processed, so this is safe for
+// procedures too.
+func (c *Client) withRateLimit(ctx context.Context, attempt func() (int, error)) func() (int, error) {
+	if !c.WaitForRateLimit {
+		return attempt
+	}
+
+	return func() (int, error) {
+		if err := c.waitForRateLimit(ctx); err != nil {
+			return 0, err
+		}
+
+		status, err := attempt()
+		for i := 0; i < maxRateLimitWaits && status == http.StatusTooManyRequests; i++ {
+			if rl := c.RateLimit(); rl == nil || rl.Reset.IsZero() {
+				// no idea when to try again
+				break
+			}
+
+			if werr := c.waitForRateLimit(ctx); werr != nil {
+				return status, err
+			}
+
+			nstatus, nerr := attempt()
+			if errors.Is(nerr, errBodyNotReplayable) {
+				return status, err
+			}
+			status, err = nstatus, nerr
+		}
+
+		return status, err
+	}
+}
@@ -0,0 +1,92 @@
+package xrpc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	resp := &http.Response{StatusCode: 200, Header: http.Header{}}
+	resp.Header.Set("RateLimit-Limit", "100")
+	resp.Header.Set("RateLimit-Remaining", "42")
+	resp.Header.Set("RateLimit-Reset", "1700000300")
+	resp.Header.Set("RateLimit-Policy", "100;w=300")
+
+	rl := parseRateLimit(resp, now)
+	if rl == nil || rl.Limit != 100 || rl.Remaining != 42 || rl.Policy != "100;w=300" || !rl.Reset.Equal(now.Add(5*time.Minute)) {
+		t.Fatalf("unexpected rate limit: %+v", rl)
+	}
+
+	resp.Header.Set("RateLimit-Reset", "30")
+	if rl := parseRateLimit(resp, now); !rl.Reset.Equal(now.Add(30 * time.Second)) {
+		t.Fatalf("expected a relative reset, got %s", rl.Reset)
+	}
+
+	resp = &http.Response{StatusCode: 429, Header: http.Header{}}
+	resp.Header.Set("Retry-After", "10")
+	if rl := parseRateLimit(resp, now); rl.Remaining != 0 || !rl.Reset.Equal(now.Add(10*time.Second)) {
+		t.Fatalf("unexpected rate limit for a 429: %+v", rl)
+	}
+
+	if rl := parseRateLimit(&http.Response{StatusCode: 200, Header: http.Header{}}, now); rl != nil {
+		t.Fatalf("expected no rate limit, got %+v", rl)
+	}
+}
+
+func TestWaitForRateLimit(t *testing.T) {
+	var calls int32
+	var resetAt atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		w.Header().Set("RateLimit-Limit", "2")
+		if n == 1 {
+			// pretend the budget is already spent, resetting very soon
+			reset := time.Now().Add(time.Second)
+			resetAt.Store(reset.UnixNano())
+			w.Header().Set("RateLimit-Remaining", "0")
+			w.Header().Set("RateLimit-Reset", strconv.FormatInt(reset.Unix()+1, 10))
+			json.NewEncoder(w).Encode(map[string]string{})
+			return
+		}
+
+		if time.Now().UnixNano() < resetAt.Load() {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(429)
+			json.NewEncoder(w).Encode(&XRPCError{ErrStr: "RateLimitExceeded", Message: "slow down"})
+			return
+		}
+
+		w.Header().Set("RateLimit-Remaining", "1")
+		json.NewEncoder(w).Encode(map[string]string{})
+	}))
+	defer srv.Close()
+
+	c := &Client{
+		Client:           http.DefaultClient,
+		Host:             srv.URL,
+		WaitForRateLimit: true,
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := c.Do(ctx, Procedure, "application/json", "com.example.set", nil, map[string]string{}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("expected the second request to wait rather than be rejected, got %d calls", n)
+	}
+
+	if rl := c.RateLimit(); rl == nil || rl.Remaining != 1 {
+		t.Fatalf("unexpected rate limit after waiting: %+v", rl)
+	}
+}
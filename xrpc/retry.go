@@ -0,0 +1,199 @@
+package xrpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy controls how a Client retries failed requests. Requests are
+// retried on network errors, timeouts and 5xx responses. Only queries are
+// retried unless RetryProcedures is set, as procedures are generally not
+// safe to repeat.
+type RetryPolicy struct {
+	// MaxAttempts is the most times a request is sent, including the first
+	MaxAttempts int
+
+	// MinBackoff and MaxBackoff bound the wait between attempts, which
+	// doubles after every attempt and is jittered
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// RetryProcedures allows procedures to be retried. Only set this if the
+	// procedures being called are idempotent.
+	RetryProcedures bool
+
+	// HedgeAfter, if set, sends a second copy of a query that hasn't been
+	// answered after this long, and uses whichever response comes first
+	HedgeAfter time.Duration
+}
+
+// DefaultRetryPolicy returns a policy suitable for most clients
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts: 4,
+		MinBackoff:  250 * time.Millisecond,
+		MaxBackoff:  10 * time.Second,
+	}
+}
+
+// errBodyNotReplayable is returned by an attempt when the request body was
+// an io.Reader that has already been consumed
+var errBodyNotReplayable = errors.New("request body cannot be resent")
+
+func (rp *RetryPolicy) backoff(attempt int) time.Duration {
+	d := rp.MinBackoff
+	for i := 1; i < attempt && d < rp.MaxBackoff; i++ {
+		d *= 2
+	}
+	if rp.MaxBackoff > 0 && d > rp.MaxBackoff {
+		d = rp.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+
+	// wait somewhere between half and all of the backoff, so that clients
+	// that failed together don't all retry together
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func isRetryable(ctx context.Context, status int, err error) bool {
+	if err == nil || ctx.Err() != nil || errors.Is(err, errBodyNotReplayable) {
+		return false
+	}
+
+	// no status means the request never got a response
+	if status == 0 {
+		return true
+	}
+
+	return status >= 500 && status != http.StatusNotImplemented
+}
+
+// withRetries runs attempt until it succeeds, fails in a way that isn't
+// worth retrying, or the policy runs out of attempts
+func (c *Client) withRetries(ctx context.Context, kind XRPCRequestType, method string, attempt func() (int, error)) (int, error) {
+	rp := c.Retry
+	if rp == nil || rp.MaxAttempts <= 1 || (kind == Procedure && !rp.RetryProcedures) {
+		return attempt()
+	}
+
+	status, err := attempt()
+	for i := 1; i < rp.MaxAttempts && isRetryable(ctx, status, err); i++ {
+		t := time.NewTimer(rp.backoff(i))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return status, err
+		case <-t.C:
+		}
+
+		retriesCounter.WithLabelValues(method).Inc()
+
+		nstatus, nerr := attempt()
+		if errors.Is(nerr, errBodyNotReplayable) {
+			return status, err
+		}
+		status, err = nstatus, nerr
+	}
+
+	return status, err
+}
+
+// send sends the request, hedging it if the policy asks for that
+func (c *Client) send(ctx context.Context, method string, req *http.Request) (*http.Response, error) {
+	if c.Retry == nil || c.Retry.HedgeAfter <= 0 || req.Method != "GET" {
+		return c.roundTrip(req.WithContext(ctx))
+	}
+
+	return c.sendHedged(ctx, method, req, c.Retry.HedgeAfter)
+}
+
+type hedgeResult struct {
+	id   int
+	resp *http.Response
+	err  error
+}
+
+// sendHedged sends req, and a second copy of it if there is no response
+// after delay. The first successful response wins, and the other request is
+// cancelled.
+func (c *Client) sendHedged(ctx context.Context, method string, req *http.Request, delay time.Duration) (*http.Response, error) {
+	results := make(chan hedgeResult, 2)
+	var cancels []context.CancelFunc
+
+	start := func() {
+		actx, cancel := context.WithCancel(ctx)
+		id := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			resp, err := c.roundTrip(req.Clone(actx))
+			results <- hedgeResult{id: id, resp: resp, err: err}
+		}()
+	}
+
+	start()
+	pending := 1
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	hedge := t.C
+
+	var res hedgeResult
+	for {
+		select {
+		case <-hedge:
+			hedgesCounter.WithLabelValues(method).Inc()
+			hedge = nil
+			start()
+			pending++
+			continue
+		case res = <-results:
+			pending--
+		}
+
+		// a failure only counts once the other request has failed too
+		if res.err == nil || pending == 0 {
+			break
+		}
+	}
+
+	for id, cancel := range cancels {
+		if id != res.id || res.err != nil {
+			cancel()
+		}
+	}
+
+	// the request that lost might still have a response to clean up
+	if pending > 0 {
+		go func() {
+			if lost := <-results; lost.resp != nil {
+				lost.resp.Body.Close()
+			}
+		}()
+	}
+
+	if res.err != nil {
+		return nil, res.err
+	}
+
+	res.resp.Body = &cancelOnClose{ReadCloser: res.resp.Body, cancel: cancels[res.id]}
+	return res.resp, nil
+}
+
+// cancelOnClose cancels the context of a hedged request once its response
+// has been read
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (cc *cancelOnClose) Close() error {
+	err := cc.ReadCloser.Close()
+	cc.cancel()
+	return err
+}
@@ -0,0 +1,92 @@
+package xrpc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetries(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1)%3 != 0 {
+			w.WriteHeader(503)
+			json.NewEncoder(w).Encode(&XRPCError{ErrStr: "Unavailable", Message: "try again"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"ok": "yes"})
+	}))
+	defer srv.Close()
+
+	c := &Client{
+		Client: http.DefaultClient,
+		Host:   srv.URL,
+		Retry: &RetryPolicy{
+			MaxAttempts: 3,
+			MinBackoff:  time.Millisecond,
+			MaxBackoff:  5 * time.Millisecond,
+		},
+	}
+
+	ctx := context.Background()
+
+	var out map[string]string
+	if err := c.Do(ctx, Query, "", "com.example.get", nil, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out["ok"] != "yes" || atomic.LoadInt32(&calls) != 3 {
+		t.Fatalf("expected success on the third attempt, got %v after %d", out, calls)
+	}
+
+	// procedures aren't retried unless asked for
+	if err := c.Do(ctx, Procedure, "application/json", "com.example.set", nil, map[string]string{"a": "b"}, nil); err == nil {
+		t.Fatal("expected procedure to fail without retries")
+	}
+	if n := atomic.LoadInt32(&calls); n != 4 {
+		t.Fatalf("expected a single attempt for the procedure, got %d", n-3)
+	}
+
+	c.Retry.RetryProcedures = true
+	if err := c.Do(ctx, Procedure, "application/json", "com.example.set", nil, map[string]string{"a": "b"}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHedging(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(5 * time.Second):
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]string{"ok": "yes"})
+	}))
+	defer srv.Close()
+
+	c := &Client{
+		Client: http.DefaultClient,
+		Host:   srv.URL,
+		Retry: &RetryPolicy{
+			HedgeAfter: 20 * time.Millisecond,
+		},
+	}
+
+	start := time.Now()
+	var out map[string]string
+	if err := c.Do(context.Background(), Query, "", "com.example.get", nil, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out["ok"] != "yes" {
+		t.Fatalf("unexpected response: %v", out)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatal("hedged request did not win")
+	}
+}
@@ -5,11 +5,14 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/bluesky-social/indigo/util"
 	"github.com/bluesky-social/indigo/util/version"
@@ -22,6 +25,28 @@ type Client struct {
 	Host       string
 	UserAgent  *string
 	Headers    map[string]string
+
+	// Proxy, if set, is the atproto-proxy target for requests, see WithProxy
+	// to change it for a single request
+	Proxy string
+
+	// Interceptors are run, in order, around every HTTP request the client
+	// sends. Requests are always traced with OpenTelemetry as well.
+	Interceptors []Interceptor
+
+	// Retry, if set, controls retrying of failed requests
+	Retry *RetryPolicy
+
+	// AuthManager, if set, holds the session used for requests in place of
+	// Auth, and refreshes it when the access token expires
+	AuthManager *AuthManager
+
+	// WaitForRateLimit delays requests while the server's rate limit is used
+	// up, instead of sending requests that will be rejected
+	WaitForRateLimit bool
+
+	rlk       sync.Mutex
+	rateLimit *RateLimit
 }
 
 func (c *Client) getClient() *http.Client {
@@ -71,17 +96,40 @@ func makeParams(p map[string]any) string {
 }
 
 func (c *Client) Do(ctx context.Context, kind XRPCRequestType, inpenc string, method string, params map[string]interface{}, bodyobj interface{}, out interface{}) error {
-	var body io.Reader
+	// getBody returns the request body, and is called again if the request
+	// has to be retried. It returns nil if the body can't be sent twice.
+	var getBody func() (io.Reader, error)
 	if bodyobj != nil {
-		if rr, ok := bodyobj.(io.Reader); ok {
-			body = rr
-		} else {
-			b, err := json.Marshal(bodyobj)
+		switch b := bodyobj.(type) {
+		case io.ReadSeeker:
+			start, err := b.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return err
+			}
+			getBody = func() (io.Reader, error) {
+				if _, err := b.Seek(start, io.SeekStart); err != nil {
+					return nil, err
+				}
+				return b, nil
+			}
+		case io.Reader:
+			used := false
+			getBody = func() (io.Reader, error) {
+				if used {
+					return nil, nil
+				}
+				used = true
+				return b, nil
+			}
+		default:
+			buf, err := json.Marshal(bodyobj)
 			if err != nil {
 				return err
 			}
 
-			body = bytes.NewReader(b)
+			getBody = func() (io.Reader, error) {
+				return bytes.NewReader(buf), nil
+			}
 		}
 	}
 
@@ -100,12 +148,85 @@ func (c *Client) Do(ctx context.Context, kind XRPCRequestType, inpenc string, me
 		paramStr = "?" + makeParams(params)
 	}
 
-	req, err := http.NewRequest(m, c.Host+"/xrpc/"+method+paramStr, body)
-	if err != nil {
+	var token string
+	if c.AuthManager != nil {
+		token = c.AuthManager.accessToken()
+	} else if c.Auth != nil {
+		token = c.Auth.AccessJwt
+	}
+
+	attempt := func(token string) func() (int, error) {
+		return func() (int, error) {
+			var body io.Reader
+			if getBody != nil {
+				b, err := getBody()
+				if err != nil {
+					return 0, err
+				}
+				if b == nil {
+					return 0, errBodyNotReplayable
+				}
+				body = b
+			}
+
+			return c.doRequest(ctx, m, inpenc, method, method+paramStr, body, c.authHeader(method, token), out)
+		}
+	}
+
+	status, err := c.withRetries(ctx, kind, method, c.withRateLimit(ctx, attempt(token)))
+	if err == nil || c.AuthManager == nil || c.usesAdminAuth(method) || !isExpiredToken(status, err) {
 		return err
 	}
 
-	if bodyobj != nil && inpenc != "" {
+	if err := c.AuthManager.refresh(ctx, c, token); err != nil {
+		return fmt.Errorf("refreshing expired session: %w", err)
+	}
+
+	_, rerr := c.withRetries(ctx, kind, method, c.withRateLimit(ctx, attempt(c.AuthManager.accessToken())))
+	if errors.Is(rerr, errBodyNotReplayable) {
+		// can't resend the body, so the caller will have to retry
+		return err
+	}
+	return rerr
+}
+
+// usesAdminAuth reports whether requests for method are made with the admin
+// token, if there is one
+func (c *Client) usesAdminAuth(method string) bool {
+	return c.AdminToken != nil && (strings.HasPrefix(method, "com.atproto.admin.") || method == "com.atproto.account.createInviteCode" || method == "com.atproto.server.createInviteCodes")
+}
+
+// authHeader returns the Authorization header for a request for method, using
+// the access token for anything that doesn't need admin auth
+func (c *Client) authHeader(method string, token string) string {
+	// use admin auth if we have it configured and are doing a request that requires it
+	if c.usesAdminAuth(method) {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:"+*c.AdminToken))
+	}
+	if token != "" {
+		return "Bearer " + token
+	}
+	return ""
+}
+
+// doRequest sends a single request and decodes the response into out. The
+// status code is returned with any error from the server.
+func (c *Client) doRequest(ctx context.Context, m string, inpenc string, method string, path string, body io.Reader, authz string, out interface{}) (status int, err error) {
+	start := time.Now()
+	defer func() {
+		observeAttempt(method, status, time.Since(start))
+	}()
+
+	req, err := http.NewRequest(m, c.Host+"/xrpc/"+path, body)
+	if err != nil {
+		return 0, err
+	}
+
+	if ub, ok := body.(*uploadBody); ok && ub.size >= 0 {
+		req.ContentLength = ub.size
+	}
+
+	if body != nil && inpenc != "" {
 		req.Header.Set("Content-Type", inpenc)
 	}
 	if c.UserAgent != nil {
@@ -120,26 +241,29 @@ func (c *Client) Do(ctx context.Context, kind XRPCRequestType, inpenc string, me
 		}
 	}
 
-	// use admin auth if we have it configured and are doing a request that requires it
-	if c.AdminToken != nil && (strings.HasPrefix(method, "com.atproto.admin.") || method == "com.atproto.account.createInviteCode" || method == "com.atproto.server.createInviteCodes") {
-		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("admin:"+*c.AdminToken)))
-	} else if c.Auth != nil {
-		req.Header.Set("Authorization", "Bearer "+c.Auth.AccessJwt)
+	if authz != "" {
+		req.Header.Set("Authorization", authz)
+	}
+
+	if proxy := c.proxyFor(ctx); proxy != "" {
+		req.Header.Set(ProxyHeader, proxy)
 	}
 
-	resp, err := c.getClient().Do(req.WithContext(ctx))
+	resp, err := c.send(ctx, method, req)
 	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
+		return 0, fmt.Errorf("request failed: %w", err)
 	}
 
 	defer resp.Body.Close()
 
+	c.recordRateLimit(resp)
+
 	if resp.StatusCode != 200 {
 		var xe XRPCError
 		if err := json.NewDecoder(resp.Body).Decode(&xe); err != nil {
-			return fmt.Errorf("failed to decode xrpc error message (status: %d): %w", resp.StatusCode, err)
+			return resp.StatusCode, fmt.Errorf("failed to decode xrpc error message (status: %d): %w", resp.StatusCode, err)
 		}
-		return fmt.Errorf("XRPC ERROR %d: %w", resp.StatusCode, &xe)
+		return resp.StatusCode, fmt.Errorf("XRPC ERROR %d: %w", resp.StatusCode, &xe)
 	}
 
 	if out != nil {
@@ -147,20 +271,24 @@ func (c *Client) Do(ctx context.Context, kind XRPCRequestType, inpenc string, me
 			if resp.ContentLength < 0 {
 				_, err := io.Copy(buf, resp.Body)
 				if err != nil {
-					return fmt.Errorf("reading response body: %w", err)
+					return resp.StatusCode, fmt.Errorf("reading response body: %w", err)
 				}
 			} else {
 				n, err := io.CopyN(buf, resp.Body, resp.ContentLength)
 				if err != nil {
-					return fmt.Errorf("reading length delimited response body (%d < %d): %w", n, resp.ContentLength, err)
+					return resp.StatusCode, fmt.Errorf("reading length delimited response body (%d < %d): %w", n, resp.ContentLength, err)
 				}
 			}
+		} else if dw, ok := out.(*downloadWriter); ok {
+			if err := dw.readFrom(resp); err != nil {
+				return resp.StatusCode, err
+			}
 		} else {
 			if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
-				return fmt.Errorf("decoding xrpc response: %w", err)
+				return resp.StatusCode, fmt.Errorf("decoding xrpc response: %w", err)
 			}
 		}
 	}
 
-	return nil
+	return resp.StatusCode, nil
 }
@@ -0,0 +1,241 @@
+// Package xrpctest provides an in-memory XRPC server for testing code that
+// talks to a PDS or other atproto service, without running one.
+package xrpctest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+// Request is an XRPC call received by the server
+type Request struct {
+	Method string // the NSID of the call
+	Params url.Values
+	Header http.Header
+	Body   []byte
+}
+
+// DecodeBody decodes the JSON body of a procedure call into out
+func (r *Request) DecodeBody(out any) error {
+	return json.Unmarshal(r.Body, out)
+}
+
+// HandlerFunc answers a call. The result is sent as JSON, unless it is a
+// []byte or io.Reader, which are sent as they are. Returning an *Error sets
+// the status and XRPC error name of the response; any other error is sent as
+// a 500.
+type HandlerFunc func(ctx context.Context, req *Request) (any, error)
+
+// Error is an XRPC error response
+type Error struct {
+	Status  int
+	Name    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Name, e.Message)
+}
+
+type fault struct {
+	latency time.Duration
+	err     *Error
+	count   int // how many calls the error applies to, or -1 for all
+}
+
+// Server is an XRPC server whose methods are registered by tests. Calls to
+// unregistered methods fail with MethodNotImplemented.
+type Server struct {
+	srv *httptest.Server
+
+	lk       sync.Mutex
+	handlers map[string]HandlerFunc
+	faults   map[string]*fault
+	calls    []*Request
+}
+
+// NewServer starts a server. Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		handlers: make(map[string]HandlerFunc),
+		faults:   make(map[string]*fault),
+	}
+	s.srv = httptest.NewServer(s)
+	return s
+}
+
+// Close shuts the server down
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// URL is the base URL of the server, to use as an xrpc.Client Host
+func (s *Server) URL() string {
+	return s.srv.URL
+}
+
+// Client returns a client for the server
+func (s *Server) Client() *xrpc.Client {
+	return &xrpc.Client{
+		Client: s.srv.Client(),
+		Host:   s.srv.URL,
+	}
+}
+
+// Handle registers the handler for a method, replacing any existing one
+func (s *Server) Handle(method string, h HandlerFunc) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.handlers[method] = h
+}
+
+// Respond makes every call to method return out, which is usually one of the
+// generated lexicon output types
+func (s *Server) Respond(method string, out any) {
+	s.Handle(method, func(ctx context.Context, req *Request) (any, error) {
+		return out, nil
+	})
+}
+
+// SetLatency delays every response for method by d
+func (s *Server) SetLatency(method string, d time.Duration) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.getFault(method).latency = d
+}
+
+// Fail makes the next count calls to method fail with the given status and
+// XRPC error, or all of them if count is negative
+func (s *Server) Fail(method string, count int, status int, name string, msg string) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	f := s.getFault(method)
+	f.err = &Error{Status: status, Name: name, Message: msg}
+	f.count = count
+}
+
+// ClearFaults removes all injected latency and errors
+func (s *Server) ClearFaults() {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.faults = make(map[string]*fault)
+}
+
+func (s *Server) getFault(method string) *fault {
+	f, ok := s.faults[method]
+	if !ok {
+		f = &fault{}
+		s.faults[method] = f
+	}
+	return f
+}
+
+// Calls returns the calls made to method so far, or all calls if method is
+// empty
+func (s *Server) Calls(method string) []*Request {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	var out []*Request
+	for _, c := range s.calls {
+		if method == "" || c.Method == method {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	method, ok := strings.CutPrefix(r.URL.Path, "/xrpc/")
+	if !ok {
+		writeError(w, &Error{Status: 404, Name: "NotFound", Message: "not an xrpc path"})
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, &Error{Status: 400, Name: "InvalidRequest", Message: err.Error()})
+		return
+	}
+
+	req := &Request{
+		Method: method,
+		Params: r.URL.Query(),
+		Header: r.Header.Clone(),
+		Body:   body,
+	}
+
+	s.lk.Lock()
+	s.calls = append(s.calls, req)
+	h := s.handlers[method]
+	var latency time.Duration
+	var ferr *Error
+	if f, ok := s.faults[method]; ok {
+		latency = f.latency
+		if f.err != nil && f.count != 0 {
+			ferr = f.err
+			if f.count > 0 {
+				f.count--
+			}
+		}
+	}
+	s.lk.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if ferr != nil {
+		writeError(w, ferr)
+		return
+	}
+
+	if h == nil {
+		writeError(w, &Error{Status: 501, Name: "MethodNotImplemented", Message: "no handler registered for " + method})
+		return
+	}
+
+	out, err := h(r.Context(), req)
+	if err != nil {
+		xe, ok := err.(*Error)
+		if !ok {
+			xe = &Error{Status: 500, Name: "InternalServerError", Message: err.Error()}
+		}
+		writeError(w, xe)
+		return
+	}
+
+	switch out := out.(type) {
+	case nil:
+		w.WriteHeader(200)
+	case []byte:
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(out)
+	case io.Reader:
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.Copy(w, out)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
+
+func writeError(w http.ResponseWriter, e *Error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(&xrpc.XRPCError{ErrStr: e.Name, Message: e.Message})
+}
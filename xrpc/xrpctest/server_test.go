@@ -0,0 +1,96 @@
+package xrpctest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+func TestServer(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	c := s.Client()
+	ctx := context.Background()
+
+	s.Respond("com.atproto.server.describeServer", &comatproto.ServerDescribeServer_Output{
+		AvailableUserDomains: []string{".test"},
+	})
+
+	s.Handle("com.atproto.repo.createRecord", func(ctx context.Context, req *Request) (any, error) {
+		var in comatproto.RepoCreateRecord_Input
+		if err := req.DecodeBody(&in); err != nil {
+			return nil, err
+		}
+		if in.Repo != "did:plc:foo" {
+			return nil, &Error{Status: 400, Name: "InvalidRequest", Message: "unknown repo"}
+		}
+		return &comatproto.RepoCreateRecord_Output{Uri: "at://did:plc:foo/" + in.Collection + "/1", Cid: "bafy"}, nil
+	})
+
+	out, err := comatproto.ServerDescribeServer(ctx, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.AvailableUserDomains) != 1 || out.AvailableUserDomains[0] != ".test" {
+		t.Fatalf("unexpected response: %+v", out)
+	}
+
+	cr, err := comatproto.RepoCreateRecord(ctx, c, &comatproto.RepoCreateRecord_Input{Repo: "did:plc:foo", Collection: "com.example.thing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr.Uri != "at://did:plc:foo/com.example.thing/1" {
+		t.Fatalf("unexpected uri: %s", cr.Uri)
+	}
+
+	var xe *xrpc.XRPCError
+	if _, err := comatproto.RepoCreateRecord(ctx, c, &comatproto.RepoCreateRecord_Input{Repo: "did:plc:bar"}); !errors.As(err, &xe) || xe.ErrStr != "InvalidRequest" {
+		t.Fatalf("expected handler error to be passed on, got %v", err)
+	}
+
+	if _, err := comatproto.ServerGetSession(ctx, c); !errors.As(err, &xe) || xe.ErrStr != "MethodNotImplemented" {
+		t.Fatalf("expected unregistered method to fail, got %v", err)
+	}
+
+	if calls := s.Calls("com.atproto.repo.createRecord"); len(calls) != 2 {
+		t.Fatalf("expected two recorded calls, got %d", len(calls))
+	}
+	if calls := s.Calls(""); len(calls) != 4 {
+		t.Fatalf("expected four recorded calls, got %d", len(calls))
+	}
+}
+
+func TestFaults(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	c := s.Client()
+	ctx := context.Background()
+
+	s.Respond("com.atproto.server.describeServer", &comatproto.ServerDescribeServer_Output{})
+	s.Fail("com.atproto.server.describeServer", 1, 503, "Unavailable", "down for maintenance")
+
+	if _, err := comatproto.ServerDescribeServer(ctx, c); err == nil {
+		t.Fatal("expected injected failure")
+	}
+	if _, err := comatproto.ServerDescribeServer(ctx, c); err != nil {
+		t.Fatalf("expected failure to only apply once: %s", err)
+	}
+
+	s.SetLatency("com.atproto.server.describeServer", time.Second)
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := comatproto.ServerDescribeServer(tctx, c); err == nil {
+		t.Fatal("expected slow call to time out")
+	}
+
+	s.ClearFaults()
+	if _, err := comatproto.ServerDescribeServer(ctx, c); err != nil {
+		t.Fatal(err)
+	}
+}